@@ -0,0 +1 @@
+package fstestutil // import "github.com/keybase/kbfs/bazilfuse/fs/fstestutil"
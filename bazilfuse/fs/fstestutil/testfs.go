@@ -3,8 +3,8 @@ package fstestutil
 import (
 	"os"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fs"
 	"golang.org/x/net/context"
 )
 
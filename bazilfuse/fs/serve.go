@@ -1,6 +1,6 @@
 // FUSE service loop, for servers that wish to use it.
 
-package fs // import "bazil.org/fuse/fs"
+package fs // import "github.com/keybase/kbfs/bazilfuse/fs"
 
 import (
 	"encoding/binary"
@@ -20,8 +20,8 @@ import (
 import (
 	"bytes"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fuseutil"
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fuseutil"
 )
 
 const (
@@ -282,6 +282,29 @@ type HandleFlusher interface {
 	Flush(ctx context.Context, req *fuse.FlushRequest) error
 }
 
+// HandleLocker is implemented by handles that take byte range
+// locks on their files.  The kernel only sends lock requests when
+// the file system is mounted with fuse.LockingPOSIX or
+// fuse.LockingFlock.
+type HandleLocker interface {
+	// Lock takes a lock, or returns fuse.Errno(syscall.EAGAIN) if
+	// it's held in a conflicting way.
+	Lock(ctx context.Context, req *fuse.LockRequest) error
+
+	// LockWait takes a lock, waiting for it to become available.
+	// It should return fuse.EINTR if ctx is canceled while it
+	// waits.
+	LockWait(ctx context.Context, req *fuse.LockWaitRequest) error
+
+	// Unlock releases the owner's locks on a range.
+	Unlock(ctx context.Context, req *fuse.UnlockRequest) error
+
+	// QueryLock sets resp.Lock to a lock that conflicts with
+	// req.Lock, or sets its Type to fuse.LockUnlock if there is
+	// none.
+	QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error
+}
+
 type HandleReadAller interface {
 	ReadAll(ctx context.Context) ([]byte, error)
 }
@@ -1287,6 +1310,73 @@ func (c *Server) handleRequest(ctx context.Context, node Node, snode *serveNode,
 		r.Respond()
 		return nil
 
+	case *fuse.LockRequest:
+		shandle := c.getHandle(r.Handle)
+		if shandle == nil {
+			return fuse.ESTALE
+		}
+		h, ok := shandle.handle.(HandleLocker)
+		if !ok {
+			return fuse.ENOSYS
+		}
+		if err := h.Lock(ctx, r); err != nil {
+			return err
+		}
+		done(nil)
+		r.Respond()
+		return nil
+
+	case *fuse.LockWaitRequest:
+		shandle := c.getHandle(r.Handle)
+		if shandle == nil {
+			return fuse.ESTALE
+		}
+		h, ok := shandle.handle.(HandleLocker)
+		if !ok {
+			return fuse.ENOSYS
+		}
+		if err := h.LockWait(ctx, r); err != nil {
+			return err
+		}
+		done(nil)
+		r.Respond()
+		return nil
+
+	case *fuse.UnlockRequest:
+		shandle := c.getHandle(r.Handle)
+		if shandle == nil {
+			return fuse.ESTALE
+		}
+		h, ok := shandle.handle.(HandleLocker)
+		if !ok {
+			return fuse.ENOSYS
+		}
+		if err := h.Unlock(ctx, r); err != nil {
+			return err
+		}
+		done(nil)
+		r.Respond()
+		return nil
+
+	case *fuse.QueryLockRequest:
+		shandle := c.getHandle(r.Handle)
+		if shandle == nil {
+			return fuse.ESTALE
+		}
+		h, ok := shandle.handle.(HandleLocker)
+		if !ok {
+			return fuse.ENOSYS
+		}
+		s := &fuse.QueryLockResponse{
+			Lock: fuse.FileLock{Type: fuse.LockUnlock},
+		}
+		if err := h.QueryLock(ctx, r, s); err != nil {
+			return err
+		}
+		done(s)
+		r.Respond(s)
+		return nil
+
 	case *fuse.ReleaseRequest:
 		shandle := c.getHandle(r.Handle)
 		if shandle == nil {
@@ -1386,9 +1476,6 @@ func (c *Server) handleRequest(ctx context.Context, node Node, snode *serveNode,
 		/*	case *FsyncdirRequest:
 				return ENOSYS
 
-			case *GetlkRequest, *SetlkRequest, *SetlkwRequest:
-				return ENOSYS
-
 			case *BmapRequest:
 				return ENOSYS
 
@@ -98,7 +98,7 @@
 // Behavior and metadata of the mounted file system can be changed by
 // passing MountOption values to Mount.
 //
-package fuse // import "bazil.org/fuse"
+package fuse // import "github.com/keybase/kbfs/bazilfuse"
 
 import (
 	"bytes"
@@ -955,11 +955,38 @@ loop:
 		}
 
 	case opGetlk:
-		panic("opGetlk")
-	case opSetlk:
-		panic("opSetlk")
-	case opSetlkw:
-		panic("opSetlkw")
+		in := (*lkIn)(m.data())
+		if m.len() < lkInSize(c.proto) {
+			goto corrupt
+		}
+		req = &QueryLockRequest{
+			Header:    m.Header(),
+			Handle:    HandleID(in.Fh),
+			LockOwner: in.Owner,
+			Lock:      in.Lk.fileLock(),
+			LockFlags: LockFlags(in.LkFlags),
+		}
+
+	case opSetlk, opSetlkw:
+		in := (*lkIn)(m.data())
+		if m.len() < lkInSize(c.proto) {
+			goto corrupt
+		}
+		lr := LockRequest{
+			Header:    m.Header(),
+			Handle:    HandleID(in.Fh),
+			LockOwner: in.Owner,
+			Lock:      in.Lk.fileLock(),
+			LockFlags: LockFlags(in.LkFlags),
+		}
+		switch {
+		case lr.Lock.Type == LockUnlock:
+			req = (*UnlockRequest)(&lr)
+		case m.hdr.Opcode == opSetlkw:
+			req = (*LockWaitRequest)(&lr)
+		default:
+			req = &lr
+		}
 
 	case opAccess:
 		in := (*accessIn)(m.data())
@@ -1791,7 +1818,7 @@ type ReleaseRequest struct {
 	Handle       HandleID
 	Flags        OpenFlags // flags from OpenRequest
 	ReleaseFlags ReleaseFlags
-	LockOwner    uint32
+	LockOwner    uint64
 }
 
 var _ = Request(&ReleaseRequest{})
@@ -2091,6 +2118,134 @@ func (r *FlushRequest) Respond() {
 	r.respond(buf)
 }
 
+// A FileLock describes a lock on a byte range of a file, as in
+// struct flock.  End is inclusive; a lock that extends to the end of
+// the file, however long it grows, has an End of math.MaxInt64.  The
+// kernel rejects responses with a larger Start or End.
+type FileLock struct {
+	Start uint64
+	End   uint64
+	Type  LockType
+	// PID is the process that holds the lock, in responses to
+	// QueryLockRequest, and the one asking for it otherwise.
+	PID int32
+}
+
+func (l fileLock) fileLock() FileLock {
+	return FileLock{
+		Start: l.Start,
+		End:   l.End,
+		Type:  LockType(l.Type),
+		PID:   int32(l.Pid),
+	}
+}
+
+func (l FileLock) String() string {
+	return fmt.Sprintf("%v %d-%d pid=%d", l.Type, l.Start, l.End, l.PID)
+}
+
+// A LockRequest asks to take a lock on a byte range of an open
+// file, failing with EAGAIN if it's held in a conflicting way, as
+// with F_SETLK or LOCK_NB.  If the lock owner already holds a lock
+// on part of the range, its type is changed.
+//
+// The kernel only sends lock requests if the file system is mounted
+// with LockingPOSIX or LockingFlock.
+type LockRequest struct {
+	Header `json:"-"`
+	Handle HandleID
+	// LockOwner identifies the process (for fcntl locks) or the
+	// open file (for flock locks) that the lock is for.
+	LockOwner uint64
+	Lock      FileLock
+	LockFlags LockFlags
+}
+
+var _ = Request(&LockRequest{})
+
+func (r *LockRequest) String() string {
+	return fmt.Sprintf("Lock [%s] %v owner=%#x %v fl=%v", &r.Header, r.Handle, r.LockOwner, r.Lock, r.LockFlags)
+}
+
+// Respond replies to the request, indicating that the lock was taken.
+func (r *LockRequest) Respond() {
+	buf := newBuffer(0)
+	r.respond(buf)
+}
+
+// A LockWaitRequest is like a LockRequest, but waits for the lock
+// to become available instead of failing, as with F_SETLKW or flock
+// without LOCK_NB.  It's interrupted if the process gets a signal.
+type LockWaitRequest LockRequest
+
+var _ = Request(&LockWaitRequest{})
+
+func (r *LockWaitRequest) String() string {
+	return fmt.Sprintf("LockWait [%s] %v owner=%#x %v fl=%v", &r.Header, r.Handle, r.LockOwner, r.Lock, r.LockFlags)
+}
+
+// Respond replies to the request, indicating that the lock was taken.
+func (r *LockWaitRequest) Respond() {
+	buf := newBuffer(0)
+	r.respond(buf)
+}
+
+// An UnlockRequest asks to release the owner's locks on a byte range
+// of an open file.  Lock.Type is LockUnlock.
+type UnlockRequest LockRequest
+
+var _ = Request(&UnlockRequest{})
+
+func (r *UnlockRequest) String() string {
+	return fmt.Sprintf("Unlock [%s] %v owner=%#x %v fl=%v", &r.Header, r.Handle, r.LockOwner, r.Lock, r.LockFlags)
+}
+
+// Respond replies to the request, indicating that the range was
+// unlocked.
+func (r *UnlockRequest) Respond() {
+	buf := newBuffer(0)
+	r.respond(buf)
+}
+
+// A QueryLockRequest asks whether the lock in Lock could be taken,
+// as with F_GETLK.
+type QueryLockRequest struct {
+	Header    `json:"-"`
+	Handle    HandleID
+	LockOwner uint64
+	Lock      FileLock
+	LockFlags LockFlags
+}
+
+var _ = Request(&QueryLockRequest{})
+
+func (r *QueryLockRequest) String() string {
+	return fmt.Sprintf("QueryLock [%s] %v owner=%#x %v fl=%v", &r.Header, r.Handle, r.LockOwner, r.Lock, r.LockFlags)
+}
+
+// Respond replies to the request with a lock that conflicts with the
+// requested one, or one of type LockUnlock if there is none.
+func (r *QueryLockRequest) Respond(resp *QueryLockResponse) {
+	buf := newBuffer(unsafe.Sizeof(lkOut{}))
+	out := (*lkOut)(buf.alloc(unsafe.Sizeof(lkOut{})))
+	out.Lk = fileLock{
+		Start: resp.Lock.Start,
+		End:   resp.Lock.End,
+		Type:  uint32(resp.Lock.Type),
+		Pid:   uint32(resp.Lock.PID),
+	}
+	r.respond(buf)
+}
+
+// A QueryLockResponse is the response to a QueryLockRequest.
+type QueryLockResponse struct {
+	Lock FileLock
+}
+
+func (r *QueryLockResponse) String() string {
+	return fmt.Sprintf("QueryLock %v", r.Lock)
+}
+
 // A RemoveRequest asks to remove a file or directory from the
 // directory r.Node.
 type RemoveRequest struct {
@@ -217,6 +217,26 @@ func AsyncRead() MountOption {
 	}
 }
 
+// LockingFlock makes the kernel pass flock(2) locks to the file
+// system, as LockRequests with LockFlock set.  Without it, flock
+// locks are only known to the kernel.
+func LockingFlock() MountOption {
+	return func(conf *mountConfig) error {
+		conf.initFlags |= InitFlockLocks
+		return nil
+	}
+}
+
+// LockingPOSIX makes the kernel pass POSIX (fcntl(2)) locks to the
+// file system, as LockRequests and QueryLockRequests.  Without it,
+// POSIX locks are only known to the kernel.
+func LockingPOSIX() MountOption {
+	return func(conf *mountConfig) error {
+		conf.initFlags |= InitPosixLocks
+		return nil
+	}
+}
+
 // WritebackCache enables the kernel to buffer writes before sending
 // them to the FUSE server. Without this, writethrough caching is
 // used.
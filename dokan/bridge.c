@@ -318,12 +318,15 @@ static DOKAN_CALLBACK NTSTATUS kbfsLibdokanC_SetFileSecurity(LPCWSTR FileName,
 	return kbfsLibdokanSetFileSecurity(FileName, SecurityInformation, SecurityDescriptor, SecurityDescriptorLength, FileInfo);
 }
 
-/*
 extern NTSTATUS kbfsLibdokanFindStreams(LPCWSTR FileName,
 										  // call this function with PWIN32_FIND_STREAM_DATA
-										  PFillFindStreamData FindStreamData, 
+										  PFillFindStreamData FindStreamData,
 										  PDOKAN_FILE_INFO FileInfo);
-*/
+static DOKAN_CALLBACK NTSTATUS kbfsLibdokanC_FindStreams(LPCWSTR FileName,
+										  PFillFindStreamData FindStreamData,
+										  PDOKAN_FILE_INFO FileInfo) {
+	return kbfsLibdokanFindStreams(FileName, FindStreamData, FileInfo);
+}
 
 
 
@@ -359,8 +362,7 @@ struct kbfsLibdokanCtx* kbfsLibdokanAllocCtx(ULONG64 slot) {
   ctx->dokan_operations.Mounted = kbfsLibdokanC_Mounted;
   ctx->dokan_operations.GetFileSecurity = kbfsLibdokanC_GetFileSecurity;
   ctx->dokan_operations.SetFileSecurity = kbfsLibdokanC_SetFileSecurity;
-  // FIXME: Multiple streams per file for e.g. resource forks
-  //   ctx->dokan_operations.FindStreams = kbfsLibdokanC_FindStreams;
+  ctx->dokan_operations.FindStreams = kbfsLibdokanC_FindStreams;
   return ctx;
 }
 
@@ -396,6 +398,10 @@ int kbfsLibdokanFill_find(PFillFindData fptr, PWIN32_FIND_DATAW a1, PDOKAN_FILE_
   return fptr(a1, a2);
 }
 
+int kbfsLibdokanFill_findstream(PFillFindStreamData fptr, PWIN32_FIND_STREAM_DATA a1, PDOKAN_FILE_INFO a2) {
+  return fptr(a1, a2);
+}
+
 BOOL kbfsLibdokan_RemoveMountPoint(LPCWSTR MountPoint) {
 	if(!kbfsLibdokanPtr_RemoveMountPoint)
 		return 0;
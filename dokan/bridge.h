@@ -42,6 +42,7 @@ error_t kbfsLibdokanRun(struct kbfsLibdokanCtx* ctx);
 void kbfsLibdokanSet_path(struct kbfsLibdokanCtx* ctx, void*);
 
 int kbfsLibdokanFill_find(PFillFindData, PWIN32_FIND_DATAW, PDOKAN_FILE_INFO);
+int kbfsLibdokanFill_findstream(PFillFindStreamData, PWIN32_FIND_STREAM_DATA, PDOKAN_FILE_INFO);
 
 BOOL kbfsLibdokan_RemoveMountPoint(LPCWSTR MountPoint);
 HANDLE kbfsLibdokan_OpenRequestorToken(PDOKAN_FILE_INFO DokanFileInfo);
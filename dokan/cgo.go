@@ -562,17 +562,35 @@ func kbfsLibdokanSetFileSecurity(
 	return ntstatusOk
 }
 
-/* FIXME add support for multiple streams per file?
 //export kbfsLibdokanFindStreams
-func kbfsLibdokanFindStreams (
+func kbfsLibdokanFindStreams(
 	fname C.LPCWSTR,
-	// call this function with PWIN32_FIND_STREAM_DATA
-	FindStreamData uintptr,
+	FindStreamData C.PFillFindStreamData, // call this function with PWIN32_FIND_STREAM_DATA
 	pfi C.PDOKAN_FILE_INFO) C.NTSTATUS {
-
-
+	debugf("FindStreams '%v' %v", d16{fname}, *pfi)
+	sf, ok := getfi(pfi).(StreamFinder)
+	if !ok {
+		return errToNT(ErrNotImplemented)
+	}
+	ctx, cancel := getContext(pfi)
+	if cancel != nil {
+		defer cancel()
+	}
+	var sdata C.kbfs_WIN32_FIND_STREAM_DATA
+	fun := func(ns *NamedStream) error {
+		*(*int64)(unsafe.Pointer(&sdata.StreamSize)) = ns.Size
+		stringToUtf16Buffer(ns.Name,
+			C.LPWSTR(unsafe.Pointer(&sdata.cStreamName)),
+			C.DWORD(C.MAX_PATH+36))
+		v := C.kbfsLibdokanFill_findstream(FindStreamData, &sdata, pfi)
+		if v != 0 {
+			return errFindNoSpace
+		}
+		return nil
+	}
+	err := sf.FindStreams(ctx, makeFI(fname, pfi), fun)
+	return errToNT(err)
 }
-*/
 
 // FileInfo contains information about a file including the path.
 type FileInfo struct {
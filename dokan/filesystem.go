@@ -183,6 +183,22 @@ type File interface {
 	CloseFile(ctx context.Context, fi *FileInfo)
 }
 
+// StreamFinder is an optional interface for Files with named streams
+// (alternate data streams) besides their default one.
+type StreamFinder interface {
+	// FindStreams calls the callback with each stream of the file,
+	// including the default one, which is named "::$DATA".  The
+	// same NamedStream may be reused for subsequent calls.
+	FindStreams(ctx context.Context, fi *FileInfo, fillStreamCallback func(*NamedStream) error) error
+}
+
+// NamedStream is used for the responses of StreamFinder.FindStreams.
+// Name is of the form ":name:$DATA".
+type NamedStream struct {
+	Name string
+	Size int64
+}
+
 // FreeSpace - semantics as with WINAPI GetDiskFreeSpaceEx
 type FreeSpace struct {
 	FreeBytesAvailable, TotalNumberOfBytes, TotalNumberOfFreeBytes uint64
@@ -269,6 +285,8 @@ const (
 	ErrObjectNameCollision = NtStatus(0xC0000035)
 	// ErrObjectPathNotFound - a pathname does not exist (ENOENT)
 	ErrObjectPathNotFound = NtStatus(0xC000003A)
+	// ErrNotImplemented - the operation isn't implemented (ENOSYS).
+	ErrNotImplemented = NtStatus(0xC0000002)
 	// ErrNotSupported - not supported.
 	ErrNotSupported = NtStatus(0xC00000BB)
 	// ErrFileIsADirectory - file is a directory.
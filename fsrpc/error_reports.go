@@ -0,0 +1,180 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package fsrpc
+
+import (
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// The error reports protocol gives GUIs the errors that the user
+// can do something about, classified and deduplicated, with a
+// suggestion of what to do, instead of log lines.
+
+// errorReportsWaitTimeout is the longest waitForErrorReports waits
+// for a new report before returning none, so that clients don't
+// hold a call open forever.
+const errorReportsWaitTimeout = time.Minute
+
+// ErrorReportsArg is the argument of the getErrorReports and
+// waitForErrorReports methods.
+type ErrorReportsArg struct {
+	// SinceID is the ID of the last report the client has seen,
+	// or 0 to get all of them.
+	SinceID uint64 `codec:"sinceID" json:"sinceID"`
+}
+
+// ErrorReport is one libkbfs.ErrorReport.
+type ErrorReport struct {
+	ID uint64 `codec:"id" json:"id"`
+	// Class is one of "quota", "permission", "conflict",
+	// "network" or "corruption".
+	Class     string        `codec:"class" json:"class"`
+	Tlf       string        `codec:"tlf" json:"tlf"`
+	Public    bool          `codec:"public" json:"public"`
+	Write     bool          `codec:"write" json:"write"`
+	Message   string        `codec:"message" json:"message"`
+	Action    string        `codec:"action" json:"action"`
+	FirstTime keybase1.Time `codec:"firstTime" json:"firstTime"`
+	LastTime  keybase1.Time `codec:"lastTime" json:"lastTime"`
+	Count     int           `codec:"count" json:"count"`
+}
+
+// ErrorReportsRes is the result of the getErrorReports and
+// waitForErrorReports methods.
+type ErrorReportsRes struct {
+	// Reports are the reports newer than the requested one,
+	// oldest first.
+	Reports []ErrorReport `codec:"reports" json:"reports"`
+}
+
+// ErrorReportsInterface is the set of error report queries.
+type ErrorReportsInterface interface {
+	// Get the reports newer than the given one.
+	GetErrorReports(context.Context, ErrorReportsArg) (
+		ErrorReportsRes, error)
+	// Like GetErrorReports, but if there are no newer reports,
+	// wait for one.
+	WaitForErrorReports(context.Context, ErrorReportsArg) (
+		ErrorReportsRes, error)
+}
+
+// ErrorReportsProtocol returns the RPC protocol for the given
+// ErrorReportsInterface.
+func ErrorReportsProtocol(i ErrorReportsInterface) rpc.Protocol {
+	makeArg := func() interface{} {
+		ret := make([]ErrorReportsArg, 1)
+		return &ret
+	}
+	return rpc.Protocol{
+		Name: "keybase.1.kbfsErrorReports",
+		Methods: map[string]rpc.ServeHandlerDescription{
+			"getErrorReports": {
+				MakeArg: makeArg,
+				Handler: func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]ErrorReportsArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]ErrorReportsArg)(nil), args)
+					}
+					return i.GetErrorReports(ctx, (*typedArgs)[0])
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"waitForErrorReports": {
+				MakeArg: makeArg,
+				Handler: func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]ErrorReportsArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]ErrorReportsArg)(nil), args)
+					}
+					return i.WaitForErrorReports(ctx, (*typedArgs)[0])
+				},
+				MethodType: rpc.MethodCall,
+			},
+		},
+	}
+}
+
+type errorReports struct {
+	config libkbfs.Config
+}
+
+// NewErrorReports returns a new error reports protocol
+// implementation.
+func NewErrorReports(config libkbfs.Config) ErrorReportsInterface {
+	return &errorReports{config: config}
+}
+
+// NewErrorReportsProtocol creates the error reports protocol for the
+// given config.  It can be used as a
+// libkbfs.AdditionalProtocolCreator.
+func NewErrorReportsProtocol(
+	_ libkbfs.Context, config libkbfs.Config) (rpc.Protocol, error) {
+	return ErrorReportsProtocol(NewErrorReports(config)), nil
+}
+
+func errorReportFromLibkbfs(r libkbfs.ErrorReport) ErrorReport {
+	return ErrorReport{
+		ID:        r.ID,
+		Class:     r.Class.String(),
+		Tlf:       string(r.Tlf),
+		Public:    r.Public,
+		Write:     r.Write,
+		Message:   r.Message,
+		Action:    r.Action,
+		FirstTime: keybase1.ToTime(r.FirstTime),
+		LastTime:  keybase1.ToTime(r.LastTime),
+		Count:     r.Count,
+	}
+}
+
+func (e *errorReports) reportsSince(sinceID uint64) ErrorReportsRes {
+	var res ErrorReportsRes
+	for _, r := range e.config.Reporter().ErrorReports() {
+		if r.ID > sinceID {
+			res.Reports = append(res.Reports, errorReportFromLibkbfs(r))
+		}
+	}
+	return res
+}
+
+// GetErrorReports implements the ErrorReportsInterface for
+// errorReports.
+func (e *errorReports) GetErrorReports(
+	ctx context.Context, arg ErrorReportsArg) (ErrorReportsRes, error) {
+	return e.reportsSince(arg.SinceID), nil
+}
+
+// WaitForErrorReports implements the ErrorReportsInterface for
+// errorReports.
+func (e *errorReports) WaitForErrorReports(
+	ctx context.Context, arg ErrorReportsArg) (ErrorReportsRes, error) {
+	// Subscribe before looking, so that no report can slip in
+	// between.
+	ch, unsubscribe := e.config.Reporter().SubscribeToErrorReports()
+	defer unsubscribe()
+
+	if res := e.reportsSince(arg.SinceID); len(res.Reports) > 0 {
+		return res, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, errorReportsWaitTimeout)
+	defer cancel()
+	select {
+	case <-ch:
+		// Get everything since the client's last report, in case
+		// more than one arrived at once.
+		return e.reportsSince(arg.SinceID), nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrorReportsRes{}, nil
+		}
+		return ErrorReportsRes{}, ctx.Err()
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package fsrpc
+
+import (
+	"errors"
+
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// The log control protocol lets the logging of a running KBFS
+// instance be changed without restarting it, e.g. to turn on debug
+// logging while reproducing a problem.
+
+// LogControlNoArg is the argument of the methods that take none.
+type LogControlNoArg struct{}
+
+// LogSettingsArg is the argument of the setLogSettings method.
+type LogSettingsArg struct {
+	// Debug turns on debug logging for all modules.
+	Debug bool `codec:"debug" json:"debug"`
+	// DebugTags turns on debug logging just for the modules
+	// covered by the given tags; see libkbfs.LogSettings.
+	DebugTags []string `codec:"debugTags" json:"debugTags"`
+}
+
+// LogStatusRes is the result of the getLogStatus method.
+type LogStatusRes struct {
+	Debug     bool     `codec:"debug" json:"debug"`
+	DebugTags []string `codec:"debugTags" json:"debugTags"`
+	LogFile   string   `codec:"logFile" json:"logFile"`
+}
+
+// LogControlInterface is the set of runtime logging controls.
+type LogControlInterface interface {
+	// Get the current log settings and log file.
+	GetLogStatus(context.Context) (LogStatusRes, error)
+	// Replace the log settings.
+	SetLogSettings(context.Context, LogSettingsArg) error
+	// Move the current log file aside, and start a new one.
+	RotateLogFile(context.Context) error
+}
+
+// LogControlProtocol returns the RPC protocol for the given
+// LogControlInterface.
+func LogControlProtocol(i LogControlInterface) rpc.Protocol {
+	noArgs := func() interface{} {
+		ret := make([]LogControlNoArg, 1)
+		return &ret
+	}
+	return rpc.Protocol{
+		Name: "keybase.1.kbfsLogControl",
+		Methods: map[string]rpc.ServeHandlerDescription{
+			"getLogStatus": {
+				MakeArg: noArgs,
+				Handler: func(ctx context.Context, _ interface{}) (interface{}, error) {
+					return i.GetLogStatus(ctx)
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"setLogSettings": {
+				MakeArg: func() interface{} {
+					ret := make([]LogSettingsArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]LogSettingsArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]LogSettingsArg)(nil), args)
+					}
+					return nil, i.SetLogSettings(ctx, (*typedArgs)[0])
+				},
+				MethodType: rpc.MethodCall,
+			},
+			"rotateLogFile": {
+				MakeArg: noArgs,
+				Handler: func(ctx context.Context, _ interface{}) (interface{}, error) {
+					return nil, i.RotateLogFile(ctx)
+				},
+				MethodType: rpc.MethodCall,
+			},
+		},
+	}
+}
+
+type logControl struct {
+	config libkbfs.Config
+}
+
+// NewLogControl returns a new log control protocol implementation.
+func NewLogControl(config libkbfs.Config) LogControlInterface {
+	return &logControl{config: config}
+}
+
+// NewLogControlProtocol creates the log control protocol for the
+// given config.  It can be used as a
+// libkbfs.AdditionalProtocolCreator.
+func NewLogControlProtocol(
+	_ libkbfs.Context, config libkbfs.Config) (rpc.Protocol, error) {
+	return LogControlProtocol(NewLogControl(config)), nil
+}
+
+var errNoLogControl = errors.New(
+	"The log settings of this KBFS instance can't be changed")
+
+func (l *logControl) logControl() (*libkbfs.LogControl, error) {
+	lc := l.config.LogControl()
+	if lc == nil {
+		return nil, errNoLogControl
+	}
+	return lc, nil
+}
+
+// GetLogStatus implements the LogControlInterface for logControl.
+func (l *logControl) GetLogStatus(ctx context.Context) (LogStatusRes, error) {
+	lc, err := l.logControl()
+	if err != nil {
+		return LogStatusRes{}, err
+	}
+	status := lc.Status()
+	return LogStatusRes{
+		Debug:     status.Debug,
+		DebugTags: status.DebugTags,
+		LogFile:   status.LogFile,
+	}, nil
+}
+
+// SetLogSettings implements the LogControlInterface for logControl.
+func (l *logControl) SetLogSettings(
+	ctx context.Context, arg LogSettingsArg) error {
+	lc, err := l.logControl()
+	if err != nil {
+		return err
+	}
+	return lc.SetSettings(libkbfs.LogSettings{
+		Debug:     arg.Debug,
+		DebugTags: arg.DebugTags,
+	})
+}
+
+// RotateLogFile implements the LogControlInterface for logControl.
+func (l *logControl) RotateLogFile(ctx context.Context) error {
+	lc, err := l.logControl()
+	if err != nil {
+		return err
+	}
+	return lc.RotateLogFile()
+}
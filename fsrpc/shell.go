@@ -0,0 +1,321 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package fsrpc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// The shell protocol serves the context-menu actions of file manager
+// extensions (Finder, Explorer, Nautilus), which get the KBFS paths
+// of the files they're asked about from the mount, but shouldn't
+// have to know how it's laid out.
+
+// publicURLPrefix is where public folders can be viewed on the web.
+const publicURLPrefix = "https://keybase.pub/"
+
+// ShellPathInfo describes a path in KBFS, for sharing it.
+type ShellPathInfo struct {
+	// Path is the canonical path, e.g. /keybase/private/alice,bob/a.
+	Path       string `codec:"path" json:"path"`
+	FolderName string `codec:"folderName" json:"folderName"`
+	Public     bool   `codec:"public" json:"public"`
+	// Writers and Readers are the users and unresolved assertions
+	// with access to the folder.  Readers is empty for public
+	// folders, which everyone can read.
+	Writers    []string      `codec:"writers" json:"writers"`
+	Readers    []string      `codec:"readers" json:"readers"`
+	Type       string        `codec:"type" json:"type"`
+	Size       uint64        `codec:"size" json:"size"`
+	Mtime      keybase1.Time `codec:"mtime" json:"mtime"`
+	LastWriter string        `codec:"lastWriter" json:"lastWriter"`
+	// URL is where the path can be viewed on the web, if it's in
+	// a public folder with a single writer.
+	URL string `codec:"url" json:"url"`
+}
+
+// ShellHistoryEntry is a recent edit within a path.
+type ShellHistoryEntry struct {
+	Path   string        `codec:"path" json:"path"`
+	Writer string        `codec:"writer" json:"writer"`
+	Type   string        `codec:"type" json:"type"`
+	Time   keybase1.Time `codec:"time" json:"time"`
+}
+
+// ShellConflict is an unresolved conflict within a path.  See
+// libkbfs.ConflictInfo.
+type ShellConflict struct {
+	Path        string        `codec:"path" json:"path"`
+	LocalPath   string        `codec:"localPath" json:"localPath"`
+	LocalSize   uint64        `codec:"localSize" json:"localSize"`
+	LocalMtime  keybase1.Time `codec:"localMtime" json:"localMtime"`
+	RemoteSize  uint64        `codec:"remoteSize" json:"remoteSize"`
+	RemoteMtime keybase1.Time `codec:"remoteMtime" json:"remoteMtime"`
+	Resolved    bool          `codec:"resolved" json:"resolved"`
+}
+
+// ShellPathArg is the argument of every ShellInterface method.
+type ShellPathArg struct {
+	Path string `codec:"path" json:"path"`
+}
+
+// ShellInterface is the set of actions that file manager
+// extensions offer on KBFS paths.
+type ShellInterface interface {
+	// Describe a path, for sharing it.
+	PathInfo(context.Context, string) (ShellPathInfo, error)
+	// List the recent edits within a path, newest first.
+	FolderHistory(context.Context, string) ([]ShellHistoryEntry, error)
+	// Flush this device's writes to a path, and then bring its
+	// folder up to date with the server.
+	ForceSync(context.Context, string) error
+	// List the conflicts awaiting manual resolution within a
+	// path.
+	Conflicts(context.Context, string) ([]ShellConflict, error)
+}
+
+// ShellProtocol returns the RPC protocol for the given
+// ShellInterface.
+func ShellProtocol(i ShellInterface) rpc.Protocol {
+	method := func(call func(context.Context, string) (interface{}, error)) rpc.ServeHandlerDescription {
+		return rpc.ServeHandlerDescription{
+			MakeArg: func() interface{} {
+				ret := make([]ShellPathArg, 1)
+				return &ret
+			},
+			Handler: func(ctx context.Context, args interface{}) (interface{}, error) {
+				typedArgs, ok := args.(*[]ShellPathArg)
+				if !ok {
+					return nil, rpc.NewTypeError((*[]ShellPathArg)(nil), args)
+				}
+				return call(ctx, (*typedArgs)[0].Path)
+			},
+			MethodType: rpc.MethodCall,
+		}
+	}
+	return rpc.Protocol{
+		Name: "keybase.1.kbfsShell",
+		Methods: map[string]rpc.ServeHandlerDescription{
+			"pathInfo": method(func(ctx context.Context, path string) (interface{}, error) {
+				return i.PathInfo(ctx, path)
+			}),
+			"folderHistory": method(func(ctx context.Context, path string) (interface{}, error) {
+				return i.FolderHistory(ctx, path)
+			}),
+			"forceSync": method(func(ctx context.Context, path string) (interface{}, error) {
+				return nil, i.ForceSync(ctx, path)
+			}),
+			"conflicts": method(func(ctx context.Context, path string) (interface{}, error) {
+				return i.Conflicts(ctx, path)
+			}),
+		},
+	}
+}
+
+type shell struct {
+	config libkbfs.Config
+	log    logger.Logger
+}
+
+// NewShell returns a new shell protocol implementation.
+func NewShell(config libkbfs.Config, log logger.Logger) ShellInterface {
+	return &shell{config: config, log: log}
+}
+
+// NewShellProtocol creates the shell protocol for the given config.
+// It can be used as a libkbfs.AdditionalProtocolCreator.
+func NewShellProtocol(
+	_ libkbfs.Context, config libkbfs.Config) (rpc.Protocol, error) {
+	return ShellProtocol(NewShell(config, config.MakeLogger("SHL"))), nil
+}
+
+// shellPath is a resolved path within a TLF.
+type shellPath struct {
+	handle *libkbfs.TlfHandle
+	node   libkbfs.Node
+	ei     libkbfs.EntryInfo
+	// canonical is the canonical form of the path.
+	canonical string
+}
+
+func (s *shell) resolve(ctx context.Context, pathStr string) (
+	shellPath, error) {
+	p, err := NewPath(pathStr)
+	if err != nil {
+		return shellPath{}, err
+	}
+	if p.PathType != TLFPathType {
+		return shellPath{}, fmt.Errorf("%s is not within a folder", pathStr)
+	}
+	handle, err := ParseTlfHandle(ctx, s.config.KBPKI(), p.TLFName, p.Public)
+	if err != nil {
+		return shellPath{}, err
+	}
+	node, ei, err := p.GetNode(ctx, s.config)
+	if err != nil {
+		return shellPath{}, err
+	}
+	canonical := strings.Join(
+		append([]string{handle.GetCanonicalPath()}, p.TLFComponents...), "/")
+	return shellPath{handle, node, ei, canonical}, nil
+}
+
+// isUnder returns whether the canonical path p is dir or is within
+// it.
+func isUnder(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// PathInfo implements the ShellInterface for shell.
+func (s *shell) PathInfo(ctx context.Context, path string) (
+	ShellPathInfo, error) {
+	s.log.CDebugf(ctx, "Path info for %q", path)
+	sp, err := s.resolve(ctx, path)
+	if err != nil {
+		return ShellPathInfo{}, err
+	}
+	md, err := s.config.KBFSOps().GetNodeMetadata(ctx, sp.node)
+	if err != nil {
+		return ShellPathInfo{}, err
+	}
+
+	name := string(sp.handle.GetCanonicalName())
+	// Strip any conflict or finalization suffix.
+	members := strings.SplitN(name, " ", 2)[0]
+	writersAndReaders := strings.SplitN(members, libkbfs.ReaderSep, 2)
+	info := ShellPathInfo{
+		Path:       sp.canonical,
+		FolderName: name,
+		Public:     sp.handle.IsPublic(),
+		Writers:    strings.Split(writersAndReaders[0], ","),
+		Type:       sp.ei.Type.String(),
+		Size:       sp.ei.Size,
+		Mtime:      keybase1.Time(sp.ei.Mtime / 1000000),
+		LastWriter: md.LastWriterUnverified.String(),
+	}
+	if len(writersAndReaders) > 1 {
+		info.Readers = strings.Split(writersAndReaders[1], ",")
+	}
+	if info.Public && len(info.Writers) == 1 {
+		info.URL = publicURLPrefix + strings.TrimPrefix(
+			sp.canonical, libkbfs.BuildCanonicalPath(
+				libkbfs.PublicPathType)+"/")
+	}
+	return info, nil
+}
+
+// FolderHistory implements the ShellInterface for shell.
+func (s *shell) FolderHistory(ctx context.Context, path string) (
+	[]ShellHistoryEntry, error) {
+	s.log.CDebugf(ctx, "Folder history for %q", path)
+	sp, err := s.resolve(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	edits, err := s.config.KBFSOps().GetEditHistory(
+		ctx, sp.node.GetFolderBranch())
+	if err != nil {
+		return nil, err
+	}
+	pathType := libkbfs.PrivatePathType
+	if sp.handle.IsPublic() {
+		pathType = libkbfs.PublicPathType
+	}
+
+	var history []ShellHistoryEntry
+	for uid, writerEdits := range edits {
+		writer, err := s.config.KBPKI().GetNormalizedUsername(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		for _, edit := range writerEdits {
+			editPath := libkbfs.BuildCanonicalPath(pathType, edit.Filepath)
+			if !isUnder(editPath, sp.canonical) {
+				continue
+			}
+			history = append(history, ShellHistoryEntry{
+				Path:   editPath,
+				Writer: writer.String(),
+				Type:   shellEditType(edit.Type),
+				Time:   keybase1.ToTime(edit.LocalTime),
+			})
+		}
+	}
+	sort.Sort(sort.Reverse(shellHistoryByTime(history)))
+	return history, nil
+}
+
+func shellEditType(t libkbfs.TlfEditNotificationType) string {
+	switch t {
+	case libkbfs.FileCreated:
+		return "created"
+	case libkbfs.FileModified:
+		return "modified"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(t))
+	}
+}
+
+type shellHistoryByTime []ShellHistoryEntry
+
+func (h shellHistoryByTime) Len() int           { return len(h) }
+func (h shellHistoryByTime) Less(i, j int) bool { return h[i].Time < h[j].Time }
+func (h shellHistoryByTime) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+// ForceSync implements the ShellInterface for shell.
+func (s *shell) ForceSync(ctx context.Context, path string) error {
+	s.log.CDebugf(ctx, "Force sync of %q", path)
+	sp, err := s.resolve(ctx, path)
+	if err != nil {
+		return err
+	}
+	kbfsOps := s.config.KBFSOps()
+	if sp.ei.Type != libkbfs.Dir {
+		if err := kbfsOps.Sync(ctx, sp.node); err != nil {
+			return err
+		}
+	}
+	return kbfsOps.SyncFromServerForTesting(ctx, sp.node.GetFolderBranch())
+}
+
+// Conflicts implements the ShellInterface for shell.
+func (s *shell) Conflicts(ctx context.Context, path string) (
+	[]ShellConflict, error) {
+	s.log.CDebugf(ctx, "Conflicts in %q", path)
+	sp, err := s.resolve(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	conflicts, err := s.config.KBFSOps().GetConflicts(
+		ctx, sp.node.GetFolderBranch())
+	if err != nil {
+		return nil, err
+	}
+	var result []ShellConflict
+	for _, c := range conflicts {
+		if !isUnder(c.Path, sp.canonical) &&
+			!isUnder(c.LocalPath, sp.canonical) {
+			continue
+		}
+		result = append(result, ShellConflict{
+			Path:        c.Path,
+			LocalPath:   c.LocalPath,
+			LocalSize:   c.Local.Size,
+			LocalMtime:  keybase1.Time(c.Local.Mtime / 1000000),
+			RemoteSize:  c.Remote.Size,
+			RemoteMtime: keybase1.Time(c.Remote.Mtime / 1000000),
+			Resolved:    c.Choice != nil,
+		})
+	}
+	return result, nil
+}
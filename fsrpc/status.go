@@ -0,0 +1,84 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package fsrpc
+
+import (
+	"encoding/json"
+
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// The status protocol gives the Keybase service and GUI a snapshot
+// of the state of every KBFS subsystem at once, for showing what
+// KBFS is busy with and what's wrong.
+
+// StatusNoArg is the argument of the methods that take none.
+type StatusNoArg struct{}
+
+// KBFSStatusRes is the result of the getKBFSStatus method.
+type KBFSStatusRes struct {
+	// Status is the JSON encoding of a
+	// libkbfs.KBFSStatusSnapshot.  It's sent as JSON, rather than
+	// as its own RPC type, so that new fields reach the GUI
+	// without a protocol change.
+	Status string `codec:"status" json:"status"`
+}
+
+// StatusInterface is the set of status queries.
+type StatusInterface interface {
+	// Get a snapshot of the state of all of KBFS.
+	GetKBFSStatus(context.Context) (KBFSStatusRes, error)
+}
+
+// StatusProtocol returns the RPC protocol for the given
+// StatusInterface.
+func StatusProtocol(i StatusInterface) rpc.Protocol {
+	return rpc.Protocol{
+		Name: "keybase.1.kbfsStatus",
+		Methods: map[string]rpc.ServeHandlerDescription{
+			"getKBFSStatus": {
+				MakeArg: func() interface{} {
+					ret := make([]StatusNoArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, _ interface{}) (interface{}, error) {
+					return i.GetKBFSStatus(ctx)
+				},
+				MethodType: rpc.MethodCall,
+			},
+		},
+	}
+}
+
+type status struct {
+	config libkbfs.Config
+}
+
+// NewStatus returns a new status protocol implementation.
+func NewStatus(config libkbfs.Config) StatusInterface {
+	return &status{config: config}
+}
+
+// NewStatusProtocol creates the status protocol for the given
+// config.  It can be used as a libkbfs.AdditionalProtocolCreator.
+func NewStatusProtocol(
+	_ libkbfs.Context, config libkbfs.Config) (rpc.Protocol, error) {
+	return StatusProtocol(NewStatus(config)), nil
+}
+
+// GetKBFSStatus implements the StatusInterface for status.
+func (s *status) GetKBFSStatus(ctx context.Context) (KBFSStatusRes, error) {
+	snapshot, err := s.config.KBFSOps().GetKBFSStatus(ctx)
+	if err != nil {
+		return KBFSStatusRes{}, err
+	}
+	buf, err := json.Marshal(snapshot)
+	if err != nil {
+		return KBFSStatusRes{}, err
+	}
+	return KBFSStatusRes{Status: string(buf)}, nil
+}
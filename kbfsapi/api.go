@@ -0,0 +1,221 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Package kbfsapi is the versioned public API through which kbfstool
+// and third-party embedders operate on files and folders.  It exposes
+// a deliberately small subset of libkbfs: the core file system
+// operations, nodes, change observers, and status.  Clients that
+// stick to this package are insulated from internal libkbfs
+// redesigns: the types here are defined by this package, and if the
+// libkbfs type behind one of them changes incompatibly, the
+// conversion in this package changes instead.  Version is bumped
+// only when that's impossible.
+//
+// libfuse and libdokan don't use this package yet, since they also
+// need libkbfs features that are outside of it (e.g., extended
+// attributes, permissions, special files and advisory locks).
+package kbfsapi
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// Version is the version of this API.  It's incremented whenever a
+// backwards-incompatible change is made to anything in this package.
+const Version = 1
+
+// Node is a handle to a file, directory or symlink.  Every
+// libkbfs.Node is a Node, and vice versa.
+type Node interface {
+	libkbfs.Node
+}
+
+// Observer is notified of changes to the nodes of the folders it is
+// registered for.  Every libkbfs.Observer is an Observer, and vice
+// versa.
+type Observer interface {
+	libkbfs.Observer
+}
+
+// EntryType is the type of a directory entry.
+type EntryType libkbfs.EntryType
+
+// Entry types.
+const (
+	File = EntryType(libkbfs.File)
+	Exec = EntryType(libkbfs.Exec)
+	Dir  = EntryType(libkbfs.Dir)
+	Sym  = EntryType(libkbfs.Sym)
+)
+
+// String implements the fmt.Stringer interface for EntryType.
+func (et EntryType) String() string {
+	return libkbfs.EntryType(et).String()
+}
+
+// Excl says whether a file creation must be exclusive.
+type Excl libkbfs.Excl
+
+// Exclusivity values for Ops.CreateFile.
+const (
+	NoExcl   = Excl(libkbfs.NoExcl)
+	WithExcl = Excl(libkbfs.WithExcl)
+)
+
+// BranchName names a branch of a folder.
+type BranchName libkbfs.BranchName
+
+// MasterBranch is the branch name of the main, merged view of a
+// folder.
+const MasterBranch = BranchName(libkbfs.MasterBranch)
+
+// FolderBranch identifies a branch of a top-level folder.
+type FolderBranch struct {
+	Tlf    tlf.ID
+	Branch BranchName
+}
+
+func (fb FolderBranch) toLibkbfs() libkbfs.FolderBranch {
+	return libkbfs.FolderBranch{
+		Tlf:    fb.Tlf,
+		Branch: libkbfs.BranchName(fb.Branch),
+	}
+}
+
+// EntryInfo is the metadata for a directory entry.
+type EntryInfo struct {
+	Type    EntryType
+	Size    uint64
+	SymPath string
+	// Mtime is in unix nanoseconds.
+	Mtime int64
+	// Ctime is in unix nanoseconds.
+	Ctime int64
+	// ChildCount is the number of entries in a directory.
+	ChildCount uint64
+	// RecursiveSize is the total Size of all the entries under a
+	// directory, at any depth.
+	RecursiveSize uint64
+}
+
+// MakeEntryInfo converts a libkbfs.EntryInfo, e.g. one returned by
+// the fsrpc package, to an EntryInfo.
+func MakeEntryInfo(ei libkbfs.EntryInfo) EntryInfo {
+	return EntryInfo{
+		Type:          EntryType(ei.Type),
+		Size:          ei.Size,
+		SymPath:       ei.SymPath,
+		Mtime:         ei.Mtime,
+		Ctime:         ei.Ctime,
+		ChildCount:    ei.ChildCount,
+		RecursiveSize: ei.RecursiveSize,
+	}
+}
+
+// Favorite is a top-level folder in the user's favorites list.
+type Favorite struct {
+	Name   string
+	Public bool
+}
+
+// TlfHandle identifies a top-level folder by its readers and
+// writers.  Get one from API.ParseTlfHandle.
+type TlfHandle struct {
+	h *libkbfs.TlfHandle
+}
+
+// GetCanonicalName returns the canonical name of the folder.
+func (h *TlfHandle) GetCanonicalName() string {
+	return string(h.h.GetCanonicalName())
+}
+
+// FolderBranchStatus is the status of a single folder-branch.
+type FolderBranchStatus libkbfs.FolderBranchStatus
+
+// KBFSStatus is the overall status of KBFS.
+type KBFSStatus libkbfs.KBFSStatus
+
+// Ops is the set of file system operations available to clients.
+// See the corresponding methods of libkbfs.KBFSOps for their
+// semantics.
+type Ops interface {
+	GetFavorites(ctx context.Context) ([]Favorite, error)
+	RefreshCachedFavorites(ctx context.Context)
+	AddFavorite(ctx context.Context, fav Favorite) error
+	DeleteFavorite(ctx context.Context, fav Favorite) error
+
+	GetOrCreateRootNode(ctx context.Context, h *TlfHandle,
+		branch BranchName) (Node, EntryInfo, error)
+	GetRootNode(ctx context.Context, h *TlfHandle,
+		branch BranchName) (Node, EntryInfo, error)
+
+	GetDirChildren(ctx context.Context, dir Node) (
+		map[string]EntryInfo, error)
+	Lookup(ctx context.Context, dir Node, name string) (
+		Node, EntryInfo, error)
+	Stat(ctx context.Context, node Node) (EntryInfo, error)
+
+	CreateDir(ctx context.Context, dir Node, name string) (
+		Node, EntryInfo, error)
+	CreateFile(ctx context.Context, dir Node, name string, isExec bool,
+		excl Excl) (Node, EntryInfo, error)
+	CreateLink(ctx context.Context, dir Node, fromName string,
+		toPath string) (EntryInfo, error)
+	RemoveDir(ctx context.Context, dir Node, dirName string) error
+	RemoveEntry(ctx context.Context, dir Node, name string) error
+	Rename(ctx context.Context, oldParent Node, oldName string,
+		newParent Node, newName string) error
+
+	Read(ctx context.Context, file Node, dest []byte, off int64) (
+		int64, error)
+	Write(ctx context.Context, file Node, data []byte, off int64) error
+	Truncate(ctx context.Context, file Node, size uint64) error
+	SetEx(ctx context.Context, file Node, ex bool) error
+	SetMtime(ctx context.Context, file Node, mtime *time.Time) error
+	Sync(ctx context.Context, file Node) error
+
+	FolderStatus(ctx context.Context, folderBranch FolderBranch) (
+		FolderBranchStatus, error)
+	Status(ctx context.Context) (KBFSStatus, error)
+}
+
+// Notifier lets clients subscribe to changes in folders.
+type Notifier interface {
+	RegisterForChanges(folderBranches []FolderBranch, obs Observer) error
+	UnregisterFromChanges(folderBranches []FolderBranch,
+		obs Observer) error
+}
+
+// API bundles the entry points of this package for a single
+// libkbfs.Config.
+type API struct {
+	Ops      Ops
+	Notifier Notifier
+
+	kbpki libkbfs.KBPKI
+}
+
+// New returns the API for the given config.
+func New(config libkbfs.Config) API {
+	return API{
+		Ops:      ops{config.KBFSOps()},
+		Notifier: notifier{config.Notifier()},
+		kbpki:    config.KBPKI(),
+	}
+}
+
+// ParseTlfHandle returns the handle of the folder with the given
+// canonical name.
+func (a API) ParseTlfHandle(ctx context.Context, name string,
+	public bool) (*TlfHandle, error) {
+	h, err := libkbfs.ParseTlfHandle(ctx, a.kbpki, name, public)
+	if err != nil {
+		return nil, err
+	}
+	return &TlfHandle{h}, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfsapi
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestAPIFileOps(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	ctx, err := libkbfs.NewContextWithCancellationDelayer(
+		libkbfs.NewContextReplayable(context.Background(),
+			func(ctx context.Context) context.Context { return ctx }))
+	require.NoError(t, err)
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+
+	api := New(config)
+	h, err := api.ParseTlfHandle(ctx, "jdoe", false)
+	require.NoError(t, err)
+	require.Equal(t, "jdoe", h.GetCanonicalName())
+	root, ei, err := api.Ops.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	require.Equal(t, Dir, ei.Type)
+
+	dir, _, err := api.Ops.CreateDir(ctx, root, "d")
+	require.NoError(t, err)
+	file, ei, err := api.Ops.CreateFile(ctx, dir, "f", true, WithExcl)
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+	_, _, err = api.Ops.CreateFile(ctx, dir, "f", false, WithExcl)
+	require.IsType(t, libkbfs.NameExistsError{}, err)
+
+	require.NoError(t, api.Ops.Write(ctx, file, []byte("hello"), 0))
+	require.NoError(t, api.Ops.Sync(ctx, file))
+	buf := make([]byte, 5)
+	n, err := api.Ops.Read(ctx, file, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf[:n]))
+
+	children, err := api.Ops.GetDirChildren(ctx, dir)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	require.Equal(t, Exec, children["f"].Type)
+	require.Equal(t, uint64(5), children["f"].Size)
+
+	_, err = api.Ops.CreateLink(ctx, dir, "l", "f")
+	require.NoError(t, err)
+	node, ei, err := api.Ops.Lookup(ctx, dir, "l")
+	require.NoError(t, err)
+	require.Nil(t, node)
+	require.Equal(t, Sym, ei.Type)
+	require.Equal(t, "f", ei.SymPath)
+
+	status, err := api.Ops.FolderStatus(ctx, FolderBranch{
+		Tlf:    root.GetFolderBranch().Tlf,
+		Branch: MasterBranch,
+	})
+	require.NoError(t, err)
+	require.Equal(t, root.GetFolderBranch().Tlf.String(), status.FolderID)
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfsapi
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ops implements Ops on top of a libkbfs.KBFSOps, converting between
+// the types of this package and the libkbfs ones.
+type ops struct {
+	kbfsOps libkbfs.KBFSOps
+}
+
+var _ Ops = ops{}
+
+func (o ops) GetFavorites(ctx context.Context) ([]Favorite, error) {
+	favs, err := o.kbfsOps.GetFavorites(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]Favorite, len(favs))
+	for i, fav := range favs {
+		ret[i] = Favorite(fav)
+	}
+	return ret, nil
+}
+
+func (o ops) RefreshCachedFavorites(ctx context.Context) {
+	o.kbfsOps.RefreshCachedFavorites(ctx)
+}
+
+func (o ops) AddFavorite(ctx context.Context, fav Favorite) error {
+	return o.kbfsOps.AddFavorite(ctx, libkbfs.Favorite(fav))
+}
+
+func (o ops) DeleteFavorite(ctx context.Context, fav Favorite) error {
+	return o.kbfsOps.DeleteFavorite(ctx, libkbfs.Favorite(fav))
+}
+
+func (o ops) GetOrCreateRootNode(ctx context.Context, h *TlfHandle,
+	branch BranchName) (Node, EntryInfo, error) {
+	n, ei, err := o.kbfsOps.GetOrCreateRootNode(
+		ctx, h.h, libkbfs.BranchName(branch))
+	return n, MakeEntryInfo(ei), err
+}
+
+func (o ops) GetRootNode(ctx context.Context, h *TlfHandle,
+	branch BranchName) (Node, EntryInfo, error) {
+	n, ei, err := o.kbfsOps.GetRootNode(
+		ctx, h.h, libkbfs.BranchName(branch))
+	return n, MakeEntryInfo(ei), err
+}
+
+func (o ops) GetDirChildren(ctx context.Context, dir Node) (
+	map[string]EntryInfo, error) {
+	children, err := o.kbfsOps.GetDirChildren(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]EntryInfo, len(children))
+	for name, ei := range children {
+		ret[name] = MakeEntryInfo(ei)
+	}
+	return ret, nil
+}
+
+func (o ops) Lookup(ctx context.Context, dir Node, name string) (
+	Node, EntryInfo, error) {
+	n, ei, err := o.kbfsOps.Lookup(ctx, dir, name)
+	return n, MakeEntryInfo(ei), err
+}
+
+func (o ops) Stat(ctx context.Context, node Node) (EntryInfo, error) {
+	ei, err := o.kbfsOps.Stat(ctx, node)
+	return MakeEntryInfo(ei), err
+}
+
+func (o ops) CreateDir(ctx context.Context, dir Node, name string) (
+	Node, EntryInfo, error) {
+	n, ei, err := o.kbfsOps.CreateDir(ctx, dir, name)
+	return n, MakeEntryInfo(ei), err
+}
+
+func (o ops) CreateFile(ctx context.Context, dir Node, name string,
+	isExec bool, excl Excl) (Node, EntryInfo, error) {
+	n, ei, err := o.kbfsOps.CreateFile(
+		ctx, dir, name, isExec, libkbfs.Excl(excl))
+	return n, MakeEntryInfo(ei), err
+}
+
+func (o ops) CreateLink(ctx context.Context, dir Node, fromName string,
+	toPath string) (EntryInfo, error) {
+	ei, err := o.kbfsOps.CreateLink(ctx, dir, fromName, toPath)
+	return MakeEntryInfo(ei), err
+}
+
+func (o ops) RemoveDir(ctx context.Context, dir Node, dirName string) error {
+	return o.kbfsOps.RemoveDir(ctx, dir, dirName)
+}
+
+func (o ops) RemoveEntry(ctx context.Context, dir Node, name string) error {
+	return o.kbfsOps.RemoveEntry(ctx, dir, name)
+}
+
+func (o ops) Rename(ctx context.Context, oldParent Node, oldName string,
+	newParent Node, newName string) error {
+	return o.kbfsOps.Rename(ctx, oldParent, oldName, newParent, newName)
+}
+
+func (o ops) Read(ctx context.Context, file Node, dest []byte, off int64) (
+	int64, error) {
+	return o.kbfsOps.Read(ctx, file, dest, off)
+}
+
+func (o ops) Write(
+	ctx context.Context, file Node, data []byte, off int64) error {
+	return o.kbfsOps.Write(ctx, file, data, off)
+}
+
+func (o ops) Truncate(ctx context.Context, file Node, size uint64) error {
+	return o.kbfsOps.Truncate(ctx, file, size)
+}
+
+func (o ops) SetEx(ctx context.Context, file Node, ex bool) error {
+	return o.kbfsOps.SetEx(ctx, file, ex)
+}
+
+func (o ops) SetMtime(
+	ctx context.Context, file Node, mtime *time.Time) error {
+	return o.kbfsOps.SetMtime(ctx, file, mtime)
+}
+
+func (o ops) Sync(ctx context.Context, file Node) error {
+	return o.kbfsOps.Sync(ctx, file)
+}
+
+func (o ops) FolderStatus(ctx context.Context, folderBranch FolderBranch) (
+	FolderBranchStatus, error) {
+	status, _, err := o.kbfsOps.FolderStatus(ctx, folderBranch.toLibkbfs())
+	return FolderBranchStatus(status), err
+}
+
+func (o ops) Status(ctx context.Context) (KBFSStatus, error) {
+	status, _, err := o.kbfsOps.Status(ctx)
+	return KBFSStatus(status), err
+}
+
+// notifier implements Notifier on top of a libkbfs.Notifier.
+type notifier struct {
+	n libkbfs.Notifier
+}
+
+var _ Notifier = notifier{}
+
+func toLibkbfsFolderBranches(
+	folderBranches []FolderBranch) []libkbfs.FolderBranch {
+	ret := make([]libkbfs.FolderBranch, len(folderBranches))
+	for i, fb := range folderBranches {
+		ret[i] = fb.toLibkbfs()
+	}
+	return ret
+}
+
+func (n notifier) RegisterForChanges(
+	folderBranches []FolderBranch, obs Observer) error {
+	return n.n.RegisterForChanges(toLibkbfsFolderBranches(folderBranches), obs)
+}
+
+func (n notifier) UnregisterFromChanges(
+	folderBranches []FolderBranch, obs Observer) error {
+	return n.n.UnregisterFromChanges(
+		toLibkbfsFolderBranches(folderBranches), obs)
+}
@@ -156,8 +156,14 @@ func NewMsgpackNoUnknownFields() *CodecMsgpack {
 	return newCodecMsgpackHelper(false)
 }
 
-// Decode implements the Codec interface for CodecMsgpack
+// Decode implements the Codec interface for CodecMsgpack.  Since buf
+// may come from an untrusted server, it first makes sure that buf
+// doesn't declare any lengths that it can't back up, so that the
+// decoder never over-allocates.
 func (c *CodecMsgpack) Decode(buf []byte, obj interface{}) (err error) {
+	if err := checkMsgpackLengths(buf); err != nil {
+		return err
+	}
 	err = codec.NewDecoderBytes(buf, c.h).Decode(obj)
 	return
 }
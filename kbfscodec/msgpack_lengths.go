@@ -0,0 +1,136 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfscodec
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MsgpackLengthError indicates that a msgpack-encoded buffer declares
+// a string, byte slice, array, map or extension that is longer than
+// the rest of the buffer, which can only happen if the buffer is
+// malformed.
+type MsgpackLengthError struct {
+	Offset    int
+	Length    uint64
+	Remaining int
+}
+
+// Error implements the error interface for MsgpackLengthError.
+func (e MsgpackLengthError) Error() string {
+	return fmt.Sprintf("msgpack length %d at offset %d exceeds the "+
+		"remaining %d bytes", e.Length, e.Offset, e.Remaining)
+}
+
+// checkMsgpackLengths scans the first msgpack object in buf, and
+// returns a MsgpackLengthError if any length it declares couldn't
+// possibly fit in the rest of buf.  Otherwise, the codec would
+// allocate whatever a malformed or malicious length asks for before
+// finding out that the data isn't there.  Since every array element
+// and map key or value takes at least one byte, the same bound works
+// for element counts.  Any other problems, such as a truncated
+// buffer, are left for the decoder to report.
+//
+// Note that this only catches lengths that are wrong for the types
+// actually encoded in buf.  The decoder will also read, for example,
+// a negative fixint as a short string if that's what the target type
+// calls for, after which it's reading from the wrong offsets and
+// can still be talked into a large allocation.
+func checkMsgpackLengths(buf []byte) error {
+	pos := 0
+	// pending counts the objects that still need to be scanned;
+	// tracking it instead of recursing keeps deeply nested input
+	// from blowing up the stack.
+	pending := uint64(1)
+	readUint := func(size int) (uint64, bool) {
+		if len(buf)-pos < size {
+			return 0, false
+		}
+		b := buf[pos : pos+size]
+		pos += size
+		switch size {
+		case 1:
+			return uint64(b[0]), true
+		case 2:
+			return uint64(binary.BigEndian.Uint16(b)), true
+		case 4:
+			return uint64(binary.BigEndian.Uint32(b)), true
+		default:
+			return binary.BigEndian.Uint64(b), true
+		}
+	}
+	for ; pending > 0; pending-- {
+		if pos >= len(buf) {
+			return nil
+		}
+		start := pos
+		b := buf[pos]
+		pos++
+
+		// skip is the number of payload bytes after the header,
+		// and children is the number of nested objects.
+		var skip, children uint64
+		var ok = true
+		switch {
+		case b <= 0x7f, b >= 0xe0, b == 0xc0, b == 0xc2, b == 0xc3:
+			// Fixints, nil and bools.
+		case b >= 0x80 && b <= 0x8f:
+			children = 2 * uint64(b&0x0f)
+		case b >= 0x90 && b <= 0x9f:
+			children = uint64(b & 0x0f)
+		case b >= 0xa0 && b <= 0xbf:
+			skip = uint64(b & 0x1f)
+		case b == 0xc4, b == 0xd9:
+			skip, ok = readUint(1)
+		case b == 0xc5, b == 0xda:
+			skip, ok = readUint(2)
+		case b == 0xc6, b == 0xdb:
+			skip, ok = readUint(4)
+		case b == 0xc7, b == 0xc8, b == 0xc9:
+			skip, ok = readUint(1 << (b - 0xc7))
+			// Plus the extension type.
+			skip++
+		case b == 0xca:
+			skip = 4
+		case b == 0xcb:
+			skip = 8
+		case b >= 0xcc && b <= 0xcf:
+			skip = 1 << (b - 0xcc)
+		case b >= 0xd0 && b <= 0xd3:
+			skip = 1 << (b - 0xd0)
+		case b >= 0xd4 && b <= 0xd8:
+			// The extension type, plus the data.
+			skip = 1 + 1<<(b-0xd4)
+		case b == 0xdc:
+			children, ok = readUint(2)
+		case b == 0xdd:
+			children, ok = readUint(4)
+		case b == 0xde:
+			children, ok = readUint(2)
+			children *= 2
+		case b == 0xdf:
+			children, ok = readUint(4)
+			children *= 2
+		default:
+			// 0xc1 is never used; scan past it and let the
+			// decoder complain.
+		}
+		if !ok {
+			return nil
+		}
+
+		remaining := len(buf) - pos
+		if skip > uint64(remaining) {
+			return MsgpackLengthError{start, skip, remaining}
+		}
+		pos += int(skip)
+		if pending-1+children > uint64(len(buf)-pos) {
+			return MsgpackLengthError{start, children, len(buf) - pos}
+		}
+		pending += children
+	}
+	return nil
+}
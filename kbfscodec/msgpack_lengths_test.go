@@ -0,0 +1,81 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfscodec
+
+import (
+	"bytes"
+	"testing"
+)
+
+type lengthsTestStruct struct {
+	A []byte
+	B string
+	C []int
+	D map[string]float64
+	E *lengthsTestStruct
+}
+
+// Test that checkMsgpackLengths accepts everything the codec encodes.
+func TestCheckMsgpackLengthsValid(t *testing.T) {
+	s := lengthsTestStruct{
+		A: bytes.Repeat([]byte{1}, 70000),
+		B: "hello",
+		C: []int{-1, 0, 1, 300, 70000, 1 << 40},
+		D: map[string]float64{"pi": 3.14},
+		E: &lengthsTestStruct{B: string(bytes.Repeat([]byte{'x'}, 300))},
+	}
+	for _, codec := range []*CodecMsgpack{NewMsgpack(), NewMsgpack().ExtCodec} {
+		buf, err := codec.Encode(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkMsgpackLengths(buf); err != nil {
+			t.Fatal(err)
+		}
+		var s2 lengthsTestStruct
+		if err := codec.Decode(buf, &s2); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Test that lengths and counts that overrun the buffer are rejected
+// before decoding.
+func TestCheckMsgpackLengthsOverrun(t *testing.T) {
+	for _, buf := range [][]byte{
+		// bin32 of length 0xbc1b6443.
+		{0xc6, 0xbc, 0x1b, 0x64, 0x43, 0x00},
+		// str16 of length 0x100.
+		{0xda, 0x01, 0x00, 'a'},
+		// array32 of 0x10000 elements.
+		{0xdd, 0x00, 0x01, 0x00, 0x00, 0x01, 0x02},
+		// map16 of 2 entries, with only 3 objects.
+		{0xde, 0x00, 0x02, 0x01, 0x02, 0x03},
+		// A fixarray holding an overlong fixstr.
+		{0x91, 0xa5, 'a'},
+	} {
+		err := checkMsgpackLengths(buf)
+		if _, ok := err.(MsgpackLengthError); !ok {
+			t.Errorf("Unexpected error for %v: %v", buf, err)
+		}
+		var v interface{}
+		if err := NewMsgpack().Decode(buf, &v); err == nil {
+			t.Errorf("Decoded %v unexpectedly", buf)
+		}
+	}
+}
+
+// Test that deeply nested input doesn't need deep recursion to
+// check.
+func TestCheckMsgpackLengthsDeep(t *testing.T) {
+	buf := append(bytes.Repeat([]byte{0x91}, 1<<20), 0xc0)
+	if err := checkMsgpackLengths(buf); err != nil {
+		t.Fatal(err)
+	}
+	err := checkMsgpackLengths(buf[:len(buf)-1])
+	if _, ok := err.(MsgpackLengthError); !ok {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
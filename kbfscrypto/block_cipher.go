@@ -0,0 +1,141 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfscrypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+
+	"github.com/keybase/client/go/libkb"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// A BlockCipher is an authenticated symmetric cipher with 32-byte
+// keys, like BlockCryptKeys, that data can be sealed with.  Each
+// cipher has its own nonce size, and a nonce must never be used
+// twice with the same key.
+type BlockCipher interface {
+	// NonceSize returns the size of the nonces used by Seal and
+	// Open.
+	NonceSize() int
+	// Overhead returns how much longer sealed data is than the
+	// data it was sealed from.
+	Overhead() int
+	// Seal encrypts and authenticates data with the given key and
+	// nonce, which must be NonceSize() bytes long, and appends the
+	// result to out.  out and data must not overlap.
+	Seal(out, data, nonce []byte, key [32]byte) ([]byte, error)
+	// Open checks and decrypts data sealed by Seal, and appends
+	// the result to out.  out and sealed must not overlap.  It
+	// returns libkb.DecryptionError if sealed wasn't sealed with
+	// the given key and nonce, or has been tampered with.
+	Open(out, sealed, nonce []byte, key [32]byte) ([]byte, error)
+}
+
+// SecretboxCipher is a BlockCipher that uses nacl/secretbox, i.e.
+// XSalsa20 and Poly1305.
+type SecretboxCipher struct{}
+
+var _ BlockCipher = SecretboxCipher{}
+
+const secretboxNonceSize = 24
+
+// NonceSize implements BlockCipher for SecretboxCipher.
+func (SecretboxCipher) NonceSize() int {
+	return secretboxNonceSize
+}
+
+// Overhead implements BlockCipher for SecretboxCipher.
+func (SecretboxCipher) Overhead() int {
+	return secretbox.Overhead
+}
+
+// Seal implements BlockCipher for SecretboxCipher.
+func (SecretboxCipher) Seal(out, data, nonce []byte, key [32]byte) (
+	[]byte, error) {
+	if len(nonce) != secretboxNonceSize {
+		return nil, InvalidNonceSizeError{len(nonce), secretboxNonceSize}
+	}
+	var n [secretboxNonceSize]byte
+	copy(n[:], nonce)
+	return secretbox.Seal(out, data, &n, &key), nil
+}
+
+// Open implements BlockCipher for SecretboxCipher.
+func (SecretboxCipher) Open(out, sealed, nonce []byte, key [32]byte) (
+	[]byte, error) {
+	if len(nonce) != secretboxNonceSize {
+		return nil, InvalidNonceSizeError{len(nonce), secretboxNonceSize}
+	}
+	var n [secretboxNonceSize]byte
+	copy(n[:], nonce)
+	data, ok := secretbox.Open(out, sealed, &n, &key)
+	if !ok {
+		return nil, libkb.DecryptionError{}
+	}
+	return data, nil
+}
+
+// AESGCMCipher is a BlockCipher that uses AES-256 in GCM mode.  It's
+// much faster than SecretboxCipher on CPUs with AES instructions,
+// which Go uses when they're there, but slower (and not constant
+// time) on those without.
+type AESGCMCipher struct{}
+
+var _ BlockCipher = AESGCMCipher{}
+
+const (
+	aesGCMNonceSize = 12
+	// aesGCMOverhead is the size of the GCM tag.
+	aesGCMOverhead = 16
+)
+
+func newAESGCM(key [32]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NonceSize implements BlockCipher for AESGCMCipher.
+func (AESGCMCipher) NonceSize() int {
+	return aesGCMNonceSize
+}
+
+// Overhead implements BlockCipher for AESGCMCipher.
+func (AESGCMCipher) Overhead() int {
+	return aesGCMOverhead
+}
+
+// Seal implements BlockCipher for AESGCMCipher.
+func (AESGCMCipher) Seal(out, data, nonce []byte, key [32]byte) (
+	[]byte, error) {
+	if len(nonce) != aesGCMNonceSize {
+		return nil, InvalidNonceSizeError{len(nonce), aesGCMNonceSize}
+	}
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, data, nil), nil
+}
+
+// Open implements BlockCipher for AESGCMCipher.
+func (AESGCMCipher) Open(out, sealed, nonce []byte, key [32]byte) (
+	[]byte, error) {
+	if len(nonce) != aesGCMNonceSize {
+		return nil, InvalidNonceSizeError{len(nonce), aesGCMNonceSize}
+	}
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := aead.Open(out, nonce, sealed, nil)
+	if err != nil {
+		return nil, libkb.DecryptionError{}
+	}
+	return data, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfscrypto
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+func testBlockCipherSealOpen(t *testing.T, c BlockCipher) {
+	var key [32]byte
+	require.NoError(t, RandRead(key[:]))
+	nonce := make([]byte, c.NonceSize())
+	require.NoError(t, RandRead(nonce))
+
+	data := []byte("some block data")
+	sealed, err := c.Seal(nil, data, nonce, key)
+	require.NoError(t, err)
+	require.Len(t, sealed, len(data)+c.Overhead())
+	opened, err := c.Open(nil, sealed, nonce, key)
+	require.NoError(t, err)
+	require.Equal(t, data, opened)
+
+	// Seal and Open append to out, reusing its capacity.
+	prefix := []byte("prefix")
+	out := make([]byte, len(prefix), len(prefix)+len(sealed))
+	copy(out, prefix)
+	appended, err := c.Seal(out, data, nonce, key)
+	require.NoError(t, err)
+	require.Equal(t, append(prefix, sealed...), appended)
+	require.True(t, &out[0] == &appended[0])
+	appended, err = c.Open(out[:len(prefix)], sealed, nonce, key)
+	require.NoError(t, err)
+	require.Equal(t, append(prefix, data...), appended)
+
+	// Tampered data, or the wrong key or nonce, don't open.
+	sealed[0] ^= 1
+	_, err = c.Open(nil, sealed, nonce, key)
+	require.Equal(t, libkb.DecryptionError{}, err)
+	sealed[0] ^= 1
+	otherKey := key
+	otherKey[0] ^= 1
+	_, err = c.Open(nil, sealed, nonce, otherKey)
+	require.Equal(t, libkb.DecryptionError{}, err)
+	nonce[0] ^= 1
+	_, err = c.Open(nil, sealed, nonce, key)
+	require.Equal(t, libkb.DecryptionError{}, err)
+
+	_, err = c.Seal(nil, data, nonce[1:], key)
+	require.Equal(t,
+		InvalidNonceSizeError{c.NonceSize() - 1, c.NonceSize()}, err)
+	_, err = c.Open(nil, sealed, nonce[1:], key)
+	require.Equal(t,
+		InvalidNonceSizeError{c.NonceSize() - 1, c.NonceSize()}, err)
+}
+
+func TestSecretboxCipherSealOpen(t *testing.T) {
+	testBlockCipherSealOpen(t, SecretboxCipher{})
+}
+
+func TestAESGCMCipherSealOpen(t *testing.T) {
+	testBlockCipherSealOpen(t, AESGCMCipher{})
+}
+
+// Test that SecretboxCipher seals data the same way nacl/secretbox
+// does, so that it can open everything sealed before it existed.
+func TestSecretboxCipherCompatibility(t *testing.T) {
+	key := [32]byte{1}
+	nonce := [24]byte{2}
+	data := []byte("some block data")
+	sealed, err := SecretboxCipher{}.Seal(nil, data, nonce[:], key)
+	require.NoError(t, err)
+	require.Equal(t, secretbox.Seal(nil, data, &nonce, &key), sealed)
+}
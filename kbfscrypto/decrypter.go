@@ -0,0 +1,41 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfscrypto
+
+import (
+	"github.com/keybase/client/go/libkb"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/context"
+)
+
+// A Decrypter is something that can decrypt using an internal crypt
+// private key.
+type Decrypter interface {
+	// DecryptBoxed opens data that was sealed with nacl/box,
+	// using the given nonce, by the holder of the private key
+	// for peersPublicKey, for the internal private key.  It
+	// returns libkb.DecryptionError if the data can't be opened.
+	DecryptBoxed(ctx context.Context, peersPublicKey [32]byte,
+		nonce [24]byte, boxed []byte) ([]byte, error)
+}
+
+// CryptPrivateKeyDecrypter is a Decrypter wrapper around a
+// CryptPrivateKey.
+type CryptPrivateKeyDecrypter struct {
+	Key CryptPrivateKey
+}
+
+// DecryptBoxed implements Decrypter for CryptPrivateKeyDecrypter.
+func (d CryptPrivateKeyDecrypter) DecryptBoxed(ctx context.Context,
+	peersPublicKey [32]byte, nonce [24]byte, boxed []byte) (
+	[]byte, error) {
+	privateKeyData := d.Key.Data()
+	data, ok := box.Open(
+		nil, boxed, &nonce, &peersPublicKey, &privateKeyData)
+	if !ok {
+		return nil, libkb.DecryptionError{}
+	}
+	return data, nil
+}
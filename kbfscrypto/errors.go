@@ -39,3 +39,64 @@ type UnknownSigVer struct {
 func (e UnknownSigVer) Error() string {
 	return fmt.Sprintf("Unknown signature version %d", int(e.Ver))
 }
+
+// NoStorageKeysError is returned when a StorageKeyring would have no
+// keys.
+type NoStorageKeysError struct{}
+
+func (e NoStorageKeysError) Error() string {
+	return "No storage keys"
+}
+
+// InvalidStorageSealError is returned when data to be opened by a
+// StorageKeyring is too short to have been sealed by one.
+type InvalidStorageSealError struct {
+	Len int
+}
+
+func (e InvalidStorageSealError) Error() string {
+	return fmt.Sprintf("Sealed data too short (%d bytes)", e.Len)
+}
+
+// UnknownStorageSealVersionError is returned when data to be opened
+// by a StorageKeyring has an unknown version.
+type UnknownStorageSealVersionError struct {
+	Version byte
+}
+
+func (e UnknownStorageSealVersionError) Error() string {
+	return fmt.Sprintf("Unknown storage seal version %d", e.Version)
+}
+
+// UnknownStorageKeyGenError is returned when data to be opened by a
+// StorageKeyring was sealed with a key generation it doesn't have.
+type UnknownStorageKeyGenError struct {
+	Gen StorageKeyGen
+}
+
+func (e UnknownStorageKeyGenError) Error() string {
+	return fmt.Sprintf("Unknown storage key generation %d", e.Gen)
+}
+
+// StorageOpenError is returned when sealed data fails to decrypt
+// or authenticate.
+type StorageOpenError struct {
+	Gen StorageKeyGen
+}
+
+func (e StorageOpenError) Error() string {
+	return fmt.Sprintf(
+		"Failed to open data sealed with storage key generation %d", e.Gen)
+}
+
+// InvalidNonceSizeError is returned when a BlockCipher is given a
+// nonce of the wrong size.
+type InvalidNonceSizeError struct {
+	Size     int
+	Expected int
+}
+
+func (e InvalidNonceSizeError) Error() string {
+	return fmt.Sprintf("Invalid nonce size %d (expected %d)",
+		e.Size, e.Expected)
+}
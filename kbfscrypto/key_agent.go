@@ -0,0 +1,154 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfscrypto
+
+import (
+	"encoding/base64"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"golang.org/x/net/context"
+)
+
+// A KeyAgent holds a device's private keys outside of KBFS, for
+// example in a PKCS#11 token, a TPM, or a Secure Enclave, and does
+// the primitive operations that need them.  Everything else is done
+// by KeyAgentSigner and KeyAgentDecrypter, so the private keys never
+// have to be in KBFS's memory.
+type KeyAgent interface {
+	// SignED25519 signs msg, as is, with the device's signing
+	// key, and returns the signature along with the key's public
+	// half.
+	SignED25519(ctx context.Context, msg []byte) (
+		keybase1.ED25519SignatureInfo, error)
+	// BoxOpen opens data that was sealed with nacl/box for the
+	// device's crypt key, like Decrypter.DecryptBoxed.
+	BoxOpen(ctx context.Context, peersPublicKey [32]byte,
+		nonce [24]byte, boxed []byte) ([]byte, error)
+}
+
+// KeyAgentSigner is a Signer wrapper around a KeyAgent.
+type KeyAgentSigner struct {
+	Agent KeyAgent
+}
+
+func (s KeyAgentSigner) signED25519(ctx context.Context, version SigVer,
+	msg []byte) (SignatureInfo, error) {
+	ed25519SigInfo, err := s.Agent.SignED25519(ctx, msg)
+	if err != nil {
+		return SignatureInfo{}, err
+	}
+	return SignatureInfo{
+		Version:   version,
+		Signature: ed25519SigInfo.Sig[:],
+		VerifyingKey: MakeVerifyingKey(libkb.NaclSigningKeyPublic(
+			ed25519SigInfo.PublicKey).GetKID()),
+	}, nil
+}
+
+// Sign implements Signer for KeyAgentSigner.
+func (s KeyAgentSigner) Sign(
+	ctx context.Context, msg []byte) (SignatureInfo, error) {
+	return s.signED25519(ctx, SigED25519, msg)
+}
+
+// SignForKBFS implements Signer for KeyAgentSigner.
+func (s KeyAgentSigner) SignForKBFS(
+	ctx context.Context, msg []byte) (SignatureInfo, error) {
+	return s.signED25519(
+		ctx, SigED25519ForKBFS, libkb.SignaturePrefixKBFS.Prefix(msg))
+}
+
+// SignToString implements Signer for KeyAgentSigner.  It builds the
+// same serialized NaclSigInfo that SigningKey.SignToString does.
+func (s KeyAgentSigner) SignToString(
+	ctx context.Context, msg []byte) (signature string, err error) {
+	ed25519SigInfo, err := s.Agent.SignED25519(ctx, msg)
+	if err != nil {
+		return "", err
+	}
+	naclSigInfo := libkb.NaclSigInfo{
+		Kid: libkb.NaclSigningKeyPublic(
+			ed25519SigInfo.PublicKey).GetBinaryKID(),
+		Payload:  msg,
+		Sig:      libkb.NaclSignature(ed25519SigInfo.Sig),
+		SigType:  libkb.SigKbEddsa,
+		HashType: libkb.HashPGPSha512,
+		Detached: true,
+	}
+	packet, err := naclSigInfo.ToPacket()
+	if err != nil {
+		return "", err
+	}
+	body, err := packet.Encode()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(body), nil
+}
+
+// KeyAgentDecrypter is a Decrypter wrapper around a KeyAgent.
+type KeyAgentDecrypter struct {
+	Agent KeyAgent
+}
+
+// DecryptBoxed implements Decrypter for KeyAgentDecrypter.
+func (d KeyAgentDecrypter) DecryptBoxed(ctx context.Context,
+	peersPublicKey [32]byte, nonce [24]byte, boxed []byte) (
+	[]byte, error) {
+	return d.Agent.BoxOpen(ctx, peersPublicKey, nonce, boxed)
+}
+
+// keyAgentSignED25519Arg is the argument of the
+// kbfs.1.keyAgent.signED25519 RPC.
+type keyAgentSignED25519Arg struct {
+	Msg []byte `codec:"msg"`
+}
+
+// keyAgentBoxOpenArg is the argument of the kbfs.1.keyAgent.boxOpen
+// RPC.
+type keyAgentBoxOpenArg struct {
+	PeersPublicKey [32]byte `codec:"peersPublicKey"`
+	Nonce          [24]byte `codec:"nonce"`
+	Boxed          []byte   `codec:"boxed"`
+}
+
+// KeyAgentClient is a KeyAgent that makes RPCs to an agent process,
+// which serves the kbfs.1.keyAgent protocol:
+//
+//	signED25519(msg: bytes) -> ED25519SignatureInfo
+//	boxOpen(peersPublicKey: Bytes32, nonce: BoxNonce, boxed: bytes) -> bytes
+//
+// When boxOpen can't open the data, the agent should return an error
+// that unwraps to libkb.DecryptionError.
+type KeyAgentClient struct {
+	Cli rpc.GenericClient
+}
+
+var _ KeyAgent = KeyAgentClient{}
+
+// SignED25519 implements KeyAgent for KeyAgentClient.
+func (c KeyAgentClient) SignED25519(ctx context.Context, msg []byte) (
+	res keybase1.ED25519SignatureInfo, err error) {
+	arg := keyAgentSignED25519Arg{Msg: msg}
+	err = c.Cli.Call(ctx, "kbfs.1.keyAgent.signED25519",
+		[]interface{}{arg}, &res)
+	return res, err
+}
+
+// BoxOpen implements KeyAgent for KeyAgentClient.
+func (c KeyAgentClient) BoxOpen(ctx context.Context,
+	peersPublicKey [32]byte, nonce [24]byte, boxed []byte) (
+	res []byte, err error) {
+	arg := keyAgentBoxOpenArg{
+		PeersPublicKey: peersPublicKey,
+		Nonce:          nonce,
+		Boxed:          boxed,
+	}
+	err = c.Cli.Call(ctx, "kbfs.1.keyAgent.boxOpen",
+		[]interface{}{arg}, &res)
+	return res, err
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfscrypto
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/context"
+)
+
+// Test that KeyAgentSigner makes the same signatures as
+// SigningKeySigner does with the same key.
+func TestKeyAgentSigner(t *testing.T) {
+	ctx := context.Background()
+	agent := MakeFakeKeyAgentOrBust("agent")
+	local := SigningKeySigner{agent.SigningKey}
+	signer := KeyAgentSigner{agent}
+	msg := []byte("message")
+
+	expected, err := local.Sign(ctx, msg)
+	require.NoError(t, err)
+	sigInfo, err := signer.Sign(ctx, msg)
+	require.NoError(t, err)
+	require.Equal(t, expected, sigInfo)
+	require.NoError(t, Verify(msg, sigInfo))
+
+	expected, err = local.SignForKBFS(ctx, msg)
+	require.NoError(t, err)
+	sigInfo, err = signer.SignForKBFS(ctx, msg)
+	require.NoError(t, err)
+	require.Equal(t, expected, sigInfo)
+	require.NoError(t, Verify(msg, sigInfo))
+
+	expectedStr, err := local.SignToString(ctx, msg)
+	require.NoError(t, err)
+	sigStr, err := signer.SignToString(ctx, msg)
+	require.NoError(t, err)
+	require.Equal(t, expectedStr, sigStr)
+}
+
+// Test that KeyAgentDecrypter opens what CryptPrivateKeyDecrypter
+// does with the same key.
+func TestKeyAgentDecrypter(t *testing.T) {
+	ctx := context.Background()
+	agent := MakeFakeKeyAgentOrBust("agent")
+	local := CryptPrivateKeyDecrypter{agent.CryptKey}
+	decrypter := KeyAgentDecrypter{agent}
+
+	ePubKey, ePrivKey, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var nonce [24]byte
+	err = RandRead(nonce[:])
+	require.NoError(t, err)
+	publicKeyData := agent.CryptKey.kp.Public
+	data := []byte("data")
+	boxed := box.Seal(nil, data, &nonce, (*[32]byte)(&publicKeyData),
+		ePrivKey)
+
+	opened, err := local.DecryptBoxed(ctx, *ePubKey, nonce, boxed)
+	require.NoError(t, err)
+	require.Equal(t, data, opened)
+	opened, err = decrypter.DecryptBoxed(ctx, *ePubKey, nonce, boxed)
+	require.NoError(t, err)
+	require.Equal(t, data, opened)
+
+	boxed[0] ^= 1
+	_, err = decrypter.DecryptBoxed(ctx, *ePubKey, nonce, boxed)
+	require.Equal(t, libkb.DecryptionError{}, err)
+}
@@ -0,0 +1,162 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfscrypto
+
+import (
+	"encoding"
+	"encoding/binary"
+	"sync"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// StorageKey is a per-device key used to encrypt data that KBFS
+// stores on local disk, like block journals, so that the data can't
+// be read at rest without the device's crypt private key, which the
+// storage key is wrapped with.
+//
+// Copies of StorageKey objects are deep copies.
+type StorageKey struct {
+	// Should only be used by implementations of Crypto.
+	byte32Container
+}
+
+var _ encoding.BinaryMarshaler = StorageKey{}
+var _ encoding.BinaryUnmarshaler = (*StorageKey)(nil)
+
+// MakeStorageKey returns a StorageKey containing the given data.
+func MakeStorageKey(data [32]byte) StorageKey {
+	return StorageKey{byte32Container{data}}
+}
+
+// MakeRandomStorageKey returns a new random StorageKey.
+func MakeRandomStorageKey() (StorageKey, error) {
+	var data [32]byte
+	err := RandRead(data[:])
+	if err != nil {
+		return StorageKey{}, err
+	}
+	return MakeStorageKey(data), nil
+}
+
+// StorageKeyGen is the generation of a StorageKey in a
+// StorageKeyring.
+type StorageKeyGen int
+
+// FirstValidStorageKeyGen is the generation of the first key in a
+// StorageKeyring.
+const FirstValidStorageKeyGen StorageKeyGen = 1
+
+const (
+	// storageSealVersion is the version byte that starts sealed
+	// data.
+	storageSealVersion    byte = 1
+	storageSealGenSize         = 4
+	storageSealNonceSize       = 24
+	storageSealHeaderSize      = 1 + storageSealGenSize + storageSealNonceSize
+
+	// StorageSealOverhead is the number of bytes that
+	// StorageKeyring.Seal adds to the data it seals.
+	StorageSealOverhead = storageSealHeaderSize + secretbox.Overhead
+)
+
+// StorageKeyring holds all the generations of a device's storage
+// key.  Data is always sealed with the latest generation, and can be
+// opened with any of them, so rotating in a new key doesn't make
+// previously sealed data unreadable.  It is goroutine-safe.
+type StorageKeyring struct {
+	lock sync.RWMutex
+	// keys[i] is the key of generation i+1.
+	keys []StorageKey
+}
+
+// NewStorageKeyring returns a StorageKeyring holding the given keys,
+// oldest generation first.
+func NewStorageKeyring(keys []StorageKey) (*StorageKeyring, error) {
+	if len(keys) == 0 {
+		return nil, NoStorageKeysError{}
+	}
+	return &StorageKeyring{
+		keys: append([]StorageKey(nil), keys...),
+	}, nil
+}
+
+// Keys returns all the keys in the keyring, oldest generation first.
+func (r *StorageKeyring) Keys() []StorageKey {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return append([]StorageKey(nil), r.keys...)
+}
+
+// LatestGen returns the generation of the key used for sealing.
+func (r *StorageKeyring) LatestGen() StorageKeyGen {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return StorageKeyGen(len(r.keys))
+}
+
+// Rotate adds key to the keyring as its latest generation, which is
+// returned.  Callers should persist the new key before calling this,
+// since data sealed afterwards can only be opened with it.
+func (r *StorageKeyring) Rotate(key StorageKey) StorageKeyGen {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.keys = append(r.keys, key)
+	return StorageKeyGen(len(r.keys))
+}
+
+func (r *StorageKeyring) getKey(gen StorageKeyGen) (StorageKey, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if gen < FirstValidStorageKeyGen || int(gen) > len(r.keys) {
+		return StorageKey{}, UnknownStorageKeyGenError{gen}
+	}
+	return r.keys[gen-1], nil
+}
+
+// Seal encrypts and authenticates data with the latest key.  The
+// result is StorageSealOverhead bytes longer than data.
+func (r *StorageKeyring) Seal(data []byte) ([]byte, error) {
+	r.lock.RLock()
+	gen := StorageKeyGen(len(r.keys))
+	key := r.keys[gen-1]
+	r.lock.RUnlock()
+
+	sealed := make([]byte, storageSealHeaderSize,
+		len(data)+StorageSealOverhead)
+	sealed[0] = storageSealVersion
+	binary.BigEndian.PutUint32(sealed[1:], uint32(gen))
+	var nonce [storageSealNonceSize]byte
+	err := RandRead(nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	copy(sealed[1+storageSealGenSize:], nonce[:])
+	return secretbox.Seal(sealed, data, &nonce, &key.data), nil
+}
+
+// Open decrypts data sealed by Seal, with whichever key generation
+// sealed it.
+func (r *StorageKeyring) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < StorageSealOverhead {
+		return nil, InvalidStorageSealError{len(sealed)}
+	}
+	if sealed[0] != storageSealVersion {
+		return nil, UnknownStorageSealVersionError{sealed[0]}
+	}
+	gen := StorageKeyGen(binary.BigEndian.Uint32(sealed[1:]))
+	key, err := r.getKey(gen)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [storageSealNonceSize]byte
+	copy(nonce[:], sealed[1+storageSealGenSize:storageSealHeaderSize])
+	data, ok := secretbox.Open(
+		nil, sealed[storageSealHeaderSize:], &nonce, &key.data)
+	if !ok {
+		return nil, StorageOpenError{gen}
+	}
+	return data, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfscrypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageKeyringSealOpen(t *testing.T) {
+	_, err := NewStorageKeyring(nil)
+	require.Equal(t, NoStorageKeysError{}, err)
+
+	key1, err := MakeRandomStorageKey()
+	require.NoError(t, err)
+	r, err := NewStorageKeyring([]StorageKey{key1})
+	require.NoError(t, err)
+	require.Equal(t, FirstValidStorageKeyGen, r.LatestGen())
+
+	data := []byte("some block data")
+	sealed1, err := r.Seal(data)
+	require.NoError(t, err)
+	require.Len(t, sealed1, len(data)+StorageSealOverhead)
+	opened, err := r.Open(sealed1)
+	require.NoError(t, err)
+	require.Equal(t, data, opened)
+
+	// Data sealed before a rotation can still be opened after it.
+	key2, err := MakeRandomStorageKey()
+	require.NoError(t, err)
+	require.Equal(t, FirstValidStorageKeyGen+1, r.Rotate(key2))
+	sealed2, err := r.Seal(data)
+	require.NoError(t, err)
+	opened, err = r.Open(sealed1)
+	require.NoError(t, err)
+	require.Equal(t, data, opened)
+	opened, err = r.Open(sealed2)
+	require.NoError(t, err)
+	require.Equal(t, data, opened)
+	require.Equal(t, []StorageKey{key1, key2}, r.Keys())
+
+	// A keyring without the new key can't open data sealed with
+	// it.
+	r1, err := NewStorageKeyring([]StorageKey{key1})
+	require.NoError(t, err)
+	_, err = r1.Open(sealed2)
+	require.Equal(t,
+		UnknownStorageKeyGenError{FirstValidStorageKeyGen + 1}, err)
+
+	// Tampering is detected.
+	sealed1[len(sealed1)-1] ^= 1
+	_, err = r.Open(sealed1)
+	require.Equal(t, StorageOpenError{FirstValidStorageKeyGen}, err)
+
+	_, err = r.Open(sealed2[:StorageSealOverhead-1])
+	require.Equal(t, InvalidStorageSealError{StorageSealOverhead - 1}, err)
+	sealed2[0] = 2
+	_, err = r.Open(sealed2)
+	require.Equal(t, UnknownStorageSealVersionError{2}, err)
+}
@@ -8,6 +8,8 @@ import (
 	"strings"
 
 	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
 )
 
 // The functions below must be used only in tests.
@@ -60,3 +62,36 @@ func MakeFakeCryptPublicKeyOrBust(seed string) CryptPublicKey {
 	k := MakeFakeCryptPrivateKeyOrBust(seed)
 	return k.GetPublicKey()
 }
+
+// FakeKeyAgent is a KeyAgent that holds its keys in memory.
+type FakeKeyAgent struct {
+	SigningKey SigningKey
+	CryptKey   CryptPrivateKey
+}
+
+var _ KeyAgent = FakeKeyAgent{}
+
+// MakeFakeKeyAgentOrBust makes a FakeKeyAgent holding the fake
+// signing and crypt private keys made with the given seed.
+func MakeFakeKeyAgentOrBust(seed string) FakeKeyAgent {
+	return FakeKeyAgent{
+		SigningKey: MakeFakeSigningKeyOrBust(seed),
+		CryptKey:   MakeFakeCryptPrivateKeyOrBust(seed),
+	}
+}
+
+// SignED25519 implements KeyAgent for FakeKeyAgent.
+func (a FakeKeyAgent) SignED25519(ctx context.Context, msg []byte) (
+	res keybase1.ED25519SignatureInfo, err error) {
+	copy(res.Sig[:], a.SigningKey.Sign(msg).Signature)
+	res.PublicKey = keybase1.ED25519PublicKey(a.SigningKey.kp.Public)
+	return res, nil
+}
+
+// BoxOpen implements KeyAgent for FakeKeyAgent.
+func (a FakeKeyAgent) BoxOpen(ctx context.Context,
+	peersPublicKey [32]byte, nonce [24]byte, boxed []byte) (
+	[]byte, error) {
+	return CryptPrivateKeyDecrypter{a.CryptKey}.DecryptBoxed(
+		ctx, peersPublicKey, nonce, boxed)
+}
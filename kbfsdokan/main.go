@@ -14,9 +14,11 @@ import (
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/kbfs/dokan"
 	"github.com/keybase/kbfs/env"
+	"github.com/keybase/kbfs/fsrpc"
 	"github.com/keybase/kbfs/libdokan"
 	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/simplefs"
 )
 
 var runtimeDir = flag.String("runtime-dir", os.Getenv("KEYBASE_RUNTIME_DIR"), "runtime directory")
@@ -98,6 +100,16 @@ func start() *libfs.Error {
 		mounter = libdokan.NewDefaultMounter(mountpoint)
 	}
 
+	// Serve SimpleFS to the Keybase service, for clients that
+	// don't use the mount, the shell protocol for file manager
+	// extensions, and the log control, status and error report
+	// protocols.
+	kbfsParams.AdditionalProtocolCreators = append(
+		kbfsParams.AdditionalProtocolCreators,
+		simplefs.NewSimpleFSProtocol, fsrpc.NewShellProtocol,
+		fsrpc.NewLogControlProtocol, fsrpc.NewStatusProtocol,
+		fsrpc.NewErrorReportsProtocol)
+
 	options := libdokan.StartOptions{
 		KbfsParams: *kbfsParams,
 		RuntimeDir: *runtimeDir,
@@ -11,19 +11,23 @@ import (
 	"fmt"
 	"os"
 
-	"bazil.org/fuse"
+	"github.com/keybase/kbfs/bazilfuse"
 
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/kbfs/env"
+	"github.com/keybase/kbfs/fsrpc"
 	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libfuse"
 	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/simplefs"
 )
 
 var runtimeDir = flag.String("runtime-dir", os.Getenv("KEYBASE_RUNTIME_DIR"), "runtime directory")
 var label = flag.String("label", os.Getenv("KEYBASE_LABEL"), "label to help identify if running as a service")
 var mountType = flag.String("mount-type", defaultMountType, "mount type: default, force, none")
 var version = flag.Bool("version", false, "Print version")
+var metricsListen = flag.String("metrics-listen", "", "host:port on which to serve metrics for Prometheus at /metrics; if empty, they aren't served")
+var debugListen = flag.String("debug-listen", "", "localhost:port on which to serve live status pages at /debug/kbfs/; if empty, they aren't served")
 
 const usageFormatStr = `Usage:
   kbfsfuse -version
@@ -33,6 +37,7 @@ To run against remote KBFS servers:
     [-bserver=%s] [-mdserver=%s]
     [-runtime-dir=path/to/dir] [-label=label] [-mount-type=force]
     [-log-to-file] [-log-file=path/to/file] [-md-version=version]
+    [-metrics-listen=host:port] [-debug-listen=localhost:port]
     %s/path/to/mountpoint
 
 To run in a local testing environment:
@@ -40,6 +45,7 @@ To run in a local testing environment:
     [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
     [-runtime-dir=path/to/dir] [-label=label] [-mount-type=force]
     [-log-to-file] [-log-file=path/to/file] [-md-version=version]
+    [-metrics-listen=host:port] [-debug-listen=localhost:port]
     %s/path/to/mountpoint
 
 `
@@ -99,10 +105,22 @@ func start() *libfs.Error {
 		mounter = libfuse.NewDefaultMounter(mountpoint, *platformParams)
 	}
 
+	// Serve SimpleFS to the Keybase service, for clients that
+	// don't use the mount, the shell protocol for file manager
+	// extensions, and the log control, status and error report
+	// protocols.
+	kbfsParams.AdditionalProtocolCreators = append(
+		kbfsParams.AdditionalProtocolCreators,
+		simplefs.NewSimpleFSProtocol, fsrpc.NewShellProtocol,
+		fsrpc.NewLogControlProtocol, fsrpc.NewStatusProtocol,
+		fsrpc.NewErrorReportsProtocol)
+
 	options := libfuse.StartOptions{
-		KbfsParams: *kbfsParams,
-		RuntimeDir: *runtimeDir,
-		Label:      *label,
+		KbfsParams:  *kbfsParams,
+		RuntimeDir:  *runtimeDir,
+		Label:       *label,
+		MetricsAddr: *metricsListen,
+		DebugAddr:   *debugListen,
 	}
 
 	return libfuse.Start(mounter, options, ctx)
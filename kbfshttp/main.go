@@ -0,0 +1,114 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Keybase file system over HTTP and WebDAV
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/keybase/kbfs/env"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libhttp"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+var version = flag.Bool("version", false, "Print version")
+var listen = flag.String("listen", "127.0.0.1:8077", "host:port to serve HTTP and WebDAV on")
+var username = flag.String("user", "kbfs", "username for HTTP basic auth")
+var serve = flag.String("serve", "", "directory in a public folder, e.g. /keybase/public/alice/www, to serve as a static website instead of serving all of KBFS")
+var passwordFile = flag.String("password-file", "", "file containing the password for HTTP basic auth; if empty, only public folders can be read")
+
+const usageFormatStr = `Usage:
+  kbfshttp -version
+
+To run against remote KBFS servers:
+  kbfshttp [-debug] [-cpuprofile=path/to/dir]
+    [-bserver=%s] [-mdserver=%s]
+    [-listen=host:port] [-user=name] [-password-file=path/to/file]
+    [-serve=/keybase/public/user/dir]
+    [-log-to-file] [-log-file=path/to/file] [-md-version=version]
+
+To run in a local testing environment:
+  kbfshttp [-debug] [-cpuprofile=path/to/dir]
+    [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
+    [-listen=host:port] [-user=name] [-password-file=path/to/file]
+    [-serve=/keybase/public/user/dir]
+    [-log-to-file] [-log-file=path/to/file] [-md-version=version]
+
+Folders are served at http://host:port/private/... and
+http://host:port/public/..., and can be mounted with any WebDAV client.
+
+With -serve, only the given public directory is served, as a static
+website: http://host:port/ maps to the directory itself, and requests
+for directories serve their index.html.
+
+`
+
+func getUsageStr(ctx libkbfs.Context) string {
+	defaultBServer := libkbfs.GetDefaultBServer(ctx)
+	if len(defaultBServer) == 0 {
+		defaultBServer = "host:port"
+	}
+	defaultMDServer := libkbfs.GetDefaultMDServer(ctx)
+	if len(defaultMDServer) == 0 {
+		defaultMDServer = "host:port"
+	}
+	return fmt.Sprintf(usageFormatStr, defaultBServer, defaultMDServer)
+}
+
+func start() *libfs.Error {
+	ctx := env.NewContext()
+
+	kbfsParams := libkbfs.AddFlags(flag.CommandLine, ctx)
+	flag.Usage = func() {
+		fmt.Print(getUsageStr(ctx))
+	}
+
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("%s\n", libkbfs.VersionString())
+		return nil
+	}
+
+	if len(flag.Args()) > 0 {
+		fmt.Print(getUsageStr(ctx))
+		return libfs.InitError("extra arguments specified")
+	}
+
+	var password string
+	if *passwordFile != "" {
+		buf, err := ioutil.ReadFile(*passwordFile)
+		if err != nil {
+			return libfs.InitError(err.Error())
+		}
+		password = strings.TrimSpace(string(buf))
+	}
+
+	options := libhttp.StartOptions{
+		KbfsParams: *kbfsParams,
+		Addr:       *listen,
+		Username:   *username,
+		Password:   password,
+		Site:       *serve,
+	}
+
+	return libhttp.Start(options, ctx)
+}
+
+func main() {
+	err := start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kbfshttp error: (%d) %s\n", err.Code, err.Message)
+
+		os.Exit(err.Code)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,14 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Package kbfsstress contains stress tests that run many concurrent,
+// mixed operations through a single libkbfs.Config against local
+// servers, to check that KBFSOps is safe to use from
+// goroutine-heavy embedders.  Run them with the race detector:
+//
+//	go test -race ./kbfsstress
+//
+// The -stress.goroutines and -stress.ops flags control the load.
+// The tests are skipped with -short.
+package kbfsstress
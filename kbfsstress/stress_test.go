@@ -0,0 +1,257 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfsstress
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+var (
+	numGoroutines = flag.Int("stress.goroutines", 50,
+		"Number of goroutines issuing operations concurrently")
+	numOps = flag.Int("stress.ops", 40,
+		"Number of operations issued by each goroutine")
+)
+
+const stressTimeout = 10 * time.Minute
+
+// makeStressContext returns a context for one goroutine's operations,
+// with the cancellation delayer that KBFS writes need.  It's cleaned
+// up when ctx is canceled.
+func makeStressContext(ctx context.Context, t *testing.T) context.Context {
+	ctx, err := libkbfs.NewContextWithCancellationDelayer(
+		libkbfs.NewContextReplayable(ctx,
+			func(ctx context.Context) context.Context { return ctx }))
+	require.NoError(t, err)
+	return ctx
+}
+
+// stressWorker issues random operations within its own directory,
+// and random reads anywhere in the folder, keeping track of what its
+// directory should contain.
+type stressWorker struct {
+	t       *testing.T
+	kbfsOps libkbfs.KBFSOps
+	root    libkbfs.Node
+	dir     libkbfs.Node
+	name    string
+	rng     *rand.Rand
+	files   map[string][]byte
+	nextID  int
+}
+
+func (w *stressWorker) pickFile() (string, bool) {
+	if len(w.files) == 0 {
+		return "", false
+	}
+	i := w.rng.Intn(len(w.files))
+	for name := range w.files {
+		if i == 0 {
+			return name, true
+		}
+		i--
+	}
+	panic("unreachable")
+}
+
+func (w *stressWorker) randomData() []byte {
+	data := make([]byte, 1+w.rng.Intn(8*1024))
+	w.rng.Read(data)
+	return data
+}
+
+func (w *stressWorker) doOp(ctx context.Context) {
+	t := w.t
+	name, haveFile := w.pickFile()
+	switch op := w.rng.Intn(8); {
+	case op == 0 || !haveFile:
+		name = fmt.Sprintf("f%d", w.nextID)
+		w.nextID++
+		data := w.randomData()
+		n, _, err := w.kbfsOps.CreateFile(
+			ctx, w.dir, name, false, libkbfs.NoExcl)
+		require.NoError(t, err)
+		require.NoError(t, w.kbfsOps.Write(ctx, n, data, 0))
+		require.NoError(t, w.kbfsOps.Sync(ctx, n))
+		w.files[name] = data
+
+	case op == 1:
+		n, _, err := w.kbfsOps.Lookup(ctx, w.dir, name)
+		require.NoError(t, err)
+		data := w.randomData()
+		off := w.rng.Intn(len(w.files[name]) + 1)
+		require.NoError(t, w.kbfsOps.Write(ctx, n, data, int64(off)))
+		require.NoError(t, w.kbfsOps.Sync(ctx, n))
+		expected := append([]byte(nil), w.files[name]...)
+		if end := off + len(data); end > len(expected) {
+			expected = append(expected,
+				make([]byte, end-len(expected))...)
+		}
+		copy(expected[off:], data)
+		w.files[name] = expected
+
+	case op == 2:
+		require.NoError(t, w.kbfsOps.RemoveEntry(ctx, w.dir, name))
+		delete(w.files, name)
+
+	case op == 3:
+		newName := fmt.Sprintf("f%d", w.nextID)
+		w.nextID++
+		require.NoError(t, w.kbfsOps.Rename(
+			ctx, w.dir, name, w.dir, newName))
+		w.files[newName] = w.files[name]
+		delete(w.files, name)
+
+	case op == 4:
+		children, err := w.kbfsOps.GetDirChildren(ctx, w.dir)
+		require.NoError(t, err)
+		require.Len(t, children, len(w.files))
+
+	case op == 5:
+		// Read from the root, which all the workers are
+		// modifying concurrently.
+		_, err := w.kbfsOps.GetDirChildren(ctx, w.root)
+		require.NoError(t, err)
+		_, err = w.kbfsOps.Stat(ctx, w.root)
+		require.NoError(t, err)
+
+	case op == 6:
+		_, _, err := w.kbfsOps.FolderStatus(
+			ctx, w.root.GetFolderBranch())
+		require.NoError(t, err)
+		_, _, err = w.kbfsOps.Status(ctx)
+		require.NoError(t, err)
+
+	default:
+		w.checkFile(ctx, name)
+	}
+}
+
+func (w *stressWorker) checkFile(ctx context.Context, name string) {
+	n, ei, err := w.kbfsOps.Lookup(ctx, w.dir, name)
+	require.NoError(w.t, err)
+	require.Equal(w.t, uint64(len(w.files[name])), ei.Size)
+	buf := make([]byte, ei.Size)
+	nRead, err := w.kbfsOps.Read(ctx, n, buf, 0)
+	require.NoError(w.t, err)
+	require.True(w.t, bytes.Equal(w.files[name], buf[:nRead]),
+		"Contents of %s/%s don't match", w.name, name)
+}
+
+func (w *stressWorker) run(ctx context.Context, ops int) {
+	for i := 0; i < ops; i++ {
+		w.doOp(ctx)
+	}
+	for name := range w.files {
+		w.checkFile(ctx, name)
+	}
+}
+
+// TestStressConcurrentMixedOps runs mixed operations from many
+// goroutines through a single Config, spread over a couple of
+// folders, and then checks that every file ended up as expected.
+func TestStressConcurrentMixedOps(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping stress test in short mode")
+	}
+
+	config := libkbfs.MakeTestConfigOrBust(t, "alice", "bob")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), stressTimeout)
+	defer cancel()
+
+	tlfNames := []string{"alice", "alice,bob"}
+	roots := make([]libkbfs.Node, len(tlfNames))
+	for i, name := range tlfNames {
+		roots[i] = libkbfs.GetRootNodeOrBust(ctx, t, config, name, false)
+	}
+
+	kbfsOps := config.KBFSOps()
+	var wg sync.WaitGroup
+	for i := 0; i < *numGoroutines; i++ {
+		root := roots[i%len(roots)]
+		name := fmt.Sprintf("w%d", i)
+		seed := int64(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := makeStressContext(ctx, t)
+			dir, _, err := kbfsOps.CreateDir(ctx, root, name)
+			require.NoError(t, err)
+			w := &stressWorker{
+				t:       t,
+				kbfsOps: kbfsOps,
+				root:    root,
+				dir:     dir,
+				name:    name,
+				rng:     rand.New(rand.NewSource(seed)),
+				files:   make(map[string][]byte),
+			}
+			w.run(ctx, *numOps)
+		}()
+	}
+	wg.Wait()
+
+	for i, root := range roots {
+		require.NoError(t, kbfsOps.SyncFromServerForTesting(
+			ctx, root.GetFolderBranch()), "TLF %s", tlfNames[i])
+		children, err := kbfsOps.GetDirChildren(ctx, root)
+		require.NoError(t, err)
+		expected := *numGoroutines / len(roots)
+		if i < *numGoroutines%len(roots) {
+			expected++
+		}
+		require.Len(t, children, expected)
+	}
+}
+
+// TestStressConcurrentRootLookups has many goroutines racing to
+// initialize the same folders through a fresh Config, which
+// exercises the creation of per-folder state.
+func TestStressConcurrentRootLookups(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping stress test in short mode")
+	}
+
+	users := []libkb.NormalizedUsername{"alice", "bob", "charlie"}
+	config := libkbfs.MakeTestConfigOrBust(t, users...)
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), stressTimeout)
+	defer cancel()
+
+	names := []string{"alice", "alice,bob", "alice,charlie",
+		"alice,bob,charlie"}
+	var wg sync.WaitGroup
+	for i := 0; i < *numGoroutines; i++ {
+		name := names[i%len(names)]
+		public := i%2 == 0
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := makeStressContext(ctx, t)
+			root, err := libkbfs.GetRootNodeForTest(
+				ctx, config, name, public)
+			require.NoError(t, err)
+			_, err = config.KBFSOps().GetDirChildren(ctx, root)
+			require.NoError(t, err)
+			_, err = config.KBFSOps().GetFavorites(ctx)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+}
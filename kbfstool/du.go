@@ -0,0 +1,193 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const duUsageStr = `Usage:
+  kbfstool du [-rev revision] [-d depth] [-a] [-h] /keybase/(public|private)/<tlf>[/<dir>]
+
+Walks the block tree of the given folder, or of a directory in it,
+and reports for each directory the logical size of the files under
+it, the physical size of their blocks and of the directory blocks
+(i.e., the encrypted and padded size, which is what counts against
+quota), and the number of blocks, like du(1).
+
+With -d, only directories at most the given depth below the given
+one are reported, although all their contents are still counted.
+With -a, files are reported too.  With -h, sizes are printed in
+human-readable units.
+
+`
+
+// diskUsage is the usage of a file or of a directory tree.
+type diskUsage struct {
+	logical  uint64
+	physical uint64
+	blocks   int
+}
+
+func (u *diskUsage) add(other diskUsage) {
+	u.logical += other.logical
+	u.physical += other.physical
+	u.blocks += other.blocks
+}
+
+// humanSize formats n bytes with a binary unit suffix, like du -h.
+func humanSize(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f := float64(n) / 1024
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", f, units[i])
+}
+
+// duWalker computes the usage of the directories of a TLFSnapshot.
+type duWalker struct {
+	snapshot *libkbfs.TLFSnapshot
+	maxDepth int
+	all      bool
+	human    bool
+}
+
+func (w *duWalker) print(u diskUsage, name string) {
+	if w.human {
+		fmt.Printf("%10s %10s %8d  %s\n",
+			humanSize(u.logical), humanSize(u.physical), u.blocks, name)
+		return
+	}
+	fmt.Printf("%14d %14d %8d  %s\n", u.logical, u.physical, u.blocks, name)
+}
+
+func (w *duWalker) walkDir(ctx context.Context, dir libkbfs.DirEntry,
+	dirName string, depth int) (diskUsage, error) {
+	u := diskUsage{
+		physical: uint64(dir.EncodedSize),
+		blocks:   1,
+	}
+	children, err := w.snapshot.GetDirChildren(ctx, dir)
+	if err != nil {
+		return diskUsage{}, err
+	}
+	storedNames := make([]string, 0, len(children))
+	for storedName := range children {
+		storedNames = append(storedNames, storedName)
+	}
+	sort.Strings(storedNames)
+
+	for _, storedName := range storedNames {
+		de := children[storedName]
+		name := storedName
+		if de.LongName != "" {
+			name = de.LongName
+		}
+		childName := path.Join(dirName, name)
+		switch de.Type {
+		case libkbfs.Dir:
+			childUsage, err := w.walkDir(ctx, de, childName, depth+1)
+			if err != nil {
+				return diskUsage{}, err
+			}
+			u.add(childUsage)
+		case libkbfs.File, libkbfs.Exec:
+			infos, err := w.snapshot.GetFileBlockInfos(ctx, de)
+			if err != nil {
+				return diskUsage{}, fmt.Errorf("%s: %v", childName, err)
+			}
+			childUsage := diskUsage{logical: de.Size, blocks: len(infos)}
+			for _, info := range infos {
+				childUsage.physical += uint64(info.EncodedSize)
+			}
+			if w.all && (w.maxDepth < 0 || depth+1 <= w.maxDepth) {
+				w.print(childUsage, childName)
+			}
+			u.add(childUsage)
+		}
+	}
+
+	if w.maxDepth < 0 || depth <= w.maxDepth {
+		w.print(u, dirName)
+	}
+	return u, nil
+}
+
+func duHelper(ctx context.Context, config libkbfs.Config, p fsrpc.Path,
+	rev int64, maxDepth int, all, human bool) error {
+	snapshot, err := openTLFSnapshot(ctx, config, p, rev)
+	if err != nil {
+		return err
+	}
+	dir, err := lookupSnapshotDir(ctx, snapshot, p.TLFComponents)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Revision %d\n", snapshot.Revision())
+	if human {
+		fmt.Printf("%10s %10s %8s  %s\n", "LOGICAL", "PHYSICAL", "BLOCKS", "PATH")
+	} else {
+		fmt.Printf("%14s %14s %8s  %s\n", "LOGICAL", "PHYSICAL", "BLOCKS", "PATH")
+	}
+	w := duWalker{
+		snapshot: snapshot,
+		maxDepth: maxDepth,
+		all:      all,
+		human:    human,
+	}
+	_, err = w.walkDir(ctx, dir, p.String(), 0)
+	return err
+}
+
+func du(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs du", flag.ContinueOnError)
+	rev := flags.Int64("rev", -1,
+		"Revision to report on; the latest one if negative.")
+	maxDepth := flags.Int("d", -1,
+		"Maximum depth of directories to report; unlimited if negative.")
+	all := flags.Bool("a", false, "Report files as well as directories.")
+	human := flags.Bool("h", false, "Print sizes in human-readable units.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("du", err)
+		return 1
+	}
+
+	if flags.NArg() != 1 {
+		fmt.Print(duUsageStr)
+		return 1
+	}
+	p, err := fsrpc.NewPath(flags.Arg(0))
+	if err != nil {
+		printError("du", err)
+		return 1
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		printError("du", fmt.Errorf("%s is not in a folder", p))
+		return 1
+	}
+
+	err = duHelper(ctx, config, p, *rev, *maxDepth, *all, *human)
+	if err != nil {
+		printError("du", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,343 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const exportUsageStr = `Usage:
+  kbfstool export [-rev revision] [-format tar|zip] [-o path] [-v] /keybase/(public|private)/<tlf>[/<dir>]
+
+Writes the contents of the given folder, or of a directory in it, to
+a tar or zip archive, with the modification times and executable bits
+of its files.  The archive is written to stdout unless -o is given;
+its format is zip if the -o path ends in .zip, and tar otherwise,
+unless -format says otherwise.
+
+With -rev, the folder is exported as of the given revision, rather
+than the latest one.  Data that later revisions removed or
+overwrote is deleted once it's garbage-collected, so only recent
+revisions can be exported in full.
+
+`
+
+// archiveWriter writes entries to an archive.
+type archiveWriter interface {
+	// writeEntry adds an entry with the given name, and returns a
+	// writer for its contents if it's a file.
+	writeEntry(name string, de libkbfs.DirEntry) (io.Writer, error)
+	Close() error
+}
+
+// exportMode returns the permission bits to give the given entry in
+// an archive.
+func exportMode(de libkbfs.DirEntry) os.FileMode {
+	switch de.Type {
+	case libkbfs.Dir:
+		return os.ModeDir | 0755
+	case libkbfs.Sym:
+		return os.ModeSymlink | 0777
+	case libkbfs.Exec:
+		return 0755
+	default:
+		return 0644
+	}
+}
+
+type tarArchiveWriter struct {
+	tw *tar.Writer
+}
+
+func (w tarArchiveWriter) writeEntry(name string, de libkbfs.DirEntry) (
+	io.Writer, error) {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(exportMode(de).Perm()),
+		ModTime: time.Unix(0, de.Mtime),
+	}
+	switch de.Type {
+	case libkbfs.Dir:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case libkbfs.Sym:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = de.SymPath
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(de.Size)
+	}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	return w.tw, nil
+}
+
+func (w tarArchiveWriter) Close() error {
+	return w.tw.Close()
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (w zipArchiveWriter) writeEntry(name string, de libkbfs.DirEntry) (
+	io.Writer, error) {
+	hdr := &zip.FileHeader{
+		Name:   name,
+		Method: zip.Deflate,
+	}
+	hdr.SetModTime(time.Unix(0, de.Mtime))
+	hdr.SetMode(exportMode(de))
+	switch de.Type {
+	case libkbfs.Dir:
+		hdr.Name += "/"
+		hdr.Method = zip.Store
+	case libkbfs.Sym:
+		hdr.Method = zip.Store
+	}
+	fw, err := w.zw.CreateHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	if de.Type == libkbfs.Sym {
+		// Zip archives store symlink targets as their contents.
+		if _, err := io.WriteString(fw, de.SymPath); err != nil {
+			return nil, err
+		}
+	}
+	return fw, nil
+}
+
+func (w zipArchiveWriter) Close() error {
+	return w.zw.Close()
+}
+
+// snapshotExporter writes directories of a TLFSnapshot to an
+// archiveWriter.
+type snapshotExporter struct {
+	snapshot *libkbfs.TLFSnapshot
+	aw       archiveWriter
+	verbose  bool
+
+	files int
+	bytes int64
+}
+
+func (se *snapshotExporter) exportDir(ctx context.Context,
+	dir libkbfs.DirEntry, dirName string) error {
+	children, err := se.snapshot.GetDirChildren(ctx, dir)
+	if err != nil {
+		return err
+	}
+	storedNames := make([]string, 0, len(children))
+	for storedName := range children {
+		storedNames = append(storedNames, storedName)
+	}
+	sort.Strings(storedNames)
+
+	for _, storedName := range storedNames {
+		de := children[storedName]
+		name := storedName
+		if de.LongName != "" {
+			name = de.LongName
+		}
+		childName := path.Join(dirName, name)
+		if se.verbose {
+			fmt.Fprintf(os.Stderr, "Exporting %s\n", childName)
+		}
+		w, err := se.aw.writeEntry(childName, de)
+		if err != nil {
+			return err
+		}
+		se.files++
+		switch de.Type {
+		case libkbfs.Dir:
+			err = se.exportDir(ctx, de, childName)
+		case libkbfs.File, libkbfs.Exec:
+			err = se.snapshot.ReadFile(ctx, de, w)
+			se.bytes += int64(de.Size)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", childName, err)
+		}
+	}
+	return nil
+}
+
+// lookupSnapshotDir returns the entry of the directory at the given
+// path components in the snapshot.
+func lookupSnapshotDir(ctx context.Context, snapshot *libkbfs.TLFSnapshot,
+	components []string) (libkbfs.DirEntry, error) {
+	de := snapshot.Root()
+	for i, name := range components {
+		children, err := snapshot.GetDirChildren(ctx, de)
+		if err != nil {
+			return libkbfs.DirEntry{}, err
+		}
+		child, ok := children[name]
+		if !ok {
+			// The name may have been too long to store as is.
+			for _, c := range children {
+				if c.LongName == name {
+					child, ok = c, true
+					break
+				}
+			}
+		}
+		if !ok {
+			return libkbfs.DirEntry{}, libkbfs.NoSuchNameError{
+				Name: strings.Join(components[:i+1], "/")}
+		}
+		de = child
+	}
+	if de.Type != libkbfs.Dir {
+		return libkbfs.DirEntry{}, fmt.Errorf(
+			"%s is not a directory", strings.Join(components, "/"))
+	}
+	return de, nil
+}
+
+// openTLFSnapshot returns a snapshot of the folder that p is in, at
+// the given revision, or at the latest one if rev is negative.
+func openTLFSnapshot(ctx context.Context, config libkbfs.Config,
+	p fsrpc.Path, rev int64) (*libkbfs.TLFSnapshot, error) {
+	h, err := fsrpc.ParseTlfHandle(ctx, config.KBPKI(), p.TLFName, p.Public)
+	if err != nil {
+		return nil, err
+	}
+	kbfsOps := config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetRootNode(ctx, h, libkbfs.MasterBranch)
+	if err != nil {
+		return nil, err
+	}
+	if rootNode == nil {
+		return nil, fmt.Errorf("%s has never been written to", p)
+	}
+	folderBranch := rootNode.GetFolderBranch()
+	revision := libkbfs.MetadataRevision(rev)
+	if rev < 0 {
+		status, _, err := kbfsOps.FolderStatus(ctx, folderBranch)
+		if err != nil {
+			return nil, err
+		}
+		revision = status.Revision
+	}
+
+	return libkbfs.NewTLFSnapshot(ctx, config, folderBranch.Tlf, revision)
+}
+
+func exportHelper(ctx context.Context, config libkbfs.Config,
+	p fsrpc.Path, rev int64, format, outPath string, verbose bool) (
+	err error) {
+	snapshot, err := openTLFSnapshot(ctx, config, p, rev)
+	if err != nil {
+		return err
+	}
+	dir, err := lookupSnapshotDir(ctx, snapshot, p.TLFComponents)
+	if err != nil {
+		return err
+	}
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Exporting %s at revision %d\n",
+			p, snapshot.Revision())
+	}
+
+	out := io.Writer(os.Stdout)
+	if outPath != "" {
+		f, err := os.OpenFile(
+			outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			closeErr := f.Close()
+			if err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				// Don't leave a partial archive behind.
+				os.Remove(outPath)
+			}
+		}()
+		out = f
+	}
+
+	var aw archiveWriter
+	switch format {
+	case "tar":
+		aw = tarArchiveWriter{tar.NewWriter(out)}
+	case "zip":
+		aw = zipArchiveWriter{zip.NewWriter(out)}
+	default:
+		return fmt.Errorf("unknown archive format %q", format)
+	}
+	se := snapshotExporter{
+		snapshot: snapshot,
+		aw:       aw,
+		verbose:  verbose,
+	}
+	if err := se.exportDir(ctx, dir, ""); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+func export(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs export", flag.ContinueOnError)
+	rev := flags.Int64("rev", -1,
+		"Revision to export; the latest one if negative.")
+	format := flags.String("format", "",
+		"Archive format, tar or zip; by default, it follows from -o.")
+	outPath := flags.String("o", "",
+		"Path of the archive to write, instead of stdout.")
+	verbose := flags.Bool("v", false, "Print each exported entry.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("export", err)
+		return 1
+	}
+
+	if flags.NArg() != 1 {
+		fmt.Print(exportUsageStr)
+		return 1
+	}
+	p, err := fsrpc.NewPath(flags.Arg(0))
+	if err != nil {
+		printError("export", err)
+		return 1
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		printError("export", fmt.Errorf("%s is not in a folder", p))
+		return 1
+	}
+
+	if *format == "" {
+		*format = "tar"
+		if strings.HasSuffix(strings.ToLower(*outPath), ".zip") {
+			*format = "zip"
+		}
+	}
+	err = exportHelper(ctx, config, p, *rev, *format, *outPath, *verbose)
+	if err != nil {
+		printError("export", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,654 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+const exportAccountUsageStr = `Usage:
+  kbfstool export-account -key-file path [-revisions n] [-limit bytes/s] [-v] <dir>
+  kbfstool export-account -decrypt -key-file path <archive>
+
+Exports the latest contents of every folder in the user's favorites
+to <dir>, as one encrypted tar archive per folder, along with a
+manifest.json describing them.  Folders that have already been
+exported to <dir> are skipped, so an interrupted export can be
+resumed by running the same command again.
+
+The archives are encrypted with the key in the key file, which is
+created if it doesn't exist yet.  Keep it safe, and apart from the
+archives: they can't be read without it.  With -decrypt, the given
+archive is decrypted to stdout as a tar stream.
+
+With -revisions, up to n revisions of each folder before the latest
+one are exported too, one archive each.  Data that later revisions
+removed or overwrote is deleted once it's garbage-collected, so older
+revisions may fail to export; that's recorded in the manifest, but
+doesn't fail the export.
+
+`
+
+const (
+	exportManifestName  = "manifest.json"
+	exportArchiveSuffix = ".tar.kbarc"
+	exportReadSize      = 512 * 1024
+)
+
+// exportRevision describes one exported past revision of a folder
+// in the manifest.
+type exportRevision struct {
+	Revision libkbfs.MetadataRevision `json:"revision"`
+	Archive  string                   `json:"archive"`
+	Files    int                      `json:"files"`
+	Bytes    int64                    `json:"bytes"`
+	Time     keybase1.Time            `json:"time"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+// exportFolder describes one exported folder in the manifest.
+type exportFolder struct {
+	Name     string                   `json:"name"`
+	Public   bool                     `json:"public"`
+	Revision libkbfs.MetadataRevision `json:"revision"`
+	Archive  string                   `json:"archive,omitempty"`
+	Files    int                      `json:"files"`
+	Bytes    int64                    `json:"bytes"`
+	Time     keybase1.Time            `json:"time"`
+	Error    string                   `json:"error,omitempty"`
+	// PastRevisions are the revisions before Revision that were
+	// exported with -revisions.
+	PastRevisions []exportRevision `json:"pastRevisions,omitempty"`
+}
+
+// exported returns whether the latest revision of the folder has
+// been exported to dir.
+func (ef *exportFolder) exported(dir string) bool {
+	if ef.Error != "" {
+		return false
+	}
+	if ef.Archive == "" {
+		// The folder was empty.
+		return true
+	}
+	_, err := os.Stat(filepath.Join(dir, ef.Archive))
+	return err == nil
+}
+
+func (ef *exportFolder) findRevision(
+	rev libkbfs.MetadataRevision) *exportRevision {
+	for i := range ef.PastRevisions {
+		if ef.PastRevisions[i].Revision == rev {
+			return &ef.PastRevisions[i]
+		}
+	}
+	return nil
+}
+
+// exportManifest is written to manifest.json in the export directory
+// after each folder is exported.
+type exportManifest struct {
+	Folders []exportFolder `json:"folders"`
+}
+
+func (m *exportManifest) find(name string, public bool) *exportFolder {
+	for i := range m.Folders {
+		if m.Folders[i].Name == name && m.Folders[i].Public == public {
+			return &m.Folders[i]
+		}
+	}
+	return nil
+}
+
+func readExportManifest(dir string) (exportManifest, error) {
+	var m exportManifest
+	buf, err := ioutil.ReadFile(filepath.Join(dir, exportManifestName))
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(buf, &m)
+	return m, err
+}
+
+// writeExportManifest replaces the manifest in dir, atomically so
+// that an interrupted export never leaves a broken one behind.
+func writeExportManifest(dir string, m exportManifest) error {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dir, exportManifestName+".tmp")
+	if err := ioutil.WriteFile(tmpPath, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, exportManifestName))
+}
+
+func exportArchiveName(fav libkbfs.Favorite) string {
+	visibility := privateName
+	if fav.Public {
+		visibility = publicName
+	}
+	return visibility + "_" + fav.Name + exportArchiveSuffix
+}
+
+func exportRevisionArchiveName(
+	fav libkbfs.Favorite, rev libkbfs.MetadataRevision) string {
+	name := exportArchiveName(fav)
+	return fmt.Sprintf("%s.r%d%s",
+		strings.TrimSuffix(name, exportArchiveSuffix), rev,
+		exportArchiveSuffix)
+}
+
+// favoritesByName sorts private folders before public ones, and each
+// by name.
+type favoritesByName []libkbfs.Favorite
+
+func (f favoritesByName) Len() int      { return len(f) }
+func (f favoritesByName) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f favoritesByName) Less(i, j int) bool {
+	if f[i].Public != f[j].Public {
+		return !f[i].Public
+	}
+	return f[i].Name < f[j].Name
+}
+
+// folderExporter writes the contents of one folder to a tar stream.
+type folderExporter struct {
+	config  libkbfs.Config
+	limiter libkbfs.BandwidthLimiter
+	tw      *tar.Writer
+	verbose bool
+	buf     []byte
+
+	files int
+	bytes int64
+}
+
+func (fe *folderExporter) header(name string, ei libkbfs.EntryInfo) *tar.Header {
+	hdr := &tar.Header{
+		Name:    name,
+		ModTime: time.Unix(0, ei.Mtime),
+	}
+	switch ei.Type {
+	case libkbfs.Dir:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+		hdr.Mode = 0700
+	case libkbfs.Sym:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = ei.SymPath
+		hdr.Mode = 0700
+	case libkbfs.Exec:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(ei.Size)
+		hdr.Mode = 0700
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(ei.Size)
+		hdr.Mode = 0600
+	}
+	return hdr
+}
+
+func (fe *folderExporter) exportFile(ctx context.Context, node libkbfs.Node,
+	name string, size int64) error {
+	kbfsOps := fe.config.KBFSOps()
+	for off := int64(0); off < size; {
+		toRead := fe.buf
+		if remaining := size - off; remaining < int64(len(toRead)) {
+			toRead = toRead[:remaining]
+		}
+		err := fe.limiter.WaitN(
+			ctx, libkbfs.BandwidthDownload, int64(len(toRead)))
+		if err != nil {
+			return err
+		}
+		n, err := kbfsOps.Read(ctx, node, toRead, off)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// The file shrank since it was listed; the tar
+			// header has already promised the old size.
+			return fmt.Errorf("%s changed during the export", name)
+		}
+		if _, err := fe.tw.Write(toRead[:n]); err != nil {
+			return err
+		}
+		off += n
+		fe.bytes += n
+	}
+	return nil
+}
+
+func (fe *folderExporter) exportDir(ctx context.Context, dir libkbfs.Node,
+	dirName string) error {
+	kbfsOps := fe.config.KBFSOps()
+	children, err := kbfsOps.GetDirChildren(ctx, dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ei := children[name]
+		childName := path.Join(dirName, name)
+		if fe.verbose {
+			fmt.Fprintf(os.Stderr, "Exporting %s\n", childName)
+		}
+		if err := fe.tw.WriteHeader(fe.header(childName, ei)); err != nil {
+			return err
+		}
+		fe.files++
+		if ei.Type == libkbfs.Sym {
+			continue
+		}
+		child, _, err := kbfsOps.Lookup(ctx, dir, name)
+		if err != nil {
+			return err
+		}
+		if ei.Type == libkbfs.Dir {
+			err = fe.exportDir(ctx, child, childName)
+		} else {
+			err = fe.exportFile(ctx, child, childName, int64(ei.Size))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeExportArchive writes an archive encrypted with key to
+// archivePath, with the plaintext written by write.  The archive is
+// written under a temporary name and only renamed once it's complete.
+func writeExportArchive(archivePath string, key *exportKey,
+	write func(w io.Writer) error) (err error) {
+	tmpPath := archivePath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	ew, err := newEncryptingWriter(f, key)
+	if err != nil {
+		return err
+	}
+	if err := write(ew); err != nil {
+		return err
+	}
+	if err := ew.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	err = f.Close()
+	f = nil
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, archivePath)
+}
+
+// exportOneFolder exports the given folder to its archive in dir,
+// and returns its manifest entry.
+func exportOneFolder(ctx context.Context, config libkbfs.Config,
+	limiter libkbfs.BandwidthLimiter, key *exportKey, dir string,
+	fav libkbfs.Favorite, verbose bool) (exportFolder, error) {
+	ef := exportFolder{
+		Name:   fav.Name,
+		Public: fav.Public,
+		Time:   keybase1.ToTime(config.Clock().Now()),
+	}
+
+	h, err := fsrpc.ParseTlfHandle(ctx, config.KBPKI(), fav.Name, fav.Public)
+	if err != nil {
+		return ef, err
+	}
+	kbfsOps := config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetRootNode(ctx, h, libkbfs.MasterBranch)
+	if err != nil {
+		return ef, err
+	}
+	if rootNode == nil {
+		// The folder has never been written to.
+		return ef, nil
+	}
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		return ef, err
+	}
+	ef.Revision = status.Revision
+
+	ef.Archive = exportArchiveName(fav)
+	fe := folderExporter{
+		config:  config,
+		limiter: limiter,
+		verbose: verbose,
+		buf:     make([]byte, exportReadSize),
+	}
+	err = writeExportArchive(filepath.Join(dir, ef.Archive), key,
+		func(w io.Writer) error {
+			fe.tw = tar.NewWriter(w)
+			if err := fe.exportDir(ctx, rootNode, ""); err != nil {
+				return err
+			}
+			return fe.tw.Close()
+		})
+	if err != nil {
+		return ef, err
+	}
+	ef.Files = fe.files
+	ef.Bytes = fe.bytes
+	return ef, nil
+}
+
+// limitedWriter waits for the limiter before each write, so that
+// reads that are only paced by their output stay within the limit.
+type limitedWriter struct {
+	ctx     context.Context
+	limiter libkbfs.BandwidthLimiter
+	w       io.Writer
+}
+
+func (lw limitedWriter) Write(p []byte) (int, error) {
+	err := lw.limiter.WaitN(lw.ctx, libkbfs.BandwidthDownload, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	return lw.w.Write(p)
+}
+
+// exportOneRevision exports the given past revision of the folder
+// with the given ID to its archive in dir, and returns its manifest
+// entry.
+func exportOneRevision(ctx context.Context, config libkbfs.Config,
+	limiter libkbfs.BandwidthLimiter, key *exportKey, dir string,
+	fav libkbfs.Favorite, tlfID tlf.ID, rev libkbfs.MetadataRevision,
+	verbose bool) (exportRevision, error) {
+	er := exportRevision{
+		Revision: rev,
+		Archive:  exportRevisionArchiveName(fav, rev),
+		Time:     keybase1.ToTime(config.Clock().Now()),
+	}
+	snapshot, err := libkbfs.NewTLFSnapshot(ctx, config, tlfID, rev)
+	if err != nil {
+		return er, err
+	}
+	var se snapshotExporter
+	err = writeExportArchive(filepath.Join(dir, er.Archive), key,
+		func(w io.Writer) error {
+			se = snapshotExporter{
+				snapshot: snapshot,
+				aw: tarArchiveWriter{tar.NewWriter(
+					limitedWriter{ctx, limiter, w})},
+				verbose: verbose,
+			}
+			if err := se.exportDir(ctx, snapshot.Root(), ""); err != nil {
+				return err
+			}
+			return se.aw.Close()
+		})
+	if err != nil {
+		return er, err
+	}
+	er.Files = se.files
+	er.Bytes = se.bytes
+	return er, nil
+}
+
+// exportPastRevisions exports up to n revisions of the given folder
+// before its exported one, skipping those that have already been
+// exported to dir, and records them in ef, calling save after each
+// one.  Revisions that can't be exported are recorded with their
+// error.
+func exportPastRevisions(ctx context.Context, config libkbfs.Config,
+	limiter libkbfs.BandwidthLimiter, key *exportKey, dir string,
+	fav libkbfs.Favorite, ef *exportFolder, n int, verbose bool,
+	save func() error) error {
+	if n == 0 || ef.Archive == "" || ef.Revision <= libkbfs.MetadataRevisionInitial {
+		return nil
+	}
+	h, err := fsrpc.ParseTlfHandle(ctx, config.KBPKI(), fav.Name, fav.Public)
+	if err != nil {
+		return err
+	}
+	rootNode, _, err := config.KBFSOps().GetRootNode(
+		ctx, h, libkbfs.MasterBranch)
+	if err != nil {
+		return err
+	}
+	if rootNode == nil {
+		return nil
+	}
+	tlfID := rootNode.GetFolderBranch().Tlf
+
+	for i := 1; i <= n; i++ {
+		rev := ef.Revision - libkbfs.MetadataRevision(i)
+		if rev < libkbfs.MetadataRevisionInitial {
+			break
+		}
+		existing := ef.findRevision(rev)
+		if existing != nil && existing.Error == "" {
+			_, statErr := os.Stat(filepath.Join(dir, existing.Archive))
+			if statErr == nil {
+				continue
+			}
+		}
+
+		er, exportErr := exportOneRevision(
+			ctx, config, limiter, key, dir, fav, tlfID, rev, verbose)
+		if exportErr != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			fmt.Printf("Couldn't export revision %d: %v\n", rev, exportErr)
+			er.Error = exportErr.Error()
+		} else {
+			fmt.Printf("Exported revision %d, %d entries (%d bytes)\n",
+				rev, er.Files, er.Bytes)
+		}
+		if existing != nil {
+			*existing = er
+		} else {
+			ef.PastRevisions = append(ef.PastRevisions, er)
+		}
+		if err := save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportAccountHelper(ctx context.Context, config libkbfs.Config,
+	dir, keyFile string, revisions int, limit int64, verbose bool) (
+	failed int, err error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	key, created, err := loadOrCreateExportKey(keyFile)
+	if err != nil {
+		return 0, err
+	}
+	if created {
+		fmt.Printf("Wrote a new archive key to %s\n", keyFile)
+	}
+	manifest, err := readExportManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	favs, err := config.KBFSOps().GetFavorites(ctx)
+	if err != nil {
+		return 0, err
+	}
+	sort.Sort(favoritesByName(favs))
+
+	// Exports are foreground work, but shouldn't swamp the
+	// connection, so they get a limiter of their own.
+	limiter := libkbfs.NewBandwidthLimiterStandard(config.Clock(),
+		libkbfs.BandwidthLimits{DownloadBytesPerSecond: limit})
+
+	for _, fav := range favs {
+		ef := manifest.find(fav.Name, fav.Public)
+		if ef != nil && ef.exported(dir) {
+			fmt.Printf("Skipping %s, exported at revision %d\n",
+				exportArchiveName(fav), ef.Revision)
+		} else {
+			fmt.Printf("Exporting %s...\n", exportArchiveName(fav))
+			newEF, exportErr := exportOneFolder(
+				ctx, config, limiter, &key, dir, fav, verbose)
+			if exportErr != nil {
+				printError("export-account",
+					fmt.Errorf("%s: %v", exportArchiveName(fav), exportErr))
+				newEF.Error = exportErr.Error()
+				failed++
+			} else {
+				fmt.Printf("Exported %d entries (%d bytes) at revision %d\n",
+					newEF.Files, newEF.Bytes, newEF.Revision)
+			}
+
+			if existing := manifest.find(fav.Name, fav.Public); existing != nil {
+				// Archives of past revisions stay valid
+				// whatever the latest revision is.
+				newEF.PastRevisions = existing.PastRevisions
+				*existing = newEF
+			} else {
+				manifest.Folders = append(manifest.Folders, newEF)
+			}
+			ef = manifest.find(fav.Name, fav.Public)
+			if err := writeExportManifest(dir, manifest); err != nil {
+				return failed, err
+			}
+		}
+
+		if ef.Error == "" {
+			err := exportPastRevisions(ctx, config, limiter, &key, dir,
+				fav, ef, revisions, verbose, func() error {
+					return writeExportManifest(dir, manifest)
+				})
+			if err != nil {
+				printError("export-account",
+					fmt.Errorf("%s: %v", exportArchiveName(fav), err))
+				failed++
+			}
+		}
+		if ctx.Err() != nil {
+			return failed, ctx.Err()
+		}
+	}
+	return failed, nil
+}
+
+func decryptExportArchive(archivePath, keyFile string) error {
+	if _, err := os.Stat(keyFile); err != nil {
+		return err
+	}
+	key, _, err := loadOrCreateExportKey(keyFile)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dr, err := newDecryptingReader(f, &key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(os.Stdout, dr)
+	return err
+}
+
+func exportAccount(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs export-account", flag.ContinueOnError)
+	keyFile := flags.String("key-file", "",
+		"Path to the archive key, which is created if needed.")
+	revisions := flags.Int("revisions", 0,
+		"Number of past revisions of each folder to export too.")
+	limit := flags.Int64("limit", 0,
+		"Maximum download rate, in bytes per second; 0 for no limit.")
+	decrypt := flags.Bool("decrypt", false,
+		"Decrypt the given archive to stdout.")
+	verbose := flags.Bool("v", false, "Print each exported entry.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("export-account", err)
+		return 1
+	}
+
+	if flags.NArg() != 1 || *keyFile == "" {
+		fmt.Print(exportAccountUsageStr)
+		return 1
+	}
+	target := flags.Arg(0)
+
+	if *decrypt {
+		if err := decryptExportArchive(target, *keyFile); err != nil {
+			printError("export-account", err)
+			return 1
+		}
+		return 0
+	}
+
+	if *limit < 0 {
+		printError("export-account",
+			fmt.Errorf("negative limit %d", *limit))
+		return 1
+	}
+	if *revisions < 0 {
+		printError("export-account",
+			fmt.Errorf("negative number of revisions %d", *revisions))
+		return 1
+	}
+	failed, err := exportAccountHelper(
+		ctx, config, target, *keyFile, *revisions, *limit, *verbose)
+	if err != nil {
+		printError("export-account", err)
+		return 1
+	}
+	if failed > 0 {
+		printError("export-account",
+			fmt.Errorf("%d folders couldn't be exported; "+
+				"run the same command again to retry them", failed))
+		return 1
+	}
+	return 0
+}
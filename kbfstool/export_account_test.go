@@ -0,0 +1,159 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeKbfstoolTestContext(t *testing.T) context.Context {
+	ctx, err := libkbfs.NewContextWithCancellationDelayer(
+		libkbfs.NewContextReplayable(context.Background(),
+			func(ctx context.Context) context.Context { return ctx }))
+	require.NoError(t, err)
+	return ctx
+}
+
+// readExportArchiveForTest returns the contents of the files in the
+// given archive, keyed by name.
+func readExportArchiveForTest(t *testing.T, archivePath string,
+	key *exportKey) map[string]string {
+	f, err := os.Open(archivePath)
+	require.NoError(t, err)
+	defer f.Close()
+	dr, err := newDecryptingReader(f, key)
+	require.NoError(t, err)
+	tr := tar.NewReader(dr)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, tr)
+		require.NoError(t, err)
+		files[hdr.Name] = buf.String()
+	}
+	return files
+}
+
+// writeFileForTest writes data to the file with the given name, and
+// returns the revision of its folder after the write.
+func writeFileForTest(ctx context.Context, t *testing.T,
+	config libkbfs.Config, dir libkbfs.Node, name, data string) (
+	rev libkbfs.MetadataRevision) {
+	kbfsOps := config.KBFSOps()
+	n, _, err := kbfsOps.Lookup(ctx, dir, name)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		n, _, err = kbfsOps.CreateFile(ctx, dir, name, false, libkbfs.NoExcl)
+	}
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps.Truncate(ctx, n, 0))
+	require.NoError(t, kbfsOps.Write(ctx, n, []byte(data), 0))
+	require.NoError(t, kbfsOps.Sync(ctx, n))
+	status, _, err := kbfsOps.FolderStatus(ctx, dir.GetFolderBranch())
+	require.NoError(t, err)
+	return status.Revision
+}
+
+func TestExportAccount(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	ctx := makeKbfstoolTestContext(t)
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+
+	root := libkbfs.GetRootNodeOrBust(ctx, t, config, "jdoe", false)
+	rev1 := writeFileForTest(ctx, t, config, root, "a", "one")
+	rev2 := writeFileForTest(ctx, t, config, root, "a", "two")
+	require.Equal(t, rev1+1, rev2)
+
+	tempDir, err := ioutil.TempDir(os.TempDir(), "export_account")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+	dir := filepath.Join(tempDir, "export")
+	keyFile := filepath.Join(tempDir, "key")
+
+	failed, err := exportAccountHelper(ctx, config, dir, keyFile, 0, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, failed)
+	key, created, err := loadOrCreateExportKey(keyFile)
+	require.NoError(t, err)
+	require.False(t, created)
+
+	manifest, err := readExportManifest(dir)
+	require.NoError(t, err)
+	ef := manifest.find("jdoe", false)
+	require.NotNil(t, ef)
+	require.Equal(t, "", ef.Error)
+	require.Equal(t, rev2, ef.Revision)
+	require.Equal(t, 1, ef.Files)
+	require.Len(t, ef.PastRevisions, 0)
+	archivePath := filepath.Join(dir, ef.Archive)
+	require.Equal(t, map[string]string{"a": "two"},
+		readExportArchiveForTest(t, archivePath, &key))
+
+	// Resuming with past revisions skips the latest one, which
+	// was already exported.
+	require.NoError(t, ioutil.WriteFile(archivePath, []byte("stale"), 0600))
+	failed, err = exportAccountHelper(ctx, config, dir, keyFile, 2, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, failed)
+	buf, err := ioutil.ReadFile(archivePath)
+	require.NoError(t, err)
+	require.Equal(t, "stale", string(buf))
+
+	manifest, err = readExportManifest(dir)
+	require.NoError(t, err)
+	ef = manifest.find("jdoe", false)
+	require.NotNil(t, ef)
+	require.Len(t, ef.PastRevisions, 2)
+	// The revision before rev1 has the newly created file.
+	expected := map[libkbfs.MetadataRevision]map[string]string{
+		rev1:     {"a": "one"},
+		rev1 - 1: {"a": ""},
+	}
+	for _, er := range ef.PastRevisions {
+		require.Equal(t, "", er.Error)
+		require.Equal(t, expected[er.Revision], readExportArchiveForTest(
+			t, filepath.Join(dir, er.Archive), &key))
+	}
+
+	// A missing archive is exported again, at the latest revision.
+	require.NoError(t, os.Remove(archivePath))
+	require.NoError(t, os.Remove(
+		filepath.Join(dir, ef.PastRevisions[0].Archive)))
+	rev3 := writeFileForTest(ctx, t, config, root, "a", "three")
+	failed, err = exportAccountHelper(ctx, config, dir, keyFile, 1, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, failed)
+	manifest, err = readExportManifest(dir)
+	require.NoError(t, err)
+	ef = manifest.find("jdoe", false)
+	require.NotNil(t, ef)
+	require.Equal(t, rev3, ef.Revision)
+	require.Equal(t, map[string]string{"a": "three"},
+		readExportArchiveForTest(t, archivePath, &key))
+	// rev2 is exported as a past revision now, and rev1's archive
+	// is still missing, since it's out of the requested range.
+	require.Len(t, ef.PastRevisions, 3)
+	er := ef.findRevision(rev2)
+	require.NotNil(t, er)
+	require.Equal(t, map[string]string{"a": "two"},
+		readExportArchiveForTest(t, filepath.Join(dir, er.Archive), &key))
+	_, err = os.Stat(filepath.Join(dir, ef.findRevision(rev1).Archive))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,239 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Exported archives are encrypted with NaCl secretbox, in chunks, so
+// that they can be written and read as streams.  An archive starts
+// with exportArchiveMagic and a random nonce prefix; each chunk is
+// then its big-endian uint32 sealed length followed by the sealed
+// data.  A chunk's nonce is the prefix followed by its big-endian
+// uint64 index, with the top bit set for the last chunk, so that
+// reordered, dropped or truncated chunks are detected.
+
+const (
+	exportArchiveMagic    = "KBFSARC1"
+	exportNoncePrefixSize = 16
+	exportChunkSize       = 64 * 1024
+	exportLastChunkFlag   = uint64(1) << 63
+)
+
+var errTruncatedArchive = errors.New("archive is truncated")
+
+type exportKey [32]byte
+
+// loadOrCreateExportKey reads the hex-encoded key in the file at
+// path, or, if there isn't one, generates a new key and writes it
+// there.
+func loadOrCreateExportKey(path string) (key exportKey, created bool,
+	err error) {
+	buf, err := ioutil.ReadFile(path)
+	if err == nil {
+		decoded, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+		if err != nil {
+			return exportKey{}, false, err
+		}
+		if len(decoded) != len(key) {
+			return exportKey{}, false, fmt.Errorf(
+				"key in %s has %d bytes, not %d",
+				path, len(decoded), len(key))
+		}
+		copy(key[:], decoded)
+		return key, false, nil
+	} else if !os.IsNotExist(err) {
+		return exportKey{}, false, err
+	}
+
+	if _, err := rand.Read(key[:]); err != nil {
+		return exportKey{}, false, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return exportKey{}, false, err
+	}
+	_, err = fmt.Fprintf(f, "%s\n", hex.EncodeToString(key[:]))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return exportKey{}, false, err
+	}
+	return key, true, nil
+}
+
+func makeExportNonce(prefix []byte, index uint64,
+	last bool) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], prefix)
+	if last {
+		index |= exportLastChunkFlag
+	}
+	binary.BigEndian.PutUint64(nonce[exportNoncePrefixSize:], index)
+	return &nonce
+}
+
+// encryptingWriter encrypts everything written to it into an
+// archive.  Close must be called to write the last chunk; it doesn't
+// close the underlying writer.
+type encryptingWriter struct {
+	w      io.Writer
+	key    *exportKey
+	prefix []byte
+	index  uint64
+	buf    []byte
+}
+
+var _ io.WriteCloser = (*encryptingWriter)(nil)
+
+func newEncryptingWriter(w io.Writer, key *exportKey) (
+	*encryptingWriter, error) {
+	prefix := make([]byte, exportNoncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, exportArchiveMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{
+		w:      w,
+		key:    key,
+		prefix: prefix,
+		buf:    make([]byte, 0, exportChunkSize),
+	}, nil
+}
+
+func (ew *encryptingWriter) writeChunk(last bool) error {
+	sealed := secretbox.Seal(nil, ew.buf,
+		makeExportNonce(ew.prefix, ew.index, last), (*[32]byte)(ew.key))
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+	if _, err := ew.w.Write(size[:]); err != nil {
+		return err
+	}
+	if _, err := ew.w.Write(sealed); err != nil {
+		return err
+	}
+	ew.index++
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+func (ew *encryptingWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		toCopy := exportChunkSize - len(ew.buf)
+		if toCopy > len(p) {
+			toCopy = len(p)
+		}
+		ew.buf = append(ew.buf, p[:toCopy]...)
+		p = p[toCopy:]
+		n += toCopy
+		// Keep a full chunk around until more data comes, since
+		// it might be the last one.
+		if len(ew.buf) == exportChunkSize && len(p) > 0 {
+			if err := ew.writeChunk(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (ew *encryptingWriter) Close() error {
+	return ew.writeChunk(true)
+}
+
+// decryptingReader reads the plaintext of an archive.
+type decryptingReader struct {
+	r      io.Reader
+	key    *exportKey
+	prefix []byte
+	index  uint64
+	buf    []byte
+	done   bool
+}
+
+var _ io.Reader = (*decryptingReader)(nil)
+
+func newDecryptingReader(r io.Reader, key *exportKey) (
+	*decryptingReader, error) {
+	header := make([]byte, len(exportArchiveMagic)+exportNoncePrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(exportArchiveMagic)],
+		[]byte(exportArchiveMagic)) {
+		return nil, errors.New("not an exported archive")
+	}
+	return &decryptingReader{
+		r:      r,
+		key:    key,
+		prefix: header[len(exportArchiveMagic):],
+	}, nil
+}
+
+func (dr *decryptingReader) readChunk() error {
+	var size [4]byte
+	if _, err := io.ReadFull(dr.r, size[:]); err == io.EOF ||
+		err == io.ErrUnexpectedEOF {
+		return errTruncatedArchive
+	} else if err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < secretbox.Overhead || n > exportChunkSize+secretbox.Overhead {
+		return fmt.Errorf("bad chunk size %d", n)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(dr.r, sealed); err == io.EOF ||
+		err == io.ErrUnexpectedEOF {
+		return errTruncatedArchive
+	} else if err != nil {
+		return err
+	}
+	for _, last := range []bool{false, true} {
+		opened, ok := secretbox.Open(dr.buf[:0], sealed,
+			makeExportNonce(dr.prefix, dr.index, last),
+			(*[32]byte)(dr.key))
+		if ok {
+			dr.buf = opened
+			dr.index++
+			dr.done = last
+			return nil
+		}
+	}
+	return fmt.Errorf("chunk %d couldn't be decrypted; "+
+		"the key is wrong or the archive is corrupt", dr.index)
+}
+
+func (dr *decryptingReader) Read(p []byte) (n int, err error) {
+	for len(dr.buf) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestExportKey(t *testing.T) exportKey {
+	dir, err := ioutil.TempDir(os.TempDir(), "export_crypt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	key, created, err := loadOrCreateExportKey(filepath.Join(dir, "key"))
+	require.NoError(t, err)
+	require.True(t, created)
+	return key
+}
+
+func encryptForTest(t *testing.T, key *exportKey, data []byte) []byte {
+	var buf bytes.Buffer
+	ew, err := newEncryptingWriter(&buf, key)
+	require.NoError(t, err)
+	// Write in odd-sized pieces, to cross chunk boundaries.
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err := ew.Write(data[:n])
+		require.NoError(t, err)
+		data = data[n:]
+	}
+	require.NoError(t, ew.Close())
+	return buf.Bytes()
+}
+
+func decryptForTest(key *exportKey, archive []byte) ([]byte, error) {
+	dr, err := newDecryptingReader(bytes.NewReader(archive), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(dr)
+}
+
+// exportChunkOffsets returns the offsets of the chunks of archive,
+// followed by the offset of its end.
+func exportChunkOffsets(t *testing.T, archive []byte) []int {
+	off := len(exportArchiveMagic) + exportNoncePrefixSize
+	var offsets []int
+	for off < len(archive) {
+		offsets = append(offsets, off)
+		off += 4 + int(binary.BigEndian.Uint32(archive[off:]))
+	}
+	require.Equal(t, len(archive), off)
+	return append(offsets, off)
+}
+
+func makeTestExportData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestExportArchiveRoundTrip(t *testing.T) {
+	key := makeTestExportKey(t)
+	for _, size := range []int{0, 1, exportChunkSize - 1, exportChunkSize,
+		exportChunkSize + 1, 3*exportChunkSize + 5} {
+		data := makeTestExportData(size)
+		archive := encryptForTest(t, &key, data)
+		// Even an empty archive has a last chunk.
+		chunks := (size + exportChunkSize - 1) / exportChunkSize
+		if chunks == 0 {
+			chunks = 1
+		}
+		require.Len(t, exportChunkOffsets(t, archive), chunks+1,
+			"size %d", size)
+		decrypted, err := decryptForTest(&key, archive)
+		require.NoError(t, err, "size %d", size)
+		require.True(t, bytes.Equal(data, decrypted), "size %d", size)
+	}
+}
+
+func TestExportArchiveWrongKey(t *testing.T) {
+	key := makeTestExportKey(t)
+	otherKey := makeTestExportKey(t)
+	archive := encryptForTest(t, &key, makeTestExportData(100))
+	_, err := decryptForTest(&otherKey, archive)
+	require.Error(t, err)
+
+	_, err = decryptForTest(&key, []byte("not an archive at all"))
+	require.Error(t, err)
+}
+
+func TestExportArchiveTruncated(t *testing.T) {
+	key := makeTestExportKey(t)
+	archive := encryptForTest(
+		t, &key, makeTestExportData(3*exportChunkSize+5))
+	offsets := exportChunkOffsets(t, archive)
+	require.Len(t, offsets, 5)
+
+	// Cutting the archive anywhere must fail, and in particular
+	// cutting it at a chunk boundary must not look like its end.
+	cuts := []int{
+		len(exportArchiveMagic) + exportNoncePrefixSize,
+		offsets[1], offsets[3], offsets[3] + 2, offsets[3] + 4,
+		offsets[3] + 10, len(archive) - 1,
+	}
+	for _, cut := range cuts {
+		_, err := decryptForTest(&key, archive[:cut])
+		require.Equal(t, errTruncatedArchive, err, "cut at %d", cut)
+	}
+	_, err := decryptForTest(&key, archive[:len(exportArchiveMagic)])
+	require.Error(t, err)
+}
+
+func TestExportArchiveReorderedChunks(t *testing.T) {
+	key := makeTestExportKey(t)
+	archive := encryptForTest(
+		t, &key, makeTestExportData(3*exportChunkSize+5))
+	offsets := exportChunkOffsets(t, archive)
+	chunk := func(i int) []byte {
+		return archive[offsets[i]:offsets[i+1]]
+	}
+	build := func(order ...int) []byte {
+		reordered := append([]byte(nil), archive[:offsets[0]]...)
+		for _, i := range order {
+			reordered = append(reordered, chunk(i)...)
+		}
+		return reordered
+	}
+
+	for _, order := range [][]int{
+		{1, 0, 2, 3},    // swapped
+		{0, 2, 1, 3},    // swapped
+		{0, 1, 3, 2},    // last chunk moved
+		{0, 2, 3},       // middle chunk dropped
+		{0, 0, 1, 2, 3}, // chunk repeated
+		{3},             // only the last chunk
+	} {
+		_, err := decryptForTest(&key, build(order...))
+		require.Error(t, err, "order %v", order)
+	}
+
+	// The chunks can't be moved to another archive either, even
+	// with the same key.
+	other := encryptForTest(
+		t, &key, makeTestExportData(3*exportChunkSize+5))
+	spliced := append([]byte(nil), other[:offsets[0]]...)
+	spliced = append(spliced, archive[offsets[0]:]...)
+	_, err := decryptForTest(&key, spliced)
+	require.Error(t, err)
+}
+
+func TestExportKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "export_crypt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+
+	key, created, err := loadOrCreateExportKey(keyFile)
+	require.NoError(t, err)
+	require.True(t, created)
+	fi, err := os.Stat(keyFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	key2, created, err := loadOrCreateExportKey(keyFile)
+	require.NoError(t, err)
+	require.False(t, created)
+	require.Equal(t, key, key2)
+}
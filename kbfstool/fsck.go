@@ -0,0 +1,100 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const fsckUsageStr = `Usage:
+  kbfstool fsck [-repair] /keybase/[public|private]/user1,assertion2
+
+Checks the directory tree of the given folder, as of its latest
+revision, for entries and indirect blocks pointing to blocks the
+block server doesn't have, files whose sizes don't match their data,
+block references used in more than one place, and, if the block
+server can list them, orphaned block references.
+
+With -repair, entries whose blocks are missing are removed, and files
+whose sizes don't match their data are truncated to their recorded
+size.  The other problems are only reported.
+
+`
+
+func fsckOne(ctx context.Context, config libkbfs.Config,
+	tlfStr string, repair bool) (clean bool, err error) {
+	tlfID, err := getTlfID(ctx, config, tlfStr)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("Checking %s (%s)...\n", tlfStr, tlfID)
+
+	result, err := libkbfs.FsckTLF(ctx, config, tlfID)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("Checked revision %d: %d directories, %d files, "+
+		"%d blocks\n", result.Revision, result.Dirs, result.Files,
+		result.Blocks)
+	if !result.OrphansChecked {
+		fmt.Print("The block server can't list its references, " +
+			"so orphaned references weren't checked\n")
+	}
+	for _, p := range result.Problems {
+		fmt.Printf("  %s\n", p)
+	}
+	fmt.Printf("Problems: %d\n", len(result.Problems))
+
+	if !repair || len(result.Problems) == 0 {
+		return len(result.Problems) == 0, nil
+	}
+
+	repaired, err := libkbfs.RepairFsckProblems(
+		ctx, config, tlfID, result.Problems)
+	for _, p := range repaired {
+		fmt.Printf("Repaired %s\n", p)
+	}
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("Repaired: %d\n", len(repaired))
+
+	return len(repaired) == len(result.Problems), nil
+}
+
+func fsck(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false,
+		"Repair the problems that can be fixed by rewriting metadata.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("fsck", err)
+		return 1
+	}
+
+	inputs := flags.Args()
+	if len(inputs) != 1 {
+		fmt.Print(fsckUsageStr)
+		return 1
+	}
+
+	clean, err := fsckOne(ctx, config, inputs[0], *repair)
+	if err != nil {
+		printError("fsck", err)
+		return 1
+	}
+
+	if !clean {
+		return 1
+	}
+	return 0
+}
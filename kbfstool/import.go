@@ -0,0 +1,446 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/kbfsapi"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const importUsageStr = `Usage:
+  kbfstool import [-j jobs] [-v] <localdir> /keybase/(public|private)/<tlf>[/<dir>]
+
+Copies the contents of <localdir> into the given directory, which is
+created if needed, uploading several files at once.  Files keep their
+modification times and executable bits.
+
+While it runs, the import records the files it has finished in
+` + importManifestName + ` in the destination directory, and
+prints its progress to stderr.  If it's interrupted, run the same
+command again to continue: files that were finished, and haven't
+changed locally since, are skipped.  The manifest is removed once
+everything has been imported.
+
+`
+
+const (
+	importManifestName = ".import-resume.json"
+	importWriteSize    = 512 * 1024
+)
+
+// importManifestInterval is how often the manifest is written while
+// files are being imported.  Tests set it to 0, to write it after
+// every file.
+var importManifestInterval = 5 * time.Second
+
+// importedFile records the local state of a file that was imported.
+type importedFile struct {
+	Size  int64 `json:"size"`
+	Mtime int64 `json:"mtime"`
+}
+
+// importManifest is written to the destination directory during an
+// import.
+type importManifest struct {
+	Source string                  `json:"source"`
+	Done   map[string]importedFile `json:"done"`
+}
+
+func readImportManifest(ctx context.Context, kbfsOps kbfsapi.Ops,
+	destNode kbfsapi.Node) (m importManifest, err error) {
+	m.Done = make(map[string]importedFile)
+	node, ei, err := kbfsOps.Lookup(ctx, destNode, importManifestName)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return m, nil
+	} else if err != nil {
+		return m, err
+	}
+	buf := make([]byte, ei.Size)
+	n, err := kbfsOps.Read(ctx, node, buf, 0)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(buf[:n], &m); err != nil {
+		return m, fmt.Errorf("%s: %v", importManifestName, err)
+	}
+	if m.Done == nil {
+		m.Done = make(map[string]importedFile)
+	}
+	return m, nil
+}
+
+func writeImportManifest(ctx context.Context, kbfsOps kbfsapi.Ops,
+	destNode kbfsapi.Node, m importManifest) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	node, _, err := kbfsOps.Lookup(ctx, destNode, importManifestName)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		node, _, err = kbfsOps.CreateFile(
+			ctx, destNode, importManifestName, false, kbfsapi.NoExcl)
+	}
+	if err != nil {
+		return err
+	}
+	if err := kbfsOps.Truncate(ctx, node, 0); err != nil {
+		return err
+	}
+	if err := kbfsOps.Write(ctx, node, buf, 0); err != nil {
+		return err
+	}
+	return kbfsOps.Sync(ctx, node)
+}
+
+// importEntry is a local file, directory or symlink to import, at
+// the slash-separated path rel under the local directory.
+type importEntry struct {
+	rel       string
+	localPath string
+	info      os.FileInfo
+}
+
+type importJob struct {
+	importEntry
+	parent kbfsapi.Node
+}
+
+type importResult struct {
+	importEntry
+	skipped bool
+	err     error
+}
+
+func isImportedFile(m importManifest, e importEntry) bool {
+	done, ok := m.Done[e.rel]
+	return ok && done.Size == e.info.Size() &&
+		done.Mtime == e.info.ModTime().UnixNano()
+}
+
+// importer uploads local files, several at a time.
+type importer struct {
+	kbfsOps kbfsapi.Ops
+	verbose bool
+}
+
+func (im *importer) uploadFile(ctx context.Context, job importJob) error {
+	name := path.Base(job.rel)
+	isExec := job.info.Mode()&0100 != 0
+	node, ei, err := im.kbfsOps.Lookup(ctx, job.parent, name)
+	switch err.(type) {
+	case nil:
+		// Left over from an interrupted import, or from
+		// before it.
+		if ei.Type != kbfsapi.File && ei.Type != kbfsapi.Exec {
+			return libkbfs.NameExistsError{Name: job.rel}
+		}
+		if err := im.kbfsOps.Truncate(ctx, node, 0); err != nil {
+			return err
+		}
+		if err := im.kbfsOps.SetEx(ctx, node, isExec); err != nil {
+			return err
+		}
+	case libkbfs.NoSuchNameError:
+		node, _, err = im.kbfsOps.CreateFile(
+			ctx, job.parent, name, isExec, kbfsapi.NoExcl)
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	f, err := os.Open(job.localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyBuffer(&nodeWriter{
+		ctx:     ctx,
+		kbfsOps: im.kbfsOps,
+		node:    node,
+	}, f, make([]byte, importWriteSize))
+	if err != nil {
+		return err
+	}
+	if err := im.kbfsOps.Sync(ctx, node); err != nil {
+		return err
+	}
+	mtime := job.info.ModTime()
+	return im.kbfsOps.SetMtime(ctx, node, &mtime)
+}
+
+func (im *importer) worker(ctx context.Context, jobs <-chan importJob,
+	results chan<- importResult) {
+	for job := range jobs {
+		if im.verbose {
+			fmt.Fprintf(os.Stderr, "Importing %s\n", job.rel)
+		}
+		err := im.uploadFile(ctx, job)
+		results <- importResult{importEntry: job.importEntry, err: err}
+	}
+}
+
+// produce creates the directories and symlinks among entries, which
+// are in walk order, and queues the files that haven't been imported
+// yet to jobs.
+func (im *importer) produce(ctx context.Context, destNode kbfsapi.Node,
+	entries []importEntry, m importManifest, jobs chan<- importJob,
+	results chan<- importResult) {
+	defer close(jobs)
+	dirs := map[string]kbfsapi.Node{".": destNode}
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		parent, ok := dirs[path.Dir(e.rel)]
+		if !ok {
+			// Its parent couldn't be created, which was
+			// already reported.
+			continue
+		}
+		name := path.Base(e.rel)
+		var err error
+		switch {
+		case e.info.IsDir():
+			var node kbfsapi.Node
+			node, _, err = im.kbfsOps.CreateDir(ctx, parent, name)
+			if _, ok := err.(libkbfs.NameExistsError); ok {
+				node, _, err = im.kbfsOps.Lookup(ctx, parent, name)
+			}
+			if err == nil {
+				dirs[e.rel] = node
+				continue
+			}
+		case e.info.Mode()&os.ModeSymlink != 0:
+			var target string
+			target, err = os.Readlink(e.localPath)
+			if err == nil {
+				_, err = im.kbfsOps.CreateLink(ctx, parent, name, target)
+			}
+			if _, ok := err.(libkbfs.NameExistsError); ok {
+				err = nil
+			}
+			results <- importResult{importEntry: e, err: err}
+			continue
+		case !e.info.Mode().IsRegular():
+			err = fmt.Errorf("unsupported file type %s", e.info.Mode())
+		case isImportedFile(m, e):
+			results <- importResult{importEntry: e, skipped: true}
+			continue
+		default:
+			jobs <- importJob{e, parent}
+			continue
+		}
+		results <- importResult{importEntry: e, err: err}
+	}
+}
+
+// walkImportSource returns the entries under localDir in walk order,
+// which puts every directory before its contents, along with the
+// number and total size of its files.
+func walkImportSource(localDir string) (
+	entries []importEntry, files int, bytes int64, err error) {
+	err = filepath.Walk(localDir, func(
+		localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if localPath == localDir {
+			return nil
+		}
+		rel, err := filepath.Rel(localDir, localPath)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, importEntry{
+			rel:       filepath.ToSlash(rel),
+			localPath: localPath,
+			info:      info,
+		})
+		if info.Mode().IsRegular() {
+			files++
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return entries, files, bytes, err
+}
+
+func importHelper(ctx context.Context, config libkbfs.Config,
+	localDir string, destPathStr string, jobCount int, verbose bool) (
+	failed int, err error) {
+	localDir, err = filepath.Abs(localDir)
+	if err != nil {
+		return 0, err
+	}
+	entries, totalFiles, totalBytes, err := walkImportSource(localDir)
+	if err != nil {
+		return 0, err
+	}
+
+	p, err := fsrpc.NewPath(destPathStr)
+	if err != nil {
+		return 0, err
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		return 0, cannotWriteErr{destPathStr, nil}
+	}
+	if err := mkdirOne(ctx, config, destPathStr, true, false); err != nil {
+		return 0, err
+	}
+	destNode, err := p.GetDirNode(ctx, config)
+	if err != nil {
+		return 0, err
+	}
+
+	kbfsOps := kbfsapi.New(config).Ops
+	m, err := readImportManifest(ctx, kbfsOps, destNode)
+	if err != nil {
+		return 0, err
+	}
+	if m.Source != "" && m.Source != localDir {
+		fmt.Fprintf(os.Stderr, "Continuing an import from %s\n", m.Source)
+	}
+	m.Source = localDir
+
+	// The producer checks what was imported before against a copy
+	// of the manifest, since this goroutine keeps updating it.
+	prevDone := importManifest{Done: make(map[string]importedFile)}
+	for rel, done := range m.Done {
+		prevDone.Done[rel] = done
+	}
+
+	im := importer{kbfsOps: kbfsOps, verbose: verbose}
+	jobs := make(chan importJob)
+	results := make(chan importResult)
+	var wg sync.WaitGroup
+	for i := 0; i < jobCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			im.worker(ctx, jobs, results)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		im.produce(ctx, destNode, entries, prevDone, jobs, results)
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var doneFiles int
+	var doneBytes int64
+	printProgress := func() {
+		fmt.Fprintf(os.Stderr, "Imported %d/%d files, %d/%d bytes\n",
+			doneFiles, totalFiles, doneBytes, totalBytes)
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastManifestWrite := time.Now()
+	dirty := false
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				results = nil
+				break
+			}
+			if r.err != nil {
+				printError("import", fmt.Errorf("%s: %v", r.rel, r.err))
+				failed++
+				continue
+			}
+			if !r.info.Mode().IsRegular() {
+				continue
+			}
+			doneFiles++
+			doneBytes += r.info.Size()
+			if !r.skipped {
+				m.Done[r.rel] = importedFile{
+					Size:  r.info.Size(),
+					Mtime: r.info.ModTime().UnixNano(),
+				}
+				dirty = true
+			}
+		case <-ticker.C:
+			printProgress()
+		}
+		if results == nil {
+			break
+		}
+		if dirty && time.Since(lastManifestWrite) >= importManifestInterval {
+			err := writeImportManifest(ctx, kbfsOps, destNode, m)
+			if err != nil {
+				return failed, err
+			}
+			lastManifestWrite = time.Now()
+			dirty = false
+		}
+	}
+	printProgress()
+	if err := ctx.Err(); err != nil {
+		return failed, err
+	}
+
+	if failed > 0 {
+		return failed, writeImportManifest(ctx, kbfsOps, destNode, m)
+	}
+	err = kbfsOps.RemoveEntry(ctx, destNode, importManifestName)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		err = nil
+	}
+	return 0, err
+}
+
+func importMain(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs import", flag.ContinueOnError)
+	jobCount := flags.Int("j", 4, "Number of files to upload at once.")
+	verbose := flags.Bool("v", false, "Print each imported file.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("import", err)
+		return 1
+	}
+
+	if flags.NArg() != 2 {
+		fmt.Print(importUsageStr)
+		return 1
+	}
+	if *jobCount < 1 {
+		printError("import", fmt.Errorf("invalid job count %d", *jobCount))
+		return 1
+	}
+
+	failed, err := importHelper(
+		ctx, config, flags.Arg(0), flags.Arg(1), *jobCount, *verbose)
+	if err != nil {
+		printError("import", err)
+		return 1
+	}
+	if failed > 0 {
+		printError("import",
+			fmt.Errorf("%d entries couldn't be imported; "+
+				"run the same command again to retry them", failed))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,202 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/kbfsapi"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+const importTestDest = "/keybase/private/jdoe/dest"
+
+// writeLocalFilesForTest writes the given files, keyed by their
+// slash-separated paths, under dir.
+func writeLocalFilesForTest(t *testing.T, dir string,
+	files map[string]string) {
+	for rel, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0700))
+		require.NoError(t, ioutil.WriteFile(p, []byte(data), 0600))
+	}
+}
+
+// lookupPathForTest returns the node at the given slash-separated
+// path under dir.
+func lookupPathForTest(ctx context.Context, config libkbfs.Config,
+	dir libkbfs.Node, rel string) (libkbfs.Node, libkbfs.EntryInfo, error) {
+	node := dir
+	names := strings.Split(rel, "/")
+	for _, name := range names[:len(names)-1] {
+		var err error
+		node, _, err = config.KBFSOps().Lookup(ctx, node, name)
+		if err != nil {
+			return nil, libkbfs.EntryInfo{}, err
+		}
+	}
+	return config.KBFSOps().Lookup(ctx, node, names[len(names)-1])
+}
+
+// checkImportedFilesForTest checks that the files under dir in KBFS
+// have the given contents.
+func checkImportedFilesForTest(ctx context.Context, t *testing.T,
+	config libkbfs.Config, dir libkbfs.Node, files map[string]string) {
+	for rel, data := range files {
+		node, ei, err := lookupPathForTest(ctx, config, dir, rel)
+		require.NoError(t, err, rel)
+		buf := make([]byte, ei.Size)
+		n, err := config.KBFSOps().Read(ctx, node, buf, 0)
+		require.NoError(t, err, rel)
+		require.Equal(t, data, string(buf[:n]), rel)
+	}
+}
+
+func getImportDestForTest(ctx context.Context, t *testing.T,
+	config libkbfs.Config) libkbfs.Node {
+	p, err := fsrpc.NewPath(importTestDest)
+	require.NoError(t, err)
+	destNode, err := p.GetDirNode(ctx, config)
+	require.NoError(t, err)
+	return destNode
+}
+
+func readImportManifestForTest(ctx context.Context, t *testing.T,
+	config libkbfs.Config, destNode libkbfs.Node) importManifest {
+	m, err := readImportManifest(
+		ctx, kbfsapi.New(config).Ops, destNode)
+	require.NoError(t, err)
+	return m
+}
+
+func TestImportResumeAfterPartialImport(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	ctx := makeKbfstoolTestContext(t)
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+
+	localDir, err := ioutil.TempDir(os.TempDir(), "import")
+	require.NoError(t, err)
+	defer os.RemoveAll(localDir)
+	files := map[string]string{
+		"a":   "aaa",
+		"d/b": "bbb",
+		"d/c": "ccc",
+		"e/f": "fff",
+	}
+	writeLocalFilesForTest(t, localDir, files)
+
+	// A directory in the way of e/f makes the first import fail
+	// part way.
+	require.NoError(t, mkdirOne(
+		ctx, config, importTestDest+"/e/f", true, false))
+	failed, err := importHelper(
+		ctx, config, localDir, importTestDest, 2, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, failed)
+
+	destNode := getImportDestForTest(ctx, t, config)
+	m := readImportManifestForTest(ctx, t, config, destNode)
+	require.Equal(t, localDir, m.Source)
+	require.Len(t, m.Done, 3)
+	for _, rel := range []string{"a", "d/b", "d/c"} {
+		fi, err := os.Stat(filepath.Join(localDir, filepath.FromSlash(rel)))
+		require.NoError(t, err)
+		require.Equal(t, importedFile{
+			Size:  fi.Size(),
+			Mtime: fi.ModTime().UnixNano(),
+		}, m.Done[rel], rel)
+	}
+	delete(files, "e/f")
+	checkImportedFilesForTest(ctx, t, config, destNode, files)
+
+	// Change a in KBFS, to tell whether it's imported again, and
+	// d/b locally.
+	writeFileForTest(ctx, t, config, destNode, "a", "changed in kbfs")
+	writeLocalFilesForTest(t, localDir, map[string]string{"d/b": "bbbb"})
+	mtime := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(
+		filepath.Join(localDir, "d", "b"), mtime, mtime))
+	eNode, _, err := config.KBFSOps().Lookup(ctx, destNode, "e")
+	require.NoError(t, err)
+	require.NoError(t, config.KBFSOps().RemoveDir(ctx, eNode, "f"))
+
+	failed, err = importHelper(
+		ctx, config, localDir, importTestDest, 2, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, failed)
+	checkImportedFilesForTest(ctx, t, config, destNode, map[string]string{
+		"a":   "changed in kbfs",
+		"d/b": "bbbb",
+		"d/c": "ccc",
+		"e/f": "fff",
+	})
+
+	// The manifest is gone once everything was imported.
+	_, _, err = config.KBFSOps().Lookup(ctx, destNode, importManifestName)
+	require.IsType(t, libkbfs.NoSuchNameError{}, err)
+}
+
+func TestImportConcurrentManifestWrites(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	ctx := makeKbfstoolTestContext(t)
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+
+	// Write the manifest after every file, while the other
+	// workers keep uploading.
+	defer func(interval time.Duration) {
+		importManifestInterval = interval
+	}(importManifestInterval)
+	importManifestInterval = 0
+
+	localDir, err := ioutil.TempDir(os.TempDir(), "import")
+	require.NoError(t, err)
+	defer os.RemoveAll(localDir)
+	files := make(map[string]string)
+	for i := 0; i < 40; i++ {
+		files[fmt.Sprintf("d%d/f%d", i%4, i)] = fmt.Sprintf("data %d", i)
+	}
+	files["blocked"] = "blocked"
+	writeLocalFilesForTest(t, localDir, files)
+
+	require.NoError(t, mkdirOne(
+		ctx, config, importTestDest+"/blocked", true, false))
+	failed, err := importHelper(
+		ctx, config, localDir, importTestDest, 8, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, failed)
+
+	// Every file but the blocked one was recorded, however the
+	// manifest writes interleaved with the uploads.
+	destNode := getImportDestForTest(ctx, t, config)
+	m := readImportManifestForTest(ctx, t, config, destNode)
+	require.Len(t, m.Done, len(files)-1)
+	for rel := range files {
+		_, ok := m.Done[rel]
+		require.Equal(t, rel != "blocked", ok, rel)
+	}
+	delete(files, "blocked")
+	checkImportedFilesForTest(ctx, t, config, destNode, files)
+
+	require.NoError(t, config.KBFSOps().RemoveDir(ctx, destNode, "blocked"))
+	failed, err = importHelper(
+		ctx, config, localDir, importTestDest, 8, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, failed)
+	files["blocked"] = "blocked"
+	checkImportedFilesForTest(ctx, t, config, destNode, files)
+	_, _, err = config.KBFSOps().Lookup(ctx, destNode, importManifestName)
+	require.IsType(t, libkbfs.NoSuchNameError{}, err)
+}
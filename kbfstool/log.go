@@ -0,0 +1,121 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+const logUsageStr = `Usage:
+  kbfstool log [-debug=true|false] [-debug-tags=tag1,tag2,...]
+    [-rotate] /path/to/mountpoint
+
+Changes the logging of the KBFS instance mounted at the given path,
+without restarting it. Settings that aren't given are left unchanged.
+With no settings, the current ones are printed instead.
+
+The possible debug tags are: mdserver, bserver, cr, journal.
+
+`
+
+// logControl talks to the running KBFS instance through its mount,
+// instead of through a KBFS instance of its own, which is why it's
+// dispatched before libkbfs.Init.
+func logControl(args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs log", flag.ContinueOnError)
+	debug := flags.Bool("debug", false,
+		"Turn debug logging on or off for all modules.")
+	debugTags := flags.String("debug-tags", "",
+		"Comma-separated tags of the modules to turn debug logging on "+
+			"for; empty turns it off for all of them.")
+	rotate := flags.Bool("rotate", false,
+		"Move the current log file aside and start a new one.")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, logUsageStr)
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		printError("log", err)
+		return 1
+	}
+
+	if len(flags.Args()) != 1 {
+		printError("log", errExactlyOnePath)
+		return 1
+	}
+	mountpoint := flags.Arg(0)
+
+	req := make(map[string]interface{})
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "debug":
+			req["Debug"] = *debug
+		case "debug-tags":
+			tags := []string{}
+			if *debugTags != "" {
+				tags = strings.Split(*debugTags, ",")
+			}
+			req["DebugTags"] = tags
+		case "rotate":
+			req["RotateLogFile"] = *rotate
+		}
+	})
+
+	if len(req) == 0 {
+		err := printLogStatus(mountpoint)
+		if err != nil {
+			printError("log", err)
+			return 1
+		}
+		return 0
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		printError("log", err)
+		return 1
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(mountpoint, libfs.LogControlFileName), data, 0600)
+	if err != nil {
+		printError("log", err)
+		return 1
+	}
+	return 0
+}
+
+func printLogStatus(mountpoint string) error {
+	data, err := ioutil.ReadFile(
+		filepath.Join(mountpoint, libfs.StatusFileName))
+	if err != nil {
+		return err
+	}
+	var status libkbfs.KBFSStatus
+	err = json.Unmarshal(data, &status)
+	if err != nil {
+		return err
+	}
+	if status.Log == nil {
+		return fmt.Errorf(
+			"the KBFS instance at %s doesn't report its log settings",
+			mountpoint)
+	}
+	fmt.Printf("Debug: %t\n", status.Log.Debug)
+	fmt.Printf("Debug tags: %s\n", strings.Join(status.Log.DebugTags, ","))
+	if status.Log.LogFile != "" {
+		fmt.Printf("Log file: %s\n", status.Log.LogFile)
+	}
+	return nil
+}
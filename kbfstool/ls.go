@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/kbfsapi"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
@@ -18,16 +19,16 @@ func printHeader(p fsrpc.Path) {
 	fmt.Printf("%s:\n", p)
 }
 
-func computeModeStr(entryType libkbfs.EntryType) string {
+func computeModeStr(entryType kbfsapi.EntryType) string {
 	var typeStr string
 	switch entryType {
-	case libkbfs.File:
+	case kbfsapi.File:
 		typeStr = "-"
-	case libkbfs.Exec:
+	case kbfsapi.Exec:
 		typeStr = "-"
-	case libkbfs.Dir:
+	case kbfsapi.Dir:
 		typeStr = "d"
-	case libkbfs.Sym:
+	case kbfsapi.Sym:
 		typeStr = "l"
 	default:
 		typeStr = "?"
@@ -37,13 +38,13 @@ func computeModeStr(entryType libkbfs.EntryType) string {
 	// and omit w below if so.
 	var modeStr string
 	switch entryType {
-	case libkbfs.File:
+	case kbfsapi.File:
 		modeStr = "rw-"
-	case libkbfs.Exec:
+	case kbfsapi.Exec:
 		modeStr = "rwx"
-	case libkbfs.Dir:
+	case kbfsapi.Dir:
 		modeStr = "rwx"
-	case libkbfs.Sym:
+	case kbfsapi.Sym:
 		modeStr = "rwx"
 	default:
 		modeStr = "rw-"
@@ -53,16 +54,16 @@ func computeModeStr(entryType libkbfs.EntryType) string {
 	return fmt.Sprintf("%s%s%s%s", typeStr, modeStr, modeStr, "---")
 }
 
-func printEntry(ctx context.Context, config libkbfs.Config, dir fsrpc.Path, name string, entryType libkbfs.EntryType, longFormat, useSigil bool) {
+func printEntry(ctx context.Context, config libkbfs.Config, dir fsrpc.Path, name string, entryType kbfsapi.EntryType, longFormat, useSigil bool) {
 	var sigil string
 	if useSigil {
 		switch entryType {
-		case libkbfs.File:
-		case libkbfs.Exec:
+		case kbfsapi.File:
+		case kbfsapi.Exec:
 			sigil = "*"
-		case libkbfs.Dir:
+		case kbfsapi.Dir:
 			sigil = "/"
-		case libkbfs.Sym:
+		case kbfsapi.Sym:
 			sigil = "@"
 		default:
 			sigil = "?"
@@ -81,7 +82,7 @@ func printEntry(ctx context.Context, config libkbfs.Config, dir fsrpc.Path, name
 		modeStr := computeModeStr(entryType)
 		mtimeStr := time.Unix(0, de.Mtime).Format("Jan 02 15:04")
 		var symPathStr string
-		if entryType == libkbfs.Sym {
+		if entryType == kbfsapi.Sym {
 			symPathStr = fmt.Sprintf(" -> %s", de.SymPath)
 		}
 		fmt.Printf("%s\t%d\t%s\t%s%s%s\n", modeStr, de.Size, mtimeStr, name, sigil, symPathStr)
@@ -90,23 +91,23 @@ func printEntry(ctx context.Context, config libkbfs.Config, dir fsrpc.Path, name
 	}
 }
 
-func lsHelper(ctx context.Context, config libkbfs.Config, p fsrpc.Path, hasMultiple bool, handleEntry func(string, libkbfs.EntryType)) error {
-	kbfsOps := config.KBFSOps()
+func lsHelper(ctx context.Context, config libkbfs.Config, p fsrpc.Path, hasMultiple bool, handleEntry func(string, kbfsapi.EntryType)) error {
+	kbfsOps := kbfsapi.New(config).Ops
 
 	switch p.PathType {
 	case fsrpc.RootPathType:
 		if hasMultiple {
 			printHeader(p)
 		}
-		handleEntry(topName, libkbfs.Dir)
+		handleEntry(topName, kbfsapi.Dir)
 		return nil
 
 	case fsrpc.KeybasePathType:
 		if hasMultiple {
 			printHeader(p)
 		}
-		handleEntry(publicName, libkbfs.Dir)
-		handleEntry(privateName, libkbfs.Dir)
+		handleEntry(publicName, kbfsapi.Dir)
+		handleEntry(privateName, kbfsapi.Dir)
 		return nil
 
 	case fsrpc.KeybaseChildPathType:
@@ -120,7 +121,7 @@ func lsHelper(ctx context.Context, config libkbfs.Config, p fsrpc.Path, hasMulti
 		}
 		for _, fav := range favs {
 			if p.Public == fav.Public {
-				handleEntry(fav.Name, libkbfs.Dir)
+				handleEntry(fav.Name, kbfsapi.Dir)
 			}
 		}
 		return nil
@@ -130,8 +131,9 @@ func lsHelper(ctx context.Context, config libkbfs.Config, p fsrpc.Path, hasMulti
 		if err != nil {
 			return err
 		}
+		ei := kbfsapi.MakeEntryInfo(de)
 
-		if de.Type == libkbfs.Dir {
+		if ei.Type == kbfsapi.Dir {
 			// GetDirChildren doesn't verify the dir-ness
 			// of the node correctly (since it ends up
 			// creating a new DirBlock if the node isn't
@@ -154,7 +156,7 @@ func lsHelper(ctx context.Context, config libkbfs.Config, p fsrpc.Path, hasMulti
 			if err != nil {
 				return err
 			}
-			handleEntry(name, de.Type)
+			handleEntry(name, ei.Type)
 		}
 		return nil
 
@@ -167,8 +169,8 @@ func lsHelper(ctx context.Context, config libkbfs.Config, p fsrpc.Path, hasMulti
 
 func lsOne(ctx context.Context, config libkbfs.Config, p fsrpc.Path, longFormat, useSigil, recursive, hasMultiple bool, errorFn func(error)) {
 	var children []string
-	handleEntry := func(name string, entryType libkbfs.EntryType) {
-		if recursive && entryType == libkbfs.Dir {
+	handleEntry := func(name string, entryType kbfsapi.EntryType) {
+		if recursive && entryType == kbfsapi.Dir {
 			children = append(children, name)
 		}
 		printEntry(ctx, config, p, name, entryType, longFormat, useSigil)
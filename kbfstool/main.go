@@ -42,6 +42,12 @@ The possible commands are:
   read		Dump file to stdout
   write		Write stdin to file
   md            Operate on metadata objects
+  export	Export a folder to a tar or zip archive
+  export-account	Export all folders to local encrypted archives
+  import	Copy a local directory into a folder, resumably
+  du		Report the size and block usage of a folder's directories
+  fsck		Check a folder's directory tree for errors
+  log		Change the logging of a mounted KBFS instance
 
 `
 
@@ -74,6 +80,12 @@ func realMain() (exitStatus int) {
 		return 1
 	}
 
+	// The log command works on an already-running KBFS instance,
+	// so it doesn't need one of its own.
+	if flag.Arg(0) == "log" {
+		return logControl(flag.Args()[1:])
+	}
+
 	log := logger.NewWithCallDepth("", 1)
 
 	// Pause journal background work, since it may interfere with
@@ -112,6 +124,16 @@ func realMain() (exitStatus int) {
 		return write(ctx, config, args)
 	case "md":
 		return mdMain(ctx, config, args)
+	case "export":
+		return export(ctx, config, args)
+	case "export-account":
+		return exportAccount(ctx, config, args)
+	case "import":
+		return importMain(ctx, config, args)
+	case "du":
+		return du(ctx, config, args)
+	case "fsck":
+		return fsck(ctx, config, args)
 	default:
 		printError("kbfs", fmt.Errorf("unknown command '%s'", cmd))
 		return 1
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const mdChainUsageStr = `Usage:
+  kbfstool md chain [-n count] input
+
+Prints a JSON description of the MD chain of a top-level folder, for
+debugging sync and conflict resolution problems: for each revision,
+its writers, the device key that signed it, its flags, and its ops
+with the block pointers they reference.  For an unmerged branch, the
+merged revision it forked from is included too.
+
+The input is of the form TLF[:Branch][^Revision], as for md dump.
+The chain is printed up to the given revision (the latest one by
+default), and goes back count revisions.
+
+`
+
+func mdChainOne(ctx context.Context, config libkbfs.Config,
+	input string, count int) error {
+	matches := mdGetRegexp.FindStringSubmatch(input)
+	if matches == nil {
+		return fmt.Errorf("Could not parse %q", input)
+	}
+
+	tlfStr := matches[1]
+	branchStr := matches[2]
+	revisionStr := matches[3]
+
+	tlfID, err := getTlfID(ctx, config, tlfStr)
+	if err != nil {
+		return err
+	}
+
+	branchID, err := getBranchID(ctx, config, tlfID, branchStr)
+	if err != nil {
+		return err
+	}
+
+	end, err := getRevision(ctx, config, tlfID, branchID, revisionStr)
+	if err != nil {
+		return err
+	}
+
+	start := end - libkbfs.MetadataRevision(count) + 1
+	if start < libkbfs.MetadataRevisionInitial {
+		start = libkbfs.MetadataRevisionInitial
+	}
+
+	desc, err := libkbfs.DescribeMDChain(
+		ctx, config, tlfID, branchID, start, end)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(desc, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	_, err = os.Stdout.Write(buf)
+	return err
+}
+
+func mdChain(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs md chain", flag.ContinueOnError)
+	count := flags.Int("n", 50, "Number of revisions to describe.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("md chain", err)
+		return 1
+	}
+
+	inputs := flags.Args()
+	if len(inputs) != 1 || *count < 1 {
+		fmt.Print(mdChainUsageStr)
+		return 1
+	}
+
+	err = mdChainOne(ctx, config, inputs[0], *count)
+	if err != nil {
+		printError("md chain", err)
+		return 1
+	}
+
+	return 0
+}
@@ -42,6 +42,15 @@ func checkDirBlock(ctx context.Context, config libkbfs.Config,
 		return err
 	}
 
+	if dirBlock.IsInd {
+		// The entries are spread across the child blocks.
+		for _, iptr := range dirBlock.IPtrs {
+			_ = checkDirBlock(
+				ctx, config, name, kmd, iptr.BlockInfo, verbose)
+		}
+		return nil
+	}
+
 	for entryName, entry := range dirBlock.Children {
 		switch entry.Type {
 		case libkbfs.File, libkbfs.Exec:
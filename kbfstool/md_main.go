@@ -12,8 +12,10 @@ const mdUsageStr = `Usage:
 
 The possible subcommands are:
   dump		Dump metadata objects
+  chain		Describe a range of the metadata chain as JSON
   check		Check metadata objects and their associated blocks for errors
   reset		Reset a broken top-level folder
+  verifyrefs	Check local (-server-root) block references against the metadata history
 
 `
 
@@ -29,10 +31,14 @@ func mdMain(ctx context.Context, config libkbfs.Config, args []string) (exitStat
 	switch cmd {
 	case "dump":
 		return mdDump(ctx, config, args)
+	case "chain":
+		return mdChain(ctx, config, args)
 	case "check":
 		return mdCheck(ctx, config, args)
 	case "reset":
 		return mdReset(ctx, config, args)
+	case "verifyrefs":
+		return mdVerifyRefs(ctx, config, args)
 	default:
 		printError("md", fmt.Errorf("unknown command '%s'", cmd))
 		return 1
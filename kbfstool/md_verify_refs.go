@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const mdVerifyRefsUsageStr = `Usage:
+  kbfstool md verifyrefs [-v] /keybase/[public|private]/user1,assertion2
+
+Cross-checks the block references held by the block server against
+those implied by the TLF's merged metadata history, and reports
+orphaned and missing references.
+
+This is a development tool: it only works against the local on-disk
+servers (-server-root), and fails against the remote block server,
+which has no way to list the references of a folder.
+
+`
+
+func printBlockRefIDs(name string, refs []libkbfs.BlockRefID, verbose bool) {
+	fmt.Printf("%s: %d\n", name, len(refs))
+	if !verbose {
+		return
+	}
+	for _, ref := range refs {
+		fmt.Printf("  %s (ref %s)\n", ref.ID, ref.RefNonce)
+	}
+}
+
+func mdVerifyRefsOne(ctx context.Context, config libkbfs.Config,
+	tlfStr string, verbose bool) (consistent bool, err error) {
+	tlfID, err := getTlfID(ctx, config, tlfStr)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("Verifying block references for %s (%s)...\n",
+		tlfStr, tlfID)
+
+	v, err := libkbfs.VerifyBlockRefs(ctx, config, tlfID)
+	if _, ok := err.(libkbfs.BServerErrorUnsupported); ok {
+		return false, fmt.Errorf(
+			"%v; verifyrefs only works with -server-root", err)
+	} else if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("Checked against revision %d\n", v.Revision)
+	fmt.Printf("Expected live/archived refs: %d/%d\n",
+		v.ExpectedLive, v.ExpectedArchived)
+	fmt.Printf("Actual live/archived refs: %d/%d\n",
+		v.ActualLive, v.ActualArchived)
+	printBlockRefIDs("Orphaned", v.Orphaned, verbose)
+	printBlockRefIDs("Missing", v.Missing, verbose)
+	printBlockRefIDs("Wrongly archived", v.WronglyArchived, verbose)
+	printBlockRefIDs("Wrongly live", v.WronglyLive, verbose)
+
+	return v.IsConsistent(), nil
+}
+
+func mdVerifyRefs(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs md verifyrefs", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "Print each inconsistent reference.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("md verifyrefs", err)
+		return 1
+	}
+
+	inputs := flags.Args()
+	if len(inputs) != 1 {
+		fmt.Print(mdVerifyRefsUsageStr)
+		return 1
+	}
+
+	consistent, err := mdVerifyRefsOne(ctx, config, inputs[0], *verbose)
+	if err != nil {
+		printError("md verifyrefs", err)
+		return 1
+	}
+
+	if !consistent {
+		fmt.Print("Inconsistencies found\n")
+		return 1
+	}
+
+	fmt.Print("\n")
+
+	return 0
+}
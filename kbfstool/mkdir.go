@@ -10,6 +10,7 @@ import (
 	"os"
 
 	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/kbfsapi"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
@@ -20,7 +21,7 @@ func maybePrintPath(path string, err error, verbose bool) {
 	}
 }
 
-func createDir(ctx context.Context, kbfsOps libkbfs.KBFSOps, parentNode libkbfs.Node, dirname, path string, verbose bool) (libkbfs.Node, error) {
+func createDir(ctx context.Context, kbfsOps kbfsapi.Ops, parentNode kbfsapi.Node, dirname, path string, verbose bool) (kbfsapi.Node, error) {
 	childNode, _, err := kbfsOps.CreateDir(ctx, parentNode, dirname)
 	maybePrintPath(path, err, verbose)
 	return childNode, err
@@ -32,7 +33,7 @@ func mkdirOne(ctx context.Context, config libkbfs.Config, dirPathStr string, cre
 		return err
 	}
 
-	kbfsOps := config.KBFSOps()
+	kbfsOps := kbfsapi.New(config).Ops
 
 	if createIntermediate {
 		if p.PathType != fsrpc.TLFPathType || len(p.TLFComponents) == 0 {
@@ -11,14 +11,15 @@ import (
 	"os"
 
 	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/kbfsapi"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
 
 type nodeReader struct {
 	ctx     context.Context
-	kbfsOps libkbfs.KBFSOps
-	node    libkbfs.Node
+	kbfsOps kbfsapi.Ops
+	node    kbfsapi.Node
 	off     int64
 	verbose bool
 }
@@ -79,7 +80,7 @@ func readHelper(ctx context.Context, config libkbfs.Config, args []string) error
 
 	nr := nodeReader{
 		ctx:     ctx,
-		kbfsOps: config.KBFSOps(),
+		kbfsOps: kbfsapi.New(config).Ops,
 		node:    fileNode,
 		off:     0,
 		verbose: *verbose,
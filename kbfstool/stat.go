@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/kbfsapi"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
@@ -20,25 +21,29 @@ func statNode(ctx context.Context, config libkbfs.Config, nodePathStr string) er
 		return err
 	}
 
-	n, ei, err := p.GetNode(ctx, config)
+	n, de, err := p.GetNode(ctx, config)
 	if err != nil {
 		return err
 	}
+	ei := kbfsapi.MakeEntryInfo(de)
 
 	// If n is non-nil, ignore the EntryInfo returned by
 	// p.getNode() so we can exercise the Stat() codepath. We
 	// can't compare the two, since they might legitimately differ
 	// due to races.
 	if n != nil {
-		ei, err = config.KBFSOps().Stat(ctx, n)
+		ei, err = kbfsapi.New(config).Ops.Stat(ctx, n)
 		if err != nil {
 			return err
 		}
 	}
 
 	var symPathStr string
-	if ei.Type == libkbfs.Sym {
+	if ei.Type == kbfsapi.Sym {
 		symPathStr = fmt.Sprintf("SymPath: %s, ", ei.SymPath)
+	} else if ei.Type == kbfsapi.Dir {
+		symPathStr = fmt.Sprintf("ChildCount: %d, RecursiveSize: %d, ",
+			ei.ChildCount, ei.RecursiveSize)
 	}
 
 	mtimeStr := time.Unix(0, ei.Mtime).String()
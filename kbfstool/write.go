@@ -11,14 +11,15 @@ import (
 	"os"
 
 	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/kbfsapi"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
 
 type nodeWriter struct {
 	ctx     context.Context
-	kbfsOps libkbfs.KBFSOps
-	node    libkbfs.Node
+	kbfsOps kbfsapi.Ops
+	node    kbfsapi.Node
 	off     int64
 	verbose bool
 }
@@ -85,7 +86,7 @@ func writeHelper(ctx context.Context, config libkbfs.Config, args []string) (err
 		return err
 	}
 
-	kbfsOps := config.KBFSOps()
+	kbfsOps := kbfsapi.New(config).Ops
 
 	noSuchFileErr := libkbfs.NoSuchNameError{Name: filename}
 
@@ -104,7 +105,7 @@ func writeHelper(ctx context.Context, config libkbfs.Config, args []string) (err
 		if *verbose {
 			fmt.Fprintf(os.Stderr, "Creating %s\n", p)
 		}
-		fileNode, _, err = kbfsOps.CreateFile(ctx, parentNode, filename, false, libkbfs.NoExcl)
+		fileNode, _, err = kbfsOps.CreateFile(ctx, parentNode, filename, false, kbfsapi.NoExcl)
 		if err != nil {
 			return err
 		}
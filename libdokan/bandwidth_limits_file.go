@@ -0,0 +1,28 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// BandwidthLimitsFile represents a write-only file where writing a
+// JSON-encoded libkbfs.BandwidthLimits changes the limits on
+// background traffic.  The current limits are shown in the status
+// file.
+type BandwidthLimitsFile struct {
+	fs *FS
+	specialWriteFile
+}
+
+// WriteFile implements writes for dokan.
+func (f *BandwidthLimitsFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.fs.logEnter(ctx, "BandwidthLimitsFile WriteFile")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return libfs.SetBandwidthLimits(ctx, f.fs.log, f.fs.config, bs)
+}
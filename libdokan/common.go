@@ -67,6 +67,8 @@ func errToDokan(err error) error {
 		return dokan.ErrObjectNameNotFound
 	case libkbfs.NoSuchUserError:
 		return dokan.ErrObjectNameNotFound
+	case libkbfs.NoSuchXattrError:
+		return dokan.ErrObjectNameNotFound
 	case libkbfs.MDServerErrorUnauthorized:
 		return dokan.ErrAccessDenied
 	case nil:
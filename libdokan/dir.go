@@ -289,6 +289,18 @@ func (d *Dir) open(ctx context.Context, oc *openContext, path []string) (dokan.F
 
 		leaf := len(path) == 1
 
+		// Named streams can only be opened on the last component.
+		if leaf {
+			name, stream, err := splitStreamName(path[0])
+			if err != nil {
+				return nil, false, err
+			}
+			if stream != "" {
+				return d.openStream(ctx, oc, name, stream)
+			}
+			path[0] = name
+		}
+
 		// Check if this is a per-file metainformation file, if so
 		// return the corresponding SpecialReadFile.
 		if leaf && strings.HasPrefix(path[0], libfs.FileInfoPrefix) {
@@ -414,6 +426,11 @@ func openSymlink(ctx context.Context, oc *openContext, parent *Dir, rootDir *Dir
 		parent.folder.fs.log.CDebugf(ctx, "openSymlink leaf returned %v,%v => %v,%v", origPath, target, isDir, err)
 		return &Symlink{parent: parent, name: path[0], isTargetADirectory: isDir}, isDir, nil
 	}
+	// Absolute targets into KBFS are followed from the root of the
+	// filesystem, wherever they were created.
+	if dst, ok := absoluteSymlinkPath(parent.folder.fs.config, target); ok {
+		return parent.folder.fs.open(ctx, oc, append(dst, path[1:]...))
+	}
 	// reference symlink, symbolic links always use '/' instead of '\'.
 	if target == "" || target[0] == '/' {
 		return nil, false, dokan.ErrNotSupported
@@ -555,12 +572,33 @@ func resolveSymlinkPath(ctx context.Context, origPath []string, targetPath strin
 	return pathComponents, nil
 }
 
+// absoluteSymlinkPath returns the path components, from the root of
+// the filesystem, of a symlink target that is an absolute path into
+// KBFS, and false for any other target.
+func absoluteSymlinkPath(config libkbfs.Config, target string) ([]string, bool) {
+	mpt := config.MountPathTransformer()
+	canonical := mpt.FromLocal(mpt.ToLocal(target))
+	if !strings.HasPrefix(canonical, libkbfs.CanonicalMountPath+"/") {
+		return nil, false
+	}
+	return strings.FieldsFunc(
+		canonical[len(libkbfs.CanonicalMountPath):], isPathSeparator), true
+}
+
 func resolveSymlinkIsDir(ctx context.Context, oc *openContext, rootDir *Dir, origPath []string, targetPath string) (bool, error) {
-	dst, err := resolveSymlinkPath(ctx, origPath, targetPath)
-	if err != nil {
-		return false, err
+	var obj dokan.File
+	var isDir bool
+	var err error
+	if dst, ok := absoluteSymlinkPath(rootDir.folder.fs.config, targetPath); ok {
+		obj, isDir, err = rootDir.folder.fs.open(ctx, oc, dst)
+	} else {
+		var dst []string
+		dst, err = resolveSymlinkPath(ctx, origPath, targetPath)
+		if err != nil {
+			return false, err
+		}
+		obj, isDir, err = rootDir.open(ctx, oc, dst)
 	}
-	obj, isDir, err := rootDir.open(ctx, oc, dst)
 	if err == nil {
 		obj.Cleanup(ctx, nil)
 	}
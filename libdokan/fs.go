@@ -34,11 +34,19 @@ type FS struct {
 
 	// remoteStatus is the current status of remote connections.
 	remoteStatus libfs.RemoteStatus
+
+	// opTimeout is the deadline for each filesystem operation.
+	opTimeout time.Duration
 }
 
 // DefaultMountFlags are the default mount flags for libdokan.
 const DefaultMountFlags = dokan.CurrentSession
 
+// opTimeoutDefault is the deadline for each filesystem operation.
+// It's a bit less than the 30 seconds after which Dokan gives up on
+// an operation itself.
+const opTimeoutDefault = 29 * time.Second
+
 // currentUserSID stores the Windows identity of the user running
 // this process. This is the same process-wide.
 var currentUserSID, currentUserSIDErr = winacl.CurrentProcessUserSid()
@@ -53,6 +61,7 @@ func NewFS(ctx context.Context, config libkbfs.Config, log logger.Logger) (*FS,
 		config:        config,
 		log:           log,
 		notifications: libfs.NewFSNotifications(log),
+		opTimeout:     opTimeoutDefault,
 	}
 
 	f.root = &Root{
@@ -102,7 +111,7 @@ func (f *FS) WithContext(ctx context.Context) (context.Context, context.CancelFu
 	ctx, err = libkbfs.NewContextWithCancellationDelayer(
 		libkbfs.NewContextReplayable(ctx, func(ctx context.Context) context.Context {
 			ctx = wrapContext(context.WithValue(ctx, CtxIDKey, id), f)
-			ctx, _ = context.WithDeadline(ctx, start.Add(29*time.Second))
+			ctx, _ = context.WithDeadline(ctx, start.Add(f.opTimeout))
 			return ctx
 		}))
 	if err != nil {
@@ -111,12 +120,22 @@ func (f *FS) WithContext(ctx context.Context) (context.Context, context.CancelFu
 	return ctx, cancel
 }
 
+// SetOpTimeoutForTesting shortens the deadline for each filesystem
+// operation to the given timeout.  A zero timeout, or one longer
+// than the default, has no effect.  It must be called before the FS
+// is mounted.
+func (f *FS) SetOpTimeoutForTesting(opTimeout time.Duration) {
+	if opTimeout > 0 && opTimeout < opTimeoutDefault {
+		f.opTimeout = opTimeout
+	}
+}
+
 var vinfo = dokan.VolumeInformation{
 	VolumeName:             "KBFS",
 	MaximumComponentLength: 0xFF, // This can be changed.
 	FileSystemFlags: dokan.FileCasePreservedNames | dokan.FileCaseSensitiveSearch |
 		dokan.FileUnicodeOnDisk | dokan.FileSupportsReparsePoints |
-		dokan.FileSupportsRemoteStorage,
+		dokan.FileSupportsRemoteStorage | dokan.FileNamedStreams,
 	FileSystemName: "KBFS",
 }
 
@@ -284,6 +303,8 @@ func (f *FS) open(ctx context.Context, oc *openContext, ps []string) (dokan.File
 		return oc.returnFileNoCleanup(NewErrorFile(f))
 	case libfs.MetricsFileName == ps[psl-1]:
 		return oc.returnFileNoCleanup(NewMetricsFile(f))
+	case libfs.TraceFileName == ps[psl-1]:
+		return oc.returnFileNoCleanup(NewTraceFile(f))
 		// TODO: Make the two cases below available from any
 		// directory.
 	case libfs.ProfileListDirName == ps[0]:
@@ -313,6 +334,12 @@ func (f *FS) open(ctx context.Context, oc *openContext, ps []string) (dokan.File
 			folder: &Folder{fs: f}, // fake Folder for logging, etc.
 			action: libfs.JournalDisableAuto,
 		})
+	case libfs.BandwidthLimitsFileName == ps[0]:
+		return oc.returnFileNoCleanup(&BandwidthLimitsFile{fs: f})
+	case libfs.LogControlFileName == ps[0]:
+		return oc.returnFileNoCleanup(&LogControlFile{fs: f})
+	case libfs.NetworkHintFileName == ps[0]:
+		return oc.returnFileNoCleanup(&NetworkHintFile{fs: f})
 
 	case ".kbfs_unmount" == ps[0]:
 		os.Exit(0)
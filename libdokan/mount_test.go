@@ -876,6 +876,65 @@ func TestRemoveFile(t *testing.T) {
 
 }
 
+func TestAlternateDataStream(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := filepath.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	const input = "hello, world\n"
+	if err := ioutil.WriteFile(p, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const zone = "[ZoneTransfer]\r\nZoneId=3\r\n"
+	if err := ioutil.WriteFile(p+":Zone.Identifier", []byte(zone), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(p + ":Zone.Identifier:$DATA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(buf), zone; g != e {
+		t.Errorf("wrong stream content: %q != %q", g, e)
+	}
+	buf, err = ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(buf), input; g != e {
+		t.Errorf("wrong content: %q != %q", g, e)
+	}
+
+	{
+		ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+		defer libkbfs.CleanupCancellationDelayer(ctx)
+
+		jdoe := libkbfs.GetRootNodeOrBust(ctx, t, config, "jdoe", false)
+		_, ei, err := config.KBFSOps().Lookup(ctx, jdoe, "myfile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g, e := string(ei.Xattrs["Zone.Identifier"]), zone; g != e {
+			t.Errorf("wrong xattr: %q != %q", g, e)
+		}
+	}
+
+	if err := os.Remove(p + ":Zone.Identifier"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile(p + ":Zone.Identifier"); !os.IsNotExist(err) {
+		t.Errorf("stream still exists: %v", err)
+	}
+	checkDir(t, filepath.Join(mnt.Dir, PrivateName, "jdoe"), map[string]fileInfoCheck{
+		"myfile": func(fi os.FileInfo) error {
+			return mustBeFileWithSize(fi, int64(len(input)))
+		},
+	})
+}
+
 func TestRemoveDir(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
 	defer libkbfs.CheckConfigAndShutdown(t, config)
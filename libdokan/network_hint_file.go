@@ -0,0 +1,28 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// NetworkHintFile represents a write-only file where writing
+// "online" or "offline" tells KBFS whether the OS thinks the device
+// has a network connection.  The resulting connectivity state is
+// shown in the status file.
+type NetworkHintFile struct {
+	fs *FS
+	specialWriteFile
+}
+
+// WriteFile implements writes for dokan.
+func (f *NetworkHintFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.fs.logEnter(ctx, "NetworkHintFile WriteFile")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return libfs.SetNetworkHint(ctx, f.fs.log, f.fs.config, bs)
+}
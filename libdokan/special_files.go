@@ -82,6 +82,18 @@ func handleTLFSpecialFile(name string, folder *Folder) dokan.File {
 			folder: folder,
 			action: libfs.JournalDisable,
 		}
+
+	case libfs.EnableJournalWriteThroughFileName:
+		return &JournalControlFile{
+			folder: folder,
+			action: libfs.JournalEnableWriteThrough,
+		}
+
+	case libfs.DisableJournalWriteThroughFileName:
+		return &JournalControlFile{
+			folder: folder,
+			action: libfs.JournalDisableWriteThrough,
+		}
 	}
 
 	return nil
@@ -71,6 +71,8 @@ func Start(mounter Mounter, options StartOptions, kbCtx libkbfs.Context) *libfs.
 		}
 		log.CInfof(ctx, "Got mount dir from service: %s", options.DokanConfig.Path)
 	}
+	config.SetMountPathTransformer(
+		libkbfs.NewMountPathTransformerStandard(options.DokanConfig.Path))
 
 	if newFolderNameErr != nil {
 		log.CWarningf(ctx, "Error guessing new folder name: %v", newFolderNameErr)
@@ -0,0 +1,271 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// Named streams (alternate data streams) are stored as the extended
+// attributes of files and directories, under the same names, so a
+// stream written on Windows is an xattr on the other platforms and
+// vice versa.  That also limits them to libkbfs's maximum xattr
+// size, which is plenty for zone identifiers and the like.
+
+const dataStreamType = "$DATA"
+
+// splitStreamName splits a path component of the form
+// "name[:stream[:type]]" into the entry name and the stream name,
+// which is empty for the default stream.
+func splitStreamName(s string) (name, stream string, err error) {
+	parts := strings.SplitN(s, ":", 3)
+	switch len(parts) {
+	case 1:
+		return s, "", nil
+	case 3:
+		if !strings.EqualFold(parts[2], dataStreamType) {
+			if parts[1] == "" {
+				// E.g., "dir::$INDEX_ALLOCATION", which is
+				// just the directory.
+				return parts[0], "", nil
+			}
+			return "", "", dokan.ErrNotSupported
+		}
+	}
+	if parts[0] == "" {
+		return "", "", dokan.ErrObjectNameNotFound
+	}
+	return parts[0], parts[1], nil
+}
+
+// openStream opens the named stream of the entry with the given name
+// in d.
+func (d *Dir) openStream(ctx context.Context, oc *openContext,
+	name, stream string) (dokan.File, bool, error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir openStream %s:%s", name, stream)
+	if err := oc.ReturningFileAllowed(); err != nil {
+		return nil, false, err
+	}
+
+	kbfsOps := d.folder.fs.config.KBFSOps()
+	node, ei, err := kbfsOps.Lookup(ctx, d.node, name)
+	if isNoSuchNameError(err) && oc.isCreation() {
+		// Creating a stream creates its file too.
+		node, ei, err = kbfsOps.CreateFile(
+			ctx, d.node, name, false, libkbfs.NoExcl)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if node == nil {
+		// Symlinks have no nodes, and no streams of their own.
+		return nil, false, dokan.ErrNotSupported
+	}
+
+	value, exists := ei.Xattrs[stream]
+	switch {
+	case !exists && !oc.isCreation():
+		return nil, false, dokan.ErrObjectNameNotFound
+	case exists && oc.isExistingError():
+		return nil, false, dokan.ErrFileAlreadyExists
+	}
+	sf := &StreamFile{
+		folder: d.folder,
+		node:   node,
+		name:   name + ":" + stream,
+		stream: stream,
+		dirty:  !exists,
+	}
+	if exists && !oc.isTruncate() {
+		sf.data = append([]byte(nil), value...)
+	} else if exists {
+		sf.dirty = true
+	}
+	return sf, false, nil
+}
+
+// StreamFile is an open named stream of a file or directory.  Its
+// contents are read when it's opened, and written back when it's
+// flushed or closed, so concurrent writers of the same stream each
+// replace what the others wrote.
+type StreamFile struct {
+	folder *Folder
+	node   libkbfs.Node
+	name   string
+	stream string
+	emptyFile
+
+	lock  sync.Mutex
+	data  []byte
+	dirty bool
+}
+
+var _ dokan.File = (*StreamFile)(nil)
+
+// GetFileInformation for dokan.
+func (sf *StreamFile) GetFileInformation(ctx context.Context, fi *dokan.FileInfo) (a *dokan.Stat, err error) {
+	sf.folder.fs.logEnterf(ctx, "StreamFile GetFileInformation %s", sf.name)
+	defer func() { sf.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	a, err = eiToStat(sf.folder.fs.config.KBFSOps().Stat(ctx, sf.node))
+	if err != nil {
+		return nil, err
+	}
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	a.FileSize = int64(len(sf.data))
+	a.FileAttributes = dokan.FileAttributeNormal
+	a.ReparsePointTag = 0
+	return a, nil
+}
+
+// ReadFile for dokan reads.
+func (sf *StreamFile) ReadFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (int, error) {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if offset >= int64(len(sf.data)) {
+		return 0, nil
+	}
+	return copy(bs, sf.data[offset:]), nil
+}
+
+// WriteFile for dokan writes.
+func (sf *StreamFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (int, error) {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if offset == -1 {
+		offset = int64(len(sf.data))
+	}
+	if end := offset + int64(len(bs)); end > int64(len(sf.data)) {
+		sf.data = append(sf.data, make([]byte, end-int64(len(sf.data)))...)
+	}
+	copy(sf.data[offset:], bs)
+	sf.dirty = true
+	return len(bs), nil
+}
+
+func (sf *StreamFile) truncateLocked(length int64) {
+	if length < int64(len(sf.data)) {
+		sf.data = sf.data[:length]
+	} else {
+		sf.data = append(sf.data, make([]byte, length-int64(len(sf.data)))...)
+	}
+	sf.dirty = true
+}
+
+// SetEndOfFile for dokan (f)truncates.
+func (sf *StreamFile) SetEndOfFile(ctx context.Context, fi *dokan.FileInfo, length int64) error {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	sf.truncateLocked(length)
+	return nil
+}
+
+// SetAllocationSize for dokan truncates, but doesn't grow the stream.
+func (sf *StreamFile) SetAllocationSize(ctx context.Context, fi *dokan.FileInfo, length int64) error {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if length < int64(len(sf.data)) {
+		sf.truncateLocked(length)
+	}
+	return nil
+}
+
+// SetFileTime is ignored for streams, which share the times of
+// their entries.
+func (sf *StreamFile) SetFileTime(context.Context, *dokan.FileInfo, time.Time, time.Time, time.Time) error {
+	return nil
+}
+
+// SetFileAttributes is ignored for streams.
+func (sf *StreamFile) SetFileAttributes(ctx context.Context, fi *dokan.FileInfo, fileAttributes dokan.FileAttribute) error {
+	return nil
+}
+
+func (sf *StreamFile) flush(ctx context.Context) error {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if !sf.dirty {
+		return nil
+	}
+	err := sf.folder.fs.config.KBFSOps().SetXattr(
+		ctx, sf.node, sf.stream, sf.data)
+	if err != nil {
+		return err
+	}
+	sf.dirty = false
+	return nil
+}
+
+// FlushFileBuffers writes the stream back to its entry.
+func (sf *StreamFile) FlushFileBuffers(ctx context.Context, fi *dokan.FileInfo) (err error) {
+	sf.folder.fs.logEnterf(ctx, "StreamFile FlushFileBuffers %s", sf.name)
+	defer func() { sf.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return sf.flush(ctx)
+}
+
+// CanDeleteFile - return just nil.
+func (sf *StreamFile) CanDeleteFile(ctx context.Context, fi *dokan.FileInfo) error {
+	return nil
+}
+
+// Cleanup writes the stream back to its entry, or removes it if it
+// was deleted.
+func (sf *StreamFile) Cleanup(ctx context.Context, fi *dokan.FileInfo) {
+	var err error
+	sf.folder.fs.logEnterf(ctx, "StreamFile Cleanup %s", sf.name)
+	defer func() { sf.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	if fi != nil && fi.IsDeleteOnClose() {
+		err = sf.folder.fs.config.KBFSOps().RemoveXattr(
+			ctx, sf.node, sf.stream)
+		if _, ok := err.(libkbfs.NoSuchXattrError); ok {
+			// It was never written back.
+			err = nil
+		}
+		return
+	}
+	err = sf.flush(ctx)
+}
+
+// FindStreams lists the named streams of a file or directory, and the
+// default stream of a file, for dokan.
+func (f *FSO) FindStreams(ctx context.Context, fi *dokan.FileInfo, callback func(*dokan.NamedStream) error) (err error) {
+	f.folder.fs.logEnter(ctx, "FSO FindStreams")
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	ei, err := f.folder.fs.config.KBFSOps().Stat(ctx, f.node)
+	if err != nil {
+		return errToDokan(err)
+	}
+	var ns dokan.NamedStream
+	if ei.Type != libkbfs.Dir {
+		ns.Name = "::" + dataStreamType
+		ns.Size = int64(ei.Size)
+		if err := callback(&ns); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(ei.Xattrs))
+	for name := range ei.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ns.Name = ":" + name + ":" + dataStreamType
+		ns.Size = int64(len(ei.Xattrs[name]))
+		if err := callback(&ns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/libfs"
+)
+
+// NewTraceFile returns a special read file that contains the most
+// recently traced operations in the Chrome trace event format.
+func NewTraceFile(fs *FS) *SpecialReadFile {
+	return &SpecialReadFile{read: libfs.GetEncodedTrace(fs.config), fs: fs}
+}
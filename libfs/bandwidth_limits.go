@@ -0,0 +1,41 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// SetBandwidthLimits changes the background bandwidth limits to the
+// ones in the given data, which must be a JSON-encoded
+// libkbfs.BandwidthLimits, if it is non-empty.  Limits missing from
+// the data are left unchanged.  It returns the number of bytes
+// consumed.
+func SetBandwidthLimits(ctx context.Context, log logger.Logger,
+	config libkbfs.Config, data []byte) (int, error) {
+	log.CDebugf(ctx, "SetBandwidthLimits(%s)", data)
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	limiter := config.BandwidthLimiter()
+	limits := limiter.Limits()
+	err := json.Unmarshal(data, &limits)
+	if err != nil {
+		return 0, err
+	}
+	if limits.UploadBytesPerSecond < 0 ||
+		limits.DownloadBytesPerSecond < 0 {
+		return 0, fmt.Errorf("Negative bandwidth limits: %+v", limits)
+	}
+
+	limiter.SetLimits(limits)
+	return len(data), nil
+}
@@ -8,6 +8,11 @@ package libfs
 // reached from any KBFS directory.
 const MetricsFileName = ".kbfs_metrics"
 
+// TraceFileName is the name of the KBFS trace file, which holds the
+// most recently traced operations in the Chrome trace event format
+// -- it can be reached from any KBFS directory.
+const TraceFileName = ".kbfs_trace"
+
 // ReclaimQuotaFileName is the name of the KBFS quota-reclaiming file
 // -- it can be reached anywhere within a top-level folder.
 const ReclaimQuotaFileName = ".kbfs_reclaim_quota"
@@ -61,6 +66,16 @@ const ResumeJournalBackgroundWorkFileName = ".kbfs_resume_journal_background_wor
 // file. It can be reached anywhere within a top-level folder.
 const DisableJournalFileName = ".kbfs_disable_journal"
 
+// EnableJournalWriteThroughFileName is the name of the file that
+// makes writes to a top-level folder bypass the journal. It can be
+// reached anywhere within a top-level folder.
+const EnableJournalWriteThroughFileName = ".kbfs_enable_journal_write_through"
+
+// DisableJournalWriteThroughFileName is the name of the file that
+// makes writes to a top-level folder go through the journal again. It
+// can be reached anywhere within a top-level folder.
+const DisableJournalWriteThroughFileName = ".kbfs_disable_journal_write_through"
+
 // EnableAutoJournalsFileName is the name of the KBFS-wide
 // auto-journal-enabling file.  It's accessible anywhere outside a TLF.
 const EnableAutoJournalsFileName = ".kbfs_enable_auto_journals"
@@ -76,3 +91,21 @@ const EditHistoryName = ".kbfs_edit_history"
 
 // FileInfoPrefix is the prefix of the per-file metadata files.
 const FileInfoPrefix = ".kbfs_fileinfo_"
+
+// BandwidthLimitsFileName is the name of the KBFS-wide file for
+// changing the background bandwidth limits.  Writing a JSON-encoded
+// libkbfs.BandwidthLimits to it sets the limits given in it.  It's
+// accessible anywhere outside a TLF.
+const BandwidthLimitsFileName = ".kbfs_bandwidth_limits"
+
+// LogControlFileName is the name of the KBFS-wide file for changing
+// the log settings and rotating the log file.  Writing a
+// JSON-encoded LogControlRequest to it applies it.  It's accessible
+// anywhere outside a TLF.
+const LogControlFileName = ".kbfs_log_control"
+
+// NetworkHintFileName is the name of the KBFS-wide file for telling
+// KBFS whether the OS thinks the device is online.  Writing "online"
+// or "offline" to it feeds that hint into the connectivity state
+// shown in the status file.  It's accessible anywhere outside a TLF.
+const NetworkHintFileName = ".kbfs_network_hint"
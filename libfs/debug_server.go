@@ -0,0 +1,269 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// debugPageTimeout bounds how long gathering the data for a single
+// debug page may take.
+const debugPageTimeout = 10 * time.Second
+
+// debugPagePrefix is the path under which all debug pages are served.
+const debugPagePrefix = "/debug/kbfs/"
+
+// debugPage is a single page of the debug server, whose data is
+// gathered by get and rendered as HTML or, with ?format=json, as
+// JSON.
+type debugPage struct {
+	name  string
+	title string
+	get   func(ctx context.Context, config libkbfs.Config) (interface{}, error)
+}
+
+var debugPages = []debugPage{
+	{"status", "KBFS status", getDebugStatus},
+	{"tlfs", "Open folders", getDebugTLFs},
+	{"journals", "Journal queues", getDebugJournals},
+	{"caches", "Cache stats", getDebugCaches},
+	{"ops", "Active operations", getDebugOps},
+	{"errors", "Recent errors", getDebugErrors},
+}
+
+func getDebugStatus(ctx context.Context, config libkbfs.Config) (
+	interface{}, error) {
+	status, _, err := config.KBFSOps().Status(ctx)
+	return status, err
+}
+
+// debugTLFStatus is the status of a single open folder-branch.
+type debugTLFStatus struct {
+	FolderBranch string
+	Status       *libkbfs.FolderBranchStatus `json:",omitempty"`
+	Error        string                      `json:",omitempty"`
+}
+
+func getDebugTLFs(ctx context.Context, config libkbfs.Config) (
+	interface{}, error) {
+	fbs, err := config.KBFSOps().GetOpenFolderBranches(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]debugTLFStatus, 0, len(fbs))
+	for _, fb := range fbs {
+		s := debugTLFStatus{FolderBranch: fb.String()}
+		status, _, err := config.KBFSOps().FolderStatus(ctx, fb)
+		if err != nil {
+			s.Error = err.Error()
+		} else {
+			s.Status = &status
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// debugJournals is the status of the journal server and of each of
+// its TLF journals.
+type debugJournals struct {
+	Server libkbfs.JournalServerStatus
+	TLFs   map[string]libkbfs.TLFJournalStatus
+}
+
+func getDebugJournals(ctx context.Context, config libkbfs.Config) (
+	interface{}, error) {
+	jServer, err := libkbfs.GetJournalServer(config)
+	if err != nil {
+		return "Journaling is not enabled.", nil
+	}
+	status, tlfIDs := jServer.Status(ctx)
+	journals := debugJournals{
+		Server: status,
+		TLFs:   make(map[string]libkbfs.TLFJournalStatus),
+	}
+	for _, tlfID := range tlfIDs {
+		tlfStatus, err := jServer.JournalStatus(tlfID)
+		if err != nil {
+			return nil, err
+		}
+		journals.TLFs[tlfID.String()] = tlfStatus
+	}
+	return journals, nil
+}
+
+// debugCaches holds the cache-related metrics, along with the
+// status of the block cache tuner, if there is one.
+type debugCaches struct {
+	Tuning  *libkbfs.BlockCacheTuningStatus `json:",omitempty"`
+	Metrics map[string]interface{}
+}
+
+// debugTimer summarizes a timer metric.
+type debugTimer struct {
+	Count  int64
+	MeanMs float64
+}
+
+func getDebugCaches(_ context.Context, config libkbfs.Config) (
+	interface{}, error) {
+	caches := debugCaches{
+		Tuning:  config.BlockCacheTuningStatus(),
+		Metrics: make(map[string]interface{}),
+	}
+	registry := config.MetricsRegistry()
+	if registry == nil {
+		return caches, nil
+	}
+	registry.Each(func(name string, i interface{}) {
+		if !strings.Contains(name, "Cache") {
+			return
+		}
+		switch metric := i.(type) {
+		case metrics.Counter:
+			caches.Metrics[name] = metric.Count()
+		case metrics.Gauge:
+			caches.Metrics[name] = metric.Value()
+		case metrics.Meter:
+			caches.Metrics[name] = metric.Snapshot().Count()
+		case metrics.Timer:
+			t := metric.Snapshot()
+			caches.Metrics[name] = debugTimer{
+				Count:  t.Count(),
+				MeanMs: t.Mean() / float64(time.Millisecond),
+			}
+		}
+	})
+	return caches, nil
+}
+
+// debugOps lists the operations in progress and the most recently
+// finished ones.
+type debugOps struct {
+	Active []libkbfs.TraceSpan
+	Recent []libkbfs.TraceSpan
+}
+
+func getDebugOps(_ context.Context, config libkbfs.Config) (
+	interface{}, error) {
+	tracer := config.Tracer()
+	if tracer == nil {
+		return "Tracing has been turned off; " +
+			"turn it on with -trace-capacity.", nil
+	}
+	return debugOps{Active: tracer.Active(), Recent: tracer.Spans()}, nil
+}
+
+func getDebugErrors(_ context.Context, config libkbfs.Config) (
+	interface{}, error) {
+	errors := config.Reporter().AllKnownErrors()
+	jsonErrors := make([]JSONReportedError, len(errors))
+	for i, e := range errors {
+		jsonErrors[i].Time = e.Time
+		jsonErrors[i].Error = e.Error.Error()
+		jsonErrors[i].Stack = convertStack(e.Stack)
+	}
+	return jsonErrors, nil
+}
+
+var debugPageTemplate = template.Must(template.New("debug").Parse(
+	`<!DOCTYPE html>
+<html>
+<head><title>{{.Title}}</title></head>
+<body>
+<p>{{range .Pages}}<a href="{{.Name}}">{{.Title}}</a> | {{end}}<a href="?format=json">JSON</a></p>
+<h1>{{.Title}}</h1>
+<pre>{{.Data}}</pre>
+</body>
+</html>
+`))
+
+func serveDebugPage(config libkbfs.Config, page debugPage,
+	w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), debugPageTimeout)
+	defer cancel()
+	value, err := page.get(ctx, config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := PrettyJSON(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	type pageLink struct{ Name, Title string }
+	links := make([]pageLink, len(debugPages))
+	for i, p := range debugPages {
+		links[i] = pageLink{p.name, p.title}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	debugPageTemplate.Execute(w, struct {
+		Title string
+		Pages []pageLink
+		Data  string
+	}{page.title, links, string(data)})
+}
+
+// NewDebugHandler returns an http.Handler that serves pages about
+// the live state of KBFS -- its status, open folders, journals,
+// caches, active operations and recent errors -- under /debug/kbfs/.
+// Each page is HTML, or JSON when requested with ?format=json.
+func NewDebugHandler(config libkbfs.Config) http.Handler {
+	mux := http.NewServeMux()
+	for _, page := range debugPages {
+		page := page
+		mux.HandleFunc(debugPagePrefix+page.name,
+			func(w http.ResponseWriter, r *http.Request) {
+				serveDebugPage(config, page, w, r)
+			})
+	}
+	mux.Handle(debugPagePrefix, http.RedirectHandler(
+		debugPagePrefix+debugPages[0].name, http.StatusFound))
+	return mux
+}
+
+// ServeDebug serves the debug pages (see NewDebugHandler) at
+// http://addr/debug/kbfs/, until the returned listener is closed.
+// Since the pages expose the names of files and folders, addr must
+// be a loopback address.
+func ServeDebug(config libkbfs.Config, addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" &&
+		(ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf(
+			"The debug server must listen on localhost, not %q", host)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		log := config.MakeLogger("")
+		err := http.Serve(listener, NewDebugHandler(config))
+		log.Debug("Stopped serving debug pages: %v", err)
+	}()
+	return listener, nil
+}
@@ -34,6 +34,12 @@ const (
 	JournalEnableAuto
 	// JournalDisableAuto is to turn off automatic journaling for new TLFs.
 	JournalDisableAuto
+	// JournalEnableWriteThrough is to make writes bypass the
+	// journal, persistently.
+	JournalEnableWriteThrough
+	// JournalDisableWriteThrough is to make writes go through the
+	// journal again.
+	JournalDisableWriteThrough
 )
 
 func (a JournalAction) String() string {
@@ -52,6 +58,10 @@ func (a JournalAction) String() string {
 		return "Enable auto-journals"
 	case JournalDisableAuto:
 		return "Disable auto-journals"
+	case JournalEnableWriteThrough:
+		return "Enable journal write-through"
+	case JournalDisableWriteThrough:
+		return "Disable journal write-through"
 	}
 	return fmt.Sprintf("JournalAction(%d)", int(a))
 }
@@ -100,6 +110,18 @@ func (a JournalAction) Execute(
 			return err
 		}
 
+	case JournalEnableWriteThrough:
+		err := jServer.SetWriteThrough(ctx, tlfID, true)
+		if err != nil {
+			return err
+		}
+
+	case JournalDisableWriteThrough:
+		err := jServer.SetWriteThrough(ctx, tlfID, false)
+		if err != nil {
+			return err
+		}
+
 	default:
 		return fmt.Errorf("Unknown action %s", a)
 	}
@@ -0,0 +1,57 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// LogControlRequest is what's written, JSON-encoded, to the log
+// control file.
+type LogControlRequest struct {
+	libkbfs.LogSettings
+	// RotateLogFile, if true, moves the current log file aside and
+	// starts a new one, after applying the settings.
+	RotateLogFile bool
+}
+
+// ControlLogs changes the log settings to the ones in the given
+// data, which must be a JSON-encoded LogControlRequest, if it is
+// non-empty.  Settings missing from the data are left unchanged.  It
+// returns the number of bytes consumed.
+func ControlLogs(ctx context.Context, log logger.Logger,
+	config libkbfs.Config, data []byte) (int, error) {
+	log.CDebugf(ctx, "ControlLogs(%s)", data)
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	logControl := config.LogControl()
+	if logControl == nil {
+		return 0, errors.New(
+			"The log settings of this KBFS instance can't be changed")
+	}
+	req := LogControlRequest{LogSettings: logControl.Settings()}
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return 0, err
+	}
+	err = logControl.SetSettings(req.LogSettings)
+	if err != nil {
+		return 0, err
+	}
+	if req.RotateLogFile {
+		err = logControl.RotateLogFile()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/metricsutil"
+)
+
+// ServeMetrics serves the metrics in config's registry at
+// http://addr/metrics, in the Prometheus text format, until the
+// returned listener is closed.
+func ServeMetrics(config libkbfs.Config, addr string) (net.Listener, error) {
+	registry := config.MetricsRegistry()
+	if registry == nil {
+		return nil, errors.New("Metrics have been turned off")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsutil.NewPrometheusHandler(registry))
+	go func() {
+		log := config.MakeLogger("")
+		err := http.Serve(listener, mux)
+		log.Debug("Stopped serving metrics: %v", err)
+	}()
+	return listener, nil
+}
@@ -0,0 +1,32 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// SetNetworkHint tells the connectivity tracker whether the OS thinks
+// the device is online, according to the given data, which must be
+// "online" or "offline", optionally surrounded by whitespace.  It
+// returns the number of bytes consumed.
+func SetNetworkHint(ctx context.Context, log logger.Logger,
+	config libkbfs.Config, data []byte) (int, error) {
+	log.CDebugf(ctx, "SetNetworkHint(%s)", data)
+	switch hint := strings.TrimSpace(string(data)); hint {
+	case "online":
+		config.Connectivity().SetNetworkHint(true)
+	case "offline":
+		config.Connectivity().SetNetworkHint(false)
+	default:
+		return 0, fmt.Errorf("Unknown network hint %q", hint)
+	}
+	return len(data), nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedTrace returns the traced operations encoded as bytes for
+// the trace file.
+func GetEncodedTrace(config libkbfs.Config) func(context.Context) ([]byte, time.Time, error) {
+	return func(context.Context) ([]byte, time.Time, error) {
+		tracer := config.Tracer()
+		if tracer == nil {
+			return []byte("Tracing has been turned off.\n"), time.Time{}, nil
+		}
+		b := bytes.NewBuffer(nil)
+		if err := tracer.WriteChromeTrace(b); err != nil {
+			return nil, time.Time{}, err
+		}
+		return b.Bytes(), time.Time{}, nil
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+func makeLockingFS(t *testing.T, config *libkbfs.ConfigLocal) (
+	string, func()) {
+	mnt, _, cancelFn := makeFSWithOptions(
+		t, config, fuse.LockingPOSIX(), fuse.LockingFlock())
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	if err := ioutil.WriteFile(p, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p, func() {
+		cancelFn()
+		mnt.Close()
+	}
+}
+
+func TestFlock(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	p, cleanup := makeLockingFS(t, config)
+	defer cleanup()
+
+	f1, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	f2, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+
+	if err := syscall.Flock(int(f1.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Flock(int(f2.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err != syscall.EWOULDBLOCK {
+		t.Fatalf("expected EWOULDBLOCK, got %v", err)
+	}
+
+	// The lease lock file is visible to other devices.
+	lockFile := path.Join(path.Dir(p), ".flock-myfile")
+	if _, err := os.Stat(lockFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the file drops its lock.
+	if err := f1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Flock(int(f2.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Flock(int(f2.Fd()), syscall.LOCK_UN); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
+		t.Fatalf("expected the lock file to be gone, got %v", err)
+	}
+}
+
+func TestFcntlLock(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	p, cleanup := makeLockingFS(t, config)
+	defer cleanup()
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lk := syscall.Flock_t{
+		Type:   syscall.F_WRLCK,
+		Whence: 0,
+		Start:  0,
+		Len:    2,
+	}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk); err != nil {
+		t.Fatal(err)
+	}
+
+	// The kernel answers queries from the lock owner itself, so
+	// only check that the query round-trips.
+	query := syscall.Flock_t{
+		Type:   syscall.F_RDLCK,
+		Whence: 0,
+		Start:  0,
+		Len:    1,
+	}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &query); err != nil {
+		t.Fatal(err)
+	}
+	if query.Type != syscall.F_UNLCK {
+		t.Errorf("expected no conflict with our own lock, got %v", query)
+	}
+
+	lockFile := path.Join(path.Dir(p), ".lock-myfile")
+	if _, err := os.Stat(lockFile); err != nil {
+		t.Fatal(err)
+	}
+
+	lk.Type = syscall.F_UNLCK
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
+		t.Fatalf("expected the lock file to be gone, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// BandwidthLimitsFile represents a write-only file where writing a
+// JSON-encoded libkbfs.BandwidthLimits changes the limits on
+// background traffic.  The current limits are shown in the status
+// file.
+type BandwidthLimitsFile struct {
+	fs *FS
+}
+
+var _ fs.Node = (*BandwidthLimitsFile)(nil)
+
+// Attr implements the fs.Node interface for BandwidthLimitsFile.
+func (f *BandwidthLimitsFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*BandwidthLimitsFile)(nil)
+
+var _ fs.HandleWriter = (*BandwidthLimitsFile)(nil)
+
+// Write implements the fs.HandleWriter interface for BandwidthLimitsFile.
+func (f *BandwidthLimitsFile) Write(ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	size, err := libfs.SetBandwidthLimits(
+		ctx, f.fs.log, f.fs.config, req.Data)
+	if err != nil {
+		return err
+	}
+	resp.Size = size
+	return nil
+}
@@ -7,7 +7,7 @@ package libfuse
 import (
 	"time"
 
-	"bazil.org/fuse"
+	"github.com/keybase/kbfs/bazilfuse"
 	"github.com/keybase/kbfs/libkbfs"
 )
 
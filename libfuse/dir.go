@@ -13,8 +13,8 @@ import (
 	"syscall"
 	"time"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fs"
 	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
@@ -345,6 +345,7 @@ type DirInterface interface {
 	fs.NodeCreater
 	fs.NodeMkdirer
 	fs.NodeSymlinker
+	fs.NodeMknoder
 	fs.NodeRenamer
 	fs.NodeRemover
 	fs.Handle
@@ -395,13 +396,28 @@ func (d *Dir) attr(ctx context.Context, a *fuse.Attr) (err error) {
 	}
 	fillAttr(&de, a)
 
-	a.Mode = os.ModeDir | 0700
-	if d.folder.list.public {
-		a.Mode |= 0055
-	}
+	a.Mode = os.ModeDir | permMode(de, d.folder.list.public)
 	return nil
 }
 
+// checkWritable returns EACCES if the owner permission bits of d
+// don't allow changing its entries.
+func (d *Dir) checkWritable(ctx context.Context) error {
+	return checkPerm(ctx, d.folder.fs.config, d.node, 0200)
+}
+
+var _ fs.NodeAccesser = (*Dir)(nil)
+
+// Access implements the fs.NodeAccesser interface for Dir.
+func (d *Dir) Access(ctx context.Context, req *fuse.AccessRequest) (
+	err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Access %o", req.Mask)
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	return checkPerm(ctx, d.folder.fs.config, d.node,
+		os.FileMode(req.Mask&07)<<6)
+}
+
 // Lookup implements the fs.NodeRequestLookuper interface for Dir.
 func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (node fs.Node, err error) {
 	d.folder.fs.log.CDebugf(ctx, "Dir Lookup %s", req.Name)
@@ -473,6 +489,11 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		return child, nil
 
 	case libkbfs.Sym:
+		if de.Special != libkbfs.NotSpecial {
+			// Like a Symlink, a SpecialEntry is never included in
+			// Folder.nodes.
+			return &SpecialEntry{parent: d, name: req.Name}, nil
+		}
 		child := &Symlink{
 			parent: d,
 			name:   req.Name,
@@ -499,6 +520,10 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 	d.folder.fs.log.CDebugf(ctx, "Dir Create %s", req.Name)
 	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
 
+	if err := d.checkWritable(ctx); err != nil {
+		return nil, nil, err
+	}
+
 	isExec := (req.Mode.Perm() & 0100) != 0
 	excl := getEXCLFromCreateRequest(req)
 	newNode, ei, err := d.folder.fs.config.KBFSOps().CreateFile(
@@ -541,6 +566,10 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (
 		return nil, err
 	}
 
+	if err := d.checkWritable(ctx); err != nil {
+		return nil, err
+	}
+
 	newNode, _, err := d.folder.fs.config.KBFSOps().CreateDir(
 		ctx, d.node, req.Name)
 	if err != nil {
@@ -568,8 +597,15 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (
 		return nil, err
 	}
 
+	if err := d.checkWritable(ctx); err != nil {
+		return nil, err
+	}
+
+	// Store absolute targets into KBFS relative to the canonical
+	// mountpoint, so they resolve on other devices too.
+	target := d.folder.fs.config.MountPathTransformer().FromLocal(req.Target)
 	if _, err := d.folder.fs.config.KBFSOps().CreateLink(
-		ctx, d.node, req.NewName, req.Target); err != nil {
+		ctx, d.node, req.NewName, target); err != nil {
 		return nil, err
 	}
 
@@ -617,6 +653,13 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest,
 		return fuse.Errno(syscall.EXDEV)
 	}
 
+	if err := d.checkWritable(ctx); err != nil {
+		return err
+	}
+	if err := realNewDir.checkWritable(ctx); err != nil {
+		return err
+	}
+
 	// overwritten node, if any, will be removed from Folder.nodes, if
 	// it is there in the first place, by its Forget
 
@@ -640,6 +683,10 @@ func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
 		return err
 	}
 
+	if err := d.checkWritable(ctx); err != nil {
+		return err
+	}
+
 	// node will be removed from Folder.nodes, if it is there in the
 	// first place, by its Forget
 
@@ -668,20 +715,33 @@ func (d *Dir) ReadDirAll(ctx context.Context) (res []fuse.Dirent, err error) {
 	for name, ei := range children {
 		fde := fuse.Dirent{
 			Name: name,
-		}
-		switch ei.Type {
-		case libkbfs.File, libkbfs.Exec:
-			fde.Type = fuse.DT_File
-		case libkbfs.Dir:
-			fde.Type = fuse.DT_Dir
-		case libkbfs.Sym:
-			fde.Type = fuse.DT_Link
+			Type: fuseDirentType(ei),
 		}
 		res = append(res, fde)
 	}
 	return res, nil
 }
 
+// fuseDirentType returns the directory entry type for the given
+// KBFS entry.
+func fuseDirentType(ei libkbfs.EntryInfo) fuse.DirentType {
+	switch ei.Special {
+	case libkbfs.Fifo:
+		return fuse.DT_FIFO
+	case libkbfs.Socket:
+		return fuse.DT_Socket
+	}
+	switch ei.Type {
+	case libkbfs.File, libkbfs.Exec:
+		return fuse.DT_File
+	case libkbfs.Dir:
+		return fuse.DT_Dir
+	case libkbfs.Sym:
+		return fuse.DT_Link
+	}
+	return fuse.DT_Unknown
+}
+
 // Forget kernel reference to this node.
 func (d *Dir) Forget() {
 	d.folder.forgetNode(d.node)
@@ -695,13 +755,18 @@ func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.
 	valid := req.Valid
 
 	if valid.Mode() {
-		// You can't set the mode on KBFS directories, but we don't
-		// want to return EPERM because that unnecessarily fails some
-		// applications like unzip.  Instead ignore it, print a debug
-		// message, and advertise this behavior on the
-		// "understand_kbfs" doc online.
-		d.folder.fs.log.CDebugf(ctx, "Ignoring unsupported attempt to set "+
-			"the mode on a directory")
+		// KBFS only stores the owner bits; see permMode.
+		err := d.folder.fs.config.KBFSOps().SetPerm(
+			ctx, d.node, req.Mode.Perm())
+		if _, ok := err.(libkbfs.InvalidParentPathError); ok {
+			// You can't set the mode on a TLF root directory,
+			// but we don't want to return EPERM because that
+			// unnecessarily fails some applications like unzip.
+			d.folder.fs.log.CDebugf(ctx, "Ignoring unsupported attempt "+
+				"to set the mode on a TLF root directory")
+		} else if err != nil {
+			return err
+		}
 		valid &^= fuse.SetattrMode
 	}
 
@@ -745,6 +810,44 @@ func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.
 	return nil
 }
 
+var _ fs.NodeGetxattrer = (*Dir)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for Dir.
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Getxattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	return getXattr(ctx, d.folder, d.node, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*Dir)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for Dir.
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Listxattr")
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	return listXattr(ctx, d.folder, d.node, req, resp)
+}
+
+var _ fs.NodeSetxattrer = (*Dir)(nil)
+
+// Setxattr implements the fs.NodeSetxattrer interface for Dir.
+func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Setxattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return setXattr(ctx, d.folder, d.node, req)
+}
+
+var _ fs.NodeRemovexattrer = (*Dir)(nil)
+
+// Removexattr implements the fs.NodeRemovexattrer interface for Dir.
+func (d *Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Removexattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return removeXattr(ctx, d.folder, d.node, req)
+}
+
 // isNoSuchNameError checks for libkbfs.NoSuchNameError.
 func isNoSuchNameError(err error) bool {
 	_, ok := err.(libkbfs.NoSuchNameError)
@@ -0,0 +1,142 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// dirPageSize is the number of entries an open directory fetches
+// from KBFS at a time while it's being read.
+const dirPageSize = 1000
+
+// dirHandle is an open Dir.  Rather than listing the whole directory
+// up front, like fs.HandleReadDirAller does, it encodes the
+// directory a page at a time as the kernel reads it, and keeps only
+// the encoded entries that haven't been read yet.
+type dirHandle struct {
+	dir *Dir
+
+	lock sync.Mutex
+	// start is the offset in the directory stream of buf[0].
+	start int64
+	// buf holds the encoded entries from start onward.
+	buf []byte
+	// cursor is the name of the last entry encoded so far.
+	cursor string
+	// done is set once all the entries have been encoded.
+	done bool
+}
+
+var _ fs.Handle = (*dirHandle)(nil)
+
+// appendDirent appends the encoding of de to data, which holds the
+// directory stream from offset start onward.  fuse.AppendDirent sets
+// each entry's offset (the offset of the entry after it, which the
+// kernel passes back to continue reading) relative to data, so shift
+// it to be relative to the whole stream.
+func appendDirent(data []byte, start int64, de fuse.Dirent) []byte {
+	i := len(data)
+	data = fuse.AppendDirent(data, de)
+	// The offset is the second uint64 of the encoded entry.
+	off := (*uint64)(unsafe.Pointer(&data[i+8]))
+	*off += uint64(start)
+	return data
+}
+
+func (h *dirHandle) resetLocked() {
+	h.start = 0
+	h.buf = nil
+	h.cursor = ""
+	h.done = false
+}
+
+// fillLocked encodes pages of entries until buf reaches the stream
+// offset end, or there are no more entries.  Whole pages that end at
+// or before the stream offset off are dropped along the way, since
+// the kernel is done with them.
+func (h *dirHandle) fillLocked(
+	ctx context.Context, parent fuse.NodeID, off, end int64) error {
+	for !h.done && h.start+int64(len(h.buf)) < end {
+		if n := int64(len(h.buf)); h.start+n <= off {
+			h.start += n
+			h.buf = nil
+		}
+		children, next, err := h.dir.folder.fs.config.KBFSOps().
+			GetDirChildrenPaged(ctx, h.dir.node, h.cursor, dirPageSize)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			h.buf = appendDirent(h.buf, h.start, fuse.Dirent{
+				// The inode only has to be non-zero, so that
+				// readdir(3) doesn't skip the entry.
+				Inode: fs.GenerateDynamicInode(uint64(parent), child.Name),
+				Type:  fuseDirentType(child.EntryInfo),
+				Name:  child.Name,
+			})
+		}
+		h.cursor = next
+		h.done = next == ""
+	}
+	return nil
+}
+
+// Read implements the fs.HandleReader interface for dirHandle.
+func (h *dirHandle) Read(ctx context.Context, req *fuse.ReadRequest,
+	resp *fuse.ReadResponse) (err error) {
+	h.dir.folder.fs.log.CDebugf(ctx, "Dir Read off=%d size=%d",
+		req.Offset, req.Size)
+	defer func() { h.dir.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if req.Offset == 0 || req.Offset < h.start {
+		// A rewinddir(3), or a seek back to entries that have
+		// already been dropped: start over.
+		h.resetLocked()
+	}
+	err = h.fillLocked(
+		ctx, req.Node, req.Offset, req.Offset+int64(req.Size))
+	if err != nil {
+		return err
+	}
+
+	// Drop the entries the kernel has already consumed; it only
+	// ever continues from the offset of an entry boundary.
+	if skip := req.Offset - h.start; skip > 0 {
+		if skip > int64(len(h.buf)) {
+			skip = int64(len(h.buf))
+		}
+		h.buf = h.buf[skip:]
+		h.start += skip
+	}
+	n := req.Size
+	if n > len(h.buf) {
+		n = len(h.buf)
+	}
+	resp.Data = append(resp.Data[:0], h.buf[:n]...)
+	return nil
+}
+
+var _ fs.NodeOpener = (*Dir)(nil)
+
+// Open implements the fs.NodeOpener interface for Dir.
+func (d *Dir) Open(ctx context.Context, req *fuse.OpenRequest,
+	resp *fuse.OpenResponse) (handle fs.Handle, err error) {
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	err = checkPerm(ctx, d.folder.fs.config, d.node, 0400)
+	if err != nil {
+		return nil, err
+	}
+	return &dirHandle{dir: d}, nil
+}
@@ -5,10 +5,13 @@
 package libfuse
 
 import (
+	"math"
+	"os"
 	"sync"
+	"syscall"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
@@ -63,10 +66,7 @@ var _ fs.Node = (*File)(nil)
 
 func fillAttrWithMode(ei *libkbfs.EntryInfo, a *fuse.Attr) {
 	fillAttr(ei, a)
-	a.Mode = 0644
-	if ei.Type == libkbfs.Exec {
-		a.Mode |= 0111
-	}
+	a.Mode = permMode(*ei, true)
 }
 
 // Attr implements the fs.Node interface for File.
@@ -76,7 +76,7 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) (err error) {
 
 	if reqID, ok := ctx.Value(CtxIDKey).(string); ok {
 		if ei := f.eiCache.getAndDestroyIfMatches(reqID); ei != nil {
-			fillAttrWithMode(ei, a)
+			f.fillAttr(ei, a)
 			return nil
 		}
 	}
@@ -100,10 +100,46 @@ func (f *File) attr(ctx context.Context, a *fuse.Attr) (err error) {
 		return err
 	}
 
-	fillAttrWithMode(&de, a)
+	f.fillAttr(&de, a)
 	return nil
 }
 
+func (f *File) fillAttr(ei *libkbfs.EntryInfo, a *fuse.Attr) {
+	fillAttrWithMode(ei, a)
+	if f.folder.fs.config.StrictTimes() {
+		// The times change on every write, so the kernel
+		// mustn't cache them.
+		a.Valid = 0
+	}
+}
+
+var _ fs.NodeOpener = (*File)(nil)
+
+// Open implements the fs.NodeOpener interface for File.
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest,
+	resp *fuse.OpenResponse) (handle fs.Handle, err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Open %s", req.Flags)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	err = checkPerm(ctx, f.folder.fs.config, f.node, openPerm(req.Flags))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+var _ fs.NodeAccesser = (*File)(nil)
+
+// Access implements the fs.NodeAccesser interface for File.
+func (f *File) Access(ctx context.Context, req *fuse.AccessRequest) (
+	err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Access %o", req.Mask)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	return checkPerm(ctx, f.folder.fs.config, f.node,
+		os.FileMode(req.Mask&07)<<6)
+}
+
 var _ fs.NodeFsyncer = (*File)(nil)
 
 func (f *File) sync(ctx context.Context) error {
@@ -159,7 +195,14 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest,
 	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
 
 	f.eiCache.destroy()
-	if err := f.folder.fs.config.KBFSOps().Write(
+	if req.FileFlags&fuse.OpenAppend != 0 {
+		// The kernel's idea of the end of the file may be out of
+		// date, so let KBFS find it.
+		if _, err := f.folder.fs.config.KBFSOps().Append(
+			ctx, f.node, req.Data); err != nil {
+			return err
+		}
+	} else if err := f.folder.fs.config.KBFSOps().Write(
 		ctx, f.node, req.Data, req.Offset); err != nil {
 		return err
 	}
@@ -174,6 +217,12 @@ func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
 	f.folder.fs.log.CDebugf(ctx, "File Flush")
 	// I'm not sure about the guarantees from KBFSOps, so we don't
 	// differentiate between Flush and Fsync.
+	//
+	// With the writeback cache, the kernel writes back the file's
+	// dirty pages before sending a flush or an fsync, so syncing
+	// here covers them too.  Pages dirtied through an mmap after
+	// the last flush are picked up by libkbfs's background
+	// flusher.
 	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
 
 	// This fits in situation 1 as described in libkbfs/delayed_cancellation.go
@@ -197,6 +246,16 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 	f.eiCache.destroy()
 
 	valid := req.Valid
+	if valid == fuse.SetattrMtime|fuse.SetattrHandle {
+		// With the writeback cache, the kernel keeps the mtime of
+		// files being written to itself, and sends it along with
+		// the file handle when it writes them back.  (Setting the
+		// mtime from userspace never includes a handle.)  KBFS
+		// already sets the mtime on every write, so drop this
+		// rather than make a separate revision for it.
+		return f.attr(ctx, &resp.Attr)
+	}
+
 	if valid.Size() {
 		if err := f.folder.fs.config.KBFSOps().Truncate(
 			ctx, f.node, req.Size); err != nil {
@@ -215,10 +274,9 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 	}
 
 	if valid.Mode() {
-		// Unix has 3 exec bits, KBFS has one; we follow the user-exec bit.
-		exec := req.Mode&0100 != 0
-		err := f.folder.fs.config.KBFSOps().SetEx(
-			ctx, f.node, exec)
+		// KBFS only stores the owner bits; see permMode.
+		err := f.folder.fs.config.KBFSOps().SetPerm(
+			ctx, f.node, req.Mode.Perm())
 		if err != nil {
 			return err
 		}
@@ -266,6 +324,177 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 	return nil
 }
 
+var _ fs.NodeGetxattrer = (*File)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for File.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Getxattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	return getXattr(ctx, f.folder, f.node, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*File)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for File.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Listxattr")
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	return listXattr(ctx, f.folder, f.node, req, resp)
+}
+
+var _ fs.NodeSetxattrer = (*File)(nil)
+
+// Setxattr implements the fs.NodeSetxattrer interface for File.
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Setxattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return setXattr(ctx, f.folder, f.node, req)
+}
+
+var _ fs.NodeRemovexattrer = (*File)(nil)
+
+// Removexattr implements the fs.NodeRemovexattrer interface for File.
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Removexattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	return removeXattr(ctx, f.folder, f.node, req)
+}
+
+// advisoryLockOwner returns the owner of the lock in a lock request.
+// flock locks always cover the whole file.
+func advisoryLockOwner(lockOwner uint64, lk fuse.FileLock,
+	flags fuse.LockFlags) (
+	libkbfs.AdvisoryLockOwner, libkbfs.AdvisoryLockRange) {
+	if flags&fuse.LockFlock != 0 {
+		return libkbfs.AdvisoryLockOwner{
+			Kind: libkbfs.AdvisoryLockFlock,
+			ID:   lockOwner,
+		}, libkbfs.AdvisoryLockWholeFile
+	}
+	return libkbfs.AdvisoryLockOwner{
+		Kind: libkbfs.AdvisoryLockPOSIX,
+		ID:   lockOwner,
+	}, libkbfs.AdvisoryLockRange{Start: lk.Start, End: lk.End}
+}
+
+func advisoryLockMode(t fuse.LockType) (libkbfs.AdvisoryLockMode, error) {
+	switch t {
+	case fuse.LockRead:
+		return libkbfs.AdvisoryLockShared, nil
+	case fuse.LockWrite:
+		return libkbfs.AdvisoryLockExclusive, nil
+	default:
+		return 0, fuse.Errno(syscall.EINVAL)
+	}
+}
+
+func (f *File) lock(ctx context.Context, req *fuse.LockRequest,
+	wait bool) error {
+	mode, err := advisoryLockMode(req.Lock.Type)
+	if err != nil {
+		return err
+	}
+	table, err := f.folder.fs.getAdvisoryLocks()
+	if err != nil {
+		return err
+	}
+	owner, r := advisoryLockOwner(req.LockOwner, req.Lock, req.LockFlags)
+	err = table.Lock(ctx, f.node, owner, r, mode, wait)
+	if wait && ctx.Err() != nil {
+		// The process got a signal while it waited.
+		return fuse.EINTR
+	}
+	return err
+}
+
+var _ fs.HandleLocker = (*File)(nil)
+
+// Lock implements the fs.HandleLocker interface for File.
+func (f *File) Lock(ctx context.Context, req *fuse.LockRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Lock %s", req.Lock)
+	defer func() { f.folder.fs.log.CDebugf(ctx, "File Lock done: %v", err) }()
+	return f.lock(ctx, req, false)
+}
+
+// LockWait implements the fs.HandleLocker interface for File.
+func (f *File) LockWait(ctx context.Context, req *fuse.LockWaitRequest) (
+	err error) {
+	f.folder.fs.log.CDebugf(ctx, "File LockWait %s", req.Lock)
+	defer func() {
+		f.folder.fs.log.CDebugf(ctx, "File LockWait done: %v", err)
+	}()
+	return f.lock(ctx, (*fuse.LockRequest)(req), true)
+}
+
+// Unlock implements the fs.HandleLocker interface for File.
+func (f *File) Unlock(ctx context.Context, req *fuse.UnlockRequest) (
+	err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Unlock %s", req.Lock)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	table, err := f.folder.fs.getAdvisoryLocks()
+	if err != nil {
+		return err
+	}
+	owner, r := advisoryLockOwner(req.LockOwner, req.Lock, req.LockFlags)
+	return table.Unlock(ctx, f.node, owner, r)
+}
+
+// QueryLock implements the fs.HandleLocker interface for File.
+func (f *File) QueryLock(ctx context.Context, req *fuse.QueryLockRequest,
+	resp *fuse.QueryLockResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File QueryLock %s", req.Lock)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	mode, err := advisoryLockMode(req.Lock.Type)
+	if err != nil {
+		return err
+	}
+	table, err := f.folder.fs.getAdvisoryLocks()
+	if err != nil {
+		return err
+	}
+	owner, r := advisoryLockOwner(req.LockOwner, req.Lock, req.LockFlags)
+	conflict, err := table.Query(ctx, f.node, owner, r, mode)
+	if err != nil || conflict == nil {
+		return err
+	}
+	resp.Lock = fuse.FileLock{
+		Start: conflict.Range.Start,
+		End:   conflict.Range.End,
+		Type:  fuse.LockRead,
+	}
+	if conflict.Mode == libkbfs.AdvisoryLockExclusive {
+		resp.Lock.Type = fuse.LockWrite
+	}
+	// The kernel rejects offsets past the largest file size.
+	if resp.Lock.End > math.MaxInt64 {
+		resp.Lock.End = math.MaxInt64
+	}
+	return nil
+}
+
+var _ fs.HandleReleaser = (*File)(nil)
+
+// Release implements the fs.HandleReleaser interface for File.
+func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) (
+	err error) {
+	if req.ReleaseFlags&fuse.ReleaseFlockUnlock == 0 {
+		return nil
+	}
+	// The last close of a file drops its flock locks.
+	f.folder.fs.log.CDebugf(ctx, "File Release (flock unlock)")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	table, err := f.folder.fs.getAdvisoryLocks()
+	if err != nil {
+		return err
+	}
+	return table.UnlockAll(ctx, libkbfs.AdvisoryLockOwner{
+		Kind: libkbfs.AdvisoryLockFlock,
+		ID:   req.LockOwner,
+	})
+}
+
 var _ fs.NodeForgetter = (*File)(nil)
 
 // Forget kernel reference to this node.
@@ -8,10 +8,11 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fs"
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/kbfs/libfs"
@@ -37,6 +38,11 @@ type FS struct {
 	execAfterDelay func(d time.Duration, f func())
 
 	root Root
+
+	// advisoryLocks serves fcntl and flock locks, when the mount
+	// passes them to us; it's created on first use.
+	advisoryLocksLock sync.Mutex
+	advisoryLocks     *libkbfs.AdvisoryLockTable
 }
 
 // NewFS creates an FS
@@ -73,6 +79,21 @@ func NewFS(config libkbfs.Config, conn *fuse.Conn, debug bool) *FS {
 	return fs
 }
 
+// getAdvisoryLocks returns the table of fcntl and flock locks taken
+// through this FS.
+func (f *FS) getAdvisoryLocks() (*libkbfs.AdvisoryLockTable, error) {
+	f.advisoryLocksLock.Lock()
+	defer f.advisoryLocksLock.Unlock()
+	if f.advisoryLocks == nil {
+		table, err := libkbfs.NewAdvisoryLockTable(f.config)
+		if err != nil {
+			return nil, err
+		}
+		f.advisoryLocks = table
+	}
+	return f.advisoryLocks, nil
+}
+
 // SetFuseConn sets fuse connection for this FS.
 func (f *FS) SetFuseConn(fuse *fs.Server, conn *fuse.Conn) {
 	f.fuse = fuse
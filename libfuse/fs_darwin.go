@@ -9,8 +9,8 @@ import (
 	"path/filepath"
 	"runtime"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fs"
 	"github.com/kardianos/osext"
 	"golang.org/x/net/context"
 )
@@ -19,9 +19,9 @@ import (
 	"testing"
 	"time"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
-	"bazil.org/fuse/fs/fstestutil"
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fs"
+	"github.com/keybase/kbfs/bazilfuse/fs/fstestutil"
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/kbfs/libfs"
@@ -32,6 +32,13 @@ import (
 
 func makeFS(t testing.TB, config *libkbfs.ConfigLocal) (
 	*fstestutil.Mount, *FS, func()) {
+	return makeFSWithOptions(t, config)
+}
+
+// makeFSWithOptions is like makeFS, but mounts with the given
+// options on top of the platform-specific ones.
+func makeFSWithOptions(t testing.TB, config *libkbfs.ConfigLocal,
+	extraOptions ...fuse.MountOption) (*fstestutil.Mount, *FS, func()) {
 	log := logger.NewTestLogger(t)
 	debugLog := log.CloneWithAddedDepth(1)
 	fuse.Debug = MakeFuseDebugFn(debugLog, false /* superVerbose */)
@@ -60,7 +67,8 @@ func makeFS(t testing.TB, config *libkbfs.ConfigLocal) (
 		filesys.conn = mnt.Conn
 		return filesys
 	}
-	options := GetPlatformSpecificMountOptionsForTest()
+	options := append(
+		GetPlatformSpecificMountOptionsForTest(), extraOptions...)
 	mnt, err := fstestutil.MountedFuncT(t, fn, &fs.Config{
 		WithContext: func(ctx context.Context, req fuse.Request) context.Context {
 			return filesys.WithContext(ctx)
@@ -719,6 +727,31 @@ func TestSymlink(t *testing.T) {
 	}()
 }
 
+func TestMkfifo(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "mypipe")
+	if err := syscall.Mkfifo(p, 0644); err != syscall.EPERM {
+		t.Fatalf("Expected EPERM without stored special files, got %v", err)
+	}
+
+	config.SetStoreSpecialFiles(true)
+	if err := syscall.Mkfifo(p, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := fi.Mode().String(), `prw-r--r--`; g != e {
+		t.Errorf("wrong mode for fifo: %q != %q", g, e)
+	}
+}
+
 func TestRename(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
 	defer libkbfs.CheckConfigAndShutdown(t, config)
@@ -1784,6 +1817,31 @@ func TestReaddirMyPublic(t *testing.T) {
 	checkDir(t, path.Join(mnt.Dir, PublicName, "jdoe"), files)
 }
 
+func TestReaddirManyPages(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	// Enough entries that the directory is read in several pages.
+	dir := path.Join(mnt.Dir, PrivateName, "jdoe", "dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]fileInfoCheck)
+	for i := 0; i < 2*dirPageSize+5; i++ {
+		files[fmt.Sprintf("file%05d", i)] = nil
+	}
+	for filename := range files {
+		if err := ioutil.WriteFile(path.Join(dir, filename), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkDir(t, dir, files)
+}
+
 func TestReaddirOtherFolderAsReader(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe", "wsmith")
 	defer libkbfs.CheckConfigAndShutdown(t, config)
@@ -11,7 +11,7 @@ import (
 	"path"
 	"runtime"
 
-	"bazil.org/fuse"
+	"github.com/keybase/kbfs/bazilfuse"
 )
 
 // Mounter defines interface for different mounting strategies
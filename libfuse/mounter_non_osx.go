@@ -6,10 +6,18 @@
 
 package libfuse
 
-import "bazil.org/fuse"
+import "github.com/keybase/kbfs/bazilfuse"
 
 func getPlatformSpecificMountOptions(dir string, platformParams PlatformParams) ([]fuse.MountOption, error) {
-	return []fuse.MountOption{}, nil
+	options := []fuse.MountOption{}
+	if platformParams.WritebackCache {
+		// Kernels that don't support it just ignore this.
+		options = append(options, fuse.WritebackCache())
+	}
+	if platformParams.AdvisoryLocks {
+		options = append(options, fuse.LockingPOSIX(), fuse.LockingFlock())
+	}
+	return options, nil
 }
 
 // GetPlatformSpecificMountOptionsForTest makes cross-platform tests work
@@ -9,7 +9,7 @@ package libfuse
 import (
 	"errors"
 
-	"bazil.org/fuse"
+	"github.com/keybase/kbfs/bazilfuse"
 )
 
 var kbfusePath = fuse.OSXFUSEPaths{
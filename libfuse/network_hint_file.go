@@ -0,0 +1,46 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// NetworkHintFile represents a write-only file where writing
+// "online" or "offline" tells KBFS whether the OS thinks the device
+// has a network connection.  The resulting connectivity state is
+// shown in the status file.
+type NetworkHintFile struct {
+	fs *FS
+}
+
+var _ fs.Node = (*NetworkHintFile)(nil)
+
+// Attr implements the fs.Node interface for NetworkHintFile.
+func (f *NetworkHintFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*NetworkHintFile)(nil)
+
+var _ fs.HandleWriter = (*NetworkHintFile)(nil)
+
+// Write implements the fs.HandleWriter interface for NetworkHintFile.
+func (f *NetworkHintFile) Write(ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	size, err := libfs.SetNetworkHint(ctx, f.fs.log, f.fs.config, req.Data)
+	if err != nil {
+		return err
+	}
+	resp.Size = size
+	return nil
+}
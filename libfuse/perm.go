@@ -0,0 +1,60 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// permMode returns the permission bits reported for an entry.  KBFS
+// only stores the owner bits (see libkbfs.EntryInfo.OwnerPerm); the
+// group and other bits stand for the other members of the TLF, who
+// may read (and, for directories, search) the entry if the owner
+// can, but never write it through this mount.  For directories,
+// those bits are only set in public TLFs, where anyone is a reader.
+func permMode(ei libkbfs.EntryInfo, shared bool) os.FileMode {
+	mode := ei.OwnerPerm()
+	if shared {
+		rx := (mode >> 6) & 05
+		mode |= rx<<3 | rx
+	}
+	return mode
+}
+
+// openPerm returns the owner permission bits needed to open a node
+// with the given flags.
+func openPerm(flags fuse.OpenFlags) os.FileMode {
+	switch {
+	case flags.IsReadOnly():
+		return 0400
+	case flags.IsWriteOnly():
+		return 0200
+	default:
+		return 0600
+	}
+}
+
+// checkPerm returns EACCES unless the owner permission bits of the
+// given node include all of want.  Since everything in a KBFS mount
+// belongs to the logged-in user, only the owner bits matter.
+func checkPerm(ctx context.Context, config libkbfs.Config,
+	node libkbfs.Node, want os.FileMode) error {
+	ei, err := config.KBFSOps().Stat(ctx, node)
+	if err != nil {
+		if isNoSuchNameError(err) {
+			return fuse.ESTALE
+		}
+		return err
+	}
+	if ei.OwnerPerm()&want != want {
+		return fuse.Errno(syscall.EACCES)
+	}
+	return nil
+}
@@ -10,12 +10,25 @@ import "flag"
 
 // PlatformParams contains all platform-specific parameters to be
 // passed to New{Default,Force}Mounter.
-type PlatformParams struct{}
+type PlatformParams struct {
+	// WritebackCache lets the kernel buffer writes in its page
+	// cache, and send them in large batches, instead of sending
+	// each write(2) call (or mmap'd page) on its own.  It's only
+	// supported on Linux, and only for files whose size isn't
+	// changed by other devices while the kernel has them cached:
+	// in this mode the kernel trusts its own idea of a cached
+	// file's size over ours.
+	WritebackCache bool
+	// AdvisoryLocks has the kernel pass fcntl and flock locks on
+	// to KBFS, so that they also exclude processes on other
+	// devices, instead of only the ones on this one.
+	AdvisoryLocks bool
+}
 
 // GetPlatformUsageString returns a string to be included in a usage
 // string corresponding to the flags added by AddPlatformFlags.
 func GetPlatformUsageString() string {
-	return ""
+	return "[--writeback-cache] [--advisory-locks] "
 }
 
 // AddPlatformFlags adds platform-specific flags to the given FlagSet
@@ -23,5 +36,9 @@ func GetPlatformUsageString() string {
 // given FlagSet is parsed.
 func AddPlatformFlags(flags *flag.FlagSet) *PlatformParams {
 	var params PlatformParams
+	flags.BoolVar(&params.WritebackCache, "writeback-cache", false,
+		"Let the kernel batch up writes (Linux only)")
+	flags.BoolVar(&params.AdvisoryLocks, "advisory-locks", false,
+		"Share fcntl and flock locks with other devices")
 	return &params
 }
@@ -0,0 +1,146 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// SpecialEntry represents a KBFS special file, like a named pipe
+// (see libkbfs.KBFSOps.CreateSpecialFile).  The kernel takes care of
+// opening them; KBFS only stores their names and attributes.  As
+// with Symlink, a SpecialEntry has no libkbfs.Node and is never
+// persisted into Folder.nodes.
+type SpecialEntry struct {
+	parent *Dir
+	name   string
+}
+
+var _ fs.Node = (*SpecialEntry)(nil)
+
+// specialMode returns the file mode type bits for a special file of
+// the given type.
+func specialMode(special libkbfs.SpecialFileType) os.FileMode {
+	switch special {
+	case libkbfs.Fifo:
+		return os.ModeNamedPipe
+	case libkbfs.Socket:
+		return os.ModeSocket
+	}
+	return 0
+}
+
+// Attr implements the fs.Node interface for SpecialEntry.
+func (s *SpecialEntry) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	s.parent.folder.fs.log.CDebugf(ctx, "SpecialEntry Attr")
+	defer func() { s.parent.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	_, de, err := s.parent.folder.fs.config.KBFSOps().Lookup(
+		ctx, s.parent.node, s.name)
+	if err != nil {
+		if _, ok := err.(libkbfs.NoSuchNameError); ok {
+			return fuse.ESTALE
+		}
+		return err
+	}
+
+	fillAttr(&de, a)
+	a.Size = 0
+	a.Mode = specialMode(de.Special) | 0644
+	return nil
+}
+
+var _ fs.NodeSetattrer = (*SpecialEntry)(nil)
+
+// Setattr implements the fs.NodeSetattrer interface for SpecialEntry.
+func (s *SpecialEntry) Setattr(ctx context.Context,
+	req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	s.parent.folder.fs.log.CDebugf(ctx, "SpecialEntry SetAttr")
+	defer func() { s.parent.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	// Special files have no node to set attributes on, but
+	// archivers set the mode, owner and times of everything they
+	// unpack, so don't fail those.  Instead ignore them and print a
+	// debug message.
+	s.parent.folder.fs.log.CDebugf(ctx, "Ignoring unsupported attempt to "+
+		"set %v on a special file", req.Valid)
+	return s.Attr(ctx, &resp.Attr)
+}
+
+// Mknod implements the fs.NodeMknoder interface for Dir.
+func (d *Dir) Mknod(ctx context.Context, req *fuse.MknodRequest) (
+	node fs.Node, err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Mknod %s %v", req.Name, req.Mode)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	if req.Mode&os.ModeType == 0 {
+		// A regular file, which mknod(2) can make too.
+		return d.mknodFile(ctx, req)
+	}
+
+	var special libkbfs.SpecialFileType
+	switch req.Mode & os.ModeType {
+	case os.ModeNamedPipe:
+		special = libkbfs.Fifo
+	case os.ModeSocket:
+		special = libkbfs.Socket
+	}
+	// Device nodes are never stored, since they'd only make sense
+	// on the device that made them.
+	if special == libkbfs.NotSpecial ||
+		!d.folder.fs.config.StoreSpecialFiles() {
+		return nil, libkbfs.SpecialFileNotSupportedError{
+			Name: req.Name, Mode: req.Mode}
+	}
+
+	if err := d.checkWritable(ctx); err != nil {
+		return nil, err
+	}
+
+	_, err = d.folder.fs.config.KBFSOps().CreateSpecialFile(
+		ctx, d.node, req.Name, special)
+	if err != nil {
+		return nil, err
+	}
+	return &SpecialEntry{parent: d, name: req.Name}, nil
+}
+
+func (d *Dir) mknodFile(ctx context.Context, req *fuse.MknodRequest) (
+	fs.Node, error) {
+	if err := d.checkWritable(ctx); err != nil {
+		return nil, err
+	}
+
+	isExec := (req.Mode.Perm() & 0100) != 0
+	newNode, _, err := d.folder.fs.config.KBFSOps().CreateFile(
+		ctx, d.node, req.Name, isExec, libkbfs.WithExcl)
+	if err != nil {
+		return nil, err
+	}
+
+	child := &File{
+		folder: d.folder,
+		node:   newNode,
+	}
+	d.folder.nodesMu.Lock()
+	d.folder.nodes[newNode.GetID()] = child
+	d.folder.nodesMu.Unlock()
+	return child, nil
+}
+
+// Mknod implements the fs.NodeMknoder interface for TLF.
+func (tlf *TLF) Mknod(ctx context.Context, req *fuse.MknodRequest) (
+	fs.Node, error) {
+	dir, err := tlf.loadDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dir.Mknod(ctx, req)
+}
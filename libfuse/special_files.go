@@ -7,7 +7,7 @@ package libfuse
 import (
 	"time"
 
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/bazilfuse/fs"
 	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 )
@@ -21,6 +21,8 @@ func handleCommonSpecialFile(
 		return NewErrorFile(fs, entryValid)
 	case libfs.MetricsFileName:
 		return NewMetricsFile(fs, entryValid)
+	case libfs.TraceFileName:
+		return NewTraceFile(fs, entryValid)
 	case libfs.ProfileListDirName:
 		return ProfileList{}
 	case libfs.ResetCachesFileName:
@@ -55,6 +57,12 @@ func handleNonTLFSpecialFile(
 			folder: &Folder{fs: fs}, // fake Folder for logging, etc.
 			action: libfs.JournalDisableAuto,
 		}
+	case libfs.BandwidthLimitsFileName:
+		return &BandwidthLimitsFile{fs}
+	case libfs.LogControlFileName:
+		return &LogControlFile{fs}
+	case libfs.NetworkHintFileName:
+		return &NetworkHintFile{fs}
 	}
 
 	return nil
@@ -142,6 +150,18 @@ func handleTLFSpecialFile(
 			folder: folder,
 			action: libfs.JournalDisable,
 		}
+
+	case libfs.EnableJournalWriteThroughFileName:
+		return &JournalControlFile{
+			folder: folder,
+			action: libfs.JournalEnableWriteThrough,
+		}
+
+	case libfs.DisableJournalWriteThroughFileName:
+		return &JournalControlFile{
+			folder: folder,
+			action: libfs.JournalDisableWriteThrough,
+		}
 	}
 	return nil
 }
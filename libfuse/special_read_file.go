@@ -7,8 +7,8 @@ package libfuse
 import (
 	"time"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fs"
 	"golang.org/x/net/context"
 )
 
@@ -19,6 +19,12 @@ type StartOptions struct {
 	KbfsParams libkbfs.InitParams
 	RuntimeDir string
 	Label      string
+	// MetricsAddr, if non-empty, is the host:port on which to
+	// serve metrics for Prometheus, at /metrics.
+	MetricsAddr string
+	// DebugAddr, if non-empty, is the localhost:port on which to
+	// serve live status pages, at /debug/kbfs/.
+	DebugAddr string
 }
 
 // Start the filesystem
@@ -89,7 +95,29 @@ func Start(mounter Mounter, options StartOptions, kbCtx libkbfs.Context) *libfs.
 
 	defer libkbfs.Shutdown()
 
+	if options.MetricsAddr != "" {
+		listener, err := libfs.ServeMetrics(config, options.MetricsAddr)
+		if err != nil {
+			return libfs.InitError(err.Error())
+		}
+		defer listener.Close()
+		log.Info("Serving metrics on http://%s/metrics", listener.Addr())
+	}
+
+	if options.DebugAddr != "" {
+		listener, err := libfs.ServeDebug(config, options.DebugAddr)
+		if err != nil {
+			return libfs.InitError(err.Error())
+		}
+		defer listener.Close()
+		log.Info("Serving debug pages on http://%s/debug/kbfs/",
+			listener.Addr())
+	}
+
 	if c != nil {
+		config.SetMountPathTransformer(
+			libkbfs.NewMountPathTransformerStandard(mounter.Dir()))
+
 		log.Debug("Creating filesystem")
 		fs := NewFS(config, c, options.KbfsParams.Debug)
 		ctx, cancel := context.WithCancel(context.Background())
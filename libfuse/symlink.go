@@ -8,8 +8,8 @@ import (
 	"os"
 	"syscall"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
@@ -61,5 +61,6 @@ func (s *Symlink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (link
 	if de.Type != libkbfs.Sym {
 		return "", fuse.Errno(syscall.EINVAL)
 	}
-	return de.SymPath, nil
+	return s.parent.folder.fs.config.MountPathTransformer().ToLocal(
+		de.SymPath), nil
 }
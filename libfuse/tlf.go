@@ -9,8 +9,8 @@ import (
 	"sync"
 	"time"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/bazilfuse/fs"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
@@ -251,9 +251,13 @@ func (tlf *TLF) Open(ctx context.Context, req *fuse.OpenRequest,
 	// Explicitly load the directory when a TLF is opened, because
 	// some OSX programs like ls have a bug that doesn't report errors
 	// on a ReadDirAll.
-	_, _, err := tlf.loadDirAllowNonexistent(ctx)
+	dir, exitEarly, err := tlf.loadDirAllowNonexistent(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return tlf, nil
+	if exitEarly {
+		// Read the nonexistent TLF as an empty folder.
+		return tlf, nil
+	}
+	return dir.Open(ctx, req, resp)
 }
@@ -0,0 +1,92 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"sort"
+	"syscall"
+
+	"github.com/keybase/kbfs/bazilfuse"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// Extended attributes are stored in the directory entries of files
+// and subdirectories.  TLF root directories have no directory entry,
+// so TLF doesn't support them.
+//
+// The XATTR_CREATE and XATTR_REPLACE flags of setxattr(2) are
+// ignored, since their values differ between platforms.
+
+func getXattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	ei, err := folder.fs.config.KBFSOps().Stat(ctx, node)
+	if err != nil {
+		if isNoSuchNameError(err) {
+			return fuse.ESTALE
+		}
+		return err
+	}
+	value, ok := ei.Xattrs[req.Name]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	// Position is only used on macOS, for resource forks.
+	if int(req.Position) > len(value) {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	value = value[req.Position:]
+	if req.Size != 0 && int(req.Size) < len(value) {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	resp.Xattr = value
+	return nil
+}
+
+func listXattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	ei, err := folder.fs.config.KBFSOps().Stat(ctx, node)
+	if err != nil {
+		if isNoSuchNameError(err) {
+			return fuse.ESTALE
+		}
+		return err
+	}
+	names := make([]string, 0, len(ei.Xattrs))
+	for name := range ei.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resp.Append(names...)
+	if req.Size != 0 && int(req.Size) < len(resp.Xattr) {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	return nil
+}
+
+func setXattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.SetxattrRequest) error {
+	value := req.Xattr
+	if req.Position != 0 {
+		// A resource fork being written in pieces; splice this
+		// piece into what's been written so far.
+		ei, err := folder.fs.config.KBFSOps().Stat(ctx, node)
+		if err != nil {
+			return err
+		}
+		existing := ei.Xattrs[req.Name]
+		if int(req.Position) > len(existing) {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		value = append(append([]byte(nil), existing[:req.Position]...),
+			req.Xattr...)
+	}
+	return folder.fs.config.KBFSOps().SetXattr(ctx, node, req.Name, value)
+}
+
+func removeXattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.RemovexattrRequest) error {
+	return folder.fs.config.KBFSOps().RemoveXattr(ctx, node, req.Name)
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+func testXattrs(t *testing.T, p string) {
+	if err := syscall.Setxattr(p, "user.a", []byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(p, "user.b", []byte{}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(p, "user.a", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(buf[:n]), "hello"; g != e {
+		t.Errorf("wrong xattr value: %q != %q", g, e)
+	}
+
+	n, err = syscall.Listxattr(p, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"),
+		"\x00"), []string{"user.a", "user.b"}; strings.Join(g, ",") !=
+		strings.Join(e, ",") {
+		t.Errorf("wrong xattr names: %v != %v", g, e)
+	}
+
+	if err := syscall.Removexattr(p, "user.a"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = syscall.Getxattr(p, "user.a", buf)
+	if err != syscall.ENODATA {
+		t.Errorf("expected ENODATA, got %v", err)
+	}
+	if err := syscall.Removexattr(p, "user.a"); err != syscall.ENODATA {
+		t.Errorf("expected ENODATA, got %v", err)
+	}
+}
+
+func TestXattrFile(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	testXattrs(t, p)
+}
+
+func TestXattrDir(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "mydir")
+	if err := os.Mkdir(p, 0755); err != nil {
+		t.Fatal(err)
+	}
+	testXattrs(t, p)
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libhttp
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// The PROPFIND response always lists the same live properties,
+// whatever the request asked for, which RFC 4918 permits for
+// allprop and which clients tolerate for named properties.
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XMLNS     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *uint64         `xml:"D:getcontentlength,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+func davResponseFor(href, name string, ei libkbfs.EntryInfo) davResponse {
+	prop := davProp{DisplayName: name}
+	if ei.Type == libkbfs.Dir {
+		prop.ResourceType.Collection = &struct{}{}
+		if !strings.HasSuffix(href, "/") {
+			href += "/"
+		}
+	} else {
+		size := ei.Size
+		prop.ContentLength = &size
+	}
+	if ei.Mtime != 0 {
+		prop.LastModified =
+			time.Unix(0, ei.Mtime).UTC().Format(http.TimeFormat)
+	}
+	return davResponse{
+		Href: (&url.URL{Path: href}).EscapedPath(),
+		Propstat: davPropstat{
+			Prop:   prop,
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+func (s *Server) servePropfind(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p fsrpc.Path) (int, error) {
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		// Listing whole trees could take forever.
+		return http.StatusForbidden,
+			errors.New("Only PROPFIND depths 0 and 1 are supported")
+	}
+
+	node, ei, err := p.GetNode(ctx, s.config)
+	if err != nil {
+		return errStatus(err), err
+	}
+	href := path.Clean("/" + r.URL.Path)
+	name := path.Base(href)
+	ms := davMultistatus{
+		XMLNS:     "DAV:",
+		Responses: []davResponse{davResponseFor(href, name, ei)},
+	}
+	if depth == "1" && ei.Type == libkbfs.Dir {
+		entries, err := s.readDir(ctx, p, node)
+		if err != nil {
+			return errStatus(err), err
+		}
+		for _, e := range entries {
+			ms.Responses = append(ms.Responses,
+				davResponseFor(path.Join(href, e.name), e.name, e.ei))
+		}
+	}
+
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return 0, nil
+	}
+	if err := xml.NewEncoder(w).Encode(ms); err != nil {
+		s.log.CDebugf(ctx, "Couldn't write PROPFIND response: %v", err)
+	}
+	return 0, nil
+}
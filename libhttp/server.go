@@ -0,0 +1,603 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Package libhttp serves KBFS over HTTP and WebDAV (class 1, without
+// locks), for platforms where neither FUSE nor Dokan is available.
+// URL paths are KBFS paths without the leading /keybase, e.g.
+// /private/alice/file.txt.
+package libhttp
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// copyBufSize is the number of bytes of file data read or written
+// at a time.
+const copyBufSize = 512 * 1024
+
+// CtxTagKey is the type used for unique context tags.
+type CtxTagKey int
+
+const (
+	// CtxIDKey is the type of the tag for unique operation IDs.
+	CtxIDKey CtxTagKey = iota
+)
+
+// CtxOpID is the display name for the unique operation HTTP ID tag.
+const CtxOpID = "HID"
+
+// Server is an http.Handler that serves KBFS.  Requests with the
+// configured basic auth credentials have full read-write WebDAV
+// access to everything the logged-in user can access; other
+// requests may only read public folders.
+type Server struct {
+	config   libkbfs.Config
+	log      logger.Logger
+	username string
+	password string
+}
+
+// NewServer returns a new Server.  If password is empty, no request
+// is authenticated.
+func NewServer(
+	config libkbfs.Config, username, password string) *Server {
+	return &Server{
+		config:   config,
+		log:      config.MakeLogger("HTTP"),
+		username: username,
+		password: password,
+	}
+}
+
+// newRequestContext returns a new context for a request, tagged with
+// a new request ID, whose cancellation KBFS writes can delay until
+// it's safe.  The caller must call libkbfs.CleanupCancellationDelayer
+// once the request is done.
+func newRequestContext(log logger.Logger) (context.Context, error) {
+	id, err := libkbfs.MakeRandomRequestID()
+	if err != nil {
+		log.Errorf("Couldn't make request ID: %v", err)
+	}
+	return libkbfs.NewContextWithCancellationDelayer(
+		libkbfs.NewContextReplayable(context.Background(),
+			func(ctx context.Context) context.Context {
+				logTags := make(logger.CtxLogTags)
+				logTags[CtxIDKey] = CtxOpID
+				ctx = logger.NewContextWithLogTags(ctx, logTags)
+				if err == nil {
+					ctx = context.WithValue(ctx, CtxIDKey, id)
+				}
+				return ctx
+			}))
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.password == "" {
+		return false
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	usernameOK := subtle.ConstantTimeCompare(
+		[]byte(username), []byte(s.username)) == 1
+	passwordOK := subtle.ConstantTimeCompare(
+		[]byte(password), []byte(s.password)) == 1
+	return usernameOK && passwordOK
+}
+
+func isReadMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PROPFIND":
+		return true
+	default:
+		return false
+	}
+}
+
+// kbfsPath returns the KBFS path for the given URL path.
+func kbfsPath(urlPath string) (fsrpc.Path, error) {
+	return fsrpc.NewPath(path.Join("/keybase", urlPath))
+}
+
+// errStatus returns the HTTP status for an error from KBFS.
+func errStatus(err error) int {
+	switch err.(type) {
+	case libkbfs.NoSuchNameError, libkbfs.NoSuchUserError,
+		libkbfs.BadTLFNameError:
+		return http.StatusNotFound
+	case libkbfs.ReadAccessError, libkbfs.WriteAccessError,
+		libkbfs.WriteUnsupportedError:
+		return http.StatusForbidden
+	case libkbfs.NameExistsError, libkbfs.DirNotEmptyError:
+		return http.StatusConflict
+	case libkbfs.NameTooLongError, fsrpc.InvalidPathErr:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ServeHTTP implements the http.Handler interface for Server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, err := newRequestContext(s.log)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	s.log.CDebugf(ctx, "%s %s", r.Method, r.URL.Path)
+
+	p, err := kbfsPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.authorized(r) && (!isReadMethod(r.Method) ||
+		p.PathType != fsrpc.TLFPathType || !p.Public) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="KBFS"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var status int
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, "+
+			"MKCOL, COPY, MOVE, PROPFIND")
+		w.Header().Set("DAV", "1")
+		w.Header().Set("MS-Author-Via", "DAV")
+		status = http.StatusOK
+	case "GET", "HEAD":
+		status, err = s.serveGet(ctx, w, r, p)
+	case "PROPFIND":
+		status, err = s.servePropfind(ctx, w, r, p)
+	case "PUT":
+		status, err = s.servePut(ctx, r, p)
+	case "DELETE":
+		status, err = s.serveDelete(ctx, p)
+	case "MKCOL":
+		status, err = s.serveMkcol(ctx, r, p)
+	case "COPY", "MOVE":
+		status, err = s.serveCopyOrMove(ctx, r, p)
+	default:
+		status = http.StatusMethodNotAllowed
+	}
+
+	switch {
+	case status == 0:
+		// The response has already been written.
+	case err != nil:
+		s.log.CDebugf(ctx, "%s %s failed: %v", r.Method, r.URL.Path, err)
+		http.Error(w, err.Error(), status)
+	default:
+		w.WriteHeader(status)
+	}
+}
+
+// dirEntry is an entry in a listed directory.
+type dirEntry struct {
+	name string
+	ei   libkbfs.EntryInfo
+}
+
+// readDir lists the given directory, which may be above the level of
+// TLFs, sorted by name.
+func (s *Server) readDir(ctx context.Context, p fsrpc.Path,
+	node libkbfs.Node) ([]dirEntry, error) {
+	dirEI := libkbfs.EntryInfo{Type: libkbfs.Dir}
+	var entries []dirEntry
+	switch p.PathType {
+	case fsrpc.KeybasePathType:
+		entries = []dirEntry{{"private", dirEI}, {"public", dirEI}}
+	case fsrpc.KeybaseChildPathType:
+		favs, err := s.config.KBFSOps().GetFavorites(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, fav := range favs {
+			if fav.Public == p.Public {
+				entries = append(entries, dirEntry{fav.Name, dirEI})
+			}
+		}
+	case fsrpc.TLFPathType:
+		children, err := s.config.KBFSOps().GetDirChildren(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		for name, ei := range children {
+			entries = append(entries, dirEntry{name, ei})
+		}
+	}
+	sort.Sort(dirEntriesByName(entries))
+	return entries, nil
+}
+
+type dirEntriesByName []dirEntry
+
+func (d dirEntriesByName) Len() int           { return len(d) }
+func (d dirEntriesByName) Less(i, j int) bool { return d[i].name < d[j].name }
+func (d dirEntriesByName) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// nodeReader is an io.ReadSeeker over a KBFS file.
+type nodeReader struct {
+	ctx     context.Context
+	kbfsOps libkbfs.KBFSOps
+	node    libkbfs.Node
+	size    int64
+	off     int64
+}
+
+func (nr *nodeReader) Read(p []byte) (int, error) {
+	if nr.off >= nr.size {
+		return 0, io.EOF
+	}
+	n, err := nr.kbfsOps.Read(nr.ctx, nr.node, p, nr.off)
+	nr.off += n
+	if err != nil {
+		return int(n), err
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return int(n), nil
+}
+
+func (nr *nodeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += nr.off
+	case io.SeekEnd:
+		offset += nr.size
+	default:
+		return 0, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	nr.off = offset
+	return offset, nil
+}
+
+var dirListingTemplate = template.Must(template.New("dir").Parse(
+	`<!DOCTYPE html>
+<html>
+<head><title>{{.Path}}</title></head>
+<body>
+<h1>{{.Path}}</h1>
+<ul>
+{{range .Entries}}<li><a href="{{.Href}}">{{.Name}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+type dirListingEntry struct {
+	Name string
+	Href string
+}
+
+func (s *Server) serveGet(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p fsrpc.Path) (int, error) {
+	node, ei, err := p.GetNode(ctx, s.config)
+	if err != nil {
+		return errStatus(err), err
+	}
+
+	if ei.Type != libkbfs.Dir {
+		_, name, err := p.DirAndBasename()
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		http.ServeContent(w, r, name, time.Unix(0, ei.Mtime), &nodeReader{
+			ctx:     ctx,
+			kbfsOps: s.config.KBFSOps(),
+			node:    node,
+			size:    int64(ei.Size),
+		})
+		return 0, nil
+	}
+
+	// Make relative links work, like http.FileServer does.
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, path.Base(r.URL.Path)+"/",
+			http.StatusMovedPermanently)
+		return 0, nil
+	}
+	entries, err := s.readDir(ctx, p, node)
+	if err != nil {
+		return errStatus(err), err
+	}
+	listing := struct {
+		Path    string
+		Entries []dirListingEntry
+	}{Path: r.URL.Path}
+	for _, e := range entries {
+		// Prefix with ./ so that names with colons aren't taken
+		// as URL schemes.
+		href := "./" + (&url.URL{Path: e.name}).EscapedPath()
+		if e.ei.Type == libkbfs.Dir {
+			href += "/"
+		}
+		listing.Entries = append(listing.Entries,
+			dirListingEntry{Name: e.name, Href: href})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == "HEAD" {
+		return http.StatusOK, nil
+	}
+	if err := dirListingTemplate.Execute(w, listing); err != nil {
+		s.log.CDebugf(ctx, "Couldn't write listing: %v", err)
+	}
+	return 0, nil
+}
+
+// getParent returns the directory node containing the given path,
+// and the name of the path within it.
+func (s *Server) getParent(ctx context.Context, p fsrpc.Path) (
+	libkbfs.Node, string, int, error) {
+	dir, name, err := p.DirAndBasename()
+	if err != nil {
+		return nil, "", http.StatusForbidden, err
+	}
+	if dir.PathType != fsrpc.TLFPathType {
+		return nil, "", http.StatusForbidden,
+			fmt.Errorf("%s is not within a folder", p)
+	}
+	node, err := dir.GetDirNode(ctx, s.config)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		// The parent of a new resource must exist.
+		return nil, "", http.StatusConflict, err
+	} else if err != nil {
+		return nil, "", errStatus(err), err
+	}
+	return node, name, 0, nil
+}
+
+func (s *Server) servePut(ctx context.Context, r *http.Request,
+	p fsrpc.Path) (int, error) {
+	parent, name, status, err := s.getParent(ctx, p)
+	if err != nil {
+		return status, err
+	}
+	kbfsOps := s.config.KBFSOps()
+	node, ei, err := kbfsOps.Lookup(ctx, parent, name)
+	created := false
+	switch err.(type) {
+	case nil:
+		if ei.Type == libkbfs.Dir {
+			return http.StatusMethodNotAllowed,
+				fmt.Errorf("%s is a directory", p)
+		}
+		if err := kbfsOps.Truncate(ctx, node, 0); err != nil {
+			return errStatus(err), err
+		}
+	case libkbfs.NoSuchNameError:
+		node, _, err = kbfsOps.CreateFile(
+			ctx, parent, name, false, libkbfs.NoExcl)
+		if err != nil {
+			return errStatus(err), err
+		}
+		created = true
+	default:
+		return errStatus(err), err
+	}
+
+	buf := make([]byte, copyBufSize)
+	var off int64
+	for {
+		n, readErr := r.Body.Read(buf)
+		if n > 0 {
+			if err := kbfsOps.Write(ctx, node, buf[:n], off); err != nil {
+				return errStatus(err), err
+			}
+			off += int64(n)
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return http.StatusBadRequest, readErr
+		}
+	}
+	if err := kbfsOps.Sync(ctx, node); err != nil {
+		return errStatus(err), err
+	}
+	if created {
+		return http.StatusCreated, nil
+	}
+	return http.StatusNoContent, nil
+}
+
+// removeAll removes name from parent, along with everything under
+// it.
+func (s *Server) removeAll(ctx context.Context, parent libkbfs.Node,
+	name string) error {
+	kbfsOps := s.config.KBFSOps()
+	node, ei, err := kbfsOps.Lookup(ctx, parent, name)
+	if err != nil {
+		return err
+	}
+	if ei.Type != libkbfs.Dir {
+		return kbfsOps.RemoveEntry(ctx, parent, name)
+	}
+	children, err := kbfsOps.GetDirChildren(ctx, node)
+	if err != nil {
+		return err
+	}
+	for childName := range children {
+		if err := s.removeAll(ctx, node, childName); err != nil {
+			return err
+		}
+	}
+	return kbfsOps.RemoveDir(ctx, parent, name)
+}
+
+func (s *Server) serveDelete(ctx context.Context, p fsrpc.Path) (
+	int, error) {
+	parent, name, status, err := s.getParent(ctx, p)
+	if err != nil {
+		if status == http.StatusConflict {
+			status = http.StatusNotFound
+		}
+		return status, err
+	}
+	if err := s.removeAll(ctx, parent, name); err != nil {
+		return errStatus(err), err
+	}
+	return http.StatusNoContent, nil
+}
+
+func (s *Server) serveMkcol(ctx context.Context, r *http.Request,
+	p fsrpc.Path) (int, error) {
+	if r.ContentLength > 0 {
+		return http.StatusUnsupportedMediaType,
+			errors.New("MKCOL bodies aren't supported")
+	}
+	parent, name, status, err := s.getParent(ctx, p)
+	if err != nil {
+		return status, err
+	}
+	_, _, err = s.config.KBFSOps().CreateDir(ctx, parent, name)
+	if _, ok := err.(libkbfs.NameExistsError); ok {
+		return http.StatusMethodNotAllowed, err
+	} else if err != nil {
+		return errStatus(err), err
+	}
+	return http.StatusCreated, nil
+}
+
+// copyAll copies the given entry to name in destParent, which must
+// not exist yet.
+func (s *Server) copyAll(ctx context.Context, src libkbfs.Node,
+	ei libkbfs.EntryInfo, destParent libkbfs.Node, name string) error {
+	kbfsOps := s.config.KBFSOps()
+	switch ei.Type {
+	case libkbfs.Dir:
+		dest, _, err := kbfsOps.CreateDir(ctx, destParent, name)
+		if err != nil {
+			return err
+		}
+		children, err := kbfsOps.GetDirChildren(ctx, src)
+		if err != nil {
+			return err
+		}
+		for childName, childEI := range children {
+			child, _, err := kbfsOps.Lookup(ctx, src, childName)
+			if err != nil {
+				return err
+			}
+			err = s.copyAll(ctx, child, childEI, dest, childName)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case libkbfs.Sym:
+		_, err := kbfsOps.CreateLink(ctx, destParent, name, ei.SymPath)
+		return err
+	default:
+		dest, _, err := kbfsOps.CreateFile(
+			ctx, destParent, name, ei.Type == libkbfs.Exec, libkbfs.WithExcl)
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, copyBufSize)
+		var off int64
+		for {
+			n, err := kbfsOps.Read(ctx, src, buf, off)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			if err := kbfsOps.Write(ctx, dest, buf[:n], off); err != nil {
+				return err
+			}
+			off += n
+		}
+		return kbfsOps.Sync(ctx, dest)
+	}
+}
+
+func (s *Server) serveCopyOrMove(ctx context.Context, r *http.Request,
+	src fsrpc.Path) (int, error) {
+	destURL, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || destURL.Path == "" {
+		return http.StatusBadRequest, errors.New("Bad Destination header")
+	}
+	dest, err := kbfsPath(destURL.Path)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if dest.String() == src.String() {
+		return http.StatusForbidden,
+			errors.New("Source and destination are the same")
+	}
+	srcParent, srcName, status, err := s.getParent(ctx, src)
+	if err != nil {
+		return status, err
+	}
+	destParent, destName, status, err := s.getParent(ctx, dest)
+	if err != nil {
+		return status, err
+	}
+
+	kbfsOps := s.config.KBFSOps()
+	srcNode, srcEI, err := kbfsOps.Lookup(ctx, srcParent, srcName)
+	if err != nil {
+		return errStatus(err), err
+	}
+	_, _, err = kbfsOps.Lookup(ctx, destParent, destName)
+	existed := false
+	switch err.(type) {
+	case nil:
+		if r.Header.Get("Overwrite") == "F" {
+			return http.StatusPreconditionFailed,
+				fmt.Errorf("%s exists", dest)
+		}
+		if err := s.removeAll(ctx, destParent, destName); err != nil {
+			return errStatus(err), err
+		}
+		existed = true
+	case libkbfs.NoSuchNameError:
+	default:
+		return errStatus(err), err
+	}
+
+	sameFolder := src.Public == dest.Public && src.TLFName == dest.TLFName
+	if r.Method == "MOVE" && sameFolder {
+		err = kbfsOps.Rename(ctx, srcParent, srcName, destParent, destName)
+	} else {
+		err = s.copyAll(ctx, srcNode, srcEI, destParent, destName)
+		if err == nil && r.Method == "MOVE" {
+			// Renames can't cross folders, so copy and then
+			// remove.
+			err = s.removeAll(ctx, srcParent, srcName)
+		}
+	}
+	if err != nil {
+		return errStatus(err), err
+	}
+	if existed {
+		return http.StatusNoContent, nil
+	}
+	return http.StatusCreated, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libhttp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func doRequest(t *testing.T, ts *httptest.Server, method, path string,
+	body string, auth bool, header map[string]string) (int, string) {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	if auth {
+		req.SetBasicAuth("kbfs", "secret")
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(buf)
+}
+
+func TestServer(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	ts := httptest.NewServer(NewServer(config, "kbfs", "secret"))
+	defer ts.Close()
+
+	// Private folders need credentials.
+	status, _ := doRequest(t, ts, "GET", "/private/jdoe/", "", false, nil)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	status, _ = doRequest(t, ts, "MKCOL", "/private/jdoe/dir", "", true, nil)
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = doRequest(
+		t, ts, "PUT", "/private/jdoe/dir/a", "hello", true, nil)
+	require.Equal(t, http.StatusCreated, status)
+	status, body := doRequest(
+		t, ts, "GET", "/private/jdoe/dir/a", "", true, nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "hello", body)
+
+	status, body = doRequest(t, ts, "PROPFIND", "/private/jdoe/dir", "", true,
+		map[string]string{"Depth": "1"})
+	require.Equal(t, http.StatusMultiStatus, status)
+	require.Contains(t, body, "<D:href>/private/jdoe/dir/a</D:href>")
+
+	status, _ = doRequest(t, ts, "MOVE", "/private/jdoe/dir/a", "", true,
+		map[string]string{"Destination": ts.URL + "/private/jdoe/b"})
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = doRequest(t, ts, "GET", "/private/jdoe/dir/a", "", true, nil)
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, _ = doRequest(t, ts, "DELETE", "/private/jdoe/dir", "", true, nil)
+	require.Equal(t, http.StatusNoContent, status)
+
+	// Public folders can be read, but not written, without
+	// credentials.
+	status, _ = doRequest(
+		t, ts, "PUT", "/public/jdoe/c", "hello", false, nil)
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, _ = doRequest(t, ts, "PUT", "/public/jdoe/c", "hello", true, nil)
+	require.Equal(t, http.StatusCreated, status)
+	status, body = doRequest(t, ts, "GET", "/public/jdoe/c", "", false, nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "hello", body)
+}
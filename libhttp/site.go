@@ -0,0 +1,143 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libhttp
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// siteIndexName is the file served for a request for a directory.
+const siteIndexName = "index.html"
+
+// SiteServer is an http.Handler that serves a directory in a public
+// folder as a static website.  URL paths are relative to that
+// directory; a request for a directory serves its index.html, and
+// directories are never listed.  Responses carry an ETag derived
+// from the hash of the file's top block, so clients can revalidate
+// cached pages cheaply.
+type SiteServer struct {
+	config libkbfs.Config
+	log    logger.Logger
+	root   fsrpc.Path
+}
+
+// NewSiteServer returns a new SiteServer for the given KBFS
+// directory, e.g. /keybase/public/alice/www, which must be in a
+// public folder.
+func NewSiteServer(
+	config libkbfs.Config, root string) (*SiteServer, error) {
+	p, err := fsrpc.NewPath(root)
+	if err != nil {
+		return nil, err
+	}
+	if p.PathType != fsrpc.TLFPathType || !p.Public {
+		return nil, fmt.Errorf(
+			"%s is not in a public folder", root)
+	}
+	return &SiteServer{
+		config: config,
+		log:    config.MakeLogger("HTTP"),
+		root:   p,
+	}, nil
+}
+
+// etag returns the entity tag for the given file, based on the hash
+// of its top block, which changes whenever its contents do.
+func (s *SiteServer) etag(
+	ctx context.Context, node libkbfs.Node) (string, error) {
+	md, err := s.config.KBFSOps().GetNodeMetadata(ctx, node)
+	if err != nil {
+		return "", err
+	}
+	return `"` + md.BlockInfo.ID.String() + `"`, nil
+}
+
+// ServeHTTP implements the http.Handler interface for SiteServer.
+func (s *SiteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, err := newRequestContext(s.log)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	s.log.CDebugf(ctx, "%s %s", r.Method, r.URL.Path)
+
+	switch r.Method {
+	case "GET", "HEAD":
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := s.serveGet(ctx, w, r)
+	switch {
+	case status == 0:
+		// The response has already been written.
+	case err != nil:
+		s.log.CDebugf(ctx, "%s %s failed: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(status), status)
+	default:
+		w.WriteHeader(status)
+	}
+}
+
+func (s *SiteServer) serveGet(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (int, error) {
+	p := s.root
+	p.TLFComponents = append([]string(nil), s.root.TLFComponents...)
+	for _, c := range strings.Split(path.Clean("/"+r.URL.Path), "/") {
+		if c != "" {
+			p.TLFComponents = append(p.TLFComponents, c)
+		}
+	}
+	node, ei, err := p.GetNode(ctx, s.config)
+	if err != nil {
+		return errStatus(err), err
+	}
+
+	name := path.Base(r.URL.Path)
+	if ei.Type == libkbfs.Dir {
+		// Make relative links work, like http.FileServer does.
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, name+"/", http.StatusMovedPermanently)
+			return 0, nil
+		}
+		node, ei, err = s.config.KBFSOps().Lookup(ctx, node, siteIndexName)
+		if err != nil {
+			return errStatus(err), err
+		}
+		name = siteIndexName
+	}
+	if ei.Type != libkbfs.File && ei.Type != libkbfs.Exec {
+		return http.StatusNotFound, fmt.Errorf(
+			"%s is not a regular file", p)
+	}
+
+	etag, err := s.etag(ctx, node)
+	if err != nil {
+		return errStatus(err), err
+	}
+	// http.ServeContent picks the content type from the name's
+	// extension, sniffing the contents only if that fails, and
+	// answers If-None-Match using the ETag.
+	w.Header().Set("Etag", etag)
+	http.ServeContent(w, r, name, time.Unix(0, ei.Mtime), &nodeReader{
+		ctx:     ctx,
+		kbfsOps: s.config.KBFSOps(),
+		node:    node,
+		size:    int64(ei.Size),
+	})
+	return 0, nil
+}
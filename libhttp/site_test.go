@@ -0,0 +1,98 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSiteServer(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	dav := httptest.NewServer(NewServer(config, "kbfs", "secret"))
+	defer dav.Close()
+
+	_, err := NewSiteServer(config, "/keybase/private/jdoe/www")
+	require.Error(t, err)
+	site, err := NewSiteServer(config, "/keybase/public/jdoe/www")
+	require.NoError(t, err)
+	ts := httptest.NewServer(site)
+	defer ts.Close()
+
+	for _, dir := range []string{"www", "www/docs", "www/empty"} {
+		status, _ := doRequest(
+			t, dav, "MKCOL", "/public/jdoe/"+dir, "", true, nil)
+		require.Equal(t, http.StatusCreated, status)
+	}
+	files := map[string]string{
+		"www/index.html":      "<html>home</html>",
+		"www/style.css":       "body {}",
+		"www/docs/index.html": "<html>docs</html>",
+	}
+	for name, content := range files {
+		status, _ := doRequest(
+			t, dav, "PUT", "/public/jdoe/"+name, content, true, nil)
+		require.Equal(t, http.StatusCreated, status)
+	}
+
+	get := func(path string, header map[string]string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		require.NoError(t, err)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// Directories serve their index.html.
+	status, body := doRequest(t, ts, "GET", "/", "", false, nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "<html>home</html>", body)
+	status, body = doRequest(t, ts, "GET", "/docs/", "", false, nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "<html>docs</html>", body)
+	resp := get("/docs", nil)
+	require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	require.Equal(t, "/docs/", resp.Header.Get("Location"))
+
+	// Directories without an index.html aren't listed.
+	status, _ = doRequest(t, ts, "GET", "/empty/", "", false, nil)
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = doRequest(t, ts, "GET", "/missing.html", "", false, nil)
+	require.Equal(t, http.StatusNotFound, status)
+
+	// Content types come from the file extension.
+	resp = get("/style.css", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/css; charset=utf-8",
+		resp.Header.Get("Content-Type"))
+	resp = get("/index.html", nil)
+	require.Equal(t, "text/html; charset=utf-8",
+		resp.Header.Get("Content-Type"))
+
+	// The ETag is stable until the file changes.
+	etag := resp.Header.Get("Etag")
+	require.NotEmpty(t, etag)
+	resp = get("/index.html", map[string]string{"If-None-Match": etag})
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	status, _ = doRequest(t, dav, "PUT", "/public/jdoe/www/index.html",
+		"<html>new home</html>", true, nil)
+	require.Equal(t, http.StatusNoContent, status)
+	resp = get("/index.html", map[string]string{"If-None-Match": etag})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEqual(t, etag, resp.Header.Get("Etag"))
+
+	// The site is read-only.
+	status, _ = doRequest(t, ts, "PUT", "/index.html", "x", true, nil)
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+}
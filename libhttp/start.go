@@ -0,0 +1,92 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libhttp
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// StartOptions are options for starting up
+type StartOptions struct {
+	KbfsParams libkbfs.InitParams
+	// Addr is the host:port to listen on.
+	Addr string
+	// Username and Password are the basic auth credentials needed
+	// for anything but reading public folders.  If Password is
+	// empty, only public folders can be read.
+	Username string
+	Password string
+	// Site, if set, is a directory in a public folder, e.g.
+	// /keybase/public/alice/www, to serve as a static website
+	// instead of serving all of KBFS.
+	Site string
+}
+
+// Start the server, and serve until interrupted.
+func Start(options StartOptions, kbCtx libkbfs.Context) *libfs.Error {
+	// InitLog errors are non-fatal and are ignored.
+	log, err := libkbfs.InitLog(options.KbfsParams, kbCtx)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	listener, err := net.Listen("tcp", options.Addr)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+	defer listener.Close()
+
+	// Declare ourselves done when we get an interrupt.
+	doneChan := make(chan struct{}, 1)
+	onInterruptFn := func() {
+		select {
+		case doneChan <- struct{}{}:
+			libkbfs.Shutdown()
+		default:
+		}
+	}
+
+	log.Debug("Initializing")
+
+	config, err := libkbfs.Init(
+		kbCtx, options.KbfsParams, nil, onInterruptFn, log)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	defer libkbfs.Shutdown()
+
+	var handler http.Handler
+	if options.Site != "" {
+		handler, err = NewSiteServer(config, options.Site)
+		if err != nil {
+			return libfs.InitError(err.Error())
+		}
+	} else {
+		if options.Password == "" {
+			log.Warning(
+				"No password set; only public folders can be read")
+		}
+		handler = NewServer(config, options.Username, options.Password)
+	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		err := server.Serve(listener)
+		log.Debug("Stopped serving: %v", err)
+	}()
+	if options.Site != "" {
+		log.Info("Serving %s on http://%s/", options.Site, listener.Addr())
+	} else {
+		log.Info("Serving KBFS on http://%s/", listener.Addr())
+	}
+
+	<-doneChan
+	log.Debug("Ending")
+	return nil
+}
@@ -0,0 +1,403 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"golang.org/x/net/context"
+)
+
+// AccessLogDirName is the name of the directory, at the root of a
+// TLF, that holds the TLF's access log.  Access logging is enabled
+// for a TLF exactly when this directory exists, so the policy is
+// visible to, and can be changed by, every writer of the TLF.
+//
+// While access logging is enabled, every device that reads a file in
+// the TLF records which file it read, and when, and periodically
+// appends the records to the log as a batch signed by the device's
+// key.  Only file paths and times are recorded, never file contents
+// or offsets, and any member of the TLF can read the log.  Reads by
+// readers who can't write to the TLF (e.g. in public folders) can't
+// be logged, and records that haven't been flushed yet are dropped
+// if the device shuts down.
+const AccessLogDirName = ".kbfs_access_log"
+
+const (
+	// accessLogFlushInterval is how long a device waits after a
+	// read before flushing the records it has accumulated.
+	accessLogFlushInterval = 30 * time.Second
+	// accessLogMaxBatchSize is the number of records that
+	// triggers an immediate flush.
+	accessLogMaxBatchSize = 100
+)
+
+// AccessLogEntry records that a file in a TLF was read.
+type AccessLogEntry struct {
+	Path   string // relative to the TLF root
+	Reader keybase1.UID
+	// ReaderKey is the verifying key of the device that read the
+	// file.
+	ReaderKey kbfscrypto.VerifyingKey
+	Time      time.Time
+}
+
+type accessLogEntriesByTime []AccessLogEntry
+
+func (es accessLogEntriesByTime) Len() int {
+	return len(es)
+}
+
+func (es accessLogEntriesByTime) Less(i, j int) bool {
+	return es[i].Time.Before(es[j].Time)
+}
+
+func (es accessLogEntriesByTime) Swap(i, j int) {
+	es[i], es[j] = es[j], es[i]
+}
+
+type accessRecord struct {
+	Path string `codec:"p"`
+	// Time is in nanoseconds since the Unix epoch.
+	Time int64 `codec:"t"`
+}
+
+// accessLogBatch is the content of one file in the access log.  Sig
+// covers the encoding of the batch with an empty Sig.
+type accessLogBatch struct {
+	Reader  keybase1.UID             `codec:"r"`
+	Records []accessRecord           `codec:"rs"`
+	Sig     kbfscrypto.SignatureInfo `codec:"s"`
+}
+
+// accessLogBatchName returns the name of the log file for a batch
+// whose last record is at the given time.  Names sort by time, which
+// lets old batches be pruned without reading them.
+func accessLogBatchName(last int64, suffix string) string {
+	return fmt.Sprintf("%020d-%s", last, suffix)
+}
+
+func accessLogBatchTime(name string) (time.Time, error) {
+	i := strings.IndexByte(name, '-')
+	if i < 0 {
+		return time.Time{}, fmt.Errorf("No time in name %q", name)
+	}
+	nanos, err := strconv.ParseInt(name[:i], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// accessLogger batches up the reads made through a folderBranchOps,
+// and appends them to the TLF's access log, if it has one.
+type accessLogger struct {
+	fbo *folderBranchOps
+	log logger.Logger
+
+	lock      sync.Mutex
+	records   []accessRecord
+	paths     map[string]bool
+	timer     *time.Timer
+	isStopped bool
+}
+
+func newAccessLogger(fbo *folderBranchOps, log logger.Logger) *accessLogger {
+	return &accessLogger{
+		fbo: fbo,
+		log: log,
+	}
+}
+
+// recordRead notes that the file at the given path was read.  Reads
+// of the same file are only recorded once per batch.
+func (al *accessLogger) recordRead(p path) {
+	if len(p.path) < 2 || p.path[1].Name == AccessLogDirName {
+		return
+	}
+	names := make([]string, 0, len(p.path)-1)
+	for _, node := range p.path[1:] {
+		names = append(names, node.Name)
+	}
+	relPath := strings.Join(names, "/")
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if al.isStopped || al.paths[relPath] {
+		return
+	}
+	if al.paths == nil {
+		al.paths = make(map[string]bool)
+	}
+	al.paths[relPath] = true
+	al.records = append(al.records, accessRecord{
+		Path: relPath,
+		Time: al.fbo.config.Clock().Now().UnixNano(),
+	})
+
+	if len(al.records) >= accessLogMaxBatchSize {
+		go al.flushInBackground()
+	} else if al.timer == nil {
+		al.timer = time.AfterFunc(
+			accessLogFlushInterval, al.flushInBackground)
+	}
+}
+
+func (al *accessLogger) flushInBackground() {
+	ctx := al.fbo.ctxWithFBOID(context.Background())
+	if err := al.flush(ctx); err != nil {
+		al.log.CWarningf(ctx, "Couldn't flush access log: %v", err)
+	}
+}
+
+// takeRecords returns and clears the pending records.
+func (al *accessLogger) takeRecords() []accessRecord {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if al.timer != nil {
+		al.timer.Stop()
+		al.timer = nil
+	}
+	records := al.records
+	al.records = nil
+	al.paths = nil
+	return records
+}
+
+// getDir returns the node for the access log directory, and false if
+// the TLF doesn't have one.
+func (al *accessLogger) getDir(ctx context.Context) (Node, bool, error) {
+	rootNode, _, _, err := al.fbo.getRootNode(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	dir, _, err := al.fbo.Lookup(ctx, rootNode, AccessLogDirName)
+	if _, ok := err.(NoSuchNameError); ok {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return dir, true, nil
+}
+
+// flush appends any pending records to the access log as a single
+// signed batch.  The records are dropped if access logging isn't
+// enabled for the TLF.
+func (al *accessLogger) flush(ctx context.Context) error {
+	records := al.takeRecords()
+	if len(records) == 0 {
+		return nil
+	}
+
+	dir, ok, err := al.getDir(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		al.log.CDebugf(ctx, "Access logging is off; dropping %d records",
+			len(records))
+		return nil
+	}
+
+	_, uid, err := al.fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+	batch := accessLogBatch{
+		Reader:  uid,
+		Records: records,
+	}
+	codec := al.fbo.config.Codec()
+	buf, err := codec.Encode(batch)
+	if err != nil {
+		return err
+	}
+	batch.Sig, err = al.fbo.config.Crypto().Sign(ctx, buf)
+	if err != nil {
+		return err
+	}
+	buf, err = codec.Encode(batch)
+	if err != nil {
+		return err
+	}
+
+	suffix, err := MakeRandomRequestID()
+	if err != nil {
+		return err
+	}
+	name := accessLogBatchName(records[len(records)-1].Time, suffix)
+	al.log.CDebugf(ctx, "Flushing %d access records to %s",
+		len(records), name)
+	file, _, err := al.fbo.CreateFile(ctx, dir, name, false, WithExcl)
+	if err != nil {
+		return err
+	}
+	err = al.fbo.Write(ctx, file, buf, 0)
+	if err != nil {
+		return err
+	}
+	return al.fbo.Sync(ctx, file)
+}
+
+// readBatch reads and verifies the batch in the given log file.
+func (al *accessLogger) readBatch(ctx context.Context, dir Node,
+	name string) ([]AccessLogEntry, error) {
+	file, ei, err := al.fbo.Lookup(ctx, dir, name)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, ei.Size)
+	n, err := al.fbo.Read(ctx, file, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var batch accessLogBatch
+	err = al.fbo.config.Codec().Decode(buf[:n], &batch)
+	if err != nil {
+		return nil, InvalidAccessLogBatchError{name, err}
+	}
+	if len(batch.Records) == 0 {
+		return nil, InvalidAccessLogBatchError{
+			name, fmt.Errorf("No records")}
+	}
+
+	sig := batch.Sig
+	batch.Sig = kbfscrypto.SignatureInfo{}
+	signed, err := al.fbo.config.Codec().Encode(batch)
+	if err != nil {
+		return nil, err
+	}
+	err = al.fbo.config.Crypto().Verify(signed, sig)
+	if err != nil {
+		return nil, InvalidAccessLogBatchError{name, err}
+	}
+	last := time.Unix(0, batch.Records[len(batch.Records)-1].Time)
+	err = al.fbo.config.KBPKI().HasVerifyingKey(
+		ctx, batch.Reader, sig.VerifyingKey, last)
+	if err != nil {
+		return nil, InvalidAccessLogBatchError{name, err}
+	}
+
+	entries := make([]AccessLogEntry, 0, len(batch.Records))
+	for _, r := range batch.Records {
+		entries = append(entries, AccessLogEntry{
+			Path:      r.Path,
+			Reader:    batch.Reader,
+			ReaderKey: sig.VerifyingKey,
+			Time:      time.Unix(0, r.Time),
+		})
+	}
+	return entries, nil
+}
+
+// getLog flushes this device's pending records, and then returns
+// every verified entry in the access log, sorted by time.
+func (al *accessLogger) getLog(ctx context.Context) (
+	[]AccessLogEntry, error) {
+	if err := al.flush(ctx); err != nil {
+		return nil, err
+	}
+	dir, ok, err := al.getDir(ctx)
+	if err != nil || !ok {
+		return nil, err
+	}
+	children, err := al.fbo.GetDirChildren(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []AccessLogEntry
+	for name := range children {
+		batchEntries, err := al.readBatch(ctx, dir, name)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, batchEntries...)
+	}
+	sort.Sort(accessLogEntriesByTime(entries))
+	return entries, nil
+}
+
+// prune removes every batch in the access log whose records are all
+// from before the given time.
+func (al *accessLogger) prune(ctx context.Context, before time.Time) error {
+	dir, ok, err := al.getDir(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	children, err := al.fbo.GetDirChildren(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for name := range children {
+		last, err := accessLogBatchTime(name)
+		if err != nil {
+			al.log.CDebugf(ctx, "Not pruning %q: %v", name, err)
+			continue
+		}
+		if !last.Before(before) {
+			continue
+		}
+		err = al.fbo.RemoveEntry(ctx, dir, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setEnabled turns access logging for the TLF on or off.  Turning it
+// off deletes the whole log.
+func (al *accessLogger) setEnabled(ctx context.Context, enabled bool) error {
+	rootNode, _, _, err := al.fbo.getRootNode(ctx)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		_, _, err := al.fbo.createDir(ctx, rootNode, AccessLogDirName)
+		if _, ok := err.(NameExistsError); ok {
+			return nil
+		}
+		return err
+	}
+
+	al.takeRecords()
+	dir, ok, err := al.getDir(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	children, err := al.fbo.GetDirChildren(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for name := range children {
+		err = al.fbo.RemoveEntry(ctx, dir, name)
+		if err != nil {
+			return err
+		}
+	}
+	return al.fbo.RemoveDir(ctx, rootNode, AccessLogDirName)
+}
+
+// shutdown stops any pending flush, and drops any pending records.
+func (al *accessLogger) shutdown() {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	al.isStopped = true
+	if al.timer != nil {
+		al.timer.Stop()
+		al.timer = nil
+	}
+	al.records = nil
+	al.paths = nil
+}
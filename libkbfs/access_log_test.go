@@ -0,0 +1,138 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogBatchName(t *testing.T) {
+	now := time.Unix(0, 1234567890123456789)
+	name := accessLogBatchName(now.UnixNano(), "abc-def")
+	last, err := accessLogBatchTime(name)
+	require.NoError(t, err)
+	require.True(t, now.Equal(last))
+
+	// Names should sort by time.
+	require.True(t, accessLogBatchName(99, "b") <
+		accessLogBatchName(100, "a"))
+
+	_, err = accessLogBatchTime("nodash")
+	require.Error(t, err)
+}
+
+func TestAccessLogReadAndPrune(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file, and turns on access logging.
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fb := rootNode1.GetFolderBranch()
+	fileA1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	require.NoError(t, kbfsOps1.Write(ctx, fileA1, data, 0))
+	require.NoError(t, kbfsOps1.Sync(ctx, fileA1))
+	entries, err := kbfsOps1.GetAccessLog(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+	err = kbfsOps1.SetAccessLogging(ctx, fb, true)
+	require.NoError(t, err)
+
+	// user2 reads the file, twice.
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	for i := 0; i < 2; i++ {
+		_, err = kbfsOps2.Read(ctx, fileA2, buf, 0)
+		require.NoError(t, err)
+	}
+
+	_, uid2, err := config2.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	key2, err := config2.KBPKI().GetCurrentVerifyingKey(ctx)
+	require.NoError(t, err)
+	checkEntries := func(entries []AccessLogEntry) {
+		require.Len(t, entries, 1)
+		require.Equal(t, "a", entries[0].Path)
+		require.Equal(t, uid2, entries[0].Reader)
+		require.Equal(t, key2, entries[0].ReaderKey)
+	}
+
+	// Getting the log flushes user2's read.
+	entries, err = kbfsOps2.GetAccessLog(ctx, fb)
+	require.NoError(t, err)
+	checkEntries(entries)
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	entries, err = kbfsOps1.GetAccessLog(ctx, fb)
+	require.NoError(t, err)
+	checkEntries(entries)
+
+	// Pruning up to an earlier time keeps the entry.
+	err = kbfsOps1.PruneAccessLog(ctx, fb, entries[0].Time)
+	require.NoError(t, err)
+	entries, err = kbfsOps1.GetAccessLog(ctx, fb)
+	require.NoError(t, err)
+	checkEntries(entries)
+
+	err = kbfsOps1.PruneAccessLog(
+		ctx, fb, entries[0].Time.Add(time.Nanosecond))
+	require.NoError(t, err)
+	entries, err = kbfsOps1.GetAccessLog(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+
+	// Turning logging off removes the log.
+	err = kbfsOps1.SetAccessLogging(ctx, fb, false)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.Lookup(ctx, rootNode1, AccessLogDirName)
+	require.IsType(t, NoSuchNameError{}, err)
+
+	// Reads while logging is off are dropped.
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	_, err = kbfsOps2.Read(ctx, fileA2, buf, 0)
+	require.NoError(t, err)
+	entries, err = kbfsOps2.GetAccessLog(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+}
+
+func TestAccessLogTampered(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	err := kbfsOps.SetAccessLogging(ctx, fb, true)
+	require.NoError(t, err)
+
+	dir, _, err := kbfsOps.Lookup(ctx, rootNode, AccessLogDirName)
+	require.NoError(t, err)
+	name := accessLogBatchName(config.Clock().Now().UnixNano(), "x")
+	file, _, err := kbfsOps.CreateFile(ctx, dir, name, false, NoExcl)
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps.Write(ctx, file, []byte{1, 2, 3}, 0))
+	require.NoError(t, kbfsOps.Sync(ctx, file))
+
+	_, err = kbfsOps.GetAccessLog(ctx, fb)
+	require.IsType(t, InvalidAccessLogBatchError{}, err)
+}
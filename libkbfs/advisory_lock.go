@@ -0,0 +1,474 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+const (
+	// advisoryLockTTL is the duration of the leases behind
+	// advisory locks.  A device that dies while holding a lock
+	// blocks other devices for at most this long.
+	advisoryLockTTL = 30 * time.Second
+	// advisoryLockFilePrefix starts the names of the lease lock
+	// files behind POSIX advisory locks, which live next to the
+	// locked files.
+	advisoryLockFilePrefix = ".lock-"
+	// advisoryFlockFilePrefix is like advisoryLockFilePrefix, for
+	// flock locks.
+	advisoryFlockFilePrefix = ".flock-"
+)
+
+// AdvisoryLockMode is the mode of an advisory lock.
+type AdvisoryLockMode int
+
+const (
+	// AdvisoryLockShared can be held by several owners at once.
+	AdvisoryLockShared AdvisoryLockMode = iota
+	// AdvisoryLockExclusive can only be held by one owner.
+	AdvisoryLockExclusive
+)
+
+func (m AdvisoryLockMode) String() string {
+	switch m {
+	case AdvisoryLockShared:
+		return "shared"
+	case AdvisoryLockExclusive:
+		return "exclusive"
+	default:
+		return fmt.Sprintf("AdvisoryLockMode(%d)", int(m))
+	}
+}
+
+// AdvisoryLockKind is the family an advisory lock belongs to.  Like
+// fcntl and flock locks on Linux, locks of different kinds never
+// conflict with each other.
+type AdvisoryLockKind int
+
+const (
+	// AdvisoryLockPOSIX locks are fcntl(2) locks, which are held
+	// by processes, on byte ranges.
+	AdvisoryLockPOSIX AdvisoryLockKind = iota
+	// AdvisoryLockFlock locks are flock(2) locks, which are held
+	// by open files, on whole files.
+	AdvisoryLockFlock
+)
+
+func (k AdvisoryLockKind) String() string {
+	switch k {
+	case AdvisoryLockPOSIX:
+		return "posix"
+	case AdvisoryLockFlock:
+		return "flock"
+	default:
+		return fmt.Sprintf("AdvisoryLockKind(%d)", int(k))
+	}
+}
+
+func (k AdvisoryLockKind) filePrefix() string {
+	if k == AdvisoryLockFlock {
+		return advisoryFlockFilePrefix
+	}
+	return advisoryLockFilePrefix
+}
+
+// AdvisoryLockOwner identifies who holds an advisory lock on this
+// device, e.g. a process or an open file, as numbered by the kernel.
+type AdvisoryLockOwner struct {
+	Kind AdvisoryLockKind
+	ID   uint64
+}
+
+// AdvisoryLockRange is a range of bytes of a file, from Start to End
+// inclusive.
+type AdvisoryLockRange struct {
+	Start uint64
+	End   uint64
+}
+
+// AdvisoryLockWholeFile covers all of a file, however long it grows.
+var AdvisoryLockWholeFile = AdvisoryLockRange{0, math.MaxUint64}
+
+func (r AdvisoryLockRange) overlaps(other AdvisoryLockRange) bool {
+	return r.Start <= other.End && other.Start <= r.End
+}
+
+// AdvisoryLockInfo is a lock held on a range of a file.
+type AdvisoryLockInfo struct {
+	Range AdvisoryLockRange
+	Mode  AdvisoryLockMode
+}
+
+// subtractAdvisoryLockRange returns the given locks, without the
+// parts of them in r.
+func subtractAdvisoryLockRange(
+	held []AdvisoryLockInfo, r AdvisoryLockRange) []AdvisoryLockInfo {
+	var remaining []AdvisoryLockInfo
+	for _, l := range held {
+		if !l.Range.overlaps(r) {
+			remaining = append(remaining, l)
+			continue
+		}
+		if l.Range.Start < r.Start {
+			remaining = append(remaining, AdvisoryLockInfo{
+				AdvisoryLockRange{l.Range.Start, r.Start - 1}, l.Mode})
+		}
+		if l.Range.End > r.End {
+			remaining = append(remaining, AdvisoryLockInfo{
+				AdvisoryLockRange{r.End + 1, l.Range.End}, l.Mode})
+		}
+	}
+	return remaining
+}
+
+// AdvisoryLockConflictError is returned by AdvisoryLockTable.Lock
+// when it isn't asked to wait, and the lock is held in a conflicting
+// mode by another owner, on this device or another one.
+type AdvisoryLockConflictError struct {
+	Name string
+}
+
+// Error implements the error interface for AdvisoryLockConflictError.
+func (e AdvisoryLockConflictError) Error() string {
+	return fmt.Sprintf("Lock on %s is held by someone else", e.Name)
+}
+
+type advisoryLockKey struct {
+	tlf  tlf.ID
+	file NodeID
+	kind AdvisoryLockKind
+}
+
+type advisoryLockEntry struct {
+	// ready is closed once the lease has been acquired, or failed
+	// to be, and again (after being replaced) once it has been
+	// released.
+	ready chan struct{}
+	lease *LeaseLock
+	// name is the name of the file when the lease was acquired.
+	name string
+	// owners and changed are protected by AdvisoryLockTable.lock.
+	owners map[uint64][]AdvisoryLockInfo
+	// changed is closed, and replaced, whenever an owner's locks
+	// change.
+	changed chan struct{}
+}
+
+// conflict returns a lock held by an owner other than the given one
+// that conflicts with locking r in the given mode, or nil if there
+// is none.
+func (e *advisoryLockEntry) conflict(owner uint64, r AdvisoryLockRange,
+	mode AdvisoryLockMode) *AdvisoryLockInfo {
+	for o, held := range e.owners {
+		if o == owner {
+			continue
+		}
+		for _, l := range held {
+			if l.Range.overlaps(r) && (mode == AdvisoryLockExclusive ||
+				l.Mode == AdvisoryLockExclusive) {
+				return &l
+			}
+		}
+	}
+	return nil
+}
+
+// notifyChanged wakes up everyone waiting for the entry's locks to
+// change.
+func (e *advisoryLockEntry) notifyChanged() {
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// AdvisoryLockTable implements POSIX and flock advisory locks on
+// KBFS files, that are respected by every device of the user.
+//
+// Between owners on this device (e.g., processes, or open file
+// descriptions), locks are taken on byte ranges, shared or exclusive
+// as requested.  Between devices, a device holds a LeaseLock on a
+// file, in a lock file next to it, for as long as any of its owners
+// holds a lock of the same kind on any part of the file; so locks on
+// different devices exclude each other whatever their ranges and
+// modes.  That's stricter than needed, but never lets two devices
+// hold conflicting locks.  Like LeaseLocks, locks can't be taken on
+// files in folders with the TLF journal enabled.
+//
+// libfuse serves fcntl and flock locks with this table.
+type AdvisoryLockTable struct {
+	config Config
+	log    logger.Logger
+	holder string
+
+	lock  sync.Mutex
+	locks map[advisoryLockKey]*advisoryLockEntry
+}
+
+// NewAdvisoryLockTable returns a new, empty AdvisoryLockTable.
+func NewAdvisoryLockTable(config Config) (*AdvisoryLockTable, error) {
+	// The holder name identifies this table to other devices (and
+	// to later instances on this one, which mustn't resume its
+	// leases).
+	holder, err := MakeRandomRequestID()
+	if err != nil {
+		return nil, err
+	}
+	return &AdvisoryLockTable{
+		config: config,
+		log:    config.MakeLogger(""),
+		holder: holder,
+		locks:  make(map[advisoryLockKey]*advisoryLockEntry),
+	}, nil
+}
+
+func makeAdvisoryLockKey(
+	file Node, kind AdvisoryLockKind) advisoryLockKey {
+	return advisoryLockKey{file.GetFolderBranch().Tlf, file.GetID(), kind}
+}
+
+// acquireLease gets the lease for the new entry e, which has already
+// been added to the table.
+func (t *AdvisoryLockTable) acquireLease(ctx context.Context,
+	key advisoryLockKey, e *advisoryLockEntry, file Node,
+	wait bool) (err error) {
+	defer close(e.ready)
+	dir, name, err := t.config.KBFSOps().GetParent(ctx, file)
+	var lease *LeaseLock
+	if err == nil {
+		lockName := key.kind.filePrefix() + name
+		if wait {
+			lease, err = AcquireLeaseLock(
+				ctx, t.config, dir, lockName, t.holder, advisoryLockTTL)
+		} else {
+			lease, err = TryAcquireLeaseLock(
+				ctx, t.config, dir, lockName, t.holder, advisoryLockTTL)
+			if _, ok := err.(LeaseLockHeldError); ok {
+				err = AdvisoryLockConflictError{name}
+			}
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err != nil {
+		delete(t.locks, key)
+		return err
+	}
+	e.lease = lease
+	e.name = name
+	return nil
+}
+
+// Lock locks the range r of the given file in the given mode on
+// behalf of the given owner, replacing any locks the owner holds on
+// parts of r.  If another owner holds a conflicting lock, it returns
+// an AdvisoryLockConflictError unless wait is set, in which case it
+// waits until the lock can be taken, or until ctx is canceled.  In
+// folders with the TLF journal enabled, it returns a
+// LeaseLockJournaledError.
+func (t *AdvisoryLockTable) Lock(ctx context.Context, file Node,
+	owner AdvisoryLockOwner, r AdvisoryLockRange, mode AdvisoryLockMode,
+	wait bool) error {
+	t.log.CDebugf(ctx, "Lock %p %d-%d for %s %d (%s, wait=%t)",
+		file.GetID(), r.Start, r.End, owner.Kind, owner.ID, mode, wait)
+	key := makeAdvisoryLockKey(file, owner.Kind)
+	for {
+		t.lock.Lock()
+		e, ok := t.locks[key]
+		if !ok {
+			// Nobody on this device has it, so get the
+			// lease first.
+			e = &advisoryLockEntry{
+				ready:   make(chan struct{}),
+				owners:  make(map[uint64][]AdvisoryLockInfo),
+				changed: make(chan struct{}),
+			}
+			t.locks[key] = e
+			t.lock.Unlock()
+			err := t.acquireLease(ctx, key, e, file, wait)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		ready := e.ready
+		select {
+		case <-ready:
+		default:
+			// Someone else on this device is getting or
+			// releasing the lease; wait for them.
+			t.lock.Unlock()
+			select {
+			case <-ready:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+
+		if e.conflict(owner.ID, r, mode) == nil {
+			held := subtractAdvisoryLockRange(e.owners[owner.ID], r)
+			e.owners[owner.ID] = append(held, AdvisoryLockInfo{r, mode})
+			e.notifyChanged()
+			t.lock.Unlock()
+			return nil
+		}
+		changed := e.changed
+		t.lock.Unlock()
+		if !wait {
+			return AdvisoryLockConflictError{e.name}
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// unlockLocked removes owner's locks on r from the entry for key,
+// and returns the entry if nobody on this device holds any lock on
+// it anymore.  The entry stays in the table, with a new ready channel
+// and no lease, until its lease has been released by releaseEntry, so
+// that nobody on this device tries to take the lease again in the
+// meantime.
+func (t *AdvisoryLockTable) unlockLocked(key advisoryLockKey,
+	owner uint64, r AdvisoryLockRange) (*advisoryLockEntry, *LeaseLock) {
+	e, ok := t.locks[key]
+	if !ok || e.lease == nil {
+		return nil, nil
+	}
+	held, ok := e.owners[owner]
+	if !ok {
+		return nil, nil
+	}
+	if held = subtractAdvisoryLockRange(held, r); len(held) > 0 {
+		e.owners[owner] = held
+	} else {
+		delete(e.owners, owner)
+	}
+	e.notifyChanged()
+	if len(e.owners) > 0 {
+		return nil, nil
+	}
+	lease := e.lease
+	e.lease = nil
+	e.ready = make(chan struct{})
+	return e, lease
+}
+
+// releaseEntry releases the lease of an entry returned by
+// unlockLocked, and then removes the entry from the table.
+func (t *AdvisoryLockTable) releaseEntry(ctx context.Context,
+	key advisoryLockKey, e *advisoryLockEntry, lease *LeaseLock) error {
+	err := lease.Release(ctx)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.locks, key)
+	close(e.ready)
+	return err
+}
+
+// Unlock releases the given owner's locks on the range r of the
+// given file.  Unlocking a range that the owner hasn't locked is a
+// no-op.
+func (t *AdvisoryLockTable) Unlock(ctx context.Context, file Node,
+	owner AdvisoryLockOwner, r AdvisoryLockRange) error {
+	t.log.CDebugf(ctx, "Unlock %p %d-%d for %s %d",
+		file.GetID(), r.Start, r.End, owner.Kind, owner.ID)
+	key := makeAdvisoryLockKey(file, owner.Kind)
+	t.lock.Lock()
+	e, lease := t.unlockLocked(key, owner.ID, r)
+	t.lock.Unlock()
+	if e == nil {
+		return nil
+	}
+	return t.releaseEntry(ctx, key, e, lease)
+}
+
+// UnlockAll releases all of the given owner's locks, as when a
+// process exits.
+func (t *AdvisoryLockTable) UnlockAll(
+	ctx context.Context, owner AdvisoryLockOwner) error {
+	t.lock.Lock()
+	type released struct {
+		e     *advisoryLockEntry
+		lease *LeaseLock
+	}
+	toRelease := make(map[advisoryLockKey]released)
+	for key := range t.locks {
+		if key.kind != owner.Kind {
+			continue
+		}
+		e, lease := t.unlockLocked(key, owner.ID, AdvisoryLockWholeFile)
+		if e != nil {
+			toRelease[key] = released{e, lease}
+		}
+	}
+	t.lock.Unlock()
+
+	var firstErr error
+	for key, r := range toRelease {
+		err := t.releaseEntry(ctx, key, r.e, r.lease)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Query returns a lock that conflicts with the given owner locking
+// the range r of the given file in the given mode, or nil if there is
+// none.  A lock held by another device is reported as an exclusive
+// lock on the whole file.  Like Lock, it returns a
+// LeaseLockJournaledError in folders with the TLF journal enabled.
+func (t *AdvisoryLockTable) Query(ctx context.Context, file Node,
+	owner AdvisoryLockOwner, r AdvisoryLockRange, mode AdvisoryLockMode) (
+	*AdvisoryLockInfo, error) {
+	key := makeAdvisoryLockKey(file, owner.Kind)
+	t.lock.Lock()
+	if e, ok := t.locks[key]; ok && e.lease != nil {
+		// This device has the lease, so only its own owners
+		// can conflict.
+		conflict := e.conflict(owner.ID, r, mode)
+		t.lock.Unlock()
+		return conflict, nil
+	}
+	t.lock.Unlock()
+
+	kbfsOps := t.config.KBFSOps()
+	dir, name, err := kbfsOps.GetParent(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	lockName := owner.Kind.filePrefix() + name
+	if TLFJournalEnabled(t.config, file.GetFolderBranch().Tlf) {
+		// Nobody can take the lock, but that doesn't mean
+		// it's free.
+		return nil, LeaseLockJournaledError{lockName}
+	}
+	_, info, mtime, err := readLeaseLockInfo(ctx, kbfsOps, dir, lockName)
+	if _, ok := err.(NoSuchNameError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if info.Expires.IsZero() {
+		info.Expires = mtime.Add(advisoryLockTTL)
+	}
+	if info.Holder == t.holder ||
+		!t.config.Clock().Now().Before(info.Expires) {
+		return nil, nil
+	}
+	return &AdvisoryLockInfo{AdvisoryLockWholeFile, AdvisoryLockExclusive}, nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func posixOwner(id uint64) AdvisoryLockOwner {
+	return AdvisoryLockOwner{AdvisoryLockPOSIX, id}
+}
+
+func TestAdvisoryLockTableLocal(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	file, _, err := config.KBFSOps().CreateFile(
+		ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	table, err := NewAdvisoryLockTable(config)
+	require.NoError(t, err)
+	all := AdvisoryLockWholeFile
+
+	// Shared locks can be held together, but not with an
+	// exclusive one.
+	err = table.Lock(ctx, file, posixOwner(1), all, AdvisoryLockShared, false)
+	require.NoError(t, err)
+	err = table.Lock(ctx, file, posixOwner(2), all, AdvisoryLockShared, false)
+	require.NoError(t, err)
+	err = table.Lock(ctx, file, posixOwner(3), all, AdvisoryLockExclusive, false)
+	require.IsType(t, AdvisoryLockConflictError{}, err)
+	err = table.Lock(ctx, file, posixOwner(1), all, AdvisoryLockExclusive, false)
+	require.IsType(t, AdvisoryLockConflictError{}, err)
+
+	// The lease lock file exists while anyone holds the lock.
+	_, _, err = config.KBFSOps().Lookup(
+		ctx, rootNode, advisoryLockFilePrefix+"a")
+	require.NoError(t, err)
+
+	// A waiting lock gets the lock once the others are released.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- table.Lock(
+			ctx, file, posixOwner(3), all, AdvisoryLockExclusive, true)
+	}()
+	require.NoError(t, table.Unlock(ctx, file, posixOwner(1), all))
+	require.NoError(t, table.UnlockAll(ctx, posixOwner(2)))
+	require.NoError(t, <-errCh)
+
+	require.NoError(t, table.Unlock(ctx, file, posixOwner(3), all))
+	_, _, err = config.KBFSOps().Lookup(
+		ctx, rootNode, advisoryLockFilePrefix+"a")
+	require.IsType(t, NoSuchNameError{}, err)
+}
+
+func TestAdvisoryLockTableRanges(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	file, _, err := config.KBFSOps().CreateFile(
+		ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	table, err := NewAdvisoryLockTable(config)
+	require.NoError(t, err)
+
+	// Locks on disjoint ranges don't conflict.
+	err = table.Lock(ctx, file, posixOwner(1), AdvisoryLockRange{0, 9},
+		AdvisoryLockExclusive, false)
+	require.NoError(t, err)
+	err = table.Lock(ctx, file, posixOwner(2), AdvisoryLockRange{10, 19},
+		AdvisoryLockExclusive, false)
+	require.NoError(t, err)
+	err = table.Lock(ctx, file, posixOwner(2), AdvisoryLockRange{5, 5},
+		AdvisoryLockShared, false)
+	require.IsType(t, AdvisoryLockConflictError{}, err)
+	conflict, err := table.Query(ctx, file, posixOwner(2),
+		AdvisoryLockRange{5, 5}, AdvisoryLockShared)
+	require.NoError(t, err)
+	require.Equal(t, &AdvisoryLockInfo{
+		AdvisoryLockRange{0, 9}, AdvisoryLockExclusive}, conflict)
+	conflict, err = table.Query(ctx, file, posixOwner(1),
+		AdvisoryLockRange{5, 5}, AdvisoryLockShared)
+	require.NoError(t, err)
+	require.Nil(t, conflict)
+
+	// Unlocking part of a range keeps the rest locked.
+	require.NoError(t, table.Unlock(
+		ctx, file, posixOwner(1), AdvisoryLockRange{0, 4}))
+	err = table.Lock(ctx, file, posixOwner(2), AdvisoryLockRange{0, 4},
+		AdvisoryLockExclusive, false)
+	require.NoError(t, err)
+	err = table.Lock(ctx, file, posixOwner(2), AdvisoryLockRange{9, 9},
+		AdvisoryLockShared, false)
+	require.IsType(t, AdvisoryLockConflictError{}, err)
+
+	// Downgrading part of an exclusive lock lets others share
+	// that part.
+	err = table.Lock(ctx, file, posixOwner(1), AdvisoryLockRange{8, 9},
+		AdvisoryLockShared, false)
+	require.NoError(t, err)
+	err = table.Lock(ctx, file, posixOwner(2), AdvisoryLockRange{9, 9},
+		AdvisoryLockShared, false)
+	require.NoError(t, err)
+	err = table.Lock(ctx, file, posixOwner(2), AdvisoryLockRange{7, 7},
+		AdvisoryLockShared, false)
+	require.IsType(t, AdvisoryLockConflictError{}, err)
+
+	// flock locks don't interact with POSIX ones, and have a
+	// lease lock file of their own.
+	flockOwner := AdvisoryLockOwner{AdvisoryLockFlock, 1}
+	err = table.Lock(ctx, file, flockOwner, AdvisoryLockWholeFile,
+		AdvisoryLockExclusive, false)
+	require.NoError(t, err)
+	_, _, err = config.KBFSOps().Lookup(
+		ctx, rootNode, advisoryFlockFilePrefix+"a")
+	require.NoError(t, err)
+	require.NoError(t, table.UnlockAll(ctx, flockOwner))
+	_, _, err = config.KBFSOps().Lookup(
+		ctx, rootNode, advisoryFlockFilePrefix+"a")
+	require.IsType(t, NoSuchNameError{}, err)
+
+	// The lease is only released once every range is unlocked.
+	require.NoError(t, table.UnlockAll(ctx, posixOwner(1)))
+	_, _, err = config.KBFSOps().Lookup(
+		ctx, rootNode, advisoryLockFilePrefix+"a")
+	require.NoError(t, err)
+	require.NoError(t, table.Unlock(
+		ctx, file, posixOwner(2), AdvisoryLockRange{0, 9}))
+	_, _, err = config.KBFSOps().Lookup(
+		ctx, rootNode, advisoryLockFilePrefix+"a")
+	require.NoError(t, err)
+	require.NoError(t, table.Unlock(
+		ctx, file, posixOwner(2), AdvisoryLockRange{10, 19}))
+	_, _, err = config.KBFSOps().Lookup(
+		ctx, rootNode, advisoryLockFilePrefix+"a")
+	require.IsType(t, NoSuchNameError{}, err)
+}
+
+func TestAdvisoryLockTableAcrossDevices(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	file, _, err := config.KBFSOps().CreateFile(
+		ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	table1, err := NewAdvisoryLockTable(config)
+	require.NoError(t, err)
+	table2, err := NewAdvisoryLockTable(config)
+	require.NoError(t, err)
+
+	// Even shared locks on disjoint ranges exclude each other
+	// across devices.
+	err = table1.Lock(ctx, file, posixOwner(1), AdvisoryLockRange{0, 0},
+		AdvisoryLockShared, false)
+	require.NoError(t, err)
+	err = table2.Lock(ctx, file, posixOwner(1), AdvisoryLockRange{1, 1},
+		AdvisoryLockShared, false)
+	require.IsType(t, AdvisoryLockConflictError{}, err)
+	conflict, err := table2.Query(ctx, file, posixOwner(1),
+		AdvisoryLockRange{1, 1}, AdvisoryLockShared)
+	require.NoError(t, err)
+	require.Equal(t, &AdvisoryLockInfo{
+		AdvisoryLockWholeFile, AdvisoryLockExclusive}, conflict)
+
+	// A canceled wait gives up.
+	cancelCtx, cancelFn := context.WithCancel(ctx)
+	cancelFn()
+	err = table2.Lock(cancelCtx, file, posixOwner(1),
+		AdvisoryLockWholeFile, AdvisoryLockShared, true)
+	require.Error(t, err)
+
+	require.NoError(t, table1.Unlock(
+		ctx, file, posixOwner(1), AdvisoryLockWholeFile))
+	conflict, err = table2.Query(ctx, file, posixOwner(1),
+		AdvisoryLockRange{1, 1}, AdvisoryLockShared)
+	require.NoError(t, err)
+	require.Nil(t, conflict)
+	err = table2.Lock(ctx, file, posixOwner(1), AdvisoryLockWholeFile,
+		AdvisoryLockExclusive, false)
+	require.NoError(t, err)
+	require.NoError(t, table2.Unlock(
+		ctx, file, posixOwner(1), AdvisoryLockWholeFile))
+}
+
+func TestAdvisoryLockTableJournaled(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "advisory_lock")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	config.EnableJournaling(tempdir, TLFJournalBackgroundWorkEnabled)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	file, _, err := config.KBFSOps().CreateFile(
+		ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = jServer.Enable(ctx, rootNode.GetFolderBranch().Tlf,
+		TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+	table, err := NewAdvisoryLockTable(config)
+	require.NoError(t, err)
+
+	for _, wait := range []bool{false, true} {
+		err = table.Lock(ctx, file, posixOwner(1), AdvisoryLockWholeFile,
+			AdvisoryLockExclusive, wait)
+		require.IsType(t, LeaseLockJournaledError{}, err)
+	}
+	// The failed lock doesn't linger in the table.
+	conflict, err := table.Query(ctx, file, posixOwner(2),
+		AdvisoryLockWholeFile, AdvisoryLockExclusive)
+	require.IsType(t, LeaseLockJournaledError{}, err)
+	require.Nil(t, conflict)
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// BandwidthDirection says which way the traffic charged to a
+// BandwidthLimiter is going.
+type BandwidthDirection int
+
+const (
+	// BandwidthUpload is traffic from this device to the servers.
+	BandwidthUpload BandwidthDirection = iota
+	// BandwidthDownload is traffic from the servers to this device.
+	BandwidthDownload
+)
+
+func (d BandwidthDirection) String() string {
+	switch d {
+	case BandwidthUpload:
+		return "upload"
+	case BandwidthDownload:
+		return "download"
+	default:
+		return fmt.Sprintf("BandwidthDirection(%d)", int(d))
+	}
+}
+
+// BandwidthLimits are the maximum rates, in bytes per second, for
+// background traffic in each direction.  Zero means unlimited.  It is
+// suitable for encoding directly as JSON.
+type BandwidthLimits struct {
+	UploadBytesPerSecond   int64
+	DownloadBytesPerSecond int64
+}
+
+func (l BandwidthLimits) get(d BandwidthDirection) int64 {
+	if d == BandwidthUpload {
+		return l.UploadBytesPerSecond
+	}
+	return l.DownloadBytesPerSecond
+}
+
+// bandwidthBucket is a token bucket for a single direction.  Its
+// balance may go negative, so that transfers bigger than a whole
+// second's worth of bytes can still go through; later transfers then
+// wait until the debt is paid off.
+type bandwidthBucket struct {
+	rate    int64
+	balance float64
+	last    time.Time
+}
+
+func (b *bandwidthBucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.balance += now.Sub(b.last).Seconds() * float64(b.rate)
+	}
+	b.last = now
+	// Allow bursts of up to one second's worth of bytes.
+	if max := float64(b.rate); b.balance > max {
+		b.balance = max
+	}
+}
+
+// BandwidthLimiterStandard implements the BandwidthLimiter interface
+// with a token bucket for each direction.
+type BandwidthLimiterStandard struct {
+	clock Clock
+
+	lock    sync.Mutex
+	buckets [2]bandwidthBucket
+	// changedCh is closed, and replaced, whenever the limits
+	// change, to wake up waiters.
+	changedCh chan struct{}
+}
+
+var _ BandwidthLimiter = (*BandwidthLimiterStandard)(nil)
+
+// NewBandwidthLimiterStandard returns a new BandwidthLimiterStandard
+// with the given initial limits.
+func NewBandwidthLimiterStandard(
+	clock Clock, limits BandwidthLimits) *BandwidthLimiterStandard {
+	l := &BandwidthLimiterStandard{
+		clock:     clock,
+		changedCh: make(chan struct{}),
+	}
+	l.buckets[BandwidthUpload].rate = limits.UploadBytesPerSecond
+	l.buckets[BandwidthDownload].rate = limits.DownloadBytesPerSecond
+	return l
+}
+
+// tryTake charges n bytes to the bucket for the given direction if
+// it isn't in debt.  Otherwise, it returns how long until it won't
+// be, along with a channel that's closed if the limits change before
+// then.
+func (l *BandwidthLimiterStandard) tryTake(d BandwidthDirection, n int64) (
+	ok bool, wait time.Duration, changedCh <-chan struct{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := &l.buckets[d]
+	if b.rate <= 0 {
+		return true, 0, nil
+	}
+	b.refill(l.clock.Now())
+	if b.balance >= 0 {
+		b.balance -= float64(n)
+		return true, 0, nil
+	}
+	wait = time.Duration(-b.balance / float64(b.rate) * float64(time.Second))
+	return false, wait, l.changedCh
+}
+
+// WaitN implements the BandwidthLimiter interface for
+// BandwidthLimiterStandard.
+func (l *BandwidthLimiterStandard) WaitN(
+	ctx context.Context, d BandwidthDirection, n int64) error {
+	for {
+		ok, wait, changedCh := l.tryTake(d, n)
+		if ok {
+			return nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changedCh:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Charge implements the BandwidthLimiter interface for
+// BandwidthLimiterStandard.
+func (l *BandwidthLimiterStandard) Charge(d BandwidthDirection, n int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := &l.buckets[d]
+	if b.rate <= 0 {
+		return
+	}
+	b.refill(l.clock.Now())
+	b.balance -= float64(n)
+}
+
+// SetLimits implements the BandwidthLimiter interface for
+// BandwidthLimiterStandard.
+func (l *BandwidthLimiterStandard) SetLimits(limits BandwidthLimits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.clock.Now()
+	for d := range l.buckets {
+		b := &l.buckets[d]
+		b.refill(now)
+		b.rate = limits.get(BandwidthDirection(d))
+		if b.rate <= 0 {
+			b.balance = 0
+		}
+	}
+	close(l.changedCh)
+	l.changedCh = make(chan struct{})
+}
+
+// Limits implements the BandwidthLimiter interface for
+// BandwidthLimiterStandard.
+func (l *BandwidthLimiterStandard) Limits() BandwidthLimits {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return BandwidthLimits{
+		UploadBytesPerSecond:   l.buckets[BandwidthUpload].rate,
+		DownloadBytesPerSecond: l.buckets[BandwidthDownload].rate,
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestBandwidthLimiterDebt(t *testing.T) {
+	clock := newTestClockNow()
+	l := NewBandwidthLimiterStandard(clock, BandwidthLimits{
+		UploadBytesPerSecond: 100,
+	})
+	ctx := context.Background()
+
+	// Unlimited directions never wait.
+	ok, _, _ := l.tryTake(BandwidthDownload, 1000000)
+	require.True(t, ok)
+
+	// A transfer bigger than the limit goes through, but the next
+	// one has to wait for the debt to be paid off.
+	require.NoError(t, l.WaitN(ctx, BandwidthUpload, 300))
+	ok, wait, _ := l.tryTake(BandwidthUpload, 1)
+	require.False(t, ok)
+	require.Equal(t, 3*time.Second, wait)
+
+	clock.Add(2 * time.Second)
+	ok, wait, _ = l.tryTake(BandwidthUpload, 1)
+	require.False(t, ok)
+	require.Equal(t, time.Second, wait)
+
+	l.Charge(BandwidthUpload, 100)
+	ok, wait, _ = l.tryTake(BandwidthUpload, 1)
+	require.False(t, ok)
+	require.Equal(t, 2*time.Second, wait)
+
+	clock.Add(2 * time.Second)
+	ok, _, _ = l.tryTake(BandwidthUpload, 1)
+	require.True(t, ok)
+}
+
+func TestBandwidthLimiterSetLimitsWakesWaiters(t *testing.T) {
+	clock := newTestClockNow()
+	l := NewBandwidthLimiterStandard(clock, BandwidthLimits{
+		UploadBytesPerSecond: 1,
+	})
+	ctx, cancel := context.WithTimeout(
+		context.Background(), individualTestTimeout)
+	defer cancel()
+
+	require.NoError(t, l.WaitN(ctx, BandwidthUpload, 1000000))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- l.WaitN(ctx, BandwidthUpload, 1)
+	}()
+
+	l.SetLimits(BandwidthLimits{})
+	require.Equal(t, BandwidthLimits{}, l.Limits())
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+}
+
+func TestBandwidthLimiterCanceled(t *testing.T) {
+	l := NewBandwidthLimiterStandard(newTestClockNow(), BandwidthLimits{
+		DownloadBytesPerSecond: 1,
+	})
+	require.NoError(t, l.WaitN(context.Background(), BandwidthDownload, 10))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := l.WaitN(ctx, BandwidthDownload, 0)
+	require.Equal(t, context.Canceled, err)
+}
@@ -413,9 +413,10 @@ func (md *BareRootMetadataV3) CheckValidSuccessor(
 		return errors.New("merged MD can't follow unmerged MD")
 	}
 
-	// (6) Check disk usage.
+	// (6) Check disk usage.  A final MD is a copy of its
+	// predecessor, so it doesn't change the usage.
 	expectedUsage := md.DiskUsage()
-	if !nextMd.IsWriterMetadataCopiedSet() {
+	if !nextMd.IsWriterMetadataCopiedSet() && !nextMd.IsFinal() {
 		expectedUsage += nextMd.RefBytes() - nextMd.UnrefBytes()
 	}
 	if nextMd.DiskUsage() != expectedUsage {
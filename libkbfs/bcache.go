@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/keybase/kbfs/kbfshash"
@@ -23,6 +24,13 @@ type idCacheKey struct {
 // internally by just their block ID (since blocks are immutable and
 // content-addressable).
 type BlockCacheStandard struct {
+	// hits and misses count calls to Get, and must be accessed
+	// atomically.  They're first in the struct so that they're
+	// 64-bit aligned on 32-bit platforms.
+	hits   uint64
+	misses uint64
+
+	// cleanBytesCapacity is protected by bytesLock.
 	cleanBytesCapacity uint64
 
 	ids *lru.Cache
@@ -73,6 +81,7 @@ func (b *BlockCacheStandard) Get(ptr BlockPointer) (Block, error) {
 			if !ok {
 				return nil, BadDataError{ptr.ID}
 			}
+			atomic.AddUint64(&b.hits, 1)
 			return block, nil
 		}
 	}
@@ -83,12 +92,38 @@ func (b *BlockCacheStandard) Get(ptr BlockPointer) (Block, error) {
 		return b.cleanPermanent[ptr.ID]
 	}()
 	if block != nil {
+		atomic.AddUint64(&b.hits, 1)
 		return block, nil
 	}
 
+	atomic.AddUint64(&b.misses, 1)
 	return nil, NoSuchBlockError{ptr.ID}
 }
 
+// getStats returns the number of Get calls that have hit and missed
+// the cache so far, along with the number of clean bytes cached and
+// the current capacity for them.
+func (b *BlockCacheStandard) getStats() (
+	hits, misses, totalBytes, capacityBytes uint64) {
+	hits = atomic.LoadUint64(&b.hits)
+	misses = atomic.LoadUint64(&b.misses)
+	b.bytesLock.Lock()
+	defer b.bytesLock.Unlock()
+	return hits, misses, b.cleanTotalBytes, b.cleanBytesCapacity
+}
+
+// setCleanBytesCapacity changes the total number of clean bytes
+// allowed in the cache, evicting transient entries if needed to
+// get under the new capacity.
+func (b *BlockCacheStandard) setCleanBytesCapacity(capacity uint64) {
+	func() {
+		b.bytesLock.Lock()
+		defer b.bytesLock.Unlock()
+		b.cleanBytesCapacity = capacity
+	}()
+	b.makeRoomForSize(0)
+}
+
 func getCachedBlockSize(block Block) uint32 {
 	// Get the size of the block.  For direct file blocks, use the
 	// length of the plaintext contents.  For everything else, just
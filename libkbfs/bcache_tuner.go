@@ -0,0 +1,187 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+)
+
+const (
+	// blockCacheTuneInterval is how often the block cache tuner
+	// reconsiders the size of the clean block cache.
+	blockCacheTuneInterval = 1 * time.Minute
+	// blockCacheTuneMinLookups is the number of cache lookups
+	// needed in one interval before the tuner trusts the hit rate
+	// enough to act on it.
+	blockCacheTuneMinLookups = 100
+	// blockCacheTuneGrowHitRate is the hit rate below which a full
+	// cache is grown, since the working set doesn't seem to fit.
+	blockCacheTuneGrowHitRate = 0.8
+	// blockCacheTuneShrinkUsage is the fraction of the capacity
+	// below which the cache is shrunk, since the working set fits
+	// with plenty of room to spare.
+	blockCacheTuneShrinkUsage = 0.5
+)
+
+// BlockCacheTuningStatus describes the automatic tuning of the size
+// of the clean block cache.  It is suitable for encoding directly as
+// JSON.
+type BlockCacheTuningStatus struct {
+	// MinBytes and MaxBytes bound the capacity the tuner may pick.
+	MinBytes      uint64
+	MaxBytes      uint64
+	CapacityBytes uint64
+	// UsedBytes is the number of clean bytes cached, which serves
+	// as the estimate of the working set when the cache isn't full.
+	UsedBytes uint64
+	// HitRate is the fraction of lookups that hit the cache during
+	// the last tuning interval, or -1 if there were too few to
+	// tell.
+	HitRate float64
+	// LastDecision describes what the tuner did last, and why.
+	LastDecision     string
+	LastDecisionTime time.Time
+}
+
+// blockCacheTuner periodically adjusts the byte capacity of a
+// BlockCacheStandard within configured bounds: it grows the cache
+// when it's full and missing often, and shrinks it when most of it
+// is going unused.
+type blockCacheTuner struct {
+	cache    *BlockCacheStandard
+	clock    Clock
+	log      logger.Logger
+	minBytes uint64
+	maxBytes uint64
+
+	shutdownChan chan struct{}
+
+	lock       sync.Mutex
+	lastHits   uint64
+	lastMisses uint64
+	status     BlockCacheTuningStatus
+}
+
+func newBlockCacheTuner(cache *BlockCacheStandard, clock Clock,
+	log logger.Logger, minBytes, maxBytes uint64) *blockCacheTuner {
+	t := &blockCacheTuner{
+		cache:        cache,
+		clock:        clock,
+		log:          log,
+		minBytes:     minBytes,
+		maxBytes:     maxBytes,
+		shutdownChan: make(chan struct{}),
+	}
+	hits, misses, used, capacity := cache.getStats()
+	t.lastHits, t.lastMisses = hits, misses
+	t.status = BlockCacheTuningStatus{
+		MinBytes:      minBytes,
+		MaxBytes:      maxBytes,
+		CapacityBytes: capacity,
+		UsedBytes:     used,
+		HitRate:       -1,
+	}
+	// Start within the bounds.
+	if capacity < minBytes {
+		t.setCapacityLocked(minBytes, "raised to the configured minimum")
+	} else if capacity > maxBytes {
+		t.setCapacityLocked(maxBytes, "lowered to the configured maximum")
+	}
+	return t
+}
+
+// nextCapacity returns the capacity the cache should have, given its
+// current capacity and usage and the hit rate over the last interval,
+// along with the reason for any change.  It returns the current
+// capacity and an empty reason if nothing should change.
+func (t *blockCacheTuner) nextCapacity(
+	capacity, used uint64, hitRate float64) (uint64, string) {
+	switch {
+	case hitRate < 0:
+		return capacity, ""
+	case hitRate < blockCacheTuneGrowHitRate &&
+		used >= capacity-capacity/10 && capacity < t.maxBytes:
+		newCapacity := capacity + capacity/4
+		if newCapacity > t.maxBytes || newCapacity <= capacity {
+			newCapacity = t.maxBytes
+		}
+		return newCapacity, fmt.Sprintf(
+			"grown: hit rate %.2f with the cache full", hitRate)
+	case hitRate >= blockCacheTuneGrowHitRate &&
+		float64(used) < float64(capacity)*blockCacheTuneShrinkUsage &&
+		capacity > t.minBytes:
+		// Leave room for the working set to grow a bit.
+		newCapacity := used + used/2
+		if newCapacity < t.minBytes {
+			newCapacity = t.minBytes
+		}
+		return newCapacity, fmt.Sprintf(
+			"shrunk: hit rate %.2f with a working set of %d bytes",
+			hitRate, used)
+	default:
+		return capacity, ""
+	}
+}
+
+func (t *blockCacheTuner) setCapacityLocked(capacity uint64, reason string) {
+	t.log.Debug("Block cache capacity %d -> %d bytes (%s)",
+		t.status.CapacityBytes, capacity, reason)
+	t.cache.setCleanBytesCapacity(capacity)
+	t.status.CapacityBytes = capacity
+	t.status.LastDecision = reason
+	t.status.LastDecisionTime = t.clock.Now()
+}
+
+// tune makes one tuning decision based on the lookups since the
+// last call.
+func (t *blockCacheTuner) tune() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	hits, misses, used, capacity := t.cache.getStats()
+	newHits, newMisses := hits-t.lastHits, misses-t.lastMisses
+	t.lastHits, t.lastMisses = hits, misses
+
+	hitRate := float64(-1)
+	if newHits+newMisses >= blockCacheTuneMinLookups {
+		hitRate = float64(newHits) / float64(newHits+newMisses)
+	}
+	t.status.HitRate = hitRate
+	t.status.UsedBytes = used
+	t.status.CapacityBytes = capacity
+
+	newCapacity, reason := t.nextCapacity(capacity, used, hitRate)
+	if newCapacity != capacity {
+		t.setCapacityLocked(newCapacity, reason)
+	}
+}
+
+func (t *blockCacheTuner) run() {
+	ticker := time.NewTicker(blockCacheTuneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.tune()
+		case <-t.shutdownChan:
+			return
+		}
+	}
+}
+
+func (t *blockCacheTuner) shutdown() {
+	close(t.shutdownChan)
+}
+
+// getStatus returns the current tuning status.
+func (t *blockCacheTuner) getStatus() BlockCacheTuningStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.status
+}
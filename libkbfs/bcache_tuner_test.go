@@ -0,0 +1,92 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCacheTunerNextCapacity(t *testing.T) {
+	bcache := NewBlockCacheStandard(10, 1000)
+	tuner := newBlockCacheTuner(
+		bcache, newTestClockNow(), logger.NewNull(), 100, 2000)
+
+	// Too few lookups to tell.
+	c, reason := tuner.nextCapacity(1000, 1000, -1)
+	require.Equal(t, uint64(1000), c)
+	require.Equal(t, "", reason)
+
+	// Full and missing: grow, but not past the max.
+	c, _ = tuner.nextCapacity(1000, 1000, 0.5)
+	require.Equal(t, uint64(1250), c)
+	c, _ = tuner.nextCapacity(1900, 1900, 0.5)
+	require.Equal(t, uint64(2000), c)
+	c, _ = tuner.nextCapacity(2000, 2000, 0.5)
+	require.Equal(t, uint64(2000), c)
+
+	// Missing, but not full: more space wouldn't help.
+	c, _ = tuner.nextCapacity(1000, 500, 0.5)
+	require.Equal(t, uint64(1000), c)
+
+	// Mostly unused: shrink, but not past the min.
+	c, _ = tuner.nextCapacity(1000, 400, 0.99)
+	require.Equal(t, uint64(600), c)
+	c, _ = tuner.nextCapacity(1000, 10, 0.99)
+	require.Equal(t, uint64(100), c)
+
+	// Hitting and well used: leave it alone.
+	c, _ = tuner.nextCapacity(1000, 900, 0.99)
+	require.Equal(t, uint64(1000), c)
+}
+
+func TestBlockCacheTunerTune(t *testing.T) {
+	bcache := NewBlockCacheStandard(100, 1000)
+	tuner := newBlockCacheTuner(
+		bcache, newTestClockNow(), logger.NewNull(), 500, 2000)
+	status := tuner.getStatus()
+	require.Equal(t, uint64(1000), status.CapacityBytes)
+	require.Equal(t, float64(-1), status.HitRate)
+
+	// Fill the cache, then miss a lot.
+	tlfID := tlf.FakeID(1, false)
+	for i := 0; i < 10; i++ {
+		block := NewFileBlock().(*FileBlock)
+		block.Contents = make([]byte, 100)
+		err := bcache.Put(BlockPointer{ID: fakeBlockID(byte(i))}, tlfID,
+			block, TransientEntry)
+		require.NoError(t, err)
+	}
+	for i := 0; i < blockCacheTuneMinLookups; i++ {
+		_, err := bcache.Get(BlockPointer{ID: fakeBlockID(byte(100 + i))})
+		require.Error(t, err)
+	}
+	tuner.tune()
+	status = tuner.getStatus()
+	require.Equal(t, float64(0), status.HitRate)
+	require.Equal(t, uint64(1250), status.CapacityBytes)
+	require.NotEqual(t, "", status.LastDecision)
+	_, _, _, capacity := bcache.getStats()
+	require.Equal(t, uint64(1250), capacity)
+
+	// Now drop most of the blocks, and hit the rest.
+	for i := 0; i < 9; i++ {
+		err := bcache.DeleteTransient(
+			BlockPointer{ID: fakeBlockID(byte(i))}, tlfID)
+		require.NoError(t, err)
+	}
+	for i := 0; i < blockCacheTuneMinLookups; i++ {
+		_, err := bcache.Get(BlockPointer{ID: fakeBlockID(9)})
+		require.NoError(t, err)
+	}
+	tuner.tune()
+	status = tuner.getStatus()
+	require.Equal(t, float64(1), status.HitRate)
+	require.Equal(t, uint64(100), status.UsedBytes)
+	require.Equal(t, uint64(500), status.CapacityBytes)
+}
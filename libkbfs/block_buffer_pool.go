@@ -0,0 +1,43 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "sync"
+
+// maxPooledBlockBufferSize is the biggest buffer that
+// blockBufferPool holds on to.  Bigger ones are left to the garbage
+// collector, so that one huge block doesn't pin a huge buffer.
+const maxPooledBlockBufferSize = 4 << 20
+
+// blockBufferPool recycles the large intermediate buffers that a
+// block passes through on its way to and from the block server --
+// the padded plaintext being encrypted, and the ciphertext and
+// padded plaintext being decrypted -- so that big reads and writes
+// don't allocate a few new ones for every block.  It holds *[]byte,
+// since putting a plain slice in a sync.Pool allocates.
+var blockBufferPool sync.Pool
+
+// getBlockBuffer returns an empty buffer with room for at least size
+// bytes.  Give it back with putBlockBuffer once nothing refers to
+// its contents anymore.
+func getBlockBuffer(size int) *[]byte {
+	buf, ok := blockBufferPool.Get().(*[]byte)
+	if !ok {
+		buf = new([]byte)
+	}
+	if cap(*buf) < size {
+		*buf = make([]byte, 0, size)
+	}
+	*buf = (*buf)[:0]
+	return buf
+}
+
+// putBlockBuffer returns a buffer from getBlockBuffer to the pool.
+func putBlockBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledBlockBufferSize {
+		return
+	}
+	blockBufferPool.Put(buf)
+}
@@ -55,6 +55,10 @@ import (
 //   - refs: The list of references to the block, encoded as a serialized
 //           blockRefInfo. May be missing.
 //
+// If the store has a storage keyring, the data and ksh files are
+// sealed with it (see kbfscrypto.StorageKeyring.Seal), so that they
+// can't be read at rest without the device key.
+//
 // Future versions of the disk store might add more files to this
 // directory; if any code is written to move blocks around, it should
 // be careful to preserve any unknown files in a block directory.
@@ -67,19 +71,21 @@ import (
 // blockDiskStore is not goroutine-safe, so any code that uses it must
 // guarantee that only one goroutine at a time calls its functions.
 type blockDiskStore struct {
-	codec  kbfscodec.Codec
-	crypto cryptoPure
-	dir    string
+	codec   kbfscodec.Codec
+	crypto  cryptoPure
+	dir     string
+	storage *kbfscrypto.StorageKeyring
 }
 
 // makeBlockDiskStore returns a new blockDiskStore for the given
-// directory.
+// directory.  If storage is nil, block data is stored unsealed.
 func makeBlockDiskStore(codec kbfscodec.Codec, crypto cryptoPure,
-	dir string) *blockDiskStore {
+	dir string, storage *kbfscrypto.StorageKeyring) *blockDiskStore {
 	return &blockDiskStore{
-		codec:  codec,
-		crypto: crypto,
-		dir:    dir,
+		codec:   codec,
+		crypto:  crypto,
+		dir:     dir,
+		storage: storage,
 	}
 }
 
@@ -132,6 +138,29 @@ func (s *blockDiskStore) makeDir(id BlockID) error {
 	return nil
 }
 
+// readFile reads the file at path, opening it with the storage
+// keyring if there is one.
+func (s *blockDiskStore) readFile(path string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil || s.storage == nil {
+		return buf, err
+	}
+	return s.storage.Open(buf)
+}
+
+// writeFile writes buf to the file at path, sealing it with the
+// storage keyring if there is one.
+func (s *blockDiskStore) writeFile(path string, buf []byte) error {
+	if s.storage != nil {
+		var err error
+		buf, err = s.storage.Seal(buf)
+		if err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path, buf, 0600)
+}
+
 // blockRefInfo is a wrapper around blockRefMap, in case we want to
 // add more fields in the future.
 type blockRefInfo struct {
@@ -195,7 +224,7 @@ func (s *blockDiskStore) addRefs(id BlockID, contexts []BlockContext,
 // present.
 func (s *blockDiskStore) getData(id BlockID) (
 	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
-	data, err := ioutil.ReadFile(s.dataPath(id))
+	data, err := s.readFile(s.dataPath(id))
 	if os.IsNotExist(err) {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
 			blockNonExistentError{id}
@@ -204,7 +233,7 @@ func (s *blockDiskStore) getData(id BlockID) (
 	}
 
 	keyServerHalfPath := s.keyServerHalfPath(id)
-	buf, err := ioutil.ReadFile(keyServerHalfPath)
+	buf, err := s.readFile(keyServerHalfPath)
 	if os.IsNotExist(err) {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
 			blockNonExistentError{id}
@@ -275,6 +304,9 @@ func (s *blockDiskStore) getDataSize(id BlockID) (int64, error) {
 	} else if err != nil {
 		return 0, err
 	}
+	if s.storage != nil {
+		return fi.Size() - kbfscrypto.StorageSealOverhead, nil
+	}
 	return fi.Size(), nil
 }
 
@@ -392,7 +424,7 @@ func (s *blockDiskStore) put(id BlockID, context BlockContext, buf []byte,
 			return err
 		}
 
-		err = ioutil.WriteFile(s.dataPath(id), buf, 0600)
+		err = s.writeFile(s.dataPath(id), buf)
 		if err != nil {
 			return err
 		}
@@ -403,7 +435,7 @@ func (s *blockDiskStore) put(id BlockID, context BlockContext, buf []byte,
 		if err != nil {
 			return err
 		}
-		err = ioutil.WriteFile(s.keyServerHalfPath(id), data, 0600)
+		err = s.writeFile(s.keyServerHalfPath(id), data)
 		if err != nil {
 			return err
 		}
@@ -24,7 +24,7 @@ func setupBlockDiskStoreTest(t *testing.T) (tempdir string, s *blockDiskStore) {
 	tempdir, err := ioutil.TempDir(os.TempDir(), "block_disk_store")
 	require.NoError(t, err)
 
-	s = makeBlockDiskStore(codec, crypto, tempdir)
+	s = makeBlockDiskStore(codec, crypto, tempdir, nil)
 	return tempdir, s
 }
 
@@ -90,7 +90,7 @@ func TestBlockDiskStoreBasic(t *testing.T) {
 	getAndCheckBlockDiskData(t, s, bID, bCtx2, data, serverHalf)
 
 	// Shutdown and restart.
-	s = makeBlockDiskStore(s.codec, s.crypto, tempdir)
+	s = makeBlockDiskStore(s.codec, s.crypto, tempdir, nil)
 
 	// Make sure we get the same block for both refs.
 
@@ -213,3 +213,38 @@ func TestBlockDiskStoreRemove(t *testing.T) {
 		})
 	require.NoError(t, err)
 }
+
+func TestBlockDiskStoreSealed(t *testing.T) {
+	tempdir, s := setupBlockDiskStoreTest(t)
+	defer teardownBlockDiskStoreTest(t, tempdir)
+	key, err := kbfscrypto.MakeRandomStorageKey()
+	require.NoError(t, err)
+	s.storage, err = kbfscrypto.NewStorageKeyring(
+		[]kbfscrypto.StorageKey{key})
+	require.NoError(t, err)
+
+	data := []byte{1, 2, 3, 4}
+	bID, bCtx, serverHalf := putBlockDisk(t, s, data)
+
+	// Neither the data nor the server half is stored as is.
+	rawData, err := ioutil.ReadFile(s.dataPath(bID))
+	require.NoError(t, err)
+	require.NotContains(t, string(rawData), string(data))
+	rawServerHalf, err := ioutil.ReadFile(s.keyServerHalfPath(bID))
+	require.NoError(t, err)
+	serverHalfData := serverHalf.Data()
+	require.NotContains(t, string(rawServerHalf), string(serverHalfData[:]))
+
+	buf, key2, err := s.getDataWithContext(bID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.Equal(t, serverHalf, key2)
+	size, err := s.getDataSize(bID)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), size)
+
+	// Without the keyring, the data can't be read.
+	s2 := makeBlockDiskStore(s.codec, s.crypto, tempdir, nil)
+	_, _, err = s2.getDataWithContext(bID, bCtx)
+	require.Error(t, err)
+}
@@ -6,7 +6,10 @@ package libkbfs
 
 import (
 	"fmt"
+	"sync"
 
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
 	"golang.org/x/net/context"
 )
 
@@ -15,16 +18,100 @@ type blockGetter interface {
 	getBlock(context.Context, KeyMetadata, BlockPointer, Block) error
 }
 
+// blockServerGetKey identifies the data fetched by a BlockServer.Get
+// call.  All references to a block share the same data, so the
+// BlockContext isn't part of it.
+type blockServerGetKey struct {
+	tlfID tlf.ID
+	id    BlockID
+}
+
+// blockServerGet is a BlockServer.Get call in flight, and its result
+// once doneCh is closed.
+type blockServerGet struct {
+	// ctx is canceled once every caller waiting on this get has
+	// given up.
+	ctx        *CoalescingContext
+	cancelFunc context.CancelFunc
+	doneCh     chan struct{}
+
+	buf        []byte
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf
+	err        error
+}
+
+// blockServerGetGroup makes sure that concurrent gets of the same
+// block, even through different references, send only one request to
+// the block server.  Later callers wait for the result of the request
+// already in flight.
+type blockServerGetGroup struct {
+	lock sync.Mutex
+	gets map[blockServerGetKey]*blockServerGet
+}
+
+func newBlockServerGetGroup() *blockServerGetGroup {
+	return &blockServerGetGroup{
+		gets: make(map[blockServerGetKey]*blockServerGet),
+	}
+}
+
+// startOrJoin returns the get in flight for key, or starts a new one
+// if there isn't one that's still wanted.
+func (g *blockServerGetGroup) startOrJoin(ctx context.Context,
+	bserv BlockServer, key blockServerGetKey,
+	bctx BlockContext) *blockServerGet {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if get, ok := g.gets[key]; ok {
+		if get.ctx.AddContext(ctx) != context.Canceled {
+			return get
+		}
+		// Everyone waiting on that one has given up, so it
+		// will fail; start over.
+	}
+
+	get := &blockServerGet{doneCh: make(chan struct{})}
+	get.ctx, get.cancelFunc = NewCoalescingContext(ctx)
+	g.gets[key] = get
+	go func() {
+		buf, serverHalf, err := bserv.Get(get.ctx, key.tlfID, key.id, bctx)
+		g.lock.Lock()
+		if g.gets[key] == get {
+			delete(g.gets, key)
+		}
+		g.lock.Unlock()
+		get.cancelFunc()
+		get.buf, get.serverHalf, get.err = buf, serverHalf, err
+		close(get.doneCh)
+	}()
+	return get
+}
+
+// get returns the same thing as bserv.Get, but shares the request
+// with any other caller getting the same block at the same time.
+// The returned buffer may be shared, and must not be modified.
+func (g *blockServerGetGroup) get(ctx context.Context, bserv BlockServer,
+	tlfID tlf.ID, id BlockID, bctx BlockContext) (
+	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	get := g.startOrJoin(ctx, bserv, blockServerGetKey{tlfID, id}, bctx)
+	select {
+	case <-get.doneCh:
+		return get.buf, get.serverHalf, get.err
+	case <-ctx.Done():
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, ctx.Err()
+	}
+}
+
 // realBlockGetter obtains real blocks using the APIs available in Config.
 type realBlockGetter struct {
 	config Config
+	gets   *blockServerGetGroup
 }
 
 // getBlock implements the interface for realBlockGetter.
 func (bg *realBlockGetter) getBlock(ctx context.Context, kmd KeyMetadata, blockPtr BlockPointer, block Block) error {
-	bserv := bg.config.BlockServer()
-	buf, blockServerHalf, err := bserv.Get(
-		ctx, kmd.TlfID(), blockPtr.ID, blockPtr.BlockContext)
+	buf, blockServerHalf, err := bg.gets.get(ctx, bg.config.BlockServer(),
+		kmd.TlfID(), blockPtr.ID, blockPtr.BlockContext)
 	if err != nil {
 		// Temporary code to track down bad block
 		// requests. Remove when not needed anymore.
@@ -54,18 +141,33 @@ func (bg *realBlockGetter) getBlock(ctx context.Context, kmd KeyMetadata, blockP
 		return err
 	}
 
-	var encryptedBlock EncryptedBlock
-	err = bg.config.Codec().Decode(buf, &encryptedBlock)
+	err = bg.decryptBlock(ctx, buf, blockCryptKey, block)
 	if err != nil {
 		return err
 	}
 
-	// decrypt the block
-	err = crypto.DecryptBlock(encryptedBlock, blockCryptKey, block)
+	block.SetEncodedSize(uint32(len(buf)))
+	return nil
+}
+
+// decryptBlock decodes buf, as returned by BlockServer.Get, and
+// decrypts it into block.
+func (bg *realBlockGetter) decryptBlock(ctx context.Context, buf []byte,
+	blockCryptKey kbfscrypto.BlockCryptKey, block Block) error {
+	// The encrypted data is only needed until the block is
+	// decrypted, so decode it into a pooled buffer; the codec
+	// reuses a byte slice's capacity when it's big enough.
+	encryptedDataBuf := getBlockBuffer(len(buf))
+	defer putBlockBuffer(encryptedDataBuf)
+	encryptedBlock := EncryptedBlock{EncryptedData: *encryptedDataBuf}
+	err := bg.config.Codec().Decode(buf, &encryptedBlock)
 	if err != nil {
-		return err
+		return BlockDecodeError{err}
 	}
 
-	block.SetEncodedSize(uint32(len(buf)))
-	return nil
+	finish := bg.config.Tracer().StartSpan(ctx, "Crypto.DecryptBlock")
+	err = bg.config.Crypto().DecryptBlock(
+		encryptedBlock, blockCryptKey, block)
+	finish(err)
+	return err
 }
@@ -0,0 +1,169 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// stallingGetBlockServer counts Get calls, and holds each one until
+// something is sent on releaseCh.
+type stallingGetBlockServer struct {
+	BlockServer
+	startedCh chan struct{}
+	releaseCh chan []byte
+
+	lock  sync.Mutex
+	calls int
+}
+
+func (b *stallingGetBlockServer) Get(ctx context.Context, tlfID tlf.ID,
+	id BlockID, context BlockContext) (
+	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	b.lock.Lock()
+	b.calls++
+	b.lock.Unlock()
+	b.startedCh <- struct{}{}
+	select {
+	case buf := <-b.releaseCh:
+		return buf, kbfscrypto.BlockCryptKeyServerHalf{}, nil
+	case <-ctx.Done():
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, ctx.Err()
+	}
+}
+
+func TestBlockServerGetGroupCoalesces(t *testing.T) {
+	bserv := &stallingGetBlockServer{
+		startedCh: make(chan struct{}, 1),
+		releaseCh: make(chan []byte),
+	}
+	g := newBlockServerGetGroup()
+	tlfID := tlf.FakeID(1, false)
+	id := fakeBlockID(1)
+	ctx := context.Background()
+
+	// Each get uses a different reference to the block.
+	const numGets = 5
+	var gets []*blockServerGet
+	for i := 0; i < numGets; i++ {
+		bctx := BlockContext{RefNonce: BlockRefNonce{byte(i)}}
+		gets = append(gets, g.startOrJoin(
+			ctx, bserv, blockServerGetKey{tlfID, id}, bctx))
+	}
+	<-bserv.startedCh
+	// A get of a different block isn't coalesced.
+	other := g.startOrJoin(ctx, bserv,
+		blockServerGetKey{tlfID, fakeBlockID(2)}, BlockContext{})
+	<-bserv.startedCh
+
+	bserv.releaseCh <- []byte{1, 2, 3}
+	bserv.releaseCh <- []byte{4}
+	for _, get := range gets {
+		require.Equal(t, gets[0], get)
+	}
+	<-gets[0].doneCh
+	<-other.doneCh
+	require.NoError(t, gets[0].err)
+	require.NoError(t, other.err)
+	bufs := [][]byte{gets[0].buf, other.buf}
+	require.Contains(t, bufs, []byte{1, 2, 3})
+	require.Contains(t, bufs, []byte{4})
+	require.Equal(t, 2, bserv.calls)
+	require.Len(t, g.gets, 0)
+}
+
+func TestBlockServerGetGroupCancel(t *testing.T) {
+	bserv := &stallingGetBlockServer{
+		startedCh: make(chan struct{}, 1),
+		releaseCh: make(chan []byte, 1),
+	}
+	g := newBlockServerGetGroup()
+	tlfID := tlf.FakeID(1, false)
+	id := fakeBlockID(1)
+
+	// The first caller gives up, but the second one still gets
+	// the block from the same request.
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	errCh1 := make(chan error, 1)
+	go func() {
+		_, _, err := g.get(ctx1, bserv, tlfID, id, BlockContext{})
+		errCh1 <- err
+	}()
+	<-bserv.startedCh
+
+	get := g.startOrJoin(
+		context.Background(), bserv, blockServerGetKey{tlfID, id},
+		BlockContext{})
+	cancel1()
+	require.Equal(t, context.Canceled, <-errCh1)
+	bserv.releaseCh <- []byte{1}
+	<-get.doneCh
+	require.NoError(t, get.err)
+	require.Equal(t, []byte{1}, get.buf)
+	require.Equal(t, 1, bserv.calls)
+
+	// Once everyone has given up, a new get starts a new request.
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	get = g.startOrJoin(ctx2, bserv, blockServerGetKey{tlfID, id},
+		BlockContext{})
+	<-bserv.startedCh
+	cancel2()
+	<-get.ctx.Done()
+	get2 := g.startOrJoin(context.Background(), bserv,
+		blockServerGetKey{tlfID, id}, BlockContext{})
+	require.NotEqual(t, get, get2)
+	<-bserv.startedCh
+	bserv.releaseCh <- []byte{2}
+	<-get2.doneCh
+	require.NoError(t, get2.err)
+	require.Equal(t, 3, bserv.calls)
+}
+
+// benchmarkDecryptBlock measures decoding and decrypting a block as
+// it comes back from the block server.
+func benchmarkDecryptBlock(b *testing.B, ver EncryptionVer, size int) {
+	codec := kbfscodec.NewMsgpack()
+	crypto := NewCryptoLocal(
+		codec, kbfscrypto.SigningKey{}, kbfscrypto.CryptPrivateKey{})
+	config := &ConfigLocal{codec: codec, crypto: crypto}
+	bg := &realBlockGetter{config: config}
+	cryptKey := makeFakeBlockCryptKey(b)
+	block := makeBenchmarkFileBlock(b, size)
+	_, encryptedBlock, err := crypto.EncryptBlock(block, cryptKey, ver)
+	require.NoError(b, err)
+	buf, err := codec.Encode(encryptedBlock)
+	require.NoError(b, err)
+	ctx := context.Background()
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var decryptedBlock FileBlock
+		err := bg.decryptBlock(ctx, buf, cryptKey, &decryptedBlock)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecryptBlockSecretbox64k(b *testing.B) {
+	benchmarkDecryptBlock(b, EncryptionSecretbox, 64*1024)
+}
+
+func BenchmarkDecryptBlockSecretbox512k(b *testing.B) {
+	benchmarkDecryptBlock(b, EncryptionSecretbox, 512*1024)
+}
+
+func BenchmarkDecryptBlockAESGCM512k(b *testing.B) {
+	benchmarkDecryptBlock(b, EncryptionAESGCM, 512*1024)
+}
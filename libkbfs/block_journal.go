@@ -5,8 +5,10 @@
 package libkbfs
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -27,6 +29,7 @@ import (
 // The directory layout looks like:
 //
 // dir/block_aggregate_info
+// dir/block_flush_progress
 // dir/block_journal/EARLIEST
 // dir/block_journal/LATEST
 // dir/block_journal/0...000
@@ -40,6 +43,13 @@ import (
 // block_aggregate_info holds aggregate info about the block journal;
 // currently it just holds the count of unflushed bytes.
 //
+// block_flush_progress, if present, holds the ordinals of the block
+// puts and reference additions at the start of the journal that the
+// server has already accepted, so that a flush that's interrupted
+// partway through a batch resumes where it left off.  It's an
+// append-only log, synced once per batch, and compaction never drops
+// the puts it lists.
+//
 // Each entry in the journal in dir/block_journal contains the
 // mutating operation and arguments for a single operation, except for
 // block data. (See diskJournal comments for more details about the
@@ -79,6 +89,9 @@ type blockJournal struct {
 	s *blockDiskStore
 
 	aggregateInfo aggregateInfo
+
+	// flushed holds the ordinals recorded in block_flush_progress.
+	flushed map[journalOrdinal]bool
 }
 
 type blockOpType int
@@ -121,6 +134,10 @@ type blockJournalEntry struct {
 	Revision MetadataRevision `codec:",omitempty"`
 	// Ignore this entry while flushing if this is true.
 	Ignore bool `codec:",omitempty"`
+	// Don't flush the contexts for these IDs, since their puts
+	// were compacted away. Only used for removeRefsOp and
+	// archiveRefsOp.
+	CompactedIDs map[BlockID]bool `codec:",omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
@@ -150,22 +167,40 @@ func (e blockJournalEntry) getSingleContext() (
 		"getSingleContext() erroneously called on op %s", e.Op)
 }
 
+// getContextsToFlush returns the contexts of this entry that still
+// need to be sent to the server, i.e. those not for compacted IDs.
+func (e blockJournalEntry) getContextsToFlush() map[BlockID][]BlockContext {
+	if len(e.CompactedIDs) == 0 {
+		return e.Contexts
+	}
+
+	contexts := make(map[BlockID][]BlockContext)
+	for id, idContexts := range e.Contexts {
+		if !e.CompactedIDs[id] {
+			contexts[id] = idContexts
+		}
+	}
+	return contexts
+}
+
 func savedBlockJournalDir(dir string) string {
 	return filepath.Join(dir, "saved_block_journal")
 }
 
 // makeBlockJournal returns a new blockJournal for the given
-// directory. Any existing journal entries are read.
+// directory. Any existing journal entries are read.  If storage is
+// non-nil, block data is sealed with it on disk.
 func makeBlockJournal(
 	ctx context.Context, codec kbfscodec.Codec, crypto cryptoPure,
-	dir string, log logger.Logger) (*blockJournal, error) {
+	dir string, storage *kbfscrypto.StorageKeyring, log logger.Logger) (
+	*blockJournal, error) {
 	journalPath := filepath.Join(dir, "block_journal")
 	deferLog := log.CloneWithAddedDepth(1)
 	j := makeDiskJournal(
 		codec, journalPath, reflect.TypeOf(blockJournalEntry{}))
 
 	storeDir := filepath.Join(dir, "blocks")
-	s := makeBlockDiskStore(codec, crypto, storeDir)
+	s := makeBlockDiskStore(codec, crypto, storeDir, storage)
 	journal := &blockJournal{
 		codec:    codec,
 		crypto:   crypto,
@@ -198,6 +233,24 @@ func makeBlockJournal(
 		return nil, err
 	}
 
+	// Get any progress from an interrupted flush, dropping any
+	// left over from entries that were already removed.
+	journal.flushed, err = readFlushProgress(dir)
+	if err != nil {
+		return nil, err
+	}
+	earliest, err := journal.j.readEarliestOrdinal()
+	switch {
+	case os.IsNotExist(err):
+		journal.flushed = nil
+		err = journal.writeFlushProgress()
+	case err == nil:
+		err = journal.pruneFlushProgress(earliest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	return journal, nil
 }
 
@@ -207,6 +260,10 @@ func makeBlockJournal(
 // encoder/decoder that supports unknown fields.
 type aggregateInfo struct {
 	UnflushedBytes int64
+	// UnflushedBlocks is the number of unflushed block puts.
+	// Journals written before it was added start out undercounting
+	// it, so it's clamped to zero.
+	UnflushedBlocks int64
 
 	codec.UnknownFieldSetHandler
 }
@@ -215,12 +272,139 @@ func aggregateInfoPath(dir string) string {
 	return filepath.Join(dir, "block_aggregate_info")
 }
 
-func (j *blockJournal) adjustUnflushedBytes(delta int64) error {
-	j.aggregateInfo.UnflushedBytes += delta
+func (j *blockJournal) adjustUnflushed(deltaBytes, deltaBlocks int64) error {
+	j.aggregateInfo.UnflushedBytes += deltaBytes
+	j.aggregateInfo.UnflushedBlocks += deltaBlocks
+	if j.aggregateInfo.UnflushedBlocks < 0 {
+		j.aggregateInfo.UnflushedBlocks = 0
+	}
 	return kbfscodec.SerializeToFile(
 		j.codec, j.aggregateInfo, aggregateInfoPath(j.dir))
 }
 
+// The functions below are for reading and writing flush progress.
+
+// block_flush_progress is a log of the ordinals of the put and
+// add-reference entries that have been flushed to the server, but
+// not yet removed from the journal, each written as 8 big-endian
+// bytes.  An ordinal is appended as soon as the server accepts its
+// entry, without an fsync; syncFlushProgress syncs the whole log
+// once per batch.  Losing the unsynced tail of the log in a crash
+// just means those entries get flushed again, which the server
+// handles idempotently, and a partially-written last record is
+// ignored.  (It can also let compaction drop a put the server
+// already has, which at worst leaves an unreferenced block behind
+// on the server.)
+
+const flushProgressRecordSize = 8
+
+func flushProgressPath(dir string) string {
+	return filepath.Join(dir, "block_flush_progress")
+}
+
+func readFlushProgress(dir string) (map[journalOrdinal]bool, error) {
+	buf, err := ioutil.ReadFile(flushProgressPath(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	flushed := make(map[journalOrdinal]bool)
+	for len(buf) >= flushProgressRecordSize {
+		ordinal := journalOrdinal(binary.BigEndian.Uint64(buf))
+		flushed[ordinal] = true
+		buf = buf[flushProgressRecordSize:]
+	}
+	return flushed, nil
+}
+
+// writeFlushProgress replaces the flush progress log with one holding
+// just the ordinals in j.flushed, or removes it if there are none.
+func (j *blockJournal) writeFlushProgress() error {
+	if len(j.flushed) == 0 {
+		err := os.Remove(flushProgressPath(j.dir))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	buf := make([]byte, 0, len(j.flushed)*flushProgressRecordSize)
+	var record [flushProgressRecordSize]byte
+	for ordinal := range j.flushed {
+		binary.BigEndian.PutUint64(record[:], uint64(ordinal))
+		buf = append(buf, record[:]...)
+	}
+	return writeFileAtomic(flushProgressPath(j.dir), buf, 0600)
+}
+
+// markFlushed records that the entry with the given ordinal has
+// been accepted by the server, so it won't be flushed again even if
+// the rest of its batch has to be retried.
+func (j *blockJournal) markFlushed(ordinal journalOrdinal) (err error) {
+	if j.flushed[ordinal] {
+		return nil
+	}
+	f, err := os.OpenFile(flushProgressPath(j.dir),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	var record [flushProgressRecordSize]byte
+	binary.BigEndian.PutUint64(record[:], uint64(ordinal))
+	_, err = f.Write(record[:])
+	if err != nil {
+		return err
+	}
+	if j.flushed == nil {
+		j.flushed = make(map[journalOrdinal]bool)
+	}
+	j.flushed[ordinal] = true
+	return nil
+}
+
+// syncFlushProgress makes the ordinals recorded by markFlushed
+// durable.
+func (j *blockJournal) syncFlushProgress() (err error) {
+	if len(j.flushed) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(flushProgressPath(j.dir), os.O_WRONLY, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return f.Sync()
+}
+
+// pruneFlushProgress forgets the flush progress of every entry
+// before end, which must all have been removed from the journal.
+// Ordinals start over once the journal empties, so stale progress
+// must not outlive its entries.
+func (j *blockJournal) pruneFlushProgress(end journalOrdinal) error {
+	pruned := false
+	for ordinal := range j.flushed {
+		if ordinal < end {
+			delete(j.flushed, ordinal)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return nil
+	}
+	return j.writeFlushProgress()
+}
+
 // The functions below are for reading and writing journal entries.
 
 func (j *blockJournal) readJournalEntry(ordinal journalOrdinal) (
@@ -288,6 +472,10 @@ func (j *blockJournal) getUnflushedBytes() int64 {
 	return j.aggregateInfo.UnflushedBytes
 }
 
+func (j *blockJournal) getUnflushedBlocks() int64 {
+	return j.aggregateInfo.UnflushedBlocks
+}
+
 func (j *blockJournal) putData(
 	ctx context.Context, id BlockID, context BlockContext, buf []byte,
 	serverHalf kbfscrypto.BlockCryptKeyServerHalf) (err error) {
@@ -313,7 +501,7 @@ func (j *blockJournal) putData(
 
 	// Decremented when the put journal entry is ignored or
 	// flushed.
-	err = j.adjustUnflushedBytes(int64(len(buf)))
+	err = j.adjustUnflushed(int64(len(buf)), 1)
 	if err != nil {
 		return err
 	}
@@ -463,6 +651,11 @@ type blockEntriesToFlush struct {
 	puts  *blockPutState
 	adds  *blockPutState
 	other []blockJournalEntry
+
+	// The journal ordinals of each entry in puts and adds,
+	// respectively.
+	putOrdinals []journalOrdinal
+	addOrdinals []journalOrdinal
 }
 
 func (be blockEntriesToFlush) length() int {
@@ -473,6 +666,25 @@ func (be blockEntriesToFlush) flushNeeded() bool {
 	return be.length() > 0
 }
 
+// setFlushedCallback makes each put and reference addition call the
+// given function with its journal ordinal once the server has
+// accepted it.
+func (be blockEntriesToFlush) setFlushedCallback(
+	flushed func(journalOrdinal) error) {
+	for i, ordinal := range be.putOrdinals {
+		ordinal := ordinal
+		be.puts.blockStates[i].syncedCb = func() error {
+			return flushed(ordinal)
+		}
+	}
+	for i, ordinal := range be.addOrdinals {
+		ordinal := ordinal
+		be.adds.blockStates[i].syncedCb = func() error {
+			return flushed(ordinal)
+		}
+	}
+}
+
 // Only entries with ordinals less than the given ordinal (assumed to
 // be <= latest ordinal + 1) are returned.  Also returns the maximum
 // MD revision that can be merged after the returned entries are
@@ -534,6 +746,13 @@ func (j *blockJournal) getNextEntriesToFlush(
 			continue
 		}
 
+		if j.flushed[ordinal] {
+			// Already flushed before an interruption; it
+			// just needs to be removed from the journal.
+			entries.all = append(entries.all, entry)
+			continue
+		}
+
 		var data []byte
 		var serverHalf kbfscrypto.BlockCryptKeyServerHalf
 
@@ -552,7 +771,8 @@ func (j *blockJournal) getNextEntriesToFlush(
 			entries.puts.addNewBlock(
 				BlockPointer{ID: id, BlockContext: bctx},
 				nil, /* only used by folderBranchOps */
-				ReadyBlockData{data, serverHalf}, nil)
+				ReadyBlockData{buf: data, serverHalf: serverHalf}, nil)
+			entries.putOrdinals = append(entries.putOrdinals, ordinal)
 
 		case addRefOp:
 			id, bctx, err := entry.getSingleContext()
@@ -564,6 +784,7 @@ func (j *blockJournal) getNextEntriesToFlush(
 				BlockPointer{ID: id, BlockContext: bctx},
 				nil, /* only used by folderBranchOps */
 				ReadyBlockData{}, nil)
+			entries.addOrdinals = append(entries.addOrdinals, ordinal)
 
 		case mdRevMarkerOp:
 			if entry.Revision < maxMDRevToFlush {
@@ -593,22 +814,29 @@ func flushNonBPSBlockJournalEntry(
 
 	switch entry.Op {
 	case removeRefsOp:
-		_, err := bserver.RemoveBlockReferences(
-			ctx, tlfID, entry.Contexts)
+		contexts := entry.getContextsToFlush()
+		if entry.Ignore || len(contexts) == 0 {
+			return nil
+		}
+		_, err := bserver.RemoveBlockReferences(ctx, tlfID, contexts)
 		if err != nil {
 			return err
 		}
 
 	case archiveRefsOp:
-		err := bserver.ArchiveBlockReferences(
-			ctx, tlfID, entry.Contexts)
+		contexts := entry.getContextsToFlush()
+		if entry.Ignore || len(contexts) == 0 {
+			return nil
+		}
+		err := bserver.ArchiveBlockReferences(ctx, tlfID, contexts)
 		if err != nil {
 			return err
 		}
 
-	case blockPutOp:
+	case blockPutOp, addRefOp:
 		if !entry.Ignore {
-			return errors.New("Trying to flush unignored blockPut as other")
+			return fmt.Errorf(
+				"Trying to flush unignored %s as other", entry.Op)
 		}
 		// Otherwise nothing to do.
 
@@ -635,7 +863,7 @@ func flushBlockEntries(ctx context.Context, log logger.Logger,
 	// reference the former.
 	log.CDebugf(ctx, "Putting %d blocks", len(entries.puts.blockStates))
 	blocksToRemove, err := doBlockPuts(ctx, bserver, bcache, reporter,
-		log, tlfID, tlfName, *entries.puts)
+		log, tlfID, tlfName, *entries.puts, maxParallelBlockPuts)
 	if err != nil {
 		if isRecoverableBlockError(err) {
 			log.CWarningf(ctx,
@@ -649,7 +877,7 @@ func flushBlockEntries(ctx context.Context, log logger.Logger,
 	log.CDebugf(ctx, "Adding %d block references",
 		len(entries.adds.blockStates))
 	blocksToRemove, err = doBlockPuts(ctx, bserver, bcache, reporter,
-		log, tlfID, tlfName, *entries.adds)
+		log, tlfID, tlfName, *entries.adds, maxParallelBlockPuts)
 	if err != nil {
 		if isRecoverableBlockError(err) {
 			log.CWarningf(ctx,
@@ -700,7 +928,7 @@ func (j *blockJournal) removeFlushedEntry(ctx context.Context,
 			return 0, err
 		}
 
-		err = j.adjustUnflushedBytes(-flushedBytes)
+		err = j.adjustUnflushed(-flushedBytes, -1)
 		if err != nil {
 			return 0, err
 		}
@@ -733,14 +961,25 @@ func (j *blockJournal) removeFlushedEntry(ctx context.Context,
 }
 
 func (j *blockJournal) removeFlushedEntries(ctx context.Context,
-	entries blockEntriesToFlush, tlfID tlf.ID, reporter Reporter) error {
+	entries blockEntriesToFlush, tlfID tlf.ID, reporter Reporter) (
+	err error) {
+	removed := entries.first
+	defer func() {
+		// Forget the progress of whatever got removed, once
+		// for the whole batch, even if not all of it did.
+		if pruneErr := j.pruneFlushProgress(removed); err == nil {
+			err = pruneErr
+		}
+	}()
+
 	// Remove them all!
 	for i, entry := range entries.all {
-		flushedBytes, err := j.removeFlushedEntry(
-			ctx, entries.first+journalOrdinal(i), entry)
+		ordinal := entries.first + journalOrdinal(i)
+		flushedBytes, err := j.removeFlushedEntry(ctx, ordinal, entry)
 		if err != nil {
 			return err
 		}
+		removed = ordinal + 1
 
 		reporter.NotifySyncStatus(ctx, &keybase1.FSPathSyncStatus{
 			PublicTopLevelFolder: tlfID.IsPublic(),
@@ -802,7 +1041,7 @@ func (j *blockJournal) ignoreBlocksAndMDRevMarkers(ctx context.Context,
 					return err
 				}
 
-				err = j.adjustUnflushedBytes(-ignoredBytes)
+				err = j.adjustUnflushed(-ignoredBytes, -1)
 				if err != nil {
 					return err
 				}
@@ -820,6 +1059,154 @@ func (j *blockJournal) ignoreBlocksAndMDRevMarkers(ctx context.Context,
 	return nil
 }
 
+// compact drops all unflushed work for blocks that were put in this
+// journal, but that have no live references left, e.g. the blocks of
+// a file that was rewritten many times while offline, whose
+// references have since been archived or removed.  The put and
+// addReference entries for such blocks are ignored, and their
+// contexts are skipped when flushing any archive or remove entries,
+// so the blocks are never uploaded only to be garbage-collected right
+// away.  The local block data is cleaned up as the ignored entries
+// are flushed.  Returns the number of bytes that no longer need to be
+// flushed.
+//
+// A block with only archived references can't be referenced again
+// (the server refuses that), so compacting it is safe even though the
+// MD revision that put it will still be flushed.  compact reads the
+// whole journal once, so it should be called at most once per flush.
+func (j *blockJournal) compact(ctx context.Context) (
+	compactedBytes int64, err error) {
+	first, err := j.j.readEarliestOrdinal()
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	last, err := j.j.readLatestOrdinal()
+	if err != nil {
+		return 0, err
+	}
+
+	// Find the blocks put in the journal, along with all the
+	// entries that refer to them.
+	puts := make(map[BlockID]bool)
+	var touchedOrdinals []journalOrdinal
+	touchedEntries := make(map[journalOrdinal]blockJournalEntry)
+	for i := first; i <= last; i++ {
+		e, err := j.readJournalEntry(i)
+		if err != nil {
+			return 0, err
+		}
+
+		if e.Ignore {
+			continue
+		}
+
+		touched := false
+		switch e.Op {
+		case blockPutOp:
+			// Puts that already made it to the server
+			// before an interrupted flush can't be dropped
+			// anymore.
+			if j.flushed[i] {
+				continue
+			}
+			id, _, err := e.getSingleContext()
+			if err != nil {
+				return 0, err
+			}
+			puts[id] = true
+			touched = true
+
+		case addRefOp, removeRefsOp, archiveRefsOp:
+			for id := range e.Contexts {
+				if puts[id] {
+					touched = true
+					break
+				}
+			}
+		}
+
+		if touched {
+			touchedOrdinals = append(touchedOrdinals, i)
+			touchedEntries[i] = e
+		}
+	}
+
+	compactedIDs := make(map[BlockID]bool)
+	for id := range puts {
+		hasRef, err := j.s.hasNonArchivedRef(id)
+		if err != nil {
+			return 0, err
+		}
+		if !hasRef {
+			compactedIDs[id] = true
+		}
+	}
+
+	if len(compactedIDs) == 0 {
+		return 0, nil
+	}
+
+	for _, i := range touchedOrdinals {
+		e := touchedEntries[i]
+		switch e.Op {
+		case blockPutOp, addRefOp:
+			id, _, err := e.getSingleContext()
+			if err != nil {
+				return 0, err
+			}
+
+			if !compactedIDs[id] {
+				continue
+			}
+
+			if e.Op == blockPutOp {
+				// Treat compacted put ops as flushed
+				// for the purposes of accounting.
+				size, err := j.s.getDataSize(id)
+				if err != nil {
+					return 0, err
+				}
+
+				err = j.adjustUnflushed(-size, -1)
+				if err != nil {
+					return 0, err
+				}
+				compactedBytes += size
+			}
+
+			e.Ignore = true
+
+		case removeRefsOp, archiveRefsOp:
+			changed := false
+			for id := range e.Contexts {
+				if !compactedIDs[id] || e.CompactedIDs[id] {
+					continue
+				}
+				if e.CompactedIDs == nil {
+					e.CompactedIDs = make(map[BlockID]bool)
+				}
+				e.CompactedIDs[id] = true
+				changed = true
+			}
+
+			if !changed {
+				continue
+			}
+		}
+
+		err = j.j.writeJournalEntry(i, e)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	j.log.CDebugf(ctx, "Compacted %d blocks (%d bytes) out of the journal",
+		len(compactedIDs), compactedBytes)
+	return compactedBytes, nil
+}
+
 func (j *blockJournal) saveBlocksUntilNextMDFlush() error {
 	if j.saveUntilMDFlush != nil {
 		return nil
@@ -48,6 +48,7 @@ func makeFakeBlockJournalEntryFuture(t *testing.T) blockJournalEntryFuture {
 			},
 			MetadataRevisionInitial,
 			false,
+			nil,
 			codec.UnknownFieldSetHandler{},
 		},
 		kbfscodec.MakeExtraOrBust("blockJournalEntry", t),
@@ -84,7 +85,7 @@ func setupBlockJournalTest(t *testing.T) (
 		}
 	}()
 
-	j, err = makeBlockJournal(ctx, codec, crypto, tempdir, log)
+	j, err = makeBlockJournal(ctx, codec, crypto, tempdir, nil, log)
 	require.NoError(t, err)
 	require.Equal(t, 0, getBlockJournalLength(t, j))
 
@@ -167,7 +168,7 @@ func TestBlockJournalBasic(t *testing.T) {
 	// Shutdown and restart.
 	err := j.checkInSyncForTest()
 	require.NoError(t, err)
-	j, err = makeBlockJournal(ctx, j.codec, j.crypto, tempdir, j.log)
+	j, err = makeBlockJournal(ctx, j.codec, j.crypto, tempdir, nil, j.log)
 	require.NoError(t, err)
 
 	require.Equal(t, 2, getBlockJournalLength(t, j))
@@ -698,7 +699,7 @@ func TestBlockJournalSaveUntilMDFlush(t *testing.T) {
 	{
 		// Make sure the saved block journal persists after a restart.
 		jRestarted, err := makeBlockJournal(
-			ctx, j.codec, j.crypto, j.dir, j.log)
+			ctx, j.codec, j.crypto, j.dir, nil, j.log)
 		require.NoError(t, err)
 		require.NotNil(t, jRestarted.saveUntilMDFlush)
 	}
@@ -853,3 +854,279 @@ func TestBlockJournalUnflushedBytesIgnore(t *testing.T) {
 
 	requireSize(len(data2))
 }
+
+func TestBlockJournalCompact(t *testing.T) {
+	ctx, tempdir, j := setupBlockJournalTest(t)
+	defer teardownBlockJournalTest(t, tempdir, j)
+
+	// Put a block, add and archive a reference to it, and then
+	// remove all its references before flushing.
+	data1 := []byte{1, 2, 3, 4}
+	bID1, bCtx1, _ := putBlockData(ctx, t, j, data1)
+	bCtx2 := addBlockRef(ctx, t, j, bID1)
+	err := j.archiveReferences(
+		ctx, map[BlockID][]BlockContext{
+			bID1: {bCtx2},
+		})
+	require.NoError(t, err)
+
+	// Put another block that stays referenced.
+	data2 := []byte{1, 2, 3, 4, 5}
+	bID2, bCtx3, serverHalf2 := putBlockData(ctx, t, j, data2)
+
+	liveCounts, err := j.removeReferences(
+		ctx, map[BlockID][]BlockContext{
+			bID1: {bCtx1, bCtx2},
+		})
+	require.NoError(t, err)
+	require.Equal(t, map[BlockID]int{bID1: 0}, liveCounts)
+
+	compactedBytes, err := j.compact(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data1)), compactedBytes)
+	require.Equal(t, int64(len(data2)), j.getUnflushedBytes())
+
+	// Compacting again should be a no-op.
+	compactedBytes, err = j.compact(ctx)
+	require.NoError(t, err)
+	require.Zero(t, compactedBytes)
+
+	err = j.checkInSyncForTest()
+	require.NoError(t, err)
+
+	blockServer := NewBlockServerMemory(newTestBlockServerLocalConfig(t))
+	tlfID := tlf.FakeID(1, false)
+	bcache := NewBlockCacheStandard(0, 0)
+	reporter := NewReporterSimple(nil, 0)
+
+	end, err := j.end()
+	require.NoError(t, err)
+	entries, _, err := j.getNextEntriesToFlush(ctx, end,
+		maxJournalBlockFlushBatchSize)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entries.puts.blockStates))
+	require.Equal(t, 0, len(entries.adds.blockStates))
+
+	err = flushBlockEntries(
+		ctx, j.log, blockServer, bcache, reporter,
+		tlfID, CanonicalTlfName("fake TLF"), entries)
+	require.NoError(t, err)
+
+	err = j.removeFlushedEntries(ctx, entries, tlfID, reporter)
+	require.NoError(t, err)
+	require.Zero(t, j.getUnflushedBytes())
+
+	// The compacted block should never have made it to the server.
+	_, _, err = blockServer.Get(ctx, tlfID, bID1, bCtx1)
+	require.IsType(t, BServerErrorBlockNonExistent{}, err)
+
+	buf, key, err := blockServer.Get(ctx, tlfID, bID2, bCtx3)
+	require.NoError(t, err)
+	require.Equal(t, data2, buf)
+	require.Equal(t, serverHalf2, key)
+
+	length, err := j.length()
+	require.NoError(t, err)
+	require.Zero(t, length)
+
+	testBlockJournalGCd(t, j)
+}
+
+func TestBlockJournalCompactArchived(t *testing.T) {
+	ctx, tempdir, j := setupBlockJournalTest(t)
+	defer teardownBlockJournalTest(t, tempdir, j)
+
+	// Put two blocks in one MD revision, and archive the reference
+	// to the second one in the next revision, as when a file is
+	// rewritten.
+	data1 := []byte{1, 2, 3, 4}
+	bID1, bCtx1, serverHalf1 := putBlockData(ctx, t, j, data1)
+	data2 := []byte{1, 2, 3, 4, 5}
+	bID2, bCtx2, _ := putBlockData(ctx, t, j, data2)
+	err := j.markMDRevision(ctx, MetadataRevisionInitial)
+	require.NoError(t, err)
+	err = j.archiveReferences(
+		ctx, map[BlockID][]BlockContext{
+			bID2: {bCtx2},
+		})
+	require.NoError(t, err)
+	err = j.markMDRevision(ctx, MetadataRevisionInitial+1)
+	require.NoError(t, err)
+
+	// Only the second block has no live references left.
+	compactedBytes, err := j.compact(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data2)), compactedBytes)
+	require.Equal(t, int64(len(data1)), j.getUnflushedBytes())
+
+	// A later MD revision references the first block again, and
+	// then archives its original reference.  The block is still
+	// referenced, so it must not be compacted.
+	bCtx3 := addBlockRef(ctx, t, j, bID1)
+	err = j.archiveReferences(
+		ctx, map[BlockID][]BlockContext{
+			bID1: {bCtx1},
+		})
+	require.NoError(t, err)
+	err = j.markMDRevision(ctx, MetadataRevisionInitial+2)
+	require.NoError(t, err)
+
+	compactedBytes, err = j.compact(ctx)
+	require.NoError(t, err)
+	require.Zero(t, compactedBytes)
+	require.Equal(t, int64(len(data1)), j.getUnflushedBytes())
+
+	err = j.checkInSyncForTest()
+	require.NoError(t, err)
+
+	blockServer := NewBlockServerMemory(newTestBlockServerLocalConfig(t))
+	tlfID := tlf.FakeID(1, false)
+	bcache := NewBlockCacheStandard(0, 0)
+	reporter := NewReporterSimple(nil, 0)
+
+	for getBlockJournalLength(t, j) > 0 {
+		flushBlockJournalOne(
+			ctx, t, j, blockServer, bcache, reporter, tlfID)
+	}
+	require.Zero(t, j.getUnflushedBytes())
+
+	buf, key, err := blockServer.Get(ctx, tlfID, bID1, bCtx3)
+	require.NoError(t, err)
+	require.Equal(t, data1, buf)
+	require.Equal(t, serverHalf1, key)
+
+	refs, err := blockServer.getAllRefsForTest(ctx, tlfID)
+	require.NoError(t, err)
+	require.Equal(t, map[BlockRefNonce]blockRefStatus{
+		bCtx1.GetRefNonce(): archivedBlockRef,
+		bCtx3.GetRefNonce(): liveBlockRef,
+	}, refs[bID1].getStatuses())
+
+	// The second block should never have made it to the server.
+	_, _, err = blockServer.Get(ctx, tlfID, bID2, bCtx2)
+	require.IsType(t, BServerErrorBlockNonExistent{}, err)
+
+	testBlockJournalGCd(t, j)
+}
+
+func TestBlockJournalFlushResume(t *testing.T) {
+	ctx, tempdir, j := setupBlockJournalTest(t)
+	defer teardownBlockJournalTest(t, tempdir, j)
+
+	data1 := []byte{1, 2, 3, 4}
+	bID1, bCtx1, serverHalf1 := putBlockData(ctx, t, j, data1)
+	data2 := []byte{1, 2, 3, 4, 5}
+	bID2, bCtx2, serverHalf2 := putBlockData(ctx, t, j, data2)
+
+	blockServer := NewBlockServerMemory(newTestBlockServerLocalConfig(t))
+	tlfID := tlf.FakeID(1, false)
+	bcache := NewBlockCacheStandard(0, 0)
+	reporter := NewReporterSimple(nil, 0)
+
+	// Pretend the first put made it to the server before the
+	// flush was interrupted.
+	err := blockServer.Put(ctx, tlfID, bID1, bCtx1, data1, serverHalf1)
+	require.NoError(t, err)
+	first, err := j.j.readEarliestOrdinal()
+	require.NoError(t, err)
+	err = j.markFlushed(first)
+	require.NoError(t, err)
+
+	// The progress should survive a restart.
+	j, err = makeBlockJournal(ctx, j.codec, j.crypto, tempdir, nil, j.log)
+	require.NoError(t, err)
+
+	end, err := j.end()
+	require.NoError(t, err)
+	entries, _, err := j.getNextEntriesToFlush(ctx, end,
+		maxJournalBlockFlushBatchSize)
+	require.NoError(t, err)
+	require.Equal(t, 2, entries.length())
+	require.Equal(t, []journalOrdinal{first + 1}, entries.putOrdinals)
+
+	var flushed []journalOrdinal
+	entries.setFlushedCallback(func(ordinal journalOrdinal) error {
+		flushed = append(flushed, ordinal)
+		return j.markFlushed(ordinal)
+	})
+	err = flushBlockEntries(
+		ctx, j.log, blockServer, bcache, reporter,
+		tlfID, CanonicalTlfName("fake TLF"), entries)
+	require.NoError(t, err)
+	require.Equal(t, []journalOrdinal{first + 1}, flushed)
+
+	err = j.removeFlushedEntries(ctx, entries, tlfID, reporter)
+	require.NoError(t, err)
+	require.Zero(t, j.getUnflushedBytes())
+
+	buf, key, err := blockServer.Get(ctx, tlfID, bID2, bCtx2)
+	require.NoError(t, err)
+	require.Equal(t, data2, buf)
+	require.Equal(t, serverHalf2, key)
+
+	// The progress file should be gone along with everything else.
+	testBlockJournalGCd(t, j)
+}
+
+func TestBlockJournalFlushProgressLog(t *testing.T) {
+	ctx, tempdir, j := setupBlockJournalTest(t)
+	defer teardownBlockJournalTest(t, tempdir, j)
+
+	putBlockData(ctx, t, j, []byte{1, 2, 3, 4})
+	putBlockData(ctx, t, j, []byte{1, 2, 3, 4, 5})
+	first, err := j.j.readEarliestOrdinal()
+	require.NoError(t, err)
+
+	// Each ordinal is appended to the log, once.
+	err = j.markFlushed(first)
+	require.NoError(t, err)
+	err = j.markFlushed(first + 1)
+	require.NoError(t, err)
+	err = j.markFlushed(first)
+	require.NoError(t, err)
+	err = j.syncFlushProgress()
+	require.NoError(t, err)
+	fi, err := os.Stat(flushProgressPath(tempdir))
+	require.NoError(t, err)
+	require.Equal(t, int64(2*flushProgressRecordSize), fi.Size())
+
+	// A record torn by a crash is ignored.
+	f, err := os.OpenFile(
+		flushProgressPath(tempdir), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0})
+	require.NoError(t, err)
+	err = f.Close()
+	require.NoError(t, err)
+
+	j, err = makeBlockJournal(ctx, j.codec, j.crypto, tempdir, nil, j.log)
+	require.NoError(t, err)
+	require.Equal(t, map[journalOrdinal]bool{first: true, first + 1: true},
+		j.flushed)
+
+	// Removing the flushed entries forgets their progress.
+	tlfID := tlf.FakeID(1, false)
+	reporter := NewReporterSimple(nil, 0)
+	end, err := j.end()
+	require.NoError(t, err)
+	entries, _, err := j.getNextEntriesToFlush(ctx, end,
+		maxJournalBlockFlushBatchSize)
+	require.NoError(t, err)
+	require.Equal(t, 2, entries.length())
+	err = j.removeFlushedEntries(ctx, entries, tlfID, reporter)
+	require.NoError(t, err)
+	require.Len(t, j.flushed, 0)
+	_, err = os.Stat(flushProgressPath(tempdir))
+	require.True(t, os.IsNotExist(err))
+
+	// Progress left over from removed entries, say by a crash
+	// before it was pruned, is dropped when the journal is loaded,
+	// since ordinals start over once the journal is empty.
+	err = j.markFlushed(first)
+	require.NoError(t, err)
+	j, err = makeBlockJournal(ctx, j.codec, j.crypto, tempdir, nil, j.log)
+	require.NoError(t, err)
+	require.Len(t, j.flushed, 0)
+	_, err = os.Stat(flushProgressPath(tempdir))
+	require.True(t, os.IsNotExist(err))
+}
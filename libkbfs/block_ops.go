@@ -26,9 +26,11 @@ func NewBlockOpsStandard(config Config, queueSize int) *BlockOpsStandard {
 		queue:   newBlockRetrievalQueue(queueSize, config.Codec()),
 		workers: make([]*blockRetrievalWorker, 0, queueSize),
 	}
-	bg := &realBlockGetter{config: config}
+	bg := &realBlockGetter{config: config, gets: newBlockServerGetGroup()}
 	for i := 0; i < queueSize; i++ {
-		bops.workers = append(bops.workers, newBlockRetrievalWorker(bg, bops.queue))
+		bops.workers = append(bops.workers, newBlockRetrievalWorker(
+			bg, bops.queue, config.BandwidthLimiter(),
+			config.Connectivity()))
 	}
 	return bops
 }
@@ -36,8 +38,11 @@ func NewBlockOpsStandard(config Config, queueSize int) *BlockOpsStandard {
 // Get implements the BlockOps interface for BlockOpsStandard.
 func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
 	blockPtr BlockPointer, block Block) error {
+	finish := b.config.Tracer().StartSpan(ctx, "BlockOps.Get")
 	errCh := b.queue.Request(ctx, defaultOnDemandRequestPriority, kmd, blockPtr, block)
-	return <-errCh
+	err := <-errCh
+	finish(err)
+	return err
 }
 
 // Ready implements the BlockOps interface for BlockOpsStandard.
@@ -71,7 +76,11 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 		return
 	}
 
-	plainSize, encryptedBlock, err := crypto.EncryptBlock(block, blockKey)
+	finish := b.config.Tracer().StartSpan(ctx, "Crypto.EncryptBlock")
+	ver := b.config.BlockEncryptionVersion()
+	plainSize, encryptedBlock, err := crypto.EncryptBlock(
+		block, blockKey, ver)
+	finish(err)
 	if err != nil {
 		return
 	}
@@ -82,8 +91,12 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 	}
 
 	readyBlockData = ReadyBlockData{
-		buf:        buf,
-		serverHalf: serverHalf,
+		buf:           buf,
+		serverHalf:    serverHalf,
+		encryptionVer: ver,
+	}
+	if dblock, ok := block.(*DirBlock); ok && dblock.IsInd {
+		readyBlockData.indirectDir = true
 	}
 
 	encodedSize := readyBlockData.GetEncodedSize()
@@ -0,0 +1,81 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/kbfs/tlf"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// BlockOpsMeasured delegates to another BlockOps instance but also
+// keeps track of stats.
+type BlockOpsMeasured struct {
+	delegate     BlockOps
+	getTimer     metrics.Timer
+	readyTimer   metrics.Timer
+	deleteTimer  metrics.Timer
+	archiveTimer metrics.Timer
+}
+
+var _ BlockOps = BlockOpsMeasured{}
+
+// NewBlockOpsMeasured creates and returns a new BlockOpsMeasured
+// instance with the given delegate and registry.
+func NewBlockOpsMeasured(delegate BlockOps, r metrics.Registry) BlockOpsMeasured {
+	getTimer := metrics.GetOrRegisterTimer("BlockOps.Get", r)
+	readyTimer := metrics.GetOrRegisterTimer("BlockOps.Ready", r)
+	deleteTimer := metrics.GetOrRegisterTimer("BlockOps.Delete", r)
+	archiveTimer := metrics.GetOrRegisterTimer("BlockOps.Archive", r)
+	return BlockOpsMeasured{
+		delegate:     delegate,
+		getTimer:     getTimer,
+		readyTimer:   readyTimer,
+		deleteTimer:  deleteTimer,
+		archiveTimer: archiveTimer,
+	}
+}
+
+// Get implements the BlockOps interface for BlockOpsMeasured.
+func (b BlockOpsMeasured) Get(ctx context.Context, kmd KeyMetadata,
+	blockPtr BlockPointer, block Block) (err error) {
+	b.getTimer.Time(func() {
+		err = b.delegate.Get(ctx, kmd, blockPtr, block)
+	})
+	return err
+}
+
+// Ready implements the BlockOps interface for BlockOpsMeasured.
+func (b BlockOpsMeasured) Ready(ctx context.Context, kmd KeyMetadata,
+	block Block) (id BlockID, plainSize int, readyBlockData ReadyBlockData,
+	err error) {
+	b.readyTimer.Time(func() {
+		id, plainSize, readyBlockData, err = b.delegate.Ready(ctx, kmd, block)
+	})
+	return id, plainSize, readyBlockData, err
+}
+
+// Delete implements the BlockOps interface for BlockOpsMeasured.
+func (b BlockOpsMeasured) Delete(ctx context.Context, tlfID tlf.ID,
+	ptrs []BlockPointer) (liveCounts map[BlockID]int, err error) {
+	b.deleteTimer.Time(func() {
+		liveCounts, err = b.delegate.Delete(ctx, tlfID, ptrs)
+	})
+	return liveCounts, err
+}
+
+// Archive implements the BlockOps interface for BlockOpsMeasured.
+func (b BlockOpsMeasured) Archive(ctx context.Context, tlfID tlf.ID,
+	ptrs []BlockPointer) (err error) {
+	b.archiveTimer.Time(func() {
+		err = b.delegate.Archive(ctx, tlfID, ptrs)
+	})
+	return err
+}
+
+// Shutdown implements the BlockOps interface for BlockOpsMeasured.
+func (b BlockOpsMeasured) Shutdown() {
+	b.delegate.Shutdown()
+}
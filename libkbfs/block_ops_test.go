@@ -117,7 +117,7 @@ func expectBlockEncrypt(config *ConfigMock, kmd KeyMetadata, decData Block, plai
 		EncryptedData: encData,
 	}
 	config.mockCrypto.EXPECT().EncryptBlock(decData,
-		kbfscrypto.BlockCryptKey{}).
+		kbfscrypto.BlockCryptKey{}, EncryptionSecretbox).
 		Return(plainSize, encryptedBlock, err)
 	if err == nil {
 		config.mockCodec.EXPECT().Encode(encryptedBlock).Return(encData, nil)
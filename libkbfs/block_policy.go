@@ -0,0 +1,125 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"github.com/keybase/go-codec/codec"
+)
+
+// CompressionType identifies how the contents of file blocks are
+// compressed before being encrypted.
+type CompressionType int
+
+const (
+	// CompressionNone means block contents aren't compressed.
+	// Every client supports it.
+	CompressionNone CompressionType = 0
+)
+
+func (t CompressionType) String() string {
+	switch t {
+	case CompressionNone:
+		return "none"
+	default:
+		return fmt.Sprintf("CompressionType(%d)", t)
+	}
+}
+
+// ChunkingType identifies how file data is split into blocks.
+type ChunkingType int
+
+const (
+	// ChunkingFixedSize means file data is split into blocks of a
+	// fixed maximum size, as by BlockSplitterSimple.  Every client
+	// supports it.
+	ChunkingFixedSize ChunkingType = 0
+)
+
+func (t ChunkingType) String() string {
+	switch t {
+	case ChunkingFixedSize:
+		return "fixed"
+	default:
+		return fmt.Sprintf("ChunkingType(%d)", t)
+	}
+}
+
+// BlockPolicy describes how the writers of a TLF should encode new
+// file data.  It's stored in the TLF's private metadata, so that all
+// writers apply the same settings; the zero value is the baseline
+// policy that every client supports.
+//
+// Negotiation: clients may differ in which compression and chunking
+// types they support.  A writer applies each part of the TLF's policy
+// that it supports, and falls back to the baseline for any part that
+// it doesn't, since every client can read data written with the
+// baseline.  A writer may only set a policy that it fully supports
+// itself (see KBFSOps.SetBlockPolicy).
+type BlockPolicy struct {
+	Compression CompressionType `codec:"c,omitempty"`
+	Chunking    ChunkingType    `codec:"k,omitempty"`
+
+	codec.UnknownFieldSetHandler
+}
+
+func (p BlockPolicy) String() string {
+	return fmt.Sprintf("{compression=%s chunking=%s}",
+		p.Compression, p.Chunking)
+}
+
+// equals returns true if the two policies have the same known
+// settings.
+func (p BlockPolicy) equals(other BlockPolicy) bool {
+	return p.Compression == other.Compression && p.Chunking == other.Chunking
+}
+
+// supportedCompressionTypes and supportedChunkingTypes list the
+// policy settings this client knows how to write.
+var supportedCompressionTypes = map[CompressionType]bool{
+	CompressionNone: true,
+}
+
+var supportedChunkingTypes = map[ChunkingType]bool{
+	ChunkingFixedSize: true,
+}
+
+// checkSupported returns an UnsupportedBlockPolicyError if this
+// client can't apply every part of the policy.
+func (p BlockPolicy) checkSupported() error {
+	if !supportedCompressionTypes[p.Compression] ||
+		!supportedChunkingTypes[p.Chunking] {
+		return UnsupportedBlockPolicyError{p}
+	}
+	return nil
+}
+
+// effective returns the policy this client should actually apply to
+// new writes, according to the negotiation rule described for
+// BlockPolicy.
+func (p BlockPolicy) effective() BlockPolicy {
+	var e BlockPolicy
+	if supportedCompressionTypes[p.Compression] {
+		e.Compression = p.Compression
+	}
+	if supportedChunkingTypes[p.Chunking] {
+		e.Chunking = p.Chunking
+	}
+	return e
+}
+
+// UnsupportedBlockPolicyError indicates that the user tried to set a
+// block policy that this client doesn't support.
+type UnsupportedBlockPolicyError struct {
+	Policy BlockPolicy
+}
+
+// Error implements the error interface for
+// UnsupportedBlockPolicyError.
+func (e UnsupportedBlockPolicyError) Error() string {
+	return fmt.Sprintf("Block policy %s is not supported by this client",
+		e.Policy)
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockPolicyNegotiation(t *testing.T) {
+	var baseline BlockPolicy
+	require.NoError(t, baseline.checkSupported())
+	require.True(t, baseline.effective().equals(baseline))
+
+	// A policy from a newer client falls back to the baseline for
+	// the parts this client doesn't support.
+	unknown := BlockPolicy{
+		Compression: CompressionType(100),
+		Chunking:    ChunkingFixedSize,
+	}
+	require.Equal(t, UnsupportedBlockPolicyError{unknown},
+		unknown.checkSupported())
+	require.True(t, unknown.effective().equals(baseline))
+}
+
+func TestKBFSOpsSetBlockPolicy(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	kbfsOps := config.KBFSOps()
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	fb := rootNode.GetFolderBranch()
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	rev := status.Revision
+	require.True(t, status.BlockPolicy.equals(BlockPolicy{}))
+
+	unknown := BlockPolicy{Compression: CompressionType(100)}
+	err = kbfsOps.SetBlockPolicy(ctx, fb, unknown)
+	require.Equal(t, UnsupportedBlockPolicyError{unknown}, err)
+
+	// Setting the existing policy doesn't write a new revision.
+	err = kbfsOps.SetBlockPolicy(ctx, fb, BlockPolicy{})
+	require.NoError(t, err)
+	status, _, err = kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, rev, status.Revision)
+}
+
+func TestRootMetadataBlockPolicy(t *testing.T) {
+	var md RootMetadata
+	require.True(t, md.BlockPolicy().equals(BlockPolicy{}))
+
+	policy := BlockPolicy{Chunking: ChunkingType(100)}
+	md.SetBlockPolicy(policy)
+	require.True(t, md.BlockPolicy().equals(policy))
+
+	// The baseline policy isn't stored explicitly.
+	md.SetBlockPolicy(BlockPolicy{})
+	require.Nil(t, md.data.BlockPolicy)
+}
@@ -123,3 +123,22 @@ func (refs blockRefMap) deepCopy() blockRefMap {
 	}
 	return refsCopy
 }
+
+// splitRefsByStatus returns the nonces of the live and archived
+// references in the given per-block reference maps.
+func splitRefsByStatus(refs map[BlockID]blockRefMap) (
+	live, archived map[BlockID][]BlockRefNonce) {
+	live = make(map[BlockID][]BlockRefNonce)
+	archived = make(map[BlockID][]BlockRefNonce)
+	for id, idRefs := range refs {
+		for nonce, refEntry := range idRefs {
+			switch refEntry.Status {
+			case liveBlockRef:
+				live[id] = append(live[id], nonce)
+			case archivedBlockRef:
+				archived[id] = append(archived[id], nonce)
+			}
+		}
+	}
+	return live, archived
+}
@@ -0,0 +1,245 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// expectedBlockRefs replays the block changes in the given merged MD
+// revisions (which must be readable, and ordered oldest first), and
+// returns the set of block pointers the block server should have
+// live and archived references for, the total number of live bytes,
+// and the latest revision covered by a GC op.
+func expectedBlockRefs(rmds []ImmutableRootMetadata) (
+	live, archived map[BlockPointer]bool, liveBytes uint64,
+	gcRevision MetadataRevision) {
+	live = make(map[BlockPointer]bool)
+	archived = make(map[BlockPointer]bool)
+
+	// See what the last GC op revision is.  All unref'd pointers from
+	// that revision or earlier should be deleted from the block
+	// server.
+	gcRevision = MetadataRevisionUninitialized
+	for _, rmd := range rmds {
+		// Don't process copies.
+		if rmd.IsWriterMetadataCopiedSet() {
+			continue
+		}
+
+		for _, op := range rmd.data.Changes.Ops {
+			GCOp, ok := op.(*GCOp)
+			if !ok {
+				continue
+			}
+			gcRevision = GCOp.LatestRev
+		}
+	}
+
+	for _, rmd := range rmds {
+		// Don't process copies.
+		if rmd.IsWriterMetadataCopiedSet() {
+			continue
+		}
+
+		for _, op := range rmd.data.Changes.Ops {
+			_, isGCOp := op.(*GCOp)
+
+			opRefs := make(map[BlockPointer]bool)
+			for _, ptr := range op.Refs() {
+				if ptr != zeroPtr {
+					live[ptr] = true
+					opRefs[ptr] = true
+				}
+			}
+			if !isGCOp {
+				for _, ptr := range op.Unrefs() {
+					delete(live, ptr)
+					if ptr != zeroPtr {
+						// If the revision has been garbage-collected,
+						// or if the pointer has been referenced and
+						// unreferenced within the same op (which
+						// indicates a failed and retried sync), the
+						// corresponding block should already be
+						// cleaned up.
+						if rmd.Revision() <= gcRevision || opRefs[ptr] {
+							delete(archived, ptr)
+						} else {
+							archived[ptr] = true
+						}
+					}
+				}
+			}
+			for _, update := range op.allUpdates() {
+				delete(live, update.Unref)
+				if update.Unref != zeroPtr && update.Ref != update.Unref {
+					if rmd.Revision() <= gcRevision {
+						delete(archived, update.Unref)
+					} else {
+						archived[update.Unref] = true
+					}
+				}
+				if update.Ref != zeroPtr {
+					live[update.Ref] = true
+				}
+			}
+		}
+		liveBytes += rmd.RefBytes()
+		liveBytes -= rmd.UnrefBytes()
+	}
+	return live, archived, liveBytes, gcRevision
+}
+
+// BlockRefID identifies a single block reference on the block
+// server.
+type BlockRefID struct {
+	ID       BlockID
+	RefNonce BlockRefNonce
+}
+
+// BlockRefVerification is the result of cross-checking the block
+// references held by the block server for a TLF against those implied
+// by the TLF's merged MD chain.  It is suitable for encoding directly
+// as JSON.
+type BlockRefVerification struct {
+	// Revision is the merged MD revision the check was done
+	// against.
+	Revision MetadataRevision
+
+	ExpectedLive     int
+	ExpectedArchived int
+	ActualLive       int
+	ActualArchived   int
+
+	// Orphaned references are held by the block server but not
+	// accounted for by the MD chain, and so leak quota.
+	Orphaned []BlockRefID `json:",omitempty"`
+	// Missing references are implied by the MD chain but unknown
+	// to the block server, which indicates data loss.
+	Missing []BlockRefID `json:",omitempty"`
+	// WronglyArchived references are live in the MD chain, but
+	// archived on the block server.
+	WronglyArchived []BlockRefID `json:",omitempty"`
+	// WronglyLive references are archived in the MD chain, but
+	// still live on the block server.
+	WronglyLive []BlockRefID `json:",omitempty"`
+}
+
+// IsConsistent returns true if no problems were found.
+func (v BlockRefVerification) IsConsistent() bool {
+	return len(v.Orphaned) == 0 && len(v.Missing) == 0 &&
+		len(v.WronglyArchived) == 0 && len(v.WronglyLive) == 0
+}
+
+func blockRefIDSet(
+	refs map[BlockID][]BlockRefNonce) map[BlockRefID]bool {
+	set := make(map[BlockRefID]bool)
+	for id, nonces := range refs {
+		for _, nonce := range nonces {
+			set[BlockRefID{id, nonce}] = true
+		}
+	}
+	return set
+}
+
+func blockRefIDSetFromPtrs(ptrs map[BlockPointer]bool) map[BlockRefID]bool {
+	set := make(map[BlockRefID]bool, len(ptrs))
+	for ptr := range ptrs {
+		set[BlockRefID{ptr.ID, ptr.GetRefNonce()}] = true
+	}
+	return set
+}
+
+// getBlockServerLocal returns the local block server behind the given
+// one, looking through journaling and metrics wrappers.
+func getBlockServerLocal(bserver BlockServer) (blockServerLocal, bool) {
+	for {
+		switch b := bserver.(type) {
+		case blockServerLocal:
+			return b, true
+		case journalBlockServer:
+			bserver = b.BlockServer
+		case BlockServerMeasured:
+			bserver = b.delegate
+		default:
+			return nil, false
+		}
+	}
+}
+
+// VerifyBlockRefs fetches the entire merged MD history of the given
+// TLF, computes the set of block references it implies, and compares
+// that with the references the block server holds.  Like
+// StateChecker, it holds all the state in memory, so it's meant for
+// occasional operator use.
+//
+// It only works against local block servers, since the remote one
+// can't enumerate the references of a TLF; for any other block
+// server, it returns BServerErrorUnsupported.  Unflushed journal
+// entries aren't taken into account, so the journal for the TLF
+// should be flushed first.
+func VerifyBlockRefs(ctx context.Context, config Config, tlfID tlf.ID) (
+	BlockRefVerification, error) {
+	bserverLocal, ok := getBlockServerLocal(config.BlockServer())
+	if !ok {
+		return BlockRefVerification{},
+			BServerErrorUnsupported{"block reference verification"}
+	}
+
+	rmds, err := getMergedMDUpdates(
+		ctx, config, tlfID, MetadataRevisionInitial)
+	if err != nil {
+		return BlockRefVerification{}, err
+	}
+
+	var v BlockRefVerification
+	var expectedLive, expectedArchived map[BlockRefID]bool
+	if len(rmds) > 0 {
+		v.Revision = rmds[len(rmds)-1].Revision()
+		livePtrs, archivedPtrs, _, _ := expectedBlockRefs(rmds)
+		expectedLive = blockRefIDSetFromPtrs(livePtrs)
+		expectedArchived = blockRefIDSetFromPtrs(archivedPtrs)
+	}
+
+	liveRefs, archivedRefs, err := bserverLocal.getAllRefs(ctx, tlfID)
+	if err != nil {
+		return BlockRefVerification{}, err
+	}
+	actualLive := blockRefIDSet(liveRefs)
+	actualArchived := blockRefIDSet(archivedRefs)
+
+	v.ExpectedLive = len(expectedLive)
+	v.ExpectedArchived = len(expectedArchived)
+	v.ActualLive = len(actualLive)
+	v.ActualArchived = len(actualArchived)
+
+	for ref := range expectedLive {
+		switch {
+		case actualLive[ref]:
+		case actualArchived[ref]:
+			v.WronglyArchived = append(v.WronglyArchived, ref)
+		default:
+			v.Missing = append(v.Missing, ref)
+		}
+	}
+	for ref := range expectedArchived {
+		switch {
+		case actualArchived[ref]:
+		case actualLive[ref]:
+			v.WronglyLive = append(v.WronglyLive, ref)
+		default:
+			v.Missing = append(v.Missing, ref)
+		}
+	}
+	for _, actual := range []map[BlockRefID]bool{actualLive, actualArchived} {
+		for ref := range actual {
+			if !expectedLive[ref] && !expectedArchived[ref] {
+				v.Orphaned = append(v.Orphaned, ref)
+			}
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/tlf"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestVerifyBlockRefs(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, uid, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	// The orphaned reference added below would fail the state
+	// check on shutdown.
+	defer kbfsTestShutdownNoMocksNoCheck(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncFromServerForTesting(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	tlfID := rootNode.GetFolderBranch().Tlf
+	v, err := VerifyBlockRefs(ctx, config, tlfID)
+	require.NoError(t, err)
+	require.True(t, v.IsConsistent(), "%+v", v)
+	require.NotZero(t, v.ExpectedLive)
+	require.Equal(t, v.ExpectedLive, v.ActualLive)
+	require.Equal(t, v.ExpectedArchived, v.ActualArchived)
+
+	// Add an extra reference to the root block that no MD
+	// accounts for.
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	rootPtr := ops.nodeCache.PathFromNode(rootNode).tailPointer()
+	nonce, err := config.Crypto().MakeBlockRefNonce()
+	require.NoError(t, err)
+	orphanContext := BlockContext{
+		Creator:  rootPtr.GetCreator(),
+		Writer:   uid,
+		RefNonce: nonce,
+	}
+	err = config.BlockServer().AddBlockReference(
+		ctx, tlfID, rootPtr.ID, orphanContext)
+	require.NoError(t, err)
+
+	v, err = VerifyBlockRefs(ctx, config, tlfID)
+	require.NoError(t, err)
+	require.False(t, v.IsConsistent())
+	require.Equal(t, []BlockRefID{{rootPtr.ID, nonce}}, v.Orphaned)
+	require.Len(t, v.Missing, 0)
+}
+
+func TestGetBlockServerLocal(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	bserver := config.BlockServer()
+	bserverLocal, ok := getBlockServerLocal(bserver)
+	require.True(t, ok)
+	require.Equal(t, bserver, bserverLocal)
+
+	measured := NewBlockServerMeasured(bserver, metrics.NewRegistry())
+	bserverLocal, ok = getBlockServerLocal(measured)
+	require.True(t, ok)
+	require.Equal(t, bserver, bserverLocal)
+
+	_, ok = getBlockServerLocal(&BlockServerRemote{})
+	require.False(t, ok)
+	_, err := VerifyBlockRefs(context.Background(),
+		&ConfigLocal{bserv: &BlockServerRemote{}}, tlf.FakeID(1, false))
+	require.IsType(t, BServerErrorUnsupported{}, err)
+}
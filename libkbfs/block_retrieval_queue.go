@@ -115,6 +115,33 @@ func (brq *blockRetrievalQueue) notifyWorker() {
 	}()
 }
 
+// BlockRetrievalQueueStatus counts the block retrievals that are
+// waiting for a worker, and the ones in progress.  It is suitable
+// for encoding directly as JSON.
+type BlockRetrievalQueueStatus struct {
+	// Queued is the number of retrievals waiting for a worker,
+	// QueuedPrefetches of which have less than on-demand priority.
+	Queued           int
+	QueuedPrefetches int
+	InProgress       int
+}
+
+// status returns the current state of the queue.
+func (brq *blockRetrievalQueue) status() BlockRetrievalQueueStatus {
+	brq.mtx.RLock()
+	defer brq.mtx.RUnlock()
+	status := BlockRetrievalQueueStatus{
+		Queued:     brq.heap.Len(),
+		InProgress: len(brq.ptrs) - brq.heap.Len(),
+	}
+	for _, retrieval := range *brq.heap {
+		if retrieval.priority < defaultOnDemandRequestPriority {
+			status.QueuedPrefetches++
+		}
+	}
+	return status
+}
+
 // Request submits a block request to the queue.
 func (brq *blockRetrievalQueue) Request(ctx context.Context, priority int, kmd KeyMetadata, ptr BlockPointer, block Block) <-chan error {
 	// Only continue if we haven't been shut down
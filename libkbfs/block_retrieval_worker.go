@@ -6,6 +6,8 @@ package libkbfs
 
 import (
 	"io"
+
+	"golang.org/x/net/context"
 )
 
 // blockRetrievalWorker processes blockRetrievalQueue requests
@@ -13,6 +15,12 @@ type blockRetrievalWorker struct {
 	blockGetter
 	stopCh chan struct{}
 	queue  *blockRetrievalQueue
+	// limiter, if non-nil, throttles retrievals with less than
+	// on-demand priority, i.e. prefetches.
+	limiter BandwidthLimiter
+	// connectivity, if non-nil, decides whether prefetches may go
+	// to the server at all.
+	connectivity ConnectivityTracker
 }
 
 // run runs the worker loop until Shutdown is called
@@ -29,12 +37,17 @@ func (brw *blockRetrievalWorker) run() {
 
 // newBlockRetrievalWorker returns a blockRetrievalWorker for a given
 // blockRetrievalQueue, using the passed in blockGetter to obtain blocks for
-// requests.
-func newBlockRetrievalWorker(bg blockGetter, q *blockRetrievalQueue) *blockRetrievalWorker {
+// requests, and the passed in BandwidthLimiter and ConnectivityTracker
+// (either of which may be nil) to throttle or drop prefetches.
+func newBlockRetrievalWorker(bg blockGetter, q *blockRetrievalQueue,
+	limiter BandwidthLimiter,
+	connectivity ConnectivityTracker) *blockRetrievalWorker {
 	brw := &blockRetrievalWorker{
-		blockGetter: bg,
-		stopCh:      make(chan struct{}),
-		queue:       q,
+		blockGetter:  bg,
+		stopCh:       make(chan struct{}),
+		queue:        q,
+		limiter:      limiter,
+		connectivity: connectivity,
 	}
 	go brw.run()
 	return brw
@@ -77,7 +90,34 @@ func (brw *blockRetrievalWorker) HandleRequest() (err error) {
 	default:
 	}
 
-	return brw.getBlock(retrieval.ctx, retrieval.kmd, retrieval.blockPtr, block)
+	brw.queue.mtx.RLock()
+	isPrefetch := retrieval.priority < defaultOnDemandRequestPriority
+	brw.queue.mtx.RUnlock()
+	if isPrefetch && brw.connectivity != nil {
+		if state := brw.connectivity.State(); !state.Policy().Prefetch {
+			return PrefetchDisabledError{state}
+		}
+	}
+	if isPrefetch && brw.limiter != nil {
+		// Wait for download headroom before prefetching, and
+		// charge for the block once its size is known.
+		err = brw.limiter.WaitN(retrieval.ctx, BandwidthDownload, 0)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err == nil {
+				brw.limiter.Charge(
+					BandwidthDownload, int64(block.GetEncodedSize()))
+			}
+		}()
+	}
+
+	var ctx context.Context = retrieval.ctx
+	if isPrefetch {
+		ctx = WithBlockPriority(ctx, BlockPriorityPrefetch)
+	}
+	return brw.getBlock(ctx, retrieval.kmd, retrieval.blockPtr, block)
 }
 
 // Shutdown shuts down the blockRetrievalWorker once its current work is done.
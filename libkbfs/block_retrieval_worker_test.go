@@ -86,7 +86,7 @@ func TestBlockRetrievalWorkerBasic(t *testing.T) {
 	defer q.Shutdown()
 
 	bg := newFakeBlockGetter()
-	w := newBlockRetrievalWorker(bg, q)
+	w := newBlockRetrievalWorker(bg, q, nil, nil)
 	require.NotNil(t, w)
 	defer w.Shutdown()
 
@@ -109,10 +109,10 @@ func TestBlockRetrievalWorkerMultipleWorkers(t *testing.T) {
 	defer q.Shutdown()
 
 	bg := newFakeBlockGetter()
-	w1 := newBlockRetrievalWorker(bg, q)
+	w1 := newBlockRetrievalWorker(bg, q, nil, nil)
 	require.NotNil(t, w1)
 	defer w1.Shutdown()
-	w2 := newBlockRetrievalWorker(bg, q)
+	w2 := newBlockRetrievalWorker(bg, q, nil, nil)
 	require.NotNil(t, w2)
 	defer w2.Shutdown()
 
@@ -153,7 +153,7 @@ func TestBlockRetrievalWorkerWithQueue(t *testing.T) {
 	defer q.Shutdown()
 
 	bg := newFakeBlockGetter()
-	w1 := newBlockRetrievalWorker(bg, q)
+	w1 := newBlockRetrievalWorker(bg, q, nil, nil)
 	require.NotNil(t, w1)
 	defer w1.Shutdown()
 
@@ -204,7 +204,7 @@ func TestBlockRetrievalWorkerCancel(t *testing.T) {
 	defer q.Shutdown()
 
 	bg := newFakeBlockGetter()
-	w := newBlockRetrievalWorker(bg, q)
+	w := newBlockRetrievalWorker(bg, q, nil, nil)
 	require.NotNil(t, w)
 	defer w.Shutdown()
 
@@ -227,7 +227,7 @@ func TestBlockRetrievalWorkerShutdown(t *testing.T) {
 	defer q.Shutdown()
 
 	bg := newFakeBlockGetter()
-	w := newBlockRetrievalWorker(bg, q)
+	w := newBlockRetrievalWorker(bg, q, nil, nil)
 	require.NotNil(t, w)
 
 	ptr1 := makeFakeBlockPointer(t)
@@ -251,3 +251,34 @@ func TestBlockRetrievalWorkerShutdown(t *testing.T) {
 	w.Shutdown()
 	require.True(t, shutdown)
 }
+
+func TestBlockRetrievalWorkerPrefetchOffline(t *testing.T) {
+	t.Log("Test that prefetches are dropped while offline.")
+	q := newBlockRetrievalQueue(1, kbfscodec.NewMsgpack())
+	require.NotNil(t, q)
+	defer q.Shutdown()
+
+	ct := NewConnectivityTrackerStandard(wallClock{})
+	ct.SetNetworkHint(false)
+	bg := newFakeBlockGetter()
+	w := newBlockRetrievalWorker(bg, q, nil, ct)
+	require.NotNil(t, w)
+	defer w.Shutdown()
+
+	ptr1 := makeFakeBlockPointer(t)
+	block1 := makeFakeFileBlock(t)
+	ch1 := bg.setBlockToReturn(ptr1, block1)
+
+	block := &FileBlock{}
+	ch := q.Request(context.Background(), 1, nil, ptr1, block)
+	err := <-ch
+	require.Equal(t, PrefetchDisabledError{ConnectivityOffline}, err)
+
+	// On-demand requests still go through.
+	ch = q.Request(context.Background(), defaultOnDemandRequestPriority,
+		nil, ptr1, block)
+	ch1 <- struct{}{}
+	err = <-ch
+	require.NoError(t, err)
+	require.Equal(t, block1, block)
+}
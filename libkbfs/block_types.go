@@ -89,6 +89,16 @@ type DirBlock struct {
 	Children map[string]DirEntry `codec:"c,omitempty"`
 	// if indirect, contains the indirect pointers to the next level of blocks
 	IPtrs []IndirectDirPtr `codec:"i,omitempty"`
+
+	// assembled is set for an indirect block that has been put
+	// together in memory from its leaf blocks (see
+	// assembleDirBlock).  Then Children holds the entries of all
+	// the leaves, IPtrs points directly to the leaves, and
+	// innerPtrs lists any blocks in between.  An assembled block
+	// must never be encoded as is, or put in the clean block
+	// cache; folderBranchOps.readyDirBlock splits it up again.
+	assembled bool
+	innerPtrs []BlockInfo
 }
 
 // NewDirBlock creates a new, empty DirBlock.
@@ -124,6 +134,8 @@ func (db DirBlock) DeepCopy(codec kbfscodec.Codec) (*DirBlock, error) {
 		dirBlockCopy.Children = make(map[string]DirEntry)
 	}
 	dirBlockCopy.cachedEncodedSize = db.cachedEncodedSize
+	dirBlockCopy.assembled = db.assembled
+	dirBlockCopy.innerPtrs = append([]BlockInfo(nil), db.innerPtrs...)
 	return &dirBlockCopy, nil
 }
 
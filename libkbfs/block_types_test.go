@@ -153,6 +153,8 @@ func makeFakeDirBlockFuture(t *testing.T) dirBlockFuture {
 			},
 			nil,
 			nil,
+			false,
+			nil,
 		},
 		map[string]dirEntryFuture{
 			"child1": makeFakeDirEntryFuture(t),
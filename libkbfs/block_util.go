@@ -44,6 +44,13 @@ func PutBlockCheckQuota(ctx context.Context, bserv BlockServer,
 	reporter Reporter, tlfID tlf.ID, blockPtr BlockPointer,
 	readyBlockData ReadyBlockData, tlfName CanonicalTlfName) error {
 	err := putBlockToServer(ctx, bserv, tlfID, blockPtr, readyBlockData)
+	return checkBlockPutQuota(ctx, reporter, tlfID, tlfName, err)
+}
+
+// checkBlockPutQuota reports err if it's just an over-quota warning,
+// and returns nil in that case; otherwise it returns err.
+func checkBlockPutQuota(ctx context.Context, reporter Reporter,
+	tlfID tlf.ID, tlfName CanonicalTlfName, err error) error {
 	if qe, ok := err.(BServerErrorOverQuota); ok && !qe.Throttled {
 		reporter.ReportErr(ctx, tlfName, tlfID.IsPublic(),
 			WriteMode, OverQuotaWarning{qe.Usage, qe.Limit})
@@ -52,11 +59,114 @@ func PutBlockCheckQuota(ctx context.Context, bserv BlockServer,
 	return err
 }
 
+// putBlocksOneAtATime implements BlockServer.PutBlocks by calling
+// bserv.Put for each block in turn.
+func putBlocksOneAtATime(ctx context.Context, bserv BlockServer,
+	tlfID tlf.ID, puts []BlockPut) []error {
+	errs := make([]error, len(puts))
+	for i, put := range puts {
+		errs[i] = bserv.Put(
+			ctx, tlfID, put.ID, put.Context, put.Buf, put.ServerHalf)
+	}
+	return errs
+}
+
+// blockPutBatcher is implemented by BlockServers whose PutBlocks
+// takes fewer round trips than the same puts done separately.
+type blockPutBatcher interface {
+	canBatchPuts() bool
+}
+
+// canBatchPuts returns whether doBlockPuts should batch puts to
+// bserv.
+func canBatchPuts(bserv BlockServer) bool {
+	b, ok := bserv.(blockPutBatcher)
+	return ok && b.canBatchPuts()
+}
+
+const (
+	// maxBlockPutBatchBlocks and maxBlockPutBatchBytes bound each
+	// batch of new blocks that doBlockPuts sends with a single
+	// BlockServer.PutBlocks call.
+	maxBlockPutBatchBlocks = 64
+	maxBlockPutBatchBytes  = MaxBlockSizeBytesDefault
+)
+
+// batchBlockPuts groups the given block states into units of work
+// for doBlockPuts.  Batching only saves anything for a server that
+// can batch, and when there are more puts than parallel workers,
+// since otherwise every put goes out right away anyway; if not, each
+// block gets its own unit.  Otherwise, new blocks are packed into
+// batches, and new references to existing blocks, which PutBlocks
+// can't handle, get their own units.
+func batchBlockPuts(blockStates []blockState, maxParallel int,
+	canBatch bool) [][]blockState {
+	batches := make([][]blockState, 0, len(blockStates))
+	if !canBatch || len(blockStates) <= maxParallel {
+		for _, bs := range blockStates {
+			batches = append(batches, []blockState{bs})
+		}
+		return batches
+	}
+
+	var curr []blockState
+	currBytes := 0
+	for _, bs := range blockStates {
+		if bs.blockPtr.RefNonce != ZeroBlockRefNonce {
+			batches = append(batches, []blockState{bs})
+			continue
+		}
+		size := bs.readyBlockData.GetEncodedSize()
+		if len(curr) == maxBlockPutBatchBlocks ||
+			(len(curr) > 0 && currBytes+size > maxBlockPutBatchBytes) {
+			batches = append(batches, curr)
+			curr, currBytes = nil, 0
+		}
+		curr = append(curr, bs)
+		currBytes += size
+	}
+	if len(curr) > 0 {
+		batches = append(batches, curr)
+	}
+	return batches
+}
+
 func doOneBlockPut(ctx context.Context, bserv BlockServer, reporter Reporter,
 	tlfID tlf.ID, tlfName CanonicalTlfName, blockState blockState,
 	errChan chan error, blocksToRemoveChan chan *FileBlock) {
 	err := PutBlockCheckQuota(ctx, bserv, reporter, tlfID, blockState.blockPtr,
 		blockState.readyBlockData, tlfName)
+	finishBlockPut(blockState, err, errChan, blocksToRemoveChan)
+}
+
+// putBlockBatchToServer puts a batch of new blocks with one
+// BlockServer.PutBlocks call, and then finishes each put like
+// doOneBlockPut does.
+func putBlockBatchToServer(ctx context.Context, bserv BlockServer,
+	reporter Reporter, tlfID tlf.ID, tlfName CanonicalTlfName,
+	batch []blockState, errChan chan error,
+	blocksToRemoveChan chan *FileBlock) {
+	puts := make([]BlockPut, len(batch))
+	for i, bs := range batch {
+		puts[i] = BlockPut{
+			ID:         bs.blockPtr.ID,
+			Context:    bs.blockPtr.BlockContext,
+			Buf:        bs.readyBlockData.buf,
+			ServerHalf: bs.readyBlockData.serverHalf,
+		}
+	}
+	errs := bserv.PutBlocks(ctx, tlfID, puts)
+	for i, bs := range batch {
+		err := checkBlockPutQuota(ctx, reporter, tlfID, tlfName, errs[i])
+		finishBlockPut(bs, err, errChan, blocksToRemoveChan)
+	}
+}
+
+// finishBlockPut calls the synced callback for a successful put, and
+// passes on any error, along with the block if the error is
+// recoverable.
+func finishBlockPut(blockState blockState, err error,
+	errChan chan error, blocksToRemoveChan chan *FileBlock) {
 	if err == nil && blockState.syncedCb != nil {
 		err = blockState.syncedCb()
 	}
@@ -77,8 +187,18 @@ func doOneBlockPut(ctx context.Context, bserv BlockServer, reporter Reporter,
 	}
 }
 
+// maxParallelBlockPutsForConfig returns the maximum number of blocks
+// that may be put at once, which is lower in low-memory mode.
+func maxParallelBlockPutsForConfig(config Config) int {
+	if config.LowMemoryMode() {
+		return lowMemoryMaxParallelBlockPuts
+	}
+	return maxParallelBlockPuts
+}
+
 // doBlockPuts writes all the pending block puts to the cache and
-// server. If the err returned by this function satisfies
+// server, at most maxParallel at a time, batching new blocks together
+// if there are more than that and bserv can batch puts. If the err returned by this function satisfies
 // isRecoverableBlockError(err), the caller should retry its entire
 // operation, starting from when the MD successor was created.
 //
@@ -86,28 +206,36 @@ func doOneBlockPut(ctx context.Context, bserv BlockServer, reporter Reporter,
 // errors and should be removed by the caller from any saved state.
 func doBlockPuts(ctx context.Context, bserv BlockServer, bcache BlockCache,
 	reporter Reporter, log logger.Logger, tlfID tlf.ID, tlfName CanonicalTlfName,
-	bps blockPutState) ([]BlockPointer, error) {
+	bps blockPutState, maxParallel int) ([]BlockPointer, error) {
 	errChan := make(chan error, 1)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	blocks := make(chan blockState, len(bps.blockStates))
+	batches := batchBlockPuts(
+		bps.blockStates, maxParallel, canBatchPuts(bserv))
+	blocks := make(chan []blockState, len(batches))
 	var wg sync.WaitGroup
 
-	numWorkers := len(bps.blockStates)
-	if numWorkers > maxParallelBlockPuts {
-		numWorkers = maxParallelBlockPuts
+	numWorkers := len(batches)
+	if numWorkers > maxParallel {
+		numWorkers = maxParallel
 	}
 	wg.Add(numWorkers)
 	// A channel to list any blocks that have been archived or
-	// deleted.  Any of these will result in an error, so the maximum
-	// we'll get is the same as the number of workers.
-	blocksToRemoveChan := make(chan *FileBlock, numWorkers)
+	// deleted.  Any of these will result in an error, which stops
+	// the workers, but every block of a batch that's already been
+	// sent may still fail.
+	blocksToRemoveChan := make(chan *FileBlock, len(bps.blockStates))
 
 	worker := func() {
 		defer wg.Done()
-		for blockState := range blocks {
-			doOneBlockPut(ctx, bserv, reporter, tlfID, tlfName,
-				blockState, errChan, blocksToRemoveChan)
+		for batch := range blocks {
+			if len(batch) == 1 {
+				doOneBlockPut(ctx, bserv, reporter, tlfID, tlfName,
+					batch[0], errChan, blocksToRemoveChan)
+			} else {
+				putBlockBatchToServer(ctx, bserv, reporter, tlfID,
+					tlfName, batch, errChan, blocksToRemoveChan)
+			}
 			select {
 			// return early if the context has been canceled
 			case <-ctx.Done():
@@ -120,8 +248,8 @@ func doBlockPuts(ctx context.Context, bserv BlockServer, bcache BlockCache,
 		go worker()
 	}
 
-	for _, blockState := range bps.blockStates {
-		blocks <- blockState
+	for _, batch := range batches {
+		blocks <- batch
 	}
 	close(blocks)
 
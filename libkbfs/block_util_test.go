@@ -5,7 +5,9 @@ import (
 	"testing"
 
 	"github.com/golang/mock/gomock"
+	"github.com/keybase/client/go/logger"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
 
@@ -102,3 +104,86 @@ func TestBlockUtilPutFail(t *testing.T) {
 		t.Errorf("Got bad error on put: %v", err2)
 	}
 }
+
+func TestBlockUtilBatchBlockPuts(t *testing.T) {
+	bps := newBlockPutState(4)
+	for i := 1; i <= 3; i++ {
+		bps.addNewBlock(BlockPointer{ID: fakeBlockID(byte(i))}, nil,
+			ReadyBlockData{buf: make([]byte, 10)}, nil)
+	}
+	bps.addNewBlock(BlockPointer{
+		ID:           fakeBlockID(1),
+		BlockContext: BlockContext{RefNonce: BlockRefNonce{1}},
+	}, nil, ReadyBlockData{}, nil)
+
+	// With enough workers for every put, or a server that can't
+	// batch, nothing is batched.
+	batches := batchBlockPuts(bps.blockStates, 4, true)
+	require.Len(t, batches, 4)
+	batches = batchBlockPuts(bps.blockStates, 2, false)
+	require.Len(t, batches, 4)
+
+	// Otherwise the new blocks go together, but the new reference
+	// doesn't.
+	batches = batchBlockPuts(bps.blockStates, 2, true)
+	require.Equal(t, [][]blockState{
+		{bps.blockStates[3]}, bps.blockStates[:3],
+	}, batches)
+
+	// Big blocks are split across batches.
+	bps = newBlockPutState(3)
+	for i := 1; i <= 3; i++ {
+		bps.addNewBlock(BlockPointer{ID: fakeBlockID(byte(i))}, nil,
+			ReadyBlockData{
+				buf: make([]byte, maxBlockPutBatchBytes/2),
+			}, nil)
+	}
+	batches = batchBlockPuts(bps.blockStates, 1, true)
+	require.Equal(t, [][]blockState{
+		bps.blockStates[:2], bps.blockStates[2:],
+	}, batches)
+}
+
+type batchingMockBlockServer struct {
+	*MockBlockServer
+}
+
+func (b batchingMockBlockServer) canBatchPuts() bool {
+	return true
+}
+
+func TestBlockUtilDoBlockPutsBatched(t *testing.T) {
+	mockCtrl, ctr, bserver, ctx := blockUtilInit(t)
+	defer blockUtilShutdown(mockCtrl, ctr)
+
+	tlfID := tlf.FakeID(1, false)
+	bps := newBlockPutState(3)
+	var puts []BlockPut
+	synced := 0
+	for i := 1; i <= 3; i++ {
+		ptr := BlockPointer{ID: fakeBlockID(byte(i))}
+		readyBlockData := ReadyBlockData{buf: []byte{byte(i)}}
+		bps.addNewBlock(ptr, nil, readyBlockData, func() error {
+			synced++
+			return nil
+		})
+		puts = append(puts, BlockPut{
+			ID:      ptr.ID,
+			Context: ptr.BlockContext,
+			Buf:     readyBlockData.buf,
+		})
+	}
+
+	// An over-quota warning for one of the blocks only gets
+	// reported.
+	bserver.EXPECT().PutBlocks(gomock.Any(), tlfID, puts).Return(
+		[]error{nil, BServerErrorOverQuota{}, nil})
+	reporter := NewReporterSimple(newTestClockNow(), 1)
+	blocksToRemove, err := doBlockPuts(ctx,
+		batchingMockBlockServer{bserver}, nil, reporter,
+		logger.NewTestLogger(t), tlfID, "", *bps, 2)
+	require.NoError(t, err)
+	require.Len(t, blocksToRemove, 0)
+	require.Equal(t, 3, synced)
+	require.Len(t, reporter.AllKnownErrors(), 1)
+}
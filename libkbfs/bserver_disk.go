@@ -114,7 +114,7 @@ func (b *BlockServerDisk) getStorage(tlfID tlf.ID) (
 	}
 
 	path := filepath.Join(b.dirPath, tlfID.String())
-	store := makeBlockDiskStore(b.codec, b.crypto, path)
+	store := makeBlockDiskStore(b.codec, b.crypto, path, nil)
 
 	storage = &blockServerDiskTlfStorage{
 		store: store,
@@ -186,6 +186,49 @@ func (b *BlockServerDisk) Put(ctx context.Context, tlfID tlf.ID, id BlockID,
 	return nil
 }
 
+// PutBlocks implements the BlockServer interface for
+// BlockServerDisk.  All the blocks are stored while holding the TLF's
+// storage lock once.
+func (b *BlockServerDisk) PutBlocks(ctx context.Context, tlfID tlf.ID,
+	puts []BlockPut) []error {
+	b.log.CDebugf(ctx, "BlockServerDisk.PutBlocks tlfID=%s count=%d",
+		tlfID, len(puts))
+	errs := make([]error, len(puts))
+	setAll := func(err error) []error {
+		for i := range errs {
+			errs[i] = translateToBlockServerError(err)
+		}
+		return errs
+	}
+
+	tlfStorage, err := b.getStorage(tlfID)
+	if err != nil {
+		return setAll(err)
+	}
+
+	tlfStorage.lock.Lock()
+	defer tlfStorage.lock.Unlock()
+	if tlfStorage.store == nil {
+		return setAll(errBlockServerDiskShutdown)
+	}
+
+	for i, put := range puts {
+		if put.Context.GetRefNonce() != ZeroBlockRefNonce {
+			errs[i] = errors.New(
+				"can't Put() a block with a non-zero refnonce")
+			continue
+		}
+		err := tlfStorage.store.put(
+			put.ID, put.Context, put.Buf, put.ServerHalf, "")
+		errs[i] = translateToBlockServerError(err)
+	}
+	return errs
+}
+
+func (b *BlockServerDisk) canBatchPuts() bool {
+	return true
+}
+
 // AddBlockReference implements the BlockServer interface for BlockServerDisk.
 func (b *BlockServerDisk) AddBlockReference(ctx context.Context, tlfID tlf.ID,
 	id BlockID, context BlockContext) error {
@@ -322,6 +365,18 @@ func (b *BlockServerDisk) getAllRefsForTest(ctx context.Context, tlfID tlf.ID) (
 	return tlfStorage.store.getAllRefsForTest()
 }
 
+// getAllRefs implements the blockServerLocal interface for
+// BlockServerDisk.
+func (b *BlockServerDisk) getAllRefs(ctx context.Context, tlfID tlf.ID) (
+	live, archived map[BlockID][]BlockRefNonce, err error) {
+	refs, err := b.getAllRefsForTest(ctx, tlfID)
+	if err != nil {
+		return nil, nil, err
+	}
+	live, archived = splitRefsByStatus(refs)
+	return live, archived, nil
+}
+
 // IsUnflushed implements the BlockServer interface for BlockServerDisk.
 func (b *BlockServerDisk) IsUnflushed(ctx context.Context, tlfID tlf.ID,
 	_ BlockID) (bool, error) {
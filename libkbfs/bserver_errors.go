@@ -369,3 +369,14 @@ func translateToBlockServerError(err error) error {
 		return err
 	}
 }
+
+// BServerErrorUnsupported is returned by block servers that don't
+// support the requested operation.
+type BServerErrorUnsupported struct {
+	Op string
+}
+
+// Error implements the Error interface for BServerErrorUnsupported.
+func (e BServerErrorUnsupported) Error() string {
+	return "BServer does not support " + e.Op
+}
@@ -17,6 +17,7 @@ type BlockServerMeasured struct {
 	delegate                    BlockServer
 	getTimer                    metrics.Timer
 	putTimer                    metrics.Timer
+	putBlocksTimer              metrics.Timer
 	addBlockReferenceTimer      metrics.Timer
 	removeBlockReferencesTimer  metrics.Timer
 	archiveBlockReferencesTimer metrics.Timer
@@ -30,6 +31,7 @@ var _ BlockServer = BlockServerMeasured{}
 func NewBlockServerMeasured(delegate BlockServer, r metrics.Registry) BlockServerMeasured {
 	getTimer := metrics.GetOrRegisterTimer("BlockServer.Get", r)
 	putTimer := metrics.GetOrRegisterTimer("BlockServer.Put", r)
+	putBlocksTimer := metrics.GetOrRegisterTimer("BlockServer.PutBlocks", r)
 	addBlockReferenceTimer := metrics.GetOrRegisterTimer("BlockServer.AddBlockReference", r)
 	removeBlockReferencesTimer := metrics.GetOrRegisterTimer("BlockServer.RemoveBlockReferences", r)
 	archiveBlockReferencesTimer := metrics.GetOrRegisterTimer("BlockServer.ArchiveBlockReferences", r)
@@ -38,6 +40,7 @@ func NewBlockServerMeasured(delegate BlockServer, r metrics.Registry) BlockServe
 		delegate:                    delegate,
 		getTimer:                    getTimer,
 		putTimer:                    putTimer,
+		putBlocksTimer:              putBlocksTimer,
 		addBlockReferenceTimer:      addBlockReferenceTimer,
 		removeBlockReferencesTimer:  removeBlockReferencesTimer,
 		archiveBlockReferencesTimer: archiveBlockReferencesTimer,
@@ -65,6 +68,20 @@ func (b BlockServerMeasured) Put(ctx context.Context, tlfID tlf.ID, id BlockID,
 	return err
 }
 
+// PutBlocks implements the BlockServer interface for
+// BlockServerMeasured.
+func (b BlockServerMeasured) PutBlocks(ctx context.Context, tlfID tlf.ID,
+	puts []BlockPut) (errs []error) {
+	b.putBlocksTimer.Time(func() {
+		errs = b.delegate.PutBlocks(ctx, tlfID, puts)
+	})
+	return errs
+}
+
+func (b BlockServerMeasured) canBatchPuts() bool {
+	return canBatchPuts(b.delegate)
+}
+
 // AddBlockReference implements the BlockServer interface for
 // BlockServerMeasured.
 func (b BlockServerMeasured) AddBlockReference(ctx context.Context, tlfID tlf.ID,
@@ -173,6 +173,13 @@ func (b *BlockServerMemory) Put(ctx context.Context, tlfID tlf.ID, id BlockID,
 	return refs.put(context, liveBlockRef, "")
 }
 
+// PutBlocks implements the BlockServer interface for
+// BlockServerMemory.
+func (b *BlockServerMemory) PutBlocks(ctx context.Context, tlfID tlf.ID,
+	puts []BlockPut) []error {
+	return putBlocksOneAtATime(ctx, b, tlfID, puts)
+}
+
 // AddBlockReference implements the BlockServer interface for BlockServerMemory.
 func (b *BlockServerMemory) AddBlockReference(ctx context.Context, tlfID tlf.ID,
 	id BlockID, context BlockContext) (err error) {
@@ -339,6 +346,18 @@ func (b *BlockServerMemory) getAllRefsForTest(
 	return res, nil
 }
 
+// getAllRefs implements the blockServerLocal interface for
+// BlockServerMemory.
+func (b *BlockServerMemory) getAllRefs(ctx context.Context, tlfID tlf.ID) (
+	live, archived map[BlockID][]BlockRefNonce, err error) {
+	refs, err := b.getAllRefsForTest(ctx, tlfID)
+	if err != nil {
+		return nil, nil, err
+	}
+	live, archived = splitRefsByStatus(refs)
+	return live, archived, nil
+}
+
 func (b *BlockServerMemory) numBlocks() int {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
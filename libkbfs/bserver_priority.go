@@ -0,0 +1,232 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"golang.org/x/net/context"
+)
+
+// BlockPriority says how urgently a request to the block server is
+// needed.  Higher priorities go to the server first when there are
+// more requests than it's allowed to have outstanding.
+type BlockPriority int
+
+const (
+	// BlockPriorityDefault means the request gets the default
+	// priority for its kind: BlockPriorityForegroundRead for gets,
+	// and BlockPriorityForegroundWrite for everything else.
+	BlockPriorityDefault BlockPriority = iota
+	// BlockPriorityQuotaReclamation is for deleting and archiving
+	// blocks that are no longer referenced.
+	BlockPriorityQuotaReclamation
+	// BlockPriorityPrefetch is for getting blocks before anyone
+	// has asked for them.
+	BlockPriorityPrefetch
+	// BlockPriorityJournalFlush is for flushing blocks from a TLF
+	// journal to the server.
+	BlockPriorityJournalFlush
+	// BlockPriorityForegroundWrite is for writes that a user is
+	// waiting on.
+	BlockPriorityForegroundWrite
+	// BlockPriorityForegroundRead is for reads that a user is
+	// waiting on.
+	BlockPriorityForegroundRead
+
+	numBlockPriorities = int(BlockPriorityForegroundRead) + 1
+)
+
+func (p BlockPriority) String() string {
+	switch p {
+	case BlockPriorityDefault:
+		return "default"
+	case BlockPriorityQuotaReclamation:
+		return "quota-reclamation"
+	case BlockPriorityPrefetch:
+		return "prefetch"
+	case BlockPriorityJournalFlush:
+		return "journal-flush"
+	case BlockPriorityForegroundWrite:
+		return "foreground-write"
+	case BlockPriorityForegroundRead:
+		return "foreground-read"
+	default:
+		return fmt.Sprintf("BlockPriority(%d)", int(p))
+	}
+}
+
+type ctxBlockPriorityKeyType int
+
+const (
+	ctxBlockPriorityKey ctxBlockPriorityKeyType = iota
+)
+
+// blockPriorityRPCTag is the RPC tag that tells the block server the
+// priority of a request, as an int.
+const blockPriorityRPCTag = "priority"
+
+// WithBlockPriority returns a context under which all block server
+// requests have the given priority.
+func WithBlockPriority(
+	ctx context.Context, priority BlockPriority) context.Context {
+	return context.WithValue(ctx, ctxBlockPriorityKey, priority)
+}
+
+// blockPriorityFromContext returns the priority set in ctx by
+// WithBlockPriority, or defaultPriority if there isn't one.
+func blockPriorityFromContext(
+	ctx context.Context, defaultPriority BlockPriority) BlockPriority {
+	priority, ok := ctx.Value(ctxBlockPriorityKey).(BlockPriority)
+	if !ok || priority <= BlockPriorityDefault ||
+		int(priority) >= numBlockPriorities {
+		return defaultPriority
+	}
+	return priority
+}
+
+// withBlockPriorityRPCTag returns a context that sends the given
+// priority to the server along with any RPC made under it.  The
+// RPC tags already in ctx are copied rather than added to, since
+// the RPC library modifies the tags map in place.
+func withBlockPriorityRPCTag(
+	ctx context.Context, priority BlockPriority) context.Context {
+	tags := make(rpc.CtxRpcTags)
+	if oldTags, ok := rpc.RpcTagsFromContext(ctx); ok {
+		for k, v := range oldTags {
+			tags[k] = v
+		}
+	}
+	tags[blockPriorityRPCTag] = int(priority)
+	return context.WithValue(ctx, rpc.CtxRpcTagsKey, tags)
+}
+
+const (
+	// defaultBlockServerForegroundReserve is the number of
+	// requests to the server that only foreground requests may
+	// use, so that background work can never make them all wait
+	// for a free slot.
+	defaultBlockServerForegroundReserve = 2 * maxParallelBlockGets
+	// defaultBlockServerMaxInFlight is the number of requests
+	// BlockServerRemote lets go to the server at once.  It leaves
+	// room for a whole batch of parallel block puts on top of the
+	// reserve.
+	defaultBlockServerMaxInFlight = maxParallelBlockPuts +
+		defaultBlockServerForegroundReserve
+)
+
+// blockRequestScheduler decides which block server requests go to
+// the server, when there are more of them than it allows to be
+// outstanding at once.  Waiting requests go in order of priority,
+// and then in the order they arrived.  Background requests can only
+// use some of the slots, leaving the rest for foreground requests.
+type blockRequestScheduler struct {
+	maxInFlight       int
+	foregroundReserve int
+
+	lock     sync.Mutex
+	inFlight int
+	// waiting holds a channel for each request waiting for a slot,
+	// by priority, which is closed once it has one.
+	waiting [numBlockPriorities][]chan struct{}
+}
+
+func newBlockRequestScheduler(
+	maxInFlight, foregroundReserve int) *blockRequestScheduler {
+	return &blockRequestScheduler{
+		maxInFlight:       maxInFlight,
+		foregroundReserve: foregroundReserve,
+	}
+}
+
+func (s *blockRequestScheduler) limitLocked(priority BlockPriority) int {
+	if priority >= BlockPriorityForegroundWrite {
+		return s.maxInFlight
+	}
+	return s.maxInFlight - s.foregroundReserve
+}
+
+// grantLocked gives free slots to the highest-priority waiting
+// requests.
+func (s *blockRequestScheduler) grantLocked() {
+	for i := numBlockPriorities - 1; i > int(BlockPriorityDefault); i-- {
+		priority := BlockPriority(i)
+		for len(s.waiting[i]) > 0 && s.inFlight < s.limitLocked(priority) {
+			close(s.waiting[i][0])
+			s.waiting[i] = s.waiting[i][1:]
+			s.inFlight++
+		}
+		if len(s.waiting[i]) > 0 {
+			// Lower priorities can't use more slots than
+			// this one, so they have to wait too.
+			return
+		}
+	}
+}
+
+func (s *blockRequestScheduler) removeWaiterLocked(
+	priority BlockPriority, ch chan struct{}) {
+	waiting := s.waiting[priority]
+	for i, waiter := range waiting {
+		if waiter == ch {
+			s.waiting[priority] = append(waiting[:i], waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *blockRequestScheduler) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.inFlight--
+	s.grantLocked()
+}
+
+// acquire waits until a request with the given priority may go to
+// the server, and returns a function to call once it's done.
+func (s *blockRequestScheduler) acquire(
+	ctx context.Context, priority BlockPriority) (func(), error) {
+	ch := make(chan struct{})
+	func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.waiting[priority] = append(s.waiting[priority], ch)
+		s.grantLocked()
+	}()
+
+	select {
+	case <-ch:
+		return s.release, nil
+	case <-ctx.Done():
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		select {
+		case <-ch:
+			// It got a slot just as ctx was canceled, so
+			// pass it on.
+			s.inFlight--
+			s.grantLocked()
+		default:
+			s.removeWaiterLocked(priority, ch)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// waitingCounts returns the number of requests waiting at each
+// priority, for testing.
+func (s *blockRequestScheduler) waitingCounts() map[BlockPriority]int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	counts := make(map[BlockPriority]int)
+	for i, waiting := range s.waiting {
+		if len(waiting) > 0 {
+			counts[BlockPriority(i)] = len(waiting)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,198 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// waitForBlockRequestWaiters waits until s has the given numbers of
+// requests waiting.
+func waitForBlockRequestWaiters(t *testing.T, s *blockRequestScheduler,
+	expected map[BlockPriority]int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		counts := s.waitingCounts()
+		if len(counts) == len(expected) {
+			equal := true
+			for p, n := range expected {
+				equal = equal && counts[p] == n
+			}
+			if equal {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Waiting requests %v, expected %v", counts, expected)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Test that requests waiting for a slot get one in order of
+// priority, and that background requests can't use the slots
+// reserved for foreground ones.
+func TestBlockRequestSchedulerOrder(t *testing.T) {
+	s := newBlockRequestScheduler(2, 1)
+	ctx := context.Background()
+
+	doneRead, err := s.acquire(ctx, BlockPriorityForegroundRead)
+	require.NoError(t, err)
+
+	// Only one slot is for background requests, so these wait.
+	type grant struct {
+		priority BlockPriority
+		done     func()
+	}
+	grantCh := make(chan grant, 3)
+	expected := make(map[BlockPriority]int)
+	for _, p := range []BlockPriority{BlockPriorityQuotaReclamation,
+		BlockPriorityPrefetch, BlockPriorityJournalFlush} {
+		go func(p BlockPriority) {
+			done, err := s.acquire(ctx, p)
+			if err != nil {
+				t.Errorf("Couldn't acquire at %s: %v", p, err)
+				return
+			}
+			grantCh <- grant{p, done}
+		}(p)
+		expected[p] = 1
+		waitForBlockRequestWaiters(t, s, expected)
+	}
+
+	// A foreground write still gets the reserved slot.
+	doneWrite, err := s.acquire(ctx, BlockPriorityForegroundWrite)
+	require.NoError(t, err)
+
+	// Freeing one slot isn't enough for the background requests.
+	doneRead()
+	select {
+	case g := <-grantCh:
+		t.Fatalf("Unexpected grant at %s", g.priority)
+	default:
+	}
+
+	// Now they go one at a time, highest priority first.
+	doneWrite()
+	for _, p := range []BlockPriority{BlockPriorityJournalFlush,
+		BlockPriorityPrefetch, BlockPriorityQuotaReclamation} {
+		var g grant
+		select {
+		case g = <-grantCh:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Request at %s wasn't granted", p)
+		}
+		require.Equal(t, p, g.priority)
+		select {
+		case g := <-grantCh:
+			t.Fatalf("Unexpected grant at %s", g.priority)
+		default:
+		}
+		g.done()
+	}
+	require.Equal(t, 0, s.inFlight)
+}
+
+// Test that a request whose context is canceled stops waiting.
+func TestBlockRequestSchedulerCanceled(t *testing.T) {
+	s := newBlockRequestScheduler(1, 0)
+	done, err := s.acquire(context.Background(), BlockPriorityPrefetch)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := s.acquire(ctx, BlockPriorityPrefetch)
+		errCh <- err
+	}()
+	waitForBlockRequestWaiters(t, s, map[BlockPriority]int{
+		BlockPriorityPrefetch: 1,
+	})
+	cancel()
+	require.Equal(t, context.Canceled, <-errCh)
+	waitForBlockRequestWaiters(t, s, map[BlockPriority]int{})
+
+	done()
+	require.Equal(t, 0, s.inFlight)
+}
+
+// blockPriorityRecordingClient records the priority sent along with
+// each request.
+type blockPriorityRecordingClient struct {
+	*FakeBServerClient
+	priorities chan interface{}
+}
+
+func (c blockPriorityRecordingClient) record(ctx context.Context) {
+	tags, _ := rpc.RpcTagsFromContext(ctx)
+	c.priorities <- tags[blockPriorityRPCTag]
+}
+
+func (c blockPriorityRecordingClient) PutBlock(
+	ctx context.Context, arg keybase1.PutBlockArg) error {
+	c.record(ctx)
+	return c.FakeBServerClient.PutBlock(ctx, arg)
+}
+
+func (c blockPriorityRecordingClient) GetBlock(
+	ctx context.Context, arg keybase1.GetBlockArg) (
+	keybase1.GetBlockRes, error) {
+	c.record(ctx)
+	return c.FakeBServerClient.GetBlock(ctx, arg)
+}
+
+// Test that BlockServerRemote tells the server the priority of each
+// request.
+func TestBServerRemoteSendsPriority(t *testing.T) {
+	codec := kbfscodec.NewMsgpack()
+	localUsers := MakeLocalUsers([]libkb.NormalizedUsername{"user1"})
+	crypto := &CryptoLocal{CryptoCommon: MakeCryptoCommon(codec)}
+	config := &ConfigLocal{codec: codec, crypto: crypto}
+	setTestLogger(config, t)
+	fc := blockPriorityRecordingClient{
+		NewFakeBServerClient(config, nil, nil, nil), make(chan interface{}, 1),
+	}
+	b := newBlockServerRemoteWithClient(config, fc)
+
+	tlfID := tlf.FakeID(2, false)
+	bCtx := BlockContext{localUsers[0].UID, "", ZeroBlockRefNonce}
+	data := []byte{1, 2, 3, 4}
+	bID, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+
+	// Tags the caller already has are sent too, but not modified.
+	callerTags := rpc.CtxRpcTags{"foo": "bar"}
+	ctx := context.WithValue(
+		context.Background(), rpc.CtxRpcTagsKey, callerTags)
+	err = b.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+	require.Equal(t, int(BlockPriorityForegroundWrite), <-fc.priorities)
+	require.Equal(t, rpc.CtxRpcTags{"foo": "bar"}, callerTags)
+
+	_, _, err = b.Get(ctx, tlfID, bID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, int(BlockPriorityForegroundRead), <-fc.priorities)
+
+	_, _, err = b.Get(WithBlockPriority(ctx, BlockPriorityPrefetch),
+		tlfID, bID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, int(BlockPriorityPrefetch), <-fc.priorities)
+
+	err = b.Put(WithBlockPriority(ctx, BlockPriorityJournalFlush),
+		tlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+	require.Equal(t, int(BlockPriorityJournalFlush), <-fc.priorities)
+}
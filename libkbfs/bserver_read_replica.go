@@ -0,0 +1,256 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// readReplicaCacheEntry is the on-disk format of a single cached
+// block. Fields are exported only for serialization.
+type readReplicaCacheEntry struct {
+	Buf []byte
+
+	codec.UnknownFieldSetHandler
+}
+
+// readReplicaKeyEntry is the on-disk format of the server half of a
+// single cached block, along with the TLF it was fetched for. Fields
+// are exported only for serialization.
+type readReplicaKeyEntry struct {
+	TlfID      tlf.ID
+	ServerHalf kbfscrypto.BlockCryptKeyServerHalf
+
+	codec.UnknownFieldSetHandler
+}
+
+// BlockServerReadReplica delegates to another BlockServer, but keeps
+// a copy of every block it fetches in a directory on disk, and
+// rejects all operations that would modify the server.
+//
+// The cache directory may be shared by many read replicas at once,
+// e.g. on a network volume mounted by every runner in a build
+// farm. Cached files are never modified once written, and each one
+// is written to a temp file and then renamed into place, so readers
+// never need to take any locks. Blocks read from the cache are
+// verified against their IDs, and re-fetched if they don't match.
+//
+// The server half of each block's key is kept apart from the
+// encrypted block, in a subdirectory per KBFS user, along with the
+// TLF the block was fetched for.  A cached block is only served to a
+// user who has fetched it from the server for the same TLF before;
+// any other read goes to the server, which checks that the user may
+// read the block.  Everything in the directory is created readable
+// only by its owner, so it should only be shared among replicas
+// running as the same local user, e.g. a build farm's bot account.
+//
+// Blocks are only cached while the given DiskLimiter has room for
+// them. Since measuring a shared directory could take a long time,
+// only the blocks cached by this replica count against the limits.
+//
+// The directory layout looks like:
+//
+// dir/blocks/0100/0...01
+// ...
+// dir/blocks/01ff/f...ff
+// dir/keys/<uid>/0100/0...01
+// ...
+// dir/keys/<uid>/01ff/f...ff
+//
+// where each file in blocks holds a serialized
+// readReplicaCacheEntry, with just the encrypted block, and each file in keys/<uid> holds a
+// serialized readReplicaKeyEntry, splayed the same way as
+// blockDiskStore.
+type BlockServerReadReplica struct {
+	BlockServer
+	codec  kbfscodec.Codec
+	crypto cryptoPure
+	cig    currentInfoGetter
+	log    logger.Logger
+	dir    string
+
+	diskLimiter DiskLimiter
+	// cachedBytes is the number of bytes cached by this replica.
+	cachedBytes *int64
+}
+
+var _ BlockServer = BlockServerReadReplica{}
+
+// NewBlockServerReadReplica constructs a new BlockServerReadReplica
+// that wraps the given delegate and caches blocks in the given
+// directory on behalf of the user given by cig, registering the
+// cache as a store with the given DiskLimiter.
+func NewBlockServerReadReplica(config blockServerLocalConfig,
+	cig currentInfoGetter, delegate BlockServer, dir string,
+	diskLimiter DiskLimiter) BlockServerReadReplica {
+	b := BlockServerReadReplica{
+		BlockServer: delegate,
+		codec:       config.Codec(),
+		crypto:      config.cryptoPure(),
+		cig:         cig,
+		log:         config.MakeLogger("BSR"),
+		dir:         dir,
+		diskLimiter: diskLimiter,
+		cachedBytes: new(int64),
+	}
+	diskLimiter.RegisterStore("readReplicaCache", func() int64 {
+		return atomic.LoadInt64(b.cachedBytes)
+	})
+	return b
+}
+
+func splayBlockPath(dir string, id BlockID) string {
+	idStr := id.String()
+	return filepath.Join(dir, idStr[:4], idStr[4:])
+}
+
+func (b BlockServerReadReplica) blockPath(id BlockID) string {
+	return splayBlockPath(filepath.Join(b.dir, "blocks"), id)
+}
+
+func (b BlockServerReadReplica) keysDir(uid keybase1.UID) string {
+	return filepath.Join(b.dir, "keys", uid.String())
+}
+
+func (b BlockServerReadReplica) getCached(ctx context.Context,
+	uid keybase1.UID, tlfID tlf.ID, id BlockID) (
+	buf []byte, serverHalf kbfscrypto.BlockCryptKeyServerHalf, ok bool) {
+	var keyEntry readReplicaKeyEntry
+	err := kbfscodec.DeserializeFromFile(
+		b.codec, splayBlockPath(b.keysDir(uid), id), &keyEntry)
+	if os.IsNotExist(err) {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, false
+	} else if err != nil {
+		b.log.CDebugf(ctx, "Couldn't read cached key for %s: %v", id, err)
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, false
+	}
+	if keyEntry.TlfID != tlfID {
+		b.log.CDebugf(ctx, "Block %s was cached for TLF %s, not %s",
+			id, keyEntry.TlfID, tlfID)
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, false
+	}
+
+	var entry readReplicaCacheEntry
+	err = kbfscodec.DeserializeFromFile(b.codec, b.blockPath(id), &entry)
+	if os.IsNotExist(err) {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, false
+	} else if err != nil {
+		b.log.CDebugf(ctx, "Couldn't read cached block %s: %v", id, err)
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, false
+	}
+
+	err = b.crypto.VerifyBlockID(entry.Buf, id)
+	if err != nil {
+		b.log.CDebugf(ctx, "Ignoring corrupt cached block %s: %v", id, err)
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, false
+	}
+
+	return entry.Buf, keyEntry.ServerHalf, true
+}
+
+func (b BlockServerReadReplica) putCached(ctx context.Context,
+	uid keybase1.UID, tlfID tlf.ID, id BlockID, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	// The block may have been cached already for another TLF or
+	// KBFS user.
+	if _, err := os.Stat(b.blockPath(id)); os.IsNotExist(err) {
+		err = serializeToFileAtomic(b.codec, readReplicaCacheEntry{
+			Buf: buf,
+		}, b.blockPath(id))
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(b.cachedBytes, int64(len(buf)))
+	} else if err != nil {
+		return err
+	}
+
+	return serializeToFileAtomic(b.codec, readReplicaKeyEntry{
+		TlfID:      tlfID,
+		ServerHalf: serverHalf,
+	}, splayBlockPath(b.keysDir(uid), id))
+}
+
+// Get implements the BlockServer interface for BlockServerReadReplica.
+func (b BlockServerReadReplica) Get(ctx context.Context, tlfID tlf.ID,
+	id BlockID, context BlockContext) (
+	buf []byte, serverHalf kbfscrypto.BlockCryptKeyServerHalf, err error) {
+	_, uid, err := b.cig.GetCurrentUserInfo(ctx)
+	if err != nil {
+		// Without a user, there's nowhere to keep the server
+		// half, so don't use the cache at all.
+		b.log.CDebugf(ctx, "Not using the cache for block %s: %v", id, err)
+		return b.BlockServer.Get(ctx, tlfID, id, context)
+	}
+
+	buf, serverHalf, ok := b.getCached(ctx, uid, tlfID, id)
+	if ok {
+		return buf, serverHalf, nil
+	}
+
+	buf, serverHalf, err = b.BlockServer.Get(ctx, tlfID, id, context)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+
+	// Caching is best-effort; if it fails, some other replica
+	// may fill it in later.
+	if !b.diskLimiter.HasSpace(int64(len(buf))) {
+		b.log.CDebugf(ctx, "Not caching block %s: over the disk limits", id)
+		return buf, serverHalf, nil
+	}
+	err = b.putCached(ctx, uid, tlfID, id, buf, serverHalf)
+	if err != nil {
+		b.log.CDebugf(ctx, "Couldn't cache block %s: %v", id, err)
+	}
+
+	return buf, serverHalf, nil
+}
+
+// Put implements the BlockServer interface for BlockServerReadReplica.
+func (b BlockServerReadReplica) Put(ctx context.Context, tlfID tlf.ID,
+	id BlockID, context BlockContext, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	return ReadReplicaError{}
+}
+
+// PutBlocks implements the BlockServer interface for
+// BlockServerReadReplica.
+func (b BlockServerReadReplica) PutBlocks(ctx context.Context, tlfID tlf.ID,
+	puts []BlockPut) []error {
+	return putBlocksOneAtATime(ctx, b, tlfID, puts)
+}
+
+// AddBlockReference implements the BlockServer interface for
+// BlockServerReadReplica.
+func (b BlockServerReadReplica) AddBlockReference(ctx context.Context,
+	tlfID tlf.ID, id BlockID, context BlockContext) error {
+	return ReadReplicaError{}
+}
+
+// RemoveBlockReferences implements the BlockServer interface for
+// BlockServerReadReplica.
+func (b BlockServerReadReplica) RemoveBlockReferences(ctx context.Context,
+	tlfID tlf.ID, contexts map[BlockID][]BlockContext) (
+	liveCounts map[BlockID]int, err error) {
+	return nil, ReadReplicaError{}
+}
+
+// ArchiveBlockReferences implements the BlockServer interface for
+// BlockServerReadReplica.
+func (b BlockServerReadReplica) ArchiveBlockReferences(ctx context.Context,
+	tlfID tlf.ID, contexts map[BlockID][]BlockContext) error {
+	return ReadReplicaError{}
+}
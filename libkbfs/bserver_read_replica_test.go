@@ -0,0 +1,141 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestBlockServerReadReplicaCache(t *testing.T) {
+	ctx := context.Background()
+	config := newTestBlockServerLocalConfig(t)
+	delegate := NewBlockServerMemory(config)
+	defer delegate.Shutdown()
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "bserver_read_replica")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	tlfID := tlf.FakeID(1, false)
+	data := []byte{1, 2, 3, 4}
+	bID, err := config.cryptoPure().MakePermanentBlockID(data)
+	require.NoError(t, err)
+	bCtx := BlockContext{keybase1.MakeTestUID(1), "", ZeroBlockRefNonce}
+	serverHalf, err := config.cryptoPure().MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = delegate.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+
+	uid1 := keybase1.MakeTestUID(1)
+	cig1 := singleCurrentInfoGetter{name: "u1", uid: uid1}
+	diskLimiter := NewDiskLimiterStandard(wallClock{}, "", DiskLimits{})
+	replica := NewBlockServerReadReplica(config, cig1, delegate, tempdir,
+		diskLimiter)
+	buf, key, err := replica.Get(ctx, tlfID, bID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.Equal(t, serverHalf, key)
+	require.Equal(t, int64(len(data)),
+		diskLimiter.Status().StoreBytes["readReplicaCache"])
+
+	// The server half is kept apart from the block, readable only
+	// by its owner.
+	var entry readReplicaCacheEntry
+	err = kbfscodec.DeserializeFromFile(
+		config.Codec(), replica.blockPath(bID), &entry)
+	require.NoError(t, err)
+	require.Equal(t, data, entry.Buf)
+	keyPath := splayBlockPath(replica.keysDir(uid1), bID)
+	fi, err := os.Stat(keyPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	fi, err = os.Stat(replica.keysDir(uid1))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+
+	// Over the disk limits, blocks are still read, but not cached.
+	diskLimiter.SetLimits(DiskLimits{MaxBytes: int64(len(data))})
+	data2 := []byte{5, 6, 7, 8}
+	bID2, err := config.cryptoPure().MakePermanentBlockID(data2)
+	require.NoError(t, err)
+	err = delegate.Put(ctx, tlfID, bID2, bCtx, data2, serverHalf)
+	require.NoError(t, err)
+	buf, _, err = replica.Get(ctx, tlfID, bID2, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data2, buf)
+	_, err = os.Stat(replica.blockPath(bID2))
+	require.True(t, os.IsNotExist(err))
+
+	// Remove the block from the delegate; a second replica for the
+	// same user sharing the same cache dir should still be able to
+	// read it.
+	_, err = delegate.RemoveBlockReferences(
+		ctx, tlfID, map[BlockID][]BlockContext{bID: {bCtx}})
+	require.NoError(t, err)
+
+	replica2 := NewBlockServerReadReplica(config, cig1, delegate, tempdir,
+		NewDiskLimiterStandard(wallClock{}, "", DiskLimits{}))
+	buf, key, err = replica2.Get(ctx, tlfID, bID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.Equal(t, serverHalf, key)
+
+	// But it's not served for another TLF, or to another user,
+	// both of which have to ask the server.
+	_, _, err = replica2.Get(ctx, tlf.FakeID(2, false), bID, bCtx)
+	require.IsType(t, BServerErrorBlockNonExistent{}, err)
+	cig2 := singleCurrentInfoGetter{name: "u2", uid: keybase1.MakeTestUID(2)}
+	replica3 := NewBlockServerReadReplica(config, cig2, delegate, tempdir,
+		NewDiskLimiterStandard(wallClock{}, "", DiskLimits{}))
+	_, _, err = replica3.Get(ctx, tlfID, bID, bCtx)
+	require.IsType(t, BServerErrorBlockNonExistent{}, err)
+
+	// A corrupted cache entry is ignored.
+	err = ioutil.WriteFile(replica.blockPath(bID), []byte{5, 6}, 0600)
+	require.NoError(t, err)
+	_, _, err = replica.Get(ctx, tlfID, bID, bCtx)
+	require.IsType(t, BServerErrorBlockNonExistent{}, err)
+}
+
+func TestBlockServerReadReplicaRejectsWrites(t *testing.T) {
+	ctx := context.Background()
+	config := newTestBlockServerLocalConfig(t)
+	delegate := NewBlockServerMemory(config)
+	defer delegate.Shutdown()
+
+	replica := NewBlockServerReadReplica(config,
+		singleCurrentInfoGetter{}, delegate, "",
+		NewDiskLimiterStandard(wallClock{}, "", DiskLimits{}))
+
+	tlfID := tlf.FakeID(1, false)
+	data := []byte{1, 2, 3, 4}
+	bID, err := config.cryptoPure().MakePermanentBlockID(data)
+	require.NoError(t, err)
+	bCtx := BlockContext{keybase1.MakeTestUID(1), "", ZeroBlockRefNonce}
+	serverHalf, err := config.cryptoPure().MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+
+	err = replica.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	require.Equal(t, ReadReplicaError{}, err)
+	err = replica.AddBlockReference(ctx, tlfID, bID, bCtx)
+	require.Equal(t, ReadReplicaError{}, err)
+	_, err = replica.RemoveBlockReferences(
+		ctx, tlfID, map[BlockID][]BlockContext{bID: {bCtx}})
+	require.Equal(t, ReadReplicaError{}, err)
+	err = replica.ArchiveBlockReferences(
+		ctx, tlfID, map[BlockID][]BlockContext{bID: {bCtx}})
+	require.Equal(t, ReadReplicaError{}, err)
+}
@@ -6,9 +6,9 @@ package libkbfs
 
 import (
 	"errors"
+	"sync"
 	"time"
 
-	"github.com/cenkalti/backoff"
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -35,6 +35,12 @@ type BlockServerRemote struct {
 	log        logger.Logger
 	deferLog   logger.Logger
 	blkSrvAddr string
+	// retrier is shared by the put and get clients, so that they
+	// back off from the server together.
+	retrier *serverRetrier
+	// scheduler decides which requests go to the server first,
+	// across both clients.
+	scheduler *blockRequestScheduler
 
 	putAuthToken *kbfscrypto.AuthToken
 	getAuthToken *kbfscrypto.AuthToken
@@ -103,24 +109,10 @@ func (b *blockServerRemoteClientHandler) OnDisconnected(ctx context.Context,
 	}
 }
 
-// ShouldRetry implements the ConnectionHandler interface.
+// ShouldRetry implements the ConnectionHandler interface.  RPCs
+// sent through the BlockServerRemote clients are retried by its
+// serverRetrier instead.
 func (b *blockServerRemoteClientHandler) ShouldRetry(rpcName string, err error) bool {
-	//do not let connection.go's DoCommand retry any batch rpcs automatically
-	//because i will manually retry them without successfully completed references
-	switch rpcName {
-	case "keybase.1.block.delReferenceWithCount":
-		return false
-	case "keybase.1.block.archiveReferenceWithCount":
-		return false
-	case "keybase.1.block.archiveReference":
-		return false
-	}
-	if _, ok := err.(BServerErrorThrottle); ok {
-		return true
-	}
-	if quotaErr, ok := err.(BServerErrorOverQuota); ok && quotaErr.Throttled {
-		return true
-	}
 	return false
 }
 
@@ -142,14 +134,18 @@ func NewBlockServerRemote(config Config, blkSrvAddr string, ctx Context) *BlockS
 		log:        log,
 		deferLog:   deferLog,
 		blkSrvAddr: blkSrvAddr,
+		retrier:    newServerRetrier("the block server", config.Clock(), log),
+		scheduler: newBlockRequestScheduler(defaultBlockServerMaxInFlight,
+			defaultBlockServerForegroundReserve),
 	}
 	bs.log.Debug("new instance server addr %s", blkSrvAddr)
 
 	// Use two separate auth tokens and clients -- one for writes and
 	// one for reads.  This allows small reads to avoid getting
-	// trapped behind large asynchronous writes.  TODO: use some real
-	// network QoS to achieve better prioritization within the actual
-	// network.
+	// trapped behind large asynchronous writes.  Beyond that,
+	// b.scheduler orders requests by priority, and the priority is
+	// passed on to the server.  TODO: use some real network QoS to
+	// achieve better prioritization within the actual network.
 	putClientHandler := &blockServerRemoteClientHandler{
 		bs:   bs,
 		name: "BlockServerRemotePut",
@@ -173,7 +169,11 @@ func NewBlockServerRemote(config Config, blkSrvAddr string, ctx Context) *BlockS
 		false, /* connect only on-demand */
 		ctx.NewRPCLogFactory(), libkb.WrapError, config.MakeLogger(""),
 		LogTagsFromContext)
-	bs.putClient = keybase1.BlockClient{Cli: putConn.GetClient()}
+	bs.putClient = keybase1.BlockClient{Cli: serverRetryClient{
+		retrier: bs.retrier,
+		client:  putConn.GetClient(),
+		modes:   bServerRetryModes,
+	}}
 	putClientHandler.client = bs.putClient
 	getConn := rpc.NewTLSConnection(blkSrvAddr,
 		kbfscrypto.GetRootCerts(blkSrvAddr),
@@ -181,7 +181,11 @@ func NewBlockServerRemote(config Config, blkSrvAddr string, ctx Context) *BlockS
 		false, /* connect only on-demand */
 		ctx.NewRPCLogFactory(), libkb.WrapError, config.MakeLogger(""),
 		LogTagsFromContext)
-	bs.getClient = keybase1.BlockClient{Cli: getConn.GetClient()}
+	bs.getClient = keybase1.BlockClient{Cli: serverRetryClient{
+		retrier: bs.retrier,
+		client:  getConn.GetClient(),
+		modes:   bServerRetryModes,
+	}}
 	getClientHandler.client = bs.getClient
 
 	bs.shutdownFn = func() {
@@ -202,6 +206,9 @@ func newBlockServerRemoteWithClient(config Config,
 		getClient: client,
 		log:       log,
 		deferLog:  deferLog,
+		retrier:   newServerRetrier("the block server", config.Clock(), log),
+		scheduler: newBlockRequestScheduler(defaultBlockServerMaxInFlight,
+			defaultBlockServerForegroundReserve),
 	}
 	return bs
 }
@@ -284,30 +291,54 @@ func makeBlockReference(id BlockID, context BlockContext) keybase1.BlockReferenc
 	}
 }
 
+// startRequest waits until the scheduler lets a request go to the
+// server, at the priority set in ctx or at defaultPriority.  It
+// returns the context to send the request with, which tells the
+// server the priority, and a function to call once the request is
+// done.
+func (b *BlockServerRemote) startRequest(ctx context.Context,
+	defaultPriority BlockPriority) (context.Context, func(), error) {
+	priority := blockPriorityFromContext(ctx, defaultPriority)
+	done, err := b.scheduler.acquire(ctx, priority)
+	if err != nil {
+		return nil, nil, err
+	}
+	return withBlockPriorityRPCTag(ctx, priority), done, nil
+}
+
 // Get implements the BlockServer interface for BlockServerRemote.
 func (b *BlockServerRemote) Get(ctx context.Context, tlfID tlf.ID, id BlockID,
 	context BlockContext) (
 	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
 	var err error
 	size := -1
+	priority := blockPriorityFromContext(ctx, BlockPriorityForegroundRead)
 	defer func() {
 		if err != nil {
 			b.deferLog.CWarningf(
-				ctx, "Get id=%s tlf=%s context=%s sz=%d err=%v",
-				id, tlfID, context, size, err)
+				ctx, "Get id=%s tlf=%s context=%s pri=%s sz=%d err=%v",
+				id, tlfID, context, priority, size, err)
 		} else {
 			b.deferLog.CDebugf(
-				ctx, "Get id=%s tlf=%s context=%s sz=%d",
-				id, tlfID, context, size)
+				ctx, "Get id=%s tlf=%s context=%s pri=%s sz=%d",
+				id, tlfID, context, priority, size)
 		}
 	}()
 
+	rpcCtx, done, err := b.startRequest(ctx, BlockPriorityForegroundRead)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	defer done()
+
 	arg := keybase1.GetBlockArg{
 		Bid:    makeBlockIDCombo(id, context),
 		Folder: tlfID.String(),
 	}
 
-	res, err := b.getClient.GetBlock(ctx, arg)
+	finish := b.config.Tracer().StartSpan(ctx, "BlockServer.GetBlock")
+	res, err := b.getClient.GetBlock(rpcCtx, arg)
+	finish(err)
 	if err != nil {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
 	}
@@ -326,18 +357,25 @@ func (b *BlockServerRemote) Put(ctx context.Context, tlfID tlf.ID, id BlockID,
 	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
 	var err error
 	size := len(buf)
+	priority := blockPriorityFromContext(ctx, BlockPriorityForegroundWrite)
 	defer func() {
 		if err != nil {
 			b.deferLog.CWarningf(
-				ctx, "Put id=%s tlf=%s context=%s sz=%d err=%v",
-				id, tlfID, context, size, err)
+				ctx, "Put id=%s tlf=%s context=%s pri=%s sz=%d err=%v",
+				id, tlfID, context, priority, size, err)
 		} else {
 			b.deferLog.CDebugf(
-				ctx, "Put id=%s tlf=%s context=%s sz=%d",
-				id, tlfID, context, size)
+				ctx, "Put id=%s tlf=%s context=%s pri=%s sz=%d",
+				id, tlfID, context, priority, size)
 		}
 	}()
 
+	rpcCtx, done, err := b.startRequest(ctx, BlockPriorityForegroundWrite)
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	arg := keybase1.PutBlockArg{
 		Bid: makeBlockIDCombo(id, context),
 		// BlockKey is misnamed -- it contains just the server
@@ -348,7 +386,31 @@ func (b *BlockServerRemote) Put(ctx context.Context, tlfID tlf.ID, id BlockID,
 	}
 
 	// Handle OverQuota errors at the caller
-	return b.putClient.PutBlock(ctx, arg)
+	finish := b.config.Tracer().StartSpan(ctx, "BlockServer.PutBlock")
+	err = b.putClient.PutBlock(rpcCtx, arg)
+	finish(err)
+	return err
+}
+
+// PutBlocks implements the BlockServer interface for
+// BlockServerRemote.  The block server protocol doesn't have a batch
+// put RPC yet, so the puts are all sent at once over the put
+// connection.  That's no better than doBlockPuts's own parallel
+// puts, so BlockServerRemote doesn't implement blockPutBatcher.
+func (b *BlockServerRemote) PutBlocks(ctx context.Context, tlfID tlf.ID,
+	puts []BlockPut) []error {
+	errs := make([]error, len(puts))
+	var wg sync.WaitGroup
+	wg.Add(len(puts))
+	for i, put := range puts {
+		go func(i int, put BlockPut) {
+			defer wg.Done()
+			errs[i] = b.Put(ctx, tlfID, put.ID, put.Context, put.Buf,
+				put.ServerHalf)
+		}(i, put)
+	}
+	wg.Wait()
+	return errs
 }
 
 // AddBlockReference implements the BlockServer interface for BlockServerRemote
@@ -367,11 +429,20 @@ func (b *BlockServerRemote) AddBlockReference(ctx context.Context, tlfID tlf.ID,
 		}
 	}()
 
+	rpcCtx, done, err := b.startRequest(ctx, BlockPriorityForegroundWrite)
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	// Handle OverQuota errors at the caller
-	return b.putClient.AddReference(ctx, keybase1.AddReferenceArg{
+	finish := b.config.Tracer().StartSpan(ctx, "BlockServer.AddReference")
+	err = b.putClient.AddReference(rpcCtx, keybase1.AddReferenceArg{
 		Ref:    makeBlockReference(id, context),
 		Folder: tlfID.String(),
 	})
+	finish(err)
+	return err
 }
 
 // RemoveBlockReferences implements the BlockServer interface for
@@ -427,17 +498,26 @@ func (b *BlockServerRemote) batchDowngradeReferences(ctx context.Context,
 	doneRefs = make(map[BlockID]map[BlockRefNonce]int)
 	notDone := b.getNotDone(contexts, doneRefs)
 
-	throttleErr := backoff.Retry(func() error {
+	rpcCtx, done, err := b.startRequest(ctx, BlockPriorityForegroundWrite)
+	if err != nil {
+		return doneRefs, err
+	}
+	defer done()
+
+	// Only the references that aren't done yet are sent each
+	// time, so it's safe to retry after any retryable error.  The
+	// RPCs themselves go through b.retrier's circuit breaker.
+	finalError = b.retrier.retry(ctx, "batchDowngradeReferences", serverRetryAll, func() error {
 		var res keybase1.DowngradeReferenceRes
 		var err error
 		if archive {
-			res, err = b.putClient.ArchiveReferenceWithCount(ctx,
+			res, err = b.putClient.ArchiveReferenceWithCount(rpcCtx,
 				keybase1.ArchiveReferenceWithCountArg{
 					Refs:   notDone,
 					Folder: tlfID.String(),
 				})
 		} else {
-			res, err = b.putClient.DelReferenceWithCount(ctx,
+			res, err = b.putClient.DelReferenceWithCount(rpcCtx,
 				keybase1.DelReferenceWithCountArg{
 					Refs:   notDone,
 					Folder: tlfID.String(),
@@ -469,30 +549,8 @@ func (b *BlockServerRemote) batchDowngradeReferences(ctx context.Context,
 		// update the list of references to downgrade
 		notDone = b.getNotDone(contexts, doneRefs)
 
-		//if context is cancelled, return immediately
-		select {
-		case <-ctx.Done():
-			finalError = ctx.Err()
-			return nil
-		default:
-		}
-
-		// check whether to backoff and retry
-		if err != nil {
-			// if error is of type throttle, retry
-			if _, ok := err.(BServerErrorThrottle); ok {
-				return err
-			}
-			// non-throttle error, do not retry here
-			finalError = err
-		}
-		return nil
-	}, backoff.NewExponentialBackOff())
-
-	// if backoff has given up retrying, return error
-	if throttleErr != nil {
-		return doneRefs, throttleErr
-	}
+		return err
+	})
 
 	if finalError == nil {
 		if len(notDone) != 0 {
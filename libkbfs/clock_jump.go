@@ -0,0 +1,70 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// clockJumpCheckInterval is how often KBFSOpsStandard checks
+	// the clock for jumps.
+	clockJumpCheckInterval = 1 * time.Minute
+	// clockJumpThreshold is how far off from clockJumpCheckInterval
+	// the time between two checks has to be before we assume the
+	// device was asleep (or its clock was changed), and that any
+	// cached MD heads might be stale.
+	clockJumpThreshold = 5 * time.Minute
+
+	clockJumpMetricsPrefix = "ClockJump."
+	// clockJumpDetectedMetric counts the detected clock jumps.
+	clockJumpDetectedMetric = clockJumpMetricsPrefix + "Detected"
+	// clockJumpStaleServesAvoidedMetric counts the heads that were
+	// found to be stale when revalidated after a clock jump, each
+	// of which would otherwise have been served until the next
+	// update notification.
+	clockJumpStaleServesAvoidedMetric = clockJumpMetricsPrefix +
+		"StaleServesAvoided"
+)
+
+// clockJumpDetector notices when the wall clock moves much more or
+// much less than expected between two checks, which usually means
+// the device was suspended in between.
+type clockJumpDetector struct {
+	clock    Clock
+	interval time.Duration
+	last     time.Time
+}
+
+func newClockJumpDetector(
+	clock Clock, interval time.Duration) *clockJumpDetector {
+	d := &clockJumpDetector{clock: clock, interval: interval}
+	d.last = d.now()
+	return d
+}
+
+func (d *clockJumpDetector) now() time.Time {
+	// Strip any monotonic clock reading, since the monotonic
+	// clock may not advance while the device is asleep.
+	return d.clock.Now().Round(0)
+}
+
+// check should be called once every interval.  It returns how far
+// the clock jumped since the last check, and whether that is more
+// than clockJumpThreshold in either direction.
+func (d *clockJumpDetector) check() (time.Duration, bool) {
+	now := d.now()
+	jump := now.Sub(d.last) - d.interval
+	d.last = now
+	return jump, jump > clockJumpThreshold || jump < -clockJumpThreshold
+}
+
+func recordClockJumpMetric(registry metrics.Registry, name string) {
+	if registry != nil {
+		metrics.GetOrRegisterCounter(name, registry).Inc(1)
+	}
+}
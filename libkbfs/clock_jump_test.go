@@ -0,0 +1,42 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClockJumpDetector(t *testing.T) {
+	clock := newTestClockNow()
+	interval := time.Minute
+	d := newClockJumpDetector(clock, interval)
+
+	// Checks on time, or a little late, aren't jumps.
+	clock.Add(interval)
+	_, ok := d.check()
+	require.False(t, ok)
+	clock.Add(interval + clockJumpThreshold)
+	_, ok = d.check()
+	require.False(t, ok)
+
+	// A long sleep is.
+	clock.Add(interval + 48*time.Hour)
+	jump, ok := d.check()
+	require.True(t, ok)
+	require.Equal(t, 48*time.Hour, jump)
+
+	// So is the clock being set back.
+	clock.Add(-clockJumpThreshold - time.Second)
+	jump, ok = d.check()
+	require.True(t, ok)
+	require.Equal(t, -clockJumpThreshold-time.Second-interval, jump)
+
+	clock.Add(interval)
+	_, ok = d.check()
+	require.False(t, ok)
+}
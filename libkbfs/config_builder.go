@@ -0,0 +1,349 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+)
+
+// InvalidConfigError indicates that a ConfigBuilder was given a
+// parameter, or combination of parameters, that can't be used to
+// construct a working Config.
+type InvalidConfigError struct {
+	Param  string
+	Reason string
+}
+
+// Error implements the error interface for InvalidConfigError.
+func (e InvalidConfigError) Error() string {
+	return fmt.Sprintf("Invalid config parameter %s: %s", e.Param, e.Reason)
+}
+
+// ConfigBuilder constructs a Config for programs that embed KBFS
+// without going through the kbfsfuse/kbfsdokan flag parsing.  Each
+// With* method returns the builder so that calls can be chained;
+// Build validates the accumulated parameters and returns the Config.
+// Unset parameters keep the defaults from DefaultInitParams.
+//
+// Unlike Init, Build does not install a signal handler or start CPU
+// profiling; those remain the responsibility of the embedding
+// program.
+type ConfigBuilder struct {
+	ctx              Context
+	params           InitParams
+	keybaseServiceCn KeybaseServiceCn
+	log              logger.Logger
+}
+
+// NewConfigBuilder returns a ConfigBuilder seeded with the default
+// init params for the run mode of the given context.
+func NewConfigBuilder(ctx Context) *ConfigBuilder {
+	return &ConfigBuilder{
+		ctx:    ctx,
+		params: DefaultInitParams(ctx),
+	}
+}
+
+// NewConfigBuilderFromParams returns a ConfigBuilder seeded with the
+// given init params, e.g. as returned by AddFlags.
+func NewConfigBuilderFromParams(
+	ctx Context, params InitParams) *ConfigBuilder {
+	return &ConfigBuilder{
+		ctx:    ctx,
+		params: params,
+	}
+}
+
+// WithDebug turns debug logging on or off.
+func (b *ConfigBuilder) WithDebug(debug bool) *ConfigBuilder {
+	b.params.Debug = debug
+	return b
+}
+
+// WithLogger sets the logger used while constructing the Config.  If
+// not set, one is created via InitLog.
+func (b *ConfigBuilder) WithLogger(log logger.Logger) *ConfigBuilder {
+	b.log = log
+	return b
+}
+
+// WithRemoteServers points the Config at the given remote block and
+// metadata servers, given as host:port.
+func (b *ConfigBuilder) WithRemoteServers(
+	bserverAddr, mdserverAddr string) *ConfigBuilder {
+	b.params.BServerAddr = bserverAddr
+	b.params.MDServerAddr = mdserverAddr
+	b.params.ServerInMemory = false
+	b.params.ServerRootDir = ""
+	return b
+}
+
+// WithInMemoryServers makes the Config use local in-memory servers,
+// acting as the given local user.
+func (b *ConfigBuilder) WithInMemoryServers(localUser string) *ConfigBuilder {
+	b.params.ServerInMemory = true
+	b.params.ServerRootDir = ""
+	b.params.LocalUser = localUser
+	return b
+}
+
+// WithServerRootDir makes the Config use local on-disk servers
+// storing their data under the given directory, acting as the given
+// local user.
+func (b *ConfigBuilder) WithServerRootDir(
+	dir, localUser string) *ConfigBuilder {
+	b.params.ServerInMemory = false
+	b.params.ServerRootDir = dir
+	b.params.LocalUser = localUser
+	return b
+}
+
+// WithJournalRoot sets the directory in which write journals are
+// kept.  An empty string disables journaling.
+func (b *ConfigBuilder) WithJournalRoot(
+	dir string, bws TLFJournalBackgroundWorkStatus) *ConfigBuilder {
+	b.params.WriteJournalRoot = dir
+	b.params.TLFJournalBackgroundWorkStatus = bws
+	return b
+}
+
+// WithJournalLimits sets the limits on the disk space used by each
+// TLF's write journal.
+func (b *ConfigBuilder) WithJournalLimits(
+	limits TLFJournalLimits) *ConfigBuilder {
+	b.params.TLFJournalLimits = limits
+	return b
+}
+
+// WithDiskLimits sets the limits on the combined disk space used by
+// all the local stores.
+func (b *ConfigBuilder) WithDiskLimits(limits DiskLimits) *ConfigBuilder {
+	b.params.DiskLimits = limits
+	return b
+}
+
+// WithMetadataVersion sets the metadata version used when creating
+// new metadata.
+func (b *ConfigBuilder) WithMetadataVersion(ver MetadataVer) *ConfigBuilder {
+	b.params.MetadataVersion = int(ver)
+	return b
+}
+
+// WithTLFValidDuration sets how long TLFs stay valid before they are
+// marked for lazy re-identification.
+func (b *ConfigBuilder) WithTLFValidDuration(d time.Duration) *ConfigBuilder {
+	b.params.TLFValidDuration = d
+	return b
+}
+
+// WithMDCacheCapacity sets the number of entries in the MD, key and
+// key bundle caches.
+func (b *ConfigBuilder) WithMDCacheCapacity(capacity int) *ConfigBuilder {
+	b.params.MDCacheCapacity = capacity
+	return b
+}
+
+// WithBlockCacheCapacity sets the number of transient entries, and
+// the total number of bytes, allowed in the clean block cache.
+func (b *ConfigBuilder) WithBlockCacheCapacity(
+	capacity int, bytesCapacity uint64) *ConfigBuilder {
+	b.params.BlockCacheCapacity = capacity
+	b.params.BlockCacheBytesCapacity = bytesCapacity
+	return b
+}
+
+// WithReadReplica makes the Config a read replica, which rejects all
+// writes, doesn't journal, polls for new TLF heads at the given
+// interval, and caches fetched blocks in the given directory (which
+// may be shared with other replicas running as the same local user).
+// An empty cacheDir uses a directory under the data dir.
+func (b *ConfigBuilder) WithReadReplica(
+	pollInterval time.Duration, cacheDir string) *ConfigBuilder {
+	b.params.ReadReplicaPollInterval = pollInterval
+	b.params.ReadReplicaCacheDir = cacheDir
+	return b
+}
+
+// WithBandwidthLimits caps the rate of background traffic in each
+// direction.
+func (b *ConfigBuilder) WithBandwidthLimits(
+	limits BandwidthLimits) *ConfigBuilder {
+	b.params.BandwidthLimits = limits
+	return b
+}
+
+// WithStrictTimes makes file mtimes and ctimes change on every
+// write, rather than on every sync.
+func (b *ConfigBuilder) WithStrictTimes(strictTimes bool) *ConfigBuilder {
+	b.params.StrictTimes = strictTimes
+	return b
+}
+
+// WithLowMemoryMode makes KBFS keep its memory usage down at the
+// cost of performance, e.g. when embedded in a mobile app.
+func (b *ConfigBuilder) WithLowMemoryMode(lowMemory bool) *ConfigBuilder {
+	b.params.LowMemoryMode = lowMemory
+	return b
+}
+
+// WithCaseInsensitive makes lookups and creates match names
+// case-insensitively.
+func (b *ConfigBuilder) WithCaseInsensitive(
+	caseInsensitive bool) *ConfigBuilder {
+	b.params.CaseInsensitive = caseInsensitive
+	return b
+}
+
+// WithNormalizeNames makes new entries be stored under the NFC forms
+// of their names, and lookups match names in either form.
+func (b *ConfigBuilder) WithNormalizeNames(
+	normalizeNames bool) *ConfigBuilder {
+	b.params.NormalizeNames = normalizeNames
+	return b
+}
+
+// WithEncryptLocalStorage makes new write journals seal their block
+// data with per-device storage keys.
+func (b *ConfigBuilder) WithEncryptLocalStorage(
+	encryptLocalStorage bool) *ConfigBuilder {
+	b.params.EncryptLocalStorage = encryptLocalStorage
+	return b
+}
+
+// WithKeybaseServiceCn sets the constructor used for the Keybase
+// service and crypto implementations.  If not set, the default RPC
+// implementation is used.
+func (b *ConfigBuilder) WithKeybaseServiceCn(
+	kbCn KeybaseServiceCn) *ConfigBuilder {
+	b.keybaseServiceCn = kbCn
+	return b
+}
+
+// WithStandalone makes the Config run without a Keybase service,
+// using the users and keys in the given StandaloneKeybaseServiceCn.
+// Unless in-memory servers or a server root dir have been chosen, it
+// also makes the Config use on-disk servers that keep their data in
+// the kbfs_servers directory under the context's data dir, so that
+// everything written survives a restart.
+func (b *ConfigBuilder) WithStandalone(
+	s StandaloneKeybaseServiceCn) *ConfigBuilder {
+	b.keybaseServiceCn = s
+	b.params.LocalUser = ""
+	if !b.params.ServerInMemory && len(b.params.ServerRootDir) == 0 {
+		b.params.ServerRootDir = filepath.Join(
+			b.ctx.GetDataDir(), "kbfs_servers")
+	}
+	return b
+}
+
+// Validate checks that the accumulated parameters are consistent,
+// returning an InvalidConfigError describing the first problem
+// found.
+func (b *ConfigBuilder) Validate() error {
+	p := b.params
+	localServers := p.ServerInMemory || len(p.ServerRootDir) > 0
+	if p.ServerInMemory && len(p.ServerRootDir) > 0 {
+		return InvalidConfigError{"ServerRootDir",
+			"can't be used together with in-memory servers"}
+	}
+	if len(p.LocalUser) > 0 && !localServers {
+		return InvalidConfigError{"LocalUser",
+			"requires in-memory servers or a server root dir"}
+	}
+	if s, ok := b.keybaseServiceCn.(StandaloneKeybaseServiceCn); ok {
+		if !localServers {
+			return InvalidConfigError{"Standalone",
+				"requires in-memory servers or a server root dir"}
+		}
+		if _, err := s.currentLocalUser(); err != nil {
+			return InvalidConfigError{"Standalone", err.Error()}
+		}
+	}
+	if !localServers {
+		if !p.BServerInMemory && len(p.BServerAddr) == 0 {
+			return InvalidConfigError{"BServerAddr",
+				"no block server address given"}
+		}
+		if !p.MDServerInMemory && len(p.MDServerAddr) == 0 {
+			return InvalidConfigError{"MDServerAddr",
+				"no metadata server address given"}
+		}
+	}
+	ver := MetadataVer(p.MetadataVersion)
+	if ver < FirstValidMetadataVer || ver > SegregatedKeyBundlesVer {
+		return InvalidConfigError{"MetadataVersion",
+			fmt.Sprintf("unknown version %d", p.MetadataVersion)}
+	}
+	if p.TLFValidDuration <= 0 {
+		return InvalidConfigError{"TLFValidDuration", "must be positive"}
+	}
+	if p.TLFJournalLimits.MaxUnflushedBytes < 0 {
+		return InvalidConfigError{"TLFJournalLimits.MaxUnflushedBytes",
+			"must not be negative"}
+	}
+	if p.DiskLimits.MaxFreeSpaceFraction < 0 ||
+		p.DiskLimits.MaxFreeSpaceFraction > 1 {
+		return InvalidConfigError{"DiskLimits.MaxFreeSpaceFraction",
+			"must be between 0 and 1"}
+	}
+	if p.DiskLimits.MaxBytes < 0 {
+		return InvalidConfigError{"DiskLimits.MaxBytes",
+			"must not be negative"}
+	}
+	if p.ReadReplicaPollInterval < 0 {
+		return InvalidConfigError{"ReadReplicaPollInterval",
+			"must not be negative"}
+	}
+	if p.BandwidthLimits.UploadBytesPerSecond < 0 {
+		return InvalidConfigError{"BandwidthLimits.UploadBytesPerSecond",
+			"must not be negative"}
+	}
+	if p.BandwidthLimits.DownloadBytesPerSecond < 0 {
+		return InvalidConfigError{"BandwidthLimits.DownloadBytesPerSecond",
+			"must not be negative"}
+	}
+	if p.MDCacheCapacity < 0 {
+		return InvalidConfigError{"MDCacheCapacity", "must not be negative"}
+	}
+	if p.BlockCacheCapacity < 0 {
+		return InvalidConfigError{"BlockCacheCapacity",
+			"must not be negative"}
+	}
+	if p.BlockCacheCapacity > 0 &&
+		p.BlockCacheBytesCapacity < MaxBlockSizeBytesDefault {
+		return InvalidConfigError{"BlockCacheBytesCapacity",
+			"must hold at least one block"}
+	}
+	return nil
+}
+
+// Build validates the accumulated parameters and constructs the
+// Config.  The caller is responsible for calling Shutdown on it.
+func (b *ConfigBuilder) Build() (Config, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+
+	log := b.log
+	if log == nil {
+		var err error
+		log, err = InitLog(b.params, b.ctx)
+		if log == nil {
+			return nil, err
+		}
+		// Any other InitLog errors are non-fatal, and have
+		// already been logged.
+	}
+
+	config, err := doInit(b.ctx, b.params, b.keybaseServiceCn, log)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testConfigBuilderParams() InitParams {
+	return InitParams{
+		BServerAddr:      "bserver:443",
+		MDServerAddr:     "mdserver:443",
+		TLFValidDuration: tlfValidDurationDefault,
+		MetadataVersion:  int(defaultClientMetadataVer),
+	}
+}
+
+func TestConfigBuilderValidate(t *testing.T) {
+	b := NewConfigBuilderFromParams(nil, testConfigBuilderParams())
+	require.NoError(t, b.Validate())
+
+	b.WithInMemoryServers("alice")
+	require.NoError(t, b.Validate())
+
+	b.WithServerRootDir("/tmp/kbfs", "alice")
+	require.NoError(t, b.Validate())
+
+	b.WithRemoteServers("", "mdserver:443")
+	require.Equal(t, InvalidConfigError{"LocalUser",
+		"requires in-memory servers or a server root dir"}, b.Validate())
+
+	b = NewConfigBuilderFromParams(nil, testConfigBuilderParams()).
+		WithRemoteServers("", "mdserver:443")
+	err := b.Validate()
+	require.IsType(t, InvalidConfigError{}, err)
+	require.Equal(t, "BServerAddr", err.(InvalidConfigError).Param)
+
+	b = NewConfigBuilderFromParams(nil, testConfigBuilderParams()).
+		WithMetadataVersion(SegregatedKeyBundlesVer + 1)
+	err = b.Validate()
+	require.IsType(t, InvalidConfigError{}, err)
+	require.Equal(t, "MetadataVersion", err.(InvalidConfigError).Param)
+
+	b = NewConfigBuilderFromParams(nil, testConfigBuilderParams()).
+		WithTLFValidDuration(-time.Second)
+	err = b.Validate()
+	require.IsType(t, InvalidConfigError{}, err)
+	require.Equal(t, "TLFValidDuration", err.(InvalidConfigError).Param)
+
+	b = NewConfigBuilderFromParams(nil, testConfigBuilderParams()).
+		WithBlockCacheCapacity(100, 1)
+	err = b.Validate()
+	require.IsType(t, InvalidConfigError{}, err)
+	require.Equal(t, "BlockCacheBytesCapacity",
+		err.(InvalidConfigError).Param)
+
+	b.WithBlockCacheCapacity(100, MaxBlockSizeBytesDefault*100)
+	require.NoError(t, b.Validate())
+}
@@ -25,10 +25,12 @@ const (
 	maxFileBytesDefault = 2 * 1024 * 1024 * 1024
 	// Max supported size of a directory entry name.
 	maxNameBytesDefault = 255
-	// Maximum supported plaintext size of a directory in KBFS. TODO:
-	// increase this once we support levels of indirection for
-	// directories.
-	maxDirBytesDefault = MaxBlockSizeBytesDefault
+	// Maximum supported plaintext size of a directory in KBFS.
+	maxDirBytesDefault = 1024 * 1024 * 1024
+	// Maximum estimated size of the entries in a single directory
+	// block, past which the directory is split into indirect
+	// blocks.  Leave room for the estimate being off.
+	maxDirBlockBytesDefault = MaxBlockSizeBytesDefault / 2
 	// Default time after setting the rekey bit before prompting for a
 	// paper key.
 	rekeyWithPromptWaitTimeDefault = 10 * time.Minute
@@ -42,6 +44,22 @@ const (
 	qrMinHeadAgeDefault = 5 * time.Minute
 	// tlfValidDurationDefault is the default for tlf validity before redoing identify.
 	tlfValidDurationDefault = 6 * time.Hour
+	// diskLimitFreeSpaceFractionDefault is the default fraction
+	// of the available disk space that the local stores may use.
+	diskLimitFreeSpaceFractionDefault = 0.5
+
+	// The cache sizes used in low-memory mode.  The block cache
+	// holds at most 8MiB of blocks.
+	lowMemoryMDCacheCapacity    = 500
+	lowMemoryBlockCacheCapacity = 1000
+	lowMemoryBlockCacheBytes    = 16 * MaxBlockSizeBytesDefault
+	// lowMemoryMaxParallelBlockPuts caps the number of blocks put
+	// at once in low-memory mode, and with it the size of the
+	// dirty data buffered for a sync.
+	lowMemoryMaxParallelBlockPuts = 10
+	// lowMemoryBlockRetrievalWorkerQueueSize caps the number of
+	// blocks fetched at once in low-memory mode.
+	lowMemoryBlockRetrievalWorkerQueueSize = 10
 )
 
 // ConfigLocal implements the Config interface using purely local
@@ -70,15 +88,48 @@ type ConfigLocal struct {
 	clock       Clock
 	kbpki       KBPKI
 	renamer     ConflictRenamer
+	crStrategy  ConflictResolutionStrategy
+	mountPaths  MountPathTransformer
 	registry    metrics.Registry
+	tracer      *Tracer
+	logControl  *LogControl
 	loggerFn    func(prefix string) logger.Logger
 	noBGFlush   bool // logic opposite so the default value is the common setting
+	strictTimes bool
+	storeSpecs  bool
+	longNames   bool
+	writeHooks  []PostWriteHook
+	caseInsens  bool
+	normNames   bool
+	sealLocal   bool
+	lowMemory   bool
 	rwpWaitTime time.Duration
 
-	maxFileBytes uint64
-	maxNameBytes uint32
-	maxDirBytes  uint64
-	rekeyQueue   RekeyQueue
+	maxFileBytes     uint64
+	maxNameBytes     uint32
+	maxDirBytes      uint64
+	maxDirBlockBytes uint64
+	rekeyQueue       RekeyQueue
+	bwLimiter        BandwidthLimiter
+	diskLimiter      DiskLimiter
+	connectivity     ConnectivityTracker
+
+	// bcacheTuner, if non-nil, adjusts the capacity of bcache
+	// between bcacheTuneMinBytes and bcacheTuneMaxBytes.
+	bcacheTuner        *blockCacheTuner
+	bcacheTuneMinBytes uint64
+	bcacheTuneMaxBytes uint64
+
+	// dirtyMemory limits the memory used by dirty data across all
+	// the dirty block caches.  It's replaced along with the caches.
+	dirtyMemory *dirtyMemoryController
+	// dirtyMemoryHeapTarget, if non-zero, overrides the default
+	// heap size above which dirtyMemory lowers its limit.
+	dirtyMemoryHeapTarget uint64
+
+	// keyHalfAuditor, if non-nil, periodically audits the crypt
+	// key server halves of the favorite TLFs.
+	keyHalfAuditor *keyHalfAuditor
 
 	qrPeriod                       time.Duration
 	qrUnrefAge                     time.Duration
@@ -92,8 +143,15 @@ type ConfigLocal struct {
 	// tlfValidDuration is the time TLFs are valid before redoing identification.
 	tlfValidDuration time.Duration
 
+	// readReplicaPollInterval, if non-zero, puts this config in
+	// read-replica mode.
+	readReplicaPollInterval time.Duration
+
 	// metadataVersion is the version to use when creating new metadata.
 	metadataVersion MetadataVer
+	// blockEncryptionVersion is the version to use when encrypting
+	// new blocks.
+	blockEncryptionVersion EncryptionVer
 }
 
 var _ Config = (*ConfigLocal)(nil)
@@ -216,14 +274,23 @@ func NewConfigLocal() *ConfigLocal {
 	config.SetClock(wallClock{})
 	config.SetReporter(NewReporterSimple(config.Clock(), 10))
 	config.SetConflictRenamer(WriterDeviceDateConflictRenamer{config})
+	config.SetConflictResolutionStrategy(
+		DefaultConflictResolutionStrategy{})
+	config.SetMountPathTransformer(NewMountPathTransformerStandard(""))
 	config.ResetCaches()
 	config.SetCodec(kbfscodec.NewMsgpack())
 	config.SetKeyOps(&KeyOpsStandard{config})
 	config.SetRekeyQueue(NewRekeyQueueStandard(config))
+	config.SetBandwidthLimiter(
+		NewBandwidthLimiterStandard(config.Clock(), BandwidthLimits{}))
+	config.SetDiskLimiter(
+		NewDiskLimiterStandard(config.Clock(), "", DiskLimits{}))
+	config.SetConnectivity(NewConnectivityTrackerStandard(config.Clock()))
 
 	config.maxFileBytes = maxFileBytesDefault
 	config.maxNameBytes = maxNameBytesDefault
 	config.maxDirBytes = maxDirBytesDefault
+	config.maxDirBlockBytes = maxDirBlockBytesDefault
 	config.rwpWaitTime = rekeyWithPromptWaitTimeDefault
 
 	config.delayedCancellationGracePeriod = delayedCancellationGracePeriodDefault
@@ -239,6 +306,7 @@ func NewConfigLocal() *ConfigLocal {
 
 	config.tlfValidDuration = tlfValidDurationDefault
 	config.metadataVersion = defaultClientMetadataVer
+	config.blockEncryptionVersion = EncryptionSecretbox
 
 	return config
 }
@@ -552,6 +620,38 @@ func (c *ConfigLocal) SetConflictRenamer(cr ConflictRenamer) {
 	c.renamer = cr
 }
 
+// ConflictResolutionStrategy implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) ConflictResolutionStrategy() ConflictResolutionStrategy {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.crStrategy
+}
+
+// SetConflictResolutionStrategy implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetConflictResolutionStrategy(
+	s ConflictResolutionStrategy) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.crStrategy = s
+}
+
+// MountPathTransformer implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MountPathTransformer() MountPathTransformer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.mountPaths
+}
+
+// SetMountPathTransformer implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetMountPathTransformer(t MountPathTransformer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.mountPaths = t
+}
+
 // MetadataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) MetadataVersion() MetadataVer {
 	c.lock.RLock()
@@ -568,7 +668,23 @@ func (c *ConfigLocal) SetMetadataVersion(mdVer MetadataVer) {
 
 // DataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) DataVersion() DataVer {
-	return FilesWithHolesDataVer
+	return IndirectDirsDataVer
+}
+
+// BlockEncryptionVersion implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) BlockEncryptionVersion() EncryptionVer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.blockEncryptionVersion
+}
+
+// SetBlockEncryptionVersion implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetBlockEncryptionVersion(ver EncryptionVer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.blockEncryptionVersion = ver
 }
 
 // DoBackgroundFlushes implements the Config interface for ConfigLocal.
@@ -585,6 +701,123 @@ func (c *ConfigLocal) SetDoBackgroundFlushes(doBGFlush bool) {
 	c.noBGFlush = !doBGFlush
 }
 
+// StrictTimes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) StrictTimes() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.strictTimes
+}
+
+// SetStrictTimes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetStrictTimes(strictTimes bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.strictTimes = strictTimes
+}
+
+// StoreSpecialFiles implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) StoreSpecialFiles() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.storeSpecs
+}
+
+// SetStoreSpecialFiles implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetStoreSpecialFiles(storeSpecialFiles bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.storeSpecs = storeSpecialFiles
+}
+
+// LowMemoryMode implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) LowMemoryMode() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.lowMemory
+}
+
+// SetLowMemoryMode implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetLowMemoryMode(lowMemory bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lowMemory = lowMemory
+}
+
+// CaseInsensitive implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) CaseInsensitive() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.caseInsens
+}
+
+// SetCaseInsensitive implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetCaseInsensitive(caseInsensitive bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.caseInsens = caseInsensitive
+}
+
+// NormalizeNames implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) NormalizeNames() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.normNames
+}
+
+// SetNormalizeNames implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetNormalizeNames(normalizeNames bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.normNames = normalizeNames
+}
+
+// EncryptLocalStorage implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) EncryptLocalStorage() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.sealLocal
+}
+
+// SetEncryptLocalStorage implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetEncryptLocalStorage(encryptLocalStorage bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sealLocal = encryptLocalStorage
+}
+
+// LongNameSupport implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) LongNameSupport() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.longNames
+}
+
+// SetLongNameSupport implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetLongNameSupport(longNames bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.longNames = longNames
+}
+
+// PostWriteHooks implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) PostWriteHooks() []PostWriteHook {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.writeHooks
+}
+
+// AddPostWriteHook implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) AddPostWriteHook(hook PostWriteHook) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// Copy the slice, since callers of PostWriteHooks may still
+	// be iterating over the old one.
+	hooks := make([]PostWriteHook, len(c.writeHooks), len(c.writeHooks)+1)
+	copy(hooks, c.writeHooks)
+	c.writeHooks = append(hooks, hook)
+}
+
 // RekeyWithPromptWaitTime implements the Config interface for
 // ConfigLocal.
 func (c *ConfigLocal) RekeyWithPromptWaitTime() time.Duration {
@@ -593,11 +826,15 @@ func (c *ConfigLocal) RekeyWithPromptWaitTime() time.Duration {
 
 // DelayedCancellationGracePeriod implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) DelayedCancellationGracePeriod() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	return c.delayedCancellationGracePeriod
 }
 
 // SetDelayedCancellationGracePeriod implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) SetDelayedCancellationGracePeriod(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.delayedCancellationGracePeriod = d
 }
 
@@ -636,14 +873,31 @@ func (c *ConfigLocal) MaxDirBytes() uint64 {
 	return c.maxDirBytes
 }
 
+// MaxDirBlockBytes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxDirBlockBytes() uint64 {
+	return c.maxDirBlockBytes
+}
+
 func (c *ConfigLocal) resetCachesWithoutShutdown() DirtyBlockCache {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	c.mdcache = NewMDCacheStandard(defaultMDCacheCapacity)
-	c.kcache = NewKeyCacheStandard(defaultMDCacheCapacity)
-	c.kbcache = NewKeyBundleCacheStandard(defaultMDCacheCapacity * 2)
+	mdCacheCapacity := defaultMDCacheCapacity
 	// Limit the block cache to 10K entries or 1024 blocks (currently 512MiB)
-	c.bcache = NewBlockCacheStandard(10000, MaxBlockSizeBytesDefault*1024)
+	bcacheCapacity, bcacheBytes := 10000, uint64(MaxBlockSizeBytesDefault*1024)
+	putsCapacity := maxParallelBlockPuts
+	if c.lowMemory {
+		mdCacheCapacity = lowMemoryMDCacheCapacity
+		bcacheCapacity = lowMemoryBlockCacheCapacity
+		bcacheBytes = lowMemoryBlockCacheBytes
+		putsCapacity = lowMemoryMaxParallelBlockPuts
+	}
+	c.mdcache = NewMDCacheStandard(mdCacheCapacity)
+	c.kcache = NewKeyCacheStandard(mdCacheCapacity)
+	c.kbcache = NewKeyBundleCacheStandard(mdCacheCapacity * 2)
+	c.bcache = NewBlockCacheStandard(bcacheCapacity, bcacheBytes)
+	if c.bcacheTuner != nil {
+		c.startBlockCacheTunerLocked()
+	}
 	oldDirtyBcache := c.dirtyBcache
 
 	// TODO: we should probably fail or re-schedule this reset if
@@ -665,14 +919,23 @@ func (c *ConfigLocal) resetCachesWithoutShutdown() DirtyBlockCache {
 	// the dirty block cache (to around 100MB with the current
 	// defaults).
 	maxSyncBufferSize :=
-		int64(MaxBlockSizeBytesDefault * maxParallelBlockPuts * 2)
+		int64(MaxBlockSizeBytesDefault * putsCapacity * 2)
 
 	// Start off conservatively to avoid getting immediate timeouts on
 	// slow connections.
 	startSyncBufferSize := minSyncBufferSize
 
-	c.dirtyBcache = NewDirtyBlockCacheStandard(c.clock, c.MakeLogger,
+	// All the dirty block caches share one limit on the memory used
+	// by their dirty data.  At most, it's what used to be the fixed
+	// limit of the sync cache: twice the max sync buffer size.
+	c.dirtyMemory = newDirtyMemoryController(c.clock, c.MakeLogger,
+		4*minSyncBufferSize, 2*maxSyncBufferSize,
+		c.dirtyMemoryHeapTargetLocked())
+
+	dirtyBcache := NewDirtyBlockCacheStandard(c.clock, c.MakeLogger,
 		minSyncBufferSize, maxSyncBufferSize, startSyncBufferSize)
+	dirtyBcache.useMemoryController(c.dirtyMemory)
+	c.dirtyBcache = dirtyBcache
 	return oldDirtyBcache
 }
 
@@ -716,34 +979,237 @@ func (c *ConfigLocal) SetLoggerMaker(
 
 // MetricsRegistry implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) MetricsRegistry() metrics.Registry {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	return c.registry
 }
 
+// Tracer implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) Tracer() *Tracer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tracer
+}
+
+// SetTracer implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetTracer(t *Tracer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tracer = t
+}
+
+// LogControl implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) LogControl() *LogControl {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.logControl
+}
+
+// SetLogControl implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetLogControl(lc *LogControl) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.logControl = lc
+}
+
 // SetRekeyQueue implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) SetRekeyQueue(r RekeyQueue) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.rekeyQueue = r
 }
 
 // RekeyQueue implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) RekeyQueue() RekeyQueue {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	return c.rekeyQueue
 }
 
+// BandwidthLimiter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BandwidthLimiter() BandwidthLimiter {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.bwLimiter
+}
+
+// SetBandwidthLimiter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetBandwidthLimiter(l BandwidthLimiter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bwLimiter = l
+}
+
+// DiskLimiter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DiskLimiter() DiskLimiter {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.diskLimiter
+}
+
+// SetDiskLimiter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetDiskLimiter(l DiskLimiter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.diskLimiter = l
+}
+
+// Connectivity implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) Connectivity() ConnectivityTracker {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.connectivity
+}
+
+// SetConnectivity implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetConnectivity(ct ConnectivityTracker) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.connectivity = ct
+}
+
+// enableBlockCacheTuning starts automatically tuning the byte
+// capacity of the clean block cache between the given bounds.  It
+// must be called before the block cache is wrapped by the journal
+// server.
+func (c *ConfigLocal) enableBlockCacheTuning(minBytes, maxBytes uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bcacheTuneMinBytes = minBytes
+	c.bcacheTuneMaxBytes = maxBytes
+	c.startBlockCacheTunerLocked()
+}
+
+// startBlockCacheTunerLocked (re)starts the tuner for the current
+// block cache.
+func (c *ConfigLocal) startBlockCacheTunerLocked() {
+	if c.bcacheTuner != nil {
+		c.bcacheTuner.shutdown()
+		c.bcacheTuner = nil
+	}
+	bcache, ok := c.bcache.(*BlockCacheStandard)
+	if !ok {
+		return
+	}
+	var log logger.Logger = logger.NewNull()
+	if c.loggerFn != nil {
+		log = c.loggerFn("BCT")
+	}
+	c.bcacheTuner = newBlockCacheTuner(bcache, c.clock, log,
+		c.bcacheTuneMinBytes, c.bcacheTuneMaxBytes)
+	go c.bcacheTuner.run()
+}
+
+// BlockCacheTuningStatus implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) BlockCacheTuningStatus() *BlockCacheTuningStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.bcacheTuner == nil {
+		return nil
+	}
+	status := c.bcacheTuner.getStatus()
+	return &status
+}
+
+func (c *ConfigLocal) dirtyMemoryHeapTargetLocked() uint64 {
+	switch {
+	case c.dirtyMemoryHeapTarget != 0:
+		return c.dirtyMemoryHeapTarget
+	case c.lowMemory:
+		return lowMemoryDirtyMemoryHeapTarget
+	default:
+		return dirtyMemoryHeapTargetDefault
+	}
+}
+
+// setDirtyMemoryHeapTarget sets the heap size above which the limit
+// on dirty memory is lowered.
+func (c *ConfigLocal) setDirtyMemoryHeapTarget(target uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dirtyMemoryHeapTarget = target
+	if c.dirtyMemory != nil {
+		c.dirtyMemory.setHeapTarget(c.dirtyMemoryHeapTargetLocked())
+	}
+}
+
+// DirtyMemoryStatus implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DirtyMemoryStatus() *DirtyMemoryStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.dirtyMemory == nil {
+		return nil
+	}
+	status := c.dirtyMemory.getStatus()
+	return &status
+}
+
+// enableKeyHalfAudits starts auditing the crypt key server halves of
+// the favorite TLFs at the given interval.
+func (c *ConfigLocal) enableKeyHalfAudits(interval time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.keyHalfAuditor != nil {
+		c.keyHalfAuditor.shutdown()
+	}
+	var log logger.Logger = logger.NewNull()
+	if c.loggerFn != nil {
+		log = c.loggerFn("KHA")
+	}
+	c.keyHalfAuditor = newKeyHalfAuditor(c, log, interval)
+	go c.keyHalfAuditor.run()
+}
+
+// KeyHalfHealth implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) KeyHalfHealth() (
+	*KeyHalfHealthStatus, <-chan StatusUpdate) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.keyHalfAuditor == nil {
+		return nil, nil
+	}
+	status, ch := c.keyHalfAuditor.getStatus()
+	return &status, ch
+}
+
 // SetMetricsRegistry implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) SetMetricsRegistry(r metrics.Registry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.registry = r
 }
 
 // SetTLFValidDuration implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) SetTLFValidDuration(r time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.tlfValidDuration = r
 }
 
 // TLFValidDuration implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) TLFValidDuration() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	return c.tlfValidDuration
 }
 
+// SetReadReplicaPollInterval implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetReadReplicaPollInterval(r time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readReplicaPollInterval = r
+}
+
+// ReadReplicaPollInterval implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) ReadReplicaPollInterval() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.readReplicaPollInterval
+}
+
 // Shutdown implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) Shutdown() error {
 	c.RekeyQueue().Clear()
@@ -800,6 +1266,18 @@ func (c *ConfigLocal) Shutdown() error {
 	c.BlockServer().Shutdown()
 	c.Crypto().Shutdown()
 	c.Reporter().Shutdown()
+	func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.bcacheTuner != nil {
+			c.bcacheTuner.shutdown()
+			c.bcacheTuner = nil
+		}
+		if c.keyHalfAuditor != nil {
+			c.keyHalfAuditor.shutdown()
+			c.keyHalfAuditor = nil
+		}
+	}()
 	err = c.DirtyBlockCache().Shutdown()
 	if err != nil {
 		errors = append(errors, err)
@@ -816,6 +1294,11 @@ func (c *ConfigLocal) Shutdown() error {
 
 // CheckStateOnShutdown implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) CheckStateOnShutdown() bool {
+	// The state checker needs all the configs of the test that
+	// made this one.
+	if c.allKnownConfigsForTesting == nil {
+		return false
+	}
 	if md, ok := c.MDServer().(mdServerLocal); ok {
 		return !md.isShutdown()
 	}
@@ -841,10 +1324,13 @@ func (c *ConfigLocal) journalizeBcaches() error {
 	// there's no need for an adaptive sync buffer size, so we
 	// always set the min and max to the same thing.
 	maxSyncBufferSize :=
-		int64(MaxBlockSizeBytesDefault * maxParallelBlockPuts * 2)
+		int64(MaxBlockSizeBytesDefault * maxParallelBlockPutsForConfig(c) * 2)
 	journalCache := NewDirtyBlockCacheStandard(c.clock, c.MakeLogger,
 		maxSyncBufferSize, maxSyncBufferSize, maxSyncBufferSize)
 	journalCache.name = "journal"
+	if syncCache.memory != nil {
+		journalCache.useMemoryController(syncCache.memory)
+	}
 	c.SetDirtyBlockCache(jServer.dirtyBlockCache(journalCache))
 
 	jServer.delegateBlockCache = c.BlockCache()
@@ -867,12 +1353,15 @@ func (c *ConfigLocal) EnableJournaling(
 	// TODO: Sanity-check the root directory, e.g. create
 	// it if it doesn't exist, make sure that it doesn't
 	// point to /keybase itself, etc.
-	log := c.MakeLogger("")
+	log := c.MakeLogger("JS")
 	branchListener := c.KBFSOps().(branchChangeListener)
 	flushListener := c.KBFSOps().(mdFlushListener)
 	jServer = makeJournalServer(c, log, journalRoot, c.BlockCache(),
 		c.DirtyBlockCache(), c.BlockServer(), c.MDOps(), branchListener,
 		flushListener)
+	// Only the unflushed block data counts against the disk
+	// limits, since that's what grows while disconnected.
+	c.DiskLimiter().RegisterStore("journal", jServer.getUnflushedBytes)
 	ctx := context.Background()
 	uid, key, err := getCurrentUIDAndVerifyingKey(ctx, c.KBPKI())
 	if err != nil {
@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"math"
 	"time"
 
 	"github.com/golang/mock/gomock"
@@ -107,6 +108,9 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.mockKserv = NewMockKeyServer(c)
 	config.SetKeyServer(config.mockKserv)
 	config.mockBserv = NewMockBlockServer(c)
+	// By default, the user has unlimited quota.
+	config.mockBserv.EXPECT().GetUserQuotaInfo(gomock.Any()).AnyTimes().
+		Return(&UserQuotaInfo{Limit: math.MaxInt64}, nil)
 	config.SetBlockServer(config.mockBserv)
 	config.mockBsplit = NewMockBlockSplitter(c)
 	config.SetBlockSplitter(config.mockBsplit)
@@ -116,6 +120,11 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.SetClock(config.mockClock)
 	config.mockRekeyQueue = NewMockRekeyQueue(c)
 	config.SetRekeyQueue(config.mockRekeyQueue)
+	config.SetBandwidthLimiter(
+		NewBandwidthLimiterStandard(wallClock{}, BandwidthLimits{}))
+	config.SetDiskLimiter(
+		NewDiskLimiterStandard(wallClock{}, "", DiskLimits{}))
+	config.SetConnectivity(NewConnectivityTrackerStandard(wallClock{}))
 	config.observer = &FakeObserver{}
 	config.ctr = ctr
 	config.SetLoggerMaker(func(m string) logger.Logger {
@@ -127,7 +136,9 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.maxFileBytes = maxFileBytesDefault
 	config.maxNameBytes = maxNameBytesDefault
 	config.maxDirBytes = maxDirBytesDefault
+	config.maxDirBlockBytes = maxDirBlockBytesDefault
 	config.rwpWaitTime = rekeyWithPromptWaitTimeDefault
+	config.blockEncryptionVersion = EncryptionSecretbox
 
 	config.qrPeriod = 0 * time.Second // no auto reclamation
 	config.qrUnrefAge = qrUnrefAgeDefault
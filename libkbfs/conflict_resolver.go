@@ -66,6 +66,21 @@ type ConflictResolver struct {
 	inputLock    sync.Mutex
 	currInput    conflictInput
 	lockNextTime bool
+
+	stats *crStatsKeeper
+
+	// manualLock protects the manual conflict resolution state
+	// below; see cr_manual.go.
+	manualLock sync.Mutex
+	manual     bool
+	// heldInput is the latest input held back while in manual
+	// mode.
+	heldInput *conflictInput
+	// choices maps the path of each conflict the user has made a
+	// choice for to that choice.
+	choices map[string]ConflictChoice
+	// activeChoices is set while a manual resolution is running.
+	activeChoices *crManualChoices
 }
 
 // NewConflictResolver constructs a new ConflictResolver (and launches
@@ -90,6 +105,7 @@ func NewConflictResolver(
 			unmerged: MetadataRevisionUninitialized,
 			merged:   MetadataRevisionUninitialized,
 		},
+		stats: newCRStatsKeeper(config.MetricsRegistry()),
 	}
 
 	cr.startProcessing(BackgroundContextWithCancellationDelayer())
@@ -188,6 +204,10 @@ func (cr *ConflictResolver) processInput(baseCtx context.Context,
 // numbers, and kicks off the resolution process.
 func (cr *ConflictResolver) Resolve(unmerged MetadataRevision,
 	merged MetadataRevision) {
+	if cr.holdIfManual(conflictInput{unmerged, merged}) {
+		return
+	}
+
 	cr.inputChanLock.RLock()
 	defer cr.inputChanLock.RUnlock()
 	if cr.inputChan == nil {
@@ -1389,6 +1409,10 @@ func (cr *ConflictResolver) fixRenameConflicts(ctx context.Context,
 				}
 				unmergedChains.createdOriginals[unmergedChain.mostRecent] = true
 			}
+			// The forked file no longer corresponds to the merged
+			// one at its old location, so don't let its parent's
+			// actions be applied to the file's new unmerged parent.
+			delete(mergedPaths, unmergedChain.mostRecent)
 			continue
 		}
 
@@ -1820,6 +1844,12 @@ func (cr *ConflictResolver) getActionsToMerge(
 	ctx context.Context, unmergedChains, mergedChains *crChains,
 	mergedPaths map[BlockPointer]path) (
 	map[BlockPointer]crActionList, error) {
+	renamer := cr.config.ConflictRenamer()
+	strategy := cr.config.ConflictResolutionStrategy()
+	if mc := cr.getActiveChoices(); mc != nil {
+		renamer, strategy = mc, mc
+	}
+
 	actionMap := make(map[BlockPointer]crActionList)
 	for unmergedMostRecent, unmergedChain := range unmergedChains.byMostRecent {
 		original := unmergedChain.original
@@ -1839,8 +1869,7 @@ func (cr *ConflictResolver) getActionsToMerge(
 		}
 
 		actions, err := unmergedChain.getActionsToMerge(
-			ctx, cr.config.ConflictRenamer(), mergedPath,
-			mergedChain)
+			ctx, renamer, strategy, mergedPath, mergedChain)
 		if err != nil {
 			return nil, err
 		}
@@ -1880,7 +1909,9 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 				moved := false
 				switch realAction := action.(type) {
 				case *copyUnmergedAttrAction:
-					if realAction.attr[0] == mtimeAttr && !realAction.moved {
+					if (realAction.attr[0] == mtimeAttr ||
+						realAction.attr[0] == xattrAttr ||
+						realAction.attr[0] == permAttr) && !realAction.moved {
 						realAction.moved = true
 						parentActions = append(parentActions, realAction)
 						moved = true
@@ -3599,7 +3630,8 @@ func (cr *ConflictResolver) completeResolution(ctx context.Context,
 	// Put all the blocks.  TODO: deal with recoverable block errors?
 	_, err = doBlockPuts(ctx, cr.config.BlockServer(), cr.config.BlockCache(),
 		cr.config.Reporter(), cr.log, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+		md.GetTlfHandle().GetCanonicalName(), *bps,
+		maxParallelBlockPutsForConfig(cr.config))
 	if err != nil {
 		return err
 	}
@@ -3667,9 +3699,14 @@ func (e CRWrapError) Error() string {
 func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	cr.log.CDebugf(ctx, "Starting conflict resolution with input %v", ci)
 	var err error
+	var opsMerged, conflictCopies int
+	start := cr.config.Clock().Now()
 	lState := makeFBOLockState()
 	defer func() {
 		cr.log.CDebugf(ctx, "Finished conflict resolution: %v", err)
+		status := cr.stats.record(cr.config.Clock().Now().Sub(start),
+			opsMerged, conflictCopies, err)
+		cr.fbo.status.setCRStatus(status)
 		if err != nil {
 			handle := cr.fbo.getHead(lState).GetTlfHandle()
 			cr.config.Reporter().ReportErr(ctx,
@@ -3683,6 +3720,16 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 		}
 	}()
 
+	// Text merges are applied once the resolution is done, after
+	// unmerged writes are unblocked.
+	var textMerges []crTextMerge
+	mergeCtx := ctx
+	defer func() {
+		if err == nil && len(textMerges) > 0 {
+			cr.applyTextMerges(mergeCtx, textMerges)
+		}
+	}()
+
 	// Canceled before we even got started?
 	err = cr.checkDone(ctx)
 	if err != nil {
@@ -3736,6 +3783,7 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	if err != nil {
 		return
 	}
+	opsMerged = unmergedChains.numOps()
 	if len(mergedPaths) == 0 {
 		var mostRecentMergedMD ImmutableRootMetadata
 		if len(mergedMDs) > 0 {
@@ -3781,6 +3829,17 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 		mostRecentMergedMD.LastModifyingWriterVerifyingKey(),
 		mostRecentMergedMD.Revision())
 
+	// Find the text files written in both branches that can be
+	// merged, before computing the actions changes the chains.
+	// Failing to find them isn't fatal; they just get conflicted
+	// copies.
+	merges, mergeErr := cr.findTextMerges(ctx, lState, unmergedChains,
+		mergedChains, unmergedPaths, mergedPaths, mostRecentMergedMD)
+	if mergeErr != nil {
+		cr.log.CDebugf(ctx, "Couldn't find text merges: %v", mergeErr)
+		merges = nil
+	}
+
 	// Step 2: Figure out which actions need to be taken in the merged
 	// branch to best reflect the unmerged changes.  The result of
 	// this step is a map containing, for each node in the merged path
@@ -3795,6 +3854,8 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	if err != nil {
 		return
 	}
+	conflictCopies = crNumConflictRenames(actionMap)
+	merges = setTextMergeNames(merges, actionMap)
 
 	// Insert the new unmerged paths as needed
 	if len(newUnmergedPaths) > 0 {
@@ -3855,6 +3916,7 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	if err != nil {
 		return
 	}
+	textMerges = merges
 
 	// TODO: If conflict resolution fails after some blocks were put,
 	// remember these and include them in the later resolution so they
@@ -0,0 +1,77 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// FileConflictPolicy says how conflict resolution should handle a
+// file that was written both locally and remotely.
+type FileConflictPolicy int
+
+const (
+	// FileConflictKeepBoth keeps the remote version of the file
+	// under its original name, and the local version under a new
+	// name chosen by the Config's ConflictRenamer.  This is the
+	// default.
+	FileConflictKeepBoth FileConflictPolicy = iota
+	// FileConflictPreferRemote keeps only the remote version of
+	// the file, and throws away the local writes to it.
+	FileConflictPreferRemote
+)
+
+func (p FileConflictPolicy) String() string {
+	switch p {
+	case FileConflictKeepBoth:
+		return "KeepBoth"
+	case FileConflictPreferRemote:
+		return "PreferRemote"
+	default:
+		return fmt.Sprintf("FileConflictPolicy(%d)", int(p))
+	}
+}
+
+// DefaultConflictResolutionStrategy always keeps both versions of a
+// conflicted file.
+type DefaultConflictResolutionStrategy struct{}
+
+var _ ConflictResolutionStrategy = DefaultConflictResolutionStrategy{}
+
+// FileConflictPolicy implements the ConflictResolutionStrategy
+// interface for DefaultConflictResolutionStrategy.
+func (DefaultConflictResolutionStrategy) FileConflictPolicy(
+	_ context.Context, _ string) (FileConflictPolicy, error) {
+	return FileConflictKeepBoth, nil
+}
+
+// ExtensionConflictResolutionStrategy picks the policy for a
+// conflicted file based on its extension, e.g. to always prefer the
+// remote version of generated ".lock" files while keeping both
+// versions of everything else.
+type ExtensionConflictResolutionStrategy struct {
+	// Default is the policy for files whose extension isn't in
+	// ByExtension.
+	Default FileConflictPolicy
+	// ByExtension maps a lower-case extension, including the
+	// leading dot (e.g. ".txt"), to a policy.
+	ByExtension map[string]FileConflictPolicy
+}
+
+var _ ConflictResolutionStrategy = ExtensionConflictResolutionStrategy{}
+
+// FileConflictPolicy implements the ConflictResolutionStrategy
+// interface for ExtensionConflictResolutionStrategy.
+func (s ExtensionConflictResolutionStrategy) FileConflictPolicy(
+	_ context.Context, p string) (FileConflictPolicy, error) {
+	_, ext := splitExtension(p)
+	if policy, ok := s.ByExtension[strings.ToLower(ext)]; ok {
+		return policy, nil
+	}
+	return s.Default, nil
+}
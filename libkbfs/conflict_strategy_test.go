@@ -0,0 +1,35 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestExtensionConflictResolutionStrategy(t *testing.T) {
+	s := ExtensionConflictResolutionStrategy{
+		Default: FileConflictKeepBoth,
+		ByExtension: map[string]FileConflictPolicy{
+			".lock":   FileConflictPreferRemote,
+			".tar.gz": FileConflictPreferRemote,
+		},
+	}
+	ctx := context.Background()
+	for p, expected := range map[string]FileConflictPolicy{
+		"/keybase/private/u1/yarn.lock":      FileConflictPreferRemote,
+		"/keybase/private/u1/YARN.LOCK":      FileConflictPreferRemote,
+		"/keybase/private/u1/a.tar.gz":       FileConflictPreferRemote,
+		"/keybase/private/u1/notes.txt":      FileConflictKeepBoth,
+		"/keybase/private/u1/.lock":          FileConflictKeepBoth,
+		"/keybase/private/u1/dir.lock/notes": FileConflictKeepBoth,
+	} {
+		policy, err := s.FileConflictPolicy(ctx, p)
+		require.NoError(t, err)
+		require.Equal(t, expected, policy, p)
+	}
+}
@@ -10,10 +10,12 @@ import (
 
 // Service names used in ConnectionStatus.
 const (
-	KeybaseServiceName     = "keybase-service"
-	MDServiceName          = "md-server"
-	LoginStatusUpdateName  = "login"
-	LogoutStatusUpdateName = "logout"
+	KeybaseServiceName      = "keybase-service"
+	MDServiceName           = "md-server"
+	KeyAgentServiceName     = "key-agent"
+	KeyHalfStoreServiceName = "key-half-store"
+	LoginStatusUpdateName   = "login"
+	LogoutStatusUpdateName  = "logout"
 )
 
 type errDisconnected struct{}
@@ -0,0 +1,263 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConnectivityState says how well this device can currently reach
+// the KBFS servers.  The states are ordered from best to worst.
+type ConnectivityState int
+
+const (
+	// ConnectivityOnline means the servers are reachable, and
+	// recent requests to them have succeeded.
+	ConnectivityOnline ConnectivityState = iota
+	// ConnectivityFlaky means the servers are reachable, but
+	// requests to them have recently failed or been slow, or the
+	// connection has only just come back.
+	ConnectivityFlaky
+	// ConnectivityOffline means there is no connection to the MD
+	// server, or the OS says there is no network.
+	ConnectivityOffline
+)
+
+func (s ConnectivityState) String() string {
+	switch s {
+	case ConnectivityOnline:
+		return "online"
+	case ConnectivityFlaky:
+		return "flaky"
+	case ConnectivityOffline:
+		return "offline"
+	default:
+		return fmt.Sprintf("ConnectivityState(%d)", int(s))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface for
+// ConnectivityState, so that it shows up by name in status JSON.
+func (s ConnectivityState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ConnectivityPolicy says how background work should behave in a
+// given ConnectivityState.  It is suitable for encoding directly as
+// JSON.
+type ConnectivityPolicy struct {
+	// MaxRetryInterval caps the backoff between attempts to
+	// register for and fetch MD updates after a failure.
+	MaxRetryInterval time.Duration
+	// RetryJournalFlushes says whether a journal that fails to
+	// flush should retry on a backoff timer.  If not, it waits
+	// until the connectivity gets better, or until there are new
+	// writes to flush.
+	RetryJournalFlushes bool
+	// Prefetch says whether block retrievals with less than
+	// on-demand priority may go to the server.
+	Prefetch bool
+}
+
+// connectivityPolicies holds the policy for each ConnectivityState.
+var connectivityPolicies = [...]ConnectivityPolicy{
+	ConnectivityOnline: {
+		MaxRetryInterval:    1 * time.Minute,
+		RetryJournalFlushes: true,
+		Prefetch:            true,
+	},
+	ConnectivityFlaky: {
+		MaxRetryInterval:    2 * time.Minute,
+		RetryJournalFlushes: true,
+	},
+	ConnectivityOffline: {
+		// Registering for updates waits for the connection
+		// anyway, so this only slows down failing fetches.
+		MaxRetryInterval: 5 * time.Minute,
+	},
+}
+
+// Policy returns the policy for background work in this state.
+func (s ConnectivityState) Policy() ConnectivityPolicy {
+	if s < 0 || int(s) >= len(connectivityPolicies) {
+		return connectivityPolicies[ConnectivityOffline]
+	}
+	return connectivityPolicies[s]
+}
+
+const (
+	// connectivityFlakyFailures is how many consecutive failed
+	// requests make an online device flaky.
+	connectivityFlakyFailures = 2
+	// connectivityOnlineSuccesses is how many consecutive
+	// successful requests make a flaky device online again.
+	connectivityOnlineSuccesses = 3
+	// connectivitySlowRequest is how long a request may take
+	// before it counts as a failure.
+	connectivitySlowRequest = 5 * time.Second
+)
+
+// ConnectivityStatus describes the current connectivity.  It is
+// suitable for encoding directly as JSON.
+type ConnectivityStatus struct {
+	State ConnectivityState
+	// Since is when the current state was entered.
+	Since time.Time
+	// LastError is the most recent failure, if there have been
+	// no successes since.
+	LastError string `json:",omitempty"`
+	// NetworkOnline is the last hint from the OS about whether
+	// there is a network, if any.
+	NetworkOnline *bool `json:",omitempty"`
+	Policy        ConnectivityPolicy
+}
+
+// ConnectivityTrackerStandard implements the ConnectivityTracker
+// interface.  It's offline while the MD server is disconnected or
+// the OS says there's no network.  Otherwise, it goes from online to
+// flaky after connectivityFlakyFailures consecutive failed requests,
+// and back after connectivityOnlineSuccesses consecutive successful
+// ones.  Coming back from offline always goes through flaky.
+type ConnectivityTrackerStandard struct {
+	clock Clock
+
+	lock          sync.Mutex
+	state         ConnectivityState
+	since         time.Time
+	mdServerDown  bool
+	networkOnline *bool
+	failures      int
+	successes     int
+	lastErr       error
+	// changedCh is closed, and replaced, whenever the state
+	// changes.
+	changedCh chan StatusUpdate
+}
+
+var _ ConnectivityTracker = (*ConnectivityTrackerStandard)(nil)
+
+// NewConnectivityTrackerStandard returns a new
+// ConnectivityTrackerStandard, which starts out online.
+func NewConnectivityTrackerStandard(
+	clock Clock) *ConnectivityTrackerStandard {
+	return &ConnectivityTrackerStandard{
+		clock:     clock,
+		state:     ConnectivityOnline,
+		since:     clock.Now(),
+		changedCh: make(chan StatusUpdate),
+	}
+}
+
+func (ct *ConnectivityTrackerStandard) recordLocked(err error) {
+	if err == nil {
+		ct.successes++
+		ct.failures = 0
+		ct.lastErr = nil
+		return
+	}
+	ct.failures++
+	ct.successes = 0
+	ct.lastErr = err
+}
+
+func (ct *ConnectivityTrackerStandard) updateLocked() {
+	var next ConnectivityState
+	switch {
+	case ct.mdServerDown || (ct.networkOnline != nil && !*ct.networkOnline):
+		next = ConnectivityOffline
+		// Successes from before going offline don't count
+		// towards coming back online.
+		ct.successes = 0
+	case ct.failures >= connectivityFlakyFailures:
+		next = ConnectivityFlaky
+	case ct.state == ConnectivityOnline:
+		next = ConnectivityOnline
+	case ct.successes >= connectivityOnlineSuccesses:
+		next = ConnectivityOnline
+	default:
+		next = ConnectivityFlaky
+	}
+	if next == ct.state {
+		return
+	}
+	ct.state = next
+	ct.since = ct.clock.Now()
+	close(ct.changedCh)
+	ct.changedCh = make(chan StatusUpdate)
+}
+
+// ServiceStatusChanged implements the ConnectivityTracker interface
+// for ConnectivityTrackerStandard.
+func (ct *ConnectivityTrackerStandard) ServiceStatusChanged(
+	service string, err error) {
+	if service != MDServiceName {
+		return
+	}
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	if err == nil {
+		ct.mdServerDown = false
+	} else if _, ok := err.(errDisconnected); ok {
+		ct.mdServerDown = true
+	}
+	ct.recordLocked(err)
+	ct.updateLocked()
+}
+
+// RequestDone implements the ConnectivityTracker interface for
+// ConnectivityTrackerStandard.
+func (ct *ConnectivityTrackerStandard) RequestDone(
+	service string, latency time.Duration, err error) {
+	if service != MDServiceName {
+		return
+	}
+	if err == nil && latency > connectivitySlowRequest {
+		err = fmt.Errorf("Request to %s took %s", service, latency)
+	}
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	ct.recordLocked(err)
+	ct.updateLocked()
+}
+
+// SetNetworkHint implements the ConnectivityTracker interface for
+// ConnectivityTrackerStandard.
+func (ct *ConnectivityTrackerStandard) SetNetworkHint(online bool) {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	ct.networkOnline = &online
+	ct.updateLocked()
+}
+
+// State implements the ConnectivityTracker interface for
+// ConnectivityTrackerStandard.
+func (ct *ConnectivityTrackerStandard) State() ConnectivityState {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	return ct.state
+}
+
+// Status implements the ConnectivityTracker interface for
+// ConnectivityTrackerStandard.
+func (ct *ConnectivityTrackerStandard) Status() (
+	ConnectivityStatus, <-chan StatusUpdate) {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	status := ConnectivityStatus{
+		State:  ct.state,
+		Since:  ct.since,
+		Policy: ct.state.Policy(),
+	}
+	if ct.lastErr != nil {
+		status.LastError = ct.lastErr.Error()
+	}
+	if ct.networkOnline != nil {
+		online := *ct.networkOnline
+		status.NetworkOnline = &online
+	}
+	return status, ct.changedCh
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestConnectivityTrackerTransitions(t *testing.T) {
+	clock := newTestClockNow()
+	ct := NewConnectivityTrackerStandard(clock)
+	require.Equal(t, ConnectivityOnline, ct.State())
+
+	// Other services don't count.
+	ct.ServiceStatusChanged(KeybaseServiceName, errDisconnected{})
+	require.Equal(t, ConnectivityOnline, ct.State())
+
+	// One failure isn't enough to be flaky, but two are.
+	err := errors.New("ping failed")
+	ct.RequestDone(MDServiceName, time.Millisecond, err)
+	require.Equal(t, ConnectivityOnline, ct.State())
+	status, changedCh := ct.Status()
+	clock.Add(time.Second)
+	ct.RequestDone(MDServiceName, 2*connectivitySlowRequest, nil)
+	require.Equal(t, ConnectivityFlaky, ct.State())
+	<-changedCh
+	status, _ = ct.Status()
+	require.Equal(t, clock.Now(), status.Since)
+	require.NotEmpty(t, status.LastError)
+	require.False(t, status.Policy.Prefetch)
+
+	// It takes a few successes to be online again.
+	for i := 0; i < connectivityOnlineSuccesses-1; i++ {
+		ct.RequestDone(MDServiceName, time.Millisecond, nil)
+		require.Equal(t, ConnectivityFlaky, ct.State())
+	}
+	ct.RequestDone(MDServiceName, time.Millisecond, nil)
+	require.Equal(t, ConnectivityOnline, ct.State())
+	status, _ = ct.Status()
+	require.Empty(t, status.LastError)
+
+	// A disconnect is offline right away, until the reconnect,
+	// which is still flaky.
+	ct.ServiceStatusChanged(MDServiceName, errDisconnected{})
+	require.Equal(t, ConnectivityOffline, ct.State())
+	ct.ServiceStatusChanged(MDServiceName, errors.New("connect failed"))
+	require.Equal(t, ConnectivityOffline, ct.State())
+	ct.ServiceStatusChanged(MDServiceName, nil)
+	require.Equal(t, ConnectivityFlaky, ct.State())
+	for i := 0; i < connectivityOnlineSuccesses; i++ {
+		ct.RequestDone(MDServiceName, time.Millisecond, nil)
+	}
+	require.Equal(t, ConnectivityOnline, ct.State())
+
+	// The OS hint overrides a working connection.
+	ct.SetNetworkHint(false)
+	require.Equal(t, ConnectivityOffline, ct.State())
+	status, _ = ct.Status()
+	require.False(t, *status.NetworkOnline)
+	require.False(t, status.Policy.RetryJournalFlushes)
+	ct.SetNetworkHint(true)
+	require.Equal(t, ConnectivityFlaky, ct.State())
+}
+
+type testConnectivityObserver struct {
+	FakeObserver
+	changes chan ConnectivityStatus
+}
+
+func (o *testConnectivityObserver) ConnectivityChanged(
+	_ context.Context, status ConnectivityStatus) {
+	o.changes <- status
+}
+
+func TestKBFSOpsConnectivityObserver(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	obs := &testConnectivityObserver{
+		changes: make(chan ConnectivityStatus, 1),
+	}
+	err := config.Notifier().RegisterForConnectivityChanges(obs)
+	require.NoError(t, err)
+
+	config.KBFSOps().PushConnectionStatusChange(
+		MDServiceName, errDisconnected{})
+	status := <-obs.changes
+	require.Equal(t, ConnectivityOffline, status.State)
+
+	config.KBFSOps().PushConnectionStatusChange(MDServiceName, nil)
+	status = <-obs.changes
+	require.Equal(t, ConnectivityFlaky, status.State)
+
+	kbfsStatus, _, err := config.KBFSOps().Status(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, ConnectivityFlaky, kbfsStatus.Connectivity.State)
+
+	err = config.Notifier().UnregisterFromConnectivityChanges(obs)
+	require.NoError(t, err)
+}
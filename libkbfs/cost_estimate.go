@@ -0,0 +1,286 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+)
+
+// CostEstimate is the estimated cost of a batch of file system
+// operations, as computed by a dry run.  Byte counts are estimates of
+// the padded, encoded block sizes, and don't include encryption or
+// MD overhead.
+type CostEstimate struct {
+	// MDRevisions is the number of new MD revisions that would be
+	// written.
+	MDRevisions int
+	// BlocksPut and BytesPut count the new blocks that would be
+	// put to the block server, including new versions of every
+	// directory along each modified path.
+	BlocksPut int
+	BytesPut  uint64
+	// BlocksUnreferenced and BytesUnreferenced count the existing
+	// (or intermediate) blocks that would become unreferenced, and
+	// so would eventually be reclaimed.
+	BlocksUnreferenced int
+	BytesUnreferenced  uint64
+}
+
+func (ce CostEstimate) String() string {
+	return fmt.Sprintf("{revisions=%d put=%d blocks/%d bytes "+
+		"unref=%d blocks/%d bytes}", ce.MDRevisions, ce.BlocksPut,
+		ce.BytesPut, ce.BlocksUnreferenced, ce.BytesUnreferenced)
+}
+
+// addRevision accounts for one MD revision that rewrites each of the
+// directories along a path, given the estimated encoded sizes of
+// their blocks from the root down.  The previous version of each of
+// those blocks becomes unreferenced.
+func (ce *CostEstimate) addRevision(dirSizes []uint64) {
+	ce.MDRevisions++
+	for _, size := range dirSizes {
+		ce.addPut(size)
+		ce.addUnref(size)
+	}
+}
+
+func (ce *CostEstimate) addPut(size uint64) {
+	ce.BlocksPut++
+	ce.BytesPut += size
+}
+
+func (ce *CostEstimate) addUnref(size uint64) {
+	ce.BlocksUnreferenced++
+	ce.BytesUnreferenced += size
+}
+
+// DryRunEntry describes a file, executable, directory or symlink to
+// be created, for estimating the cost of a copy with
+// KBFSOps.EstimateCopy.
+type DryRunEntry struct {
+	Name string
+	Type EntryType
+	// Size is the length of the contents of a file.
+	Size uint64
+	// Children are the entries to create within a directory.
+	Children []DryRunEntry
+}
+
+// costEstimator simulates block splitting and directory updates to
+// estimate the costs of operations, without writing anything.
+type costEstimator struct {
+	config Config
+	uid    keybase1.UID
+	// fullBlockLen is the number of bytes of file data that fit into
+	// a single block, as determined by the block splitter.  It's
+	// computed lazily.
+	fullBlockLen uint64
+}
+
+func newCostEstimator(config Config, uid keybase1.UID) *costEstimator {
+	return &costEstimator{config: config, uid: uid}
+}
+
+// paddedSize returns the size of an encoded block of the given
+// length after padding.
+func paddedSize(encodedLen int) uint64 {
+	return uint64(nextPowerOfTwo(uint32(encodedLen))) + padPrefixSize
+}
+
+func (ce *costEstimator) encodedBlockSize(block Block) (uint64, error) {
+	buf, err := ce.config.Codec().Encode(block)
+	if err != nil {
+		return 0, err
+	}
+	return paddedSize(len(buf)), nil
+}
+
+// makeBlockInfo returns a plausible-looking BlockInfo, so that
+// encoded sizes of blocks containing pointers come out about right.
+func (ce *costEstimator) makeBlockInfo() (BlockInfo, error) {
+	id, err := ce.config.Crypto().MakeTemporaryBlockID()
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	return BlockInfo{
+		BlockPointer: BlockPointer{
+			ID:           id,
+			KeyGen:       FirstValidKeyGen,
+			DataVer:      FirstValidDataVer,
+			BlockContext: BlockContext{Creator: ce.uid},
+		},
+		EncodedSize: uint32(MaxBlockSizeBytesDefault),
+	}, nil
+}
+
+// getFullBlockLen determines how many bytes the block splitter puts
+// into a single block when writing sequentially to the end of a file.
+// This assumes the splitter splits at a fixed size for such writes,
+// which holds for BlockSplitterSimple.
+func (ce *costEstimator) getFullBlockLen() uint64 {
+	if ce.fullBlockLen > 0 {
+		return ce.fullBlockLen
+	}
+	bsplit := ce.config.BlockSplitter()
+	block := NewFileBlock().(*FileBlock)
+	buf := make([]byte, 64*1024)
+	for {
+		off := int64(len(block.Contents))
+		n := bsplit.CopyUntilSplit(block, true, buf, off)
+		if n < int64(len(buf)) {
+			break
+		}
+	}
+	ce.fullBlockLen = uint64(len(block.Contents))
+	return ce.fullBlockLen
+}
+
+// estimateFile returns the number and total size of the blocks
+// needed to store a file of the given size, including the top-level
+// indirect block if there is one.
+func (ce *costEstimator) estimateFile(size uint64) (
+	numBlocks int, bytes uint64, err error) {
+	dataBlockSize := func(n uint64) (uint64, error) {
+		return ce.encodedBlockSize(&FileBlock{Contents: make([]byte, n)})
+	}
+
+	fullLen := ce.getFullBlockLen()
+	if size <= fullLen {
+		bytes, err := dataBlockSize(size)
+		if err != nil {
+			return 0, 0, err
+		}
+		return 1, bytes, nil
+	}
+
+	numFull := size / fullLen
+	rem := size % fullLen
+	fullSize, err := dataBlockSize(fullLen)
+	if err != nil {
+		return 0, 0, err
+	}
+	numBlocks = int(numFull)
+	bytes = numFull * fullSize
+	if rem > 0 {
+		remSize, err := dataBlockSize(rem)
+		if err != nil {
+			return 0, 0, err
+		}
+		numBlocks++
+		bytes += remSize
+	}
+
+	// Account for the top block holding the indirect pointers.
+	// TODO: account for multiple levels of indirection once files
+	// support them.
+	info, err := ce.makeBlockInfo()
+	if err != nil {
+		return 0, 0, err
+	}
+	top := &FileBlock{
+		CommonBlock: CommonBlock{IsInd: true},
+		IPtrs:       make([]IndirectFilePtr, numBlocks),
+	}
+	for i := range top.IPtrs {
+		top.IPtrs[i] = IndirectFilePtr{
+			BlockInfo: info,
+			Off:       int64(uint64(i) * fullLen),
+		}
+	}
+	topSize, err := ce.encodedBlockSize(top)
+	if err != nil {
+		return 0, 0, err
+	}
+	return numBlocks + 1, bytes + topSize, nil
+}
+
+// estimateDir returns the encoded size of a directory block holding
+// the given entries.
+func (ce *costEstimator) estimateDir(entries []DryRunEntry) (uint64, error) {
+	info, err := ce.makeBlockInfo()
+	if err != nil {
+		return 0, err
+	}
+	dblock := NewDirBlock().(*DirBlock)
+	for _, entry := range entries {
+		de := DirEntry{
+			EntryInfo: EntryInfo{
+				Type:  entry.Type,
+				Size:  entry.Size,
+				Mtime: 1,
+				Ctime: 1,
+			},
+		}
+		if entry.Type != Sym {
+			de.BlockInfo = info
+		}
+		dblock.Children[entry.Name] = de
+	}
+	return ce.encodedBlockSize(dblock)
+}
+
+// addCopy adds to est the cost of creating the given entries within
+// the directory at the end of a path whose directory blocks have the
+// given encoded sizes.  Each creation is its own MD revision, and
+// writing a non-empty file takes another one when it is synced.
+func (ce *costEstimator) addCopy(est *CostEstimate, dirSizes []uint64,
+	entries []DryRunEntry) error {
+	for _, entry := range entries {
+		switch entry.Type {
+		case File, Exec:
+			est.addRevision(dirSizes)
+			emptySize, err := ce.encodedBlockSize(NewFileBlock())
+			if err != nil {
+				return err
+			}
+			est.addPut(emptySize)
+			if entry.Size == 0 {
+				continue
+			}
+
+			est.addRevision(dirSizes)
+			est.addUnref(emptySize)
+			numBlocks, bytes, err := ce.estimateFile(entry.Size)
+			if err != nil {
+				return err
+			}
+			est.BlocksPut += numBlocks
+			est.BytesPut += bytes
+		case Dir:
+			est.addRevision(dirSizes)
+			emptySize, err := ce.encodedBlockSize(NewDirBlock())
+			if err != nil {
+				return err
+			}
+			est.addPut(emptySize)
+			if len(entry.Children) == 0 {
+				continue
+			}
+
+			// The new directory is rewritten by every child
+			// creation; use its final size as an upper bound.
+			size, err := ce.estimateDir(entry.Children)
+			if err != nil {
+				return err
+			}
+			childSizes := make([]uint64, len(dirSizes), len(dirSizes)+1)
+			copy(childSizes, dirSizes)
+			childSizes = append(childSizes, size)
+			if err := ce.addCopy(est, childSizes, entry.Children); err != nil {
+				return err
+			}
+		case Sym:
+			// Symlinks live entirely within their parent's
+			// directory entry.
+			est.addRevision(dirSizes)
+		default:
+			return fmt.Errorf("Unknown entry type %s for %s",
+				entry.Type, entry.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCostEstimatorFileBlocks(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetBlockSplitter(&BlockSplitterSimple{10, 8 * 1024})
+
+	ce := newCostEstimator(config, "")
+	for _, test := range []struct {
+		size      uint64
+		numBlocks int
+	}{
+		{0, 1},
+		{10, 1},
+		{11, 3},
+		{25, 4},
+		{30, 4},
+	} {
+		numBlocks, bytes, err := ce.estimateFile(test.size)
+		require.NoError(t, err)
+		require.Equal(t, test.numBlocks, numBlocks, "size=%d", test.size)
+		require.True(t, bytes >= test.size)
+	}
+}
+
+func TestKBFSOpsEstimateCopyAndRemove(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetBlockSplitter(&BlockSplitterSimple{10, 8 * 1024})
+
+	kbfsOps := config.KBFSOps()
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+
+	entries := []DryRunEntry{
+		{
+			Name: "a",
+			Type: Dir,
+			Children: []DryRunEntry{
+				{Name: "b", Type: File, Size: 25},
+			},
+		},
+		{Name: "c", Type: Sym},
+	}
+	est, err := kbfsOps.EstimateCopy(ctx, rootNode, entries)
+	require.NoError(t, err)
+	// Create a, create b, sync b, and create c.
+	require.Equal(t, 4, est.MDRevisions)
+	// root+a, a's first version, root+a+b and b's empty block,
+	// root+a+b and b's three data blocks plus its top block, and
+	// root.
+	require.Equal(t, 12, est.BlocksPut)
+	// The old versions of each rewritten directory, plus b's empty
+	// block.
+	require.Equal(t, 7, est.BlocksUnreferenced)
+
+	// Nothing should have been written.
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	rev := status.Revision
+
+	aNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateFile(ctx, aNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, bNode, make([]byte, 25), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, bNode)
+	require.NoError(t, err)
+
+	status, _, err = kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, rev+3, status.Revision)
+
+	_, err = kbfsOps.EstimateCopy(ctx, rootNode, entries)
+	require.Equal(t, NameExistsError{"a"}, err)
+
+	est, err = kbfsOps.EstimateRemove(ctx, rootNode, "a")
+	require.NoError(t, err)
+	// Remove b, then a.
+	require.Equal(t, 2, est.MDRevisions)
+	require.Equal(t, 3, est.BlocksPut)
+	// b's data blocks and top block, old versions of root+a, a and
+	// root.
+	require.Equal(t, 8, est.BlocksUnreferenced)
+
+	_, err = kbfsOps.EstimateRemove(ctx, rootNode, "c")
+	require.Equal(t, NoSuchNameError{"c"}, err)
+}
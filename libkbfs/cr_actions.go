@@ -190,6 +190,15 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 				unmergedEntry.Type = cuea.unmergedEntry.Type
 			case mtimeAttr:
 				unmergedEntry.Mtime = cuea.unmergedEntry.Mtime
+			case xattrAttr:
+				unmergedEntry.Xattrs = cuea.unmergedEntry.Xattrs
+			case permAttr:
+				unmergedEntry.Type = cuea.unmergedEntry.Type
+				unmergedEntry.Perm = cuea.unmergedEntry.Perm
+			case appendOnlyAttr:
+				unmergedEntry.AppendOnly = cuea.unmergedEntry.AppendOnly
+			case derivedAttr:
+				unmergedEntry.Derived = cuea.unmergedEntry.Derived
 			}
 		}
 	}
@@ -379,6 +388,15 @@ func (cuaa *copyUnmergedAttrAction) do(ctx context.Context,
 			mergedEntry.Type = unmergedEntry.Type
 		case mtimeAttr:
 			mergedEntry.Mtime = unmergedEntry.Mtime
+		case xattrAttr:
+			mergedEntry.Xattrs = unmergedEntry.Xattrs
+		case permAttr:
+			mergedEntry.Type = unmergedEntry.Type
+			mergedEntry.Perm = unmergedEntry.Perm
+		case appendOnlyAttr:
+			mergedEntry.AppendOnly = unmergedEntry.AppendOnly
+		case derivedAttr:
+			mergedEntry.Derived = unmergedEntry.Derived
 		case sizeAttr:
 			mergedEntry.Size = unmergedEntry.Size
 			mergedEntry.EncodedSize = unmergedEntry.EncodedSize
@@ -871,6 +889,21 @@ type collapseActionInfo struct {
 
 type crActionList []crAction
 
+// crNumConflictRenames returns the number of actions in the given
+// action map that rename an entry to a conflicted name.
+func crNumConflictRenames(actionMap map[BlockPointer]crActionList) int {
+	n := 0
+	for _, actions := range actionMap {
+		for _, action := range actions {
+			switch action.(type) {
+			case *renameUnmergedAction, *renameMergedAction:
+				n++
+			}
+		}
+	}
+	return n
+}
+
 func setTopAction(action crAction, fromName string, index int,
 	infoMap map[string]collapseActionInfo, indicesToRemove map[int]bool) {
 	info, ok := infoMap[fromName]
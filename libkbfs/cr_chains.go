@@ -109,7 +109,8 @@ func (cc *crChain) getCollapsedWriteRange() []WriteRange {
 }
 
 func (cc *crChain) getActionsToMerge(
-	ctx context.Context, renamer ConflictRenamer, mergedPath path,
+	ctx context.Context, renamer ConflictRenamer,
+	strategy ConflictResolutionStrategy, mergedPath path,
 	mergedChain *crChain) (crActionList, error) {
 	var actions crActionList
 
@@ -130,9 +131,24 @@ func (cc *crChain) getActionsToMerge(
 		// TODO: In the future we may be able to do smarter merging
 		// here if the write ranges don't overlap, though maybe only
 		// for certain file types?
-		if len(myWriteRange) == 1 && myWriteRange[0].isTruncate() &&
+		dropSyncs := len(myWriteRange) == 1 &&
+			myWriteRange[0].isTruncate() &&
 			len(mergedWriteRange) == 1 && mergedWriteRange[0].isTruncate() &&
-			myWriteRange[0].Off == mergedWriteRange[0].Off {
+			myWriteRange[0].Off == mergedWriteRange[0].Off
+
+		// Otherwise, if both branches wrote to the file, let the
+		// strategy decide whether to keep the unmerged writes.
+		if !dropSyncs && strategy != nil && cc.hasSyncOp() &&
+			mergedChain.hasSyncOp() {
+			policy, err := strategy.FileConflictPolicy(
+				ctx, mergedPath.CanonicalPathString())
+			if err != nil {
+				return nil, err
+			}
+			dropSyncs = policy == FileConflictPreferRemote
+		}
+
+		if dropSyncs {
 			// drop all sync ops
 			for i, op := range cc.ops {
 				if _, ok := op.(*syncOp); ok {
@@ -200,12 +216,14 @@ func (cc *crChain) identifyType(ctx context.Context, fbo *folderBlockOps,
 			cc.file = true
 			return nil
 		case *setAttrOp:
-			if realOp.Attr != mtimeAttr {
+			if realOp.Attr == exAttr || realOp.Attr == sizeAttr ||
+				realOp.Attr == appendOnlyAttr || realOp.Attr == derivedAttr {
 				cc.file = true
 				return nil
 			}
-			// We can't tell the file type from an mtimeAttr, so we
-			// may have to actually fetch the block to figure it out.
+			// We can't tell the file type from an mtimeAttr, an
+			// xattrAttr or a permAttr, so we may have to actually
+			// fetch the block to figure it out.
 			parentDir = realOp.Dir.Ref
 		default:
 			return nil
@@ -370,6 +388,18 @@ type crChains struct {
 	resOps []*resolutionOp
 }
 
+// numOps returns the total number of operations in all the chains.
+func (ccs *crChains) numOps() int {
+	if ccs == nil {
+		return 0
+	}
+	n := 0
+	for _, chain := range ccs.byOriginal {
+		n += len(chain.ops)
+	}
+	return n
+}
+
 func (ccs *crChains) addOp(ptr BlockPointer, op op) error {
 	currChain, ok := ccs.byMostRecent[ptr]
 	if !ok {
@@ -602,8 +632,13 @@ func (ccs *crChains) makeChainForNewOp(targetPtr BlockPointer, newOp op) error {
 	case *renameOp:
 		// In this case, we don't want to split the rename chain, so
 		// just make up a new operation and later overwrite it with
-		// the rename op.
-		co, err := newCreateOp(realOp.NewName, realOp.NewDir.Unref, File)
+		// the rename op.  A rename within a directory leaves NewDir
+		// empty.
+		newDir := realOp.NewDir.Unref
+		if newDir == zeroPtr {
+			newDir = realOp.OldDir.Unref
+		}
+		co, err := newCreateOp(realOp.NewName, newDir, File)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,358 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// ConflictChoice is a user's choice for how to resolve a conflicted
+// file, when manual conflict resolution is enabled for a folder.
+type ConflictChoice int
+
+const (
+	// ConflictChoiceKeepBoth keeps the remote version of the file
+	// under its name, and the local version under a conflicted
+	// name.  This is what automatic conflict resolution does.
+	ConflictChoiceKeepBoth ConflictChoice = iota
+	// ConflictChoiceLocal keeps only the local version of the file.
+	ConflictChoiceLocal
+	// ConflictChoiceRemote keeps only the remote version of the
+	// file.
+	ConflictChoiceRemote
+)
+
+func (c ConflictChoice) String() string {
+	switch c {
+	case ConflictChoiceKeepBoth:
+		return "KeepBoth"
+	case ConflictChoiceLocal:
+		return "Local"
+	case ConflictChoiceRemote:
+		return "Remote"
+	default:
+		return fmt.Sprintf("ConflictChoice(%d)", int(c))
+	}
+}
+
+// ConflictInfo describes a file that was written both in the local,
+// unmerged branch of a folder and in the remote, merged branch.  It
+// is suitable for encoding directly as JSON.
+type ConflictInfo struct {
+	// Path is the canonical path of the file in the remote
+	// branch, which is where it will be after resolution.  It
+	// identifies the conflict in KBFSOps.ResolveConflict.
+	Path string
+	// LocalPath is the canonical path of the file in the local
+	// branch, which may differ from Path if a parent directory
+	// was renamed remotely.
+	LocalPath string
+	Local     EntryInfo
+	Remote    EntryInfo
+	// Choice is set once the user has chosen how to resolve the
+	// conflict.
+	Choice *ConflictChoice `json:",omitempty"`
+}
+
+// crConflict is a conflict found while in manual conflict
+// resolution mode, along with the paths needed to act on it.
+type crConflict struct {
+	info       ConflictInfo
+	mergedPath path
+}
+
+type crConflictsByPath []crConflict
+
+func (cs crConflictsByPath) Len() int {
+	return len(cs)
+}
+
+func (cs crConflictsByPath) Less(i, j int) bool {
+	return cs[i].info.Path < cs[j].info.Path
+}
+
+func (cs crConflictsByPath) Swap(i, j int) {
+	cs[i], cs[j] = cs[j], cs[i]
+}
+
+// crManualChoices holds the user's choices for all the conflicts in
+// a branch while it is being resolved.  It implements
+// ConflictResolutionStrategy to drop the local writes of files where
+// the remote version was chosen, and wraps the configured
+// ConflictRenamer to give local copies that should replace the
+// remote version a name that can be found once resolution is done.
+type crManualChoices struct {
+	byPath      map[string]ConflictChoice
+	byLocalPath map[string]ConflictChoice
+	// localNames maps local paths to the temporary name given to
+	// the local copy during resolution.
+	localNames map[string]string
+	renamer    ConflictRenamer
+}
+
+var _ ConflictResolutionStrategy = (*crManualChoices)(nil)
+
+func newCRManualChoices(conflicts []crConflict,
+	choices map[string]ConflictChoice,
+	renamer ConflictRenamer) *crManualChoices {
+	mc := &crManualChoices{
+		byPath:      make(map[string]ConflictChoice, len(conflicts)),
+		byLocalPath: make(map[string]ConflictChoice, len(conflicts)),
+		localNames:  make(map[string]string),
+		renamer:     renamer,
+	}
+	for _, c := range conflicts {
+		choice := choices[c.info.Path]
+		mc.byPath[c.info.Path] = choice
+		mc.byLocalPath[c.info.LocalPath] = choice
+	}
+	return mc
+}
+
+// FileConflictPolicy implements the ConflictResolutionStrategy
+// interface for crManualChoices.
+func (mc *crManualChoices) FileConflictPolicy(
+	_ context.Context, p string) (FileConflictPolicy, error) {
+	if mc.byPath[p] == ConflictChoiceRemote {
+		return FileConflictPreferRemote, nil
+	}
+	return FileConflictKeepBoth, nil
+}
+
+// ConflictRename implements the ConflictRenamer interface for
+// crManualChoices.
+func (mc *crManualChoices) ConflictRename(
+	ctx context.Context, op op, original string) (string, error) {
+	localPath := op.getFinalPath().CanonicalPathString()
+	if mc.byLocalPath[localPath] != ConflictChoiceLocal {
+		return mc.renamer.ConflictRename(ctx, op, original)
+	}
+	if name, ok := mc.localNames[localPath]; ok {
+		return name, nil
+	}
+	suffix, err := MakeRandomRequestID()
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s.local-%s", original, suffix)
+	mc.localNames[localPath] = name
+	return name, nil
+}
+
+// isManual returns whether manual conflict resolution is enabled.
+func (cr *ConflictResolver) isManual() bool {
+	cr.manualLock.Lock()
+	defer cr.manualLock.Unlock()
+	return cr.manual
+}
+
+// setManual enables or disables manual conflict resolution.  When
+// disabling it, it returns any input that was held back while it was
+// enabled, which the caller should pass to Resolve.
+func (cr *ConflictResolver) setManual(manual bool) (
+	held conflictInput, ok bool) {
+	cr.manualLock.Lock()
+	defer cr.manualLock.Unlock()
+	cr.manual = manual
+	if manual || cr.heldInput == nil {
+		return conflictInput{}, false
+	}
+	held = *cr.heldInput
+	cr.heldInput = nil
+	cr.choices = nil
+	return held, true
+}
+
+// holdIfManual records the given input instead of resolving it, if
+// manual conflict resolution is enabled, and returns true in that
+// case.
+func (cr *ConflictResolver) holdIfManual(ci conflictInput) bool {
+	cr.manualLock.Lock()
+	defer cr.manualLock.Unlock()
+	if !cr.manual || cr.activeChoices != nil {
+		return false
+	}
+	if cr.heldInput == nil {
+		cr.heldInput = &ci
+		return true
+	}
+	if ci.unmerged > cr.heldInput.unmerged {
+		cr.heldInput.unmerged = ci.unmerged
+	}
+	if ci.merged > cr.heldInput.merged {
+		cr.heldInput.merged = ci.merged
+	}
+	return true
+}
+
+// getActiveChoices returns the choices for the manual resolution in
+// progress, if any.
+func (cr *ConflictResolver) getActiveChoices() *crManualChoices {
+	cr.manualLock.Lock()
+	defer cr.manualLock.Unlock()
+	return cr.activeChoices
+}
+
+func (cr *ConflictResolver) getConflictDirEntry(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, p path) (DirEntry, error) {
+	parentPath := *p.parentPath()
+	dblock, err := cr.fbo.blocks.GetDirBlockForReading(ctx, lState, kmd,
+		parentPath.tailPointer(), cr.fbo.branch(), parentPath)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	de, ok := dblock.Children[p.tailName()]
+	if !ok {
+		return DirEntry{}, NoSuchNameError{p.tailName()}
+	}
+	return de, nil
+}
+
+func (cr *ConflictResolver) getConflictEntry(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, p path) (EntryInfo, error) {
+	de, err := cr.getConflictDirEntry(ctx, lState, kmd, p)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	return de.EntryInfo, nil
+}
+
+// listConflicts returns the files written in both the unmerged and
+// the merged branch, sorted by path.
+func (cr *ConflictResolver) listConflicts(
+	ctx context.Context, lState *lockState) ([]crConflict, error) {
+	defer cr.saveInput()()
+
+	unmergedChains, mergedChains, unmergedPaths, mergedPaths, _,
+		mergedMDs, err := cr.buildChainsAndPaths(ctx, lState, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(mergedPaths) == 0 {
+		return nil, nil
+	}
+	mergedMD := mergedMDs[len(mergedMDs)-1]
+	unmergedMD := cr.fbo.getHead(lState)
+
+	localPaths := make(map[BlockPointer]path, len(unmergedPaths))
+	for _, p := range unmergedPaths {
+		localPaths[p.tailPointer()] = p
+	}
+
+	cr.manualLock.Lock()
+	choices := make(map[string]ConflictChoice, len(cr.choices))
+	for p, choice := range cr.choices {
+		choices[p] = choice
+	}
+	cr.manualLock.Unlock()
+
+	var conflicts []crConflict
+	for unmergedMostRecent, chain := range unmergedChains.byMostRecent {
+		if !chain.isFile() || !fileWithConflictingWrite(unmergedChains,
+			mergedChains, chain.original, chain.original) {
+			continue
+		}
+		mergedPath, ok := mergedPaths[unmergedMostRecent]
+		if !ok {
+			continue
+		}
+		localPath, ok := localPaths[unmergedMostRecent]
+		if !ok {
+			continue
+		}
+		local, err := cr.getConflictEntry(ctx, lState, unmergedMD, localPath)
+		if err != nil {
+			return nil, err
+		}
+		remote, err := cr.getConflictEntry(ctx, lState, mergedMD, mergedPath)
+		if err != nil {
+			return nil, err
+		}
+		c := crConflict{
+			info: ConflictInfo{
+				Path:      mergedPath.CanonicalPathString(),
+				LocalPath: localPath.CanonicalPathString(),
+				Local:     local,
+				Remote:    remote,
+			},
+			mergedPath: mergedPath,
+		}
+		if choice, ok := choices[c.info.Path]; ok {
+			c.info.Choice = &choice
+		}
+		conflicts = append(conflicts, c)
+	}
+	sort.Sort(crConflictsByPath(conflicts))
+	return conflicts, nil
+}
+
+// setChoice records the choice for the conflict at path p, and
+// returns whether all the given conflicts now have a choice.
+func (cr *ConflictResolver) setChoice(p string, choice ConflictChoice,
+	conflicts []crConflict) bool {
+	cr.manualLock.Lock()
+	defer cr.manualLock.Unlock()
+	if cr.choices == nil {
+		cr.choices = make(map[string]ConflictChoice)
+	}
+	cr.choices[p] = choice
+	for _, c := range conflicts {
+		if _, ok := cr.choices[c.info.Path]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveManually resolves the current branch using the user's
+// choices for each of the given conflicts, and waits for the
+// resolution to finish.  It returns the temporary names given to
+// the local copies that should replace the remote versions, keyed
+// by the merged path of each such conflict.
+func (cr *ConflictResolver) resolveManually(ctx context.Context,
+	lState *lockState, conflicts []crConflict) (
+	map[string]string, error) {
+	mc := func() *crManualChoices {
+		cr.manualLock.Lock()
+		defer cr.manualLock.Unlock()
+		cr.activeChoices = newCRManualChoices(
+			conflicts, cr.choices, cr.config.ConflictRenamer())
+		cr.heldInput = nil
+		return cr.activeChoices
+	}()
+	defer func() {
+		cr.manualLock.Lock()
+		defer cr.manualLock.Unlock()
+		cr.activeChoices = nil
+	}()
+
+	// Make sure this input isn't ignored, even if it's for
+	// revisions that were already looked at by listConflicts.
+	cr.BeginNewBranch()
+	cr.Resolve(cr.fbo.getHead(lState).Revision(),
+		MetadataRevisionUninitialized)
+	if err := cr.Wait(ctx); err != nil {
+		return nil, err
+	}
+	if !cr.fbo.isMasterBranch(lState) {
+		status := cr.stats.getStatus()
+		return nil, fmt.Errorf(
+			"Manual conflict resolution failed: %s", status.LastError)
+	}
+
+	cr.manualLock.Lock()
+	defer cr.manualLock.Unlock()
+	cr.choices = nil
+	localNames := make(map[string]string)
+	for _, c := range conflicts {
+		if name, ok := mc.localNames[c.info.LocalPath]; ok {
+			localNames[c.info.Path] = name
+		}
+	}
+	return localNames, nil
+}
@@ -0,0 +1,400 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+)
+
+// crTextMergeMaxBytes is the largest file, in any of the three
+// versions, that conflict resolution will try to merge line by line
+// instead of making a conflicted copy.
+const crTextMergeMaxBytes = 64 * 1024
+
+// crIsMergeableText returns whether the given file contents look
+// like text that can be merged line by line.
+func crIsMergeableText(data []byte) bool {
+	return len(data) <= crTextMergeMaxBytes &&
+		bytes.IndexByte(data, 0) < 0 && utf8.Valid(data)
+}
+
+// crSplitLines splits the given text into lines, each of which keeps
+// its trailing newline (if any).
+func crSplitLines(data []byte) []string {
+	var lines []string
+	s := string(data)
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			lines = append(lines, s)
+			break
+		}
+		lines = append(lines, s[:i+1])
+		s = s[i+1:]
+	}
+	return lines
+}
+
+// crLineHunk says that lines [start, end) of the base version are
+// replaced by lines in another version.
+type crLineHunk struct {
+	start, end int
+	lines      []string
+}
+
+func (h crLineHunk) equals(other crLineHunk) bool {
+	if h.start != other.start || h.end != other.end ||
+		len(h.lines) != len(other.lines) {
+		return false
+	}
+	for i := range h.lines {
+		if h.lines[i] != other.lines[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// crDiffLines returns the hunks, in order, that turn base into
+// other, based on their longest common subsequence of lines.
+func crDiffLines(base, other []string) []crLineHunk {
+	// lcs[i][j] is the length of the longest common subsequence
+	// of base[i:] and other[j:].
+	lcs := make([][]int, len(base)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(other)+1)
+	}
+	for i := len(base) - 1; i >= 0; i-- {
+		for j := len(other) - 1; j >= 0; j-- {
+			if base[i] == other[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var hunks []crLineHunk
+	var curr *crLineHunk
+	i, j := 0, 0
+	for i < len(base) || j < len(other) {
+		if i < len(base) && j < len(other) && base[i] == other[j] {
+			if curr != nil {
+				hunks = append(hunks, *curr)
+				curr = nil
+			}
+			i++
+			j++
+			continue
+		}
+		if curr == nil {
+			curr = &crLineHunk{start: i, end: i}
+		}
+		if j < len(other) &&
+			(i == len(base) || lcs[i][j+1] >= lcs[i+1][j]) {
+			curr.lines = append(curr.lines, other[j])
+			j++
+		} else {
+			i++
+			curr.end = i
+		}
+	}
+	if curr != nil {
+		hunks = append(hunks, *curr)
+	}
+	return hunks
+}
+
+// crMergeText does a three-way merge of the lines of local and
+// remote, which were both changed from base.  It returns false if
+// the two sets of changes overlap, unless they are identical.
+func crMergeText(base, local, remote []byte) ([]byte, bool) {
+	baseLines := crSplitLines(base)
+	localHunks := crDiffLines(baseLines, crSplitLines(local))
+	remoteHunks := crDiffLines(baseLines, crSplitLines(remote))
+
+	var buf bytes.Buffer
+	pos := 0
+	apply := func(h crLineHunk) {
+		for _, line := range baseLines[pos:h.start] {
+			buf.WriteString(line)
+		}
+		for _, line := range h.lines {
+			buf.WriteString(line)
+		}
+		pos = h.end
+	}
+
+	i, j := 0, 0
+	for i < len(localHunks) || j < len(remoteHunks) {
+		if i == len(localHunks) {
+			apply(remoteHunks[j])
+			j++
+			continue
+		}
+		if j == len(remoteHunks) {
+			apply(localHunks[i])
+			i++
+			continue
+		}
+
+		l, r := localHunks[i], remoteHunks[j]
+		overlap := l.start == r.start ||
+			(l.start < r.end && r.start < l.end)
+		switch {
+		case overlap && l.equals(r):
+			apply(l)
+			i++
+			j++
+		case overlap:
+			return nil, false
+		case l.start < r.start:
+			apply(l)
+			i++
+		default:
+			apply(r)
+			j++
+		}
+	}
+	for _, line := range baseLines[pos:] {
+		buf.WriteString(line)
+	}
+	return buf.Bytes(), true
+}
+
+// crTextMerge is a text file written in both branches whose changes
+// can be merged.  Conflict resolution still makes a conflicted copy
+// of the local version; once the resolution is done, the merged text
+// replaces the remote version and the copy is removed.
+type crTextMerge struct {
+	mergedPath   path
+	local        []byte
+	remote       []byte
+	merged       []byte
+	conflictName string
+}
+
+// readForMerge returns the contents of the given file, and false if
+// it is too big or doesn't look like text.
+func (cr *ConflictResolver) readForMerge(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, p path) ([]byte, bool, error) {
+	buf := make([]byte, crTextMergeMaxBytes+1)
+	n, err := cr.fbo.blocks.Read(ctx, lState, kmd, p, buf, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	data := buf[:n]
+	return data, crIsMergeableText(data), nil
+}
+
+// findTextMerges returns the text files written in both branches
+// that can be merged line by line, and would otherwise get a
+// conflicted copy.
+func (cr *ConflictResolver) findTextMerges(ctx context.Context,
+	lState *lockState, unmergedChains, mergedChains *crChains,
+	unmergedPaths []path, mergedPaths map[BlockPointer]path,
+	mergedMD ImmutableRootMetadata) ([]crTextMerge, error) {
+	if cr.getActiveChoices() != nil {
+		// The user has already chosen what to do with each
+		// conflict.
+		return nil, nil
+	}
+	unmergedMD := cr.fbo.getHead(lState)
+	strategy := cr.config.ConflictResolutionStrategy()
+
+	localPaths := make(map[BlockPointer]path, len(unmergedPaths))
+	for _, p := range unmergedPaths {
+		localPaths[p.tailPointer()] = p
+	}
+
+	var merges []crTextMerge
+	for unmergedMostRecent, chain := range unmergedChains.byMostRecent {
+		if !chain.isFile() || !fileWithConflictingWrite(unmergedChains,
+			mergedChains, chain.original, chain.original) {
+			continue
+		}
+		mergedPath, ok := mergedPaths[unmergedMostRecent]
+		if !ok {
+			continue
+		}
+		localPath, ok := localPaths[unmergedMostRecent]
+		if !ok {
+			continue
+		}
+		policy, err := strategy.FileConflictPolicy(
+			ctx, mergedPath.CanonicalPathString())
+		if err != nil {
+			return nil, err
+		}
+		if policy != FileConflictKeepBoth {
+			continue
+		}
+
+		localEntry, err := cr.getConflictDirEntry(
+			ctx, lState, unmergedMD, localPath)
+		if err != nil {
+			return nil, err
+		}
+		remoteEntry, err := cr.getConflictDirEntry(
+			ctx, lState, mergedMD, mergedPath)
+		if err != nil {
+			return nil, err
+		}
+		if localEntry.Type != File || remoteEntry.Type != File {
+			continue
+		}
+
+		localParent := *localPath.parentPath()
+		name := localPath.tailName()
+		base, ok, err := cr.readForMerge(ctx, lState, unmergedMD,
+			localParent.ChildPath(name, chain.original))
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		local, ok, err := cr.readForMerge(ctx, lState, unmergedMD,
+			localParent.ChildPath(name, localEntry.BlockPointer))
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		mergedParent := *mergedPath.parentPath()
+		remote, ok, err := cr.readForMerge(ctx, lState, mergedMD,
+			mergedParent.ChildPath(mergedPath.tailName(),
+				remoteEntry.BlockPointer))
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+
+		if bytes.Equal(local, remote) {
+			// Nothing to merge, and rewriting the file after
+			// the resolution would only add a revision.
+			continue
+		}
+
+		merged, ok := crMergeText(base, local, remote)
+		if !ok {
+			cr.log.CDebugf(ctx, "Changes to %s overlap; not merging",
+				mergedPath)
+			continue
+		}
+		merges = append(merges, crTextMerge{
+			mergedPath: mergedPath,
+			local:      local,
+			remote:     remote,
+			merged:     merged,
+		})
+	}
+	return merges, nil
+}
+
+// setTextMergeNames fills in the name of the conflicted copy for
+// each of the given merges, and drops the ones that won't get a
+// copy.
+func setTextMergeNames(merges []crTextMerge,
+	actionMap map[BlockPointer]crActionList) []crTextMerge {
+	var named []crTextMerge
+	for _, m := range merges {
+		parentPtr := m.mergedPath.parentPath().tailPointer()
+		for _, action := range actionMap[parentPtr] {
+			rua, ok := action.(*renameUnmergedAction)
+			if ok && rua.fromName == m.mergedPath.tailName() &&
+				rua.symPath == "" {
+				m.conflictName = rua.toName
+				named = append(named, m)
+				break
+			}
+		}
+	}
+	return named
+}
+
+// applyTextMerge writes the merged text over the remote version of
+// the file, and removes the conflicted copy of the local version.
+// It leaves things alone if either file has changed since the merge
+// was computed.
+func (cr *ConflictResolver) applyTextMerge(
+	ctx context.Context, m crTextMerge) error {
+	parentPath := *m.mergedPath.parentPath()
+	parent, err := cr.fbo.lookupPathByNames(ctx, parentPath)
+	if err != nil {
+		return err
+	}
+	name := m.mergedPath.tailName()
+	file, ei, err := cr.fbo.Lookup(ctx, parent, name)
+	if err != nil {
+		return err
+	}
+	copyFile, copyEI, err := cr.fbo.Lookup(ctx, parent, m.conflictName)
+	if err != nil {
+		return err
+	}
+
+	readAll := func(n Node, ei EntryInfo) ([]byte, error) {
+		buf := make([]byte, ei.Size)
+		nRead, err := cr.fbo.Read(ctx, n, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:nRead], nil
+	}
+	current, err := readAll(file, ei)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, m.remote) {
+		cr.log.CDebugf(ctx, "%s changed since merging; keeping the "+
+			"conflicted copy", name)
+		return nil
+	}
+	copyData, err := readAll(copyFile, copyEI)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(copyData, m.local) {
+		cr.log.CDebugf(ctx, "%s doesn't hold the local version of %s; "+
+			"keeping it", m.conflictName, name)
+		return nil
+	}
+
+	err = cr.fbo.Write(ctx, file, m.merged, 0)
+	if err != nil {
+		return err
+	}
+	err = cr.fbo.Truncate(ctx, file, uint64(len(m.merged)))
+	if err != nil {
+		return err
+	}
+	err = cr.fbo.Sync(ctx, file)
+	if err != nil {
+		return err
+	}
+	return cr.fbo.RemoveEntry(ctx, parent, m.conflictName)
+}
+
+// applyTextMerges applies each of the given merges after a
+// successful resolution.  Any merge that fails just leaves its
+// conflicted copy in place.
+func (cr *ConflictResolver) applyTextMerges(
+	ctx context.Context, merges []crTextMerge) {
+	for _, m := range merges {
+		cr.log.CDebugf(ctx, "Merging text of %s with %s",
+			m.mergedPath, m.conflictName)
+		if err := cr.applyTextMerge(ctx, m); err != nil {
+			cr.log.CWarningf(ctx, "Couldn't merge text of %s: %v",
+				m.mergedPath, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCRIsMergeableText(t *testing.T) {
+	require.True(t, crIsMergeableText([]byte("hello\nworld\n")))
+	require.True(t, crIsMergeableText(nil))
+	require.False(t, crIsMergeableText([]byte{'a', 0, 'b'}))
+	require.False(t, crIsMergeableText([]byte{0xff, 0xfe}))
+	require.False(t, crIsMergeableText(make([]byte, crTextMergeMaxBytes+1)))
+}
+
+func TestCRSplitLines(t *testing.T) {
+	require.Equal(t, []string{"a\n", "b\n", "c"},
+		crSplitLines([]byte("a\nb\nc")))
+	require.Equal(t, []string{"a\n", "\n"}, crSplitLines([]byte("a\n\n")))
+	require.Len(t, crSplitLines(nil), 0)
+}
+
+func TestCRMergeText(t *testing.T) {
+	base := "1\n2\n3\n4\n5\n"
+	for _, tc := range []struct {
+		name, local, remote, merged string
+		ok                          bool
+	}{
+		{"disjoint edits", "one\n2\n3\n4\n5\n", "1\n2\n3\n4\nfive\n",
+			"one\n2\n3\n4\nfive\n", true},
+		{"insert and delete", "1\n2\n2.5\n3\n4\n5\n", "1\n3\n4\n5\n",
+			"1\n2.5\n3\n4\n5\n", true},
+		{"appends at both ends", "0\n" + base, base + "6\n",
+			"0\n" + base + "6\n", true},
+		{"same edit", "1\n2\nthree\n4\n5\n", "1\n2\nthree\n4\n5\n",
+			"1\n2\nthree\n4\n5\n", true},
+		{"overlapping edits", "1\n2\nthree\n4\n5\n", "1\n2\nTHREE\n4\n5\n",
+			"", false},
+		{"only local", "1\n2\n3\n4\n5\n6\n", base,
+			"1\n2\n3\n4\n5\n6\n", true},
+	} {
+		merged, ok := crMergeText(
+			[]byte(base), []byte(tc.local), []byte(tc.remote))
+		require.Equal(t, tc.ok, ok, tc.name)
+		if ok {
+			require.Equal(t, tc.merged, string(merged), tc.name)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// CRPreviewAction is one change that conflict resolution would make
+// to a directory in the merged branch.
+type CRPreviewAction struct {
+	// Dir is the canonical path of the directory in the merged
+	// branch.
+	Dir    string
+	Action string
+}
+
+// CRPreviewConflictedCopy is an entry that conflict resolution would
+// move aside under a new name, because it was changed in both
+// branches.
+type CRPreviewConflictedCopy struct {
+	// Path is the canonical path of the conflicted entry in the
+	// merged branch.
+	Path string
+	// ConflictPath is the canonical path the entry would be
+	// renamed to.  The final name may get an extra suffix if
+	// another entry already has this name when the resolution
+	// actually happens.
+	ConflictPath string
+	// Local is true if the local copy of the entry would be
+	// renamed, and false if the remote copy would be.
+	Local bool
+}
+
+// ConflictResolutionPreview describes what conflict resolution would
+// do to an unmerged folder-branch, if it ran now.  It is suitable
+// for encoding directly as JSON.
+type ConflictResolutionPreview struct {
+	// Ops lists the unmerged operations that would be merged.
+	Ops              []string
+	Actions          []CRPreviewAction
+	ConflictedCopies []CRPreviewConflictedCopy
+}
+
+type crPreviewActionsByDir []CRPreviewAction
+
+func (as crPreviewActionsByDir) Len() int {
+	return len(as)
+}
+
+func (as crPreviewActionsByDir) Less(i, j int) bool {
+	if as[i].Dir != as[j].Dir {
+		return as[i].Dir < as[j].Dir
+	}
+	return as[i].Action < as[j].Action
+}
+
+func (as crPreviewActionsByDir) Swap(i, j int) {
+	as[i], as[j] = as[j], as[i]
+}
+
+type crPreviewCopiesByPath []CRPreviewConflictedCopy
+
+func (cs crPreviewCopiesByPath) Len() int {
+	return len(cs)
+}
+
+func (cs crPreviewCopiesByPath) Less(i, j int) bool {
+	return cs[i].Path < cs[j].Path
+}
+
+func (cs crPreviewCopiesByPath) Swap(i, j int) {
+	cs[i], cs[j] = cs[j], cs[i]
+}
+
+// saveInput returns a function that restores the current input to
+// what it is now.  Building the chains moves the current input
+// forward, which would make CR ignore a later resolution request for
+// the same revisions, so anything that builds them without resolving
+// needs to put it back afterward.
+func (cr *ConflictResolver) saveInput() func() {
+	cr.inputLock.Lock()
+	defer cr.inputLock.Unlock()
+	saved := cr.currInput
+	return func() {
+		cr.inputLock.Lock()
+		defer cr.inputLock.Unlock()
+		cr.currInput = saved
+	}
+}
+
+// preview computes the actions conflict resolution would take for
+// the current unmerged branch, without applying any of them.
+func (cr *ConflictResolver) preview(ctx context.Context,
+	lState *lockState) (ConflictResolutionPreview, error) {
+	defer cr.saveInput()()
+
+	unmergedChains, mergedChains, unmergedPaths, mergedPaths, recOps,
+		mergedMDs, err := cr.buildChainsAndPaths(ctx, lState, false)
+	if err != nil {
+		return ConflictResolutionPreview{}, err
+	}
+	if len(mergedPaths) == 0 {
+		return ConflictResolutionPreview{}, nil
+	}
+
+	var preview ConflictResolutionPreview
+	for _, chain := range unmergedChains.byOriginal {
+		for _, op := range chain.ops {
+			preview.Ops = append(preview.Ops, op.String())
+		}
+	}
+	sort.Strings(preview.Ops)
+
+	mostRecentMergedMD := mergedMDs[len(mergedMDs)-1]
+	mostRecentMergedWriterInfo := newWriterInfo(
+		mostRecentMergedMD.LastModifyingWriter(),
+		mostRecentMergedMD.LastModifyingWriterVerifyingKey(),
+		mostRecentMergedMD.Revision())
+	actionMap, _, err := cr.computeActions(
+		ctx, unmergedChains, mergedChains, unmergedPaths, mergedPaths,
+		recOps, mostRecentMergedWriterInfo)
+	if err != nil {
+		return ConflictResolutionPreview{}, err
+	}
+
+	dirs := make(map[BlockPointer]string, len(mergedPaths))
+	for _, p := range mergedPaths {
+		dirs[p.tailPointer()] = p.CanonicalPathString()
+	}
+	for mergedMostRecent, actions := range actionMap {
+		dir := dirs[mergedMostRecent]
+		for _, action := range actions {
+			preview.Actions = append(preview.Actions, CRPreviewAction{
+				Dir:    dir,
+				Action: action.String(),
+			})
+
+			var from, to string
+			local := false
+			switch a := action.(type) {
+			case *renameUnmergedAction:
+				from, to, local = a.fromName, a.toName, true
+			case *renameMergedAction:
+				from, to = a.fromName, a.toName
+			default:
+				continue
+			}
+			preview.ConflictedCopies = append(preview.ConflictedCopies,
+				CRPreviewConflictedCopy{
+					Path:         crPreviewJoin(dir, from),
+					ConflictPath: crPreviewJoin(dir, to),
+					Local:        local,
+				})
+		}
+	}
+	sort.Sort(crPreviewActionsByDir(preview.Actions))
+	sort.Sort(crPreviewCopiesByPath(preview.ConflictedCopies))
+	return preview, nil
+}
+
+func crPreviewJoin(dir, name string) string {
+	return strings.TrimSuffix(dir, "/") + "/" + name
+}
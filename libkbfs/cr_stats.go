@@ -0,0 +1,149 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// Reasons for conflict resolution failures, as reported in
+// ConflictResolutionStatus.Failures and in the metrics registry.
+const (
+	crFailureCanceled      = "Canceled"
+	crFailureMissingBlock  = "MissingBlock"
+	crFailureMDConflict    = "MDConflict"
+	crFailureOverQuota     = "OverQuota"
+	crFailureOther         = "Other"
+	crMetricsPrefix        = "ConflictResolver."
+	crMetricsFailurePrefix = crMetricsPrefix + "Failures."
+)
+
+// ConflictResolutionStatus summarizes the outcomes of all the
+// conflict resolutions attempted for a folder-branch since KBFS
+// started.  It is suitable for encoding directly as JSON.
+type ConflictResolutionStatus struct {
+	Attempts  int64
+	Successes int64
+	// Failures counts failed attempts by reason.
+	Failures map[string]int64 `json:",omitempty"`
+	// OpsMerged is the total number of unmerged operations that
+	// were successfully merged.
+	OpsMerged int64
+	// ConflictCopies is the total number of entries that had to
+	// be renamed out of the way because both branches changed
+	// them.
+	ConflictCopies int64
+	TotalDuration  time.Duration
+	LastDuration   time.Duration
+	LastError      string `json:",omitempty"`
+}
+
+// crFailureReason classifies a conflict resolution error into one
+// of a small, fixed set of reasons, so that it can be used as part
+// of a metric name.
+func crFailureReason(err error) string {
+	switch err {
+	case context.Canceled, context.DeadlineExceeded:
+		return crFailureCanceled
+	}
+	switch err.(type) {
+	case BServerErrorBlockNonExistent, BServerErrorBlockDeleted,
+		BServerErrorBlockArchived:
+		return crFailureMissingBlock
+	case MDServerErrorConflictRevision, MDServerErrorConflictPrevRoot,
+		MDServerErrorConflictDiskUsage, MDServerErrorConflictFolderMapping:
+		return crFailureMDConflict
+	case BServerErrorOverQuota:
+		return crFailureOverQuota
+	default:
+		return crFailureOther
+	}
+}
+
+// crStatsKeeper tracks conflict resolution outcomes for a single
+// folder-branch, and also exports them, aggregated over all
+// folder-branches, to a metrics registry if there is one.
+type crStatsKeeper struct {
+	registry metrics.Registry
+
+	lock   sync.Mutex
+	status ConflictResolutionStatus
+}
+
+func newCRStatsKeeper(registry metrics.Registry) *crStatsKeeper {
+	if registry != nil {
+		// Register these up front, so that they show up
+		// even before the first resolution.
+		metrics.GetOrRegisterCounter(crMetricsPrefix+"Attempts", registry)
+		metrics.GetOrRegisterTimer(crMetricsPrefix+"Duration", registry)
+	}
+	return &crStatsKeeper{registry: registry}
+}
+
+func newCRSample() metrics.Sample {
+	return metrics.NewExpDecaySample(1028, 0.015)
+}
+
+// record notes the outcome of a single conflict resolution attempt,
+// and returns the updated status.
+func (k *crStatsKeeper) record(duration time.Duration,
+	opsMerged, conflictCopies int, err error) ConflictResolutionStatus {
+	if r := k.registry; r != nil {
+		metrics.GetOrRegisterCounter(crMetricsPrefix+"Attempts", r).Inc(1)
+		metrics.GetOrRegisterTimer(crMetricsPrefix+"Duration", r).
+			Update(duration)
+		if err != nil {
+			metrics.GetOrRegisterCounter(
+				crMetricsFailurePrefix+crFailureReason(err), r).Inc(1)
+		} else {
+			metrics.GetOrRegisterCounter(
+				crMetricsPrefix+"Successes", r).Inc(1)
+			metrics.GetOrRegisterHistogram(crMetricsPrefix+"OpsMerged",
+				r, newCRSample()).Update(int64(opsMerged))
+			metrics.GetOrRegisterHistogram(crMetricsPrefix+"ConflictCopies",
+				r, newCRSample()).Update(int64(conflictCopies))
+		}
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.status.Attempts++
+	k.status.TotalDuration += duration
+	k.status.LastDuration = duration
+	if err != nil {
+		if k.status.Failures == nil {
+			k.status.Failures = make(map[string]int64)
+		}
+		k.status.Failures[crFailureReason(err)]++
+		k.status.LastError = err.Error()
+	} else {
+		k.status.Successes++
+		k.status.OpsMerged += int64(opsMerged)
+		k.status.ConflictCopies += int64(conflictCopies)
+		k.status.LastError = ""
+	}
+	return k.getStatusLocked()
+}
+
+func (k *crStatsKeeper) getStatusLocked() ConflictResolutionStatus {
+	status := k.status
+	if k.status.Failures != nil {
+		status.Failures = make(map[string]int64, len(k.status.Failures))
+		for reason, count := range k.status.Failures {
+			status.Failures[reason] = count
+		}
+	}
+	return status
+}
+
+func (k *crStatsKeeper) getStatus() ConflictResolutionStatus {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.getStatusLocked()
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestCRStatsKeeperRecord(t *testing.T) {
+	r := metrics.NewRegistry()
+	k := newCRStatsKeeper(r)
+
+	k.record(2*time.Second, 3, 1, nil)
+	k.record(time.Second, 5, 0, context.Canceled)
+	status := k.record(time.Second, 7, 0, errors.New("boom"))
+
+	require.Equal(t, ConflictResolutionStatus{
+		Attempts:  3,
+		Successes: 1,
+		Failures: map[string]int64{
+			crFailureCanceled: 1,
+			crFailureOther:    1,
+		},
+		OpsMerged:      3,
+		ConflictCopies: 1,
+		TotalDuration:  4 * time.Second,
+		LastDuration:   time.Second,
+		LastError:      "boom",
+	}, status)
+
+	// The returned status must not alias the keeper's.
+	status.Failures[crFailureOther] = 10
+	require.Equal(t, int64(1), k.getStatus().Failures[crFailureOther])
+
+	require.Equal(t, int64(3), metrics.GetOrRegisterCounter(
+		crMetricsPrefix+"Attempts", r).Count())
+	require.Equal(t, int64(1), metrics.GetOrRegisterCounter(
+		crMetricsFailurePrefix+crFailureCanceled, r).Count())
+	require.Equal(t, int64(3), metrics.GetOrRegisterTimer(
+		crMetricsPrefix+"Duration", r).Count())
+	require.Equal(t, int64(3), metrics.GetOrRegisterHistogram(
+		crMetricsPrefix+"OpsMerged", r, newCRSample()).Sum())
+}
+
+func TestCRFailureReason(t *testing.T) {
+	require.Equal(t, crFailureCanceled,
+		crFailureReason(context.DeadlineExceeded))
+	require.Equal(t, crFailureMissingBlock,
+		crFailureReason(BServerErrorBlockNonExistent{}))
+	require.Equal(t, crFailureMDConflict,
+		crFailureReason(MDServerErrorConflictRevision{}))
+	require.Equal(t, crFailureOverQuota,
+		crFailureReason(BServerErrorOverQuota{}))
+	require.Equal(t, crFailureOther, crFailureReason(errors.New("other")))
+}
@@ -8,7 +8,6 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
-	"io"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -17,7 +16,6 @@ import (
 	"github.com/keybase/kbfs/kbfshash"
 	"github.com/keybase/kbfs/tlf"
 	"golang.org/x/crypto/nacl/box"
-	"golang.org/x/crypto/nacl/secretbox"
 )
 
 // CryptoCommon contains many of the function implementations need for
@@ -281,18 +279,40 @@ func (c CryptoCommon) EncryptTLFCryptKeyClientHalf(
 	return
 }
 
-func (c CryptoCommon) encryptData(data []byte, key [32]byte) (encryptedData, error) {
-	var nonce [24]byte
-	err := kbfscrypto.RandRead(nonce[:])
+// blockCipherForVersion returns the cipher used by the given
+// encryption version.
+func blockCipherForVersion(ver EncryptionVer) (kbfscrypto.BlockCipher, error) {
+	switch ver {
+	case EncryptionSecretbox:
+		return kbfscrypto.SecretboxCipher{}, nil
+	case EncryptionAESGCM:
+		return kbfscrypto.AESGCMCipher{}, nil
+	default:
+		return nil, UnknownEncryptionVer{ver}
+	}
+}
+
+func (c CryptoCommon) encryptData(data []byte, key [32]byte,
+	ver EncryptionVer) (encryptedData, error) {
+	cipher, err := blockCipherForVersion(ver)
+	if err != nil {
+		return encryptedData{}, err
+	}
+
+	nonce := make([]byte, cipher.NonceSize())
+	err = kbfscrypto.RandRead(nonce)
 	if err != nil {
 		return encryptedData{}, err
 	}
 
-	sealedData := secretbox.Seal(nil, data, &nonce, &key)
+	sealedData, err := cipher.Seal(nil, data, nonce, key)
+	if err != nil {
+		return encryptedData{}, err
+	}
 
 	return encryptedData{
-		Version:       EncryptionSecretbox,
-		Nonce:         nonce[:],
+		Version:       ver,
+		Nonce:         nonce,
 		EncryptedData: sealedData,
 	}, nil
 }
@@ -306,7 +326,8 @@ func (c CryptoCommon) EncryptPrivateMetadata(
 		return
 	}
 
-	encryptedData, err := c.encryptData(encodedPmd, key.Data())
+	encryptedData, err := c.encryptData(
+		encodedPmd, key.Data(), EncryptionSecretbox)
 	if err != nil {
 		return
 	}
@@ -315,30 +336,28 @@ func (c CryptoCommon) EncryptPrivateMetadata(
 	return
 }
 
-func (c CryptoCommon) decryptData(encryptedData encryptedData, key [32]byte) ([]byte, error) {
-	if encryptedData.Version != EncryptionSecretbox {
-		return nil, UnknownEncryptionVer{encryptedData.Version}
+// decryptData decrypts encryptedData and appends the result to out.
+func (c CryptoCommon) decryptData(out []byte, encryptedData encryptedData,
+	key [32]byte) ([]byte, error) {
+	cipher, err := blockCipherForVersion(encryptedData.Version)
+	if err != nil {
+		return nil, err
 	}
 
-	var nonce [24]byte
-	if len(encryptedData.Nonce) != len(nonce) {
+	if len(encryptedData.Nonce) != cipher.NonceSize() {
 		return nil, InvalidNonceError{encryptedData.Nonce}
 	}
-	copy(nonce[:], encryptedData.Nonce)
 
-	decryptedData, ok := secretbox.Open(nil, encryptedData.EncryptedData, &nonce, &key)
-	if !ok {
-		return nil, libkb.DecryptionError{}
-	}
-
-	return decryptedData, nil
+	return cipher.Open(
+		out, encryptedData.EncryptedData, encryptedData.Nonce, key)
 }
 
 // DecryptPrivateMetadata implements the Crypto interface for CryptoCommon.
 func (c CryptoCommon) DecryptPrivateMetadata(
 	encryptedPmd EncryptedPrivateMetadata, key kbfscrypto.TLFCryptKey) (
 	PrivateMetadata, error) {
-	encodedPmd, err := c.decryptData(encryptedData(encryptedPmd), key.Data())
+	encodedPmd, err := c.decryptData(
+		nil, encryptedData(encryptedPmd), key.Data())
 	if err != nil {
 		return PrivateMetadata{}, err
 	}
@@ -380,30 +399,39 @@ const padPrefixSize = 4
 
 // padBlock adds random padding to an encoded block.
 func (c CryptoCommon) padBlock(block []byte) ([]byte, error) {
+	return appendPaddedBlock(nil, block)
+}
+
+// appendPaddedBlock appends block to out with random padding, and
+// its length in front.  Only the padded block is allocated (and only
+// if out doesn't have room for it); the padding is read straight
+// into place.
+func appendPaddedBlock(out, block []byte) ([]byte, error) {
 	blockLen := uint32(len(block))
-	overallLen := nextPowerOfTwo(blockLen)
-	padLen := int64(overallLen - blockLen)
+	paddedLen := padPrefixSize + int(nextPowerOfTwo(blockLen))
 
-	buf := bytes.NewBuffer(make([]byte, 0, overallLen+padPrefixSize))
+	start := len(out)
+	if cap(out)-start < paddedLen {
+		newOut := make([]byte, start, start+paddedLen)
+		copy(newOut, out)
+		out = newOut
+	}
+	out = out[:start+paddedLen]
+	padded := out[start:]
 
 	// first 4 bytes contain the length of the block data
-	if err := binary.Write(buf, binary.LittleEndian, blockLen); err != nil {
-		return nil, err
-	}
+	binary.LittleEndian.PutUint32(padded, blockLen)
 
 	// followed by the actual block data
-	buf.Write(block)
+	n := copy(padded[padPrefixSize:], block)
 
 	// followed by random data
-	n, err := io.CopyN(buf, rand.Reader, padLen)
+	err := kbfscrypto.RandRead(padded[padPrefixSize+n:])
 	if err != nil {
 		return nil, err
 	}
-	if n != padLen {
-		return nil, kbfscrypto.UnexpectedShortCryptoRandRead{}
-	}
 
-	return buf.Bytes(), nil
+	return out, nil
 }
 
 // depadBlock extracts the actual block data from a padded block.
@@ -412,30 +440,40 @@ func (c CryptoCommon) depadBlock(paddedBlock []byte) ([]byte, error) {
 
 	var blockLen uint32
 	if err := binary.Read(buf, binary.LittleEndian, &blockLen); err != nil {
-		return nil, err
+		return nil, PaddedBlockReadError{
+			ActualLen: len(paddedBlock), ExpectedLen: padPrefixSize}
 	}
-	blockEndPos := int(blockLen + padPrefixSize)
+	// Convert before adding, so that a huge length from a
+	// malformed block can't wrap around.
+	blockEndPos := int64(blockLen) + padPrefixSize
 
-	if len(paddedBlock) < blockEndPos {
-		return nil, PaddedBlockReadError{ActualLen: len(paddedBlock), ExpectedLen: blockEndPos}
+	if int64(len(paddedBlock)) < blockEndPos {
+		return nil, PaddedBlockReadError{
+			ActualLen: len(paddedBlock), ExpectedLen: int(blockEndPos)}
 	}
 	return buf.Next(int(blockLen)), nil
 }
 
 // EncryptBlock implements the Crypto interface for CryptoCommon.
-func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
+func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey,
+	ver EncryptionVer) (
 	plainSize int, encryptedBlock EncryptedBlock, err error) {
 	encodedBlock, err := c.codec.Encode(block)
 	if err != nil {
 		return
 	}
 
-	paddedBlock, err := c.padBlock(encodedBlock)
+	// The padded block is only needed until it's sealed, so pad
+	// it into a pooled buffer.
+	paddedBuf := getBlockBuffer(padPrefixSize +
+		int(nextPowerOfTwo(uint32(len(encodedBlock)))))
+	defer putBlockBuffer(paddedBuf)
+	paddedBlock, err := appendPaddedBlock(*paddedBuf, encodedBlock)
 	if err != nil {
 		return
 	}
 
-	encryptedData, err := c.encryptData(paddedBlock, key.Data())
+	encryptedData, err := c.encryptData(paddedBlock, key.Data(), ver)
 	if err != nil {
 		return
 	}
@@ -449,11 +487,22 @@ func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
 func (c CryptoCommon) DecryptBlock(
 	encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey,
 	block Block) error {
-	paddedBlock, err := c.decryptData(encryptedData(encryptedBlock), key.Data())
+	// The decoded block doesn't refer to the padded block (the
+	// codec copies everything it decodes), so decrypt it into a
+	// pooled buffer.
+	paddedBuf := getBlockBuffer(len(encryptedBlock.EncryptedData))
+	defer putBlockBuffer(paddedBuf)
+	paddedBlock, err := c.decryptData(
+		*paddedBuf, encryptedData(encryptedBlock), key.Data())
 	if err != nil {
 		return err
 	}
+	return c.decodePaddedBlock(paddedBlock, block)
+}
 
+// decodePaddedBlock extracts the encoded block data from a decrypted
+// padded block, and decodes it into the given block.
+func (c CryptoCommon) decodePaddedBlock(paddedBlock []byte, block Block) error {
 	encodedBlock, err := c.depadBlock(paddedBlock)
 	if err != nil {
 		return err
@@ -550,7 +599,8 @@ func (c CryptoCommon) EncryptTLFCryptKeys(
 		return
 	}
 
-	encryptedData, err := c.encryptData(encodedKeys, key.Data())
+	encryptedData, err := c.encryptData(
+		encodedKeys, key.Data(), EncryptionSecretbox)
 	if err != nil {
 		return
 	}
@@ -563,7 +613,8 @@ func (c CryptoCommon) EncryptTLFCryptKeys(
 func (c CryptoCommon) DecryptTLFCryptKeys(
 	encKeys EncryptedTLFCryptKeys, key kbfscrypto.TLFCryptKey) (
 	[]kbfscrypto.TLFCryptKey, error) {
-	encodedKeys, err := c.decryptData(encryptedData(encKeys), key.Data())
+	encodedKeys, err := c.decryptData(
+		nil, encryptedData(encKeys), key.Data())
 	if err != nil {
 		return nil, err
 	}
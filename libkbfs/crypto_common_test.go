@@ -251,7 +251,8 @@ func TestCryptoCommonEncryptDecryptBlock(t *testing.T) {
 	block := TestBlock{42}
 	key := kbfscrypto.BlockCryptKey{}
 
-	_, encryptedBlock, err := c.EncryptBlock(&block, key)
+	_, encryptedBlock, err := c.EncryptBlock(
+		&block, key, EncryptionSecretbox)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -568,7 +569,7 @@ func checkDecryptionFailures(
 	// Wrong version.
 
 	encryptedDataWrongVersion := encryptedData
-	encryptedDataWrongVersion.Version++
+	encryptedDataWrongVersion.Version = 0
 	expectedErr = UnknownEncryptionVer{encryptedDataWrongVersion.Version}
 	err = decryptFn(encryptedDataWrongVersion, key)
 	if err != expectedErr {
@@ -640,7 +641,7 @@ func TestDecryptPrivateMetadataFailures(t *testing.T) {
 		})
 }
 
-func makeFakeBlockCryptKey(t *testing.T) kbfscrypto.BlockCryptKey {
+func makeFakeBlockCryptKey(t testing.TB) kbfscrypto.BlockCryptKey {
 	var blockCryptKeyData [32]byte
 	err := kbfscrypto.RandRead(blockCryptKeyData[:])
 	blockCryptKey := kbfscrypto.MakeBlockCryptKey(blockCryptKeyData)
@@ -663,7 +664,8 @@ func TestEncryptBlock(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	plainSize, encryptedBlock, err := c.EncryptBlock(&block, cryptKey)
+	plainSize, encryptedBlock, err := c.EncryptBlock(
+		&block, cryptKey, EncryptionSecretbox)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -724,7 +726,8 @@ func TestDecryptEncryptedBlock(t *testing.T) {
 
 	block := TestBlock{50}
 
-	_, encryptedBlock, err := c.EncryptBlock(&block, cryptKey)
+	_, encryptedBlock, err := c.EncryptBlock(
+		&block, cryptKey, EncryptionSecretbox)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -748,7 +751,8 @@ func TestDecryptBlockFailures(t *testing.T) {
 
 	block := TestBlock{50}
 
-	_, encryptedBlock, err := c.EncryptBlock(&block, cryptKey)
+	_, encryptedBlock, err := c.EncryptBlock(
+		&block, cryptKey, EncryptionSecretbox)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -770,6 +774,56 @@ func TestDecryptBlockFailures(t *testing.T) {
 		})
 }
 
+// Test that crypto.DecryptBlock() decrypts a Block object encrypted
+// with AES-256-GCM, and rejects it when it's tampered with.
+func TestDecryptEncryptedBlockAESGCM(t *testing.T) {
+	c := MakeCryptoCommon(kbfscodec.NewMsgpack())
+
+	cryptKey := makeFakeBlockCryptKey(t)
+
+	block := TestBlock{50}
+
+	_, encryptedBlock, err := c.EncryptBlock(
+		&block, cryptKey, EncryptionAESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if encryptedBlock.Version != EncryptionAESGCM {
+		t.Errorf("Expected version %d, got %d",
+			EncryptionAESGCM, encryptedBlock.Version)
+	}
+	nonceSize := kbfscrypto.AESGCMCipher{}.NonceSize()
+	if len(encryptedBlock.Nonce) != nonceSize {
+		t.Errorf("Expected a nonce of %d bytes, got %d",
+			nonceSize, len(encryptedBlock.Nonce))
+	}
+
+	var decryptedBlock TestBlock
+	err = c.DecryptBlock(encryptedBlock, cryptKey, &decryptedBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decryptedBlock != block {
+		t.Errorf("Decrypted block %d doesn't match %d", decryptedBlock, block)
+	}
+
+	checkDecryptionFailures(t, encryptedData(encryptedBlock), cryptKey,
+		func(encryptedData encryptedData, key interface{}) error {
+			var dummy TestBlock
+			return c.DecryptBlock(
+				EncryptedBlock(encryptedData),
+				key.(kbfscrypto.BlockCryptKey), &dummy)
+		},
+		func(key interface{}) interface{} {
+			cryptKey := key.(kbfscrypto.BlockCryptKey)
+			cryptKeyCorruptData := cryptKey.Data()
+			cryptKeyCorruptData[0] = ^cryptKeyCorruptData[0]
+			return kbfscrypto.MakeBlockCryptKey(cryptKeyCorruptData)
+		})
+}
+
 // Test padding of blocks results in a larger block, with length
 // equal to power of 2 + 4.
 func TestBlockPadding(t *testing.T) {
@@ -918,7 +972,8 @@ func TestBlockEncryptedLen(t *testing.T) {
 	var expectedLen int
 	for i := 1025; i < 2000; i++ {
 		data := randomData[:i]
-		_, encBlock, err := c.EncryptBlock(&data, cryptKey)
+		_, encBlock, err := c.EncryptBlock(
+			&data, cryptKey, EncryptionSecretbox)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -934,3 +989,42 @@ func TestBlockEncryptedLen(t *testing.T) {
 		}
 	}
 }
+
+// makeBenchmarkFileBlock returns a file block with size bytes of
+// random contents.
+func makeBenchmarkFileBlock(b *testing.B, size int) *FileBlock {
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = make([]byte, size)
+	if err := kbfscrypto.RandRead(block.Contents); err != nil {
+		b.Fatal(err)
+	}
+	return block
+}
+
+func benchmarkEncryptBlock(b *testing.B, ver EncryptionVer, size int) {
+	c := MakeCryptoCommon(kbfscodec.NewMsgpack())
+	cryptKey := makeFakeBlockCryptKey(b)
+	block := makeBenchmarkFileBlock(b, size)
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := c.EncryptBlock(block, cryptKey, ver)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncryptBlockSecretbox64k(b *testing.B) {
+	benchmarkEncryptBlock(b, EncryptionSecretbox, 64*1024)
+}
+
+func BenchmarkEncryptBlockSecretbox512k(b *testing.B) {
+	benchmarkEncryptBlock(b, EncryptionSecretbox, 512*1024)
+}
+
+func BenchmarkEncryptBlockAESGCM512k(b *testing.B) {
+	benchmarkEncryptBlock(b, EncryptionAESGCM, 512*1024)
+}
@@ -0,0 +1,180 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"golang.org/x/net/context"
+)
+
+// CryptoKeyAgent is a Crypto implementation whose signing and
+// decryption are done by an external key agent process, which might
+// keep the device keys in a PKCS#11 token, a TPM, or a Secure
+// Enclave.  See kbfscrypto.KeyAgentClient for the protocol the agent
+// must serve.
+type CryptoKeyAgent struct {
+	CryptoLocal
+	config     Config
+	log        logger.Logger
+	shutdownFn func()
+}
+
+var _ Crypto = (*CryptoKeyAgent)(nil)
+
+var _ rpc.ConnectionHandler = (*CryptoKeyAgent)(nil)
+
+// NewCryptoKeyAgent constructs a new CryptoKeyAgent that talks to the
+// agent listening on the given unix socket.
+func NewCryptoKeyAgent(config Config, kbCtx Context,
+	socketPath string) *CryptoKeyAgent {
+	c := &CryptoKeyAgent{
+		config: config,
+		log:    config.MakeLogger(""),
+	}
+	transport := &unixSocketTransport{
+		socketPath: socketPath,
+		logFactory: kbCtx.NewRPCLogFactory(),
+	}
+	conn := rpc.NewConnectionWithTransport(c, transport,
+		libkb.ErrorUnwrapper{}, true, libkb.WrapError,
+		config.MakeLogger(""), LogTagsFromContext)
+	c.init(kbfscrypto.KeyAgentClient{Cli: conn.GetClient()},
+		conn.Shutdown)
+	return c
+}
+
+// newCryptoKeyAgentWithAgent should only be used for testing.
+func newCryptoKeyAgentWithAgent(config Config,
+	agent kbfscrypto.KeyAgent) *CryptoKeyAgent {
+	c := &CryptoKeyAgent{
+		config: config,
+		log:    config.MakeLogger(""),
+	}
+	c.init(agent, func() {})
+	return c
+}
+
+func (c *CryptoKeyAgent) init(agent kbfscrypto.KeyAgent, shutdownFn func()) {
+	c.CryptoLocal = NewCryptoLocalWithProviders(c.config.Codec(),
+		kbfscrypto.KeyAgentSigner{Agent: agent},
+		kbfscrypto.KeyAgentDecrypter{Agent: agent})
+	c.shutdownFn = shutdownFn
+}
+
+// Shutdown implements the Crypto interface for CryptoKeyAgent.
+func (c *CryptoKeyAgent) Shutdown() {
+	c.shutdownFn()
+}
+
+// HandlerName implements the ConnectionHandler interface.
+func (*CryptoKeyAgent) HandlerName() string {
+	return "CryptoKeyAgent"
+}
+
+// OnConnect implements the ConnectionHandler interface.
+func (c *CryptoKeyAgent) OnConnect(ctx context.Context, conn *rpc.Connection,
+	_ rpc.GenericClient, server *rpc.Server) error {
+	c.config.KBFSOps().PushConnectionStatusChange(KeyAgentServiceName, nil)
+	return nil
+}
+
+// OnConnectError implements the ConnectionHandler interface.
+func (c *CryptoKeyAgent) OnConnectError(err error, wait time.Duration) {
+	c.log.Warning("CryptoKeyAgent: connection error: %q; retrying in %s",
+		err, wait)
+	c.config.KBFSOps().PushConnectionStatusChange(KeyAgentServiceName, err)
+}
+
+// OnDoCommandError implements the ConnectionHandler interface.
+func (c *CryptoKeyAgent) OnDoCommandError(err error, wait time.Duration) {
+	c.log.Warning("CryptoKeyAgent: docommand error: %q; retrying in %s",
+		err, wait)
+	c.config.KBFSOps().PushConnectionStatusChange(KeyAgentServiceName, err)
+}
+
+// OnDisconnected implements the ConnectionHandler interface.
+func (c *CryptoKeyAgent) OnDisconnected(_ context.Context,
+	status rpc.DisconnectStatus) {
+	if status == rpc.StartingNonFirstConnection {
+		c.log.Warning("CryptoKeyAgent is disconnected")
+		c.config.KBFSOps().PushConnectionStatusChange(
+			KeyAgentServiceName, errDisconnected{})
+	}
+}
+
+// ShouldRetry implements the ConnectionHandler interface.
+func (c *CryptoKeyAgent) ShouldRetry(rpcName string, err error) bool {
+	return false
+}
+
+// ShouldRetryOnConnect implements the ConnectionHandler interface.
+func (c *CryptoKeyAgent) ShouldRetryOnConnect(err error) bool {
+	return true
+}
+
+// unixSocketTransport is a ConnectionTransport implementation that
+// dials a local service, like a key agent, over a unix socket.
+type unixSocketTransport struct {
+	socketPath string
+	logFactory rpc.LogFactory
+
+	// Protects everything below.
+	mutex           sync.Mutex
+	conn            net.Conn
+	transport       rpc.Transporter
+	stagedTransport rpc.Transporter
+}
+
+var _ rpc.ConnectionTransport = (*unixSocketTransport)(nil)
+
+// Dial is an implementation of the ConnectionTransport interface.
+func (kt *unixSocketTransport) Dial(ctx context.Context) (
+	rpc.Transporter, error) {
+	conn, err := net.Dial("unix", kt.socketPath)
+	if err != nil {
+		return nil, err
+	}
+	transport := rpc.NewTransport(conn, kt.logFactory, libkb.WrapError)
+
+	kt.mutex.Lock()
+	defer kt.mutex.Unlock()
+	kt.conn = conn
+	kt.stagedTransport = transport
+	return transport, nil
+}
+
+// IsConnected is an implementation of the ConnectionTransport interface.
+func (kt *unixSocketTransport) IsConnected() bool {
+	kt.mutex.Lock()
+	defer kt.mutex.Unlock()
+	return kt.transport != nil && kt.transport.IsConnected()
+}
+
+// Finalize is an implementation of the ConnectionTransport interface.
+func (kt *unixSocketTransport) Finalize() {
+	kt.mutex.Lock()
+	defer kt.mutex.Unlock()
+	kt.transport = kt.stagedTransport
+	kt.stagedTransport = nil
+}
+
+// Close is an implementation of the ConnectionTransport interface.
+func (kt *unixSocketTransport) Close() {
+	kt.mutex.Lock()
+	defer kt.mutex.Unlock()
+	if kt.conn != nil {
+		kt.conn.Close()
+	}
+	kt.conn = nil
+	kt.transport = nil
+	kt.stagedTransport = nil
+}
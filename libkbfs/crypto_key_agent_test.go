@@ -0,0 +1,110 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// Test that a CryptoKeyAgent signs and decrypts like a CryptoLocal
+// holding the same keys.
+func TestCryptoKeyAgentSignAndDecrypt(t *testing.T) {
+	ctx := context.Background()
+	config := testCryptoClientConfig(t)
+	agent := kbfscrypto.MakeFakeKeyAgentOrBust("agent")
+	local := NewCryptoLocal(config.Codec(), agent.SigningKey, agent.CryptKey)
+	c := newCryptoKeyAgentWithAgent(config, agent)
+	defer c.Shutdown()
+
+	msg := []byte("message")
+	expected, err := local.SignForKBFS(ctx, msg)
+	require.NoError(t, err)
+	sigInfo, err := c.SignForKBFS(ctx, msg)
+	require.NoError(t, err)
+	require.Equal(t, expected, sigInfo)
+	require.NoError(t, c.Verify(msg, sigInfo))
+
+	_, _, ePubKey, ePrivKey, cryptKey, err := c.MakeRandomTLFKeys()
+	require.NoError(t, err)
+	serverHalf, err := c.MakeRandomTLFCryptKeyServerHalf()
+	require.NoError(t, err)
+	clientHalf, err := c.MaskTLFCryptKey(serverHalf, cryptKey)
+	require.NoError(t, err)
+	encryptedClientHalf, err := c.EncryptTLFCryptKeyClientHalf(
+		ePrivKey, agent.CryptKey.GetPublicKey(), clientHalf)
+	require.NoError(t, err)
+
+	decryptedClientHalf, err := c.DecryptTLFCryptKeyClientHalf(
+		ctx, ePubKey, encryptedClientHalf)
+	require.NoError(t, err)
+	require.Equal(t, clientHalf, decryptedClientHalf)
+
+	// Only the second key is for the agent's crypt key.
+	otherKey := kbfscrypto.MakeFakeCryptPrivateKeyOrBust("other")
+	otherEncryptedClientHalf, err := c.EncryptTLFCryptKeyClientHalf(
+		ePrivKey, otherKey.GetPublicKey(), clientHalf)
+	require.NoError(t, err)
+	keys := []EncryptedTLFCryptKeyClientAndEphemeral{
+		{EPubKey: ePubKey, ClientHalf: otherEncryptedClientHalf},
+		{EPubKey: ePubKey, ClientHalf: encryptedClientHalf},
+	}
+	decryptedClientHalf, index, err := c.DecryptTLFCryptKeyClientHalfAny(
+		ctx, keys, false)
+	require.NoError(t, err)
+	require.Equal(t, clientHalf, decryptedClientHalf)
+	require.Equal(t, 1, index)
+}
+
+type failingKeyAgent struct {
+	err error
+}
+
+func (a failingKeyAgent) SignED25519(ctx context.Context, msg []byte) (
+	keybase1.ED25519SignatureInfo, error) {
+	return keybase1.ED25519SignatureInfo{}, a.err
+}
+
+func (a failingKeyAgent) BoxOpen(ctx context.Context,
+	peersPublicKey [32]byte, nonce [24]byte, boxed []byte) (
+	[]byte, error) {
+	return nil, a.err
+}
+
+// Test that errors from the key agent itself aren't mistaken for
+// keys that can't be decrypted.
+func TestCryptoKeyAgentErrors(t *testing.T) {
+	ctx := context.Background()
+	config := testCryptoClientConfig(t)
+	agentErr := errors.New("agent unavailable")
+	c := newCryptoKeyAgentWithAgent(config, failingKeyAgent{agentErr})
+	defer c.Shutdown()
+
+	_, err := c.Sign(ctx, []byte("message"))
+	require.Equal(t, agentErr, err)
+
+	_, _, ePubKey, ePrivKey, cryptKey, err := c.MakeRandomTLFKeys()
+	require.NoError(t, err)
+	serverHalf, err := c.MakeRandomTLFCryptKeyServerHalf()
+	require.NoError(t, err)
+	clientHalf, err := c.MaskTLFCryptKey(serverHalf, cryptKey)
+	require.NoError(t, err)
+	cryptPrivateKey := kbfscrypto.MakeFakeCryptPrivateKeyOrBust("agent")
+	encryptedClientHalf, err := c.EncryptTLFCryptKeyClientHalf(
+		ePrivKey, cryptPrivateKey.GetPublicKey(), clientHalf)
+	require.NoError(t, err)
+
+	keys := []EncryptedTLFCryptKeyClientAndEphemeral{
+		{EPubKey: ePubKey, ClientHalf: encryptedClientHalf},
+		{EPubKey: ePubKey, ClientHalf: encryptedClientHalf},
+	}
+	_, _, err = c.DecryptTLFCryptKeyClientHalfAny(ctx, keys, false)
+	require.Equal(t, agentErr, err)
+}
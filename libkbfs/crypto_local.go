@@ -12,25 +12,36 @@ import (
 	"golang.org/x/net/context"
 )
 
-// CryptoLocal implements the Crypto interface by using a local
-// signing key and a local crypt private key.
+// CryptoLocal implements the Crypto interface by doing all the
+// private key operations with a kbfscrypto.Signer and a
+// kbfscrypto.Decrypter, which may hold the keys locally or delegate
+// to something else, like a key agent.
 type CryptoLocal struct {
 	CryptoCommon
-	kbfscrypto.SigningKeySigner
-	cryptPrivateKey kbfscrypto.CryptPrivateKey
+	kbfscrypto.Signer
+	decrypter kbfscrypto.Decrypter
 }
 
 var _ Crypto = CryptoLocal{}
 
 // NewCryptoLocal constructs a new CryptoLocal instance with the given
-// signing key.
+// signing key and crypt private key.
 func NewCryptoLocal(codec kbfscodec.Codec,
 	signingKey kbfscrypto.SigningKey,
 	cryptPrivateKey kbfscrypto.CryptPrivateKey) CryptoLocal {
+	return NewCryptoLocalWithProviders(codec,
+		kbfscrypto.SigningKeySigner{Key: signingKey},
+		kbfscrypto.CryptPrivateKeyDecrypter{Key: cryptPrivateKey})
+}
+
+// NewCryptoLocalWithProviders constructs a new CryptoLocal instance
+// that signs with signer and decrypts with decrypter.
+func NewCryptoLocalWithProviders(codec kbfscodec.Codec,
+	signer kbfscrypto.Signer, decrypter kbfscrypto.Decrypter) CryptoLocal {
 	return CryptoLocal{
 		MakeCryptoCommon(codec),
-		kbfscrypto.SigningKeySigner{Key: signingKey},
-		cryptPrivateKey,
+		signer,
+		decrypter,
 	}
 }
 
@@ -69,12 +80,9 @@ func (c CryptoLocal) DecryptTLFCryptKeyClientHalf(ctx context.Context,
 		return
 	}
 
-	publicKeyData := publicKey.Data()
-	privateKeyData := c.cryptPrivateKey.Data()
-	decryptedData, ok := box.Open(nil, encryptedClientHalf.EncryptedData,
-		&nonce, &publicKeyData, &privateKeyData)
-	if !ok {
-		err = libkb.DecryptionError{}
+	decryptedData, err := c.decrypter.DecryptBoxed(ctx, publicKey.Data(),
+		nonce, encryptedClientHalf.EncryptedData)
+	if err != nil {
 		return
 	}
 
@@ -101,17 +109,20 @@ func (c CryptoLocal) DecryptTLFCryptKeyClientHalfAny(ctx context.Context,
 		if err != nil {
 			continue
 		}
-		ePubKeyData := k.EPubKey.Data()
-		privateKeyData := c.cryptPrivateKey.Data()
-		decryptedData, ok := box.Open(
-			nil, k.ClientHalf.EncryptedData, &nonce,
-			&ePubKeyData, &privateKeyData)
-		if ok {
-			var clientHalfData [32]byte
-			copy(clientHalfData[:], decryptedData)
-			return kbfscrypto.MakeTLFCryptKeyClientHalf(
-				clientHalfData), i, nil
+		decryptedData, err := c.decrypter.DecryptBoxed(
+			ctx, k.EPubKey.Data(), nonce, k.ClientHalf.EncryptedData)
+		if _, ok := err.(libkb.DecryptionError); ok {
+			continue
+		} else if err != nil {
+			// Something other than the key is wrong, like
+			// a lost connection to a key agent, so don't
+			// bother with the other keys.
+			return clientHalf, index, err
 		}
+		var clientHalfData [32]byte
+		copy(clientHalfData[:], decryptedData)
+		return kbfscrypto.MakeTLFCryptKeyClientHalf(
+			clientHalfData), i, nil
 	}
 	err = libkb.DecryptionError{}
 	return
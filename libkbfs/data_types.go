@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"encoding/hex"
 	"fmt"
+	"os"
 	"reflect"
 	"strings"
 	"time"
@@ -63,6 +64,11 @@ const (
 	// EncryptionSecretbox is the encryption version that uses
 	// nacl/secretbox or nacl/box.
 	EncryptionSecretbox EncryptionVer = 1
+	// EncryptionAESGCM is the encryption version that uses
+	// AES-256-GCM.  It's only used for blocks, whose pointers
+	// then have at least AESGCMDataVer, so that older clients
+	// refuse them instead of failing to decrypt them.
+	EncryptionAESGCM EncryptionVer = 2
 )
 
 // encryptedData is encrypted data with a nonce and a version.
@@ -154,6 +160,14 @@ const (
 	// FilesWithHolesDataVer is the data version for files
 	// with holes.
 	FilesWithHolesDataVer DataVer = 2
+	// AESGCMDataVer is the data version for blocks encrypted with
+	// EncryptionAESGCM.
+	AESGCMDataVer DataVer = 3
+	// IndirectDirsDataVer is the data version for directories
+	// whose entries are split across indirect blocks (see
+	// indirect_dir.go).  Older clients would take such a
+	// directory for an empty one.
+	IndirectDirsDataVer DataVer = 4
 )
 
 // BlockRefNonce is a 64-bit unique sequence of bytes for identifying
@@ -326,9 +340,29 @@ var bpSize = uint64(reflect.TypeOf(BlockPointer{}).Size())
 
 // ReadyBlockData is a block that has been encoded (and encrypted).
 type ReadyBlockData struct {
-	// These fields should not be used outside of putBlockToServer.
+	// These fields should not be used outside of putBlockToServer
+	// and putBlockBatchToServer.
 	buf        []byte
 	serverHalf kbfscrypto.BlockCryptKeyServerHalf
+
+	// encryptionVer is the version buf was encrypted with, if it
+	// was encrypted by BlockOps.Ready.
+	encryptionVer EncryptionVer
+
+	// indirectDir is set if the block is an indirect DirBlock.
+	indirectDir bool
+}
+
+// dataVersion returns the data version to use in pointers to a
+// block with the given data version, once it's readied as r.
+func (r ReadyBlockData) dataVersion(blockVer DataVer) DataVer {
+	if r.encryptionVer == EncryptionAESGCM && blockVer < AESGCMDataVer {
+		blockVer = AESGCMDataVer
+	}
+	if r.indirectDir && blockVer < IndirectDirsDataVer {
+		blockVer = IndirectDirsDataVer
+	}
+	return blockVer
 }
 
 // GetEncodedSize returns the size of the encoded (and encrypted)
@@ -337,6 +371,15 @@ func (r ReadyBlockData) GetEncodedSize() int {
 	return len(r.buf)
 }
 
+// BlockPut holds the arguments for one of the puts in a call to
+// BlockServer.PutBlocks.
+type BlockPut struct {
+	ID         BlockID
+	Context    BlockContext
+	Buf        []byte
+	ServerHalf kbfscrypto.BlockCryptKeyServerHalf
+}
+
 // Favorite is a top-level favorited folder name.
 type Favorite struct {
 	Name   string
@@ -369,6 +412,31 @@ func (f Favorite) toKBFolder(created bool) keybase1.Folder {
 	}
 }
 
+// FavoriteMetadata describes the latest activity in a favorite
+// folder.  It's all zero for a folder that has never been written.
+type FavoriteMetadata struct {
+	// Revision is the latest merged revision of the folder.
+	Revision MetadataRevision
+	// LastModified is when the latest revision was made,
+	// according to the server.
+	LastModified time.Time
+	// LastWriter is the user who made the latest change to the
+	// folder's contents.
+	LastWriter libkb.NormalizedUsername
+	// Unread is true if the folder has changed, by another device
+	// or user, since this device last caught up with it.  A
+	// folder this device has never seen is taken to be read as
+	// of the first time its metadata is fetched.
+	Unread bool
+}
+
+// FavoriteWithMetadata is a favorite along with the metadata of its
+// folder, as returned by KBFSOps.GetFavoritesWithMetadata.
+type FavoriteWithMetadata struct {
+	Favorite
+	FavoriteMetadata
+}
+
 // BranchName is the name given to a KBFS branch, for a particular
 // top-level folder.  Currently, the notion of a "branch" is
 // client-side only, and can be used to specify which root to use for
@@ -398,6 +466,18 @@ func (fb FolderBranch) String() string {
 	return s
 }
 
+// folderBranchList sorts FolderBranches by TLF ID, then by branch.
+type folderBranchList []FolderBranch
+
+func (l folderBranchList) Len() int { return len(l) }
+func (l folderBranchList) Less(i, j int) bool {
+	if l[i].Tlf != l[j].Tlf {
+		return l[i].Tlf.String() < l[j].Tlf.String()
+	}
+	return l[i].Branch < l[j].Branch
+}
+func (l folderBranchList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
 // BlockChanges tracks the set of blocks that changed in a commit, and
 // the operations that made the changes.  It might consist of just a
 // BlockPointer if the list is too big to embed in the MD structure
@@ -512,6 +592,40 @@ func (et EntryType) String() string {
 	return "<invalid EntryType>"
 }
 
+// SpecialFileType is the type of a special file, like a named pipe,
+// stored in KBFS.  Special files have no contents; they're stored
+// as symlinks (see KBFSOps.CreateSpecialFile), so that old clients
+// see a dangling symlink rather than an unknown entry type.
+type SpecialFileType int
+
+const (
+	// NotSpecial means the entry isn't a special file.
+	NotSpecial SpecialFileType = iota
+	// Fifo is a named pipe.
+	Fifo
+	// Socket is a Unix domain socket.
+	Socket
+)
+
+// String implements the fmt.Stringer interface for SpecialFileType
+func (st SpecialFileType) String() string {
+	switch st {
+	case NotSpecial:
+		return "NOT_SPECIAL"
+	case Fifo:
+		return "FIFO"
+	case Socket:
+		return "SOCKET"
+	}
+	return "<invalid SpecialFileType>"
+}
+
+// symPath returns the symlink target stored for a special file of
+// this type.  It's under a disallowed prefix, so it never resolves.
+func (st SpecialFileType) symPath() string {
+	return ".kbfs_special_" + strings.ToLower(st.String())
+}
+
 // Excl indicates whether O_EXCL is set on a fuse call
 type Excl bool
 
@@ -548,6 +662,74 @@ type EntryInfo struct {
 	Mtime int64
 	// Ctime is in unix nanoseconds
 	Ctime int64
+	// LongName is the full name of an entry whose name is too
+	// long to be stored directly (see Config.LongNameSupport).
+	LongName string `codec:",omitempty"`
+	// Xattrs are the extended attributes of the entry.  The map
+	// is shared between copies of the entry, so it must be
+	// replaced rather than modified in place.
+	Xattrs map[string][]byte `codec:",omitempty"`
+	// Perm holds the owner permission bits of the entry, if they
+	// have been set explicitly; see OwnerPerm.
+	Perm EntryPerm `codec:",omitempty"`
+	// Special is the type of the special file a Sym entry stands
+	// for, if any.
+	Special SpecialFileType `codec:",omitempty"`
+	// AppendOnly is set on files that may only be written at
+	// their end, and never truncated (see KBFSOps.SetAppendOnly).
+	AppendOnly bool `codec:",omitempty"`
+	// ChildCount is the number of entries in a directory.
+	ChildCount uint64 `codec:",omitempty"`
+	// RecursiveSize is the total Size of all the entries under a
+	// directory, at any depth.  Like ChildCount, it's updated
+	// whenever the directory, or anything under it, is synced;
+	// directories that haven't changed since these fields were
+	// added report zero for both.
+	RecursiveSize uint64 `codec:",omitempty"`
+	// Derived holds metadata computed from the contents of a file
+	// by the PostWriteHooks registered on the Config, keyed by hook
+	// name.  Like Xattrs, the map is shared between copies of the
+	// entry.
+	Derived map[string][]byte `codec:",omitempty"`
+}
+
+// EntryPerm holds owner permission bits that have been set
+// explicitly on an entry (see KBFSOps.SetPerm).  The zero value
+// means the entry has the default permissions for its type.
+type EntryPerm uint16
+
+// entryPermSet marks an EntryPerm as explicitly set, so that an
+// entry can have no owner permissions at all.
+const entryPermSet EntryPerm = 1 << 15
+
+func makeEntryPerm(perm os.FileMode) EntryPerm {
+	return EntryPerm(perm&0700) | entryPermSet
+}
+
+// OwnerPerm returns the owner permission bits (a subset of 0700) of
+// the entry.  Entries without explicitly-set permissions are
+// readable and writable, and executable unless they're regular
+// files.  The executable bit of a file always follows its type, so
+// that it stays consistent with KBFSOps.SetEx and with old clients.
+func (ei EntryInfo) OwnerPerm() os.FileMode {
+	perm := os.FileMode(0700)
+	if ei.Perm&entryPermSet != 0 {
+		perm = os.FileMode(ei.Perm) & 0700
+	}
+	switch ei.Type {
+	case File:
+		perm &^= 0100
+	case Exec:
+		perm |= 0100
+	}
+	return perm
+}
+
+// DirChild is a single named entry of a directory, as returned a
+// page at a time by KBFSOps.GetDirChildrenPaged.
+type DirChild struct {
+	Name string
+	EntryInfo
 }
 
 // ReportedError represents an error reported by KBFS.
@@ -711,6 +893,38 @@ func UserQuotaInfoDecode(b []byte, codec kbfscodec.Codec) (
 	return &info, nil
 }
 
+// QuotaUsage summarizes a user's quota usage, as reported by the
+// block server.
+type QuotaUsage struct {
+	// LimitBytes is the user's total quota.
+	LimitBytes int64
+	// UsedBytes is the number of bytes the user's blocks take up,
+	// including archived blocks.
+	UsedBytes int64
+	// ArchivedBytes is the number of used bytes in archived
+	// blocks, which can be reclaimed.
+	ArchivedBytes int64
+}
+
+// MakeQuotaUsage summarizes the given quota info.
+func MakeQuotaUsage(info *UserQuotaInfo) QuotaUsage {
+	usage := QuotaUsage{LimitBytes: info.Limit}
+	if info.Total != nil {
+		usage.UsedBytes = info.Total.Bytes[UsageWrite]
+		usage.ArchivedBytes = info.Total.Bytes[UsageArchive]
+	}
+	return usage
+}
+
+// QuotaWarning describes a write that is about to exceed the user's
+// quota.
+type QuotaWarning struct {
+	// Usage is the user's quota usage before the write.
+	Usage QuotaUsage
+	// PendingBytes is the number of bytes the write will add.
+	PendingBytes int64
+}
+
 // OpSummary describes the changes performed by a single op, and is
 // suitable for encoding directly as JSON.
 type OpSummary struct {
@@ -0,0 +1,109 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// deviceRevocationTracker remembers which devices KBFS has already
+// seen revoked, so that it reacts to each revocation only once.
+type deviceRevocationTracker struct {
+	lock    sync.Mutex
+	revoked map[keybase1.UID]map[kbfscrypto.VerifyingKey]bool
+}
+
+func newDeviceRevocationTracker() *deviceRevocationTracker {
+	return &deviceRevocationTracker{
+		revoked: make(map[keybase1.UID]map[kbfscrypto.VerifyingKey]bool),
+	}
+}
+
+// newlyRevoked returns the verifying keys of the devices that the
+// given user info lists as revoked, but that haven't been seen
+// revoked before.  The first time a user is seen, all of their
+// revoked devices count as new.
+func (drt *deviceRevocationTracker) newlyRevoked(
+	userInfo UserInfo) []kbfscrypto.VerifyingKey {
+	drt.lock.Lock()
+	defer drt.lock.Unlock()
+	seen := drt.revoked[userInfo.UID]
+	if seen == nil {
+		seen = make(map[kbfscrypto.VerifyingKey]bool)
+		drt.revoked[userInfo.UID] = seen
+	}
+	var keys []kbfscrypto.VerifyingKey
+	for key := range userInfo.RevokedVerifyingKeys {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// getTlfsToRekeyForRevocation returns the IDs of the cached private
+// TLFs that include the given user, and that the current user can
+// rekey to remove the user's revoked devices.
+func (fs *KBFSOpsStandard) getTlfsToRekeyForRevocation(
+	uid, currentUID keybase1.UID) []tlf.ID {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	lState := makeFBOLockState()
+	var ids []tlf.ID
+	for fb, ops := range fs.ops {
+		if fb.Branch != MasterBranch || fb.Tlf.IsPublic() {
+			continue
+		}
+		head := ops.getHead(lState)
+		if head == (ImmutableRootMetadata{}) {
+			continue
+		}
+		h := head.GetTlfHandle()
+		if h.IsReader(uid) && h.IsWriter(currentUID) {
+			ids = append(ids, fb.Tlf)
+		}
+	}
+	return ids
+}
+
+// handleRevokedDevices reacts right away to the revocation of the
+// given devices of the given user.  If this device is one of them,
+// it purges all of its cached TLF keys.  Otherwise it schedules
+// rekeys of every affected cached TLF, rather than waiting for the
+// next access to each one.
+func (fs *KBFSOpsStandard) handleRevokedDevices(ctx context.Context,
+	uid keybase1.UID, keys []kbfscrypto.VerifyingKey) error {
+	_, currentUID, err := fs.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if uid == currentUID {
+		currentKey, err := fs.config.KBPKI().GetCurrentVerifyingKey(ctx)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if key == currentKey {
+				fs.log.CDebugf(ctx, "This device has been revoked; "+
+					"purging its cached TLF keys")
+				fs.config.KeyCache().Clear()
+				return nil
+			}
+		}
+	}
+
+	for _, id := range fs.getTlfsToRekeyForRevocation(uid, currentUID) {
+		fs.log.CDebugf(ctx, "Scheduling a rekey of %s to remove the "+
+			"revoked devices of %s", id, uid)
+		fs.config.RekeyQueue().Enqueue(id)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserKeysChangedRekeysForRevokedDevice(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1, u2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+	clock := newTestClockNow()
+	config1.SetClock(clock)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(t, config2)
+	_, uid2, err := config2.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	name := u1.String() + "," + u2.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fb := rootNode1.GetFolderBranch()
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// Give u2 a second device, and key the folder for it.
+	AddDeviceForLocalUserOrBust(t, config1, uid2)
+	AddDeviceForLocalUserOrBust(t, config2, uid2)
+	require.NoError(t, kbfsOps1.Rekey(ctx, fb.Tlf))
+
+	ops := kbfsOps1.(*KBFSOpsStandard).getOpsNoAdd(fb)
+	lState := makeFBOLockState()
+	keyGen := ops.getHead(lState).LatestKeyGeneration()
+
+	// Nothing has been revoked yet.
+	require.NoError(t, kbfsOps1.UserKeysChanged(ctx, uid2))
+	require.NoError(t, config1.RekeyQueue().Wait(ctx))
+	require.Equal(t, keyGen, ops.getHead(lState).LatestKeyGeneration())
+
+	// Revoking the second device rekeys the folder right away,
+	// with a new key generation.
+	clock.Add(1 * time.Minute)
+	RevokeDeviceForLocalUserOrBust(t, config1, uid2, 1)
+	RevokeDeviceForLocalUserOrBust(t, config2, uid2, 1)
+	require.NoError(t, kbfsOps1.UserKeysChanged(ctx, uid2))
+	require.NoError(t, config1.RekeyQueue().Wait(ctx))
+	head := ops.getHead(lState)
+	require.Equal(t, keyGen+1, head.LatestKeyGeneration())
+
+	// The same revocation isn't handled twice.
+	require.NoError(t, kbfsOps1.UserKeysChanged(ctx, uid2))
+	require.NoError(t, config1.RekeyQueue().Wait(ctx))
+	require.Equal(t, head.Revision(), ops.getHead(lState).Revision())
+}
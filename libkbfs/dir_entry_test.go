@@ -34,6 +34,14 @@ func makeFakeDirEntryFuture(t *testing.T) dirEntryFuture {
 				"fake sym path",
 				101,
 				102,
+				"fake long name",
+				map[string][]byte{"fake xattr": []byte("fake value")},
+				makeEntryPerm(0500),
+				Fifo,
+				true,
+				3,
+				300,
+				map[string][]byte{"fake hook": []byte("fake derived")},
 			},
 			codec.UnknownFieldSetHandler{},
 		},
@@ -22,9 +22,13 @@ type dirtyBlockID struct {
 
 type dirtyReq struct {
 	respChan chan<- struct{}
+	tlfID    tlf.ID
 	bytes    int64
 	start    time.Time
 	deadline time.Time
+	// blockedOnMemory is set once the request has been refused
+	// by the dirty memory controller.
+	blockedOnMemory bool
 }
 
 const (
@@ -108,6 +112,12 @@ const (
 // if resetBufferCapTime passes without any large syncs.  TODO: in the
 // future it might make sense to decrease the buffer capacity, rather
 // than resetting it to the minimum?
+//
+// If a dirtyMemoryController is set, it replaces the fixed limit of
+// twice the maximum sync buffer size on waitBuf: the bytes of every
+// TLF in every cache sharing the controller count toward its
+// adaptive limit, and ShouldForceSync also returns true for any TLF
+// with dirty data once the controller sees enough memory pressure.
 type DirtyBlockCacheStandard struct {
 	clock   Clock
 	makeLog func(string) logger.Logger
@@ -141,6 +151,10 @@ type DirtyBlockCacheStandard struct {
 	// to avoid keeping it too high as network conditions change?
 	resetBufferCapTime time.Duration
 
+	// memory, if non-nil, limits the dirty bytes of all the caches
+	// sharing it.  See useMemoryController.
+	memory *dirtyMemoryController
+
 	shutdownLock sync.RWMutex
 	isShutdown   bool
 
@@ -152,6 +166,9 @@ type DirtyBlockCacheStandard struct {
 	ignoreSyncBytes int64 // these bytes have "timed out"
 	syncStarted     time.Time
 	resetter        *time.Timer
+	// memoryBytes is this cache's share, per TLF, of the bytes
+	// counted by memory.
+	memoryBytes map[tlf.ID]int64
 }
 
 // NewDirtyBlockCacheStandard constructs a new BlockCacheStandard
@@ -175,6 +192,7 @@ func NewDirtyBlockCacheStandard(clock Clock,
 		maxSyncBufCap:      maxSyncBufCap,
 		syncBufferCap:      startSyncBufCap,
 		resetBufferCapTime: resetBufferCapTimeDefault,
+		memoryBytes:        make(map[tlf.ID]int64),
 	}
 	d.reqWg.Add(1)
 	go d.processPermission()
@@ -317,16 +335,48 @@ func (d *DirtyBlockCacheStandard) logLocked(fmt string, arg ...interface{}) {
 	}
 }
 
-func (d *DirtyBlockCacheStandard) acceptNewWrite(newBytes int64) bool {
+// useMemoryController makes the cache share the limit of the given
+// dirty memory controller.  It must be called before the cache is
+// used.
+func (d *DirtyBlockCacheStandard) useMemoryController(
+	memory *dirtyMemoryController) {
+	d.memory = memory
+	memory.addCache(d.signalDecreasedBytes)
+}
+
+// updateMemoryLocked tells the dirty memory controller, if any, that
+// the dirty bytes of the given TLF changed by delta.
+func (d *DirtyBlockCacheStandard) updateMemoryLocked(
+	tlfID tlf.ID, delta int64) {
+	if d.memory == nil || delta == 0 {
+		return
+	}
+	d.memory.add(tlfID, delta)
+	d.memoryBytes[tlfID] += delta
+	if d.memoryBytes[tlfID] == 0 {
+		delete(d.memoryBytes, tlfID)
+	}
+}
+
+func (d *DirtyBlockCacheStandard) acceptNewWrite(req *dirtyReq) bool {
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	// Accept any write, as long as we're not already over the limits.
-	// Allow the total dirty bytes to get close to double the max
-	// buffer size, to allow us to fill up the buffer for the next
-	// sync.
-	canAccept := d.waitBufBytes < d.maxSyncBufCap*2
+	var canAccept bool
+	if d.memory != nil {
+		canAccept = d.memory.canDirty(req.bytes, !req.blockedOnMemory)
+		if !canAccept {
+			req.blockedOnMemory = true
+		}
+	} else {
+		// Accept any write, as long as we're not already over the
+		// limits.  Allow the total dirty bytes to get close to
+		// double the max buffer size, to allow us to fill up the
+		// buffer for the next sync.
+		canAccept = d.waitBufBytes < d.maxSyncBufCap*2
+	}
 	if canAccept {
-		d.waitBufBytes += newBytes
+		d.waitBufBytes += req.bytes
+		d.updateMemoryLocked(req.tlfID, req.bytes)
 	}
 
 	return canAccept
@@ -450,7 +500,7 @@ func (d *DirtyBlockCacheStandard) processPermission() {
 			// Apply any backpressure?
 			backpressure = d.calcBackpressure(currentReq.start,
 				currentReq.deadline)
-			if backpressure == 0 && d.acceptNewWrite(currentReq.bytes) {
+			if backpressure == 0 && d.acceptNewWrite(&currentReq) {
 				// If we have an active request, and we have room in
 				// our buffers to deal with it, grant permission to
 				// the requestor by closing the response channel.
@@ -489,7 +539,7 @@ func (d *DirtyBlockCacheStandard) processPermission() {
 // RequestPermissionToDirty implements the DirtyBlockCache interface
 // for DirtyBlockCacheStandard.
 func (d *DirtyBlockCacheStandard) RequestPermissionToDirty(
-	ctx context.Context, _ tlf.ID, estimatedDirtyBytes int64) (
+	ctx context.Context, tlfID tlf.ID, estimatedDirtyBytes int64) (
 	DirtyPermChan, error) {
 	d.shutdownLock.RLock()
 	defer d.shutdownLock.RUnlock()
@@ -509,7 +559,13 @@ func (d *DirtyBlockCacheStandard) RequestPermissionToDirty(
 		// never get close to a timeout in a background task.
 		deadline = defaultDeadline
 	}
-	req := dirtyReq{c, estimatedDirtyBytes, now, deadline}
+	req := dirtyReq{
+		respChan: c,
+		tlfID:    tlfID,
+		bytes:    estimatedDirtyBytes,
+		start:    now,
+		deadline: deadline,
+	}
 	select {
 	case d.requestsChan <- req:
 		return c, nil
@@ -528,7 +584,7 @@ func (d *DirtyBlockCacheStandard) signalDecreasedBytes() {
 
 // UpdateUnsyncedBytes implements the DirtyBlockCache interface for
 // DirtyBlockCacheStandard.
-func (d *DirtyBlockCacheStandard) UpdateUnsyncedBytes(_ tlf.ID,
+func (d *DirtyBlockCacheStandard) UpdateUnsyncedBytes(tlfID tlf.ID,
 	newUnsyncedBytes int64, wasSyncing bool) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
@@ -537,6 +593,7 @@ func (d *DirtyBlockCacheStandard) UpdateUnsyncedBytes(_ tlf.ID,
 	} else {
 		d.waitBufBytes += newUnsyncedBytes
 	}
+	d.updateMemoryLocked(tlfID, newUnsyncedBytes)
 	if newUnsyncedBytes < 0 {
 		d.signalDecreasedBytes()
 	}
@@ -554,7 +611,7 @@ func (d *DirtyBlockCacheStandard) UpdateSyncingBytes(_ tlf.ID, size int64) {
 
 // BlockSyncFinished implements the DirtyBlockCache interface for
 // DirtyBlockCacheStandard.
-func (d *DirtyBlockCacheStandard) BlockSyncFinished(_ tlf.ID, size int64) {
+func (d *DirtyBlockCacheStandard) BlockSyncFinished(tlfID tlf.ID, size int64) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	if size > 0 {
@@ -563,6 +620,7 @@ func (d *DirtyBlockCacheStandard) BlockSyncFinished(_ tlf.ID, size int64) {
 		// The block will be retried, so put it back on the waitBuf
 		d.waitBufBytes -= size
 	}
+	d.updateMemoryLocked(tlfID, -size)
 	if size > 0 {
 		d.signalDecreasedBytes()
 	}
@@ -626,11 +684,14 @@ func (d *DirtyBlockCacheStandard) SyncFinished(_ tlf.ID, size int64) {
 
 // ShouldForceSync implements the DirtyBlockCache interface for
 // DirtyBlockCacheStandard.
-func (d *DirtyBlockCacheStandard) ShouldForceSync(_ tlf.ID) bool {
+func (d *DirtyBlockCacheStandard) ShouldForceSync(tlfID tlf.ID) bool {
 	d.lock.RLock()
 	defer d.lock.RUnlock()
 	// TODO: Fill up to likely block boundaries?
-	return d.waitBufBytes >= d.syncBufferCap
+	if d.waitBufBytes >= d.syncBufferCap {
+		return true
+	}
+	return d.memory != nil && d.memory.shouldSync(tlfID)
 }
 
 // Shutdown implements the DirtyBlockCache interface for
@@ -651,6 +712,11 @@ func (d *DirtyBlockCacheStandard) Shutdown() error {
 	for req := range d.requestsChan {
 		d.waitBufBytes += req.bytes
 	}
+	// Whatever is left over doesn't count against the memory limit
+	// anymore.
+	for tlfID, bytes := range d.memoryBytes {
+		d.updateMemoryLocked(tlfID, -bytes)
+	}
 	if d.syncBufBytes != 0 || d.waitBufBytes != 0 || d.ignoreSyncBytes != 0 {
 		return fmt.Errorf("Unexpected dirty bytes leftover on shutdown: "+
 			"syncBuf=%d, waitBuf=%d, ignore=%d",
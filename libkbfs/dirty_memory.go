@@ -0,0 +1,268 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/tlf"
+)
+
+const (
+	// dirtyMemoryTuneInterval is how often the dirty memory
+	// controller reconsiders its limit.
+	dirtyMemoryTuneInterval = 1 * time.Second
+	// dirtyMemoryHeapTargetDefault is the heap size above which
+	// the dirty memory controller starts lowering its limit.
+	dirtyMemoryHeapTargetDefault = 2 << 30
+	// lowMemoryDirtyMemoryHeapTarget is the same, for low-memory
+	// devices.
+	lowMemoryDirtyMemoryHeapTarget = 512 << 20
+	// dirtyMemorySyncFraction is the fraction of the limit at which
+	// every TLF holding dirty data is asked to sync right away.
+	dirtyMemorySyncFraction = 0.5
+)
+
+// DirtyMemoryStatus describes the memory held by dirty file data
+// across all TLFs, and the limit the dirty block caches keep it
+// under.  It is suitable for encoding directly as JSON.
+type DirtyMemoryStatus struct {
+	// UsedBytes is the number of dirty bytes, either already
+	// dirtied or granted to writes in progress, that haven't
+	// finished syncing yet.
+	UsedBytes int64
+	// TLFBytes breaks UsedBytes down by TLF.
+	TLFBytes map[string]int64 `json:",omitempty"`
+	// LimitBytes is the current limit on UsedBytes; new writes
+	// wait while it's reached.  It adapts between MinLimitBytes
+	// and MaxLimitBytes according to the size of the heap.
+	LimitBytes    int64
+	MinLimitBytes int64
+	MaxLimitBytes int64
+	// SyncThresholdBytes is the usage at which every TLF with
+	// dirty data is asked to sync right away.
+	SyncThresholdBytes int64
+	// HeapBytes is the size of the heap when the limit was last
+	// reconsidered, and HeapTargetBytes is the size above which
+	// the limit is lowered.
+	HeapBytes       uint64
+	HeapTargetBytes uint64
+	// WritesBlocked counts the writes that had to wait because
+	// the limit was reached.
+	WritesBlocked uint64
+	// LastDecision describes the last change to the limit, and
+	// why.
+	LastDecision     string
+	LastDecisionTime time.Time
+}
+
+// dirtyMemoryController keeps the total amount of dirty file data,
+// across all TLFs and all the DirtyBlockCacheStandards sharing it,
+// under a limit.  Rather than a fixed limit, it adapts to how much
+// memory the process is actually using: whenever the heap grows past
+// a target size, it lowers the limit multiplicatively, and while the
+// heap is comfortably below the target it raises it back toward the
+// maximum.  Once usage passes a fraction of the limit, it asks every
+// TLF holding dirty data to sync, so that memory is freed before
+// writes have to block.
+type dirtyMemoryController struct {
+	clock    Clock
+	makeLog  func(string) logger.Logger
+	minBytes int64
+	maxBytes int64
+	// readHeapBytes returns the current size of the heap; it's
+	// replaced in tests.
+	readHeapBytes func() uint64
+
+	lock       sync.Mutex
+	log        logger.Logger
+	heapTarget uint64
+	// decreased holds a function for each cache sharing the
+	// controller, which wakes up any write waiting in it.
+	decreased  []func()
+	limit      int64
+	usedBytes  int64
+	tlfBytes   map[tlf.ID]int64
+	lastTune   time.Time
+	heapBytes  uint64
+	blocked    uint64
+	lastReason string
+	lastTime   time.Time
+}
+
+func readRuntimeHeapBytes() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+func newDirtyMemoryController(clock Clock,
+	makeLog func(string) logger.Logger, minBytes, maxBytes int64,
+	heapTarget uint64) *dirtyMemoryController {
+	return &dirtyMemoryController{
+		clock:         clock,
+		makeLog:       makeLog,
+		minBytes:      minBytes,
+		maxBytes:      maxBytes,
+		heapTarget:    heapTarget,
+		readHeapBytes: readRuntimeHeapBytes,
+		limit:         maxBytes,
+		tlfBytes:      make(map[tlf.ID]int64),
+	}
+}
+
+func (c *dirtyMemoryController) logLocked(fmt string, arg ...interface{}) {
+	if c.log == nil && c.makeLog != nil {
+		c.log = c.makeLog("DMC")
+	}
+	if c.log != nil {
+		c.log.CDebugf(nil, fmt, arg...)
+	}
+}
+
+// addCache registers a function that wakes up the writes waiting in
+// a cache sharing the controller, since they may be waiting on bytes
+// dirtied through another one.
+func (c *dirtyMemoryController) addCache(decreased func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.decreased = append(c.decreased, decreased)
+}
+
+// add records that the given TLF's dirty bytes changed by delta.
+func (c *dirtyMemoryController) add(tlfID tlf.ID, delta int64) {
+	decreased := func() []func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.usedBytes += delta
+		c.tlfBytes[tlfID] += delta
+		if c.tlfBytes[tlfID] == 0 {
+			delete(c.tlfBytes, tlfID)
+		}
+		if delta >= 0 {
+			return nil
+		}
+		return c.decreased
+	}()
+	for _, f := range decreased {
+		f()
+	}
+}
+
+// nextLimit returns the limit the controller should have, given its
+// current limit and the size of the heap, along with the reason for
+// any change.  It returns the current limit and an empty reason if
+// nothing should change.
+func (c *dirtyMemoryController) nextLimit(
+	limit int64, heapBytes uint64) (int64, string) {
+	switch {
+	case c.heapTarget == 0:
+		// Adapting to the heap is turned off.
+		return limit, ""
+	case heapBytes > c.heapTarget && limit > c.minBytes:
+		newLimit := limit - limit/4
+		if newLimit < c.minBytes {
+			newLimit = c.minBytes
+		}
+		return newLimit, fmt.Sprintf(
+			"lowered: heap of %d bytes is over the target", heapBytes)
+	case heapBytes < c.heapTarget-c.heapTarget/4 && limit < c.maxBytes:
+		newLimit := limit + c.minBytes
+		if newLimit > c.maxBytes {
+			newLimit = c.maxBytes
+		}
+		return newLimit, fmt.Sprintf(
+			"raised: heap of %d bytes is under the target", heapBytes)
+	default:
+		return limit, ""
+	}
+}
+
+// maybeTuneLocked reconsiders the limit, if it hasn't done so
+// within the last dirtyMemoryTuneInterval.
+func (c *dirtyMemoryController) maybeTuneLocked() {
+	now := c.clock.Now()
+	if !c.lastTune.IsZero() && now.Sub(c.lastTune) < dirtyMemoryTuneInterval {
+		return
+	}
+	c.lastTune = now
+	c.heapBytes = c.readHeapBytes()
+	newLimit, reason := c.nextLimit(c.limit, c.heapBytes)
+	if newLimit == c.limit {
+		return
+	}
+	c.logLocked("Dirty memory limit %d -> %d bytes (%s)",
+		c.limit, newLimit, reason)
+	c.limit = newLimit
+	c.lastReason = reason
+	c.lastTime = now
+}
+
+func (c *dirtyMemoryController) setHeapTarget(heapTarget uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.heapTarget = heapTarget
+}
+
+// canDirty returns whether a write that will dirty newBytes may
+// proceed now.  A write is always allowed when nothing is dirty, so
+// that one big write can't wait forever.  firstTry should be false
+// when asking again about a write that was already refused, so that
+// it's only counted as blocked once.
+func (c *dirtyMemoryController) canDirty(newBytes int64, firstTry bool) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.maybeTuneLocked()
+	if c.usedBytes > 0 && c.usedBytes+newBytes > c.limit {
+		if firstTry {
+			c.blocked++
+		}
+		return false
+	}
+	return true
+}
+
+func (c *dirtyMemoryController) syncThresholdLocked() int64 {
+	return int64(float64(c.limit) * dirtyMemorySyncFraction)
+}
+
+// shouldSync returns whether the given TLF should sync right away,
+// because dirty data is using enough of the limit overall and this
+// TLF holds some of it.
+func (c *dirtyMemoryController) shouldSync(tlfID tlf.ID) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.usedBytes >= c.syncThresholdLocked() && c.tlfBytes[tlfID] > 0
+}
+
+// getStatus returns the current state of the controller.
+func (c *dirtyMemoryController) getStatus() DirtyMemoryStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var tlfBytes map[string]int64
+	if len(c.tlfBytes) > 0 {
+		tlfBytes = make(map[string]int64, len(c.tlfBytes))
+		for tlfID, bytes := range c.tlfBytes {
+			tlfBytes[tlfID.String()] = bytes
+		}
+	}
+	return DirtyMemoryStatus{
+		UsedBytes:          c.usedBytes,
+		TLFBytes:           tlfBytes,
+		LimitBytes:         c.limit,
+		MinLimitBytes:      c.minBytes,
+		MaxLimitBytes:      c.maxBytes,
+		SyncThresholdBytes: c.syncThresholdLocked(),
+		HeapBytes:          c.heapBytes,
+		HeapTargetBytes:    c.heapTarget,
+		WritesBlocked:      c.blocked,
+		LastDecision:       c.lastReason,
+		LastDecisionTime:   c.lastTime,
+	}
+}
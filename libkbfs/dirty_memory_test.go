@@ -0,0 +1,137 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestDirtyMemoryControllerNextLimit(t *testing.T) {
+	c := newDirtyMemoryController(
+		newTestClockNow(), testLoggerMaker(t), 100, 1000, 4000)
+
+	// Over the target: lower, but not past the min.
+	l, reason := c.nextLimit(1000, 5000)
+	require.Equal(t, int64(750), l)
+	require.NotEqual(t, "", reason)
+	l, _ = c.nextLimit(120, 5000)
+	require.Equal(t, int64(100), l)
+	l, _ = c.nextLimit(100, 5000)
+	require.Equal(t, int64(100), l)
+
+	// Well under the target: raise, but not past the max.
+	l, _ = c.nextLimit(500, 2000)
+	require.Equal(t, int64(600), l)
+	l, _ = c.nextLimit(950, 2000)
+	require.Equal(t, int64(1000), l)
+
+	// Close to the target: leave it alone.
+	l, reason = c.nextLimit(500, 3500)
+	require.Equal(t, int64(500), l)
+	require.Equal(t, "", reason)
+
+	// No target: leave it alone.
+	c.setHeapTarget(0)
+	l, _ = c.nextLimit(500, 5000)
+	require.Equal(t, int64(500), l)
+}
+
+func TestDirtyMemoryControllerTune(t *testing.T) {
+	clock := newTestClockNow()
+	c := newDirtyMemoryController(clock, testLoggerMaker(t), 100, 1000, 4000)
+	heapBytes := uint64(5000)
+	c.readHeapBytes = func() uint64 { return heapBytes }
+
+	require.True(t, c.canDirty(10, true))
+	status := c.getStatus()
+	require.Equal(t, int64(750), status.LimitBytes)
+	require.Equal(t, int64(375), status.SyncThresholdBytes)
+	require.Equal(t, heapBytes, status.HeapBytes)
+	require.NotEqual(t, "", status.LastDecision)
+
+	// Not again until the interval has passed.
+	require.True(t, c.canDirty(10, true))
+	require.Equal(t, int64(750), c.getStatus().LimitBytes)
+	clock.Add(dirtyMemoryTuneInterval)
+	require.True(t, c.canDirty(10, true))
+	require.Equal(t, int64(563), c.getStatus().LimitBytes)
+
+	// Once the heap shrinks, the limit grows back.
+	heapBytes = 1000
+	clock.Add(dirtyMemoryTuneInterval)
+	require.True(t, c.canDirty(10, true))
+	require.Equal(t, int64(663), c.getStatus().LimitBytes)
+}
+
+// Test that caches sharing a dirty memory controller are limited by
+// their combined dirty bytes, and that they ask TLFs to sync based on
+// them.
+func TestDirtyMemoryControllerSharedAcrossCaches(t *testing.T) {
+	// The caches' own buffers are big enough not to matter.
+	bufSize := int64(1000)
+	c := newDirtyMemoryController(&wallClock{}, testLoggerMaker(t), 10, 100, 0)
+	cache1 := NewDirtyBlockCacheStandard(&wallClock{}, testLoggerMaker(t),
+		bufSize, bufSize, bufSize)
+	defer func() {
+		require.NoError(t, cache1.Shutdown())
+	}()
+	cache1.useMemoryController(c)
+	cache2 := NewDirtyBlockCacheStandard(&wallClock{}, testLoggerMaker(t),
+		bufSize, bufSize, bufSize)
+	defer func() {
+		require.NoError(t, cache2.Shutdown())
+	}()
+	cache2.useMemoryController(c)
+	blockedChan := make(chan int64, 1)
+	cache2.blockedChanForTesting = blockedChan
+	ctx := context.Background()
+
+	tlfID1 := tlf.FakeID(1, false)
+	tlfID2 := tlf.FakeID(2, false)
+	c1, err := cache1.RequestPermissionToDirty(ctx, tlfID1, 60)
+	require.NoError(t, err)
+	<-c1
+	// More than half the limit is dirty, so the TLF holding it
+	// should sync, but the other one has nothing to sync.
+	require.True(t, cache1.ShouldForceSync(tlfID1))
+	require.False(t, cache2.ShouldForceSync(tlfID2))
+
+	// A write to the other TLF, through the other cache, has to
+	// wait.
+	c2, err := cache2.RequestPermissionToDirty(ctx, tlfID2, 50)
+	require.NoError(t, err)
+	require.Equal(t, int64(50), <-blockedChan)
+	select {
+	case <-c2:
+		t.Fatal("Request should be blocked")
+	default:
+	}
+	status := c.getStatus()
+	require.Equal(t, int64(60), status.UsedBytes)
+	require.Equal(t, map[string]int64{tlfID1.String(): 60}, status.TLFBytes)
+	require.Equal(t, uint64(1), status.WritesBlocked)
+
+	// Syncing the first TLF's data lets it through.
+	cache1.UpdateSyncingBytes(tlfID1, 60)
+	cache1.BlockSyncFinished(tlfID1, 60)
+	cache1.SyncFinished(tlfID1, 60)
+	select {
+	case blockedSize := <-blockedChan:
+		require.Equal(t, int64(-1), blockedSize)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Request wasn't unblocked")
+	}
+	<-c2
+	require.Equal(t, map[string]int64{tlfID2.String(): 50},
+		c.getStatus().TLFBytes)
+
+	cache2.UpdateUnsyncedBytes(tlfID2, -50, false)
+	require.Equal(t, int64(0), c.getStatus().UsedBytes)
+}
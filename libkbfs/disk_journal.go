@@ -29,17 +29,25 @@ import (
 // serializable entry object. The files EARLIEST and LATEST point to
 // the earliest and latest valid ordinal, respectively.
 //
+// The presence of EARLIEST is what marks the journal as non-empty.
+// If the journal is durable, all files are also written atomically
+// and synced to disk, so a crash in the middle of an append or
+// removal leaves the journal in either its old or its new state
+// (possibly with an unreferenced entry file left behind, which is
+// overwritten by the next append).  That costs several fsyncs per
+// append, so it's only used by the journals of the local disk MD
+// server; client journals, which are written on every local write,
+// aren't durable.
+//
 // This class is not goroutine-safe; it assumes that all
 // synchronization is done at a higher level.
 //
-// TODO: Do all high-level operations atomically on the file-system
-// level.
-//
 // TODO: Make IO ops cancellable.
 type diskJournal struct {
 	codec     kbfscodec.Codec
 	dir       string
 	entryType reflect.Type
+	durable   bool
 }
 
 // makeDiskJournal returns a new diskJournal for the given directory.
@@ -52,6 +60,26 @@ func makeDiskJournal(
 	}
 }
 
+// makeDurableDiskJournal is like makeDiskJournal, except that the
+// returned journal writes all its files with writeFileAtomic.
+func makeDurableDiskJournal(
+	codec kbfscodec.Codec, dir string, entryType reflect.Type) diskJournal {
+	j := makeDiskJournal(codec, dir, entryType)
+	j.durable = true
+	return j
+}
+
+func (j diskJournal) writeFile(path string, data []byte) error {
+	if j.durable {
+		return writeFileAtomic(path, data, 0600)
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
 // journalOrdinal is the ordinal used for naming journal entries.
 type journalOrdinal uint64
 
@@ -98,7 +126,7 @@ func (j diskJournal) readOrdinal(path string) (
 
 func (j diskJournal) writeOrdinal(
 	path string, o journalOrdinal) error {
-	return ioutil.WriteFile(path, []byte(o.String()), 0600)
+	return j.writeFile(path, []byte(o.String()))
 }
 
 func (j diskJournal) readEarliestOrdinal() (
@@ -111,6 +139,13 @@ func (j diskJournal) writeEarliestOrdinal(o journalOrdinal) error {
 }
 
 func (j diskJournal) readLatestOrdinal() (journalOrdinal, error) {
+	// EARLIEST is written after LATEST on the first append, and
+	// removed before it when clearing, so a LATEST without an
+	// EARLIEST is left over from a crash and must be ignored.
+	_, err := os.Stat(j.earliestPath())
+	if err != nil {
+		return 0, err
+	}
 	return j.readOrdinal(j.latestPath())
 }
 
@@ -210,11 +245,6 @@ func (j diskJournal) writeJournalEntry(
 			j.entryType, entryType))
 	}
 
-	err := os.MkdirAll(j.dir, 0700)
-	if err != nil {
-		return err
-	}
-
 	p := j.journalEntryPath(o)
 
 	buf, err := j.codec.Encode(entry)
@@ -222,7 +252,7 @@ func (j diskJournal) writeJournalEntry(
 		return err
 	}
 
-	return ioutil.WriteFile(p, buf, 0600)
+	return j.writeFile(p, buf)
 }
 
 // appendJournalEntry appends the given entry to the journal. If o is
@@ -238,8 +268,11 @@ func (j diskJournal) appendJournalEntry(
 	// TODO: Consider caching the latest ordinal in memory instead
 	// of reading it from disk every time.
 	var next journalOrdinal
-	lo, err := j.readLatestOrdinal()
-	if os.IsNotExist(err) {
+	_, err := j.readEarliestOrdinal()
+	empty := os.IsNotExist(err)
+	if empty {
+		// Any LATEST file left over from a crashed first
+		// append is ignored (and overwritten below).
 		if o != nil {
 			next = *o
 		} else {
@@ -248,6 +281,10 @@ func (j diskJournal) appendJournalEntry(
 	} else if err != nil {
 		return 0, err
 	} else {
+		lo, err := j.readLatestOrdinal()
+		if err != nil {
+			return 0, err
+		}
 		next = lo + 1
 		if next == 0 {
 			// Rollover is almost certainly a bug.
@@ -265,19 +302,18 @@ func (j diskJournal) appendJournalEntry(
 		return 0, err
 	}
 
-	_, err = j.readEarliestOrdinal()
-	if os.IsNotExist(err) {
-		err := j.writeEarliestOrdinal(next)
-		if err != nil {
-			return 0, err
-		}
-	} else if err != nil {
-		return 0, err
-	}
+	// Write LATEST before EARLIEST, since the latter is what makes
+	// the journal non-empty.
 	err = j.writeLatestOrdinal(next)
 	if err != nil {
 		return 0, err
 	}
+	if empty {
+		err = j.writeEarliestOrdinal(next)
+		if err != nil {
+			return 0, err
+		}
+	}
 	return next, nil
 }
 
@@ -0,0 +1,247 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// diskLimiterFreeBytesCacheTime is how long the free space of
+	// the disk is cached for, so that checking for space before
+	// every write doesn't cost a system call.
+	diskLimiterFreeBytesCacheTime = time.Second
+	// diskLimiterRecheckInterval is how often blocked writers
+	// recheck for space, since space can also be freed by
+	// processes other than KBFS.
+	diskLimiterRecheckInterval = 10 * time.Second
+)
+
+// DiskLimits bounds the combined disk usage of all of KBFS's local
+// stores, such as the journal and the read replica block cache.  A
+// zero value means no limits.  It is suitable for encoding directly
+// as JSON.
+type DiskLimits struct {
+	// MaxFreeSpaceFraction is the largest fraction of the space
+	// available to KBFS -- the free space on the disk plus what
+	// the local stores already use -- that the local stores may
+	// use together, or zero for no limit.
+	MaxFreeSpaceFraction float64
+	// MaxBytes is the most the local stores may use together,
+	// regardless of free space, or zero for no limit.
+	MaxBytes int64
+}
+
+func (l DiskLimits) isUnlimited() bool {
+	return l.MaxFreeSpaceFraction <= 0 && l.MaxBytes <= 0
+}
+
+// DiskLimiterStatus describes the current usage of the local stores
+// against their limits.  It is suitable for encoding directly as
+// JSON.
+type DiskLimiterStatus struct {
+	Limits DiskLimits
+	// FreeBytes is the free space on the disk as of the last
+	// check, or -1 if it's unknown.
+	FreeBytes int64
+	// LimitBytes is the current combined limit on the local
+	// stores, or -1 if there isn't one.
+	LimitBytes int64
+	UsedBytes  int64
+	// StoreBytes maps each local store to its usage.
+	StoreBytes map[string]int64
+}
+
+// getFreeBytesFunc returns the free space on the disk holding the
+// given directory.
+type getFreeBytesFunc func(dir string) (int64, error)
+
+// DiskLimiterStandard implements the DiskLimiter interface by
+// summing the usage reported by each local store, and comparing it
+// against the free space on the disk holding a given directory.
+type DiskLimiterStandard struct {
+	clock        Clock
+	dir          string
+	getFreeBytes getFreeBytesFunc
+
+	lock          sync.Mutex
+	limits        DiskLimits
+	stores        map[string]func() int64
+	freeBytes     int64
+	freeBytesTime time.Time
+	// spaceCh is closed, and replaced, whenever space may have
+	// been freed or the limits change, to wake up waiters.
+	spaceCh chan struct{}
+}
+
+var _ DiskLimiter = (*DiskLimiterStandard)(nil)
+
+// NewDiskLimiterStandard returns a new DiskLimiterStandard with the
+// given initial limits, which checks the free space on the disk
+// holding dir.  If dir is empty, MaxFreeSpaceFraction is ignored.
+func NewDiskLimiterStandard(
+	clock Clock, dir string, limits DiskLimits) *DiskLimiterStandard {
+	return newDiskLimiterStandardWithFreeBytesFunc(
+		clock, dir, limits, getFreeBytes)
+}
+
+func newDiskLimiterStandardWithFreeBytesFunc(clock Clock, dir string,
+	limits DiskLimits, getFreeBytes getFreeBytesFunc) *DiskLimiterStandard {
+	return &DiskLimiterStandard{
+		clock:        clock,
+		dir:          dir,
+		getFreeBytes: getFreeBytes,
+		limits:       limits,
+		stores:       make(map[string]func() int64),
+		freeBytes:    -1,
+		spaceCh:      make(chan struct{}),
+	}
+}
+
+// usage returns the usage of each store, and their total.  It must
+// be called without l.lock held, since the stores may take their own
+// locks, which may in turn be held while calling SpaceFreed.
+func (l *DiskLimiterStandard) usage() (map[string]int64, int64) {
+	l.lock.Lock()
+	stores := make(map[string]func() int64, len(l.stores))
+	for name, usage := range l.stores {
+		stores[name] = usage
+	}
+	l.lock.Unlock()
+
+	storeBytes := make(map[string]int64, len(stores))
+	var total int64
+	for name, usage := range stores {
+		storeBytes[name] = usage()
+		total += storeBytes[name]
+	}
+	return storeBytes, total
+}
+
+// limitLocked returns the current combined limit given the current
+// total usage, or -1 if there isn't one.
+func (l *DiskLimiterStandard) limitLocked(used int64) int64 {
+	limit := int64(-1)
+	if l.limits.MaxFreeSpaceFraction > 0 && l.dir != "" {
+		now := l.clock.Now()
+		if l.freeBytes < 0 ||
+			now.Sub(l.freeBytesTime) >= diskLimiterFreeBytesCacheTime {
+			freeBytes, err := l.getFreeBytes(l.dir)
+			if err == nil {
+				l.freeBytes = freeBytes
+				l.freeBytesTime = now
+			}
+		}
+		if l.freeBytes >= 0 {
+			limit = int64(l.limits.MaxFreeSpaceFraction *
+				float64(l.freeBytes+used))
+		}
+	}
+	if l.limits.MaxBytes > 0 && (limit < 0 || l.limits.MaxBytes < limit) {
+		limit = l.limits.MaxBytes
+	}
+	return limit
+}
+
+// checkSpace returns whether there's room for n more bytes, along
+// with a channel that's closed when there might be room, if there
+// isn't now.  Stores that are empty always have room, so that a
+// single write bigger than the limit can still make progress.
+func (l *DiskLimiterStandard) checkSpace(n int64) (
+	ok bool, spaceCh <-chan struct{}) {
+	_, used := l.usage()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.limits.isUnlimited() || used == 0 {
+		return true, nil
+	}
+	limit := l.limitLocked(used)
+	if limit < 0 || used+n <= limit {
+		return true, nil
+	}
+	return false, l.spaceCh
+}
+
+// RegisterStore implements the DiskLimiter interface for
+// DiskLimiterStandard.
+func (l *DiskLimiterStandard) RegisterStore(name string, usage func() int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.stores[name] = usage
+}
+
+// WaitForSpace implements the DiskLimiter interface for
+// DiskLimiterStandard.
+func (l *DiskLimiterStandard) WaitForSpace(
+	ctx context.Context, n int64) error {
+	for {
+		ok, spaceCh := l.checkSpace(n)
+		if ok {
+			return nil
+		}
+		timer := time.NewTimer(diskLimiterRecheckInterval)
+		select {
+		case <-timer.C:
+		case <-spaceCh:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// HasSpace implements the DiskLimiter interface for
+// DiskLimiterStandard.
+func (l *DiskLimiterStandard) HasSpace(n int64) bool {
+	ok, _ := l.checkSpace(n)
+	return ok
+}
+
+// SpaceFreed implements the DiskLimiter interface for
+// DiskLimiterStandard.
+func (l *DiskLimiterStandard) SpaceFreed() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	close(l.spaceCh)
+	l.spaceCh = make(chan struct{})
+}
+
+// SetLimits implements the DiskLimiter interface for
+// DiskLimiterStandard.
+func (l *DiskLimiterStandard) SetLimits(limits DiskLimits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limits = limits
+	close(l.spaceCh)
+	l.spaceCh = make(chan struct{})
+}
+
+// Limits implements the DiskLimiter interface for
+// DiskLimiterStandard.
+func (l *DiskLimiterStandard) Limits() DiskLimits {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limits
+}
+
+// Status implements the DiskLimiter interface for
+// DiskLimiterStandard.
+func (l *DiskLimiterStandard) Status() DiskLimiterStatus {
+	storeBytes, used := l.usage()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	limit := l.limitLocked(used)
+	return DiskLimiterStatus{
+		Limits:     l.limits,
+		FreeBytes:  l.freeBytes,
+		LimitBytes: limit,
+		UsedBytes:  used,
+		StoreBytes: storeBytes,
+	}
+}
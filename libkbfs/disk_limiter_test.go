@@ -0,0 +1,109 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestDiskLimiterFreeSpaceFraction(t *testing.T) {
+	clock := newTestClockNow()
+	freeBytes := int64(1000)
+	getFreeBytesCalls := 0
+	l := newDiskLimiterStandardWithFreeBytesFunc(clock, "dir",
+		DiskLimits{MaxFreeSpaceFraction: 0.5},
+		func(dir string) (int64, error) {
+			require.Equal(t, "dir", dir)
+			getFreeBytesCalls++
+			return freeBytes, nil
+		})
+	var journalBytes, cacheBytes int64
+	l.RegisterStore("journal", func() int64 { return journalBytes })
+	l.RegisterStore("cache", func() int64 { return cacheBytes })
+
+	// Empty stores always have room.
+	require.True(t, l.HasSpace(10000))
+	require.Equal(t, 0, getFreeBytesCalls)
+
+	// The stores together may use half of the free space plus
+	// their own usage.
+	journalBytes = 300
+	cacheBytes = 100
+	freeBytes = 600
+	require.True(t, l.HasSpace(100))
+	require.False(t, l.HasSpace(101))
+	require.Equal(t, DiskLimiterStatus{
+		Limits:     DiskLimits{MaxFreeSpaceFraction: 0.5},
+		FreeBytes:  600,
+		LimitBytes: 500,
+		UsedBytes:  400,
+		StoreBytes: map[string]int64{"journal": 300, "cache": 100},
+	}, l.Status())
+
+	// The free space is cached for a while.
+	require.Equal(t, 1, getFreeBytesCalls)
+	freeBytes = 800
+	require.False(t, l.HasSpace(101))
+	clock.Add(diskLimiterFreeBytesCacheTime)
+	require.True(t, l.HasSpace(101))
+	require.Equal(t, 2, getFreeBytesCalls)
+
+	// An absolute limit applies regardless of free space.
+	l.SetLimits(DiskLimits{MaxFreeSpaceFraction: 0.5, MaxBytes: 450})
+	require.True(t, l.HasSpace(50))
+	require.False(t, l.HasSpace(51))
+}
+
+func TestDiskLimiterSpaceFreedWakesWaiters(t *testing.T) {
+	l := newDiskLimiterStandardWithFreeBytesFunc(newTestClockNow(), "",
+		DiskLimits{MaxBytes: 100}, getFreeBytes)
+	usedBytes := int64(100)
+	l.RegisterStore("journal", func() int64 {
+		return atomic.LoadInt64(&usedBytes)
+	})
+	ctx, cancel := context.WithTimeout(
+		context.Background(), individualTestTimeout)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- l.WaitForSpace(ctx, 10)
+	}()
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("WaitForSpace returned early: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	atomic.StoreInt64(&usedBytes, 50)
+	l.SpaceFreed()
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+}
+
+func TestDiskLimiterCanceled(t *testing.T) {
+	l := NewDiskLimiterStandard(newTestClockNow(), "",
+		DiskLimits{MaxBytes: 1})
+	l.RegisterStore("journal", func() int64 { return 1 })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := l.WaitForSpace(ctx, 1)
+	require.Equal(t, context.Canceled, err)
+
+	// Lifting the limits makes room.
+	l.SetLimits(DiskLimits{})
+	require.NoError(t, l.WaitForSpace(context.Background(), 1))
+}
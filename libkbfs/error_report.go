@@ -0,0 +1,294 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrorClass says what kind of problem a reported error is, from
+// the point of view of the user who has to deal with it.
+type ErrorClass int
+
+const (
+	// ErrorClassOther covers errors that the user can't do
+	// anything about.  They aren't turned into ErrorReports.
+	ErrorClassOther ErrorClass = iota
+	// ErrorClassQuota means the user is out of space, or of some
+	// other allowance on the servers.
+	ErrorClassQuota
+	// ErrorClassPermission means the user isn't allowed to do
+	// what they tried to, or a folder needs to be rekeyed before
+	// they can.
+	ErrorClassPermission
+	// ErrorClassConflict means changes from this device
+	// conflicted with changes made elsewhere.
+	ErrorClassConflict
+	// ErrorClassNetwork means the servers couldn't be reached,
+	// or didn't answer in time.
+	ErrorClassNetwork
+	// ErrorClassCorruption means data or metadata failed to
+	// decode or verify.
+	ErrorClassCorruption
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassOther:
+		return "other"
+	case ErrorClassQuota:
+		return "quota"
+	case ErrorClassPermission:
+		return "permission"
+	case ErrorClassConflict:
+		return "conflict"
+	case ErrorClassNetwork:
+		return "network"
+	case ErrorClassCorruption:
+		return "corruption"
+	default:
+		return fmt.Sprintf("ErrorClass(%d)", int(c))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface for
+// ErrorClass, so that it shows up by name in JSON.
+func (c ErrorClass) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// classifyError returns the ErrorClass of err.
+func classifyError(err error) ErrorClass {
+	switch err.(type) {
+	case OverQuotaWarning, BServerErrorOverQuota,
+		MDServerErrorTooManyFoldersCreated:
+		return ErrorClassQuota
+	case ReadAccessError, WriteAccessError, WriteUnsupportedError,
+		TlfAccessError, NeedSelfRekeyError, NeedOtherRekeyError,
+		RekeyPermissionError, NoCurrentSessionError,
+		BServerErrorUnauthorized, BServerErrorNoPermission,
+		MDServerErrorUnauthorized, MDServerErrorWriteAccess:
+		return ErrorClassPermission
+	case UnmergedError, UnmergedSelfConflictError,
+		CRAbandonStagedBranchError, RekeyConflictError,
+		MDServerErrorConflictRevision, MDServerErrorConflictPrevRoot,
+		MDServerErrorConflictDiskUsage, MDServerErrorConflictFolderMapping:
+		return ErrorClassConflict
+	case TimeoutError, ServerCircuitOpenError,
+		BServerErrorThrottle, MDServerErrorThrottle:
+		return ErrorClassNetwork
+	case BlockDecodeError, BadDataError, BadCryptoError, BadCryptoMDError,
+		BadMDError, MDMismatchError, MDDecodeError, KeyBundleDecodeError,
+		InconsistentEncodedSizeError, BadSplitError,
+		UnverifiableTlfUpdateError, KeyHalfMismatchError,
+		MerkleRootRollbackError, MerkleRootEquivocationError,
+		MDRollbackError, MDEquivocationError:
+		return ErrorClassCorruption
+	case net.Error:
+		return ErrorClassNetwork
+	}
+
+	if err == context.DeadlineExceeded || err == io.ErrUnexpectedEOF {
+		return ErrorClassNetwork
+	}
+	return ErrorClassOther
+}
+
+// errorReportAction returns a suggestion for what the user can do
+// about err, which is of the given class.
+func errorReportAction(class ErrorClass, err error) string {
+	switch err.(type) {
+	case NeedSelfRekeyError:
+		return "Open Keybase on one of your other devices to " +
+			"give this device access to the folder."
+	case NeedOtherRekeyError:
+		return "Ask a writer of the folder to open Keybase on one " +
+			"of their devices to give you access."
+	case NoCurrentSessionError:
+		return "Log in to Keybase."
+	case MDServerErrorTooManyFoldersCreated:
+		return "Remove folders you no longer need before creating " +
+			"new ones."
+	}
+
+	switch class {
+	case ErrorClassQuota:
+		return "Delete files you no longer need, or upgrade your " +
+			"storage plan."
+	case ErrorClassPermission:
+		return "Ask a writer of the folder to give you access."
+	case ErrorClassConflict:
+		return "Your changes conflicted with changes made on " +
+			"another device; check the folder for conflicted " +
+			"copies of your files."
+	case ErrorClassNetwork:
+		return "Check your internet connection.  KBFS will keep " +
+			"retrying in the background."
+	case ErrorClassCorruption:
+		return "Some data couldn't be verified.  Send your logs " +
+			"to Keybase with `keybase log send`."
+	default:
+		return ""
+	}
+}
+
+// ErrorReport is a classified, user-actionable summary of one or
+// more identical errors reported to a Reporter.  It is suitable for
+// encoding directly as JSON.
+type ErrorReport struct {
+	// ID is unique among the reports of a Reporter, and increases
+	// with each new report.
+	ID    uint64
+	Class ErrorClass
+	// Tlf is the folder the error happened in, if any.
+	Tlf    CanonicalTlfName `json:",omitempty"`
+	Public bool             `json:",omitempty"`
+	// Write is true if the error happened while writing.
+	Write   bool `json:",omitempty"`
+	Message string
+	// Action suggests what the user can do about the error.
+	Action string
+	// FirstTime and LastTime are when the first and most recent
+	// of the errors making up this report happened, and Count is
+	// how many of them there were.
+	FirstTime time.Time
+	LastTime  time.Time
+	Count     int
+}
+
+const (
+	// defaultMaxErrorReports is how many ErrorReports a Reporter
+	// that remembers all errors keeps.
+	defaultMaxErrorReports = 100
+	// errorReportDedupWindow is how soon after the last identical
+	// error another one is folded into the same report, rather
+	// than starting a new one.
+	errorReportDedupWindow = time.Minute
+	// errorReportSubscriberBufSize is how many new reports can
+	// pile up for a subscriber before it misses some.
+	errorReportSubscriberBufSize = 16
+)
+
+// errorReportLog keeps the most recent ErrorReports, folding
+// repeated errors into the report of the first one, and sends new
+// reports to its subscribers.
+type errorReportLog struct {
+	maxReports int
+
+	lock    sync.Mutex
+	lastID  uint64
+	reports []*ErrorReport // oldest first
+	// subscribers maps a subscription ID to its channel.
+	subscribers      map[int]chan ErrorReport
+	nextSubscriberID int
+}
+
+func newErrorReportLog(maxReports int) *errorReportLog {
+	if maxReports < 1 {
+		maxReports = defaultMaxErrorReports
+	}
+	return &errorReportLog{
+		maxReports:  maxReports,
+		subscribers: make(map[int]chan ErrorReport),
+	}
+}
+
+// add records err, which happened at time now, unless it's of
+// ErrorClassOther.
+func (l *errorReportLog) add(now time.Time, tlfName CanonicalTlfName,
+	public bool, mode ErrorModeType, err error) {
+	class := classifyError(err)
+	if class == ErrorClassOther {
+		return
+	}
+	msg := err.Error()
+	write := mode == WriteMode
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, r := range l.reports {
+		if r.Class == class && r.Tlf == tlfName &&
+			r.Public == public && r.Write == write &&
+			r.Message == msg &&
+			now.Sub(r.LastTime) <= errorReportDedupWindow {
+			r.LastTime = now
+			r.Count++
+			return
+		}
+	}
+
+	l.lastID++
+	report := &ErrorReport{
+		ID:        l.lastID,
+		Class:     class,
+		Tlf:       tlfName,
+		Public:    public,
+		Write:     write,
+		Message:   msg,
+		Action:    errorReportAction(class, err),
+		FirstTime: now,
+		LastTime:  now,
+		Count:     1,
+	}
+	if len(l.reports) == l.maxReports {
+		l.reports = append(l.reports[:0], l.reports[1:]...)
+	}
+	l.reports = append(l.reports, report)
+
+	for _, ch := range l.subscribers {
+		select {
+		case ch <- *report:
+		default:
+			// The subscriber isn't keeping up; it can
+			// catch up with get.
+		}
+	}
+}
+
+// get returns copies of all the reports, oldest first.
+func (l *errorReportLog) get() []ErrorReport {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	reports := make([]ErrorReport, len(l.reports))
+	for i, r := range l.reports {
+		reports[i] = *r
+	}
+	return reports
+}
+
+// subscribe returns a channel that gets each new report, and a
+// function that ends the subscription and closes the channel.
+func (l *errorReportLog) subscribe() (<-chan ErrorReport, func()) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	id := l.nextSubscriberID
+	l.nextSubscriberID++
+	ch := make(chan ErrorReport, errorReportSubscriberBufSize)
+	l.subscribers[id] = ch
+	return ch, func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if ch, ok := l.subscribers[id]; ok {
+			delete(l.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+// shutdown ends all subscriptions.
+func (l *errorReportLog) shutdown() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for id, ch := range l.subscribers {
+		delete(l.subscribers, id)
+		close(ch)
+	}
+}
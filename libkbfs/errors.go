@@ -6,9 +6,12 @@ package libkbfs
 
 import (
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
+	merkle "github.com/keybase/go-merkle-tree"
 	"github.com/keybase/kbfs/tlf"
 )
 
@@ -49,6 +52,17 @@ func (e NoSuchNameError) Error() string {
 	return fmt.Sprintf("%s doesn't exist", e.Name)
 }
 
+// EntryReplacedError indicates that a conditional removal was
+// skipped, because the entry no longer refers to the expected node.
+type EntryReplacedError struct {
+	Name string
+}
+
+// Error implements the error interface for EntryReplacedError
+func (e EntryReplacedError) Error() string {
+	return fmt.Sprintf("%s has been replaced", e.Name)
+}
+
 // NoSuchUserError indicates that the given user couldn't be resolved.
 type NoSuchUserError struct {
 	Input string
@@ -194,6 +208,21 @@ func (e WriteUnsupportedError) Error() string {
 	return fmt.Sprintf("Writing to %s is unsupported", e.Filename)
 }
 
+// TlfFinalizedError indicates an error when trying to write to a
+// finalized TLF, which is read-only.
+type TlfFinalizedError struct {
+	Tlf       CanonicalTlfName
+	Public    bool
+	Successor CanonicalTlfName
+}
+
+// Error implements the error interface for TlfFinalizedError.
+func (e TlfFinalizedError) Error() string {
+	return fmt.Sprintf("%s is finalized and read-only; use %s instead",
+		buildCanonicalPathForTlfName(e.Public, e.Tlf),
+		buildCanonicalPathForTlfName(e.Public, e.Successor))
+}
+
 // NewReadAccessError constructs a ReadAccessError for the given
 // directory and user.
 func NewReadAccessError(h *TlfHandle, username libkb.NormalizedUsername, filename string) error {
@@ -383,6 +412,36 @@ func (e MDMissingDataError) Error() string {
 		"for directory %v", e.ID)
 }
 
+// MDDecodeError indicates that an encoded MD object, usually one
+// received from the server, is malformed.
+type MDDecodeError struct {
+	Tlf         tlf.ID
+	MetadataVer MetadataVer
+	Err         error
+}
+
+// Error implements the error interface for MDDecodeError.
+func (e MDDecodeError) Error() string {
+	return fmt.Sprintf("Couldn't decode version %d metadata for folder "+
+		"%s: %v", int(e.MetadataVer), e.Tlf, e.Err)
+}
+
+// KeyBundleDecodeError indicates that an encoded writer or reader key
+// bundle, usually one received from the server, is malformed.
+type KeyBundleDecodeError struct {
+	Writer bool
+	Err    error
+}
+
+// Error implements the error interface for KeyBundleDecodeError.
+func (e KeyBundleDecodeError) Error() string {
+	kind := "reader"
+	if e.Writer {
+		kind = "writer"
+	}
+	return fmt.Sprintf("Couldn't decode %s key bundle: %v", kind, e.Err)
+}
+
 // MDMismatchError indicates an inconsistent or unverifiable MD object
 // for the given top-level folder.
 type MDMismatchError struct {
@@ -657,6 +716,20 @@ func (e WrongOpsError) Error() string {
 		"branch %s", e.opsFB.Tlf, e.opsFB.Branch, e.nodeFB.Tlf, e.nodeFB.Branch)
 }
 
+// BatchAcrossFoldersError indicates that a batch of operations (see
+// KBFSOps.RunBatch) was given nodes from more than one folder-branch.
+type BatchAcrossFoldersError struct {
+	batchFB FolderBranch
+	nodeFB  FolderBranch
+}
+
+// Error implements the error interface for BatchAcrossFoldersError.
+func (e BatchAcrossFoldersError) Error() string {
+	return fmt.Sprintf("Batch for folder %v, branch %s, was given a node "+
+		"in folder %v, branch %s", e.batchFB.Tlf, e.batchFB.Branch,
+		e.nodeFB.Tlf, e.nodeFB.Branch)
+}
+
 // NodeNotFoundError indicates that we tried to find a node for the
 // given BlockPointer and failed.
 type NodeNotFoundError struct {
@@ -841,6 +914,31 @@ func (e DisallowedPrefixError) Error() string {
 		e.name, e.prefix)
 }
 
+// SpecialFileNotSupportedError indicates that the user tried to
+// create a special file, like a named pipe or a device node, that
+// KBFS won't store.
+type SpecialFileNotSupportedError struct {
+	Name string
+	Mode os.FileMode
+}
+
+// Error implements the error interface for SpecialFileNotSupportedError.
+func (e SpecialFileNotSupportedError) Error() string {
+	return fmt.Sprintf("Cannot create %s: special files of mode %v are "+
+		"not supported", e.Name, e.Mode)
+}
+
+// AppendOnlyError indicates that the user tried to write an
+// append-only file anywhere but at its end, or to truncate it.
+type AppendOnlyError struct {
+	Name string
+}
+
+// Error implements the error interface for AppendOnlyError.
+func (e AppendOnlyError) Error() string {
+	return fmt.Sprintf("%s is append-only", e.Name)
+}
+
 // FileTooBigError indicates that the user tried to write a file that
 // would be bigger than KBFS's supported size.
 type FileTooBigError struct {
@@ -1159,3 +1257,221 @@ func (e TLFCryptKeyNotPerDeviceEncrypted) Error() string {
 	return fmt.Sprintf("TLF crypt key for %s at generation %d is not per-device encrypted",
 		e.tlf, e.keyGen)
 }
+
+// ErrJournalFull is returned when a write can't be added to a TLF's
+// journal because the journal has reached one of its configured
+// limits, and isn't configured to wait for it to flush.
+type ErrJournalFull struct {
+	TlfID          tlf.ID
+	UnflushedBytes int64
+	ByteLimit      int64
+	Entries        uint64
+	EntryLimit     uint64
+}
+
+// Error implements the error interface for ErrJournalFull.
+func (e ErrJournalFull) Error() string {
+	return fmt.Sprintf("Journal for %s is full: %d/%d unflushed bytes, "+
+		"%d/%d entries", e.TlfID, e.UnflushedBytes, e.ByteLimit,
+		e.Entries, e.EntryLimit)
+}
+
+// ErrJournalOverQuota is returned when a TLF's journal can't flush
+// because the block server rejected its blocks for being over the
+// user's quota.  The journal keeps accepting writes locally, up to
+// its limits, and resumes flushing once usage drops below the quota.
+type ErrJournalOverQuota struct {
+	TlfID tlf.ID
+	Usage QuotaUsage
+}
+
+// Error implements the error interface for ErrJournalOverQuota.
+func (e ErrJournalOverQuota) Error() string {
+	return fmt.Sprintf("Journal for %s can't flush while over quota: "+
+		"%d/%d bytes used", e.TlfID, e.Usage.UsedBytes, e.Usage.LimitBytes)
+}
+
+// ReadReplicaError indicates an attempt to modify a TLF through a
+// Config running in read-replica mode.
+type ReadReplicaError struct {
+	Filename string
+}
+
+// Error implements the error interface for ReadReplicaError.
+func (e ReadReplicaError) Error() string {
+	if e.Filename == "" {
+		return "Can't write in read-replica mode"
+	}
+	return fmt.Sprintf("Can't write to %s in read-replica mode", e.Filename)
+}
+
+// ManualConflictResolutionDisabledError indicates an attempt to
+// resolve a conflict by hand in a folder that doesn't have manual
+// conflict resolution enabled.
+type ManualConflictResolutionDisabledError struct {
+	Tlf tlf.ID
+}
+
+// Error implements the error interface for
+// ManualConflictResolutionDisabledError.
+func (e ManualConflictResolutionDisabledError) Error() string {
+	return fmt.Sprintf("Manual conflict resolution is not enabled for %s",
+		e.Tlf)
+}
+
+// NoSuchConflictError indicates that there is no conflict to resolve
+// at the given path.
+type NoSuchConflictError struct {
+	Path string
+}
+
+// Error implements the error interface for NoSuchConflictError.
+func (e NoSuchConflictError) Error() string {
+	return fmt.Sprintf("No conflict at %s", e.Path)
+}
+
+// InvalidAccessLogBatchError indicates that a batch of records in a
+// TLF's access log couldn't be decoded, or its signature couldn't be
+// verified.
+type InvalidAccessLogBatchError struct {
+	Name string
+	Err  error
+}
+
+// Error implements the error interface for InvalidAccessLogBatchError.
+func (e InvalidAccessLogBatchError) Error() string {
+	return fmt.Sprintf("Invalid access log batch %s: %v", e.Name, e.Err)
+}
+
+// NoSuchXattrError indicates that an entry has no extended attribute
+// with the given name.
+type NoSuchXattrError struct {
+	Name string
+}
+
+// Error implements the error interface for NoSuchXattrError.
+func (e NoSuchXattrError) Error() string {
+	return fmt.Sprintf("No extended attribute %s", e.Name)
+}
+
+// XattrTooBigError indicates that setting an extended attribute
+// would make an entry's extended attributes bigger than KBFS's
+// supported size.
+type XattrTooBigError struct {
+	Name            string
+	size            int
+	maxAllowedBytes int
+}
+
+// Error implements the error interface for XattrTooBigError.
+func (e XattrTooBigError) Error() string {
+	return fmt.Sprintf("Setting extended attribute %s would make the "+
+		"extended attributes %d bytes, which is over the supported "+
+		"limit of %d bytes", e.Name, e.size, e.maxAllowedBytes)
+}
+
+// TLFAccessLogUnsupportedError indicates that neither the MD server
+// nor the block server keeps an access log for TLFs.
+type TLFAccessLogUnsupportedError struct{}
+
+// Error implements the error interface for TLFAccessLogUnsupportedError.
+func (e TLFAccessLogUnsupportedError) Error() string {
+	return "The servers don't keep TLF access logs"
+}
+
+// PrefetchDisabledError indicates that a block retrieval with less
+// than on-demand priority was dropped, because the policy for the
+// current connectivity state doesn't allow prefetching.
+type PrefetchDisabledError struct {
+	State ConnectivityState
+}
+
+// Error implements the error interface for PrefetchDisabledError.
+func (e PrefetchDisabledError) Error() string {
+	return fmt.Sprintf("Not prefetching while %s", e.State)
+}
+
+// ServerCircuitOpenError indicates that an RPC wasn't sent, because
+// recent RPCs to the same server kept failing.
+type ServerCircuitOpenError struct {
+	Server string
+	// RetryAfter is how long until the next RPC may be let
+	// through, or 0 if one is being tried right now.
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface for ServerCircuitOpenError.
+func (e ServerCircuitOpenError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("Not contacting %s for another %s after "+
+			"repeated failures", e.Server, e.RetryAfter)
+	}
+	return fmt.Sprintf("Not contacting %s while checking whether it "+
+		"has recovered from repeated failures", e.Server)
+}
+
+// MerkleRootRollbackError indicates that the MD server returned a
+// root of one of its Merkle trees that is older than one it had
+// returned before.
+type MerkleRootRollbackError struct {
+	TreeID      keybase1.MerkleTreeID
+	SeqNo       int64
+	LatestSeqNo int64
+}
+
+// Error implements the error interface for MerkleRootRollbackError.
+func (e MerkleRootRollbackError) Error() string {
+	return fmt.Sprintf("The MD server rolled back Merkle tree %s to "+
+		"root %d, after returning root %d", e.TreeID, e.SeqNo,
+		e.LatestSeqNo)
+}
+
+// MerkleRootEquivocationError indicates that the MD server returned
+// roots of one of its Merkle trees that aren't on the same chain, so
+// it has shown at least two different histories.
+type MerkleRootEquivocationError struct {
+	TreeID keybase1.MerkleTreeID
+	SeqNo  int64
+	// Hash is the hash of the root with SeqNo that was verified
+	// before, and ServerHash is the hash the server's latest root
+	// leads back to instead.
+	Hash       merkle.Hash
+	ServerHash merkle.Hash
+}
+
+// Error implements the error interface for MerkleRootEquivocationError.
+func (e MerkleRootEquivocationError) Error() string {
+	return fmt.Sprintf("The MD server returned two different roots %d "+
+		"of Merkle tree %s: %x and %x", e.SeqNo, e.TreeID,
+		[]byte(e.Hash), []byte(e.ServerHash))
+}
+
+// MDRollbackError indicates that the MD server returned a head for a
+// TLF that is older than the head in its own Merkle tree.
+type MDRollbackError struct {
+	TlfID          tlf.ID
+	Revision       MetadataRevision
+	MerkleRevision MetadataRevision
+}
+
+// Error implements the error interface for MDRollbackError.
+func (e MDRollbackError) Error() string {
+	return fmt.Sprintf("The MD server returned revision %d as the head "+
+		"of folder %s, but its Merkle tree has revision %d",
+		e.Revision, e.TlfID, e.MerkleRevision)
+}
+
+// MDEquivocationError indicates that the MD server returned a head
+// for a TLF that differs from the MD with the same revision in its
+// own Merkle tree.
+type MDEquivocationError struct {
+	TlfID    tlf.ID
+	Revision MetadataRevision
+}
+
+// Error implements the error interface for MDEquivocationError.
+func (e MDEquivocationError) Error() string {
+	return fmt.Sprintf("The MD server returned a head for folder %s, "+
+		"revision %d, that doesn't match its Merkle tree",
+		e.TlfID, e.Revision)
+}
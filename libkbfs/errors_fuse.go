@@ -9,7 +9,7 @@ package libkbfs
 import (
 	"syscall"
 
-	"bazil.org/fuse"
+	"github.com/keybase/kbfs/bazilfuse"
 )
 
 var _ fuse.ErrorNumber = NoSuchUserError{""}
@@ -52,6 +52,14 @@ func (e WriteUnsupportedError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENOENT)
 }
 
+var _ fuse.ErrorNumber = TlfFinalizedError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// TlfFinalizedError.
+func (e TlfFinalizedError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
 var _ fuse.ErrorNumber = NeedSelfRekeyError{}
 
 // Errno implements the fuse.ErrorNumber interface for
@@ -132,3 +140,59 @@ var _ fuse.ErrorNumber = NoSuchFolderListError{}
 func (e NoSuchFolderListError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENOENT)
 }
+
+var _ fuse.ErrorNumber = ReadReplicaError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// ReadReplicaError.
+func (e ReadReplicaError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
+var _ fuse.ErrorNumber = NoSuchXattrError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoSuchXattrError.
+func (e NoSuchXattrError) Errno() fuse.Errno {
+	return fuse.ErrNoXattr
+}
+
+var _ fuse.ErrorNumber = XattrTooBigError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// XattrTooBigError.
+func (e XattrTooBigError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.E2BIG)
+}
+
+var _ fuse.ErrorNumber = SpecialFileNotSupportedError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// SpecialFileNotSupportedError.
+func (e SpecialFileNotSupportedError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EPERM)
+}
+
+var _ fuse.ErrorNumber = AppendOnlyError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// AppendOnlyError.
+func (e AppendOnlyError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EPERM)
+}
+
+var _ fuse.ErrorNumber = AdvisoryLockConflictError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// AdvisoryLockConflictError.
+func (e AdvisoryLockConflictError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EAGAIN)
+}
+
+var _ fuse.ErrorNumber = LeaseLockJournaledError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// LeaseLockJournaledError.
+func (e LeaseLockJournaledError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOLCK)
+}
@@ -5,14 +5,37 @@
 package libkbfs
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfssync"
+	"github.com/keybase/kbfs/tlf"
 
 	"golang.org/x/net/context"
 )
 
+const (
+	// favoritesRefreshInterval is how often the favorites list is
+	// fetched from the server while there are FavoritesObservers,
+	// to find out about changes made by other devices.
+	favoritesRefreshInterval = 10 * time.Minute
+	// favoritesMetadataParallelism is how many folder heads are
+	// fetched at once by KBFSOps.GetFavoritesWithMetadata.
+	favoritesMetadataParallelism = 10
+	// favoritesCacheFile holds the sealed favorites cache of a
+	// user, under the user's directory in the disk cache dir.
+	favoritesCacheFile = "favorites"
+	// favoritesStorageKeysFile holds the keys that seal the
+	// favorites cache, wrapped by the device key.
+	favoritesStorageKeysFile = "storage_keys"
+)
+
 type favToAdd struct {
 	Favorite
 
@@ -25,10 +48,40 @@ func (f favToAdd) toKBFolder() keybase1.Folder {
 	return f.Favorite.toKBFolder(f.created)
 }
 
+// favoritesPendingChange is an addition to or deletion from the
+// favorites list that couldn't be sent to the server yet.
+type favoritesPendingChange struct {
+	Favorite Favorite
+	Created  bool `codec:",omitempty"`
+	Deleted  bool `codec:",omitempty"`
+}
+
+// favoriteSeenRevision is the latest revision of a folder that this
+// device has caught up with.
+type favoriteSeenRevision struct {
+	TlfID    tlf.ID
+	Revision MetadataRevision
+}
+
+// favoritesCacheInfo is what's stored in the disk cache of a user's
+// favorites list.
+type favoritesCacheInfo struct {
+	Favorites []Favorite
+	// Pending holds the changes made while the server couldn't
+	// be reached, in the order they were made.
+	Pending []favoritesPendingChange `codec:",omitempty"`
+	// Seen holds the seen revisions of folders, for
+	// FavoriteMetadata.Unread.
+	Seen []favoriteSeenRevision `codec:",omitempty"`
+
+	codec.UnknownFieldSetHandler
+}
+
 // favReq represents a request to access the logged-in user's
 // favorites list.  A single request can do one or more of the
 // following: refresh the current cached list, add a favorite, remove
-// a favorite, and get all the favorites.  When the request is done,
+// a favorite, get all the favorites, and track which revisions of
+// folders have been seen.  When the request is done,
 // the resulting error (or nil) is sent over the done channel.  The
 // given ctx is used for all network operations.
 type favReq struct {
@@ -37,6 +90,14 @@ type favReq struct {
 	toAdd   []favToAdd
 	toDel   []Favorite
 	favs    chan<- []Favorite
+	// seen holds revisions of folders that this device has
+	// caught up with, and seenBaselines the latest revisions of
+	// folders, to be taken as seen for folders that have never
+	// been seen before.  The resulting seen revisions of the
+	// folders in seenBaselines are sent over seenOut.
+	seen          map[tlf.ID]MetadataRevision
+	seenBaselines map[tlf.ID]MetadataRevision
+	seenOut       chan<- map[tlf.ID]MetadataRevision
 
 	// Closed when the request is done.
 	done chan struct{}
@@ -62,9 +123,30 @@ type Favorites struct {
 	// the last refresh.
 	cache map[Favorite]bool
 
+	// seen tracks the latest revision of each folder that this
+	// device has caught up with.  Only accessed by the loop
+	// goroutine.
+	seen map[tlf.ID]MetadataRevision
+
 	inFlightLock sync.Mutex
 	inFlightAdds map[favToAdd]*favReq
 
+	observers *observerList
+
+	// diskCacheDir, if set, is where the favorites list of each
+	// user is cached between runs, and where changes made while
+	// the server can't be reached are queued.  Protected by
+	// diskCacheLock.
+	diskCacheLock sync.Mutex
+	diskCacheDir  string
+
+	// The rest of the disk cache state is only accessed by the
+	// loop goroutine.  diskUID is the user whose cache is loaded,
+	// if any.
+	diskUID     keybase1.UID
+	diskKeyring *kbfscrypto.StorageKeyring
+	pending     []favoritesPendingChange
+
 	muShutdown sync.RWMutex
 	shutdown   bool
 }
@@ -74,8 +156,9 @@ func newFavoritesWithChan(config Config, reqChan chan *favReq) *Favorites {
 		config:       config,
 		reqChan:      reqChan,
 		inFlightAdds: make(map[favToAdd]*favReq),
+		observers:    newObserverList(),
 	}
-	go f.loop()
+	go f.loop(time.NewTicker(favoritesRefreshInterval))
 	return f
 }
 
@@ -94,9 +177,223 @@ func (f *Favorites) closeReq(req *favReq, err error) {
 	}
 }
 
+// EnableDiskCache makes this Favorites cache the favorites list of
+// the logged-in user in the given directory, sealed with a storage
+// key wrapped by the device key.  The cached list is used whenever
+// the server can't be reached, and additions and deletions made
+// then are queued, and sent to the server once it can be reached
+// again.
+func (f *Favorites) EnableDiskCache(dir string) {
+	f.diskCacheLock.Lock()
+	defer f.diskCacheLock.Unlock()
+	f.diskCacheDir = dir
+}
+
+func (f *Favorites) getDiskCacheDir() string {
+	f.diskCacheLock.Lock()
+	defer f.diskCacheLock.Unlock()
+	return f.diskCacheDir
+}
+
+// canQueue returns whether a favorites change that failed with the
+// given error should be queued, rather than failed.
+func (f *Favorites) canQueue(err error) bool {
+	return f.getDiskCacheDir() != "" && err != context.Canceled &&
+		err != context.DeadlineExceeded
+}
+
+// loadDiskCache loads the disk cache of the logged-in user, unless
+// it's already loaded.  If a different user was logged in before,
+// their favorites are forgotten first.
+func (f *Favorites) loadDiskCache(ctx context.Context, dir string) error {
+	_, uid, err := f.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if uid == f.diskUID {
+		return nil
+	}
+	f.cache = nil
+	f.pending = nil
+	f.seen = nil
+	f.diskKeyring = nil
+	f.diskUID = uid
+
+	userDir := filepath.Join(dir, uid.String())
+	err = os.MkdirAll(userDir, 0700)
+	if err != nil {
+		return err
+	}
+	cryptKey, err := f.config.KBPKI().GetCurrentCryptPublicKey(ctx)
+	if err != nil {
+		return err
+	}
+	keyring, err := loadStorageKeyring(ctx, f.config.Codec(),
+		f.config.Crypto(), cryptKey,
+		filepath.Join(userDir, favoritesStorageKeysFile))
+	if err != nil {
+		return err
+	}
+	f.diskKeyring = keyring
+
+	sealed, err := ioutil.ReadFile(filepath.Join(userDir, favoritesCacheFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	buf, err := keyring.Open(sealed)
+	if err != nil {
+		return err
+	}
+	var info favoritesCacheInfo
+	err = f.config.Codec().Decode(buf, &info)
+	if err != nil {
+		return err
+	}
+	f.cache = make(map[Favorite]bool, len(info.Favorites))
+	for _, fav := range info.Favorites {
+		f.cache[fav] = true
+	}
+	f.pending = info.Pending
+	f.seen = make(map[tlf.ID]MetadataRevision, len(info.Seen))
+	for _, s := range info.Seen {
+		f.seen[s.TlfID] = s.Revision
+	}
+	return nil
+}
+
+// saveDiskCache writes the cached favorites, and any pending
+// changes, to the disk cache of the current user.
+func (f *Favorites) saveDiskCache(dir string) error {
+	if f.diskKeyring == nil {
+		return nil
+	}
+	info := favoritesCacheInfo{
+		Favorites: make([]Favorite, 0, len(f.cache)),
+		Pending:   f.pending,
+	}
+	for fav := range f.cache {
+		info.Favorites = append(info.Favorites, fav)
+	}
+	for id, rev := range f.seen {
+		info.Seen = append(info.Seen, favoriteSeenRevision{id, rev})
+	}
+	buf, err := f.config.Codec().Encode(info)
+	if err != nil {
+		return err
+	}
+	sealed, err := f.diskKeyring.Seal(buf)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, f.diskUID.String(), favoritesCacheFile)
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, sealed, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// queueChange records a change that couldn't be sent to the server,
+// replacing any earlier pending change to the same favorite.
+func (f *Favorites) queueChange(change favoritesPendingChange) {
+	for i, p := range f.pending {
+		if p.Favorite == change.Favorite {
+			f.pending = append(f.pending[:i], f.pending[i+1:]...)
+			break
+		}
+	}
+	f.pending = append(f.pending, change)
+}
+
+// sendPending sends the queued changes to the server, in order,
+// stopping at the first one that fails.
+func (f *Favorites) sendPending(ctx context.Context) error {
+	kbpki := f.config.KBPKI()
+	for len(f.pending) > 0 {
+		p := f.pending[0]
+		var err error
+		if p.Deleted {
+			err = kbpki.FavoriteDelete(ctx, p.Favorite.toKBFolder(false))
+		} else {
+			err = kbpki.FavoriteAdd(ctx, p.Favorite.toKBFolder(p.Created))
+		}
+		if err != nil {
+			return err
+		}
+		f.pending = f.pending[1:]
+	}
+	f.pending = nil
+	return nil
+}
+
+// refresh replaces the cached favorites with the server's list,
+// after sending any pending changes, and tells the observers about
+// any differences, which were made by other devices.
+func (f *Favorites) refresh(ctx context.Context) error {
+	err := f.sendPending(ctx)
+	if err != nil {
+		return err
+	}
+
+	kbpki := f.config.KBPKI()
+	folders, err := kbpki.FavoriteList(ctx)
+	if err != nil {
+		return err
+	}
+
+	cache := make(map[Favorite]bool)
+	for _, folder := range folders {
+		cache[*NewFavoriteFromFolder(folder)] = true
+	}
+	username, _, err := kbpki.GetCurrentUserInfo(ctx)
+	if err == nil {
+		// Add favorites for the current user, that cannot be deleted.
+		cache[Favorite{string(username), true}] = true
+		cache[Favorite{string(username), false}] = true
+	}
+
+	if f.cache != nil {
+		var added, removed []Favorite
+		for fav := range cache {
+			if !f.cache[fav] {
+				added = append(added, fav)
+			}
+		}
+		for fav := range f.cache {
+			if !cache[fav] {
+				removed = append(removed, fav)
+			}
+		}
+		if len(added) > 0 || len(removed) > 0 {
+			f.observers.favoritesChanged(ctx, added, removed)
+		}
+	}
+	f.cache = cache
+	return nil
+}
+
 func (f *Favorites) handleReq(req *favReq) (err error) {
 	defer func() { f.closeReq(req, err) }()
 
+	log := f.config.MakeLogger("")
+	dir := f.getDiskCacheDir()
+	if dir != "" {
+		// Without the disk cache, favorites still work as long
+		// as the server can be reached.
+		if err := f.loadDiskCache(req.ctx, dir); err != nil {
+			log.CDebugf(req.ctx, "Couldn't load favorites cache: %v", err)
+		}
+		defer func() {
+			if err := f.saveDiskCache(dir); err != nil {
+				log.CDebugf(req.ctx,
+					"Couldn't save favorites cache: %v", err)
+			}
+		}()
+	}
+
 	kbpki := f.config.KBPKI()
 	// Fetch a new list if:
 	//  * The user asked us to refresh
@@ -104,20 +401,11 @@ func (f *Favorites) handleReq(req *favReq) (err error) {
 	//  * The user wants the list of favorites.  TODO: use the cached list
 	//    once we have proper invalidation from the server.
 	if req.refresh || f.cache == nil || req.favs != nil {
-		folders, err := kbpki.FavoriteList(req.ctx)
-		if err != nil {
+		err := f.refresh(req.ctx)
+		if err != nil && (f.cache == nil || !f.canQueue(err)) {
 			return err
-		}
-
-		f.cache = make(map[Favorite]bool)
-		for _, folder := range folders {
-			f.cache[*NewFavoriteFromFolder(folder)] = true
-		}
-		username, _, err := f.config.KBPKI().GetCurrentUserInfo(req.ctx)
-		if err == nil {
-			// Add favorites for the current user, that cannot be deleted.
-			f.cache[Favorite{string(username), true}] = true
-			f.cache[Favorite{string(username), false}] = true
+		} else if err != nil {
+			log.CDebugf(req.ctx, "Using cached favorites: %v", err)
 		}
 	}
 
@@ -126,9 +414,14 @@ func (f *Favorites) handleReq(req *favReq) (err error) {
 			continue
 		}
 		err := kbpki.FavoriteAdd(req.ctx, fav.toKBFolder())
-		if err != nil {
-			f.config.MakeLogger("").CDebugf(req.ctx,
-				"Failure adding favorite %v: %v", fav, err)
+		if err != nil && f.canQueue(err) {
+			log.CDebugf(req.ctx, "Queuing favorite add %v: %v", fav, err)
+			f.queueChange(favoritesPendingChange{
+				Favorite: fav.Favorite,
+				Created:  fav.created,
+			})
+		} else if err != nil {
+			log.CDebugf(req.ctx, "Failure adding favorite %v: %v", fav, err)
 			return err
 		}
 		f.cache[fav.Favorite] = true
@@ -139,7 +432,13 @@ func (f *Favorites) handleReq(req *favReq) (err error) {
 		// the favorite.
 		folder := fav.toKBFolder(false)
 		err := kbpki.FavoriteDelete(req.ctx, folder)
-		if err != nil {
+		if err != nil && f.canQueue(err) {
+			log.CDebugf(req.ctx, "Queuing favorite delete %v: %v", fav, err)
+			f.queueChange(favoritesPendingChange{
+				Favorite: fav,
+				Deleted:  true,
+			})
+		} else if err != nil {
 			return err
 		}
 		delete(f.cache, fav)
@@ -153,16 +452,62 @@ func (f *Favorites) handleReq(req *favReq) (err error) {
 		req.favs <- favorites
 	}
 
+	if req.seenOut != nil {
+		if f.seen == nil {
+			f.seen = make(map[tlf.ID]MetadataRevision)
+		}
+		for id, rev := range req.seen {
+			if rev > f.seen[id] {
+				f.seen[id] = rev
+			}
+		}
+		seen := make(map[tlf.ID]MetadataRevision, len(req.seenBaselines))
+		for id, rev := range req.seenBaselines {
+			if _, ok := f.seen[id]; !ok {
+				f.seen[id] = rev
+			}
+			seen[id] = f.seen[id]
+		}
+		req.seenOut <- seen
+	}
+
 	return nil
 }
 
-func (f *Favorites) loop() {
-	for req := range f.reqChan {
-		f.handleReq(req)
-		f.wg.Done()
+func (f *Favorites) loop(refreshTicker *time.Ticker) {
+	defer refreshTicker.Stop()
+	for {
+		select {
+		case req, ok := <-f.reqChan:
+			if !ok {
+				return
+			}
+			f.handleReq(req)
+			f.wg.Done()
+		case <-refreshTicker.C:
+			if !f.observers.hasFavoritesObservers() {
+				continue
+			}
+			f.handleReq(&favReq{
+				refresh: true,
+				done:    make(chan struct{}),
+				ctx:     context.Background(),
+			})
+		}
 	}
 }
 
+// RegisterForChanges makes the given observer hear about changes to
+// the favorites list made by other devices.
+func (f *Favorites) RegisterForChanges(obs FavoritesObserver) {
+	f.observers.add(obs)
+}
+
+// UnregisterFromChanges undoes RegisterForChanges.
+func (f *Favorites) UnregisterFromChanges(obs FavoritesObserver) {
+	f.observers.remove(obs)
+}
+
 // Shutdown shuts down this Favorites instance.
 func (f *Favorites) Shutdown() error {
 	f.muShutdown.Lock()
@@ -329,3 +674,28 @@ func (f *Favorites) Get(ctx context.Context) ([]Favorite, error) {
 	}
 	return <-favChan, nil
 }
+
+// updateSeen records that this device has caught up with the given
+// revisions of folders, and returns the latest revision of each
+// folder in latest that this device has seen.  Folders that have
+// never been seen are taken to be seen as of their latest revision.
+func (f *Favorites) updateSeen(ctx context.Context,
+	seen, latest map[tlf.ID]MetadataRevision) (
+	map[tlf.ID]MetadataRevision, error) {
+	if f.hasShutdown() {
+		return nil, ShutdownHappenedError{}
+	}
+	seenChan := make(chan map[tlf.ID]MetadataRevision, 1)
+	req := &favReq{
+		ctx:           ctx,
+		seen:          seen,
+		seenBaselines: latest,
+		seenOut:       seenChan,
+		done:          make(chan struct{}),
+	}
+	err := f.sendReq(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return <-seenChan, nil
+}
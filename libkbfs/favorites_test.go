@@ -5,11 +5,17 @@
 package libkbfs
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/golang/mock/gomock"
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
 
@@ -187,3 +193,87 @@ func TestFavoritesListFailsDuringAddAsync(t *testing.T) {
 	f.AddAsync(ctx, fav1) // should work
 	<-c
 }
+
+type testFavoritesObserver struct {
+	FakeObserver
+	added   []Favorite
+	removed []Favorite
+}
+
+func (o *testFavoritesObserver) FavoritesChanged(ctx context.Context,
+	added, removed []Favorite) {
+	o.added = added
+	o.removed = removed
+}
+
+func checkFavorites(ctx context.Context, t *testing.T, f *Favorites,
+	expected ...Favorite) {
+	favs, err := f.Get(ctx)
+	require.NoError(t, err)
+	expected = append(expected,
+		Favorite{"tester", true}, Favorite{"tester", false})
+	require.Len(t, favs, len(expected))
+	for _, fav := range expected {
+		require.Contains(t, favs, fav)
+	}
+}
+
+func TestFavoritesDiskCacheOffline(t *testing.T) {
+	mockCtrl, config, ctx := favTestInit(t)
+	codec := kbfscodec.NewMsgpack()
+	config.SetCodec(codec)
+	cryptKey := kbfscrypto.MakeFakeCryptPrivateKeyOrBust("crypt")
+	config.SetCrypto(NewCryptoLocal(codec,
+		kbfscrypto.MakeFakeSigningKeyOrBust("sign"), cryptKey))
+	config.mockKbpki.EXPECT().GetCurrentCryptPublicKey(gomock.Any()).
+		AnyTimes().Return(cryptKey.GetPublicKey(), nil)
+	dir, err := ioutil.TempDir(os.TempDir(), "favorites")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f := NewFavorites(config)
+	f.EnableDiskCache(dir)
+	fav1 := Favorite{"test1", true}
+	fav2 := Favorite{"test2", false}
+	fav3 := Favorite{"test3", true}
+	config.mockKbpki.EXPECT().FavoriteList(gomock.Any()).
+		Return([]keybase1.Folder{fav1.toKBFolder(false)}, nil)
+	checkFavorites(ctx, t, f, fav1)
+
+	// While offline, the cached list is used, and changes are
+	// queued.
+	errOffline := errors.New("offline")
+	config.mockKbpki.EXPECT().FavoriteAdd(gomock.Any(),
+		fav2.toKBFolder(false)).Return(errOffline)
+	require.NoError(t, f.Add(ctx, favToAdd{fav2, false}))
+	config.mockKbpki.EXPECT().FavoriteDelete(gomock.Any(),
+		fav1.toKBFolder(false)).Return(errOffline)
+	require.NoError(t, f.Delete(ctx, fav1))
+	config.mockKbpki.EXPECT().FavoriteAdd(gomock.Any(),
+		fav2.toKBFolder(false)).Return(errOffline)
+	checkFavorites(ctx, t, f, fav2)
+	require.NoError(t, f.Shutdown())
+
+	// The cache and the queued changes survive a restart.
+	f = NewFavorites(config)
+	f.EnableDiskCache(dir)
+	defer favTestShutdown(t, mockCtrl, config, f)
+	obs := &testFavoritesObserver{}
+	f.RegisterForChanges(obs)
+	config.mockKbpki.EXPECT().FavoriteAdd(gomock.Any(),
+		fav2.toKBFolder(false)).Return(errOffline)
+	checkFavorites(ctx, t, f, fav2)
+
+	// Once back online, the queued changes are sent, and changes
+	// from other devices are announced.
+	config.mockKbpki.EXPECT().FavoriteAdd(gomock.Any(),
+		fav2.toKBFolder(false)).Return(nil)
+	config.mockKbpki.EXPECT().FavoriteDelete(gomock.Any(),
+		fav1.toKBFolder(false)).Return(nil)
+	config.mockKbpki.EXPECT().FavoriteList(gomock.Any()).Return(
+		[]keybase1.Folder{fav2.toKBFolder(false), fav3.toKBFolder(false)},
+		nil)
+	checkFavorites(ctx, t, f, fav2, fav3)
+	require.Equal(t, []Favorite{fav3}, obs.added)
+	require.Len(t, obs.removed, 0)
+}
@@ -0,0 +1,359 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// fileRangeLockTTL is the duration of the leases behind file
+	// range locks, and of the guard lease that serializes them.
+	fileRangeLockTTL = 30 * time.Second
+	// fileRangeLockFilePrefix starts the names of the lease lock
+	// files behind range locks, which live next to the locked file
+	// and are named <prefix><file>.<off>-<length>.
+	fileRangeLockFilePrefix = ".range-"
+	// fileRangeGuardFilePrefix starts the name of the lease lock
+	// file that guards the range locks of a file, and the syncs
+	// done under them.
+	fileRangeGuardFilePrefix = ".rangeguard-"
+)
+
+// FileRangeLockConflictError is returned by KBFSOps.LockFileRange
+// when it isn't asked to wait, and part of the range is locked by
+// someone else, on this device or another one.
+type FileRangeLockConflictError struct {
+	Name   string
+	Off    uint64
+	Length uint64
+}
+
+// Error implements the error interface for FileRangeLockConflictError.
+func (e FileRangeLockConflictError) Error() string {
+	return fmt.Sprintf("Range %d+%d of %s is locked by someone else",
+		e.Off, e.Length, e.Name)
+}
+
+// FileRangeNotLockedError is returned by FileRangeLock.Write for a
+// write outside of the locked range, or after the lock was released.
+type FileRangeNotLockedError struct {
+	Name string
+	Off  int64
+	Len  int
+}
+
+// Error implements the error interface for FileRangeNotLockedError.
+func (e FileRangeNotLockedError) Error() string {
+	return fmt.Sprintf("Range %d+%d of %s is not locked",
+		e.Off, e.Len, e.Name)
+}
+
+// fileRangeEnd returns the end of the range with the given offset and
+// length, where a length of 0 means the range extends forever.
+func fileRangeEnd(off, length uint64) uint64 {
+	if length == 0 || off+length < off {
+		return math.MaxUint64
+	}
+	return off + length
+}
+
+func fileRangeLockName(name string, off, length uint64) string {
+	return fmt.Sprintf("%s%s.%d-%d", fileRangeLockFilePrefix, name, off, length)
+}
+
+// parseFileRangeLockName returns the range locked by the lock file
+// with the given name, if it's a range lock file for the given file.
+func parseFileRangeLockName(lockName, name string) (
+	off, length uint64, ok bool) {
+	prefix := fileRangeLockFilePrefix + name + "."
+	if !strings.HasPrefix(lockName, prefix) {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(lockName, prefix), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	off, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	length, err = strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return off, length, true
+}
+
+type fileRangeWrite struct {
+	data []byte
+	off  int64
+}
+
+// FileRangeLock is a lock on a byte range of a file, returned by
+// KBFSOps.LockFileRange, that's respected by every device of the
+// user (or team) that takes range locks on the file.
+//
+// Each locked range is a LeaseLock on a lock file next to the file,
+// and a short-lived guard LeaseLock serializes taking range locks
+// with checking for overlapping ones.  Writes made through the lock
+// are kept in memory until Flush or Unlock, which apply them and sync
+// the file while holding the guard.  Taking the guard is an
+// exclusive create, which only succeeds once this device has caught
+// up with the folder, so each flush builds on every earlier one, and
+// writers of disjoint ranges never cause a conflict copy of the file.
+//
+// Range locks can't be taken in folders with the TLF journal enabled,
+// since the lock files are LeaseLocks; LockFileRange returns a
+// LeaseLockJournaledError instead.
+type FileRangeLock struct {
+	config Config
+	dir    Node
+	file   Node
+	name   string
+	off    uint64
+	length uint64
+	holder string
+
+	lock     sync.Mutex
+	lease    *LeaseLock
+	writes   []fileRangeWrite
+	unlocked bool
+}
+
+// acquireFileRangeGuard takes the guard lock for the range locks of
+// the file with the given name.  Unlike AcquireLeaseLock, it doesn't
+// wait for the current holder's lease to expire, since the guard is
+// only ever held for a moment.
+func acquireFileRangeGuard(ctx context.Context, config Config, dir Node,
+	name, holder string) (*LeaseLock, error) {
+	for {
+		guard, err := TryAcquireLeaseLock(ctx, config, dir,
+			fileRangeGuardFilePrefix+name, holder, fileRangeLockTTL)
+		switch err.(type) {
+		case nil:
+			return guard, nil
+		case LeaseLockHeldError:
+			select {
+			case <-time.After(leaseLockMinRetryInterval):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		case ExclOnUnmergedError:
+			// We were out of date, but have caught up now,
+			// so just retry.
+		case NoSuchNameError:
+			// The holder released the guard between our
+			// attempt to create it and reading who held
+			// it, so just retry.
+		default:
+			return nil, err
+		}
+	}
+}
+
+// findFileRangeLockConflict returns the name of an unexpired lock
+// file on a range of the given file that overlaps the given range,
+// or "" if there is none.  It removes expired lock files on
+// overlapping ranges.  The caller must hold the file's guard lock.
+func findFileRangeLockConflict(ctx context.Context, config Config,
+	dir Node, name string, off, length uint64) (string, error) {
+	kbfsOps := config.KBFSOps()
+	children, err := kbfsOps.GetDirChildren(ctx, dir)
+	if err != nil {
+		return "", err
+	}
+	end := fileRangeEnd(off, length)
+	for lockName := range children {
+		lockOff, lockLength, ok := parseFileRangeLockName(lockName, name)
+		if !ok || lockOff >= end || off >= fileRangeEnd(lockOff, lockLength) {
+			continue
+		}
+
+		_, info, mtime, err := readLeaseLockInfo(ctx, kbfsOps, dir, lockName)
+		if _, ok := err.(NoSuchNameError); ok {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if info.Expires.IsZero() {
+			info.Expires = mtime.Add(fileRangeLockTTL)
+		}
+		if config.Clock().Now().Before(info.Expires) {
+			return lockName, nil
+		}
+
+		// Nobody can renew the lock without the guard, so the
+		// expired lock file can safely be removed.
+		err = kbfsOps.RemoveEntry(ctx, dir, lockName)
+		if _, ok := err.(NoSuchNameError); !ok && err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// tryLockFileRange makes one attempt at locking the given range of
+// the file.
+func tryLockFileRange(ctx context.Context, config Config, dir, file Node,
+	name string, off, length uint64, holder string) (*FileRangeLock, error) {
+	guard, err := acquireFileRangeGuard(ctx, config, dir, name, holder)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// If the guard can't be released, it will expire soon
+		// enough, so don't fail the lock over it.
+		if err := guard.Release(ctx); err != nil {
+			config.MakeLogger("").CDebugf(ctx,
+				"Couldn't release range guard for %s: %v", name, err)
+		}
+	}()
+
+	conflict, err := findFileRangeLockConflict(
+		ctx, config, dir, name, off, length)
+	if err != nil {
+		return nil, err
+	}
+	if conflict != "" {
+		return nil, FileRangeLockConflictError{name, off, length}
+	}
+
+	lease, err := TryAcquireLeaseLock(ctx, config, dir,
+		fileRangeLockName(name, off, length), holder, fileRangeLockTTL)
+	if _, ok := err.(LeaseLockHeldError); ok {
+		return nil, FileRangeLockConflictError{name, off, length}
+	} else if err != nil {
+		return nil, err
+	}
+	return &FileRangeLock{
+		config: config,
+		dir:    dir,
+		file:   file,
+		name:   name,
+		off:    off,
+		length: length,
+		holder: holder,
+		lease:  lease,
+	}, nil
+}
+
+// lockFileRange locks length bytes (or the rest, if length is 0) of
+// the file with the given name in the given directory, starting at
+// off.
+func lockFileRange(ctx context.Context, config Config, dir, file Node,
+	name string, off, length uint64, wait bool) (*FileRangeLock, error) {
+	// Each lock gets its own holder name, so that two locks on
+	// this device exclude each other just like locks on different
+	// devices do.
+	holder, err := MakeRandomRequestID()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		l, err := tryLockFileRange(
+			ctx, config, dir, file, name, off, length, holder)
+		if _, ok := err.(FileRangeLockConflictError); !ok || !wait {
+			return l, err
+		}
+		select {
+		case <-time.After(leaseLockMinRetryInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Write stages the given data to be written to the file at the given
+// offset, which must be within the locked range.  The data isn't
+// visible to anyone, including reads on this device, until the next
+// Flush or Unlock.
+func (l *FileRangeLock) Write(ctx context.Context, data []byte,
+	off int64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.unlocked || off < 0 || uint64(off) < l.off ||
+		uint64(off)+uint64(len(data)) > fileRangeEnd(l.off, l.length) {
+		return FileRangeNotLockedError{l.name, off, len(data)}
+	}
+	l.writes = append(l.writes, fileRangeWrite{
+		data: append([]byte(nil), data...),
+		off:  off,
+	})
+	return nil
+}
+
+func (l *FileRangeLock) flushLocked(ctx context.Context) (err error) {
+	if len(l.writes) == 0 {
+		return nil
+	}
+	select {
+	case <-l.lease.Lost():
+		return LeaseLockLostError{Name: l.lease.name}
+	default:
+	}
+
+	guard, err := acquireFileRangeGuard(
+		ctx, l.config, l.dir, l.name, l.holder)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if releaseErr := guard.Release(ctx); err == nil {
+			err = releaseErr
+		}
+	}()
+
+	kbfsOps := l.config.KBFSOps()
+	for _, w := range l.writes {
+		err = kbfsOps.Write(ctx, l.file, w.data, w.off)
+		if err != nil {
+			return err
+		}
+	}
+	err = kbfsOps.Sync(ctx, l.file)
+	if err != nil {
+		return err
+	}
+	l.writes = nil
+	return nil
+}
+
+// Flush applies the writes staged so far to the file, and syncs it.
+func (l *FileRangeLock) Flush(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.unlocked {
+		return nil
+	}
+	return l.flushLocked(ctx)
+}
+
+// Unlock flushes any staged writes and releases the lock.  If the
+// flush fails, the lock is kept, and Unlock may be retried, unless
+// the lock was lost, in which case the staged writes are dropped.
+func (l *FileRangeLock) Unlock(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.unlocked {
+		return nil
+	}
+	err := l.flushLocked(ctx)
+	if _, ok := err.(LeaseLockLostError); ok {
+		l.unlocked = true
+		return err
+	} else if err != nil {
+		return err
+	}
+	l.unlocked = true
+	return l.lease.Release(ctx)
+}
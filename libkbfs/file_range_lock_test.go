@@ -0,0 +1,143 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileRangeLockLocal(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	kbfsOps := config.KBFSOps()
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// Disjoint ranges can be locked together, but overlapping
+	// ones can't.
+	l1, err := kbfsOps.LockFileRange(ctx, fileNode, 0, 4, false)
+	require.NoError(t, err)
+	l2, err := kbfsOps.LockFileRange(ctx, fileNode, 4, 4, false)
+	require.NoError(t, err)
+	_, err = kbfsOps.LockFileRange(ctx, fileNode, 2, 4, false)
+	require.IsType(t, FileRangeLockConflictError{}, err)
+	_, err = kbfsOps.LockFileRange(ctx, fileNode, 6, 0, false)
+	require.IsType(t, FileRangeLockConflictError{}, err)
+
+	// Writes must stay within the locked range, and aren't visible
+	// until they're flushed.
+	err = l1.Write(ctx, []byte{1, 2, 3, 4, 5}, 0)
+	require.IsType(t, FileRangeNotLockedError{}, err)
+	require.NoError(t, l1.Write(ctx, []byte{1, 2}, 0))
+	require.NoError(t, l2.Write(ctx, []byte{5, 6, 7, 8}, 4))
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), ei.Size)
+
+	// A waiting lock gets the range once it's released.
+	lockCh := make(chan *FileRangeLock, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		l, err := kbfsOps.LockFileRange(ctx, fileNode, 0, 0, true)
+		lockCh <- l
+		errCh <- err
+	}()
+	require.NoError(t, l2.Unlock(ctx))
+	require.NoError(t, l1.Unlock(ctx))
+	l3 := <-lockCh
+	require.NoError(t, <-errCh)
+	require.NoError(t, l3.Unlock(ctx))
+
+	buf := make([]byte, 8)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 0, 0, 5, 6, 7, 8}, buf[:n])
+
+	err = l1.Write(ctx, []byte{1}, 0)
+	require.IsType(t, FileRangeNotLockedError{}, err)
+
+	// No lock files are left behind.
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+}
+
+func TestFileRangeLockAcrossDevices(t *testing.T) {
+	config1, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+	config2 := ConfigAsUser(config1, "u1")
+	defer CheckConfigAndShutdown(t, config2)
+
+	kbfsOps1 := config1.KBFSOps()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, "u1", false)
+	fileNode1, _, err := kbfsOps1.CreateFile(
+		ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps1.Write(ctx, fileNode1, make([]byte, 8), 0))
+	require.NoError(t, kbfsOps1.Sync(ctx, fileNode1))
+
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1", false)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	l1, err := kbfsOps1.LockFileRange(ctx, fileNode1, 0, 4, false)
+	require.NoError(t, err)
+	l2, err := kbfsOps2.LockFileRange(ctx, fileNode2, 4, 4, false)
+	require.NoError(t, err)
+	_, err = kbfsOps2.LockFileRange(ctx, fileNode2, 0, 1, false)
+	require.IsType(t, FileRangeLockConflictError{}, err)
+
+	// Both devices write their own halves of the file, without
+	// a conflict copy.
+	require.NoError(t, l1.Write(ctx, []byte{1, 2, 3, 4}, 0))
+	require.NoError(t, l2.Write(ctx, []byte{5, 6, 7, 8}, 4))
+	require.NoError(t, l1.Unlock(ctx))
+	require.NoError(t, l2.Unlock(ctx))
+
+	require.NoError(t,
+		kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch()))
+	buf := make([]byte, 8)
+	n, err := kbfsOps1.Read(ctx, fileNode1, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, buf[:n])
+	children, err := kbfsOps1.GetDirChildren(ctx, rootNode1)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+}
+
+func TestFileRangeLockJournaled(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "file_range_lock")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	config.EnableJournaling(tempdir, TLFJournalBackgroundWorkEnabled)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+
+	kbfsOps := config.KBFSOps()
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = jServer.Enable(ctx, rootNode.GetFolderBranch().Tlf,
+		TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+
+	_, err = kbfsOps.LockFileRange(ctx, fileNode, 0, 4, false)
+	require.IsType(t, LeaseLockJournaledError{}, err)
+	_, err = kbfsOps.LockFileRange(ctx, fileNode, 0, 4, true)
+	require.IsType(t, LeaseLockJournaledError{}, err)
+}
@@ -0,0 +1,397 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// folderBatch tracks the operations staged by KBFSOps.RunBatch for
+// one folder-branch.  Each operation is applied to the same
+// successor MD and announced locally as soon as it's staged, but
+// the MD itself is only put when the batch commits.
+type folderBatch struct {
+	// md is the successor MD holding all the staged ops, or nil if
+	// nothing has been staged yet.
+	md *RootMetadata
+	// ops are the ops of md that have been staged successfully.
+	ops []op
+	// bps holds all the blocks put for the staged ops, so they can
+	// be cleaned up if the batch is rolled back.
+	bps *blockPutState
+	// committing is set while md is being put.
+	committing bool
+}
+
+// startBatch takes mdWriterLock, and holds it until finishBatch is
+// called with the same lState.
+func (fbo *folderBranchOps) startBatch(
+	ctx context.Context, lState *lockState) {
+	fbo.log.CDebugf(ctx, "Starting a batch")
+	fbo.mdWriterLock.Lock(lState)
+	fbo.batch = &folderBatch{bps: newBlockPutState(0)}
+}
+
+// stageBatchOpsLocked stands in for finalizeMDWriteLocked while a
+// batch is being staged: it caches the new blocks and announces the
+// ops added to md since the last call, so that later operations in
+// the batch see their effects, but doesn't put md.
+func (fbo *folderBranchOps) stageBatchOpsLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, bps *blockPutState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	b := fbo.batch
+	if err := fbo.finalizeBlocks(bps); err != nil {
+		return err
+	}
+	if bps != nil {
+		b.bps.mergeOtherBps(bps)
+	}
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	ops := md.data.Changes.Ops
+	for _, op := range ops[len(b.ops):] {
+		fbo.notifyOneOpLocked(ctx, lState, op, md.ReadOnly())
+	}
+	b.ops = ops
+	return nil
+}
+
+// doBatchOpLocked runs one operation of the current batch.  If the
+// operation fails before it's staged, any partial change it made to
+// the batch's MD is thrown away, so the operation has no effect; it
+// is retried if the error is a retriable one.
+func (fbo *folderBranchOps) doBatchOpLocked(ctx context.Context,
+	lState *lockState, fn func() error) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	b := fbo.batch
+	for i := 0; ; i++ {
+		var snapshot *RootMetadata
+		if b.md != nil {
+			var err error
+			snapshot, err = b.md.deepCopy(fbo.config.Codec())
+			if err != nil {
+				return err
+			}
+		}
+
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if b.md != nil && len(b.md.data.Changes.Ops) != len(b.ops) {
+			b.md = snapshot
+			b.ops = nil
+			if snapshot != nil {
+				b.ops = snapshot.data.Changes.Ops
+			}
+		}
+		if !isRetriableError(err, i) {
+			return err
+		}
+		fbo.log.CDebugf(ctx, "Trying batch op again after "+
+			"retriable error: %v", err)
+	}
+}
+
+func (fbo *folderBranchOps) commitBatchLocked(
+	ctx context.Context, lState *lockState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	b := fbo.batch
+	if b.md == nil || len(b.ops) == 0 {
+		// Nothing to commit.
+		return nil
+	}
+	fbo.log.CDebugf(ctx, "Committing a batch of %d ops", len(b.ops))
+
+	b.committing = true
+	bps, err := fbo.maybeUnembedAndPutBlocks(ctx, b.md)
+	if err != nil {
+		return err
+	}
+	if bps != nil {
+		b.bps.mergeOtherBps(bps)
+	}
+	return fbo.finalizeMDWriteLocked(ctx, lState, b.md, b.bps, NoExcl)
+}
+
+// rollBackBatchLocked undoes the local effects of the staged ops, in
+// reverse order, and cleans up their blocks.
+func (fbo *folderBranchOps) rollBackBatchLocked(
+	ctx context.Context, lState *lockState) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	b := fbo.batch
+	if b.md == nil {
+		return
+	}
+	fbo.log.CDebugf(ctx, "Rolling back a batch of %d ops", len(b.ops))
+
+	fbo.headLock.Lock(lState)
+	for i := len(b.ops) - 1; i >= 0; i-- {
+		io, err := invertOpForLocalNotifications(b.ops[i])
+		if err != nil {
+			fbo.log.CWarningf(ctx,
+				"got error %v when invert op %v; skipping", err, b.ops[i])
+			continue
+		}
+		fbo.notifyOneOpLocked(ctx, lState, io, b.md.ReadOnly())
+	}
+	fbo.headLock.Unlock(lState)
+
+	fbo.fbm.cleanUpBlockState(b.md.ReadOnly(), b.bps, blockDeleteOnMDFail)
+}
+
+// finishBatch commits the current batch if err is nil, or rolls it
+// back otherwise, and releases mdWriterLock.
+func (fbo *folderBranchOps) finishBatch(
+	ctx context.Context, lState *lockState, err error) error {
+	defer fbo.mdWriterLock.Unlock(lState)
+	defer func() { fbo.batch = nil }()
+
+	if err == nil {
+		err = fbo.commitBatchLocked(ctx, lState)
+	}
+	if err != nil {
+		fbo.rollBackBatchLocked(ctx, lState)
+	}
+	fbo.deferLog.CDebugf(ctx, "Batch done: %v", err)
+	return err
+}
+
+// RunBatch implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) RunBatch(
+	ctx context.Context, fn func(tx BatchOps) error) error {
+	tx := newBatchOps(func(context.Context, Node) *folderBranchOps {
+		return fbo
+	})
+	return tx.finish(ctx, fn(tx))
+}
+
+// batchOps implements BatchOps for KBFSOps.RunBatch.  It starts a
+// batch on the folder-branch that getOps returns for the first node
+// it's given.
+type batchOps struct {
+	getOps func(ctx context.Context, node Node) *folderBranchOps
+	lState *lockState
+	fbo    *folderBranchOps
+}
+
+var _ BatchOps = (*batchOps)(nil)
+
+func newBatchOps(
+	getOps func(ctx context.Context, node Node) *folderBranchOps) *batchOps {
+	return &batchOps{getOps: getOps, lState: makeFBOLockState()}
+}
+
+func (tx *batchOps) do(ctx context.Context, node Node,
+	fn func(fbo *folderBranchOps) error) error {
+	if tx.fbo == nil {
+		tx.fbo = tx.getOps(ctx, node)
+		tx.fbo.startBatch(ctx, tx.lState)
+	}
+	if fb := node.GetFolderBranch(); fb != tx.fbo.folderBranch {
+		return BatchAcrossFoldersError{tx.fbo.folderBranch, fb}
+	}
+
+	return tx.fbo.doBatchOpLocked(ctx, tx.lState, func() error {
+		return fn(tx.fbo)
+	})
+}
+
+func (tx *batchOps) finish(ctx context.Context, err error) error {
+	if tx.fbo == nil {
+		// No operations were staged.
+		return err
+	}
+	return tx.fbo.finishBatch(ctx, tx.lState, err)
+}
+
+// CreateDir implements the BatchOps interface for batchOps.
+func (tx *batchOps) CreateDir(ctx context.Context, dir Node, name string) (
+	n Node, ei EntryInfo, err error) {
+	err = tx.do(ctx, dir, func(fbo *folderBranchOps) error {
+		if err := checkDisallowedPrefixes(name); err != nil {
+			return err
+		}
+		node, de, err := fbo.createEntryLocked(
+			ctx, tx.lState, dir, name, Dir, NoExcl)
+		n, ei = node, de.EntryInfo
+		return err
+	})
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return n, ei, nil
+}
+
+// CreateFile implements the BatchOps interface for batchOps.
+func (tx *batchOps) CreateFile(ctx context.Context, dir Node, name string,
+	isExec bool) (n Node, ei EntryInfo, err error) {
+	entryType := File
+	if isExec {
+		entryType = Exec
+	}
+	err = tx.do(ctx, dir, func(fbo *folderBranchOps) error {
+		if err := checkDisallowedPrefixes(name); err != nil {
+			return err
+		}
+		node, de, err := fbo.createEntryLocked(
+			ctx, tx.lState, dir, name, entryType, NoExcl)
+		n, ei = node, de.EntryInfo
+		return err
+	})
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return n, ei, nil
+}
+
+// CreateLink implements the BatchOps interface for batchOps.
+func (tx *batchOps) CreateLink(ctx context.Context, dir Node,
+	fromName string, toPath string) (ei EntryInfo, err error) {
+	err = tx.do(ctx, dir, func(fbo *folderBranchOps) error {
+		de, err := fbo.createLinkLocked(
+			ctx, tx.lState, dir, fromName, toPath, NotSpecial)
+		ei = de.EntryInfo
+		return err
+	})
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	return ei, nil
+}
+
+// RemoveDir implements the BatchOps interface for batchOps.
+func (tx *batchOps) RemoveDir(
+	ctx context.Context, dir Node, dirName string) error {
+	return tx.do(ctx, dir, func(fbo *folderBranchOps) error {
+		storedName, err := fbo.storedName(dirName)
+		if err != nil {
+			return err
+		}
+		return fbo.removeDirLocked(ctx, tx.lState, dir, storedName)
+	})
+}
+
+// RemoveEntry implements the BatchOps interface for batchOps.
+func (tx *batchOps) RemoveEntry(
+	ctx context.Context, dir Node, name string) error {
+	return tx.do(ctx, dir, func(fbo *folderBranchOps) error {
+		storedName, err := fbo.storedName(name)
+		if err != nil {
+			return err
+		}
+		md, err := fbo.getMDForWriteLocked(ctx, tx.lState)
+		if err != nil {
+			return err
+		}
+		dirPath, err := fbo.pathFromNodeForMDWriteLocked(tx.lState, dir)
+		if err != nil {
+			return err
+		}
+		return fbo.removeEntryLocked(ctx, tx.lState, md, dirPath, storedName)
+	})
+}
+
+// Rename implements the BatchOps interface for batchOps.
+func (tx *batchOps) Rename(ctx context.Context, oldParent Node,
+	oldName string, newParent Node, newName string) error {
+	if oldParent.GetFolderBranch() != newParent.GetFolderBranch() {
+		return RenameAcrossDirsError{}
+	}
+	return tx.do(ctx, oldParent, func(fbo *folderBranchOps) error {
+		oldParentPath, err :=
+			fbo.pathFromNodeForMDWriteLocked(tx.lState, oldParent)
+		if err != nil {
+			return err
+		}
+		newParentPath, err :=
+			fbo.pathFromNodeForMDWriteLocked(tx.lState, newParent)
+		if err != nil {
+			return err
+		}
+		return fbo.renameLocked(ctx, tx.lState, oldParentPath, oldName,
+			newParentPath, newName)
+	})
+}
+
+// syncFileLocked stages the dirty data of the given file, so that
+// the dirty-data limits can't make a batched write wait on a sync
+// that needs mdWriterLock.
+func (tx *batchOps) syncFileLocked(ctx context.Context,
+	fbo *folderBranchOps, file Node) error {
+	filePath, err := fbo.pathFromNodeForMDWriteLocked(tx.lState, file)
+	if err != nil {
+		return err
+	}
+	_, err = fbo.syncLocked(ctx, tx.lState, filePath)
+	return err
+}
+
+// Write implements the BatchOps interface for batchOps.
+func (tx *batchOps) Write(
+	ctx context.Context, file Node, data []byte, off int64) error {
+	return tx.do(ctx, file, func(fbo *folderBranchOps) error {
+		md, err := fbo.getMDLocked(ctx, tx.lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+		err = fbo.blocks.Write(
+			ctx, tx.lState, md.ReadOnly(), file, data, off)
+		if err != nil {
+			return err
+		}
+		return tx.syncFileLocked(ctx, fbo, file)
+	})
+}
+
+// Truncate implements the BatchOps interface for batchOps.
+func (tx *batchOps) Truncate(
+	ctx context.Context, file Node, size uint64) error {
+	return tx.do(ctx, file, func(fbo *folderBranchOps) error {
+		md, err := fbo.getMDLocked(ctx, tx.lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+		err = fbo.blocks.Truncate(
+			ctx, tx.lState, md.ReadOnly(), file, size)
+		if err != nil {
+			return err
+		}
+		return tx.syncFileLocked(ctx, fbo, file)
+	})
+}
+
+// SetEx implements the BatchOps interface for batchOps.
+func (tx *batchOps) SetEx(ctx context.Context, file Node, ex bool) error {
+	return tx.do(ctx, file, func(fbo *folderBranchOps) error {
+		filePath, err := fbo.pathFromNodeForMDWriteLocked(tx.lState, file)
+		if err != nil {
+			return err
+		}
+		return fbo.setExLocked(ctx, tx.lState, filePath, ex)
+	})
+}
+
+// SetMtime implements the BatchOps interface for batchOps.
+func (tx *batchOps) SetMtime(
+	ctx context.Context, file Node, mtime *time.Time) error {
+	if mtime == nil {
+		return nil
+	}
+	return tx.do(ctx, file, func(fbo *folderBranchOps) error {
+		filePath, err := fbo.pathFromNodeForMDWriteLocked(tx.lState, file)
+		if err != nil {
+			return err
+		}
+		return fbo.setMtimeLocked(ctx, tx.lState, filePath, mtime)
+	})
+}
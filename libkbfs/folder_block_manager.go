@@ -393,6 +393,9 @@ func (fbm *folderBlockManager) doChunkedDowngrades(ctx context.Context,
 	[]BlockID, error) {
 	fbm.log.CDebugf(ctx, "Downgrading %d pointers (archive=%t)",
 		len(ptrs), archive)
+	// Nobody is waiting on these, so let everything else go to
+	// the block server first.
+	ctx = WithBlockPriority(ctx, BlockPriorityQuotaReclamation)
 	bops := fbm.config.BlockOps()
 
 	// Round up to find the number of chunks.
@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"container/heap"
 	"errors"
 	"fmt"
 	"path/filepath"
@@ -366,15 +367,10 @@ func (fbo *folderBlockOps) GetBlockForReading(ctx context.Context,
 		NewCommonBlock, false, path{})
 }
 
-// getDirBlockHelperLocked retrieves the block pointed to by ptr, which
-// must be valid, either from the cache or from the server. An error
-// is returned if the retrieved block is not a dir block.
-//
-// This must be called only by GetDirBlockForReading() and
-// getDirLocked().
-//
-// p is used only when reporting errors, and can be empty.
-func (fbo *folderBlockOps) getDirBlockHelperLocked(ctx context.Context,
+// getDirBlockNoAssembleLocked is like getDirBlockHelperLocked, but
+// returns the top block of an indirect directory as is, without
+// fetching the blocks under it.
+func (fbo *folderBlockOps) getDirBlockNoAssembleLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, ptr BlockPointer,
 	branch BranchName, p path) (*DirBlock, error) {
 	fbo.blockLock.AssertAnyLocked(lState)
@@ -391,10 +387,35 @@ func (fbo *folderBlockOps) getDirBlockHelperLocked(ctx context.Context,
 	if !ok {
 		return nil, NotDirBlockError{ptr, branch, p}
 	}
-
 	return dblock, nil
 }
 
+// getDirBlockHelperLocked retrieves the block pointed to by ptr, which
+// must be valid, either from the cache or from the server. An error
+// is returned if the retrieved block is not a dir block.  The top
+// block of an indirect directory is returned assembled (see
+// assembleDirBlock); unless it's dirty, the assembled block is a new
+// one, which the caller may modify.
+//
+// This must be called only by GetDirBlockForReading() and
+// getDirLocked().
+//
+// p is used only when reporting errors, and can be empty.
+func (fbo *folderBlockOps) getDirBlockHelperLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, ptr BlockPointer,
+	branch BranchName, p path) (*DirBlock, error) {
+	dblock, err := fbo.getDirBlockNoAssembleLocked(
+		ctx, lState, kmd, ptr, branch, p)
+	if err != nil {
+		return nil, err
+	}
+	return assembleDirBlock(ctx, dblock,
+		func(ctx context.Context, ptr BlockPointer) (*DirBlock, error) {
+			return fbo.getDirBlockNoAssembleLocked(
+				ctx, lState, kmd, ptr, branch, p)
+		})
+}
+
 // GetFileBlockForReading retrieves the block pointed to by ptr, which
 // must be valid, either from the cache or from the server. An error
 // is returned if the retrieved block is not a file block.
@@ -567,10 +588,12 @@ func (fbo *folderBlockOps) getDirLocked(ctx context.Context,
 		return nil, err
 	}
 
-	if rtype == blockWrite && !fbo.config.DirtyBlockCache().IsDirty(
-		fbo.id(), dir.tailPointer(), dir.Branch) {
+	if rtype == blockWrite && !dblock.assembled &&
+		!fbo.config.DirtyBlockCache().IsDirty(
+			fbo.id(), dir.tailPointer(), dir.Branch) {
 		// Copy the block if it's for writing and the block is
-		// not yet dirty.
+		// not yet dirty.  A clean assembled block is already a
+		// copy.
 		dblock, err = dblock.DeepCopy(fbo.config.Codec())
 		if err != nil {
 			return nil, err
@@ -731,6 +754,128 @@ func (fbo *folderBlockOps) GetDirtyDirChildren(
 	return children, nil
 }
 
+// dirChildHeap is a max-heap of directory children, ordered by name.
+// It's used to pick out the first page of a directory's children
+// without sorting all of them.
+type dirChildHeap []DirChild
+
+func (h dirChildHeap) Len() int            { return len(h) }
+func (h dirChildHeap) Less(i, j int) bool  { return h[i].Name > h[j].Name }
+func (h dirChildHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *dirChildHeap) Push(x interface{}) { *h = append(*h, x.(DirChild)) }
+func (h *dirChildHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// addDirChildrenAfter adds the children of dblock named after cursor
+// to h, keeping only the max smallest names overall.  A non-positive
+// max keeps them all.
+func addDirChildrenAfter(
+	h *dirChildHeap, dblock *DirBlock, cursor string, max int) {
+	for name, de := range dblock.Children {
+		if name <= cursor {
+			continue
+		}
+		child := DirChild{Name: name, EntryInfo: de.EntryInfo}
+		if max <= 0 || h.Len() < max {
+			heap.Push(h, child)
+		} else if name < (*h)[0].Name {
+			(*h)[0] = child
+			heap.Fix(h, 0)
+		}
+	}
+}
+
+// addDirChildrenPageLocked adds the (possibly dirty) children of
+// dblock, a block of the directory dir, to h as addDirChildrenAfter
+// does.  For an indirect block, only the blocks under it that can
+// hold children of the page are fetched.
+func (fbo *folderBlockOps) addDirChildrenPageLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir path, dblock *DirBlock,
+	h *dirChildHeap, cursor string, max int) error {
+	fbo.blockLock.AssertAnyLocked(lState)
+	if !dblock.IsInd || dblock.assembled {
+		dblock, err := fbo.updateWithDirtyEntriesLocked(ctx, lState, dblock)
+		if err != nil {
+			return err
+		}
+		addDirChildrenAfter(h, dblock, cursor, max)
+		return nil
+	}
+
+	// Each child block holds the names from its offset up to the
+	// offset of the next one.
+	for i, iptr := range dblock.IPtrs {
+		if i+1 < len(dblock.IPtrs) && dblock.IPtrs[i+1].Off <= cursor {
+			continue
+		}
+		if max > 0 && h.Len() == max && (*h)[0].Name < iptr.Off {
+			// Every name from here on is past the page.
+			break
+		}
+		childBlock, err := fbo.getDirBlockNoAssembleLocked(
+			ctx, lState, kmd, iptr.BlockPointer, dir.Branch, dir)
+		if err != nil {
+			return err
+		}
+		err = fbo.addDirChildrenPageLocked(
+			ctx, lState, kmd, dir, childBlock, h, cursor, max)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDirtyDirChildrenPage returns, in name order, up to limit of the
+// (possibly dirty) children entries of the given directory that come
+// after cursor, along with the cursor for the next page, which is
+// empty if there are no more entries.  A non-positive limit returns
+// all the remaining entries.  For an indirect directory, only the
+// blocks that can hold entries of the page are fetched.
+func (fbo *folderBlockOps) GetDirtyDirChildrenPage(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, dir path,
+	cursor string, limit int) ([]DirChild, string, error) {
+	// Collect one more entry than asked for, to know whether
+	// there's another page.
+	max := 0
+	if limit > 0 {
+		max = limit + 1
+	}
+	h := &dirChildHeap{}
+	err := func() error {
+		fbo.blockLock.RLock(lState)
+		defer fbo.blockLock.RUnlock(lState)
+		if !dir.isValid() {
+			return InvalidPathError{dir}
+		}
+		dblock, err := fbo.getDirBlockNoAssembleLocked(
+			ctx, lState, kmd, dir.tailPointer(), dir.Branch, dir)
+		if err != nil {
+			return err
+		}
+		return fbo.addDirChildrenPageLocked(
+			ctx, lState, kmd, dir, dblock, h, cursor, max)
+	}()
+	if err != nil {
+		return nil, "", err
+	}
+
+	children := make([]DirChild, h.Len())
+	for i := len(children) - 1; i >= 0; i-- {
+		children[i] = heap.Pop(h).(DirChild)
+	}
+	if max > 0 && len(children) == max {
+		children = children[:limit]
+		return children, children[limit-1].Name, nil
+	}
+	return children, "", nil
+}
+
 // file must have a valid parent.
 func (fbo *folderBlockOps) getDirtyParentAndEntryLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path, rtype blockReqType) (
@@ -775,11 +920,36 @@ func (fbo *folderBlockOps) GetDirtyParentAndEntry(
 // file must have a valid parent.
 func (fbo *folderBlockOps) getDirtyEntryLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path) (DirEntry, error) {
-	// TODO: Since we only need a single DirEntry, avoid having to
-	// look up every entry in the DirBlock.
-	_, de, err := fbo.getDirtyParentAndEntryLocked(
-		ctx, lState, kmd, file, blockRead)
-	return de, err
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	if !file.hasValidParent() {
+		return DirEntry{}, InvalidParentPathError{file}
+	}
+
+	// Only look at the block that holds the entry, in case the
+	// parent is a big, indirect directory.
+	parentPath := file.parentPath()
+	dblock, err := fbo.getDirBlockNoAssembleLocked(ctx, lState, kmd,
+		parentPath.tailPointer(), parentPath.Branch, *parentPath)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	name := file.tailName()
+	de, ok, err := lookupDirEntry(ctx, dblock, name,
+		func(ctx context.Context, ptr BlockPointer) (*DirBlock, error) {
+			return fbo.getDirBlockNoAssembleLocked(
+				ctx, lState, kmd, ptr, parentPath.Branch, *parentPath)
+		})
+	if err != nil {
+		return DirEntry{}, err
+	}
+	if !ok {
+		return DirEntry{}, NoSuchNameError{name}
+	}
+	if dirtyDe, ok := fbo.deCache[de.Ref()]; ok {
+		return dirtyDe, nil
+	}
+	return de, nil
 }
 
 // GetDirtyEntry returns the possibly-dirty DirEntry of the given file
@@ -978,6 +1148,18 @@ func (fbo *folderBlockOps) nowUnixNano() int64 {
 	return fbo.config.Clock().Now().UnixNano()
 }
 
+// setDirtyEntryTimes sets the mtime and ctime of the given dirty
+// file entry to now, if the config asks for strict times.
+// Otherwise, they are set when the file is synced.
+func (fbo *folderBlockOps) setDirtyEntryTimes(de *DirEntry) {
+	if !fbo.config.StrictTimes() {
+		return
+	}
+	now := fbo.nowUnixNano()
+	de.Mtime = now
+	de.Ctime = now
+}
+
 // PrepRename prepares the given rename operation. It returns copies
 // of the old and new parent block (which may be the same), what is to
 // be the new DirEntry, and a local block cache. It also modifies md,
@@ -1211,6 +1393,9 @@ func (fbo *folderBlockOps) writeGetFileLocked(
 	if !kmd.GetTlfHandle().IsWriter(uid) {
 		return nil, "", NewWriteAccessError(kmd.GetTlfHandle(), username, file.String())
 	}
+	if fbo.config.ReadReplicaPollInterval() > 0 {
+		return nil, "", ReadReplicaError{file.String()}
+	}
 	fblock, err := fbo.getFileLocked(ctx, lState, kmd, file, blockWrite)
 	if err != nil {
 		return nil, "", err
@@ -1264,12 +1449,28 @@ func (fbo *folderBlockOps) createIndirectBlockLocked(lState *lockState,
 	return fblock, nil
 }
 
+// writeMode says where writeDataLocked writes its data.
+type writeMode int
+
+const (
+	// writeAtOffset writes at the given offset, which must be the
+	// end of the file if it's append-only.
+	writeAtOffset writeMode = iota
+	// writeAtEnd ignores the given offset, and writes at the end
+	// of the file.
+	writeAtEnd
+	// writeUnchecked writes at the given offset, even if the file
+	// is append-only.  It's for replaying writes, and for extending
+	// truncates, that have already been checked.
+	writeUnchecked
+)
+
 // Returns the set of blocks dirtied during this write that might need
 // to be cleaned up if the write is deferred.
 func (fbo *folderBlockOps) writeDataLocked(
 	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
-	data []byte, off int64) (latestWrite WriteRange, dirtyPtrs []BlockPointer,
-	newlyDirtiedChildBytes int64, err error) {
+	data []byte, off int64, mode writeMode) (latestWrite WriteRange,
+	dirtyPtrs []BlockPointer, newlyDirtiedChildBytes int64, err error) {
 	if jServer, err := GetJournalServer(fbo.config); err == nil {
 		jServer.dirtyOpStart(fbo.id())
 		defer jServer.dirtyOpEnd(fbo.id())
@@ -1282,9 +1483,11 @@ func (fbo *folderBlockOps) writeDataLocked(
 		fbo.log.CDebugf(ctx, "writeDataLocked done: %v", err)
 	}()
 
-	if sz := off + int64(len(data)); uint64(sz) > fbo.config.MaxFileBytes() {
-		return WriteRange{}, nil, 0,
-			FileTooBigError{file, sz, fbo.config.MaxFileBytes()}
+	if mode != writeAtEnd {
+		if sz := off + int64(len(data)); uint64(sz) > fbo.config.MaxFileBytes() {
+			return WriteRange{}, nil, 0,
+				FileTooBigError{file, sz, fbo.config.MaxFileBytes()}
+		}
 	}
 
 	fblock, uid, err := fbo.writeGetFileLocked(ctx, lState, kmd, file)
@@ -1317,6 +1520,19 @@ func (fbo *folderBlockOps) writeDataLocked(
 	if err != nil {
 		return WriteRange{}, nil, 0, err
 	}
+	switch mode {
+	case writeAtOffset:
+		if de.AppendOnly && off != int64(de.Size) {
+			return WriteRange{}, nil, 0, AppendOnlyError{file.tailName()}
+		}
+	case writeAtEnd:
+		off = int64(de.Size)
+		if sz := off + int64(len(data)); uint64(sz) > fbo.config.MaxFileBytes() {
+			return WriteRange{}, nil, 0,
+				FileTooBigError{file, sz, fbo.config.MaxFileBytes()}
+		}
+	}
+	fbo.setDirtyEntryTimes(&de)
 	if de.BlockPointer != file.tailPointer() {
 		fbo.log.CDebugf(ctx, "DirEntry and file tail pointer don't match: "+
 			"%v vs %v", de.BlockPointer, file.tailPointer())
@@ -1469,19 +1685,44 @@ func (fbo *folderBlockOps) writeDataLocked(
 func (fbo *folderBlockOps) Write(
 	ctx context.Context, lState *lockState, kmd KeyMetadata,
 	file Node, data []byte, off int64) error {
+	_, err := fbo.write(ctx, lState, kmd, file, data, off, false)
+	return err
+}
+
+// Append writes the given data at the end of the given file, and
+// returns the offset it was written at.  Since the end is found under
+// blockLock, concurrent appends never overwrite each other.  Like
+// Write, it may block if there is too much unflushed data.
+func (fbo *folderBlockOps) Append(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, data []byte) (int64, error) {
+	return fbo.write(ctx, lState, kmd, file, data, 0, true)
+}
+
+// write writes the given data to the given file, either at off or,
+// if atEnd is true, at the end of the file.  It returns the offset of
+// the write.
+func (fbo *folderBlockOps) write(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, data []byte, off int64, atEnd bool) (int64, error) {
+	mode := writeAtOffset
+	if atEnd {
+		mode = writeAtEnd
+	}
+
 	// If there is too much unflushed data, we should wait until some
 	// of it gets flush so our memory usage doesn't grow without
 	// bound.
 	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(ctx,
 		fbo.id(), int64(len(data)))
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(fbo.id(),
 		-int64(len(data)), false)
 	err = fbo.maybeWaitOnDeferredWrites(ctx, lState, file, c)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	fbo.blockLock.Lock(lState)
@@ -1489,18 +1730,20 @@ func (fbo *folderBlockOps) Write(
 
 	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+
 	defer func() {
 		fbo.doDeferWrite = false
 	}()
 
 	latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err := fbo.writeDataLocked(
-		ctx, lState, kmd, filePath, data, off)
+		ctx, lState, kmd, filePath, data, off, mode)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	off = int64(latestWrite.Off)
 
 	fbo.observers.localChange(ctx, file, latestWrite)
 
@@ -1529,13 +1772,13 @@ func (fbo *folderBlockOps) Write(
 				// Write the data again.  We know this won't be
 				// deferred, so no need to check the new ptrs.
 				_, _, _, err = fbo.writeDataLocked(
-					ctx, lState, kmd, f, dataCopy, off)
+					ctx, lState, kmd, f, dataCopy, off, writeUnchecked)
 				return err
 			})
 		fbo.deferredWaitBytes += newlyDirtiedChildBytes
 	}
 
-	return nil
+	return off, nil
 }
 
 // truncateExtendLocked is called by truncateLocked to extend a file and
@@ -1591,6 +1834,7 @@ func (fbo *folderBlockOps) truncateExtendLocked(
 	if err != nil {
 		return WriteRange{}, nil, err
 	}
+	fbo.setDirtyEntryTimes(&de)
 
 	si, err := fbo.getOrCreateSyncInfoLocked(lState, de)
 	if err != nil {
@@ -1641,9 +1885,13 @@ const truncateExtendCutoffPoint = 128 * 1024
 
 // Returns the set of newly-ID'd blocks created during this truncate
 // that might need to be cleaned up if the truncate is deferred.
+// truncateLocked truncates or extends the given file to the given
+// size.  If checkAppendOnly is true, it fails if the file is
+// append-only.
 func (fbo *folderBlockOps) truncateLocked(
 	ctx context.Context, lState *lockState, kmd KeyMetadata,
-	file path, size uint64) (*WriteRange, []BlockPointer, int64, error) {
+	file path, size uint64, checkAppendOnly bool) (
+	*WriteRange, []BlockPointer, int64, error) {
 	if jServer, err := GetJournalServer(fbo.config); err == nil {
 		jServer.dirtyOpStart(fbo.id())
 		defer jServer.dirtyOpEnd(fbo.id())
@@ -1654,6 +1902,16 @@ func (fbo *folderBlockOps) truncateLocked(
 		return &WriteRange{}, nil, 0, err
 	}
 
+	if checkAppendOnly {
+		de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file)
+		if err != nil {
+			return &WriteRange{}, nil, 0, err
+		}
+		if de.AppendOnly && size != de.Size {
+			return &WriteRange{}, nil, 0, AppendOnlyError{file.tailName()}
+		}
+	}
+
 	// find the block where the file should now end
 	iSize := int64(size) // TODO: deal with overflow
 	ptr, parentBlock, indexInParent, block, nextBlockOff, startOff, err :=
@@ -1675,7 +1933,7 @@ func (fbo *folderBlockOps) truncateLocked(
 		moreNeeded := iSize - currLen
 		latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err :=
 			fbo.writeDataLocked(ctx, lState, kmd, file,
-				make([]byte, moreNeeded, moreNeeded), currLen)
+				make([]byte, moreNeeded, moreNeeded), currLen, writeUnchecked)
 		if err != nil {
 			return &latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err
 		}
@@ -1690,6 +1948,7 @@ func (fbo *folderBlockOps) truncateLocked(
 	if err != nil {
 		return nil, nil, 0, err
 	}
+	fbo.setDirtyEntryTimes(&de)
 
 	oldLen := len(block.Contents)
 	dirtyBcache := fbo.config.DirtyBlockCache()
@@ -1792,12 +2051,13 @@ func (fbo *folderBlockOps) Truncate(
 		return err
 	}
 
+
 	defer func() {
 		fbo.doDeferWrite = false
 	}()
 
 	latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err := fbo.truncateLocked(
-		ctx, lState, kmd, filePath, size)
+		ctx, lState, kmd, filePath, size, true)
 	if err != nil {
 		return err
 	}
@@ -1825,7 +2085,7 @@ func (fbo *folderBlockOps) Truncate(
 				// Truncate the file again.  We know this won't be
 				// deferred, so no need to check the new ptrs.
 				_, _, _, err := fbo.truncateLocked(
-					ctx, lState, kmd, f, size)
+					ctx, lState, kmd, f, size, false)
 				return err
 			})
 		fbo.deferredWaitBytes += newlyDirtiedChildBytes
@@ -1953,7 +2213,7 @@ func ReadyBlock(ctx context.Context, config Config, kmd KeyMetadata,
 		ptr = BlockPointer{
 			ID:      id,
 			KeyGen:  kmd.LatestKeyGeneration(),
-			DataVer: block.DataVersion(),
+			DataVer: readyBlockData.dataVersion(block.DataVersion()),
 			BlockContext: BlockContext{
 				Creator:  uid,
 				RefNonce: ZeroBlockRefNonce,
@@ -2885,6 +3145,15 @@ func (fbo *folderBlockOps) setCachedAttr(
 		fileEntry.Type = realEntry.Type
 	case mtimeAttr:
 		fileEntry.Mtime = realEntry.Mtime
+	case xattrAttr:
+		fileEntry.Xattrs = realEntry.Xattrs
+	case permAttr:
+		fileEntry.Type = realEntry.Type
+		fileEntry.Perm = realEntry.Perm
+	case appendOnlyAttr:
+		fileEntry.AppendOnly = realEntry.AppendOnly
+	case derivedAttr:
+		fileEntry.Derived = realEntry.Derived
 	}
 	fileEntry.Ctime = realEntry.Ctime
 	fbo.deCache[ref] = fileEntry
@@ -9,11 +9,13 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/keybase/backoff"
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfscrypto"
@@ -87,6 +89,10 @@ const (
 	// If there are more than this many new revisions, fast forward
 	// rather than downloading them all.
 	fastForwardRevThresh = 50
+	// The maximum total size of the names and values of an entry's
+	// extended attributes, which are stored in its parent's
+	// directory block.
+	maxXattrBytes = 64 << 10
 )
 
 type fboMutexLevel mutexLevel
@@ -223,10 +229,16 @@ type folderBranchOps struct {
 	bid          BranchID // protected by mdWriterLock
 	bType        branchType
 	observers    *observerList
+	// quotaUsage tracks the user's quota usage, to warn observers
+	// about writes that would exceed it.
+	quotaUsage *quotaUsageCache
 
 	// these locks, when locked concurrently by the same goroutine,
 	// should only be taken in the following order to avoid deadlock:
 	mdWriterLock leveledMutex // taken by any method making MD modifications
+	// batch is the batch of operations being staged by
+	// KBFSOps.RunBatch, if any.  Protected by mdWriterLock.
+	batch *folderBatch
 
 	// protects access to head and latestMergedRevision.
 	headLock leveledRWMutex
@@ -278,6 +290,11 @@ type folderBranchOps struct {
 	// Can be used to turn off notifications for a while (e.g., for testing)
 	updatePauseChan chan (<-chan struct{})
 
+	// Signals the update goroutine to check for a new head right
+	// away, without waiting for a notification (e.g., after the
+	// device wakes up from a long sleep).
+	revalidateHeadChan chan struct{}
+
 	// After a shutdown, this channel will be closed when the register
 	// goroutine completes.
 	updateDoneChan chan struct{}
@@ -299,8 +316,17 @@ type folderBranchOps struct {
 
 	editHistory *TlfEditHistory
 
+	accessLog *accessLogger
+
 	branchChanges kbfssync.RepeatedWaitGroup
 	mdFlushes     kbfssync.RepeatedWaitGroup
+
+	// postWriteHookFiles maps each file that has post-write hooks
+	// running on it to whether they need to run again once they
+	// finish.  Protected by postWriteHookLock.
+	postWriteHookLock  sync.Mutex
+	postWriteHookFiles map[NodeID]bool
+	postWriteHooks     kbfssync.RepeatedWaitGroup
 }
 
 var _ KBFSOps = (*folderBranchOps)(nil)
@@ -339,6 +365,7 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 		bid:          BranchID{},
 		bType:        bType,
 		observers:    observers,
+		quotaUsage:   newQuotaUsageCache(config),
 		status:       newFolderBranchStatusKeeper(config, nodeCache),
 		mdWriterLock: mdWriterLock,
 		headLock:     headLock,
@@ -360,12 +387,15 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 		log:             log,
 		deferLog:        log.CloneWithAddedDepth(1),
 		shutdownChan:    make(chan struct{}),
-		updatePauseChan: make(chan (<-chan struct{})),
-		forceSyncChan:   forceSyncChan,
+		updatePauseChan:    make(chan (<-chan struct{})),
+		revalidateHeadChan: make(chan struct{}, 1),
+		forceSyncChan:      forceSyncChan,
+		postWriteHookFiles: make(map[NodeID]bool),
 	}
 	fbo.cr = NewConflictResolver(config, fbo)
 	fbo.fbm = newFolderBlockManager(config, fb, fbo)
 	fbo.editHistory = NewTlfEditHistory(config, fbo, log)
+	fbo.accessLog = newAccessLogger(fbo, log)
 	if config.DoBackgroundFlushes() {
 		go fbo.backgroundFlusher(secondsBetweenBackgroundFlushes * time.Second)
 	}
@@ -413,6 +443,8 @@ func (fbo *folderBranchOps) Shutdown() error {
 	fbo.cr.Shutdown()
 	fbo.fbm.shutdown()
 	fbo.editHistory.Shutdown()
+	fbo.accessLog.shutdown()
+	fbo.status.shutdown()
 	// Wait for the update goroutine to finish, so that we don't have
 	// any races with logging during test reporting.
 	if fbo.updateDoneChan != nil {
@@ -434,10 +466,21 @@ func (fbo *folderBranchOps) GetFavorites(ctx context.Context) (
 	return nil, errors.New("GetFavorites is not supported by folderBranchOps")
 }
 
+func (fbo *folderBranchOps) GetFavoritesWithMetadata(ctx context.Context) (
+	[]FavoriteWithMetadata, error) {
+	return nil, errors.New(
+		"GetFavoritesWithMetadata is not supported by folderBranchOps")
+}
+
 func (fbo *folderBranchOps) RefreshCachedFavorites(ctx context.Context) {
 	// no-op
 }
 
+func (fbo *folderBranchOps) UserKeysChanged(
+	ctx context.Context, uid keybase1.UID) error {
+	return errors.New("UserKeysChanged is not supported by folderBranchOps")
+}
+
 func (fbo *folderBranchOps) DeleteFavorite(ctx context.Context,
 	fav Favorite) error {
 	return errors.New("DeleteFavorite is not supported by folderBranchOps")
@@ -1023,6 +1066,15 @@ func (fbo *folderBranchOps) getMDForWriteLockedForFilename(
 	ctx context.Context, lState *lockState, filename string) (*RootMetadata, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	if fbo.config.ReadReplicaPollInterval() > 0 {
+		return nil, ReadReplicaError{filename}
+	}
+
+	// All the operations in a batch share one successor MD.
+	if fbo.batch != nil && fbo.batch.md != nil {
+		return fbo.batch.md, nil
+	}
+
 	md, err := fbo.getMDLocked(ctx, lState, mdWrite)
 	if err != nil {
 		return nil, err
@@ -1032,8 +1084,16 @@ func (fbo *folderBranchOps) getMDForWriteLockedForFilename(
 	if err != nil {
 		return nil, err
 	}
-	if !md.GetTlfHandle().IsWriter(uid) {
-		return nil, NewWriteAccessError(md.GetTlfHandle(), username, filename)
+	handle := md.GetTlfHandle()
+	if !handle.IsWriter(uid) {
+		return nil, NewWriteAccessError(handle, username, filename)
+	}
+	if md.IsFinal() {
+		return nil, TlfFinalizedError{
+			Tlf:       handle.GetCanonicalName(),
+			Public:    handle.IsPublic(),
+			Successor: handle.SuccessorHandle().GetCanonicalName(),
+		}
 	}
 
 	// Make a new successor of the current MD to hold the coming
@@ -1044,6 +1104,9 @@ func (fbo *folderBranchOps) getMDForWriteLockedForFilename(
 		return nil, err
 	}
 
+	if fbo.batch != nil {
+		fbo.batch.md = newMd
+	}
 	return newMd, nil
 }
 
@@ -1112,9 +1175,7 @@ func (fbo *folderBranchOps) maybeUnembedAndPutBlocks(ctx context.Context,
 		}
 	}()
 
-	ptrsToDelete, err := doBlockPuts(ctx, fbo.config.BlockServer(),
-		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+	ptrsToDelete, err := fbo.doBlockPuts(ctx, md.ReadOnly(), *bps)
 	if err != nil {
 		return nil, err
 	}
@@ -1176,6 +1237,9 @@ func (fbo *folderBranchOps) initMDLocked(
 	if !handle.IsWriter(uid) {
 		return NewWriteAccessError(handle, username, handle.GetCanonicalPath())
 	}
+	if fbo.config.ReadReplicaPollInterval() > 0 {
+		return ReadReplicaError{handle.GetCanonicalPath()}
+	}
 
 	var expectedKeyGen KeyGen
 	var tlfCryptKey *kbfscrypto.TLFCryptKey
@@ -1268,6 +1332,18 @@ func (fbo *folderBranchOps) GetTLFCryptKeys(ctx context.Context,
 	return nil, tlf.ID{}, errors.New("GetTLFCryptKeys is not supported by folderBranchOps")
 }
 
+func (fbo *folderBranchOps) GetUserQuotaInfo(ctx context.Context) (
+	QuotaUsage, error) {
+	return QuotaUsage{}, errors.New(
+		"GetUserQuotaInfo is not supported by folderBranchOps")
+}
+
+func (fbo *folderBranchOps) GetOpenFolderBranches(ctx context.Context) (
+	[]FolderBranch, error) {
+	return nil, errors.New(
+		"GetOpenFolderBranches is not supported by folderBranchOps")
+}
+
 func (fbo *folderBranchOps) GetTLFID(ctx context.Context, h *TlfHandle) (tlf.ID, error) {
 	return tlf.ID{}, errors.New("GetTLFID is not supported by folderBranchOps")
 }
@@ -1409,6 +1485,11 @@ func (fbo *folderBranchOps) SetInitialHeadToNew(
 
 		fbo.mdWriterLock.Lock(lState)
 		defer fbo.mdWriterLock.Unlock(lState)
+		// Another caller may have initialized the folder while
+		// we were waiting for the lock.
+		if fbo.getHead(lState) != (ImmutableRootMetadata{}) {
+			return nil
+		}
 		return fbo.initMDLocked(ctx, lState, rmd)
 	})
 }
@@ -1548,6 +1629,51 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 	return children, nil
 }
 
+func (fbo *folderBranchOps) GetDirChildrenPaged(ctx context.Context,
+	dir Node, cursor string, limit int) (
+	children []DirChild, nextCursor string, err error) {
+	fbo.log.CDebugf(ctx, "GetDirChildrenPaged %p cursor=%q limit=%d",
+		dir.GetID(), cursor, limit)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "Done GetDirChildrenPaged: %v", err)
+	}()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = runUnlessCanceled(ctx, func() error {
+		var err error
+		lState := makeFBOLockState()
+
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		dirPath, err := fbo.pathFromNodeForRead(dir)
+		if err != nil {
+			return err
+		}
+
+		// See the comment in GetDirChildren.
+		if md.data.Dir.BlockPointer != dirPath.path[0].BlockPointer {
+			fbo.log.CDebugf(ctx, "Returning an empty children set for "+
+				"unlinked directory %v", dirPath.tailPointer())
+			return nil
+		}
+
+		children, nextCursor, err = fbo.blocks.GetDirtyDirChildrenPage(
+			ctx, lState, md.ReadOnly(), dirPath, cursor, limit)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return children, nextCursor, nil
+}
+
 func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 	node Node, ei EntryInfo, err error) {
 	fbo.log.CDebugf(ctx, "Lookup %p %s", dir.GetID(), name)
@@ -1558,6 +1684,14 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 		return nil, EntryInfo{}, err
 	}
 
+	// New entries are stored under normalized names, so try that
+	// form first.
+	lookupName := fbo.normalizedName(name)
+	storedName, err := fbo.storedName(lookupName)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
 	var de DirEntry
 	err = runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
@@ -1572,10 +1706,33 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 			return err
 		}
 
-		childPath := dirPath.ChildPathNoPtr(name)
+		childPath := dirPath.ChildPathNoPtr(storedName)
 
 		de, err = fbo.blocks.GetDirtyEntry(
 			ctx, lState, md.ReadOnly(), childPath)
+		if err == nil && storedName != lookupName &&
+			de.LongName != lookupName {
+			// Some other entry has the short form of this name.
+			err = NoSuchNameError{name}
+		}
+		if _, ok := err.(NoSuchNameError); ok &&
+			fbo.inexactNameMatching() {
+			var children map[string]EntryInfo
+			children, err = fbo.blocks.GetDirtyDirChildren(
+				ctx, lState, md.ReadOnly(), dirPath)
+			if err != nil {
+				return err
+			}
+			match, ok := equivalentNameMatch(
+				children, name, fbo.namesEquivalent)
+			if !ok {
+				return NoSuchNameError{name}
+			}
+			storedName = match
+			childPath = dirPath.ChildPathNoPtr(storedName)
+			de, err = fbo.blocks.GetDirtyEntry(
+				ctx, lState, md.ReadOnly(), childPath)
+		}
 		if err != nil {
 			return err
 		}
@@ -1588,7 +1745,8 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 				return err
 			}
 
-			node, err = fbo.nodeCache.GetOrCreate(de.BlockPointer, name, dir)
+			node, err = fbo.nodeCache.GetOrCreate(
+				de.BlockPointer, storedName, dir)
 			if err != nil {
 				return err
 			}
@@ -1729,6 +1887,56 @@ func (bps *blockPutState) DeepCopy() *blockPutState {
 	return newBps
 }
 
+// warnIfOverQuota tells any QuotaObservers if putting the given
+// blocks would exceed the user's quota, and returns the number of
+// new bytes they would use.
+func (fbo *folderBranchOps) warnIfOverQuota(
+	ctx context.Context, bps blockPutState) int64 {
+	var bytes int64
+	for _, bs := range bps.blockStates {
+		// Blocks put as new references are already paid for.
+		if bs.blockPtr.RefNonce == ZeroBlockRefNonce {
+			bytes += int64(bs.readyBlockData.GetEncodedSize())
+		}
+	}
+	if bytes == 0 {
+		return 0
+	}
+	usage, err := fbo.quotaUsage.get(ctx)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't get quota usage: %+v", err)
+		return bytes
+	}
+	if usage.UsedBytes+bytes > usage.LimitBytes {
+		fbo.log.CDebugf(ctx, "Putting %d bytes will exceed quota: %+v",
+			bytes, usage)
+		fbo.observers.quotaWarning(ctx, QuotaWarning{usage, bytes})
+	}
+	return bytes
+}
+
+// doBlockPuts puts the given blocks for md, like the doBlockPuts
+// function, after warning observers if they'd exceed the user's
+// quota.
+func (fbo *folderBranchOps) doBlockPuts(ctx context.Context,
+	md ReadOnlyRootMetadata, bps blockPutState) ([]BlockPointer, error) {
+	bytes := fbo.warnIfOverQuota(ctx, bps)
+	blocksToRemove, err := doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, md.TlfID(),
+		md.GetTlfHandle().GetCanonicalName(), bps,
+		maxParallelBlockPutsForConfig(fbo.config))
+	if qe, ok := err.(BServerErrorOverQuota); ok {
+		// The server's numbers are better than ours.
+		fbo.quotaUsage.set(QuotaUsage{
+			LimitBytes: qe.Limit,
+			UsedBytes:  qe.Usage,
+		})
+	} else if err == nil {
+		fbo.quotaUsage.addUsedBytes(bytes)
+	}
+	return blocksToRemove, err
+}
+
 func (fbo *folderBranchOps) readyBlockMultiple(ctx context.Context,
 	kmd KeyMetadata, currBlock Block, uid keybase1.UID,
 	bps *blockPutState) (info BlockInfo, plainSize int, err error) {
@@ -1742,6 +1950,227 @@ func (fbo *folderBranchOps) readyBlockMultiple(ctx context.Context,
 	return
 }
 
+// readyDirLeaves readies the leaf blocks for the (direct or
+// assembled) directory block dblock, which is too big to be stored
+// in one block, and returns the pointers to them, in name order.
+// The entries are split up by the existing leaves of an assembled
+// block, and only the leaves whose entries changed get new blocks,
+// which are split up again if they've grown too big.
+func (fbo *folderBranchOps) readyDirLeaves(ctx context.Context,
+	lState *lockState, md *RootMetadata, dblock *DirBlock,
+	uid keybase1.UID, bps *blockPutState) ([]IndirectDirPtr, error) {
+	names := make([]string, 0, len(dblock.Children))
+	for name := range dblock.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Group the names by the leaf that holds them.
+	oldLeaves := dblock.IPtrs
+	if !dblock.IsInd {
+		oldLeaves = []IndirectDirPtr{{}}
+	}
+	groups := make([][]string, len(oldLeaves))
+	g := 0
+	for _, name := range names {
+		for g+1 < len(oldLeaves) && oldLeaves[g+1].Off <= name {
+			g++
+		}
+		groups[g] = append(groups[g], name)
+	}
+
+	maxBytes := fbo.config.MaxDirBlockBytes()
+	var leaves []IndirectDirPtr
+	for i, group := range groups {
+		old := oldLeaves[i]
+		if old.IsInitialized() {
+			if len(group) > 0 {
+				oldLeaf, err := fbo.blocks.GetDirBlockForReading(
+					ctx, lState, md.ReadOnly(), old.BlockPointer,
+					fbo.branch(), path{})
+				if err != nil {
+					return nil, err
+				}
+				if dirLeafUnchanged(oldLeaf, dblock, group) {
+					leaves = append(leaves, old)
+					continue
+				}
+			}
+			md.AddUnrefBlock(old.BlockInfo)
+		}
+
+		// Fill new leaves with the group's entries, in order.
+		var leaf *DirBlock
+		var leafOff string
+		var leafBytes uint64
+		readyLeaf := func() error {
+			info, _, err := fbo.readyBlockMultiple(
+				ctx, md.ReadOnly(), leaf, uid, bps)
+			if err != nil {
+				return err
+			}
+			md.AddRefBlock(info)
+			leaves = append(leaves, IndirectDirPtr{
+				BlockInfo: info,
+				Off:       leafOff,
+			})
+			return nil
+		}
+		for _, name := range group {
+			de := dblock.Children[name]
+			size := estimateDirEntrySize(name, de)
+			if leaf != nil && leafBytes+size > maxBytes {
+				if err := readyLeaf(); err != nil {
+					return nil, err
+				}
+				leaf = nil
+			}
+			if leaf == nil {
+				leaf = NewDirBlock().(*DirBlock)
+				leafOff = name
+				leafBytes = 0
+			}
+			leaf.Children[name] = de
+			leafBytes += size
+		}
+		if leaf != nil {
+			if err := readyLeaf(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(leaves) > 0 {
+		leaves[0].Off = ""
+	}
+	return leaves, nil
+}
+
+// readyDirBlock readies the directory block dblock, and returns the
+// info of the block to point to it by, along with the directory's
+// size.  A directory whose entries are too big for one block (see
+// Config.MaxDirBlockBytes) is stored as a tree of blocks (see
+// indirect_dir.go), whose pointers carry IndirectDirsDataVer; in
+// that case, dblock is updated in place to the assembled form of the
+// new tree, and the returned size is the estimated size of its
+// entries.
+func (fbo *folderBranchOps) readyDirBlock(ctx context.Context,
+	lState *lockState, md *RootMetadata, dblock *DirBlock,
+	uid keybase1.UID, bps *blockPutState) (BlockInfo, uint64, error) {
+	maxBytes := fbo.config.MaxDirBlockBytes()
+	size := estimateDirSize(dblock)
+
+	// Only go back to a direct block once the entries fit
+	// comfortably, so a directory near the limit doesn't flip back
+	// and forth.
+	if (!dblock.IsInd && size <= maxBytes) ||
+		(dblock.IsInd && size <= maxBytes/2) {
+		if dblock.IsInd {
+			for _, iptr := range dblock.IPtrs {
+				md.AddUnrefBlock(iptr.BlockInfo)
+			}
+			for _, info := range dblock.innerPtrs {
+				md.AddUnrefBlock(info)
+			}
+			dblock.IsInd = false
+			dblock.IPtrs = nil
+			dblock.assembled = false
+			dblock.innerPtrs = nil
+		}
+		info, plainSize, err := fbo.readyBlockMultiple(
+			ctx, md.ReadOnly(), dblock, uid, bps)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		return info, uint64(plainSize), nil
+	}
+
+	leaves, err := fbo.readyDirLeaves(ctx, lState, md, dblock, uid, bps)
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+
+	// The blocks between the top block and the leaves change
+	// whenever any leaf does, so just make them all again.
+	for _, info := range dblock.innerPtrs {
+		md.AddUnrefBlock(info)
+	}
+	var innerPtrs []BlockInfo
+	level := leaves
+	for {
+		var levelBytes uint64
+		for _, iptr := range level {
+			levelBytes += uint64(indirectDirPtrSizeEstimate + len(iptr.Off))
+		}
+		if levelBytes <= maxBytes {
+			break
+		}
+		var nextLevel []IndirectDirPtr
+		var inner *DirBlock
+		var innerBytes uint64
+		readyInner := func() error {
+			info, _, err := fbo.readyBlockMultiple(
+				ctx, md.ReadOnly(), inner, uid, bps)
+			if err != nil {
+				return err
+			}
+			md.AddRefBlock(info)
+			innerPtrs = append(innerPtrs, info)
+			nextLevel = append(nextLevel, IndirectDirPtr{
+				BlockInfo: info,
+				Off:       inner.IPtrs[0].Off,
+			})
+			return nil
+		}
+		for _, iptr := range level {
+			ptrBytes := uint64(indirectDirPtrSizeEstimate + len(iptr.Off))
+			// Every inner block gets at least two pointers, so
+			// the tree always gets shallower.
+			if inner != nil && len(inner.IPtrs) > 1 &&
+				innerBytes+ptrBytes > maxBytes {
+				if err := readyInner(); err != nil {
+					return BlockInfo{}, 0, err
+				}
+				inner = nil
+			}
+			if inner == nil {
+				inner = &DirBlock{
+					CommonBlock: CommonBlock{IsInd: true},
+					Children:    make(map[string]DirEntry),
+				}
+				innerBytes = 0
+			}
+			inner.IPtrs = append(inner.IPtrs, iptr)
+			innerBytes += ptrBytes
+		}
+		if err := readyInner(); err != nil {
+			return BlockInfo{}, 0, err
+		}
+		level = nextLevel
+	}
+
+	top := &DirBlock{
+		CommonBlock: CommonBlock{IsInd: true},
+		Children:    make(map[string]DirEntry),
+		IPtrs:       level,
+	}
+	info, _, readyBlockData, err := ReadyBlock(
+		ctx, fbo.config, md.ReadOnly(), top, uid)
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+
+	// Only the top block itself goes in the clean cache, so that
+	// lookups just fetch the leaves they need; dblock becomes the
+	// assembled form of the new tree, for any later syncs in this
+	// operation.
+	dblock.IsInd = true
+	dblock.IPtrs = leaves
+	dblock.assembled = true
+	dblock.innerPtrs = innerPtrs
+	bps.addNewBlock(info.BlockPointer, top, readyBlockData, nil)
+	return info, size, nil
+}
+
 func (fbo *folderBranchOps) unembedBlockChanges(
 	ctx context.Context, bps *blockPutState, md *RootMetadata,
 	changes *BlockChanges, uid keybase1.UID) error {
@@ -1811,6 +2240,17 @@ func (fbo *folderBranchOps) unembedBlockChanges(
 
 type localBcache map[BlockPointer]*DirBlock
 
+// dirBlockStats returns the number of entries in dblock, which must
+// be direct or assembled, and the total size of everything under it.
+// Since every sync of an entry also syncs its parent, each directory
+// only needs to look at its own children.
+func dirBlockStats(dblock *DirBlock) (childCount, recursiveSize uint64) {
+	for _, de := range dblock.Children {
+		recursiveSize += de.Size + de.RecursiveSize
+	}
+	return uint64(len(dblock.Children)), recursiveSize
+}
+
 // syncBlock updates, and readies, the blocks along the path for the
 // given write, up to the root of the tree or stopAt (if specified).
 // When it updates the root of the tree, it also modifies the given
@@ -1850,8 +2290,19 @@ func (fbo *folderBranchOps) syncBlock(
 	doSetTime := true
 	now := fbo.nowUnixNano()
 	for len(newPath.path) < len(dir.path)+1 {
-		info, plainSize, err := fbo.readyBlockMultiple(
-			ctx, md.ReadOnly(), currBlock, uid, bps)
+		var info BlockInfo
+		var size, childCount, recursiveSize uint64
+		var err error
+		if dblock, ok := currBlock.(*DirBlock); ok {
+			childCount, recursiveSize = dirBlockStats(dblock)
+			info, size, err = fbo.readyDirBlock(
+				ctx, lState, md, dblock, uid, bps)
+		} else {
+			var plainSize int
+			info, plainSize, err = fbo.readyBlockMultiple(
+				ctx, md.ReadOnly(), currBlock, uid, bps)
+			size = uint64(plainSize)
+		}
 		if err != nil {
 			return path{}, DirEntry{}, nil, err
 		}
@@ -1896,11 +2347,14 @@ func (fbo *folderBranchOps) syncBlock(
 
 			// modify the direntry for currName; make one
 			// if it doesn't exist (which should only
-			// happen the first time around).
+			// happen the first time around).  A new
+			// entry may already be seeded with its long
+			// name, but without a block.
 			//
 			// TODO: Pull the creation out of here and
 			// into createEntryLocked().
-			if de, ok = prevDblock.Children[currName]; !ok {
+			if de, ok = prevDblock.Children[currName]; !ok ||
+				!de.IsInitialized() {
 				// If this isn't the first time
 				// around, we have an error.
 				if len(newPath.path) > 1 {
@@ -1914,8 +2368,9 @@ func (fbo *folderBranchOps) syncBlock(
 				// new directory entry when doSetTime is true.
 				de = DirEntry{
 					EntryInfo: EntryInfo{
-						Type: entryType,
-						Size: 0,
+						Type:     entryType,
+						Size:     0,
+						LongName: de.LongName,
 					},
 				}
 				// If we're creating a new directory entry, the
@@ -1928,15 +2383,15 @@ func (fbo *folderBranchOps) syncBlock(
 		}
 
 		if de.Type == Dir {
-			// TODO: When we use indirect dir blocks,
-			// we'll have to calculate the size some other
-			// way.
-			de.Size = uint64(plainSize)
+			de.Size = size
+			de.ChildCount = childCount
+			de.RecursiveSize = recursiveSize
 		}
 
 		if prevIdx < 0 {
 			md.AddUpdate(md.data.Dir.BlockInfo, info)
-		} else if prevDe, ok := prevDblock.Children[currName]; ok {
+		} else if prevDe, ok := prevDblock.Children[currName]; ok &&
+			prevDe.IsInitialized() {
 			md.AddUpdate(prevDe.BlockInfo, info)
 		} else {
 			// this is a new block
@@ -2030,8 +2485,9 @@ func (fbo *folderBranchOps) syncBlockAndCheckEmbedLocked(ctx context.Context,
 	}
 
 	// Do the block changes need their own blocks?  Unembed only if
-	// this is the final call to this function with this MD.
-	if stopAt == zeroPtr {
+	// this is the final call to this function with this MD.  A
+	// batch keeps adding to its MD, so it unembeds when it commits.
+	if stopAt == zeroPtr && fbo.batch == nil {
 		bsplit := fbo.config.BlockSplitter()
 		if !bsplit.ShouldEmbedBlockChanges(&md.data.Changes) {
 			err = fbo.unembedBlockChanges(ctx, bps, md, &md.data.Changes,
@@ -2067,6 +2523,7 @@ func (fbo *folderBranchOps) finalizeBlocks(bps *blockPutState) error {
 		return nil
 	}
 	bcache := fbo.config.BlockCache()
+	lowMemory := fbo.config.LowMemoryMode()
 	for _, blockState := range bps.blockStates {
 		newPtr := blockState.blockPtr
 		// only cache this block if we made a brand new block, not if
@@ -2074,6 +2531,11 @@ func (fbo *folderBranchOps) finalizeBlocks(bps *blockPutState) error {
 		if !newPtr.IsFirstRef() {
 			continue
 		}
+		// In low-memory mode, let go of synced file data right
+		// away; it can be fetched again if it's read.
+		if _, isFile := blockState.block.(*FileBlock); isFile && lowMemory {
+			continue
+		}
 		if err := bcache.Put(newPtr, fbo.id(), blockState.block,
 			TransientEntry); err != nil {
 			return err
@@ -2102,6 +2564,10 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 	lState *lockState, md *RootMetadata, bps *blockPutState, excl Excl) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	if fbo.batch != nil && !fbo.batch.committing {
+		return fbo.stageBatchOpsLocked(ctx, lState, md, bps)
+	}
+
 	// finally, write out the new metadata
 	mdops := fbo.config.MDOps()
 
@@ -2230,6 +2696,12 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 		fbo.fbm.archiveUnrefBlocks(irmd.ReadOnly())
 	}
 
+	if fbo.batch != nil {
+		// The batched ops were already announced as they were
+		// staged.
+		fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{irmd})
+		return nil
+	}
 	fbo.notifyBatchLocked(ctx, lState, irmd)
 	return nil
 }
@@ -2401,11 +2873,12 @@ func (fbo *folderBranchOps) finalizeGCOp(ctx context.Context, gco *GCOp) (
 func (fbo *folderBranchOps) syncBlockAndFinalizeLocked(ctx context.Context,
 	lState *lockState, md *RootMetadata, newBlock Block, dir path,
 	name string, entryType EntryType, mtime bool, ctime bool,
-	stopAt BlockPointer, excl Excl) (de DirEntry, err error) {
+	stopAt BlockPointer, excl Excl, lbc localBcache) (
+	de DirEntry, err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 	_, de, bps, err := fbo.syncBlockAndCheckEmbedLocked(
 		ctx, lState, md, newBlock, dir, name, entryType, mtime,
-		ctime, zeroPtr, nil)
+		ctime, zeroPtr, lbc)
 	if err != nil {
 		return DirEntry{}, err
 	}
@@ -2417,9 +2890,7 @@ func (fbo *folderBranchOps) syncBlockAndFinalizeLocked(ctx context.Context,
 		}
 	}()
 
-	_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
-		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+	_, err = fbo.doBlockPuts(ctx, md.ReadOnly(), *bps)
 	if err != nil {
 		return DirEntry{}, err
 	}
@@ -2488,15 +2959,12 @@ func (fbo *folderBranchOps) createEntryLocked(
 	entryType EntryType, excl Excl) (Node, DirEntry, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	if err := checkDisallowedPrefixes(name); err != nil {
+	name = fbo.normalizedName(name)
+	storedName, err := fbo.storedName(name)
+	if err != nil {
 		return nil, DirEntry{}, err
 	}
 
-	if uint32(len(name)) > fbo.config.MaxNameBytes() {
-		return nil, DirEntry{},
-			NameTooLongError{name, fbo.config.MaxNameBytes()}
-	}
-
 	filename, err := fbo.canonicalPath(ctx, dir, name)
 	if err != nil {
 		return nil, DirEntry{}, err
@@ -2520,16 +2988,19 @@ func (fbo *folderBranchOps) createEntryLocked(
 	}
 
 	// does name already exist?
-	if _, ok := dblock.Children[name]; ok {
+	if _, ok := dblock.Children[storedName]; ok {
 		return nil, DirEntry{}, NameExistsError{name}
 	}
+	if err := fbo.checkEquivalentNameConflict(ctx, dblock, name); err != nil {
+		return nil, DirEntry{}, err
+	}
 
 	if err := fbo.checkNewDirSize(
-		ctx, lState, md.ReadOnly(), dirPath, name); err != nil {
+		ctx, lState, md.ReadOnly(), dirPath, storedName); err != nil {
 		return nil, DirEntry{}, err
 	}
 
-	co, err := newCreateOp(name, dirPath.tailPointer(), entryType)
+	co, err := newCreateOp(storedName, dirPath.tailPointer(), entryType)
 	if err != nil {
 		return nil, DirEntry{}, err
 	}
@@ -2546,13 +3017,26 @@ func (fbo *folderBranchOps) createEntryLocked(
 		newBlock = &FileBlock{}
 	}
 
+	var lbc localBcache
+	if storedName != name {
+		// Seed the new entry with its full name; syncBlock will
+		// fill in the rest.
+		dblock.Children[storedName] = DirEntry{
+			EntryInfo: EntryInfo{
+				Type:     entryType,
+				LongName: name,
+			},
+		}
+		lbc = localBcache{dirPath.tailPointer(): dblock}
+	}
+
 	de, err := fbo.syncBlockAndFinalizeLocked(
-		ctx, lState, md, newBlock, dirPath, name, entryType,
-		true, true, zeroPtr, excl)
+		ctx, lState, md, newBlock, dirPath, storedName, entryType,
+		true, true, zeroPtr, excl, lbc)
 	if err != nil {
 		return nil, DirEntry{}, err
 	}
-	node, err := fbo.nodeCache.GetOrCreate(de.BlockPointer, name, dir)
+	node, err := fbo.nodeCache.GetOrCreate(de.BlockPointer, storedName, dir)
 	if err != nil {
 		return nil, DirEntry{}, err
 	}
@@ -2647,9 +3131,21 @@ func (fbo *folderBranchOps) CreateDir(
 		return nil, EntryInfo{}, err
 	}
 
+	if err := checkDisallowedPrefixes(path); err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	return fbo.createDir(ctx, dir, path)
+}
+
+// createDir creates a directory without checking its name against
+// disallowedPrefixes, so that KBFS itself can make directories like
+// AccessLogDirName.
+func (fbo *folderBranchOps) createDir(
+	ctx context.Context, dir Node, path string) (Node, EntryInfo, error) {
 	var retNode Node
 	var retEntryInfo EntryInfo
-	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+	err := fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
 			node, de, err :=
 				fbo.createEntryLocked(ctx, lState, dir, path, Dir, NoExcl)
@@ -2683,6 +3179,10 @@ func (fbo *folderBranchOps) CreateFile(
 		return nil, EntryInfo{}, err
 	}
 
+	if err := checkDisallowedPrefixes(path); err != nil {
+		return nil, EntryInfo{}, err
+	}
+
 	var entryType EntryType
 	if isExec {
 		entryType = Exec
@@ -2723,16 +3223,17 @@ func (fbo *folderBranchOps) CreateFile(
 
 func (fbo *folderBranchOps) createLinkLocked(
 	ctx context.Context, lState *lockState, dir Node, fromName string,
-	toPath string) (DirEntry, error) {
+	toPath string, special SpecialFileType) (DirEntry, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	if err := checkDisallowedPrefixes(fromName); err != nil {
 		return DirEntry{}, err
 	}
 
-	if uint32(len(fromName)) > fbo.config.MaxNameBytes() {
-		return DirEntry{},
-			NameTooLongError{fromName, fbo.config.MaxNameBytes()}
+	fromName = fbo.normalizedName(fromName)
+	storedName, err := fbo.storedName(fromName)
+	if err != nil {
+		return DirEntry{}, err
 	}
 
 	// verify we have permission to write
@@ -2755,16 +3256,19 @@ func (fbo *folderBranchOps) createLinkLocked(
 	// TODO: validate inputs
 
 	// does name already exist?
-	if _, ok := dblock.Children[fromName]; ok {
+	if _, ok := dblock.Children[storedName]; ok {
 		return DirEntry{}, NameExistsError{fromName}
 	}
+	if err := fbo.checkEquivalentNameConflict(ctx, dblock, fromName); err != nil {
+		return DirEntry{}, err
+	}
 
 	if err := fbo.checkNewDirSize(ctx, lState, md.ReadOnly(),
-		dirPath, fromName); err != nil {
+		dirPath, storedName); err != nil {
 		return DirEntry{}, err
 	}
 
-	co, err := newCreateOp(fromName, dirPath.tailPointer(), Sym)
+	co, err := newCreateOp(storedName, dirPath.tailPointer(), Sym)
 	if err != nil {
 		return DirEntry{}, err
 	}
@@ -2772,23 +3276,25 @@ func (fbo *folderBranchOps) createLinkLocked(
 
 	// Create a direntry for the link, and then sync
 	now := fbo.nowUnixNano()
-	dblock.Children[fromName] = DirEntry{
+	dblock.Children[storedName] = DirEntry{
 		EntryInfo: EntryInfo{
-			Type:    Sym,
-			Size:    uint64(len(toPath)),
-			SymPath: toPath,
-			Mtime:   now,
-			Ctime:   now,
+			Type:     Sym,
+			Size:     uint64(len(toPath)),
+			SymPath:  toPath,
+			Mtime:    now,
+			Ctime:    now,
+			LongName: longNameFor(fromName, storedName),
+			Special:  special,
 		},
 	}
 
 	_, err = fbo.syncBlockAndFinalizeLocked(
 		ctx, lState, md, dblock, *dirPath.parentPath(),
-		dirPath.tailName(), Dir, true, true, zeroPtr, NoExcl)
+		dirPath.tailName(), Dir, true, true, zeroPtr, NoExcl, nil)
 	if err != nil {
 		return DirEntry{}, err
 	}
-	return dblock.Children[fromName], nil
+	return dblock.Children[storedName], nil
 }
 
 func (fbo *folderBranchOps) CreateLink(
@@ -2808,7 +3314,41 @@ func (fbo *folderBranchOps) CreateLink(
 		func(lState *lockState) error {
 			// Don't set ei directly, as that can cause a race when
 			// the Create is canceled.
-			de, err := fbo.createLinkLocked(ctx, lState, dir, fromName, toPath)
+			de, err := fbo.createLinkLocked(
+				ctx, lState, dir, fromName, toPath, NotSpecial)
+			retEntryInfo = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	return retEntryInfo, nil
+}
+
+func (fbo *folderBranchOps) CreateSpecialFile(
+	ctx context.Context, dir Node, name string, special SpecialFileType) (
+	ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CreateSpecialFile %p %s %s",
+		dir.GetID(), name, special)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+
+	if special != Fifo && special != Socket {
+		return EntryInfo{}, fmt.Errorf(
+			"Invalid special file type %s", special)
+	}
+
+	var retEntryInfo EntryInfo
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// Don't set ei directly, as that can cause a race when
+			// the Create is canceled.
+			de, err := fbo.createLinkLocked(
+				ctx, lState, dir, name, special.symPath(), special)
 			retEntryInfo = de.EntryInfo
 			return err
 		})
@@ -2880,7 +3420,7 @@ func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
 	// sync the parent directory
 	_, err = fbo.syncBlockAndFinalizeLocked(
 		ctx, lState, md, pblock, *dir.parentPath(), dir.tailName(),
-		Dir, true, true, zeroPtr, NoExcl)
+		Dir, true, true, zeroPtr, NoExcl, nil)
 	if err != nil {
 		return err
 	}
@@ -2937,9 +3477,14 @@ func (fbo *folderBranchOps) RemoveDir(
 		return
 	}
 
+	storedName, err := fbo.storedName(dirName)
+	if err != nil {
+		return err
+	}
+
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			return fbo.removeDirLocked(ctx, lState, dir, dirName)
+			return fbo.removeDirLocked(ctx, lState, dir, storedName)
 		})
 }
 
@@ -2953,6 +3498,11 @@ func (fbo *folderBranchOps) RemoveEntry(ctx context.Context, dir Node,
 		return err
 	}
 
+	storedName, err := fbo.storedName(name)
+	if err != nil {
+		return err
+	}
+
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
 			// verify we have permission to write
@@ -2966,56 +3516,282 @@ func (fbo *folderBranchOps) RemoveEntry(ctx context.Context, dir Node,
 				return err
 			}
 
-			return fbo.removeEntryLocked(ctx, lState, md, dirPath, name)
+			return fbo.removeEntryLocked(
+				ctx, lState, md, dirPath, storedName)
 		})
 }
 
-func (fbo *folderBranchOps) renameLocked(
-	ctx context.Context, lState *lockState, oldParent path,
-	oldName string, newParent path, newName string) (err error) {
-	fbo.mdWriterLock.AssertLocked(lState)
+// RemoveEntryIfUnchanged implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) RemoveEntryIfUnchanged(ctx context.Context,
+	dir Node, name string, node Node) (err error) {
+	fbo.log.CDebugf(ctx, "RemoveEntryIfUnchanged %p %s %p",
+		dir.GetID(), name, node.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	// verify we have permission to write
-	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	err = fbo.checkNode(dir)
 	if err != nil {
 		return err
 	}
 
-	oldPBlock, newPBlock, newDe, lbc, err := fbo.blocks.PrepRename(
-		ctx, lState, md, oldParent, oldName, newParent, newName)
-
+	storedName, err := fbo.storedName(name)
 	if err != nil {
 		return err
 	}
 
-	// does name exist?
-	if de, ok := newPBlock.Children[newName]; ok {
-		// Usually higher-level programs check these, but just in case.
-		if de.Type == Dir && newDe.Type != Dir {
-			return NotDirError{newParent.ChildPathNoPtr(newName)}
-		} else if de.Type != Dir && newDe.Type == Dir {
-			return NotFileError{newParent.ChildPathNoPtr(newName)}
-		}
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// verify we have permission to write
+			md, err := fbo.getMDForWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
 
-		if de.Type == Dir {
-			// The directory must be empty.
-			oldTargetDir, err := fbo.blocks.GetDirBlockForReading(ctx, lState,
-				md.ReadOnly(), de.BlockPointer, newParent.Branch,
-				newParent.ChildPathNoPtr(newName))
+			dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
 			if err != nil {
 				return err
 			}
-			if len(oldTargetDir.Children) != 0 {
-				fbo.log.CWarningf(ctx, "Renaming over a non-empty directory "+
-					" (%s/%s) not allowed.", newParent, newName)
-				return DirNotEmptyError{newName}
+
+			// Check the entry under the writer lock, so that
+			// nothing can replace it before it's removed.
+			pblock, err := fbo.blocks.GetDir(
+				ctx, lState, md.ReadOnly(), dirPath, blockRead)
+			if err != nil {
+				return err
+			}
+			de, ok := pblock.Children[storedName]
+			if !ok {
+				return NoSuchNameError{name}
+			}
+			curr := fbo.nodeCache.Get(de.BlockPointer.Ref())
+			if curr == nil || curr.GetID() != node.GetID() {
+				return EntryReplacedError{name}
 			}
-		}
 
-		// Delete the old block pointed to by this direntry.
-		err := fbo.unrefEntry(ctx, lState, md, newParent, de, newName)
+			return fbo.removeEntryLocked(
+				ctx, lState, md, dirPath, storedName)
+		})
+}
+
+// dirBlockSizesForPath returns the encoded sizes of the directory
+// blocks along the given path, from the root down.
+func (fbo *folderBranchOps) dirBlockSizesForPath(ctx context.Context,
+	lState *lockState, md ImmutableRootMetadata, dir path) (
+	[]uint64, error) {
+	sizes := make([]uint64, len(dir.path))
+	sizes[0] = uint64(md.data.Dir.EncodedSize)
+	for i := 1; i < len(dir.path); i++ {
+		p := path{FolderBranch: dir.FolderBranch, path: dir.path[:i+1]}
+		de, err := fbo.blocks.GetDirtyEntry(ctx, lState, md.ReadOnly(), p)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		sizes[i] = uint64(de.EncodedSize)
+	}
+	return sizes, nil
+}
+
+func (fbo *folderBranchOps) EstimateCopy(ctx context.Context, dir Node,
+	entries []DryRunEntry) (est CostEstimate, err error) {
+	fbo.log.CDebugf(ctx, "EstimateCopy %p (%d entries)",
+		dir.GetID(), len(entries))
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %s %v", est, err) }()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return CostEstimate{}, err
+	}
+
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		dirPath, err := fbo.pathFromNodeForRead(dir)
+		if err != nil {
+			return err
+		}
+
+		children, err := fbo.blocks.GetDirtyDirChildren(
+			ctx, lState, md.ReadOnly(), dirPath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if _, ok := children[entry.Name]; ok {
+				return NameExistsError{entry.Name}
+			}
+		}
+
+		dirSizes, err := fbo.dirBlockSizesForPath(ctx, lState, md, dirPath)
+		if err != nil {
+			return err
+		}
+
+		_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+		if err != nil {
+			return err
+		}
+		return newCostEstimator(fbo.config, uid).addCopy(
+			&est, dirSizes, entries)
+	})
+	if err != nil {
+		return CostEstimate{}, err
+	}
+	return est, nil
+}
+
+// addRemoveCost adds to est the cost of recursively removing the
+// given entry from dir, whose directory blocks along the path have
+// the given encoded sizes.  Each removal is its own MD revision, with
+// the children of a directory removed before the directory itself.
+func (fbo *folderBranchOps) addRemoveCost(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, est *CostEstimate, dir path,
+	dirSizes []uint64, name string, de DirEntry) error {
+	childPath := dir.ChildPath(name, de.BlockPointer)
+	switch de.Type {
+	case Dir:
+		dblock, err := fbo.blocks.GetDir(
+			ctx, lState, kmd, childPath, blockRead)
+		if err != nil {
+			return err
+		}
+		childSizes := make([]uint64, len(dirSizes), len(dirSizes)+1)
+		copy(childSizes, dirSizes)
+		childSizes = append(childSizes, uint64(de.EncodedSize))
+		for childName, childDe := range dblock.Children {
+			err := fbo.addRemoveCost(ctx, lState, kmd, est, childPath,
+				childSizes, childName, childDe)
+			if err != nil {
+				return err
+			}
+		}
+	case File, Exec:
+		blockInfos, err := fbo.blocks.GetIndirectFileBlockInfos(
+			ctx, lState, kmd, childPath)
+		if isRecoverableBlockErrorForRemoval(err) {
+			fbo.log.CDebugf(ctx, "Recoverable block error encountered "+
+				"while estimating removal of %v; continuing: %v",
+				childPath, err)
+		} else if err != nil {
+			return err
+		}
+		for _, blockInfo := range blockInfos {
+			est.addUnref(uint64(blockInfo.EncodedSize))
+		}
+	}
+
+	est.addRevision(dirSizes)
+	// Symlinks don't have a block of their own.
+	if de.BlockPointer.IsValid() {
+		est.addUnref(uint64(de.EncodedSize))
+	}
+	return nil
+}
+
+func (fbo *folderBranchOps) EstimateRemove(ctx context.Context, dir Node,
+	name string) (est CostEstimate, err error) {
+	fbo.log.CDebugf(ctx, "EstimateRemove %p %s", dir.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %s %v", est, err) }()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return CostEstimate{}, err
+	}
+
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		dirPath, err := fbo.pathFromNodeForRead(dir)
+		if err != nil {
+			return err
+		}
+
+		de, err := fbo.blocks.GetDirtyEntry(
+			ctx, lState, md.ReadOnly(), dirPath.ChildPathNoPtr(name))
+		if err != nil {
+			return err
+		}
+
+		dirSizes, err := fbo.dirBlockSizesForPath(ctx, lState, md, dirPath)
+		if err != nil {
+			return err
+		}
+
+		return fbo.addRemoveCost(ctx, lState, md.ReadOnly(), &est,
+			dirPath, dirSizes, name, de)
+	})
+	if err != nil {
+		return CostEstimate{}, err
+	}
+	return est, nil
+}
+
+func (fbo *folderBranchOps) renameLocked(
+	ctx context.Context, lState *lockState, oldParent path,
+	oldName string, newParent path, newName string) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// From here on, use the names that the entries are stored
+	// under.
+	newLongName := fbo.normalizedName(newName)
+	if oldName, err = fbo.storedName(oldName); err != nil {
+		return err
+	}
+	if newName, err = fbo.storedName(newLongName); err != nil {
+		return err
+	}
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	oldPBlock, newPBlock, newDe, lbc, err := fbo.blocks.PrepRename(
+		ctx, lState, md, oldParent, oldName, newParent, newName)
+
+	if err != nil {
+		return err
+	}
+	newDe.LongName = longNameFor(newLongName, newName)
+
+	// does name exist?
+	if de, ok := newPBlock.Children[newName]; ok {
+		// Usually higher-level programs check these, but just in case.
+		if de.Type == Dir && newDe.Type != Dir {
+			return NotDirError{newParent.ChildPathNoPtr(newName)}
+		} else if de.Type != Dir && newDe.Type == Dir {
+			return NotFileError{newParent.ChildPathNoPtr(newName)}
+		}
+
+		if de.Type == Dir {
+			// The directory must be empty.
+			oldTargetDir, err := fbo.blocks.GetDirBlockForReading(ctx, lState,
+				md.ReadOnly(), de.BlockPointer, newParent.Branch,
+				newParent.ChildPathNoPtr(newName))
+			if err != nil {
+				return err
+			}
+			if len(oldTargetDir.Children) != 0 {
+				fbo.log.CWarningf(ctx, "Renaming over a non-empty directory "+
+					" (%s/%s) not allowed.", newParent, newName)
+				return DirNotEmptyError{newName}
+			}
+		}
+
+		// Delete the old block pointed to by this direntry.
+		err := fbo.unrefEntry(ctx, lState, md, newParent, de, newName)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -3103,9 +3879,7 @@ func (fbo *folderBranchOps) renameLocked(
 		}
 	}()
 
-	_, err = doBlockPuts(ctx, fbo.config.BlockServer(), fbo.config.BlockCache(),
-		fbo.config.Reporter(), fbo.log, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *newBps)
+	_, err = fbo.doBlockPuts(ctx, md.ReadOnly(), *newBps)
 	if err != nil {
 		return err
 	}
@@ -3205,6 +3979,7 @@ func (fbo *folderBranchOps) Read(
 	if err != nil {
 		return 0, err
 	}
+	fbo.accessLog.recordRead(filePath)
 	return bytesRead, nil
 }
 
@@ -3218,6 +3993,13 @@ func (fbo *folderBranchOps) Write(
 		return err
 	}
 
+	// Apply backpressure (or fail) if the journal is full, rather
+	// than buffering more dirty data that can't be synced.
+	err = waitForTLFJournalSpace(ctx, fbo.config, fbo.id())
+	if err != nil {
+		return err
+	}
+
 	return runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
 
@@ -3240,6 +4022,48 @@ func (fbo *folderBranchOps) Write(
 	})
 }
 
+func (fbo *folderBranchOps) Append(
+	ctx context.Context, file Node, data []byte) (off int64, err error) {
+	fbo.log.CDebugf(ctx, "Append %p %d", file.GetID(), len(data))
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %d %v", off, err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return 0, err
+	}
+
+	err = waitForTLFJournalSpace(ctx, fbo.config, fbo.id())
+	if err != nil {
+		return 0, err
+	}
+
+	// Don't let the goroutine below write directly to the return
+	// variable, since if the context is canceled the goroutine might
+	// outlast this function call.
+	var appendOff int64
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		md, err := fbo.getMDLocked(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+
+		appendOff, err = fbo.blocks.Append(
+			ctx, lState, md.ReadOnly(), file, data)
+		if err != nil {
+			return err
+		}
+
+		fbo.status.addDirtyNode(file)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return appendOff, nil
+}
+
 func (fbo *folderBranchOps) Truncate(
 	ctx context.Context, file Node, size uint64) (err error) {
 	fbo.log.CDebugf(ctx, "Truncate %p %d", file.GetID(), size)
@@ -3333,7 +4157,7 @@ func (fbo *folderBranchOps) setExLocked(
 	dblock.Children[file.tailName()] = de
 	_, err = fbo.syncBlockAndFinalizeLocked(
 		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
-		Dir, false, false, zeroPtr, NoExcl)
+		Dir, false, false, zeroPtr, NoExcl, nil)
 	return err
 }
 
@@ -3358,15 +4182,15 @@ func (fbo *folderBranchOps) SetEx(
 		})
 }
 
-func (fbo *folderBranchOps) setMtimeLocked(
+func (fbo *folderBranchOps) setPermLocked(
 	ctx context.Context, lState *lockState, file path,
-	mtime *time.Time) error {
+	perm os.FileMode) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	// verify we have permission to write
 	md, err := fbo.getMDForWriteLocked(ctx, lState)
 	if err != nil {
-		return err
+		return
 	}
 
 	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
@@ -3374,13 +4198,35 @@ func (fbo *folderBranchOps) setMtimeLocked(
 	if err != nil {
 		return err
 	}
-	de.Mtime = mtime.UnixNano()
-	// setting the mtime counts as changing the file MD, so must set ctime too
+
+	// Symlinks have no permissions of their own (to match ext4
+	// behavior).
+	if de.Type == Sym {
+		fbo.log.CDebugf(ctx, "Ignoring setperm on type %s", de.Type)
+		return nil
+	}
+
+	oldType, oldPerm := de.Type, de.OwnerPerm()
+	de.Perm = makeEntryPerm(perm)
+	// Keep the type of a file in sync with its executable bit, for
+	// the benefit of old clients and SetEx.
+	if de.Type == File && perm&0100 != 0 {
+		de.Type = Exec
+	} else if de.Type == Exec && perm&0100 == 0 {
+		de.Type = File
+	}
+	if de.Type == oldType && de.OwnerPerm() == oldPerm {
+		// As with setex, skip no-op changes to keep
+		// permissions-preserving rsyncs fast.
+		fbo.log.CDebugf(ctx, "Ignoring no-op setperm")
+		return nil
+	}
+
 	de.Ctime = fbo.nowUnixNano()
 
 	parentPath := file.parentPath()
 	sao, err := newSetAttrOp(file.tailName(), parentPath.tailPointer(),
-		mtimeAttr, file.tailPointer())
+		permAttr, file.tailPointer())
 	if err != nil {
 		return err
 	}
@@ -3388,9 +4234,9 @@ func (fbo *folderBranchOps) setMtimeLocked(
 	// If the MD doesn't match the MD expected by the path, that
 	// implies we are using a cached path, which implies the node has
 	// been unlinked.  In that case, we can safely ignore this
-	// setmtime.
+	// setperm.
 	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
-		fbo.log.CDebugf(ctx, "Skipping setmtime for a removed file %v",
+		fbo.log.CDebugf(ctx, "Skipping setperm for a removed file %v",
 			file.tailPointer())
 		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
 			ctx, lState, sao, de)
@@ -3402,75 +4248,337 @@ func (fbo *folderBranchOps) setMtimeLocked(
 	dblock.Children[file.tailName()] = de
 	_, err = fbo.syncBlockAndFinalizeLocked(
 		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
-		Dir, false, false, zeroPtr, NoExcl)
+		Dir, false, false, zeroPtr, NoExcl, nil)
 	return err
 }
 
-func (fbo *folderBranchOps) SetMtime(
-	ctx context.Context, file Node, mtime *time.Time) (err error) {
-	fbo.log.CDebugf(ctx, "SetMtime %p %v", file.GetID(), mtime)
+func (fbo *folderBranchOps) SetPerm(
+	ctx context.Context, node Node, perm os.FileMode) (err error) {
+	fbo.log.CDebugf(ctx, "SetPerm %p %v", node.GetID(), perm)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	if mtime == nil {
-		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
-		return nil
-	}
-
-	err = fbo.checkNode(file)
+	err = fbo.checkNode(node)
 	if err != nil {
 		return
 	}
 
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			nodePath, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
 			if err != nil {
 				return err
 			}
 
-			return fbo.setMtimeLocked(ctx, lState, filePath, mtime)
+			return fbo.setPermLocked(ctx, lState, nodePath, perm)
 		})
 }
 
-func (fbo *folderBranchOps) syncLocked(ctx context.Context,
-	lState *lockState, file path) (stillDirty bool, err error) {
+func (fbo *folderBranchOps) setAppendOnlyLocked(
+	ctx context.Context, lState *lockState, file path,
+	appendOnly bool) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	// if the cache for this file isn't dirty, we're done
-	if !fbo.blocks.IsDirty(lState, file) {
-		return false, nil
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return
 	}
 
-	// Verify we have permission to write.  We do this after the dirty
-	// check because otherwise readers who sync clean files on close
-	// would get an error.
-	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md.ReadOnly(), file)
 	if err != nil {
-		return true, err
+		return err
 	}
 
-	// If the MD doesn't match the MD expected by the path, that
-	// implies we are using a cached path, which implies the node has
-	// been unlinked.  In that case, we can safely ignore this sync.
-	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
-		fbo.log.CDebugf(ctx, "Skipping sync for a removed file %v",
-			file.tailPointer())
-		// Removing the cached info here is a little sketchy,
-		// since there's no guarantee that this sync comes
-		// from closing the file, and we still want to serve
-		// stat calls accurately if the user still has an open
-		// handle to this file. TODO: Hook this in with the
-		// node cache GC logic to be perfectly accurate.
-		return true, fbo.blocks.ClearCacheInfo(lState, file)
+	if de.Type != File && de.Type != Exec {
+		return NotFileError{file}
+	}
+	if de.AppendOnly == appendOnly {
+		fbo.log.CDebugf(ctx, "Ignoring no-op setappendonly")
+		return nil
 	}
 
-	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	de.AppendOnly = appendOnly
+	de.Ctime = fbo.nowUnixNano()
+
+	parentPath := file.parentPath()
+	sao, err := newSetAttrOp(file.tailName(), parentPath.tailPointer(),
+		appendOnlyAttr, file.tailPointer())
 	if err != nil {
-		return true, err
+		return err
 	}
 
-	// notify the daemon that a write is being performed
-	fbo.config.Reporter().Notify(ctx, writeNotification(file, false))
+	// If the MD doesn't match the MD expected by the path, that
+	// implies we are using a cached path, which implies the node has
+	// been unlinked.  In that case, we can safely ignore this
+	// setappendonly.
+	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
+		fbo.log.CDebugf(ctx, "Skipping setappendonly for a removed file %v",
+			file.tailPointer())
+		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
+			ctx, lState, sao, de)
+		return nil
+	}
+
+	md.AddOp(sao)
+
+	dblock.Children[file.tailName()] = de
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr, NoExcl, nil)
+	return err
+}
+
+func (fbo *folderBranchOps) SetAppendOnly(
+	ctx context.Context, file Node, appendOnly bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetAppendOnly %p %t", file.GetID(), appendOnly)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setAppendOnlyLocked(ctx, lState, filePath, appendOnly)
+		})
+}
+
+func (fbo *folderBranchOps) setMtimeLocked(
+	ctx context.Context, lState *lockState, file path,
+	mtime *time.Time) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md.ReadOnly(), file)
+	if err != nil {
+		return err
+	}
+	de.Mtime = mtime.UnixNano()
+	// setting the mtime counts as changing the file MD, so must set ctime too
+	de.Ctime = fbo.nowUnixNano()
+
+	parentPath := file.parentPath()
+	sao, err := newSetAttrOp(file.tailName(), parentPath.tailPointer(),
+		mtimeAttr, file.tailPointer())
+	if err != nil {
+		return err
+	}
+
+	// If the MD doesn't match the MD expected by the path, that
+	// implies we are using a cached path, which implies the node has
+	// been unlinked.  In that case, we can safely ignore this
+	// setmtime.
+	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
+		fbo.log.CDebugf(ctx, "Skipping setmtime for a removed file %v",
+			file.tailPointer())
+		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
+			ctx, lState, sao, de)
+		return nil
+	}
+
+	md.AddOp(sao)
+
+	dblock.Children[file.tailName()] = de
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr, NoExcl, nil)
+	return err
+}
+
+func (fbo *folderBranchOps) SetMtime(
+	ctx context.Context, file Node, mtime *time.Time) (err error) {
+	fbo.log.CDebugf(ctx, "SetMtime %p %v", file.GetID(), mtime)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if mtime == nil {
+		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
+		return nil
+	}
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setMtimeLocked(ctx, lState, filePath, mtime)
+		})
+}
+
+func (fbo *folderBranchOps) setXattrLocked(
+	ctx context.Context, lState *lockState, file path, name string,
+	value []byte, remove bool) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md.ReadOnly(), file)
+	if err != nil {
+		return err
+	}
+
+	// Entries share their xattr map, so build a new one.
+	xattrs := make(map[string][]byte, len(de.Xattrs)+1)
+	size := 0
+	for n, v := range de.Xattrs {
+		if n == name {
+			continue
+		}
+		xattrs[n] = v
+		size += len(n) + len(v)
+	}
+	if remove {
+		if _, ok := de.Xattrs[name]; !ok {
+			return NoSuchXattrError{name}
+		}
+	} else {
+		size += len(name) + len(value)
+		if size > maxXattrBytes {
+			return XattrTooBigError{name, size, maxXattrBytes}
+		}
+		xattrs[name] = append([]byte(nil), value...)
+	}
+	if len(xattrs) == 0 {
+		xattrs = nil
+	}
+	de.Xattrs = xattrs
+	de.Ctime = fbo.nowUnixNano()
+
+	parentPath := file.parentPath()
+	sao, err := newSetAttrOp(file.tailName(), parentPath.tailPointer(),
+		xattrAttr, file.tailPointer())
+	if err != nil {
+		return err
+	}
+
+	// If the MD doesn't match the MD expected by the path, that
+	// implies we are using a cached path, which implies the node has
+	// been unlinked.  In that case, we can safely ignore this
+	// setxattr.
+	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
+		fbo.log.CDebugf(ctx, "Skipping setxattr for a removed file %v",
+			file.tailPointer())
+		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
+			ctx, lState, sao, de)
+		return nil
+	}
+
+	md.AddOp(sao)
+
+	dblock.Children[file.tailName()] = de
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr, NoExcl, nil)
+	return err
+}
+
+func (fbo *folderBranchOps) SetXattr(
+	ctx context.Context, node Node, name string, value []byte) (err error) {
+	fbo.log.CDebugf(ctx, "SetXattr %p %s (%d bytes)",
+		node.GetID(), name, len(value))
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(node)
+	if err != nil {
+		return
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			nodePath, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setXattrLocked(
+				ctx, lState, nodePath, name, value, false)
+		})
+}
+
+func (fbo *folderBranchOps) RemoveXattr(
+	ctx context.Context, node Node, name string) (err error) {
+	fbo.log.CDebugf(ctx, "RemoveXattr %p %s", node.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(node)
+	if err != nil {
+		return
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			nodePath, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setXattrLocked(ctx, lState, nodePath, name, nil, true)
+		})
+}
+
+func (fbo *folderBranchOps) syncLocked(ctx context.Context,
+	lState *lockState, file path) (stillDirty bool, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// if the cache for this file isn't dirty, we're done
+	if !fbo.blocks.IsDirty(lState, file) {
+		return false, nil
+	}
+
+	// Verify we have permission to write.  We do this after the dirty
+	// check because otherwise readers who sync clean files on close
+	// would get an error.
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return true, err
+	}
+
+	// If the MD doesn't match the MD expected by the path, that
+	// implies we are using a cached path, which implies the node has
+	// been unlinked.  In that case, we can safely ignore this sync.
+	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
+		fbo.log.CDebugf(ctx, "Skipping sync for a removed file %v",
+			file.tailPointer())
+		// Removing the cached info here is a little sketchy,
+		// since there's no guarantee that this sync comes
+		// from closing the file, and we still want to serve
+		// stat calls accurately if the user still has an open
+		// handle to this file. TODO: Hook this in with the
+		// node cache GC logic to be perfectly accurate.
+		return true, fbo.blocks.ClearCacheInfo(lState, file)
+	}
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return true, err
+	}
+
+	// notify the daemon that a write is being performed
+	fbo.config.Reporter().Notify(ctx, writeNotification(file, false))
 	defer fbo.config.Reporter().Notify(ctx, writeNotification(file, true))
 
 	// Filled in by doBlockPuts below.
@@ -3485,92 +4593,399 @@ func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 		return true, err
 	}
 
-	newPath, _, newBps, err :=
-		fbo.syncBlockAndCheckEmbedLocked(
-			ctx, lState, md, fblock, *file.parentPath(),
-			file.tailName(), File, true, true, zeroPtr, lbc)
+	// With strict times, the dirty entry already has the times of
+	// the last write, so don't overwrite them with the sync time.
+	setTimes := !fbo.config.StrictTimes()
+	newPath, _, newBps, err :=
+		fbo.syncBlockAndCheckEmbedLocked(
+			ctx, lState, md, fblock, *file.parentPath(),
+			file.tailName(), File, setTimes, setTimes, zeroPtr, lbc)
+	if err != nil {
+		return true, err
+	}
+
+	bps.mergeOtherBps(newBps)
+
+	// Note: We explicitly don't call fbo.fbm.cleanUpBlockState here
+	// when there's an error, because it's possible some of the blocks
+	// will be reused in a future attempt at this same sync, and we
+	// don't want them cleaned up in that case.  Instead, the
+	// FinishSync call below will take care of that.
+
+	blocksToRemove, err = fbo.doBlockPuts(ctx, md.ReadOnly(), *bps)
+	if err != nil {
+		return true, err
+	}
+
+	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl)
+	if err != nil {
+		return true, err
+	}
+
+	// At this point, all reads through the old path (i.e., file)
+	// see writes that happened since StartSync, whereas all reads
+	// through the new path (newPath) don't.
+	//
+	// TODO: This isn't completely correct, since reads that
+	// happen after a write should always see the new data.
+	//
+	// After FinishSync succeeds, then reads through both the old
+	// and the new paths will see the writes that happened during
+	// the sync.
+
+	return fbo.blocks.FinishSync(ctx, lState, file, newPath,
+		md.ReadOnly(), syncState, fbo.fbm)
+}
+
+func (fbo *folderBranchOps) Sync(ctx context.Context, file Node) (err error) {
+	fbo.log.CDebugf(ctx, "Sync %p", file.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return
+	}
+
+	var wasDirty, stillDirty bool
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			if err != nil {
+				return err
+			}
+
+			wasDirty = fbo.blocks.IsDirty(lState, filePath)
+			stillDirty, err = fbo.syncLocked(ctx, lState, filePath)
+			return err
+		})
+	if err != nil {
+		return err
+	}
+
+	if !stillDirty {
+		fbo.status.rmDirtyNode(file)
+	}
+	if wasDirty {
+		fbo.schedulePostWriteHooks(file)
+	}
+
+	return nil
+}
+
+func (fbo *folderBranchOps) LockFileRange(ctx context.Context, file Node,
+	off, length uint64, wait bool) (l *FileRangeLock, err error) {
+	fbo.log.CDebugf(ctx, "LockFileRange %p %d+%d (wait=%t)",
+		file.GetID(), off, length, wait)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	dir, name, err := fbo.getParent(file)
+	if err != nil {
+		return nil, err
+	}
+	return lockFileRange(ctx, fbo.config, dir, file, name, off, length, wait)
+}
+
+func (fbo *folderBranchOps) getParent(node Node) (
+	dir Node, name string, err error) {
+	err = fbo.checkNode(node)
+	if err != nil {
+		return nil, "", err
+	}
+
+	p, err := fbo.pathFromNodeForRead(node)
+	if err != nil {
+		return nil, "", err
+	}
+	if !p.hasValidParent() {
+		return nil, "", InvalidParentPathError{p}
+	}
+	// The parent node stays cached as long as the node does.
+	dir = fbo.nodeCache.Get(p.parentPath().tailPointer().Ref())
+	if dir == nil {
+		return nil, "", InvalidParentPathError{p}
+	}
+	return dir, p.tailName(), nil
+}
+
+func (fbo *folderBranchOps) GetParent(ctx context.Context, node Node) (
+	dir Node, name string, err error) {
+	fbo.log.CDebugf(ctx, "GetParent %p", node.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	return fbo.getParent(node)
+}
+
+func (fbo *folderBranchOps) FolderStatus(
+	ctx context.Context, folderBranch FolderBranch) (
+	fbs FolderBranchStatus, updateChan <-chan StatusUpdate, err error) {
+	fbo.log.CDebugf(ctx, "Status")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return FolderBranchStatus{}, nil,
+			WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	return fbo.status.getStatus(ctx, &fbo.blocks)
+}
+
+func (fbo *folderBranchOps) SetBlockPolicy(ctx context.Context,
+	folderBranch FolderBranch, policy BlockPolicy) (err error) {
+	fbo.log.CDebugf(ctx, "SetBlockPolicy %s", policy)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	if err := policy.checkSupported(); err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			md, err := fbo.getMDForWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+
+			if md.BlockPolicy().equals(policy) {
+				return nil
+			}
+			md.SetBlockPolicy(policy)
+
+			// A policy change doesn't touch any blocks.  Like
+			// a rekey, record it with a rekeyOp, which every
+			// client already knows how to process, so that
+			// older clients can still read this revision.
+			md.AddOp(newRekeyOp())
+
+			bps, err := fbo.maybeUnembedAndPutBlocks(ctx, md)
+			if err != nil {
+				return err
+			}
+
+			return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl)
+		})
+}
+
+func (fbo *folderBranchOps) SetManualConflictResolution(
+	ctx context.Context, folderBranch FolderBranch, manual bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetManualConflictResolution %t", manual)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	fbo.status.setManualCR(manual)
+	if held, ok := fbo.cr.setManual(manual); ok {
+		// Resolve whatever conflicts piled up while in manual
+		// mode.
+		fbo.cr.Resolve(held.unmerged, held.merged)
+	}
+	return nil
+}
+
+func (fbo *folderBranchOps) GetConflicts(
+	ctx context.Context, folderBranch FolderBranch) (
+	conflicts []ConflictInfo, err error) {
+	fbo.log.CDebugf(ctx, "GetConflicts")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	cs, err := fbo.cr.listConflicts(ctx, lState)
 	if err != nil {
-		return true, err
+		return nil, err
 	}
+	conflicts = make([]ConflictInfo, 0, len(cs))
+	for _, c := range cs {
+		conflicts = append(conflicts, c.info)
+	}
+	return conflicts, nil
+}
 
-	bps.mergeOtherBps(newBps)
+func (fbo *folderBranchOps) PreviewConflictResolution(
+	ctx context.Context, folderBranch FolderBranch) (
+	preview ConflictResolutionPreview, err error) {
+	fbo.log.CDebugf(ctx, "PreviewConflictResolution")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	// Note: We explicitly don't call fbo.fbm.cleanUpBlockState here
-	// when there's an error, because it's possible some of the blocks
-	// will be reused in a future attempt at this same sync, and we
-	// don't want them cleaned up in that case.  Instead, the
-	// FinishSync call below will take care of that.
+	if folderBranch != fbo.folderBranch {
+		return ConflictResolutionPreview{},
+			WrongOpsError{fbo.folderBranch, folderBranch}
+	}
 
-	blocksToRemove, err = doBlockPuts(ctx, fbo.config.BlockServer(),
-		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
-	if err != nil {
-		return true, err
+	lState := makeFBOLockState()
+	if fbo.isMasterBranch(lState) {
+		return ConflictResolutionPreview{}, nil
 	}
+	return fbo.cr.preview(ctx, lState)
+}
 
-	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl)
-	if err != nil {
-		return true, err
+func (fbo *folderBranchOps) SetAccessLogging(
+	ctx context.Context, folderBranch FolderBranch, enabled bool) (
+	err error) {
+	fbo.log.CDebugf(ctx, "SetAccessLogging %t", enabled)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
 	}
+	return fbo.accessLog.setEnabled(ctx, enabled)
+}
 
-	// At this point, all reads through the old path (i.e., file)
-	// see writes that happened since StartSync, whereas all reads
-	// through the new path (newPath) don't.
-	//
-	// TODO: This isn't completely correct, since reads that
-	// happen after a write should always see the new data.
-	//
-	// After FinishSync succeeds, then reads through both the old
-	// and the new paths will see the writes that happened during
-	// the sync.
+func (fbo *folderBranchOps) GetAccessLog(
+	ctx context.Context, folderBranch FolderBranch) (
+	entries []AccessLogEntry, err error) {
+	fbo.log.CDebugf(ctx, "GetAccessLog")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	return fbo.blocks.FinishSync(ctx, lState, file, newPath,
-		md.ReadOnly(), syncState, fbo.fbm)
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	return fbo.accessLog.getLog(ctx)
 }
 
-func (fbo *folderBranchOps) Sync(ctx context.Context, file Node) (err error) {
-	fbo.log.CDebugf(ctx, "Sync %p", file.GetID())
+func (fbo *folderBranchOps) PruneAccessLog(
+	ctx context.Context, folderBranch FolderBranch, before time.Time) (
+	err error) {
+	fbo.log.CDebugf(ctx, "PruneAccessLog %s", before)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(file)
-	if err != nil {
-		return
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
 	}
+	return fbo.accessLog.prune(ctx, before)
+}
 
-	var stillDirty bool
-	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
-			if err != nil {
-				return err
-			}
+func (fbo *folderBranchOps) GetTLFAccessLog(
+	ctx context.Context, folderBranch FolderBranch, since time.Time) (
+	events []TLFAccessEvent, err error) {
+	fbo.log.CDebugf(ctx, "GetTLFAccessLog %s", since)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-			stillDirty, err = fbo.syncLocked(ctx, lState, filePath)
-			return err
-		})
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	username, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	handle := md.GetTlfHandle()
+	if !handle.IsWriter(uid) {
+		return nil, NewWriteAccessError(handle, username, "")
 	}
 
-	if !stillDirty {
-		fbo.status.rmDirtyNode(file)
+	// Each server can only know about the fetches made from it.
+	supported := false
+	for _, server := range []interface{}{
+		fbo.config.MDServer(), fbo.config.BlockServer()} {
+		logServer, ok := server.(TLFAccessLogServer)
+		if !ok {
+			continue
+		}
+		supported = true
+		serverEvents, err := logServer.GetTLFAccessLog(ctx, fbo.id(), since)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, serverEvents...)
 	}
+	if !supported {
+		return nil, TLFAccessLogUnsupportedError{}
+	}
+	sort.Stable(tlfAccessEventsByTime(events))
+	return events, nil
+}
 
-	return nil
+// lookupPathByNames returns the node for the given path in the
+// current head, looking up each entry by name rather than by
+// pointer.
+func (fbo *folderBranchOps) lookupPathByNames(
+	ctx context.Context, p path) (Node, error) {
+	node, _, _, err := fbo.getRootNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, pn := range p.path[1:] {
+		node, _, err = fbo.Lookup(ctx, node, pn.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
 }
 
-func (fbo *folderBranchOps) FolderStatus(
-	ctx context.Context, folderBranch FolderBranch) (
-	fbs FolderBranchStatus, updateChan <-chan StatusUpdate, err error) {
-	fbo.log.CDebugf(ctx, "Status")
+func (fbo *folderBranchOps) ResolveConflict(
+	ctx context.Context, folderBranch FolderBranch, p string,
+	choice ConflictChoice) (err error) {
+	fbo.log.CDebugf(ctx, "ResolveConflict %s: %s", p, choice)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
 	if folderBranch != fbo.folderBranch {
-		return FolderBranchStatus{}, nil,
-			WrongOpsError{fbo.folderBranch, folderBranch}
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if !fbo.cr.isManual() {
+		return ManualConflictResolutionDisabledError{fbo.id()}
+	}
+	if choice < ConflictChoiceKeepBoth || choice > ConflictChoiceRemote {
+		return fmt.Errorf("Unknown conflict choice %s", choice)
 	}
 
-	return fbo.status.getStatus(ctx, &fbo.blocks)
+	lState := makeFBOLockState()
+	conflicts, err := fbo.cr.listConflicts(ctx, lState)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, c := range conflicts {
+		if c.info.Path == p {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return NoSuchConflictError{p}
+	}
+
+	if !fbo.cr.setChoice(p, choice, conflicts) {
+		// Wait for the rest of the choices.
+		return nil
+	}
+
+	localNames, err := fbo.cr.resolveManually(ctx, lState, conflicts)
+	if err != nil {
+		return err
+	}
+
+	// Now that both versions are merged, move the local version
+	// of each file over the remote one where the user chose it.
+	for _, c := range conflicts {
+		name, ok := localNames[c.info.Path]
+		if !ok {
+			continue
+		}
+		parent, err := fbo.lookupPathByNames(ctx, *c.mergedPath.parentPath())
+		if err != nil {
+			return err
+		}
+		err = fbo.Rename(ctx, parent, name, parent, c.mergedPath.tailName())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (fbo *folderBranchOps) Status(
@@ -3579,6 +4994,11 @@ func (fbo *folderBranchOps) Status(
 	return KBFSStatus{}, nil, InvalidOpError{}
 }
 
+func (fbo *folderBranchOps) GetKBFSStatus(
+	ctx context.Context) (KBFSStatusSnapshot, error) {
+	return KBFSStatusSnapshot{}, InvalidOpError{}
+}
+
 // RegisterForChanges registers a single Observer to receive
 // notifications about this folder/branch.
 func (fbo *folderBranchOps) RegisterForChanges(obs Observer) error {
@@ -3602,7 +5022,7 @@ func (fbo *folderBranchOps) notifyBatchLocked(
 	fbo.headLock.AssertLocked(lState)
 
 	lastOp := md.data.Changes.Ops[len(md.data.Changes.Ops)-1]
-	fbo.notifyOneOpLocked(ctx, lState, lastOp, md)
+	fbo.notifyOneOpLocked(ctx, lState, lastOp, md.ReadOnly())
 	fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{md})
 }
 
@@ -3661,11 +5081,18 @@ func (fbo *folderBranchOps) unlinkFromCache(op op, oldDir BlockPointer,
 }
 
 func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
-	lState *lockState, op op, md ImmutableRootMetadata) {
+	lState *lockState, op op, md ReadOnlyRootMetadata) {
 	fbo.headLock.AssertLocked(lState)
 
 	fbo.blocks.UpdatePointers(lState, op)
 
+	// Compute the path changes before the node cache is changed
+	// below, but announce them after the node changes.
+	if pathChanges := fbo.pathChangesForOpLocked(
+		ctx, lState, op, md); len(pathChanges) > 0 {
+		defer fbo.observers.pathChanges(ctx, pathChanges)
+	}
+
 	var changes []NodeChange
 	switch realOp := op.(type) {
 	default:
@@ -3942,6 +5369,7 @@ func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
 	}
 
 	appliedRevs := make([]ImmutableRootMetadata, 0, len(rmds))
+	var rekeyRequest ImmutableRootMetadata
 	for _, rmd := range rmds {
 		// check that we're applying the expected MD revision
 		if rmd.Revision() <= fbo.getCurrMDRevisionLocked(lState) {
@@ -3956,18 +5384,48 @@ func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
 		if err != nil {
 			return err
 		}
-		// No new operations in these.
-		if rmd.IsWriterMetadataCopiedSet() {
+		if rmd.IsRekeySet() && !rmd.IsFinal() {
+			rekeyRequest = rmd
+		} else {
+			rekeyRequest = ImmutableRootMetadata{}
+		}
+		// No new operations in these; a final MD is a copy of its
+		// predecessor.
+		if rmd.IsWriterMetadataCopiedSet() || rmd.IsFinal() {
 			continue
 		}
 		for _, op := range rmd.data.Changes.Ops {
-			fbo.notifyOneOpLocked(ctx, lState, op, rmd)
+			fbo.notifyOneOpLocked(ctx, lState, op, rmd.ReadOnly())
 		}
 		appliedRevs = append(appliedRevs, rmd)
 	}
 	if len(appliedRevs) > 0 {
 		fbo.editHistory.UpdateHistory(ctx, appliedRevs)
 	}
+	if rekeyRequest != (ImmutableRootMetadata{}) {
+		return fbo.handleRekeyRequest(ctx, rekeyRequest)
+	}
+	return nil
+}
+
+// handleRekeyRequest notifies the user and queues a rekey if rmd,
+// which was made by another user or device, left the rekey bit set
+// and the current user is a writer who can do the rekey.
+func (fbo *folderBranchOps) handleRekeyRequest(
+	ctx context.Context, rmd ImmutableRootMetadata) error {
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+	handle := rmd.GetTlfHandle()
+	if !handle.IsWriter(uid) {
+		return nil
+	}
+	fbo.log.CDebugf(ctx, "Revision %d requested a rekey; queuing one",
+		rmd.Revision())
+	fbo.config.Reporter().Notify(ctx, rekeyRequestNotification(
+		handle, rmd.LastModifyingUser(), rmd.LocalTimestamp()))
+	fbo.config.RekeyQueue().Enqueue(rmd.TlfID())
 	return nil
 }
 
@@ -4024,7 +5482,7 @@ func (fbo *folderBranchOps) undoMDUpdatesLocked(ctx context.Context,
 					err, ops[j])
 				continue
 			}
-			fbo.notifyOneOpLocked(ctx, lState, io, rmd)
+			fbo.notifyOneOpLocked(ctx, lState, io, rmd.ReadOnly())
 		}
 	}
 	// TODO: update the edit history?
@@ -4532,6 +5990,10 @@ func (fbo *folderBranchOps) SyncFromServerForTesting(
 		return err
 	}
 
+	if err := fbo.postWriteHooks.Wait(ctx); err != nil {
+		return err
+	}
+
 	if !fbo.isMasterBranch(lState) {
 		if err := fbo.cr.Wait(ctx); err != nil {
 			return err
@@ -4650,12 +6112,27 @@ func (fbo *folderBranchOps) maybeFastForward(ctx context.Context,
 		return false, nil
 	}
 
-	fbo.log.CDebugf(ctx, "Checking head for possible "+
+	fbo.log.CDebugf(ctx, "Checking for possible "+
 		"fast-forwarding (last update time=%s)", lastUpdate)
-	currHead, err := fbo.config.MDOps().GetForTLF(ctx, fbo.id())
+	// If we're too far behind, the server leaves out everything
+	// but the head, so we never download history we'd skip anyway.
+	rmds, skipped, err := fbo.config.MDOps().GetMergedDelta(ctx, fbo.id(),
+		fbo.getLatestMergedRevision(lState), fastForwardRevThresh)
 	if err != nil {
 		return false, err
 	}
+	if !skipped {
+		// Might as well apply all the revisions.  Cache them so
+		// they don't have to be fetched again.
+		for _, rmd := range rmds {
+			if err := fbo.config.MDCache().Put(rmd); err != nil {
+				fbo.log.CDebugf(ctx, "Error putting md %d into the "+
+					"cache: %v", rmd.Revision(), err)
+			}
+		}
+		return false, nil
+	}
+	currHead := rmds[0]
 	fbo.log.CDebugf(ctx, "Current head is revision %d", currHead.Revision())
 
 	fbo.mdWriterLock.Lock(lState)
@@ -4679,8 +6156,9 @@ func (fbo *folderBranchOps) maybeFastForward(ctx context.Context,
 	fbo.headLock.Lock(lState)
 	defer fbo.headLock.Unlock(lState)
 
-	if currHead.Revision() < fbo.latestMergedRevision+fastForwardRevThresh {
-		// Might as well fetch all the revisions.
+	if currHead.Revision() <= fbo.latestMergedRevision+fastForwardRevThresh {
+		// We caught up some other way in the meantime, so might as
+		// well fetch all the revisions.
 		return false, nil
 	}
 
@@ -4759,6 +6237,11 @@ func (fbo *folderBranchOps) registerAndWaitForUpdates() {
 					fbo.log.CDebugf(ctx,
 						"Retrying registerForUpdates in %s due to err: %v",
 						nextTime, err)
+					// Back off further while the
+					// connection is unreliable, so
+					// failing fetches don't pile up.
+					expBackoff.MaxInterval = fbo.config.Connectivity().
+						State().Policy().MaxRetryInterval
 				})
 			if err != nil {
 				return err
@@ -4780,6 +6263,23 @@ func (fbo *folderBranchOps) registerForUpdates(ctx context.Context) (
 	currRev := fbo.getLatestMergedRevision(lState)
 	fbo.log.CDebugf(ctx, "Registering for updates (curr rev = %d)", currRev)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if interval := fbo.config.ReadReplicaPollInterval(); interval > 0 {
+		// Read replicas don't rely on the MD server to notify
+		// them; instead, they just check for a new head after
+		// every interval.
+		c := make(chan error, 1)
+		go func() {
+			select {
+			case <-time.After(interval):
+				c <- nil
+			case <-ctx.Done():
+				c <- ctx.Err()
+			}
+		}()
+		return c, nil
+	}
+
 	// RegisterForUpdate will itself retry on connectivity issues
 	return fbo.config.MDServer().RegisterForUpdate(ctx, fbo.id(), currRev)
 }
@@ -4822,6 +6322,12 @@ func (fbo *folderBranchOps) waitForAndProcessUpdates(
 				return time.Time{}, err
 			}
 			return currUpdate, nil
+		case <-fbo.revalidateHeadChan:
+			// Don't return, since we're still registered for
+			// updates on updateChan.
+			if fbo.revalidateHead(ctx, lState, lastUpdate) {
+				lastUpdate = fbo.config.Clock().Now()
+			}
 		case unpause := <-fbo.updatePauseChan:
 			fbo.log.CInfof(ctx, "Updates paused")
 			// wait to be unpaused
@@ -4837,6 +6343,49 @@ func (fbo *folderBranchOps) waitForAndProcessUpdates(
 	}
 }
 
+// signalRevalidateHead asks the update goroutine to check for a new
+// head as soon as possible.
+func (fbo *folderBranchOps) signalRevalidateHead() {
+	select {
+	case fbo.revalidateHeadChan <- struct{}{}:
+	default:
+	}
+}
+
+// revalidateHead fetches and applies any updates to the head that we
+// haven't been notified about, and returns whether it succeeded.
+// Failures are only logged, since the next notification will pick up
+// the same updates.
+func (fbo *folderBranchOps) revalidateHead(ctx context.Context,
+	lState *lockState, lastUpdate time.Time) bool {
+	if !fbo.isMasterBranch(lState) {
+		// CR will pick up the latest head.
+		return false
+	}
+	fbo.log.CDebugf(ctx, "Revalidating head")
+	ctx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
+	defer cancel()
+
+	oldRev := fbo.getLatestMergedRevision(lState)
+	ffDone, err := fbo.maybeFastForward(
+		ctx, lState, lastUpdate, fbo.config.Clock().Now())
+	if err == nil && !ffDone {
+		err = fbo.getAndApplyMDUpdates(ctx, lState, fbo.applyMDUpdates)
+	}
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't revalidate head: %v", err)
+		return false
+	}
+	newRev := fbo.getLatestMergedRevision(lState)
+	if newRev > oldRev {
+		fbo.log.CDebugf(ctx, "Head was stale (rev %d, now %d)",
+			oldRev, newRev)
+		recordClockJumpMetric(fbo.config.MetricsRegistry(),
+			clockJumpStaleServesAvoidedMetric)
+	}
+	return true
+}
+
 func (fbo *folderBranchOps) backgroundFlusher(betweenFlushes time.Duration) {
 	ticker := time.NewTicker(betweenFlushes)
 	defer ticker.Stop()
@@ -5004,7 +6553,7 @@ func (fbo *folderBranchOps) finalizeResolutionLocked(ctx context.Context,
 
 	// notifyOneOp for every fixed-up merged op.
 	for _, op := range newOps {
-		fbo.notifyOneOpLocked(ctx, lState, op, irmd)
+		fbo.notifyOneOpLocked(ctx, lState, op, irmd.ReadOnly())
 	}
 	fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{irmd})
 	return nil
@@ -5244,6 +6793,104 @@ func (fbo *folderBranchOps) GetEditHistory(ctx context.Context,
 	return fbo.editHistory.GetComplete(ctx, head)
 }
 
+// GetKeyGenerations implements the KBFSOps interface for folderBranchOps
+func (fbo *folderBranchOps) GetKeyGenerations(ctx context.Context,
+	tlfID tlf.ID) (infos []KeyGenerationInfo, err error) {
+	fbo.log.CDebugf(ctx, "GetKeyGenerations")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	fb := FolderBranch{tlfID, MasterBranch}
+	if fb != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, fb}
+	}
+
+	return getKeyGenerations(ctx, fbo.config, tlfID)
+}
+
+// finalize makes the MD server finalize this TLF, after resetUser
+// has reset their account, and applies the resulting final MD.  It
+// returns the finalized handle of the TLF, whose successor handle
+// then refers to a new TLF.
+func (fbo *folderBranchOps) finalize(ctx context.Context,
+	resetUser libkb.NormalizedUsername) (handle *TlfHandle, err error) {
+	fbo.log.CDebugf(ctx, "finalize %s", resetUser)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if fbo.folderBranch.Branch != MasterBranch {
+		return nil, WrongOpsError{fbo.folderBranch,
+			FolderBranch{fbo.id(), MasterBranch}}
+	}
+
+	mdServer, ok := fbo.config.MDServer().(mdServerLocal)
+	if !ok {
+		return nil, errors.New(
+			"Only local MD servers can finalize TLFs")
+	}
+
+	// Everything written so far must be on the server before the
+	// final copy of its head is made.
+	if err := WaitForTLFJournal(ctx, fbo.config, fbo.id(),
+		fbo.log); err != nil {
+		return nil, err
+	}
+
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+
+	if !fbo.isMasterBranchLocked(lState) {
+		return nil, UnmergedError{}
+	}
+	if fbo.blocks.GetState(lState) != cleanState {
+		return nil, errors.New("Can't finalize a TLF with dirty writes")
+	}
+
+	md, err := fbo.getMDLocked(ctx, lState, mdWrite)
+	if err != nil {
+		return nil, err
+	}
+	handle = md.GetTlfHandle()
+
+	username, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !handle.IsWriter(uid) {
+		return nil, NewWriteAccessError(handle, username, "")
+	}
+	if md.IsFinal() {
+		return nil, TlfFinalizedError{
+			Tlf:       handle.GetCanonicalName(),
+			Public:    handle.IsPublic(),
+			Successor: handle.SuccessorHandle().GetCanonicalName(),
+		}
+	}
+	_, resetUID, err := fbo.config.KBPKI().Resolve(ctx, string(resetUser))
+	if err != nil {
+		return nil, err
+	}
+	if !handle.IsReader(resetUID) {
+		return nil, fmt.Errorf("%s is not a member of %s",
+			resetUser, handle.GetCanonicalPath())
+	}
+
+	err = mdServer.finalizeTLF(ctx, fbo.id(), resetUser)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fbo.getAndApplyMDUpdates(ctx, lState, fbo.applyMDUpdatesLocked)
+	if err != nil {
+		return nil, err
+	}
+	md = fbo.getHead(lState)
+	if !md.IsFinal() {
+		return nil, fmt.Errorf("Head revision %d of %s is unexpectedly "+
+			"not final", md.Revision(), fbo.id())
+	}
+	return md.GetTlfHandle(), nil
+}
+
 // PushStatusChange forces a new status be fetched by status listeners.
 func (fbo *folderBranchOps) PushStatusChange() {
 	fbo.config.KBFSOps().PushStatusChange()
@@ -26,6 +26,12 @@ type FolderBranchStatus struct {
 	FolderID            string
 	Revision            MetadataRevision
 
+	// Finalized is true if this folder is read-only because one of
+	// its members reset their account.  Successor is then the path
+	// of the folder that replaced it.
+	Finalized bool   `json:",omitempty"`
+	Successor string `json:",omitempty"`
+
 	// DirtyPaths are files that have been written, but not flushed.
 	// They do not represent unstaged changes in your local instance.
 	DirtyPaths []string
@@ -36,6 +42,30 @@ type FolderBranchStatus struct {
 	Merged   []*crChainSummary
 
 	Journal *TLFJournalStatus `json:",omitempty"`
+
+	// RekeyHistory lists, oldest first, each merged revision that
+	// changed the key generation or the set of users and devices
+	// with access to this folder.  It's brought up to date in the
+	// background, starting with the first status request, so it
+	// may lag behind Revision.
+	RekeyHistory []RekeyHistoryEntry `json:",omitempty"`
+	// RekeyRequest is the latest request for a writer to rekey
+	// this folder, made by a device without keys for it.
+	RekeyRequest *RekeyRequestStatus `json:",omitempty"`
+
+	// BlockPolicy is the folder's policy for encoding new file
+	// data, and EffectiveBlockPolicy is the part of it that this
+	// client applies.
+	BlockPolicy          BlockPolicy
+	EffectiveBlockPolicy BlockPolicy
+
+	// ConflictResolution summarizes the conflict resolutions
+	// attempted for this folder-branch since KBFS started.
+	ConflictResolution *ConflictResolutionStatus `json:",omitempty"`
+	// ManualConflictResolution is true if conflicts in this
+	// folder-branch are left for the user to resolve (see
+	// KBFSOps.GetConflicts).
+	ManualConflictResolution bool `json:",omitempty"`
 }
 
 // KBFSStatus represents the content of the top-level status file. It is
@@ -48,6 +78,23 @@ type KBFSStatus struct {
 	LimitBytes      int64
 	FailingServices map[string]error
 	JournalServer   *JournalServerStatus `json:",omitempty"`
+	BandwidthLimits BandwidthLimits
+	DiskLimiter     DiskLimiterStatus
+	// BlockCacheTuning is set if the block cache's size is being
+	// tuned automatically.
+	BlockCacheTuning *BlockCacheTuningStatus `json:",omitempty"`
+	// DirtyMemory is set if the memory used by dirty data is
+	// being limited.
+	DirtyMemory *DirtyMemoryStatus `json:",omitempty"`
+	// KeyHalfHealth is set if the crypt key server halves are
+	// being audited in the background.
+	KeyHalfHealth *KeyHalfHealthStatus `json:",omitempty"`
+	// Log is set if the log settings can be changed at runtime.
+	Log *LogStatus `json:",omitempty"`
+	// Connectivity is how well this device can currently reach
+	// the servers, and the policy for background work that follows
+	// from it.
+	Connectivity ConnectivityStatus
 }
 
 // StatusUpdate is a dummy type used to indicate status has been updated.
@@ -64,6 +111,9 @@ type folderBranchStatusKeeper struct {
 	dirtyNodes map[NodeID]Node
 	unmerged   []*crChainSummary
 	merged     []*crChainSummary
+	crStatus   *ConflictResolutionStatus
+	manualCR   bool
+	rekeys     *rekeyHistoryTracker
 	dataMutex  sync.Mutex
 
 	updateChan  chan StatusUpdate
@@ -76,6 +126,7 @@ func newFolderBranchStatusKeeper(
 		config:     config,
 		nodeCache:  nodeCache,
 		dirtyNodes: make(map[NodeID]Node),
+		rekeys:     newRekeyHistoryTracker(config),
 		updateChan: make(chan StatusUpdate, 1),
 	}
 }
@@ -97,9 +148,15 @@ func (fbsk *folderBranchStatusKeeper) setRootMetadata(md ImmutableRootMetadata)
 		return
 	}
 	fbsk.md = md
+	fbsk.rekeys.headChanged(md)
 	fbsk.signalChangeLocked()
 }
 
+// shutdown stops any background status updates.
+func (fbsk *folderBranchStatusKeeper) shutdown() {
+	fbsk.rekeys.shutdownAndWait()
+}
+
 func (fbsk *folderBranchStatusKeeper) setCRSummary(unmerged []*crChainSummary,
 	merged []*crChainSummary) {
 	fbsk.dataMutex.Lock()
@@ -113,6 +170,21 @@ func (fbsk *folderBranchStatusKeeper) setCRSummary(unmerged []*crChainSummary,
 	fbsk.signalChangeLocked()
 }
 
+func (fbsk *folderBranchStatusKeeper) setCRStatus(
+	status ConflictResolutionStatus) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	fbsk.crStatus = &status
+	fbsk.signalChangeLocked()
+}
+
+func (fbsk *folderBranchStatusKeeper) setManualCR(manual bool) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	fbsk.manualCR = manual
+	fbsk.signalChangeLocked()
+}
+
 func (fbsk *folderBranchStatusKeeper) addNode(m map[NodeID]Node, n Node) {
 	fbsk.dataMutex.Lock()
 	defer fbsk.dataMutex.Unlock()
@@ -182,6 +254,17 @@ func (fbsk *folderBranchStatusKeeper) getStatus(ctx context.Context,
 		fbs.LatestKeyGeneration = fbsk.md.LatestKeyGeneration()
 		fbs.FolderID = fbsk.md.TlfID().String()
 		fbs.Revision = fbsk.md.Revision()
+		if fbsk.md.IsFinal() {
+			fbs.Finalized = true
+			fbs.Successor = fbsk.md.GetTlfHandle().SuccessorHandle().
+				GetCanonicalPath()
+		}
+
+		fbsk.rekeys.setHead(fbsk.md)
+		fbs.RekeyHistory = fbsk.rekeys.getEntries()
+		fbs.RekeyRequest = fbsk.rekeys.getRequest()
+		fbs.BlockPolicy = fbsk.md.BlockPolicy()
+		fbs.EffectiveBlockPolicy = fbs.BlockPolicy.effective()
 
 		// TODO: Ideally, the journal would push status
 		// updates to this object instead, so we can notify
@@ -209,6 +292,8 @@ func (fbsk *folderBranchStatusKeeper) getStatus(ctx context.Context,
 
 	fbs.Unmerged = fbsk.unmerged
 	fbs.Merged = fbsk.merged
+	fbs.ConflictResolution = fbsk.crStatus
+	fbs.ManualConflictResolution = fbsk.manualCR
 
 	return fbs, fbsk.updateChan, nil
 }
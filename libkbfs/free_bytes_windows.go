@@ -0,0 +1,32 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package libkbfs
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceExW = syscall.NewLazyDLL("kernel32.dll").
+	NewProc("GetDiskFreeSpaceExW")
+
+// getFreeBytes returns the space on the disk holding dir that's
+// available to the current user.
+func getFreeBytes(dir string) (int64, error) {
+	dirPtr, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var freeBytesAvailable uint64
+	r1, _, err := getDiskFreeSpaceExW.Call(
+		uintptr(unsafe.Pointer(dirPtr)),
+		uintptr(unsafe.Pointer(&freeBytesAvailable)), 0, 0)
+	if r1 == 0 {
+		return 0, err
+	}
+	return int64(freeBytesAvailable), nil
+}
@@ -0,0 +1,32 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build gofuzz
+
+package libkbfs
+
+// These are the go-fuzz targets for the on-wire structures that KBFS
+// receives from servers.  To run one, first generate the seed corpus
+// from the unit test vectors, and then build and run the target:
+//
+//   KEYBASE_TEST_FUZZ_CORPUS_DIR=/tmp/fuzz go test -run TestFuzzCorpus
+//   go-fuzz-build -func FuzzRootMetadataSigned \
+//       github.com/keybase/kbfs/libkbfs
+//   go-fuzz -bin libkbfs-fuzz.zip -workdir /tmp/fuzz/RootMetadataSigned
+
+// FuzzRootMetadataSigned is the go-fuzz target for signed MD objects.
+func FuzzRootMetadataSigned(data []byte) int {
+	return fuzzRootMetadataSigned(data)
+}
+
+// FuzzKeyBundles is the go-fuzz target for writer and reader key
+// bundles.
+func FuzzKeyBundles(data []byte) int {
+	return fuzzKeyBundles(data)
+}
+
+// FuzzBlock is the go-fuzz target for blocks.
+func FuzzBlock(data []byte) int {
+	return fuzzBlock(data)
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+)
+
+// The functions in this file are the bodies of the go-fuzz targets in
+// fuzz.go.  They live outside of it so that the unit tests can run
+// them over the seed corpus without the gofuzz build tag.  Each one
+// feeds untrusted bytes, as they'd arrive from a server, to the
+// decoders for one kind of on-wire structure, and panics if a
+// decoder either panics itself or fails with an untyped error.  As
+// go-fuzz expects, they return 1 if the input decoded, and 0
+// otherwise.
+
+// fuzzMetadataVersions are the MD versions that the MD fuzz target
+// tries to decode every input as.
+var fuzzMetadataVersions = []MetadataVer{
+	InitialExtraMetadataVer, SegregatedKeyBundlesVer,
+}
+
+func newFuzzCodec() kbfscodec.Codec {
+	codec := kbfscodec.NewMsgpack()
+	RegisterOps(codec)
+	return codec
+}
+
+func panicOnUntypedFuzzError(err error) {
+	panic(fmt.Sprintf("Unexpected error type %T: %v", err, err))
+}
+
+// fuzzRootMetadataSigned decodes data as a signed MD object of each
+// supported version, and validates whatever decodes.
+func fuzzRootMetadataSigned(data []byte) int {
+	codec := newFuzzCodec()
+	crypto := MakeCryptoCommon(codec)
+	ret := 0
+	for _, ver := range fuzzMetadataVersions {
+		rmds, err := DecodeRootMetadataSigned(codec, tlf.NullID, ver,
+			SegregatedKeyBundlesVer, data, time.Time{})
+		switch err.(type) {
+		case nil:
+		case MDDecodeError:
+			continue
+		default:
+			panicOnUntypedFuzzError(err)
+		}
+		ret = 1
+		// Validation has to reject anything malformed without
+		// panicking; its errors are deliberately untyped.
+		_ = rmds.IsValidAndSigned(codec, crypto, nil)
+		_, _ = rmds.MD.MakeBareTlfHandle(nil)
+	}
+	return ret
+}
+
+// fuzzKeyBundles decodes data as both a writer and a reader key
+// bundle.
+func fuzzKeyBundles(data []byte) int {
+	codec := newFuzzCodec()
+	crypto := MakeCryptoCommon(codec)
+	ret := 0
+	wkb, err := DecodeTLFWriterKeyBundleV3(codec, data)
+	switch err.(type) {
+	case nil:
+		ret = 1
+		_, _ = crypto.MakeTLFWriterKeyBundleID(wkb)
+		_ = wkb.IsWriter(keybase1.UID(""), keybase1.KID(""))
+	case KeyBundleDecodeError:
+	default:
+		panicOnUntypedFuzzError(err)
+	}
+	rkb, err := DecodeTLFReaderKeyBundleV3(codec, data)
+	switch err.(type) {
+	case nil:
+		ret = 1
+		_, _ = crypto.MakeTLFReaderKeyBundleID(rkb)
+	case KeyBundleDecodeError:
+	default:
+		panicOnUntypedFuzzError(err)
+	}
+	return ret
+}
+
+// fuzzBlock decodes data first as the encrypted container of a
+// block, as the block server returns it, and then as the padded
+// contents of a decrypted file and directory block, since random
+// inputs can't get through decryption.
+func fuzzBlock(data []byte) int {
+	codec := newFuzzCodec()
+	crypto := MakeCryptoCommon(codec)
+	ret := 0
+	var encryptedBlock EncryptedBlock
+	if err := codec.Decode(data, &encryptedBlock); err == nil {
+		ret = 1
+	}
+	for _, block := range []Block{NewFileBlock(), NewDirBlock()} {
+		switch err := crypto.decodePaddedBlock(data, block); err.(type) {
+		case nil:
+			ret = 1
+		case PaddedBlockReadError, BlockDecodeError:
+		default:
+			panicOnUntypedFuzzError(err)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,181 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// EnvTestFuzzCorpusDir is the environment variable name for a
+// directory into which TestFuzzCorpus writes the seed corpus of each
+// go-fuzz target, in the layout go-fuzz expects.
+const EnvTestFuzzCorpusDir = "KEYBASE_TEST_FUZZ_CORPUS_DIR"
+
+var fuzzTargets = map[string]func([]byte) int{
+	"RootMetadataSigned": fuzzRootMetadataSigned,
+	"KeyBundles":         fuzzKeyBundles,
+	"Block":              fuzzBlock,
+}
+
+// makeFuzzCorpus builds valid encodings of every structure that the
+// fuzz targets decode, keyed by target name, from the same kinds of
+// test vectors as the other unit tests.
+func makeFuzzCorpus(t *testing.T) map[string][][]byte {
+	ctx := context.Background()
+	codec := newFuzzCodec()
+	crypto := MakeCryptoCommon(codec)
+	signer := kbfscrypto.SigningKeySigner{
+		Key: kbfscrypto.MakeFakeSigningKeyOrBust("key"),
+	}
+	writer, reader := keybase1.MakeTestUID(1), keybase1.MakeTestUID(2)
+	bh, err := tlf.MakeHandle(
+		[]keybase1.UID{writer}, []keybase1.UID{reader}, nil, nil, nil)
+	require.NoError(t, err)
+
+	corpus := make(map[string][][]byte)
+	for _, ver := range fuzzMetadataVersions {
+		brmd, err := MakeInitialBareRootMetadata(
+			ver, tlf.FakeID(1, false), bh)
+		require.NoError(t, err)
+		extra, err := FakeInitialRekey(
+			brmd, crypto, bh, kbfscrypto.TLFPublicKey{})
+		require.NoError(t, err)
+		brmd.SetLastModifyingWriter(writer)
+		brmd.SetLastModifyingUser(writer)
+		brmd.SetSerializedPrivateMetadata([]byte{42})
+		err = brmd.SignWriterMetadataInternally(ctx, codec, signer)
+		require.NoError(t, err)
+		rmds, err := SignBareRootMetadata(
+			ctx, codec, signer, signer, brmd, time.Time{})
+		require.NoError(t, err)
+		buf, err := EncodeRootMetadataSigned(codec, rmds)
+		require.NoError(t, err)
+		corpus["RootMetadataSigned"] = append(
+			corpus["RootMetadataSigned"], buf)
+
+		if extraV3, ok := extra.(*ExtraMetadataV3); ok {
+			buf, err := codec.Encode(extraV3.GetWriterKeyBundle())
+			require.NoError(t, err)
+			corpus["KeyBundles"] = append(corpus["KeyBundles"], buf)
+			buf, err = codec.Encode(extraV3.GetReaderKeyBundle())
+			require.NoError(t, err)
+			corpus["KeyBundles"] = append(corpus["KeyBundles"], buf)
+		}
+	}
+
+	directFile := NewFileBlock().(*FileBlock)
+	directFile.Contents = []byte("hello")
+	indirectFile := NewFileBlock().(*FileBlock)
+	indirectFile.IsInd = true
+	indirectFile.IPtrs = []IndirectFilePtr{{
+		BlockInfo: BlockInfo{
+			BlockPointer: BlockPointer{
+				ID:           fakeBlockID(1),
+				KeyGen:       FirstValidKeyGen,
+				DataVer:      FirstValidDataVer,
+				BlockContext: makeFakeBlockContext(t),
+			},
+			EncodedSize: 100,
+		},
+		Off: 0,
+	}}
+	dir := NewDirBlock().(*DirBlock)
+	dir.Children["a"] = DirEntry{EntryInfo: EntryInfo{Type: File, Size: 5}}
+	dir.Children["b"] = DirEntry{EntryInfo: EntryInfo{Type: Dir}}
+	key := kbfscrypto.MakeBlockCryptKey([32]byte{0x1})
+	for _, block := range []Block{directFile, indirectFile, dir} {
+		encoded, err := codec.Encode(block)
+		require.NoError(t, err)
+		padded, err := crypto.padBlock(encoded)
+		require.NoError(t, err)
+		corpus["Block"] = append(corpus["Block"], padded)
+
+		_, encryptedBlock, err := crypto.EncryptBlock(
+			block, key, EncryptionSecretbox)
+		require.NoError(t, err)
+		buf, err := codec.Encode(encryptedBlock)
+		require.NoError(t, err)
+		corpus["Block"] = append(corpus["Block"], buf)
+	}
+	return corpus
+}
+
+// TestFuzzCorpus checks that every seed input decodes, and writes
+// the seed corpus out if EnvTestFuzzCorpusDir is set.
+func TestFuzzCorpus(t *testing.T) {
+	corpus := makeFuzzCorpus(t)
+	dir := os.Getenv(EnvTestFuzzCorpusDir)
+	for name, target := range fuzzTargets {
+		require.NotEmpty(t, corpus[name], name)
+		for i, data := range corpus[name] {
+			require.Equal(t, 1, target(data), "%s seed %d", name, i)
+			if dir == "" {
+				continue
+			}
+			corpusDir := filepath.Join(dir, name, "corpus")
+			require.NoError(t, os.MkdirAll(corpusDir, 0700))
+			err := ioutil.WriteFile(
+				filepath.Join(corpusDir, fmt.Sprintf("seed%d", i)),
+				data, 0600)
+			require.NoError(t, err)
+		}
+	}
+}
+
+// TestFuzzTargetsMutatedCorpus runs every fuzz target over a fixed
+// set of truncations and random mutations of its seed corpus, which
+// catches the shallowest decoder panics without go-fuzz.
+func TestFuzzTargetsMutatedCorpus(t *testing.T) {
+	corpus := makeFuzzCorpus(t)
+	r := rand.New(rand.NewSource(1))
+	for name, target := range fuzzTargets {
+		for _, seed := range corpus[name] {
+			for i := 0; i <= len(seed); i += 1 + len(seed)/50 {
+				target(seed[:i])
+			}
+			for i := 0; i < 200; i++ {
+				data := append([]byte(nil), seed...)
+				for j := 0; j < 1+r.Intn(4); j++ {
+					data[r.Intn(len(data))] = byte(r.Intn(256))
+				}
+				target(data)
+			}
+		}
+	}
+}
+
+func TestDecodeRootMetadataSignedNoMD(t *testing.T) {
+	codec := newFuzzCodec()
+	buf, err := codec.Encode(RootMetadataSigned{})
+	require.NoError(t, err)
+	for _, ver := range fuzzMetadataVersions {
+		_, err := DecodeRootMetadataSigned(codec, tlf.FakeID(1, false),
+			ver, SegregatedKeyBundlesVer, buf, time.Time{})
+		require.IsType(t, MDDecodeError{}, err)
+	}
+}
+
+func TestDepadBlockHugeLength(t *testing.T) {
+	crypto := MakeCryptoCommon(newFuzzCodec())
+	padded := make([]byte, 8)
+	binary.LittleEndian.PutUint32(padded, 0xffffffff)
+	_, err := crypto.depadBlock(padded)
+	require.IsType(t, PaddedBlockReadError{}, err)
+	_, err = crypto.depadBlock(padded[:2])
+	require.IsType(t, PaddedBlockReadError{}, err)
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"reflect"
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// A directory whose entries don't fit in one block is stored as a
+// tree of DirBlocks, like an indirect file.  The leaf blocks hold the
+// entries, split up by name: each IndirectDirPtr points to a block
+// holding the names from its Off up to (but not including) the Off
+// of the next pointer, in that block or the ones after it.  The
+// first pointer of the top block has an empty Off, so that it covers
+// every name before the second one.
+//
+// Pointers to the indirect blocks of a directory carry
+// IndirectDirsDataVer, so that clients that don't know about them
+// refuse the directory instead of taking it for an empty one.
+//
+// Lookups (see lookupDirEntry) and listing pages only fetch the leaf
+// blocks that can hold the names they want.  To modify the
+// directory, its top block is assembled (see assembleDirBlock) into
+// a single DirBlock holding all the entries, so that modifications
+// work just like they do for a direct block.  Assembled blocks are
+// only kept while the directory is dirty, never in the clean block
+// cache.  When the directory is synced, only the leaf blocks whose
+// entries changed are re-put (see folderBranchOps.readyDirBlock),
+// along with the blocks above them.
+
+const (
+	// dirEntrySizeEstimate is a conservative estimate of the
+	// encoded size of a directory entry, not counting its name,
+	// symlink path, long name and extended attributes.
+	dirEntrySizeEstimate = 256
+	// indirectDirPtrSizeEstimate is a conservative estimate of the
+	// encoded size of an IndirectDirPtr, not counting its offset.
+	indirectDirPtrSizeEstimate = 192
+)
+
+// estimateDirEntrySize estimates the number of bytes the given entry
+// takes up in an encoded directory block.
+func estimateDirEntrySize(name string, de DirEntry) uint64 {
+	size := uint64(dirEntrySizeEstimate + len(name) +
+		len(de.SymPath) + len(de.LongName))
+	for k, v := range de.Xattrs {
+		size += uint64(len(k) + len(v))
+	}
+	return size
+}
+
+// estimateDirSize estimates the number of bytes all the entries of
+// the given directory block take up once encoded.
+func estimateDirSize(dblock *DirBlock) uint64 {
+	var size uint64
+	for name, de := range dblock.Children {
+		size += estimateDirEntrySize(name, de)
+	}
+	return size
+}
+
+// assembleDirBlock returns the assembled form of the directory block
+// top: if it's indirect, a copy of it whose Children are the entries
+// of all its leaf blocks, fetched with getBlock.  A direct or already
+// assembled block is returned as is.
+func assembleDirBlock(ctx context.Context, top *DirBlock,
+	getBlock func(context.Context, BlockPointer) (*DirBlock, error)) (
+	*DirBlock, error) {
+	if !top.IsInd || top.assembled {
+		return top, nil
+	}
+
+	assembled := &DirBlock{
+		CommonBlock: CommonBlock{IsInd: true},
+		Children:    make(map[string]DirEntry),
+		assembled:   true,
+	}
+	encodedSize := top.GetEncodedSize()
+	var addPtrs func(iptrs []IndirectDirPtr) error
+	addPtrs = func(iptrs []IndirectDirPtr) error {
+		for _, iptr := range iptrs {
+			block, err := getBlock(ctx, iptr.BlockPointer)
+			if err != nil {
+				return err
+			}
+			encodedSize += iptr.EncodedSize
+			if block.IsInd {
+				assembled.innerPtrs = append(
+					assembled.innerPtrs, iptr.BlockInfo)
+				if err := addPtrs(block.IPtrs); err != nil {
+					return err
+				}
+				continue
+			}
+			assembled.IPtrs = append(assembled.IPtrs, iptr)
+			for name, de := range block.Children {
+				assembled.Children[name] = de
+			}
+		}
+		return nil
+	}
+	if err := addPtrs(top.IPtrs); err != nil {
+		return nil, err
+	}
+	// Account for the whole tree when caching the assembled block.
+	assembled.SetEncodedSize(encodedSize)
+	return assembled, nil
+}
+
+// dirChildIndex returns the index of the pointer in the indirect
+// directory block dblock that leads to the given name.
+func dirChildIndex(dblock *DirBlock, name string) int {
+	i := sort.Search(len(dblock.IPtrs), func(i int) bool {
+		return dblock.IPtrs[i].Off > name
+	})
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+// lookupDirEntry returns the entry with the given name in the
+// directory whose top block is top, and whether it exists.  For an
+// indirect directory, it only fetches the blocks, with getBlock, on
+// the way to the one leaf that can hold the name.
+func lookupDirEntry(ctx context.Context, top *DirBlock, name string,
+	getBlock func(context.Context, BlockPointer) (*DirBlock, error)) (
+	DirEntry, bool, error) {
+	dblock := top
+	for dblock.IsInd && !dblock.assembled {
+		if len(dblock.IPtrs) == 0 {
+			return DirEntry{}, false, nil
+		}
+		iptr := dblock.IPtrs[dirChildIndex(dblock, name)]
+		var err error
+		dblock, err = getBlock(ctx, iptr.BlockPointer)
+		if err != nil {
+			return DirEntry{}, false, err
+		}
+	}
+	de, ok := dblock.Children[name]
+	return de, ok, nil
+}
+
+// dirLeafUnchanged returns whether the leaf block holds exactly the
+// entries of dblock with the given names.
+func dirLeafUnchanged(leaf *DirBlock, dblock *DirBlock, names []string) bool {
+	if len(leaf.Children) != len(names) {
+		return false
+	}
+	for _, name := range names {
+		de, ok := leaf.Children[name]
+		if !ok || !reflect.DeepEqual(de, dblock.Children[name]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// getDirBlockForTest returns the (assembled) directory block of dir.
+func getDirBlockForTest(ctx context.Context, t *testing.T, config Config,
+	dir Node) *DirBlock {
+	ops := config.KBFSOps().(*KBFSOpsStandard).getOpsNoAdd(
+		dir.GetFolderBranch())
+	lState := makeFBOLockState()
+	p := ops.nodeCache.PathFromNode(dir)
+	dblock, err := ops.blocks.GetDirBlockForReading(ctx, lState,
+		ops.getHead(lState), p.tailPointer(), p.Branch, p)
+	require.NoError(t, err)
+	return dblock
+}
+
+// getDirPtrForTest returns the pointer to the block of dir.
+func getDirPtrForTest(config Config, dir Node) BlockPointer {
+	ops := config.KBFSOps().(*KBFSOpsStandard).getOpsNoAdd(
+		dir.GetFolderBranch())
+	return ops.nodeCache.PathFromNode(dir).tailPointer()
+}
+
+func checkDirChildrenForTest(ctx context.Context, t *testing.T,
+	config Config, dir Node, names []string) {
+	children, err := config.KBFSOps().GetDirChildren(ctx, dir)
+	require.NoError(t, err)
+	var got []string
+	for name := range children {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	require.Equal(t, names, got)
+}
+
+func TestIndirectDirSplitAndCollapse(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	// Two entries per leaf block, and three pointers per indirect
+	// block.
+	config.maxDirBlockBytes = 3*indirectDirPtrSizeEstimate + 10
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("f%02d", i)
+		_, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+		names = append(names, name)
+	}
+
+	dblock := getDirBlockForTest(ctx, t, config, rootNode)
+	require.True(t, dblock.IsInd)
+	require.Len(t, dblock.IPtrs, 10)
+	require.NotEmpty(t, dblock.innerPtrs)
+	require.Equal(t, "", dblock.IPtrs[0].Off)
+	require.Equal(t, "f02", dblock.IPtrs[1].Off)
+	checkDirChildrenForTest(ctx, t, config, rootNode, names)
+
+	// Older clients can't read the directory, and only the top
+	// block, not its assembled form, is cached.
+	ptr := getDirPtrForTest(config, rootNode)
+	require.Equal(t, IndirectDirsDataVer, ptr.DataVer)
+	block, err := config.BlockCache().Get(ptr)
+	require.NoError(t, err)
+	require.True(t, block.(*DirBlock).IsInd)
+	require.False(t, block.(*DirBlock).assembled)
+	require.Len(t, block.(*DirBlock).Children, 0)
+
+	// Changing one entry only replaces the leaf holding it.
+	fileNode, _, err := kbfsOps.Lookup(ctx, rootNode, "f05")
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	newDblock := getDirBlockForTest(ctx, t, config, rootNode)
+	require.Len(t, newDblock.IPtrs, len(dblock.IPtrs))
+	for i, iptr := range newDblock.IPtrs {
+		if i == 2 {
+			require.NotEqual(t, dblock.IPtrs[i], iptr)
+		} else {
+			require.Equal(t, dblock.IPtrs[i], iptr)
+		}
+	}
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), ei.Size)
+
+	// Another device sees the whole directory.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	checkDirChildrenForTest(ctx, t, config2, rootNode2, names)
+	_, ei, err = config2.KBFSOps().Lookup(ctx, rootNode2, "f05")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), ei.Size)
+
+	// Removing most of the entries makes the directory direct
+	// again.
+	for _, name := range names[1:] {
+		err := kbfsOps.RemoveEntry(ctx, rootNode, name)
+		require.NoError(t, err)
+	}
+	dblock = getDirBlockForTest(ctx, t, config, rootNode)
+	require.False(t, dblock.IsInd)
+	require.Len(t, dblock.IPtrs, 0)
+	require.True(t,
+		getDirPtrForTest(config, rootNode).DataVer < IndirectDirsDataVer)
+	checkDirChildrenForTest(ctx, t, config, rootNode, names[:1])
+
+	err = config2.KBFSOps().SyncFromServerForTesting(
+		ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	checkDirChildrenForTest(ctx, t, config2, rootNode2, names[:1])
+}
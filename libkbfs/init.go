@@ -16,6 +16,7 @@ import (
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
 )
 
 // InitParams contains the initialization parameters for Init(). It is
@@ -48,6 +49,24 @@ type InitParams struct {
 	// Fake local user name. If non-empty, either ServerInMemory
 	// must be true or ServerRootDir must be non-empty.
 	LocalUser string
+	// If non-empty, the path of the unix socket of a key agent
+	// that holds the device's private keys and does all the
+	// signing and decryption with them.  Ignored if LocalUser is
+	// non-empty.
+	KeyAgentSocket string
+	// KeyHalfDir, if non-empty, is a directory in which to keep the
+	// crypt key server halves, instead of on the Keybase key
+	// server; see KeyServerStore.  Ignored when the MD server is
+	// local.
+	KeyHalfDir string
+	// KeyHalfSocket, if non-empty, is the unix socket of a separate
+	// service in which to keep the crypt key server halves; see
+	// KeyHalfStoreClient.  Ignored if KeyHalfDir is non-empty.
+	KeyHalfSocket string
+	// KeyHalfAuditInterval, if non-zero, audits the crypt key
+	// server halves of the favorite TLFs at this interval; see
+	// AuditTLFKeyHalves.
+	KeyHalfAuditInterval time.Duration
 
 	// TLFValidDuration is the duration that TLFs are valid
 	// before marked for lazy revalidation.
@@ -57,6 +76,12 @@ type InitParams struct {
 	// when creating new metadata.
 	MetadataVersion int
 
+	// BlockEncryptionVersion, if non-zero, is the version of
+	// encryption to use for new blocks.  Blocks encrypted with
+	// EncryptionAESGCM can't be read by clients older than
+	// AESGCMDataVer.
+	BlockEncryptionVersion int
+
 	// LogToFile if true, logs to a default file location.
 	LogToFile bool
 
@@ -72,8 +97,111 @@ type InitParams struct {
 	// directory to put write journals in. If non-empty, enables
 	// write journaling to be turned on for TLFs.
 	WriteJournalRoot string
+
+	// TLFJournalLimits bounds the disk space used by each TLF's
+	// write journal. Only has an effect when WriteJournalRoot is
+	// non-empty.
+	TLFJournalLimits TLFJournalLimits
+
+	// DiskLimits bounds the combined disk space used by all the
+	// local stores, e.g. the write journals and the read replica
+	// block cache, relative to the free space on the disk holding
+	// the data directory.  They can be changed at runtime via
+	// Config.DiskLimiter().
+	DiskLimits DiskLimits
+
+	// EncryptLocalStorage, if true, seals the block data of new
+	// write journals with per-device storage keys.  Only has an
+	// effect when WriteJournalRoot is non-empty.
+	EncryptLocalStorage bool
+
+	// ReadReplicaPollInterval, if non-zero, runs KBFS as a read
+	// replica that polls for new TLF heads at this interval.  Read
+	// replicas reject all writes and never use a write journal,
+	// regardless of WriteJournalRoot.
+	ReadReplicaPollInterval time.Duration
+	// ReadReplicaCacheDir is where a read replica caches the blocks
+	// it fetches.  It may be shared by many replicas running as
+	// the same local user; see BlockServerReadReplica.  If empty, a directory under the
+	// data dir is used.  Only has an effect when
+	// ReadReplicaPollInterval is non-zero.
+	ReadReplicaCacheDir string
+
+	// FavoritesCacheDir, if non-empty, is where the logged-in
+	// user's favorites list is cached, so that it's available,
+	// and can be changed, while the servers can't be reached.
+	FavoritesCacheDir string
+
+	// MDDiskCacheDir, if non-empty, is where the latest fetched
+	// head of each folder, and its key bundles, are cached, so
+	// that folders can be shown after a restart without fetching
+	// their heads again first.  It's off by default, since a
+	// cached head may be stale, and writes made on top of it
+	// before catching up end up in conflict resolution.
+	MDDiskCacheDir string
+
+	// MDCacheCapacity, if non-zero, overrides the number of
+	// entries in the MD and key caches.
+	MDCacheCapacity int
+	// BlockCacheCapacity, if non-zero, overrides the number of
+	// transient entries in the clean block cache, and
+	// BlockCacheBytesCapacity overrides its total size in bytes.
+	BlockCacheCapacity      int
+	BlockCacheBytesCapacity uint64
+	// BlockCacheAutoTuneMaxBytes, if non-zero, turns on automatic
+	// tuning of the clean block cache's byte capacity, based on
+	// its hit rate and working set, between
+	// BlockCacheAutoTuneMinBytes and this.
+	BlockCacheAutoTuneMinBytes int64
+	BlockCacheAutoTuneMaxBytes int64
+	// DirtyMemoryHeapTarget, if non-zero, overrides the heap size
+	// above which the limit on memory used by dirty data is
+	// lowered.
+	DirtyMemoryHeapTarget int64
+
+	// BandwidthLimits caps the rate of background traffic, such
+	// as journal flushes, prefetches and rekeys.  They can be
+	// changed at runtime via Config.BandwidthLimiter().
+	BandwidthLimits BandwidthLimits
+
+	// LowMemoryMode, if true, keeps memory usage down at the cost
+	// of performance, for running inside apps with tight memory
+	// budgets: it shrinks the caches (unless their sizes are given
+	// explicitly), caps the number of concurrent block operations,
+	// and doesn't cache synced file blocks.
+	LowMemoryMode bool
+
+	// StrictTimes, if true, updates file mtimes and ctimes on
+	// every write rather than on every sync.
+	StrictTimes bool
+
+	// StoreSpecialFiles, if true, stores named pipes and sockets
+	// created through the mount, rather than refusing to create
+	// them.
+	StoreSpecialFiles bool
+
+	// CaseInsensitive, if true, matches names case-insensitively
+	// in lookups and creates.
+	CaseInsensitive bool
+
+	// NormalizeNames, if true, stores new entries under the NFC
+	// forms of their names, and matches lookups in either form.
+	NormalizeNames bool
+
+	// TraceCapacity, if non-zero, turns on operation tracing, and
+	// is the number of the most recent spans to keep; see Tracer.
+	TraceCapacity int
+
+	// AdditionalProtocolCreators are called to create extra RPC
+	// protocols, such as SimpleFS, that KBFS serves to the
+	// Keybase service.
+	AdditionalProtocolCreators []AdditionalProtocolCreator
 }
 
+// AdditionalProtocolCreator creates an additional protocol for KBFS
+// to serve over its connection to the Keybase service.
+type AdditionalProtocolCreator func(Context, Config) (rpc.Protocol, error)
+
 // GetDefaultBServer returns the default value for the -bserver flag.
 func GetDefaultBServer(ctx Context) string {
 	switch ctx.GetRunMode() {
@@ -129,6 +257,10 @@ func DefaultInitParams(ctx Context) InitParams {
 		},
 		TLFJournalBackgroundWorkStatus: TLFJournalBackgroundWorkEnabled,
 		WriteJournalRoot:               filepath.Join(ctx.GetDataDir(), "kbfs_journal"),
+		FavoritesCacheDir:              filepath.Join(ctx.GetDataDir(), "kbfs_favorites"),
+		DiskLimits: DiskLimits{
+			MaxFreeSpaceFraction: diskLimitFreeSpaceFractionDefault,
+		},
 	}
 }
 
@@ -149,6 +281,10 @@ func AddFlags(flags *flag.FlagSet, ctx Context) *InitParams {
 	flags.BoolVar(&params.MDServerInMemory, "mdserver-in-memory", false, "use in-memory mdserver (and ignore -mdserver, and -server-root for the mdserver)")
 	flags.StringVar(&params.ServerRootDir, "server-root", "", "directory to put local server files (and ignore -bserver and -mdserver)")
 	flags.StringVar(&params.LocalUser, "localuser", "", "fake local user (used only with -server-in-memory or -server-root)")
+	flags.StringVar(&params.KeyHalfDir, "key-half-dir", "", "(EXPERIMENTAL) directory in which to keep the server halves of folder keys, instead of on the Keybase key server")
+	flags.StringVar(&params.KeyHalfSocket, "key-half-store", "", "(EXPERIMENTAL) unix socket of a service in which to keep the server halves of folder keys, instead of on the Keybase key server")
+	flags.StringVar(&params.KeyAgentSocket, "key-agent", "", "(EXPERIMENTAL) unix socket of a key agent that holds the device keys, so they never live in KBFS memory")
+	flags.DurationVar(&params.KeyHalfAuditInterval, "key-half-audit-interval", 0, "(EXPERIMENTAL) If non-zero, check the key server halves of the favorite TLFs against their MACs at this interval")
 	flags.DurationVar(&params.TLFValidDuration, "tlf-valid", defaultParams.TLFValidDuration, "time tlfs are valid before redoing identification")
 	flags.BoolVar(&params.LogToFile, "log-to-file", false, fmt.Sprintf("Log to default file: %s", defaultLogPath(ctx)))
 	flags.StringVar(&params.LogFileConfig.Path, "log-file", "", "Path to log file")
@@ -163,7 +299,32 @@ func AddFlags(flags *flag.FlagSet, ctx Context) *InitParams {
 	// params.TLFJournalBackgroundWorkStatus via a flag.
 	params.TLFJournalBackgroundWorkStatus = defaultParams.TLFJournalBackgroundWorkStatus
 
+	flags.BoolVar(&params.EncryptLocalStorage, "encrypt-local-storage", false, "(EXPERIMENTAL) Seal the block data of new write journals with a per-device storage key wrapped by the device key")
+	flags.Var(SizeFlag{&params.TLFJournalLimits.MaxUnflushedBytes}, "journal-max-unflushed-bytes", "(EXPERIMENTAL) Maximum unflushed block data per TLF journal; 0 for no limit")
+	flags.Uint64Var(&params.TLFJournalLimits.MaxEntries, "journal-max-entries", 0, "(EXPERIMENTAL) Maximum number of unflushed entries per TLF journal; 0 for no limit")
+	flags.BoolVar(&params.TLFJournalLimits.BlockWhenFull, "journal-block-when-full", false, "(EXPERIMENTAL) Make writes to a full TLF journal wait for it to flush, instead of failing")
+	flags.Float64Var(&params.DiskLimits.MaxFreeSpaceFraction, "disk-limit-fraction", defaultParams.DiskLimits.MaxFreeSpaceFraction, "Maximum fraction of the available disk space used by all local stores together, e.g. journals; 0 for no limit")
+	flags.Var(SizeFlag{&params.DiskLimits.MaxBytes}, "disk-limit-max-bytes", "Maximum disk space used by all local stores together, regardless of free space; 0 for no limit")
+
+	flags.DurationVar(&params.ReadReplicaPollInterval, "read-replica-poll-interval", 0, "(EXPERIMENTAL) If non-zero, run as a read-only replica that polls for TLF updates at this interval")
+	flags.StringVar(&params.ReadReplicaCacheDir, "read-replica-cache-dir", "", "(EXPERIMENTAL) Directory, possibly shared by many read replicas running as the same local user, in which to cache blocks")
+	flags.StringVar(&params.FavoritesCacheDir, "favorites-cache-dir", defaultParams.FavoritesCacheDir, "If non-empty, cache the favorites list in the given directory, for use while offline")
+	flags.StringVar(&params.MDDiskCacheDir, "md-disk-cache-dir", "", "(EXPERIMENTAL) If non-empty, cache the latest head of each folder in the given directory, for use after a restart")
+
+	flags.Var(SizeFlag{&params.BandwidthLimits.UploadBytesPerSecond}, "upload-bandwidth-limit", "Maximum bytes per second of background uploads, e.g. journal flushes; 0 for no limit")
+	flags.Var(SizeFlag{&params.BandwidthLimits.DownloadBytesPerSecond}, "download-bandwidth-limit", "Maximum bytes per second of background downloads, e.g. prefetches; 0 for no limit")
+	flags.Var(SizeFlag{&params.BlockCacheAutoTuneMinBytes}, "block-cache-auto-tune-min", "Lower bound for automatic tuning of the block cache's size")
+	flags.Var(SizeFlag{&params.BlockCacheAutoTuneMaxBytes}, "block-cache-auto-tune-max", "If non-zero, automatically tune the block cache's size, based on its hit rate, up to this many bytes")
+	flags.Var(SizeFlag{&params.DirtyMemoryHeapTarget}, "dirty-memory-heap-target", "Heap size above which to let less dirty data build up before syncing (0 for the default)")
+	flags.BoolVar(&params.LowMemoryMode, "low-memory", false, "Keep memory usage down at the cost of performance, e.g. on mobile devices")
+	flags.BoolVar(&params.StrictTimes, "strict-times", false, "Update file mtimes and ctimes on every write, rather than on every sync")
+	flags.BoolVar(&params.StoreSpecialFiles, "store-special-files", false, "Store named pipes and sockets created through the mount, rather than refusing to create them")
+	flags.BoolVar(&params.CaseInsensitive, "case-insensitive", false, "Match names case-insensitively, refusing to create entries whose names differ from existing ones only in case")
+	flags.BoolVar(&params.NormalizeNames, "normalize-names", false, "Store new entry names in Unicode NFC form, and match names in NFC or NFD form interchangeably")
+
+	flags.IntVar(&params.TraceCapacity, "trace-capacity", 0, "If non-zero, trace operations, keeping this many of the most recent spans for the trace file")
 	flags.IntVar(&params.MetadataVersion, "md-version", defaultParams.MetadataVersion, "Metadata version to use when creating new metadata")
+	flags.IntVar(&params.BlockEncryptionVersion, "block-encryption-version", 0, "(EXPERIMENTAL) Encryption version to use for new blocks: 1 for NaCl secretbox (the default), or 2 for AES-256-GCM, which is faster on CPUs with AES instructions, but can't be read by older clients")
 	return &params
 }
 
@@ -190,7 +351,8 @@ func makeMDServer(config Config, serverInMemory bool, serverRootDir, mdserverAdd
 	return mdServer, nil
 }
 
-func makeKeyServer(config Config, serverInMemory bool, serverRootDir, keyserverAddr string) (
+func makeKeyServer(config Config, serverInMemory bool, serverRootDir,
+	keyserverAddr, keyHalfDir, keyHalfSocket string, ctx Context) (
 	KeyServer, error) {
 	if serverInMemory {
 		// local in-memory key server
@@ -203,6 +365,18 @@ func makeKeyServer(config Config, serverInMemory bool, serverRootDir, keyserverA
 		return NewKeyServerDir(config, keyPath)
 	}
 
+	if len(keyHalfDir) > 0 {
+		// server halves in a directory of the user's choosing
+		return NewKeyServerStore(
+			config, NewKeyHalfStoreDir(keyHalfDir)), nil
+	}
+
+	if len(keyHalfSocket) > 0 {
+		// server halves in a separate local service
+		return NewKeyServerStore(config,
+			NewKeyHalfStoreClient(config, ctx, keyHalfSocket)), nil
+	}
+
 	if len(keyserverAddr) == 0 {
 		return nil, errors.New("Empty key server address")
 	}
@@ -303,9 +477,53 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 		os.Exit(1)
 	}()
 
+	config, err := doInit(ctx, params, keybaseServiceCn, log)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// doInit constructs a config from the given params, without
+// touching any process-wide state like signal handlers or profiling.
+func doInit(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn,
+	log logger.Logger) (*ConfigLocal, error) {
 	config := NewConfigLocal()
 
-	config.SetBlockOps(NewBlockOpsStandard(config, defaultBlockRetrievalWorkerQueueSize))
+	if params.LowMemoryMode {
+		// Rebuild the default caches at their low-memory sizes,
+		// before any sizes given explicitly replace them.
+		config.SetLowMemoryMode(true)
+		config.ResetCaches()
+	}
+	if params.MDCacheCapacity > 0 {
+		config.SetMDCache(NewMDCacheStandard(params.MDCacheCapacity))
+		config.SetKeyCache(NewKeyCacheStandard(params.MDCacheCapacity))
+		config.SetKeyBundleCache(
+			NewKeyBundleCacheStandard(params.MDCacheCapacity * 2))
+	}
+	if params.BlockCacheCapacity > 0 {
+		config.SetBlockCache(NewBlockCacheStandard(
+			params.BlockCacheCapacity, params.BlockCacheBytesCapacity))
+	}
+
+	config.BandwidthLimiter().SetLimits(params.BandwidthLimits)
+	config.SetDiskLimiter(NewDiskLimiterStandard(
+		config.Clock(), ctx.GetDataDir(), params.DiskLimits))
+	config.SetStrictTimes(params.StrictTimes)
+	config.SetStoreSpecialFiles(params.StoreSpecialFiles)
+	config.SetCaseInsensitive(params.CaseInsensitive)
+	config.SetNormalizeNames(params.NormalizeNames)
+	config.SetEncryptLocalStorage(params.EncryptLocalStorage)
+	if params.TraceCapacity > 0 {
+		config.SetTracer(NewTracer(config.Clock(), params.TraceCapacity))
+	}
+
+	blockOpsQueueSize := defaultBlockRetrievalWorkerQueueSize
+	if params.LowMemoryMode {
+		blockOpsQueueSize = lowMemoryBlockRetrievalWorkerQueueSize
+	}
+	config.SetBlockOps(NewBlockOpsStandard(config, blockOpsQueueSize))
 
 	bsplitter, err := NewBlockSplitterSimple(MaxBlockSizeBytesDefault, 8*1024,
 		config.Codec())
@@ -322,33 +540,76 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 		keyBundleCache := config.KeyBundleCache()
 		keyBundleCache = NewKeyBundleCacheMeasured(keyBundleCache, registry)
 		config.SetKeyBundleCache(keyBundleCache)
+
+		config.SetBlockOps(NewBlockOpsMeasured(config.BlockOps(), registry))
+
+		// Grab the block cache now, before journaling wraps it.
+		bcache, _ := config.BlockCache().(*BlockCacheStandard)
+		registerStateMetrics(config, bcache, registry)
 	}
 
 	// Set logging
-	config.SetLoggerMaker(func(module string) logger.Logger {
-		mname := "kbfs"
-		if module != "" {
-			mname += fmt.Sprintf("(%s)", module)
-		}
-		// Add log depth so that context-based messages get the right
-		// file printed out.
-		lg := logger.NewWithCallDepth(mname, 1)
-		if params.Debug {
-			// Turn on debugging.  TODO: allow a proper log file and
-			// style to be specified.
-			lg.Configure("", true, "")
+	logFileConfig := params.LogFileConfig
+	if params.LogToFile {
+		logFileConfig.Path = defaultLogPath(ctx)
+	}
+	logControl, err := NewLogControl(
+		LogSettings{Debug: params.Debug}, logFileConfig)
+	if err != nil {
+		return nil, err
+	}
+	config.SetLogControl(logControl)
+	config.SetLoggerMaker(logControl.MakeLogger)
+
+	if params.BlockCacheAutoTuneMaxBytes > 0 {
+		if params.BlockCacheAutoTuneMinBytes < 0 ||
+			params.BlockCacheAutoTuneMinBytes >
+				params.BlockCacheAutoTuneMaxBytes {
+			return nil, fmt.Errorf(
+				"Invalid block cache auto-tune bounds: %d to %d",
+				params.BlockCacheAutoTuneMinBytes,
+				params.BlockCacheAutoTuneMaxBytes)
 		}
-		return lg
-	})
+		config.enableBlockCacheTuning(
+			uint64(params.BlockCacheAutoTuneMinBytes),
+			uint64(params.BlockCacheAutoTuneMaxBytes))
+	}
+
+	if params.DirtyMemoryHeapTarget < 0 {
+		return nil, fmt.Errorf("Invalid dirty memory heap target: %d",
+			params.DirtyMemoryHeapTarget)
+	}
+	config.setDirtyMemoryHeapTarget(uint64(params.DirtyMemoryHeapTarget))
 
 	config.SetMetadataVersion(MetadataVer(params.MetadataVersion))
+	if params.BlockEncryptionVersion != 0 {
+		ver := EncryptionVer(params.BlockEncryptionVersion)
+		if _, err := blockCipherForVersion(ver); err != nil {
+			return nil, err
+		}
+		config.SetBlockEncryptionVersion(ver)
+	}
 	config.SetTLFValidDuration(params.TLFValidDuration)
 
 	kbfsOps := NewKBFSOpsStandard(config)
+	if len(params.FavoritesCacheDir) > 0 {
+		kbfsOps.favs.EnableDiskCache(params.FavoritesCacheDir)
+	}
 	config.SetKBFSOps(kbfsOps)
 	config.SetNotifier(kbfsOps)
 	config.SetKeyManager(NewKeyManagerStandard(config))
-	config.SetMDOps(NewMDOpsStandard(config))
+	mdOpsStandard := NewMDOpsStandard(config)
+	// Heads cached from an in-memory MD server would refer to
+	// folders that no longer exist after a restart.
+	if len(params.MDDiskCacheDir) > 0 &&
+		!(params.ServerInMemory || params.MDServerInMemory) {
+		mdOpsStandard.EnableDiskCache(params.MDDiskCacheDir)
+	}
+	var mdOps MDOps = mdOpsStandard
+	if registry := config.MetricsRegistry(); registry != nil {
+		mdOps = NewMDOpsMeasured(mdOps, registry)
+	}
+	config.SetMDOps(mdOps)
 
 	if keybaseServiceCn == nil {
 		keybaseServiceCn = keybaseDaemon{}
@@ -389,9 +650,11 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 	}
 	config.SetMDServer(mdServer)
 
-	// note: the mdserver is the keyserver at the moment.
+	// note: unless the server halves are kept elsewhere, the
+	// mdserver is the keyserver at the moment.
 	keyServer, err := makeKeyServer(
-		config, params.ServerInMemory || params.MDServerInMemory, params.ServerRootDir, params.MDServerAddr)
+		config, params.ServerInMemory || params.MDServerInMemory, params.ServerRootDir, params.MDServerAddr,
+		params.KeyHalfDir, params.KeyHalfSocket, ctx)
 	if err != nil {
 		return nil, fmt.Errorf("problem creating key server: %v", err)
 	}
@@ -407,18 +670,42 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 		return nil, fmt.Errorf("cannot open block database: %v", err)
 	}
 
+	if params.ReadReplicaPollInterval > 0 {
+		cacheDir := params.ReadReplicaCacheDir
+		if len(cacheDir) == 0 {
+			cacheDir = filepath.Join(
+				ctx.GetDataDir(), "kbfs_read_replica_cache")
+		}
+		log.Debug("Running as a read replica, caching blocks in %s",
+			cacheDir)
+		bserv = NewBlockServerReadReplica(
+			blockServerLocalConfigAdapter{config}, config.KBPKI(),
+			bserv, cacheDir, config.DiskLimiter())
+		config.SetReadReplicaPollInterval(params.ReadReplicaPollInterval)
+		// Replicas never write, so they can't reclaim quota.
+		config.qrPeriod = 0
+	}
+
 	if registry := config.MetricsRegistry(); registry != nil {
 		bserv = NewBlockServerMeasured(bserv, registry)
 	}
 
 	config.SetBlockServer(bserv)
 
+	if params.KeyHalfAuditInterval > 0 {
+		config.enableKeyHalfAudits(params.KeyHalfAuditInterval)
+	}
+
 	// TODO: Don't turn on journaling if -server-in-memory is
 	// used.
 
-	if len(params.WriteJournalRoot) > 0 {
+	if len(params.WriteJournalRoot) > 0 &&
+		params.ReadReplicaPollInterval == 0 {
 		config.EnableJournaling(params.WriteJournalRoot,
 			params.TLFJournalBackgroundWorkStatus)
+		if jServer, err := GetJournalServer(config); err == nil {
+			jServer.SetTLFJournalLimits(params.TLFJournalLimits)
+		}
 	}
 
 	return config, nil
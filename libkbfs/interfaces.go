@@ -5,11 +5,13 @@
 package libkbfs
 
 import (
+	"os"
 	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
+	merkle "github.com/keybase/go-merkle-tree"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
@@ -57,6 +59,30 @@ type Node interface {
 	GetBasename() string
 }
 
+// BatchOps are the modifying operations that can be staged in a
+// batch by KBFSOps.RunBatch.  Each behaves like the KBFSOps method of
+// the same name, and later operations see the effects of earlier
+// ones, but nothing is written to the MD server until the batch
+// commits.  An operation that returns an error has no effect on the
+// batch.  Writes and truncates are synced as part of the batch.
+// Creates are never exclusive.
+type BatchOps interface {
+	CreateDir(ctx context.Context, dir Node, name string) (
+		Node, EntryInfo, error)
+	CreateFile(ctx context.Context, dir Node, name string, isExec bool) (
+		Node, EntryInfo, error)
+	CreateLink(ctx context.Context, dir Node, fromName string,
+		toPath string) (EntryInfo, error)
+	RemoveDir(ctx context.Context, dir Node, dirName string) error
+	RemoveEntry(ctx context.Context, dir Node, name string) error
+	Rename(ctx context.Context, oldParent Node, oldName string,
+		newParent Node, newName string) error
+	Write(ctx context.Context, file Node, data []byte, off int64) error
+	Truncate(ctx context.Context, file Node, size uint64) error
+	SetEx(ctx context.Context, file Node, ex bool) error
+	SetMtime(ctx context.Context, file Node, mtime *time.Time) error
+}
+
 // KBFSOps handles all file system operations.  Expands all indirect
 // pointers.  Operations that modify the server data change all the
 // block IDs along the path, and so must return a path with the new
@@ -90,10 +116,28 @@ type Node interface {
 // Context derived from it), allowing the caller to determine whether
 // the notification is a result of their own action or an external
 // action.
+//
+// All methods are safe to call concurrently, from any number of
+// goroutines, on any mix of folders and nodes; embedders don't need
+// any locking of their own.  Operations on the same folder-branch
+// are serialized internally as needed, so concurrent writes to the
+// same file or directory are applied in some order, but not
+// necessarily the order in which the calls were made.  The only
+// exception is Shutdown, which must not be called concurrently with
+// any other method (including via Config.Shutdown).
 type KBFSOps interface {
 	// GetFavorites returns the logged-in user's list of favorite
 	// top-level folders.  This is a remote-access operation.
 	GetFavorites(ctx context.Context) ([]Favorite, error)
+	// GetFavoritesWithMetadata is like GetFavorites, but also
+	// returns the latest revision, modification time and writer of
+	// each favorite folder, and whether it has changed since this
+	// device last caught up with it, so that folders can be sorted
+	// by recent activity.  It fetches the head of every favorite
+	// folder, a few at a time, so it's much more expensive than
+	// GetFavorites.
+	GetFavoritesWithMetadata(ctx context.Context) (
+		[]FavoriteWithMetadata, error)
 	// RefreshCachedFavorites tells the instances to forget any cached
 	// favorites list and fetch a new list from the server.  The
 	// effects are asychronous; if there's an error refreshing the
@@ -136,6 +180,17 @@ type KBFSOps interface {
 	// permission for the top-level folder.  This is a remote-access
 	// operation.
 	GetDirChildren(ctx context.Context, dir Node) (map[string]EntryInfo, error)
+	// GetDirChildrenPaged returns up to limit children of the
+	// directory, in name order, starting just after the name given
+	// by cursor (or at the beginning, if cursor is empty).  A
+	// non-positive limit returns all the remaining children.  The
+	// returned cursor can be passed in to get the next page; it's
+	// empty once there are no more children.  Unlike
+	// GetDirChildren, this never holds more than a page of the
+	// directory in memory at once, beyond the directory blocks
+	// themselves.
+	GetDirChildrenPaged(ctx context.Context, dir Node, cursor string,
+		limit int) (children []DirChild, nextCursor string, err error)
 	// Lookup returns the Node and entry info associated with a
 	// given name in a directory, if the logged-in user has read
 	// permissions to the top-level folder.  The returned Node is nil
@@ -167,6 +222,14 @@ type KBFSOps interface {
 	// is a remote-sync operation.
 	CreateLink(ctx context.Context, dir Node, fromName string, toPath string) (
 		EntryInfo, error)
+	// CreateSpecialFile creates a new special file, like a named
+	// pipe, of the given type under the given node, if the
+	// logged-in user has write permission to the top-level folder.
+	// Special files have no contents and get no Node of their own.
+	// Returns the new entry info for the created special file.
+	// This is a remote-sync operation.
+	CreateSpecialFile(ctx context.Context, dir Node, name string,
+		special SpecialFileType) (EntryInfo, error)
 	// RemoveDir removes the subdirectory represented by the given
 	// node, if the logged-in user has write permission to the
 	// top-level folder.  Will return an error if the subdirectory is
@@ -176,6 +239,25 @@ type KBFSOps interface {
 	// given node, if the logged-in user has write permission to the
 	// top-level folder.  This is a remote-sync operation.
 	RemoveEntry(ctx context.Context, dir Node, name string) error
+	// RemoveEntryIfUnchanged is like RemoveEntry, but only removes
+	// the entry if it still refers to the given node, as of the
+	// latest revision known to this device.  If the entry has
+	// since been replaced, it is left alone, and
+	// EntryReplacedError is returned.
+	RemoveEntryIfUnchanged(
+		ctx context.Context, dir Node, name string, node Node) error
+	// EstimateCopy estimates the cost of creating the given tree
+	// of entries within the given directory, by simulating block
+	// splitting and MD updates without writing anything.  Returns
+	// an error if any of the top-level entries already exists.
+	// This is a remote-access operation.
+	EstimateCopy(ctx context.Context, dir Node, entries []DryRunEntry) (
+		CostEstimate, error)
+	// EstimateRemove estimates the cost of recursively removing the
+	// named entry from the given directory, without removing
+	// anything.  This is a remote-access operation.
+	EstimateRemove(ctx context.Context, dir Node, name string) (
+		CostEstimate, error)
 	// Rename performs an atomic rename operation with a given
 	// top-level folder if the logged-in user has write permission to
 	// that folder, and will return an error if nodes from different
@@ -208,6 +290,13 @@ type KBFSOps interface {
 	// the necessary blocks have been locally cached.  This is a
 	// remote-access operation.
 	Write(ctx context.Context, file Node, data []byte, off int64) error
+	// Append writes the given data at the end of the file at the
+	// given node, if the logged-in user has write permission to the
+	// top-level folder, and returns the offset it was written at.
+	// Unlike a Write at the file's size, concurrent appends on this
+	// device never overwrite each other.  This is a remote-access
+	// operation.
+	Append(ctx context.Context, file Node, data []byte) (int64, error)
 	// Truncate modifies the file at the given node, by either
 	// shrinking or extending its size to match the given size, if the
 	// logged-in user has write permission to the top-level folder.
@@ -221,34 +310,169 @@ type KBFSOps interface {
 	// permissions to the top-level folder.  This is a remote-sync
 	// operation.
 	SetEx(ctx context.Context, file Node, ex bool) error
+	// SetAppendOnly turns on or off the append-only flag of the
+	// file represented by a given node, if the logged-in user has
+	// write permissions to the top-level folder.  Writes to an
+	// append-only file anywhere but at its end, and truncates of
+	// it, fail with AppendOnlyError.  This is a remote-sync
+	// operation.
+	SetAppendOnly(ctx context.Context, file Node, appendOnly bool) error
+	// SetPerm sets the owner permission bits (perm & 0700) of the
+	// file or directory represented by a given node, if the
+	// logged-in user has write permissions to the top-level folder.
+	// Setting the owner-exec bit of a file is equivalent to SetEx.
+	// It is a noop on symlinks.  This is a remote-sync operation.
+	SetPerm(ctx context.Context, node Node, perm os.FileMode) error
 	// SetMtime sets the modification time on the file represented by
 	// a given node, if the logged-in user has write permissions to
 	// the top-level folder.  If mtime is nil, it is a noop.  This is
 	// a remote-sync operation.
 	SetMtime(ctx context.Context, file Node, mtime *time.Time) error
+	// SetXattr sets the named extended attribute of the file or
+	// directory represented by a given node, if the logged-in user
+	// has write permissions to the top-level folder.  The
+	// attributes are stored in the entry, and are returned in its
+	// EntryInfo.  This is a remote-sync operation.
+	SetXattr(ctx context.Context, node Node, name string, value []byte) error
+	// RemoveXattr removes the named extended attribute of the file
+	// or directory represented by a given node, if the logged-in
+	// user has write permissions to the top-level folder.  It
+	// returns NoSuchXattrError if there is no such attribute.  This
+	// is a remote-sync operation.
+	RemoveXattr(ctx context.Context, node Node, name string) error
 	// Sync flushes all outstanding writes and truncates for the given
 	// file to the KBFS servers, if the logged-in user has write
 	// permissions to the top-level folder.  If done through a file
 	// system interface, this may include modifications done via
 	// multiple file handles.  This is a remote-sync operation.
 	Sync(ctx context.Context, file Node) error
+	// RunBatch calls fn, and commits all the changes fn makes
+	// through tx as a single MD revision once fn returns nil, so
+	// that other clients (and this device, after a crash) see
+	// either all of them or none.  If fn, or the commit, returns an
+	// error, none of the changes are made and that error is
+	// returned.  All the nodes given to tx must be in the same
+	// folder-branch.  Other writes to that folder-branch wait until
+	// the batch is done, so fn must not call any modifying KBFSOps
+	// methods itself.  This is a remote-sync operation.
+	RunBatch(ctx context.Context, fn func(tx BatchOps) error) error
+	// LockFileRange locks length bytes of the file at the given
+	// node, starting at off, against other range locks on the
+	// file, from this device or any other device of the logged-in
+	// user (or team).  A length of 0 locks the rest of the file.
+	// If part of the range is already locked, it returns a
+	// FileRangeLockConflictError, unless wait is set, in which
+	// case it waits until the range is free or ctx is canceled.
+	// Writes made through the returned lock are synced in turn
+	// with those of other range lock holders, so writers of
+	// disjoint ranges of the same file don't conflict.  The caller
+	// must call Unlock on the lock when done.  Range locks can't
+	// be taken in folders with the TLF journal enabled; for those
+	// it returns a LeaseLockJournaledError.  This is a
+	// remote-sync operation.
+	LockFileRange(ctx context.Context, file Node, off, length uint64,
+		wait bool) (*FileRangeLock, error)
+	// GetParent returns the directory that contains the given
+	// node, and the node's name in it.
+	GetParent(ctx context.Context, node Node) (dir Node, name string,
+		err error)
 	// FolderStatus returns the status of a particular folder/branch, along
 	// with a channel that will be closed when the status has been
 	// updated (to eliminate the need for polling this method).
 	FolderStatus(ctx context.Context, folderBranch FolderBranch) (
 		FolderBranchStatus, <-chan StatusUpdate, error)
+	// SetBlockPolicy changes the policy used by all writers of the
+	// given folder to encode new file data, by writing a new
+	// revision.  Existing data is left as is.  Returns an
+	// UnsupportedBlockPolicyError if this client doesn't support
+	// the given policy.  This is a remote-sync operation.
+	SetBlockPolicy(ctx context.Context, folderBranch FolderBranch,
+		policy BlockPolicy) error
+	// SetManualConflictResolution turns manual conflict
+	// resolution on or off for the given folder-branch.  While it
+	// is on, conflicts are not resolved automatically; instead,
+	// this device keeps writing to its unmerged branch until the
+	// user resolves the conflicts listed by GetConflicts with
+	// ResolveConflict.  Turning it off resolves any outstanding
+	// conflicts automatically.
+	SetManualConflictResolution(ctx context.Context,
+		folderBranch FolderBranch, manual bool) error
+	// GetConflicts lists, sorted by path, the files written both
+	// in this device's unmerged branch of the given folder-branch
+	// and in the merged branch, with both versions of each.  It
+	// returns an empty list if the folder-branch is not unmerged.
+	GetConflicts(ctx context.Context, folderBranch FolderBranch) (
+		[]ConflictInfo, error)
+	// ResolveConflict records the user's choice for the conflict
+	// at the given path, as listed by GetConflicts.  Once every
+	// conflict has a choice, it resolves the unmerged branch
+	// accordingly, and returns once the resolution is done.  It
+	// returns a ManualConflictResolutionDisabledError if manual
+	// conflict resolution isn't on for the folder-branch.
+	ResolveConflict(ctx context.Context, folderBranch FolderBranch,
+		path string, choice ConflictChoice) error
+	// PreviewConflictResolution computes what conflict resolution
+	// would do to the given folder-branch if it ran now, without
+	// changing anything: the unmerged operations it would merge,
+	// the actions it would take in each merged directory, and the
+	// entries it would rename to conflicted copies.  It returns an
+	// empty preview if the folder-branch is not unmerged.
+	PreviewConflictResolution(ctx context.Context,
+		folderBranch FolderBranch) (ConflictResolutionPreview, error)
+	// SetAccessLogging turns access logging on or off for the
+	// given folder-branch, for every member of the TLF.  While it
+	// is on, each device that reads a file in the TLF records the
+	// file's path and the time of the read in a log in the TLF;
+	// see AccessLogDirName.  Turning it off deletes the log.
+	SetAccessLogging(ctx context.Context, folderBranch FolderBranch,
+		enabled bool) error
+	// GetAccessLog returns the verified entries in the access log
+	// of the given folder-branch, sorted by time, after flushing
+	// any reads this device hasn't logged yet.  It returns an
+	// empty list if access logging is off.
+	GetAccessLog(ctx context.Context, folderBranch FolderBranch) (
+		[]AccessLogEntry, error)
+	// PruneAccessLog removes the entries older than the given
+	// time from the access log of the given folder-branch.  It
+	// removes whole batches of entries at a time, so some older
+	// entries may remain.
+	PruneAccessLog(ctx context.Context, folderBranch FolderBranch,
+		before time.Time) error
+	// GetTLFAccessLog returns the fetches of the given
+	// folder-branch's MD and blocks, made by any device at or
+	// after the given time, that the servers recorded, sorted by
+	// time.  Unlike GetAccessLog, it doesn't depend on the
+	// readers' cooperation, but it needs support from the
+	// servers; see TLFAccessLogServer.  Only writers of the TLF
+	// may get its access log.
+	GetTLFAccessLog(ctx context.Context, folderBranch FolderBranch,
+		since time.Time) ([]TLFAccessEvent, error)
 	// Status returns the status of KBFS, along with a channel that will be
 	// closed when the status has been updated (to eliminate the need for
 	// polling this method). KBFSStatus can be non-empty even if there is an
 	// error.
 	Status(ctx context.Context) (
 		KBFSStatus, <-chan StatusUpdate, error)
+	// GetKBFSStatus returns a snapshot of the state of every KBFS
+	// subsystem at once: the logged-in user, connectivity, the
+	// journals' backlogs, the caches, the open folders' conflict
+	// resolutions and rekeys, the block retrieval queue, and the
+	// most recent errors.  It's meant for the Keybase service and
+	// GUI.
+	GetKBFSStatus(ctx context.Context) (KBFSStatusSnapshot, error)
 	// UnstageForTesting clears out this device's staged state, if
 	// any, and fast-forwards to the current head of this
 	// folder-branch.
 	UnstageForTesting(ctx context.Context, folderBranch FolderBranch) error
 	// Rekey rekeys this folder.
 	Rekey(ctx context.Context, id tlf.ID) error
+	// UserKeysChanged tells KBFS that the keys of the given user
+	// have changed.  If any of the user's devices have been
+	// revoked since KBFS last looked, it immediately schedules
+	// rekeys of the cached folders that include the user or, if
+	// this device is one of them, purges this device's cached
+	// TLF keys.
+	UserKeysChanged(ctx context.Context, uid keybase1.UID) error
 	// SyncFromServerForTesting blocks until the local client has
 	// contacted the server and guaranteed that all known updates
 	// for the given top-level folder have been applied locally
@@ -270,10 +494,24 @@ type KBFSOps interface {
 	// for the folder.
 	GetEditHistory(ctx context.Context, folderBranch FolderBranch) (
 		edits TlfWriterEdits, err error)
-
+	// GetKeyGenerations returns the history of the key generations
+	// of the given TLF, with the revision that created each one,
+	// every device that was given it, and which of those devices
+	// have since been revoked.  Like GetUpdateHistory, this is an
+	// expensive operation, and should only be used occasionally.
+	GetKeyGenerations(ctx context.Context, tlfID tlf.ID) (
+		[]KeyGenerationInfo, error)
 	// GetNodeMetadata gets metadata associated with a Node.
 	GetNodeMetadata(ctx context.Context, node Node) (NodeMetadata, error)
 
+	// GetUserQuotaInfo returns the logged-in user's current quota
+	// usage, fetched from the block server.
+	GetUserQuotaInfo(ctx context.Context) (QuotaUsage, error)
+
+	// GetOpenFolderBranches returns all the folder-branches that
+	// have been accessed since startup, sorted by TLF ID.
+	GetOpenFolderBranches(ctx context.Context) ([]FolderBranch, error)
+
 	// Shutdown is called to clean up any resources associated with
 	// this KBFSOps instance.
 	Shutdown() error
@@ -576,6 +814,16 @@ type Reporter interface {
 		mode ErrorModeType, err error)
 	// AllKnownErrors returns all errors known to this Reporter.
 	AllKnownErrors() []ReportedError
+	// ErrorReports returns the classified, deduplicated reports of
+	// the user-actionable errors known to this Reporter, oldest
+	// first.
+	ErrorReports() []ErrorReport
+	// SubscribeToErrorReports returns a channel that receives
+	// each new error report, and a function to call to end the
+	// subscription, which closes the channel.  Reports that
+	// arrive while the channel is full are dropped, but can still
+	// be found with ErrorReports.
+	SubscribeToErrorReports() (<-chan ErrorReport, func())
 	// Notify sends the given notification to any sink.
 	Notify(ctx context.Context, notification *keybase1.FSNotification)
 	// NotifySyncStatus sends the given path sync status to any sink.
@@ -605,6 +853,8 @@ type KeyCache interface {
 	GetTLFCryptKey(tlf.ID, KeyGen) (kbfscrypto.TLFCryptKey, error)
 	// PutTLFCryptKey stores the crypt key for the given TLF.
 	PutTLFCryptKey(tlf.ID, KeyGen, kbfscrypto.TLFCryptKey) error
+	// Clear removes every key from the cache.
+	Clear()
 }
 
 // BlockCacheLifetime denotes the lifetime of an entry in BlockCache.
@@ -824,10 +1074,12 @@ type cryptoPure interface {
 		encryptedPMD EncryptedPrivateMetadata,
 		key kbfscrypto.TLFCryptKey) (PrivateMetadata, error)
 
-	// EncryptBlocks encrypts a block. plainSize is the size of the encoded
-	// block; EncryptBlock() must guarantee that plainSize <=
+	// EncryptBlocks encrypts a block with the given encryption
+	// version. plainSize is the size of the encoded block;
+	// EncryptBlock() must guarantee that plainSize <=
 	// len(encryptedBlock).
-	EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
+	EncryptBlock(block Block, key kbfscrypto.BlockCryptKey,
+		ver EncryptionVer) (
 		plainSize int, encryptedBlock EncryptedBlock, err error)
 
 	// DecryptBlock decrypts a block. Similar to EncryptBlock(),
@@ -944,6 +1196,16 @@ type MDOps interface {
 	GetUnmergedRange(ctx context.Context, id tlf.ID, bid BranchID,
 		start, stop MetadataRevision) ([]ImmutableRootMetadata, error)
 
+	// GetMergedDelta returns the merged metadata objects that a
+	// device whose latest known merged revision is since needs in
+	// order to catch up, as a slice of length at most maxRevs
+	// ordered by revision.  If there are more than maxRevs newer
+	// revisions, only the current head is returned, and skipped is
+	// true; the caller must then fast-forward to it rather than
+	// apply it as a successor.
+	GetMergedDelta(ctx context.Context, id tlf.ID, since MetadataRevision,
+		maxRevs int) (rmds []ImmutableRootMetadata, skipped bool, err error)
+
 	// Put stores the metadata object for the given
 	// top-level folder.
 	Put(ctx context.Context, rmd *RootMetadata) (MdID, error)
@@ -968,6 +1230,15 @@ type MDOps interface {
 	// entered into a conflicting state.
 	GetLatestHandleForTLF(ctx context.Context, id tlf.ID) (
 		tlf.Handle, error)
+
+	// GetChangeSummary cheaply summarizes the changes made to the
+	// merged branch of the given TLF since the given revision.  It
+	// fetches only the server's head revision number, without
+	// decrypting or verifying the head MD; the counts come from
+	// whatever later revisions are already cached locally.  Callers
+	// must fetch the MD as usual to see the changes themselves.
+	GetChangeSummary(ctx context.Context, handle *TlfHandle,
+		since MetadataRevision) (ChangeSummary, error)
 }
 
 // KeyOps fetches server-side key halves from the key server.
@@ -1069,6 +1340,15 @@ type MDServer interface {
 	GetRange(ctx context.Context, id tlf.ID, bid BranchID, mStatus MergeStatus,
 		start, stop MetadataRevision) ([]*RootMetadataSigned, error)
 
+	// GetMergedDelta returns the merged (signed/encrypted) metadata
+	// objects newer than the given revision, in order, leaving out
+	// the history that a client catching up from that revision
+	// doesn't need: if there are more than maxRevs newer revisions,
+	// the ones in between are superseded by the head, and only the
+	// head is returned, with skipped set to true.
+	GetMergedDelta(ctx context.Context, id tlf.ID, since MetadataRevision,
+		maxRevs int) (rmdses []*RootMetadataSigned, skipped bool, err error)
+
 	// Put stores the (signed/encrypted) metadata object for the given
 	// top-level folder. Note: If the unmerged bit is set in the metadata
 	// block's flags bitmask it will be appended to the unmerged per-device
@@ -1135,6 +1415,27 @@ type MDServer interface {
 	GetKeyBundles(ctx context.Context, tlfID tlf.ID,
 		wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
 		*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error)
+
+	// GetMerkleRootLatest returns the latest root of the given
+	// Merkle tree of TLF heads, or nil if the tree is still empty.
+	GetMerkleRootLatest(ctx context.Context,
+		treeID keybase1.MerkleTreeID) (*MerkleRoot, error)
+
+	// GetMerkleNode returns the encoded Merkle tree node with the
+	// given hash.  The caller should check that the node matches
+	// the hash.
+	GetMerkleNode(ctx context.Context, hash merkle.Hash) ([]byte, error)
+}
+
+// TLFAccessLogServer is an optional interface that an MDServer or a
+// BlockServer can implement if it keeps a log of the recent fetches
+// of each TLF's data.
+type TLFAccessLogServer interface {
+	// GetTLFAccessLog returns the fetches of the given TLF's data
+	// that the server recorded at or after the given time, oldest
+	// first.  Only writers of the TLF may get its access log.
+	GetTLFAccessLog(ctx context.Context, id tlf.ID, since time.Time) (
+		[]TLFAccessEvent, error)
 }
 
 type mdServerLocal interface {
@@ -1145,6 +1446,14 @@ type mdServerLocal interface {
 		rev MetadataRevision, err error)
 	isShutdown() bool
 	copy(config mdServerLocalConfig) mdServerLocal
+	// finalizeTLF appends a final copy of the merged head of the
+	// given TLF, after the given user has reset their account.
+	// The TLF is then only reachable through its finalized handle,
+	// and its old handle is free to be used for a new TLF.  Only
+	// writers may finalize a TLF.  The remote MD server has no RPC
+	// for this yet, so only local servers support it.
+	finalizeTLF(ctx context.Context, id tlf.ID,
+		resetUser libkb.NormalizedUsername) error
 }
 
 // BlockServer gets and puts opaque data blocks.  The instantiation
@@ -1176,6 +1485,13 @@ type BlockServer interface {
 	// the error.
 	Put(ctx context.Context, tlfID tlf.ID, id BlockID, context BlockContext,
 		buf []byte, serverHalf kbfscrypto.BlockCryptKeyServerHalf) error
+	// PutBlocks does a Put for each of the given blocks, but lets
+	// the server handle them together, saving round trips when
+	// there are many small blocks.  It returns the error for each
+	// put, in the same order as puts; there is no all-or-nothing
+	// guarantee, but since Put is idempotent, any failed puts may
+	// simply be retried.
+	PutBlocks(ctx context.Context, tlfID tlf.ID, puts []BlockPut) []error
 
 	// AddBlockReference adds a new reference to the given block,
 	// defined by the given context (which should contain a non-zero
@@ -1235,6 +1551,15 @@ type blockServerLocal interface {
 	// for the given TLF, and should only be used during testing.
 	getAllRefsForTest(ctx context.Context, tlfID tlf.ID) (
 		map[BlockID]blockRefMap, error)
+	// getAllRefs returns the nonces of every live and archived
+	// reference the server holds for blocks in the given TLF.
+	// It's meant for offline verification against the TLF's MD
+	// chain (see VerifyBlockRefs), and isn't scalable, since it
+	// returns everything in memory at once.  The remote block
+	// server has no RPC to enumerate a TLF's references, which is
+	// why this is limited to local servers.
+	getAllRefs(ctx context.Context, tlfID tlf.ID) (
+		live, archived map[BlockID][]BlockRefNonce, err error)
 }
 
 // BlockSplitter decides when a file or directory block needs to be split
@@ -1316,6 +1641,52 @@ type Observer interface {
 	TlfHandleChange(ctx context.Context, newHandle *TlfHandle)
 }
 
+// PathObserver is an Observer that also wants a structured
+// description of each change, by path (e.g., to implement file
+// watchers).  Registering a PathObserver with the Notifier is enough
+// to get both kinds of notifications.
+type PathObserver interface {
+	Observer
+	// PathChanges announces that the given entries have changed,
+	// all in the same top-level folder and branch, after the
+	// corresponding BatchChanges call.  Only changes under nodes
+	// that are known to this device are announced.
+	PathChanges(ctx context.Context, changes []PathChange)
+}
+
+// QuotaObserver is an Observer that also wants to be warned when
+// writes to its folders are about to exceed the user's quota, rather
+// than learning about it from failed syncs.
+type QuotaObserver interface {
+	Observer
+	// QuotaWarning announces that a write to one of the observed
+	// folders is about to exceed the user's quota.
+	QuotaWarning(ctx context.Context, warning QuotaWarning)
+}
+
+// FavoritesObserver is an Observer that also wants to hear about
+// changes to the logged-in user's favorites list made by other
+// devices, which are noticed whenever the list is fetched from the
+// server.  FavoritesChanged is called while the favorites list is
+// locked, so it must not call the favorites methods of KBFSOps
+// synchronously.
+type FavoritesObserver interface {
+	Observer
+	// FavoritesChanged announces that the given favorites were
+	// added to and removed from the list.
+	FavoritesChanged(ctx context.Context, added, removed []Favorite)
+}
+
+// ConnectivityObserver is an Observer that also wants to hear about
+// changes to the ConnectivityState of this device, e.g. to tell the
+// user that changes are being queued locally.
+type ConnectivityObserver interface {
+	Observer
+	// ConnectivityChanged announces that the device has entered
+	// the state in the given status.
+	ConnectivityChanged(ctx context.Context, status ConnectivityStatus)
+}
+
 // Notifier notifies registrants of directory changes
 type Notifier interface {
 	// RegisterForChanges declares that the given Observer wants to
@@ -1325,6 +1696,22 @@ type Notifier interface {
 	// longer wants to subscribe to updates for the given top-level
 	// folders.
 	UnregisterFromChanges(folderBranches []FolderBranch, obs Observer) error
+	// RegisterForFavoritesChanges declares that the given
+	// FavoritesObserver wants to hear about changes to the
+	// favorites list.
+	RegisterForFavoritesChanges(obs FavoritesObserver) error
+	// UnregisterFromFavoritesChanges declares that the given
+	// FavoritesObserver no longer wants to hear about changes to
+	// the favorites list.
+	UnregisterFromFavoritesChanges(obs FavoritesObserver) error
+	// RegisterForConnectivityChanges declares that the given
+	// ConnectivityObserver wants to hear about changes to the
+	// connectivity state.
+	RegisterForConnectivityChanges(obs ConnectivityObserver) error
+	// UnregisterFromConnectivityChanges declares that the given
+	// ConnectivityObserver no longer wants to hear about changes
+	// to the connectivity state.
+	UnregisterFromConnectivityChanges(obs ConnectivityObserver) error
 }
 
 // Clock is an interface for getting the current time
@@ -1340,9 +1727,60 @@ type ConflictRenamer interface {
 		string, error)
 }
 
+// ConflictResolutionStrategy decides how conflict resolution should
+// merge changes that can't be applied automatically.  Applications
+// may register their own strategy with
+// Config.SetConflictResolutionStrategy to replace the default
+// behavior, which keeps both versions and gives the local one a
+// conflicted name (see ConflictRenamer).
+type ConflictResolutionStrategy interface {
+	// FileConflictPolicy returns how to resolve a file that was
+	// written both locally and remotely.  `p` is the canonical
+	// path of the file in the remote (merged) branch.
+	FileConflictPolicy(ctx context.Context, p string) (
+		FileConflictPolicy, error)
+}
+
+// MountPathTransformer rewrites the targets of symlinks that are
+// absolute paths into KBFS, which depend on where KBFS is mounted,
+// so that a link created through one platform's mountpoint resolves
+// through another's.
+type MountPathTransformer interface {
+	// ToLocal returns the form of a stored symlink target to show
+	// through the local mountpoint.
+	ToLocal(target string) string
+	// FromLocal returns the form in which to store a symlink
+	// target given through the local mountpoint.
+	FromLocal(target string) string
+}
+
+// PostWriteHook computes metadata derived from the contents of a
+// file, such as its MIME type or the dimensions of an image, for
+// folder browsing UIs to show without reading the file.  After a
+// file is synced, the hooks registered on the Config are run on it
+// in the background, and their results are stored in the Derived
+// map of the file's EntryInfo, under each hook's name.
+type PostWriteHook interface {
+	// Name returns the key for this hook's results in
+	// EntryInfo.Derived.
+	Name() string
+	// DerivedMetadata returns the metadata for a file with the
+	// given name and entry, given the first bytes of its
+	// contents (up to postWriteHookHeadBytes).  A nil result
+	// removes any metadata previously stored by this hook.
+	DerivedMetadata(ctx context.Context, name string, ei EntryInfo,
+		head []byte) ([]byte, error)
+}
+
 // Config collects all the singleton instance instantiations needed to
 // run KBFS in one place.  The methods below are self-explanatory and
 // do not require comments.
+//
+// A single Config may be shared by any number of goroutines.  Its
+// getters and setters are safe to call concurrently, though the
+// setters are meant for use during initialization; swapping out a
+// component while it's in use leaves existing users holding the old
+// one.
 type Config interface {
 	KBFSOps() KBFSOps
 	SetKBFSOps(KBFSOps)
@@ -1388,11 +1826,36 @@ type Config interface {
 	SetClock(Clock)
 	ConflictRenamer() ConflictRenamer
 	SetConflictRenamer(ConflictRenamer)
+	ConflictResolutionStrategy() ConflictResolutionStrategy
+	SetConflictResolutionStrategy(ConflictResolutionStrategy)
+	MountPathTransformer() MountPathTransformer
+	SetMountPathTransformer(MountPathTransformer)
 	MetadataVersion() MetadataVer
 	SetMetadataVersion(MetadataVer)
 	DataVersion() DataVer
+	// BlockEncryptionVersion is the version of encryption to use
+	// for new blocks.
+	BlockEncryptionVersion() EncryptionVer
+	SetBlockEncryptionVersion(EncryptionVer)
 	RekeyQueue() RekeyQueue
 	SetRekeyQueue(RekeyQueue)
+	BandwidthLimiter() BandwidthLimiter
+	SetBandwidthLimiter(BandwidthLimiter)
+	DiskLimiter() DiskLimiter
+	SetDiskLimiter(DiskLimiter)
+	Connectivity() ConnectivityTracker
+	SetConnectivity(ConnectivityTracker)
+	// BlockCacheTuningStatus returns the state of the automatic
+	// tuning of the block cache's size, or nil if it isn't enabled.
+	BlockCacheTuningStatus() *BlockCacheTuningStatus
+	// DirtyMemoryStatus returns the state of the limit on memory
+	// used by dirty data, or nil if there isn't one.
+	DirtyMemoryStatus() *DirtyMemoryStatus
+	// KeyHalfHealth returns the results of the background audits
+	// of crypt key server halves, or nil if they aren't enabled,
+	// along with a channel that is closed when the problems
+	// found change.
+	KeyHalfHealth() (*KeyHalfHealthStatus, <-chan StatusUpdate)
 	// ReqsBufSize indicates the number of read or write operations
 	// that can be buffered per folder
 	ReqsBufSize() int
@@ -1405,11 +1868,72 @@ type Config interface {
 	// MaxDirBytes indicates the maximum supported plaintext size of a
 	// directory in bytes.
 	MaxDirBytes() uint64
+	// MaxDirBlockBytes indicates the maximum estimated size of the
+	// entries in a single directory block; bigger directories are
+	// split into multiple blocks.
+	MaxDirBlockBytes() uint64
 	// DoBackgroundFlushes says whether we should periodically try to
 	// flush dirty files, even without a sync from the user.  Should
 	// be true except for during some testing.
 	DoBackgroundFlushes() bool
 	SetDoBackgroundFlushes(bool)
+	// StrictTimes says whether file times should follow POSIX
+	// more closely: the mtime and ctime of a file change on every
+	// write or truncate, rather than when the file is synced.
+	// This helps tools like make that compare timestamps, at the
+	// cost of less attribute caching.
+	StrictTimes() bool
+	SetStrictTimes(bool)
+	// StoreSpecialFiles says whether frontends should store named
+	// pipes and sockets created through them as special files
+	// (see KBFSOps.CreateSpecialFile), so that unpacking archives
+	// that contain them works.  Otherwise, creating them fails
+	// with SpecialFileNotSupportedError.
+	StoreSpecialFiles() bool
+	SetStoreSpecialFiles(bool)
+	// LowMemoryMode says whether KBFS should keep its memory
+	// usage down at the cost of performance, e.g. inside mobile
+	// apps: it caps the number of concurrent block operations,
+	// and doesn't keep synced file blocks in the block cache.
+	// Smaller caches must be set up separately, e.g. by
+	// ResetCaches.
+	LowMemoryMode() bool
+	SetLowMemoryMode(bool)
+	// CaseInsensitive says whether names are matched
+	// case-insensitively, as on Windows and macOS: Lookup finds an
+	// entry whose name differs from the given one only in case,
+	// and creating an entry fails with NameExistsError if such an
+	// entry exists.  Names are still stored as given.
+	CaseInsensitive() bool
+	SetCaseInsensitive(bool)
+	// NormalizeNames says whether new entries are stored under the
+	// Unicode NFC forms of their names, and whether Lookup finds
+	// an entry whose name has the same NFC form as the given one.
+	// That keeps names typed on macOS, which uses NFD, and on
+	// other platforms, which mostly use NFC, from creating
+	// separate entries that look the same.
+	NormalizeNames() bool
+	SetNormalizeNames(bool)
+	// EncryptLocalStorage says whether write journals created from
+	// now on seal their block data and key server halves with
+	// per-device storage keys, which are kept on disk wrapped
+	// with the device's crypt key.  It must be set before
+	// journaling is enabled.
+	EncryptLocalStorage() bool
+	SetEncryptLocalStorage(bool)
+	// LongNameSupport says whether entry names longer than
+	// MaxNameBytes are allowed.  If so, each such entry is stored
+	// under a shortened form of its name that ends with a hash of
+	// the full name, and the full name is kept in its EntryInfo.
+	LongNameSupport() bool
+	SetLongNameSupport(bool)
+	// PostWriteHooks returns the hooks that compute derived
+	// metadata for files after they're written, in the order they
+	// were added.
+	PostWriteHooks() []PostWriteHook
+	// AddPostWriteHook registers a hook to be run in the
+	// background on every file synced by this device from now on.
+	AddPostWriteHook(PostWriteHook)
 	// RekeyWithPromptWaitTime indicates how long to wait, after
 	// setting the rekey bit, before prompting for a paper key.
 	RekeyWithPromptWaitTime() time.Duration
@@ -1453,10 +1977,24 @@ type Config interface {
 	// objects, which is to use the default registry.
 	MetricsRegistry() metrics.Registry
 	SetMetricsRegistry(metrics.Registry)
+	// Tracer may be nil, which means operations aren't traced.
+	Tracer() *Tracer
+	SetTracer(*Tracer)
+	// LogControl may be nil, which means the log settings can't
+	// be changed at runtime.
+	LogControl() *LogControl
+	SetLogControl(*LogControl)
 	// TLFValidDuration is the time TLFs are valid before identification needs to be redone.
 	TLFValidDuration() time.Duration
 	// SetTLFValidDuration sets TLFValidDuration.
 	SetTLFValidDuration(time.Duration)
+	// ReadReplicaPollInterval, if non-zero, means this config is a
+	// read replica: all writes are rejected, and each TLF polls
+	// the MD server for a new head at this interval instead of
+	// waiting for update notifications.
+	ReadReplicaPollInterval() time.Duration
+	// SetReadReplicaPollInterval sets ReadReplicaPollInterval.
+	SetReadReplicaPollInterval(time.Duration)
 	// Shutdown is called to free config resources.
 	Shutdown() error
 	// CheckStateOnShutdown tells the caller whether or not it is safe
@@ -1564,6 +2102,74 @@ type RekeyQueue interface {
 	Wait(ctx context.Context) error
 }
 
+// BandwidthLimiter throttles background network traffic, such as
+// journal flushes, prefetches and rekeys, so that it doesn't
+// saturate the user's connection.
+type BandwidthLimiter interface {
+	// WaitN blocks until the given direction is within its limit,
+	// and then charges n bytes of traffic to it.  It returns early
+	// with an error if ctx is canceled.
+	WaitN(ctx context.Context, d BandwidthDirection, n int64) error
+	// Charge records n bytes of traffic in the given direction,
+	// for transfers whose size isn't known until they're done,
+	// without waiting.  Pair it with a preceding call to WaitN
+	// with n == 0.
+	Charge(d BandwidthDirection, n int64)
+	// SetLimits changes the limits, effective immediately.
+	SetLimits(limits BandwidthLimits)
+	// Limits returns the current limits.
+	Limits() BandwidthLimits
+}
+
+// DiskLimiter bounds the combined disk usage of all the local
+// stores, such as the journal and the read replica block cache, so
+// that they don't fill up the user's disk.
+type DiskLimiter interface {
+	// RegisterStore adds a local store under the given name,
+	// whose current usage in bytes is returned by usage.  usage
+	// must not call back into the DiskLimiter.
+	RegisterStore(name string, usage func() int64)
+	// WaitForSpace blocks until the local stores have room for n
+	// more bytes, to apply backpressure to writes.  It returns
+	// early with an error if ctx is canceled.
+	WaitForSpace(ctx context.Context, n int64) error
+	// HasSpace returns whether the local stores have room for n
+	// more bytes, without waiting, for fills of caches that can
+	// just skip caching instead.
+	HasSpace(n int64) bool
+	// SpaceFreed tells the DiskLimiter that a store may have
+	// freed some space, to wake up any waiters.
+	SpaceFreed()
+	// SetLimits changes the limits, effective immediately.
+	SetLimits(limits DiskLimits)
+	// Limits returns the current limits.
+	Limits() DiskLimits
+	// Status returns the current usage of the local stores.
+	Status() DiskLimiterStatus
+}
+
+// ConnectivityTracker keeps track of whether this device is online,
+// flaky or offline, based on the outcomes of requests to the servers
+// and on hints from the OS, so that background work can follow the
+// ConnectivityPolicy for the current state.
+type ConnectivityTracker interface {
+	// ServiceStatusChanged records a change in the connection to
+	// the given service: a nil err when it connects, and an error
+	// when it fails or disconnects.
+	ServiceStatusChanged(service string, err error)
+	// RequestDone records the outcome of a single request to the
+	// given service, which took the given time.
+	RequestDone(service string, latency time.Duration, err error)
+	// SetNetworkHint records whether the OS thinks the device has
+	// a network connection.
+	SetNetworkHint(online bool)
+	// State returns the current state.
+	State() ConnectivityState
+	// Status returns the current status, along with a channel
+	// that is closed when the state changes.
+	Status() (ConnectivityStatus, <-chan StatusUpdate)
+}
+
 // BareRootMetadata is a read-only interface to the bare serializeable MD that
 // is signed by the reader or writer.
 type BareRootMetadata interface {
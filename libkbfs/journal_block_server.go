@@ -59,6 +59,17 @@ func (j journalBlockServer) Put(
 	return j.BlockServer.Put(ctx, tlfID, id, context, buf, serverHalf)
 }
 
+func (j journalBlockServer) PutBlocks(
+	ctx context.Context, tlfID tlf.ID, puts []BlockPut) []error {
+	if _, ok := j.jServer.getTLFJournal(tlfID); ok {
+		// The journal puts each block locally; they get
+		// batched again when the journal is flushed.
+		return putBlocksOneAtATime(ctx, j, tlfID, puts)
+	}
+
+	return j.BlockServer.PutBlocks(ctx, tlfID, puts)
+}
+
 func (j journalBlockServer) AddBlockReference(
 	ctx context.Context, tlfID tlf.ID, id BlockID,
 	context BlockContext) (err error) {
@@ -337,6 +337,30 @@ func (j journalMDOps) GetUnmergedRange(
 		delegateFn)
 }
 
+func (j journalMDOps) GetMergedDelta(
+	ctx context.Context, id tlf.ID, since MetadataRevision, maxRevs int) (
+	[]ImmutableRootMetadata, bool, error) {
+	tlfJournal, ok := j.jServer.getTLFJournal(id)
+	if ok {
+		head, err := tlfJournal.getMDHead(ctx)
+		if err != nil && err != errTLFJournalDisabled {
+			return nil, false, err
+		}
+		if head != (ImmutableBareRootMetadata{}) {
+			// Journaled revisions aren't on the server yet,
+			// so none of them may be skipped.
+			irmds, err := j.GetRange(
+				ctx, id, since+1, since+MetadataRevision(maxRevs))
+			if err != nil {
+				return nil, false, err
+			}
+			return irmds, false, nil
+		}
+	}
+
+	return j.MDOps.GetMergedDelta(ctx, id, since, maxRevs)
+}
+
 func (j journalMDOps) Put(ctx context.Context, rmd *RootMetadata) (
 	MdID, error) {
 	if tlfJournal, ok := j.jServer.getTLFJournal(rmd.TlfID()); ok {
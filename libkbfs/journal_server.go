@@ -23,6 +23,18 @@ import (
 
 type journalServerConfig struct {
 	EnableAuto bool
+	// WriteThrough lists the TLFs whose writes bypass the journal
+	// and go straight to the servers, even when EnableAuto is set.
+	WriteThrough []tlf.ID `json:",omitempty"`
+}
+
+func (jsc journalServerConfig) isWriteThrough(tlfID tlf.ID) bool {
+	for _, id := range jsc.WriteThrough {
+		if id == tlfID {
+			return true
+		}
+	}
+	return false
 }
 
 // JournalServerStatus represents the overall status of the
@@ -34,9 +46,14 @@ type JournalServerStatus struct {
 	CurrentUID          keybase1.UID
 	CurrentVerifyingKey kbfscrypto.VerifyingKey
 	EnableAuto          bool
+	WriteThrough        []tlf.ID
 	JournalCount        int
 	UnflushedBytes      int64 // (signed because os.FileInfo.Size() is signed)
 	UnflushedPaths      []string
+	// DiskUsage is the total size of all the files under RootDir,
+	// including block data kept around until the corresponding
+	// MD is flushed.
+	DiskUsage int64
 }
 
 // branchChangeListener describes a caller that will get updates via
@@ -96,6 +113,12 @@ type JournalServer struct {
 	dirtyOps            uint
 	dirtyOpsDone        *sync.Cond
 	serverConfig        journalServerConfig
+	tlfJournalLimits    TLFJournalLimits
+	// storageKeys is non-nil if Config.EncryptLocalStorage is
+	// set, in which case new journals seal their block data with
+	// them, or if any existing journal is sealed.
+	storageKeys     *kbfscrypto.StorageKeyring
+	currentCryptKey kbfscrypto.CryptPublicKey
 }
 
 func makeJournalServer(
@@ -184,12 +207,27 @@ func (j *JournalServer) tlfJournalPathLocked(tlfID tlf.ID) string {
 	return filepath.Join(j.rootPath(), dir)
 }
 
+// storageKeysPathLocked returns the path of the file holding the
+// current device's wrapped storage keys.  Like the TLF journal
+// paths, it's unique to the device.
+func (j *JournalServer) storageKeysPathLocked() string {
+	if j.currentVerifyingKey == (kbfscrypto.VerifyingKey{}) {
+		panic("currentVerifyingKey is zero")
+	}
+
+	shortDeviceIDStr := j.currentVerifyingKey.String()[:36]
+	return filepath.Join(
+		j.rootPath(), fmt.Sprintf("%s-storage-keys", shortDeviceIDStr))
+}
+
 func (j *JournalServer) getTLFJournal(tlfID tlf.ID) (*tlfJournal, bool) {
 	getJournalFn := func() (*tlfJournal, bool, bool) {
 		j.lock.RLock()
 		defer j.lock.RUnlock()
 		tlfJournal, ok := j.tlfJournals[tlfID]
-		return tlfJournal, j.serverConfig.EnableAuto, ok
+		enableAuto := j.serverConfig.EnableAuto &&
+			!j.serverConfig.isWriteThrough(tlfID)
+		return tlfJournal, enableAuto, ok
 	}
 	tlfJournal, enableAuto, ok := getJournalFn()
 	if !ok && enableAuto {
@@ -278,6 +316,13 @@ func (j *JournalServer) EnableExistingJournals(
 		}
 	}()
 
+	if j.config.EncryptLocalStorage() {
+		err := j.loadStorageKeysLocked(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
 	fileInfos, err := ioutil.ReadDir(j.rootPath())
 	if os.IsNotExist(err) {
 		enableSucceeded = true
@@ -294,13 +339,14 @@ func (j *JournalServer) EnableExistingJournals(
 		}
 
 		dir := filepath.Join(j.rootPath(), name)
-		uid, key, tlfID, err := readTLFJournalInfoFile(dir)
+		info, err := readTLFJournalInfoFile(dir)
 		if err != nil {
 			j.log.CDebugf(
 				ctx, "Skipping non-TLF dir %q: %v", name, err)
 			continue
 		}
 
+		uid, key, tlfID := info.UID, info.VerifyingKey, info.TlfID
 		if uid != currentUID {
 			j.log.CDebugf(
 				ctx, "Skipping dir %q due to mismatched UID %s",
@@ -323,6 +369,13 @@ func (j *JournalServer) EnableExistingJournals(
 			continue
 		}
 
+		if j.serverConfig.isWriteThrough(tlfID) {
+			j.log.CDebugf(
+				ctx, "Skipping dir %q for write-through TLF %s",
+				name, tlfID)
+			continue
+		}
+
 		// Allow enable even if dirty, since any dirty writes
 		// in flight are most likely for another user.
 		err = j.enableLocked(ctx, tlfID, bws, true)
@@ -339,6 +392,28 @@ func (j *JournalServer) EnableExistingJournals(
 	return nil
 }
 
+// loadStorageKeysLocked loads the current device's storage keys,
+// making them first if they don't exist yet, unless they're already
+// loaded.
+func (j *JournalServer) loadStorageKeysLocked(ctx context.Context) error {
+	if j.storageKeys != nil {
+		return nil
+	}
+	cryptKey, err := j.config.KBPKI().GetCurrentCryptPublicKey(ctx)
+	if err != nil {
+		return err
+	}
+	storageKeys, err := loadStorageKeyring(
+		ctx, j.config.Codec(), j.config.Crypto(), cryptKey,
+		j.storageKeysPathLocked())
+	if err != nil {
+		return err
+	}
+	j.storageKeys = storageKeys
+	j.currentCryptKey = cryptKey
+	return nil
+}
+
 func (j *JournalServer) enableLocked(
 	ctx context.Context, tlfID tlf.ID, bws TLFJournalBackgroundWorkStatus,
 	allowEnableIfDirty bool) (err error) {
@@ -383,13 +458,25 @@ func (j *JournalServer) enableLocked(
 	}
 
 	tlfDir := j.tlfJournalPathLocked(tlfID)
+	// A journal sealed while Config.EncryptLocalStorage was set
+	// still needs the storage keys to be read after it's turned
+	// off, or its unflushed data would be unreachable.
+	if info, err := readTLFJournalInfoFile(tlfDir); err == nil &&
+		info.SealedStorage {
+		err := j.loadStorageKeysLocked(ctx)
+		if err != nil {
+			return err
+		}
+	}
 	tlfJournal, err := makeTLFJournal(
 		ctx, j.currentUID, j.currentVerifyingKey, tlfDir,
-		tlfID, tlfJournalConfigAdapter{j.config}, j.delegateBlockServer,
+		tlfID, j.storageKeys, j.config.EncryptLocalStorage(),
+		tlfJournalConfigAdapter{j.config}, j.delegateBlockServer,
 		bws, nil, j.onBranchChange, j.onMDFlush)
 	if err != nil {
 		return err
 	}
+	tlfJournal.setLimits(j.tlfJournalLimits)
 
 	j.tlfJournals[tlfID] = tlfJournal
 	return nil
@@ -400,6 +487,10 @@ func (j *JournalServer) Enable(ctx context.Context, tlfID tlf.ID,
 	bws TLFJournalBackgroundWorkStatus) error {
 	j.lock.Lock()
 	defer j.lock.Unlock()
+	if j.serverConfig.isWriteThrough(tlfID) {
+		return fmt.Errorf("Can't enable journal for write-through TLF %s",
+			tlfID)
+	}
 	return j.enableLocked(ctx, tlfID, bws, false)
 }
 
@@ -434,6 +525,71 @@ func (j *JournalServer) DisableAuto(ctx context.Context) error {
 	return j.writeConfig()
 }
 
+// SetWriteThrough turns write-through mode on or off for the given
+// TLF, persistently.  While it is on, the TLF's journal is disabled
+// and its blocks and MD are written straight to the servers, even if
+// auto-journaling is enabled.  Turning it on first flushes anything
+// already in the TLF's journal.  Turning it off re-enables the
+// journal if auto-journaling is enabled.
+func (j *JournalServer) SetWriteThrough(
+	ctx context.Context, tlfID tlf.ID, writeThrough bool) (err error) {
+	j.log.CDebugf(ctx, "Setting write-through for %s to %t",
+		tlfID, writeThrough)
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx,
+				"Error when setting write-through for %s: %v",
+				tlfID, err)
+		}
+	}()
+
+	if writeThrough && j.hasTLFJournal(tlfID) {
+		// A journal can only be disabled once it's empty.
+		err := j.Flush(ctx, tlfID)
+		if err != nil {
+			return err
+		}
+		_, err = j.Disable(ctx, tlfID)
+		if err != nil {
+			return err
+		}
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.serverConfig.isWriteThrough(tlfID) == writeThrough {
+		// Nothing to do.
+		return nil
+	}
+
+	if writeThrough {
+		j.serverConfig.WriteThrough = append(
+			j.serverConfig.WriteThrough, tlfID)
+	} else {
+		ids := make([]tlf.ID, 0, len(j.serverConfig.WriteThrough))
+		for _, id := range j.serverConfig.WriteThrough {
+			if id != tlfID {
+				ids = append(ids, id)
+			}
+		}
+		j.serverConfig.WriteThrough = ids
+	}
+	err = j.writeConfig()
+	if err != nil {
+		return err
+	}
+
+	// A TLF without a journal gets one the next time it's
+	// accessed, but one that was disabled above has to be turned
+	// back on explicitly.
+	if _, ok := j.tlfJournals[tlfID]; ok && !writeThrough &&
+		j.serverConfig.EnableAuto {
+		return j.enableLocked(
+			ctx, tlfID, TLFJournalBackgroundWorkEnabled, false)
+	}
+	return nil
+}
+
 func (j *JournalServer) dirtyOpStart(tlfID tlf.ID) {
 	j.lock.Lock()
 	defer j.lock.Unlock()
@@ -480,6 +636,29 @@ func (j *JournalServer) ResumeBackgroundWork(ctx context.Context, tlfID tlf.ID)
 		tlfID)
 }
 
+// retryBackgroundWork makes the background work goroutine retry
+// right away, if it's waiting to retry after an error (e.g., after
+// losing its connection while the device was asleep).
+func (j *JournalServer) retryBackgroundWork(
+	ctx context.Context, tlfID tlf.ID) {
+	if tlfJournal, ok := j.getTLFJournal(tlfID); ok {
+		j.log.CDebugf(ctx, "Signaling retry for %s", tlfID)
+		tlfJournal.signalWork()
+	}
+}
+
+// retryAllBackgroundWork makes every journal's background work
+// goroutine retry right away, if it's waiting to retry after an error
+// (e.g., because the device was offline).
+func (j *JournalServer) retryAllBackgroundWork(ctx context.Context) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	for tlfID, tlfJournal := range j.tlfJournals {
+		j.log.CDebugf(ctx, "Signaling retry for %s", tlfID)
+		tlfJournal.signalWork()
+	}
+}
+
 // Flush flushes the write journal for the given TLF.
 func (j *JournalServer) Flush(ctx context.Context, tlfID tlf.ID) (err error) {
 	j.log.CDebugf(ctx, "Flushing journal for %s", tlfID)
@@ -566,6 +745,54 @@ func (j *JournalServer) mdOps() journalMDOps {
 	return journalMDOps{j.delegateMDOps, j}
 }
 
+// SetTLFJournalLimits sets the limits on the size of each TLF
+// journal, for both existing and future journals.
+func (j *JournalServer) SetTLFJournalLimits(limits TLFJournalLimits) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.tlfJournalLimits = limits
+	for _, tlfJournal := range j.tlfJournals {
+		tlfJournal.setLimits(limits)
+	}
+}
+
+// waitForSpace waits until the journal for the given TLF, if there
+// is one, is under its limits, or returns ErrJournalFull if it isn't
+// and the limits don't call for waiting.  Then it waits until the
+// local stores are under the disk limits.
+func (j *JournalServer) waitForSpace(ctx context.Context, tlfID tlf.ID) error {
+	tlfJournal, ok := j.getTLFJournal(tlfID)
+	if !ok {
+		return nil
+	}
+	err := tlfJournal.waitForSpace(ctx, 0)
+	if err == errTLFJournalDisabled {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return j.config.DiskLimiter().WaitForSpace(ctx, 0)
+}
+
+// diskUsage returns the total size of the regular files under dir.
+func diskUsage(dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(
+		path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return total, err
+}
+
 // Status returns a JournalServerStatus object suitable for
 // diagnostics.  It also returns a list of TLF IDs which have journals
 // enabled.
@@ -585,17 +812,38 @@ func (j *JournalServer) Status(
 		totalUnflushedBytes += unflushedBytes
 		tlfIDs = append(tlfIDs, tlfJournal.tlfID)
 	}
+	usage, err := diskUsage(j.rootPath())
+	if err != nil {
+		j.log.CWarningf(ctx, "Couldn't calculate disk usage: %v", err)
+	}
 	return JournalServerStatus{
 		RootDir:             j.rootPath(),
 		Version:             1,
 		CurrentUID:          j.currentUID,
 		CurrentVerifyingKey: j.currentVerifyingKey,
 		EnableAuto:          j.serverConfig.EnableAuto,
+		WriteThrough:        j.serverConfig.WriteThrough,
 		JournalCount:        len(tlfIDs),
 		UnflushedBytes:      totalUnflushedBytes,
+		DiskUsage:           usage,
 	}, tlfIDs
 }
 
+// getUnflushedBytes returns the total number of unflushed bytes in
+// all the TLF journals, without the cost of computing a full Status.
+func (j *JournalServer) getUnflushedBytes() int64 {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	var totalUnflushedBytes int64
+	for _, tlfJournal := range j.tlfJournals {
+		// Journals that are shut down or disabled have nothing
+		// left to flush.
+		unflushedBytes, _ := tlfJournal.getUnflushedBytes()
+		totalUnflushedBytes += unflushedBytes
+	}
+	return totalUnflushedBytes
+}
+
 // JournalStatus returns a TLFServerStatus object for the given TLF
 // suitable for diagnostics.
 func (j *JournalServer) JournalStatus(tlfID tlf.ID) (
@@ -646,6 +894,30 @@ func (j *JournalServer) shutdownExistingJournalsLocked(ctx context.Context) {
 	j.tlfJournals = make(map[tlf.ID]*tlfJournal)
 	j.currentUID = keybase1.UID("")
 	j.currentVerifyingKey = kbfscrypto.VerifyingKey{}
+	j.storageKeys = nil
+	j.currentCryptKey = kbfscrypto.CryptPublicKey{}
+}
+
+// RotateStorageKey adds a new storage key for the current device,
+// which block data newly written to sealed journals is sealed with
+// from then on, and returns its generation.  Data sealed with the
+// previous keys stays readable.  It's an error to call this if
+// Config.EncryptLocalStorage was false when the journals were
+// enabled, and none of them is sealed.
+func (j *JournalServer) RotateStorageKey(ctx context.Context) (
+	kbfscrypto.StorageKeyGen, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.storageKeys == nil {
+		return 0, errors.New("Local storage encryption is not enabled")
+	}
+	gen, err := rotateStorageKeyring(j.config.Codec(), j.config.Crypto(),
+		j.currentCryptKey, j.storageKeys, j.storageKeysPathLocked())
+	if err != nil {
+		return 0, err
+	}
+	j.log.CDebugf(ctx, "Rotated storage key to generation %d", gen)
+	return gen, nil
 }
 
 // shutdownExistingJournals shuts down all write journals, sets the
@@ -9,6 +9,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -447,3 +448,220 @@ func TestJournalServerEnableAuto(t *testing.T) {
 	require.Equal(t, 1, status.JournalCount)
 	require.Len(t, tlfIDs, 1)
 }
+
+func TestJournalServerWriteThrough(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	ctx := context.Background()
+
+	tlfID := tlf.FakeID(2, false)
+	err := jServer.EnableAuto(ctx)
+	require.NoError(t, err)
+	err = jServer.SetWriteThrough(ctx, tlfID, true)
+	require.NoError(t, err)
+
+	status, tlfIDs := jServer.Status(ctx)
+	require.True(t, status.EnableAuto)
+	require.Equal(t, []tlf.ID{tlfID}, status.WriteThrough)
+	require.Len(t, tlfIDs, 0)
+
+	blockServer := config.BlockServer()
+	crypto := config.Crypto()
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user1", false)
+	require.NoError(t, err)
+	uid := h.ResolvedWriters()[0]
+
+	// Put a block, which should go straight to the server without
+	// creating a journal.
+	bCtx := BlockContext{uid, "", ZeroBlockRefNonce}
+	data := []byte{1, 2, 3, 4}
+	bID, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = blockServer.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+
+	status, tlfIDs = jServer.Status(ctx)
+	require.Zero(t, status.JournalCount)
+	require.Len(t, tlfIDs, 0)
+	_, _, err = jServer.delegateBlockServer.Get(ctx, tlfID, bID, bCtx)
+	require.NoError(t, err)
+
+	err = jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkPaused)
+	require.Error(t, err)
+
+	// Simulate a restart; the setting should persist.
+	jServer = makeJournalServer(
+		config, jServer.log, tempdir, jServer.delegateBlockCache,
+		jServer.delegateDirtyBlockCache,
+		jServer.delegateBlockServer, jServer.delegateMDOps, nil, nil)
+	uid, verifyingKey, err :=
+		getCurrentUIDAndVerifyingKey(ctx, config.KBPKI())
+	require.NoError(t, err)
+	err = jServer.EnableExistingJournals(
+		ctx, uid, verifyingKey, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+	status, _ = jServer.Status(ctx)
+	require.Equal(t, []tlf.ID{tlfID}, status.WriteThrough)
+
+	// Turning write-through off should journal new writes again.
+	err = jServer.SetWriteThrough(ctx, tlfID, false)
+	require.NoError(t, err)
+	status, _ = jServer.Status(ctx)
+	require.Len(t, status.WriteThrough, 0)
+	_, ok := jServer.getTLFJournal(tlfID)
+	require.True(t, ok)
+}
+
+func TestJournalServerEncryptLocalStorage(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "journal_server")
+	require.NoError(t, err)
+	config := MakeTestConfigOrBust(t, "test_user1")
+	defer teardownJournalServerTest(t, tempdir, config)
+	config.SetEncryptLocalStorage(true)
+	config.EnableJournaling(tempdir, TLFJournalBackgroundWorkPaused)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+	require.NotNil(t, jServer.storageKeys)
+
+	// Use a shutdown-only BlockServer so that it errors if the
+	// journal tries to access it.
+	jServer.delegateBlockServer = shutdownOnlyBlockServer{}
+
+	ctx := context.Background()
+	tlfID := tlf.FakeID(2, false)
+	err = jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	blockServer := config.BlockServer()
+	crypto := config.Crypto()
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user1", false)
+	require.NoError(t, err)
+	uid := h.ResolvedWriters()[0]
+
+	putBlock := func(data []byte) (BlockID, BlockContext,
+		kbfscrypto.BlockCryptKeyServerHalf) {
+		bCtx := BlockContext{uid, "", ZeroBlockRefNonce}
+		bID, err := crypto.MakePermanentBlockID(data)
+		require.NoError(t, err)
+		serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+		require.NoError(t, err)
+		err = blockServer.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+		require.NoError(t, err)
+		return bID, bCtx, serverHalf
+	}
+
+	data1 := []byte{1, 2, 3, 4}
+	bID1, bCtx1, serverHalf1 := putBlock(data1)
+
+	// The data is sealed on disk.
+	tlfJournal, ok := jServer.getTLFJournal(tlfID)
+	require.True(t, ok)
+	sealed, err := ioutil.ReadFile(tlfJournal.blockJournal.s.dataPath(bID1))
+	require.NoError(t, err)
+	require.Len(t, sealed, len(data1)+kbfscrypto.StorageSealOverhead)
+	opened, err := jServer.storageKeys.Open(sealed)
+	require.NoError(t, err)
+	require.Equal(t, data1, opened)
+	size, err := tlfJournal.blockJournal.s.getDataSize(bID1)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data1)), size)
+
+	gen, err := jServer.RotateStorageKey(ctx)
+	require.NoError(t, err)
+	require.Equal(t, kbfscrypto.FirstValidStorageKeyGen+1, gen)
+	data2 := []byte{5, 6, 7, 8}
+	bID2, bCtx2, serverHalf2 := putBlock(data2)
+
+	// Simulate a restart; the storage keys, including the
+	// rotated one, should be unwrapped again.
+	jServer = makeJournalServer(
+		config, jServer.log, tempdir, jServer.delegateBlockCache,
+		jServer.delegateDirtyBlockCache,
+		jServer.delegateBlockServer, jServer.delegateMDOps, nil, nil)
+	uid, verifyingKey, err :=
+		getCurrentUIDAndVerifyingKey(ctx, config.KBPKI())
+	require.NoError(t, err)
+	err = jServer.EnableExistingJournals(
+		ctx, uid, verifyingKey, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+	require.Equal(t, gen, jServer.storageKeys.LatestGen())
+	config.SetBlockCache(jServer.blockCache())
+	config.SetBlockServer(jServer.blockServer())
+	config.SetMDOps(jServer.mdOps())
+	blockServer = config.BlockServer()
+
+	buf, key, err := blockServer.Get(ctx, tlfID, bID1, bCtx1)
+	require.NoError(t, err)
+	require.Equal(t, data1, buf)
+	require.Equal(t, serverHalf1, key)
+	buf, key, err = blockServer.Get(ctx, tlfID, bID2, bCtx2)
+	require.NoError(t, err)
+	require.Equal(t, data2, buf)
+	require.Equal(t, serverHalf2, key)
+}
+
+func TestJournalServerSealedAfterEncryptLocalStorageOff(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "journal_server")
+	require.NoError(t, err)
+	config := MakeTestConfigOrBust(t, "test_user1")
+	defer teardownJournalServerTest(t, tempdir, config)
+	config.SetEncryptLocalStorage(true)
+	config.EnableJournaling(tempdir, TLFJournalBackgroundWorkPaused)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+	jServer.delegateBlockServer = shutdownOnlyBlockServer{}
+
+	ctx := context.Background()
+	tlfID1 := tlf.FakeID(2, false)
+	err = jServer.Enable(ctx, tlfID1, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user1", false)
+	require.NoError(t, err)
+	uid := h.ResolvedWriters()[0]
+	crypto := config.Crypto()
+	data := []byte{1, 2, 3, 4}
+	bCtx := BlockContext{uid, "", ZeroBlockRefNonce}
+	bID, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = config.BlockServer().Put(ctx, tlfID1, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+
+	// Restart with local storage encryption turned off; the
+	// sealed journal should still be readable.
+	config.SetEncryptLocalStorage(false)
+	jServer = makeJournalServer(
+		config, jServer.log, tempdir, jServer.delegateBlockCache,
+		jServer.delegateDirtyBlockCache,
+		jServer.delegateBlockServer, jServer.delegateMDOps, nil, nil)
+	uid, verifyingKey, err :=
+		getCurrentUIDAndVerifyingKey(ctx, config.KBPKI())
+	require.NoError(t, err)
+	err = jServer.EnableExistingJournals(
+		ctx, uid, verifyingKey, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+	require.NotNil(t, jServer.storageKeys)
+	_, ok := jServer.getTLFJournal(tlfID1)
+	require.True(t, ok)
+
+	buf, key, err := jServer.blockServer().Get(ctx, tlfID1, bID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.Equal(t, serverHalf, key)
+
+	// New journals aren't sealed, though.
+	tlfID2 := tlf.FakeID(3, false)
+	err = jServer.Enable(ctx, tlfID2, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+	info, err := readTLFJournalInfoFile(jServer.tlfJournalPathLocked(tlfID2))
+	require.NoError(t, err)
+	require.False(t, info.SealedStorage)
+	tlfJournal, ok := jServer.getTLFJournal(tlfID2)
+	require.True(t, ok)
+	require.Nil(t, tlfJournal.blockJournal.s.storage)
+}
@@ -47,6 +47,18 @@ func WaitForTLFJournal(ctx context.Context, config Config, tlfID tlf.ID,
 	return nil
 }
 
+// waitForTLFJournalSpace returns nil if the corresponding journal, if
+// one exists, has room for more writes.  Otherwise it either waits
+// for the journal to flush, or returns ErrJournalFull, depending on
+// the journal's limits.
+func waitForTLFJournalSpace(
+	ctx context.Context, config Config, tlfID tlf.ID) error {
+	if jServer, err := GetJournalServer(config); err == nil {
+		return jServer.waitForSpace(ctx, tlfID)
+	}
+	return nil
+}
+
 func fillInJournalStatusUnflushedPaths(ctx context.Context, config Config,
 	jStatus *JournalServerStatus, tlfIDs []tlf.ID) error {
 	if len(tlfIDs) == 0 {
@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"fmt"
 	"reflect"
 	"sync"
 	"testing"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
 
@@ -197,6 +199,55 @@ func TestMultipleMDUpdatesUnembedChanges(t *testing.T) {
 	testMultipleMDUpdates(t, true)
 }
 
+// Tests that a device that missed many MD updates fast-forwards to
+// the head without fetching the revisions in between.
+func TestFastForwardSkipsHistory(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	defer close(c)
+
+	kbfsOps1 := config1.KBFSOps()
+	for i := 0; i <= fastForwardRevThresh; i++ {
+		_, _, err := kbfsOps1.CreateFile(
+			ctx, rootNode1, fmt.Sprintf("f%d", i), false, NoExcl)
+		require.NoError(t, err)
+	}
+
+	kbfsOps2 := config2.KBFSOps()
+	fbo := kbfsOps2.(*KBFSOpsStandard).getOpsNoAdd(
+		rootNode2.GetFolderBranch())
+	lState := makeFBOLockState()
+	startRev := fbo.getLatestMergedRevision(lState)
+	ffDone, err := fbo.maybeFastForward(
+		ctx, lState, time.Time{}, config2.Clock().Now())
+	require.NoError(t, err)
+	require.True(t, ffDone)
+	require.Equal(t, startRev+fastForwardRevThresh+1,
+		fbo.getLatestMergedRevision(lState))
+
+	// None of the revisions in between were fetched.
+	_, err = config2.MDCache().Get(fbo.id(), startRev+1, NullBranchID)
+	require.IsType(t, NoSuchMDError{}, err)
+
+	entries, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, entries, fastForwardRevThresh+1)
+}
+
 // Tests that, in the face of a conflict, a user will commit its
 // changes to a private branch, which will persist after restart (and
 // the other user will be unaffected).
@@ -816,6 +867,222 @@ func TestBasicCRFileConflict(t *testing.T) {
 	}
 }
 
+// Tests that a conflict resolution strategy can choose to keep only
+// the merged version of a file written by both users.
+func TestCRFileConflictPreferRemoteStrategy(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetConflictResolutionStrategy(ExtensionConflictResolutionStrategy{
+		Default: FileConflictKeepBoth,
+		ByExtension: map[string]FileConflictPolicy{
+			".lock": FileConflictPreferRemote,
+		},
+	})
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates two files in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b.lock", false, NoExcl)
+	require.NoError(t, err)
+	fileC1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "c", false, NoExcl)
+	require.NoError(t, err)
+
+	// look them up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b.lock")
+	require.NoError(t, err)
+	fileC2, _, err := kbfsOps2.Lookup(ctx, dirA2, "c")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Both users write both files.
+	data1 := []byte{1, 2, 3, 4, 5}
+	for _, n := range []Node{fileB1, fileC1} {
+		require.NoError(t, kbfsOps1.Write(ctx, n, data1, 0))
+		require.NoError(t, kbfsOps1.Sync(ctx, n))
+	}
+	data2 := []byte{5, 4, 3, 2, 1}
+	for _, n := range []Node{fileB2, fileC2} {
+		require.NoError(t, kbfsOps2.Write(ctx, n, data2, 0))
+		require.NoError(t, kbfsOps2.Sync(ctx, n))
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// The lock file should have user 1's contents, and no
+	// conflicted copy, while the other file is kept twice.
+	children1, err := kbfsOps1.GetDirChildren(ctx, dirA1)
+	require.NoError(t, err)
+	children2, err := kbfsOps2.GetDirChildren(ctx, dirA2)
+	require.NoError(t, err)
+	require.Len(t, children1, 3)
+	require.Contains(t, children1, "b.lock")
+	require.Contains(t, children1, "c")
+	require.Equal(t, children1, children2)
+
+	checkContents := func(kbfsOps KBFSOps, dir Node) {
+		n, _, err := kbfsOps.Lookup(ctx, dir, "b.lock")
+		require.NoError(t, err)
+		buf := make([]byte, len(data1))
+		nRead, err := kbfsOps.Read(ctx, n, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, data1, buf[:nRead])
+	}
+	checkContents(kbfsOps1, dirA1)
+	checkContents(kbfsOps2, dirA2)
+}
+
+// Tests that with manual conflict resolution, conflicts are listed
+// instead of being resolved, and are then resolved according to the
+// user's choices.
+func TestCRManualResolution(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates three files in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileNames := []string{"b", "c", "d"}
+	var files1 []Node
+	for _, fileName := range fileNames {
+		n, _, err := kbfsOps1.CreateFile(ctx, dirA1, fileName, false, NoExcl)
+		require.NoError(t, err)
+		files1 = append(files1, n)
+	}
+
+	// look them up on user2, and turn on manual CR there
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fb := rootNode2.GetFolderBranch()
+	err = kbfsOps2.SetManualConflictResolution(ctx, fb, true)
+	require.NoError(t, err)
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	var files2 []Node
+	for _, fileName := range fileNames {
+		n, _, err := kbfsOps2.Lookup(ctx, dirA2, fileName)
+		require.NoError(t, err)
+		files2 = append(files2, n)
+	}
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+
+	// Both users write all the files.
+	data1 := []byte{1, 2, 3, 4, 5}
+	for _, n := range files1 {
+		require.NoError(t, kbfsOps1.Write(ctx, n, data1, 0))
+		require.NoError(t, kbfsOps1.Sync(ctx, n))
+	}
+	data2 := []byte{5, 4, 3, 2}
+	for _, n := range files2 {
+		require.NoError(t, kbfsOps2.Write(ctx, n, data2, 0))
+		require.NoError(t, kbfsOps2.Sync(ctx, n))
+	}
+
+	// re-enable updates; user 2 should stay unmerged.
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.Error(t, err)
+
+	conflicts, err := kbfsOps2.GetConflicts(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, conflicts, len(fileNames))
+	for i, conflict := range conflicts {
+		require.Equal(t, "/keybase/private/"+name+"/a/"+fileNames[i],
+			conflict.Path)
+		require.Equal(t, conflict.Path, conflict.LocalPath)
+		require.Equal(t, uint64(len(data2)), conflict.Local.Size)
+		require.Equal(t, uint64(len(data1)), conflict.Remote.Size)
+		require.Nil(t, conflict.Choice)
+	}
+
+	err = kbfsOps2.ResolveConflict(
+		ctx, fb, conflicts[0].Path, ConflictChoiceLocal)
+	require.NoError(t, err)
+	err = kbfsOps2.ResolveConflict(
+		ctx, fb, conflicts[1].Path, ConflictChoiceRemote)
+	require.NoError(t, err)
+	conflicts, err = kbfsOps2.GetConflicts(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, conflicts, len(fileNames))
+	require.Equal(t, ConflictChoiceLocal, *conflicts[0].Choice)
+	require.Equal(t, ConflictChoiceRemote, *conflicts[1].Choice)
+	require.Nil(t, conflicts[2].Choice)
+
+	// The last choice triggers the resolution.
+	err = kbfsOps2.ResolveConflict(
+		ctx, fb, conflicts[2].Path, ConflictChoiceKeepBoth)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	children1, err := kbfsOps1.GetDirChildren(ctx, dirA1)
+	require.NoError(t, err)
+	children2, err := kbfsOps2.GetDirChildren(ctx, dirA2)
+	require.NoError(t, err)
+	// b and c, plus both versions of d.
+	require.Len(t, children1, 4)
+	require.Equal(t, children1, children2)
+
+	checkContents := func(kbfsOps KBFSOps, dir Node, name string,
+		expected []byte) {
+		n, _, err := kbfsOps.Lookup(ctx, dir, name)
+		require.NoError(t, err)
+		buf := make([]byte, 10)
+		nRead, err := kbfsOps.Read(ctx, n, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, buf[:nRead])
+	}
+	checkContents(kbfsOps1, dirA1, "b", data2)
+	checkContents(kbfsOps1, dirA1, "c", data1)
+	checkContents(kbfsOps1, dirA1, "d", data1)
+	checkContents(kbfsOps2, dirA2, "b", data2)
+	checkContents(kbfsOps2, dirA2, "c", data1)
+	checkContents(kbfsOps2, dirA2, "d", data1)
+}
+
 // Tests that two users can create the same file simultaneously, and
 // the unmerged user can write to it, and they will be merged into a
 // single file.
@@ -2058,3 +2325,158 @@ func TestUnmergedPutAfterCanceledUnmergedPut(t *testing.T) {
 		}
 	}
 }
+
+// Tests that previewing conflict resolution reports the conflicted
+// copies that CR later makes, without resolving anything itself.
+func TestCRPreviewConflictResolution(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false, NoExcl)
+	require.NoError(t, err)
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fb := rootNode2.GetFolderBranch()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b")
+	require.NoError(t, err)
+
+	// Nothing to preview yet.
+	preview, err := kbfsOps2.PreviewConflictResolution(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, ConflictResolutionPreview{}, preview)
+
+	// disable updates and CR on user 2
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+
+	// Both users write the file.
+	require.NoError(t, kbfsOps1.Write(ctx, fileB1, []byte{1, 2, 3}, 0))
+	require.NoError(t, kbfsOps1.Sync(ctx, fileB1))
+	require.NoError(t, kbfsOps2.Write(ctx, fileB2, []byte{3, 2, 1}, 0))
+	require.NoError(t, kbfsOps2.Sync(ctx, fileB2))
+
+	preview, err = kbfsOps2.PreviewConflictResolution(ctx, fb)
+	require.NoError(t, err)
+	require.NotEmpty(t, preview.Ops)
+	require.NotEmpty(t, preview.Actions)
+	require.Len(t, preview.ConflictedCopies, 1)
+	dir := "/keybase/private/" + name + "/a/"
+	conflictedCopy := preview.ConflictedCopies[0]
+	require.Equal(t, dir+"b", conflictedCopy.Path)
+	require.True(t, conflictedCopy.Local)
+	cre := WriterDeviceDateConflictRenamer{}
+	conflictName := cre.ConflictRenameHelper(
+		config2.Clock().Now(), "u2", "dev1", "b")
+	require.Equal(t, dir+conflictName, conflictedCopy.ConflictPath)
+
+	// The preview shouldn't have changed anything.
+	children2, err := kbfsOps2.GetDirChildren(ctx, dirA2)
+	require.NoError(t, err)
+	require.Len(t, children2, 1)
+
+	// re-enable updates and CR, and check that CR did what the
+	// preview said.
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	children2, err = kbfsOps2.GetDirChildren(ctx, dirA2)
+	require.NoError(t, err)
+	require.Len(t, children2, 2)
+	require.Contains(t, children2, "b")
+	require.Contains(t, children2, conflictName)
+}
+
+// Tests that concurrent edits to different lines of a small text file
+// are merged during CR, instead of making a conflicted copy.
+func TestCRTextMerge(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a text file in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false, NoExcl)
+	require.NoError(t, err)
+	base := []byte("1\n2\n3\n4\n5\n")
+	require.NoError(t, kbfsOps1.Write(ctx, fileB1, base, 0))
+	require.NoError(t, kbfsOps1.Sync(ctx, fileB1))
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fb := rootNode2.GetFolderBranch()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b")
+	require.NoError(t, err)
+
+	// disable updates and CR on user 2
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+
+	// user1 changes the first line, and user2 the last one.
+	require.NoError(t, kbfsOps1.Write(
+		ctx, fileB1, []byte("one\n2\n3\n4\n5\n"), 0))
+	require.NoError(t, kbfsOps1.Sync(ctx, fileB1))
+	require.NoError(t, kbfsOps2.Write(
+		ctx, fileB2, []byte("1\n2\n3\n4\nfive\n"), 0))
+	require.NoError(t, kbfsOps2.Sync(ctx, fileB2))
+
+	// re-enable updates and CR
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	expected := []byte("one\n2\n3\n4\nfive\n")
+	for _, ops := range []struct {
+		kbfsOps KBFSOps
+		dir     Node
+	}{{kbfsOps1, dirA1}, {kbfsOps2, dirA2}} {
+		children, err := ops.kbfsOps.GetDirChildren(ctx, ops.dir)
+		require.NoError(t, err)
+		require.Len(t, children, 1)
+		file, ei, err := ops.kbfsOps.Lookup(ctx, ops.dir, "b")
+		require.NoError(t, err)
+		buf := make([]byte, ei.Size)
+		n, err := ops.kbfsOps.Read(ctx, file, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, buf[:n])
+	}
+}
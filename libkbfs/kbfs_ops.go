@@ -7,12 +7,17 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
+	"os"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/sync/errgroup"
 
 	"golang.org/x/net/context"
 )
@@ -33,10 +38,23 @@ type KBFSOpsStandard struct {
 	// Closing this channel will shutdown the reidentification
 	// watcher.
 	reIdentifyControlChan chan chan<- struct{}
+	// Closed on shutdown.
+	shutdownChan chan struct{}
 
 	favs *Favorites
 
+	// revocations remembers the revoked devices KBFS has already
+	// reacted to.
+	revocations *deviceRevocationTracker
+
+	// quotaUsage is shared by all the folderBranchOps.
+	quotaUsage *quotaUsageCache
+
 	currentStatus kbfsCurrentStatus
+
+	// connectivityObservers hear about changes to the
+	// connectivity state.
+	connectivityObservers *observerList
 }
 
 var _ KBFSOps = (*KBFSOpsStandard)(nil)
@@ -51,10 +69,20 @@ func NewKBFSOpsStandard(config Config) *KBFSOpsStandard {
 		ops:                   make(map[FolderBranch]*folderBranchOps),
 		opsByFav:              make(map[Favorite]*folderBranchOps),
 		reIdentifyControlChan: make(chan chan<- struct{}),
-		favs: NewFavorites(config),
+		shutdownChan:          make(chan struct{}),
+		favs:                  NewFavorites(config),
+		revocations:           newDeviceRevocationTracker(),
+		quotaUsage:            newQuotaUsageCache(config),
+		connectivityObservers: newObserverList(),
 	}
 	kops.currentStatus.Init()
 	go kops.markForReIdentifyIfNeededLoop()
+	go kops.watchForClockJumpsLoop()
+	// Get the starting status now, so that no changes are missed
+	// before the loop starts.
+	ct := config.Connectivity()
+	status, changedCh := ct.Status()
+	go kops.watchConnectivityLoop(ct, status, changedCh)
 	return kops
 }
 
@@ -100,15 +128,106 @@ func (fs *KBFSOpsStandard) markForReIdentifyIfNeeded(
 	}
 }
 
+// watchForClockJumpsLoop checks the clock every
+// clockJumpCheckInterval, and revalidates all the cached heads when
+// the clock jumps.  This catches laptops waking up from a long
+// sleep, which may have missed update notifications in the meantime.
+func (fs *KBFSOpsStandard) watchForClockJumpsLoop() {
+	ticker := time.NewTicker(clockJumpCheckInterval)
+	defer ticker.Stop()
+	d := newClockJumpDetector(fs.config.Clock(), clockJumpCheckInterval)
+	for {
+		select {
+		case <-ticker.C:
+		case <-fs.shutdownChan:
+			return
+		}
+		if jump, ok := d.check(); ok {
+			fs.revalidateAfterClockJump(context.Background(), jump)
+		}
+	}
+}
+
+// revalidateAfterClockJump makes every favorited TLF that has been
+// initialized check for a new head right away, and kicks its journal
+// (if any) out of any backoff it was waiting on.  Favorites that
+// haven't been initialized have nothing cached to revalidate.
+func (fs *KBFSOpsStandard) revalidateAfterClockJump(
+	ctx context.Context, jump time.Duration) {
+	fs.log.CDebugf(ctx, "Clock jumped by %s; revalidating all heads", jump)
+	recordClockJumpMetric(fs.config.MetricsRegistry(),
+		clockJumpDetectedMetric)
+	fs.revalidateAllHeads(ctx)
+}
+
+// revalidateAllHeads makes every favorited TLF that has been
+// initialized check for a new head right away, and kicks every
+// journal out of any backoff or wait it was in.
+func (fs *KBFSOpsStandard) revalidateAllHeads(ctx context.Context) {
+	func() {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		for _, fbo := range fs.opsByFav {
+			fbo.signalRevalidateHead()
+		}
+	}()
+	if jServer, err := GetJournalServer(fs.config); err == nil {
+		jServer.retryAllBackgroundWork(ctx)
+	}
+}
+
+// watchConnectivityLoop tells the connectivity observers and the
+// status listeners whenever the connectivity state changes from the
+// given starting status, and when it gets better, kicks the
+// background work that may have been waiting for it.
+func (fs *KBFSOpsStandard) watchConnectivityLoop(ct ConnectivityTracker,
+	status ConnectivityStatus, changedCh <-chan StatusUpdate) {
+	for {
+		select {
+		case <-changedCh:
+		case <-fs.shutdownChan:
+			return
+		}
+		prevState := status.State
+		status, changedCh = ct.Status()
+		if status.State == prevState {
+			continue
+		}
+
+		ctx := context.Background()
+		fs.log.CDebugf(ctx, "Connectivity changed from %s to %s",
+			prevState, status.State)
+		fs.currentStatus.PushStatusChange()
+		fs.connectivityObservers.connectivityChanged(ctx, status)
+		// States are ordered from best to worst.
+		if status.State < prevState {
+			fs.revalidateAllHeads(ctx)
+		}
+	}
+}
+
 // Shutdown safely shuts down any background goroutines that may have
 // been launched by KBFSOpsStandard.
 func (fs *KBFSOpsStandard) Shutdown() error {
 	close(fs.reIdentifyControlChan)
+	close(fs.shutdownChan)
 	var errors []error
 	if err := fs.favs.Shutdown(); err != nil {
 		errors = append(errors, err)
 	}
-	for _, ops := range fs.ops {
+	// Copy the ops under the lock, but shut them down outside of
+	// it, since shutting down waits for their background work,
+	// which may itself need to look up other ops.
+	var allOps []*folderBranchOps
+	func() {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		allOps = make([]*folderBranchOps, 0, len(fs.ops))
+		for _, ops := range fs.ops {
+			allOps = append(allOps, ops)
+		}
+	}()
+	for _, ops := range allOps {
 		if err := ops.Shutdown(); err != nil {
 			errors = append(errors, err)
 			// Continue on and try to shut down the other FBOs.
@@ -127,6 +246,7 @@ func (fs *KBFSOpsStandard) Shutdown() error {
 func (fs *KBFSOpsStandard) PushConnectionStatusChange(
 	service string, newStatus error) {
 	fs.currentStatus.PushConnectionStatusChange(service, newStatus)
+	fs.config.Connectivity().ServiceStatusChanged(service, newStatus)
 }
 
 // PushStatusChange forces a new status be fetched by status listeners.
@@ -141,6 +261,114 @@ func (fs *KBFSOpsStandard) GetFavorites(ctx context.Context) (
 	return fs.favs.Get(ctx)
 }
 
+// getFavoriteHead returns the ID and the latest merged MD of the
+// given favorite folder.
+func (fs *KBFSOpsStandard) getFavoriteHead(ctx context.Context,
+	fav Favorite) (tlf.ID, ImmutableRootMetadata, error) {
+	handle, err := parseTlfHandleLoose(
+		ctx, fs.config.KBPKI(), fav.Name, fav.Public)
+	if err != nil {
+		return tlf.ID{}, ImmutableRootMetadata{}, err
+	}
+	return fs.config.MDOps().GetForHandle(ctx, handle, Merged)
+}
+
+// GetFavoritesWithMetadata implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetFavoritesWithMetadata(ctx context.Context) (
+	[]FavoriteWithMetadata, error) {
+	favs, err := fs.favs.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	kbpki := fs.config.KBPKI()
+	deviceKey, err := kbpki.GetCurrentVerifyingKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]FavoriteWithMetadata, len(favs))
+	ids := make([]tlf.ID, len(favs))
+	writerKeys := make([]kbfscrypto.VerifyingKey, len(favs))
+	favChan := make(chan int, len(favs))
+	for i, fav := range favs {
+		results[i].Favorite = fav
+		favChan <- i
+	}
+	close(favChan)
+
+	eg, groupCtx := errgroup.WithContext(ctx)
+	fetchFn := func() error {
+		for i := range favChan {
+			id, head, err := fs.getFavoriteHead(groupCtx, favs[i])
+			if groupCtx.Err() != nil {
+				return groupCtx.Err()
+			} else if err != nil {
+				// A folder that can't be looked up, e.g. one
+				// with an unresolvable assertion, shouldn't
+				// hide the others.
+				fs.log.CDebugf(groupCtx, "Couldn't get the head of %v: %v",
+					favs[i], err)
+				continue
+			} else if head == (ImmutableRootMetadata{}) {
+				continue
+			}
+			ids[i] = id
+			writerKeys[i] = head.LastModifyingWriterVerifyingKey()
+			results[i].Revision = head.Revision()
+			results[i].LastModified = head.LocalTimestamp()
+			results[i].LastWriter, err = kbpki.GetNormalizedUsername(
+				groupCtx, head.LastModifyingWriter())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := 0; i < favoritesMetadataParallelism && i < len(favs); i++ {
+		eg.Go(fetchFn)
+	}
+	err = eg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	// This device has caught up with a folder if it has the
+	// folder's latest revision, or made that revision itself.
+	ops := make([]*folderBranchOps, len(favs))
+	func() {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		for i, fav := range favs {
+			ops[i] = fs.opsByFav[fav]
+		}
+	}()
+	seen := make(map[tlf.ID]MetadataRevision)
+	latest := make(map[tlf.ID]MetadataRevision)
+	lState := makeFBOLockState()
+	for i, result := range results {
+		if ids[i] == (tlf.ID{}) {
+			continue
+		}
+		latest[ids[i]] = result.Revision
+		if writerKeys[i] == deviceKey {
+			seen[ids[i]] = result.Revision
+		} else if ops[i] != nil {
+			seen[ids[i]] = ops[i].getLatestMergedRevision(lState)
+		}
+	}
+	seen, err = fs.favs.updateSeen(ctx, seen, latest)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		if ids[i] != (tlf.ID{}) {
+			results[i].Unread = results[i].Revision > seen[ids[i]]
+		}
+	}
+	return results, nil
+}
+
 // RefreshCachedFavorites implements the KBFSOps interface for
 // KBFSOpsStandard.
 func (fs *KBFSOpsStandard) RefreshCachedFavorites(ctx context.Context) {
@@ -220,6 +448,7 @@ func (fs *KBFSOpsStandard) getOpsNoAdd(fb FolderBranch) *folderBranchOps {
 		// TODO: add some interface for specifying the type of the
 		// branch; for now assume online and read-write.
 		ops = newFolderBranchOps(fs.config, fb, standard)
+		ops.quotaUsage = fs.quotaUsage
 		fs.ops[fb] = ops
 	}
 	return ops
@@ -371,12 +600,28 @@ func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 		h.GetCanonicalPath(), branch, create)
 	defer func() { fs.deferLog.CDebugf(ctx, "Done: %#v", err) }()
 
+	// Anyone may read a public TLF, even without logging in, but
+	// then there's no device that could have an unmerged branch.
+	loggedIn := true
+	if h.IsPublic() {
+		name, err := GetCurrentUsernameIfPossible(
+			ctx, fs.config.KBPKI(), true)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
+		loggedIn = name != ""
+	}
+
 	// Do GetForHandle() unlocked -- no cache lookups, should be fine
 	mdops := fs.config.MDOps()
-	// TODO: only do this the first time, cache the folder ID after that
-	_, md, err := mdops.GetForHandle(ctx, h, Unmerged)
-	if err != nil {
-		return nil, EntryInfo{}, err
+	var md ImmutableRootMetadata
+	if loggedIn {
+		// TODO: only do this the first time, cache the folder ID
+		// after that
+		_, md, err = mdops.GetForHandle(ctx, h, Unmerged)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
 	}
 
 	if md == (ImmutableRootMetadata{}) {
@@ -483,6 +728,14 @@ func (fs *KBFSOpsStandard) GetDirChildren(ctx context.Context, dir Node) (
 	return ops.GetDirChildren(ctx, dir)
 }
 
+// GetDirChildrenPaged implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetDirChildrenPaged(ctx context.Context,
+	dir Node, cursor string, limit int) ([]DirChild, string, error) {
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.GetDirChildrenPaged(ctx, dir, cursor, limit)
+}
+
 // Lookup implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Lookup(ctx context.Context, dir Node, name string) (
 	Node, EntryInfo, error) {
@@ -520,6 +773,14 @@ func (fs *KBFSOpsStandard) CreateLink(
 	return ops.CreateLink(ctx, dir, fromName, toPath)
 }
 
+// CreateSpecialFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CreateSpecialFile(
+	ctx context.Context, dir Node, name string, special SpecialFileType) (
+	EntryInfo, error) {
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.CreateSpecialFile(ctx, dir, name, special)
+}
+
 // RemoveDir implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) RemoveDir(
 	ctx context.Context, dir Node, name string) error {
@@ -534,6 +795,29 @@ func (fs *KBFSOpsStandard) RemoveEntry(
 	return ops.RemoveEntry(ctx, dir, name)
 }
 
+// RemoveEntryIfUnchanged implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) RemoveEntryIfUnchanged(
+	ctx context.Context, dir Node, name string, node Node) error {
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.RemoveEntryIfUnchanged(ctx, dir, name, node)
+}
+
+// EstimateCopy implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) EstimateCopy(
+	ctx context.Context, dir Node, entries []DryRunEntry) (
+	CostEstimate, error) {
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.EstimateCopy(ctx, dir, entries)
+}
+
+// EstimateRemove implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) EstimateRemove(
+	ctx context.Context, dir Node, name string) (CostEstimate, error) {
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.EstimateRemove(ctx, dir, name)
+}
+
 // Rename implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Rename(
 	ctx context.Context, oldParent Node, oldName string, newParent Node,
@@ -565,6 +849,13 @@ func (fs *KBFSOpsStandard) Write(
 	return ops.Write(ctx, file, data, off)
 }
 
+// Append implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) Append(
+	ctx context.Context, file Node, data []byte) (int64, error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.Append(ctx, file, data)
+}
+
 // Truncate implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Truncate(
 	ctx context.Context, file Node, size uint64) error {
@@ -579,6 +870,20 @@ func (fs *KBFSOpsStandard) SetEx(
 	return ops.SetEx(ctx, file, ex)
 }
 
+// SetAppendOnly implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetAppendOnly(
+	ctx context.Context, file Node, appendOnly bool) error {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.SetAppendOnly(ctx, file, appendOnly)
+}
+
+// SetPerm implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetPerm(
+	ctx context.Context, node Node, perm os.FileMode) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.SetPerm(ctx, node, perm)
+}
+
 // SetMtime implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SetMtime(
 	ctx context.Context, file Node, mtime *time.Time) error {
@@ -586,12 +891,47 @@ func (fs *KBFSOpsStandard) SetMtime(
 	return ops.SetMtime(ctx, file, mtime)
 }
 
+// SetXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetXattr(
+	ctx context.Context, node Node, name string, value []byte) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.SetXattr(ctx, node, name, value)
+}
+
+// RemoveXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) RemoveXattr(
+	ctx context.Context, node Node, name string) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.RemoveXattr(ctx, node, name)
+}
+
 // Sync implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Sync(ctx context.Context, file Node) error {
 	ops := fs.getOpsByNode(ctx, file)
 	return ops.Sync(ctx, file)
 }
 
+// RunBatch implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) RunBatch(
+	ctx context.Context, fn func(tx BatchOps) error) error {
+	tx := newBatchOps(fs.getOpsByNode)
+	return tx.finish(ctx, fn(tx))
+}
+
+// LockFileRange implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) LockFileRange(ctx context.Context, file Node,
+	off, length uint64, wait bool) (*FileRangeLock, error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.LockFileRange(ctx, file, off, length, wait)
+}
+
+// GetParent implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetParent(ctx context.Context, node Node) (
+	dir Node, name string, err error) {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.GetParent(ctx, node)
+}
+
 // FolderStatus implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) FolderStatus(
 	ctx context.Context, folderBranch FolderBranch) (
@@ -600,6 +940,93 @@ func (fs *KBFSOpsStandard) FolderStatus(
 	return ops.FolderStatus(ctx, folderBranch)
 }
 
+// SetBlockPolicy implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetBlockPolicy(ctx context.Context,
+	folderBranch FolderBranch, policy BlockPolicy) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.SetBlockPolicy(ctx, folderBranch, policy)
+}
+
+// SetManualConflictResolution implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetManualConflictResolution(ctx context.Context,
+	folderBranch FolderBranch, manual bool) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.SetManualConflictResolution(ctx, folderBranch, manual)
+}
+
+// GetConflicts implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetConflicts(ctx context.Context,
+	folderBranch FolderBranch) ([]ConflictInfo, error) {
+	ops := fs.getOpsNoAdd(folderBranch)
+	return ops.GetConflicts(ctx, folderBranch)
+}
+
+// ResolveConflict implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ResolveConflict(ctx context.Context,
+	folderBranch FolderBranch, path string, choice ConflictChoice) error {
+	ops := fs.getOpsNoAdd(folderBranch)
+	return ops.ResolveConflict(ctx, folderBranch, path, choice)
+}
+
+// PreviewConflictResolution implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) PreviewConflictResolution(ctx context.Context,
+	folderBranch FolderBranch) (ConflictResolutionPreview, error) {
+	ops := fs.getOpsNoAdd(folderBranch)
+	return ops.PreviewConflictResolution(ctx, folderBranch)
+}
+
+// SetAccessLogging implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetAccessLogging(ctx context.Context,
+	folderBranch FolderBranch, enabled bool) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.SetAccessLogging(ctx, folderBranch, enabled)
+}
+
+// GetAccessLog implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetAccessLog(ctx context.Context,
+	folderBranch FolderBranch) ([]AccessLogEntry, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.GetAccessLog(ctx, folderBranch)
+}
+
+// PruneAccessLog implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) PruneAccessLog(ctx context.Context,
+	folderBranch FolderBranch, before time.Time) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.PruneAccessLog(ctx, folderBranch, before)
+}
+
+// GetTLFAccessLog implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetTLFAccessLog(ctx context.Context,
+	folderBranch FolderBranch, since time.Time) ([]TLFAccessEvent, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.GetTLFAccessLog(ctx, folderBranch, since)
+}
+
+// getUsageAndLimit returns the quota usage and limit of the
+// logged-in user, or -1 for each if they can't be fetched.
+func (fs *KBFSOpsStandard) getUsageAndLimit(ctx context.Context) (
+	usageBytes, limitBytes int64) {
+	usageBytes, limitBytes = -1, -1
+	if !fs.config.MDServer().IsConnected() {
+		return usageBytes, limitBytes
+	}
+	quotaInfo, err := fs.config.BlockServer().GetUserQuotaInfo(ctx)
+	if err != nil {
+		return usageBytes, limitBytes
+	}
+	limitBytes = quotaInfo.Limit
+	if quotaInfo.Total != nil {
+		usageBytes = quotaInfo.Total.Bytes[UsageWrite]
+	} else {
+		usageBytes = 0
+	}
+	return usageBytes, limitBytes
+}
+
 // Status implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 	KBFSStatus, <-chan StatusUpdate, error) {
@@ -610,16 +1037,8 @@ func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 	// authenticated with our password.  TODO: fix this in the
 	// service/GUI by handling multiple simultaneous passphrase
 	// requests at once.
-	if err == nil && fs.config.MDServer().IsConnected() {
-		quotaInfo, err := fs.config.BlockServer().GetUserQuotaInfo(ctx)
-		if err == nil {
-			limitBytes = quotaInfo.Limit
-			if quotaInfo.Total != nil {
-				usageBytes = quotaInfo.Total.Bytes[UsageWrite]
-			} else {
-				usageBytes = 0
-			}
-		}
+	if err == nil {
+		usageBytes, limitBytes = fs.getUsageAndLimit(ctx)
 	}
 	failures, ch := fs.currentStatus.CurrentStatus()
 	var jServerStatus *JournalServerStatus
@@ -634,16 +1053,78 @@ func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 		}
 	}
 
+	keyHalfHealth, _ := fs.config.KeyHalfHealth()
+	connectivity, _ := fs.config.Connectivity().Status()
+
+	var logStatus *LogStatus
+	if logControl := fs.config.LogControl(); logControl != nil {
+		status := logControl.Status()
+		logStatus = &status
+	}
+
 	return KBFSStatus{
-		CurrentUser:     username.String(),
-		IsConnected:     fs.config.MDServer().IsConnected(),
-		UsageBytes:      usageBytes,
-		LimitBytes:      limitBytes,
-		FailingServices: failures,
-		JournalServer:   jServerStatus,
+		CurrentUser:      username.String(),
+		IsConnected:      fs.config.MDServer().IsConnected(),
+		UsageBytes:       usageBytes,
+		LimitBytes:       limitBytes,
+		FailingServices:  failures,
+		JournalServer:    jServerStatus,
+		BandwidthLimits:  fs.config.BandwidthLimiter().Limits(),
+		DiskLimiter:      fs.config.DiskLimiter().Status(),
+		BlockCacheTuning: fs.config.BlockCacheTuningStatus(),
+		DirtyMemory:      fs.config.DirtyMemoryStatus(),
+		KeyHalfHealth:    keyHalfHealth,
+		Log:              logStatus,
+		Connectivity:     connectivity,
 	}, ch, err
 }
 
+// GetKBFSStatus implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetKBFSStatus(ctx context.Context) (
+	KBFSStatusSnapshot, error) {
+	snapshot := KBFSStatusSnapshot{
+		Time:        fs.config.Clock().Now(),
+		IsConnected: fs.config.MDServer().IsConnected(),
+		UsageBytes:  -1,
+		LimitBytes:  -1,
+	}
+	username, _, err := fs.config.KBPKI().GetCurrentUserInfo(ctx)
+	switch err.(type) {
+	case nil:
+		snapshot.CurrentUser = username.String()
+		// As in Status, only ask for the quota once logged in.
+		snapshot.UsageBytes, snapshot.LimitBytes =
+			fs.getUsageAndLimit(ctx)
+	case NoCurrentSessionError:
+		// Nobody is logged in, so leave CurrentUser empty.
+	default:
+		return KBFSStatusSnapshot{}, err
+	}
+
+	snapshot.Connectivity, _ = fs.config.Connectivity().Status()
+	failures, _ := fs.currentStatus.CurrentStatus()
+	if len(failures) > 0 {
+		snapshot.FailingServices = make(map[string]string, len(failures))
+		for service, err := range failures {
+			snapshot.FailingServices[service] = err.Error()
+		}
+	}
+	snapshot.Journals = getJournalsSnapshot(ctx, fs.config)
+	snapshot.Caches = CachesSnapshot{
+		BlockCache:       getBlockCacheStats(fs.config.BlockCache()),
+		BlockCacheTuning: fs.config.BlockCacheTuningStatus(),
+		DirtyMemory:      fs.config.DirtyMemoryStatus(),
+	}
+	snapshot.Folders, err = getFolderSnapshots(ctx, fs)
+	if err != nil {
+		return KBFSStatusSnapshot{}, err
+	}
+	snapshot.BlockRetrievals = getBlockRetrievalQueueStatus(
+		fs.config.BlockOps())
+	snapshot.RecentErrors = getRecentErrors(fs.config.Reporter())
+	return snapshot, nil
+}
+
 // UnstageForTesting implements the KBFSOps interface for KBFSOpsStandard
 // TODO: remove once we have automatic conflict resolution
 func (fs *KBFSOpsStandard) UnstageForTesting(
@@ -659,6 +1140,22 @@ func (fs *KBFSOpsStandard) Rekey(ctx context.Context, id tlf.ID) error {
 	return ops.Rekey(ctx, id)
 }
 
+// UserKeysChanged implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) UserKeysChanged(
+	ctx context.Context, uid keybase1.UID) error {
+	userInfo, err := fs.config.KeybaseService().LoadUserPlusKeys(ctx, uid)
+	if err != nil {
+		return err
+	}
+	keys := fs.revocations.newlyRevoked(userInfo)
+	if len(keys) == 0 {
+		return nil
+	}
+	fs.log.CDebugf(ctx, "User %s has %d newly-revoked devices",
+		uid, len(keys))
+	return fs.handleRevokedDevices(ctx, uid, keys)
+}
+
 // SyncFromServerForTesting implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SyncFromServerForTesting(
 	ctx context.Context, folderBranch FolderBranch) error {
@@ -680,6 +1177,70 @@ func (fs *KBFSOpsStandard) GetEditHistory(ctx context.Context,
 	return ops.GetEditHistory(ctx, folderBranch)
 }
 
+// GetKeyGenerations implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetKeyGenerations(ctx context.Context,
+	tlfID tlf.ID) ([]KeyGenerationInfo, error) {
+	ops := fs.getOpsNoAdd(FolderBranch{Tlf: tlfID, Branch: MasterBranch})
+	return ops.GetKeyGenerations(ctx, tlfID)
+}
+
+// GetUserQuotaInfo implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetUserQuotaInfo(ctx context.Context) (
+	QuotaUsage, error) {
+	return fs.quotaUsage.fetch(ctx)
+}
+
+// GetOpenFolderBranches implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetOpenFolderBranches(ctx context.Context) (
+	[]FolderBranch, error) {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	fbs := make([]FolderBranch, 0, len(fs.ops))
+	for fb := range fs.ops {
+		fbs = append(fbs, fb)
+	}
+	sort.Sort(folderBranchList(fbs))
+	return fbs, nil
+}
+
+// finalizeTLF finalizes the given TLF, after resetUser has reset
+// their account.  The finalized TLF stays readable, under its handle
+// with a finalized extension, but can't be written to.  Its old name
+// then refers to a new, empty successor TLF, whose root node is
+// returned.  Only writers may finalize a TLF, and only local MD
+// servers support it; see mdServerLocal.finalizeTLF.
+func (fs *KBFSOpsStandard) finalizeTLF(ctx context.Context,
+	folderBranch FolderBranch, resetUser libkb.NormalizedUsername) (
+	Node, error) {
+	ops := fs.getOpsNoAdd(folderBranch)
+	finalHandle, err := ops.finalize(ctx, resetUser)
+	if err != nil {
+		return nil, err
+	}
+
+	// The finalized TLF is now only reachable by its finalized
+	// name, and its old name belongs to the successor.
+	func() {
+		fs.opsLock.Lock()
+		defer fs.opsLock.Unlock()
+		for fav, favOps := range fs.opsByFav {
+			if favOps == ops {
+				delete(fs.opsByFav, fav)
+			}
+		}
+	}()
+	fs.getOpsByHandle(ctx, finalHandle, folderBranch)
+
+	node, _, err := fs.getMaybeCreateRootNode(
+		ctx, finalHandle.SuccessorHandle(), MasterBranch, true)
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
 // GetNodeMetadata implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetNodeMetadata(ctx context.Context, node Node) (
 	NodeMetadata, error) {
@@ -712,6 +1273,38 @@ func (fs *KBFSOpsStandard) UnregisterFromChanges(
 	return nil
 }
 
+// RegisterForFavoritesChanges implements the Notifier interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) RegisterForFavoritesChanges(
+	obs FavoritesObserver) error {
+	fs.favs.RegisterForChanges(obs)
+	return nil
+}
+
+// UnregisterFromFavoritesChanges implements the Notifier interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) UnregisterFromFavoritesChanges(
+	obs FavoritesObserver) error {
+	fs.favs.UnregisterFromChanges(obs)
+	return nil
+}
+
+// RegisterForConnectivityChanges implements the Notifier interface
+// for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) RegisterForConnectivityChanges(
+	obs ConnectivityObserver) error {
+	fs.connectivityObservers.add(obs)
+	return nil
+}
+
+// UnregisterFromConnectivityChanges implements the Notifier interface
+// for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) UnregisterFromConnectivityChanges(
+	obs ConnectivityObserver) error {
+	fs.connectivityObservers.remove(obs)
+	return nil
+}
+
 func (fs *KBFSOpsStandard) onTLFBranchChange(tlfID tlf.ID, newBID BranchID) {
 	ops := fs.getOpsNoAdd(FolderBranch{Tlf: tlfID, Branch: MasterBranch})
 	ops.onTLFBranchChange(newBID) // folderBranchOps makes a goroutine
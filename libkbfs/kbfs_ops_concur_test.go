@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"bytes"
 	"errors"
+	"math"
 	"runtime"
 	"sync"
 	"testing"
@@ -1059,6 +1060,8 @@ func TestKBFSOpsConcurWriteParallelBlocksError(t *testing.T) {
 		gomock.Any(), gomock.Any()).Times(3).Return(nil)
 	b.EXPECT().ArchiveBlockReferences(gomock.Any(), gomock.Any(),
 		gomock.Any()).AnyTimes().Return(nil)
+	b.EXPECT().GetUserQuotaInfo(gomock.Any()).AnyTimes().Return(
+		&UserQuotaInfo{Limit: math.MaxInt64}, nil)
 
 	// make blocks small
 	blockSize := int64(5)
@@ -1908,3 +1911,38 @@ func TestKBFSOpsCancelGetFavorites(t *testing.T) {
 	}
 	testRPCWithCanceledContext(t, serverConn, f)
 }
+
+// Test that config settings can be changed while KBFSOps calls are
+// reading them from other goroutines.  This is mostly useful when run
+// with -race.
+func TestKBFSOpsConcurConfigAccessors(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, "test_user")
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+
+	var wg sync.WaitGroup
+	const n = 20
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			config.SetDelayedCancellationGracePeriod(time.Duration(i))
+			config.SetTLFValidDuration(time.Hour + time.Duration(i))
+			config.SetMetricsRegistry(config.MetricsRegistry())
+			_ = config.ReadReplicaPollInterval()
+		}(i)
+		go func() {
+			defer wg.Done()
+			if _, err := kbfsOps.GetDirChildren(ctx, rootNode); err != nil {
+				t.Errorf("Couldn't get children: %v", err)
+			}
+			if _, _, err := kbfsOps.FolderStatus(
+				ctx, rootNode.GetFolderBranch()); err != nil {
+				t.Errorf("Couldn't get status: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -9,6 +9,8 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -684,12 +686,91 @@ func TestKBFSOpsGetBaseDirChildrenCacheSuccess(t *testing.T) {
 	for c, ei := range children {
 		if de, ok := dirBlock.Children[c]; !ok {
 			t.Errorf("No such child: %s", c)
-		} else if de.EntryInfo != ei {
+		} else if !reflect.DeepEqual(de.EntryInfo, ei) {
 			t.Errorf("Wrong EntryInfo for child %s: %v", c, ei)
 		}
 	}
 }
 
+func TestKBFSOpsGetDirChildrenPagedIndirect(t *testing.T) {
+	mockCtrl, config, ctx, cancel := kbfsOpsInit(t, false)
+	defer kbfsTestShutdown(mockCtrl, config, ctx, cancel)
+
+	u, id, rmd := injectNewRMD(t, config)
+
+	rootID := fakeBlockID(42)
+	blockPtr := makeBP(rootID, rmd, config, u)
+	rmd.data.Dir.BlockPointer = blockPtr
+	childPtrs := []BlockPointer{
+		makeBP(fakeBlockID(43), rmd, config, u),
+		makeBP(fakeBlockID(44), rmd, config, u),
+		makeBP(fakeBlockID(45), rmd, config, u),
+	}
+	dirBlock := NewDirBlock().(*DirBlock)
+	dirBlock.IsInd = true
+	for i, off := range []string{"", "m", "t"} {
+		dirBlock.IPtrs = append(dirBlock.IPtrs, IndirectDirPtr{
+			BlockInfo: BlockInfo{BlockPointer: childPtrs[i]},
+			Off:       off,
+		})
+	}
+	node := pathNode{blockPtr, "p"}
+	p := path{FolderBranch{Tlf: id}, []pathNode{node}}
+	testPutBlockInCache(t, config, node.BlockPointer, id, dirBlock)
+	childBlocks := make([]*DirBlock, len(childPtrs))
+	for i, names := range [][]string{{"e", "a", "c"}, {"p", "m"}, {"t"}} {
+		childBlocks[i] = NewDirBlock().(*DirBlock)
+		for _, name := range names {
+			childBlocks[i].Children[name] = DirEntry{
+				EntryInfo: EntryInfo{Type: File},
+			}
+		}
+	}
+	// The last child block isn't in the cache, and so can't be
+	// fetched: neither the first two pages nor lookups of names
+	// before it need it.
+	for i := 0; i < 2; i++ {
+		testPutBlockInCache(t, config, childPtrs[i], id, childBlocks[i])
+	}
+	ops := getOps(config, id)
+	n := nodeFromPath(t, ops, p)
+
+	lState := makeFBOLockState()
+	de, err := ops.blocks.GetDirtyEntry(ctx, lState, rmd, p.ChildPathNoPtr("p"))
+	require.NoError(t, err)
+	require.Equal(t, File, de.Type)
+	_, err = ops.blocks.GetDirtyEntry(ctx, lState, rmd, p.ChildPathNoPtr("n"))
+	require.Equal(t, NoSuchNameError{"n"}, err)
+
+	children, next, err := config.KBFSOps().GetDirChildrenPaged(
+		ctx, n, "", 2)
+	require.NoError(t, err)
+	require.Equal(t, "c", next)
+	require.Equal(t, []DirChild{
+		{Name: "a", EntryInfo: EntryInfo{Type: File}},
+		{Name: "c", EntryInfo: EntryInfo{Type: File}},
+	}, children)
+
+	children, next, err = config.KBFSOps().GetDirChildrenPaged(
+		ctx, n, next, 2)
+	require.NoError(t, err)
+	require.Equal(t, "m", next)
+	require.Equal(t, []DirChild{
+		{Name: "e", EntryInfo: EntryInfo{Type: File}},
+		{Name: "m", EntryInfo: EntryInfo{Type: File}},
+	}, children)
+
+	testPutBlockInCache(t, config, childPtrs[2], id, childBlocks[2])
+	children, next, err = config.KBFSOps().GetDirChildrenPaged(
+		ctx, n, next, 2)
+	require.NoError(t, err)
+	require.Equal(t, "", next)
+	require.Equal(t, []DirChild{
+		{Name: "p", EntryInfo: EntryInfo{Type: File}},
+		{Name: "t", EntryInfo: EntryInfo{Type: File}},
+	}, children)
+}
+
 func TestKBFSOpsGetBaseDirChildrenUncachedSuccess(t *testing.T) {
 	mockCtrl, config, ctx, cancel := kbfsOpsInit(t, false)
 	defer kbfsTestShutdown(mockCtrl, config, ctx, cancel)
@@ -812,7 +893,7 @@ func TestKBFSOpsGetNestedDirChildrenCacheSuccess(t *testing.T) {
 	for c, ei := range children {
 		if de, ok := dirBlock.Children[c]; !ok {
 			t.Errorf("No such child: %s", c)
-		} else if de.EntryInfo != ei {
+		} else if !reflect.DeepEqual(de.EntryInfo, ei) {
 			t.Errorf("Wrong EntryInfo for child %s: %v", c, ei)
 		}
 	}
@@ -853,7 +934,7 @@ func TestKBFSOpsLookupSuccess(t *testing.T) {
 	bPath := ops.nodeCache.PathFromNode(bn)
 	expectedBNode := pathNode{makeBP(bID, rmd, config, u), "b"}
 	expectedBNode.KeyGen = 1
-	if ei != dirBlock.Children["b"].EntryInfo {
+	if !reflect.DeepEqual(ei, dirBlock.Children["b"].EntryInfo) {
 		t.Errorf("Lookup returned a bad entry info: %v vs %v",
 			ei, dirBlock.Children["b"].EntryInfo)
 	} else if bPath.path[2] != expectedBNode {
@@ -893,7 +974,7 @@ func TestKBFSOpsLookupSymlinkSuccess(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error on Lookup: %v", err)
 	}
-	if ei != dirBlock.Children["b"].EntryInfo {
+	if !reflect.DeepEqual(ei, dirBlock.Children["b"].EntryInfo) {
 		t.Errorf("Lookup returned a bad directory entry: %v vs %v",
 			ei, dirBlock.Children["b"].EntryInfo)
 	} else if bn != nil {
@@ -1011,7 +1092,7 @@ func TestKBFSOpsStatSuccess(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error on Stat: %v", err)
 	}
-	if ei != dirBlock.Children["b"].EntryInfo {
+	if !reflect.DeepEqual(ei, dirBlock.Children["b"].EntryInfo) {
 		t.Errorf("Stat returned a bad entry info: %v vs %v",
 			ei, dirBlock.Children["b"].EntryInfo)
 	}
@@ -5335,7 +5416,7 @@ func TestKBFSOpsWriteRenameStat(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Couldn't stat file: %v", err)
 	}
-	if ei != newEi {
+	if !reflect.DeepEqual(ei, newEi) {
 		t.Errorf("Entry info unexpectedly changed from %+v to %+v", ei, newEi)
 	}
 }
@@ -5381,12 +5462,62 @@ func TestKBFSOpsWriteRenameGetDirChildren(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Couldn't stat file: %v", err)
 	}
-	if ei != eis["b"] {
+	if !reflect.DeepEqual(ei, eis["b"]) {
 		t.Errorf("Entry info unexpectedly changed from %+v to %+v",
 			ei, eis["b"])
 	}
 }
 
+func TestKBFSOpsGetDirChildrenPaged(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	names := []string{"a", "b", "c", "d", "e"}
+	for _, name := range []string{"d", "b", "e", "a"} {
+		_, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+	}
+	// Leave a dirty write in c, whose new size should show up in
+	// its page.
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	var got []string
+	cursor := ""
+	for {
+		children, next, err := kbfsOps.GetDirChildrenPaged(
+			ctx, rootNode, cursor, 2)
+		require.NoError(t, err)
+		require.True(t, len(children) <= 2)
+		for _, child := range children {
+			got = append(got, child.Name)
+			if child.Name == "c" {
+				require.Equal(t, uint64(3), child.Size)
+			}
+		}
+		if next == "" {
+			break
+		}
+		require.Equal(t, children[len(children)-1].Name, next)
+		cursor = next
+	}
+	require.Equal(t, names, got)
+
+	// A non-positive limit returns the rest of the directory.
+	children, next, err := kbfsOps.GetDirChildrenPaged(ctx, rootNode, "b", 0)
+	require.NoError(t, err)
+	require.Equal(t, "", next)
+	require.Len(t, children, 3)
+	require.Equal(t, "c", children[0].Name)
+
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+}
+
 func TestKBFSOpsCreateFileWithArchivedBlock(t *testing.T) {
 	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
 	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
@@ -5604,3 +5735,746 @@ func TestKBFSOpsMaliciousMDServerRange(t *testing.T) {
 	// have MDOps do the handle check, that'll trigger first.
 	require.IsType(t, MDPrevRootMismatch{}, err)
 }
+
+func testKBFSOpsWriteTimes(t *testing.T, strictTimes bool) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetStrictTimes(strictTimes)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, ei, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	require.Equal(t, now.UnixNano(), ei.Mtime)
+
+	clock.Add(1 * time.Minute)
+	writeTime := clock.Now()
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	if strictTimes {
+		require.Equal(t, writeTime.UnixNano(), ei.Mtime)
+		require.Equal(t, writeTime.UnixNano(), ei.Ctime)
+	} else {
+		require.Equal(t, now.UnixNano(), ei.Mtime)
+	}
+
+	clock.Add(1 * time.Minute)
+	syncTime := clock.Now()
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	if strictTimes {
+		require.Equal(t, writeTime.UnixNano(), ei.Mtime)
+		require.Equal(t, writeTime.UnixNano(), ei.Ctime)
+	} else {
+		require.Equal(t, syncTime.UnixNano(), ei.Mtime)
+		require.Equal(t, syncTime.UnixNano(), ei.Ctime)
+	}
+}
+
+func TestKBFSOpsWriteTimes(t *testing.T) {
+	testKBFSOpsWriteTimes(t, false)
+}
+
+func TestKBFSOpsWriteTimesStrict(t *testing.T) {
+	testKBFSOpsWriteTimes(t, true)
+}
+
+func TestKBFSOpsFinalizeTLF(t *testing.T) {
+	config1, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1", "u2")
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, "u2")
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := "u1,u2"
+	rootNode := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode, _, err := kbfsOps1.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps1.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	fb := rootNode.GetFolderBranch()
+
+	// Only members can be reset users.
+	_, err = kbfsOps1.(*KBFSOpsStandard).finalizeTLF(ctx, fb, "u3")
+	require.Error(t, err)
+
+	successorNode, err := kbfsOps1.(*KBFSOpsStandard).finalizeTLF(ctx, fb, "u2")
+	require.NoError(t, err)
+	require.NotEqual(t, fb, successorNode.GetFolderBranch())
+
+	head, err := config1.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.NoError(t, err)
+	require.True(t, head.IsFinal())
+	finalHandle := head.GetTlfHandle()
+	require.Equal(t, "u2", string(finalHandle.FinalizedInfo().Username))
+	require.Equal(t, CanonicalTlfName(name),
+		finalHandle.SuccessorHandle().GetCanonicalName())
+
+	// The finalized TLF is read-only.
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.Equal(t, TlfFinalizedError{
+		Tlf:       finalHandle.GetCanonicalName(),
+		Successor: CanonicalTlfName(name),
+	}, err)
+	_, err = kbfsOps1.(*KBFSOpsStandard).finalizeTLF(ctx, fb, "u2")
+	require.IsType(t, TlfFinalizedError{}, err)
+
+	status, _, err := kbfsOps1.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.True(t, status.Finalized)
+	require.Equal(t, "/keybase/private/"+name, status.Successor)
+
+	// The other user reads the finalized TLF by its finalized
+	// name, and gets the empty successor by the old one.
+	finalNode := GetRootNodeOrBust(
+		ctx, t, config2, string(finalHandle.GetCanonicalName()), false)
+	require.Equal(t, fb, finalNode.GetFolderBranch())
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, finalNode, "a")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+
+	successorNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	require.Equal(t, successorNode.GetFolderBranch(),
+		successorNode2.GetFolderBranch())
+	children, err := kbfsOps2.GetDirChildren(ctx, successorNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 0)
+}
+
+func TestKBFSOpsAnonymousPublicRead(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1", "u2")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", true)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	anonConfig := ConfigAsUser(config, "")
+	defer CheckConfigAndShutdown(t, anonConfig)
+	anonOps := anonConfig.KBFSOps()
+
+	anonRootNode := GetRootNodeOrBust(ctx, t, anonConfig, "u1", true)
+	require.Equal(t, rootNode.GetFolderBranch(), anonRootNode.GetFolderBranch())
+	anonFileNode, _, err := anonOps.Lookup(ctx, anonRootNode, "a")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, err := anonOps.Read(ctx, anonFileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+
+	// New writes show up for the anonymous reader.
+	data = []byte{4, 5, 6}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	err = anonOps.SyncFromServerForTesting(ctx, anonRootNode.GetFolderBranch())
+	require.NoError(t, err)
+	n, err = anonOps.Read(ctx, anonFileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+
+	// But nothing else is allowed.
+	_, _, err = anonOps.CreateFile(ctx, anonRootNode, "b", false, NoExcl)
+	require.IsType(t, NoCurrentSessionError{}, err)
+	h, err := ParseTlfHandle(
+		ctx, anonConfig.KBPKI(), "u2", true)
+	require.NoError(t, err)
+	_, _, err = anonOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.Error(t, err)
+	_, err = ParseTlfHandle(ctx, anonConfig.KBPKI(), "u1", false)
+	require.IsType(t, NoCurrentSessionError{}, err)
+}
+
+type fixedQuotaBlockServer struct {
+	BlockServer
+	limit, used, archived int64
+}
+
+func (fqbs fixedQuotaBlockServer) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	info := NewUserQuotaInfo()
+	info.Limit = fqbs.limit
+	info.Total.Bytes[UsageWrite] = fqbs.used
+	info.Total.Bytes[UsageArchive] = fqbs.archived
+	return info, nil
+}
+
+type testQuotaObserver struct {
+	testBGObserver
+	warnings chan QuotaWarning
+}
+
+func (t *testQuotaObserver) BatchChanges(ctx context.Context,
+	changes []NodeChange) {
+	// ignore
+}
+
+func (t *testQuotaObserver) QuotaWarning(ctx context.Context,
+	warning QuotaWarning) {
+	t.warnings <- warning
+}
+
+func TestKBFSOpsQuotaWarning(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	bserver := config.BlockServer()
+	// The state checker needs the local block server back.
+	defer config.SetBlockServer(bserver)
+	config.SetBlockServer(fixedQuotaBlockServer{
+		BlockServer: bserver,
+		limit:       100000,
+		used:        90000,
+		archived:    1000,
+	})
+	kbfsOps := config.KBFSOps()
+	usage, err := kbfsOps.GetUserQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, QuotaUsage{
+		LimitBytes:    100000,
+		UsedBytes:     90000,
+		ArchivedBytes: 1000,
+	}, usage)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	observer := &testQuotaObserver{warnings: make(chan QuotaWarning, 1)}
+	err = config.Notifier().RegisterForChanges(
+		[]FolderBranch{rootNode.GetFolderBranch()}, observer)
+	require.NoError(t, err)
+
+	// A small write doesn't warn.
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	require.Len(t, observer.warnings, 0)
+
+	// A write that's too big for the remaining quota warns, before
+	// the server has to reject it.
+	data := make([]byte, 20000)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	require.Len(t, observer.warnings, 1)
+	warning := <-observer.warnings
+	require.Equal(t, int64(100000), warning.Usage.LimitBytes)
+	require.True(t, warning.Usage.UsedBytes >= 90000)
+	require.True(t, warning.PendingBytes >= int64(len(data)))
+	require.True(t, warning.Usage.UsedBytes+warning.PendingBytes > 100000)
+}
+
+func TestKBFSOpsGetOpenFolderBranches(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	kbfsOps := config.KBFSOps()
+	fbs, err := kbfsOps.GetOpenFolderBranches(ctx)
+	require.NoError(t, err)
+	require.Len(t, fbs, 0)
+
+	privateNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	publicNode := GetRootNodeOrBust(ctx, t, config, "test_user", true)
+	expected := []FolderBranch{
+		privateNode.GetFolderBranch(), publicNode.GetFolderBranch()}
+	if expected[0].Tlf.String() > expected[1].Tlf.String() {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	fbs, err = kbfsOps.GetOpenFolderBranches(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, fbs)
+}
+
+func TestKBFSOpsLowMemoryMode(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetLowMemoryMode(true)
+	config.ResetCaches()
+
+	bcache := config.BlockCache().(*BlockCacheStandard)
+	require.Equal(t, uint64(lowMemoryBlockCacheBytes), bcache.cleanBytesCapacity)
+	require.Equal(t, lowMemoryMaxParallelBlockPuts,
+		maxParallelBlockPutsForConfig(config))
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// The synced file block isn't cached, but can still be read.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	p := ops.nodeCache.PathFromNode(fileNode)
+	_, err = bcache.Get(p.tailPointer())
+	require.IsType(t, NoSuchBlockError{}, err)
+	_, err = bcache.Get(ops.nodeCache.PathFromNode(rootNode).tailPointer())
+	require.NoError(t, err)
+
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+}
+
+func TestKBFSOpsSetPerm(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, ei, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), ei.OwnerPerm())
+	dirNode, ei, err := kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), ei.OwnerPerm())
+
+	// Only the owner bits are kept.
+	err = kbfsOps.SetPerm(ctx, fileNode, 0444)
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, File, ei.Type)
+	require.Equal(t, os.FileMode(0400), ei.OwnerPerm())
+
+	// The owner-exec bit of a file is its type.
+	err = kbfsOps.SetPerm(ctx, fileNode, 0500)
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+	require.Equal(t, os.FileMode(0500), ei.OwnerPerm())
+	err = kbfsOps.SetEx(ctx, fileNode, false)
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, File, ei.Type)
+	require.Equal(t, os.FileMode(0400), ei.OwnerPerm())
+
+	// No permissions at all is different from the default.
+	err = kbfsOps.SetPerm(ctx, dirNode, 0)
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, dirNode)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0), ei.OwnerPerm())
+
+	// A no-op change doesn't make a new revision.
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsNoAdd(rootNode.GetFolderBranch())
+	lState := makeFBOLockState()
+	rev := ops.getCurrMDRevision(lState)
+	err = kbfsOps.SetPerm(ctx, dirNode, 0)
+	require.NoError(t, err)
+	require.Equal(t, rev, ops.getCurrMDRevision(lState))
+
+	// The permissions are persisted.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	_, ei, err = config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0400), ei.OwnerPerm())
+	_, ei, err = config2.KBFSOps().Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0), ei.OwnerPerm())
+}
+
+func TestKBFSOpsCreateSpecialFile(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	ei, err := kbfsOps.CreateSpecialFile(ctx, rootNode, "p", Fifo)
+	require.NoError(t, err)
+	require.Equal(t, Sym, ei.Type)
+	require.Equal(t, Fifo, ei.Special)
+	_, err = kbfsOps.CreateSpecialFile(ctx, rootNode, "s", Socket)
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateSpecialFile(ctx, rootNode, "x", NotSpecial)
+	require.Error(t, err)
+	_, err = kbfsOps.CreateSpecialFile(ctx, rootNode, "p", Socket)
+	require.IsType(t, NameExistsError{}, err)
+
+	// Another device sees the special files.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	children, err := config2.KBFSOps().GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	require.Equal(t, Fifo, children["p"].Special)
+	require.Equal(t, Socket, children["s"].Special)
+
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "p")
+	require.NoError(t, err)
+	children, err = kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+}
+
+func TestKBFSOpsRunBatch(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("old"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsNoAdd(rootNode.GetFolderBranch())
+	lState := makeFBOLockState()
+	rev := ops.getCurrMDRevision(lState)
+
+	// Replace "a" by way of a temp file, and make a dir, all in
+	// one revision.
+	err = kbfsOps.RunBatch(ctx, func(tx BatchOps) error {
+		tmpNode, _, err := tx.CreateFile(ctx, rootNode, "a.tmp", false)
+		if err != nil {
+			return err
+		}
+		if err := tx.Write(ctx, tmpNode, []byte("new"), 0); err != nil {
+			return err
+		}
+		if err := tx.Rename(ctx, rootNode, "a.tmp", rootNode, "a"); err != nil {
+			return err
+		}
+		_, _, err = tx.CreateDir(ctx, rootNode, "b")
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, rev+1, ops.getCurrMDRevision(lState))
+
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	children, err := config2.KBFSOps().GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	require.Equal(t, Dir, children["b"].Type)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	data := make([]byte, 3)
+	_, err = config2.KBFSOps().Read(ctx, fileNode2, data, 0)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+
+	// A failed batch changes nothing.
+	rev = ops.getCurrMDRevision(lState)
+	expectedErr := errors.New("fail")
+	err = kbfsOps.RunBatch(ctx, func(tx BatchOps) error {
+		if _, _, err := tx.CreateDir(ctx, rootNode, "c"); err != nil {
+			return err
+		}
+		if err := tx.RemoveDir(ctx, rootNode, "b"); err != nil {
+			return err
+		}
+		return expectedErr
+	})
+	require.Equal(t, expectedErr, err)
+	require.Equal(t, rev, ops.getCurrMDRevision(lState))
+	children, err = kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	require.Contains(t, children, "b")
+
+	// The folder is still writable after the failed batch.
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "c")
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsAppend(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("abc"), 0)
+	require.NoError(t, err)
+	off, err := kbfsOps.Append(ctx, fileNode, []byte("de"))
+	require.NoError(t, err)
+	require.Equal(t, int64(3), off)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	err = kbfsOps.SetAppendOnly(ctx, fileNode, true)
+	require.NoError(t, err)
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.True(t, ei.AppendOnly)
+	err = kbfsOps.SetAppendOnly(ctx, rootNode, true)
+	require.IsType(t, InvalidParentPathError{}, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.SetAppendOnly(ctx, dirNode, true)
+	require.IsType(t, NotFileError{}, err)
+
+	// Only writes at the end are allowed.
+	err = kbfsOps.Write(ctx, fileNode, []byte("x"), 0)
+	require.IsType(t, AppendOnlyError{}, err)
+	err = kbfsOps.Truncate(ctx, fileNode, 1)
+	require.IsType(t, AppendOnlyError{}, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("f"), 5)
+	require.NoError(t, err)
+	off, err = kbfsOps.Append(ctx, fileNode, []byte("g"))
+	require.NoError(t, err)
+	require.Equal(t, int64(6), off)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// Another device sees the flag and the data.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", false)
+	fileNode2, ei, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	require.True(t, ei.AppendOnly)
+	data := make([]byte, 7)
+	_, err = config2.KBFSOps().Read(ctx, fileNode2, data, 0)
+	require.NoError(t, err)
+	require.Equal(t, "abcdefg", string(data))
+	err = config2.KBFSOps().Write(ctx, fileNode2, []byte("x"), 1)
+	require.IsType(t, AppendOnlyError{}, err)
+}
+
+func TestKBFSOpsDirChildCountAndRecursiveSize(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	aNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateDir(ctx, aNode, "b")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, bNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, aNode, "d", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, make([]byte, 10), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	checkStats := func(node Node, count, size uint64) EntryInfo {
+		ei, err := kbfsOps.Stat(ctx, node)
+		require.NoError(t, err)
+		require.Equal(t, count, ei.ChildCount)
+		require.Equal(t, size, ei.RecursiveSize)
+		return ei
+	}
+	bEI := checkStats(bNode, 1, 10)
+	aEI := checkStats(aNode, 2, bEI.Size+10)
+	checkStats(rootNode, 1, aEI.Size+aEI.RecursiveSize)
+
+	// Removing the file updates every directory above it.
+	err = kbfsOps.RemoveEntry(ctx, bNode, "c")
+	require.NoError(t, err)
+	bEI = checkStats(bNode, 0, 0)
+	aEI = checkStats(aNode, 2, bEI.Size)
+	checkStats(rootNode, 1, aEI.Size+aEI.RecursiveSize)
+}
+
+func findFavoriteWithMetadata(t *testing.T, favs []FavoriteWithMetadata,
+	fav Favorite) FavoriteWithMetadata {
+	for _, f := range favs {
+		if f.Favorite == fav {
+			return f
+		}
+	}
+	t.Fatalf("Couldn't find favorite %v", fav)
+	return FavoriteWithMetadata{}
+}
+
+func TestKBFSOpsGetFavoritesWithMetadata(t *testing.T) {
+	config1, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1", "u2")
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+	config2 := ConfigAsUser(config1, "u2")
+	defer CheckConfigAndShutdown(t, config2)
+
+	kbfsOps1 := config1.KBFSOps()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, "u1,u2", false)
+	shared := Favorite{"u1,u2", false}
+	public := Favorite{"u2", true}
+
+	// u2 hasn't seen the folder before, so it's taken to be read.
+	kbfsOps2 := config2.KBFSOps()
+	require.NoError(t, kbfsOps2.AddFavorite(ctx, shared))
+	favs, err := kbfsOps2.GetFavoritesWithMetadata(ctx)
+	require.NoError(t, err)
+	fav := findFavoriteWithMetadata(t, favs, shared)
+	require.Equal(t, MetadataRevisionInitial, fav.Revision)
+	require.False(t, fav.Unread)
+	// u2's public folder has never been written.
+	require.Equal(t, FavoriteMetadata{},
+		findFavoriteWithMetadata(t, favs, public).FavoriteMetadata)
+
+	fileNode, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps1.Write(ctx, fileNode, []byte{1}, 0))
+	require.NoError(t, kbfsOps1.Sync(ctx, fileNode))
+	head, err := config1.MDOps().GetForTLF(
+		ctx, rootNode1.GetFolderBranch().Tlf)
+	require.NoError(t, err)
+
+	// The writing device has seen its own change, but u2 hasn't.
+	favs, err = kbfsOps1.GetFavoritesWithMetadata(ctx)
+	require.NoError(t, err)
+	fav = findFavoriteWithMetadata(t, favs, shared)
+	require.Equal(t, head.Revision(), fav.Revision)
+	require.Equal(t, head.LocalTimestamp(), fav.LastModified)
+	require.Equal(t, libkb.NormalizedUsername("u1"), fav.LastWriter)
+	require.False(t, fav.Unread)
+
+	favs, err = kbfsOps2.GetFavoritesWithMetadata(ctx)
+	require.NoError(t, err)
+	fav = findFavoriteWithMetadata(t, favs, shared)
+	require.Equal(t, head.Revision(), fav.Revision)
+	require.True(t, fav.Unread)
+
+	// Once u2 catches up, the folder is read.
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1,u2", false)
+	require.NoError(t,
+		kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch()))
+	favs, err = kbfsOps2.GetFavoritesWithMetadata(ctx)
+	require.NoError(t, err)
+	require.False(t, findFavoriteWithMetadata(t, favs, shared).Unread)
+}
+
+func TestKBFSOpsAESGCMBlocks(t *testing.T) {
+	config1, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1", "u2")
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+	config1.SetBlockEncryptionVersion(EncryptionAESGCM)
+
+	config2 := ConfigAsUser(config1, "u2")
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := "u1,u2"
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(
+		ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps1.Write(ctx, fileNode1, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+
+	// Pointers to the new blocks say that they need a client that
+	// knows about AES-GCM.
+	head, err := config1.MDOps().GetForTLF(
+		ctx, rootNode1.GetFolderBranch().Tlf)
+	require.NoError(t, err)
+	require.Equal(t, AESGCMDataVer, head.data.Dir.DataVer)
+
+	// Another user, who writes with secretbox, can read them.
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsGetKBFSStatus(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	config.Reporter().ReportErr(ctx, "u1", false, WriteMode,
+		errors.New("fake error"))
+
+	status, err := kbfsOps.GetKBFSStatus(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "u1", status.CurrentUser)
+	require.True(t, status.IsConnected)
+	require.Equal(t, ConnectivityOnline, status.Connectivity.State)
+	require.NotNil(t, status.Caches.BlockCache)
+	require.NotNil(t, status.Caches.DirtyMemory)
+	require.NotNil(t, status.BlockRetrievals)
+	require.Len(t, status.Folders, 1)
+	folder := status.Folders[0]
+	require.Equal(t, rootNode.GetFolderBranch().String(), folder.FolderBranch)
+	require.Equal(t, MetadataRevision(3), folder.Revision)
+	require.False(t, folder.Staged)
+	require.Equal(t, "", folder.Error)
+	require.Len(t, status.RecentErrors, 1)
+	require.Equal(t, "fake error", status.RecentErrors[0].Error)
+}
+
+func TestKBFSOpsRemoveEntryIfUnchanged(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	kbfsOps := config.KBFSOps()
+	oldNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// Replace the file, as another device stealing a lock would.
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.NoError(t, err)
+	newNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, WithExcl)
+	require.NoError(t, err)
+
+	err = kbfsOps.RemoveEntryIfUnchanged(ctx, rootNode, "a", oldNode)
+	require.Equal(t, EntryReplacedError{"a"}, err)
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+
+	err = kbfsOps.RemoveEntryIfUnchanged(ctx, rootNode, "a", newNode)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	require.IsType(t, NoSuchNameError{}, err)
+}
@@ -0,0 +1,195 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// KBFSStatusSnapshot is the state of every KBFS subsystem at one
+// point in time, as returned by KBFSOps.GetKBFSStatus.  It's meant
+// for the Keybase service and GUI, so unlike KBFSStatus it holds
+// errors as strings; it is suitable for encoding directly as JSON.
+type KBFSStatusSnapshot struct {
+	// Time is when the snapshot was taken.
+	Time time.Time
+	// CurrentUser is the logged-in user, or empty if nobody is
+	// logged in.
+	CurrentUser string `json:",omitempty"`
+	// IsConnected is true if there's a connection to the MD
+	// server, and Connectivity says how well the servers can
+	// currently be reached.
+	IsConnected  bool
+	Connectivity ConnectivityStatus
+	// UsageBytes and LimitBytes are the user's quota usage and
+	// limit, or -1 if they aren't known.
+	UsageBytes int64
+	LimitBytes int64
+	// FailingServices maps each service that's currently failing
+	// to its error.
+	FailingServices map[string]string `json:",omitempty"`
+	// Journals is set if journaling is enabled.
+	Journals *JournalsSnapshot `json:",omitempty"`
+	Caches   CachesSnapshot
+	// Folders is the state of each open folder-branch, including
+	// any conflict resolution or rekey in progress.
+	Folders []FolderSnapshot `json:",omitempty"`
+	// BlockRetrievals is set if the block retrieval queue, which
+	// also holds the prefetches, can be inspected.
+	BlockRetrievals *BlockRetrievalQueueStatus `json:",omitempty"`
+	// RecentErrors lists the most recently reported errors,
+	// oldest first.
+	RecentErrors []RecentError `json:",omitempty"`
+}
+
+// JournalsSnapshot is the state of the journal server and of each
+// of its TLF journals, including how much each has left to flush.
+type JournalsSnapshot struct {
+	Server JournalServerStatus
+	// TLFs maps each TLF ID to the status of its journal.
+	TLFs map[string]TLFJournalStatus `json:",omitempty"`
+}
+
+// CachesSnapshot is the state of the caches holding block data.
+type CachesSnapshot struct {
+	// BlockCache is set if the block cache keeps stats.
+	BlockCache *BlockCacheStats `json:",omitempty"`
+	// BlockCacheTuning is set if the block cache's size is being
+	// tuned automatically.
+	BlockCacheTuning *BlockCacheTuningStatus `json:",omitempty"`
+	// DirtyMemory is set if the memory used by dirty data is
+	// being limited.
+	DirtyMemory *DirtyMemoryStatus `json:",omitempty"`
+}
+
+// BlockCacheStats counts the hits and misses of the clean block
+// cache since KBFS started, along with its current size.
+type BlockCacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Bytes         uint64
+	CapacityBytes uint64
+}
+
+// FolderSnapshot is the part of a FolderBranchStatus that says what
+// an open folder-branch is busy with.
+type FolderSnapshot struct {
+	FolderBranch string
+	Revision     MetadataRevision
+	// Staged is true if there are local changes that still have
+	// to go through conflict resolution.
+	Staged bool `json:",omitempty"`
+	// ConflictResolution summarizes the conflict resolutions
+	// attempted for this folder-branch.
+	ConflictResolution *ConflictResolutionStatus `json:",omitempty"`
+	// RekeyPending is true if the folder is waiting to be rekeyed.
+	RekeyPending bool `json:",omitempty"`
+	// Error is set if the folder's status couldn't be fetched.
+	Error string `json:",omitempty"`
+}
+
+// RecentError is an error reported to the Reporter.
+type RecentError struct {
+	Time  time.Time
+	Error string
+}
+
+// getBlockCacheStats returns the stats of bcache, or nil if it
+// doesn't keep any.
+func getBlockCacheStats(bcache BlockCache) *BlockCacheStats {
+	if jbcache, ok := bcache.(journalBlockCache); ok {
+		bcache = jbcache.BlockCache
+	}
+	std, ok := bcache.(*BlockCacheStandard)
+	if !ok {
+		return nil
+	}
+	hits, misses, bytes, capacity := std.getStats()
+	return &BlockCacheStats{
+		Hits:          hits,
+		Misses:        misses,
+		Bytes:         bytes,
+		CapacityBytes: capacity,
+	}
+}
+
+// getBlockRetrievalQueueStatus returns the status of the retrieval
+// queue of bops, or nil if it doesn't have one.
+func getBlockRetrievalQueueStatus(bops BlockOps) *BlockRetrievalQueueStatus {
+	switch b := bops.(type) {
+	case BlockOpsMeasured:
+		return getBlockRetrievalQueueStatus(b.delegate)
+	case *BlockOpsConstrained:
+		return getBlockRetrievalQueueStatus(b.BlockOps)
+	case *BlockOpsStandard:
+		status := b.queue.status()
+		return &status
+	default:
+		return nil
+	}
+}
+
+// getJournalsSnapshot returns the state of the journals, or nil if
+// journaling isn't enabled.
+func getJournalsSnapshot(
+	ctx context.Context, config Config) *JournalsSnapshot {
+	jServer, err := GetJournalServer(config)
+	if err != nil {
+		return nil
+	}
+	status, tlfIDs := jServer.Status(ctx)
+	journals := &JournalsSnapshot{Server: status}
+	for _, tlfID := range tlfIDs {
+		tlfStatus, err := jServer.JournalStatus(tlfID)
+		if err != nil {
+			// The journal went away after Status.
+			continue
+		}
+		if journals.TLFs == nil {
+			journals.TLFs = make(map[string]TLFJournalStatus)
+		}
+		journals.TLFs[tlfID.String()] = tlfStatus
+	}
+	return journals
+}
+
+// getFolderSnapshots returns the state of each open folder-branch.
+func getFolderSnapshots(ctx context.Context, kbfsOps KBFSOps) (
+	[]FolderSnapshot, error) {
+	fbs, err := kbfsOps.GetOpenFolderBranches(ctx)
+	if err != nil {
+		return nil, err
+	}
+	folders := make([]FolderSnapshot, 0, len(fbs))
+	for _, fb := range fbs {
+		folder := FolderSnapshot{FolderBranch: fb.String()}
+		status, _, err := kbfsOps.FolderStatus(ctx, fb)
+		if err != nil {
+			folder.Error = err.Error()
+		} else {
+			folder.Revision = status.Revision
+			folder.Staged = status.Staged
+			folder.ConflictResolution = status.ConflictResolution
+			folder.RekeyPending = status.RekeyPending
+		}
+		folders = append(folders, folder)
+	}
+	return folders, nil
+}
+
+// getRecentErrors returns the errors known to r, oldest first.
+func getRecentErrors(r Reporter) []RecentError {
+	reported := r.AllKnownErrors()
+	if len(reported) == 0 {
+		return nil
+	}
+	errors := make([]RecentError, len(reported))
+	for i, e := range reported {
+		errors[i] = RecentError{Time: e.Time, Error: e.Error.Error()}
+	}
+	return errors
+}
@@ -60,3 +60,8 @@ func (b KeyCacheMeasured) PutTLFCryptKey(
 	})
 	return err
 }
+
+// Clear implements the KeyCache interface for KeyCacheMeasured.
+func (b KeyCacheMeasured) Clear() {
+	b.delegate.Clear()
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfshash"
 )
@@ -50,6 +51,28 @@ func (wkb TLFWriterKeyBundleV3) IsWriter(user keybase1.UID, deviceKID keybase1.K
 	return ok
 }
 
+// DecodeTLFWriterKeyBundleV3 deserializes a writer key bundle,
+// returning a KeyBundleDecodeError if it is malformed.
+func DecodeTLFWriterKeyBundleV3(codec kbfscodec.Codec, buf []byte) (
+	*TLFWriterKeyBundleV3, error) {
+	var wkb TLFWriterKeyBundleV3
+	if err := codec.Decode(buf, &wkb); err != nil {
+		return nil, KeyBundleDecodeError{Writer: true, Err: err}
+	}
+	return &wkb, nil
+}
+
+// DecodeTLFReaderKeyBundleV3 deserializes a reader key bundle,
+// returning a KeyBundleDecodeError if it is malformed.
+func DecodeTLFReaderKeyBundleV3(codec kbfscodec.Codec, buf []byte) (
+	*TLFReaderKeyBundleV3, error) {
+	var rkb TLFReaderKeyBundleV3
+	if err := codec.Decode(buf, &rkb); err != nil {
+		return nil, KeyBundleDecodeError{Writer: false, Err: err}
+	}
+	return &rkb, nil
+}
+
 // TLFReaderKeyBundleID is the hash of a serialized TLFReaderKeyBundle.
 type TLFReaderKeyBundleID struct {
 	h kbfshash.Hash
@@ -0,0 +1,162 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// KeyGenerationDevice is a device that was given a TLF key
+// generation.  It is suitable for encoding directly as JSON.
+type KeyGenerationDevice struct {
+	UID        keybase1.UID
+	Username   string
+	DeviceKID  keybase1.KID
+	DeviceName string `json:",omitempty"`
+	// Writer is false if the device's user could only read the
+	// TLF.
+	Writer bool
+	// AddedRevision is the first merged revision in which the
+	// device had the key generation.
+	AddedRevision MetadataRevision
+	// Revoked is true if the device's crypt key has been revoked
+	// since, at RevokedTime.
+	Revoked     bool
+	RevokedTime time.Time `json:",omitempty"`
+}
+
+// KeyGenerationInfo describes one key generation of a TLF, and every
+// device that could ever read data encrypted with it.  It is
+// suitable for encoding directly as JSON.
+type KeyGenerationInfo struct {
+	KeyGen KeyGen
+	// CreatedRevision is the merged revision that introduced the
+	// key generation.
+	CreatedRevision MetadataRevision
+	// Devices is sorted by username, and then by device KID.
+	Devices []KeyGenerationDevice
+}
+
+// keyGenerationDevicesByUser sorts devices by username, and then by
+// device KID.
+type keyGenerationDevicesByUser []KeyGenerationDevice
+
+func (d keyGenerationDevicesByUser) Len() int      { return len(d) }
+func (d keyGenerationDevicesByUser) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d keyGenerationDevicesByUser) Less(i, j int) bool {
+	if d[i].Username != d[j].Username {
+		return d[i].Username < d[j].Username
+	}
+	return d[i].DeviceKID.String() < d[j].DeviceKID.String()
+}
+
+// addKeyGenerationDevices adds to info every device in dkim that
+// isn't there already, as added in the given revision.
+func addKeyGenerationDevices(info *KeyGenerationInfo,
+	seen map[keybase1.KID]bool, dkim UserDeviceKeyInfoMap, writer bool,
+	rev MetadataRevision) {
+	for uid, dkm := range dkim {
+		for kid := range dkm {
+			if seen[kid] {
+				continue
+			}
+			seen[kid] = true
+			info.Devices = append(info.Devices, KeyGenerationDevice{
+				UID:           uid,
+				DeviceKID:     kid,
+				Writer:        writer,
+				AddedRevision: rev,
+			})
+		}
+	}
+}
+
+// fillKeyGenerationDevices fills in the username, device name and
+// revocation status of each device in infos from the current user
+// info of its user.
+func fillKeyGenerationDevices(ctx context.Context, config Config,
+	infos []KeyGenerationInfo) error {
+	userInfos := make(map[keybase1.UID]UserInfo)
+	for i := range infos {
+		for j := range infos[i].Devices {
+			d := &infos[i].Devices[j]
+			userInfo, ok := userInfos[d.UID]
+			if !ok {
+				var err error
+				userInfo, err = config.KeybaseService().LoadUserPlusKeys(
+					ctx, d.UID)
+				if err != nil {
+					return err
+				}
+				userInfos[d.UID] = userInfo
+			}
+			d.Username = string(userInfo.Name)
+			d.DeviceName = userInfo.KIDNames[d.DeviceKID]
+			for key, t := range userInfo.RevokedCryptPublicKeys {
+				if key.KID().Equal(d.DeviceKID) {
+					d.Revoked = true
+					d.RevokedTime = keybase1.FromTime(t.Unix)
+					break
+				}
+			}
+		}
+		sort.Sort(keyGenerationDevicesByUser(infos[i].Devices))
+	}
+	return nil
+}
+
+// getKeyGenerations returns the history of the key generations of
+// the given TLF, in order, by walking all of its merged MD updates.
+// Public TLFs have no key generations.
+//
+// A device can be added to the latest key generation after it was
+// created, but not to an older one, so each revision only needs its
+// latest key generation's bundles.
+func getKeyGenerations(ctx context.Context, config Config, tlfID tlf.ID) (
+	[]KeyGenerationInfo, error) {
+	if tlfID.IsPublic() {
+		return nil, nil
+	}
+
+	rmds, err := getMergedMDUpdates(
+		ctx, config, tlfID, MetadataRevisionInitial)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []KeyGenerationInfo
+	var seen map[keybase1.KID]bool
+	for _, rmd := range rmds {
+		keyGen := rmd.LatestKeyGeneration()
+		if keyGen < FirstValidKeyGen {
+			continue
+		}
+		if len(infos) == 0 || infos[len(infos)-1].KeyGen != keyGen {
+			infos = append(infos, KeyGenerationInfo{
+				KeyGen:          keyGen,
+				CreatedRevision: rmd.Revision(),
+			})
+			seen = make(map[keybase1.KID]bool)
+		}
+		rDkim, wDkim, err := rmd.getUserDeviceKeyInfoMaps(keyGen)
+		if err != nil {
+			return nil, err
+		}
+		info := &infos[len(infos)-1]
+		addKeyGenerationDevices(info, seen, wDkim, true, rmd.Revision())
+		addKeyGenerationDevices(info, seen, rDkim, false, rmd.Revision())
+	}
+
+	err = fillKeyGenerationDevices(ctx, config, infos)
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
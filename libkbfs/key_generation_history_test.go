@@ -0,0 +1,110 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetKeyGenerations(t *testing.T) {
+	config, uid1, ctx, cancel := kbfsOpsInitNoMocks(t, "u1", "u2")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1#u2", false)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	kbfsOps := config.KBFSOps()
+
+	_, uid2, err := config.KBPKI().Resolve(ctx, "u2")
+	require.NoError(t, err)
+	getKID := func(uid keybase1.UID, index int) keybase1.KID {
+		keys, err := config.KBPKI().GetCryptPublicKeys(ctx, uid)
+		require.NoError(t, err)
+		return keys[index].KID()
+	}
+	u1Dev := getKID(uid1, 0)
+	u2Dev1 := getKID(uid2, 0)
+
+	infos, err := kbfsOps.GetKeyGenerations(ctx, tlfID)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, FirstValidKeyGen, infos[0].KeyGen)
+	require.Equal(t, MetadataRevisionInitial, infos[0].CreatedRevision)
+	require.Len(t, infos[0].Devices, 2)
+
+	// A new device for the reader u2 is added to the current key generation.
+	AddDeviceForLocalUserOrBust(t, config, uid2)
+	u2Dev2 := getKID(uid2, 1)
+	err = kbfsOps.Rekey(ctx, tlfID)
+	require.NoError(t, err)
+	head, err := config.MDOps().GetForTLF(ctx, tlfID)
+	require.NoError(t, err)
+	addedRev := head.Revision()
+
+	// Revoking u2's first device makes a new key generation without
+	// it.
+	clock.Add(1 * time.Minute)
+	RevokeDeviceForLocalUserOrBust(t, config, uid2, 0)
+	err = kbfsOps.Rekey(ctx, tlfID)
+	require.NoError(t, err)
+	head, err = config.MDOps().GetForTLF(ctx, tlfID)
+	require.NoError(t, err)
+	require.Equal(t, FirstValidKeyGen+1, head.LatestKeyGeneration())
+
+	infos, err = kbfsOps.GetKeyGenerations(ctx, tlfID)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+
+	revokedTime := keybase1.FromTime(keybase1.ToTime(clock.Now()))
+	u1Device := KeyGenerationDevice{
+		UID:           uid1,
+		Username:      "u1",
+		DeviceKID:     u1Dev,
+		Writer:        true,
+		AddedRevision: MetadataRevisionInitial,
+	}
+	u2Device1 := KeyGenerationDevice{
+		UID:           uid2,
+		Username:      "u2",
+		DeviceKID:     u2Dev1,
+		AddedRevision: MetadataRevisionInitial,
+		Revoked:       true,
+		RevokedTime:   revokedTime,
+	}
+	u2Device2 := KeyGenerationDevice{
+		UID:           uid2,
+		Username:      "u2",
+		DeviceKID:     u2Dev2,
+		AddedRevision: addedRev,
+	}
+	require.Equal(t, FirstValidKeyGen, infos[0].KeyGen)
+	expected := []KeyGenerationDevice{u1Device, u2Device1, u2Device2}
+	sort.Sort(keyGenerationDevicesByUser(expected))
+	require.Equal(t, expected, infos[0].Devices)
+
+	u1Device.AddedRevision = head.Revision()
+	u2Device2.AddedRevision = head.Revision()
+	require.Equal(t, FirstValidKeyGen+1, infos[1].KeyGen)
+	require.Equal(t, head.Revision(), infos[1].CreatedRevision)
+	require.Equal(t, []KeyGenerationDevice{u1Device, u2Device2},
+		infos[1].Devices)
+}
+
+func TestGetKeyGenerationsPublic(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", true)
+	infos, err := config.KBFSOps().GetKeyGenerations(
+		ctx, rootNode.GetFolderBranch().Tlf)
+	require.NoError(t, err)
+	require.Len(t, infos, 0)
+}
@@ -0,0 +1,391 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/syndtr/goleveldb/leveldb"
+	"golang.org/x/net/context"
+)
+
+// KeyHalfProblemType is the type of a problem found by
+// AuditTLFKeyHalves.
+type KeyHalfProblemType int
+
+const (
+	// KeyHalfMissing means that the key server doesn't have the
+	// server half a key bundle refers to.
+	KeyHalfMissing KeyHalfProblemType = iota
+	// KeyHalfMismatch means that the server half the key server
+	// returned doesn't match the MAC in the key bundle, so it was
+	// tampered with or corrupted.
+	KeyHalfMismatch
+	// KeyHalfUnreadable means that the key server refused or
+	// failed to return the server half.
+	KeyHalfUnreadable
+)
+
+func (t KeyHalfProblemType) String() string {
+	switch t {
+	case KeyHalfMissing:
+		return "missing"
+	case KeyHalfMismatch:
+		return "MAC mismatch"
+	case KeyHalfUnreadable:
+		return "unreadable"
+	default:
+		return fmt.Sprintf("KeyHalfProblemType(%d)", int(t))
+	}
+}
+
+// KeyHalfProblem is a single problem with a crypt key server half,
+// found by AuditTLFKeyHalves.  It is suitable for encoding directly
+// as JSON.
+type KeyHalfProblem struct {
+	Type      KeyHalfProblemType
+	TlfID     tlf.ID
+	KeyGen    KeyGen
+	UID       keybase1.UID
+	DeviceKID keybase1.KID
+	// Err is the error from the key server, for
+	// KeyHalfUnreadable.
+	Err string `json:",omitempty"`
+}
+
+func (p KeyHalfProblem) String() string {
+	s := fmt.Sprintf("%s: key generation %d for device %s: %s",
+		p.TlfID, p.KeyGen, p.DeviceKID, p.Type)
+	if p.Err != "" {
+		s += fmt.Sprintf(" (%s)", p.Err)
+	}
+	return s
+}
+
+// KeyHalfAuditResult is the result of checking a TLF with
+// AuditTLFKeyHalves.
+type KeyHalfAuditResult struct {
+	// Revision is the merged MD revision whose key bundles were
+	// checked.
+	Revision MetadataRevision
+	// Checked is the number of server halves checked.
+	Checked  int
+	Problems []KeyHalfProblem
+}
+
+// isMissingKeyHalfError returns whether err means that the key
+// server doesn't have a server half, rather than that it couldn't be
+// fetched.
+func isMissingKeyHalfError(err error) bool {
+	switch err {
+	case leveldb.ErrNotFound:
+		return true
+	}
+	switch err.(type) {
+	case libkb.NotFoundError:
+		return true
+	default:
+		return false
+	}
+}
+
+// keyHalfProblemsByTLF sorts key half problems by TLF ID, and then
+// by key generation.
+type keyHalfProblemsByTLF []KeyHalfProblem
+
+func (p keyHalfProblemsByTLF) Len() int      { return len(p) }
+func (p keyHalfProblemsByTLF) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p keyHalfProblemsByTLF) Less(i, j int) bool {
+	if p[i].TlfID != p[j].TlfID {
+		return p[i].TlfID.String() < p[j].TlfID.String()
+	}
+	return p[i].KeyGen < p[j].KeyGen
+}
+
+// auditKeyHalves checks the server halves of every key generation of
+// kmd for the current device.
+func auditKeyHalves(ctx context.Context, config Config, kmd KeyMetadata) (
+	KeyHalfAuditResult, error) {
+	var result KeyHalfAuditResult
+	if kmd.TlfID().IsPublic() {
+		return result, nil
+	}
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return KeyHalfAuditResult{}, err
+	}
+	cryptKey, err := config.KBPKI().GetCurrentCryptPublicKey(ctx)
+	if err != nil {
+		return KeyHalfAuditResult{}, err
+	}
+
+	crypto := config.Crypto()
+	for keyGen := FirstValidKeyGen; keyGen <= kmd.LatestKeyGeneration(); keyGen++ {
+		_, _, serverHalfID, found, err :=
+			kmd.GetTLFCryptKeyParams(keyGen, uid, cryptKey)
+		if err != nil {
+			return KeyHalfAuditResult{}, err
+		}
+		if !found {
+			// The device was added after this key
+			// generation, or was never added at all.
+			continue
+		}
+
+		result.Checked++
+		problem := KeyHalfProblem{
+			TlfID:     kmd.TlfID(),
+			KeyGen:    keyGen,
+			UID:       uid,
+			DeviceKID: cryptKey.KID(),
+		}
+		serverHalf, err := config.KeyServer().GetTLFCryptKeyServerHalf(
+			ctx, serverHalfID, cryptKey)
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			return KeyHalfAuditResult{}, ctx.Err()
+		case isMissingKeyHalfError(err):
+			problem.Type = KeyHalfMissing
+			result.Problems = append(result.Problems, problem)
+			continue
+		default:
+			problem.Type = KeyHalfUnreadable
+			problem.Err = err.Error()
+			result.Problems = append(result.Problems, problem)
+			continue
+		}
+
+		err = crypto.VerifyTLFCryptKeyServerHalfID(
+			serverHalfID, uid, cryptKey.KID(), serverHalf)
+		if err != nil {
+			problem.Type = KeyHalfMismatch
+			result.Problems = append(result.Problems, problem)
+		}
+	}
+	return result, nil
+}
+
+// AuditTLFKeyHalves checks that the key server still has the crypt
+// key server halves of every key generation of the given TLF for the
+// current device, and that they match the MACs (the server half IDs)
+// in the TLF's key bundles.  Only the current device's halves can be
+// checked, since the key server only gives a device its own halves.
+//
+// Problems are returned in the result; an error is only returned
+// if the check couldn't be done.
+func AuditTLFKeyHalves(ctx context.Context, config Config, tlfID tlf.ID) (
+	KeyHalfAuditResult, error) {
+	head, err := config.MDOps().GetForTLF(ctx, tlfID)
+	if err != nil {
+		return KeyHalfAuditResult{}, err
+	}
+	if head == (ImmutableRootMetadata{}) {
+		return KeyHalfAuditResult{}, fmt.Errorf("TLF %s has no MD", tlfID)
+	}
+	result, err := auditKeyHalves(ctx, config, head)
+	if err != nil {
+		return KeyHalfAuditResult{}, err
+	}
+	result.Revision = head.Revision()
+	return result, nil
+}
+
+// KeyHalfHealthStatus describes the results of the background audits
+// of crypt key server halves.  It is suitable for encoding directly
+// as JSON.
+type KeyHalfHealthStatus struct {
+	// LastAuditTime is when the last audit of all the favorite
+	// TLFs finished, or zero if none has yet.
+	LastAuditTime time.Time
+	// TLFsAudited is the number of TLFs checked by the last
+	// audit.
+	TLFsAudited int
+	// Problems holds the problems found by the last audit of each
+	// TLF, sorted by TLF and key generation.
+	Problems []KeyHalfProblem `json:",omitempty"`
+	// FailedTLFs maps the names of the TLFs that couldn't be
+	// audited last time to the reason why.
+	FailedTLFs map[string]string `json:",omitempty"`
+}
+
+// CtxKeyHalfAuditTagKey is the type used for unique context tags
+// within a key half audit.
+type CtxKeyHalfAuditTagKey int
+
+const (
+	// CtxKeyHalfAuditIDKey is the type of the tag for unique
+	// operation IDs within a key half audit.
+	CtxKeyHalfAuditIDKey CtxKeyHalfAuditTagKey = iota
+)
+
+// CtxKeyHalfAuditOpID is the display name for the unique operation
+// key half audit ID tag.
+const CtxKeyHalfAuditOpID = "KHAID"
+
+// keyHalfAuditor periodically audits the crypt key server halves of
+// all the user's private favorite TLFs, and keeps a
+// KeyHalfHealthStatus with the results.
+type keyHalfAuditor struct {
+	config   Config
+	log      logger.Logger
+	interval time.Duration
+
+	shutdownChan chan struct{}
+
+	lock       sync.Mutex
+	status     KeyHalfHealthStatus
+	updateChan chan StatusUpdate
+}
+
+func newKeyHalfAuditor(config Config, log logger.Logger,
+	interval time.Duration) *keyHalfAuditor {
+	return &keyHalfAuditor{
+		config:       config,
+		log:          log,
+		interval:     interval,
+		shutdownChan: make(chan struct{}),
+		updateChan:   make(chan StatusUpdate),
+	}
+}
+
+// auditFavorite audits the TLF of the given favorite, and returns
+// the problems found.
+func (a *keyHalfAuditor) auditFavorite(
+	ctx context.Context, fav Favorite) ([]KeyHalfProblem, error) {
+	h, err := ParseTlfHandle(ctx, a.config.KBPKI(), fav.Name, fav.Public)
+	if err != nil {
+		return nil, err
+	}
+	_, md, err := a.config.MDOps().GetForHandle(ctx, h, Merged)
+	if err != nil {
+		return nil, err
+	}
+	if md == (ImmutableRootMetadata{}) {
+		return nil, nil
+	}
+	result, err := auditKeyHalves(ctx, a.config, md)
+	if err != nil {
+		return nil, err
+	}
+	return result.Problems, nil
+}
+
+// audit audits every private favorite TLF, and updates the status.
+func (a *keyHalfAuditor) audit(ctx context.Context) error {
+	favs, err := a.config.KBFSOps().GetFavorites(ctx)
+	if err != nil {
+		return err
+	}
+
+	status := KeyHalfHealthStatus{}
+	for _, fav := range favs {
+		if fav.Public {
+			continue
+		}
+		problems, err := a.auditFavorite(ctx, fav)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		status.TLFsAudited++
+		if err != nil {
+			a.log.CDebugf(ctx, "Couldn't audit the key halves of %s: %v",
+				fav.Name, err)
+			if status.FailedTLFs == nil {
+				status.FailedTLFs = make(map[string]string)
+			}
+			status.FailedTLFs[fav.Name] = err.Error()
+			continue
+		}
+		for _, p := range problems {
+			a.log.CWarningf(ctx, "Key half problem in %s: %s",
+				fav.Name, p)
+		}
+		status.Problems = append(status.Problems, problems...)
+	}
+	sort.Sort(keyHalfProblemsByTLF(status.Problems))
+	status.LastAuditTime = a.config.Clock().Now()
+	a.setStatus(status)
+	return nil
+}
+
+// setStatus replaces the status, and notifies anyone waiting on the
+// update channel, or on KBFSOps.Status, if the problems found have
+// changed.
+func (a *keyHalfAuditor) setStatus(status KeyHalfHealthStatus) {
+	changed := func() bool {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		changed := !reflect.DeepEqual(
+			a.status.Problems, status.Problems) ||
+			!reflect.DeepEqual(a.status.FailedTLFs, status.FailedTLFs)
+		a.status = status
+		if changed {
+			close(a.updateChan)
+			a.updateChan = make(chan StatusUpdate)
+		}
+		return changed
+	}()
+	if changed {
+		a.config.KBFSOps().PushStatusChange()
+	}
+}
+
+func (a *keyHalfAuditor) run() {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithCancel(ctxWithRandomIDReplayable(
+				context.Background(), CtxKeyHalfAuditIDKey,
+				CtxKeyHalfAuditOpID, a.log))
+			go func() {
+				select {
+				case <-a.shutdownChan:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			err := a.audit(ctx)
+			cancel()
+			if err != nil {
+				a.log.CDebugf(ctx, "Key half audit failed: %v", err)
+			}
+		case <-a.shutdownChan:
+			return
+		}
+	}
+}
+
+func (a *keyHalfAuditor) shutdown() {
+	close(a.shutdownChan)
+}
+
+// getStatus returns the current health status, and a channel that is
+// closed when the problems found change.
+func (a *keyHalfAuditor) getStatus() (
+	KeyHalfHealthStatus, <-chan StatusUpdate) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	status := a.status
+	status.Problems = append([]KeyHalfProblem(nil), a.status.Problems...)
+	if a.status.FailedTLFs != nil {
+		status.FailedTLFs = make(map[string]string)
+		for k, v := range a.status.FailedTLFs {
+			status.FailedTLFs[k] = v
+		}
+	}
+	return status, a.updateChan
+}
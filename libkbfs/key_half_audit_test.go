@@ -0,0 +1,103 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// tamperingKeyServer returns corrupted versions of the server halves
+// with the given IDs.
+type tamperingKeyServer struct {
+	KeyServer
+	tampered map[TLFCryptKeyServerHalfID]bool
+}
+
+func (ks tamperingKeyServer) GetTLFCryptKeyServerHalf(ctx context.Context,
+	serverHalfID TLFCryptKeyServerHalfID, key kbfscrypto.CryptPublicKey) (
+	kbfscrypto.TLFCryptKeyServerHalf, error) {
+	serverHalf, err := ks.KeyServer.GetTLFCryptKeyServerHalf(
+		ctx, serverHalfID, key)
+	if err != nil || !ks.tampered[serverHalfID] {
+		return serverHalf, err
+	}
+	data := serverHalf.Data()
+	data[0] ^= 1
+	return kbfscrypto.MakeTLFCryptKeyServerHalf(data), nil
+}
+
+func TestAuditTLFKeyHalves(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	head, err := config.MDOps().GetForTLF(ctx, tlfID)
+	require.NoError(t, err)
+	require.Equal(t, FirstValidKeyGen, head.LatestKeyGeneration())
+
+	result, err := AuditTLFKeyHalves(ctx, config, tlfID)
+	require.NoError(t, err)
+	require.Equal(t, head.Revision(), result.Revision)
+	require.Equal(t, 1, result.Checked)
+	require.Len(t, result.Problems, 0)
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	cryptKey, err := config.KBPKI().GetCurrentCryptPublicKey(ctx)
+	require.NoError(t, err)
+	_, _, serverHalfID, found, err := head.GetTLFCryptKeyParams(
+		FirstValidKeyGen, uid, cryptKey)
+	require.NoError(t, err)
+	require.True(t, found)
+	expectedProblem := KeyHalfProblem{
+		TlfID:     tlfID,
+		KeyGen:    FirstValidKeyGen,
+		UID:       uid,
+		DeviceKID: cryptKey.KID(),
+	}
+
+	// A tampered server half is caught by its MAC.
+	keyServer := config.KeyServer()
+	config.SetKeyServer(tamperingKeyServer{
+		keyServer, map[TLFCryptKeyServerHalfID]bool{serverHalfID: true}})
+	result, err = AuditTLFKeyHalves(ctx, config, tlfID)
+	require.NoError(t, err)
+	expectedProblem.Type = KeyHalfMismatch
+	require.Equal(t, []KeyHalfProblem{expectedProblem}, result.Problems)
+	config.SetKeyServer(keyServer)
+
+	// So is a missing one.
+	err = keyServer.DeleteTLFCryptKeyServerHalf(
+		ctx, uid, cryptKey.KID(), serverHalfID)
+	require.NoError(t, err)
+	result, err = AuditTLFKeyHalves(ctx, config, tlfID)
+	require.NoError(t, err)
+	expectedProblem.Type = KeyHalfMissing
+	require.Equal(t, []KeyHalfProblem{expectedProblem}, result.Problems)
+
+	// The background auditor reports it for the favorite TLF, and
+	// notifies its listeners.
+	a := newKeyHalfAuditor(config, logger.NewTestLogger(t), time.Hour)
+	status, ch := a.getStatus()
+	require.Equal(t, KeyHalfHealthStatus{}, status)
+	err = a.audit(ctx)
+	require.NoError(t, err)
+	select {
+	case <-ch:
+	default:
+		t.Fatal("Health status channel wasn't closed")
+	}
+	status, _ = a.getStatus()
+	require.Equal(t, 1, status.TLFsAudited)
+	require.Equal(t, []KeyHalfProblem{expectedProblem}, status.Problems)
+	require.Len(t, status.FailedTLFs, 0)
+}
@@ -0,0 +1,236 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"golang.org/x/net/context"
+)
+
+// KeyHalfStore holds encoded TLF crypt key server halves by ID, in a
+// place the user controls, for use by KeyServerStore in place of the
+// Keybase key server.  A store is only trusted to keep the halves
+// available: KeyServerStore checks every half it gets against the
+// half's ID.
+type KeyHalfStore interface {
+	// Get returns the encoded server half with the given ID.  If
+	// there isn't one, it returns libkb.NotFoundError.
+	Get(ctx context.Context, id TLFCryptKeyServerHalfID) ([]byte, error)
+	// Put stores the given encoded server halves under their IDs.
+	Put(ctx context.Context, halves map[TLFCryptKeyServerHalfID][]byte) error
+	// Delete removes the server half with the given ID, if there is
+	// one.
+	Delete(ctx context.Context, id TLFCryptKeyServerHalfID) error
+	// Shutdown frees any resources held by the store.
+	Shutdown()
+}
+
+// KeyHalfStoreDir is a KeyHalfStore that keeps each server half in
+// its own file, named by the half's ID, in a directory.  Since each
+// file is written atomically and never changed afterwards, the
+// directory can be on removable media, or shared between a user's
+// devices with any file syncing tool.
+type KeyHalfStoreDir struct {
+	dir string
+}
+
+var _ KeyHalfStore = KeyHalfStoreDir{}
+
+// NewKeyHalfStoreDir returns a KeyHalfStoreDir that keeps its server
+// halves in the given directory.
+func NewKeyHalfStoreDir(dir string) KeyHalfStoreDir {
+	return KeyHalfStoreDir{dir}
+}
+
+func (s KeyHalfStoreDir) path(id TLFCryptKeyServerHalfID) string {
+	return filepath.Join(s.dir, id.String())
+}
+
+// Get implements the KeyHalfStore interface for KeyHalfStoreDir.
+func (s KeyHalfStoreDir) Get(
+	_ context.Context, id TLFCryptKeyServerHalfID) ([]byte, error) {
+	buf, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, libkb.NotFoundError{
+			Msg: fmt.Sprintf("No key half with ID %s", id)}
+	}
+	return buf, err
+}
+
+// Put implements the KeyHalfStore interface for KeyHalfStoreDir.
+func (s KeyHalfStoreDir) Put(_ context.Context,
+	halves map[TLFCryptKeyServerHalfID][]byte) error {
+	for id, buf := range halves {
+		err := writeFileAtomic(s.path(id), buf, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete implements the KeyHalfStore interface for KeyHalfStoreDir.
+func (s KeyHalfStoreDir) Delete(
+	_ context.Context, id TLFCryptKeyServerHalfID) error {
+	err := os.Remove(s.path(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown implements the KeyHalfStore interface for KeyHalfStoreDir.
+func (s KeyHalfStoreDir) Shutdown() {}
+
+// keyHalfStoreGetArg is the argument of the kbfs.1.keyHalfStore.get
+// RPC.
+type keyHalfStoreGetArg struct {
+	ID string `codec:"id"`
+}
+
+// keyHalfStorePutArg is the argument of the kbfs.1.keyHalfStore.put
+// RPC.
+type keyHalfStorePutArg struct {
+	Halves map[string][]byte `codec:"halves"`
+}
+
+// keyHalfStoreDeleteArg is the argument of the
+// kbfs.1.keyHalfStore.delete RPC.
+type keyHalfStoreDeleteArg struct {
+	ID string `codec:"id"`
+}
+
+// KeyHalfStoreClient is a KeyHalfStore that makes RPCs to a separate
+// service listening on a unix socket, which serves the
+// kbfs.1.keyHalfStore protocol:
+//
+//	get(id: string) -> bytes
+//	put(halves: map<string, bytes>)
+//	delete(id: string)
+//
+// IDs are the hex strings of the server half IDs.  When get can't
+// find a half, the service should return an error that unwraps to
+// libkb.NotFoundError.
+type KeyHalfStoreClient struct {
+	config     Config
+	log        logger.Logger
+	cli        rpc.GenericClient
+	shutdownFn func()
+}
+
+var _ KeyHalfStore = (*KeyHalfStoreClient)(nil)
+
+var _ rpc.ConnectionHandler = (*KeyHalfStoreClient)(nil)
+
+// NewKeyHalfStoreClient constructs a new KeyHalfStoreClient that
+// talks to the service listening on the given unix socket.
+func NewKeyHalfStoreClient(config Config, kbCtx Context,
+	socketPath string) *KeyHalfStoreClient {
+	s := &KeyHalfStoreClient{
+		config: config,
+		log:    config.MakeLogger(""),
+	}
+	transport := &unixSocketTransport{
+		socketPath: socketPath,
+		logFactory: kbCtx.NewRPCLogFactory(),
+	}
+	conn := rpc.NewConnectionWithTransport(s, transport,
+		libkb.ErrorUnwrapper{}, true, libkb.WrapError,
+		config.MakeLogger(""), LogTagsFromContext)
+	s.cli = conn.GetClient()
+	s.shutdownFn = conn.Shutdown
+	return s
+}
+
+// Get implements the KeyHalfStore interface for KeyHalfStoreClient.
+func (s *KeyHalfStoreClient) Get(
+	ctx context.Context, id TLFCryptKeyServerHalfID) (res []byte, err error) {
+	arg := keyHalfStoreGetArg{ID: id.String()}
+	err = s.cli.Call(ctx, "kbfs.1.keyHalfStore.get",
+		[]interface{}{arg}, &res)
+	return res, err
+}
+
+// Put implements the KeyHalfStore interface for KeyHalfStoreClient.
+func (s *KeyHalfStoreClient) Put(ctx context.Context,
+	halves map[TLFCryptKeyServerHalfID][]byte) error {
+	arg := keyHalfStorePutArg{Halves: make(map[string][]byte, len(halves))}
+	for id, buf := range halves {
+		arg.Halves[id.String()] = buf
+	}
+	return s.cli.Call(ctx, "kbfs.1.keyHalfStore.put",
+		[]interface{}{arg}, nil)
+}
+
+// Delete implements the KeyHalfStore interface for KeyHalfStoreClient.
+func (s *KeyHalfStoreClient) Delete(
+	ctx context.Context, id TLFCryptKeyServerHalfID) error {
+	arg := keyHalfStoreDeleteArg{ID: id.String()}
+	return s.cli.Call(ctx, "kbfs.1.keyHalfStore.delete",
+		[]interface{}{arg}, nil)
+}
+
+// Shutdown implements the KeyHalfStore interface for
+// KeyHalfStoreClient.
+func (s *KeyHalfStoreClient) Shutdown() {
+	s.shutdownFn()
+}
+
+// HandlerName implements the ConnectionHandler interface.
+func (*KeyHalfStoreClient) HandlerName() string {
+	return "KeyHalfStoreClient"
+}
+
+// OnConnect implements the ConnectionHandler interface.
+func (s *KeyHalfStoreClient) OnConnect(ctx context.Context,
+	conn *rpc.Connection, _ rpc.GenericClient, server *rpc.Server) error {
+	s.config.KBFSOps().PushConnectionStatusChange(
+		KeyHalfStoreServiceName, nil)
+	return nil
+}
+
+// OnConnectError implements the ConnectionHandler interface.
+func (s *KeyHalfStoreClient) OnConnectError(err error, wait time.Duration) {
+	s.log.Warning("KeyHalfStoreClient: connection error: %q; retrying in %s",
+		err, wait)
+	s.config.KBFSOps().PushConnectionStatusChange(
+		KeyHalfStoreServiceName, err)
+}
+
+// OnDoCommandError implements the ConnectionHandler interface.
+func (s *KeyHalfStoreClient) OnDoCommandError(err error, wait time.Duration) {
+	s.log.Warning("KeyHalfStoreClient: docommand error: %q; retrying in %s",
+		err, wait)
+	s.config.KBFSOps().PushConnectionStatusChange(
+		KeyHalfStoreServiceName, err)
+}
+
+// OnDisconnected implements the ConnectionHandler interface.
+func (s *KeyHalfStoreClient) OnDisconnected(_ context.Context,
+	status rpc.DisconnectStatus) {
+	if status == rpc.StartingNonFirstConnection {
+		s.log.Warning("KeyHalfStoreClient is disconnected")
+		s.config.KBFSOps().PushConnectionStatusChange(
+			KeyHalfStoreServiceName, errDisconnected{})
+	}
+}
+
+// ShouldRetry implements the ConnectionHandler interface.
+func (s *KeyHalfStoreClient) ShouldRetry(rpcName string, err error) bool {
+	return false
+}
+
+// ShouldRetryOnConnect implements the ConnectionHandler interface.
+func (s *KeyHalfStoreClient) ShouldRetryOnConnect(err error) bool {
+	return true
+}
@@ -1233,6 +1233,73 @@ func TestKeyManagerReaderRekeyAndRevoke(t *testing.T) {
 	}
 }
 
+// Test that a rekey request from a reader's new device is noticed by
+// the writer, which rekeys automatically, and that the request and
+// its acceptance show up in the folder status.
+func TestKeyManagerReaderRekeyRequest(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1, u2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(t, config2)
+	_, uid2, err := config2.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	name := u1.String() + ReaderSep + u2.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	fb := rootNode1.GetFolderBranch()
+	kbfsOps1 := config1.KBFSOps()
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// The configs don't share a Keybase Daemon so we have to add the
+	// device in all places.
+	AddDeviceForLocalUserOrBust(t, config1, uid2)
+	devIndex := AddDeviceForLocalUserOrBust(t, config2, uid2)
+	config2Dev2 := ConfigAsUser(config2, u2)
+	defer CheckConfigAndShutdown(t, config2Dev2)
+	SwitchDeviceForLocalUserOrBust(t, config2Dev2, devIndex)
+
+	_, err = GetRootNodeForTest(ctx, config2Dev2, name, false)
+	require.IsType(t, NeedSelfRekeyError{}, err)
+
+	// The new device can only request a rekey.
+	kbfsOps2Dev2 := config2Dev2.KBFSOps()
+	err = kbfsOps2Dev2.Rekey(ctx, fb.Tlf)
+	require.NoError(t, err)
+	requestRev := getOps(config2Dev2, fb.Tlf).head.Revision()
+
+	// The writer picks up the request and rekeys in the background.
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	err = config1.RekeyQueue().Wait(ctx)
+	require.NoError(t, err)
+
+	// The rekey history is fetched in the background, once the
+	// status is asked for.
+	_, _, err = kbfsOps1.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	err = getOps(config1, fb.Tlf).status.rekeys.wait(ctx)
+	require.NoError(t, err)
+
+	status, _, err := kbfsOps1.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.NotNil(t, status.RekeyRequest)
+	require.Equal(t, RekeyRequestAccepted, status.RekeyRequest.State)
+	require.Equal(t, u2, status.RekeyRequest.Requester)
+	require.Equal(t, requestRev, status.RekeyRequest.RequestRevision)
+	require.Equal(t, u1, status.RekeyRequest.Accepter)
+	require.Equal(t, status.Revision, status.RekeyRequest.AcceptRevision)
+
+	err = kbfsOps2Dev2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	root2Dev2 := GetRootNodeOrBust(ctx, t, config2Dev2, name, false)
+	children, err := kbfsOps2Dev2.GetDirChildren(ctx, root2Dev2)
+	require.NoError(t, err)
+	require.Contains(t, children, "a")
+}
+
 // This tests 2 variations of the situation where clients w/o the folder key set the rekey bit.
 // In one case the client is a writer and in the other a reader. They both blindly copy the existing
 // metadata and simply set the rekey bit. Then another participant rekeys the folder and they try to read.
@@ -23,7 +23,10 @@ import (
 type KeyServerLocal struct {
 	config Config
 	db     *leveldb.DB // TLFCryptKeyServerHalfID -> TLFCryptKeyServerHalf
-	log    logger.Logger
+	// storage backs db, and has to be closed separately, since
+	// db didn't open it.
+	storage storage.Storage
+	log     logger.Logger
 
 	shutdownLock *sync.RWMutex
 	shutdown     *bool
@@ -39,7 +42,7 @@ func newKeyServerLocal(config Config, storage storage.Storage,
 	if err != nil {
 		return nil, err
 	}
-	kops := &KeyServerLocal{config, db, config.MakeLogger(""),
+	kops := &KeyServerLocal{config, db, storage, config.MakeLogger(""),
 		&sync.RWMutex{}, new(bool), shutdownFunc}
 	return kops, nil
 }
@@ -166,7 +169,7 @@ func (ks *KeyServerLocal) DeleteTLFCryptKeyServerHalf(ctx context.Context,
 
 // Copies a key server but swaps the config.
 func (ks *KeyServerLocal) copy(config Config) *KeyServerLocal {
-	return &KeyServerLocal{config, ks.db, config.MakeLogger(""),
+	return &KeyServerLocal{config, ks.db, ks.storage, config.MakeLogger(""),
 		ks.shutdownLock, ks.shutdown, ks.shutdownFunc}
 }
 
@@ -182,6 +185,9 @@ func (ks *KeyServerLocal) Shutdown() {
 	if ks.db != nil {
 		ks.db.Close()
 	}
+	if ks.storage != nil {
+		ks.storage.Close()
+	}
 
 	if ks.shutdownFunc != nil {
 		ks.shutdownFunc(ks.log)
@@ -0,0 +1,104 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"golang.org/x/net/context"
+)
+
+// KeyServerStore is a KeyServer that keeps TLF crypt key server
+// halves in a KeyHalfStore the user controls, instead of on the
+// Keybase key server, for users who don't want to trust Keybase with
+// both halves of their keys.
+//
+// Every device that needs a folder's keys must be able to reach the
+// same store, so the store has to be shared between a user's
+// devices, and between the members of any shared folders, by other
+// means.  Devices whose server halves aren't in the store can't
+// decrypt the folder.
+type KeyServerStore struct {
+	config Config
+	store  KeyHalfStore
+	log    logger.Logger
+}
+
+// Test that KeyServerStore fully implements the KeyServer interface.
+var _ KeyServer = (*KeyServerStore)(nil)
+
+// NewKeyServerStore returns a KeyServerStore that keeps its server
+// halves in the given store.
+func NewKeyServerStore(config Config, store KeyHalfStore) *KeyServerStore {
+	return &KeyServerStore{config, store, config.MakeLogger("")}
+}
+
+// GetTLFCryptKeyServerHalf implements the KeyServer interface for
+// KeyServerStore.
+func (ks *KeyServerStore) GetTLFCryptKeyServerHalf(ctx context.Context,
+	serverHalfID TLFCryptKeyServerHalfID, key kbfscrypto.CryptPublicKey) (
+	kbfscrypto.TLFCryptKeyServerHalf, error) {
+	buf, err := ks.store.Get(ctx, serverHalfID)
+	if err != nil {
+		return kbfscrypto.TLFCryptKeyServerHalf{}, err
+	}
+
+	var serverHalf kbfscrypto.TLFCryptKeyServerHalf
+	err = ks.config.Codec().Decode(buf, &serverHalf)
+	if err != nil {
+		return kbfscrypto.TLFCryptKeyServerHalf{}, err
+	}
+
+	_, uid, err := ks.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return kbfscrypto.TLFCryptKeyServerHalf{}, err
+	}
+
+	// The store isn't trusted to return the right half.
+	err = ks.config.Crypto().VerifyTLFCryptKeyServerHalfID(
+		serverHalfID, uid, key.KID(), serverHalf)
+	if err != nil {
+		ks.log.CDebugf(ctx, "error verifying server half ID: %s", err)
+		return kbfscrypto.TLFCryptKeyServerHalf{}, err
+	}
+	return serverHalf, nil
+}
+
+// PutTLFCryptKeyServerHalves implements the KeyServer interface for
+// KeyServerStore.
+func (ks *KeyServerStore) PutTLFCryptKeyServerHalves(ctx context.Context,
+	serverKeyHalves map[keybase1.UID]map[keybase1.KID]kbfscrypto.TLFCryptKeyServerHalf) error {
+	halves := make(map[TLFCryptKeyServerHalfID][]byte)
+	crypto := ks.config.Crypto()
+	for uid, deviceMap := range serverKeyHalves {
+		for deviceKID, serverHalf := range deviceMap {
+			buf, err := ks.config.Codec().Encode(serverHalf)
+			if err != nil {
+				return err
+			}
+			id, err := crypto.GetTLFCryptKeyServerHalfID(
+				uid, deviceKID, serverHalf)
+			if err != nil {
+				return err
+			}
+			halves[id] = buf
+		}
+	}
+	return ks.store.Put(ctx, halves)
+}
+
+// DeleteTLFCryptKeyServerHalf implements the KeyServer interface for
+// KeyServerStore.
+func (ks *KeyServerStore) DeleteTLFCryptKeyServerHalf(ctx context.Context,
+	_ keybase1.UID, _ keybase1.KID,
+	serverHalfID TLFCryptKeyServerHalfID) error {
+	return ks.store.Delete(ctx, serverHalfID)
+}
+
+// Shutdown implements the KeyServer interface for KeyServerStore.
+func (ks *KeyServerStore) Shutdown() {
+	ks.store.Shutdown()
+}
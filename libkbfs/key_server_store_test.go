@@ -0,0 +1,131 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestKeyServerStoreDir(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	dir, err := ioutil.TempDir(os.TempDir(), "key_half_store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config.KeyServer().Shutdown()
+	config.SetKeyServer(NewKeyServerStore(config, NewKeyHalfStoreDir(dir)))
+
+	ctx := context.Background()
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	publicKey, err := config.KBPKI().GetCurrentCryptPublicKey(ctx)
+	require.NoError(t, err)
+	serverHalf1 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{1})
+	serverHalf2 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{2})
+	serverHalfID1, err := config.Crypto().GetTLFCryptKeyServerHalfID(
+		uid, publicKey.KID(), serverHalf1)
+	require.NoError(t, err)
+	serverHalfID2, err := config.Crypto().GetTLFCryptKeyServerHalfID(
+		uid, publicKey.KID(), serverHalf2)
+	require.NoError(t, err)
+
+	// A half that was never stored is reported as missing.
+	kserv := config.KeyServer()
+	_, err = kserv.GetTLFCryptKeyServerHalf(ctx, serverHalfID1, publicKey)
+	require.True(t, isMissingKeyHalfError(err))
+
+	err = kserv.PutTLFCryptKeyServerHalves(ctx,
+		map[keybase1.UID]map[keybase1.KID]kbfscrypto.TLFCryptKeyServerHalf{
+			uid: {publicKey.KID(): serverHalf1},
+		})
+	require.NoError(t, err)
+	err = kserv.PutTLFCryptKeyServerHalves(ctx,
+		map[keybase1.UID]map[keybase1.KID]kbfscrypto.TLFCryptKeyServerHalf{
+			uid: {publicKey.KID(): serverHalf2},
+		})
+	require.NoError(t, err)
+	half, err := kserv.GetTLFCryptKeyServerHalf(ctx, serverHalfID1, publicKey)
+	require.NoError(t, err)
+	require.Equal(t, serverHalf1, half)
+
+	// A half that doesn't match its ID is rejected.
+	buf, err := ioutil.ReadFile(filepath.Join(dir, serverHalfID2.String()))
+	require.NoError(t, err)
+	err = ioutil.WriteFile(
+		filepath.Join(dir, serverHalfID1.String()), buf, 0600)
+	require.NoError(t, err)
+	_, err = kserv.GetTLFCryptKeyServerHalf(ctx, serverHalfID1, publicKey)
+	require.Error(t, err)
+	require.False(t, isMissingKeyHalfError(err))
+
+	err = kserv.DeleteTLFCryptKeyServerHalf(
+		ctx, uid, publicKey.KID(), serverHalfID2)
+	require.NoError(t, err)
+	_, err = kserv.GetTLFCryptKeyServerHalf(ctx, serverHalfID2, publicKey)
+	require.True(t, isMissingKeyHalfError(err))
+	// Deleting it again is fine.
+	err = kserv.DeleteTLFCryptKeyServerHalf(
+		ctx, uid, publicKey.KID(), serverHalfID2)
+	require.NoError(t, err)
+}
+
+// countingKeyHalfStore counts the server halves fetched from a
+// KeyHalfStore.
+type countingKeyHalfStore struct {
+	KeyHalfStore
+
+	lock sync.Mutex
+	gets int
+}
+
+func (s *countingKeyHalfStore) Get(
+	ctx context.Context, id TLFCryptKeyServerHalfID) ([]byte, error) {
+	s.lock.Lock()
+	s.gets++
+	s.lock.Unlock()
+	return s.KeyHalfStore.Get(ctx, id)
+}
+
+func TestKeyServerStoreDirFolderKeys(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	dir, err := ioutil.TempDir(os.TempDir(), "key_half_store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config.KeyServer().Shutdown()
+	store := &countingKeyHalfStore{KeyHalfStore: NewKeyHalfStoreDir(dir)}
+	config.SetKeyServer(NewKeyServerStore(config, store))
+
+	// The server half of a new private folder's key goes to the
+	// store...
+	GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fileInfos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, fileInfos, 1)
+
+	// ...and is read back from there once the key cache is
+	// cleared.
+	config.ResetCaches()
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	fileNode, _, err := config.KBFSOps().CreateFile(
+		ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = config.KBFSOps().Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = config.KBFSOps().Sync(ctx, fileNode)
+	require.NoError(t, err)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	require.NotZero(t, store.gets)
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
 )
 
 // keybaseDaemon is the default KeybaseServiceCn implementation, which
@@ -21,7 +22,16 @@ func (k keybaseDaemon) NewKeybaseService(config Config, params InitParams, ctx C
 	localUser := libkb.NewNormalizedUsername(params.LocalUser)
 	if len(localUser) == 0 {
 		ctx.ConfigureSocketInfo()
-		return NewKeybaseDaemonRPC(config, ctx, log, params.Debug), nil
+		var protocols []rpc.Protocol
+		for _, create := range params.AdditionalProtocolCreators {
+			protocol, err := create(ctx, config)
+			if err != nil {
+				return nil, err
+			}
+			protocols = append(protocols, protocol)
+		}
+		return NewKeybaseDaemonRPC(
+			config, ctx, log, params.Debug, protocols), nil
 	}
 
 	users := []libkb.NormalizedUsername{"strib", "max", "chris", "fred"}
@@ -63,13 +73,16 @@ func (k keybaseDaemon) NewKeybaseService(config Config, params InitParams, ctx C
 func (k keybaseDaemon) NewCrypto(config Config, params InitParams, ctx Context, log logger.Logger) (Crypto, error) {
 	var crypto Crypto
 	localUser := libkb.NewNormalizedUsername(params.LocalUser)
-	if localUser == "" {
-		crypto = NewCryptoClientRPC(config, ctx)
-	} else {
+	switch {
+	case localUser != "":
 		signingKey := MakeLocalUserSigningKeyOrBust(localUser)
 		cryptPrivateKey := MakeLocalUserCryptPrivateKeyOrBust(localUser)
 		crypto = NewCryptoLocal(
 			config.Codec(), signingKey, cryptPrivateKey)
+	case params.KeyAgentSocket != "":
+		crypto = NewCryptoKeyAgent(config, ctx, params.KeyAgentSocket)
+	default:
+		crypto = NewCryptoClientRPC(config, ctx)
 	}
 	return crypto, nil
 }
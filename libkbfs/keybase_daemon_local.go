@@ -243,7 +243,16 @@ func (k *KeybaseDaemonLocal) LoadUnverifiedKeys(ctx context.Context, uid keybase
 	if err != nil {
 		return nil, err
 	}
-	return u.UnverifiedKeys, nil
+	// Like the service, include all the keys the user has ever
+	// had, not just the ones dropped by an account reset.
+	keys := u.GetPublicKeys()
+	for key := range u.RevokedVerifyingKeys {
+		keys = append(keys, keybase1.PublicKey{
+			KID:      key.KID(),
+			IsSibkey: true,
+		})
+	}
+	return append(keys, u.UnverifiedKeys...), nil
 }
 
 // CurrentSession implements KeybaseDaemon for KeybaseDaemonLocal.
@@ -251,6 +260,9 @@ func (k *KeybaseDaemonLocal) CurrentSession(ctx context.Context, sessionID int)
 	SessionInfo, error) {
 	k.lock.Lock()
 	defer k.lock.Unlock()
+	if k.currentUID == keybase1.UID("") {
+		return SessionInfo{}, NoCurrentSessionError{}
+	}
 	u, err := k.localUsers.getLocalUser(k.currentUID)
 	if err != nil {
 		return SessionInfo{}, err
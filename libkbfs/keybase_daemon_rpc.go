@@ -43,9 +43,13 @@ var _ KeybaseService = (*KeybaseDaemonRPC)(nil)
 
 // NewKeybaseDaemonRPC makes a new KeybaseDaemonRPC that makes RPC
 // calls using the socket of the given Keybase context.
-func NewKeybaseDaemonRPC(config Config, kbCtx Context, log logger.Logger, debug bool) *KeybaseDaemonRPC {
+func NewKeybaseDaemonRPC(config Config, kbCtx Context, log logger.Logger,
+	debug bool, additionalProtocols []rpc.Protocol) *KeybaseDaemonRPC {
 	k := newKeybaseDaemonRPC(config, kbCtx, log)
 	k.config = config
+	// Set these before connecting, so they're registered on the
+	// first connection too.
+	k.AddProtocols(additionalProtocols)
 	k.daemonLog = logger.NewWithCallDepth("daemon", 1)
 	if debug {
 		k.daemonLog.Configure("", true, "")
@@ -348,11 +348,19 @@ func TestKeybaseDaemonUserCache(t *testing.T) {
 		func(ctx context.Context) {
 			errChan <- nil
 		}).Return(errChan)
+	// Every change is checked for revoked devices.
+	keysChanged := make(chan keybase1.UID, 2)
+	config.mockKbfs.EXPECT().UserKeysChanged(gomock.Any(), gomock.Any()).Do(
+		func(ctx context.Context, uid keybase1.UID) {
+			keysChanged <- uid
+		}).Return(nil).Times(2)
 	err = c.KeyfamilyChanged(context.Background(), uid1)
 	<-errChan
 	// This one shouldn't trigger CheckForRekeys; if it does, the mock
 	// controller will catch it during Finish.
 	err = c.KeyfamilyChanged(context.Background(), uid2)
+	changed := map[keybase1.UID]bool{<-keysChanged: true, <-keysChanged: true}
+	require.Equal(t, map[keybase1.UID]bool{uid1: true, uid2: true}, changed)
 }
 
 // truncateNotificationTimestamps is a helper function to truncate
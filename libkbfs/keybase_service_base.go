@@ -237,6 +237,20 @@ func (k *KeybaseServiceBase) KeyfamilyChanged(ctx context.Context,
 		k.config.MDServer().CheckForRekeys(context.Background())
 	}
 
+	if k.config != nil {
+		// Look for revoked devices in the background, since that
+		// needs to load the user's keys from the service.
+		go func() {
+			ctx := ctxWithRandomIDReplayable(context.Background(),
+				CtxKeybaseServiceIDKey, CtxKeybaseServiceOpID, k.log)
+			err := k.config.KBFSOps().UserKeysChanged(ctx, uid)
+			if err != nil {
+				k.log.CDebugf(ctx, "Couldn't check %s for revoked "+
+					"devices: %v", uid, err)
+			}
+		}()
+	}
+
 	return nil
 }
 
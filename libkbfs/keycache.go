@@ -53,3 +53,8 @@ func (k *KeyCacheStandard) PutTLFCryptKey(
 	k.lru.Add(cacheKey, key)
 	return nil
 }
+
+// Clear implements the KeyCache interface for KeyCacheStandard.
+func (k *KeyCacheStandard) Clear() {
+	k.lru.Purge()
+}
@@ -56,3 +56,19 @@ func TestKeyCacheBasic(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyCacheClear(t *testing.T) {
+	cache := NewKeyCacheStandard(10)
+	id := tlf.FakeID(100, true)
+	key := kbfscrypto.MakeTLFCryptKey([32]byte{0xf})
+	keyGen := KeyGen(1)
+	err := cache.PutTLFCryptKey(id, keyGen, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Clear()
+	_, err = cache.GetTLFCryptKey(id, keyGen)
+	if _, ok := err.(KeyCacheMissError); !ok {
+		t.Fatal(errors.New("expected KeyCacheMissError"))
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	// leaseLockMinRetryInterval bounds how often AcquireLeaseLock
+	// re-checks a lock held by someone else.
+	leaseLockMinRetryInterval = 1 * time.Second
+)
+
+// LeaseLockHeldError is returned by TryAcquireLeaseLock when the lock
+// is held by someone else, and its lease hasn't expired yet.
+type LeaseLockHeldError struct {
+	Name    string
+	Holder  string
+	Expires time.Time
+}
+
+// Error implements the error interface for LeaseLockHeldError.
+func (e LeaseLockHeldError) Error() string {
+	return fmt.Sprintf("Lock %s is held by %s until %s",
+		e.Name, e.Holder, e.Expires)
+}
+
+// LeaseLockLostError is returned by LeaseLock.Release when the lease
+// expired and was taken over by someone else before the lock was
+// released.
+type LeaseLockLostError struct {
+	Name   string
+	Holder string
+}
+
+// Error implements the error interface for LeaseLockLostError.
+func (e LeaseLockLostError) Error() string {
+	return fmt.Sprintf("Lock %s was lost to %s", e.Name, e.Holder)
+}
+
+// LeaseLockJournaledError is returned by TryAcquireLeaseLock when the
+// TLF journal is enabled for the folder of the lock.  Exclusive
+// creates aren't exclusive while the journal is on, so neither would
+// the lock be.
+type LeaseLockJournaledError struct {
+	Name string
+}
+
+// Error implements the error interface for LeaseLockJournaledError.
+func (e LeaseLockJournaledError) Error() string {
+	return fmt.Sprintf("Can't take lock %s while the folder's journal "+
+		"is enabled", e.Name)
+}
+
+// leaseLockInfo is the JSON-encoded contents of a lock file.
+type leaseLockInfo struct {
+	Holder  string
+	Expires time.Time
+}
+
+// LeaseLock is an advisory lock, for coordinating between devices,
+// that's held as long as its holder keeps renewing it.
+//
+// A lock is a file in a KBFS directory, created with WithExcl, that
+// names its holder and the time at which its lease expires.  While
+// the lock is held, the lease is renewed in the background.  If the
+// holder crashes or loses its connection, the lease eventually
+// expires, and anyone else may then steal the lock.  Acquiring a lock
+// under the same holder name as its current holder (e.g., after a
+// restart) resumes the existing lease right away.
+//
+// Like any lease, this is only safe if clocks are roughly in sync,
+// and if holders stop relying on the lock once Lost is closed.  Locks
+// can't be taken in folders with the TLF journal enabled, since the
+// journal turns exclusive creates into regular ones.
+type LeaseLock struct {
+	config Config
+	log    logger.Logger
+	dir    Node
+	name   string
+	holder string
+	ttl    time.Duration
+
+	lock     sync.Mutex
+	file     Node
+	released bool
+
+	lostCh     chan struct{}
+	shutdownCh chan struct{}
+	doneCh     chan struct{}
+}
+
+func readLeaseLockInfo(ctx context.Context, kbfsOps KBFSOps, dir Node,
+	name string) (file Node, info leaseLockInfo, mtime time.Time, err error) {
+	file, ei, err := kbfsOps.Lookup(ctx, dir, name)
+	if err != nil {
+		return nil, leaseLockInfo{}, time.Time{}, err
+	}
+	mtime = time.Unix(0, ei.Mtime)
+
+	buf := make([]byte, ei.Size)
+	n, err := kbfsOps.Read(ctx, file, buf, 0)
+	if err != nil {
+		return nil, leaseLockInfo{}, time.Time{}, err
+	}
+	// A lock file whose holder crashed before filling it in will
+	// fail to decode; it's treated as held by nobody until its
+	// mtime plus the lease duration.
+	_ = json.Unmarshal(buf[:n], &info)
+	return file, info, mtime, nil
+}
+
+func writeLeaseLockInfo(ctx context.Context, kbfsOps KBFSOps, file Node,
+	info leaseLockInfo) error {
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	err = kbfsOps.Truncate(ctx, file, 0)
+	if err != nil {
+		return err
+	}
+	err = kbfsOps.Write(ctx, file, buf, 0)
+	if err != nil {
+		return err
+	}
+	return kbfsOps.Sync(ctx, file)
+}
+
+// TryAcquireLeaseLock tries once to acquire the lock with the given
+// name in the given directory on behalf of the given holder, with a
+// lease that lasts for the given duration before it has to be
+// renewed.  If someone else holds an unexpired lease on the lock, it
+// returns a LeaseLockHeldError.  If the TLF journal is enabled for
+// the folder, it returns a LeaseLockJournaledError.
+func TryAcquireLeaseLock(ctx context.Context, config Config, dir Node,
+	name, holder string, ttl time.Duration) (*LeaseLock, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("Invalid lease duration %s", ttl)
+	}
+	if TLFJournalEnabled(config, dir.GetFolderBranch().Tlf) {
+		return nil, LeaseLockJournaledError{name}
+	}
+
+	kbfsOps := config.KBFSOps()
+	log := config.MakeLogger("")
+	file, _, err := kbfsOps.CreateFile(ctx, dir, name, false, WithExcl)
+	switch err.(type) {
+	case nil:
+	case NameExistsError:
+		var info leaseLockInfo
+		var mtime time.Time
+		file, info, mtime, err = readLeaseLockInfo(
+			ctx, kbfsOps, dir, name)
+		if err != nil {
+			return nil, err
+		}
+		if info.Expires.IsZero() {
+			info.Expires = mtime.Add(ttl)
+		}
+
+		if info.Holder != holder {
+			if config.Clock().Now().Before(info.Expires) {
+				return nil, LeaseLockHeldError{
+					name, info.Holder, info.Expires}
+			}
+
+			// Steal the expired lock by re-creating the
+			// file, so that if several devices try at
+			// once, only one of them wins.  Only remove
+			// the file that was found expired, in case
+			// someone else stole it first.
+			log.CDebugf(ctx, "Stealing lock %s from %s, which "+
+				"expired at %s", name, info.Holder, info.Expires)
+			err = kbfsOps.RemoveEntryIfUnchanged(ctx, dir, name, file)
+			switch err.(type) {
+			case nil, NoSuchNameError:
+			case EntryReplacedError:
+				return nil, LeaseLockHeldError{Name: name}
+			default:
+				return nil, err
+			}
+			file, _, err = kbfsOps.CreateFile(
+				ctx, dir, name, false, WithExcl)
+			if _, ok := err.(NameExistsError); ok {
+				return nil, LeaseLockHeldError{Name: name}
+			} else if err != nil {
+				return nil, err
+			}
+		} else {
+			log.CDebugf(ctx, "Resuming lease on lock %s for %s",
+				name, holder)
+		}
+	default:
+		return nil, err
+	}
+
+	l := &LeaseLock{
+		config:     config,
+		log:        log,
+		dir:        dir,
+		name:       name,
+		holder:     holder,
+		ttl:        ttl,
+		file:       file,
+		lostCh:     make(chan struct{}),
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+	err = l.renew(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	go l.renewLoop()
+	return l, nil
+}
+
+// AcquireLeaseLock is like TryAcquireLeaseLock, except that it keeps
+// retrying until it gets the lock, or until the given context is
+// canceled.
+func AcquireLeaseLock(ctx context.Context, config Config, dir Node,
+	name, holder string, ttl time.Duration) (*LeaseLock, error) {
+	for {
+		l, err := TryAcquireLeaseLock(ctx, config, dir, name, holder, ttl)
+		switch e := err.(type) {
+		case nil:
+			return l, nil
+		case LeaseLockHeldError:
+			wait := leaseLockMinRetryInterval
+			if d := e.Expires.Sub(config.Clock().Now()); d > wait {
+				wait = d
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		case ExclOnUnmergedError:
+			// We were out of date, but have caught up now,
+			// so just retry.
+		default:
+			return nil, err
+		}
+	}
+}
+
+// renew extends the lease on the lock, unless it has been stolen.
+func (l *LeaseLock) renew(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.released {
+		return nil
+	}
+
+	kbfsOps := l.config.KBFSOps()
+	file, info, _, err := readLeaseLockInfo(ctx, kbfsOps, l.dir, l.name)
+	if _, ok := err.(NoSuchNameError); ok {
+		return LeaseLockLostError{Name: l.name}
+	} else if err != nil {
+		return err
+	}
+	if file.GetID() != l.file.GetID() ||
+		(info.Holder != "" && info.Holder != l.holder) {
+		return LeaseLockLostError{l.name, info.Holder}
+	}
+
+	return writeLeaseLockInfo(ctx, kbfsOps, l.file, leaseLockInfo{
+		Holder:  l.holder,
+		Expires: l.config.Clock().Now().Add(l.ttl),
+	})
+}
+
+func (l *LeaseLock) renewLoop() {
+	defer close(l.doneCh)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(
+				context.Background(), l.ttl/3)
+			err := l.renew(ctx)
+			cancel()
+			if _, ok := err.(LeaseLockLostError); ok {
+				l.log.CWarningf(ctx, "Lost lock %s: %v", l.name, err)
+				close(l.lostCh)
+				return
+			} else if err != nil {
+				// Keep trying; the lease is still good
+				// until it expires.
+				l.log.CDebugf(ctx, "Couldn't renew lock %s: %v",
+					l.name, err)
+			}
+		case <-l.shutdownCh:
+			return
+		}
+	}
+}
+
+// Lost returns a channel that's closed if the lease is found to have
+// been taken over by someone else while the lock is held.
+func (l *LeaseLock) Lost() <-chan struct{} {
+	return l.lostCh
+}
+
+// Release stops renewing the lease and removes the lock file, so
+// others can acquire the lock right away.  If the lock was lost in
+// the meantime, it returns a LeaseLockLostError, and leaves the new
+// holder's lock file alone.
+func (l *LeaseLock) Release(ctx context.Context) error {
+	l.lock.Lock()
+	if l.released {
+		l.lock.Unlock()
+		return nil
+	}
+	l.released = true
+	l.lock.Unlock()
+
+	close(l.shutdownCh)
+	<-l.doneCh
+
+	kbfsOps := l.config.KBFSOps()
+	file, info, _, err := readLeaseLockInfo(ctx, kbfsOps, l.dir, l.name)
+	if _, ok := err.(NoSuchNameError); ok {
+		return LeaseLockLostError{Name: l.name}
+	} else if err != nil {
+		return err
+	}
+	if file.GetID() != l.file.GetID() || info.Holder != l.holder {
+		return LeaseLockLostError{l.name, info.Holder}
+	}
+	err = kbfsOps.RemoveEntryIfUnchanged(ctx, l.dir, l.name, l.file)
+	switch err.(type) {
+	case NoSuchNameError, EntryReplacedError:
+		return LeaseLockLostError{Name: l.name}
+	default:
+		return err
+	}
+}
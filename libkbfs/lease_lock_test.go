@@ -0,0 +1,106 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaseLockAcquireAndRelease(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	ttl := time.Hour
+
+	l, err := TryAcquireLeaseLock(ctx, config, rootNode, "lock", "a", ttl)
+	require.NoError(t, err)
+
+	_, err = TryAcquireLeaseLock(ctx, config, rootNode, "lock", "b", ttl)
+	require.IsType(t, LeaseLockHeldError{}, err)
+	require.Equal(t, "a", err.(LeaseLockHeldError).Holder)
+
+	err = l.Release(ctx)
+	require.NoError(t, err)
+	// Releasing twice is a no-op.
+	err = l.Release(ctx)
+	require.NoError(t, err)
+
+	l, err = TryAcquireLeaseLock(ctx, config, rootNode, "lock", "b", ttl)
+	require.NoError(t, err)
+	err = l.Release(ctx)
+	require.NoError(t, err)
+}
+
+func TestLeaseLockResumeAndSteal(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	ttl := time.Hour
+
+	l1, err := TryAcquireLeaseLock(ctx, config, rootNode, "lock", "a", ttl)
+	require.NoError(t, err)
+
+	// The same holder can resume its own lease right away.
+	l2, err := TryAcquireLeaseLock(ctx, config, rootNode, "lock", "a", ttl)
+	require.NoError(t, err)
+	err = l2.Release(ctx)
+	require.NoError(t, err)
+
+	// Once released, the stale handle has lost the lock.
+	err = l1.Release(ctx)
+	require.IsType(t, LeaseLockLostError{}, err)
+
+	l1, err = TryAcquireLeaseLock(ctx, config, rootNode, "lock", "a", ttl)
+	require.NoError(t, err)
+
+	// After the lease expires, someone else can steal it.
+	clock.Add(2 * ttl)
+	l3, err := AcquireLeaseLock(ctx, config, rootNode, "lock", "b", ttl)
+	require.NoError(t, err)
+
+	err = l1.Release(ctx)
+	require.Equal(t, LeaseLockLostError{"lock", "b"}, err)
+
+	err = l3.Release(ctx)
+	require.NoError(t, err)
+}
+
+func TestLeaseLockJournaled(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "lease_lock")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	config.EnableJournaling(tempdir, TLFJournalBackgroundWorkEnabled)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	err = jServer.Enable(ctx, rootNode.GetFolderBranch().Tlf,
+		TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+
+	// Otherwise two holders could both get the lock, since the
+	// journal turns the exclusive create into a regular one.
+	_, err = TryAcquireLeaseLock(ctx, config, rootNode, "lock", "a", time.Hour)
+	require.Equal(t, LeaseLockJournaledError{"lock"}, err)
+	_, _, err = config.KBFSOps().Lookup(ctx, rootNode, "lock")
+	require.IsType(t, NoSuchNameError{}, err)
+}
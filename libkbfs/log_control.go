@@ -0,0 +1,186 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	logging "github.com/keybase/go-logging"
+)
+
+// logDebugTags maps each tag that debug logging can be turned on
+// for separately, vlog-style, to the prefixes of the logger modules
+// it covers.
+var logDebugTags = map[string][]string{
+	"mdserver": {"MDSR", "MDSD", "MDSM"},
+	"bserver":  {"BSR", "BSD", "BSM"},
+	"cr":       {"CR "},
+	"journal":  {"JS", "TLFJ"},
+}
+
+// LogSettings says how verbosely KBFS logs.  It is suitable for
+// encoding directly as JSON.
+type LogSettings struct {
+	// Debug turns on debug logging for all modules.
+	Debug bool
+	// DebugTags turns on debug logging just for the modules
+	// covered by the given tags: "mdserver", "bserver", "cr" and
+	// "journal".
+	DebugTags []string
+}
+
+// LogStatus describes the current logging configuration.
+type LogStatus struct {
+	LogSettings
+	// LogFile is the path of the current log file, if logging to
+	// a file.
+	LogFile string `json:",omitempty"`
+}
+
+// LogControl makes loggers whose verbosity can be changed at
+// runtime, and rotates the log file on demand.
+type LogControl struct {
+	lock       sync.Mutex
+	settings   LogSettings
+	modules    map[string]string // logging module -> KBFS module
+	fileConfig logger.LogFileConfig
+	fileStart  time.Time
+}
+
+// NewLogControl returns a LogControl with the given initial
+// settings.  fileConfig is the configuration of the log file
+// already set up by InitLog; its Path is empty if KBFS isn't
+// logging to a file.
+func NewLogControl(settings LogSettings,
+	fileConfig logger.LogFileConfig) (*LogControl, error) {
+	if err := checkLogDebugTags(settings.DebugTags); err != nil {
+		return nil, err
+	}
+	return &LogControl{
+		settings:   settings,
+		modules:    make(map[string]string),
+		fileConfig: fileConfig,
+		fileStart:  time.Now(),
+	}, nil
+}
+
+func checkLogDebugTags(tags []string) error {
+	for _, tag := range tags {
+		if _, ok := logDebugTags[tag]; !ok {
+			return fmt.Errorf("Unknown log debug tag %q", tag)
+		}
+	}
+	return nil
+}
+
+// isDebugLocked returns whether debug logging is on for the given
+// KBFS module.
+func (lc *LogControl) isDebugLocked(module string) bool {
+	if lc.settings.Debug {
+		return true
+	}
+	for _, tag := range lc.settings.DebugTags {
+		for _, prefix := range logDebugTags[tag] {
+			if strings.HasPrefix(module, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MakeLogger makes a logger for the given KBFS module, with debug
+// logging on or off as the current settings say.  It can be passed
+// to Config.SetLoggerMaker.
+func (lc *LogControl) MakeLogger(module string) logger.Logger {
+	mname := "kbfs"
+	if module != "" {
+		mname += fmt.Sprintf("(%s)", module)
+	}
+	// Add log depth so that context-based messages get the right
+	// file printed out.
+	lg := logger.NewWithCallDepth(mname, 1)
+
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	lc.modules[mname] = module
+	if lc.isDebugLocked(module) {
+		// Turn on debugging.  TODO: allow a proper log file and
+		// style to be specified.
+		lg.Configure("", true, "")
+	}
+	return lg
+}
+
+// Settings returns the current log settings.
+func (lc *LogControl) Settings() LogSettings {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	settings := lc.settings
+	settings.DebugTags = append([]string(nil), settings.DebugTags...)
+	return settings
+}
+
+// Status returns the current logging configuration.
+func (lc *LogControl) Status() LogStatus {
+	// fileConfig never changes, so it doesn't need the lock.
+	return LogStatus{
+		LogSettings: lc.Settings(),
+		LogFile:     lc.fileConfig.Path,
+	}
+}
+
+// SetSettings changes the log settings, which take effect
+// immediately for all loggers made so far.
+func (lc *LogControl) SetSettings(settings LogSettings) error {
+	if err := checkLogDebugTags(settings.DebugTags); err != nil {
+		return err
+	}
+	tags := append([]string(nil), settings.DebugTags...)
+	sort.Strings(tags)
+	settings.DebugTags = tags
+
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	lc.settings = settings
+	for mname, module := range lc.modules {
+		level := logging.INFO
+		if lc.isDebugLocked(module) {
+			level = logging.DEBUG
+		}
+		logging.SetLevel(level, mname)
+	}
+	return nil
+}
+
+// RotateLogFile moves the current log file aside, with the same
+// naming scheme as automatic rotations, and starts a new one.
+func (lc *LogControl) RotateLogFile() error {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	if lc.fileConfig.Path == "" {
+		return fmt.Errorf("KBFS is not logging to a file")
+	}
+	now := time.Now()
+	rotated := fmt.Sprintf("%s-%s-%s", lc.fileConfig.Path,
+		lc.fileStart.Format("20060102T150405"),
+		now.Format("20060102T150405"))
+	if err := os.Rename(lc.fileConfig.Path, rotated); err != nil {
+		return err
+	}
+	// Setting the same config again reopens the log file at its
+	// path, which creates a new one.
+	if err := logger.SetLogFileConfig(&lc.fileConfig); err != nil {
+		return err
+	}
+	lc.fileStart = now
+	return nil
+}
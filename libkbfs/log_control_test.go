@@ -0,0 +1,57 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	logging "github.com/keybase/go-logging"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogControlSettings(t *testing.T) {
+	_, err := NewLogControl(
+		LogSettings{DebugTags: []string{"bogus"}}, logger.LogFileConfig{})
+	require.Error(t, err)
+
+	lc, err := NewLogControl(LogSettings{}, logger.LogFileConfig{})
+	require.NoError(t, err)
+	lc.MakeLogger("MDSR")
+	lc.MakeLogger("CR 1234")
+	lc.MakeLogger("BSR")
+	require.False(t, logging.GetLevel("kbfs(MDSR)") == logging.DEBUG)
+
+	err = lc.SetSettings(LogSettings{DebugTags: []string{"cr", "mdserver"}})
+	require.NoError(t, err)
+	require.Equal(t, LogSettings{DebugTags: []string{"cr", "mdserver"}},
+		lc.Settings())
+	require.Equal(t, logging.DEBUG, logging.GetLevel("kbfs(MDSR)"))
+	require.Equal(t, logging.DEBUG, logging.GetLevel("kbfs(CR 1234)"))
+	require.Equal(t, logging.INFO, logging.GetLevel("kbfs(BSR)"))
+
+	// Bad tags leave the settings alone.
+	err = lc.SetSettings(LogSettings{DebugTags: []string{"bogus"}})
+	require.Error(t, err)
+	require.Equal(t, LogSettings{DebugTags: []string{"cr", "mdserver"}},
+		lc.Settings())
+
+	err = lc.SetSettings(LogSettings{})
+	require.NoError(t, err)
+	require.Equal(t, logging.INFO, logging.GetLevel("kbfs(MDSR)"))
+
+	// Loggers made after a change get the new settings.
+	err = lc.SetSettings(LogSettings{Debug: true})
+	require.NoError(t, err)
+	lc.MakeLogger("JS")
+	require.Equal(t, logging.DEBUG, logging.GetLevel("kbfs(JS)"))
+	require.Equal(t, logging.DEBUG, logging.GetLevel("kbfs(BSR)"))
+	err = lc.SetSettings(LogSettings{})
+	require.NoError(t, err)
+
+	// Not logging to a file, so there's nothing to rotate.
+	err = lc.RotateLogFile()
+	require.Error(t, err)
+}
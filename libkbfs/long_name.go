@@ -0,0 +1,64 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"unicode/utf8"
+)
+
+const (
+	// longNameHashLen is the number of hex digits of the hash of a
+	// long name that are kept in its short form.
+	longNameHashLen = 32
+	// longNameSeparator separates the start of a long name from
+	// its hash in its short form.
+	longNameSeparator = "~"
+)
+
+// shortNameForLongName returns the name under which an entry with the
+// given long name is stored: as much of the start of the name as
+// fits in maxBytes, followed by a hash of the whole name.  It returns
+// false if maxBytes is too small to hold the hash.
+func shortNameForLongName(name string, maxBytes uint32) (string, bool) {
+	hash := sha256.Sum256([]byte(name))
+	suffix := longNameSeparator +
+		hex.EncodeToString(hash[:])[:longNameHashLen]
+	if uint32(len(suffix)) >= maxBytes {
+		return "", false
+	}
+	prefixLen := int(maxBytes) - len(suffix)
+	// Don't split a multi-byte character.
+	for prefixLen > 0 && !utf8.RuneStart(name[prefixLen]) {
+		prefixLen--
+	}
+	return name[:prefixLen] + suffix, true
+}
+
+// longNameFor returns the value of EntryInfo.LongName for an entry
+// with the given name, which is stored under storedName.
+func longNameFor(name, storedName string) string {
+	if name == storedName {
+		return ""
+	}
+	return name
+}
+
+// storedName returns the name under which the entry with the given
+// name is stored in its parent directory, or a NameTooLongError if
+// the name is too long and long names aren't supported.
+func (fbo *folderBranchOps) storedName(name string) (string, error) {
+	maxBytes := fbo.config.MaxNameBytes()
+	if uint32(len(name)) <= maxBytes {
+		return name, nil
+	}
+	if fbo.config.LongNameSupport() {
+		if short, ok := shortNameForLongName(name, maxBytes); ok {
+			return short, nil
+		}
+	}
+	return "", NameTooLongError{name, maxBytes}
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShortNameForLongName(t *testing.T) {
+	name := strings.Repeat("a", 300)
+	short, ok := shortNameForLongName(name, 255)
+	require.True(t, ok)
+	require.Len(t, short, 255)
+	require.True(t, strings.HasPrefix(short, name[:200]))
+
+	// The short form is stable, and differs for different names.
+	short2, ok := shortNameForLongName(name, 255)
+	require.True(t, ok)
+	require.Equal(t, short, short2)
+	short2, ok = shortNameForLongName(name+"b", 255)
+	require.True(t, ok)
+	require.NotEqual(t, short, short2)
+
+	// Multi-byte characters aren't split.
+	short, ok = shortNameForLongName(strings.Repeat("é", 200), 255)
+	require.True(t, ok)
+	require.True(t, utf8.ValidString(short))
+	require.True(t, len(short) <= 255)
+
+	_, ok = shortNameForLongName(name, longNameHashLen)
+	require.False(t, ok)
+}
+
+func TestLongNames(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	kbfsOps := config.KBFSOps()
+
+	long1 := strings.Repeat("x", 300)
+	long2 := strings.Repeat("y", 300)
+
+	// Without long name support, long names are rejected.
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, long1, false, NoExcl)
+	require.IsType(t, NameTooLongError{}, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, long1)
+	require.IsType(t, NameTooLongError{}, err)
+
+	config.SetLongNameSupport(true)
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, long1)
+	require.NoError(t, err)
+	_, ei, err := kbfsOps.Lookup(ctx, rootNode, long1)
+	require.NoError(t, err)
+	require.Equal(t, long1, ei.LongName)
+
+	// The directory lists the short form, with the full name.
+	short1, ok := shortNameForLongName(long1, config.MaxNameBytes())
+	require.True(t, ok)
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	require.Equal(t, long1, children[short1].LongName)
+
+	// The short form can be looked up directly too.
+	_, ei, err = kbfsOps.Lookup(ctx, rootNode, short1)
+	require.NoError(t, err)
+	require.Equal(t, long1, ei.LongName)
+
+	// Renaming to a short name drops the full name.
+	err = kbfsOps.Rename(ctx, rootNode, long1, rootNode, "b")
+	require.NoError(t, err)
+	_, ei, err = kbfsOps.Lookup(ctx, rootNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, "", ei.LongName)
+
+	dir, _, err := kbfsOps.CreateDir(ctx, rootNode, long2)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, dir, long1, false, NoExcl)
+	require.NoError(t, err)
+	_, ei, err = kbfsOps.Lookup(ctx, dir, long1)
+	require.NoError(t, err)
+	require.Equal(t, long1, ei.LongName)
+	_, _, err = kbfsOps.CreateFile(ctx, dir, long1, false, WithExcl)
+	require.IsType(t, NameExistsError{}, err)
+
+	err = kbfsOps.RemoveEntry(ctx, dir, long1)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveDir(ctx, rootNode, long2)
+	require.NoError(t, err)
+	children, err = kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+}
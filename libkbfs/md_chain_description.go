@@ -0,0 +1,153 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// OpDescription describes a single op in an MD revision.
+type OpDescription struct {
+	// Op is the human-readable form of the op, as returned by
+	// its String method.
+	Op string
+
+	Refs    []string `json:",omitempty"`
+	Unrefs  []string `json:",omitempty"`
+	Updates []string `json:",omitempty"`
+}
+
+// MDDescription describes a single MD revision.
+type MDDescription struct {
+	Revision MetadataRevision
+	MdID     string
+	PrevRoot string
+	Merged   bool
+	BranchID string `json:",omitempty"`
+
+	// LastModifyingWriter is the writer that last changed the
+	// writer metadata, and LastModifyingUser the user (maybe a
+	// reader, rekeying) that made this revision.
+	LastModifyingWriter keybase1.UID
+	LastModifyingUser   keybase1.UID
+	// VerifyingKey is the KID of the device key that signed
+	// this revision.
+	VerifyingKey  keybase1.KID
+	KeyGeneration KeyGen
+	LocalTime     time.Time
+
+	Rekey                bool `json:",omitempty"`
+	WriterMetadataCopied bool `json:",omitempty"`
+	Final                bool `json:",omitempty"`
+
+	DiskUsage  uint64
+	RefBytes   uint64
+	UnrefBytes uint64
+
+	// Readable is false if this device can't decrypt the
+	// private metadata, in which case Ops is empty.
+	Readable bool
+	Ops      []OpDescription `json:",omitempty"`
+}
+
+// MDChainDescription describes a range of the MD chain of a TLF, on
+// either the merged branch or an unmerged one.  It is suitable for
+// encoding directly as JSON.
+type MDChainDescription struct {
+	TlfID    string
+	BranchID string `json:",omitempty"`
+	// BranchPoint is the merged revision an unmerged branch
+	// forked from.  It's only set for unmerged branches.
+	BranchPoint MetadataRevision `json:",omitempty"`
+
+	Revisions []MDDescription
+}
+
+func describeOp(op op) OpDescription {
+	desc := OpDescription{Op: op.String()}
+	for _, ptr := range op.Refs() {
+		desc.Refs = append(desc.Refs, ptr.String())
+	}
+	for _, ptr := range op.Unrefs() {
+		desc.Unrefs = append(desc.Unrefs, ptr.String())
+	}
+	for _, update := range op.allUpdates() {
+		desc.Updates = append(desc.Updates,
+			update.Unref.String()+" -> "+update.Ref.String())
+	}
+	return desc
+}
+
+func describeMD(rmd ImmutableRootMetadata) MDDescription {
+	desc := MDDescription{
+		Revision:             rmd.Revision(),
+		MdID:                 rmd.MdID().String(),
+		PrevRoot:             rmd.PrevRoot().String(),
+		Merged:               rmd.MergedStatus() == Merged,
+		LastModifyingWriter:  rmd.LastModifyingWriter(),
+		LastModifyingUser:    rmd.LastModifyingUser(),
+		VerifyingKey:         rmd.LastModifyingWriterVerifyingKey().KID(),
+		KeyGeneration:        rmd.LatestKeyGeneration(),
+		LocalTime:            rmd.LocalTimestamp(),
+		Rekey:                rmd.IsRekeySet(),
+		WriterMetadataCopied: rmd.IsWriterMetadataCopiedSet(),
+		Final:                rmd.IsFinal(),
+		DiskUsage:            rmd.DiskUsage(),
+		RefBytes:             rmd.RefBytes(),
+		UnrefBytes:           rmd.UnrefBytes(),
+		Readable:             rmd.IsReadable(),
+	}
+	if rmd.BID() != NullBranchID {
+		desc.BranchID = rmd.BID().String()
+	}
+	if desc.Readable {
+		for _, op := range rmd.data.Changes.Ops {
+			desc.Ops = append(desc.Ops, describeOp(op))
+		}
+	}
+	return desc
+}
+
+// DescribeMDChain fetches the MD revisions of the given TLF between
+// start and end (inclusive) on the given branch, and describes them
+// for debugging.  For an unmerged branch, the whole branch up to end
+// is fetched to find its branch point, and revisions before start
+// are then left out.  Revisions that this device can't decrypt are
+// still described, without their ops.
+func DescribeMDChain(ctx context.Context, config Config, tlfID tlf.ID,
+	bid BranchID, start, end MetadataRevision) (MDChainDescription, error) {
+	desc := MDChainDescription{TlfID: tlfID.String()}
+	var rmds []ImmutableRootMetadata
+	if bid == NullBranchID {
+		var err error
+		rmds, err = getMDRange(ctx, config, tlfID, bid, start, end, Merged)
+		if err != nil {
+			return MDChainDescription{}, err
+		}
+	} else {
+		desc.BranchID = bid.String()
+		branchPoint, unmergedRmds, err := getUnmergedMDUpdates(
+			ctx, config, tlfID, bid, end)
+		if err != nil {
+			return MDChainDescription{}, err
+		}
+		desc.BranchPoint = branchPoint
+		for _, rmd := range unmergedRmds {
+			if rmd.Revision() >= start {
+				rmds = append(rmds, rmd)
+			}
+		}
+	}
+
+	desc.Revisions = make([]MDDescription, 0, len(rmds))
+	for _, rmd := range rmds {
+		desc.Revisions = append(desc.Revisions, describeMD(rmd))
+	}
+	return desc, nil
+}
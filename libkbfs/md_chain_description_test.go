@@ -0,0 +1,53 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribeMDChain(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, uid, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+
+	tlfID := rootNode.GetFolderBranch().Tlf
+	desc, err := DescribeMDChain(ctx, config, tlfID, NullBranchID,
+		MetadataRevisionInitial, MetadataRevisionInitial+2)
+	require.NoError(t, err)
+	require.Equal(t, tlfID.String(), desc.TlfID)
+	require.Equal(t, "", desc.BranchID)
+	require.Len(t, desc.Revisions, 3)
+
+	for i, rev := range desc.Revisions {
+		require.Equal(t, MetadataRevisionInitial+MetadataRevision(i),
+			rev.Revision)
+		require.True(t, rev.Merged)
+		require.True(t, rev.Readable)
+		require.Equal(t, uid, rev.LastModifyingWriter)
+		require.False(t, rev.VerifyingKey.IsNil())
+		if i > 0 {
+			require.Equal(t, desc.Revisions[i-1].MdID, rev.PrevRoot)
+		}
+	}
+	require.Equal(t, "create a (DIR)", desc.Revisions[1].Ops[0].Op)
+	require.NotEmpty(t, desc.Revisions[1].Ops[0].Updates)
+	require.Equal(t, "rm a", desc.Revisions[2].Ops[0].Op)
+	require.NotEmpty(t, desc.Revisions[2].Ops[0].Unrefs)
+
+	_, err = json.Marshal(desc)
+	require.NoError(t, err)
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keybase/kbfs/tlf"
+)
+
+// ChangeFlags is a bitmap summarizing the kinds of changes made to a
+// TLF since some revision.
+type ChangeFlags int
+
+const (
+	// ChangeFlagChanged is set if the TLF has any revisions since
+	// the given one.
+	ChangeFlagChanged ChangeFlags = 1 << iota
+	// ChangeFlagEntriesAdded is set if any entries were created.
+	ChangeFlagEntriesAdded
+	// ChangeFlagEntriesRemoved is set if any entries were removed.
+	ChangeFlagEntriesRemoved
+	// ChangeFlagEntriesModified is set if any entries were written
+	// to, renamed, or had their attributes changed.
+	ChangeFlagEntriesModified
+	// ChangeFlagIncomplete is set if some of the new revisions
+	// weren't available locally, so the counts (and the other
+	// flags) only cover the ones that were.
+	ChangeFlagIncomplete
+)
+
+func (f ChangeFlags) String() string {
+	var names []string
+	for _, flag := range []struct {
+		flag ChangeFlags
+		name string
+	}{
+		{ChangeFlagChanged, "changed"},
+		{ChangeFlagEntriesAdded, "added"},
+		{ChangeFlagEntriesRemoved, "removed"},
+		{ChangeFlagEntriesModified, "modified"},
+		{ChangeFlagIncomplete, "incomplete"},
+	} {
+		if f&flag.flag != 0 {
+			names = append(names, flag.name)
+			f &^= flag.flag
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("0x%x", int(f)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// ChangeSummary summarizes the changes made to a TLF's merged branch
+// since some revision.  See MDOps.GetChangeSummary.
+type ChangeSummary struct {
+	// Head is the server's current merged revision of the TLF, or
+	// MetadataRevisionUninitialized if it has none yet.
+	Head     MetadataRevision
+	Flags    ChangeFlags
+	Added    int
+	Removed  int
+	Modified int
+}
+
+// summarizeCachedChanges fills in the counts and flags of summary
+// for the revisions after since, up to summary.Head, using only the
+// revisions that are already in the MD cache.
+func summarizeCachedChanges(mdcache MDCache, id tlf.ID,
+	since MetadataRevision, summary *ChangeSummary) {
+	if summary.Head <= since {
+		return
+	}
+	summary.Flags |= ChangeFlagChanged
+	for rev := since + 1; rev <= summary.Head; rev++ {
+		rmd, err := mdcache.Get(id, rev, NullBranchID)
+		if err != nil {
+			summary.Flags |= ChangeFlagIncomplete
+			continue
+		}
+		for _, op := range rmd.data.Changes.Ops {
+			switch op := op.(type) {
+			case *createOp:
+				// The initial revision creates the root
+				// directory, which isn't an entry.
+				if op.NewName != "" {
+					summary.Added++
+				}
+			case *rmOp:
+				summary.Removed++
+			case *renameOp, *syncOp, *setAttrOp:
+				summary.Modified++
+			}
+		}
+	}
+	if summary.Added > 0 {
+		summary.Flags |= ChangeFlagEntriesAdded
+	}
+	if summary.Removed > 0 {
+		summary.Flags |= ChangeFlagEntriesRemoved
+	}
+	if summary.Modified > 0 {
+		summary.Flags |= ChangeFlagEntriesModified
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+)
+
+// mdDiskCacheEntry is what's stored in the MD disk cache for one
+// revision of a TLF: a merged head exactly as the MD server sent it,
+// along with the key bundles it refers to, if any.
+type mdDiskCacheEntry struct {
+	// Path is the canonical path of the TLF's handle when the
+	// head was fetched, which is what heads are looked up by.
+	Path    string
+	Version MetadataVer
+	Block   []byte
+	// Timestamp is the server's (untrusted) timestamp for Block.
+	Timestamp       keybase1.Time
+	WriterKeyBundle *TLFWriterKeyBundleV3 `codec:",omitempty"`
+	ReaderKeyBundle *TLFReaderKeyBundleV3 `codec:",omitempty"`
+
+	codec.UnknownFieldSetHandler
+}
+
+// mdDiskCache keeps the latest merged head of each TLF fetched by
+// the logged-in user, and its key bundles, in a directory per user
+// and TLF, named by revision.  This way, after a restart, the heads
+// of favorite folders don't all have to be fetched again before
+// they can be shown.
+//
+// Each cached head is served at most once per run, for the first
+// lookup of its TLF; the folder then registers for updates from that
+// revision, and so catches up with anything newer on the server.
+// After that, heads always come from the server.  Since entries are
+// stored as the server signed them, they go through the same checks
+// as replies from the server when they're loaded.
+type mdDiskCache struct {
+	codec kbfscodec.Codec
+	dir   string
+
+	lock sync.Mutex
+	// uid is the user whose entries are indexed in paths.
+	uid   keybase1.UID
+	paths map[string]tlf.ID
+	// served holds the TLFs whose heads have come from the cache
+	// or the server since startup.
+	served map[tlf.ID]bool
+}
+
+func newMDDiskCache(codec kbfscodec.Codec, dir string) *mdDiskCache {
+	return &mdDiskCache{
+		codec: codec,
+		dir:   dir,
+	}
+}
+
+func (c *mdDiskCache) tlfDir(uid keybase1.UID, id tlf.ID) string {
+	return filepath.Join(c.dir, uid.String(), id.String())
+}
+
+// latestRevisionFile returns the name of the newest revision file in
+// the given TLF directory, or "" if there is none.
+func latestRevisionFile(dir string) (string, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	var latest string
+	latestRev := MetadataRevisionUninitialized
+	for _, fi := range fileInfos {
+		rev, err := strconv.ParseInt(fi.Name(), 10, 64)
+		if err != nil {
+			// Probably a leftover temporary file.
+			continue
+		}
+		if MetadataRevision(rev) > latestRev {
+			latest = fi.Name()
+			latestRev = MetadataRevision(rev)
+		}
+	}
+	return latest, nil
+}
+
+func (c *mdDiskCache) readEntry(dir string) (
+	entry mdDiskCacheEntry, ok bool, err error) {
+	name, err := latestRevisionFile(dir)
+	if err != nil || name == "" {
+		return mdDiskCacheEntry{}, false, err
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return mdDiskCacheEntry{}, false, err
+	}
+	err = c.codec.Decode(buf, &entry)
+	if err != nil {
+		return mdDiskCacheEntry{}, false, err
+	}
+	return entry, true, nil
+}
+
+// loadLocked indexes the entries of the given user by path, unless
+// they're already indexed.  If a different user's entries were
+// indexed before, they're forgotten first.
+func (c *mdDiskCache) loadLocked(uid keybase1.UID) error {
+	if uid == c.uid && c.paths != nil {
+		return nil
+	}
+	c.uid = uid
+	c.paths = make(map[string]tlf.ID)
+	c.served = make(map[tlf.ID]bool)
+
+	fileInfos, err := ioutil.ReadDir(filepath.Join(c.dir, uid.String()))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range fileInfos {
+		id, err := tlf.ParseID(fi.Name())
+		if err != nil {
+			continue
+		}
+		entry, ok, err := c.readEntry(c.tlfDir(uid, id))
+		if err != nil || !ok {
+			// Skip unreadable entries; they'll be replaced
+			// with the next fetch from the server.
+			continue
+		}
+		c.paths[entry.Path] = id
+	}
+	return nil
+}
+
+// getForPath returns the cached head of the TLF with the given
+// canonical path, and its extra metadata, unless there isn't one, or
+// a head for that TLF has already been served.  max is the newest
+// metadata version that may be decoded.
+func (c *mdDiskCache) getForPath(
+	uid keybase1.UID, path string, max MetadataVer) (
+	tlf.ID, *RootMetadataSigned, ExtraMetadata, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.loadLocked(uid)
+	if err != nil {
+		return tlf.NullID, nil, nil, err
+	}
+	id, ok := c.paths[path]
+	if !ok || c.served[id] {
+		return tlf.NullID, nil, nil, nil
+	}
+	c.served[id] = true
+
+	entry, ok, err := c.readEntry(c.tlfDir(uid, id))
+	if err != nil || !ok {
+		return tlf.NullID, nil, nil, err
+	}
+	rmds, err := DecodeRootMetadataSigned(c.codec, id, entry.Version,
+		max, entry.Block, keybase1.FromTime(entry.Timestamp))
+	if err != nil {
+		return tlf.NullID, nil, nil, err
+	}
+	if rmds.MD.TlfID() != id {
+		return tlf.NullID, nil, nil, MDMismatchError{
+			rmds.MD.RevisionNumber(), path, rmds.MD.TlfID(),
+			errors.New("Cached MD is for the wrong folder"),
+		}
+	}
+	var extra ExtraMetadata
+	if entry.WriterKeyBundle != nil && entry.ReaderKeyBundle != nil {
+		extra, err = NewExtraMetadataV3(
+			entry.WriterKeyBundle, entry.ReaderKeyBundle)
+		if err != nil {
+			return tlf.NullID, nil, nil, err
+		}
+	}
+	return id, rmds, extra, nil
+}
+
+// makeEntry encodes the given merged head and its extra metadata for
+// a later call to put.  It must be called before rmds is processed.
+func (c *mdDiskCache) makeEntry(path string, rmds *RootMetadataSigned,
+	extra ExtraMetadata) ([]byte, error) {
+	block, err := EncodeRootMetadataSigned(c.codec, rmds)
+	if err != nil {
+		return nil, err
+	}
+	wkb, rkb := getAnyKeyBundlesV3(extra)
+	return c.codec.Encode(mdDiskCacheEntry{
+		Path:            path,
+		Version:         rmds.Version(),
+		Block:           block,
+		Timestamp:       keybase1.ToTime(rmds.untrustedServerTimestamp),
+		WriterKeyBundle: wkb,
+		ReaderKeyBundle: rkb,
+	})
+}
+
+// put stores an entry made by makeEntry as the cached head of the
+// given TLF, replacing any older one.
+func (c *mdDiskCache) put(uid keybase1.UID, id tlf.ID, path string,
+	rev MetadataRevision, entry []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.loadLocked(uid)
+	if err != nil {
+		return err
+	}
+	// A head fetched from the server is at least as new as
+	// anything in the cache.
+	c.served[id] = true
+
+	dir := c.tlfDir(uid, id)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	name := strconv.FormatInt(int64(rev), 10)
+	filePath := filepath.Join(dir, name)
+	tmpPath := filePath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, entry, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		return err
+	}
+	c.paths[path] = id
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fileInfos {
+		if fi.Name() != name {
+			err := os.Remove(filepath.Join(dir, fi.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMDDiskCacheAcrossRestarts(t *testing.T) {
+	config, uid, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	dir, err := ioutil.TempDir(os.TempDir(), "md_disk_cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	h, err := ParseTlfHandle(
+		ctx, config.KBPKI(), "test_user", false)
+	require.NoError(t, err)
+
+	mdOps := NewMDOpsStandard(config)
+	mdOps.EnableDiskCache(dir)
+	id, rmd, err := mdOps.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+	cachedRev := rmd.Revision()
+
+	// Once a head has been fetched, later lookups go to the
+	// server, even though the head is now cached.
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	_, rmd, err = mdOps.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+	require.Equal(t, cachedRev+1, rmd.Revision())
+	cachedRev = rmd.Revision()
+
+	// After a restart, the first lookup gets the cached head,
+	// and the next ones go to the server again.
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	mdOps = NewMDOpsStandard(config)
+	mdOps.EnableDiskCache(dir)
+	cachedID, rmd, err := mdOps.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+	require.Equal(t, id, cachedID)
+	require.Equal(t, cachedRev, rmd.Revision())
+	_, rmd, err = mdOps.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+	require.Equal(t, cachedRev+1, rmd.Revision())
+	cachedRev = rmd.Revision()
+
+	// Only the latest cached revision is kept.
+	tlfDir := filepath.Join(dir, uid.String(), id.String())
+	fileInfos, err := ioutil.ReadDir(tlfDir)
+	require.NoError(t, err)
+	require.Len(t, fileInfos, 1)
+	require.Equal(t, cachedRev.String(), fileInfos[0].Name())
+
+	// A cached head that doesn't check out is ignored.
+	err = ioutil.WriteFile(
+		filepath.Join(tlfDir, (cachedRev+1).String()), []byte("bad"), 0600)
+	require.NoError(t, err)
+	mdOps = NewMDOpsStandard(config)
+	mdOps.EnableDiskCache(dir)
+	_, rmd, err = mdOps.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+	require.Equal(t, cachedRev, rmd.Revision())
+}
@@ -39,6 +39,14 @@ func makeMdIDJournal(codec kbfscodec.Codec, dir string) mdIDJournal {
 	return mdIDJournal{j}
 }
 
+// makeDurableMdIDJournal is like makeMdIDJournal, except that the
+// returned journal is backed by a durable diskJournal.
+func makeDurableMdIDJournal(codec kbfscodec.Codec, dir string) mdIDJournal {
+	j := makeDurableDiskJournal(
+		codec, dir, reflect.TypeOf(mdIDJournalEntry{}))
+	return mdIDJournal{j}
+}
+
 func ordinalToRevision(o journalOrdinal) (MetadataRevision, error) {
 	r := MetadataRevision(o)
 	if r < MetadataRevisionInitial {
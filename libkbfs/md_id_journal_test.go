@@ -5,10 +5,13 @@
 package libkbfs
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/keybase/go-codec/codec"
 	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/stretchr/testify/require"
 )
 
 type mdIDJournalEntryFuture struct {
@@ -38,3 +41,76 @@ func makeFakeMDIDJournalEntryFuture(t *testing.T) mdIDJournalEntryFuture {
 func TestMDIDJournalEntryUnknownFields(t *testing.T) {
 	testStructUnknownFields(t, makeFakeMDIDJournalEntryFuture(t))
 }
+
+// TestMDIDJournalCrashedFirstAppend simulates a crash in the middle
+// of the first append to a journal, after LATEST has been written but
+// before EARLIEST has, and checks that the journal is still
+// considered empty and can be appended to.
+func TestMDIDJournalCrashedFirstAppend(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "md_id_journal")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	j := makeMdIDJournal(kbfscodec.NewMsgpack(), tempdir)
+	err = j.writeLatestRevision(MetadataRevision(10))
+	require.NoError(t, err)
+
+	length, err := j.length()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), length)
+	rev, err := j.readLatestRevision()
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevisionUninitialized, rev)
+
+	err = j.append(MetadataRevision(5), mdIDJournalEntry{ID: fakeMdID(1)})
+	require.NoError(t, err)
+
+	length, err = j.length()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), length)
+	rev, err = j.readLatestRevision()
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(5), rev)
+	rev, err = j.readEarliestRevision()
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(5), rev)
+}
+
+func benchmarkMDIDJournalAppend(b *testing.B, durable bool) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "md_id_journal")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}()
+
+	codec := kbfscodec.NewMsgpack()
+	j := makeMdIDJournal(codec, tempdir)
+	if durable {
+		j = makeDurableMdIDJournal(codec, tempdir)
+	}
+	entry := mdIDJournalEntry{ID: fakeMdID(1)}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := j.append(MetadataRevisionInitial+MetadataRevision(i), entry)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMDIDJournalAppend(b *testing.B) {
+	benchmarkMDIDJournalAppend(b, false)
+}
+
+func BenchmarkMDIDJournalAppendDurable(b *testing.B) {
+	benchmarkMDIDJournalAppend(b, true)
+}
@@ -23,15 +23,127 @@ import (
 type MDOpsStandard struct {
 	config Config
 	log    logger.Logger
+	// diskCache, if non-nil, persists fetched merged heads across
+	// restarts.
+	diskCache *mdDiskCache
+	merkle    *merkleVerifier
 }
 
 // NewMDOpsStandard returns a new MDOpsStandard
 func NewMDOpsStandard(config Config) *MDOpsStandard {
-	return &MDOpsStandard{config, config.MakeLogger("")}
+	log := config.MakeLogger("")
+	return &MDOpsStandard{
+		config: config,
+		log:    log,
+		merkle: newMerkleVerifier(config, log),
+	}
+}
+
+// EnableDiskCache makes md keep the merged heads it fetches, along
+// with their key bundles, in the given directory, and use them for
+// the first lookup of each folder after a restart.  It must be
+// called before md is used.
+func (md *MDOpsStandard) EnableDiskCache(dir string) {
+	md.diskCache = newMDDiskCache(md.config.Codec(), dir)
+}
+
+// diskCacheUID returns the user whose disk cache should be used, or
+// an empty UID if there's no disk cache or nobody is logged in.
+func (md *MDOpsStandard) diskCacheUID(ctx context.Context) keybase1.UID {
+	if md.diskCache == nil {
+		return keybase1.UID("")
+	}
+	_, uid, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return keybase1.UID("")
+	}
+	return uid
+}
+
+// prepareDiskCachePut returns a function that stores the given
+// merged head in the disk cache under the given path, to be called
+// once the head has been processed successfully, or nil if there's
+// no disk cache.  It must be called before rmds is processed.
+func (md *MDOpsStandard) prepareDiskCachePut(ctx context.Context,
+	path string, rmds *RootMetadataSigned, extra ExtraMetadata) func() {
+	uid := md.diskCacheUID(ctx)
+	if uid == keybase1.UID("") {
+		return nil
+	}
+	id, rev := rmds.MD.TlfID(), rmds.MD.RevisionNumber()
+	entry, err := md.diskCache.makeEntry(path, rmds, extra)
+	if err != nil {
+		md.log.CDebugf(ctx, "Couldn't encode head %d for %s: %v",
+			rev, path, err)
+		return nil
+	}
+	return func() {
+		err := md.diskCache.put(uid, id, path, rev, entry)
+		if err != nil {
+			md.log.CDebugf(ctx, "Couldn't cache head %d for %s: %v",
+				rev, path, err)
+		}
+	}
+}
+
+// getForHandleFromDiskCache returns the cached merged head for the
+// given handle, if there is one that hasn't been served yet, and it
+// passes the same checks as a head from the server.
+func (md *MDOpsStandard) getForHandleFromDiskCache(ctx context.Context,
+	handle *TlfHandle) (tlf.ID, ImmutableRootMetadata, bool) {
+	uid := md.diskCacheUID(ctx)
+	if uid == keybase1.UID("") {
+		return tlf.NullID, ImmutableRootMetadata{}, false
+	}
+	path := handle.GetCanonicalPath()
+	id, rmds, extra, err := md.diskCache.getForPath(
+		uid, path, md.config.MetadataVersion())
+	if err != nil {
+		md.log.CDebugf(ctx, "Couldn't read cached head for %s: %v",
+			path, err)
+		return tlf.NullID, ImmutableRootMetadata{}, false
+	}
+	if rmds == nil {
+		return tlf.NullID, ImmutableRootMetadata{}, false
+	}
+	wkbID := rmds.MD.GetTLFWriterKeyBundleID()
+	rkbID := rmds.MD.GetTLFReaderKeyBundleID()
+	rmd, err := md.processHeadForHandle(ctx, handle, rmds, extra)
+	if err != nil {
+		md.log.CDebugf(ctx, "Ignoring cached head for %s: %v", path, err)
+		return tlf.NullID, ImmutableRootMetadata{}, false
+	}
+	if wkb, rkb, ok := getKeyBundlesV3(extra); ok {
+		kbcache := md.config.KeyBundleCache()
+		kbcache.PutTLFWriterKeyBundle(id, wkbID, wkb)
+		kbcache.PutTLFReaderKeyBundle(id, rkbID, rkb)
+	}
+	md.log.CDebugf(ctx, "Using cached head %d for %s", rmd.Revision(), path)
+	return id, rmd, true
 }
 
 // convertVerifyingKeyError gives a better error when the TLF was
 // signed by a key that is no longer associated with the last writer.
+// prepareMerkleCheck returns a function that checks the given merged
+// head against root once the head has been processed, or nil if root
+// is nil.  root must have been fetched before rmds, and this must be
+// called before rmds is processed.
+func (md *MDOpsStandard) prepareMerkleCheck(root *MerkleRoot,
+	rmds *RootMetadataSigned) (
+	func(context.Context, ImmutableRootMetadata) error, error) {
+	if root == nil {
+		return nil, nil
+	}
+	hash, err := md.config.Crypto().MakeMerkleHash(rmds)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, rmd ImmutableRootMetadata) error {
+		return md.merkle.checkHead(ctx, *root, rmd.TlfID(), rmd.Revision(),
+			hash, rmd.data.TLFPrivateKey)
+	}, nil
+}
+
 func (md *MDOpsStandard) convertVerifyingKeyError(ctx context.Context,
 	rmds *RootMetadataSigned, handle *TlfHandle, err error) error {
 	if _, ok := err.(KeyNotFoundError); !ok {
@@ -170,7 +282,9 @@ func (md *MDOpsStandard) processMetadata(ctx context.Context,
 	handle *TlfHandle, rmds *RootMetadataSigned, extra ExtraMetadata,
 	getRangeLock *sync.Mutex) (ImmutableRootMetadata, error) {
 	// First, verify validity and signatures.
+	finish := md.config.Tracer().StartSpan(ctx, "Crypto.VerifyMD")
 	err := rmds.IsValidAndSigned(md.config.Codec(), md.config.Crypto(), extra)
+	finish(err)
 	if err != nil {
 		return ImmutableRootMetadata{}, MDMismatchError{
 			rmds.MD.RevisionNumber(), handle.GetCanonicalPath(),
@@ -216,11 +330,13 @@ func (md *MDOpsStandard) processMetadata(ctx context.Context,
 	// Try to decrypt using the keys available in this md.  If that
 	// doesn't work, a future MD may contain more keys and will be
 	// tried later.
+	finish = md.config.Tracer().StartSpan(ctx, "Crypto.DecryptMD")
 	pmd, err := decryptMDPrivateData(
 		ctx, md.config.Codec(), md.config.Crypto(),
 		md.config.BlockCache(), md.config.BlockOps(),
 		md.config.KeyManager(), uid, rmd.GetSerializedPrivateMetadata(),
 		rmd, rmd)
+	finish(err)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
 	}
@@ -243,13 +359,34 @@ func (md *MDOpsStandard) processMetadata(ctx context.Context,
 
 // GetForHandle implements the MDOps interface for MDOpsStandard.
 func (md *MDOpsStandard) GetForHandle(ctx context.Context, handle *TlfHandle,
-	mStatus MergeStatus) (tlf.ID, ImmutableRootMetadata, error) {
+	mStatus MergeStatus) (_ tlf.ID, _ ImmutableRootMetadata, err error) {
+	finish := md.config.Tracer().StartSpan(ctx, "MDOps.GetForHandle")
+	defer func() { finish(err) }()
+	if mStatus == Merged {
+		id, rmd, ok := md.getForHandleFromDiskCache(ctx, handle)
+		if ok {
+			return id, rmd, nil
+		}
+	}
+
 	mdserv := md.config.MDServer()
 	bh, err := handle.ToBareHandle()
 	if err != nil {
 		return tlf.ID{}, ImmutableRootMetadata{}, err
 	}
 
+	var root *MerkleRoot
+	if mStatus == Merged {
+		treeID := keybase1.MerkleTreeID_KBFS_PRIVATE
+		if handle.IsPublic() {
+			treeID = keybase1.MerkleTreeID_KBFS_PUBLIC
+		}
+		root, err = md.merkle.getRoot(ctx, treeID)
+		if err != nil {
+			return tlf.ID{}, ImmutableRootMetadata{}, err
+		}
+	}
+
 	id, rmds, err := mdserv.GetForHandle(ctx, bh, mStatus)
 	if err != nil {
 		return tlf.ID{}, ImmutableRootMetadata{}, err
@@ -269,33 +406,62 @@ func (md *MDOpsStandard) GetForHandle(ctx context.Context, handle *TlfHandle,
 		return tlf.ID{}, ImmutableRootMetadata{}, err
 	}
 
-	bareMdHandle, err := rmds.MD.MakeBareTlfHandle(extra)
+	var cachePut func()
+	if mStatus == Merged {
+		cachePut = md.prepareDiskCachePut(
+			ctx, handle.GetCanonicalPath(), rmds, extra)
+	}
+	merkleCheck, err := md.prepareMerkleCheck(root, rmds)
 	if err != nil {
 		return tlf.ID{}, ImmutableRootMetadata{}, err
 	}
 
-	mdHandle, err := MakeTlfHandle(ctx, bareMdHandle, md.config.KBPKI())
+	rmd, err := md.processHeadForHandle(ctx, handle, rmds, extra)
 	if err != nil {
 		return tlf.ID{}, ImmutableRootMetadata{}, err
 	}
 
+	if merkleCheck != nil {
+		err := merkleCheck(ctx, rmd)
+		if err != nil {
+			return tlf.ID{}, ImmutableRootMetadata{}, err
+		}
+	}
+	if cachePut != nil {
+		cachePut()
+	}
+	return id, rmd, nil
+}
+
+// processHeadForHandle checks that the given head, fetched for the
+// given handle, is valid and belongs to that handle, and converts it
+// to an ImmutableRootMetadata.  After this function is called, rmds
+// shouldn't be used.
+func (md *MDOpsStandard) processHeadForHandle(ctx context.Context,
+	handle *TlfHandle, rmds *RootMetadataSigned, extra ExtraMetadata) (
+	ImmutableRootMetadata, error) {
+	bareMdHandle, err := rmds.MD.MakeBareTlfHandle(extra)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+
+	mdHandle, err := MakeTlfHandle(ctx, bareMdHandle, md.config.KBPKI())
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+
 	// Check for mutual handle resolution.
 	if err := mdHandle.MutuallyResolvesTo(ctx, md.config.Codec(),
 		md.config.KBPKI(), *handle, rmds.MD.RevisionNumber(), rmds.MD.TlfID(),
 		md.log); err != nil {
-		return tlf.ID{}, ImmutableRootMetadata{}, err
+		return ImmutableRootMetadata{}, err
 	}
 
 	// TODO: For now, use the mdHandle that came with rmds for
 	// consistency. In the future, we'd want to eventually notify
 	// the upper layers of the new name, either directly, or
 	// through a rekey.
-	rmd, err := md.processMetadata(ctx, mdHandle, rmds, extra, nil)
-	if err != nil {
-		return tlf.ID{}, ImmutableRootMetadata{}, err
-	}
-
-	return id, rmd, nil
+	return md.processMetadata(ctx, mdHandle, rmds, extra, nil)
 }
 
 func (md *MDOpsStandard) processMetadataWithID(ctx context.Context,
@@ -322,7 +488,16 @@ func (md *MDOpsStandard) processMetadataWithID(ctx context.Context,
 }
 
 func (md *MDOpsStandard) getForTLF(ctx context.Context, id tlf.ID,
-	bid BranchID, mStatus MergeStatus) (ImmutableRootMetadata, error) {
+	bid BranchID, mStatus MergeStatus) (_ ImmutableRootMetadata, err error) {
+	finish := md.config.Tracer().StartSpan(ctx, "MDOps.GetForTLF")
+	defer func() { finish(err) }()
+	var root *MerkleRoot
+	if mStatus == Merged && bid == NullBranchID {
+		root, err = md.merkle.getRoot(ctx, merkleTreeIDForTLF(id))
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
+	}
 	rmds, err := md.config.MDServer().GetForTLF(ctx, id, bid, mStatus)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
@@ -343,10 +518,28 @@ func (md *MDOpsStandard) getForTLF(ctx context.Context, id tlf.ID,
 	if err != nil {
 		return ImmutableRootMetadata{}, err
 	}
+	var cachePut func()
+	if mStatus == Merged && id == rmds.MD.TlfID() {
+		cachePut = md.prepareDiskCachePut(
+			ctx, handle.GetCanonicalPath(), rmds, extra)
+	}
+	merkleCheck, err := md.prepareMerkleCheck(root, rmds)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
 	rmd, err := md.processMetadataWithID(ctx, id, bid, handle, rmds, extra, nil)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
 	}
+	if merkleCheck != nil {
+		err := merkleCheck(ctx, rmd)
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
+	}
+	if cachePut != nil {
+		cachePut()
+	}
 	return rmd, nil
 }
 
@@ -497,7 +690,9 @@ func (md *MDOpsStandard) processRange(ctx context.Context, id tlf.ID,
 
 func (md *MDOpsStandard) getRange(ctx context.Context, id tlf.ID,
 	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
-	[]ImmutableRootMetadata, error) {
+	_ []ImmutableRootMetadata, err error) {
+	finish := md.config.Tracer().StartSpan(ctx, "MDOps.GetRange")
+	defer func() { finish(err) }()
 	rmds, err := md.config.MDServer().GetRange(
 		ctx, id, bid, mStatus, start, stop)
 	if err != nil {
@@ -522,8 +717,48 @@ func (md *MDOpsStandard) GetUnmergedRange(ctx context.Context, id tlf.ID,
 	return md.getRange(ctx, id, bid, Unmerged, start, stop)
 }
 
+// GetMergedDelta implements the MDOps interface for MDOpsStandard.
+func (md *MDOpsStandard) GetMergedDelta(ctx context.Context, id tlf.ID,
+	since MetadataRevision, maxRevs int) (
+	_ []ImmutableRootMetadata, skipped bool, err error) {
+	finish := md.config.Tracer().StartSpan(ctx, "MDOps.GetMergedDelta")
+	defer func() { finish(err) }()
+	rmdses, skipped, err := md.config.MDServer().GetMergedDelta(
+		ctx, id, since, maxRevs)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(rmdses) > maxRevs {
+		return nil, false, fmt.Errorf("Got %d revisions after %d; "+
+			"expected at most %d", len(rmdses), since, maxRevs)
+	}
+	// When the server skips history, it must send exactly the
+	// head, which callers rely on.
+	if skipped && len(rmdses) != 1 {
+		return nil, false, fmt.Errorf("Got %d revisions after %d with "+
+			"skipped history; expected just the head", len(rmdses), since)
+	}
+	rmds, err := md.processRange(ctx, id, NullBranchID, rmdses)
+	if err != nil {
+		return nil, false, err
+	}
+	if skipped {
+		if rmds[0].Revision() <= since+MetadataRevision(maxRevs) {
+			return nil, false, fmt.Errorf("Got head %d with skipped "+
+				"history, but it's within %d revisions of %d",
+				rmds[0].Revision(), maxRevs, since)
+		}
+	} else if len(rmds) > 0 && rmds[0].Revision() != since+1 {
+		return nil, false, fmt.Errorf("Got revisions starting at %d; "+
+			"expected %d", rmds[0].Revision(), since+1)
+	}
+	return rmds, skipped, nil
+}
+
 func (md *MDOpsStandard) put(
-	ctx context.Context, rmd *RootMetadata) (MdID, error) {
+	ctx context.Context, rmd *RootMetadata) (_ MdID, err error) {
+	finish := md.config.Tracer().StartSpan(ctx, "MDOps.Put")
+	defer func() { finish(err) }()
 	_, me, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
 	if err != nil {
 		return MdID{}, err
@@ -621,6 +856,26 @@ func (md *MDOpsStandard) GetLatestHandleForTLF(ctx context.Context, id tlf.ID) (
 	return md.config.MDServer().GetLatestHandleForTLF(ctx, id)
 }
 
+// GetChangeSummary implements the MDOps interface for MDOpsStandard.
+func (md *MDOpsStandard) GetChangeSummary(ctx context.Context,
+	handle *TlfHandle, since MetadataRevision) (ChangeSummary, error) {
+	bh, err := handle.ToBareHandle()
+	if err != nil {
+		return ChangeSummary{}, err
+	}
+	id, rmds, err := md.config.MDServer().GetForHandle(ctx, bh, Merged)
+	if err != nil {
+		return ChangeSummary{}, err
+	}
+	summary := ChangeSummary{Head: MetadataRevisionUninitialized}
+	if rmds == nil {
+		return summary, nil
+	}
+	summary.Head = rmds.MD.RevisionNumber()
+	summarizeCachedChanges(md.config.MDCache(), id, since, &summary)
+	return summary, nil
+}
+
 func (md *MDOpsStandard) getExtraMD(ctx context.Context, brmd BareRootMetadata) (
 	extra ExtraMetadata, err error) {
 	wkbID, rkbID := brmd.GetTLFWriterKeyBundleID(), brmd.GetTLFReaderKeyBundleID()
@@ -0,0 +1,169 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/kbfs/tlf"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// MDOpsMeasured delegates to another MDOps instance but also keeps
+// track of stats, which mostly measure round trips to the MD server.
+type MDOpsMeasured struct {
+	delegate                   MDOps
+	getForHandleTimer          metrics.Timer
+	getForTLFTimer             metrics.Timer
+	getUnmergedForTLFTimer     metrics.Timer
+	getRangeTimer              metrics.Timer
+	getUnmergedRangeTimer      metrics.Timer
+	getMergedDeltaTimer        metrics.Timer
+	putTimer                   metrics.Timer
+	putUnmergedTimer           metrics.Timer
+	pruneBranchTimer           metrics.Timer
+	resolveBranchTimer         metrics.Timer
+	getLatestHandleForTLFTimer metrics.Timer
+	getChangeSummaryTimer      metrics.Timer
+}
+
+var _ MDOps = MDOpsMeasured{}
+
+// NewMDOpsMeasured creates and returns a new MDOpsMeasured instance
+// with the given delegate and registry.
+func NewMDOpsMeasured(delegate MDOps, r metrics.Registry) MDOpsMeasured {
+	return MDOpsMeasured{
+		delegate:               delegate,
+		getForHandleTimer:      metrics.GetOrRegisterTimer("MDOps.GetForHandle", r),
+		getForTLFTimer:         metrics.GetOrRegisterTimer("MDOps.GetForTLF", r),
+		getUnmergedForTLFTimer: metrics.GetOrRegisterTimer("MDOps.GetUnmergedForTLF", r),
+		getRangeTimer:          metrics.GetOrRegisterTimer("MDOps.GetRange", r),
+		getUnmergedRangeTimer:  metrics.GetOrRegisterTimer("MDOps.GetUnmergedRange", r),
+		getMergedDeltaTimer:    metrics.GetOrRegisterTimer("MDOps.GetMergedDelta", r),
+		putTimer:               metrics.GetOrRegisterTimer("MDOps.Put", r),
+		putUnmergedTimer:       metrics.GetOrRegisterTimer("MDOps.PutUnmerged", r),
+		pruneBranchTimer:       metrics.GetOrRegisterTimer("MDOps.PruneBranch", r),
+		resolveBranchTimer:     metrics.GetOrRegisterTimer("MDOps.ResolveBranch", r),
+		getLatestHandleForTLFTimer: metrics.GetOrRegisterTimer(
+			"MDOps.GetLatestHandleForTLF", r),
+		getChangeSummaryTimer: metrics.GetOrRegisterTimer(
+			"MDOps.GetChangeSummary", r),
+	}
+}
+
+// GetForHandle implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) GetForHandle(ctx context.Context, handle *TlfHandle,
+	mStatus MergeStatus) (tlfID tlf.ID, rmd ImmutableRootMetadata, err error) {
+	m.getForHandleTimer.Time(func() {
+		tlfID, rmd, err = m.delegate.GetForHandle(ctx, handle, mStatus)
+	})
+	return tlfID, rmd, err
+}
+
+// GetForTLF implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) GetForTLF(ctx context.Context, id tlf.ID) (
+	rmd ImmutableRootMetadata, err error) {
+	m.getForTLFTimer.Time(func() {
+		rmd, err = m.delegate.GetForTLF(ctx, id)
+	})
+	return rmd, err
+}
+
+// GetUnmergedForTLF implements the MDOps interface for
+// MDOpsMeasured.
+func (m MDOpsMeasured) GetUnmergedForTLF(ctx context.Context, id tlf.ID,
+	bid BranchID) (rmd ImmutableRootMetadata, err error) {
+	m.getUnmergedForTLFTimer.Time(func() {
+		rmd, err = m.delegate.GetUnmergedForTLF(ctx, id, bid)
+	})
+	return rmd, err
+}
+
+// GetRange implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) GetRange(ctx context.Context, id tlf.ID,
+	start, stop MetadataRevision) (rmds []ImmutableRootMetadata, err error) {
+	m.getRangeTimer.Time(func() {
+		rmds, err = m.delegate.GetRange(ctx, id, start, stop)
+	})
+	return rmds, err
+}
+
+// GetUnmergedRange implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) GetUnmergedRange(ctx context.Context, id tlf.ID,
+	bid BranchID, start, stop MetadataRevision) (
+	rmds []ImmutableRootMetadata, err error) {
+	m.getUnmergedRangeTimer.Time(func() {
+		rmds, err = m.delegate.GetUnmergedRange(ctx, id, bid, start, stop)
+	})
+	return rmds, err
+}
+
+// GetMergedDelta implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) GetMergedDelta(ctx context.Context, id tlf.ID,
+	since MetadataRevision, maxRevs int) (
+	rmds []ImmutableRootMetadata, skipped bool, err error) {
+	m.getMergedDeltaTimer.Time(func() {
+		rmds, skipped, err = m.delegate.GetMergedDelta(
+			ctx, id, since, maxRevs)
+	})
+	return rmds, skipped, err
+}
+
+// Put implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) Put(ctx context.Context, rmd *RootMetadata) (
+	mdID MdID, err error) {
+	m.putTimer.Time(func() {
+		mdID, err = m.delegate.Put(ctx, rmd)
+	})
+	return mdID, err
+}
+
+// PutUnmerged implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) PutUnmerged(ctx context.Context, rmd *RootMetadata) (
+	mdID MdID, err error) {
+	m.putUnmergedTimer.Time(func() {
+		mdID, err = m.delegate.PutUnmerged(ctx, rmd)
+	})
+	return mdID, err
+}
+
+// PruneBranch implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) PruneBranch(ctx context.Context, id tlf.ID,
+	bid BranchID) (err error) {
+	m.pruneBranchTimer.Time(func() {
+		err = m.delegate.PruneBranch(ctx, id, bid)
+	})
+	return err
+}
+
+// ResolveBranch implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) ResolveBranch(ctx context.Context, id tlf.ID,
+	bid BranchID, blocksToDelete []BlockID, rmd *RootMetadata) (
+	mdID MdID, err error) {
+	m.resolveBranchTimer.Time(func() {
+		mdID, err = m.delegate.ResolveBranch(
+			ctx, id, bid, blocksToDelete, rmd)
+	})
+	return mdID, err
+}
+
+// GetLatestHandleForTLF implements the MDOps interface for
+// MDOpsMeasured.
+func (m MDOpsMeasured) GetLatestHandleForTLF(ctx context.Context,
+	id tlf.ID) (h tlf.Handle, err error) {
+	m.getLatestHandleForTLFTimer.Time(func() {
+		h, err = m.delegate.GetLatestHandleForTLF(ctx, id)
+	})
+	return h, err
+}
+
+// GetChangeSummary implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) GetChangeSummary(ctx context.Context,
+	handle *TlfHandle, since MetadataRevision) (
+	summary ChangeSummary, err error) {
+	m.getChangeSummaryTimer.Time(func() {
+		summary, err = m.delegate.GetChangeSummary(ctx, handle, since)
+	})
+	return summary, err
+}
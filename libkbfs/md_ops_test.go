@@ -60,6 +60,9 @@ func mdOpsInit(t *testing.T) (mockCtrl *gomock.Controller,
 	config.SetCodec(kbfscodec.NewMsgpack())
 	config.mockMdserv.EXPECT().OffsetFromServerTime().
 		Return(time.Duration(0), true).AnyTimes()
+	// Merkle checks are tested with real MD servers.
+	config.mockMdserv.EXPECT().GetMerkleRootLatest(gomock.Any(),
+		gomock.Any()).Return(nil, nil).AnyTimes()
 	h1, _ := kbfshash.DefaultHash([]byte{1})
 	h2, _ := kbfshash.DefaultHash([]byte{2})
 	config.mockCrypto.EXPECT().MakeTLFWriterKeyBundleID(gomock.Any()).
@@ -724,6 +727,33 @@ func TestMDOpsPutFailEncode(t *testing.T) {
 	}
 }
 
+func TestMDOpsGetMergedDeltaFailSkippedWithoutHead(t *testing.T) {
+	mockCtrl, config, ctx := mdOpsInit(t)
+	defer mdOpsShutdown(mockCtrl, config)
+
+	id := tlf.FakeID(1, false)
+	config.mockMdserv.EXPECT().GetMergedDelta(ctx, id, MetadataRevision(10),
+		5).Return(nil, true, nil)
+	_, _, err := config.MDOps().GetMergedDelta(ctx, id, 10, 5)
+	require.Error(t, err)
+}
+
+func TestMDOpsGetMergedDeltaFailSkippedHeadTooClose(t *testing.T) {
+	mockCtrl, config, ctx := mdOpsInit(t)
+	defer mdOpsShutdown(mockCtrl, config)
+
+	rmdses, extras := makeRMDSRange(t, config, 100, 1, fakeMdID(1))
+	verifyMDForPrivateHelper(config, rmdses[0], 0, 1)
+	id := rmdses[0].MD.TlfID()
+	config.mockMdserv.EXPECT().GetMergedDelta(ctx, id, MetadataRevision(98),
+		5).Return(rmdses, true, nil)
+	for _, e := range extras {
+		expectGetKeyBundles(ctx, config, e)
+	}
+	_, _, err := config.MDOps().GetMergedDelta(ctx, id, 98, 5)
+	require.Error(t, err)
+}
+
 func TestMDOpsGetRangeFailFinal(t *testing.T) {
 	mockCtrl, config, ctx := mdOpsInit(t)
 	defer mdOpsShutdown(mockCtrl, config)
@@ -178,6 +178,36 @@ func getSingleMD(ctx context.Context, config Config, id tlf.ID, bid BranchID,
 	return rmds[0], nil
 }
 
+// makeMergedDelta implements MDServer.GetMergedDelta in terms of
+// functions that get the merged head and a merged range, which an
+// MDServer implementation should call under a single lock or
+// transaction if it can.
+func makeMergedDelta(since MetadataRevision, maxRevs int,
+	getHead func() (*RootMetadataSigned, error),
+	getRange func(start, stop MetadataRevision) (
+		[]*RootMetadataSigned, error)) (
+	rmdses []*RootMetadataSigned, skipped bool, err error) {
+	head, err := getHead()
+	if err != nil {
+		return nil, false, err
+	}
+	if head == nil {
+		return nil, false, nil
+	}
+	headRev := head.MD.RevisionNumber()
+	if headRev <= since {
+		return nil, false, nil
+	}
+	if headRev-since > MetadataRevision(maxRevs) {
+		return []*RootMetadataSigned{head}, true, nil
+	}
+	rmdses, err = getRange(since+1, headRev)
+	if err != nil {
+		return nil, false, err
+	}
+	return rmdses, false, nil
+}
+
 // getMergedMDUpdates returns a slice of all the merged MDs for a TLF,
 // starting from the given startRev.  The returned MDs are the same
 // instances that are stored in the MD cache, so they should be
@@ -14,8 +14,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
+	merkle "github.com/keybase/go-merkle-tree"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/syndtr/goleveldb/leveldb"
 	"golang.org/x/net/context"
@@ -38,6 +40,9 @@ type mdServerDiskShared struct {
 	truncateLockManager *mdServerLocalTruncateLockManager
 
 	updateManager *mdServerLocalUpdateManager
+	// The Merkle trees are kept in memory, so they start over
+	// after a restart.
+	merkleTrees *mdServerLocalMerkleTrees
 
 	shutdownFunc func(logger.Logger)
 }
@@ -75,7 +80,9 @@ func newMDServerDisk(config mdServerLocalConfig, dirPath string,
 		tlfStorage:          make(map[tlf.ID]*mdServerTlfStorage),
 		truncateLockManager: &truncateLockManager,
 		updateManager:       newMDServerLocalUpdateManager(),
-		shutdownFunc:        shutdownFunc,
+		merkleTrees: newMDServerLocalMerkleTrees(
+			config.Codec(), config.cryptoPure(), config.Clock()),
+		shutdownFunc: shutdownFunc,
 	}
 	mdserv := &MDServerDisk{config, log, &shared}
 	return mdserv, nil
@@ -135,9 +142,12 @@ func (md *MDServerDisk) getStorage(tlfID tlf.ID) (*mdServerTlfStorage, error) {
 	}
 
 	path := filepath.Join(md.dirPath, tlfID.String())
-	storage = makeMDServerTlfStorage(
+	storage, err = makeMDServerTlfStorage(
 		tlfID, md.config.Codec(), md.config.cryptoPure(),
 		md.config.Clock(), md.config.MetadataVersion(), path)
+	if err != nil {
+		return nil, err
+	}
 
 	md.tlfStorage[tlfID] = storage
 	return storage, nil
@@ -316,7 +326,8 @@ func (md *MDServerDisk) GetForTLF(ctx context.Context, id tlf.ID,
 		}
 	}
 
-	_, currentUID, err := md.config.currentInfoGetter().GetCurrentUserInfo(ctx)
+	currentUID, err := getCurrentUIDForRead(
+		ctx, md.config.currentInfoGetter(), id)
 	if err != nil {
 		return nil, MDServerError{err}
 	}
@@ -347,7 +358,8 @@ func (md *MDServerDisk) GetRange(ctx context.Context, id tlf.ID,
 		}
 	}
 
-	_, currentUID, err := md.config.currentInfoGetter().GetCurrentUserInfo(ctx)
+	currentUID, err := getCurrentUIDForRead(
+		ctx, md.config.currentInfoGetter(), id)
 	if err != nil {
 		return nil, MDServerError{err}
 	}
@@ -360,6 +372,26 @@ func (md *MDServerDisk) GetRange(ctx context.Context, id tlf.ID,
 	return tlfStorage.getRange(currentUID, bid, start, stop)
 }
 
+// GetMergedDelta implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) GetMergedDelta(ctx context.Context, id tlf.ID,
+	since MetadataRevision, maxRevs int) (
+	[]*RootMetadataSigned, bool, error) {
+	md.log.CDebugf(ctx, "GetMergedDelta since %d (max %d)", since, maxRevs)
+
+	currentUID, err := getCurrentUIDForRead(
+		ctx, md.config.currentInfoGetter(), id)
+	if err != nil {
+		return nil, false, MDServerError{err}
+	}
+
+	tlfStorage, err := md.getStorage(id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return tlfStorage.getMergedDelta(currentUID, since, maxRevs)
+}
+
 // Put implements the MDServer interface for MDServerDisk.
 func (md *MDServerDisk) Put(ctx context.Context, rmds *RootMetadataSigned,
 	extra ExtraMetadata) error {
@@ -390,6 +422,15 @@ func (md *MDServerDisk) Put(ctx context.Context, rmds *RootMetadataSigned,
 	}
 
 	mStatus := rmds.MD.MergedStatus()
+	if mStatus == Merged {
+		// The MD is already stored, so just log any failure; the
+		// tree will catch up with the next head.
+		if err := md.merkleTrees.putHead(rmds); err != nil {
+			md.log.CWarningf(ctx, "Couldn't add head to Merkle tree: %v",
+				err)
+		}
+	}
+
 	if mStatus == Merged &&
 		// Don't send notifies if it's just a rekey (the real mdserver
 		// sends a "folder needs rekey" notification in this case).
@@ -420,6 +461,88 @@ func (md *MDServerDisk) PruneBranch(ctx context.Context, id tlf.ID, bid BranchID
 	return md.deleteBranchID(ctx, id)
 }
 
+// finalizeTLF implements the mdServerLocal interface for
+// MDServerDisk.
+func (md *MDServerDisk) finalizeTLF(ctx context.Context, id tlf.ID,
+	resetUser libkb.NormalizedUsername) error {
+	currentUID, _, err :=
+		getCurrentUIDAndVerifyingKey(ctx, md.config.currentInfoGetter())
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	tlfStorage, err := md.getStorage(id)
+	if err != nil {
+		return err
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.handleDb == nil {
+		return errMDServerDiskShutdown
+	}
+
+	codec := md.config.Codec()
+	var finalRmds *RootMetadataSigned
+	var finalHandle tlf.Handle
+	err = tlfStorage.finalize(func(head *RootMetadataSigned,
+		extra ExtraMetadata) (*RootMetadataSigned, error) {
+		rmds, h, err := makeFinalMDForServer(
+			codec, md.config.Clock().Now(), currentUID, head, extra,
+			resetUser, func(h tlf.Handle) (bool, error) {
+				hBytes, err := codec.Encode(h)
+				if err != nil {
+					return false, MDServerError{err}
+				}
+				taken, err := md.handleDb.Has(hBytes, nil)
+				if err != nil {
+					return false, MDServerError{err}
+				}
+				return taken, nil
+			})
+		finalRmds = rmds
+		finalHandle = h
+		return rmds, err
+	})
+	if err != nil {
+		return err
+	}
+	if err := md.merkleTrees.putHead(finalRmds); err != nil {
+		md.log.CWarningf(ctx, "Couldn't add head to Merkle tree: %v", err)
+	}
+
+	// Only the finalized handle leads to this TLF from now on.
+	batch := &leveldb.Batch{}
+	iter := md.handleDb.NewIterator(nil, nil)
+	for iter.Next() {
+		var dbID tlf.ID
+		err := dbID.UnmarshalBinary(iter.Value())
+		if err != nil {
+			iter.Release()
+			return MDServerError{err}
+		}
+		if dbID == id {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return MDServerError{err}
+	}
+	finalHandleBytes, err := codec.Encode(finalHandle)
+	if err != nil {
+		return MDServerError{err}
+	}
+	batch.Put(finalHandleBytes, id.Bytes())
+	err = md.handleDb.Write(batch, nil)
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	md.updateManager.setHead(id, md)
+	return nil
+}
+
 func (md *MDServerDisk) getCurrentMergedHeadRevision(
 	ctx context.Context, id tlf.ID) (rev MetadataRevision, err error) {
 	head, err := md.GetForTLF(ctx, id, NullBranchID, Merged)
@@ -624,6 +747,19 @@ func (md *MDServerDisk) OffsetFromServerTime() (time.Duration, bool) {
 	return 0, true
 }
 
+// GetMerkleRootLatest implements the MDServer interface for
+// MDServerDisk.
+func (md *MDServerDisk) GetMerkleRootLatest(_ context.Context,
+	treeID keybase1.MerkleTreeID) (*MerkleRoot, error) {
+	return md.merkleTrees.getRootLatest(treeID), nil
+}
+
+// GetMerkleNode implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) GetMerkleNode(
+	_ context.Context, hash merkle.Hash) ([]byte, error) {
+	return md.merkleTrees.getNode(hash)
+}
+
 // GetKeyBundles implements the MDServer interface for MDServerDisk.
 func (md *MDServerDisk) GetKeyBundles(_ context.Context,
 	tlfID tlf.ID, wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
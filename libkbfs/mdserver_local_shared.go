@@ -7,12 +7,29 @@ package libkbfs
 import (
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
+	merkle "github.com/keybase/go-merkle-tree"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
 )
 
+// getCurrentUIDForRead returns the UID of the current user, for
+// reading the given TLF.  Since anyone may read a public TLF, it
+// returns an empty UID rather than an error for one if no user is
+// logged in.
+func getCurrentUIDForRead(ctx context.Context, cig currentInfoGetter,
+	id tlf.ID) (keybase1.UID, error) {
+	_, uid, err := cig.GetCurrentUserInfo(ctx)
+	if _, ok := err.(NoCurrentSessionError); ok && id.IsPublic() {
+		return keybase1.UID(""), nil
+	}
+	return uid, err
+}
+
 // Helper to aid in enforcement that only specified public keys can
 // access TLF metadata. mergedMasterHead can be nil, in which case
 // true is returned.
@@ -25,6 +42,17 @@ func isReader(currentUID keybase1.UID, mergedMasterHead BareRootMetadata,
 	return h.IsReader(currentUID), nil
 }
 
+// Helper to aid in enforcement that only writers can get a TLF's
+// access log.
+func isWriter(currentUID keybase1.UID, mergedMasterHead BareRootMetadata,
+	extra ExtraMetadata) (bool, error) {
+	h, err := mergedMasterHead.MakeBareTlfHandle(extra)
+	if err != nil {
+		return false, err
+	}
+	return h.IsWriter(currentUID), nil
+}
+
 // Helper to aid in enforcement that only specified public keys can
 // access TLF metadata. mergedMasterHead can be nil, in which case
 // true is returned.
@@ -49,6 +77,54 @@ func isWriterOrValidRekey(codec kbfscodec.Codec, currentUID keybase1.UID,
 	return false, nil
 }
 
+// makeFinalMDForServer returns a final copy of the given merged
+// head, and the finalized bare handle of the TLF, on behalf of the
+// given user.  The number in the finalized extension is the lowest
+// one for which isHandleTaken returns false.
+func makeFinalMDForServer(codec kbfscodec.Codec, now time.Time,
+	currentUID keybase1.UID, head *RootMetadataSigned, extra ExtraMetadata,
+	resetUser libkb.NormalizedUsername,
+	isHandleTaken func(h tlf.Handle) (bool, error)) (
+	*RootMetadataSigned, tlf.Handle, error) {
+	if head == nil {
+		return nil, tlf.Handle{}, MDServerErrorBadRequest{
+			Reason: "Can't finalize a TLF with no MD"}
+	}
+	if head.MD.IsFinal() {
+		return nil, tlf.Handle{}, MDServerErrorBadRequest{
+			Reason: MetadataIsFinalError{}.Error()}
+	}
+	h, err := head.MD.MakeBareTlfHandle(extra)
+	if err != nil {
+		return nil, tlf.Handle{}, MDServerError{err}
+	}
+	if !h.IsWriter(currentUID) {
+		return nil, tlf.Handle{}, MDServerErrorUnauthorized{}
+	}
+
+	for num := uint16(1); ; num++ {
+		fi, err := tlf.NewHandleExtension(
+			tlf.HandleExtensionFinalized, num, resetUser, now)
+		if err != nil {
+			return nil, tlf.Handle{}, MDServerErrorBadRequest{
+				Reason: err.Error()}
+		}
+		h.FinalizedInfo = fi
+		taken, err := isHandleTaken(h)
+		if err != nil {
+			return nil, tlf.Handle{}, err
+		}
+		if taken {
+			continue
+		}
+		finalRmds, err := head.MakeFinalCopy(codec, now, fi)
+		if err != nil {
+			return nil, tlf.Handle{}, MDServerError{err}
+		}
+		return finalRmds, h, nil
+	}
+}
+
 // mdServerLocalTruncateLockManager manages the truncate locks for a
 // set of TLFs. Note that it is not goroutine-safe.
 type mdServerLocalTruncateLockManager struct {
@@ -162,3 +238,145 @@ func (m *mdServerLocalUpdateManager) registerForUpdate(
 	m.observers[id][server] = c
 	return c
 }
+
+// mdServerLocalMerkleTree is one Merkle tree of TLF heads kept by
+// mdServerLocalMerkleTrees.
+type mdServerLocalMerkleTree struct {
+	engine *merkle.MemEngine
+	tree   *merkle.Tree
+	// latest is nil until the first head is put.
+	latest *MerkleRoot
+	// TLF ID -> revision of the TLF's leaf, and the leaf's encoding
+	revs   map[tlf.ID]MetadataRevision
+	values map[tlf.ID][]byte
+}
+
+// mdServerLocalMerkleTrees keeps Merkle trees of the merged heads put
+// to a set of mdServerLocal instances sharing the same data, one for
+// public TLFs and one for private TLFs, like the real MD server.
+// Unlike the real MD server, it publishes a new root for every head,
+// and keeps the leaves of both trees in the clear.  It is
+// goroutine-safe.
+type mdServerLocalMerkleTrees struct {
+	codec  kbfscodec.Codec
+	crypto cryptoPure
+	clock  Clock
+
+	lock  sync.Mutex
+	trees map[keybase1.MerkleTreeID]*mdServerLocalMerkleTree
+}
+
+func newMDServerLocalMerkleTrees(
+	codec kbfscodec.Codec, crypto cryptoPure,
+	clock Clock) *mdServerLocalMerkleTrees {
+	return &mdServerLocalMerkleTrees{
+		codec:  codec,
+		crypto: crypto,
+		clock:  clock,
+		trees:  make(map[keybase1.MerkleTreeID]*mdServerLocalMerkleTree),
+	}
+}
+
+// putHead adds the given new merged head to the tree for its TLF,
+// and publishes the new root.  Heads older than the one already in
+// the tree are ignored.
+func (m *mdServerLocalMerkleTrees) putHead(rmds *RootMetadataSigned) error {
+	hash, err := m.crypto.MakeMerkleHash(rmds)
+	if err != nil {
+		return err
+	}
+	now := m.clock.Now().Unix()
+	leaf := MerkleLeaf{
+		Revision:  rmds.MD.RevisionNumber(),
+		Hash:      hash,
+		Timestamp: now,
+	}
+	buf, err := m.codec.Encode(leaf)
+	if err != nil {
+		return err
+	}
+
+	id := rmds.MD.TlfID()
+	treeID := merkleTreeIDForTLF(id)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	t, ok := m.trees[treeID]
+	if !ok {
+		engine := merkle.NewMemEngine()
+		t = &mdServerLocalMerkleTree{
+			engine: engine,
+			tree:   merkle.NewTree(engine, merkleTreeConfig),
+			revs:   make(map[tlf.ID]MetadataRevision),
+			values: make(map[tlf.ID][]byte),
+		}
+		m.trees[treeID] = t
+	}
+	if t.revs[id] >= leaf.Revision {
+		return nil
+	}
+	t.revs[id] = leaf.Revision
+	t.values[id] = buf
+
+	prevRoot, err := t.engine.LookupRoot()
+	if err != nil {
+		return err
+	}
+	// Rebuild the whole tree, since merkle.Tree.Upsert doesn't
+	// replace existing leaves properly.  There are never many
+	// TLFs on a local server.
+	kvps := make([]merkle.KeyValuePair, 0, len(t.values))
+	for id, value := range t.values {
+		kvps = append(kvps,
+			merkle.KeyValuePair{Key: merkleLeafKey(id), Value: value})
+	}
+	err = t.tree.Build(merkle.NewSortedMapFromList(kvps), nil)
+	if err != nil {
+		return err
+	}
+	root, err := t.engine.LookupRoot()
+	if err != nil {
+		return err
+	}
+	var seqNo int64 = 1
+	if t.latest != nil {
+		seqNo = t.latest.SeqNo + 1
+	}
+	t.latest = &MerkleRoot{
+		Version:   MerkleRootVersion,
+		TreeID:    treeID,
+		SeqNo:     seqNo,
+		Timestamp: now,
+		Hash:      root,
+		PrevRoot:  prevRoot,
+	}
+	return nil
+}
+
+func (m *mdServerLocalMerkleTrees) getRootLatest(
+	treeID keybase1.MerkleTreeID) *MerkleRoot {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	t, ok := m.trees[treeID]
+	if !ok {
+		return nil
+	}
+	root := *t.latest
+	return &root
+}
+
+func (m *mdServerLocalMerkleTrees) getNode(hash merkle.Hash) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, t := range m.trees {
+		buf, err := t.engine.LookupNode(hash)
+		if err != nil {
+			return nil, err
+		}
+		if buf != nil {
+			return buf, nil
+		}
+	}
+	return nil, MDServerErrorBadRequest{
+		Reason: fmt.Sprintf("No Merkle node with hash %x", []byte(hash)),
+	}
+}
@@ -12,8 +12,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
+	merkle "github.com/keybase/go-merkle-tree"
 	"github.com/keybase/kbfs/tlf"
 	"golang.org/x/net/context"
 )
@@ -71,8 +73,11 @@ type mdServerMemShared struct {
 	// (TLF ID, device KID) -> branch ID
 	branchDb            map[mdBranchKey]BranchID
 	truncateLockManager *mdServerLocalTruncateLockManager
+	// TLF ID -> recent fetches of the TLF's MD, oldest first
+	accessLogDb map[tlf.ID][]TLFAccessEvent
 
 	updateManager *mdServerLocalUpdateManager
+	merkleTrees   *mdServerLocalMerkleTrees
 }
 
 // MDServerMemory just stores metadata objects in memory.
@@ -84,6 +89,11 @@ type MDServerMemory struct {
 }
 
 var _ mdServerLocal = (*MDServerMemory)(nil)
+var _ TLFAccessLogServer = (*MDServerMemory)(nil)
+
+// mdServerMemoryMaxAccessLogEvents is the number of recent fetches
+// that MDServerMemory remembers for each TLF.
+const mdServerMemoryMaxAccessLogEvents = 1000
 
 // NewMDServerMemory constructs a new MDServerMemory object that stores
 // all data in-memory.
@@ -94,6 +104,7 @@ func NewMDServerMemory(config mdServerLocalConfig) (*MDServerMemory, error) {
 	branchDb := make(map[mdBranchKey]BranchID)
 	writerKeyBundleDb := make(map[mdExtraWriterKey]*TLFWriterKeyBundleV3)
 	readerKeyBundleDb := make(map[mdExtraReaderKey]*TLFReaderKeyBundleV3)
+	accessLogDb := make(map[tlf.ID][]TLFAccessEvent)
 	log := config.MakeLogger("MDSM")
 	truncateLockManager := newMDServerLocalTruncatedLockManager()
 	shared := mdServerMemShared{
@@ -104,7 +115,10 @@ func NewMDServerMemory(config mdServerLocalConfig) (*MDServerMemory, error) {
 		writerKeyBundleDb:   writerKeyBundleDb,
 		readerKeyBundleDb:   readerKeyBundleDb,
 		truncateLockManager: &truncateLockManager,
+		accessLogDb:         accessLogDb,
 		updateManager:       newMDServerLocalUpdateManager(),
+		merkleTrees: newMDServerLocalMerkleTrees(
+			config.Codec(), config.cryptoPure(), config.Clock()),
 	}
 	mdserv := &MDServerMemory{config, log, &shared}
 	return mdserv, nil
@@ -184,7 +198,8 @@ func (md *MDServerMemory) checkGetParams(
 		return NullBranchID, MDServerError{err}
 	}
 
-	_, currentUID, err := md.config.currentInfoGetter().GetCurrentUserInfo(ctx)
+	currentUID, err := getCurrentUIDForRead(
+		ctx, md.config.currentInfoGetter(), id)
 	if err != nil {
 		return NullBranchID, MDServerError{err}
 	}
@@ -229,6 +244,9 @@ func (md *MDServerMemory) GetForTLF(ctx context.Context, id tlf.ID,
 	if err != nil {
 		return nil, MDServerError{err}
 	}
+	if rmds != nil {
+		md.recordAccess(ctx, id)
+	}
 	return rmds, nil
 }
 
@@ -289,6 +307,21 @@ func (md *MDServerMemory) getCurrentDeviceKID(ctx context.Context) (keybase1.KID
 	return key.KID(), nil
 }
 
+// GetMergedDelta implements the MDServer interface for
+// MDServerMemory.
+func (md *MDServerMemory) GetMergedDelta(ctx context.Context, id tlf.ID,
+	since MetadataRevision, maxRevs int) (
+	[]*RootMetadataSigned, bool, error) {
+	md.log.CDebugf(ctx, "GetMergedDelta since %d (max %d)", since, maxRevs)
+	return makeMergedDelta(since, maxRevs,
+		func() (*RootMetadataSigned, error) {
+			return md.GetForTLF(ctx, id, NullBranchID, Merged)
+		},
+		func(start, stop MetadataRevision) ([]*RootMetadataSigned, error) {
+			return md.GetRange(ctx, id, NullBranchID, Merged, start, stop)
+		})
+}
+
 // GetRange implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) GetRange(ctx context.Context, id tlf.ID,
 	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
@@ -307,6 +340,8 @@ func (md *MDServerMemory) GetRange(ctx context.Context, id tlf.ID,
 		return nil, MDServerError{err}
 	}
 
+	event := md.makeAccessEvent(ctx)
+
 	md.lock.Lock()
 	defer md.lock.Unlock()
 	if md.mdDb == nil {
@@ -348,9 +383,100 @@ func (md *MDServerMemory) GetRange(ctx context.Context, id tlf.ID,
 		rmdses = append(rmdses, rmds)
 	}
 
+	if len(rmdses) > 0 {
+		md.recordAccessLocked(id, event)
+	}
 	return rmdses, nil
 }
 
+// makeAccessEvent returns an event recording that the current device
+// fetched some MD just now.
+func (md *MDServerMemory) makeAccessEvent(
+	ctx context.Context) TLFAccessEvent {
+	event := TLFAccessEvent{
+		Kind: TLFAccessMD,
+		Time: md.config.Clock().Now(),
+	}
+	cig := md.config.currentInfoGetter()
+	_, uid, err := cig.GetCurrentUserInfo(ctx)
+	if err != nil {
+		// An anonymous read of a public TLF.
+		return event
+	}
+	event.Reader = uid
+	if key, err := cig.GetCurrentVerifyingKey(ctx); err == nil {
+		event.ReaderKey = key
+	}
+	return event
+}
+
+func (md *MDServerMemory) recordAccessLocked(
+	id tlf.ID, event TLFAccessEvent) {
+	if md.accessLogDb == nil {
+		return
+	}
+	events := append(md.accessLogDb[id], event)
+	if len(events) > mdServerMemoryMaxAccessLogEvents {
+		events = append([]TLFAccessEvent(nil),
+			events[len(events)-mdServerMemoryMaxAccessLogEvents:]...)
+	}
+	md.accessLogDb[id] = events
+}
+
+// recordAccess records that the current device just fetched some of
+// the given TLF's MD.
+func (md *MDServerMemory) recordAccess(ctx context.Context, id tlf.ID) {
+	event := md.makeAccessEvent(ctx)
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	md.recordAccessLocked(id, event)
+}
+
+// GetTLFAccessLog implements the TLFAccessLogServer interface for
+// MDServerMemory.
+func (md *MDServerMemory) GetTLFAccessLog(ctx context.Context, id tlf.ID,
+	since time.Time) ([]TLFAccessEvent, error) {
+	mergedMasterHead, err :=
+		md.getHeadForTLF(ctx, id, NullBranchID, Merged)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	if mergedMasterHead == nil {
+		return nil, nil
+	}
+
+	_, currentUID, err := md.config.currentInfoGetter().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	extra, err := md.getExtraMetadata(
+		id, mergedMasterHead.MD.GetTLFWriterKeyBundleID(),
+		mergedMasterHead.MD.GetTLFReaderKeyBundleID())
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	ok, err := isWriter(currentUID, mergedMasterHead.MD, extra)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	if !ok {
+		return nil, MDServerErrorUnauthorized{}
+	}
+
+	md.lock.RLock()
+	defer md.lock.RUnlock()
+	if md.accessLogDb == nil {
+		return nil, errMDServerMemoryShutdown
+	}
+	var events []TLFAccessEvent
+	for _, event := range md.accessLogDb[id] {
+		if !event.Time.Before(since) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
 // Put implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 	extra ExtraMetadata) error {
@@ -504,6 +630,15 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 		return MDServerError{err}
 	}
 
+	if mStatus == Merged {
+		// The MD is already stored, so just log any failure; the
+		// tree will catch up with the next head.
+		if err := md.merkleTrees.putHead(rmds); err != nil {
+			md.log.CWarningf(ctx, "Couldn't add head to Merkle tree: %v",
+				err)
+		}
+	}
+
 	if mStatus == Merged &&
 		// Don't send notifies if it's just a rekey (the real mdserver
 		// sends a "folder needs rekey" notification in this case).
@@ -545,6 +680,83 @@ func (md *MDServerMemory) PruneBranch(ctx context.Context, id tlf.ID, bid Branch
 	return nil
 }
 
+// finalizeTLF implements the mdServerLocal interface for
+// MDServerMemory.
+func (md *MDServerMemory) finalizeTLF(ctx context.Context, id tlf.ID,
+	resetUser libkb.NormalizedUsername) error {
+	currentUID, _, err :=
+		getCurrentUIDAndVerifyingKey(ctx, md.config.currentInfoGetter())
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	head, err := md.getHeadForTLF(ctx, id, NullBranchID, Merged)
+	if err != nil {
+		return MDServerError{err}
+	}
+	var extra ExtraMetadata
+	if head != nil {
+		extra, err = md.getExtraMetadata(id,
+			head.MD.GetTLFWriterKeyBundleID(),
+			head.MD.GetTLFReaderKeyBundleID())
+		if err != nil {
+			return MDServerError{err}
+		}
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.mdDb == nil {
+		return errMDServerMemoryShutdown
+	}
+
+	codec := md.config.Codec()
+	now := md.config.Clock().Now()
+	finalRmds, finalHandle, err := makeFinalMDForServer(
+		codec, now, currentUID, head, extra, resetUser,
+		func(h tlf.Handle) (bool, error) {
+			hBytes, err := codec.Encode(h)
+			if err != nil {
+				return false, MDServerError{err}
+			}
+			_, ok := md.handleDb[mdHandleKey(hBytes)]
+			return ok, nil
+		})
+	if err != nil {
+		return err
+	}
+
+	encodedMd, err := EncodeRootMetadataSigned(codec, finalRmds)
+	if err != nil {
+		return MDServerError{err}
+	}
+	finalHandleBytes, err := codec.Encode(finalHandle)
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	key := mdBlockKey{id, NullBranchID}
+	blockList := md.mdDb[key]
+	blockList.blocks = append(blockList.blocks,
+		mdBlockMem{encodedMd, now, finalRmds.MD.Version()})
+	md.mdDb[key] = blockList
+	if err := md.merkleTrees.putHead(finalRmds); err != nil {
+		md.log.CWarningf(ctx, "Couldn't add head to Merkle tree: %v", err)
+	}
+
+	// Only the finalized handle leads to this TLF from now on.
+	for hBytes, hID := range md.handleDb {
+		if hID == id {
+			delete(md.handleDb, hBytes)
+		}
+	}
+	md.handleDb[mdHandleKey(finalHandleBytes)] = id
+	md.latestHandleDb[id] = finalHandle
+
+	md.updateManager.setHead(id, md)
+	return nil
+}
+
 func (md *MDServerMemory) getBranchID(ctx context.Context, id tlf.ID) (BranchID, error) {
 	branchKey, err := md.getBranchKey(ctx, id)
 	if err != nil {
@@ -633,6 +845,7 @@ func (md *MDServerMemory) Shutdown() {
 	md.latestHandleDb = nil
 	md.branchDb = nil
 	md.truncateLockManager = nil
+	md.accessLogDb = nil
 }
 
 // IsConnected implements the MDServer interface for MDServerMemory.
@@ -809,6 +1022,19 @@ func (md *MDServerMemory) getKeyBundles(
 	return wkb, rkb, nil
 }
 
+// GetMerkleRootLatest implements the MDServer interface for
+// MDServerMemory.
+func (md *MDServerMemory) GetMerkleRootLatest(_ context.Context,
+	treeID keybase1.MerkleTreeID) (*MerkleRoot, error) {
+	return md.merkleTrees.getRootLatest(treeID), nil
+}
+
+// GetMerkleNode implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) GetMerkleNode(
+	_ context.Context, hash merkle.Hash) ([]byte, error) {
+	return md.merkleTrees.getNode(hash)
+}
+
 // GetKeyBundles implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) GetKeyBundles(_ context.Context,
 	tlfID tlf.ID, wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
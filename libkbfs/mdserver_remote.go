@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"encoding/hex"
 	"fmt"
 	"sync"
 	"time"
@@ -13,6 +14,7 @@ import (
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	merkle "github.com/keybase/go-merkle-tree"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
 	"golang.org/x/net/context"
@@ -46,7 +48,7 @@ type MDServerRemote struct {
 	isAuthenticated  bool
 
 	observerMu sync.Mutex // protects observers
-	observers  map[tlf.ID]chan<- error
+	observers  map[tlf.ID]mdServerObserver
 
 	tickerCancel context.CancelFunc
 	tickerMu     sync.Mutex // protects the ticker cancel function
@@ -59,6 +61,13 @@ type MDServerRemote struct {
 	serverOffset      time.Duration
 }
 
+// mdServerObserver is a registration for the next update to a TLF,
+// along with the head revision the caller had when it registered.
+type mdServerObserver struct {
+	c        chan<- error
+	currHead MetadataRevision
+}
+
 // Test that MDServerRemote fully implements the MDServer interface.
 var _ MDServer = (*MDServerRemote)(nil)
 
@@ -75,8 +84,8 @@ var _ rpc.ConnectionHandler = (*MDServerRemote)(nil)
 func NewMDServerRemote(config Config, srvAddr string, ctx Context) *MDServerRemote {
 	mdServer := &MDServerRemote{
 		config:     config,
-		observers:  make(map[tlf.ID]chan<- error),
-		log:        config.MakeLogger(""),
+		observers:  make(map[tlf.ID]mdServerObserver),
+		log:        config.MakeLogger("MDSR"),
 		mdSrvAddr:  srvAddr,
 		rekeyTimer: time.NewTimer(MdServerBackgroundRekeyPeriod),
 	}
@@ -88,7 +97,15 @@ func NewMDServerRemote(config Config, srvAddr string, ctx Context) *MDServerRemo
 		ctx.NewRPCLogFactory(), libkb.WrapError,
 		config.MakeLogger(""), LogTagsFromContext)
 	mdServer.conn = conn
-	mdServer.client = keybase1.MetadataClient{Cli: conn.GetClient()}
+	// The connection itself doesn't retry failed RPCs (see
+	// ShouldRetry); the retrier does, with backoff, and stops
+	// sending them altogether while the server keeps failing.
+	mdServer.client = keybase1.MetadataClient{Cli: serverRetryClient{
+		retrier: newServerRetrier(
+			"the MD server", config.Clock(), mdServer.log),
+		client: conn.GetClient(),
+		modes:  mdServerRetryModes,
+	}}
 
 	// Check for rekey opportunities periodically.
 	rekeyCtx, rekeyCancel := context.WithCancel(context.Background())
@@ -136,7 +153,14 @@ func (md *MDServerRemote) OnConnect(ctx context.Context,
 	pingIntervalSeconds, err := md.resetAuth(ctx, c)
 	switch err.(type) {
 	case nil:
+		// Observers outlive disconnects, so renew their
+		// registrations on this connection, without holding up
+		// the connect.
+		go md.resubscribeObservers(ctxWithRandomIDReplayable(
+			context.Background(), CtxMDSRIDKey, CtxMDSROpID, md.log), c)
 	case NoCurrentSessionError:
+		// Registrations need an authenticated session.
+		md.cancelObservers()
 	default:
 		return err
 	}
@@ -238,12 +262,18 @@ func (md *MDServerRemote) pingOnce(ctx context.Context) {
 	clock := md.config.Clock()
 	beforePing := clock.Now()
 	resp, err := md.client.Ping2(ctx)
+	afterPing := clock.Now()
+	pingLatency := afterPing.Sub(beforePing)
+	if ctx.Err() == nil {
+		// Pings are the steady stream of requests that tell
+		// the connectivity tracker how the connection is doing.
+		md.config.Connectivity().RequestDone(
+			MDServiceName, pingLatency, err)
+	}
 	if err != nil {
 		md.log.CDebugf(ctx, "MDServerRemote: ping error %s", err)
 		return
 	}
-	afterPing := clock.Now()
-	pingLatency := afterPing.Sub(beforePing)
 	if md.serverOffset > 0 && pingLatency > 5*time.Second {
 		md.log.CDebugf(ctx, "Ignoring large ping time: %s",
 			pingLatency)
@@ -308,7 +338,10 @@ func (md *MDServerRemote) OnConnectError(err error, wait time.Duration) {
 		err, wait)
 	// TODO: it might make sense to show something to the user if this is
 	// due to authentication, for example.
-	md.cancelObservers()
+	if !md.ShouldRetryOnConnect(err) {
+		// We won't reconnect, so nothing would renew the observers.
+		md.cancelObservers()
+	}
 	md.resetPingTicker(0)
 	if md.authToken != nil {
 		md.authToken.Shutdown()
@@ -341,7 +374,10 @@ func (md *MDServerRemote) OnDisconnected(ctx context.Context,
 		md.serverOffset = 0
 	}()
 
-	md.cancelObservers()
+	// Keep any registered observers; they will be re-registered, with
+	// the revisions they were registered with, as soon as we
+	// reconnect.  That way no updates are missed, and callers don't
+	// have to notice the disconnect and back off before re-registering.
 	md.resetPingTicker(0)
 	if md.authToken != nil {
 		md.authToken.Shutdown()
@@ -354,10 +390,10 @@ func (md *MDServerRemote) OnDisconnected(ctx context.Context,
 	md.config.KBFSOps().PushConnectionStatusChange(MDServiceName, errDisconnected{})
 }
 
-// ShouldRetry implements the ConnectionHandler interface.
+// ShouldRetry implements the ConnectionHandler interface.  RPCs
+// sent through md.client are retried by its serverRetrier instead.
 func (md *MDServerRemote) ShouldRetry(name string, err error) bool {
-	_, shouldThrottle := err.(MDServerErrorThrottle)
-	return shouldThrottle
+	return false
 }
 
 // ShouldRetryOnConnect implements the ConnectionHandler interface.
@@ -371,8 +407,54 @@ func (md *MDServerRemote) cancelObservers() {
 	md.observerMu.Lock()
 	defer md.observerMu.Unlock()
 	// fire errors for any registered observers
-	for id, observerChan := range md.observers {
-		md.signalObserverLocked(observerChan, id, MDServerDisconnected{})
+	for id, o := range md.observers {
+		md.signalObserverLocked(o.c, id, MDServerDisconnected{})
+	}
+}
+
+// resubscribeObservers registers every current observer with the MD
+// server over the given client, using the head revision each observer
+// originally registered with, so that the server signals right away
+// any update that was missed while disconnected.  Observers that
+// can't be re-registered get the error, so their callers can retry
+// on their own.
+func (md *MDServerRemote) resubscribeObservers(
+	ctx context.Context, c keybase1.MetadataClient) {
+	observers := func() map[tlf.ID]mdServerObserver {
+		md.observerMu.Lock()
+		defer md.observerMu.Unlock()
+		observers := make(map[tlf.ID]mdServerObserver, len(md.observers))
+		for id, o := range md.observers {
+			observers[id] = o
+		}
+		return observers
+	}()
+	if len(observers) == 0 {
+		return
+	}
+
+	md.log.CDebugf(ctx, "MDServerRemote: re-registering %d observers",
+		len(observers))
+	for id, o := range observers {
+		err := c.RegisterForUpdates(ctx, keybase1.RegisterForUpdatesArg{
+			FolderID:     id.String(),
+			CurrRevision: o.currHead.Number(),
+			LogTags:      nil,
+		})
+		if err == nil {
+			continue
+		}
+		md.log.CDebugf(ctx, "MDServerRemote: couldn't re-register "+
+			"observer for %s: %v", id, err)
+		func() {
+			md.observerMu.Lock()
+			defer md.observerMu.Unlock()
+			// The observer may have been signaled, and replaced by
+			// a new registration, in the meantime.
+			if curr, ok := md.observers[id]; ok && curr.c == o.c {
+				md.signalObserverLocked(curr.c, id, err)
+			}
+		}()
 	}
 }
 
@@ -410,7 +492,9 @@ func (md *MDServerRemote) get(ctx context.Context, id tlf.ID,
 	}
 
 	// request
+	finish := md.config.Tracer().StartSpan(ctx, "MDServer.GetMetadata")
 	response, err := md.client.GetMetadata(ctx, arg)
+	finish(err)
 	if err != nil {
 		return id, nil, err
 	}
@@ -474,6 +558,22 @@ func (md *MDServerRemote) GetRange(ctx context.Context, id tlf.ID,
 	return rmds, err
 }
 
+// GetMergedDelta implements the MDServer interface for
+// MDServerRemote.  The MD server protocol has no RPC for this yet, so
+// it checks the head first, and only fetches the range after since if
+// it isn't skipped.
+func (md *MDServerRemote) GetMergedDelta(ctx context.Context, id tlf.ID,
+	since MetadataRevision, maxRevs int) (
+	[]*RootMetadataSigned, bool, error) {
+	return makeMergedDelta(since, maxRevs,
+		func() (*RootMetadataSigned, error) {
+			return md.GetForTLF(ctx, id, NullBranchID, Merged)
+		},
+		func(start, stop MetadataRevision) ([]*RootMetadataSigned, error) {
+			return md.GetRange(ctx, id, NullBranchID, Merged, start, stop)
+		})
+}
+
 // Put implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) Put(ctx context.Context, rmds *RootMetadataSigned,
 	extra ExtraMetadata) error {
@@ -515,7 +615,10 @@ func (md *MDServerRemote) Put(ctx context.Context, rmds *RootMetadataSigned,
 		}
 	}
 
-	return md.client.PutMetadata(ctx, arg)
+	finish := md.config.Tracer().StartSpan(ctx, "MDServer.PutMetadata")
+	err = md.client.PutMetadata(ctx, arg)
+	finish(err)
+	return err
 }
 
 // PruneBranch implements the MDServer interface for MDServerRemote.
@@ -537,14 +640,14 @@ func (md *MDServerRemote) MetadataUpdate(_ context.Context, arg keybase1.Metadat
 
 	md.observerMu.Lock()
 	defer md.observerMu.Unlock()
-	observerChan, ok := md.observers[id]
+	o, ok := md.observers[id]
 	if !ok {
 		// not registered
 		return nil
 	}
 
 	// signal that we've seen the update
-	md.signalObserverLocked(observerChan, id, nil)
+	md.signalObserverLocked(o.c, id, nil)
 	return nil
 }
 
@@ -607,7 +710,7 @@ func (md *MDServerRemote) RegisterForUpdate(ctx context.Context, id tlf.ID,
 					id))
 			}
 			c = make(chan error, 1)
-			md.observers[id] = c
+			md.observers[id] = mdServerObserver{c, currHead}
 		}()
 		// Use this instead of md.client since we're already
 		// inside a DoCommand().
@@ -619,8 +722,8 @@ func (md *MDServerRemote) RegisterForUpdate(ctx context.Context, id tlf.ID,
 				defer md.observerMu.Unlock()
 				// we could've been canceled by a shutdown so look this up
 				// again before closing and deleting.
-				if updateChan, ok := md.observers[id]; ok {
-					close(updateChan)
+				if o, ok := md.observers[id]; ok {
+					close(o.c)
 					delete(md.observers, id)
 				}
 			}()
@@ -861,6 +964,35 @@ func (md *MDServerRemote) backgroundRekeyChecker(ctx context.Context) {
 	}
 }
 
+// GetMerkleRootLatest implements the MDServer interface for
+// MDServerRemote.
+func (md *MDServerRemote) GetMerkleRootLatest(ctx context.Context,
+	treeID keybase1.MerkleTreeID) (*MerkleRoot, error) {
+	res, err := md.client.GetMerkleRootLatest(ctx, treeID)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Root) == 0 {
+		return nil, nil
+	}
+	if res.Version != MerkleRootVersion {
+		return nil, fmt.Errorf("Unsupported Merkle root version: %d",
+			res.Version)
+	}
+	var root MerkleRoot
+	err = md.config.Codec().Decode(res.Root, &root)
+	if err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
+
+// GetMerkleNode implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) GetMerkleNode(
+	ctx context.Context, hash merkle.Hash) ([]byte, error) {
+	return md.client.GetMerkleNode(ctx, hex.EncodeToString(hash))
+}
+
 // GetKeyBundles implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) GetKeyBundles(ctx context.Context,
 	tlf tlf.ID, wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
@@ -884,8 +1016,8 @@ func (md *MDServerRemote) GetKeyBundles(ctx context.Context,
 				response.WriterBundle.Version)
 			return nil, nil, err
 		}
-		wkb = new(TLFWriterKeyBundleV3)
-		err = md.config.Codec().Decode(response.WriterBundle.Bundle, wkb)
+		wkb, err = DecodeTLFWriterKeyBundleV3(
+			md.config.Codec(), response.WriterBundle.Bundle)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -908,8 +1040,8 @@ func (md *MDServerRemote) GetKeyBundles(ctx context.Context,
 				response.ReaderBundle.Version)
 			return nil, nil, err
 		}
-		rkb = new(TLFReaderKeyBundleV3)
-		err = md.config.Codec().Decode(response.ReaderBundle.Bundle, rkb)
+		rkb, err = DecodeTLFReaderKeyBundleV3(
+			md.config.Codec(), response.ReaderBundle.Bundle)
 		if err != nil {
 			return nil, nil, err
 		}
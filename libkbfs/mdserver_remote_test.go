@@ -0,0 +1,96 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeMDServerClient records registerForUpdates calls, and fails
+// them for any folder in failFolders.
+type fakeMDServerClient struct {
+	failFolders map[string]error
+
+	lock       sync.Mutex
+	registered map[string]int64
+}
+
+var _ rpc.GenericClient = (*fakeMDServerClient)(nil)
+
+func (c *fakeMDServerClient) Call(ctx context.Context, s string,
+	args interface{}, res interface{}) error {
+	if s != "keybase.1.metadata.registerForUpdates" {
+		return errors.New("unexpected call " + s)
+	}
+	arg := args.([]interface{})[0].(keybase1.RegisterForUpdatesArg)
+	if err := c.failFolders[arg.FolderID]; err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.registered[arg.FolderID] = arg.CurrRevision
+	return nil
+}
+
+func (c *fakeMDServerClient) Notify(ctx context.Context, s string,
+	args interface{}) error {
+	return errors.New("unexpected notify " + s)
+}
+
+// Test that observers are re-registered with the revisions they
+// registered with, that they still get notified afterwards, and
+// that ones that can't be re-registered get the error.
+func TestMDServerRemoteResubscribeObservers(t *testing.T) {
+	md := &MDServerRemote{
+		log:       logger.NewTestLogger(t),
+		observers: make(map[tlf.ID]mdServerObserver),
+	}
+	id1 := tlf.FakeID(1, false)
+	id2 := tlf.FakeID(2, false)
+	c1 := make(chan error, 1)
+	c2 := make(chan error, 1)
+	md.observers[id1] = mdServerObserver{c1, MetadataRevision(5)}
+	md.observers[id2] = mdServerObserver{c2, MetadataRevision(7)}
+
+	regErr := errors.New("register failed")
+	client := &fakeMDServerClient{
+		failFolders: map[string]error{id2.String(): regErr},
+		registered:  make(map[string]int64),
+	}
+	ctx := context.Background()
+	md.resubscribeObservers(ctx, keybase1.MetadataClient{Cli: client})
+
+	require.Equal(t, map[string]int64{id1.String(): 5}, client.registered)
+
+	// The failed observer is signaled and removed.
+	require.Equal(t, regErr, <-c2)
+	_, ok := <-c2
+	require.False(t, ok)
+
+	// The renewed one is still waiting for its update.
+	select {
+	case err := <-c1:
+		t.Fatalf("Unexpected signal: %v", err)
+	default:
+	}
+	require.Len(t, md.observers, 1)
+
+	err := md.MetadataUpdate(ctx, keybase1.MetadataUpdateArg{
+		FolderID: id1.String(),
+		Revision: 6,
+	})
+	require.NoError(t, err)
+	require.NoError(t, <-c1)
+	require.Len(t, md.observers, 0)
+}
@@ -162,6 +162,60 @@ func TestMDServerBasics(t *testing.T) {
 // This should pass for both local and remote servers. Make sure that
 // registering multiple TLFs for updates works. This is a regression
 // test for https://keybase.atlassian.net/browse/KBFS-467 .
+func TestMDServerGetMergedDelta(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	mdServer := config.MDServer()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := tlf.MakeHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	rmdses, skipped, err := mdServer.GetMergedDelta(ctx, id, 0, 5)
+	require.NoError(t, err)
+	require.False(t, skipped)
+	require.Len(t, rmdses, 0)
+
+	prevRoot := MdID{}
+	for i := MetadataRevision(1); i <= 10; i++ {
+		brmd := makeBRMDForTest(t, config.Crypto(), id, h, i, uid, prevRoot)
+		rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+		err = mdServer.Put(ctx, rmds, nil)
+		require.NoError(t, err)
+		prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+	}
+
+	for _, test := range []struct {
+		since    MetadataRevision
+		expected []MetadataRevision
+		skipped  bool
+	}{
+		{10, nil, false},
+		{7, []MetadataRevision{8, 9, 10}, false},
+		{5, []MetadataRevision{6, 7, 8, 9, 10}, false},
+		// More than 5 revisions behind just gets the head.
+		{4, []MetadataRevision{10}, true},
+		{0, []MetadataRevision{10}, true},
+	} {
+		rmdses, skipped, err := mdServer.GetMergedDelta(
+			ctx, id, test.since, 5)
+		require.NoError(t, err)
+		require.Equal(t, test.skipped, skipped, "since %d", test.since)
+		var revs []MetadataRevision
+		for _, rmds := range rmdses {
+			revs = append(revs, rmds.MD.RevisionNumber())
+		}
+		require.Equal(t, test.expected, revs, "since %d", test.since)
+	}
+}
+
 func TestMDServerRegisterForUpdate(t *testing.T) {
 	// setup
 	config := MakeTestConfigOrBust(t, "test_user")
@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
@@ -60,6 +61,13 @@ import (
 // Writer (reader) key bundles for V3 metadata objects are stored
 // separately in dir/wkbv3 (dir/rkbv3). The number of bundles is
 // small, so no need to splay them.
+//
+// A put is made crash-safe by writing all files atomically, and in
+// dependency order: the MD object and its key bundles are written
+// first, and only then is the MD appended to its branch journal.
+// Since MD objects and key bundles are content-addressed, a crash
+// before the journal append just leaves behind unreferenced files,
+// which a retried put will reuse.
 type mdServerTlfStorage struct {
 	tlfID  tlf.ID
 	codec  kbfscodec.Codec
@@ -76,7 +84,7 @@ type mdServerTlfStorage struct {
 
 func makeMDServerTlfStorage(tlfID tlf.ID, codec kbfscodec.Codec,
 	crypto cryptoPure, clock Clock, mdVer MetadataVer,
-	dir string) *mdServerTlfStorage {
+	dir string) (*mdServerTlfStorage, error) {
 	journal := &mdServerTlfStorage{
 		tlfID:          tlfID,
 		codec:          codec,
@@ -86,7 +94,24 @@ func makeMDServerTlfStorage(tlfID tlf.ID, codec kbfscodec.Codec,
 		dir:            dir,
 		branchJournals: make(map[BranchID]mdIDJournal),
 	}
-	return journal
+
+	// Pick up the branches stored by an earlier instance, so that
+	// their heads survive a restart.
+	fileInfos, err := ioutil.ReadDir(journal.branchJournalsPath())
+	if os.IsNotExist(err) {
+		return journal, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, fi := range fileInfos {
+		bid, err := ParseBranchID(fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		journal.branchJournals[bid] = makeDurableMdIDJournal(
+			codec, filepath.Join(journal.branchJournalsPath(), fi.Name()))
+	}
+	return journal, nil
 }
 
 // The functions below are for building various paths.
@@ -186,7 +211,7 @@ func (s *mdServerTlfStorage) putMDLocked(
 		Version:     rmds.MD.Version(),
 	}
 
-	err = kbfscodec.SerializeToFile(s.codec, srmds, s.mdPath(id))
+	err = serializeToFileAtomic(s.codec, srmds, s.mdPath(id))
 	if err != nil {
 		return MdID{}, err
 	}
@@ -207,7 +232,7 @@ func (s *mdServerTlfStorage) getOrCreateBranchJournalLocked(
 		return mdIDJournal{}, err
 	}
 
-	j = makeMdIDJournal(s.codec, dir)
+	j = makeDurableMdIDJournal(s.codec, dir)
 	s.branchJournals[bid] = j
 	return j, nil
 }
@@ -392,13 +417,13 @@ func (s *mdServerTlfStorage) putExtraMetadataLocked(
 		return err
 	}
 
-	err = kbfscodec.SerializeToFile(
+	err = serializeToFileAtomic(
 		s.codec, extraV3.wkb, s.writerKeyBundleV3Path(wkbID))
 	if err != nil {
 		return err
 	}
 
-	err = kbfscodec.SerializeToFile(
+	err = serializeToFileAtomic(
 		s.codec, extraV3.rkb, s.readerKeyBundleV3Path(rkbID))
 	if err != nil {
 		return err
@@ -465,6 +490,35 @@ func (s *mdServerTlfStorage) getRange(
 	return s.getRangeReadLocked(currentUID, bid, start, stop)
 }
 
+func (s *mdServerTlfStorage) getMergedDelta(
+	currentUID keybase1.UID, since MetadataRevision, maxRevs int) (
+	[]*RootMetadataSigned, bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.isShutdownReadLocked() {
+		return nil, false, errMDServerTlfStorageShutdown
+	}
+
+	err := s.checkGetParamsReadLocked(currentUID, NullBranchID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return makeMergedDelta(since, maxRevs,
+		func() (*RootMetadataSigned, error) {
+			rmds, err := s.getHeadForTLFReadLocked(NullBranchID)
+			if err != nil {
+				return nil, MDServerError{err}
+			}
+			return rmds, nil
+		},
+		func(start, stop MetadataRevision) ([]*RootMetadataSigned, error) {
+			return s.getRangeReadLocked(
+				currentUID, NullBranchID, start, stop)
+		})
+}
+
 func (s *mdServerTlfStorage) put(
 	currentUID keybase1.UID, currentVerifyingKey kbfscrypto.VerifyingKey,
 	rmds *RootMetadataSigned, extra ExtraMetadata) (
@@ -584,6 +638,54 @@ func (s *mdServerTlfStorage) put(
 	return recordBranchID, nil
 }
 
+// finalize appends the final copy of the merged head returned by
+// makeFinal to the merged journal.
+func (s *mdServerTlfStorage) finalize(
+	makeFinal func(head *RootMetadataSigned, extra ExtraMetadata) (
+		*RootMetadataSigned, error)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.isShutdownReadLocked() {
+		return errMDServerTlfStorageShutdown
+	}
+
+	head, err := s.getHeadForTLFReadLocked(NullBranchID)
+	if err != nil {
+		return MDServerError{err}
+	}
+	var extra ExtraMetadata
+	if head != nil {
+		extra, err = s.getExtraMetadataReadLocked(
+			head.MD.GetTLFWriterKeyBundleID(),
+			head.MD.GetTLFReaderKeyBundleID())
+		if err != nil {
+			return MDServerError{err}
+		}
+	}
+
+	finalRmds, err := makeFinal(head, extra)
+	if err != nil {
+		return err
+	}
+
+	id, err := s.putMDLocked(finalRmds)
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	j, err := s.getOrCreateBranchJournalLocked(NullBranchID)
+	if err != nil {
+		return err
+	}
+
+	err = j.append(finalRmds.MD.RevisionNumber(), mdIDJournalEntry{ID: id})
+	if err != nil {
+		return MDServerError{err}
+	}
+	return nil
+}
+
 func (s *mdServerTlfStorage) getKeyBundles(
 	wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
 	*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error) {
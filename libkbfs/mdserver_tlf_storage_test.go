@@ -39,9 +39,12 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 	}()
 
 	tlfID := tlf.FakeID(1, false)
-	s := makeMDServerTlfStorage(tlfID, codec, crypto, wallClock{},
+	s, err := makeMDServerTlfStorage(tlfID, codec, crypto, wallClock{},
 		defaultClientMetadataVer, tempdir)
-	defer s.shutdown()
+	require.NoError(t, err)
+	defer func() {
+		s.shutdown()
+	}()
 
 	require.Equal(t, 0, getMDStorageLength(t, s, NullBranchID))
 
@@ -147,4 +150,102 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 
 	require.Equal(t, 10, getMDStorageLength(t, s, NullBranchID))
 	require.Equal(t, 35, getMDStorageLength(t, s, bid))
+
+	// (12) Both branches survive a restart.
+
+	s.shutdown()
+	s, err = makeMDServerTlfStorage(tlfID, codec, crypto, wallClock{},
+		defaultClientMetadataVer, tempdir)
+	require.NoError(t, err)
+
+	require.Equal(t, 10, getMDStorageLength(t, s, NullBranchID))
+	require.Equal(t, 35, getMDStorageLength(t, s, bid))
+
+	head, err = s.getForTLF(uid, NullBranchID)
+	require.NoError(t, err)
+	require.NotNil(t, head)
+	require.Equal(t, MetadataRevision(10), head.MD.RevisionNumber())
+
+	head, err = s.getForTLF(uid, bid)
+	require.NoError(t, err)
+	require.NotNil(t, head)
+	require.Equal(t, MetadataRevision(40), head.MD.RevisionNumber())
+}
+
+func TestMDServerTlfStorageFinalize(t *testing.T) {
+	codec := kbfscodec.NewMsgpack()
+	crypto := MakeCryptoCommon(codec)
+	signingKey := kbfscrypto.MakeFakeSigningKeyOrBust("test key")
+	verifyingKey := kbfscrypto.MakeFakeVerifyingKeyOrBust("test key")
+	signer := kbfscrypto.SigningKeySigner{Key: signingKey}
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	tlfID := tlf.FakeID(1, false)
+	s, err := makeMDServerTlfStorage(tlfID, codec, crypto, wallClock{},
+		defaultClientMetadataVer, tempdir)
+	require.NoError(t, err)
+	defer s.shutdown()
+
+	uid := keybase1.MakeTestUID(1)
+	h, err := tlf.MakeHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	prevRoot := MdID{}
+	var headPrevRoot MdID
+	for i := MetadataRevision(1); i <= 2; i++ {
+		brmd := makeBRMDForTest(t, crypto, tlfID, h, i, uid, prevRoot)
+		rmds := signRMDSForTest(t, codec, signer, brmd)
+		_, err := s.put(uid, verifyingKey, rmds, nil)
+		require.NoError(t, err)
+		headPrevRoot = prevRoot
+		prevRoot, err = crypto.MakeMdID(rmds.MD)
+		require.NoError(t, err)
+	}
+
+	// The first finalized handle is taken, so the second one is
+	// used.
+	now := wallClock{}.Now()
+	var finalHandle tlf.Handle
+	makeFinal := func(uid keybase1.UID) func(*RootMetadataSigned,
+		ExtraMetadata) (*RootMetadataSigned, error) {
+		return func(head *RootMetadataSigned, extra ExtraMetadata) (
+			*RootMetadataSigned, error) {
+			rmds, fh, err := makeFinalMDForServer(
+				codec, now, uid, head, extra, "u2",
+				func(h tlf.Handle) (bool, error) {
+					return h.FinalizedInfo.Number == 1, nil
+				})
+			finalHandle = fh
+			return rmds, err
+		}
+	}
+
+	// Only writers may finalize.
+	err = s.finalize(makeFinal(keybase1.MakeTestUID(2)))
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+
+	err = s.finalize(makeFinal(uid))
+	require.NoError(t, err)
+	require.Equal(t, 3, getMDStorageLength(t, s, NullBranchID))
+	require.Equal(t, uint16(2), finalHandle.FinalizedInfo.Number)
+
+	head, err := s.getForTLF(uid, NullBranchID)
+	require.NoError(t, err)
+	require.True(t, head.MD.IsFinal())
+	require.Equal(t, MetadataRevision(3), head.MD.RevisionNumber())
+	// A final MD keeps the PrevRoot of the MD it copies.
+	require.Equal(t, headPrevRoot, head.MD.GetPrevRoot())
+	headHandle, err := head.MD.MakeBareTlfHandle(nil)
+	require.NoError(t, err)
+	require.Equal(t, finalHandle, headHandle)
+
+	err = s.finalize(makeFinal(uid))
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+	require.Equal(t, 3, getMDStorageLength(t, s, NullBranchID))
 }
@@ -11,6 +11,7 @@ import (
 	merkle "github.com/keybase/go-merkle-tree"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfshash"
+	"github.com/keybase/kbfs/tlf"
 )
 
 // MerkleRootVersion is the current Merkle root version.
@@ -44,6 +45,26 @@ func (l MerkleLeaf) Construct() interface{} {
 	return []byte{}
 }
 
+// merkleTreeConfig is the shape of the MD server's Merkle trees of
+// TLF heads.
+var merkleTreeConfig = merkle.NewConfig(
+	merkle.SHA512Hasher{}, 256, 512, MerkleLeaf{})
+
+// merkleTreeIDForTLF returns the ID of the Merkle tree that holds the
+// head of the given TLF.
+func merkleTreeIDForTLF(id tlf.ID) keybase1.MerkleTreeID {
+	if id.IsPublic() {
+		return keybase1.MerkleTreeID_KBFS_PUBLIC
+	}
+	return keybase1.MerkleTreeID_KBFS_PRIVATE
+}
+
+// merkleLeafKey returns the key of the given TLF's leaf in its Merkle
+// tree.
+func merkleLeafKey(id tlf.ID) merkle.Hash {
+	return merkle.Hash(id.Bytes())
+}
+
 // MerkleHash is the hash of a RootMetadataSigned block.
 type MerkleHash struct {
 	h kbfshash.Hash
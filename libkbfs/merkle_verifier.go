@@ -0,0 +1,246 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	merkle "github.com/keybase/go-merkle-tree"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// merkleVerifierMaxChainWalk is the most roots a merkleVerifier
+// walks back through to check that a new root leads back to the one
+// it verified last.  If the server has published more roots than
+// that in between, e.g. while this device was offline, the new root
+// is accepted without checking the link, to bound the cost.
+const merkleVerifierMaxChainWalk = 128
+
+// merkleServerEngine is a read-only merkle.StorageEngine for looking
+// things up under one root of one of the MD server's Merkle trees.
+type merkleServerEngine struct {
+	ctx    context.Context
+	mdserv MDServer
+	root   merkle.Hash
+}
+
+var _ merkle.StorageEngine = merkleServerEngine{}
+
+var errMerkleServerEngineReadOnly = errors.New(
+	"The MD server's Merkle trees can't be changed by clients")
+
+// StoreNode implements the merkle.StorageEngine interface for
+// merkleServerEngine.
+func (e merkleServerEngine) StoreNode(merkle.Hash, []byte) error {
+	return errMerkleServerEngineReadOnly
+}
+
+// CommitRoot implements the merkle.StorageEngine interface for
+// merkleServerEngine.
+func (e merkleServerEngine) CommitRoot(
+	merkle.Hash, merkle.Hash, merkle.TxInfo) error {
+	return errMerkleServerEngineReadOnly
+}
+
+// LookupNode implements the merkle.StorageEngine interface for
+// merkleServerEngine.
+func (e merkleServerEngine) LookupNode(hash merkle.Hash) ([]byte, error) {
+	return e.mdserv.GetMerkleNode(e.ctx, hash)
+}
+
+// LookupRoot implements the merkle.StorageEngine interface for
+// merkleServerEngine.
+func (e merkleServerEngine) LookupRoot() (merkle.Hash, error) {
+	return e.root, nil
+}
+
+// merkleVerifierConfig is the subset of the Config interface needed
+// by merkleVerifier (for ease of testing).
+type merkleVerifierConfig interface {
+	Codec() kbfscodec.Codec
+	Crypto() Crypto
+	MDServer() MDServer
+}
+
+// merkleVerifier checks merged heads from the MD server against the
+// server's Merkle trees of TLF heads, so that the server can't roll
+// a TLF back to an older head without showing two different
+// histories of its trees, which is caught too.
+//
+// The roots of each tree form a chain numbered by sequence number,
+// since each root node includes the hash of the previous root.  The
+// verifier remembers the latest root it has verified for each tree,
+// and only accepts a newer root if it leads back to that one.  A
+// head is checked against its TLF's leaf under a root that was
+// fetched before the head: the head can't be older than the leaf,
+// and if it has the same revision, it must have the same hash.  The
+// leaf may well be older than the head, since the real MD server
+// only publishes a new root every so often.
+type merkleVerifier struct {
+	config merkleVerifierConfig
+	log    logger.Logger
+
+	// lock is held while a new root is fetched and checked, so that
+	// roots are verified in order.
+	lock  sync.Mutex
+	roots map[keybase1.MerkleTreeID]MerkleRoot
+}
+
+func newMerkleVerifier(
+	config merkleVerifierConfig, log logger.Logger) *merkleVerifier {
+	return &merkleVerifier{
+		config: config,
+		log:    log,
+		roots:  make(map[keybase1.MerkleTreeID]MerkleRoot),
+	}
+}
+
+// getRoot returns the latest root of the given tree, after checking
+// that it leads back to the one verified last, or nil if the tree is
+// still empty.
+func (v *merkleVerifier) getRoot(ctx context.Context,
+	treeID keybase1.MerkleTreeID) (*MerkleRoot, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	root, err := v.config.MDServer().GetMerkleRootLatest(ctx, treeID)
+	if err != nil {
+		return nil, err
+	}
+	prev, ok := v.roots[treeID]
+	if root == nil {
+		if ok {
+			return nil, MerkleRootRollbackError{treeID, 0, prev.SeqNo}
+		}
+		return nil, nil
+	}
+	if root.TreeID != treeID {
+		return nil, fmt.Errorf("Asked for Merkle tree %s, got a root of %s",
+			treeID, root.TreeID)
+	}
+	if ok {
+		err := v.checkChain(ctx, *root, prev)
+		if err != nil {
+			return nil, err
+		}
+	}
+	v.roots[treeID] = *root
+	return root, nil
+}
+
+// checkChain checks that root leads back to prev, which was verified
+// before, through the chain of root nodes.
+func (v *merkleVerifier) checkChain(ctx context.Context,
+	root, prev MerkleRoot) error {
+	switch {
+	case root.SeqNo < prev.SeqNo:
+		return MerkleRootRollbackError{root.TreeID, root.SeqNo, prev.SeqNo}
+	case root.SeqNo == prev.SeqNo:
+		if !root.Hash.Eq(prev.Hash) {
+			return MerkleRootEquivocationError{
+				root.TreeID, prev.SeqNo, prev.Hash, root.Hash}
+		}
+		return nil
+	case root.SeqNo-prev.SeqNo > merkleVerifierMaxChainWalk:
+		v.log.CDebugf(ctx, "Not checking the %d roots of Merkle tree %s "+
+			"since root %d", root.SeqNo-prev.SeqNo, root.TreeID,
+			prev.SeqNo)
+		return nil
+	}
+
+	mdserv := v.config.MDServer()
+	hash := root.Hash
+	for seqNo := root.SeqNo; seqNo > prev.SeqNo; seqNo-- {
+		buf, err := mdserv.GetMerkleNode(ctx, hash)
+		if err != nil {
+			return err
+		}
+		if !(merkle.SHA512Hasher{}).Hash(buf).Eq(hash) {
+			return merkle.HashMismatchError{H: hash}
+		}
+		var node merkle.Node
+		err = v.config.Codec().Decode(buf, &node)
+		if err != nil {
+			return err
+		}
+		hash = node.PrevRoot
+	}
+	if !hash.Eq(prev.Hash) {
+		return MerkleRootEquivocationError{
+			root.TreeID, prev.SeqNo, prev.Hash, hash}
+	}
+	return nil
+}
+
+// getLeaf returns the leaf of the given TLF under the given root, or
+// nil if the TLF isn't in the tree yet.  privKey is the TLF's private
+// key, which is needed if the root's leaves are encrypted.
+func (v *merkleVerifier) getLeaf(ctx context.Context,
+	root MerkleRoot, id tlf.ID, privKey kbfscrypto.TLFPrivateKey) (
+	*MerkleLeaf, error) {
+	tree := merkle.NewTree(
+		merkleServerEngine{ctx, v.config.MDServer(), root.Hash}, merkleTreeConfig)
+	val, _, err := tree.Find(merkleLeafKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, nil
+	}
+	buf, ok := val.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected Merkle leaf value of type %T",
+			val)
+	}
+
+	if root.EPubKey == nil {
+		var leaf MerkleLeaf
+		err := v.config.Codec().Decode(buf, &leaf)
+		if err != nil {
+			return nil, err
+		}
+		return &leaf, nil
+	}
+	if root.Nonce == nil {
+		return nil, errors.New("Merkle root with encrypted leaves " +
+			"has no nonce")
+	}
+	var encryptedLeaf EncryptedMerkleLeaf
+	err = v.config.Codec().Decode(buf, &encryptedLeaf)
+	if err != nil {
+		return nil, err
+	}
+	return v.config.Crypto().DecryptMerkleLeaf(
+		encryptedLeaf, privKey, root.Nonce, *root.EPubKey)
+}
+
+// checkHead checks the given merged head of the given TLF, which has
+// the given Merkle hash, against the TLF's leaf under root, which
+// must have been fetched before the head.  privKey is as for getLeaf.
+func (v *merkleVerifier) checkHead(ctx context.Context,
+	root MerkleRoot, id tlf.ID, rev MetadataRevision, hash MerkleHash,
+	privKey kbfscrypto.TLFPrivateKey) error {
+	leaf, err := v.getLeaf(ctx, root, id, privKey)
+	if err != nil {
+		return err
+	}
+	switch {
+	case leaf == nil:
+		return nil
+	case leaf.Revision > rev:
+		return MDRollbackError{id, rev, leaf.Revision}
+	case leaf.Revision == rev && !bytes.Equal(
+		leaf.Hash.Bytes(), hash.Bytes()):
+		return MDEquivocationError{id, rev}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	merkle "github.com/keybase/go-merkle-tree"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// testMerkleMDServer serves Merkle trees from trees, which can be
+// swapped out to emulate a misbehaving server.
+type testMerkleMDServer struct {
+	MDServer
+	trees *mdServerLocalMerkleTrees
+}
+
+func (s *testMerkleMDServer) GetMerkleRootLatest(_ context.Context,
+	treeID keybase1.MerkleTreeID) (*MerkleRoot, error) {
+	return s.trees.getRootLatest(treeID), nil
+}
+
+func (s *testMerkleMDServer) GetMerkleNode(
+	_ context.Context, hash merkle.Hash) ([]byte, error) {
+	return s.trees.getNode(hash)
+}
+
+// rollbackMDServer returns old as the merged head of every TLF.
+type rollbackMDServer struct {
+	MDServer
+	old func() *RootMetadataSigned
+}
+
+func (s rollbackMDServer) GetForTLF(ctx context.Context, id tlf.ID,
+	bid BranchID, mStatus MergeStatus) (*RootMetadataSigned, error) {
+	return s.old(), nil
+}
+
+type testMerkleVerifierConfig struct {
+	Config
+	mdserv MDServer
+}
+
+func (c testMerkleVerifierConfig) MDServer() MDServer {
+	return c.mdserv
+}
+
+// makeMerkleTestHeads creates some files in a private TLF, and returns
+// all of its merged MDs.
+func makeMerkleTestHeads(ctx context.Context, t *testing.T,
+	config Config) (tlf.ID, []*RootMetadataSigned) {
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		_, _, err := config.KBFSOps().CreateFile(
+			ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+	}
+	id := rootNode.GetFolderBranch().Tlf
+	rmdses, err := config.MDServer().GetRange(
+		ctx, id, NullBranchID, Merged, MetadataRevisionInitial, 100)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 6)
+	return id, rmdses
+}
+
+func TestMerkleVerifierCheckHead(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	id, rmdses := makeMerkleTestHeads(ctx, t, config)
+
+	v := newMerkleVerifier(config, config.MakeLogger(""))
+	root, err := v.getRoot(ctx, keybase1.MerkleTreeID_KBFS_PRIVATE)
+	require.NoError(t, err)
+	require.NotNil(t, root)
+	check := func(rev MetadataRevision, rmds *RootMetadataSigned) error {
+		hash, err := config.Crypto().MakeMerkleHash(rmds)
+		require.NoError(t, err)
+		return v.checkHead(
+			ctx, *root, id, rev, hash, kbfscrypto.TLFPrivateKey{})
+	}
+
+	head, prev := rmdses[len(rmdses)-1], rmdses[len(rmdses)-2]
+	headRev := head.MD.RevisionNumber()
+	require.NoError(t, check(headRev, head))
+	err = check(headRev-1, prev)
+	require.Equal(t, MDRollbackError{id, headRev - 1, headRev}, err)
+
+	// A different MD with the head's revision doesn't match the
+	// tree.
+	err = check(headRev, prev)
+	require.Equal(t, MDEquivocationError{id, headRev}, err)
+
+	// A TLF that isn't in the tree yet can't be checked.
+	err = v.checkHead(ctx, *root, tlf.FakeID(1, false), 1, MerkleHash{},
+		kbfscrypto.TLFPrivateKey{})
+	require.NoError(t, err)
+}
+
+func TestMDOpsMerkleRollback(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	id, rmdses := makeMerkleTestHeads(ctx, t, config)
+	headRev := rmdses[len(rmdses)-1].MD.RevisionNumber()
+
+	mdserv := rollbackMDServer{config.MDServer(),
+		func() *RootMetadataSigned {
+			rmdses, err := config.MDServer().GetRange(
+				ctx, id, NullBranchID, Merged, headRev-1, headRev-1)
+			require.NoError(t, err)
+			return rmdses[0]
+		}}
+	mdOps := NewMDOpsStandard(testMerkleVerifierConfig{config, mdserv})
+	_, err := mdOps.GetForTLF(ctx, id)
+	require.Equal(t, MDRollbackError{id, headRev - 1, headRev}, err)
+}
+
+func TestMerkleVerifierRootChain(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	_, rmdses := makeMerkleTestHeads(ctx, t, config)
+
+	// Use the same timestamps for every tree, so that trees with
+	// the same heads have the same roots.
+	clock := newTestClockNow()
+	makeTrees := func(heads ...*RootMetadataSigned) *mdServerLocalMerkleTrees {
+		trees := newMDServerLocalMerkleTrees(
+			config.Codec(), config.Crypto(), clock)
+		for _, rmds := range heads {
+			require.NoError(t, trees.putHead(rmds))
+		}
+		return trees
+	}
+	mdserv := &testMerkleMDServer{
+		trees: makeTrees(rmdses[0], rmdses[1]),
+	}
+	v := newMerkleVerifier(
+		testMerkleVerifierConfig{config, mdserv}, config.MakeLogger(""))
+	treeID := keybase1.MerkleTreeID_KBFS_PRIVATE
+	getRoot := func() (*MerkleRoot, error) {
+		return v.getRoot(ctx, treeID)
+	}
+
+	root, err := getRoot()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), root.SeqNo)
+	// A root that extends the verified one is fine.
+	require.NoError(t, mdserv.trees.putHead(rmdses[2]))
+	require.NoError(t, mdserv.trees.putHead(rmdses[3]))
+	root, err = getRoot()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), root.SeqNo)
+	verifiedHash := root.Hash
+
+	// A server that goes back to an older root is caught.
+	mdserv.trees = makeTrees(rmdses[0], rmdses[1])
+	_, err = getRoot()
+	require.Equal(t, MerkleRootRollbackError{treeID, 2, 4}, err)
+
+	// So is one that shows a different root with the same
+	// sequence number...
+	forked := makeTrees(rmdses[0], rmdses[2], rmdses[3], rmdses[4])
+	mdserv.trees = forked
+	_, err = getRoot()
+	require.Equal(t, MerkleRootEquivocationError{treeID, 4, verifiedHash,
+		forked.getRootLatest(treeID).Hash}, err)
+
+	// ...or a newer root that doesn't lead back to the verified
+	// one.
+	forked = makeTrees(rmdses[0], rmdses[1], rmdses[3], rmdses[4])
+	forkedHash := forked.getRootLatest(treeID).Hash
+	require.NoError(t, forked.putHead(rmdses[5]))
+	mdserv.trees = forked
+	_, err = getRoot()
+	require.Equal(t, MerkleRootEquivocationError{treeID, 4, verifiedHash,
+		forkedHash}, err)
+
+	// The verified root is still the old one.
+	mdserv.trees = makeTrees(rmdses...)
+	root, err = getRoot()
+	require.NoError(t, err)
+	require.Equal(t, int64(6), root.SeqNo)
+}
+
+func TestMerkleVerifierEncryptedLeaf(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+	crypto := config.Crypto()
+
+	pubKey, privKey, ePubKey, ePrivKey, _, err := crypto.MakeRandomTLFKeys()
+	require.NoError(t, err)
+	var nonce [24]byte
+	nonce[0] = 1
+	id := tlf.FakeID(1, false)
+	leaf := MerkleLeaf{Revision: 10, Timestamp: 1}
+	encryptedLeaf, err := crypto.EncryptMerkleLeaf(
+		leaf, pubKey, &nonce, ePrivKey)
+	require.NoError(t, err)
+	buf, err := config.Codec().Encode(encryptedLeaf)
+	require.NoError(t, err)
+
+	engine := merkle.NewMemEngine()
+	err = merkle.NewTree(engine, merkleTreeConfig).Upsert(
+		merkle.KeyValuePair{Key: merkleLeafKey(id), Value: buf}, nil)
+	require.NoError(t, err)
+	hash, err := engine.LookupRoot()
+	require.NoError(t, err)
+	treeID := keybase1.MerkleTreeID_KBFS_PRIVATE
+	root := &MerkleRoot{
+		Version: MerkleRootVersion,
+		TreeID:  treeID,
+		SeqNo:   1,
+		Hash:    hash,
+		EPubKey: &ePubKey,
+		Nonce:   &nonce,
+	}
+	trees := newMDServerLocalMerkleTrees(
+		config.Codec(), config.Crypto(), config.Clock())
+	trees.trees[treeID] = &mdServerLocalMerkleTree{
+		engine: engine,
+		latest: root,
+	}
+	v := newMerkleVerifier(testMerkleVerifierConfig{
+		config, &testMerkleMDServer{trees: trees}}, config.MakeLogger(""))
+
+	gotLeaf, err := v.getLeaf(ctx, *root, id, privKey)
+	require.NoError(t, err)
+	require.Equal(t, leaf, *gotLeaf)
+	err = v.checkHead(ctx, *root, id, 9, MerkleHash{}, privKey)
+	require.Equal(t, MDRollbackError{id, 9, 10}, err)
+}
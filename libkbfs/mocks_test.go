@@ -8,11 +8,13 @@ import (
 	libkb "github.com/keybase/client/go/libkb"
 	logger "github.com/keybase/client/go/logger"
 	keybase1 "github.com/keybase/client/go/protocol/keybase1"
+	go_merkle_tree "github.com/keybase/go-merkle-tree"
 	kbfscodec "github.com/keybase/kbfs/kbfscodec"
 	kbfscrypto "github.com/keybase/kbfs/kbfscrypto"
 	tlf "github.com/keybase/kbfs/tlf"
 	go_metrics "github.com/rcrowley/go-metrics"
 	context "golang.org/x/net/context"
+	os "os"
 	time "time"
 )
 
@@ -165,6 +167,132 @@ func (_mr *_MockNodeRecorder) GetBasename() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetBasename")
 }
 
+// Mock of BatchOps interface
+type MockBatchOps struct {
+	ctrl     *gomock.Controller
+	recorder *_MockBatchOpsRecorder
+}
+
+// Recorder for MockBatchOps (not exported)
+type _MockBatchOpsRecorder struct {
+	mock *MockBatchOps
+}
+
+func NewMockBatchOps(ctrl *gomock.Controller) *MockBatchOps {
+	mock := &MockBatchOps{ctrl: ctrl}
+	mock.recorder = &_MockBatchOpsRecorder{mock}
+	return mock
+}
+
+func (_m *MockBatchOps) EXPECT() *_MockBatchOpsRecorder {
+	return _m.recorder
+}
+
+func (_m *MockBatchOps) CreateDir(ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CreateDir", ctx, dir, name)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockBatchOpsRecorder) CreateDir(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateDir", arg0, arg1, arg2)
+}
+
+func (_m *MockBatchOps) CreateFile(ctx context.Context, dir Node, name string, isExec bool) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CreateFile", ctx, dir, name, isExec)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockBatchOpsRecorder) CreateFile(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateFile", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockBatchOps) CreateLink(ctx context.Context, dir Node, fromName string, toPath string) (EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CreateLink", ctx, dir, fromName, toPath)
+	ret0, _ := ret[0].(EntryInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockBatchOpsRecorder) CreateLink(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateLink", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockBatchOps) RemoveDir(ctx context.Context, dir Node, dirName string) error {
+	ret := _m.ctrl.Call(_m, "RemoveDir", ctx, dir, dirName)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBatchOpsRecorder) RemoveDir(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveDir", arg0, arg1, arg2)
+}
+
+func (_m *MockBatchOps) RemoveEntry(ctx context.Context, dir Node, name string) error {
+	ret := _m.ctrl.Call(_m, "RemoveEntry", ctx, dir, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBatchOpsRecorder) RemoveEntry(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveEntry", arg0, arg1, arg2)
+}
+
+func (_m *MockBatchOps) Rename(ctx context.Context, oldParent Node, oldName string, newParent Node, newName string) error {
+	ret := _m.ctrl.Call(_m, "Rename", ctx, oldParent, oldName, newParent, newName)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBatchOpsRecorder) Rename(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Rename", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockBatchOps) Write(ctx context.Context, file Node, data []byte, off int64) error {
+	ret := _m.ctrl.Call(_m, "Write", ctx, file, data, off)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBatchOpsRecorder) Write(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Write", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockBatchOps) Truncate(ctx context.Context, file Node, size uint64) error {
+	ret := _m.ctrl.Call(_m, "Truncate", ctx, file, size)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBatchOpsRecorder) Truncate(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Truncate", arg0, arg1, arg2)
+}
+
+func (_m *MockBatchOps) SetEx(ctx context.Context, file Node, ex bool) error {
+	ret := _m.ctrl.Call(_m, "SetEx", ctx, file, ex)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBatchOpsRecorder) SetEx(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetEx", arg0, arg1, arg2)
+}
+
+func (_m *MockBatchOps) SetMtime(ctx context.Context, file Node, mtime *time.Time) error {
+	ret := _m.ctrl.Call(_m, "SetMtime", ctx, file, mtime)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBatchOpsRecorder) SetMtime(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMtime", arg0, arg1, arg2)
+}
+
 // Mock of KBFSOps interface
 type MockKBFSOps struct {
 	ctrl     *gomock.Controller
@@ -197,6 +325,17 @@ func (_mr *_MockKBFSOpsRecorder) GetFavorites(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetFavorites", arg0)
 }
 
+func (_m *MockKBFSOps) GetFavoritesWithMetadata(ctx context.Context) ([]FavoriteWithMetadata, error) {
+	ret := _m.ctrl.Call(_m, "GetFavoritesWithMetadata", ctx)
+	ret0, _ := ret[0].([]FavoriteWithMetadata)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetFavoritesWithMetadata(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetFavoritesWithMetadata", arg0)
+}
+
 func (_m *MockKBFSOps) RefreshCachedFavorites(ctx context.Context) {
 	_m.ctrl.Call(_m, "RefreshCachedFavorites", ctx)
 }
@@ -283,6 +422,18 @@ func (_mr *_MockKBFSOpsRecorder) GetDirChildren(arg0, arg1 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetDirChildren", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) GetDirChildrenPaged(ctx context.Context, dir Node, cursor string, limit int) ([]DirChild, string, error) {
+	ret := _m.ctrl.Call(_m, "GetDirChildrenPaged", ctx, dir, cursor, limit)
+	ret0, _ := ret[0].([]DirChild)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetDirChildrenPaged(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetDirChildrenPaged", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) Lookup(ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
 	ret := _m.ctrl.Call(_m, "Lookup", ctx, dir, name)
 	ret0, _ := ret[0].(Node)
@@ -341,6 +492,17 @@ func (_mr *_MockKBFSOpsRecorder) CreateLink(arg0, arg1, arg2, arg3 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateLink", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockKBFSOps) CreateSpecialFile(ctx context.Context, dir Node, name string, special SpecialFileType) (EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CreateSpecialFile", ctx, dir, name, special)
+	ret0, _ := ret[0].(EntryInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) CreateSpecialFile(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateSpecialFile", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) RemoveDir(ctx context.Context, dir Node, dirName string) error {
 	ret := _m.ctrl.Call(_m, "RemoveDir", ctx, dir, dirName)
 	ret0, _ := ret[0].(error)
@@ -351,6 +513,16 @@ func (_mr *_MockKBFSOpsRecorder) RemoveDir(arg0, arg1, arg2 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveDir", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) RemoveEntryIfUnchanged(ctx context.Context, dir Node, name string, node Node) error {
+	ret := _m.ctrl.Call(_m, "RemoveEntryIfUnchanged", ctx, dir, name, node)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RemoveEntryIfUnchanged(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveEntryIfUnchanged", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) RemoveEntry(ctx context.Context, dir Node, name string) error {
 	ret := _m.ctrl.Call(_m, "RemoveEntry", ctx, dir, name)
 	ret0, _ := ret[0].(error)
@@ -361,6 +533,28 @@ func (_mr *_MockKBFSOpsRecorder) RemoveEntry(arg0, arg1, arg2 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveEntry", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) EstimateCopy(ctx context.Context, dir Node, entries []DryRunEntry) (CostEstimate, error) {
+	ret := _m.ctrl.Call(_m, "EstimateCopy", ctx, dir, entries)
+	ret0, _ := ret[0].(CostEstimate)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) EstimateCopy(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EstimateCopy", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) EstimateRemove(ctx context.Context, dir Node, name string) (CostEstimate, error) {
+	ret := _m.ctrl.Call(_m, "EstimateRemove", ctx, dir, name)
+	ret0, _ := ret[0].(CostEstimate)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) EstimateRemove(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EstimateRemove", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) Rename(ctx context.Context, oldParent Node, oldName string, newParent Node, newName string) error {
 	ret := _m.ctrl.Call(_m, "Rename", ctx, oldParent, oldName, newParent, newName)
 	ret0, _ := ret[0].(error)
@@ -392,6 +586,17 @@ func (_mr *_MockKBFSOpsRecorder) Write(arg0, arg1, arg2, arg3 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Write", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockKBFSOps) Append(ctx context.Context, file Node, data []byte) (int64, error) {
+	ret := _m.ctrl.Call(_m, "Append", ctx, file, data)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) Append(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Append", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) Truncate(ctx context.Context, file Node, size uint64) error {
 	ret := _m.ctrl.Call(_m, "Truncate", ctx, file, size)
 	ret0, _ := ret[0].(error)
@@ -412,6 +617,26 @@ func (_mr *_MockKBFSOpsRecorder) SetEx(arg0, arg1, arg2 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetEx", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) SetAppendOnly(ctx context.Context, file Node, appendOnly bool) error {
+	ret := _m.ctrl.Call(_m, "SetAppendOnly", ctx, file, appendOnly)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetAppendOnly(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetAppendOnly", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) SetPerm(ctx context.Context, node Node, perm os.FileMode) error {
+	ret := _m.ctrl.Call(_m, "SetPerm", ctx, node, perm)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetPerm(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetPerm", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) SetMtime(ctx context.Context, file Node, mtime *time.Time) error {
 	ret := _m.ctrl.Call(_m, "SetMtime", ctx, file, mtime)
 	ret0, _ := ret[0].(error)
@@ -422,6 +647,26 @@ func (_mr *_MockKBFSOpsRecorder) SetMtime(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMtime", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) SetXattr(ctx context.Context, node Node, name string, value []byte) error {
+	ret := _m.ctrl.Call(_m, "SetXattr", ctx, node, name, value)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetXattr(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetXattr", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) RemoveXattr(ctx context.Context, node Node, name string) error {
+	ret := _m.ctrl.Call(_m, "RemoveXattr", ctx, node, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RemoveXattr(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveXattr", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) Sync(ctx context.Context, file Node) error {
 	ret := _m.ctrl.Call(_m, "Sync", ctx, file)
 	ret0, _ := ret[0].(error)
@@ -432,6 +677,39 @@ func (_mr *_MockKBFSOpsRecorder) Sync(arg0, arg1 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Sync", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) RunBatch(ctx context.Context, fn func(BatchOps) error) error {
+	ret := _m.ctrl.Call(_m, "RunBatch", ctx, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RunBatch(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RunBatch", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) LockFileRange(ctx context.Context, file Node, off uint64, length uint64, wait bool) (*FileRangeLock, error) {
+	ret := _m.ctrl.Call(_m, "LockFileRange", ctx, file, off, length, wait)
+	ret0, _ := ret[0].(*FileRangeLock)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) LockFileRange(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LockFileRange", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockKBFSOps) GetParent(ctx context.Context, node Node) (Node, string, error) {
+	ret := _m.ctrl.Call(_m, "GetParent", ctx, node)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetParent(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetParent", arg0, arg1)
+}
+
 func (_m *MockKBFSOps) FolderStatus(ctx context.Context, folderBranch FolderBranch) (FolderBranchStatus, <-chan StatusUpdate, error) {
 	ret := _m.ctrl.Call(_m, "FolderStatus", ctx, folderBranch)
 	ret0, _ := ret[0].(FolderBranchStatus)
@@ -444,6 +722,16 @@ func (_mr *_MockKBFSOpsRecorder) FolderStatus(arg0, arg1 interface{}) *gomock.Ca
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "FolderStatus", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) SetBlockPolicy(ctx context.Context, folderBranch FolderBranch, policy BlockPolicy) error {
+	ret := _m.ctrl.Call(_m, "SetBlockPolicy", ctx, folderBranch, policy)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetBlockPolicy(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockPolicy", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) Status(ctx context.Context) (KBFSStatus, <-chan StatusUpdate, error) {
 	ret := _m.ctrl.Call(_m, "Status", ctx)
 	ret0, _ := ret[0].(KBFSStatus)
@@ -456,6 +744,111 @@ func (_mr *_MockKBFSOpsRecorder) Status(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Status", arg0)
 }
 
+func (_m *MockKBFSOps) GetKBFSStatus(ctx context.Context) (KBFSStatusSnapshot, error) {
+	ret := _m.ctrl.Call(_m, "GetKBFSStatus", ctx)
+	ret0, _ := ret[0].(KBFSStatusSnapshot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetKBFSStatus(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetKBFSStatus", arg0)
+}
+
+func (_m *MockKBFSOps) SetManualConflictResolution(ctx context.Context, folderBranch FolderBranch, manual bool) error {
+	ret := _m.ctrl.Call(_m, "SetManualConflictResolution", ctx, folderBranch, manual)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetManualConflictResolution(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetManualConflictResolution", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) GetConflicts(ctx context.Context, folderBranch FolderBranch) ([]ConflictInfo, error) {
+	ret := _m.ctrl.Call(_m, "GetConflicts", ctx, folderBranch)
+	ret0, _ := ret[0].([]ConflictInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetConflicts(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetConflicts", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) ResolveConflict(ctx context.Context, folderBranch FolderBranch, path string, choice ConflictChoice) error {
+	ret := _m.ctrl.Call(_m, "ResolveConflict", ctx, folderBranch, path, choice)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) ResolveConflict(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ResolveConflict", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) PreviewConflictResolution(ctx context.Context, folderBranch FolderBranch) (ConflictResolutionPreview, error) {
+	ret := _m.ctrl.Call(_m, "PreviewConflictResolution", ctx, folderBranch)
+	ret0, _ := ret[0].(ConflictResolutionPreview)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) PreviewConflictResolution(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PreviewConflictResolution", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) SetAccessLogging(ctx context.Context, folderBranch FolderBranch, enabled bool) error {
+	ret := _m.ctrl.Call(_m, "SetAccessLogging", ctx, folderBranch, enabled)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetAccessLogging(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetAccessLogging", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) GetAccessLog(ctx context.Context, folderBranch FolderBranch) ([]AccessLogEntry, error) {
+	ret := _m.ctrl.Call(_m, "GetAccessLog", ctx, folderBranch)
+	ret0, _ := ret[0].([]AccessLogEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetAccessLog(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetAccessLog", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) PruneAccessLog(ctx context.Context, folderBranch FolderBranch, before time.Time) error {
+	ret := _m.ctrl.Call(_m, "PruneAccessLog", ctx, folderBranch, before)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) PruneAccessLog(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PruneAccessLog", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) UserKeysChanged(ctx context.Context, uid keybase1.UID) error {
+	ret := _m.ctrl.Call(_m, "UserKeysChanged", ctx, uid)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) UserKeysChanged(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UserKeysChanged", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) GetTLFAccessLog(ctx context.Context, folderBranch FolderBranch, since time.Time) ([]TLFAccessEvent, error) {
+	ret := _m.ctrl.Call(_m, "GetTLFAccessLog", ctx, folderBranch, since)
+	ret0, _ := ret[0].([]TLFAccessEvent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetTLFAccessLog(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTLFAccessLog", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) UnstageForTesting(ctx context.Context, folderBranch FolderBranch) error {
 	ret := _m.ctrl.Call(_m, "UnstageForTesting", ctx, folderBranch)
 	ret0, _ := ret[0].(error)
@@ -508,6 +901,39 @@ func (_mr *_MockKBFSOpsRecorder) GetEditHistory(arg0, arg1 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetEditHistory", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) GetKeyGenerations(ctx context.Context, tlfID tlf.ID) ([]KeyGenerationInfo, error) {
+	ret := _m.ctrl.Call(_m, "GetKeyGenerations", ctx, tlfID)
+	ret0, _ := ret[0].([]KeyGenerationInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetKeyGenerations(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetKeyGenerations", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) GetUserQuotaInfo(ctx context.Context) (QuotaUsage, error) {
+	ret := _m.ctrl.Call(_m, "GetUserQuotaInfo", ctx)
+	ret0, _ := ret[0].(QuotaUsage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetUserQuotaInfo(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUserQuotaInfo", arg0)
+}
+
+func (_m *MockKBFSOps) GetOpenFolderBranches(ctx context.Context) ([]FolderBranch, error) {
+	ret := _m.ctrl.Call(_m, "GetOpenFolderBranches", ctx)
+	ret0, _ := ret[0].([]FolderBranch)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetOpenFolderBranches(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetOpenFolderBranches", arg0)
+}
+
 func (_m *MockKBFSOps) GetNodeMetadata(ctx context.Context, node Node) (NodeMetadata, error) {
 	ret := _m.ctrl.Call(_m, "GetNodeMetadata", ctx, node)
 	ret0, _ := ret[0].(NodeMetadata)
@@ -1362,6 +1788,27 @@ func (_mr *_MockReporterRecorder) AllKnownErrors() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "AllKnownErrors")
 }
 
+func (_m *MockReporter) ErrorReports() []ErrorReport {
+	ret := _m.ctrl.Call(_m, "ErrorReports")
+	ret0, _ := ret[0].([]ErrorReport)
+	return ret0
+}
+
+func (_mr *_MockReporterRecorder) ErrorReports() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ErrorReports")
+}
+
+func (_m *MockReporter) SubscribeToErrorReports() (<-chan ErrorReport, func()) {
+	ret := _m.ctrl.Call(_m, "SubscribeToErrorReports")
+	ret0, _ := ret[0].(<-chan ErrorReport)
+	ret1, _ := ret[1].(func())
+	return ret0, ret1
+}
+
+func (_mr *_MockReporterRecorder) SubscribeToErrorReports() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SubscribeToErrorReports")
+}
+
 func (_m *MockReporter) Notify(ctx context.Context, notification *keybase1.FSNotification) {
 	_m.ctrl.Call(_m, "Notify", ctx, notification)
 }
@@ -1488,6 +1935,14 @@ func (_mr *_MockKeyCacheRecorder) PutTLFCryptKey(arg0, arg1, arg2 interface{}) *
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutTLFCryptKey", arg0, arg1, arg2)
 }
 
+func (_m *MockKeyCache) Clear() {
+	_m.ctrl.Call(_m, "Clear")
+}
+
+func (_mr *_MockKeyCacheRecorder) Clear() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Clear")
+}
+
 // Mock of BlockCache interface
 type MockBlockCache struct {
 	ctrl     *gomock.Controller
@@ -1927,16 +2382,16 @@ func (_mr *_MockcryptoPureRecorder) DecryptPrivateMetadata(arg0, arg1 interface{
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DecryptPrivateMetadata", arg0, arg1)
 }
 
-func (_m *MockcryptoPure) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (int, EncryptedBlock, error) {
-	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key)
+func (_m *MockcryptoPure) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey, ver EncryptionVer) (int, EncryptedBlock, error) {
+	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key, ver)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(EncryptedBlock)
 	ret2, _ := ret[2].(error)
 	return ret0, ret1, ret2
 }
 
-func (_mr *_MockcryptoPureRecorder) EncryptBlock(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1)
+func (_mr *_MockcryptoPureRecorder) EncryptBlock(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1, arg2)
 }
 
 func (_m *MockcryptoPure) DecryptBlock(encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey, block Block) error {
@@ -2257,16 +2712,16 @@ func (_mr *_MockCryptoRecorder) DecryptPrivateMetadata(arg0, arg1 interface{}) *
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DecryptPrivateMetadata", arg0, arg1)
 }
 
-func (_m *MockCrypto) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (int, EncryptedBlock, error) {
-	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key)
+func (_m *MockCrypto) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey, ver EncryptionVer) (int, EncryptedBlock, error) {
+	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key, ver)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(EncryptedBlock)
 	ret2, _ := ret[2].(error)
 	return ret0, ret1, ret2
 }
 
-func (_mr *_MockCryptoRecorder) EncryptBlock(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1)
+func (_mr *_MockCryptoRecorder) EncryptBlock(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1, arg2)
 }
 
 func (_m *MockCrypto) DecryptBlock(encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey, block Block) error {
@@ -2507,6 +2962,18 @@ func (_mr *_MockMDOpsRecorder) GetUnmergedRange(arg0, arg1, arg2, arg3, arg4 int
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUnmergedRange", arg0, arg1, arg2, arg3, arg4)
 }
 
+func (_m *MockMDOps) GetMergedDelta(ctx context.Context, id tlf.ID, since MetadataRevision, maxRevs int) ([]ImmutableRootMetadata, bool, error) {
+	ret := _m.ctrl.Call(_m, "GetMergedDelta", ctx, id, since, maxRevs)
+	ret0, _ := ret[0].([]ImmutableRootMetadata)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockMDOpsRecorder) GetMergedDelta(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetMergedDelta", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockMDOps) Put(ctx context.Context, rmd *RootMetadata) (MdID, error) {
 	ret := _m.ctrl.Call(_m, "Put", ctx, rmd)
 	ret0, _ := ret[0].(MdID)
@@ -2561,6 +3028,17 @@ func (_mr *_MockMDOpsRecorder) GetLatestHandleForTLF(arg0, arg1 interface{}) *go
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetLatestHandleForTLF", arg0, arg1)
 }
 
+func (_m *MockMDOps) GetChangeSummary(ctx context.Context, handle *TlfHandle, since MetadataRevision) (ChangeSummary, error) {
+	ret := _m.ctrl.Call(_m, "GetChangeSummary", ctx, handle, since)
+	ret0, _ := ret[0].(ChangeSummary)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDOpsRecorder) GetChangeSummary(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetChangeSummary", arg0, arg1, arg2)
+}
+
 // Mock of KeyOps interface
 type MockKeyOps struct {
 	ctrl     *gomock.Controller
@@ -2778,6 +3256,18 @@ func (_mr *_MockMDServerRecorder) GetRange(arg0, arg1, arg2, arg3, arg4, arg5 in
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRange", arg0, arg1, arg2, arg3, arg4, arg5)
 }
 
+func (_m *MockMDServer) GetMergedDelta(ctx context.Context, id tlf.ID, since MetadataRevision, maxRevs int) ([]*RootMetadataSigned, bool, error) {
+	ret := _m.ctrl.Call(_m, "GetMergedDelta", ctx, id, since, maxRevs)
+	ret0, _ := ret[0].([]*RootMetadataSigned)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockMDServerRecorder) GetMergedDelta(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetMergedDelta", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockMDServer) Put(ctx context.Context, rmds *RootMetadataSigned, extra ExtraMetadata) error {
 	ret := _m.ctrl.Call(_m, "Put", ctx, rmds, extra)
 	ret0, _ := ret[0].(error)
@@ -2897,8 +3387,30 @@ func (_m *MockMDServer) GetKeyBundles(ctx context.Context, tlfID tlf.ID, wkbID T
 	return ret0, ret1, ret2
 }
 
-func (_mr *_MockMDServerRecorder) GetKeyBundles(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetKeyBundles", arg0, arg1, arg2, arg3)
+func (_mr *_MockMDServerRecorder) GetKeyBundles(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetKeyBundles", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockMDServer) GetMerkleRootLatest(ctx context.Context, treeID keybase1.MerkleTreeID) (*MerkleRoot, error) {
+	ret := _m.ctrl.Call(_m, "GetMerkleRootLatest", ctx, treeID)
+	ret0, _ := ret[0].(*MerkleRoot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) GetMerkleRootLatest(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetMerkleRootLatest", arg0, arg1)
+}
+
+func (_m *MockMDServer) GetMerkleNode(ctx context.Context, hash go_merkle_tree.Hash) ([]byte, error) {
+	ret := _m.ctrl.Call(_m, "GetMerkleNode", ctx, hash)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) GetMerkleNode(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetMerkleNode", arg0, arg1)
 }
 
 // Mock of mdServerLocal interface
@@ -2964,6 +3476,18 @@ func (_mr *_MockmdServerLocalRecorder) GetRange(arg0, arg1, arg2, arg3, arg4, ar
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRange", arg0, arg1, arg2, arg3, arg4, arg5)
 }
 
+func (_m *MockmdServerLocal) GetMergedDelta(ctx context.Context, id tlf.ID, since MetadataRevision, maxRevs int) ([]*RootMetadataSigned, bool, error) {
+	ret := _m.ctrl.Call(_m, "GetMergedDelta", ctx, id, since, maxRevs)
+	ret0, _ := ret[0].([]*RootMetadataSigned)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockmdServerLocalRecorder) GetMergedDelta(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetMergedDelta", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockmdServerLocal) Put(ctx context.Context, rmds *RootMetadataSigned, extra ExtraMetadata) error {
 	ret := _m.ctrl.Call(_m, "Put", ctx, rmds, extra)
 	ret0, _ := ret[0].(error)
@@ -3087,6 +3611,28 @@ func (_mr *_MockmdServerLocalRecorder) GetKeyBundles(arg0, arg1, arg2, arg3 inte
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetKeyBundles", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockmdServerLocal) GetMerkleRootLatest(ctx context.Context, treeID keybase1.MerkleTreeID) (*MerkleRoot, error) {
+	ret := _m.ctrl.Call(_m, "GetMerkleRootLatest", ctx, treeID)
+	ret0, _ := ret[0].(*MerkleRoot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockmdServerLocalRecorder) GetMerkleRootLatest(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetMerkleRootLatest", arg0, arg1)
+}
+
+func (_m *MockmdServerLocal) GetMerkleNode(ctx context.Context, hash go_merkle_tree.Hash) ([]byte, error) {
+	ret := _m.ctrl.Call(_m, "GetMerkleNode", ctx, hash)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockmdServerLocalRecorder) GetMerkleNode(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetMerkleNode", arg0, arg1)
+}
+
 func (_m *MockmdServerLocal) addNewAssertionForTest(uid keybase1.UID, newAssertion keybase1.SocialAssertion) error {
 	ret := _m.ctrl.Call(_m, "addNewAssertionForTest", uid, newAssertion)
 	ret0, _ := ret[0].(error)
@@ -3128,6 +3674,16 @@ func (_mr *_MockmdServerLocalRecorder) copy(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "copy", arg0)
 }
 
+func (_m *MockmdServerLocal) finalizeTLF(ctx context.Context, id tlf.ID, resetUser libkb.NormalizedUsername) error {
+	ret := _m.ctrl.Call(_m, "finalizeTLF", ctx, id, resetUser)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockmdServerLocalRecorder) finalizeTLF(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "finalizeTLF", arg0, arg1, arg2)
+}
+
 // Mock of BlockServer interface
 type MockBlockServer struct {
 	ctrl     *gomock.Controller
@@ -3179,6 +3735,16 @@ func (_mr *_MockBlockServerRecorder) Put(arg0, arg1, arg2, arg3, arg4, arg5 inte
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Put", arg0, arg1, arg2, arg3, arg4, arg5)
 }
 
+func (_m *MockBlockServer) PutBlocks(ctx context.Context, tlfID tlf.ID, puts []BlockPut) []error {
+	ret := _m.ctrl.Call(_m, "PutBlocks", ctx, tlfID, puts)
+	ret0, _ := ret[0].([]error)
+	return ret0
+}
+
+func (_mr *_MockBlockServerRecorder) PutBlocks(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutBlocks", arg0, arg1, arg2)
+}
+
 func (_m *MockBlockServer) AddBlockReference(ctx context.Context, tlfID tlf.ID, id BlockID, context BlockContext) error {
 	ret := _m.ctrl.Call(_m, "AddBlockReference", ctx, tlfID, id, context)
 	ret0, _ := ret[0].(error)
@@ -3291,6 +3857,16 @@ func (_mr *_MockblockServerLocalRecorder) Put(arg0, arg1, arg2, arg3, arg4, arg5
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Put", arg0, arg1, arg2, arg3, arg4, arg5)
 }
 
+func (_m *MockblockServerLocal) PutBlocks(ctx context.Context, tlfID tlf.ID, puts []BlockPut) []error {
+	ret := _m.ctrl.Call(_m, "PutBlocks", ctx, tlfID, puts)
+	ret0, _ := ret[0].([]error)
+	return ret0
+}
+
+func (_mr *_MockblockServerLocalRecorder) PutBlocks(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutBlocks", arg0, arg1, arg2)
+}
+
 func (_m *MockblockServerLocal) AddBlockReference(ctx context.Context, tlfID tlf.ID, id BlockID, context BlockContext) error {
 	ret := _m.ctrl.Call(_m, "AddBlockReference", ctx, tlfID, id, context)
 	ret0, _ := ret[0].(error)
@@ -3352,13 +3928,25 @@ func (_mr *_MockblockServerLocalRecorder) GetUserQuotaInfo(arg0 interface{}) *go
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUserQuotaInfo", arg0)
 }
 
-func (_m *MockblockServerLocal) getAllRefs(ctx context.Context, tlfID tlf.ID) (map[BlockID]blockRefMap, error) {
-	ret := _m.ctrl.Call(_m, "getAllRefs", ctx, tlfID)
+func (_m *MockblockServerLocal) getAllRefsForTest(ctx context.Context, tlfID tlf.ID) (map[BlockID]blockRefMap, error) {
+	ret := _m.ctrl.Call(_m, "getAllRefsForTest", ctx, tlfID)
 	ret0, _ := ret[0].(map[BlockID]blockRefMap)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
+func (_mr *_MockblockServerLocalRecorder) getAllRefsForTest(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "getAllRefsForTest", arg0, arg1)
+}
+
+func (_m *MockblockServerLocal) getAllRefs(ctx context.Context, tlfID tlf.ID) (map[BlockID][]BlockRefNonce, map[BlockID][]BlockRefNonce, error) {
+	ret := _m.ctrl.Call(_m, "getAllRefs", ctx, tlfID)
+	ret0, _ := ret[0].(map[BlockID][]BlockRefNonce)
+	ret1, _ := ret[1].(map[BlockID][]BlockRefNonce)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
 func (_mr *_MockblockServerLocalRecorder) getAllRefs(arg0, arg1 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "getAllRefs", arg0, arg1)
 }
@@ -3560,6 +4148,46 @@ func (_mr *_MockNotifierRecorder) UnregisterFromChanges(arg0, arg1 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnregisterFromChanges", arg0, arg1)
 }
 
+func (_m *MockNotifier) RegisterForFavoritesChanges(obs FavoritesObserver) error {
+	ret := _m.ctrl.Call(_m, "RegisterForFavoritesChanges", obs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockNotifierRecorder) RegisterForFavoritesChanges(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RegisterForFavoritesChanges", arg0)
+}
+
+func (_m *MockNotifier) UnregisterFromFavoritesChanges(obs FavoritesObserver) error {
+	ret := _m.ctrl.Call(_m, "UnregisterFromFavoritesChanges", obs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockNotifierRecorder) UnregisterFromFavoritesChanges(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnregisterFromFavoritesChanges", arg0)
+}
+
+func (_m *MockNotifier) RegisterForConnectivityChanges(obs ConnectivityObserver) error {
+	ret := _m.ctrl.Call(_m, "RegisterForConnectivityChanges", obs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockNotifierRecorder) RegisterForConnectivityChanges(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RegisterForConnectivityChanges", arg0)
+}
+
+func (_m *MockNotifier) UnregisterFromConnectivityChanges(obs ConnectivityObserver) error {
+	ret := _m.ctrl.Call(_m, "UnregisterFromConnectivityChanges", obs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockNotifierRecorder) UnregisterFromConnectivityChanges(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnregisterFromConnectivityChanges", arg0)
+}
+
 // Mock of Clock interface
 type MockClock struct {
 	ctrl     *gomock.Controller
@@ -4040,6 +4668,24 @@ func (_mr *_MockConfigRecorder) SetConflictRenamer(arg0 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetConflictRenamer", arg0)
 }
 
+func (_m *MockConfig) MountPathTransformer() MountPathTransformer {
+	ret := _m.ctrl.Call(_m, "MountPathTransformer")
+	ret0, _ := ret[0].(MountPathTransformer)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MountPathTransformer() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MountPathTransformer")
+}
+
+func (_m *MockConfig) SetMountPathTransformer(_param0 MountPathTransformer) {
+	_m.ctrl.Call(_m, "SetMountPathTransformer", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMountPathTransformer(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMountPathTransformer", arg0)
+}
+
 func (_m *MockConfig) MetadataVersion() MetadataVer {
 	ret := _m.ctrl.Call(_m, "MetadataVersion")
 	ret0, _ := ret[0].(MetadataVer)
@@ -4068,6 +4714,24 @@ func (_mr *_MockConfigRecorder) DataVersion() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DataVersion")
 }
 
+func (_m *MockConfig) BlockEncryptionVersion() EncryptionVer {
+	ret := _m.ctrl.Call(_m, "BlockEncryptionVersion")
+	ret0, _ := ret[0].(EncryptionVer)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockEncryptionVersion() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockEncryptionVersion")
+}
+
+func (_m *MockConfig) SetBlockEncryptionVersion(_param0 EncryptionVer) {
+	_m.ctrl.Call(_m, "SetBlockEncryptionVersion", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBlockEncryptionVersion(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockEncryptionVersion", arg0)
+}
+
 func (_m *MockConfig) RekeyQueue() RekeyQueue {
 	ret := _m.ctrl.Call(_m, "RekeyQueue")
 	ret0, _ := ret[0].(RekeyQueue)
@@ -4126,6 +4790,16 @@ func (_mr *_MockConfigRecorder) MaxDirBytes() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxDirBytes")
 }
 
+func (_m *MockConfig) MaxDirBlockBytes() uint64 {
+	ret := _m.ctrl.Call(_m, "MaxDirBlockBytes")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MaxDirBlockBytes() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxDirBlockBytes")
+}
+
 func (_m *MockConfig) DoBackgroundFlushes() bool {
 	ret := _m.ctrl.Call(_m, "DoBackgroundFlushes")
 	ret0, _ := ret[0].(bool)
@@ -4246,6 +4920,42 @@ func (_mr *_MockConfigRecorder) SetMetricsRegistry(arg0 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMetricsRegistry", arg0)
 }
 
+func (_m *MockConfig) Tracer() *Tracer {
+	ret := _m.ctrl.Call(_m, "Tracer")
+	ret0, _ := ret[0].(*Tracer)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) Tracer() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Tracer")
+}
+
+func (_m *MockConfig) SetTracer(_param0 *Tracer) {
+	_m.ctrl.Call(_m, "SetTracer", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetTracer(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetTracer", arg0)
+}
+
+func (_m *MockConfig) LogControl() *LogControl {
+	ret := _m.ctrl.Call(_m, "LogControl")
+	ret0, _ := ret[0].(*LogControl)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) LogControl() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LogControl")
+}
+
+func (_m *MockConfig) SetLogControl(_param0 *LogControl) {
+	_m.ctrl.Call(_m, "SetLogControl", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetLogControl(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetLogControl", arg0)
+}
+
 func (_m *MockConfig) TLFValidDuration() time.Duration {
 	ret := _m.ctrl.Call(_m, "TLFValidDuration")
 	ret0, _ := ret[0].(time.Duration)
@@ -4264,6 +4974,271 @@ func (_mr *_MockConfigRecorder) SetTLFValidDuration(arg0 interface{}) *gomock.Ca
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetTLFValidDuration", arg0)
 }
 
+func (_m *MockConfig) ReadReplicaPollInterval() time.Duration {
+	ret := _m.ctrl.Call(_m, "ReadReplicaPollInterval")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ReadReplicaPollInterval() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ReadReplicaPollInterval")
+}
+
+func (_m *MockConfig) SetReadReplicaPollInterval(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetReadReplicaPollInterval", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetReadReplicaPollInterval(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetReadReplicaPollInterval", arg0)
+}
+
+func (_m *MockConfig) BandwidthLimiter() BandwidthLimiter {
+	ret := _m.ctrl.Call(_m, "BandwidthLimiter")
+	ret0, _ := ret[0].(BandwidthLimiter)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BandwidthLimiter() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BandwidthLimiter")
+}
+
+func (_m *MockConfig) SetBandwidthLimiter(_param0 BandwidthLimiter) {
+	_m.ctrl.Call(_m, "SetBandwidthLimiter", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBandwidthLimiter(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBandwidthLimiter", arg0)
+}
+
+func (_m *MockConfig) Connectivity() ConnectivityTracker {
+	ret := _m.ctrl.Call(_m, "Connectivity")
+	ret0, _ := ret[0].(ConnectivityTracker)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) Connectivity() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Connectivity")
+}
+
+func (_m *MockConfig) SetConnectivity(_param0 ConnectivityTracker) {
+	_m.ctrl.Call(_m, "SetConnectivity", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetConnectivity(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetConnectivity", arg0)
+}
+
+func (_m *MockConfig) DiskLimiter() DiskLimiter {
+	ret := _m.ctrl.Call(_m, "DiskLimiter")
+	ret0, _ := ret[0].(DiskLimiter)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DiskLimiter() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DiskLimiter")
+}
+
+func (_m *MockConfig) SetDiskLimiter(_param0 DiskLimiter) {
+	_m.ctrl.Call(_m, "SetDiskLimiter", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetDiskLimiter(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDiskLimiter", arg0)
+}
+
+func (_m *MockConfig) ConflictResolutionStrategy() ConflictResolutionStrategy {
+	ret := _m.ctrl.Call(_m, "ConflictResolutionStrategy")
+	ret0, _ := ret[0].(ConflictResolutionStrategy)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ConflictResolutionStrategy() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ConflictResolutionStrategy")
+}
+
+func (_m *MockConfig) SetConflictResolutionStrategy(_param0 ConflictResolutionStrategy) {
+	_m.ctrl.Call(_m, "SetConflictResolutionStrategy", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetConflictResolutionStrategy(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetConflictResolutionStrategy", arg0)
+}
+
+func (_m *MockConfig) StrictTimes() bool {
+	ret := _m.ctrl.Call(_m, "StrictTimes")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) StrictTimes() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "StrictTimes")
+}
+
+func (_m *MockConfig) SetStrictTimes(_param0 bool) {
+	_m.ctrl.Call(_m, "SetStrictTimes", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetStrictTimes(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetStrictTimes", arg0)
+}
+
+func (_m *MockConfig) StoreSpecialFiles() bool {
+	ret := _m.ctrl.Call(_m, "StoreSpecialFiles")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) StoreSpecialFiles() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "StoreSpecialFiles")
+}
+
+func (_m *MockConfig) SetStoreSpecialFiles(_param0 bool) {
+	_m.ctrl.Call(_m, "SetStoreSpecialFiles", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetStoreSpecialFiles(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetStoreSpecialFiles", arg0)
+}
+
+func (_m *MockConfig) LowMemoryMode() bool {
+	ret := _m.ctrl.Call(_m, "LowMemoryMode")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) LowMemoryMode() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LowMemoryMode")
+}
+
+func (_m *MockConfig) SetLowMemoryMode(_param0 bool) {
+	_m.ctrl.Call(_m, "SetLowMemoryMode", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetLowMemoryMode(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetLowMemoryMode", arg0)
+}
+
+func (_m *MockConfig) CaseInsensitive() bool {
+	ret := _m.ctrl.Call(_m, "CaseInsensitive")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) CaseInsensitive() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CaseInsensitive")
+}
+
+func (_m *MockConfig) SetCaseInsensitive(_param0 bool) {
+	_m.ctrl.Call(_m, "SetCaseInsensitive", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetCaseInsensitive(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetCaseInsensitive", arg0)
+}
+
+func (_m *MockConfig) NormalizeNames() bool {
+	ret := _m.ctrl.Call(_m, "NormalizeNames")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) NormalizeNames() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "NormalizeNames")
+}
+
+func (_m *MockConfig) SetNormalizeNames(_param0 bool) {
+	_m.ctrl.Call(_m, "SetNormalizeNames", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetNormalizeNames(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetNormalizeNames", arg0)
+}
+
+func (_m *MockConfig) EncryptLocalStorage() bool {
+	ret := _m.ctrl.Call(_m, "EncryptLocalStorage")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) EncryptLocalStorage() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptLocalStorage")
+}
+
+func (_m *MockConfig) SetEncryptLocalStorage(_param0 bool) {
+	_m.ctrl.Call(_m, "SetEncryptLocalStorage", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetEncryptLocalStorage(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetEncryptLocalStorage", arg0)
+}
+
+func (_m *MockConfig) LongNameSupport() bool {
+	ret := _m.ctrl.Call(_m, "LongNameSupport")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) LongNameSupport() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LongNameSupport")
+}
+
+func (_m *MockConfig) BlockCacheTuningStatus() *BlockCacheTuningStatus {
+	ret := _m.ctrl.Call(_m, "BlockCacheTuningStatus")
+	ret0, _ := ret[0].(*BlockCacheTuningStatus)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockCacheTuningStatus() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockCacheTuningStatus")
+}
+
+func (_m *MockConfig) DirtyMemoryStatus() *DirtyMemoryStatus {
+	ret := _m.ctrl.Call(_m, "DirtyMemoryStatus")
+	ret0, _ := ret[0].(*DirtyMemoryStatus)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DirtyMemoryStatus() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DirtyMemoryStatus")
+}
+
+func (_m *MockConfig) KeyHalfHealth() (*KeyHalfHealthStatus, <-chan StatusUpdate) {
+	ret := _m.ctrl.Call(_m, "KeyHalfHealth")
+	ret0, _ := ret[0].(*KeyHalfHealthStatus)
+	ret1, _ := ret[1].(<-chan StatusUpdate)
+	return ret0, ret1
+}
+
+func (_mr *_MockConfigRecorder) KeyHalfHealth() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "KeyHalfHealth")
+}
+
+func (_m *MockConfig) SetLongNameSupport(_param0 bool) {
+	_m.ctrl.Call(_m, "SetLongNameSupport", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetLongNameSupport(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetLongNameSupport", arg0)
+}
+
+func (_m *MockConfig) PostWriteHooks() []PostWriteHook {
+	ret := _m.ctrl.Call(_m, "PostWriteHooks")
+	ret0, _ := ret[0].([]PostWriteHook)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) PostWriteHooks() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PostWriteHooks")
+}
+
+func (_m *MockConfig) AddPostWriteHook(_param0 PostWriteHook) {
+	_m.ctrl.Call(_m, "AddPostWriteHook", _param0)
+}
+
+func (_mr *_MockConfigRecorder) AddPostWriteHook(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AddPostWriteHook", arg0)
+}
+
 func (_m *MockConfig) Shutdown() error {
 	ret := _m.ctrl.Call(_m, "Shutdown")
 	ret0, _ := ret[0].(error)
@@ -0,0 +1,96 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "strings"
+
+const (
+	// CanonicalMountPath is the mountpoint under which absolute
+	// symlink targets into KBFS are stored.
+	CanonicalMountPath = "/keybase"
+	// defaultWindowsMountDrive is the drive letter under which
+	// KBFS is usually mounted on Windows.
+	defaultWindowsMountDrive = "K:"
+)
+
+// isWindowsMountPath returns whether mount looks like a Windows path,
+// i.e. one that starts with a drive letter.
+func isWindowsMountPath(mount string) bool {
+	return len(mount) >= 2 && mount[1] == ':'
+}
+
+// trimMountPath returns the rest of p, with '/' separators, if p is
+// mount or a path under it, and false otherwise.  Windows mount
+// paths are matched case-insensitively, with either separator.
+func trimMountPath(p, mount string) (string, bool) {
+	mount = strings.TrimRight(mount, `/\`)
+	if mount == "" || len(p) < len(mount) {
+		return "", false
+	}
+	if isWindowsMountPath(mount) {
+		if !strings.EqualFold(p[:len(mount)], mount) {
+			return "", false
+		}
+		p = strings.Replace(p, `\`, "/", -1)
+	} else if p[:len(mount)] != mount {
+		return "", false
+	}
+	rest := p[len(mount):]
+	if rest != "" && rest[0] != '/' {
+		return "", false
+	}
+	return rest, true
+}
+
+// MountPathTransformerStandard rewrites absolute symlink targets
+// between the canonical mountpoint, CanonicalMountPath, and the
+// local one.  Targets under the usual Windows drive, K:, are treated
+// like canonical ones.
+type MountPathTransformerStandard struct {
+	localMount string
+}
+
+var _ MountPathTransformer = MountPathTransformerStandard{}
+
+// NewMountPathTransformerStandard returns a new
+// MountPathTransformerStandard for the given local mountpoint.  If
+// localMount is empty, targets are left alone.
+func NewMountPathTransformerStandard(
+	localMount string) MountPathTransformerStandard {
+	return MountPathTransformerStandard{localMount}
+}
+
+// ToLocal implements the MountPathTransformer interface for
+// MountPathTransformerStandard.
+func (t MountPathTransformerStandard) ToLocal(target string) string {
+	if t.localMount == "" {
+		return target
+	}
+	rest, ok := trimMountPath(target, CanonicalMountPath)
+	if !ok {
+		rest, ok = trimMountPath(target, defaultWindowsMountDrive)
+	}
+	if !ok {
+		return target
+	}
+	local := strings.TrimRight(t.localMount, `/\`)
+	if isWindowsMountPath(local) {
+		return local + strings.Replace(rest, "/", `\`, -1)
+	}
+	return local + rest
+}
+
+// FromLocal implements the MountPathTransformer interface for
+// MountPathTransformerStandard.
+func (t MountPathTransformerStandard) FromLocal(target string) string {
+	if t.localMount == "" {
+		return target
+	}
+	rest, ok := trimMountPath(target, t.localMount)
+	if !ok {
+		return target
+	}
+	return CanonicalMountPath + rest
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMountPathTransformerStandardToLocal(t *testing.T) {
+	unix := NewMountPathTransformerStandard("/home/u/kbfs/")
+	windows := NewMountPathTransformerStandard(`L:\`)
+	for _, test := range []struct {
+		target, unix, windows string
+	}{
+		{"/keybase/private/u1/a", "/home/u/kbfs/private/u1/a",
+			`L:\private\u1\a`},
+		{`K:\private\u1\a`, "/home/u/kbfs/private/u1/a",
+			`L:\private\u1\a`},
+		{"k:/public/u1", "/home/u/kbfs/public/u1", `L:\public\u1`},
+		{"/keybase", "/home/u/kbfs", "L:"},
+		// Targets outside of KBFS, or relative ones, are kept.
+		{"/keybase2/a", "/keybase2/a", "/keybase2/a"},
+		{"/tmp/a", "/tmp/a", "/tmp/a"},
+		{"../a", "../a", "../a"},
+		{"K:a", "K:a", "K:a"},
+	} {
+		require.Equal(t, test.unix, unix.ToLocal(test.target),
+			test.target)
+		require.Equal(t, test.windows, windows.ToLocal(test.target),
+			test.target)
+	}
+
+	// Without a local mountpoint, nothing is rewritten.
+	none := NewMountPathTransformerStandard("")
+	require.Equal(t, "/keybase/a", none.ToLocal("/keybase/a"))
+	require.Equal(t, "/keybase/a", none.FromLocal("/keybase/a"))
+}
+
+func TestMountPathTransformerStandardFromLocal(t *testing.T) {
+	unix := NewMountPathTransformerStandard("/home/u/kbfs")
+	require.Equal(t, "/keybase/private/u1/a",
+		unix.FromLocal("/home/u/kbfs/private/u1/a"))
+	require.Equal(t, "/home/u/kbfs2/a", unix.FromLocal("/home/u/kbfs2/a"))
+	require.Equal(t, "a/b", unix.FromLocal("a/b"))
+
+	windows := NewMountPathTransformerStandard("K:")
+	require.Equal(t, "/keybase/private/u1/a",
+		windows.FromLocal(`k:\private\u1\a`))
+	require.Equal(t, `C:\a`, windows.FromLocal(`C:\a`))
+}
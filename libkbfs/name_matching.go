@@ -0,0 +1,92 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/text/unicode/norm"
+)
+
+// equivalentNameMatch returns the stored name of the entry among
+// children, keyed by stored name, whose name is equivalent to name
+// according to equivalent.  If several entries match, which can
+// happen for entries created before a matching mode was turned on or
+// by other devices, the one with the smallest stored name wins, so
+// that every lookup finds the same entry.  It returns false if
+// there's no match.
+func equivalentNameMatch(children map[string]EntryInfo, name string,
+	equivalent func(a, b string) bool) (string, bool) {
+	match := ""
+	found := false
+	for storedName, ei := range children {
+		visibleName := storedName
+		if ei.LongName != "" {
+			visibleName = ei.LongName
+		}
+		if !equivalent(visibleName, name) {
+			continue
+		}
+		if !found || storedName < match {
+			match = storedName
+			found = true
+		}
+	}
+	return match, found
+}
+
+// dirBlockChildrenInfo returns the EntryInfos of the children of
+// dblock, keyed by stored name, for equivalentNameMatch.
+func dirBlockChildrenInfo(dblock *DirBlock) map[string]EntryInfo {
+	children := make(map[string]EntryInfo, len(dblock.Children))
+	for name, de := range dblock.Children {
+		children[name] = de.EntryInfo
+	}
+	return children
+}
+
+// inexactNameMatching returns whether names that aren't identical
+// might still refer to the same entry (see Config.CaseInsensitive
+// and Config.NormalizeNames).
+func (fbo *folderBranchOps) inexactNameMatching() bool {
+	return fbo.config.CaseInsensitive() || fbo.config.NormalizeNames()
+}
+
+// normalizedName returns the form of name under which a new entry
+// is stored: its NFC form if names are normalized, or name itself
+// otherwise.
+func (fbo *folderBranchOps) normalizedName(name string) string {
+	if !fbo.config.NormalizeNames() {
+		return name
+	}
+	return norm.NFC.String(name)
+}
+
+// namesEquivalent returns whether a and b refer to the same entry.
+func (fbo *folderBranchOps) namesEquivalent(a, b string) bool {
+	a, b = fbo.normalizedName(a), fbo.normalizedName(b)
+	if fbo.config.CaseInsensitive() {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+// checkEquivalentNameConflict returns a NameExistsError if inexact
+// name matching is on and dblock already has an entry whose name is
+// equivalent to name.
+func (fbo *folderBranchOps) checkEquivalentNameConflict(
+	ctx context.Context, dblock *DirBlock, name string) error {
+	if !fbo.inexactNameMatching() {
+		return nil
+	}
+	if match, ok := equivalentNameMatch(
+		dirBlockChildrenInfo(dblock), name, fbo.namesEquivalent); ok {
+		fbo.log.CDebugf(ctx, "Name %s conflicts with existing entry %s",
+			name, match)
+		return NameExistsError{name}
+	}
+	return nil
+}
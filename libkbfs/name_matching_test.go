@@ -0,0 +1,127 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEquivalentNameMatch(t *testing.T) {
+	children := map[string]EntryInfo{
+		"Readme.md": {},
+		"README.md": {},
+		"short~abc": {LongName: "Long.txt"},
+	}
+
+	match, ok := equivalentNameMatch(children, "readme.MD", strings.EqualFold)
+	require.True(t, ok)
+	// The smallest stored name wins.
+	require.Equal(t, "README.md", match)
+
+	// Long names are matched by their full names.
+	match, ok = equivalentNameMatch(children, "LONG.TXT", strings.EqualFold)
+	require.True(t, ok)
+	require.Equal(t, "short~abc", match)
+	_, ok = equivalentNameMatch(children, "SHORT~ABC", strings.EqualFold)
+	require.False(t, ok)
+
+	_, ok = equivalentNameMatch(children, "other", strings.EqualFold)
+	require.False(t, ok)
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	kbfsOps := config.KBFSOps()
+
+	fileNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, "Readme.md", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("hello"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// Without case-insensitivity, names differing only in case
+	// are different entries.
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "README.md")
+	require.IsType(t, NoSuchNameError{}, err)
+
+	config.SetCaseInsensitive(true)
+	node, ei, err := kbfsOps.Lookup(ctx, rootNode, "README.md")
+	require.NoError(t, err)
+	require.Equal(t, fileNode.GetID(), node.GetID())
+	require.Equal(t, uint64(5), ei.Size)
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "Other.md")
+	require.IsType(t, NoSuchNameError{}, err)
+
+	// Creating a conflicting entry of any type fails.
+	_, _, err = kbfsOps.CreateFile(
+		ctx, rootNode, "README.md", false, NoExcl)
+	require.IsType(t, NameExistsError{}, err)
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "readme.MD")
+	require.IsType(t, NameExistsError{}, err)
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "README.MD", "x")
+	require.IsType(t, NameExistsError{}, err)
+
+	// The original name is kept.
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	require.Contains(t, children, "Readme.md")
+}
+
+func TestNormalizeNames(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	kbfsOps := config.KBFSOps()
+
+	const nfc = "caf\u00e9"
+	const nfd = "cafe\u0301"
+	const oldNFD = "re\u0301sume\u0301"
+
+	// Without normalization, names are stored as given.
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, oldNFD, false, NoExcl)
+	require.NoError(t, err)
+
+	config.SetNormalizeNames(true)
+
+	// New entries are stored in NFC, and found in either form.
+	fileNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, nfd, false, NoExcl)
+	require.NoError(t, err)
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Contains(t, children, nfc)
+	require.NotContains(t, children, nfd)
+	for _, name := range []string{nfc, nfd} {
+		node, _, err := kbfsOps.Lookup(ctx, rootNode, name)
+		require.NoError(t, err)
+		require.Equal(t, fileNode.GetID(), node.GetID())
+	}
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, nfc)
+	require.IsType(t, NameExistsError{}, err)
+
+	// Old entries stored in NFD are found, and conflict, too.
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "r\u00e9sum\u00e9")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(
+		ctx, rootNode, "r\u00e9sum\u00e9", false, NoExcl)
+	require.IsType(t, NameExistsError{}, err)
+
+	// Renames store the new name in NFC too.
+	err = kbfsOps.Rename(ctx, rootNode, nfc, rootNode, "na\u0308ive")
+	require.NoError(t, err)
+	children, err = kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Contains(t, children, "n\u00e4ive")
+}
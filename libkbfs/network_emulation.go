@@ -0,0 +1,334 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	merkle "github.com/keybase/go-merkle-tree"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// NetworkConditions describes an emulated network link between a
+// client and the block and MD servers.
+type NetworkConditions struct {
+	// RTT is the round-trip time of each RPC.
+	RTT time.Duration
+	// Jitter is the most by which any one round trip may be
+	// randomly shorter or longer than RTT.
+	Jitter time.Duration
+	// LossRate is the probability, in [0, 1), that any one
+	// attempt at an RPC is lost.  A lost attempt is retried after
+	// a retransmission timeout of twice the RTT, as a TCP sender
+	// would, so losses show up as extra latency rather than as
+	// errors.
+	LossRate float64
+	// Seed seeds the choice of jitter and losses, so that a run
+	// with the same sequence of RPCs sees the same delays.
+	Seed int64
+}
+
+// IsZero returns whether the conditions don't delay anything.
+func (nc NetworkConditions) IsZero() bool {
+	return nc.RTT == 0 && nc.Jitter == 0 && nc.LossRate == 0
+}
+
+// NetworkEmulatorStats summarizes the delays a NetworkEmulator has
+// added so far.
+type NetworkEmulatorStats struct {
+	// RPCs is the number of delayed RPCs.
+	RPCs int
+	// Lost is the number of attempts that were lost and retried.
+	Lost int
+	// Delay is the total delay added to all RPCs.
+	Delay time.Duration
+}
+
+// NetworkEmulator delays the RPCs of the BlockServer and MDServer of
+// one or more Configs, according to some NetworkConditions.  Unlike
+// BlockOpsConstrained, which only limits the bandwidth of block
+// puts, it adds a round trip to every block and MD RPC, which makes
+// it suitable for performance regression tests of high-latency
+// links.  It waits on the real clock rather than on a Config's
+// Clock, so it works with test clocks too.
+type NetworkEmulator struct {
+	conditions NetworkConditions
+
+	lock  sync.Mutex
+	rand  *rand.Rand
+	stats NetworkEmulatorStats
+}
+
+// NewNetworkEmulator returns a new NetworkEmulator for the given
+// conditions.
+func NewNetworkEmulator(conditions NetworkConditions) (
+	*NetworkEmulator, error) {
+	if conditions.RTT < 0 || conditions.Jitter < 0 {
+		return nil, fmt.Errorf("Negative RTT %s or jitter %s",
+			conditions.RTT, conditions.Jitter)
+	}
+	if conditions.LossRate < 0 || conditions.LossRate >= 1 {
+		return nil, fmt.Errorf("Loss rate %f not in [0, 1)",
+			conditions.LossRate)
+	}
+	return &NetworkEmulator{
+		conditions: conditions,
+		rand:       rand.New(rand.NewSource(conditions.Seed)),
+	}, nil
+}
+
+// Install wraps the block server and MD server of the given config,
+// so that all their RPCs are delayed.  Configs that share servers
+// should either be installed into before sharing them, or only once.
+func (ne *NetworkEmulator) Install(config Config) {
+	config.SetBlockServer(&networkEmulatedBlockServer{
+		BlockServer: config.BlockServer(),
+		emulator:    ne,
+	})
+	config.SetMDServer(&networkEmulatedMDServer{
+		MDServer: config.MDServer(),
+		emulator: ne,
+	})
+}
+
+// Stats returns a summary of the delays added so far.
+func (ne *NetworkEmulator) Stats() NetworkEmulatorStats {
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+	return ne.stats
+}
+
+// nextDelay picks the delay of the next RPC.
+func (ne *NetworkEmulator) nextDelay() time.Duration {
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+	var delay time.Duration
+	for ne.conditions.LossRate > 0 &&
+		ne.rand.Float64() < ne.conditions.LossRate {
+		delay += 2 * ne.conditions.RTT
+		ne.stats.Lost++
+	}
+	rtt := ne.conditions.RTT
+	if ne.conditions.Jitter > 0 {
+		rtt += time.Duration(
+			ne.rand.Int63n(2*int64(ne.conditions.Jitter)+1)) -
+			ne.conditions.Jitter
+	}
+	if rtt > 0 {
+		delay += rtt
+	}
+	ne.stats.RPCs++
+	ne.stats.Delay += delay
+	return delay
+}
+
+// roundTrip waits for the delay of one RPC, or until ctx is done.
+func (ne *NetworkEmulator) roundTrip(ctx context.Context) error {
+	delay := ne.nextDelay()
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// networkEmulatedBlockServer is an implementation of BlockServer
+// whose RPCs are delayed by a NetworkEmulator.
+type networkEmulatedBlockServer struct {
+	BlockServer
+	emulator *NetworkEmulator
+}
+
+var _ BlockServer = (*networkEmulatedBlockServer)(nil)
+
+func (n *networkEmulatedBlockServer) Get(ctx context.Context, tlfID tlf.ID,
+	id BlockID, bctx BlockContext) (
+	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	return n.BlockServer.Get(ctx, tlfID, id, bctx)
+}
+
+func (n *networkEmulatedBlockServer) Put(ctx context.Context, tlfID tlf.ID,
+	id BlockID, bctx BlockContext, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return err
+	}
+	return n.BlockServer.Put(ctx, tlfID, id, bctx, buf, serverHalf)
+}
+
+func (n *networkEmulatedBlockServer) PutBlocks(ctx context.Context,
+	tlfID tlf.ID, puts []BlockPut) []error {
+	// The whole batch costs one round trip.
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		errs := make([]error, len(puts))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	return n.BlockServer.PutBlocks(ctx, tlfID, puts)
+}
+
+func (n *networkEmulatedBlockServer) canBatchPuts() bool {
+	return true
+}
+
+func (n *networkEmulatedBlockServer) AddBlockReference(ctx context.Context,
+	tlfID tlf.ID, id BlockID, bctx BlockContext) error {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return err
+	}
+	return n.BlockServer.AddBlockReference(ctx, tlfID, id, bctx)
+}
+
+func (n *networkEmulatedBlockServer) RemoveBlockReferences(
+	ctx context.Context, tlfID tlf.ID,
+	contexts map[BlockID][]BlockContext) (map[BlockID]int, error) {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return nil, err
+	}
+	return n.BlockServer.RemoveBlockReferences(ctx, tlfID, contexts)
+}
+
+func (n *networkEmulatedBlockServer) ArchiveBlockReferences(
+	ctx context.Context, tlfID tlf.ID,
+	contexts map[BlockID][]BlockContext) error {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return err
+	}
+	return n.BlockServer.ArchiveBlockReferences(ctx, tlfID, contexts)
+}
+
+func (n *networkEmulatedBlockServer) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return nil, err
+	}
+	return n.BlockServer.GetUserQuotaInfo(ctx)
+}
+
+// networkEmulatedMDServer is an implementation of MDServer whose RPCs
+// are delayed by a NetworkEmulator.
+type networkEmulatedMDServer struct {
+	MDServer
+	emulator *NetworkEmulator
+}
+
+var _ MDServer = (*networkEmulatedMDServer)(nil)
+
+func (n *networkEmulatedMDServer) GetForHandle(ctx context.Context,
+	handle tlf.Handle, mStatus MergeStatus) (
+	tlf.ID, *RootMetadataSigned, error) {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return tlf.NullID, nil, err
+	}
+	return n.MDServer.GetForHandle(ctx, handle, mStatus)
+}
+
+func (n *networkEmulatedMDServer) GetForTLF(ctx context.Context, id tlf.ID,
+	bid BranchID, mStatus MergeStatus) (*RootMetadataSigned, error) {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return nil, err
+	}
+	return n.MDServer.GetForTLF(ctx, id, bid, mStatus)
+}
+
+func (n *networkEmulatedMDServer) GetRange(ctx context.Context, id tlf.ID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
+	[]*RootMetadataSigned, error) {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return nil, err
+	}
+	return n.MDServer.GetRange(ctx, id, bid, mStatus, start, stop)
+}
+
+func (n *networkEmulatedMDServer) GetMergedDelta(ctx context.Context,
+	id tlf.ID, since MetadataRevision, maxRevs int) (
+	[]*RootMetadataSigned, bool, error) {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return nil, false, err
+	}
+	return n.MDServer.GetMergedDelta(ctx, id, since, maxRevs)
+}
+
+func (n *networkEmulatedMDServer) Put(ctx context.Context,
+	rmds *RootMetadataSigned, extra ExtraMetadata) error {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return err
+	}
+	return n.MDServer.Put(ctx, rmds, extra)
+}
+
+func (n *networkEmulatedMDServer) PruneBranch(
+	ctx context.Context, id tlf.ID, bid BranchID) error {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return err
+	}
+	return n.MDServer.PruneBranch(ctx, id, bid)
+}
+
+func (n *networkEmulatedMDServer) TruncateLock(
+	ctx context.Context, id tlf.ID) (bool, error) {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return false, err
+	}
+	return n.MDServer.TruncateLock(ctx, id)
+}
+
+func (n *networkEmulatedMDServer) TruncateUnlock(
+	ctx context.Context, id tlf.ID) (bool, error) {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return false, err
+	}
+	return n.MDServer.TruncateUnlock(ctx, id)
+}
+
+func (n *networkEmulatedMDServer) GetLatestHandleForTLF(
+	ctx context.Context, id tlf.ID) (tlf.Handle, error) {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return tlf.Handle{}, err
+	}
+	return n.MDServer.GetLatestHandleForTLF(ctx, id)
+}
+
+func (n *networkEmulatedMDServer) GetKeyBundles(ctx context.Context,
+	tlfID tlf.ID, wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
+	*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error) {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return nil, nil, err
+	}
+	return n.MDServer.GetKeyBundles(ctx, tlfID, wkbID, rkbID)
+}
+
+func (n *networkEmulatedMDServer) GetMerkleRootLatest(ctx context.Context,
+	treeID keybase1.MerkleTreeID) (*MerkleRoot, error) {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return nil, err
+	}
+	return n.MDServer.GetMerkleRootLatest(ctx, treeID)
+}
+
+func (n *networkEmulatedMDServer) GetMerkleNode(
+	ctx context.Context, hash merkle.Hash) ([]byte, error) {
+	if err := n.emulator.roundTrip(ctx); err != nil {
+		return nil, err
+	}
+	return n.MDServer.GetMerkleNode(ctx, hash)
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestNetworkEmulatorBadConditions(t *testing.T) {
+	_, err := NewNetworkEmulator(NetworkConditions{RTT: -time.Second})
+	require.Error(t, err)
+	_, err = NewNetworkEmulator(NetworkConditions{LossRate: 1})
+	require.Error(t, err)
+}
+
+func TestNetworkEmulatorReproducible(t *testing.T) {
+	conditions := NetworkConditions{
+		RTT:      100 * time.Millisecond,
+		Jitter:   20 * time.Millisecond,
+		LossRate: 0.25,
+		Seed:     42,
+	}
+	ne1, err := NewNetworkEmulator(conditions)
+	require.NoError(t, err)
+	ne2, err := NewNetworkEmulator(conditions)
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		delay := ne1.nextDelay()
+		require.Equal(t, delay, ne2.nextDelay())
+		require.True(t, delay >= conditions.RTT-conditions.Jitter)
+	}
+	stats := ne1.Stats()
+	require.Equal(t, stats, ne2.Stats())
+	require.Equal(t, 100, stats.RPCs)
+	require.NotZero(t, stats.Lost)
+	require.True(t, stats.Delay >=
+		100*(conditions.RTT-conditions.Jitter)+
+			time.Duration(stats.Lost)*2*conditions.RTT)
+}
+
+func TestNetworkEmulatorCanceled(t *testing.T) {
+	ne, err := NewNetworkEmulator(NetworkConditions{RTT: time.Hour})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, ne.roundTrip(ctx))
+}
+
+func TestNetworkEmulatorInstall(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, "u1")
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	ne, err := NewNetworkEmulator(NetworkConditions{RTT: time.Millisecond})
+	require.NoError(t, err)
+	ne.Install(config)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	_, _, err = config.KBFSOps().CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	stats := ne.Stats()
+	require.NotZero(t, stats.RPCs)
+	require.True(t, stats.Delay >= time.Duration(stats.RPCs)*time.Millisecond)
+}
@@ -57,6 +57,17 @@ func (ol *observerList) batchChanges(
 	}
 }
 
+func (ol *observerList) pathChanges(
+	ctx context.Context, changes []PathChange) {
+	ol.lock.RLock()
+	defer ol.lock.RUnlock()
+	for _, o := range ol.observers {
+		if po, ok := o.(PathObserver); ok {
+			po.PathChanges(ctx, changes)
+		}
+	}
+}
+
 func (ol *observerList) tlfHandleChange(
 	ctx context.Context, newHandle *TlfHandle) {
 	ol.lock.RLock()
@@ -65,3 +76,47 @@ func (ol *observerList) tlfHandleChange(
 		o.TlfHandleChange(ctx, newHandle)
 	}
 }
+
+func (ol *observerList) hasFavoritesObservers() bool {
+	ol.lock.RLock()
+	defer ol.lock.RUnlock()
+	for _, o := range ol.observers {
+		if _, ok := o.(FavoritesObserver); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (ol *observerList) favoritesChanged(
+	ctx context.Context, added, removed []Favorite) {
+	ol.lock.RLock()
+	defer ol.lock.RUnlock()
+	for _, o := range ol.observers {
+		if fo, ok := o.(FavoritesObserver); ok {
+			fo.FavoritesChanged(ctx, added, removed)
+		}
+	}
+}
+
+func (ol *observerList) connectivityChanged(
+	ctx context.Context, status ConnectivityStatus) {
+	ol.lock.RLock()
+	defer ol.lock.RUnlock()
+	for _, o := range ol.observers {
+		if co, ok := o.(ConnectivityObserver); ok {
+			co.ConnectivityChanged(ctx, status)
+		}
+	}
+}
+
+func (ol *observerList) quotaWarning(
+	ctx context.Context, warning QuotaWarning) {
+	ol.lock.RLock()
+	defer ol.lock.RUnlock()
+	for _, o := range ol.observers {
+		if qo, ok := o.(QuotaObserver); ok {
+			qo.QuotaWarning(ctx, warning)
+		}
+	}
+}
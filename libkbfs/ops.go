@@ -924,6 +924,10 @@ const (
 	exAttr attrChange = iota
 	mtimeAttr
 	sizeAttr // only used during conflict resolution
+	xattrAttr
+	permAttr
+	appendOnlyAttr
+	derivedAttr
 )
 
 func (ac attrChange) String() string {
@@ -934,6 +938,14 @@ func (ac attrChange) String() string {
 		return "mtime"
 	case sizeAttr:
 		return "size"
+	case xattrAttr:
+		return "xattr"
+	case permAttr:
+		return "perm"
+	case appendOnlyAttr:
+		return "appendonly"
+	case derivedAttr:
+		return "derived"
 	}
 	return "<invalid attrChange>"
 }
@@ -1015,7 +1027,13 @@ func (sao *setAttrOp) checkConflict(
 	isFile bool) (crAction, error) {
 	switch realMergedOp := mergedOp.(type) {
 	case *setAttrOp:
-		if realMergedOp.Attr == sao.Attr {
+		// Extended attributes, permissions, the append-only
+		// flag and derived metadata are small and rarely edited
+		// concurrently, so rather than making a conflict copy,
+		// the unmerged attributes win.
+		if realMergedOp.Attr == sao.Attr && sao.Attr != xattrAttr &&
+			sao.Attr != permAttr && sao.Attr != appendOnlyAttr &&
+			sao.Attr != derivedAttr {
 			var symPath string
 			var causedByAttr attrChange
 			if !isFile {
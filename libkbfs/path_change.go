@@ -0,0 +1,167 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"github.com/keybase/client/go/libkb"
+	"golang.org/x/net/context"
+)
+
+// PathChangeType is the kind of change described by a PathChange.
+type PathChangeType int
+
+const (
+	// PathCreated means that a file, directory or symlink was
+	// created.
+	PathCreated PathChangeType = iota
+	// PathWritten means that a file was written to or truncated.
+	PathWritten
+	// PathRenamed means that an entry was moved from OldPath to
+	// Path.
+	PathRenamed
+	// PathRemoved means that an entry was removed.
+	PathRemoved
+	// PathAttrChanged means that one of an entry's attributes
+	// changed.
+	PathAttrChanged
+)
+
+func (t PathChangeType) String() string {
+	switch t {
+	case PathCreated:
+		return "create"
+	case PathWritten:
+		return "write"
+	case PathRenamed:
+		return "rename"
+	case PathRemoved:
+		return "remove"
+	case PathAttrChanged:
+		return "setattr"
+	default:
+		return fmt.Sprintf("PathChangeType(%d)", int(t))
+	}
+}
+
+// PathChange describes a single change to an entry in a TLF, by
+// path.
+type PathChange struct {
+	Type PathChangeType
+	// Path is the canonical path of the changed entry, or its new
+	// path if it was renamed.  It is empty if the new location of a
+	// renamed entry isn't known on this device.
+	Path string
+	// OldPath is the canonical path that a renamed entry used to
+	// have.  It is empty if that location isn't known on this device.
+	OldPath string
+	// Writes is the list of byte ranges written or truncated, for
+	// PathWritten.
+	Writes []WriteRange
+	// Attr is the name of the changed attribute ("ex" or "mtime"),
+	// for PathAttrChanged.
+	Attr string
+	// Writer is the user who made the change.
+	Writer libkb.NormalizedUsername
+	// Revision is the TLF revision that contains the change.
+	Revision MetadataRevision
+}
+
+// pathChangesForOpLocked returns the path changes for the given op,
+// which must already have had its pointers updated in the node
+// cache.  Only changes under cached nodes are returned, since we
+// can't name anything else.
+func (fbo *folderBranchOps) pathChangesForOpLocked(ctx context.Context,
+	lState *lockState, op op, md ReadOnlyRootMetadata) []PathChange {
+	fbo.headLock.AssertLocked(lState)
+
+	nodePath := func(ptr BlockPointer) (path, bool) {
+		node := fbo.nodeCache.Get(ptr.Ref())
+		if node == nil {
+			return path{}, false
+		}
+		p, err := fbo.pathFromNodeForRead(node)
+		if err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't get path for %v: %v", ptr, err)
+			return path{}, false
+		}
+		return p, true
+	}
+	childPath := func(dir BlockPointer, name string) string {
+		p, ok := nodePath(dir)
+		if !ok {
+			return ""
+		}
+		return p.ChildPathNoPtr(name).CanonicalPathString()
+	}
+
+	var changes []PathChange
+	add := func(pc PathChange) {
+		if pc.Path != "" || pc.OldPath != "" {
+			changes = append(changes, pc)
+		}
+	}
+	switch realOp := op.(type) {
+	case *createOp:
+		add(PathChange{
+			Type: PathCreated,
+			Path: childPath(realOp.Dir.Ref, realOp.NewName),
+		})
+	case *rmOp:
+		add(PathChange{
+			Type: PathRemoved,
+			Path: childPath(realOp.Dir.Ref, realOp.OldName),
+		})
+	case *renameOp:
+		newDir := realOp.NewDir.Ref
+		if newDir == zeroPtr {
+			newDir = realOp.OldDir.Ref
+		}
+		add(PathChange{
+			Type:    PathRenamed,
+			Path:    childPath(newDir, realOp.NewName),
+			OldPath: childPath(realOp.OldDir.Ref, realOp.OldName),
+		})
+	case *syncOp:
+		if p, ok := nodePath(realOp.File.Ref); ok {
+			add(PathChange{
+				Type:   PathWritten,
+				Path:   p.CanonicalPathString(),
+				Writes: realOp.Writes,
+			})
+		}
+	case *setAttrOp:
+		add(PathChange{
+			Type: PathAttrChanged,
+			Path: childPath(realOp.Dir.Ref, realOp.Name),
+			Attr: realOp.Attr.String(),
+		})
+	case *resolutionOp:
+		// Any unref'd block that has a node is an implied removal;
+		// see notifyOneOpLocked.
+		for _, unref := range op.Unrefs() {
+			if p, ok := nodePath(unref); ok {
+				add(PathChange{
+					Type: PathRemoved,
+					Path: p.CanonicalPathString(),
+				})
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	var writer libkb.NormalizedUsername
+	if h := md.GetTlfHandle(); h != nil {
+		writer = h.resolvedWriters[md.LastModifyingWriter()]
+	}
+	for i := range changes {
+		changes[i].Writer = writer
+		changes[i].Revision = md.Revision()
+	}
+	return changes
+}
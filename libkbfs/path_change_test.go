@@ -0,0 +1,111 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type testPathObserver struct {
+	lock    sync.Mutex
+	changes []PathChange
+}
+
+func (t *testPathObserver) LocalChange(ctx context.Context, node Node,
+	write WriteRange) {
+	// ignore
+}
+
+func (t *testPathObserver) BatchChanges(ctx context.Context,
+	changes []NodeChange) {
+	// ignore
+}
+
+func (t *testPathObserver) TlfHandleChange(ctx context.Context,
+	newHandle *TlfHandle) {
+	// ignore
+}
+
+func (t *testPathObserver) PathChanges(ctx context.Context,
+	changes []PathChange) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.changes = append(t.changes, changes...)
+}
+
+func (t *testPathObserver) take() []PathChange {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	changes := t.changes
+	t.changes = nil
+	return changes
+}
+
+func TestPathObserver(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	kbfsOps := config.KBFSOps()
+	obs := &testPathObserver{}
+	err := config.Notifier().RegisterForChanges(
+		[]FolderBranch{rootNode.GetFolderBranch()}, obs)
+	require.NoError(t, err)
+
+	var lastRev MetadataRevision
+	checkChange := func(expected PathChange) {
+		changes := obs.take()
+		require.Len(t, changes, 1)
+		actual := changes[0]
+		require.True(t, actual.Revision > lastRev)
+		lastRev = actual.Revision
+		expected.Writer = "u1"
+		expected.Revision = actual.Revision
+		require.Equal(t, expected, actual)
+	}
+
+	dir := "/keybase/private/u1/"
+	fileA, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	checkChange(PathChange{Type: PathCreated, Path: dir + "a"})
+
+	err = kbfsOps.Write(ctx, fileA, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileA)
+	require.NoError(t, err)
+	checkChange(PathChange{
+		Type:   PathWritten,
+		Path:   dir + "a",
+		Writes: []WriteRange{{Off: 0, Len: 3}},
+	})
+
+	err = kbfsOps.SetEx(ctx, fileA, true)
+	require.NoError(t, err)
+	checkChange(PathChange{
+		Type: PathAttrChanged,
+		Path: dir + "a",
+		Attr: "ex",
+	})
+
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b")
+	require.NoError(t, err)
+	checkChange(PathChange{
+		Type:    PathRenamed,
+		Path:    dir + "b",
+		OldPath: dir + "a",
+	})
+
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "b")
+	require.NoError(t, err)
+	checkChange(PathChange{Type: PathRemoved, Path: dir + "b"})
+
+	err = config.Notifier().UnregisterFromChanges(
+		[]FolderBranch{rootNode.GetFolderBranch()}, obs)
+	require.NoError(t, err)
+}
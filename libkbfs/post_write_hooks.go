@@ -0,0 +1,198 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+
+	"golang.org/x/net/context"
+)
+
+// postWriteHookHeadBytes is how much of the start of a file is read
+// and handed to each PostWriteHook.
+const postWriteHookHeadBytes = 64 << 10
+
+// derivedEqual returns whether two Derived maps hold the same
+// metadata.
+func derivedEqual(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		other, ok := b[name]
+		if !ok || !bytes.Equal(value, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// schedulePostWriteHooks runs the post-write hooks on the given file
+// in the background, if there are any.  If the hooks are already
+// running on the file, they're run once more after they finish, so
+// that the stored metadata always ends up matching the last write.
+func (fbo *folderBranchOps) schedulePostWriteHooks(file Node) {
+	if len(fbo.config.PostWriteHooks()) == 0 {
+		return
+	}
+
+	fbo.postWriteHookLock.Lock()
+	defer fbo.postWriteHookLock.Unlock()
+	id := file.GetID()
+	if _, ok := fbo.postWriteHookFiles[id]; ok {
+		fbo.postWriteHookFiles[id] = true
+		return
+	}
+	fbo.postWriteHookFiles[id] = false
+	fbo.postWriteHooks.Add(1)
+	go fbo.postWriteHookLoop(file)
+}
+
+func (fbo *folderBranchOps) postWriteHookLoop(file Node) {
+	defer fbo.postWriteHooks.Done()
+	id := file.GetID()
+	for {
+		err := fbo.runUnlessShutdown(func(ctx context.Context) error {
+			return fbo.runPostWriteHooks(ctx, file)
+		})
+		_, shutdown := err.(ShutdownHappenedError)
+
+		fbo.postWriteHookLock.Lock()
+		again := fbo.postWriteHookFiles[id]
+		if !again || shutdown {
+			delete(fbo.postWriteHookFiles, id)
+			fbo.postWriteHookLock.Unlock()
+			return
+		}
+		fbo.postWriteHookFiles[id] = false
+		fbo.postWriteHookLock.Unlock()
+	}
+}
+
+// runPostWriteHooks runs every post-write hook on the current
+// contents of the given file, and stores the results in its entry.
+func (fbo *folderBranchOps) runPostWriteHooks(
+	ctx context.Context, file Node) (err error) {
+	fbo.log.CDebugf(ctx, "Running post-write hooks on %p", file.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	ei, err := fbo.Stat(ctx, file)
+	if err != nil {
+		return err
+	}
+	if ei.Type != File && ei.Type != Exec {
+		return nil
+	}
+	name := file.GetBasename()
+	if name == "" {
+		// The file has been unlinked.
+		return nil
+	}
+
+	headLen := ei.Size
+	if headLen > postWriteHookHeadBytes {
+		headLen = postWriteHookHeadBytes
+	}
+	head := make([]byte, headLen)
+	n, err := fbo.Read(ctx, file, head, 0)
+	if err != nil {
+		return err
+	}
+	head = head[:n]
+
+	derived := make(map[string][]byte)
+	size := 0
+	for _, hook := range fbo.config.PostWriteHooks() {
+		hookName := hook.Name()
+		value, err := hook.DerivedMetadata(ctx, name, ei, head)
+		if err != nil {
+			// Keep whatever the hook stored before, rather
+			// than failing the other hooks.
+			fbo.log.CDebugf(ctx, "Post-write hook %s failed: %v",
+				hookName, err)
+			value = ei.Derived[hookName]
+		}
+		if value == nil {
+			continue
+		}
+		if size+len(hookName)+len(value) > maxXattrBytes {
+			fbo.log.CDebugf(ctx, "Dropping %d bytes of metadata from "+
+				"post-write hook %s", len(value), hookName)
+			continue
+		}
+		size += len(hookName) + len(value)
+		derived[hookName] = value
+	}
+	if len(derived) == 0 {
+		derived = nil
+	}
+	if derivedEqual(derived, ei.Derived) {
+		return nil
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setDerivedLocked(ctx, lState, filePath, derived)
+		})
+}
+
+func (fbo *folderBranchOps) setDerivedLocked(ctx context.Context,
+	lState *lockState, file path, derived map[string][]byte) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md.ReadOnly(), file)
+	if err != nil {
+		return err
+	}
+
+	if de.Type != File && de.Type != Exec {
+		return NotFileError{file}
+	}
+	if derivedEqual(de.Derived, derived) {
+		fbo.log.CDebugf(ctx, "Ignoring no-op derived metadata change")
+		return nil
+	}
+
+	// The metadata is bookkeeping rather than a change made by the
+	// user, so the ctime is left alone.
+	de.Derived = derived
+
+	parentPath := file.parentPath()
+	sao, err := newSetAttrOp(file.tailName(), parentPath.tailPointer(),
+		derivedAttr, file.tailPointer())
+	if err != nil {
+		return err
+	}
+
+	// If the MD doesn't match the MD expected by the path, that
+	// implies we are using a cached path, which implies the node has
+	// been unlinked.  In that case, there's nothing to store the
+	// metadata on.
+	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
+		fbo.log.CDebugf(ctx, "Skipping derived metadata for a removed "+
+			"file %v", file.tailPointer())
+		return nil
+	}
+
+	md.AddOp(sao)
+
+	dblock.Children[file.tailName()] = de
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr, NoExcl, nil)
+	return err
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type testMIMEHook struct{}
+
+func (testMIMEHook) Name() string {
+	return "mime"
+}
+
+func (testMIMEHook) DerivedMetadata(ctx context.Context, name string,
+	ei EntryInfo, head []byte) ([]byte, error) {
+	switch {
+	case name == "broken":
+		return nil, errors.New("broken")
+	case len(head) == 0:
+		return nil, nil
+	case bytes.HasPrefix(head, []byte("\x89PNG")):
+		return []byte("image/png"), nil
+	default:
+		return []byte("text/plain"), nil
+	}
+}
+
+func TestPostWriteHooks(t *testing.T) {
+	config1, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+	config1.AddPostWriteHook(testMIMEHook{})
+
+	kbfsOps1 := config1.KBFSOps()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, "u1", false)
+	fileNode1, _, err := kbfsOps1.CreateFile(
+		ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	writeAndCheck := func(data string, expected map[string][]byte) {
+		require.NoError(t, kbfsOps1.Truncate(ctx, fileNode1, 0))
+		require.NoError(t, kbfsOps1.Write(ctx, fileNode1, []byte(data), 0))
+		require.NoError(t, kbfsOps1.Sync(ctx, fileNode1))
+		require.NoError(t, kbfsOps1.SyncFromServerForTesting(
+			ctx, rootNode1.GetFolderBranch()))
+		ei, err := kbfsOps1.Stat(ctx, fileNode1)
+		require.NoError(t, err)
+		require.Equal(t, expected, ei.Derived)
+	}
+	writeAndCheck("hello", map[string][]byte{"mime": []byte("text/plain")})
+	writeAndCheck("\x89PNG\r\n", map[string][]byte{"mime": []byte("image/png")})
+
+	// The metadata is visible to other devices, which don't run
+	// the hooks themselves.
+	config2 := ConfigAsUser(config1, "u1")
+	defer CheckConfigAndShutdown(t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1", false)
+	_, ei, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("image/png"), ei.Derived["mime"])
+
+	// Emptying the file removes the metadata.
+	writeAndCheck("", nil)
+
+	// A failing hook keeps its old metadata.
+	writeAndCheck("hi there", map[string][]byte{"mime": []byte("text/plain")})
+	require.NoError(t, kbfsOps1.Rename(ctx, rootNode1, "a", rootNode1, "broken"))
+	writeAndCheck("\x89PNG\r\n", map[string][]byte{"mime": []byte("text/plain")})
+}
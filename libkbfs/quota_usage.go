@@ -0,0 +1,73 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// quotaUsageCacheTimeout is how long a fetched quota usage is
+// trusted, while being adjusted for local writes, before it's
+// fetched from the block server again.
+const quotaUsageCacheTimeout = time.Minute
+
+// quotaUsageCache keeps a recent copy of the user's quota usage, so
+// that writes can be checked against it without asking the block
+// server every time.
+type quotaUsageCache struct {
+	config Config
+
+	lock      sync.Mutex
+	usage     QuotaUsage
+	fetchTime time.Time // zero if usage has never been fetched
+}
+
+func newQuotaUsageCache(config Config) *quotaUsageCache {
+	return &quotaUsageCache{config: config}
+}
+
+// fetch gets the current quota usage from the block server, and
+// caches it.
+func (q *quotaUsageCache) fetch(ctx context.Context) (QuotaUsage, error) {
+	info, err := q.config.BlockServer().GetUserQuotaInfo(ctx)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	usage := MakeQuotaUsage(info)
+	q.set(usage)
+	return usage, nil
+}
+
+// get returns the cached quota usage, fetching it if it's missing or
+// stale.
+func (q *quotaUsageCache) get(ctx context.Context) (QuotaUsage, error) {
+	q.lock.Lock()
+	usage, fetchTime := q.usage, q.fetchTime
+	q.lock.Unlock()
+	if !fetchTime.IsZero() &&
+		q.config.Clock().Now().Sub(fetchTime) < quotaUsageCacheTimeout {
+		return usage, nil
+	}
+	return q.fetch(ctx)
+}
+
+// set replaces the cached quota usage, e.g. with usage reported by
+// the block server in an error.
+func (q *quotaUsageCache) set(usage QuotaUsage) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.usage = usage
+	q.fetchTime = q.config.Clock().Now()
+}
+
+// addUsedBytes accounts for bytes written since the last fetch.
+func (q *quotaUsageCache) addUsedBytes(bytes int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.usage.UsedBytes += bytes
+}
@@ -0,0 +1,455 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfssync"
+	"golang.org/x/net/context"
+)
+
+// UserDevices lists a set of devices (identified by the KIDs of
+// their crypt public keys) belonging to a single user.
+type UserDevices struct {
+	User    libkb.NormalizedUsername
+	Devices []keybase1.KID
+}
+
+type userDevicesList []UserDevices
+
+func (l userDevicesList) Len() int           { return len(l) }
+func (l userDevicesList) Less(i, j int) bool { return l[i].User < l[j].User }
+func (l userDevicesList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+type kidList []keybase1.KID
+
+func (l kidList) Len() int           { return len(l) }
+func (l kidList) Less(i, j int) bool { return l[i] < l[j] }
+func (l kidList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// RekeyHistoryEntry describes a single change to the set of users
+// and devices that have access to a TLF, as recorded in its merged MD
+// chain.  It is suitable for encoding directly as JSON.
+type RekeyHistoryEntry struct {
+	Revision      MetadataRevision
+	KeyGeneration KeyGen
+	// NewKeyGeneration is true if this revision introduced a new
+	// key generation, rather than just adding devices to the
+	// existing one.
+	NewKeyGeneration bool
+	Timestamp        time.Time
+	// Rekeyer is the user that made this revision.
+	Rekeyer libkb.NormalizedUsername
+	// RekeyerDevice is the KID of the verifying key of the device
+	// that made this revision, if it was made by a writer.
+	RekeyerDevice keybase1.KID `json:",omitempty"`
+
+	Added   []UserDevices `json:",omitempty"`
+	Removed []UserDevices `json:",omitempty"`
+}
+
+// RekeyRequestState is the state of a request, from a device that
+// doesn't yet have the keys for a TLF, for a writer to rekey it.
+type RekeyRequestState int
+
+const (
+	// RekeyRequestPending means that the rekey bit is still set
+	// in the merged head.
+	RekeyRequestPending RekeyRequestState = iota
+	// RekeyRequestAccepted means that a later revision rekeyed
+	// the TLF and cleared the rekey bit.
+	RekeyRequestAccepted
+)
+
+func (s RekeyRequestState) String() string {
+	switch s {
+	case RekeyRequestPending:
+		return "pending"
+	case RekeyRequestAccepted:
+		return "accepted"
+	default:
+		return fmt.Sprintf("RekeyRequestState(%d)", int(s))
+	}
+}
+
+// RekeyRequestStatus describes the latest rekey request recorded in
+// a TLF's merged MD chain, i.e. the latest revision that set the
+// rekey bit, and the revision that accepted it by clearing the bit,
+// if any.  It is suitable for encoding directly as JSON.
+type RekeyRequestStatus struct {
+	State           RekeyRequestState
+	Requester       libkb.NormalizedUsername
+	RequestRevision MetadataRevision
+	RequestTime     time.Time
+
+	// Accepter is the writer that rekeyed the TLF in response.
+	Accepter       libkb.NormalizedUsername `json:",omitempty"`
+	AcceptRevision MetadataRevision         `json:",omitempty"`
+	AcceptTime     time.Time
+}
+
+// userDeviceSet maps each user with access to a TLF to the set of
+// that user's devices that have keys for the TLF.
+type userDeviceSet map[keybase1.UID]map[keybase1.KID]bool
+
+// diffUserDeviceSets returns the devices present in newSet but not in
+// oldSet (added), and those present in oldSet but not in newSet
+// (removed).
+func diffUserDeviceSets(oldSet, newSet userDeviceSet) (
+	added, removed userDeviceSet) {
+	diff := func(a, b userDeviceSet) userDeviceSet {
+		d := make(userDeviceSet)
+		for uid, kids := range a {
+			for kid := range kids {
+				if b[uid][kid] {
+					continue
+				}
+				if d[uid] == nil {
+					d[uid] = make(map[keybase1.KID]bool)
+				}
+				d[uid][kid] = true
+			}
+		}
+		return d
+	}
+	return diff(newSet, oldSet), diff(oldSet, newSet)
+}
+
+// rekeyHistoryTracker incrementally derives the rekey history and
+// the latest rekey request of a TLF from its merged MD chain, and
+// caches the result so that each revision only needs to be examined
+// once.  The history is brought up to date in the background
+// whenever the head changes, so that reading it never waits on
+// fetching MD history from the server.
+type rekeyHistoryTracker struct {
+	config Config
+	log    logger.Logger
+
+	wg     kbfssync.RepeatedWaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// lock protects everything below.  Only the updater goroutine
+	// (or, in tests, the caller of update and processMD) changes
+	// the fields after head, and it only takes the lock to publish
+	// its results.
+	lock     sync.Mutex
+	head     ImmutableRootMetadata
+	updating bool
+	shutdown bool
+
+	entries []RekeyHistoryEntry
+	request *RekeyRequestStatus
+	// lastRev is the last merged revision that has been examined.
+	lastRev    MetadataRevision
+	lastKeyGen KeyGen
+	lastSet    userDeviceSet
+}
+
+func newRekeyHistoryTracker(config Config) *rekeyHistoryTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &rekeyHistoryTracker{
+		config:     config,
+		log:        config.MakeLogger(""),
+		ctx:        ctx,
+		cancel:     cancel,
+		lastRev:    MetadataRevisionUninitialized,
+		lastKeyGen: KeyGen(0),
+		lastSet:    make(userDeviceSet),
+	}
+}
+
+func (rht *rekeyHistoryTracker) userDeviceSetForMD(
+	rmd ImmutableRootMetadata) (userDeviceSet, error) {
+	set := make(userDeviceSet)
+	keyGen := rmd.LatestKeyGeneration()
+	if keyGen < FirstValidKeyGen {
+		return set, nil
+	}
+	h := rmd.GetTlfHandle()
+	uids := append(h.ResolvedWriters(), h.ResolvedReaders()...)
+	for _, uid := range uids {
+		kids, err := rmd.GetDeviceKIDs(keyGen, uid)
+		if err != nil {
+			return nil, err
+		}
+		if len(kids) == 0 {
+			continue
+		}
+		set[uid] = make(map[keybase1.KID]bool, len(kids))
+		for _, kid := range kids {
+			set[uid][kid] = true
+		}
+	}
+	return set, nil
+}
+
+func (rht *rekeyHistoryTracker) toUserDevices(ctx context.Context,
+	set userDeviceSet) ([]UserDevices, error) {
+	if len(set) == 0 {
+		return nil, nil
+	}
+	uds := make([]UserDevices, 0, len(set))
+	for uid, kids := range set {
+		name, err := rht.config.KBPKI().GetNormalizedUsername(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		ud := UserDevices{User: name}
+		for kid := range kids {
+			ud.Devices = append(ud.Devices, kid)
+		}
+		sort.Sort(kidList(ud.Devices))
+		uds = append(uds, ud)
+	}
+	sort.Sort(userDevicesList(uds))
+	return uds, nil
+}
+
+// processRekeyRequest returns the new rekey request if rmd set the
+// rekey bit, or the accepted pending one if rmd cleared it, or nil
+// if rmd didn't change the rekey request.
+func (rht *rekeyHistoryTracker) processRekeyRequest(
+	ctx context.Context, rmd ImmutableRootMetadata) (
+	*RekeyRequestStatus, error) {
+	pending := rht.request != nil &&
+		rht.request.State == RekeyRequestPending
+	if rmd.IsRekeySet() == pending {
+		return nil, nil
+	}
+	name, err := rht.config.KBPKI().GetNormalizedUsername(
+		ctx, rmd.LastModifyingUser())
+	if err != nil {
+		return nil, err
+	}
+	if !pending {
+		return &RekeyRequestStatus{
+			State:           RekeyRequestPending,
+			Requester:       name,
+			RequestRevision: rmd.Revision(),
+			RequestTime:     rmd.LocalTimestamp(),
+		}, nil
+	}
+	request := *rht.request
+	request.State = RekeyRequestAccepted
+	request.Accepter = name
+	request.AcceptRevision = rmd.Revision()
+	request.AcceptTime = rmd.LocalTimestamp()
+	return &request, nil
+}
+
+// processMD examines the given merged revision, which must be the
+// successor of the last examined one, and records a history entry if
+// it changed the key generation or the set of keyed devices.
+func (rht *rekeyHistoryTracker) processMD(
+	ctx context.Context, rmd ImmutableRootMetadata) error {
+	request, err := rht.processRekeyRequest(ctx, rmd)
+	if err != nil {
+		return err
+	}
+	set, err := rht.userDeviceSetForMD(rmd)
+	if err != nil {
+		return err
+	}
+	keyGen := rmd.LatestKeyGeneration()
+	added, removed := diffUserDeviceSets(rht.lastSet, set)
+	newKeyGen := keyGen != rht.lastKeyGen
+	var entry *RekeyHistoryEntry
+	if newKeyGen || len(added) > 0 || len(removed) > 0 {
+		entry = &RekeyHistoryEntry{
+			Revision:         rmd.Revision(),
+			KeyGeneration:    keyGen,
+			NewKeyGeneration: newKeyGen,
+			Timestamp:        rmd.LocalTimestamp(),
+		}
+		entry.Rekeyer, err = rht.config.KBPKI().GetNormalizedUsername(
+			ctx, rmd.LastModifyingUser())
+		if err != nil {
+			return err
+		}
+		if rmd.LastModifyingUser() == rmd.LastModifyingWriter() {
+			entry.RekeyerDevice =
+				rmd.LastModifyingWriterVerifyingKey().KID()
+		}
+		entry.Added, err = rht.toUserDevices(ctx, added)
+		if err != nil {
+			return err
+		}
+		entry.Removed, err = rht.toUserDevices(ctx, removed)
+		if err != nil {
+			return err
+		}
+	}
+
+	rht.lock.Lock()
+	defer rht.lock.Unlock()
+	if request != nil {
+		rht.request = request
+	}
+	if entry != nil {
+		rht.entries = append(rht.entries, *entry)
+	}
+	rht.lastRev = rmd.Revision()
+	rht.lastKeyGen = keyGen
+	rht.lastSet = set
+	return nil
+}
+
+// update brings the cached history up to date with the given merged
+// head, fetching any intermediate revisions that haven't yet been
+// examined.
+func (rht *rekeyHistoryTracker) update(
+	ctx context.Context, head ImmutableRootMetadata) error {
+	if head.TlfID().IsPublic() || head.MergedStatus() != Merged {
+		return nil
+	}
+	if head.Revision() < rht.lastRev {
+		// The head went backwards (e.g., after a journal
+		// flush failure); start over.
+		rht.lock.Lock()
+		rht.entries = nil
+		rht.request = nil
+		rht.lastRev = MetadataRevisionUninitialized
+		rht.lastKeyGen = KeyGen(0)
+		rht.lastSet = make(userDeviceSet)
+		rht.lock.Unlock()
+	}
+	for start := rht.lastRev + 1; start < head.Revision(); {
+		end := start + maxMDsAtATime - 1
+		if end >= head.Revision() {
+			end = head.Revision() - 1
+		}
+		rmds, err := getMDRange(ctx, rht.config, head.TlfID(),
+			NullBranchID, start, end, Merged)
+		if err != nil {
+			return err
+		}
+		if len(rmds) == 0 {
+			break
+		}
+		for _, rmd := range rmds {
+			if err := rht.processMD(ctx, rmd); err != nil {
+				return err
+			}
+		}
+		start = rht.lastRev + 1
+	}
+	if head.Revision() > rht.lastRev {
+		return rht.processMD(ctx, head)
+	}
+	return nil
+}
+
+func (rht *rekeyHistoryTracker) process() {
+	defer rht.wg.Done()
+	for {
+		rht.lock.Lock()
+		head := rht.head
+		if head.Revision() == rht.lastRev {
+			rht.updating = false
+			rht.lock.Unlock()
+			return
+		}
+		rht.lock.Unlock()
+
+		ctx := ctxWithRandomIDReplayable(
+			rht.ctx, CtxFBOIDKey, CtxFBOOpID, rht.log)
+		err := rht.update(ctx, head)
+		if err != nil {
+			if rht.ctx.Err() == nil {
+				rht.log.CWarningf(ctx,
+					"Error getting rekey history for %s: %v",
+					head.TlfID(), err)
+			}
+			// Try again on the next head change.
+			rht.lock.Lock()
+			rht.updating = false
+			rht.lock.Unlock()
+			return
+		}
+	}
+}
+
+// setHead starts tracking the history of the head's TLF, if it
+// hasn't yet, and brings the history up to date with the given head
+// in the background.
+func (rht *rekeyHistoryTracker) setHead(head ImmutableRootMetadata) {
+	rht.lock.Lock()
+	defer rht.lock.Unlock()
+	rht.setHeadLocked(head)
+}
+
+// headChanged is like setHead, except that it does nothing if the
+// history isn't being tracked yet, so that no history is fetched for
+// TLFs whose status nobody asks for.
+func (rht *rekeyHistoryTracker) headChanged(head ImmutableRootMetadata) {
+	rht.lock.Lock()
+	defer rht.lock.Unlock()
+	if rht.head == (ImmutableRootMetadata{}) {
+		return
+	}
+	rht.setHeadLocked(head)
+}
+
+func (rht *rekeyHistoryTracker) setHeadLocked(head ImmutableRootMetadata) {
+	if rht.shutdown || head.TlfID().IsPublic() ||
+		head.MergedStatus() != Merged {
+		return
+	}
+	rht.head = head
+	if rht.updating {
+		return
+	}
+	rht.updating = true
+	rht.wg.Add(1)
+	go rht.process()
+}
+
+// wait returns once the history has been brought up to date with the
+// latest head passed to setHead, or the update failed.
+func (rht *rekeyHistoryTracker) wait(ctx context.Context) error {
+	return rht.wg.Wait(ctx)
+}
+
+// shutdownAndWait stops any background update, and waits for it to
+// finish.
+func (rht *rekeyHistoryTracker) shutdownAndWait() {
+	rht.lock.Lock()
+	rht.shutdown = true
+	rht.lock.Unlock()
+	rht.cancel()
+	_ = rht.wg.Wait(context.Background())
+}
+
+// getEntries returns a copy of the cached history, oldest first.
+func (rht *rekeyHistoryTracker) getEntries() []RekeyHistoryEntry {
+	rht.lock.Lock()
+	defer rht.lock.Unlock()
+	if len(rht.entries) == 0 {
+		return nil
+	}
+	entries := make([]RekeyHistoryEntry, len(rht.entries))
+	copy(entries, rht.entries)
+	return entries
+}
+
+// getRequest returns a copy of the latest rekey request, or nil if
+// there hasn't been one.
+func (rht *rekeyHistoryTracker) getRequest() *RekeyRequestStatus {
+	rht.lock.Lock()
+	defer rht.lock.Unlock()
+	if rht.request == nil {
+		return nil
+	}
+	request := *rht.request
+	return &request
+}
@@ -0,0 +1,172 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestDiffUserDeviceSets(t *testing.T) {
+	uid1 := keybase1.MakeTestUID(1)
+	uid2 := keybase1.MakeTestUID(2)
+	uid3 := keybase1.MakeTestUID(3)
+	kid1 := keybase1.KID("kid1")
+	kid2 := keybase1.KID("kid2")
+	kid3 := keybase1.KID("kid3")
+
+	oldSet := userDeviceSet{
+		uid1: {kid1: true},
+		uid2: {kid2: true, kid3: true},
+	}
+	newSet := userDeviceSet{
+		uid1: {kid1: true},
+		uid2: {kid2: true},
+		uid3: {kid1: true},
+	}
+
+	added, removed := diffUserDeviceSets(oldSet, newSet)
+	require.Equal(t, userDeviceSet{uid3: {kid1: true}}, added)
+	require.Equal(t, userDeviceSet{uid2: {kid3: true}}, removed)
+
+	added, removed = diffUserDeviceSets(newSet, newSet)
+	require.Len(t, added, 0)
+	require.Len(t, removed, 0)
+}
+
+// rekeyTLFForHistoryTest adds a device for the reader u2 of the given
+// TLF and rekeys it, then revokes u2's first device and rekeys it
+// again.  It returns the expected rekey history of the TLF, without
+// timestamps, and the heads after each rekey.
+func rekeyTLFForHistoryTest(ctx context.Context, t *testing.T,
+	config Config, tlfID tlf.ID) (
+	expected []RekeyHistoryEntry, heads []ImmutableRootMetadata) {
+	_, uid1, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	_, uid2, err := config.KBPKI().Resolve(ctx, "u2")
+	require.NoError(t, err)
+	getKID := func(uid keybase1.UID, index int) keybase1.KID {
+		keys, err := config.KBPKI().GetCryptPublicKeys(ctx, uid)
+		require.NoError(t, err)
+		return keys[index].KID()
+	}
+	u1Dev := getKID(uid1, 0)
+	u2Dev1 := getKID(uid2, 0)
+	verifyingKey, err := config.KBPKI().GetCurrentVerifyingKey(ctx)
+	require.NoError(t, err)
+
+	kbfsOps := config.KBFSOps()
+	AddDeviceForLocalUserOrBust(t, config, uid2)
+	u2Dev2 := getKID(uid2, 1)
+	err = kbfsOps.Rekey(ctx, tlfID)
+	require.NoError(t, err)
+	head, err := config.MDOps().GetForTLF(ctx, tlfID)
+	require.NoError(t, err)
+	heads = append(heads, head)
+
+	RevokeDeviceForLocalUserOrBust(t, config, uid2, 0)
+	err = kbfsOps.Rekey(ctx, tlfID)
+	require.NoError(t, err)
+	head, err = config.MDOps().GetForTLF(ctx, tlfID)
+	require.NoError(t, err)
+	heads = append(heads, head)
+
+	expected = []RekeyHistoryEntry{
+		{
+			Revision:         MetadataRevisionInitial,
+			KeyGeneration:    FirstValidKeyGen,
+			NewKeyGeneration: true,
+			Rekeyer:          "u1",
+			RekeyerDevice:    verifyingKey.KID(),
+			Added: []UserDevices{
+				{User: "u1", Devices: []keybase1.KID{u1Dev}},
+				{User: "u2", Devices: []keybase1.KID{u2Dev1}},
+			},
+		},
+		{
+			Revision:      heads[0].Revision(),
+			KeyGeneration: FirstValidKeyGen,
+			Rekeyer:       "u1",
+			RekeyerDevice: verifyingKey.KID(),
+			Added: []UserDevices{
+				{User: "u2", Devices: []keybase1.KID{u2Dev2}},
+			},
+		},
+		{
+			Revision:         heads[1].Revision(),
+			KeyGeneration:    FirstValidKeyGen + 1,
+			NewKeyGeneration: true,
+			Rekeyer:          "u1",
+			RekeyerDevice:    verifyingKey.KID(),
+			Removed: []UserDevices{
+				{User: "u2", Devices: []keybase1.KID{u2Dev1}},
+			},
+		},
+	}
+	return expected, heads
+}
+
+func requireRekeyHistoryEqual(t *testing.T,
+	expected, actual []RekeyHistoryEntry) {
+	for i := range actual {
+		require.False(t, actual[i].Timestamp.IsZero())
+		actual[i].Timestamp = time.Time{}
+	}
+	require.Equal(t, expected, actual)
+}
+
+func TestRekeyHistoryTrackerUpdate(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1", "u2")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1#u2", false)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	expected, heads := rekeyTLFForHistoryTest(ctx, t, config, tlfID)
+
+	// Catching up with the first head fetches all the revisions
+	// before it.
+	rht := newRekeyHistoryTracker(config)
+	err := rht.update(ctx, heads[0])
+	require.NoError(t, err)
+	requireRekeyHistoryEqual(t, expected[:2], rht.getEntries())
+	require.Nil(t, rht.getRequest())
+
+	// Later heads are processed incrementally.
+	err = rht.processMD(ctx, heads[1])
+	require.NoError(t, err)
+	requireRekeyHistoryEqual(t, expected, rht.getEntries())
+
+	// Updating to the same head again is a no-op.
+	err = rht.update(ctx, heads[1])
+	require.NoError(t, err)
+	requireRekeyHistoryEqual(t, expected, rht.getEntries())
+}
+
+func TestRekeyHistoryFolderStatus(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1", "u2")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1#u2", false)
+	fb := rootNode.GetFolderBranch()
+	expected, _ := rekeyTLFForHistoryTest(ctx, t, config, fb.Tlf)
+
+	// The history is fetched in the background, once the status
+	// is asked for.
+	_, _, err := config.KBFSOps().FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	ops := config.KBFSOps().(*KBFSOpsStandard).getOpsNoAdd(fb)
+	err = ops.status.rekeys.wait(ctx)
+	require.NoError(t, err)
+
+	status, _, err := config.KBFSOps().FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	requireRekeyHistoryEqual(t, expected, status.RekeyHistory)
+	require.Nil(t, status.RekeyRequest)
+}
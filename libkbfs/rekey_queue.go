@@ -145,7 +145,14 @@ func (rkq *RekeyQueueStandard) processRekeys(ctx context.Context, hasWorkCh chan
 					// Assign an ID to this rekey operation so we can track it.
 					newCtx := ctxWithRandomIDReplayable(ctx, CtxRekeyIDKey,
 						CtxRekeyOpID, nil)
-					err := rkq.config.KBFSOps().Rekey(newCtx, id)
+					// Rekeys are background work, so don't
+					// start one while the uplink is over its
+					// limit.
+					err := rkq.config.BandwidthLimiter().WaitN(
+						newCtx, BandwidthUpload, 0)
+					if err == nil {
+						err = rkq.config.KBFSOps().Rekey(newCtx, id)
+					}
 					if ch := rkq.dequeue(); ch != nil {
 						ch <- err
 						close(ch)
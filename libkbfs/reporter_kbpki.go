@@ -198,6 +198,7 @@ func (r *ReporterKBPKI) NotifySyncStatus(ctx context.Context,
 
 // Shutdown implements the Reporter interface for ReporterKBPKI.
 func (r *ReporterKBPKI) Shutdown() {
+	r.ReporterSimple.Shutdown()
 	r.canceler()
 	close(r.notifyBuffer)
 	close(r.notifySyncBuffer)
@@ -270,6 +271,25 @@ func rekeyNotification(ctx context.Context, config Config, handle *TlfHandle, fi
 	}
 }
 
+// rekeyRequestNotification tells a writer's client that the given
+// user, which has a device without keys for the TLF, asked for it to
+// be rekeyed.
+func rekeyRequestNotification(handle *TlfHandle, requester keybase1.UID,
+	requestTime time.Time) *keybase1.FSNotification {
+	return &keybase1.FSNotification{
+		PublicTopLevelFolder: handle.IsPublic(),
+		Filename:             string(handle.GetCanonicalPath()),
+		Status:               "rekey requested",
+		StatusCode:           keybase1.FSStatusCode_START,
+		NotificationType:     keybase1.FSNotificationType_REKEYING,
+		Params: map[string]string{
+			errorParamTlf: string(handle.GetCanonicalName()),
+		},
+		WriterUid: requester,
+		LocalTime: keybase1.ToTime(requestTime),
+	}
+}
+
 func baseFileEditNotification(file path, writer keybase1.UID,
 	localTime time.Time) *keybase1.FSNotification {
 	n := baseNotification(file, true)
@@ -22,7 +22,9 @@ type ReporterSimple struct {
 	filledOnce     bool
 	// errors is a circular buffer when maxErrors >= 1
 	errors []ReportedError
-	lock   sync.RWMutex // protects everything
+	lock   sync.RWMutex // protects everything above
+
+	reports *errorReportLog
 }
 
 // NewReporterSimple creates a new ReporterSimple.
@@ -31,6 +33,7 @@ func NewReporterSimple(clock Clock, maxErrors int) *ReporterSimple {
 		clock:          clock,
 		maxErrors:      maxErrors,
 		currErrorIndex: -1,
+		reports:        newErrorReportLog(maxErrors),
 	}
 
 	if maxErrors >= 1 {
@@ -42,14 +45,17 @@ func NewReporterSimple(clock Clock, maxErrors int) *ReporterSimple {
 
 // ReportErr implements the Reporter interface for ReporterSimple.
 func (r *ReporterSimple) ReportErr(ctx context.Context,
-	_ CanonicalTlfName, _ bool, _ ErrorModeType, err error) {
+	tlfName CanonicalTlfName, public bool, mode ErrorModeType, err error) {
+	now := r.clock.Now()
+	r.reports.add(now, tlfName, public, mode, err)
+
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
 	stack := make([]uintptr, 20)
 	n := runtime.Callers(2, stack)
 	re := ReportedError{
-		Time:  r.clock.Now(),
+		Time:  now,
 		Error: err,
 		Stack: stack[:n],
 	}
@@ -86,6 +92,18 @@ func (r *ReporterSimple) AllKnownErrors() []ReportedError {
 	return errors
 }
 
+// ErrorReports implements the Reporter interface for ReporterSimple.
+func (r *ReporterSimple) ErrorReports() []ErrorReport {
+	return r.reports.get()
+}
+
+// SubscribeToErrorReports implements the Reporter interface for
+// ReporterSimple.
+func (r *ReporterSimple) SubscribeToErrorReports() (
+	<-chan ErrorReport, func()) {
+	return r.reports.subscribe()
+}
+
 // Notify implements the Reporter interface for ReporterSimple.
 func (r *ReporterSimple) Notify(_ context.Context, _ *keybase1.FSNotification) {
 	// ignore notifications
@@ -99,5 +117,5 @@ func (r *ReporterSimple) NotifySyncStatus(_ context.Context,
 
 // Shutdown implements the Reporter interface for ReporterSimple.
 func (r *ReporterSimple) Shutdown() {
-
+	r.reports.shutdown()
 }
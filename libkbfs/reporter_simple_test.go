@@ -7,6 +7,10 @@ package libkbfs
 import (
 	"errors"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 func checkReportedErrors(t *testing.T, expected []error,
@@ -64,3 +68,79 @@ func TestReporterSimpleUnlimited(t *testing.T) {
 	checkReportedErrors(t, []error{err1, err2, err3, err4, err5, err6},
 		r.AllKnownErrors())
 }
+
+func TestReporterSimpleErrorReports(t *testing.T) {
+	clock := newTestClockNow()
+	r := NewReporterSimple(clock, 2)
+	defer r.Shutdown()
+	ch, unsubscribe := r.SubscribeToErrorReports()
+
+	// Errors the user can't act on aren't reported.
+	r.ReportErr(nil, "", false, ReadMode, errors.New("1"))
+	require.Len(t, r.ErrorReports(), 0)
+
+	start := clock.Now()
+	r.ReportErr(nil, "alice", false, WriteMode,
+		OverQuotaWarning{UsageBytes: 10, LimitBytes: 5})
+	report := <-ch
+	require.Equal(t, uint64(1), report.ID)
+	require.Equal(t, ErrorClassQuota, report.Class)
+	require.Equal(t, CanonicalTlfName("alice"), report.Tlf)
+	require.True(t, report.Write)
+	require.NotEmpty(t, report.Action)
+	require.Equal(t, 1, report.Count)
+
+	// A repeat within the dedup window is folded into the same
+	// report, without a new one going to subscribers.
+	clock.Add(errorReportDedupWindow / 2)
+	r.ReportErr(nil, "alice", false, WriteMode,
+		OverQuotaWarning{UsageBytes: 10, LimitBytes: 5})
+	reports := r.ErrorReports()
+	require.Len(t, reports, 1)
+	require.Equal(t, 2, reports[0].Count)
+	require.Equal(t, start, reports[0].FirstTime)
+	require.Equal(t, clock.Now(), reports[0].LastTime)
+	select {
+	case report := <-ch:
+		t.Fatalf("Unexpected report %+v", report)
+	default:
+	}
+
+	// Different errors get their own reports, and only the most
+	// recent ones are kept.
+	r.ReportErr(nil, "alice", false, ReadMode, ReadAccessError{})
+	r.ReportErr(nil, "", false, ReadMode, context.DeadlineExceeded)
+	reports = r.ErrorReports()
+	require.Len(t, reports, 2)
+	require.Equal(t, ErrorClassPermission, reports[0].Class)
+	require.Equal(t, uint64(2), reports[0].ID)
+	require.Equal(t, ErrorClassNetwork, reports[1].Class)
+	require.Equal(t, uint64(3), reports[1].ID)
+	require.Equal(t, ErrorClassPermission, (<-ch).Class)
+	require.Equal(t, ErrorClassNetwork, (<-ch).Class)
+
+	// Once the window has passed, a repeat starts a new report.
+	clock.Add(2 * time.Minute)
+	r.ReportErr(nil, "", false, ReadMode, context.DeadlineExceeded)
+	reports = r.ErrorReports()
+	require.Len(t, reports, 2)
+	require.Equal(t, uint64(4), reports[1].ID)
+	require.Equal(t, 1, reports[1].Count)
+	require.Equal(t, uint64(4), (<-ch).ID)
+
+	unsubscribe()
+	_, ok := <-ch
+	require.False(t, ok)
+}
+
+func TestClassifyError(t *testing.T) {
+	require.Equal(t, ErrorClassQuota, classifyError(BServerErrorOverQuota{}))
+	require.Equal(t, ErrorClassPermission,
+		classifyError(NeedSelfRekeyError{}))
+	require.Equal(t, ErrorClassConflict,
+		classifyError(MDServerErrorConflictRevision{}))
+	require.Equal(t, ErrorClassNetwork,
+		classifyError(ServerCircuitOpenError{}))
+	require.Equal(t, ErrorClassCorruption, classifyError(BadDataError{}))
+	require.Equal(t, ErrorClassOther, classifyError(NameExistsError{}))
+}
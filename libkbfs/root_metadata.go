@@ -70,6 +70,9 @@ type PrivateMetadata struct {
 	TLFPrivateKey kbfscrypto.TLFPrivateKey
 	// The block changes done as part of the update that created this MD
 	Changes BlockChanges
+	// The policy for encoding new file data, if it's been set to
+	// something other than the baseline.
+	BlockPolicy *BlockPolicy `codec:",omitempty"`
 
 	codec.UnknownFieldSetHandler
 
@@ -469,6 +472,25 @@ func (md *RootMetadata) UnrefBytes() uint64 {
 	return md.bareMd.UnrefBytes()
 }
 
+// BlockPolicy returns the TLF's policy for encoding new file data.
+func (md *RootMetadata) BlockPolicy() BlockPolicy {
+	if md.data.BlockPolicy == nil {
+		return BlockPolicy{}
+	}
+	return *md.data.BlockPolicy
+}
+
+// SetBlockPolicy sets the TLF's policy for encoding new file data.
+func (md *RootMetadata) SetBlockPolicy(policy BlockPolicy) {
+	if policy.equals(BlockPolicy{}) {
+		// Keep the encoding of the private metadata unchanged
+		// for TLFs that use the baseline policy.
+		md.data.BlockPolicy = nil
+		return
+	}
+	md.data.BlockPolicy = &policy
+}
+
 // DiskUsage wraps the respective method of the underlying BareRootMetadata for convenience.
 func (md *RootMetadata) DiskUsage() uint64 {
 	return md.bareMd.DiskUsage()
@@ -653,6 +675,12 @@ func (md *RootMetadata) HasKeyForUser(keyGen KeyGen, user keybase1.UID) bool {
 	return md.bareMd.HasKeyForUser(keyGen, user, md.extra)
 }
 
+// GetDeviceKIDs wraps the respective method of the underlying BareRootMetadata for convenience.
+func (md *RootMetadata) GetDeviceKIDs(keyGen KeyGen, user keybase1.UID) (
+	[]keybase1.KID, error) {
+	return md.bareMd.GetDeviceKIDs(keyGen, user, md.extra)
+}
+
 // fakeInitialRekey wraps the FakeInitialRekey test function for
 // convenience.
 func (md *RootMetadata) fakeInitialRekey(crypto cryptoPure) error {
@@ -1114,18 +1142,18 @@ func DecodeRootMetadata(codec kbfscodec.Codec, tlf tlf.ID,
 	}
 	if ver > SegregatedKeyBundlesVer {
 		// Shouldn't be possible at the moment.
-		panic("Invalid metadata version")
+		return nil, NewMetadataVersionError{tlf, ver}
 	}
 	if ver < SegregatedKeyBundlesVer {
 		var brmd BareRootMetadataV2
 		if err := codec.Decode(buf, &brmd); err != nil {
-			return nil, err
+			return nil, MDDecodeError{tlf, ver, err}
 		}
 		return &brmd, nil
 	}
 	var brmd BareRootMetadataV3
 	if err := codec.Decode(buf, &brmd); err != nil {
-		return nil, err
+		return nil, MDDecodeError{tlf, ver, err}
 	}
 	return &brmd, nil
 }
@@ -1143,7 +1171,7 @@ func DecodeRootMetadataSigned(
 	}
 	if ver > SegregatedKeyBundlesVer {
 		// Shouldn't be possible at the moment.
-		panic("Invalid metadata version")
+		return nil, NewMetadataVersionError{tlf, ver}
 	}
 	var rmds RootMetadataSigned
 	if ver < SegregatedKeyBundlesVer {
@@ -1152,19 +1180,26 @@ func DecodeRootMetadataSigned(
 		rmds.MD = &BareRootMetadataV3{}
 	}
 	if err := codec.Decode(buf, &rmds); err != nil {
-		return nil, err
+		return nil, MDDecodeError{tlf, ver, err}
+	}
+	// A nil MD field decodes to a nil interface, which would
+	// otherwise make every later use of rmds.MD panic.
+	if rmds.MD == nil {
+		return nil, MDDecodeError{tlf, ver, errors.New("No metadata")}
 	}
 	if ver < SegregatedKeyBundlesVer {
 		// For v2, the writer signature is in rmds.MD, so copy
 		// it out.
 		if !rmds.WriterSigInfo.IsNil() {
-			return nil, fmt.Errorf(
-				"Decoded RootMetadataSigned with version "+
-					"%d unexpectedly has non-nil "+
-					"writer signature %s",
-				ver, rmds.WriterSigInfo)
+			return nil, MDDecodeError{tlf, ver, fmt.Errorf(
+				"Unexpectedly non-nil writer signature %s",
+				rmds.WriterSigInfo)}
+		}
+		mdv2, ok := rmds.MD.(*BareRootMetadataV2)
+		if !ok {
+			return nil, MDDecodeError{tlf, ver, fmt.Errorf(
+				"Unexpected metadata type %T", rmds.MD)}
 		}
-		mdv2 := rmds.MD.(*BareRootMetadataV2)
 		rmds.WriterSigInfo = mdv2.WriterMetadataSigInfo
 	}
 	rmds.untrustedServerTimestamp = untrustedServerTimestamp
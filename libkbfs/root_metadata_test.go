@@ -75,6 +75,7 @@ func makeFakePrivateMetadataFuture(t *testing.T) privateMetadataFuture {
 				},
 				0,
 			},
+			&BlockPolicy{Compression: CompressionType(1)},
 			codec.UnknownFieldSetHandler{},
 			BlockChanges{},
 		},
@@ -565,6 +566,8 @@ func (kc *dummyNoKeyCache) PutTLFCryptKey(_ tlf.ID, _ KeyGen, _ kbfscrypto.TLFCr
 	return nil
 }
 
+func (kc *dummyNoKeyCache) Clear() {}
+
 // Test upconversion from MDv2 to MDv3 for a private folder.
 func TestRootMetadataUpconversionPrivate(t *testing.T) {
 	config := MakeTestConfigOrBust(t, "alice", "bob", "charlie")
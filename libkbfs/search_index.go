@@ -0,0 +1,732 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+const (
+	// searchIndexMaxContentBytes is the size of the largest file
+	// whose contents are indexed; only the names of bigger files
+	// are.
+	searchIndexMaxContentBytes = 1 << 20
+	// searchIndexStorageKeysFile holds the keys that seal the
+	// index files, wrapped by the device key.
+	searchIndexStorageKeysFile = "storage_keys"
+)
+
+// SearchIndexNotEnabledError is returned by SearchIndex.Search for a
+// TLF that hasn't been enabled with SearchIndex.EnableTLF.
+type SearchIndexNotEnabledError struct {
+	TlfID tlf.ID
+}
+
+// Error implements the error interface for SearchIndexNotEnabledError.
+func (e SearchIndexNotEnabledError) Error() string {
+	return fmt.Sprintf("Search isn't enabled for folder %s", e.TlfID)
+}
+
+// SearchResult is a single entry matching a SearchIndex query.
+type SearchResult struct {
+	// Path is the path of the entry, relative to the root of its
+	// TLF.
+	Path string
+	Type EntryType
+}
+
+type searchResultsByPath []SearchResult
+
+func (r searchResultsByPath) Len() int           { return len(r) }
+func (r searchResultsByPath) Less(i, j int) bool { return r[i].Path < r[j].Path }
+func (r searchResultsByPath) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// searchTerms splits s into lower-case words, without duplicates.
+func searchTerms(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	seen := make(map[string]bool, len(words))
+	terms := words[:0]
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// searchIndexDoc is what's indexed about a single entry.
+type searchIndexDoc struct {
+	Type         EntryType
+	NameTerms    []string `codec:",omitempty"`
+	ContentTerms []string `codec:",omitempty"`
+}
+
+// searchIndexInfo is the structure stored, sealed, in the index file
+// of a TLF.
+type searchIndexInfo struct {
+	// Revision is the TLF revision the index is up to date with.
+	Revision MetadataRevision
+	Docs     map[string]searchIndexDoc
+
+	codec.UnknownFieldSetHandler
+}
+
+// searchIndexWork is a batch of changes for the worker of a
+// tlfSearchIndex to apply, or, if done is non-nil, a request to be
+// told once all the earlier changes have been applied.
+type searchIndexWork struct {
+	changes []PathChange
+	done    chan struct{}
+}
+
+// tlfSearchIndex is the index of a single TLF.  It's registered as a
+// PathObserver for the TLF, and applies the announced changes in the
+// background, since observers are called with the TLF locked.
+type tlfSearchIndex struct {
+	config  Config
+	log     logger.Logger
+	root    Node
+	tlfID   tlf.ID
+	path    string
+	keyring *kbfscrypto.StorageKeyring
+
+	// lock protects everything below.
+	lock     sync.Mutex
+	revision MetadataRevision
+	docs     map[string]searchIndexDoc
+	terms    map[string]map[string]bool
+	// dirs holds the nodes of all the indexed directories, so
+	// that changes under them keep being announced.
+	dirs    map[string]Node
+	pending []searchIndexWork
+
+	kickCh     chan struct{}
+	shutdownCh chan struct{}
+	doneCh     chan struct{}
+}
+
+var _ PathObserver = (*tlfSearchIndex)(nil)
+
+// LocalChange implements the Observer interface for tlfSearchIndex.
+func (t *tlfSearchIndex) LocalChange(
+	ctx context.Context, node Node, write WriteRange) {
+}
+
+// BatchChanges implements the Observer interface for tlfSearchIndex.
+func (t *tlfSearchIndex) BatchChanges(
+	ctx context.Context, changes []NodeChange) {
+}
+
+// TlfHandleChange implements the Observer interface for
+// tlfSearchIndex.
+func (t *tlfSearchIndex) TlfHandleChange(
+	ctx context.Context, newHandle *TlfHandle) {
+}
+
+// PathChanges implements the PathObserver interface for
+// tlfSearchIndex.
+func (t *tlfSearchIndex) PathChanges(
+	ctx context.Context, changes []PathChange) {
+	t.enqueue(searchIndexWork{changes: changes})
+}
+
+func (t *tlfSearchIndex) enqueue(w searchIndexWork) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending = append(t.pending, w)
+	select {
+	case t.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+// relPath returns the path of the entry with the given canonical
+// path, relative to the root of the TLF.
+func (t *tlfSearchIndex) relPath(canonicalPath string) (string, bool) {
+	// The first component after the prefix is the TLF name, which
+	// may change along with the handle.
+	prefix := buildCanonicalPathForTlf(t.tlfID) + "/"
+	if !strings.HasPrefix(canonicalPath, prefix) {
+		return "", false
+	}
+	parts := strings.SplitN(canonicalPath[len(prefix):], "/", 2)
+	if len(parts) < 2 || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func (t *tlfSearchIndex) lookup(ctx context.Context, rel string) (
+	Node, EntryInfo, error) {
+	kbfsOps := t.config.KBFSOps()
+	node := t.root
+	var ei EntryInfo
+	for _, name := range strings.Split(rel, "/") {
+		if node == nil {
+			return nil, EntryInfo{}, NoSuchNameError{rel}
+		}
+		var err error
+		node, ei, err = kbfsOps.Lookup(ctx, node, name)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
+	}
+	return node, ei, nil
+}
+
+// addTermsLocked adds the terms of doc to the inverted index.
+func (t *tlfSearchIndex) addTermsLocked(rel string, doc searchIndexDoc) {
+	for _, terms := range [][]string{doc.NameTerms, doc.ContentTerms} {
+		for _, term := range terms {
+			paths, ok := t.terms[term]
+			if !ok {
+				paths = make(map[string]bool)
+				t.terms[term] = paths
+			}
+			paths[rel] = true
+		}
+	}
+}
+
+// removeDocLocked removes the entry at rel from the index, if it's
+// there.
+func (t *tlfSearchIndex) removeDocLocked(rel string) {
+	doc, ok := t.docs[rel]
+	if !ok {
+		return
+	}
+	delete(t.docs, rel)
+	for _, terms := range [][]string{doc.NameTerms, doc.ContentTerms} {
+		for _, term := range terms {
+			delete(t.terms[term], rel)
+			if len(t.terms[term]) == 0 {
+				delete(t.terms, term)
+			}
+		}
+	}
+}
+
+func (t *tlfSearchIndex) setDoc(rel string, doc searchIndexDoc) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.removeDocLocked(rel)
+	t.docs[rel] = doc
+	t.addTermsLocked(rel, doc)
+}
+
+func isUnderSearchPath(p, rel string) bool {
+	return p == rel || strings.HasPrefix(p, rel+"/")
+}
+
+// removeTree removes the entry at rel, and everything under it.
+func (t *tlfSearchIndex) removeTree(rel string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for p := range t.docs {
+		if isUnderSearchPath(p, rel) {
+			t.removeDocLocked(p)
+		}
+	}
+	for p := range t.dirs {
+		if isUnderSearchPath(p, rel) {
+			delete(t.dirs, p)
+		}
+	}
+}
+
+// moveTree moves the entry at oldRel, and everything under it, to
+// newRel, and returns false if there's no entry at oldRel.
+func (t *tlfSearchIndex) moveTree(oldRel, newRel string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.docs[oldRel]; !ok {
+		return false
+	}
+	// Anything that was renamed over is gone.
+	for p := range t.docs {
+		if isUnderSearchPath(p, newRel) {
+			t.removeDocLocked(p)
+		}
+	}
+	for p := range t.dirs {
+		if isUnderSearchPath(p, newRel) {
+			delete(t.dirs, p)
+		}
+	}
+	moved := make(map[string]searchIndexDoc)
+	for p, doc := range t.docs {
+		if isUnderSearchPath(p, oldRel) {
+			moved[newRel+strings.TrimPrefix(p, oldRel)] = doc
+			t.removeDocLocked(p)
+		}
+	}
+	for p, doc := range moved {
+		t.docs[p] = doc
+		t.addTermsLocked(p, doc)
+	}
+	for p, node := range t.dirs {
+		if isUnderSearchPath(p, oldRel) {
+			delete(t.dirs, p)
+			t.dirs[newRel+strings.TrimPrefix(p, oldRel)] = node
+		}
+	}
+	return true
+}
+
+// contentTerms returns the terms in the contents of the given file,
+// if it's small enough and looks like text.
+func (t *tlfSearchIndex) contentTerms(ctx context.Context, file Node,
+	ei EntryInfo) ([]string, error) {
+	if ei.Size == 0 || ei.Size > searchIndexMaxContentBytes {
+		return nil, nil
+	}
+	buf := make([]byte, ei.Size)
+	n, err := t.config.KBFSOps().Read(ctx, file, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(buf[:n]) {
+		return nil, nil
+	}
+	return searchTerms(string(buf[:n])), nil
+}
+
+// indexEntry indexes the entry at rel, and, if it's a directory,
+// everything under it.  The contents of files are only read if
+// withContents is set; otherwise the entries are assumed to be
+// indexed already, and only the directory nodes are collected.
+func (t *tlfSearchIndex) indexEntry(ctx context.Context, rel string,
+	node Node, ei EntryInfo, withContents bool) error {
+	if rel != "" && withContents {
+		doc := searchIndexDoc{
+			Type:      ei.Type,
+			NameTerms: searchTerms(rel[strings.LastIndex(rel, "/")+1:]),
+		}
+		if ei.Type == File || ei.Type == Exec {
+			terms, err := t.contentTerms(ctx, node, ei)
+			if err != nil {
+				return err
+			}
+			doc.ContentTerms = terms
+		}
+		t.setDoc(rel, doc)
+	}
+	if ei.Type != Dir {
+		return nil
+	}
+
+	t.lock.Lock()
+	t.dirs[rel] = node
+	t.lock.Unlock()
+
+	kbfsOps := t.config.KBFSOps()
+	children, err := kbfsOps.GetDirChildren(ctx, node)
+	if err != nil {
+		return err
+	}
+	for name := range children {
+		childNode, childEI, err := kbfsOps.Lookup(ctx, node, name)
+		if err != nil {
+			return err
+		}
+		childRel := name
+		if rel != "" {
+			childRel = rel + "/" + name
+		}
+		err = t.indexEntry(ctx, childRel, childNode, childEI, withContents)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindex indexes the entry at rel from scratch, or removes it from
+// the index if it no longer exists.
+func (t *tlfSearchIndex) reindex(ctx context.Context, rel string) error {
+	t.removeTree(rel)
+	node, ei, err := t.lookup(ctx, rel)
+	if _, ok := err.(NoSuchNameError); ok {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return t.indexEntry(ctx, rel, node, ei, true)
+}
+
+func (t *tlfSearchIndex) applyChange(
+	ctx context.Context, pc PathChange) error {
+	rel, hasRel := t.relPath(pc.Path)
+	oldRel, hasOldRel := t.relPath(pc.OldPath)
+	switch pc.Type {
+	case PathRemoved:
+		if hasRel {
+			t.removeTree(rel)
+		}
+		return nil
+	case PathRenamed:
+		if hasOldRel && hasRel && t.moveTree(oldRel, rel) {
+			// Only the name of the moved entry itself has
+			// changed.
+			node, ei, err := t.lookup(ctx, rel)
+			if _, ok := err.(NoSuchNameError); ok {
+				t.removeTree(rel)
+				return nil
+			} else if err != nil {
+				return err
+			}
+			t.lock.Lock()
+			doc := t.docs[rel]
+			t.lock.Unlock()
+			doc.Type = ei.Type
+			doc.NameTerms = searchTerms(rel[strings.LastIndex(rel, "/")+1:])
+			t.setDoc(rel, doc)
+			if ei.Type == Dir {
+				t.lock.Lock()
+				t.dirs[rel] = node
+				t.lock.Unlock()
+			}
+			return nil
+		}
+		if hasOldRel {
+			t.removeTree(oldRel)
+		}
+		if hasRel {
+			return t.reindex(ctx, rel)
+		}
+		return nil
+	default:
+		if !hasRel {
+			return nil
+		}
+		return t.reindex(ctx, rel)
+	}
+}
+
+func (t *tlfSearchIndex) save() error {
+	t.lock.Lock()
+	info := searchIndexInfo{
+		Revision: t.revision,
+		Docs:     t.docs,
+	}
+	buf, err := t.config.Codec().Encode(info)
+	t.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	sealed, err := t.keyring.Seal(buf)
+	if err != nil {
+		return err
+	}
+	tmpPath := t.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, sealed, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, t.path)
+}
+
+// load reads the saved index, if there is one, and returns whether
+// it's up to date with the given revision.
+func (t *tlfSearchIndex) load(rev MetadataRevision) (bool, error) {
+	sealed, err := ioutil.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	buf, err := t.keyring.Open(sealed)
+	if err != nil {
+		return false, err
+	}
+	var info searchIndexInfo
+	err = t.config.Codec().Decode(buf, &info)
+	if err != nil {
+		return false, err
+	}
+	if info.Revision != rev {
+		return false, nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.revision = info.Revision
+	for rel, doc := range info.Docs {
+		t.docs[rel] = doc
+		t.addTermsLocked(rel, doc)
+	}
+	return true, nil
+}
+
+func (t *tlfSearchIndex) process(ctx context.Context) {
+	for {
+		t.lock.Lock()
+		if len(t.pending) == 0 {
+			t.lock.Unlock()
+			return
+		}
+		w := t.pending[0]
+		t.pending = t.pending[1:]
+		t.lock.Unlock()
+
+		if w.done != nil {
+			close(w.done)
+			continue
+		}
+
+		for _, pc := range w.changes {
+			if err := t.applyChange(ctx, pc); err != nil {
+				t.log.CDebugf(ctx, "Couldn't index change %s of %s: %v",
+					pc.Type, pc.Path, err)
+			}
+			t.lock.Lock()
+			if pc.Revision > t.revision {
+				t.revision = pc.Revision
+			}
+			t.lock.Unlock()
+		}
+		if err := t.save(); err != nil {
+			t.log.CWarningf(ctx, "Couldn't save search index: %v", err)
+		}
+	}
+}
+
+func (t *tlfSearchIndex) processLoop() {
+	defer close(t.doneCh)
+	ctx := context.Background()
+	for {
+		select {
+		case <-t.kickCh:
+			t.process(ctx)
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
+// search returns the entries for which each of the given terms is a
+// prefix of one of their name or content terms.
+func (t *tlfSearchIndex) search(queryTerms []string) []SearchResult {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var matches map[string]bool
+	for _, qt := range queryTerms {
+		termMatches := make(map[string]bool)
+		for term, paths := range t.terms {
+			if !strings.HasPrefix(term, qt) {
+				continue
+			}
+			for p := range paths {
+				if matches == nil || matches[p] {
+					termMatches[p] = true
+				}
+			}
+		}
+		matches = termMatches
+		if len(matches) == 0 {
+			return nil
+		}
+	}
+
+	results := make([]SearchResult, 0, len(matches))
+	for p := range matches {
+		results = append(results, SearchResult{p, t.docs[p].Type})
+	}
+	sort.Sort(searchResultsByPath(results))
+	return results
+}
+
+// SearchIndex keeps an index of the names and (for small text files)
+// contents of the entries in the TLFs it's enabled for, so that they
+// can be searched without walking the TLFs.
+//
+// The index of each TLF is kept up to date from the PathChanges
+// notifications for the TLF, and is stored in a local directory,
+// sealed with a per-device key that's wrapped by the device's crypt
+// key.  A stored index is only reused if the TLF hasn't changed since
+// it was written; otherwise the TLF is indexed from scratch.
+//
+// To make sure that changes anywhere in a TLF are announced, the
+// index holds on to the nodes of all its directories.
+type SearchIndex struct {
+	config  Config
+	log     logger.Logger
+	dir     string
+	keyring *kbfscrypto.StorageKeyring
+
+	lock sync.Mutex
+	tlfs map[tlf.ID]*tlfSearchIndex
+}
+
+// NewSearchIndex returns a new SearchIndex that stores its indexes
+// in the given directory.
+func NewSearchIndex(ctx context.Context, config Config, dir string) (
+	*SearchIndex, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	cryptKey, err := config.KBPKI().GetCurrentCryptPublicKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := loadStorageKeyring(ctx, config.Codec(), config.Crypto(),
+		cryptKey, filepath.Join(dir, searchIndexStorageKeysFile))
+	if err != nil {
+		return nil, err
+	}
+	return &SearchIndex{
+		config:  config,
+		log:     config.MakeLogger(""),
+		dir:     dir,
+		keyring: keyring,
+		tlfs:    make(map[tlf.ID]*tlfSearchIndex),
+	}, nil
+}
+
+// EnableTLF starts indexing the TLF with the given root node, which
+// may take a while if the TLF has to be indexed from scratch.  It's
+// a no-op if the TLF is already indexed.
+func (s *SearchIndex) EnableTLF(ctx context.Context, rootNode Node) error {
+	fb := rootNode.GetFolderBranch()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.tlfs[fb.Tlf]; ok {
+		return nil
+	}
+	s.log.CDebugf(ctx, "Enabling search for %s", fb.Tlf)
+
+	t := &tlfSearchIndex{
+		config:     s.config,
+		log:        s.log,
+		root:       rootNode,
+		tlfID:      fb.Tlf,
+		path:       filepath.Join(s.dir, fb.Tlf.String()+".idx"),
+		keyring:    s.keyring,
+		docs:       make(map[string]searchIndexDoc),
+		terms:      make(map[string]map[string]bool),
+		dirs:       make(map[string]Node),
+		kickCh:     make(chan struct{}, 1),
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+
+	// Register first, so no change is missed while indexing;
+	// changes that are already indexed are harmless to apply
+	// again.
+	notifier := s.config.Notifier()
+	err := notifier.RegisterForChanges([]FolderBranch{fb}, t)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		status, _, err := s.config.KBFSOps().FolderStatus(ctx, fb)
+		if err != nil {
+			return err
+		}
+		upToDate, err := t.load(status.Revision)
+		if err != nil {
+			s.log.CDebugf(ctx, "Ignoring unreadable search index "+
+				"for %s: %v", fb.Tlf, err)
+		}
+		if !upToDate {
+			t.revision = status.Revision
+		}
+		err = t.indexEntry(ctx, "", rootNode, EntryInfo{Type: Dir}, !upToDate)
+		if err != nil {
+			return err
+		}
+		return t.save()
+	}()
+	if err != nil {
+		_ = notifier.UnregisterFromChanges([]FolderBranch{fb}, t)
+		return err
+	}
+
+	s.tlfs[fb.Tlf] = t
+	go t.processLoop()
+	return nil
+}
+
+func (s *SearchIndex) getTLF(tlfID tlf.ID) (*tlfSearchIndex, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, ok := s.tlfs[tlfID]
+	if !ok {
+		return nil, SearchIndexNotEnabledError{tlfID}
+	}
+	return t, nil
+}
+
+// Search returns the entries of the given TLF matching query, sorted
+// by path.  An entry matches if every word of query is the start of
+// a word in its name or contents, ignoring case.
+func (s *SearchIndex) Search(ctx context.Context, tlfID tlf.ID,
+	query string) ([]SearchResult, error) {
+	t, err := s.getTLF(tlfID)
+	if err != nil {
+		return nil, err
+	}
+	queryTerms := searchTerms(query)
+	if len(queryTerms) == 0 {
+		return nil, nil
+	}
+	return t.search(queryTerms), nil
+}
+
+// WaitForUpdates waits until the index of the given TLF reflects all
+// the changes to the TLF that have been announced so far.
+func (s *SearchIndex) WaitForUpdates(ctx context.Context,
+	tlfID tlf.ID) error {
+	t, err := s.getTLF(tlfID)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	t.enqueue(searchIndexWork{done: done})
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops indexing all TLFs, and saves their indexes.
+func (s *SearchIndex) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var firstErr error
+	for tlfID, t := range s.tlfs {
+		err := s.config.Notifier().UnregisterFromChanges(
+			[]FolderBranch{t.root.GetFolderBranch()}, t)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		close(t.shutdownCh)
+		<-t.doneCh
+		// Apply whatever was announced before unregistering.
+		t.process(ctx)
+		delete(s.tlfs, tlfID)
+	}
+	return firstErr
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func writeFileForSearchTest(ctx context.Context, t *testing.T,
+	kbfsOps KBFSOps, dir Node, name, data string) {
+	file, _, err := kbfsOps.CreateFile(ctx, dir, name, false, NoExcl)
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps.Write(ctx, file, []byte(data), 0))
+	require.NoError(t, kbfsOps.Sync(ctx, file))
+}
+
+func checkSearch(ctx context.Context, t *testing.T, index *SearchIndex,
+	tlfID tlf.ID, query string, expectedPaths ...string) {
+	require.NoError(t, index.WaitForUpdates(ctx, tlfID))
+	results, err := index.Search(ctx, tlfID, query)
+	require.NoError(t, err)
+	var paths []string
+	for _, r := range results {
+		paths = append(paths, r.Path)
+	}
+	require.Equal(t, expectedPaths, paths, query)
+}
+
+func TestSearchIndex(t *testing.T) {
+	config1, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "search_index")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kbfsOps1 := config1.KBFSOps()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, "u1", false)
+	tlfID := rootNode1.GetFolderBranch().Tlf
+	notesNode, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "notes")
+	require.NoError(t, err)
+	writeFileForSearchTest(
+		ctx, t, kbfsOps1, notesNode, "todo.txt", "Buy milk and eggs")
+	writeFileForSearchTest(
+		ctx, t, kbfsOps1, rootNode1, "photo.jpg", "\xff\xd8\xff milk")
+
+	index, err := NewSearchIndex(ctx, config1, dir)
+	require.NoError(t, err)
+	_, err = index.Search(ctx, tlfID, "milk")
+	require.IsType(t, SearchIndexNotEnabledError{}, err)
+	require.NoError(t, index.EnableTLF(ctx, rootNode1))
+
+	// Names and the contents of text files are indexed.
+	checkSearch(ctx, t, index, tlfID, "TODO", "notes/todo.txt")
+	checkSearch(ctx, t, index, tlfID, "milk", "notes/todo.txt")
+	checkSearch(ctx, t, index, tlfID, "mil egg", "notes/todo.txt")
+	checkSearch(ctx, t, index, tlfID, "no", "notes")
+	checkSearch(ctx, t, index, tlfID, "jpg", "photo.jpg")
+	checkSearch(ctx, t, index, tlfID, "milk cheese")
+
+	// Local changes are picked up.
+	writeFileForSearchTest(ctx, t, kbfsOps1, rootNode1, "b.txt", "hello")
+	checkSearch(ctx, t, index, tlfID, "hello", "b.txt")
+	err = kbfsOps1.Rename(ctx, rootNode1, "notes", rootNode1, "archive")
+	require.NoError(t, err)
+	checkSearch(ctx, t, index, tlfID, "milk", "archive/todo.txt")
+	checkSearch(ctx, t, index, tlfID, "notes")
+	require.NoError(t, kbfsOps1.RemoveEntry(ctx, rootNode1, "b.txt"))
+	checkSearch(ctx, t, index, tlfID, "hello")
+
+	// So are changes from other devices, deep in the tree.
+	config2 := ConfigAsUser(config1, "u1")
+	defer CheckConfigAndShutdown(t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1", false)
+	archiveNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "archive")
+	require.NoError(t, err)
+	writeFileForSearchTest(
+		ctx, t, kbfsOps2, archiveNode2, "c.txt", "remote words")
+	require.NoError(t,
+		kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch()))
+	checkSearch(ctx, t, index, tlfID, "remote", "archive/c.txt")
+
+	// A saved index that's still up to date is reused.
+	require.NoError(t, index.Shutdown(ctx))
+	index, err = NewSearchIndex(ctx, config1, dir)
+	require.NoError(t, err)
+	defer index.Shutdown(ctx)
+	require.NoError(t, index.EnableTLF(ctx, rootNode1))
+	checkSearch(ctx, t, index, tlfID, "milk", "archive/todo.txt")
+	checkSearch(ctx, t, index, tlfID, "words", "archive/c.txt")
+}
@@ -0,0 +1,371 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"golang.org/x/net/context"
+)
+
+// serverErrorClass says what a failed server RPC means for retrying.
+type serverErrorClass int
+
+const (
+	// serverErrorPermanent covers successes, and errors that will
+	// be the same next time, or that aren't the server's fault.
+	// They are never retried, and count as a healthy server.
+	serverErrorPermanent serverErrorClass = iota
+	// serverErrorThrottle means the server refused to do the work
+	// because it is overloaded, so it is always safe to retry.
+	serverErrorThrottle
+	// serverErrorTransient is a generic server-side error, or a
+	// failure to reach the server at all.  The server may or may
+	// not have done the work, so only idempotent RPCs retry it.
+	serverErrorTransient
+)
+
+// isServerTransportError returns true if err means the RPC couldn't
+// be delivered or its reply couldn't be read, as opposed to an error
+// sent back by the server.
+func isServerTransportError(err error) bool {
+	switch err.(type) {
+	case net.Error, rpc.PacketizerError, rpc.DispatcherError,
+		rpc.ReceiverError:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+func classifyServerError(err error) serverErrorClass {
+	switch e := err.(type) {
+	case MDServerErrorThrottle, BServerErrorThrottle:
+		return serverErrorThrottle
+	case BServerErrorOverQuota:
+		if e.Throttled {
+			return serverErrorThrottle
+		}
+	case MDServerError, BServerError:
+		return serverErrorTransient
+	}
+	if isServerTransportError(err) {
+		// A server that keeps dropping connections must trip
+		// the circuit breaker, not look healthy.
+		return serverErrorTransient
+	}
+	return serverErrorPermanent
+}
+
+// serverRetryPolicy is the backoff schedule for one serverErrorClass.
+type serverRetryPolicy struct {
+	// maxAttempts is the most times an RPC is sent, counting the
+	// first.
+	maxAttempts     int
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	multiplier      float64
+	// randomizationFactor spreads each wait uniformly over
+	// [1-randomizationFactor, 1+randomizationFactor] times the
+	// current interval, so that clients that failed together
+	// don't all come back together.
+	randomizationFactor float64
+}
+
+// serverRetryPolicies holds the default policy for each retryable
+// serverErrorClass.
+var serverRetryPolicies = [...]serverRetryPolicy{
+	serverErrorThrottle: {
+		maxAttempts:         10,
+		initialInterval:     1 * time.Second,
+		maxInterval:         30 * time.Second,
+		multiplier:          2,
+		randomizationFactor: 0.5,
+	},
+	serverErrorTransient: {
+		maxAttempts:         3,
+		initialInterval:     200 * time.Millisecond,
+		maxInterval:         2 * time.Second,
+		multiplier:          2,
+		randomizationFactor: 0.5,
+	},
+}
+
+// jitter returns a wait spread around interval, given a random
+// number r in [0, 1).
+func (p serverRetryPolicy) jitter(
+	interval time.Duration, r float64) time.Duration {
+	delta := p.randomizationFactor * float64(interval)
+	return time.Duration(float64(interval) - delta + r*2*delta)
+}
+
+// next returns the wait before the next attempt, given the previous
+// wait interval (or 0 before the first retry), and the interval to
+// pass in next time.
+func (p serverRetryPolicy) next(prev time.Duration) (
+	wait, interval time.Duration) {
+	interval = p.initialInterval
+	if prev > 0 {
+		interval = time.Duration(float64(prev) * p.multiplier)
+	}
+	if interval > p.maxInterval {
+		interval = p.maxInterval
+	}
+	return p.jitter(interval, rand.Float64()), interval
+}
+
+const (
+	// serverCircuitFailures is how many consecutive throttled or
+	// transient failures open a server's circuit.
+	serverCircuitFailures = 5
+	// serverCircuitCooldown is how long a circuit stays open the
+	// first time; it doubles each time a probe fails, up to
+	// serverCircuitMaxCooldown.
+	serverCircuitCooldown    = 10 * time.Second
+	serverCircuitMaxCooldown = 2 * time.Minute
+)
+
+// serverCircuitBreaker stops RPCs from going to a server that keeps
+// failing.  After serverCircuitFailures consecutive failures, the
+// circuit opens and RPCs fail fast with ServerCircuitOpenError.
+// Once the cooldown passes, one RPC at a time is let through as a
+// probe; a healthy reply closes the circuit, and another failure
+// opens it again for longer.
+type serverCircuitBreaker struct {
+	server string
+	clock  Clock
+	log    logger.Logger
+
+	lock      sync.Mutex
+	failures  int
+	cooldown  time.Duration
+	openUntil time.Time // zero while closed
+	probing   bool
+}
+
+func newServerCircuitBreaker(
+	server string, clock Clock, log logger.Logger) *serverCircuitBreaker {
+	return &serverCircuitBreaker{
+		server: server,
+		clock:  clock,
+		log:    log,
+	}
+}
+
+// allow returns nil if an RPC may be sent now, and must then be
+// followed by a call to done with the RPC's result.
+func (cb *serverCircuitBreaker) allow() error {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.openUntil.IsZero() {
+		return nil
+	}
+	if wait := cb.openUntil.Sub(cb.clock.Now()); wait > 0 {
+		return ServerCircuitOpenError{cb.server, wait}
+	}
+	if cb.probing {
+		return ServerCircuitOpenError{cb.server, 0}
+	}
+	cb.probing = true
+	return nil
+}
+
+// done records the result of an RPC that allow let through.
+func (cb *serverCircuitBreaker) done(err error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	wasProbing := cb.probing
+	cb.probing = false
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		// The caller gave up, which says nothing about the
+		// server.
+		return
+	}
+
+	if classifyServerError(err) == serverErrorPermanent {
+		if !cb.openUntil.IsZero() {
+			cb.log.Debug("Circuit to %s closed", cb.server)
+		}
+		cb.failures = 0
+		cb.cooldown = 0
+		cb.openUntil = time.Time{}
+		return
+	}
+
+	cb.failures++
+	if !wasProbing && cb.failures < serverCircuitFailures {
+		return
+	}
+	switch {
+	case cb.cooldown == 0:
+		cb.cooldown = serverCircuitCooldown
+	case wasProbing:
+		cb.cooldown *= 2
+		if cb.cooldown > serverCircuitMaxCooldown {
+			cb.cooldown = serverCircuitMaxCooldown
+		}
+	}
+	cooldown := serverRetryPolicy{randomizationFactor: 0.25}.jitter(
+		cb.cooldown, rand.Float64())
+	cb.openUntil = cb.clock.Now().Add(cooldown)
+	cb.log.Warning("Circuit to %s open for %s after %d failures; "+
+		"last error: %v", cb.server, cooldown, cb.failures, err)
+}
+
+// serverRetryMode says which failures of an RPC may be retried.
+type serverRetryMode int
+
+const (
+	// serverRetryThrottled retries only throttled RPCs, since a
+	// generic server error may have happened after the work was
+	// done.  It is the default for RPCs.
+	serverRetryThrottled serverRetryMode = iota
+	// serverRetryAll is for idempotent RPCs, which may also be
+	// retried after transient errors.
+	serverRetryAll
+	// serverRetryNone is for RPCs whose callers retry them
+	// themselves, e.g. to leave out the parts already done.
+	serverRetryNone
+)
+
+// serverRetrier sends RPCs to one server, through its circuit
+// breaker, retrying them with jittered exponential backoff according
+// to the policy for each class of error.
+type serverRetrier struct {
+	log      logger.Logger
+	breaker  *serverCircuitBreaker
+	policies [len(serverRetryPolicies)]serverRetryPolicy
+}
+
+func newServerRetrier(
+	server string, clock Clock, log logger.Logger) *serverRetrier {
+	return &serverRetrier{
+		log:      log,
+		breaker:  newServerCircuitBreaker(server, clock, log),
+		policies: serverRetryPolicies,
+	}
+}
+
+// retry calls f until it succeeds, fails in a way that mode doesn't
+// allow retrying, or runs out of attempts.  If the server's circuit
+// opens in between attempts, the error from the last attempt that
+// was actually sent is returned.
+func (r *serverRetrier) retry(ctx context.Context, name string,
+	mode serverRetryMode, f func() error) error {
+	var attempts [len(serverRetryPolicies)]int
+	var intervals [len(serverRetryPolicies)]time.Duration
+	var lastErr error
+	for {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(ServerCircuitOpenError); ok && lastErr != nil {
+			return lastErr
+		}
+		lastErr = err
+
+		class := classifyServerError(err)
+		switch {
+		case class == serverErrorPermanent, mode == serverRetryNone:
+			return err
+		case class == serverErrorTransient && mode != serverRetryAll:
+			return err
+		}
+		policy := r.policies[class]
+		attempts[class]++
+		if attempts[class] >= policy.maxAttempts {
+			return err
+		}
+		var wait time.Duration
+		wait, intervals[class] = policy.next(intervals[class])
+		r.log.CDebugf(ctx, "Retrying %s in %s after error: %v",
+			name, wait, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// do is like retry, but each attempt goes through the server's
+// circuit breaker.  Callers of retry should send their RPCs through
+// a serverRetryClient instead.
+func (r *serverRetrier) do(ctx context.Context, name string,
+	mode serverRetryMode, f func() error) error {
+	return r.retry(ctx, name, mode, func() error {
+		if err := r.breaker.allow(); err != nil {
+			return err
+		}
+		err := f()
+		r.breaker.done(err)
+		return err
+	})
+}
+
+// serverRetryClient is an rpc.GenericClient that sends RPCs through
+// a serverRetrier.  Any RPC not listed in modes gets
+// serverRetryThrottled.
+type serverRetryClient struct {
+	retrier *serverRetrier
+	client  rpc.GenericClient
+	modes   map[string]serverRetryMode
+}
+
+var _ rpc.GenericClient = serverRetryClient{}
+
+// Call implements the rpc.GenericClient interface for
+// serverRetryClient.
+func (c serverRetryClient) Call(ctx context.Context, s string,
+	args interface{}, res interface{}) error {
+	return c.retrier.do(ctx, s, c.modes[s], func() error {
+		return c.client.Call(ctx, s, args, res)
+	})
+}
+
+// Notify implements the rpc.GenericClient interface for
+// serverRetryClient.
+func (c serverRetryClient) Notify(ctx context.Context, s string,
+	args interface{}) error {
+	return c.retrier.do(ctx, s, serverRetryNone, func() error {
+		return c.client.Notify(ctx, s, args)
+	})
+}
+
+// mdServerRetryModes lists the MD server RPCs that aren't retried
+// only on throttling.
+var mdServerRetryModes = map[string]serverRetryMode{
+	"keybase.1.metadata.getMetadata":           serverRetryAll,
+	"keybase.1.metadata.getKey":                serverRetryAll,
+	"keybase.1.metadata.getKeyBundles":         serverRetryAll,
+	"keybase.1.metadata.getLatestFolderHandle": serverRetryAll,
+	"keybase.1.metadata.getFoldersForRekey":    serverRetryAll,
+	"keybase.1.metadata.ping":                  serverRetryAll,
+	"keybase.1.metadata.ping2":                 serverRetryAll,
+	"keybase.1.metadata.getMerkleRoot":         serverRetryAll,
+	"keybase.1.metadata.getMerkleRootLatest":   serverRetryAll,
+	"keybase.1.metadata.getMerkleRootSince":    serverRetryAll,
+	"keybase.1.metadata.getMerkleNode":         serverRetryAll,
+}
+
+// bServerRetryModes lists the block server RPCs that aren't retried
+// only on throttling.
+var bServerRetryModes = map[string]serverRetryMode{
+	"keybase.1.block.getBlock":         serverRetryAll,
+	"keybase.1.block.getUserQuotaInfo": serverRetryAll,
+	// batchDowngradeReferences retries these itself, leaving out
+	// the references that were already done.
+	"keybase.1.block.delReferenceWithCount":     serverRetryNone,
+	"keybase.1.block.archiveReferenceWithCount": serverRetryNone,
+	"keybase.1.block.archiveReference":          serverRetryNone,
+}
@@ -0,0 +1,176 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeRetryClient returns the errors in errs, in order, from
+// successive calls, and then nil.
+type fakeRetryClient struct {
+	errs  []error
+	calls int
+}
+
+var _ rpc.GenericClient = (*fakeRetryClient)(nil)
+
+func (c *fakeRetryClient) Call(ctx context.Context, s string,
+	args interface{}, res interface{}) error {
+	c.calls++
+	if c.calls > len(c.errs) {
+		return nil
+	}
+	return c.errs[c.calls-1]
+}
+
+func (c *fakeRetryClient) Notify(ctx context.Context, s string,
+	args interface{}) error {
+	return c.Call(ctx, s, args, nil)
+}
+
+func makeTestServerRetrier(t *testing.T, clock Clock) *serverRetrier {
+	r := newServerRetrier("test server", clock, logger.NewTestLogger(t))
+	for i := range r.policies {
+		r.policies[i].initialInterval = time.Millisecond
+		r.policies[i].maxInterval = time.Millisecond
+	}
+	return r
+}
+
+func TestServerRetryClientModes(t *testing.T) {
+	ctx := context.Background()
+	throttle := BServerErrorThrottle{Msg: "slow down"}
+	transient := BServerError{Msg: "oops"}
+	permanent := BServerErrorBlockNonExistent{}
+
+	for _, test := range []struct {
+		mode  serverRetryMode
+		errs  []error
+		err   error
+		calls int
+	}{
+		{serverRetryThrottled, []error{throttle, throttle}, nil, 3},
+		{serverRetryThrottled, []error{transient}, transient, 1},
+		{serverRetryThrottled, []error{permanent}, permanent, 1},
+		{serverRetryAll, []error{transient, throttle}, nil, 3},
+		// Transient errors give up after three attempts.
+		{serverRetryAll,
+			[]error{transient, transient, transient}, transient, 3},
+		{serverRetryNone, []error{throttle}, throttle, 1},
+	} {
+		fake := &fakeRetryClient{errs: test.errs}
+		c := serverRetryClient{
+			retrier: makeTestServerRetrier(t, newTestClockNow()),
+			client:  fake,
+			modes:   map[string]serverRetryMode{"rpc": test.mode},
+		}
+		err := c.Call(ctx, "rpc", nil, nil)
+		require.Equal(t, test.err, err, "mode %d, errs %v",
+			test.mode, test.errs)
+		require.Equal(t, test.calls, fake.calls, "mode %d, errs %v",
+			test.mode, test.errs)
+	}
+}
+
+func TestServerRetryPolicyJitter(t *testing.T) {
+	p := serverRetryPolicy{
+		initialInterval:     time.Second,
+		maxInterval:         4 * time.Second,
+		multiplier:          2,
+		randomizationFactor: 0.5,
+	}
+	require.Equal(t, 500*time.Millisecond, p.jitter(time.Second, 0))
+	require.Equal(t, time.Second, p.jitter(time.Second, 0.5))
+	require.Equal(t, 1400*time.Millisecond, p.jitter(time.Second, 0.9))
+
+	var interval time.Duration
+	for _, expected := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second,
+	} {
+		var wait time.Duration
+		wait, interval = p.next(interval)
+		require.Equal(t, expected, interval)
+		require.True(t, wait >= interval/2 && wait < interval*3/2,
+			"wait %s, interval %s", wait, interval)
+	}
+}
+
+func TestServerCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	clock := newTestClockNow()
+	r := makeTestServerRetrier(t, clock)
+	throttle := MDServerErrorThrottle{Err: errors.New("slow down")}
+	fake := &fakeRetryClient{}
+	for i := 0; i < serverCircuitFailures; i++ {
+		fake.errs = append(fake.errs, throttle)
+	}
+	c := serverRetryClient{retrier: r, client: fake}
+
+	// The circuit opens part way through the retries, and the last
+	// real error is returned.
+	err := c.Call(ctx, "rpc", nil, nil)
+	require.Equal(t, throttle, err)
+	require.Equal(t, serverCircuitFailures, fake.calls)
+
+	// Now RPCs fail fast.
+	err = c.Call(ctx, "rpc", nil, nil)
+	openErr, ok := err.(ServerCircuitOpenError)
+	require.True(t, ok, "%v", err)
+	require.True(t, openErr.RetryAfter > 0)
+	require.Equal(t, serverCircuitFailures, fake.calls)
+
+	// After the cooldown, one probe at a time is let through; if
+	// it fails, the circuit opens for longer.
+	clock.Add(serverCircuitCooldown * 2)
+	require.NoError(t, r.breaker.allow())
+	require.Equal(t, ServerCircuitOpenError{"test server", 0},
+		r.breaker.allow())
+	r.breaker.done(throttle)
+	err = r.breaker.allow()
+	openErr, ok = err.(ServerCircuitOpenError)
+	require.True(t, ok, "%v", err)
+	require.True(t, openErr.RetryAfter > serverCircuitCooldown*5/4,
+		"%s", openErr.RetryAfter)
+
+	// A successful probe closes it again.
+	clock.Add(serverCircuitCooldown * 4)
+	err = c.Call(ctx, "rpc", nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, r.breaker.allow())
+	require.NoError(t, r.breaker.allow())
+}
+
+func TestServerCircuitBreakerTransportErrors(t *testing.T) {
+	r := makeTestServerRetrier(t, newTestClockNow())
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("refused")}
+
+	// Dropped connections and dial failures count as failures, so
+	// a server that drops every connection opens the circuit.
+	for i := 0; i < serverCircuitFailures; i++ {
+		require.NoError(t, r.breaker.allow())
+		if i%2 == 0 {
+			r.breaker.done(io.EOF)
+		} else {
+			r.breaker.done(dialErr)
+		}
+	}
+	_, ok := r.breaker.allow().(ServerCircuitOpenError)
+	require.True(t, ok)
+
+	require.Equal(t, serverErrorTransient,
+		classifyServerError(rpc.NewPacketizerError("bad frame")))
+	require.Equal(t, serverErrorPermanent,
+		classifyServerError(BServerErrorBlockNonExistent{}))
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"github.com/keybase/kbfs/kbfscrypto"
+)
+
+// StandaloneKeybaseServiceCn is a KeybaseServiceCn that lets KBFS run
+// without a Keybase service, e.g. for hermetic integration tests and
+// demos.  Instead of coming from the service, the set of known users
+// and the private keys of the logged-in user are supplied by the
+// caller.  It must be used with local (in-memory or on-disk) servers.
+type StandaloneKeybaseServiceCn struct {
+	// Users is the set of users that can be resolved, along with
+	// their public keys.
+	Users []LocalUser
+	// CurrentUser is the name of the logged-in user, which must
+	// be one of Users.
+	CurrentUser libkb.NormalizedUsername
+	// SigningKey and CryptPrivateKey are the private keys of the
+	// logged-in user, and must match its current public keys.
+	SigningKey      kbfscrypto.SigningKey
+	CryptPrivateKey kbfscrypto.CryptPrivateKey
+}
+
+var _ KeybaseServiceCn = StandaloneKeybaseServiceCn{}
+
+// MakeStandaloneKeybaseServiceCn returns a StandaloneKeybaseServiceCn
+// for the given users, logged in as currentUser, with keys derived
+// deterministically from each user's name.  The keys are not secret,
+// so this is only suitable for tests and demos.
+func MakeStandaloneKeybaseServiceCn(users []libkb.NormalizedUsername,
+	currentUser libkb.NormalizedUsername) StandaloneKeybaseServiceCn {
+	return StandaloneKeybaseServiceCn{
+		Users:           MakeLocalUsers(users),
+		CurrentUser:     currentUser,
+		SigningKey:      MakeLocalUserSigningKeyOrBust(currentUser),
+		CryptPrivateKey: MakeLocalUserCryptPrivateKeyOrBust(currentUser),
+	}
+}
+
+// currentLocalUser returns the logged-in user, after checking that
+// the private keys match its current public keys.
+func (s StandaloneKeybaseServiceCn) currentLocalUser() (LocalUser, error) {
+	for _, u := range s.Users {
+		if u.Name != s.CurrentUser {
+			continue
+		}
+		if u.CurrentVerifyingKeyIndex >= len(u.VerifyingKeys) ||
+			u.VerifyingKeys[u.CurrentVerifyingKeyIndex] !=
+				s.SigningKey.GetVerifyingKey() {
+			return LocalUser{}, fmt.Errorf(
+				"Signing key doesn't match the current verifying "+
+					"key of user %s", s.CurrentUser)
+		}
+		if u.CurrentCryptPublicKeyIndex >= len(u.CryptPublicKeys) ||
+			u.CryptPublicKeys[u.CurrentCryptPublicKeyIndex] !=
+				s.CryptPrivateKey.GetPublicKey() {
+			return LocalUser{}, fmt.Errorf(
+				"Crypt private key doesn't match the current crypt "+
+					"public key of user %s", s.CurrentUser)
+		}
+		return u, nil
+	}
+	return LocalUser{}, fmt.Errorf("User %s not in list of users",
+		s.CurrentUser)
+}
+
+// NewKeybaseService implements the KeybaseServiceCn interface for
+// StandaloneKeybaseServiceCn.
+func (s StandaloneKeybaseServiceCn) NewKeybaseService(config Config,
+	params InitParams, ctx Context, log logger.Logger) (
+	KeybaseService, error) {
+	u, err := s.currentLocalUser()
+	if err != nil {
+		return nil, err
+	}
+
+	codec := config.Codec()
+	if params.ServerInMemory {
+		return NewKeybaseDaemonMemory(u.UID, s.Users, codec), nil
+	}
+
+	if len(params.ServerRootDir) > 0 {
+		favPath := filepath.Join(params.ServerRootDir, "kbfs_favs")
+		return NewKeybaseDaemonDisk(u.UID, s.Users, favPath, codec)
+	}
+
+	return nil, errors.New(
+		"Can't run standalone without a local server")
+}
+
+// NewCrypto implements the KeybaseServiceCn interface for
+// StandaloneKeybaseServiceCn.
+func (s StandaloneKeybaseServiceCn) NewCrypto(config Config,
+	params InitParams, ctx Context, log logger.Logger) (Crypto, error) {
+	if _, err := s.currentLocalUser(); err != nil {
+		return nil, err
+	}
+	return NewCryptoLocal(config.Codec(), s.SigningKey, s.CryptPrivateKey),
+		nil
+}
+
+// standaloneContext is a Context that keeps its logs and data under
+// a single directory, and has no Keybase service to connect to.
+type standaloneContext struct {
+	dir string
+}
+
+// NewStandaloneContext returns a Context for running KBFS without a
+// Keybase service, which keeps its logs and data (e.g. write
+// journals, and the data of the local servers) under the given
+// directory.
+func NewStandaloneContext(dir string) Context {
+	return standaloneContext{dir}
+}
+
+func (c standaloneContext) GetRunMode() libkb.RunMode {
+	return libkb.DevelRunMode
+}
+
+func (c standaloneContext) GetLogDir() string {
+	return filepath.Join(c.dir, "logs")
+}
+
+func (c standaloneContext) GetDataDir() string {
+	return c.dir
+}
+
+func (c standaloneContext) ConfigureSocketInfo() error {
+	return nil
+}
+
+func (c standaloneContext) GetSocket(clearError bool) (
+	net.Conn, rpc.Transporter, bool, error) {
+	return nil, nil, false,
+		errors.New("No Keybase service when running standalone")
+}
+
+func (c standaloneContext) NewRPCLogFactory() *libkb.RPCLogFactory {
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestStandaloneKeybaseServiceCnKeyMismatch(t *testing.T) {
+	users := []libkb.NormalizedUsername{"u1", "u2"}
+	s := MakeStandaloneKeybaseServiceCn(users, "u1")
+	_, err := s.currentLocalUser()
+	require.NoError(t, err)
+
+	s.SigningKey = MakeLocalUserSigningKeyOrBust("u2")
+	_, err = s.currentLocalUser()
+	require.Error(t, err)
+
+	s = MakeStandaloneKeybaseServiceCn(users, "u3")
+	_, err = s.currentLocalUser()
+	require.Error(t, err)
+
+	ctx := NewStandaloneContext(os.TempDir())
+	b := NewConfigBuilderFromParams(ctx, testConfigBuilderParams()).
+		WithStandalone(s)
+	err = b.Validate()
+	require.IsType(t, InvalidConfigError{}, err)
+	require.Equal(t, "Standalone", err.(InvalidConfigError).Param)
+
+	b = NewConfigBuilderFromParams(ctx, testConfigBuilderParams()).
+		WithStandalone(MakeStandaloneKeybaseServiceCn(users, "u1"))
+	require.NoError(t, b.Validate())
+	b.WithRemoteServers("bserver:443", "mdserver:443")
+	err = b.Validate()
+	require.IsType(t, InvalidConfigError{}, err)
+	require.Equal(t, "Standalone", err.(InvalidConfigError).Param)
+}
+
+func makeStandaloneConfigForTest(t *testing.T, dir string) Config {
+	users := []libkb.NormalizedUsername{"u1", "u2"}
+	config, err := NewConfigBuilder(NewStandaloneContext(dir)).
+		WithLogger(logger.NewTestLogger(t)).
+		WithJournalRoot("", TLFJournalBackgroundWorkEnabled).
+		WithStandalone(MakeStandaloneKeybaseServiceCn(users, "u1")).
+		Build()
+	require.NoError(t, err)
+	return config
+}
+
+func TestStandaloneReadWrite(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "standalone")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	config := makeStandaloneConfigForTest(t, tempdir)
+	shutdown := true
+	defer func() {
+		if shutdown {
+			err := config.Shutdown()
+			require.NoError(t, err)
+		}
+	}()
+
+	ctx, err := NewContextWithCancellationDelayer(
+		NewContextReplayable(context.Background(),
+			func(c context.Context) context.Context {
+				return c
+			}))
+	require.NoError(t, err)
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1,u2", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+
+	// The servers keep their data on disk by default, so it
+	// survives a restart.
+	shutdown = false
+	err = config.Shutdown()
+	require.NoError(t, err)
+	config = makeStandaloneConfigForTest(t, tempdir)
+	shutdown = true
+
+	rootNode = GetRootNodeOrBust(ctx, t, config, "u1,u2", false)
+	kbfsOps = config.KBFSOps()
+	fileNode, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	buf = make([]byte, len(data))
+	n, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+}
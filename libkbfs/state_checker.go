@@ -68,6 +68,14 @@ func (sc *StateChecker) findAllBlocksInPath(ctx context.Context,
 		return err
 	}
 
+	// The blocks of an indirect directory.
+	for _, iptr := range dblock.IPtrs {
+		blockSizes[iptr.BlockPointer] = iptr.EncodedSize
+	}
+	for _, info := range dblock.innerPtrs {
+		blockSizes[info.BlockPointer] = info.EncodedSize
+	}
+
 	for name, de := range dblock.Children {
 		if de.Type == Sym {
 			continue
@@ -151,30 +159,10 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlf tlf.ID) error
 	lastGCRevisionTime, lastGCRev := sc.getLastGCData(ctx, tlf)
 
 	// Build the expected block list.
-	expectedLiveBlocks := make(map[BlockPointer]bool)
-	expectedRef := uint64(0)
-	archivedBlocks := make(map[BlockPointer]bool)
+	expectedLiveBlocks, archivedBlocks, expectedRef, gcRevision :=
+		expectedBlockRefs(rmds)
 	actualLiveBlocks := make(map[BlockPointer]uint32)
 
-	// See what the last GC op revision is.  All unref'd pointers from
-	// that revision or earlier should be deleted from the block
-	// server.
-	gcRevision := MetadataRevisionUninitialized
-	for _, rmd := range rmds {
-		// Don't process copies.
-		if rmd.IsWriterMetadataCopiedSet() {
-			continue
-		}
-
-		for _, op := range rmd.data.Changes.Ops {
-			GCOp, ok := op.(*GCOp)
-			if !ok {
-				continue
-			}
-			gcRevision = GCOp.LatestRev
-		}
-	}
-
 	for _, rmd := range rmds {
 		// Don't process copies.
 		if rmd.IsWriterMetadataCopiedSet() {
@@ -203,48 +191,7 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlf tlf.ID) error
 		for _, op := range rmd.data.Changes.Ops {
 			_, isGCOp := op.(*GCOp)
 			hasGCOp = hasGCOp || isGCOp
-
-			opRefs := make(map[BlockPointer]bool)
-			for _, ptr := range op.Refs() {
-				if ptr != zeroPtr {
-					expectedLiveBlocks[ptr] = true
-					opRefs[ptr] = true
-				}
-			}
-			if !isGCOp {
-				for _, ptr := range op.Unrefs() {
-					delete(expectedLiveBlocks, ptr)
-					if ptr != zeroPtr {
-						// If the revision has been garbage-collected,
-						// or if the pointer has been referenced and
-						// unreferenced within the same op (which
-						// indicates a failed and retried sync), the
-						// corresponding block should already be
-						// cleaned up.
-						if rmd.Revision() <= gcRevision || opRefs[ptr] {
-							delete(archivedBlocks, ptr)
-						} else {
-							archivedBlocks[ptr] = true
-						}
-					}
-				}
-			}
-			for _, update := range op.allUpdates() {
-				delete(expectedLiveBlocks, update.Unref)
-				if update.Unref != zeroPtr && update.Ref != update.Unref {
-					if rmd.Revision() <= gcRevision {
-						delete(archivedBlocks, update.Unref)
-					} else {
-						archivedBlocks[update.Unref] = true
-					}
-				}
-				if update.Ref != zeroPtr {
-					expectedLiveBlocks[update.Ref] = true
-				}
-			}
 		}
-		expectedRef += rmd.RefBytes()
-		expectedRef -= rmd.UnrefBytes()
 
 		if len(rmd.data.Changes.Ops) == 1 && hasGCOp {
 			// Don't check GC status for GC revisions
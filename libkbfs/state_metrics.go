@@ -0,0 +1,64 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// functionalGauge is a metrics.Gauge whose value is computed
+// whenever it's read, for exporting state that's already tracked
+// elsewhere.
+type functionalGauge struct {
+	value func() int64
+}
+
+var _ metrics.Gauge = functionalGauge{}
+
+// Snapshot implements the metrics.Gauge interface for
+// functionalGauge.
+func (g functionalGauge) Snapshot() metrics.Gauge {
+	return metrics.GaugeSnapshot(g.Value())
+}
+
+// Update implements the metrics.Gauge interface for
+// functionalGauge.
+func (g functionalGauge) Update(int64) {
+	panic("Update called on a functionalGauge")
+}
+
+// Value implements the metrics.Gauge interface for functionalGauge.
+func (g functionalGauge) Value() int64 {
+	return g.value()
+}
+
+// registerStateMetrics registers gauges in r for the block cache's
+// hit counts and size, and for the backlog of any journals, which
+// are read each time the gauges are.
+func registerStateMetrics(config Config, bcache *BlockCacheStandard,
+	r metrics.Registry) {
+	if bcache != nil {
+		r.Register("BlockCache.Hits", functionalGauge{func() int64 {
+			hits, _, _, _ := bcache.getStats()
+			return int64(hits)
+		}})
+		r.Register("BlockCache.Misses", functionalGauge{func() int64 {
+			_, misses, _, _ := bcache.getStats()
+			return int64(misses)
+		}})
+		r.Register("BlockCache.Bytes", functionalGauge{func() int64 {
+			_, _, totalBytes, _ := bcache.getStats()
+			return int64(totalBytes)
+		}})
+	}
+	r.Register("Journal.UnflushedBytes", functionalGauge{func() int64 {
+		jServer, err := GetJournalServer(config)
+		if err != nil {
+			// Journaling isn't enabled.
+			return 0
+		}
+		return jServer.getUnflushedBytes()
+	}})
+}
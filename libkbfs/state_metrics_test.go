@@ -0,0 +1,44 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/tlf"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateMetrics(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	registry := metrics.NewRegistry()
+	bcache := NewBlockCacheStandard(10, 1<<20)
+	registerStateMetrics(config, bcache, registry)
+	gauge := func(name string) int64 {
+		return registry.Get(name).(metrics.Gauge).Value()
+	}
+
+	ptr := BlockPointer{ID: fakeBlockID(1)}
+	_, err := bcache.Get(ptr)
+	require.IsType(t, NoSuchBlockError{}, err)
+	require.Equal(t, int64(0), gauge("BlockCache.Hits"))
+	require.Equal(t, int64(1), gauge("BlockCache.Misses"))
+
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = []byte{1, 2, 3}
+	err = bcache.Put(ptr, tlf.FakeID(1, false), block, TransientEntry)
+	require.NoError(t, err)
+	_, err = bcache.Get(ptr)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), gauge("BlockCache.Hits"))
+	require.Equal(t, int64(1), gauge("BlockCache.Misses"))
+	require.NotEqual(t, int64(0), gauge("BlockCache.Bytes"))
+
+	// Without journaling, there's never a backlog.
+	require.Equal(t, int64(0), gauge("Journal.UnflushedBytes"))
+}
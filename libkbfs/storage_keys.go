@@ -0,0 +1,141 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"golang.org/x/net/context"
+)
+
+// wrappedStorageKey is a StorageKey encrypted for a device's crypt
+// public key, the same way a TLFCryptKeyClientHalf is, so that only
+// the device (via Crypto.DecryptTLFCryptKeyClientHalf) can unwrap
+// it.
+type wrappedStorageKey struct {
+	EPubKey      kbfscrypto.TLFEphemeralPublicKey
+	EncryptedKey EncryptedTLFCryptKeyClientHalf
+
+	codec.UnknownFieldSetHandler
+}
+
+// storageKeysInfo is the structure stored in a storage keys file.
+type storageKeysInfo struct {
+	// CryptKey is the device key the storage keys are wrapped
+	// for.
+	CryptKey kbfscrypto.CryptPublicKey
+	// Keys[i] is the wrapped storage key of generation i+1.
+	Keys []wrappedStorageKey
+
+	codec.UnknownFieldSetHandler
+}
+
+func wrapStorageKey(crypto cryptoPure, cryptKey kbfscrypto.CryptPublicKey,
+	key kbfscrypto.StorageKey) (wrappedStorageKey, error) {
+	// Only the ephemeral key pair is needed.
+	_, _, ePubKey, ePrivKey, _, err := crypto.MakeRandomTLFKeys()
+	if err != nil {
+		return wrappedStorageKey{}, err
+	}
+	encryptedKey, err := crypto.EncryptTLFCryptKeyClientHalf(
+		ePrivKey, cryptKey,
+		kbfscrypto.MakeTLFCryptKeyClientHalf(key.Data()))
+	if err != nil {
+		return wrappedStorageKey{}, err
+	}
+	return wrappedStorageKey{
+		EPubKey:      ePubKey,
+		EncryptedKey: encryptedKey,
+	}, nil
+}
+
+func unwrapStorageKey(ctx context.Context, crypto Crypto,
+	wrapped wrappedStorageKey) (kbfscrypto.StorageKey, error) {
+	clientHalf, err := crypto.DecryptTLFCryptKeyClientHalf(
+		ctx, wrapped.EPubKey, wrapped.EncryptedKey)
+	if err != nil {
+		return kbfscrypto.StorageKey{}, err
+	}
+	return kbfscrypto.MakeStorageKey(clientHalf.Data()), nil
+}
+
+// writeStorageKeys wraps the given keys for cryptKey and writes them
+// to path, replacing any existing file atomically and durably, since
+// losing it would make everything sealed with the keys unreadable.
+func writeStorageKeys(codec kbfscodec.Codec, crypto cryptoPure,
+	cryptKey kbfscrypto.CryptPublicKey, keys []kbfscrypto.StorageKey,
+	path string) error {
+	info := storageKeysInfo{CryptKey: cryptKey}
+	for _, key := range keys {
+		wrapped, err := wrapStorageKey(crypto, cryptKey, key)
+		if err != nil {
+			return err
+		}
+		info.Keys = append(info.Keys, wrapped)
+	}
+	return serializeToFileAtomic(codec, info, path)
+}
+
+// loadStorageKeyring reads the storage keys at path and unwraps them
+// with the current device's crypt key, which must be cryptKey.  If
+// there's no file at path, a new keyring with a random key is made
+// and written there.
+func loadStorageKeyring(ctx context.Context, codec kbfscodec.Codec,
+	crypto Crypto, cryptKey kbfscrypto.CryptPublicKey, path string) (
+	*kbfscrypto.StorageKeyring, error) {
+	var info storageKeysInfo
+	err := kbfscodec.DeserializeFromFile(codec, path, &info)
+	if os.IsNotExist(err) {
+		key, err := kbfscrypto.MakeRandomStorageKey()
+		if err != nil {
+			return nil, err
+		}
+		keys := []kbfscrypto.StorageKey{key}
+		err = writeStorageKeys(codec, crypto, cryptKey, keys, path)
+		if err != nil {
+			return nil, err
+		}
+		return kbfscrypto.NewStorageKeyring(keys)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if info.CryptKey != cryptKey {
+		return nil, fmt.Errorf(
+			"Storage keys in %s are for crypt key %s, not %s",
+			path, info.CryptKey, cryptKey)
+	}
+	keys := make([]kbfscrypto.StorageKey, 0, len(info.Keys))
+	for _, wrapped := range info.Keys {
+		key, err := unwrapStorageKey(ctx, crypto, wrapped)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return kbfscrypto.NewStorageKeyring(keys)
+}
+
+// rotateStorageKeyring adds a new random key to keyring, after
+// writing it with the existing ones to path, and returns its
+// generation.
+func rotateStorageKeyring(codec kbfscodec.Codec, crypto cryptoPure,
+	cryptKey kbfscrypto.CryptPublicKey, keyring *kbfscrypto.StorageKeyring,
+	path string) (kbfscrypto.StorageKeyGen, error) {
+	key, err := kbfscrypto.MakeRandomStorageKey()
+	if err != nil {
+		return 0, err
+	}
+	keys := append(keyring.Keys(), key)
+	err = writeStorageKeys(codec, crypto, cryptKey, keys, path)
+	if err != nil {
+		return 0, err
+	}
+	return keyring.Rotate(key), nil
+}
@@ -207,7 +207,8 @@ func MakeTestConfigOrBust(t logger.TestLogBackend,
 }
 
 // ConfigAsUser clones a test configuration, setting another user as
-// the logged in user
+// the logged in user.  If loggedInUser is empty, no user is logged
+// in.
 func ConfigAsUser(config *ConfigLocal, loggedInUser libkb.NormalizedUsername) *ConfigLocal {
 	c := newConfigForTest()
 	c.SetLoggerMaker(config.loggerFn)
@@ -221,9 +222,13 @@ func ConfigAsUser(config *ConfigLocal, loggedInUser libkb.NormalizedUsername) *C
 	c.SetClock(config.Clock())
 
 	daemon := config.KeybaseService().(*KeybaseDaemonLocal)
-	loggedInUID, ok := daemon.asserts[string(loggedInUser)]
-	if !ok {
-		panic("bad test: unknown user: " + loggedInUser)
+	var loggedInUID keybase1.UID
+	if loggedInUser != "" {
+		var ok bool
+		loggedInUID, ok = daemon.asserts[string(loggedInUser)]
+		if !ok {
+			panic("bad test: unknown user: " + loggedInUser)
+		}
 	}
 
 	var localUsers []LocalUser
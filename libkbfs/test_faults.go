@@ -0,0 +1,350 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	merkle "github.com/keybase/go-merkle-tree"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// Fault is a kind of failure that a FaultInjector can inject.
+type Fault string
+
+// The faults that a FaultInjector can inject.
+const (
+	// FaultBlockPut makes block server puts fail.
+	FaultBlockPut Fault = "BlockPut"
+	// FaultBlockGet makes block server gets fail.
+	FaultBlockGet Fault = "BlockGet"
+	// FaultMDConflict makes merged MD puts fail with a revision
+	// conflict, as if another device had written first.  The
+	// failed put lands on an unmerged branch, which conflict
+	// resolution merges once the merged branch really moves on.
+	FaultMDConflict Fault = "MDConflict"
+	// FaultPartition makes every call to the block server and the
+	// MD server fail, as if the network were down.
+	FaultPartition Fault = "Partition"
+	// FaultCrypto makes decryptions of blocks and private MD
+	// fail.
+	FaultCrypto Fault = "Crypto"
+)
+
+// InjectedFaultError is returned by operations that a FaultInjector
+// made fail.
+type InjectedFaultError struct {
+	Fault Fault
+}
+
+// Error implements the error interface for InjectedFaultError.
+func (e InjectedFaultError) Error() string {
+	return fmt.Sprintf("Injected fault: %s", e.Fault)
+}
+
+type faultSchedule struct {
+	// skip is the number of matching calls to let through before
+	// failing any.
+	skip int
+	// remaining is the number of matching calls left to fail, or
+	// -1 to fail all of them until the fault is cleared.
+	remaining int
+}
+
+// FaultInjector is used to make certain ops in the BlockServer,
+// MDServer or Crypto of a Config fail, on a deterministic schedule.
+// Unlike NaïveStaller, which only delays ops, it lets tests check
+// how KBFS recovers from errors.
+//
+// Schedules count every matching call made through the config,
+// including the ones made by background goroutines like the
+// prefetcher, so tests that need exact counts should only inject
+// faults into ops that the test itself drives.
+type FaultInjector struct {
+	config Config
+
+	lock      sync.Mutex
+	installed bool
+	schedules map[Fault]*faultSchedule
+	injected  map[Fault]int
+}
+
+// NewFaultInjector returns a new FaultInjector for the given config.
+// It doesn't change the config until the first call to Inject.
+func NewFaultInjector(config Config) *FaultInjector {
+	return &FaultInjector{
+		config:    config,
+		schedules: make(map[Fault]*faultSchedule),
+		injected:  make(map[Fault]int),
+	}
+}
+
+// installLocked wraps the servers and crypto of the config, so that
+// their ops can fail.
+func (fi *FaultInjector) installLocked() {
+	if fi.installed {
+		return
+	}
+	fi.config.SetBlockServer(&faultyBlockServer{
+		BlockServer: fi.config.BlockServer(),
+		injector:    fi,
+	})
+	fi.config.SetMDServer(&faultyMDServer{
+		MDServer: fi.config.MDServer(),
+		injector: fi,
+	})
+	fi.config.SetCrypto(&faultyCrypto{
+		Crypto:   fi.config.Crypto(),
+		injector: fi,
+	})
+	fi.installed = true
+}
+
+// Inject lets the next skip calls matching the given fault succeed,
+// and then makes the count calls after that fail.  If count is
+// negative, all of them fail until Clear is called.  Calling Inject
+// again for the same fault replaces its schedule.
+func (fi *FaultInjector) Inject(fault Fault, skip, count int) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.installLocked()
+	fi.schedules[fault] = &faultSchedule{skip: skip, remaining: count}
+}
+
+// Clear stops injecting the given fault.
+func (fi *FaultInjector) Clear(fault Fault) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	delete(fi.schedules, fault)
+}
+
+// Injected returns the number of times the given fault has been
+// injected so far.
+func (fi *FaultInjector) Injected(fault Fault) int {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return fi.injected[fault]
+}
+
+// check returns an error if a call matching any of the given faults
+// should fail right now.
+func (fi *FaultInjector) check(faults ...Fault) error {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	for _, fault := range faults {
+		s, ok := fi.schedules[fault]
+		if !ok {
+			continue
+		}
+		if s.skip > 0 {
+			s.skip--
+			continue
+		}
+		if s.remaining == 0 {
+			continue
+		}
+		if s.remaining > 0 {
+			s.remaining--
+		}
+		fi.injected[fault]++
+		return InjectedFaultError{fault}
+	}
+	return nil
+}
+
+// partitioned returns whether a partition is currently being
+// injected, without counting it as an injection.
+func (fi *FaultInjector) partitioned() bool {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	s, ok := fi.schedules[FaultPartition]
+	return ok && s.skip == 0 && s.remaining != 0
+}
+
+// faultyBlockServer is an implementation of BlockServer whose
+// operations fail according to a FaultInjector's schedule.
+type faultyBlockServer struct {
+	BlockServer
+	injector *FaultInjector
+}
+
+var _ BlockServer = (*faultyBlockServer)(nil)
+
+func (f *faultyBlockServer) Get(ctx context.Context, tlfID tlf.ID, id BlockID,
+	bctx BlockContext) (
+	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	if err := f.injector.check(FaultPartition, FaultBlockGet); err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	return f.BlockServer.Get(ctx, tlfID, id, bctx)
+}
+
+func (f *faultyBlockServer) Put(ctx context.Context, tlfID tlf.ID, id BlockID,
+	bctx BlockContext, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	if err := f.injector.check(FaultPartition, FaultBlockPut); err != nil {
+		return err
+	}
+	return f.BlockServer.Put(ctx, tlfID, id, bctx, buf, serverHalf)
+}
+
+func (f *faultyBlockServer) PutBlocks(ctx context.Context, tlfID tlf.ID,
+	puts []BlockPut) []error {
+	return putBlocksOneAtATime(ctx, f, tlfID, puts)
+}
+
+func (f *faultyBlockServer) AddBlockReference(ctx context.Context,
+	tlfID tlf.ID, id BlockID, bctx BlockContext) error {
+	if err := f.injector.check(FaultPartition); err != nil {
+		return err
+	}
+	return f.BlockServer.AddBlockReference(ctx, tlfID, id, bctx)
+}
+
+func (f *faultyBlockServer) RemoveBlockReferences(ctx context.Context,
+	tlfID tlf.ID, contexts map[BlockID][]BlockContext) (
+	map[BlockID]int, error) {
+	if err := f.injector.check(FaultPartition); err != nil {
+		return nil, err
+	}
+	return f.BlockServer.RemoveBlockReferences(ctx, tlfID, contexts)
+}
+
+func (f *faultyBlockServer) ArchiveBlockReferences(ctx context.Context,
+	tlfID tlf.ID, contexts map[BlockID][]BlockContext) error {
+	if err := f.injector.check(FaultPartition); err != nil {
+		return err
+	}
+	return f.BlockServer.ArchiveBlockReferences(ctx, tlfID, contexts)
+}
+
+func (f *faultyBlockServer) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	if err := f.injector.check(FaultPartition); err != nil {
+		return nil, err
+	}
+	return f.BlockServer.GetUserQuotaInfo(ctx)
+}
+
+// faultyMDServer is an implementation of MDServer whose operations
+// fail according to a FaultInjector's schedule.
+type faultyMDServer struct {
+	MDServer
+	injector *FaultInjector
+}
+
+var _ MDServer = (*faultyMDServer)(nil)
+
+func (f *faultyMDServer) GetForHandle(ctx context.Context, handle tlf.Handle,
+	mStatus MergeStatus) (tlf.ID, *RootMetadataSigned, error) {
+	if err := f.injector.check(FaultPartition); err != nil {
+		return tlf.NullID, nil, err
+	}
+	return f.MDServer.GetForHandle(ctx, handle, mStatus)
+}
+
+func (f *faultyMDServer) GetForTLF(ctx context.Context, id tlf.ID,
+	bid BranchID, mStatus MergeStatus) (*RootMetadataSigned, error) {
+	if err := f.injector.check(FaultPartition); err != nil {
+		return nil, err
+	}
+	return f.MDServer.GetForTLF(ctx, id, bid, mStatus)
+}
+
+func (f *faultyMDServer) GetRange(ctx context.Context, id tlf.ID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
+	[]*RootMetadataSigned, error) {
+	if err := f.injector.check(FaultPartition); err != nil {
+		return nil, err
+	}
+	return f.MDServer.GetRange(ctx, id, bid, mStatus, start, stop)
+}
+
+func (f *faultyMDServer) GetMergedDelta(ctx context.Context, id tlf.ID,
+	since MetadataRevision, maxRevs int) (
+	[]*RootMetadataSigned, bool, error) {
+	if err := f.injector.check(FaultPartition); err != nil {
+		return nil, false, err
+	}
+	return f.MDServer.GetMergedDelta(ctx, id, since, maxRevs)
+}
+
+func (f *faultyMDServer) GetMerkleRootLatest(ctx context.Context,
+	treeID keybase1.MerkleTreeID) (*MerkleRoot, error) {
+	if err := f.injector.check(FaultPartition); err != nil {
+		return nil, err
+	}
+	return f.MDServer.GetMerkleRootLatest(ctx, treeID)
+}
+
+func (f *faultyMDServer) GetMerkleNode(
+	ctx context.Context, hash merkle.Hash) ([]byte, error) {
+	if err := f.injector.check(FaultPartition); err != nil {
+		return nil, err
+	}
+	return f.MDServer.GetMerkleNode(ctx, hash)
+}
+
+func (f *faultyMDServer) Put(ctx context.Context, rmds *RootMetadataSigned,
+	extra ExtraMetadata) error {
+	if err := f.injector.check(FaultPartition); err != nil {
+		return err
+	}
+	if rmds.MD.MergedStatus() == Merged {
+		if err := f.injector.check(FaultMDConflict); err != nil {
+			return MDServerErrorConflictRevision{
+				Desc:     err.Error(),
+				Expected: rmds.MD.RevisionNumber(),
+				Actual:   rmds.MD.RevisionNumber() + 1,
+			}
+		}
+	}
+	return f.MDServer.Put(ctx, rmds, extra)
+}
+
+func (f *faultyMDServer) PruneBranch(
+	ctx context.Context, id tlf.ID, bid BranchID) error {
+	if err := f.injector.check(FaultPartition); err != nil {
+		return err
+	}
+	return f.MDServer.PruneBranch(ctx, id, bid)
+}
+
+func (f *faultyMDServer) IsConnected() bool {
+	if f.injector.partitioned() {
+		return false
+	}
+	return f.MDServer.IsConnected()
+}
+
+// faultyCrypto is an implementation of Crypto whose decryptions fail
+// according to a FaultInjector's schedule.
+type faultyCrypto struct {
+	Crypto
+	injector *FaultInjector
+}
+
+var _ Crypto = (*faultyCrypto)(nil)
+
+func (f *faultyCrypto) DecryptPrivateMetadata(
+	encryptedPMD EncryptedPrivateMetadata, key kbfscrypto.TLFCryptKey) (
+	PrivateMetadata, error) {
+	if err := f.injector.check(FaultCrypto); err != nil {
+		return PrivateMetadata{}, err
+	}
+	return f.Crypto.DecryptPrivateMetadata(encryptedPMD, key)
+}
+
+func (f *faultyCrypto) DecryptBlock(encryptedBlock EncryptedBlock,
+	key kbfscrypto.BlockCryptKey, block Block) error {
+	if err := f.injector.check(FaultCrypto); err != nil {
+		return err
+	}
+	return f.Crypto.DecryptBlock(encryptedBlock, key, block)
+}
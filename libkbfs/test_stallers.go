@@ -32,12 +32,14 @@ const (
 	StallableMDGetUnmergedForTLF     StallableMDOp = "GetUnmergedForTLF"
 	StallableMDGetRange              StallableMDOp = "GetRange"
 	StallableMDGetUnmergedRange      StallableMDOp = "GetUnmergedRange"
+	StallableMDGetMergedDelta        StallableMDOp = "GetMergedDelta"
 	StallableMDPut                   StallableMDOp = "Put"
 	StallableMDAfterPut              StallableMDOp = "AfterPut"
 	StallableMDPutUnmerged           StallableMDOp = "PutUnmerged"
 	StallableMDAfterPutUnmerged      StallableMDOp = "AfterPutUnmerged"
 	StallableMDPruneBranch           StallableMDOp = "PruneBranch"
 	StallableMDResolveBranch         StallableMDOp = "ResolveBranch"
+	StallableMDGetChangeSummary      StallableMDOp = "GetChangeSummary"
 )
 
 type stallKeyType uint64
@@ -381,6 +383,11 @@ func (f *stallingBlockServer) Put(ctx context.Context, tlfID tlf.ID, id BlockID,
 	})
 }
 
+func (f *stallingBlockServer) PutBlocks(ctx context.Context, tlfID tlf.ID,
+	puts []BlockPut) []error {
+	return putBlocksOneAtATime(ctx, f, tlfID, puts)
+}
+
 // stallingMDOps is an implementation of MDOps whose operations
 // sometimes stall. In particular, if the operation name matches
 // stallOpName, and ctx.Value(stallKey) is a key in the corresponding
@@ -437,6 +444,19 @@ func (m *stallingMDOps) GetLatestHandleForTLF(ctx context.Context, id tlf.ID) (
 	return h, err
 }
 
+func (m *stallingMDOps) GetChangeSummary(ctx context.Context,
+	handle *TlfHandle, since MetadataRevision) (
+	summary ChangeSummary, err error) {
+	m.maybeStall(ctx, StallableMDGetChangeSummary)
+	err = runWithContextCheck(ctx, func(ctx context.Context) error {
+		var errGetChangeSummary error
+		summary, errGetChangeSummary = m.delegate.GetChangeSummary(
+			ctx, handle, since)
+		return errGetChangeSummary
+	})
+	return summary, err
+}
+
 func (m *stallingMDOps) GetUnmergedForTLF(ctx context.Context, id tlf.ID,
 	bid BranchID) (md ImmutableRootMetadata, err error) {
 	m.maybeStall(ctx, StallableMDGetUnmergedForTLF)
@@ -460,6 +480,19 @@ func (m *stallingMDOps) GetRange(ctx context.Context, id tlf.ID,
 	return mds, err
 }
 
+func (m *stallingMDOps) GetMergedDelta(ctx context.Context, id tlf.ID,
+	since MetadataRevision, maxRevs int) (
+	mds []ImmutableRootMetadata, skipped bool, err error) {
+	m.maybeStall(ctx, StallableMDGetMergedDelta)
+	err = runWithContextCheck(ctx, func(ctx context.Context) error {
+		var errGetMergedDelta error
+		mds, skipped, errGetMergedDelta = m.delegate.GetMergedDelta(
+			ctx, id, since, maxRevs)
+		return errGetMergedDelta
+	})
+	return mds, skipped, err
+}
+
 func (m *stallingMDOps) GetUnmergedRange(ctx context.Context, id tlf.ID,
 	bid BranchID, start, stop MetadataRevision) (mds []ImmutableRootMetadata, err error) {
 	m.maybeStall(ctx, StallableMDGetUnmergedRange)
@@ -0,0 +1,61 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+)
+
+// TLFAccessKind says what kind of data a TLFAccessEvent fetched.
+type TLFAccessKind int
+
+const (
+	// TLFAccessMD is a fetch of one or more of the TLF's MD
+	// objects.
+	TLFAccessMD TLFAccessKind = iota
+	// TLFAccessBlock is a fetch of one of the TLF's blocks.
+	TLFAccessBlock
+)
+
+func (k TLFAccessKind) String() string {
+	switch k {
+	case TLFAccessMD:
+		return "MD"
+	case TLFAccessBlock:
+		return "block"
+	default:
+		return fmt.Sprintf("TLFAccessKind(%d)", int(k))
+	}
+}
+
+// TLFAccessEvent records that a server handed some of a TLF's data
+// to a device.
+type TLFAccessEvent struct {
+	Kind   TLFAccessKind
+	Reader keybase1.UID
+	// ReaderKey is the verifying key of the device that fetched
+	// the data.  It's empty if the fetch was anonymous, as reads
+	// of public TLFs can be.
+	ReaderKey kbfscrypto.VerifyingKey
+	Time      time.Time
+}
+
+type tlfAccessEventsByTime []TLFAccessEvent
+
+func (es tlfAccessEventsByTime) Len() int {
+	return len(es)
+}
+
+func (es tlfAccessEventsByTime) Less(i, j int) bool {
+	return es[i].Time.Before(es[j].Time)
+}
+
+func (es tlfAccessEventsByTime) Swap(i, j int) {
+	es[i], es[j] = es[j], es[i]
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLFAccessLog(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "#" + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fb := rootNode1.GetFolderBranch()
+	_, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps1.SyncFromServerForTesting(ctx, fb))
+
+	// The reader user2 fetches the TLF.
+	since := config1.Clock().Now()
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	_, _, err = kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	_, uid2, err := config2.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	key2, err := config2.KBPKI().GetCurrentVerifyingKey(ctx)
+	require.NoError(t, err)
+
+	events, err := kbfsOps1.GetTLFAccessLog(ctx, fb, since)
+	require.NoError(t, err)
+	found := false
+	for i, event := range events {
+		require.False(t, event.Time.Before(since))
+		if i > 0 {
+			require.False(t, event.Time.Before(events[i-1].Time))
+		}
+		if event.Reader == uid2 {
+			require.Equal(t, TLFAccessMD, event.Kind)
+			require.Equal(t, key2, event.ReaderKey)
+			found = true
+		}
+	}
+	require.True(t, found)
+
+	// Nothing has been fetched in the future.
+	events, err = kbfsOps1.GetTLFAccessLog(ctx, fb, since.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, events, 0)
+
+	// Readers can't see the log.
+	_, err = kbfsOps2.GetTLFAccessLog(ctx, rootNode2.GetFolderBranch(), since)
+	require.IsType(t, WriteAccessError{}, err)
+}
@@ -0,0 +1,419 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// FsckProblemType is the type of a problem found by FsckTLF.
+type FsckProblemType int
+
+const (
+	// FsckDanglingPtr means that a directory entry or an indirect
+	// file block points to a block the block server doesn't
+	// have.
+	FsckDanglingPtr FsckProblemType = iota
+	// FsckSizeMismatch means that the size of a file entry
+	// doesn't match the data in its blocks.
+	FsckSizeMismatch
+	// FsckDuplicateRef means that a block reference is used in
+	// more than one place in the directory tree.
+	FsckDuplicateRef
+	// FsckOrphanedRef means that the block server holds a
+	// reference that nothing in the MD history accounts for.
+	FsckOrphanedRef
+)
+
+func (t FsckProblemType) String() string {
+	switch t {
+	case FsckDanglingPtr:
+		return "dangling pointer"
+	case FsckSizeMismatch:
+		return "size mismatch"
+	case FsckDuplicateRef:
+		return "duplicate reference"
+	case FsckOrphanedRef:
+		return "orphaned reference"
+	default:
+		return fmt.Sprintf("FsckProblemType(%d)", int(t))
+	}
+}
+
+// FsckProblem is a single problem found by FsckTLF.
+type FsckProblem struct {
+	Type FsckProblemType
+	// Path is the slash-separated path, relative to the TLF
+	// root, of the entry the problem is in.  It's empty for the
+	// root directory, and for orphaned references.
+	Path string
+	// Ptr is the block pointer the problem is about.  For
+	// orphaned references, only its ID and RefNonce are set.
+	Ptr BlockPointer
+	// Size and DataSize are the size of the entry and the size
+	// implied by its blocks, for FsckSizeMismatch.
+	Size     uint64
+	DataSize uint64
+}
+
+func (p FsckProblem) String() string {
+	name := p.Path
+	if name == "" {
+		name = "/"
+	}
+	switch p.Type {
+	case FsckSizeMismatch:
+		return fmt.Sprintf("%s: %s: entry size %d, data size %d",
+			name, p.Type, p.Size, p.DataSize)
+	case FsckOrphanedRef:
+		return fmt.Sprintf("%s: block %s (ref %s)",
+			p.Type, p.Ptr.ID, p.Ptr.RefNonce)
+	default:
+		return fmt.Sprintf("%s: %s: %v", name, p.Type, p.Ptr)
+	}
+}
+
+// FsckResult is the result of checking a TLF with FsckTLF.
+type FsckResult struct {
+	// Revision is the merged MD revision that was checked.
+	Revision MetadataRevision
+
+	Dirs   int
+	Files  int
+	Blocks int
+
+	// OrphansChecked is false if the block server can't list the
+	// references it holds, in which case orphaned references
+	// weren't looked for.
+	OrphansChecked bool
+
+	Problems []FsckProblem
+}
+
+// isMissingBlockError returns whether err means that the block
+// server doesn't have a block, rather than that it couldn't be
+// fetched.
+func isMissingBlockError(err error) bool {
+	switch err.(type) {
+	case BServerErrorBlockNonExistent, BServerErrorBlockDeleted,
+		BServerErrorBlockArchived:
+		return true
+	default:
+		return false
+	}
+}
+
+// tlfFsck walks the directory tree of a TLFSnapshot for FsckTLF.
+type tlfFsck struct {
+	snapshot *TLFSnapshot
+	result   *FsckResult
+	// refs holds every block reference seen so far.
+	refs map[BlockRef]bool
+}
+
+func (f *tlfFsck) addProblem(p FsckProblem) {
+	f.result.Problems = append(f.result.Problems, p)
+}
+
+// getBlock gets the block for ptr, on behalf of the entry at p.  It
+// returns a nil block, after recording the problem, if the block is
+// referenced more than once or is missing.
+func (f *tlfFsck) getBlock(ctx context.Context, p string, ptr BlockPointer,
+	newBlock func() Block) (Block, error) {
+	if f.refs[ptr.Ref()] {
+		f.addProblem(FsckProblem{Type: FsckDuplicateRef, Path: p, Ptr: ptr})
+		return nil, nil
+	}
+	f.refs[ptr.Ref()] = true
+	f.result.Blocks++
+
+	block, err := f.snapshot.getBlock(ctx, ptr, newBlock)
+	if isMissingBlockError(err) {
+		f.addProblem(FsckProblem{Type: FsckDanglingPtr, Path: p, Ptr: ptr})
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return block, nil
+}
+
+// checkFileBlocks checks the file block tree rooted at ptr, which
+// starts at offset off of the file at p, and returns the offset its
+// data ends at, and whether all of its blocks were found.
+func (f *tlfFsck) checkFileBlocks(ctx context.Context, p string,
+	ptr BlockPointer, off int64) (end int64, complete bool, err error) {
+	block, err := f.getBlock(ctx, p, ptr, NewFileBlock)
+	if err != nil || block == nil {
+		return 0, false, err
+	}
+	fblock, ok := block.(*FileBlock)
+	if !ok {
+		return 0, false, NotFileBlockError{ptr, MasterBranch, path{}}
+	}
+	if !fblock.IsInd {
+		return off + int64(len(fblock.Contents)), true, nil
+	}
+
+	complete = true
+	for _, iptr := range fblock.IPtrs {
+		iend, icomplete, err := f.checkFileBlocks(
+			ctx, p, iptr.BlockPointer, iptr.Off)
+		if err != nil {
+			return 0, false, err
+		}
+		if iend > end {
+			end = iend
+		}
+		complete = complete && icomplete
+	}
+	return end, complete, nil
+}
+
+func (f *tlfFsck) checkFile(ctx context.Context, p string,
+	file DirEntry) error {
+	f.result.Files++
+	end, complete, err := f.checkFileBlocks(ctx, p, file.BlockPointer, 0)
+	if err != nil {
+		return err
+	}
+	// The size can't be checked if some of the data is missing.
+	if complete && uint64(end) != file.Size {
+		f.addProblem(FsckProblem{
+			Type:     FsckSizeMismatch,
+			Path:     p,
+			Ptr:      file.BlockPointer,
+			Size:     file.Size,
+			DataSize: uint64(end),
+		})
+	}
+	return nil
+}
+
+// collectDirEntries adds the entries of the directory block tree
+// rooted at ptr, for the directory at p, to children.
+func (f *tlfFsck) collectDirEntries(ctx context.Context, p string,
+	ptr BlockPointer, children map[string]DirEntry) error {
+	block, err := f.getBlock(ctx, p, ptr, NewDirBlock)
+	if err != nil || block == nil {
+		return err
+	}
+	dblock, ok := block.(*DirBlock)
+	if !ok {
+		return NotDirBlockError{ptr, MasterBranch, path{}}
+	}
+	if dblock.IsInd {
+		for _, iptr := range dblock.IPtrs {
+			err := f.collectDirEntries(ctx, p, iptr.BlockPointer, children)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for name, de := range dblock.Children {
+		children[name] = de
+	}
+	return nil
+}
+
+func (f *tlfFsck) checkDir(ctx context.Context, p string,
+	dir DirEntry) error {
+	f.result.Dirs++
+	children := make(map[string]DirEntry)
+	err := f.collectDirEntries(ctx, p, dir.BlockPointer, children)
+	if err != nil {
+		return err
+	}
+
+	storedNames := make([]string, 0, len(children))
+	for storedName := range children {
+		storedNames = append(storedNames, storedName)
+	}
+	sort.Strings(storedNames)
+
+	for _, storedName := range storedNames {
+		de := children[storedName]
+		name := storedName
+		if de.LongName != "" {
+			name = de.LongName
+		}
+		childPath := name
+		if p != "" {
+			childPath = p + "/" + name
+		}
+		switch de.Type {
+		case Dir:
+			err = f.checkDir(ctx, childPath, de)
+		case File, Exec:
+			err = f.checkFile(ctx, childPath, de)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FsckTLF checks the directory tree reachable from the merged head
+// of the given TLF for pointers to blocks the block server doesn't
+// have, file entries whose sizes don't match their data, and block
+// references used more than once.  If the block server supports it,
+// it also checks for orphaned references with VerifyBlockRefs.
+//
+// Problems are returned in the result; an error is only returned
+// if the check couldn't be done.
+func FsckTLF(ctx context.Context, config Config, tlfID tlf.ID) (
+	FsckResult, error) {
+	head, err := config.MDOps().GetForTLF(ctx, tlfID)
+	if err != nil {
+		return FsckResult{}, err
+	}
+	if head == (ImmutableRootMetadata{}) {
+		return FsckResult{}, fmt.Errorf("TLF %s has no MD", tlfID)
+	}
+	snapshot, err := NewTLFSnapshot(ctx, config, tlfID, head.Revision())
+	if err != nil {
+		return FsckResult{}, err
+	}
+
+	result := FsckResult{Revision: snapshot.Revision()}
+	f := tlfFsck{
+		snapshot: snapshot,
+		result:   &result,
+		refs:     make(map[BlockRef]bool),
+	}
+	if err := f.checkDir(ctx, "", snapshot.Root()); err != nil {
+		return FsckResult{}, err
+	}
+
+	v, err := VerifyBlockRefs(ctx, config, tlfID)
+	switch err.(type) {
+	case nil:
+		result.OrphansChecked = true
+		for _, ref := range v.Orphaned {
+			result.Problems = append(result.Problems, FsckProblem{
+				Type: FsckOrphanedRef,
+				Ptr: BlockPointer{
+					ID:           ref.ID,
+					BlockContext: BlockContext{RefNonce: ref.RefNonce},
+				},
+			})
+		}
+	case BServerErrorUnsupported:
+	default:
+		return FsckResult{}, err
+	}
+	return result, nil
+}
+
+// lookupFsckPath returns the node at the given slash-separated path
+// under rootNode.
+func lookupFsckPath(ctx context.Context, kbfsOps KBFSOps, rootNode Node,
+	p string) (Node, error) {
+	n := rootNode
+	for _, name := range strings.Split(p, "/") {
+		var err error
+		n, _, err = kbfsOps.Lookup(ctx, n, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// repairFsckProblem repairs p, if it's repairable and the TLF
+// hasn't changed at its path since it was checked, and returns
+// whether it did.
+func repairFsckProblem(ctx context.Context, kbfsOps KBFSOps, rootNode Node,
+	p FsckProblem) (bool, error) {
+	switch p.Type {
+	case FsckDanglingPtr, FsckSizeMismatch:
+	default:
+		return false, nil
+	}
+	if p.Path == "" {
+		return false, nil
+	}
+
+	n, err := lookupFsckPath(ctx, kbfsOps, rootNode, p.Path)
+	if err != nil {
+		return false, err
+	}
+	md, err := kbfsOps.GetNodeMetadata(ctx, n)
+	if err != nil {
+		return false, err
+	}
+	// Only repair entries whose own block the problem is about,
+	// and that haven't changed since.
+	if md.BlockInfo.BlockPointer != p.Ptr {
+		return false, nil
+	}
+
+	switch p.Type {
+	case FsckDanglingPtr:
+		parentNode, name := rootNode, p.Path
+		if i := strings.LastIndex(p.Path, "/"); i >= 0 {
+			parentNode, err = lookupFsckPath(
+				ctx, kbfsOps, rootNode, p.Path[:i])
+			if err != nil {
+				return false, err
+			}
+			name = p.Path[i+1:]
+		}
+		// Unlike RemoveDir, RemoveEntry doesn't need to read
+		// the entry's block.
+		err = kbfsOps.RemoveEntry(ctx, parentNode, name)
+	case FsckSizeMismatch:
+		// Truncating to the entry's size makes the data match
+		// it, without changing what readers see.
+		err = kbfsOps.Truncate(ctx, n, p.Size)
+		if err == nil {
+			err = kbfsOps.Sync(ctx, n)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RepairFsckProblems repairs the problems found by FsckTLF that can
+// be fixed by rewriting metadata, and returns the ones it repaired:
+// entries whose blocks are missing are removed, and files whose
+// sizes don't match their data are truncated to their entry size.
+// Other problems, and entries that changed since they were checked,
+// are left alone.
+func RepairFsckProblems(ctx context.Context, config Config, tlfID tlf.ID,
+	problems []FsckProblem) (repaired []FsckProblem, err error) {
+	head, err := config.MDOps().GetForTLF(ctx, tlfID)
+	if err != nil {
+		return nil, err
+	}
+	if head == (ImmutableRootMetadata{}) {
+		return nil, fmt.Errorf("TLF %s has no MD", tlfID)
+	}
+	kbfsOps := config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetRootNode(
+		ctx, head.GetTlfHandle(), MasterBranch)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range problems {
+		ok, err := repairFsckProblem(ctx, kbfsOps, rootNode, p)
+		if err != nil {
+			return repaired, fmt.Errorf("%s: %v", p.Path, err)
+		}
+		if ok {
+			repaired = append(repaired, p)
+		}
+	}
+	return repaired, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsckTLF(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	// The block removed below would fail the state check on
+	// shutdown.
+	defer kbfsTestShutdownNoMocksNoCheck(t, config, ctx, cancel)
+
+	kbfsOps := config.KBFSOps()
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, aNode, []byte("contents of a"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, aNode)
+	require.NoError(t, err)
+	dNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateFile(ctx, dNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, bNode, []byte("contents of b"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, bNode)
+	require.NoError(t, err)
+	// Let the block deletions and archives of the writes finish.
+	err = kbfsOps.SyncFromServerForTesting(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	tlfID := rootNode.GetFolderBranch().Tlf
+	result, err := FsckTLF(ctx, config, tlfID)
+	require.NoError(t, err)
+	require.Len(t, result.Problems, 0)
+	require.Equal(t, 2, result.Dirs)
+	require.Equal(t, 2, result.Files)
+	require.Equal(t, 4, result.Blocks)
+	require.True(t, result.OrphansChecked)
+
+	// Lose the block of a.
+	md, err := kbfsOps.GetNodeMetadata(ctx, aNode)
+	require.NoError(t, err)
+	aPtr := md.BlockInfo.BlockPointer
+	_, err = config.BlockServer().RemoveBlockReferences(ctx, tlfID,
+		map[BlockID][]BlockContext{aPtr.ID: {aPtr.BlockContext}})
+	require.NoError(t, err)
+	config.ResetCaches()
+
+	result, err = FsckTLF(ctx, config, tlfID)
+	require.NoError(t, err)
+	expected := FsckProblem{Type: FsckDanglingPtr, Path: "a", Ptr: aPtr}
+	require.Equal(t, []FsckProblem{expected}, result.Problems)
+
+	repaired, err := RepairFsckProblems(ctx, config, tlfID, result.Problems)
+	require.NoError(t, err)
+	require.Equal(t, []FsckProblem{expected}, repaired)
+
+	result, err = FsckTLF(ctx, config, tlfID)
+	require.NoError(t, err)
+	require.Len(t, result.Problems, 0)
+	require.Equal(t, 1, result.Files)
+}
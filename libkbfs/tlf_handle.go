@@ -205,6 +205,16 @@ func (h *TlfHandle) SetFinalizedInfo(info *tlf.HandleExtension) {
 	h.name = h.recomputeNameWithExtensions()
 }
 
+// SuccessorHandle returns the handle of the TLF that takes the place
+// of h's TLF once it's finalized, i.e. h without any extensions.
+func (h TlfHandle) SuccessorHandle() *TlfHandle {
+	newHandle := h.deepCopy()
+	newHandle.conflictInfo = nil
+	newHandle.finalizedInfo = nil
+	newHandle.name = newHandle.recomputeNameWithExtensions()
+	return newHandle
+}
+
 // Extensions returns a list of extensions for the given handle.
 func (h TlfHandle) Extensions() (extensions []tlf.HandleExtension) {
 	if h.ConflictInfo() != nil {
@@ -39,6 +39,9 @@ type tlfJournalConfig interface {
 	encryptionKeyGetter() encryptionKeyGetter
 	mdDecryptionKeyGetter() mdDecryptionKeyGetter
 	MDServer() MDServer
+	BandwidthLimiter() BandwidthLimiter
+	DiskLimiter() DiskLimiter
+	Connectivity() ConnectivityTracker
 	usernameGetter() normalizedUsernameGetter
 	MakeLogger(module string) logger.Logger
 }
@@ -69,6 +72,12 @@ const (
 	// This will be the final entry for unflushed paths if there are
 	// too many revisions to process at once.
 	incompleteUnflushedPathsMarker = "..."
+	// How much weight the rate of the latest flushed batch gets
+	// in the moving average flush rate.
+	tlfJournalFlushRateWeight = 0.3
+	// How often an over-quota journal checks whether the user's
+	// usage has dropped enough to resume flushing.
+	tlfJournalOverQuotaCheckInterval = time.Minute
 )
 
 // TLFJournalStatus represents the status of a TLF's journal for
@@ -83,6 +92,54 @@ type TLFJournalStatus struct {
 	UnflushedBytes int64 // (signed because os.FileInfo.Size() is signed)
 	UnflushedPaths []string
 	LastFlushErr   string `json:",omitempty"`
+	// ByteLimit and EntryLimit are the configured limits on
+	// UnflushedBytes and on the total number of journal entries
+	// (BlockOpCount plus the number of unflushed revisions); zero
+	// means unlimited.
+	ByteLimit  int64  `json:",omitempty"`
+	EntryLimit uint64 `json:",omitempty"`
+	// Full is true if the journal has no room left under one of
+	// its limits.
+	Full bool `json:",omitempty"`
+	// UnflushedBlocks is the number of blocks whose data hasn't
+	// been flushed yet.
+	UnflushedBlocks int64
+	// FlushRate is the recent rate, in bytes per second, at which
+	// block data has been flushed, or zero if nothing has been
+	// flushed yet.
+	FlushRate int64 `json:",omitempty"`
+	// EstimatedTimeRemaining is how long flushing UnflushedBytes
+	// is expected to take at FlushRate.  It's zero if there's no
+	// estimate, e.g. because the last flush failed.
+	EstimatedTimeRemaining time.Duration `json:",omitempty"`
+	// OverQuota, if non-nil, is the user's quota usage as last
+	// reported by the block server, which has rejected this
+	// journal's blocks for being over quota.  Until usage drops
+	// below the quota, the journal only accepts writes locally.
+	OverQuota *QuotaUsage `json:",omitempty"`
+}
+
+// TLFJournalLimits bounds the local disk space used by a single TLF
+// journal, which could otherwise grow without bound while
+// disconnected.  The limits are soft, in that concurrent block puts
+// may overshoot them slightly.  A zero value means no limits.
+type TLFJournalLimits struct {
+	// MaxUnflushedBytes is the maximum number of bytes of
+	// unflushed block data, or zero for no limit.
+	MaxUnflushedBytes int64
+	// MaxEntries is the maximum number of unflushed block and MD
+	// journal entries, or zero for no limit.  Since each entry is
+	// stored in its own file, this bounds the number of files in
+	// the journal.
+	MaxEntries uint64
+	// BlockWhenFull, if true, makes writes to a full journal wait
+	// until enough of it has been flushed, instead of failing
+	// with ErrJournalFull.
+	BlockWhenFull bool
+}
+
+func (l TLFJournalLimits) isUnlimited() bool {
+	return l.MaxUnflushedBytes <= 0 && l.MaxEntries == 0
 }
 
 // TLFJournalBackgroundWorkStatus indicates whether a journal should
@@ -190,6 +247,18 @@ type tlfJournal struct {
 	disabled       bool
 	lastFlushErr   error
 	unflushedPaths unflushedPathCache
+	// flushRate is a moving average of the rate, in bytes per
+	// second, at which block data has been flushed to the server.
+	flushRate float64
+	// overQuota is non-nil while the block server is rejecting
+	// flushed blocks for being over quota, and holds the last
+	// known quota usage.
+	overQuota *QuotaUsage
+	limits    TLFJournalLimits
+	// spaceCh is closed, and replaced, whenever entries are
+	// removed from the journal or its limits change, to wake up
+	// writers waiting for space.
+	spaceCh chan struct{}
 
 	bwDelegate tlfJournalBWDelegate
 }
@@ -204,27 +273,28 @@ type tlfJournalInfo struct {
 	UID          keybase1.UID
 	VerifyingKey kbfscrypto.VerifyingKey
 	TlfID        tlf.ID
+	// SealedStorage is true if the journal's block data is sealed
+	// with the device's storage keys.  It's fixed when the
+	// journal is created.
+	SealedStorage bool `json:",omitempty"`
 }
 
-func readTLFJournalInfoFile(dir string) (
-	keybase1.UID, kbfscrypto.VerifyingKey, tlf.ID, error) {
+func readTLFJournalInfoFile(dir string) (tlfJournalInfo, error) {
 	infoJSON, err := ioutil.ReadFile(getTLFJournalInfoFilePath(dir))
 	if err != nil {
-		return keybase1.UID(""), kbfscrypto.VerifyingKey{}, tlf.ID{}, err
+		return tlfJournalInfo{}, err
 	}
 
 	var info tlfJournalInfo
 	err = json.Unmarshal(infoJSON, &info)
 	if err != nil {
-		return keybase1.UID(""), kbfscrypto.VerifyingKey{}, tlf.ID{}, err
+		return tlfJournalInfo{}, err
 	}
 
-	return info.UID, info.VerifyingKey, info.TlfID, nil
+	return info, nil
 }
 
-func writeTLFJournalInfoFile(dir string, uid keybase1.UID,
-	key kbfscrypto.VerifyingKey, tlfID tlf.ID) error {
-	info := tlfJournalInfo{uid, key, tlfID}
+func writeTLFJournalInfoFile(dir string, info tlfJournalInfo) error {
 	infoJSON, err := json.Marshal(info)
 	if err != nil {
 		return err
@@ -240,7 +310,8 @@ func writeTLFJournalInfoFile(dir string, uid keybase1.UID,
 
 func makeTLFJournal(
 	ctx context.Context, uid keybase1.UID, key kbfscrypto.VerifyingKey,
-	dir string, tlfID tlf.ID, config tlfJournalConfig,
+	dir string, tlfID tlf.ID, storage *kbfscrypto.StorageKeyring,
+	sealNewStorage bool, config tlfJournalConfig,
 	delegateBlockServer BlockServer, bws TLFJournalBackgroundWorkStatus,
 	bwDelegate tlfJournalBWDelegate, onBranchChange branchChangeListener,
 	onMDFlush mdFlushListener) (*tlfJournal, error) {
@@ -254,11 +325,27 @@ func makeTLFJournal(
 		return nil, errors.New("Empty tlf.ID")
 	}
 
-	readUID, readKey, readTlfID, err := readTLFJournalInfoFile(dir)
+	readInfo, err := readTLFJournalInfoFile(dir)
 	switch {
 	case os.IsNotExist(err):
+		// Seal the block data of a new journal only if asked
+		// to, even if storage keys were passed in for other,
+		// already sealed journals.
+		if !sealNewStorage {
+			storage = nil
+		} else if storage == nil {
+			return nil, fmt.Errorf(
+				"Journal for %s should be sealed, but there "+
+					"are no storage keys", tlfID)
+		}
+
 		// Info file doesn't exist, so write it.
-		err := writeTLFJournalInfoFile(dir, uid, key, tlfID)
+		err := writeTLFJournalInfoFile(dir, tlfJournalInfo{
+			UID:           uid,
+			VerifyingKey:  key,
+			TlfID:         tlfID,
+			SealedStorage: sealNewStorage,
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -269,27 +356,37 @@ func makeTLFJournal(
 	default:
 		// Info file exists, so it should match passed-in
 		// parameters.
-		if uid != readUID {
+		if uid != readInfo.UID {
 			return nil, fmt.Errorf(
-				"Expected UID %s, got %s", uid, readUID)
+				"Expected UID %s, got %s", uid, readInfo.UID)
 		}
 
-		if key != readKey {
+		if key != readInfo.VerifyingKey {
 			return nil, fmt.Errorf(
 				"Expected verifying key %s, got %s",
-				key, readKey)
+				key, readInfo.VerifyingKey)
 		}
 
-		if tlfID != readTlfID {
+		if tlfID != readInfo.TlfID {
 			return nil, fmt.Errorf(
-				"Expected TLF ID %s, got %s", tlfID, readTlfID)
+				"Expected TLF ID %s, got %s", tlfID, readInfo.TlfID)
+		}
+
+		// Keep using unsealed storage for journals created
+		// without it.
+		if !readInfo.SealedStorage {
+			storage = nil
+		} else if storage == nil {
+			return nil, fmt.Errorf(
+				"Journal for %s is sealed, but there are no "+
+					"storage keys", tlfID)
 		}
 	}
 
 	log := config.MakeLogger("TLFJ")
 
 	blockJournal, err := makeBlockJournal(
-		ctx, config.Codec(), config.Crypto(), dir, log)
+		ctx, config.Codec(), config.Crypto(), dir, storage, log)
 	if err != nil {
 		return nil, err
 	}
@@ -319,6 +416,7 @@ func makeTLFJournal(
 		backgroundShutdownCh: make(chan struct{}),
 		blockJournal:         blockJournal,
 		mdJournal:            mdJournal,
+		spaceCh:              make(chan struct{}),
 		bwDelegate:           bwDelegate,
 	}
 
@@ -466,13 +564,27 @@ func (j *tlfJournal) doBackgroundWorkLoop(
 					panic("Retry timer should be nil after work is done")
 				}
 
-				if err != nil {
+				if _, ok := err.(ErrJournalOverQuota); ok {
+					// Retrying won't help until the user's
+					// usage drops, so just check on it
+					// every so often.
+					j.log.CDebugf(ctx, "%v; checking again in %s",
+						err, tlfJournalOverQuotaCheckInterval)
+					retry.Reset()
+					retryTimer = time.AfterFunc(
+						tlfJournalOverQuotaCheckInterval, j.signalWork)
+				} else if err != nil {
 					j.log.CWarningf(ctx,
 						"Background work error for %s: %v",
 						j.tlfID, err)
 
-					bTime := retry.NextBackOff()
-					if bTime != backoff.Stop {
+					state := j.config.Connectivity().State()
+					if !state.Policy().RetryJournalFlushes {
+						// Retrying won't help until we're
+						// back online, which signals us.
+						j.log.CDebugf(ctx, "Device is %s; "+
+							"waiting to retry", state)
+					} else if bTime := retry.NextBackOff(); bTime != backoff.Stop {
 						j.log.CWarningf(ctx, "Retrying in %s", bTime)
 						retryTimer = time.AfterFunc(bTime, j.signalWork)
 					}
@@ -603,6 +715,10 @@ func (j *tlfJournal) flush(ctx context.Context) (err error) {
 	j.flushLock.Lock()
 	defer j.flushLock.Unlock()
 
+	// Let reads and unjournaled writes go to the block server
+	// ahead of the flush.
+	ctx = WithBlockPriority(ctx, BlockPriorityJournalFlush)
+
 	flushedBlockEntries := 0
 	flushedMDEntries := 0
 	defer func() {
@@ -621,6 +737,7 @@ func (j *tlfJournal) flush(ctx context.Context) (err error) {
 	// TODO: Avoid starving flushing MD ops if there are many
 	// block ops. See KBFS-1502.
 
+	compacted := false
 	for {
 		isConflict, err := j.isOnConflictBranch()
 		if err != nil {
@@ -631,6 +748,19 @@ func (j *tlfJournal) flush(ctx context.Context) (err error) {
 			return nil
 		}
 
+		if !compacted {
+			// Drop any blocks that have been superseded
+			// since they were put, so we don't waste
+			// bandwidth uploading them.  This reads the
+			// whole block journal, so do it just once per
+			// flush rather than once per batch.
+			err := j.compactBlockJournal(ctx)
+			if err != nil {
+				return err
+			}
+			compacted = true
+		}
+
 		blockEnd, mdEnd, err := j.getJournalEnds(ctx)
 		if err != nil {
 			return err
@@ -641,12 +771,21 @@ func (j *tlfJournal) flush(ctx context.Context) (err error) {
 			break
 		}
 
+		if err := j.checkOverQuota(ctx); err != nil {
+			return err
+		}
+
 		j.log.CDebugf(ctx, "Flushing up to blockEnd=%d and mdEnd=%d",
 			blockEnd, mdEnd)
 
 		// Flush the block journal ops in parallel.
 		numFlushed, maxMDRevToFlush, err := j.flushBlockEntries(ctx, blockEnd)
-		if err != nil {
+		if qe, ok := err.(BServerErrorOverQuota); ok && qe.Throttled {
+			return j.setOverQuota(ctx, QuotaUsage{
+				LimitBytes: qe.Limit,
+				UsedBytes:  qe.Usage,
+			})
+		} else if err != nil {
 			return err
 		}
 		flushedBlockEntries += numFlushed
@@ -676,10 +815,72 @@ func (j *tlfJournal) flush(ctx context.Context) (err error) {
 	return nil
 }
 
+// setOverQuota puts the journal into the over-quota state, where
+// blocks aren't flushed until the user's usage drops below the given
+// limit, and returns the corresponding ErrJournalOverQuota.
+func (j *tlfJournal) setOverQuota(
+	ctx context.Context, usage QuotaUsage) error {
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	if j.overQuota == nil {
+		j.log.CDebugf(ctx, "Block server rejected blocks for %s "+
+			"while over quota; only writing locally", j.tlfID)
+	}
+	j.overQuota = &usage
+	return ErrJournalOverQuota{j.tlfID, usage}
+}
+
+// checkOverQuota returns an ErrJournalOverQuota if the journal is
+// over quota and the user's usage hasn't dropped below the limit
+// since.  Otherwise, it takes the journal out of the over-quota
+// state.
+func (j *tlfJournal) checkOverQuota(ctx context.Context) error {
+	j.journalLock.RLock()
+	overQuota := j.overQuota != nil
+	j.journalLock.RUnlock()
+	if !overQuota {
+		return nil
+	}
+
+	info, err := j.delegateBlockServer.GetUserQuotaInfo(ctx)
+	if err != nil {
+		return err
+	}
+	usage := MakeQuotaUsage(info)
+	if usage.UsedBytes >= usage.LimitBytes {
+		return j.setOverQuota(ctx, usage)
+	}
+
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	j.log.CDebugf(ctx, "Usage dropped below quota; resuming flushes for %s",
+		j.tlfID)
+	j.overQuota = nil
+	return nil
+}
+
 var errTLFJournalShutdown = errors.New("tlfJournal is shutdown")
 var errTLFJournalDisabled = errors.New("tlfJournal is disabled")
 var errTLFJournalNotEmpty = errors.New("tlfJournal is not empty")
 
+func (j *tlfJournal) compactBlockJournal(ctx context.Context) error {
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	if err := j.checkEnabledLocked(); err != nil {
+		return err
+	}
+
+	compactedBytes, err := j.blockJournal.compact(ctx)
+	if err != nil {
+		return err
+	}
+
+	if compactedBytes > 0 {
+		j.signalSpaceLocked()
+	}
+	return nil
+}
+
 func (j *tlfJournal) getNextBlockEntriesToFlush(
 	ctx context.Context, end journalOrdinal) (
 	entries blockEntriesToFlush, maxMDRevToFlush MetadataRevision, err error) {
@@ -693,16 +894,61 @@ func (j *tlfJournal) getNextBlockEntriesToFlush(
 		maxJournalBlockFlushBatchSize)
 }
 
+// updateFlushRateLocked folds the given number of bytes, flushed
+// over the given duration, into the moving average flush rate.
+func (j *tlfJournal) updateFlushRateLocked(
+	flushedBytes int64, elapsed time.Duration) {
+	if flushedBytes <= 0 || elapsed <= 0 {
+		return
+	}
+	rate := float64(flushedBytes) / elapsed.Seconds()
+	if j.flushRate == 0 {
+		j.flushRate = rate
+		return
+	}
+	j.flushRate = tlfJournalFlushRateWeight*rate +
+		(1-tlfJournalFlushRateWeight)*j.flushRate
+}
+
 func (j *tlfJournal) removeFlushedBlockEntries(ctx context.Context,
-	entries blockEntriesToFlush) error {
+	entries blockEntriesToFlush, elapsed time.Duration) error {
 	j.journalLock.Lock()
 	defer j.journalLock.Unlock()
 	if err := j.checkEnabledLocked(); err != nil {
 		return err
 	}
 
-	return j.blockJournal.removeFlushedEntries(ctx, entries, j.tlfID,
+	unflushedBytes := j.blockJournal.getUnflushedBytes()
+	err := j.blockJournal.removeFlushedEntries(ctx, entries, j.tlfID,
 		j.config.Reporter())
+	if err != nil {
+		return err
+	}
+	j.updateFlushRateLocked(
+		unflushedBytes-j.blockJournal.getUnflushedBytes(), elapsed)
+
+	j.signalSpaceLocked()
+	return nil
+}
+
+func (j *tlfJournal) markBlockEntryFlushed(ordinal journalOrdinal) error {
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	if err := j.checkEnabledLocked(); err != nil {
+		return err
+	}
+
+	return j.blockJournal.markFlushed(ordinal)
+}
+
+func (j *tlfJournal) syncBlockFlushProgress() error {
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	if err := j.checkEnabledLocked(); err != nil {
+		return err
+	}
+
+	return j.blockJournal.syncFlushProgress()
 }
 
 func (j *tlfJournal) flushBlockEntries(
@@ -716,16 +962,40 @@ func (j *tlfJournal) flushBlockEntries(
 		return 0, maxMDRevToFlush, nil
 	}
 
+	// Record each put as it's accepted by the server, so that if
+	// this flush is interrupted, we don't redo it.
+	entries.setFlushedCallback(func(ordinal journalOrdinal) error {
+		return j.markBlockEntryFlushed(ordinal)
+	})
+
+	// Stay under the upload limit, so that flushing in the
+	// background doesn't saturate the user's uplink.
+	var putBytes int64
+	for _, bs := range entries.puts.blockStates {
+		putBytes += int64(bs.readyBlockData.GetEncodedSize())
+	}
+	err = j.config.BandwidthLimiter().WaitN(ctx, BandwidthUpload, putBytes)
+	if err != nil {
+		return 0, MetadataRevisionUninitialized, err
+	}
+
 	// TODO: fill this in for logging/error purposes.
 	var tlfName CanonicalTlfName
+	start := j.config.Clock().Now()
 	err = flushBlockEntries(ctx, j.log, j.delegateBlockServer,
 		j.config.BlockCache(), j.config.Reporter(),
 		j.tlfID, tlfName, entries)
+	// Make the progress of this batch durable once, whether or not
+	// all of it made it.
+	if syncErr := j.syncBlockFlushProgress(); err == nil {
+		err = syncErr
+	}
 	if err != nil {
 		return 0, MetadataRevisionUninitialized, err
 	}
 
-	err = j.removeFlushedBlockEntries(ctx, entries)
+	err = j.removeFlushedBlockEntries(
+		ctx, entries, j.config.Clock().Now().Sub(start))
 	if err != nil {
 		return 0, MetadataRevisionUninitialized, err
 	}
@@ -778,6 +1048,7 @@ func (j *tlfJournal) removeFlushedMDEntry(ctx context.Context,
 	}
 
 	j.unflushedPaths.removeFromCache(rmds.MD.RevisionNumber())
+	j.signalSpaceLocked()
 	return nil
 }
 
@@ -914,6 +1185,18 @@ func (j *tlfJournal) getJournalStatusLocked() (TLFJournalStatus, error) {
 		lastFlushErr = j.lastFlushErr.Error()
 	}
 	unflushedBytes := j.blockJournal.getUnflushedBytes()
+	// The journal is full if it has no room for even one more
+	// byte.
+	err = j.checkLimitsLocked(1)
+	_, full := err.(ErrJournalFull)
+	if err != nil && !full {
+		return TLFJournalStatus{}, err
+	}
+	var timeRemaining time.Duration
+	if j.flushRate > 0 && unflushedBytes > 0 && j.lastFlushErr == nil {
+		timeRemaining = time.Duration(
+			float64(unflushedBytes) / j.flushRate * float64(time.Second))
+	}
 	return TLFJournalStatus{
 		Dir:            j.dir,
 		BranchID:       j.mdJournal.getBranchID().String(),
@@ -922,6 +1205,14 @@ func (j *tlfJournal) getJournalStatusLocked() (TLFJournalStatus, error) {
 		BlockOpCount:   blockEntryCount,
 		UnflushedBytes: unflushedBytes,
 		LastFlushErr:   lastFlushErr,
+		ByteLimit:      j.limits.MaxUnflushedBytes,
+		EntryLimit:     j.limits.MaxEntries,
+		Full:           full,
+
+		UnflushedBlocks:        j.blockJournal.getUnflushedBlocks(),
+		FlushRate:              int64(j.flushRate),
+		EstimatedTimeRemaining: timeRemaining,
+		OverQuota:              j.overQuota,
 	}, nil
 }
 
@@ -1139,6 +1430,89 @@ func (j *tlfJournal) shutdown() {
 	// Make further accesses error out.
 	j.blockJournal = nil
 	j.mdJournal = nil
+	// Wake up any writers waiting for space, so they see the
+	// shutdown.
+	j.signalSpaceLocked()
+}
+
+// setLimits changes the limits on the size of this journal.
+func (j *tlfJournal) setLimits(limits TLFJournalLimits) {
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	j.limits = limits
+	j.signalSpaceLocked()
+}
+
+func (j *tlfJournal) signalSpaceLocked() {
+	close(j.spaceCh)
+	j.spaceCh = make(chan struct{})
+	j.config.DiskLimiter().SpaceFreed()
+}
+
+// checkLimitsLocked returns an ErrJournalFull if adding a block of
+// the given size would put the journal over one of its limits.  An
+// empty journal always has room, so that a single block bigger than
+// the byte limit can still make progress.
+func (j *tlfJournal) checkLimitsLocked(size int64) error {
+	if j.limits.isUnlimited() {
+		return nil
+	}
+
+	unflushedBytes := j.blockJournal.getUnflushedBytes()
+	blockEntryCount, err := j.blockJournal.length()
+	if err != nil {
+		return err
+	}
+	mdEntryCount, err := j.mdJournal.length()
+	if err != nil {
+		return err
+	}
+	entries := blockEntryCount + mdEntryCount
+	if entries == 0 {
+		return nil
+	}
+
+	if (j.limits.MaxUnflushedBytes > 0 &&
+		unflushedBytes+size > j.limits.MaxUnflushedBytes) ||
+		(j.limits.MaxEntries > 0 && entries >= j.limits.MaxEntries) {
+		return ErrJournalFull{
+			TlfID:          j.tlfID,
+			UnflushedBytes: unflushedBytes,
+			ByteLimit:      j.limits.MaxUnflushedBytes,
+			Entries:        entries,
+			EntryLimit:     j.limits.MaxEntries,
+		}
+	}
+	return nil
+}
+
+// waitForSpace returns nil once the journal has room for a block of
+// the given size.  If it doesn't, it either returns ErrJournalFull
+// or, if the limits say so, waits for the background flush to make
+// room.
+func (j *tlfJournal) waitForSpace(ctx context.Context, size int64) error {
+	for {
+		spaceCh, blockWhenFull, err := func() (
+			<-chan struct{}, bool, error) {
+			j.journalLock.RLock()
+			defer j.journalLock.RUnlock()
+			if err := j.checkEnabledLocked(); err != nil {
+				return nil, false, err
+			}
+			return j.spaceCh, j.limits.BlockWhenFull,
+				j.checkLimitsLocked(size)
+		}()
+		if _, full := err.(ErrJournalFull); !full || !blockWhenFull {
+			return err
+		}
+
+		j.log.CDebugf(ctx, "Waiting for journal space: %v", err)
+		select {
+		case <-spaceCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 // disable prevents new operations from hitting the journal.  Will
@@ -1208,13 +1582,25 @@ func (j *tlfJournal) getBlockDataWithContext(
 func (j *tlfJournal) putBlockData(
 	ctx context.Context, id BlockID, context BlockContext, buf []byte,
 	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	// Wait without holding journalLock, so that flushes can make
+	// room.
+	if err := j.waitForSpace(ctx, int64(len(buf))); err != nil {
+		return err
+	}
+	// Then make sure this journal, along with all the other local
+	// stores, isn't about to fill up the disk.
+	err := j.config.DiskLimiter().WaitForSpace(ctx, int64(len(buf)))
+	if err != nil {
+		return err
+	}
+
 	j.journalLock.Lock()
 	defer j.journalLock.Unlock()
 	if err := j.checkEnabledLocked(); err != nil {
 		return err
 	}
 
-	err := j.blockJournal.putData(ctx, id, context, buf, serverHalf)
+	err = j.blockJournal.putData(ctx, id, context, buf, serverHalf)
 	if err != nil {
 		return err
 	}
@@ -1262,10 +1648,8 @@ func (j *tlfJournal) removeBlockReferences(
 
 	// Don't remove the block data if we remove the last
 	// reference; we still need it to flush the initial put
-	// operation.
-	//
-	// TODO: It would be nice if we could detect that case and
-	// avoid having to flush the put.
+	// operation, unless the put gets compacted away before the
+	// next flush.
 	liveCounts, err = j.blockJournal.removeReferences(ctx, contexts)
 	if err != nil {
 		return nil, err
@@ -1376,12 +1760,10 @@ func (j *tlfJournal) prepAndAddRMDWithRetry(ctx context.Context,
 	rmd *RootMetadata,
 	f func(unflushedPathMDInfo, unflushedPathsPerRevMap) (bool, error)) error {
 	mdInfo := unflushedPathMDInfo{
-		revision: rmd.Revision(),
-		kmd:      rmd,
-		pmd:      *rmd.Data(),
-		// TODO: Plumb through clock?  Though the timestamp doesn't
-		// matter for the unflushed path cache.
-		localTimestamp: time.Now(),
+		revision:       rmd.Revision(),
+		kmd:            rmd,
+		pmd:            *rmd.Data(),
+		localTimestamp: j.config.Clock().Now(),
 	}
 	perRevMap, err := j.unflushedPaths.prepUnflushedPaths(
 		ctx, j.uid, j.key, j.config.Codec(), j.log, mdInfo)
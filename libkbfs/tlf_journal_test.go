@@ -119,6 +119,18 @@ func (c testTLFJournalConfig) Reporter() Reporter {
 	return c.reporter
 }
 
+func (c testTLFJournalConfig) BandwidthLimiter() BandwidthLimiter {
+	return NewBandwidthLimiterStandard(wallClock{}, BandwidthLimits{})
+}
+
+func (c testTLFJournalConfig) DiskLimiter() DiskLimiter {
+	return NewDiskLimiterStandard(wallClock{}, "", DiskLimits{})
+}
+
+func (c testTLFJournalConfig) Connectivity() ConnectivityTracker {
+	return NewConnectivityTrackerStandard(wallClock{})
+}
+
 func (c testTLFJournalConfig) cryptoPure() cryptoPure {
 	return c.crypto
 }
@@ -161,7 +173,7 @@ func (c testTLFJournalConfig) makeMD(
 func (c testTLFJournalConfig) checkMD(rmds *RootMetadataSigned,
 	expectedRevision MetadataRevision, expectedPrevRoot MdID,
 	expectedMergeStatus MergeStatus, expectedBranchID BranchID) {
-	verifyingKey := c.crypto.SigningKeySigner.Key.GetVerifyingKey()
+	verifyingKey := c.verifyingKey
 	checkBRMD(c.t, c.uid, verifyingKey, c.Codec(), c.Crypto(),
 		rmds.MD, expectedRevision, expectedPrevRoot,
 		expectedMergeStatus, expectedBranchID)
@@ -249,7 +261,7 @@ func setupTLFJournalTest(
 	delegateBlockServer := NewBlockServerMemory(config)
 
 	tlfJournal, err = makeTLFJournal(ctx, uid, verifyingKey,
-		tempdir, config.tlfID, config, delegateBlockServer,
+		tempdir, config.tlfID, nil, false, config, delegateBlockServer,
 		bwStatus, delegate, nil, nil)
 	require.NoError(t, err)
 
@@ -401,6 +413,194 @@ func TestTLFJournalBlockOpBasic(t *testing.T) {
 	require.Equal(t, rev, MetadataRevisionUninitialized)
 }
 
+type overQuotaBlockServer struct {
+	BlockServer
+
+	lock      sync.Mutex
+	overQuota bool
+	puts      int
+}
+
+func (b *overQuotaBlockServer) setOverQuota(overQuota bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.overQuota = overQuota
+}
+
+func (b *overQuotaBlockServer) Put(ctx context.Context, tlfID tlf.ID,
+	id BlockID, context BlockContext, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.puts++
+	if b.overQuota {
+		return BServerErrorOverQuota{Usage: 100, Limit: 100, Throttled: true}
+	}
+	return b.BlockServer.Put(ctx, tlfID, id, context, buf, serverHalf)
+}
+
+func (b *overQuotaBlockServer) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	info := NewUserQuotaInfo()
+	info.Limit = 100
+	if b.overQuota {
+		info.Total.Bytes[UsageWrite] = 100
+	} else {
+		info.Total.Bytes[UsageWrite] = 50
+	}
+	return info, nil
+}
+
+func TestTLFJournalOverQuota(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	bserver := &overQuotaBlockServer{
+		BlockServer: tlfJournal.delegateBlockServer,
+		overQuota:   true,
+	}
+	tlfJournal.delegateBlockServer = bserver
+
+	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
+	err := tlfJournal.flush(ctx)
+	require.Equal(t, ErrJournalOverQuota{
+		TlfID: config.tlfID,
+		Usage: QuotaUsage{LimitBytes: 100, UsedBytes: 100},
+	}, err)
+	requireJournalEntryCounts(t, tlfJournal, 1, 0)
+	status, err := tlfJournal.getJournalStatus()
+	require.NoError(t, err)
+	require.Equal(t, &QuotaUsage{LimitBytes: 100, UsedBytes: 100},
+		status.OverQuota)
+
+	// Writes are still accepted locally, and aren't retried while
+	// the user is still over quota.
+	putBlock(ctx, t, config, tlfJournal, []byte{5, 6, 7, 8})
+	requireJournalEntryCounts(t, tlfJournal, 2, 0)
+	err = tlfJournal.flush(ctx)
+	require.IsType(t, ErrJournalOverQuota{}, err)
+	require.Equal(t, 1, bserver.puts)
+
+	// Once usage drops, flushing resumes.
+	bserver.setOverQuota(false)
+	err = tlfJournal.flush(ctx)
+	require.NoError(t, err)
+	requireJournalEntryCounts(t, tlfJournal, 0, 0)
+	status, err = tlfJournal.getJournalStatus()
+	require.NoError(t, err)
+	require.Nil(t, status.OverQuota)
+	require.Equal(t, "", status.LastFlushErr)
+}
+
+func TestTLFJournalLimitsFull(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	tlfJournal.setLimits(TLFJournalLimits{MaxUnflushedBytes: 4})
+
+	// The first block always fits.
+	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
+
+	data := []byte{5, 6, 7, 8}
+	id, bCtx, serverHalf := config.makeBlock(data)
+	err := tlfJournal.putBlockData(ctx, id, bCtx, data, serverHalf)
+	require.IsType(t, ErrJournalFull{}, err)
+
+	status, err := tlfJournal.getJournalStatus()
+	require.NoError(t, err)
+	require.True(t, status.Full)
+	require.Equal(t, int64(4), status.ByteLimit)
+
+	numFlushed, _, err := tlfJournal.flushBlockEntries(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, numFlushed)
+
+	err = tlfJournal.putBlockData(ctx, id, bCtx, data, serverHalf)
+	require.NoError(t, err)
+}
+
+func TestTLFJournalStatusFlushRate(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
+	putBlock(ctx, t, config, tlfJournal, []byte{5, 6, 7, 8})
+
+	// Nothing has been flushed yet, so there's no estimate.
+	status, err := tlfJournal.getJournalStatus()
+	require.NoError(t, err)
+	require.Equal(t, int64(8), status.UnflushedBytes)
+	require.Equal(t, int64(2), status.UnflushedBlocks)
+	require.Equal(t, int64(0), status.FlushRate)
+	require.Equal(t, time.Duration(0), status.EstimatedTimeRemaining)
+
+	numFlushed, _, err := tlfJournal.flushBlockEntries(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, numFlushed)
+
+	status, err = tlfJournal.getJournalStatus()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), status.UnflushedBytes)
+	require.Equal(t, int64(1), status.UnflushedBlocks)
+	require.True(t, status.EstimatedTimeRemaining > 0)
+
+	func() {
+		tlfJournal.journalLock.Lock()
+		defer tlfJournal.journalLock.Unlock()
+		tlfJournal.flushRate = 0
+		tlfJournal.updateFlushRateLocked(4, 2*time.Second)
+	}()
+	status, err = tlfJournal.getJournalStatus()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), status.FlushRate)
+	require.Equal(t, 2*time.Second, status.EstimatedTimeRemaining)
+}
+
+func TestTLFJournalLimitsBlockWhenFull(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	tlfJournal.setLimits(
+		TLFJournalLimits{MaxEntries: 1, BlockWhenFull: true})
+	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
+
+	data := []byte{5, 6, 7, 8}
+	id, bCtx, serverHalf := config.makeBlock(data)
+
+	// A put with a canceled context should give up waiting.
+	canceledCtx, cancelPut := context.WithCancel(ctx)
+	cancelPut()
+	err := tlfJournal.putBlockData(canceledCtx, id, bCtx, data, serverHalf)
+	require.Equal(t, context.Canceled, err)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tlfJournal.putBlockData(ctx, id, bCtx, data, serverHalf)
+	}()
+
+	// Flushing makes room for the blocked put.
+	numFlushed, _, err := tlfJournal.flushBlockEntries(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, numFlushed)
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		require.FailNow(t, ctx.Err().Error())
+	}
+}
+
 func TestTLFJournalBlockOpBusyPause(t *testing.T) {
 	tempdir, config, ctx, cancel, tlfJournal, delegate :=
 		setupTLFJournalTest(t, TLFJournalBackgroundWorkEnabled)
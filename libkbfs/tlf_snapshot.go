@@ -0,0 +1,224 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io"
+
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// TLFSnapshot gives read-only access to the contents of a TLF as of
+// one of its merged revisions, by reading the blocks that revision
+// refers to directly rather than through KBFSOps.  It never changes
+// the TLF, and doesn't see unsynced local changes.
+//
+// Blocks that a later revision unreferences are deleted once they're
+// garbage-collected, so only fairly recent revisions can be read in
+// full; reading a file or directory whose blocks are gone fails.
+type TLFSnapshot struct {
+	config Config
+	rmd    ImmutableRootMetadata
+}
+
+// NewTLFSnapshot returns a TLFSnapshot of the given TLF at the given
+// merged revision.
+func NewTLFSnapshot(ctx context.Context, config Config, tlfID tlf.ID,
+	rev MetadataRevision) (*TLFSnapshot, error) {
+	rmd, err := getSingleMD(ctx, config, tlfID, NullBranchID, rev, Merged)
+	if err != nil {
+		return nil, err
+	}
+	if err := isReadableOrError(ctx, config, rmd.ReadOnly()); err != nil {
+		return nil, err
+	}
+	return &TLFSnapshot{config, rmd}, nil
+}
+
+// Revision returns the revision of the snapshot.
+func (s *TLFSnapshot) Revision() MetadataRevision {
+	return s.rmd.Revision()
+}
+
+// Root returns the entry of the root directory of the TLF.
+func (s *TLFSnapshot) Root() DirEntry {
+	return s.rmd.data.Dir
+}
+
+// getBlock gets the block for ptr, from the block cache if possible,
+// like getFileBlockForMD.
+func (s *TLFSnapshot) getBlock(ctx context.Context, ptr BlockPointer,
+	newBlock func() Block) (Block, error) {
+	block, err := s.config.BlockCache().Get(ptr)
+	if err == nil {
+		return block, nil
+	}
+	block = newBlock()
+	if err := s.config.BlockOps().Get(ctx, s.rmd, ptr, block); err != nil {
+		return nil, err
+	}
+	if err := s.config.BlockCache().Put(
+		ptr, s.rmd.TlfID(), block, TransientEntry); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// GetDirChildren returns the entries of the directory with the given
+// entry, keyed by their stored names (see EntryInfo.LongName).  The
+// returned map must not be modified.
+func (s *TLFSnapshot) GetDirChildren(ctx context.Context, dir DirEntry) (
+	map[string]DirEntry, error) {
+	if dir.Type != Dir {
+		return nil, NotDirBlockError{dir.BlockPointer, MasterBranch, path{}}
+	}
+	dblock, err := s.getDirBlock(ctx, dir.BlockPointer)
+	if err != nil {
+		return nil, err
+	}
+	dblock, err = assembleDirBlock(ctx, dblock, s.getDirBlock)
+	if err != nil {
+		return nil, err
+	}
+	return dblock.Children, nil
+}
+
+func (s *TLFSnapshot) getDirBlock(ctx context.Context, ptr BlockPointer) (
+	*DirBlock, error) {
+	block, err := s.getBlock(ctx, ptr, NewDirBlock)
+	if err != nil {
+		return nil, err
+	}
+	dblock, ok := block.(*DirBlock)
+	if !ok {
+		return nil, NotDirBlockError{ptr, MasterBranch, path{}}
+	}
+	return dblock, nil
+}
+
+// zeroWriter writes runs of zeroes, for the holes in files.
+type zeroWriter struct {
+	w     io.Writer
+	zeros []byte
+}
+
+func (zw *zeroWriter) writeZeros(n int64) error {
+	for n > 0 {
+		if zw.zeros == nil {
+			zw.zeros = make([]byte, 64<<10)
+		}
+		chunk := zw.zeros
+		if int64(len(chunk)) > n {
+			chunk = chunk[:n]
+		}
+		if _, err := zw.w.Write(chunk); err != nil {
+			return err
+		}
+		n -= int64(len(chunk))
+	}
+	return nil
+}
+
+// writeFileBlocks writes the contents of the file block tree rooted
+// at ptr, which starts at offset startOff of the file, to zw,
+// preceded by zeroes for any hole since offset *written.  It stops
+// at offset size.
+func (s *TLFSnapshot) writeFileBlocks(ctx context.Context, ptr BlockPointer,
+	startOff, size int64, zw *zeroWriter, written *int64) error {
+	block, err := s.getBlock(ctx, ptr, NewFileBlock)
+	if err != nil {
+		return err
+	}
+	fblock, ok := block.(*FileBlock)
+	if !ok {
+		return NotFileBlockError{ptr, MasterBranch, path{}}
+	}
+	if fblock.IsInd {
+		for _, iptr := range fblock.IPtrs {
+			if iptr.Off >= size {
+				break
+			}
+			err := s.writeFileBlocks(
+				ctx, iptr.BlockPointer, iptr.Off, size, zw, written)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if startOff > *written {
+		if err := zw.writeZeros(startOff - *written); err != nil {
+			return err
+		}
+		*written = startOff
+	}
+	contents := fblock.Contents
+	if end := startOff + int64(len(contents)); end > size {
+		contents = contents[:size-startOff]
+	}
+	if _, err := zw.w.Write(contents); err != nil {
+		return err
+	}
+	*written = startOff + int64(len(contents))
+	return nil
+}
+
+// ReadFile writes the contents of the file with the given entry to w.
+func (s *TLFSnapshot) ReadFile(
+	ctx context.Context, file DirEntry, w io.Writer) error {
+	if file.Type != File && file.Type != Exec {
+		return NotFileBlockError{file.BlockPointer, MasterBranch, path{}}
+	}
+	size := int64(file.Size)
+	zw := &zeroWriter{w: w}
+	var written int64
+	if size > 0 {
+		err := s.writeFileBlocks(
+			ctx, file.BlockPointer, 0, size, zw, &written)
+		if err != nil {
+			return err
+		}
+	}
+	// The file may end in a hole.
+	return zw.writeZeros(size - written)
+}
+
+// appendFileBlockInfos appends the info of the block with the given
+// info, and of all the blocks under it if it's indirect, to infos.
+func (s *TLFSnapshot) appendFileBlockInfos(ctx context.Context,
+	info BlockInfo, infos []BlockInfo) ([]BlockInfo, error) {
+	infos = append(infos, info)
+	block, err := s.getBlock(ctx, info.BlockPointer, NewFileBlock)
+	if err != nil {
+		return nil, err
+	}
+	fblock, ok := block.(*FileBlock)
+	if !ok {
+		return nil, NotFileBlockError{info.BlockPointer, MasterBranch, path{}}
+	}
+	if !fblock.IsInd {
+		return infos, nil
+	}
+	for _, iptr := range fblock.IPtrs {
+		infos, err = s.appendFileBlockInfos(ctx, iptr.BlockInfo, infos)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// GetFileBlockInfos returns the infos of all the blocks of the file
+// with the given entry, top block first.  Their EncodedSize fields
+// give the space the file takes up on the block server.
+func (s *TLFSnapshot) GetFileBlockInfos(
+	ctx context.Context, file DirEntry) ([]BlockInfo, error) {
+	if file.Type != File && file.Type != Exec {
+		return nil, NotFileBlockError{file.BlockPointer, MasterBranch, path{}}
+	}
+	return s.appendFileBlockInfos(ctx, file.BlockInfo, nil)
+}
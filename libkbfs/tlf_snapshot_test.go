@@ -0,0 +1,85 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLFSnapshot(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	// Small blocks, so that files have indirect blocks.
+	config.SetBlockSplitter(&BlockSplitterSimple{10, 8 * 1024})
+
+	kbfsOps := config.KBFSOps()
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", false)
+
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	oldData := []byte("the first version of a")
+	err = kbfsOps.Write(ctx, aNode, oldData, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, aNode)
+	require.NoError(t, err)
+	dNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	eNode, _, err := kbfsOps.CreateFile(ctx, dNode, "e", true, NoExcl)
+	require.NoError(t, err)
+	// Leave a hole at the start of e.
+	err = kbfsOps.Write(ctx, eNode, []byte("end"), 5)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, eNode)
+	require.NoError(t, err)
+
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	rev := status.Revision
+
+	// Change and remove things after the snapshot's revision.
+	err = kbfsOps.Write(ctx, aNode, []byte("second"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, aNode)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, dNode, "e")
+	require.NoError(t, err)
+
+	snapshot, err := NewTLFSnapshot(
+		ctx, config, rootNode.GetFolderBranch().Tlf, rev)
+	require.NoError(t, err)
+	require.Equal(t, rev, snapshot.Revision())
+
+	children, err := snapshot.GetDirChildren(ctx, snapshot.Root())
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	var buf bytes.Buffer
+	err = snapshot.ReadFile(ctx, children["a"], &buf)
+	require.NoError(t, err)
+	require.Equal(t, oldData, buf.Bytes())
+
+	infos, err := snapshot.GetFileBlockInfos(ctx, children["a"])
+	require.NoError(t, err)
+	// The top block is indirect, with several blocks under it.
+	require.True(t, len(infos) > 2, "%v", infos)
+	require.Equal(t, children["a"].BlockInfo, infos[0])
+	for _, info := range infos {
+		require.NotZero(t, info.EncodedSize)
+	}
+
+	children, err = snapshot.GetDirChildren(ctx, children["d"])
+	require.NoError(t, err)
+	require.Equal(t, Exec, children["e"].Type)
+	buf.Reset()
+	err = snapshot.ReadFile(ctx, children["e"], &buf)
+	require.NoError(t, err)
+	expected := append(make([]byte, 5), []byte("end")...)
+	require.Equal(t, expected, buf.Bytes())
+
+	_, err = snapshot.GetDirChildren(ctx, children["e"])
+	require.IsType(t, NotDirBlockError{}, err)
+}
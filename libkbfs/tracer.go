@@ -0,0 +1,211 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// TraceSpan records a single timed step of an operation, like an MD
+// get or a block put.
+type TraceSpan struct {
+	// Name says what was done, e.g. "BlockServer.GetBlock".
+	Name string
+	// OpID identifies the operation the span was part of, built
+	// from the ID tags (like FID or DID) attached to its context,
+	// e.g. "FID=abcd1234".  It's empty if the context had none.
+	OpID     string
+	Start    time.Time
+	Duration time.Duration
+	// Err is the text of the error the step failed with, if any.
+	Err string
+}
+
+// Tracer records the most recent spans of all operations in a
+// fixed-size ring buffer, so that slow operations can be diagnosed
+// after the fact.  It also keeps track of the spans that are still
+// in progress.  A nil *Tracer is valid, and records nothing.
+type Tracer struct {
+	clock Clock
+
+	lock   sync.Mutex
+	spans  []TraceSpan
+	next   int  // where the next span goes in spans
+	full   bool // whether spans has wrapped around
+	active map[uint64]TraceSpan
+	nextID uint64 // the key of the next span in active
+}
+
+// NewTracer returns a Tracer that keeps the last capacity spans,
+// timed with the given clock.
+func NewTracer(clock Clock, capacity int) *Tracer {
+	return &Tracer{
+		clock:  clock,
+		spans:  make([]TraceSpan, capacity),
+		active: make(map[uint64]TraceSpan),
+	}
+}
+
+// traceOpID returns the operation ID for the given context, made
+// from all the ID tags attached to it, sorted for stability.
+func traceOpID(ctx context.Context) string {
+	tags, ok := logger.LogTagsFromContext(ctx)
+	if !ok {
+		return ""
+	}
+	var ids []string
+	for key, name := range tags {
+		if v := ctx.Value(key); v != nil {
+			ids = append(ids, fmt.Sprintf("%s=%v", name, v))
+		}
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// StartSpan starts timing a step named name of the operation in
+// ctx.  The returned function must be called once the step is done,
+// with the error it failed with, if any, to record the span.
+func (t *Tracer) StartSpan(
+	ctx context.Context, name string) (finish func(err error)) {
+	if t == nil {
+		return func(error) {}
+	}
+	span := TraceSpan{
+		Name:  name,
+		OpID:  traceOpID(ctx),
+		Start: t.clock.Now(),
+	}
+	t.lock.Lock()
+	id := t.nextID
+	t.nextID++
+	t.active[id] = span
+	t.lock.Unlock()
+	return func(err error) {
+		span.Duration = t.clock.Now().Sub(span.Start)
+		if err != nil {
+			span.Err = err.Error()
+		}
+		t.finish(id, span)
+	}
+}
+
+func (t *Tracer) finish(id uint64, span TraceSpan) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.active, id)
+	if len(t.spans) == 0 {
+		return
+	}
+	t.spans[t.next] = span
+	t.next++
+	if t.next == len(t.spans) {
+		t.next = 0
+		t.full = true
+	}
+}
+
+// Spans returns the recorded spans, oldest finished first.
+func (t *Tracer) Spans() []TraceSpan {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.full {
+		return append([]TraceSpan(nil), t.spans[:t.next]...)
+	}
+	spans := make([]TraceSpan, 0, len(t.spans))
+	spans = append(spans, t.spans[t.next:]...)
+	return append(spans, t.spans[:t.next]...)
+}
+
+// traceSpansByStart sorts spans by their start times.
+type traceSpansByStart []TraceSpan
+
+func (s traceSpansByStart) Len() int           { return len(s) }
+func (s traceSpansByStart) Less(i, j int) bool { return s[i].Start.Before(s[j].Start) }
+func (s traceSpansByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Active returns the spans that haven't finished yet, oldest first,
+// with their durations so far.
+func (t *Tracer) Active() []TraceSpan {
+	if t == nil {
+		return nil
+	}
+	now := t.clock.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	spans := make([]TraceSpan, 0, len(t.active))
+	for _, span := range t.active {
+		span.Duration = now.Sub(span.Start)
+		spans = append(spans, span)
+	}
+	sort.Sort(traceSpansByStart(spans))
+	return spans
+}
+
+// chromeTraceEvent is a single event in the Chrome trace event
+// format, as read by chrome://tracing.
+type chromeTraceEvent struct {
+	Name string            `json:"name"`
+	Ph   string            `json:"ph"`
+	Ts   int64             `json:"ts"`
+	Dur  int64             `json:"dur,omitempty"`
+	Pid  int               `json:"pid"`
+	Tid  int               `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// WriteChromeTrace writes the recorded spans to w in the Chrome
+// trace event format, so they can be loaded into chrome://tracing.
+// Each operation gets its own thread, named after its ID, so all the
+// spans of one operation show up on the same row.
+func (t *Tracer) WriteChromeTrace(w io.Writer) error {
+	events := []chromeTraceEvent{}
+	tids := make(map[string]int)
+	for _, span := range t.Spans() {
+		tid, ok := tids[span.OpID]
+		if !ok {
+			tid = len(tids) + 1
+			tids[span.OpID] = tid
+			name := span.OpID
+			if name == "" {
+				name = "(no op ID)"
+			}
+			events = append(events, chromeTraceEvent{
+				Name: "thread_name",
+				Ph:   "M",
+				Pid:  1,
+				Tid:  tid,
+				Args: map[string]string{"name": name},
+			})
+		}
+		event := chromeTraceEvent{
+			Name: span.Name,
+			Ph:   "X",
+			Ts:   span.Start.UnixNano() / int64(time.Microsecond),
+			Dur:  int64(span.Duration / time.Microsecond),
+			Pid:  1,
+			Tid:  tid,
+		}
+		if span.Err != "" {
+			event.Args = map[string]string{"err": span.Err}
+		}
+		events = append(events, event)
+	}
+	return json.NewEncoder(w).Encode(struct {
+		TraceEvents []chromeTraceEvent `json:"traceEvents"`
+	}{events})
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type tracerTestIDKey int
+
+const tracerTestIDKeyValue tracerTestIDKey = iota
+
+func TestTracerRingBuffer(t *testing.T) {
+	clock, start := newTestClockAndTimeNow()
+	tracer := NewTracer(clock, 2)
+	ctx := ctxWithRandomIDReplayable(
+		context.Background(), tracerTestIDKeyValue, "TID", nil)
+	opID := traceOpID(ctx)
+	require.Regexp(t, "^TID=.+", opID)
+
+	for _, name := range []string{"a", "b", "c"} {
+		finish := tracer.StartSpan(ctx, name)
+		clock.Add(time.Millisecond)
+		finish(nil)
+	}
+	finish := tracer.StartSpan(context.Background(), "d")
+	finish(errors.New("failed"))
+
+	// Only the last two spans are kept, oldest first.
+	spans := tracer.Spans()
+	require.Equal(t, []TraceSpan{
+		{
+			Name:     "c",
+			OpID:     opID,
+			Start:    start.Add(2 * time.Millisecond),
+			Duration: time.Millisecond,
+		},
+		{
+			Name:  "d",
+			Start: start.Add(3 * time.Millisecond),
+			Err:   "failed",
+		},
+	}, spans)
+
+	var buf bytes.Buffer
+	err := tracer.WriteChromeTrace(&buf)
+	require.NoError(t, err)
+	var trace struct {
+		TraceEvents []chromeTraceEvent `json:"traceEvents"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &trace)
+	require.NoError(t, err)
+	require.Len(t, trace.TraceEvents, 4)
+	require.Equal(t, "M", trace.TraceEvents[0].Ph)
+	require.Equal(t, opID, trace.TraceEvents[0].Args["name"])
+	require.Equal(t, chromeTraceEvent{
+		Name: "c",
+		Ph:   "X",
+		Ts:   spans[0].Start.UnixNano() / int64(time.Microsecond),
+		Dur:  1000,
+		Pid:  1,
+		Tid:  1,
+	}, trace.TraceEvents[1])
+	require.Equal(t, 2, trace.TraceEvents[3].Tid)
+	require.Equal(t, "failed", trace.TraceEvents[3].Args["err"])
+
+	// Unfinished spans are active.
+	finish = tracer.StartSpan(ctx, "e")
+	clock.Add(time.Second)
+	require.Equal(t, []TraceSpan{{
+		Name:     "e",
+		OpID:     opID,
+		Start:    start.Add(3 * time.Millisecond),
+		Duration: time.Second,
+	}}, tracer.Active())
+	finish(nil)
+	require.Len(t, tracer.Active(), 0)
+
+	// A nil tracer records nothing.
+	var nilTracer *Tracer
+	nilTracer.StartSpan(ctx, "e")(nil)
+	require.Nil(t, nilTracer.Spans())
+}
+
+func TestTracerOps(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetTracer(NewTracer(config.Clock(), 100))
+
+	ctx = ctxWithRandomIDReplayable(ctx, tracerTestIDKeyValue, "TID", nil)
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// All the spans of the sync are keyed by its operation ID.
+	opID := traceOpID(ctx)
+	names := make(map[string]bool)
+	for _, span := range config.Tracer().Spans() {
+		if span.OpID == opID {
+			names[span.Name] = true
+		}
+	}
+	require.True(t, names["MDOps.GetForHandle"])
+	require.True(t, names["MDOps.Put"])
+	require.True(t, names["Crypto.EncryptBlock"])
+}
@@ -356,8 +356,15 @@ func (upc *unflushedPathCache) reinitializeWithResolution(
 	upc.lock.Lock()
 	defer upc.lock.Unlock()
 
-	if perRevMap == nil && upc.state != upcUninitialized {
-		return false
+	if perRevMap == nil {
+		if upc.state != upcUninitialized {
+			return false
+		}
+		// Nothing has been cached yet, and since there's no
+		// chains populator to compute paths with, there's nothing
+		// to reinitialize either.  Marking the cache as initialized
+		// here would make every later append ask to be retried.
+		return true
 	}
 
 	upc.unflushedPaths = unflushedPathsMap{mdInfo.revision: perRevMap}
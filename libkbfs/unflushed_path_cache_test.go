@@ -0,0 +1,24 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test that resolving a branch before the cache is ever initialized
+// doesn't leave it unable to take any more appends.
+func TestUnflushedPathCacheResolveUninitialized(t *testing.T) {
+	var upc unflushedPathCache
+	mdInfo := unflushedPathMDInfo{revision: MetadataRevisionInitial}
+	require.True(t, upc.reinitializeWithResolution(mdInfo, nil))
+	require.Nil(t, upc.getUnflushedPaths())
+
+	mdInfo.revision++
+	require.True(t, upc.appendToCache(mdInfo, nil))
+	require.Nil(t, upc.getUnflushedPaths())
+}
@@ -7,9 +7,14 @@ package libkbfs
 import (
 	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"golang.org/x/net/context"
 )
@@ -125,3 +130,86 @@ func LogTagsFromContext(ctx context.Context) (map[interface{}]string, bool) {
 	tags, ok := logger.LogTagsFromContext(ctx)
 	return map[interface{}]string(tags), ok
 }
+
+// writeFileAtomic writes data to the file at path, creating any
+// needed parent directories, such that readers (including a reader
+// after a crash) see either the old contents of path or all of the
+// new contents, but never a partial write.  It does so by writing to
+// a temp file in the same directory, syncing it, renaming it over
+// path, and syncing the directory.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (
+	err error) {
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tempPath := f.Name()
+	defer func() {
+		if err != nil {
+			// Best effort; the temp file is harmless if left
+			// behind.
+			_ = os.Remove(tempPath)
+		}
+	}()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tempPath, perm)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		return err
+	}
+
+	// The rename itself isn't durable until the directory is
+	// synced.
+	return syncDir(dir)
+}
+
+// syncDir fsyncs the directory at the given path, so that entries
+// created, renamed or removed in it survive a crash.  Windows can't
+// sync directories, so it does nothing there.
+func syncDir(path string) (err error) {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := d.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return d.Sync()
+}
+
+// serializeToFileAtomic is like kbfscodec.SerializeToFile, except
+// that it writes the file with writeFileAtomic.
+func serializeToFileAtomic(
+	c kbfscodec.Codec, obj interface{}, path string) error {
+	buf, err := c.Encode(obj)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf, 0600)
+}
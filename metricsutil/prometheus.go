@@ -0,0 +1,102 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package metricsutil
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// prometheusPrefix is prepended to every exported metric name.
+const prometheusPrefix = "kbfs_"
+
+// prometheusQuantiles are the quantiles exported for timers and
+// histograms.
+var prometheusQuantiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+
+// prometheusName turns a go-metrics name, like "BlockServer.Get",
+// into a valid Prometheus metric name, like "kbfs_BlockServer_Get".
+func prometheusName(name string) string {
+	buf := []byte(prometheusPrefix + name)
+	for i, c := range buf {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z',
+			c >= '0' && c <= '9', c == '_', c == ':':
+		default:
+			buf[i] = '_'
+		}
+	}
+	return string(buf)
+}
+
+// writePrometheusSummary writes a summary, dividing all its values
+// by scale.  Since the quantiles only cover a sample of the values,
+// the sum is estimated from the sample's mean, so that sum/count is
+// still the mean.
+func writePrometheusSummary(w io.Writer, name string, count int64,
+	sum float64, ps []float64, scale float64) {
+	fmt.Fprintf(w, "# TYPE %s summary\n", name)
+	for i, q := range prometheusQuantiles {
+		fmt.Fprintf(w, "%s{quantile=\"%g\"} %g\n", name, q, ps[i]/scale)
+	}
+	fmt.Fprintf(w, "%s_sum %g\n", name, sum/scale)
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+// WritePrometheus writes the metrics in the given registry to the
+// given io.Writer in the Prometheus text exposition format, sorted by
+// name.  Timers are exported as summaries in seconds, histograms as
+// summaries of their raw values, and meters as counters of their
+// events.
+func WritePrometheus(r metrics.Registry, w io.Writer) {
+	var namedMetrics namedMetricSlice
+	r.Each(func(name string, i interface{}) {
+		namedMetrics = append(namedMetrics, namedMetric{name, i})
+	})
+
+	sort.Sort(namedMetrics)
+	for _, namedMetric := range namedMetrics {
+		name := prometheusName(namedMetric.name)
+		switch metric := namedMetric.m.(type) {
+		case metrics.Counter:
+			fmt.Fprintf(w, "# TYPE %s counter\n", name)
+			fmt.Fprintf(w, "%s %d\n", name, metric.Count())
+		case metrics.Gauge:
+			fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+			fmt.Fprintf(w, "%s %d\n", name, metric.Value())
+		case metrics.GaugeFloat64:
+			fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+			fmt.Fprintf(w, "%s %g\n", name, metric.Value())
+		case metrics.Histogram:
+			h := metric.Snapshot()
+			writePrometheusSummary(w, name, h.Count(),
+				h.Mean()*float64(h.Count()),
+				h.Percentiles(prometheusQuantiles), 1)
+		case metrics.Meter:
+			fmt.Fprintf(w, "# TYPE %s_total counter\n", name)
+			fmt.Fprintf(w, "%s_total %d\n", name, metric.Snapshot().Count())
+		case metrics.Timer:
+			t := metric.Snapshot()
+			writePrometheusSummary(w, name, t.Count(),
+				t.Mean()*float64(t.Count()),
+				t.Percentiles(prometheusQuantiles), float64(time.Second))
+		}
+	}
+}
+
+// NewPrometheusHandler returns an http.Handler that serves the
+// metrics in the given registry for Prometheus to scrape, usually
+// at /metrics.
+func NewPrometheusHandler(r metrics.Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WritePrometheus(r, w)
+	})
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package simplefs
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// numChangesWorkers is the number of folders SimpleFSGetChanges
+// checks at once.
+const numChangesWorkers = 10
+
+func (k *SimpleFS) getChanges(ctx context.Context, folder FolderSince) (
+	FolderChanges, error) {
+	p, err := fsrpc.NewPath(folder.Path)
+	if err != nil {
+		return FolderChanges{}, err
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		return FolderChanges{}, fmt.Errorf("%s is not a folder", p)
+	}
+	handle, err := fsrpc.ParseTlfHandle(
+		ctx, k.config.KBPKI(), p.TLFName, p.Public)
+	if err != nil {
+		return FolderChanges{}, err
+	}
+	summary, err := k.config.MDOps().GetChangeSummary(
+		ctx, handle, libkbfs.MetadataRevision(folder.Revision))
+	if err != nil {
+		return FolderChanges{}, err
+	}
+	return FolderChanges{
+		Head:     int64(summary.Head),
+		Flags:    int(summary.Flags),
+		Added:    summary.Added,
+		Removed:  summary.Removed,
+		Modified: summary.Modified,
+	}, nil
+}
+
+// SimpleFSGetChanges implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSGetChanges(ctx context.Context,
+	folders []FolderSince) ([]FolderChanges, error) {
+	k.log.CDebugf(ctx, "Getting changes for %d folders", len(folders))
+	results := make([]FolderChanges, len(folders))
+	indices := make(chan int, len(folders))
+	for i := range folders {
+		indices <- i
+	}
+	close(indices)
+
+	var wg sync.WaitGroup
+	for w := 0; w < numChangesWorkers && w < len(folders); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				changes, err := k.getChanges(ctx, folders[i])
+				if err != nil {
+					changes = FolderChanges{Error: err.Error()}
+				}
+				changes.Path = folders[i].Path
+				results[i] = changes
+			}
+		}()
+	}
+	wg.Wait()
+	return results, ctx.Err()
+}
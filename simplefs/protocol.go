@@ -0,0 +1,405 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package simplefs
+
+import (
+	"encoding/hex"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"golang.org/x/net/context"
+)
+
+// The types and protocol below follow the conventions of the
+// generated keybase1 protocols, so that they can move there
+// unchanged once the SimpleFS protocol is part of the vendored
+// client.
+
+// OpID identifies an open file or an asynchronous operation.  It is
+// chosen by the caller, using SimpleFSMakeOpid.
+type OpID [16]byte
+
+func (o OpID) String() string {
+	return hex.EncodeToString(o[:])
+}
+
+// OpenFlags control how SimpleFSOpen opens a path.
+type OpenFlags int
+
+const (
+	// OpenRead opens an existing file for reading.
+	OpenRead OpenFlags = 0
+	// OpenReplace truncates the file when opening it.
+	OpenReplace OpenFlags = 1
+	// OpenExisting fails the open if the path doesn't exist,
+	// instead of creating it.
+	OpenExisting OpenFlags = 2
+	// OpenWrite allows writes through the opened file.
+	OpenWrite OpenFlags = 4
+	// OpenDirectory creates a directory instead of a file, if the
+	// path doesn't exist.
+	OpenDirectory OpenFlags = 8
+)
+
+// DirentType is the type of a Dirent.
+type DirentType int
+
+const (
+	// DirentFile is a regular file.
+	DirentFile DirentType = 0
+	// DirentDir is a directory.
+	DirentDir DirentType = 1
+	// DirentSym is a symbolic link.
+	DirentSym DirentType = 2
+	// DirentExec is an executable file.
+	DirentExec DirentType = 3
+)
+
+// Dirent describes one entry in a directory.
+type Dirent struct {
+	Name          string        `codec:"name" json:"name"`
+	DirentType    DirentType    `codec:"direntType" json:"direntType"`
+	Size          int64         `codec:"size" json:"size"`
+	Time          keybase1.Time `codec:"time" json:"time"`
+	SymlinkTarget string        `codec:"symlinkTarget" json:"symlinkTarget"`
+}
+
+// OpType is the kind of an asynchronous operation.
+type OpType int
+
+const (
+	// OpList lists a directory.
+	OpList OpType = 0
+	// OpCopy copies a file or directory.
+	OpCopy OpType = 1
+	// OpMove moves a file or directory.
+	OpMove OpType = 2
+	// OpRemove removes a file or directory.
+	OpRemove OpType = 3
+)
+
+// OpProgress describes how far along an asynchronous operation is.
+// BytesTotal and FilesTotal are zero until they're known.
+type OpProgress struct {
+	OpType     OpType        `codec:"opType" json:"opType"`
+	Start      keybase1.Time `codec:"start" json:"start"`
+	BytesTotal int64         `codec:"bytesTotal" json:"bytesTotal"`
+	BytesDone  int64         `codec:"bytesDone" json:"bytesDone"`
+	FilesTotal int64         `codec:"filesTotal" json:"filesTotal"`
+	FilesDone  int64         `codec:"filesDone" json:"filesDone"`
+}
+
+// ListResult is the result of a finished list operation.
+type ListResult struct {
+	Entries []Dirent `codec:"entries" json:"entries"`
+}
+
+// FileContent is the data read from an open file.
+type FileContent struct {
+	Data []byte `codec:"data" json:"data"`
+}
+
+// FolderSince names a folder, and the revision of it that the caller
+// has already seen.
+type FolderSince struct {
+	Path     string `codec:"path" json:"path"`
+	Revision int64  `codec:"revision" json:"revision"`
+}
+
+// FolderChanges summarizes the changes to a folder since the revision
+// given in the corresponding FolderSince.  Flags is a bitmap of
+// libkbfs.ChangeFlags.  If the folder couldn't be checked, Error says
+// why, and the other fields are unset.
+type FolderChanges struct {
+	Path     string `codec:"path" json:"path"`
+	Head     int64  `codec:"head" json:"head"`
+	Flags    int    `codec:"flags" json:"flags"`
+	Added    int    `codec:"added" json:"added"`
+	Removed  int    `codec:"removed" json:"removed"`
+	Modified int    `codec:"modified" json:"modified"`
+	Error    string `codec:"error" json:"error"`
+}
+
+// SimpleFSMakeOpidArg is the argument of SimpleFSMakeOpid.
+type SimpleFSMakeOpidArg struct {
+}
+
+// SimpleFSListArg is the argument of SimpleFSList.
+type SimpleFSListArg struct {
+	OpID OpID   `codec:"opID" json:"opID"`
+	Path string `codec:"path" json:"path"`
+}
+
+// SimpleFSReadListArg is the argument of SimpleFSReadList.
+type SimpleFSReadListArg struct {
+	OpID OpID `codec:"opID" json:"opID"`
+}
+
+// SimpleFSStatArg is the argument of SimpleFSStat.
+type SimpleFSStatArg struct {
+	Path string `codec:"path" json:"path"`
+}
+
+// SimpleFSOpenArg is the argument of SimpleFSOpen.
+type SimpleFSOpenArg struct {
+	OpID  OpID      `codec:"opID" json:"opID"`
+	Dest  string    `codec:"dest" json:"dest"`
+	Flags OpenFlags `codec:"flags" json:"flags"`
+}
+
+// SimpleFSReadArg is the argument of SimpleFSRead.
+type SimpleFSReadArg struct {
+	OpID   OpID  `codec:"opID" json:"opID"`
+	Offset int64 `codec:"offset" json:"offset"`
+	Size   int   `codec:"size" json:"size"`
+}
+
+// SimpleFSWriteArg is the argument of SimpleFSWrite.
+type SimpleFSWriteArg struct {
+	OpID    OpID   `codec:"opID" json:"opID"`
+	Offset  int64  `codec:"offset" json:"offset"`
+	Content []byte `codec:"content" json:"content"`
+}
+
+// SimpleFSCloseArg is the argument of SimpleFSClose.
+type SimpleFSCloseArg struct {
+	OpID OpID `codec:"opID" json:"opID"`
+}
+
+// SimpleFSCopyArg is the argument of SimpleFSCopy.
+type SimpleFSCopyArg struct {
+	OpID OpID   `codec:"opID" json:"opID"`
+	Src  string `codec:"src" json:"src"`
+	Dest string `codec:"dest" json:"dest"`
+}
+
+// SimpleFSMoveArg is the argument of SimpleFSMove.
+type SimpleFSMoveArg struct {
+	OpID OpID   `codec:"opID" json:"opID"`
+	Src  string `codec:"src" json:"src"`
+	Dest string `codec:"dest" json:"dest"`
+}
+
+// SimpleFSRemoveArg is the argument of SimpleFSRemove.
+type SimpleFSRemoveArg struct {
+	OpID      OpID   `codec:"opID" json:"opID"`
+	Path      string `codec:"path" json:"path"`
+	Recursive bool   `codec:"recursive" json:"recursive"`
+	// ManifestPath, if set, is where to write an undo manifest
+	// (see RemoveManifest) before removing anything.  It must not
+	// be within Path.
+	ManifestPath string `codec:"manifestPath" json:"manifestPath"`
+}
+
+// SimpleFSCheckArg is the argument of SimpleFSCheck.
+type SimpleFSCheckArg struct {
+	OpID OpID `codec:"opID" json:"opID"`
+}
+
+// SimpleFSWaitArg is the argument of SimpleFSWait.
+type SimpleFSWaitArg struct {
+	OpID OpID `codec:"opID" json:"opID"`
+}
+
+// SimpleFSCancelArg is the argument of SimpleFSCancel.
+type SimpleFSCancelArg struct {
+	OpID OpID `codec:"opID" json:"opID"`
+}
+
+// SimpleFSGetChangesArg is the argument of SimpleFSGetChanges.
+type SimpleFSGetChangesArg struct {
+	Folders []FolderSince `codec:"folders" json:"folders"`
+}
+
+// SimpleFSInterface is a path-based interface to KBFS, for clients
+// that don't have a mounted file system.  Paths look like
+// /keybase/private/alice/dir/file.  Operations that can take a while
+// (list, copy, move and remove) start in the background and return
+// right away; their progress can be checked with SimpleFSCheck, and
+// their result collected with SimpleFSWait (or SimpleFSReadList).
+type SimpleFSInterface interface {
+	// Make a new OpID for an open file or an operation.
+	SimpleFSMakeOpid(context.Context) (OpID, error)
+	// Start listing the given directory.
+	SimpleFSList(context.Context, SimpleFSListArg) error
+	// Wait for a list operation, and get its results.
+	SimpleFSReadList(context.Context, OpID) (ListResult, error)
+	// Get information about the given path.
+	SimpleFSStat(context.Context, string) (Dirent, error)
+	// Open a file, creating it (or a directory) if it doesn't
+	// exist, unless the flags say otherwise.
+	SimpleFSOpen(context.Context, SimpleFSOpenArg) error
+	// Read from an open file.
+	SimpleFSRead(context.Context, SimpleFSReadArg) (FileContent, error)
+	// Write to a file opened for writing.
+	SimpleFSWrite(context.Context, SimpleFSWriteArg) error
+	// Close an open file, flushing any writes.
+	SimpleFSClose(context.Context, OpID) error
+	// Start copying a file or directory tree.
+	SimpleFSCopy(context.Context, SimpleFSCopyArg) error
+	// Start moving a file or directory tree.
+	SimpleFSMove(context.Context, SimpleFSMoveArg) error
+	// Start removing a file or directory.
+	SimpleFSRemove(context.Context, SimpleFSRemoveArg) error
+	// Get the progress of an operation.
+	SimpleFSCheck(context.Context, OpID) (OpProgress, error)
+	// Wait for an operation to finish, and get its error.
+	SimpleFSWait(context.Context, OpID) error
+	// Cancel an operation.
+	SimpleFSCancel(context.Context, OpID) error
+	// Cheaply check whether each of the given folders has changed
+	// since the given revision, for clients polling many folders.
+	SimpleFSGetChanges(context.Context, []FolderSince) ([]FolderChanges, error)
+}
+
+func simpleFSHandler(makeArg func() interface{},
+	handle func(context.Context, interface{}) (interface{}, error)) rpc.ServeHandlerDescription {
+	return rpc.ServeHandlerDescription{
+		MakeArg:    makeArg,
+		Handler:    handle,
+		MethodType: rpc.MethodCall,
+	}
+}
+
+// SimpleFSProtocol returns the RPC protocol for the given
+// SimpleFSInterface.
+func SimpleFSProtocol(i SimpleFSInterface) rpc.Protocol {
+	return rpc.Protocol{
+		Name: "keybase.1.SimpleFS",
+		Methods: map[string]rpc.ServeHandlerDescription{
+			"simpleFSMakeOpid": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSMakeOpidArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					return i.SimpleFSMakeOpid(ctx)
+				}),
+			"simpleFSList": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSListArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSListArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSListArg)(nil), args)
+					}
+					return nil, i.SimpleFSList(ctx, (*typedArgs)[0])
+				}),
+			"simpleFSReadList": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSReadListArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSReadListArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSReadListArg)(nil), args)
+					}
+					return i.SimpleFSReadList(ctx, (*typedArgs)[0].OpID)
+				}),
+			"simpleFSStat": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSStatArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSStatArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSStatArg)(nil), args)
+					}
+					return i.SimpleFSStat(ctx, (*typedArgs)[0].Path)
+				}),
+			"simpleFSOpen": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSOpenArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSOpenArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSOpenArg)(nil), args)
+					}
+					return nil, i.SimpleFSOpen(ctx, (*typedArgs)[0])
+				}),
+			"simpleFSRead": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSReadArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSReadArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSReadArg)(nil), args)
+					}
+					return i.SimpleFSRead(ctx, (*typedArgs)[0])
+				}),
+			"simpleFSWrite": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSWriteArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSWriteArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSWriteArg)(nil), args)
+					}
+					return nil, i.SimpleFSWrite(ctx, (*typedArgs)[0])
+				}),
+			"simpleFSClose": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSCloseArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSCloseArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSCloseArg)(nil), args)
+					}
+					return nil, i.SimpleFSClose(ctx, (*typedArgs)[0].OpID)
+				}),
+			"simpleFSCopy": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSCopyArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSCopyArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSCopyArg)(nil), args)
+					}
+					return nil, i.SimpleFSCopy(ctx, (*typedArgs)[0])
+				}),
+			"simpleFSMove": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSMoveArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSMoveArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSMoveArg)(nil), args)
+					}
+					return nil, i.SimpleFSMove(ctx, (*typedArgs)[0])
+				}),
+			"simpleFSRemove": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSRemoveArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSRemoveArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSRemoveArg)(nil), args)
+					}
+					return nil, i.SimpleFSRemove(ctx, (*typedArgs)[0])
+				}),
+			"simpleFSCheck": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSCheckArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSCheckArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSCheckArg)(nil), args)
+					}
+					return i.SimpleFSCheck(ctx, (*typedArgs)[0].OpID)
+				}),
+			"simpleFSWait": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSWaitArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSWaitArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSWaitArg)(nil), args)
+					}
+					return nil, i.SimpleFSWait(ctx, (*typedArgs)[0].OpID)
+				}),
+			"simpleFSCancel": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSCancelArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSCancelArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSCancelArg)(nil), args)
+					}
+					return nil, i.SimpleFSCancel(ctx, (*typedArgs)[0].OpID)
+				}),
+			"simpleFSGetChanges": simpleFSHandler(
+				func() interface{} { return &[]SimpleFSGetChangesArg{{}} },
+				func(ctx context.Context, args interface{}) (interface{}, error) {
+					typedArgs, ok := args.(*[]SimpleFSGetChangesArg)
+					if !ok {
+						return nil, rpc.NewTypeError((*[]SimpleFSGetChangesArg)(nil), args)
+					}
+					return i.SimpleFSGetChanges(ctx, (*typedArgs)[0].Folders)
+				}),
+		},
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package simplefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+)
+
+// numRemoveWorkers is the number of entries a recursive remove
+// removes at once.  Each removal dereferences the blocks of the
+// removed entry, which may first have to be fetched.
+const numRemoveWorkers = 8
+
+// RemoveManifestEntry describes one removed file or directory.
+type RemoveManifestEntry struct {
+	Path string `json:"path"`
+	Type string `json:"type"`
+	Size uint64 `json:"size"`
+	// Mtime and Ctime are in nanoseconds since the epoch.
+	Mtime         int64  `json:"mtime"`
+	Ctime         int64  `json:"ctime"`
+	SymlinkTarget string `json:"symlinkTarget,omitempty"`
+}
+
+// RemoveManifest records everything a remove operation is about to
+// remove, so that it can be restored, as far as possible, from the
+// folder as of Revision if the remove is cancelled or regretted.
+// Entries are listed parents first.
+type RemoveManifest struct {
+	Path     string                   `json:"path"`
+	Revision libkbfs.MetadataRevision `json:"revision"`
+	Time     keybase1.Time            `json:"time"`
+	Entries  []RemoveManifestEntry    `json:"entries"`
+}
+
+// removeEntry is one entry to be removed by doRemove.
+type removeEntry struct {
+	parent libkbfs.Node
+	name   string
+	ei     libkbfs.EntryInfo
+	path   string
+	depth  int
+}
+
+// walkRemoveTree appends the entries under the given directory to
+// entries, parents first.
+func (k *SimpleFS) walkRemoveTree(ctx context.Context, dir libkbfs.Node,
+	dirPath string, depth int, entries []removeEntry) ([]removeEntry, error) {
+	kbfsOps := k.config.KBFSOps()
+	children, err := kbfsOps.GetDirChildren(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ei := children[name]
+		childPath := dirPath + "/" + name
+		entries = append(entries, removeEntry{dir, name, ei, childPath, depth})
+		if ei.Type != libkbfs.Dir {
+			continue
+		}
+		child, _, err := kbfsOps.Lookup(ctx, dir, name)
+		if err != nil {
+			return nil, err
+		}
+		entries, err = k.walkRemoveTree(ctx, child, childPath, depth+1, entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// writeRemoveManifest writes the manifest for the given entries,
+// as JSON, to the file at manifestPath.
+func (k *SimpleFS) writeRemoveManifest(ctx context.Context,
+	p fsrpc.Path, fb libkbfs.FolderBranch, entries []removeEntry,
+	manifestPath string) error {
+	mp, err := fsrpc.NewPath(manifestPath)
+	if err != nil {
+		return err
+	}
+	if pathStr := p.String(); mp.String() == pathStr ||
+		strings.HasPrefix(mp.String(), pathStr+"/") {
+		return fmt.Errorf("Manifest %s is within %s", mp, p)
+	}
+
+	kbfsOps := k.config.KBFSOps()
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	if err != nil {
+		return err
+	}
+	manifest := RemoveManifest{
+		Path:     p.String(),
+		Revision: status.Revision,
+		Time:     keybase1.ToTime(k.config.Clock().Now()),
+		Entries:  make([]RemoveManifestEntry, 0, len(entries)),
+	}
+	for _, e := range entries {
+		manifest.Entries = append(manifest.Entries, RemoveManifestEntry{
+			Path:          e.path,
+			Type:          e.ei.Type.String(),
+			Size:          e.ei.Size,
+			Mtime:         e.ei.Mtime,
+			Ctime:         e.ei.Ctime,
+			SymlinkTarget: e.ei.SymPath,
+		})
+	}
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	parent, name, err := k.getParent(ctx, mp)
+	if err != nil {
+		return err
+	}
+	node, _, err := kbfsOps.Lookup(ctx, parent, name)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		node, _, err = kbfsOps.CreateFile(
+			ctx, parent, name, false, libkbfs.NoExcl)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if err := kbfsOps.Truncate(ctx, node, 0); err != nil {
+		return err
+	}
+	if err := kbfsOps.Write(ctx, node, buf, 0); err != nil {
+		return err
+	}
+	return kbfsOps.Sync(ctx, node)
+}
+
+// removeEntries removes the given entries, numRemoveWorkers at a
+// time.  None of the entries may be within another one.
+func (k *SimpleFS) removeEntries(ctx context.Context, ip *inprogress,
+	entries []removeEntry) error {
+	kbfsOps := k.config.KBFSOps()
+	entriesToRemove := make(chan removeEntry, len(entries))
+	eg, groupCtx := errgroup.WithContext(ctx)
+	removeFn := func() error {
+		for e := range entriesToRemove {
+			select {
+			case <-groupCtx.Done():
+				return groupCtx.Err()
+			default:
+			}
+
+			var err error
+			if e.ei.Type == libkbfs.Dir {
+				err = kbfsOps.RemoveDir(groupCtx, e.parent, e.name)
+			} else {
+				err = kbfsOps.RemoveEntry(groupCtx, e.parent, e.name)
+			}
+			if err != nil {
+				return err
+			}
+			k.updateProgress(ip, func(progress *OpProgress) {
+				progress.FilesDone++
+				if e.ei.Type != libkbfs.Dir {
+					progress.BytesDone += int64(e.ei.Size)
+				}
+			})
+		}
+		return nil
+	}
+	for i := 0; i < numRemoveWorkers; i++ {
+		eg.Go(removeFn)
+	}
+	for _, e := range entries {
+		entriesToRemove <- e
+	}
+	close(entriesToRemove)
+	return eg.Wait()
+}
+
+// doRemove removes the given path, and everything under it if
+// recursive is set.  If manifestPath is set, it first writes an undo
+// manifest there.
+func (k *SimpleFS) doRemove(ctx context.Context, ip *inprogress,
+	p fsrpc.Path, recursive bool, manifestPath string) error {
+	parent, name, err := k.getParent(ctx, p)
+	if err != nil {
+		return err
+	}
+	kbfsOps := k.config.KBFSOps()
+	node, ei, err := kbfsOps.Lookup(ctx, parent, name)
+	if err != nil {
+		return err
+	}
+	entries := []removeEntry{{parent, name, ei, p.String(), 0}}
+	if ei.Type == libkbfs.Dir && recursive {
+		entries, err = k.walkRemoveTree(ctx, node, p.String(), 1, entries)
+		if err != nil {
+			return err
+		}
+	}
+	var bytes int64
+	maxDepth := 0
+	for _, e := range entries {
+		if e.ei.Type != libkbfs.Dir {
+			bytes += int64(e.ei.Size)
+		}
+		if e.depth > maxDepth {
+			maxDepth = e.depth
+		}
+	}
+	k.updateProgress(ip, func(progress *OpProgress) {
+		// A move across folders has already counted its copy.
+		progress.BytesTotal += bytes
+		progress.FilesTotal += int64(len(entries))
+	})
+
+	if manifestPath != "" {
+		err := k.writeRemoveManifest(
+			ctx, p, parent.GetFolderBranch(), entries, manifestPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Remove the deepest entries first, so that every directory is
+	// empty by the time it's removed.
+	byDepth := make([][]removeEntry, maxDepth+1)
+	for _, e := range entries {
+		byDepth[e.depth] = append(byDepth[e.depth], e)
+	}
+	for depth := maxDepth; depth >= 0; depth-- {
+		if err := k.removeEntries(ctx, ip, byDepth[depth]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
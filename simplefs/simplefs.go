@@ -0,0 +1,715 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Package simplefs implements the SimpleFS RPC protocol, which lets
+// clients without a mounted file system, such as the Keybase GUI and
+// the mobile apps, list, read, write, copy, move and remove files in
+// KBFS.
+package simplefs
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// copyBufSize is the number of bytes copied at a time by copy and
+// move operations.
+const copyBufSize = 512 * 1024
+
+// CtxTagKey is the type used for unique context tags.
+type CtxTagKey int
+
+const (
+	// CtxIDKey is the type of the tag for unique operation IDs.
+	CtxIDKey CtxTagKey = iota
+)
+
+// CtxOpID is the display name for the unique operation SimpleFS ID
+// tag.
+const CtxOpID = "SFSID"
+
+// handle is a file opened with SimpleFSOpen.
+type handle struct {
+	node  libkbfs.Node
+	flags OpenFlags
+}
+
+// inprogress is an asynchronous operation.
+type inprogress struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// progress is protected by SimpleFS.lock.
+	progress OpProgress
+	// err and entries may only be read once done is closed.
+	err     error
+	entries []Dirent
+}
+
+// SimpleFS implements SimpleFSInterface on top of a libkbfs.Config.
+type SimpleFS struct {
+	config libkbfs.Config
+	log    logger.Logger
+
+	lock       sync.Mutex
+	handles    map[OpID]*handle
+	inProgress map[OpID]*inprogress
+}
+
+var _ SimpleFSInterface = (*SimpleFS)(nil)
+
+// NewSimpleFS returns a new SimpleFS for the given config.
+func NewSimpleFS(config libkbfs.Config) *SimpleFS {
+	return &SimpleFS{
+		config:     config,
+		log:        config.MakeLogger("SFS"),
+		handles:    make(map[OpID]*handle),
+		inProgress: make(map[OpID]*inprogress),
+	}
+}
+
+// NewSimpleFSProtocol creates the SimpleFS protocol for the given
+// config.  It can be used as a libkbfs.AdditionalProtocolCreator.
+func NewSimpleFSProtocol(
+	_ libkbfs.Context, config libkbfs.Config) (rpc.Protocol, error) {
+	return SimpleFSProtocol(NewSimpleFS(config)), nil
+}
+
+// NoSuchOpError is returned for an OpID that doesn't name an open
+// file or an operation in progress.
+type NoSuchOpError struct {
+	OpID OpID
+}
+
+func (e NoSuchOpError) Error() string {
+	return fmt.Sprintf("No such SimpleFS op ID: %s", e.OpID)
+}
+
+// OpIDInUseError is returned when an OpID that is already in use is
+// given for a new open file or operation.
+type OpIDInUseError struct {
+	OpID OpID
+}
+
+func (e OpIDInUseError) Error() string {
+	return fmt.Sprintf("SimpleFS op ID %s is already in use", e.OpID)
+}
+
+// makeContext returns a context derived from ctx, tagged with a new
+// request ID, whose cancellation KBFS writes can delay until it's
+// safe.  The caller must cancel ctx or call
+// libkbfs.CleanupCancellationDelayer once it's done with the
+// returned context.
+func (k *SimpleFS) makeContext(ctx context.Context) (context.Context, error) {
+	id, errRandomReqID := libkbfs.MakeRandomRequestID()
+	if errRandomReqID != nil {
+		k.log.Errorf("Couldn't make request ID: %v", errRandomReqID)
+	}
+	return libkbfs.NewContextWithCancellationDelayer(
+		libkbfs.NewContextReplayable(ctx,
+			func(ctx context.Context) context.Context {
+				logTags := make(logger.CtxLogTags)
+				logTags[CtxIDKey] = CtxOpID
+				ctx = logger.NewContextWithLogTags(ctx, logTags)
+				if errRandomReqID == nil {
+					ctx = context.WithValue(ctx, CtxIDKey, id)
+				}
+				return ctx
+			}))
+}
+
+// newContext returns a context for an asynchronous operation, which
+// has to outlive the RPC that started it.
+func (k *SimpleFS) newContext() (context.Context, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, err := k.makeContext(ctx)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return ctx, cancel, nil
+}
+
+// startAsync runs fn in the background as the operation named by
+// opID.
+func (k *SimpleFS) startAsync(ctx context.Context, opID OpID, opType OpType,
+	fn func(ctx context.Context, ip *inprogress) error) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := k.inProgress[opID]; ok {
+		return OpIDInUseError{opID}
+	}
+	if _, ok := k.handles[opID]; ok {
+		return OpIDInUseError{opID}
+	}
+
+	opCtx, cancel, err := k.newContext()
+	if err != nil {
+		return err
+	}
+	ip := &inprogress{
+		cancel: cancel,
+		done:   make(chan struct{}),
+		progress: OpProgress{
+			OpType: opType,
+			Start:  keybase1.ToTime(k.config.Clock().Now()),
+		},
+	}
+	k.inProgress[opID] = ip
+	k.log.CDebugf(ctx, "Starting op %s of type %d", opID, opType)
+	go func() {
+		defer cancel()
+		err := fn(opCtx, ip)
+		if err != nil {
+			k.log.CDebugf(opCtx, "Op %s failed: %v", opID, err)
+		}
+		ip.err = err
+		close(ip.done)
+	}()
+	return nil
+}
+
+func (k *SimpleFS) updateProgress(ip *inprogress, fn func(*OpProgress)) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	fn(&ip.progress)
+}
+
+func (k *SimpleFS) getInProgress(opID OpID) (*inprogress, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	ip, ok := k.inProgress[opID]
+	if !ok {
+		return nil, NoSuchOpError{opID}
+	}
+	return ip, nil
+}
+
+// wait waits for the given operation to finish, and then forgets
+// it.
+func (k *SimpleFS) wait(ctx context.Context, opID OpID) (*inprogress, error) {
+	ip, err := k.getInProgress(opID)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-ip.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	delete(k.inProgress, opID)
+	return ip, nil
+}
+
+func (k *SimpleFS) getHandle(opID OpID) (*handle, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	h, ok := k.handles[opID]
+	if !ok {
+		return nil, NoSuchOpError{opID}
+	}
+	return h, nil
+}
+
+func direntFor(name string, ei libkbfs.EntryInfo) Dirent {
+	d := Dirent{
+		Name: name,
+		Size: int64(ei.Size),
+		// Mtime is in nanoseconds.
+		Time:          keybase1.Time(ei.Mtime / 1000000),
+		SymlinkTarget: ei.SymPath,
+	}
+	switch ei.Type {
+	case libkbfs.Dir:
+		d.DirentType = DirentDir
+	case libkbfs.Sym:
+		d.DirentType = DirentSym
+	case libkbfs.Exec:
+		d.DirentType = DirentExec
+	default:
+		d.DirentType = DirentFile
+	}
+	return d
+}
+
+// getParent returns the directory node containing the given path,
+// and the name of the path within it.
+func (k *SimpleFS) getParent(ctx context.Context, p fsrpc.Path) (
+	libkbfs.Node, string, error) {
+	dir, name, err := p.DirAndBasename()
+	if err != nil {
+		return nil, "", err
+	}
+	if dir.PathType != fsrpc.TLFPathType {
+		return nil, "", fmt.Errorf("%s is not within a folder", p)
+	}
+	node, err := dir.GetDirNode(ctx, k.config)
+	if err != nil {
+		return nil, "", err
+	}
+	return node, name, nil
+}
+
+// SimpleFSMakeOpid implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSMakeOpid(_ context.Context) (OpID, error) {
+	var opID OpID
+	_, err := rand.Read(opID[:])
+	return opID, err
+}
+
+func (k *SimpleFS) list(ctx context.Context, p fsrpc.Path) ([]Dirent, error) {
+	switch p.PathType {
+	case fsrpc.RootPathType:
+		return []Dirent{{Name: "keybase", DirentType: DirentDir}}, nil
+	case fsrpc.KeybasePathType:
+		return []Dirent{
+			{Name: "private", DirentType: DirentDir},
+			{Name: "public", DirentType: DirentDir},
+		}, nil
+	case fsrpc.KeybaseChildPathType:
+		favs, err := k.config.KBFSOps().GetFavorites(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var entries []Dirent
+		for _, fav := range favs {
+			if fav.Public == p.Public {
+				entries = append(entries,
+					Dirent{Name: fav.Name, DirentType: DirentDir})
+			}
+		}
+		return entries, nil
+	}
+
+	node, ei, err := p.GetNode(ctx, k.config)
+	if err != nil {
+		return nil, err
+	}
+	if ei.Type != libkbfs.Dir {
+		_, name, err := p.DirAndBasename()
+		if err != nil {
+			return nil, err
+		}
+		return []Dirent{direntFor(name, ei)}, nil
+	}
+	children, err := k.config.KBFSOps().GetDirChildren(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]Dirent, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, direntFor(name, children[name]))
+	}
+	return entries, nil
+}
+
+// SimpleFSList implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSList(ctx context.Context, arg SimpleFSListArg) error {
+	p, err := fsrpc.NewPath(arg.Path)
+	if err != nil {
+		return err
+	}
+	return k.startAsync(ctx, arg.OpID, OpList,
+		func(ctx context.Context, ip *inprogress) error {
+			entries, err := k.list(ctx, p)
+			if err != nil {
+				return err
+			}
+			ip.entries = entries
+			k.updateProgress(ip, func(progress *OpProgress) {
+				progress.FilesTotal = int64(len(entries))
+				progress.FilesDone = int64(len(entries))
+			})
+			return nil
+		})
+}
+
+// SimpleFSReadList implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSReadList(ctx context.Context, opID OpID) (
+	ListResult, error) {
+	ip, err := k.wait(ctx, opID)
+	if err != nil {
+		return ListResult{}, err
+	}
+	if ip.err != nil {
+		return ListResult{}, ip.err
+	}
+	return ListResult{Entries: ip.entries}, nil
+}
+
+// SimpleFSStat implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSStat(ctx context.Context, path string) (
+	Dirent, error) {
+	p, err := fsrpc.NewPath(path)
+	if err != nil {
+		return Dirent{}, err
+	}
+	var name string
+	if p.PathType != fsrpc.RootPathType {
+		_, name, err = p.DirAndBasename()
+		if err != nil {
+			return Dirent{}, err
+		}
+	}
+	_, ei, err := p.GetNode(ctx, k.config)
+	if err != nil {
+		return Dirent{}, err
+	}
+	return direntFor(name, ei), nil
+}
+
+// SimpleFSOpen implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSOpen(ctx context.Context, arg SimpleFSOpenArg) error {
+	ctx, err := k.makeContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	p, err := fsrpc.NewPath(arg.Dest)
+	if err != nil {
+		return err
+	}
+	node, ei, err := p.GetNode(ctx, k.config)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok &&
+		arg.Flags&OpenExisting == 0 {
+		parent, name, err := k.getParent(ctx, p)
+		if err != nil {
+			return err
+		}
+		if arg.Flags&OpenDirectory != 0 {
+			node, ei, err = k.config.KBFSOps().CreateDir(ctx, parent, name)
+		} else {
+			node, ei, err = k.config.KBFSOps().CreateFile(
+				ctx, parent, name, false, libkbfs.NoExcl)
+		}
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if node == nil {
+		return fmt.Errorf("Can't open %s", p)
+	}
+	if ei.Type == libkbfs.Dir && arg.Flags&OpenDirectory == 0 {
+		return fmt.Errorf("%s is a directory", p)
+	}
+	if ei.Type != libkbfs.Dir && arg.Flags&OpenReplace != 0 {
+		if err := k.config.KBFSOps().Truncate(ctx, node, 0); err != nil {
+			return err
+		}
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := k.handles[arg.OpID]; ok {
+		return OpIDInUseError{arg.OpID}
+	}
+	if _, ok := k.inProgress[arg.OpID]; ok {
+		return OpIDInUseError{arg.OpID}
+	}
+	k.handles[arg.OpID] = &handle{node: node, flags: arg.Flags}
+	return nil
+}
+
+// SimpleFSRead implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSRead(ctx context.Context, arg SimpleFSReadArg) (
+	FileContent, error) {
+	h, err := k.getHandle(arg.OpID)
+	if err != nil {
+		return FileContent{}, err
+	}
+	if arg.Size < 0 {
+		return FileContent{}, fmt.Errorf("Invalid read size %d", arg.Size)
+	}
+	buf := make([]byte, arg.Size)
+	n, err := k.config.KBFSOps().Read(ctx, h.node, buf, arg.Offset)
+	if err != nil {
+		return FileContent{}, err
+	}
+	return FileContent{Data: buf[:n]}, nil
+}
+
+// SimpleFSWrite implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSWrite(ctx context.Context, arg SimpleFSWriteArg) error {
+	ctx, err := k.makeContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	h, err := k.getHandle(arg.OpID)
+	if err != nil {
+		return err
+	}
+	if h.flags&OpenWrite == 0 {
+		return errors.New("File not opened for writing")
+	}
+	return k.config.KBFSOps().Write(ctx, h.node, arg.Content, arg.Offset)
+}
+
+// SimpleFSClose implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSClose(ctx context.Context, opID OpID) error {
+	ctx, err := k.makeContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	h, err := k.getHandle(opID)
+	if err != nil {
+		return err
+	}
+	func() {
+		k.lock.Lock()
+		defer k.lock.Unlock()
+		delete(k.handles, opID)
+	}()
+	if h.flags&OpenWrite == 0 {
+		return nil
+	}
+	return k.config.KBFSOps().Sync(ctx, h.node)
+}
+
+// countTree returns the number of bytes and files under the given
+// entry, for progress reporting.
+func (k *SimpleFS) countTree(ctx context.Context, node libkbfs.Node,
+	ei libkbfs.EntryInfo) (bytes, files int64, err error) {
+	if ei.Type != libkbfs.Dir {
+		return int64(ei.Size), 1, nil
+	}
+	children, err := k.config.KBFSOps().GetDirChildren(ctx, node)
+	if err != nil {
+		return 0, 0, err
+	}
+	files = 1
+	for name, childEI := range children {
+		if childEI.Type != libkbfs.Dir {
+			bytes += int64(childEI.Size)
+			files++
+			continue
+		}
+		child, _, err := k.config.KBFSOps().Lookup(ctx, node, name)
+		if err != nil {
+			return 0, 0, err
+		}
+		childBytes, childFiles, err := k.countTree(ctx, child, childEI)
+		if err != nil {
+			return 0, 0, err
+		}
+		bytes += childBytes
+		files += childFiles
+	}
+	return bytes, files, nil
+}
+
+func (k *SimpleFS) copyFile(ctx context.Context, ip *inprogress,
+	src libkbfs.Node, dest libkbfs.Node) error {
+	kbfsOps := k.config.KBFSOps()
+	buf := make([]byte, copyBufSize)
+	var off int64
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		n, err := kbfsOps.Read(ctx, src, buf, off)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if err := kbfsOps.Write(ctx, dest, buf[:n], off); err != nil {
+			return err
+		}
+		off += n
+		k.updateProgress(ip, func(progress *OpProgress) {
+			progress.BytesDone += n
+		})
+	}
+	return kbfsOps.Sync(ctx, dest)
+}
+
+// copyTree copies the given entry to name in destParent, which must
+// not exist yet.
+func (k *SimpleFS) copyTree(ctx context.Context, ip *inprogress,
+	src libkbfs.Node, ei libkbfs.EntryInfo, destParent libkbfs.Node,
+	name string) error {
+	kbfsOps := k.config.KBFSOps()
+	switch ei.Type {
+	case libkbfs.Dir:
+		dest, _, err := kbfsOps.CreateDir(ctx, destParent, name)
+		if err != nil {
+			return err
+		}
+		children, err := kbfsOps.GetDirChildren(ctx, src)
+		if err != nil {
+			return err
+		}
+		for childName, childEI := range children {
+			child, _, err := kbfsOps.Lookup(ctx, src, childName)
+			if err != nil {
+				return err
+			}
+			err = k.copyTree(ctx, ip, child, childEI, dest, childName)
+			if err != nil {
+				return err
+			}
+		}
+	case libkbfs.Sym:
+		_, err := kbfsOps.CreateLink(ctx, destParent, name, ei.SymPath)
+		if err != nil {
+			return err
+		}
+	default:
+		dest, _, err := kbfsOps.CreateFile(
+			ctx, destParent, name, ei.Type == libkbfs.Exec, libkbfs.WithExcl)
+		if err != nil {
+			return err
+		}
+		if err := k.copyFile(ctx, ip, src, dest); err != nil {
+			return err
+		}
+	}
+	k.updateProgress(ip, func(progress *OpProgress) {
+		progress.FilesDone++
+	})
+	return nil
+}
+
+func (k *SimpleFS) doCopy(ctx context.Context, ip *inprogress,
+	src, dest fsrpc.Path) error {
+	srcNode, srcEI, err := src.GetNode(ctx, k.config)
+	if err != nil {
+		return err
+	}
+	if srcNode == nil {
+		return fmt.Errorf("Can't copy %s", src)
+	}
+	bytes, files, err := k.countTree(ctx, srcNode, srcEI)
+	if err != nil {
+		return err
+	}
+	k.updateProgress(ip, func(progress *OpProgress) {
+		progress.BytesTotal = bytes
+		progress.FilesTotal = files
+	})
+	destParent, destName, err := k.getParent(ctx, dest)
+	if err != nil {
+		return err
+	}
+	return k.copyTree(ctx, ip, srcNode, srcEI, destParent, destName)
+}
+
+// SimpleFSCopy implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSCopy(ctx context.Context, arg SimpleFSCopyArg) error {
+	src, err := fsrpc.NewPath(arg.Src)
+	if err != nil {
+		return err
+	}
+	dest, err := fsrpc.NewPath(arg.Dest)
+	if err != nil {
+		return err
+	}
+	return k.startAsync(ctx, arg.OpID, OpCopy,
+		func(ctx context.Context, ip *inprogress) error {
+			return k.doCopy(ctx, ip, src, dest)
+		})
+}
+
+// SimpleFSMove implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSMove(ctx context.Context, arg SimpleFSMoveArg) error {
+	src, err := fsrpc.NewPath(arg.Src)
+	if err != nil {
+		return err
+	}
+	dest, err := fsrpc.NewPath(arg.Dest)
+	if err != nil {
+		return err
+	}
+	return k.startAsync(ctx, arg.OpID, OpMove,
+		func(ctx context.Context, ip *inprogress) error {
+			if src.PathType == fsrpc.TLFPathType &&
+				dest.PathType == fsrpc.TLFPathType &&
+				src.Public == dest.Public && src.TLFName == dest.TLFName {
+				srcParent, srcName, err := k.getParent(ctx, src)
+				if err != nil {
+					return err
+				}
+				destParent, destName, err := k.getParent(ctx, dest)
+				if err != nil {
+					return err
+				}
+				return k.config.KBFSOps().Rename(
+					ctx, srcParent, srcName, destParent, destName)
+			}
+
+			// Renames can't cross folders, so copy and then remove.
+			if err := k.doCopy(ctx, ip, src, dest); err != nil {
+				return err
+			}
+			return k.doRemove(ctx, ip, src, true, "")
+		})
+}
+
+// SimpleFSRemove implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSRemove(ctx context.Context, arg SimpleFSRemoveArg) error {
+	p, err := fsrpc.NewPath(arg.Path)
+	if err != nil {
+		return err
+	}
+	return k.startAsync(ctx, arg.OpID, OpRemove,
+		func(ctx context.Context, ip *inprogress) error {
+			return k.doRemove(
+				ctx, ip, p, arg.Recursive, arg.ManifestPath)
+		})
+}
+
+// SimpleFSCheck implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSCheck(_ context.Context, opID OpID) (
+	OpProgress, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	ip, ok := k.inProgress[opID]
+	if !ok {
+		return OpProgress{}, NoSuchOpError{opID}
+	}
+	return ip.progress, nil
+}
+
+// SimpleFSWait implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSWait(ctx context.Context, opID OpID) error {
+	ip, err := k.wait(ctx, opID)
+	if err != nil {
+		return err
+	}
+	return ip.err
+}
+
+// SimpleFSCancel implements the SimpleFSInterface for SimpleFS.
+func (k *SimpleFS) SimpleFSCancel(_ context.Context, opID OpID) error {
+	ip, err := k.getInProgress(opID)
+	if err != nil {
+		return err
+	}
+	ip.cancel()
+	return nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package simplefs
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeOpID(ctx context.Context, t *testing.T, sfs *SimpleFS) OpID {
+	opID, err := sfs.SimpleFSMakeOpid(ctx)
+	require.NoError(t, err)
+	return opID
+}
+
+func writeFile(ctx context.Context, t *testing.T, sfs *SimpleFS,
+	path string, data string) {
+	opID := makeOpID(ctx, t, sfs)
+	err := sfs.SimpleFSOpen(ctx, SimpleFSOpenArg{
+		OpID:  opID,
+		Dest:  path,
+		Flags: OpenWrite | OpenReplace,
+	})
+	require.NoError(t, err)
+	err = sfs.SimpleFSWrite(ctx, SimpleFSWriteArg{
+		OpID:    opID,
+		Content: []byte(data),
+	})
+	require.NoError(t, err)
+	require.NoError(t, sfs.SimpleFSClose(ctx, opID))
+}
+
+func readFile(ctx context.Context, t *testing.T, sfs *SimpleFS,
+	path string) string {
+	opID := makeOpID(ctx, t, sfs)
+	err := sfs.SimpleFSOpen(ctx, SimpleFSOpenArg{
+		OpID:  opID,
+		Dest:  path,
+		Flags: OpenExisting,
+	})
+	require.NoError(t, err)
+	content, err := sfs.SimpleFSRead(ctx, SimpleFSReadArg{
+		OpID: opID,
+		Size: 1024,
+	})
+	require.NoError(t, err)
+	require.NoError(t, sfs.SimpleFSClose(ctx, opID))
+	return string(content.Data)
+}
+
+func listNames(ctx context.Context, t *testing.T, sfs *SimpleFS,
+	path string) []string {
+	opID := makeOpID(ctx, t, sfs)
+	err := sfs.SimpleFSList(ctx, SimpleFSListArg{OpID: opID, Path: path})
+	require.NoError(t, err)
+	result, err := sfs.SimpleFSReadList(ctx, opID)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range result.Entries {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func TestSimpleFS(t *testing.T) {
+	ctx := context.Background()
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	sfs := NewSimpleFS(config)
+	const tlf = "/keybase/private/jdoe"
+
+	// Create a directory and a file in it.
+	opID := makeOpID(ctx, t, sfs)
+	err := sfs.SimpleFSOpen(ctx, SimpleFSOpenArg{
+		OpID:  opID,
+		Dest:  tlf + "/dir",
+		Flags: OpenDirectory,
+	})
+	require.NoError(t, err)
+	require.NoError(t, sfs.SimpleFSClose(ctx, opID))
+	writeFile(ctx, t, sfs, tlf+"/dir/a", "hello")
+
+	de, err := sfs.SimpleFSStat(ctx, tlf+"/dir/a")
+	require.NoError(t, err)
+	require.Equal(t, "a", de.Name)
+	require.Equal(t, DirentFile, de.DirentType)
+	require.Equal(t, int64(5), de.Size)
+	require.Equal(t, "hello", readFile(ctx, t, sfs, tlf+"/dir/a"))
+
+	// Copy the directory, and check the progress.
+	opID = makeOpID(ctx, t, sfs)
+	err = sfs.SimpleFSCopy(ctx, SimpleFSCopyArg{
+		OpID: opID,
+		Src:  tlf + "/dir",
+		Dest: tlf + "/dir2",
+	})
+	require.NoError(t, err)
+	_, err = sfs.SimpleFSCheck(ctx, opID)
+	require.NoError(t, err)
+	require.NoError(t, sfs.SimpleFSWait(ctx, opID))
+	_, err = sfs.SimpleFSCheck(ctx, opID)
+	require.Equal(t, NoSuchOpError{opID}, err)
+	require.Equal(t, "hello", readFile(ctx, t, sfs, tlf+"/dir2/a"))
+
+	// Move a file within the folder.
+	opID = makeOpID(ctx, t, sfs)
+	err = sfs.SimpleFSMove(ctx, SimpleFSMoveArg{
+		OpID: opID,
+		Src:  tlf + "/dir2/a",
+		Dest: tlf + "/b",
+	})
+	require.NoError(t, err)
+	require.NoError(t, sfs.SimpleFSWait(ctx, opID))
+	require.Equal(t, []string{"b", "dir", "dir2"}, listNames(ctx, t, sfs, tlf))
+	require.Len(t, listNames(ctx, t, sfs, tlf+"/dir2"), 0)
+
+	// Remove a non-empty directory, with an undo manifest.
+	writeFile(ctx, t, sfs, tlf+"/dir/c", "world")
+	opID = makeOpID(ctx, t, sfs)
+	err = sfs.SimpleFSRemove(ctx, SimpleFSRemoveArg{
+		OpID:         opID,
+		Path:         tlf + "/dir",
+		Recursive:    true,
+		ManifestPath: tlf + "/manifest",
+	})
+	require.NoError(t, err)
+	require.NoError(t, sfs.SimpleFSWait(ctx, opID))
+	require.Equal(t, []string{"b", "dir2", "manifest"},
+		listNames(ctx, t, sfs, tlf))
+
+	var manifest RemoveManifest
+	err = json.Unmarshal(
+		[]byte(readFile(ctx, t, sfs, tlf+"/manifest")), &manifest)
+	require.NoError(t, err)
+	require.Equal(t, tlf+"/dir", manifest.Path)
+	require.NotEqual(t, libkbfs.MetadataRevisionUninitialized,
+		manifest.Revision)
+	var paths []string
+	for _, e := range manifest.Entries {
+		paths = append(paths, e.Path)
+	}
+	require.Equal(t, []string{tlf + "/dir", tlf + "/dir/a", tlf + "/dir/c"},
+		paths)
+	require.Equal(t, "DIR", manifest.Entries[0].Type)
+	require.Equal(t, uint64(5), manifest.Entries[2].Size)
+
+	// The manifest can't be within the removed path.
+	opID = makeOpID(ctx, t, sfs)
+	err = sfs.SimpleFSRemove(ctx, SimpleFSRemoveArg{
+		OpID:         opID,
+		Path:         tlf + "/dir2",
+		Recursive:    true,
+		ManifestPath: tlf + "/dir2/manifest",
+	})
+	require.NoError(t, err)
+	require.Error(t, sfs.SimpleFSWait(ctx, opID))
+
+	// Writes need the write flag.
+	opID = makeOpID(ctx, t, sfs)
+	err = sfs.SimpleFSOpen(ctx, SimpleFSOpenArg{
+		OpID:  opID,
+		Dest:  tlf + "/b",
+		Flags: OpenExisting,
+	})
+	require.NoError(t, err)
+	err = sfs.SimpleFSWrite(ctx, SimpleFSWriteArg{
+		OpID:    opID,
+		Content: []byte("x"),
+	})
+	require.Error(t, err)
+	require.NoError(t, sfs.SimpleFSClose(ctx, opID))
+}
+
+func TestSimpleFSGetChanges(t *testing.T) {
+	ctx := context.Background()
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	sfs := NewSimpleFS(config)
+	const tlf = "/keybase/private/jdoe"
+
+	changes, err := sfs.SimpleFSGetChanges(ctx, []FolderSince{{Path: tlf}})
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, "", changes[0].Error)
+	head := changes[0].Head
+
+	writeFile(ctx, t, sfs, tlf+"/a", "hello")
+
+	changes, err = sfs.SimpleFSGetChanges(ctx, []FolderSince{
+		{Path: tlf, Revision: head},
+		{Path: "/keybase/private"},
+	})
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	require.Equal(t, "", changes[0].Error)
+	require.True(t, changes[0].Head > head)
+	flags := libkbfs.ChangeFlags(changes[0].Flags)
+	require.NotZero(t, flags&libkbfs.ChangeFlagChanged)
+	require.NotZero(t, flags&libkbfs.ChangeFlagEntriesAdded)
+	require.Equal(t, 1, changes[0].Added)
+	require.NotEqual(t, "", changes[1].Error)
+
+	changes, err = sfs.SimpleFSGetChanges(ctx, []FolderSince{
+		{Path: tlf, Revision: changes[0].Head},
+	})
+	require.NoError(t, err)
+	require.Zero(t, changes[0].Flags)
+}
@@ -0,0 +1,276 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// These benchmarks run against whichever engine the build tags
+// select, so compare engines by running, e.g.:
+// go test -test.run=NONE -test.bench=Engine
+// go test -test.run=NONE -test.bench=Engine -tags fuse
+
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+// EnvTestBenchResults is the environment variable name for a file to
+// which BenchmarkEngine appends one JSON-encoded benchResult per
+// line, for tracking performance regressions across runs.  Since the
+// testing package runs each benchmark a few times to pick b.N, only
+// the last line for each name is the final result.
+const EnvTestBenchResults = "KEYBASE_TEST_BENCH_RESULTS"
+
+// benchResult is the machine-readable result of a single engine
+// benchmark run.  Latencies are only filled in for benchmarks that
+// time individual operations.
+type benchResult struct {
+	Name      string  `json:"name"`
+	Engine    string  `json:"engine"`
+	BlockSize int64   `json:"block_size"`
+	N         int     `json:"n"`
+	NsPerOp   int64   `json:"ns_per_op"`
+	MBPerSec  float64 `json:"mb_per_sec,omitempty"`
+	P50Nanos  int64   `json:"p50_ns,omitempty"`
+	P99Nanos  int64   `json:"p99_ns,omitempty"`
+	MaxNanos  int64   `json:"max_ns,omitempty"`
+
+	elapsed    time.Duration
+	bytesPerOp int64
+	latencies  []time.Duration
+}
+
+// durations sorts a slice of durations in increasing order.
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// percentile returns the p-th percentile of the given latencies,
+// which must be sorted.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(latencies)-1) * p)
+	return latencies[i]
+}
+
+// report fills in the derived fields of r, logs its latencies, and
+// appends it to the results file if EnvTestBenchResults is set.
+func (r *benchResult) report(b *testing.B) {
+	r.N = b.N
+	if r.N > 0 {
+		r.NsPerOp = r.elapsed.Nanoseconds() / int64(r.N)
+	}
+	if r.bytesPerOp > 0 && r.elapsed > 0 {
+		r.MBPerSec = float64(r.bytesPerOp) * float64(r.N) /
+			r.elapsed.Seconds() / 1e6
+	}
+	if len(r.latencies) > 0 {
+		sort.Sort(durations(r.latencies))
+		r.P50Nanos = percentile(r.latencies, 0.5).Nanoseconds()
+		r.P99Nanos = percentile(r.latencies, 0.99).Nanoseconds()
+		r.MaxNanos = r.latencies[len(r.latencies)-1].Nanoseconds()
+		b.Logf("p50 %s, p99 %s, max %s",
+			time.Duration(r.P50Nanos), time.Duration(r.P99Nanos),
+			time.Duration(r.MaxNanos))
+	}
+
+	path := os.Getenv(EnvTestBenchResults)
+	if path == "" {
+		return
+	}
+	buf, err := json.Marshal(r)
+	if err != nil {
+		b.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// benchEngine runs the given benchmark body as alice, against a
+// fresh engine with the given block size, and then reports the
+// result under the given name.  The body is responsible for the benchmark timer, and for
+// filling in the elapsed time and, if it applies, the latencies of
+// the result.
+func benchEngine(b *testing.B, name string, blockSizeBytes int64,
+	f func(cb func(fileOp) error, r *benchResult) error) {
+	r := &benchResult{Name: name, BlockSize: blockSizeBytes}
+	test(silentBenchmark{b},
+		users("alice"),
+		blockSize(blockSizeBytes),
+		as(alice,
+			fileOp{func(c *ctx) error {
+				r.Engine = c.engine.Name()
+				return nil
+			}, Defaults},
+			custom(func(cb func(fileOp) error) error {
+				return f(cb, r)
+			}),
+		),
+	)
+	r.report(b)
+}
+
+// timeOps runs op for each of b.N iterations, timing each one
+// individually.
+func timeOps(b *testing.B, cb func(fileOp) error, r *benchResult,
+	op func(i int) fileOp) error {
+	r.latencies = make([]time.Duration, 0, b.N)
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		opStart := time.Now()
+		if err := cb(op(i)); err != nil {
+			return err
+		}
+		r.latencies = append(r.latencies, time.Since(opStart))
+	}
+	r.elapsed = time.Since(start)
+	b.StopTimer()
+	return nil
+}
+
+// stat looks up the given path, and gets its mtime, like a stat(2)
+// call on a mounted file system would.
+func stat(name string) fileOp {
+	return fileOp{func(c *ctx) error {
+		n, _, err := c.getNode(name, noCreate, resolveAllSyms)
+		if err != nil {
+			return err
+		}
+		_, err = c.engine.GetMtime(c.user, n)
+		return err
+	}, Defaults}
+}
+
+// readdir lists the given directory, without checking its contents.
+func readdir(name string) fileOp {
+	return fileOp{func(c *ctx) error {
+		n, _, err := c.getNode(name, noCreate, resolveAllSyms)
+		if err != nil {
+			return err
+		}
+		_, err = c.engine.GetDirChildrenTypes(c.user, n)
+		return err
+	}, Defaults}
+}
+
+const (
+	// Keep the file smaller than the starting size of the sync
+	// buffer, since the test clock never triggers a background sync
+	// that would make room for more dirty data.
+	benchEngineFileSize  = 256 << 10
+	benchEngineWriteSize = 64 << 10
+	benchEngineDirSize   = 100
+)
+
+// benchEngineWrite measures the throughput of writing a new 256 KB
+// file, in 64 KB writes with a sync after the last one, per
+// iteration.
+func benchEngineWrite(b *testing.B, name string, blockSizeBytes int64) {
+	b.SetBytes(benchEngineFileSize)
+	benchEngine(b, name, blockSizeBytes,
+		func(cb func(fileOp) error, r *benchResult) error {
+			r.bytesPerOp = benchEngineFileSize
+			buf := make([]byte, benchEngineWriteSize)
+			b.ResetTimer()
+			start := time.Now()
+			err := benchmarkDoBenchWrites(b, cb,
+				benchEngineFileSize/benchEngineWriteSize, buf, 0)
+			r.elapsed = time.Since(start)
+			b.StopTimer()
+			return err
+		})
+}
+
+// benchEngineSync measures the latency of a 4 KB write to an
+// existing file followed by a sync.
+func benchEngineSync(b *testing.B, name string, blockSizeBytes int64) {
+	benchEngine(b, name, blockSizeBytes,
+		func(cb func(fileOp) error, r *benchResult) error {
+			if err := cb(mkfile("bench", "")); err != nil {
+				return err
+			}
+			buf := make([]byte, 4<<10)
+			return timeOps(b, cb, r, func(i int) fileOp {
+				buf[0] = byte(i)
+				off := (int64(i) * int64(len(buf))) % benchEngineFileSize
+				return pwriteBSSync("bench", buf, off, true)
+			})
+		})
+}
+
+// benchEngineStat measures the latency of stat'ing one of the files
+// in a directory.
+func benchEngineStat(b *testing.B, name string, blockSizeBytes int64) {
+	benchEngine(b, name, blockSizeBytes,
+		func(cb func(fileOp) error, r *benchResult) error {
+			tr := tree{files: benchEngineDirSize, fileSize: 1}
+			if err := cb(populate("bench", tr)); err != nil {
+				return err
+			}
+			return timeOps(b, cb, r, func(i int) fileOp {
+				return stat(fmt.Sprintf("bench/f%d", i%benchEngineDirSize))
+			})
+		})
+}
+
+// benchEngineReaddir measures the latency of listing a directory
+// with 100 files in it.
+func benchEngineReaddir(b *testing.B, name string, blockSizeBytes int64) {
+	benchEngine(b, name, blockSizeBytes,
+		func(cb func(fileOp) error, r *benchResult) error {
+			tr := tree{files: benchEngineDirSize, fileSize: 1}
+			if err := cb(populate("bench", tr)); err != nil {
+				return err
+			}
+			return timeOps(b, cb, r, func(int) fileOp {
+				return readdir("bench")
+			})
+		})
+}
+
+// BenchmarkEngine measures write throughput and sync, stat and
+// readdir latencies for a few block sizes.  Set EnvTestBenchResults
+// to also get the results as JSON.
+func BenchmarkEngine(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		f    func(b *testing.B, name string, blockSizeBytes int64)
+	}{
+		{"Write", benchEngineWrite},
+		{"Sync", benchEngineSync},
+		{"Stat", benchEngineStat},
+		{"Readdir", benchEngineReaddir},
+	}
+	for _, blockSizeBytes := range []int64{16 << 10, 64 << 10, 512 << 10} {
+		blockSizeBytes := blockSizeBytes
+		sizeName := fmt.Sprintf("block%dk", blockSizeBytes>>10)
+		b.Run(sizeName,
+			func(b *testing.B) {
+				for _, bench := range benchmarks {
+					bench := bench
+					// testing.B has no Name method
+					// before Go 1.8.
+					name := fmt.Sprintf("BenchmarkEngine/%s/%s",
+						sizeName, bench.name)
+					b.Run(bench.name, func(b *testing.B) {
+						bench.f(b, name, blockSizeBytes)
+					})
+				}
+			})
+	}
+}
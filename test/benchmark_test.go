@@ -254,3 +254,43 @@ func BenchmarkWriteMixedFilesNormalBandwidth(b *testing.B) {
 		),
 	)
 }
+
+// benchmarkMkfileWithNetwork creates small files, one per iteration,
+// over an emulated network link.
+func benchmarkMkfileWithNetwork(b *testing.B,
+	conditions libkbfs.NetworkConditions) {
+	test(silentBenchmark{b},
+		users("alice"),
+		network(conditions),
+		as(alice,
+			custom(func(cb func(fileOp) error) error {
+				b.ResetTimer()
+				defer b.StopTimer()
+				for i := 0; i < b.N; i++ {
+					err := cb(mkfile(fmt.Sprintf("file%d", i), "hello"))
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}),
+		),
+	)
+}
+
+func BenchmarkMkfileHighLatency(b *testing.B) {
+	benchmarkMkfileWithNetwork(b, libkbfs.NetworkConditions{
+		RTT:    100 * time.Millisecond,
+		Jitter: 10 * time.Millisecond,
+		Seed:   1,
+	})
+}
+
+func BenchmarkMkfileHighLatencyLossy(b *testing.B) {
+	benchmarkMkfileWithNetwork(b, libkbfs.NetworkConditions{
+		RTT:      100 * time.Millisecond,
+		Jitter:   10 * time.Millisecond,
+		LossRate: 0.05,
+		Seed:     1,
+	})
+}
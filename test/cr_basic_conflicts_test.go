@@ -175,6 +175,39 @@ func TestCrConflictWriteFileWithAddTime(t *testing.T) {
 	)
 }
 
+// bob and alice both write(to the same file), but bob's clock is a
+// day ahead of alice's.
+func TestCrConflictWriteFileWithSkewedClock(t *testing.T) {
+	skew := 25 * time.Hour
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile("a/b", "hello"),
+		),
+		as(bob,
+			skewClock(skew),
+			disableUpdates(),
+		),
+		as(alice,
+			write("a/b", "world"),
+		),
+		as(bob, noSync(),
+			write("a/b", "uh oh"),
+			reenableUpdates(),
+			lsdir("a/", m{"b$": "FILE",
+				crnameAtTimeEsc("b", bob, skew): "FILE"}),
+			read("a/b", "world"),
+			read(crnameAtTime("a/b", bob, skew), "uh oh"),
+		),
+		as(alice,
+			lsdir("a/", m{"b$": "FILE",
+				crnameAtTimeEsc("b", bob, skew): "FILE"}),
+			read("a/b", "world"),
+			read(crnameAtTime("a/b", bob, skew), "uh oh"),
+		),
+	)
+}
+
 // bob and alice both write(to the same file),
 func TestCrConflictWriteFileWithExtension(t *testing.T) {
 	test(t,
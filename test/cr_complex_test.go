@@ -242,6 +242,43 @@ func TestCrUnmergedRenameWithParallelWrite(t *testing.T) {
 	)
 }
 
+// bob renames and writes to a file while unmerged, and creates a new
+// file in its old directory, at the same time alice writes to it.
+func TestCrUnmergedRenameWriteAndCreateWithParallelWrite(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkdir("a"),
+			mkdir("b"),
+			write("a/foo", "hello"),
+		),
+		as(bob,
+			disableUpdates(),
+		),
+		as(alice,
+			write("a/foo", "goodbye"),
+		),
+		as(bob, noSync(),
+			write("a/baz", "new"),
+			rename("a/foo", "b/bar"),
+			write("b/bar", "bye"),
+			reenableUpdates(),
+			lsdir("a", m{"foo": "FILE", "baz": "FILE"}),
+			lsdir("b", m{"bar": "FILE"}),
+			read("a/foo", "goodbye"),
+			read("a/baz", "new"),
+			read("b/bar", "byelo"),
+		),
+		as(alice,
+			lsdir("a", m{"foo": "FILE", "baz": "FILE"}),
+			lsdir("b", m{"bar": "FILE"}),
+			read("a/foo", "goodbye"),
+			read("a/baz", "new"),
+			read("b/bar", "byelo"),
+		),
+	)
+}
+
 // bob makes a non-conflicting file executable while alice writes to it
 func TestCrUnmergedSetexParallelWrite(t *testing.T) {
 	test(t,
@@ -37,14 +37,17 @@ type opt struct {
 	tlfIsPublic              bool
 	users                    map[libkb.NormalizedUsername]User
 	stallers                 map[libkb.NormalizedUsername]*libkbfs.NaïveStaller
+	faultInjectors           map[libkb.NormalizedUsername]*libkbfs.FaultInjector
 	t                        testing.TB
 	initOnce                 sync.Once
 	engine                   Engine
 	blockSize                int64
 	blockChangeSize          int64
 	bwKBps                   int
+	network                  libkbfs.NetworkConditions
 	timeout                  time.Duration
 	clock                    *libkbfs.TestClock
+	userClocks               map[libkb.NormalizedUsername]*userClock
 	isParallel               bool
 	journal                  bool
 }
@@ -114,9 +117,17 @@ func (o *opt) runInitOnce() {
 	o.initOnce.Do(func() {
 		o.clock = &libkbfs.TestClock{}
 		o.clock.Set(time.Unix(0, 0))
+		o.userClocks = make(map[libkb.NormalizedUsername]*userClock)
+		clocks := make(map[libkb.NormalizedUsername]libkbfs.Clock)
+		for _, u := range o.usernames {
+			o.userClocks[u] = &userClock{base: o.clock}
+			clocks[u] = o.userClocks[u]
+		}
 		o.users = o.engine.InitTest(o.t, o.blockSize, o.blockChangeSize,
-			o.bwKBps, o.timeout, o.usernames, o.clock, o.journal)
+			o.bwKBps, o.network, o.timeout, o.usernames, clocks,
+			o.journal)
 		o.stallers = o.makeStallers()
+		o.faultInjectors = o.makeFaultInjectors()
 	})
 }
 
@@ -129,6 +140,15 @@ func (o *opt) makeStallers() (
 	return stallers
 }
 
+func (o *opt) makeFaultInjectors() (
+	injectors map[libkb.NormalizedUsername]*libkbfs.FaultInjector) {
+	injectors = make(map[libkb.NormalizedUsername]*libkbfs.FaultInjector)
+	for username, user := range o.users {
+		injectors[username] = o.engine.MakeFaultInjector(user)
+	}
+	return injectors
+}
+
 func ntimesString(n int, s string) string {
 	var bs bytes.Buffer
 	for i := 0; i < n; i++ {
@@ -157,6 +177,14 @@ func bandwidth(n int) optionOp {
 	}
 }
 
+// network emulates the given latency and loss on every block and MD
+// RPC made by every user.
+func network(conditions libkbfs.NetworkConditions) optionOp {
+	return func(o *opt) {
+		o.network = conditions
+	}
+}
+
 func opTimeout(n time.Duration) optionOp {
 	return func(o *opt) {
 		o.timeout = n
@@ -247,11 +275,12 @@ const (
 
 type ctx struct {
 	*opt
-	user       User
-	username   libkb.NormalizedUsername
-	rootNode   Node
-	noSyncInit bool
-	staller    *libkbfs.NaïveStaller
+	user          User
+	username      libkb.NormalizedUsername
+	rootNode      Node
+	noSyncInit    bool
+	staller       *libkbfs.NaïveStaller
+	faultInjector *libkbfs.FaultInjector
 }
 
 func runFileOp(c *ctx, fop fileOp) (string, error) {
@@ -302,6 +331,29 @@ func (o *opt) expectSuccess(reason string, err error) {
 	}
 }
 
+// userClock is one user's view of the clock shared by all the users
+// of a test, which may be skewed from everyone else's.
+type userClock struct {
+	base *libkbfs.TestClock
+
+	lock sync.Mutex
+	skew time.Duration
+}
+
+// Now implements the libkbfs.Clock interface for userClock.
+func (uc *userClock) Now() time.Time {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	return uc.base.Now().Add(uc.skew)
+}
+
+func (uc *userClock) addSkew(d time.Duration) {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	uc.skew += d
+}
+
+// addTime advances the clock of every user by the given duration.
 func addTime(d time.Duration) fileOp {
 	return fileOp{func(c *ctx) error {
 		c.clock.Add(d)
@@ -309,16 +361,35 @@ func addTime(d time.Duration) fileOp {
 	}, Defaults}
 }
 
+// setTime sets the clock shared by every user to the given time.
+// Any users with a skewed clock stay skewed by the same amount.
+func setTime(t time.Time) fileOp {
+	return fileOp{func(c *ctx) error {
+		c.clock.Set(t)
+		return nil
+	}, Defaults}
+}
+
+// skewClock moves the current user's clock by the given duration,
+// without changing the time as seen by any other user.
+func skewClock(d time.Duration) fileOp {
+	return fileOp{func(c *ctx) error {
+		c.userClocks[c.username].addSkew(d)
+		return nil
+	}, IsInit}
+}
+
 func as(user username, fops ...fileOp) optionOp {
 	return func(o *opt) {
 		o.t.Log("as:", user)
 		o.runInitOnce()
 		u := libkb.NewNormalizedUsername(string(user))
 		ctx := &ctx{
-			opt:      o,
-			user:     o.users[u],
-			username: u,
-			staller:  o.stallers[u],
+			opt:           o,
+			user:          o.users[u],
+			username:      u,
+			staller:       o.stallers[u],
+			faultInjector: o.faultInjectors[u],
 		}
 
 		for _, fop := range fops {
@@ -629,6 +700,35 @@ func undoStallOnMDGetForTLF() fileOp {
 	}, IsInit}
 }
 
+func stallOnMDGetMergedDelta() fileOp {
+	return fileOp{func(c *ctx) error {
+		// TODO: Allow test to pass in a more precise maxStalls limit.
+		c.staller.StallMDOp(libkbfs.StallableMDGetMergedDelta, 100, false)
+		return nil
+	}, Defaults}
+}
+
+func waitForStalledMDGetMergedDelta() fileOp {
+	return fileOp{func(c *ctx) error {
+		c.staller.WaitForStallMDOp(libkbfs.StallableMDGetMergedDelta)
+		return nil
+	}, IsInit}
+}
+
+func unstallOneMDGetMergedDelta() fileOp {
+	return fileOp{func(c *ctx) error {
+		c.staller.UnstallOneMDOp(libkbfs.StallableMDGetMergedDelta)
+		return nil
+	}, IsInit}
+}
+
+func undoStallOnMDGetMergedDelta() fileOp {
+	return fileOp{func(c *ctx) error {
+		c.staller.UndoStallMDOp(libkbfs.StallableMDGetMergedDelta)
+		return nil
+	}, IsInit}
+}
+
 func stallDelegateOnMDGetRange() fileOp {
 	return fileOp{func(c *ctx) error {
 		// TODO: Allow test to pass in a more precise maxStalls limit.
@@ -703,6 +803,35 @@ func undoStallOnMDResolveBranch() fileOp {
 	}, IsInit}
 }
 
+// injectFault makes the count calls matching the given fault, after
+// the next skip ones, fail for the current user.  If count is
+// negative, every matching call fails until clearFault is called.
+func injectFault(fault libkbfs.Fault, skip, count int) fileOp {
+	return fileOp{func(c *ctx) error {
+		c.faultInjector.Inject(fault, skip, count)
+		return nil
+	}, Defaults}
+}
+
+func clearFault(fault libkbfs.Fault) fileOp {
+	return fileOp{func(c *ctx) error {
+		c.faultInjector.Clear(fault)
+		return nil
+	}, IsInit}
+}
+
+// checkFaultsInjected checks how many times the given fault has been
+// injected for the current user.
+func checkFaultsInjected(fault libkbfs.Fault, expected int) fileOp {
+	return fileOp{func(c *ctx) error {
+		if injected := c.faultInjector.Injected(fault); injected != expected {
+			return fmt.Errorf("Fault %s injected %d times, expected %d",
+				fault, injected, expected)
+		}
+		return nil
+	}, IsInit}
+}
+
 func reenableUpdates() fileOp {
 	return fileOp{func(c *ctx) error {
 		err := c.engine.ReenableUpdates(c.user, c.tlfName, c.tlfIsPublic)
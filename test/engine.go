@@ -36,12 +36,18 @@ type Engine interface {
 	// dedicated data block instead. If blockSize or blockChangeSize
 	// are zero, the engine defaults are used. bwKBps indicates a
 	// bandwidth constraint to simulate to the server in kilobytes per
-	// second; if zero, the engine defaults are used.  opTimeout
+	// second; if zero, the engine defaults are used.  network
+	// describes the latency and loss to emulate on every block and
+	// MD RPC; if it is zero, RPCs aren't delayed.  opTimeout
 	// specifies a per-operation timeout; if it is more than the
 	// default engine timeout, or if it is zero, it has no effect.
+	// clocks holds the clock each user should see, including in
+	// quota reclamation and the journal.
 	InitTest(t testing.TB, blockSize int64, blockChangeSize int64,
-		bwKBps int, opTimeout time.Duration, users []libkb.NormalizedUsername,
-		clock libkbfs.Clock, journal bool) map[libkb.NormalizedUsername]User
+		bwKBps int, network libkbfs.NetworkConditions,
+		opTimeout time.Duration, users []libkb.NormalizedUsername,
+		clocks map[libkb.NormalizedUsername]libkbfs.Clock,
+		journal bool) map[libkb.NormalizedUsername]User
 	// GetUID is called by the test harness to retrieve a user instance's UID.
 	GetUID(u User) keybase1.UID
 	// GetFavorites returns the set of all public or private
@@ -100,6 +106,9 @@ type Engine interface {
 	//MakeNaïveStaller returns a NaïveStaller associated with user u for
 	//stalling BlockOps or MDOps.
 	MakeNaïveStaller(u User) *libkbfs.NaïveStaller
+	// MakeFaultInjector returns a FaultInjector associated with
+	// user u for making BlockServer, MDServer or Crypto ops fail.
+	MakeFaultInjector(u User) *libkbfs.FaultInjector
 	// ReenableUpdates is called by the test harness as the given
 	// user to resume updates if previously disabled for testing.
 	ReenableUpdates(u User, tlfName string, isPublic bool) (err error)
@@ -41,3 +41,21 @@ func maybeSetBw(t testing.TB, config libkbfs.Config, bwKBps int) {
 		config.SetDoBackgroundFlushes(true)
 	}
 }
+
+// maybeSetNetwork emulates the given network conditions on the block
+// and MD servers of all the given configs.  It must only be called
+// once all the configs of a test have been made, since ConfigAsUser
+// can't copy emulated servers.
+func maybeSetNetwork(t testing.TB, conditions libkbfs.NetworkConditions,
+	configs ...libkbfs.Config) {
+	if conditions.IsZero() {
+		return
+	}
+	emulator, err := libkbfs.NewNetworkEmulator(conditions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range configs {
+		emulator.Install(config)
+	}
+}
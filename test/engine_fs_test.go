@@ -287,6 +287,11 @@ func (*fsEngine) MakeNaïveStaller(u User) *libkbfs.NaïveStaller {
 	return libkbfs.NewNaïveStaller(u.(*fsUser).config)
 }
 
+// MakeFaultInjector implements the Engine interface.
+func (*fsEngine) MakeFaultInjector(u User) *libkbfs.FaultInjector {
+	return libkbfs.NewFaultInjector(u.(*fsUser).config)
+}
+
 // ReenableUpdatesForTesting is called by the test harness as the given user to resume updates
 // if previously disabled for testing.
 func (*fsEngine) ReenableUpdates(user User, tlfName string, isPublic bool) (err error) {
@@ -505,9 +510,10 @@ func fiTypeString(fi os.FileInfo) string {
 }
 
 func (e *fsEngine) InitTest(t testing.TB, blockSize int64,
-	blockChangeSize int64, bwKBps int, opTimeout time.Duration,
-	users []libkb.NormalizedUsername,
-	clock libkbfs.Clock, journal bool) map[libkb.NormalizedUsername]User {
+	blockChangeSize int64, bwKBps int, network libkbfs.NetworkConditions,
+	opTimeout time.Duration, users []libkb.NormalizedUsername,
+	clocks map[libkb.NormalizedUsername]libkbfs.Clock,
+	journal bool) map[libkb.NormalizedUsername]User {
 	e.t = t
 	res := map[libkb.NormalizedUsername]User{}
 	initSuccess := false
@@ -526,20 +532,24 @@ func (e *fsEngine) InitTest(t testing.TB, blockSize int64,
 
 	// create the first user specially
 	config0 := libkbfs.MakeTestConfigOrBust(t, users...)
-	config0.SetClock(clock)
+	config0.SetClock(clocks[users[0]])
 
 	setBlockSizes(t, config0, blockSize, blockChangeSize)
 	maybeSetBw(t, config0, bwKBps)
 	uids := make([]keybase1.UID, len(users))
 	cfgs := make([]*libkbfs.ConfigLocal, len(users))
+	configs := make([]libkbfs.Config, len(users))
 	cfgs[0] = config0
+	configs[0] = config0
 	uids[0] = nameToUID(t, config0)
 	for i, name := range users[1:] {
 		c := libkbfs.ConfigAsUser(config0, name)
-		c.SetClock(clock)
+		c.SetClock(clocks[name])
 		cfgs[i+1] = c
+		configs[i+1] = c
 		uids[i+1] = nameToUID(t, c)
 	}
+	maybeSetNetwork(t, network, configs...)
 
 	for i, name := range users {
 		u := e.createUser(t, i, cfgs[i], opTimeout)
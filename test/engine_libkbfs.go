@@ -51,8 +51,10 @@ func (k *LibKBFS) Init() {
 
 // InitTest implements the Engine interface.
 func (k *LibKBFS) InitTest(t testing.TB, blockSize int64, blockChangeSize int64,
-	bwKBps int, opTimeout time.Duration, users []libkb.NormalizedUsername,
-	clock libkbfs.Clock, journal bool) map[libkb.NormalizedUsername]User {
+	bwKBps int, network libkbfs.NetworkConditions, opTimeout time.Duration,
+	users []libkb.NormalizedUsername,
+	clocks map[libkb.NormalizedUsername]libkbfs.Clock,
+	journal bool) map[libkb.NormalizedUsername]User {
 	// Start a new log for this test.
 	k.t = t
 	k.t.Log("\n------------------------------------------")
@@ -64,19 +66,22 @@ func (k *LibKBFS) InitTest(t testing.TB, blockSize int64, blockChangeSize int64,
 	maybeSetBw(t, config, bwKBps)
 	k.opTimeout = opTimeout
 
-	config.SetClock(clock)
+	config.SetClock(clocks[users[0]])
 	userMap[users[0]] = config
 	k.refs[config] = make(map[libkbfs.Node]bool)
 	k.updateChannels[config] = make(map[libkbfs.FolderBranch]chan<- struct{})
 
 	// create the rest of the users as copies of the original config
+	configs := []libkbfs.Config{config}
 	for _, name := range users[1:] {
 		c := libkbfs.ConfigAsUser(config, name)
-		c.SetClock(clock)
+		c.SetClock(clocks[name])
 		userMap[name] = c
+		configs = append(configs, c)
 		k.refs[c] = make(map[libkbfs.Node]bool)
 		k.updateChannels[c] = make(map[libkbfs.FolderBranch]chan<- struct{})
 	}
+	maybeSetNetwork(t, network, configs...)
 
 	if journal {
 		jdir, err := ioutil.TempDir(os.TempDir(), "kbfs_journal")
@@ -496,6 +501,11 @@ func (*LibKBFS) MakeNaïveStaller(u User) *libkbfs.NaïveStaller {
 	return libkbfs.NewNaïveStaller(u.(*libkbfs.ConfigLocal))
 }
 
+// MakeFaultInjector implements the Engine interface.
+func (*LibKBFS) MakeFaultInjector(u User) *libkbfs.FaultInjector {
+	return libkbfs.NewFaultInjector(u.(*libkbfs.ConfigLocal))
+}
+
 // ReenableUpdates implements the Engine interface.
 func (k *LibKBFS) ReenableUpdates(u User, tlfName string, isPublic bool) error {
 	config := u.(*libkbfs.ConfigLocal)
@@ -29,7 +29,7 @@ func TestFastForwardBasic(t *testing.T) {
 		as(bob,
 			read("a/b", "hello"),
 			disableUpdates(),
-			stallOnMDGetForTLF(),
+			stallOnMDGetMergedDelta(),
 		),
 		as(alice, busyWork...),
 		as(alice,
@@ -41,9 +41,9 @@ func TestFastForwardBasic(t *testing.T) {
 				reenableUpdatesNoSync(),
 			),
 			as(bob, noSync(),
-				// Wait for the background update to fetch the head.
-				waitForStalledMDGetForTLF(),
-				unstallOneMDGetForTLF(),
+				// Wait for the background update to fetch the delta.
+				waitForStalledMDGetMergedDelta(),
+				unstallOneMDGetMergedDelta(),
 			),
 		),
 		as(bob, noSync(),
@@ -51,7 +51,7 @@ func TestFastForwardBasic(t *testing.T) {
 			// the fast forward to complete (the unpause channel
 			// isn't buffered).
 			disableUpdates(),
-			undoStallOnMDGetForTLF(),
+			undoStallOnMDGetMergedDelta(),
 			reenableUpdatesNoSync(),
 			// Make sure the next sync only calls GetRange once.
 			stallOnMDGetRange(),
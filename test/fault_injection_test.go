@@ -0,0 +1,99 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package test
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// alice's write hits an MD conflict, which puts it on an unmerged
+// branch until bob's next write gives conflict resolution something
+// to merge it with.
+func TestFaultMDConflict(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile("a", "hello"),
+			disableUpdates(),
+			injectFault(libkbfs.FaultMDConflict, 0, 1),
+			mkfile("b", "world"),
+			checkFaultsInjected(libkbfs.FaultMDConflict, 1),
+		),
+		as(bob,
+			read("a", "hello"),
+			mkfile("c", "again"),
+		),
+		as(alice, noSync(),
+			reenableUpdates(),
+			lsdir("", m{"a$": "FILE", "b$": "FILE", "c$": "FILE"}),
+		),
+		as(bob,
+			read("b", "world"),
+		),
+	)
+}
+
+// alice's second block put fails, and her write goes through on the
+// next try.
+func TestFaultBlockPut(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile("a", "hello"),
+			injectFault(libkbfs.FaultBlockPut, 0, 1),
+			expectError(write("a", "world"), "Injected fault: BlockPut"),
+			checkFaultsInjected(libkbfs.FaultBlockPut, 1),
+			write("a", "world"),
+		),
+		as(bob,
+			read("a", "world"),
+		),
+	)
+}
+
+// alice can't write while partitioned from the servers, but catches
+// up once the partition heals.
+func TestFaultPartition(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile("a", "hello"),
+		),
+		as(bob,
+			read("a", "hello"),
+			injectFault(libkbfs.FaultPartition, 0, -1),
+			expectError(write("b", "world"), "Injected fault: Partition"),
+		),
+		as(alice,
+			write("a", "goodbye"),
+		),
+		as(bob,
+			clearFault(libkbfs.FaultPartition),
+			read("a", "goodbye"),
+			write("b", "world"),
+		),
+		as(alice,
+			read("b", "world"),
+		),
+	)
+}
+
+// bob can't decrypt alice's file until the crypto errors stop.
+func TestFaultCrypto(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile("a", "hello"),
+		),
+		as(bob,
+			injectFault(libkbfs.FaultCrypto, 0, -1),
+			expectError(read("a", "hello"), "Injected fault: Crypto"),
+			clearFault(libkbfs.FaultCrypto),
+			read("a", "hello"),
+		),
+	)
+}
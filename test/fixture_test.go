@@ -0,0 +1,197 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"testing"
+)
+
+// tree declaratively describes a pre-populated directory tree, so
+// that tests and benchmarks don't have to hand-roll the mkfile calls
+// to build one.  Every directory in the tree, starting with its
+// root, holds `files` files named f0, f1, ..., and, unless it's at
+// the full depth, `fanout` subdirectories named d0, d1, ....  If
+// symlinks is set, each directory that has files also holds a
+// symlink l0 to f0.  The contents of each file are determined by
+// its path; see fixtureContents.
+type tree struct {
+	depth    int
+	fanout   int
+	files    int
+	fileSize int64
+	symlinks bool
+}
+
+// fixtureContents returns the contents of the fixture file at the
+// given path: the path, repeated up to the given size.
+func fixtureContents(p string, size int64) []byte {
+	pattern := []byte(p + "\n")
+	contents := bytes.Repeat(pattern, int(size)/len(pattern)+1)
+	return contents[:size]
+}
+
+// walk calls fn on every directory in the tree rooted at root,
+// parents before children.
+func (tr tree) walk(root string, fn func(dir string, depth int) error) error {
+	var walkDir func(dir string, depth int) error
+	walkDir = func(dir string, depth int) error {
+		if err := fn(dir, depth); err != nil {
+			return err
+		}
+		if depth == tr.depth {
+			return nil
+		}
+		for i := 0; i < tr.fanout; i++ {
+			err := walkDir(path.Join(dir, fmt.Sprintf("d%d", i)), depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walkDir(root, 0)
+}
+
+// filePaths returns the paths of all the files in the tree rooted at
+// root, not counting symlinks.
+func (tr tree) filePaths(root string) []string {
+	var paths []string
+	_ = tr.walk(root, func(dir string, depth int) error {
+		for i := 0; i < tr.files; i++ {
+			paths = append(paths, path.Join(dir, fmt.Sprintf("f%d", i)))
+		}
+		return nil
+	})
+	return paths
+}
+
+// populate builds the given tree at root, which may be "" for the
+// root of the TLF.
+func populate(root string, tr tree) fileOp {
+	return fileOp{func(c *ctx) error {
+		return tr.walk(root, func(dir string, depth int) error {
+			if dir != "" {
+				if err := mkdir(dir).operation(c); err != nil {
+					return err
+				}
+			}
+			for i := 0; i < tr.files; i++ {
+				p := path.Join(dir, fmt.Sprintf("f%d", i))
+				err := mkfile(
+					p, string(fixtureContents(p, tr.fileSize))).operation(c)
+				if err != nil {
+					return err
+				}
+			}
+			if tr.symlinks && tr.files > 0 {
+				return link(path.Join(dir, "l0"), "f0").operation(c)
+			}
+			return nil
+		})
+	}, Defaults}
+}
+
+// checkTree checks that the tree at root matches the given tree
+// exactly, including the contents of every file.
+func checkTree(root string, tr tree) fileOp {
+	return fileOp{func(c *ctx) error {
+		return tr.walk(root, func(dir string, depth int) error {
+			expected := m{}
+			for i := 0; i < tr.files; i++ {
+				expected[fmt.Sprintf("^f%d$", i)] = "FILE"
+			}
+			if depth < tr.depth {
+				for i := 0; i < tr.fanout; i++ {
+					expected[fmt.Sprintf("^d%d$", i)] = "DIR"
+				}
+			}
+			if tr.symlinks && tr.files > 0 {
+				expected["^l0$"] = "SYM"
+			}
+			if err := lsdir(dir, expected).operation(c); err != nil {
+				return err
+			}
+			for i := 0; i < tr.files; i++ {
+				p := path.Join(dir, fmt.Sprintf("f%d", i))
+				err := read(
+					p, string(fixtureContents(p, tr.fileSize))).operation(c)
+				if err != nil {
+					return err
+				}
+			}
+			if tr.symlinks && tr.files > 0 {
+				p := path.Join(dir, "f0")
+				return read(path.Join(dir, "l0"),
+					string(fixtureContents(p, tr.fileSize))).operation(c)
+			}
+			return nil
+		})
+	}, Defaults}
+}
+
+func TestFixtureTree(t *testing.T) {
+	tr := tree{depth: 2, fanout: 2, files: 2, fileSize: 100, symlinks: true}
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			populate("a", tr),
+		),
+		as(bob,
+			checkTree("a", tr),
+			write("a/d1/d0/f1", "changed"),
+		),
+		as(alice,
+			read("a/d1/d0/f1", "changed"),
+			rm("a/d1/d0/f1"),
+			expectError(checkTree("a", tr),
+				"^f1$ of type FILE not found"),
+		),
+	)
+}
+
+func TestFixtureTreeAtRoot(t *testing.T) {
+	tr := tree{files: 3, fileSize: 5000}
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			populate("", tr),
+		),
+		as(bob,
+			checkTree("", tr),
+		),
+	)
+}
+
+// BenchmarkReadTree reads every file in a pre-populated tree.
+func BenchmarkReadTree(b *testing.B) {
+	tr := tree{depth: 2, fanout: 3, files: 4, fileSize: 4 * 1024}
+	test(silentBenchmark{b},
+		users("alice", "bob"),
+		as(alice,
+			populate("bench", tr),
+		),
+		as(bob,
+			custom(func(cb func(fileOp) error) error {
+				paths := tr.filePaths("bench")
+				b.SetBytes(int64(len(paths)) * tr.fileSize)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for _, p := range paths {
+						err := cb(read(p, string(fixtureContents(
+							p, tr.fileSize))))
+						if err != nil {
+							return err
+						}
+					}
+				}
+				b.StopTimer()
+				return nil
+			}),
+		),
+	)
+}
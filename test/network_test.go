@@ -0,0 +1,40 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// alice and bob share a folder over a slow, lossy link.
+func TestNetworkLatencyAndLoss(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		network(libkbfs.NetworkConditions{
+			RTT:      2 * time.Millisecond,
+			Jitter:   time.Millisecond,
+			LossRate: 0.1,
+			Seed:     1,
+		}),
+		as(alice,
+			mkdir("a"),
+			mkfile("a/b", "hello"),
+		),
+		as(bob,
+			read("a/b", "hello"),
+			write("a/c", "world"),
+		),
+		as(alice,
+			read("a/c", "world"),
+			rm("a/b"),
+		),
+		as(bob,
+			lsdir("a", m{"c$": "FILE"}),
+		),
+	)
+}
@@ -33,7 +33,7 @@ func createUserDokan(t testing.TB, ith int, config *libkbfs.ConfigLocal,
 	opTimeout time.Duration) *fsUser {
 	driveLetter := 'T' + byte(ith)
 	if driveLetter > 'Z' {
-		t.Error("Too many users - out of drive letters")
+		t.Fatal("Too many users - out of drive letters")
 	}
 
 	createSuccess := false
@@ -53,9 +53,7 @@ func createUserDokan(t testing.TB, ith int, config *libkbfs.ConfigLocal,
 		t.Fatal(err)
 	}
 
-	if opTimeout > 0 {
-		t.Logf("Ignoring op timeout for Dokan test")
-	}
+	fs.SetOpTimeoutForTesting(opTimeout)
 
 	mnt, err := dokan.Mount(&dokan.Config{
 		FileSystem: fs,
@@ -78,7 +76,7 @@ func createUserDokan(t testing.TB, ith int, config *libkbfs.ConfigLocal,
 	}
 }
 
-var driveLetterLocks ['Z' - 'A']sync.Mutex
+var driveLetterLocks ['Z' - 'A' + 1]sync.Mutex
 
 func getDriveLetterLock(driveLetter byte) *sync.Mutex {
 	return &driveLetterLocks[driveLetter-'A']
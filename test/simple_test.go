@@ -59,6 +59,26 @@ func TestSetMtime(t *testing.T) {
 	)
 }
 
+// Check that writes get their mtimes from each writer's own clock.
+func TestWriteMtimeWithSkewedClock(t *testing.T) {
+	now := time.Unix(0, 0).Add(1 * time.Hour)
+	skew := 1 * time.Minute
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			setTime(now),
+			skewClock(skew),
+			mkfile("a/b", "hello"),
+			mtime("a/b", now.Add(skew)),
+		),
+		as(bob,
+			mtime("a/b", now.Add(skew)),
+			mkfile("a/c", "world"),
+			mtime("a/c", now),
+		),
+	)
+}
+
 func TestFavoritesBasic(t *testing.T) {
 	test(t,
 		users("alice", "bob"),